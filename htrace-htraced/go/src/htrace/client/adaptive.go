@@ -0,0 +1,414 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"strconv"
+	"time"
+)
+
+//
+// Adaptive writes.
+//
+// When client.adaptive.enabled is set, the client adapts its writes to how
+// each server is coping.  The spans of a write are sent one request at a time,
+// and the size of each request is chosen just before it is sent:
+//
+// * Each server starts with requests of client.adaptive.max.spans.  After a
+//   request which fails, or takes longer than client.adaptive.slow.ms, the
+//   size is halved, down to client.adaptive.min.spans, and the wait between
+//   requests is doubled, up to client.adaptive.max.delay.ms.  After any other
+//   request, client.adaptive.step.spans are added to the size, and the wait
+//   is halved.  This is additive increase, multiplicative decrease.
+//
+// * If client.circuit.failure.pct of the last client.circuit.window requests
+//   to a server failed, the circuit to it opens.  Writes to the server then
+//   fail straight away with ERR_CIRCUIT_OPEN, without being sent, and the
+//   spans they hold are reported as undelivered, so that the caller can keep
+//   them and write them again later.  After client.circuit.probe.ms, the
+//   circuit is half open, and the next request is a probe of
+//   client.adaptive.min.spans.  If the probe succeeds, the circuit closes,
+//   and writes grow back from there.  If it fails, the circuit opens again.
+//
+// Only failures which suggest that the server is struggling count: the
+// server being unreachable, or erroring out.  Requests which were too large,
+// malformed, or rejected because ingestion is paused don't.
+//
+// The state of each server is in the client metrics, and each change to it
+// can be reported to a callback.  All the timing goes through a Clock, which
+// tests can replace.
+//
+
+// The circuit states.
+const (
+	CIRCUIT_CLOSED    = "closed"
+	CIRCUIT_OPEN      = "open"
+	CIRCUIT_HALF_OPEN = "halfOpen"
+)
+
+// The shortest wait between adaptive requests.  Waits shorter than this are
+// dropped.
+const ADAPTIVE_MIN_DELAY = 10 * time.Millisecond
+
+// The source of time for adaptive writes.
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct {
+}
+
+func (rc realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (rc realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// A change to how the client writes to a server.
+type AdaptiveStateChange struct {
+	// The REST address of the server.
+	Server string
+
+	// The circuit state before and after the change.
+	OldCircuit string
+	Circuit    string
+
+	// The request size, in spans, before and after the change.
+	OldBatchSpans int
+	BatchSpans    int
+
+	// The wait between requests after the change.
+	Delay time.Duration
+}
+
+// A function which the client calls each time the adaptive state of a
+// server changes.  It may be called concurrently from several goroutines.
+type AdaptiveStateCallback func(change *AdaptiveStateChange)
+
+// The configuration of adaptive writes.
+type adaptiveConf struct {
+	enabled    bool
+	maxSpans   int
+	minSpans   int
+	stepSpans  int
+	slow       time.Duration
+	maxDelay   time.Duration
+	window     int
+	failurePct int
+	probe      time.Duration
+}
+
+func newAdaptiveConf(cnf *conf.Config) adaptiveConf {
+	acnf := adaptiveConf{
+		enabled:   cnf.GetBool(conf.HTRACE_CLIENT_ADAPTIVE_ENABLED),
+		maxSpans:  cnf.GetInt(conf.HTRACE_CLIENT_ADAPTIVE_MAX_SPANS),
+		minSpans:  cnf.GetInt(conf.HTRACE_CLIENT_ADAPTIVE_MIN_SPANS),
+		stepSpans: cnf.GetInt(conf.HTRACE_CLIENT_ADAPTIVE_STEP_SPANS),
+		slow: time.Millisecond *
+			time.Duration(cnf.GetInt64(conf.HTRACE_CLIENT_ADAPTIVE_SLOW_MS)),
+		maxDelay: time.Millisecond * time.Duration(
+			cnf.GetInt64(conf.HTRACE_CLIENT_ADAPTIVE_MAX_DELAY_MS)),
+		window:     cnf.GetInt(conf.HTRACE_CLIENT_CIRCUIT_WINDOW),
+		failurePct: cnf.GetInt(conf.HTRACE_CLIENT_CIRCUIT_FAILURE_PCT),
+		probe: time.Millisecond *
+			time.Duration(cnf.GetInt64(conf.HTRACE_CLIENT_CIRCUIT_PROBE_MS)),
+	}
+	if acnf.minSpans < 1 {
+		acnf.minSpans = 1
+	}
+	if acnf.maxSpans < acnf.minSpans {
+		acnf.maxSpans = acnf.minSpans
+	}
+	if acnf.window < 1 {
+		acnf.window = 1
+	}
+	return acnf
+}
+
+// The adaptive state of a server.  This is protected by the client lock.
+type adaptiveState struct {
+	// The number of spans to put in the next request, or 0 if we haven't
+	// written to the server yet.
+	batchSpans int
+
+	// How long to wait between requests.
+	delay time.Duration
+
+	// Whether the most recent requests failed, as a ring buffer, and the
+	// number of entries in it.
+	outcomes    []bool
+	numOutcomes int
+	nextOutcome int
+
+	circuit string
+
+	// When the circuit may be half opened, if it is open.
+	probeAt time.Time
+
+	// The number of times the circuit has opened, and the number of times
+	// the request size shrank and grew.
+	numOpened uint64
+	numShrunk uint64
+	numGrown  uint64
+}
+
+// What the next request of an adaptive write to a server should look like.
+type adaptivePlan struct {
+	// The number of spans to send.
+	batchSpans int
+
+	// How long to wait before sending.
+	delay time.Duration
+
+	// If the circuit is open, how long until it half opens.  0 if the
+	// request may be sent.
+	retryAfter time.Duration
+}
+
+// Get the adaptive state of a server, with the client lock held.
+func (hcl *Client) adaptiveStateLocked(tgt *serverTarget) *adaptiveState {
+	st := &tgt.adaptive
+	if st.batchSpans == 0 {
+		st.batchSpans = hcl.adaptiveConf.maxSpans
+		st.outcomes = make([]bool, hcl.adaptiveConf.window)
+		st.circuit = CIRCUIT_CLOSED
+	}
+	return st
+}
+
+// Plan the next request of an adaptive write to a server.
+func (hcl *Client) planAdaptive(tgt *serverTarget) *adaptivePlan {
+	now := hcl.clock.Now()
+	hcl.lock.Lock()
+	st := hcl.adaptiveStateLocked(tgt)
+	change := hcl.newStateChangeLocked(tgt, st)
+	if st.circuit == CIRCUIT_OPEN {
+		if now.Before(st.probeAt) {
+			hcl.lock.Unlock()
+			return &adaptivePlan{retryAfter: st.probeAt.Sub(now)}
+		}
+		st.circuit = CIRCUIT_HALF_OPEN
+		st.batchSpans = hcl.adaptiveConf.minSpans
+	}
+	plan := &adaptivePlan{batchSpans: st.batchSpans, delay: st.delay}
+	hcl.finishStateChangeLocked(change, st)
+	hcl.lock.Unlock()
+	hcl.mtr.reportStateChange(change)
+	return plan
+}
+
+// Record the outcome of a request which an adaptive write sent to a server.
+func (hcl *Client) recordAdaptive(tgt *serverTarget, latency time.Duration,
+	err error) {
+	acnf := &hcl.adaptiveConf
+	failed := countsAsFailure(err)
+	now := hcl.clock.Now()
+	hcl.lock.Lock()
+	st := hcl.adaptiveStateLocked(tgt)
+	change := hcl.newStateChangeLocked(tgt, st)
+	st.outcomes[st.nextOutcome] = failed
+	st.nextOutcome = (st.nextOutcome + 1) % len(st.outcomes)
+	if st.numOutcomes < len(st.outcomes) {
+		st.numOutcomes++
+	}
+	switch st.circuit {
+	case CIRCUIT_HALF_OPEN:
+		if failed {
+			hcl.openCircuitLocked(st, now)
+		} else {
+			st.circuit = CIRCUIT_CLOSED
+			st.numOutcomes = 0
+		}
+	case CIRCUIT_CLOSED:
+		if st.numOutcomes == len(st.outcomes) {
+			numFailed := 0
+			for i := range st.outcomes {
+				if st.outcomes[i] {
+					numFailed++
+				}
+			}
+			if numFailed*100 >= acnf.failurePct*st.numOutcomes {
+				hcl.openCircuitLocked(st, now)
+			}
+		}
+	}
+	if failed || latency > acnf.slow {
+		if st.batchSpans > acnf.minSpans {
+			st.batchSpans = st.batchSpans / 2
+			if st.batchSpans < acnf.minSpans {
+				st.batchSpans = acnf.minSpans
+			}
+			st.numShrunk++
+		}
+		st.delay = st.delay * 2
+		if st.delay < ADAPTIVE_MIN_DELAY {
+			st.delay = ADAPTIVE_MIN_DELAY
+		}
+		if st.delay > acnf.maxDelay {
+			st.delay = acnf.maxDelay
+		}
+	} else if err == nil {
+		if st.batchSpans < acnf.maxSpans {
+			st.batchSpans += acnf.stepSpans
+			if st.batchSpans > acnf.maxSpans {
+				st.batchSpans = acnf.maxSpans
+			}
+			st.numGrown++
+		}
+		st.delay = st.delay / 2
+		if st.delay < ADAPTIVE_MIN_DELAY {
+			st.delay = 0
+		}
+	}
+	hcl.finishStateChangeLocked(change, st)
+	hcl.lock.Unlock()
+	hcl.mtr.reportStateChange(change)
+}
+
+func (hcl *Client) openCircuitLocked(st *adaptiveState, now time.Time) {
+	st.circuit = CIRCUIT_OPEN
+	st.probeAt = now.Add(hcl.adaptiveConf.probe)
+	st.numOpened++
+}
+
+// Returns true if a failed request suggests that the server is struggling.
+func countsAsFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch common.ErrorCodeOf(err) {
+	case common.ERR_TOO_LARGE, common.ERR_MESSAGE_TOO_LARGE,
+		common.ERR_BAD_REQUEST, common.ERR_BAD_PARAMETER,
+		common.ERR_READ_ONLY, common.ERR_INGEST_PAUSED,
+		common.ERR_PERMISSION_DENIED:
+		return false
+	}
+	return true
+}
+
+// Start describing a change to the adaptive state of a server.
+func (hcl *Client) newStateChangeLocked(tgt *serverTarget,
+	st *adaptiveState) *AdaptiveStateChange {
+	return &AdaptiveStateChange{
+		Server:        tgt.restAddr,
+		OldCircuit:    st.circuit,
+		OldBatchSpans: st.batchSpans,
+	}
+}
+
+// Finish describing a change to the adaptive state of a server.  If nothing
+// changed but the delay, the change is cleared, so that it isn't reported.
+func (hcl *Client) finishStateChangeLocked(change *AdaptiveStateChange,
+	st *adaptiveState) {
+	change.Circuit = st.circuit
+	change.BatchSpans = st.batchSpans
+	change.Delay = st.delay
+	if change.Circuit == change.OldCircuit &&
+		change.BatchSpans == change.OldBatchSpans {
+		change.Server = ""
+	}
+}
+
+// Make the error for a write to a server whose circuit is open.
+func circuitOpenError(tgt *serverTarget, retryAfter time.Duration) error {
+	return common.NewHtraceError(common.ERR_CIRCUIT_OPEN,
+		map[string]string{
+			common.ERR_DETAIL_RETRY_AFTER_MS: strconv.FormatInt(
+				int64(retryAfter/time.Millisecond), 10),
+		}, "Not writing to %s, because too many recent writes to it "+
+			"failed.  The client will try it again in %s.", tgt.restAddr,
+		retryAfter.String())
+}
+
+// Write the spans of a write one request at a time, choosing the size of each
+// request from the adaptive state of the server it goes to.
+func (cw *chunkWriter) writeAdaptive(numSpans int) {
+	hcl := cw.hcl
+	attempts := 0
+	for begin := 0; begin < numSpans; {
+		rest := SpanRange{Begin: begin, End: numSpans}
+		tgts, _ := hcl.writeTargets()
+		if len(tgts) == 0 {
+			// writeChunk says why there is nowhere to write to.
+			_, _, err := hcl.writeChunk(cw.enc, rest, cw.metadata)
+			cw.fail(rest, err)
+			return
+		}
+		plan := hcl.planAdaptive(tgts[0])
+		if plan.retryAfter > 0 {
+			cw.fail(rest, circuitOpenError(tgts[0], plan.retryAfter))
+			return
+		}
+		if begin > 0 && plan.delay > 0 {
+			hcl.clock.Sleep(plan.delay)
+		}
+		cw.lock.Lock()
+		lim := cw.lim
+		cw.lock.Unlock()
+		if lim.maxSpans <= 0 || lim.maxSpans > plan.batchSpans {
+			lim.maxSpans = plan.batchSpans
+		}
+		r := cw.enc.split(rest, lim)[0]
+		if !cw.checkSize(r) {
+			begin = r.End
+			continue
+		}
+		start := hcl.clock.Now()
+		resp, tgt, err := hcl.writeChunk(cw.enc, r, cw.metadata)
+		if tgt == nil {
+			tgt = tgts[0]
+		}
+		hcl.recordAdaptive(tgt, hcl.clock.Now().Sub(start), err)
+		if err == nil {
+			cw.deliver(resp)
+			begin = r.End
+			attempts = 0
+			continue
+		}
+		switch common.ErrorCodeOf(err) {
+		case common.ERR_INGEST_PAUSED:
+			if cw.waitForResume(err) {
+				continue
+			}
+		case common.ERR_TOO_LARGE, common.ERR_MESSAGE_TOO_LARGE:
+			// Learn the server's limits, and split the rest again.
+			if cw.resplit(r, tgt) != nil {
+				continue
+			}
+		case common.ERR_BAD_REQUEST, common.ERR_BAD_PARAMETER,
+			common.ERR_READ_ONLY:
+		default:
+			// The next attempt is smaller, since the failure shrank the
+			// request size.
+			attempts++
+			if attempts <= hcl.writeRetries {
+				continue
+			}
+		}
+		cw.fail(r, err)
+		begin = r.End
+		attempts = 0
+	}
+}
@@ -0,0 +1,752 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"htrace/common"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Splitting big writes.
+//
+// Servers may limit the number of spans, and the number of bytes, in a single
+// WriteSpans request.  HRPC requests are also limited to MAX_HRPC_BODY_LENGTH
+// bytes.  Rather than making callers deal with this, the client splits big
+// writes into chunks which fit.
+//
+// The spans are encoded once, up front, so that the size of each chunk is
+// known exactly.  The limits come from the server's GetServerVersion
+// response, which the client remembers for each server, or else from
+// client.write.max.spans and client.write.max.bytes.  We don't ask the server
+// for its limits before every write.  Instead, when a server rejects a request
+// as TOO_LARGE, we fetch its limits and split the request again.  If the
+// server doesn't advertise any limits, the request is split in half.
+//
+// The chunks of a split write are sent client.write.parallelism at a time, and
+// each is retried up to client.write.retries times.  A write which fits in
+// one request is never retried, just as before writes were split.  Chunks
+// which can't be delivered are reported as ranges of span indexes, so that
+// the caller can send just those spans again.
+//
+// If the first writable server allows it, the chunks are instead pipelined
+// over a single HRPC connection, up to client.hrpc.max.in.flight at a time;
+// see negotiate.go.  Chunks which fail there are retried the usual way.  If
+// the connection breaks, every chunk in flight on it fails with
+// ERR_CONNECTION_LOST, and the chunks which were not sent yet are sent the
+// usual way.
+//
+// A server whose ingestion is paused rejects writes with ERR_INGEST_PAUSED,
+// and says how long to wait before trying again.  The client waits, and sends
+// the chunk again, for up to client.pause.max.wait.ms in all.  This
+// doesn't use up any retries, and applies even to writes which fit in one
+// request.
+//
+// If client.adaptive.enabled is set, none of this parallelism applies.  The
+// chunks are sent one at a time, and each is sized just before it is sent;
+// see adaptive.go.
+//
+
+// How long to wait before writing to a paused server again, if it doesn't
+// say.  HRPC errors don't.
+const DEFAULT_PAUSE_RETRY_DELAY = time.Second
+
+// A range of indexes into the spans passed to a write.  Begin is inclusive,
+// and End is exclusive.
+type SpanRange struct {
+	Begin int
+	End   int
+}
+
+func (r SpanRange) String() string {
+	return fmt.Sprintf("[%d, %d)", r.Begin, r.End)
+}
+
+// The outcome of a write, added up over all the requests it was split into.
+type WriteResult struct {
+	// The number of requests which delivered spans.
+	NumChunks int
+
+	// The sum of the servers' responses to those requests.  As with a single
+	// request, Accepted and Rejected are only filled in by servers which are
+	// reached over REST.
+	Resp common.WriteSpansResp
+
+	// The spans which were not delivered, in order.  Adjacent ranges are
+	// merged.
+	Undelivered []SpanRange
+}
+
+// The error returned when only some chunks of a split write were delivered.
+type WriteSpansError struct {
+	// The spans which were not delivered, in order.
+	Undelivered []SpanRange
+
+	// The total number of spans in the write.
+	NumSpans int
+
+	// The error which the first undelivered chunk failed with.
+	Err error
+}
+
+// Get the number of spans which were not delivered.
+func (werr *WriteSpansError) NumUndelivered() int {
+	num := 0
+	for _, r := range werr.Undelivered {
+		num += r.End - r.Begin
+	}
+	return num
+}
+
+func (werr *WriteSpansError) Error() string {
+	ranges := make([]string, len(werr.Undelivered))
+	for i := range werr.Undelivered {
+		ranges[i] = werr.Undelivered[i].String()
+	}
+	return fmt.Sprintf("Failed to deliver %d out of %d spans, at indexes %s: "+
+		"%s", werr.NumUndelivered(), werr.NumSpans,
+		strings.Join(ranges, ", "), werr.Err.Error())
+}
+
+// Limits on the size of a WriteSpans request.  0 means there is no limit.
+type writeLimits struct {
+	maxSpans int
+	maxBytes int
+}
+
+// Get the limits to use for writes to a server.
+func (hcl *Client) writeLimitsFor(tgt *serverTarget) writeLimits {
+	hcl.lock.Lock()
+	lim := writeLimits{maxSpans: tgt.maxWriteSpans, maxBytes: tgt.maxWriteBytes}
+	hcl.lock.Unlock()
+	if lim.maxSpans <= 0 {
+		lim.maxSpans = hcl.writeLimits.maxSpans
+	}
+	if lim.maxBytes <= 0 {
+		lim.maxBytes = hcl.writeLimits.maxBytes
+	}
+	if hcl.hrpcWrites(tgt) && (lim.maxBytes <= 0 ||
+		lim.maxBytes > common.MAX_HRPC_BODY_LENGTH) {
+		lim.maxBytes = common.MAX_HRPC_BODY_LENGTH
+	}
+	return lim
+}
+
+// Spans encoded for a particular transport.  The encoding of span i is
+// buf[offs[i]:offs[i+1]].
+type encodedSpans struct {
+	buf  []byte
+	offs []int
+
+	// An upper bound on the size of the WriteSpansReq which goes in front of
+	// the spans in each request.
+	hdrSize int
+
+	// True if the spans are encoded as msgpack, for HRPC.
+	hrpc bool
+
+	// The spans, metadata, write groups, and token, in case they have to be
+	// encoded for the other transport.
+	spans     []*common.Span
+	metadata  map[string]string
+	groups    []common.WriteGroup
+	authToken string
+
+	// Protects other.
+	lock sync.Mutex
+
+	// The spans encoded for the other transport, or nil if we haven't needed
+	// them.
+	other *encodedSpans
+}
+
+// Encode spans as JSON, for REST, or as msgpack, for HRPC.  HRPC requests
+// carry the token in the WriteSpansReq, so it counts towards their size.
+func encodeSpans(spans []*common.Span, metadata map[string]string,
+	groups []common.WriteGroup, authToken string,
+	hrpc bool) (*encodedSpans, error) {
+	var w bytes.Buffer
+	var encode func(v interface{}) error
+	if hrpc {
+		mh := new(codec.MsgpackHandle)
+		mh.WriteExt = true
+		encode = codec.NewEncoder(&w, mh).Encode
+	} else {
+		encode = json.NewEncoder(&w).Encode
+	}
+	req := &common.WriteSpansReq{
+		NumSpans: len(spans),
+		Metadata: metadata,
+		Groups:   groups,
+	}
+	if hrpc {
+		req.AuthToken = authToken
+	}
+	err := encode(req)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error serializing "+
+			"WriteSpansReq: %s", err.Error()))
+	}
+	enc := &encodedSpans{
+		offs:      make([]int, 0, len(spans)+1),
+		hdrSize:   w.Len(),
+		hrpc:      hrpc,
+		spans:     spans,
+		metadata:  metadata,
+		groups:    groups,
+		authToken: authToken,
+	}
+	w.Reset()
+	enc.offs = append(enc.offs, 0)
+	for spanIdx := range spans {
+		err = encode(spans[spanIdx])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error serializing "+
+				"span %d out of %d: %s", spanIdx, len(spans), err.Error()))
+		}
+		enc.offs = append(enc.offs, w.Len())
+	}
+	enc.buf = w.Bytes()
+	return enc, nil
+}
+
+// Get the spans encoded for HRPC, or for REST.  Writes are encoded for the
+// transport of the first server, but a chunk may end up going to a server
+// which doesn't support HRPC writes.  The spans are encoded again, once.
+func (enc *encodedSpans) forTransport(hrpc bool) (*encodedSpans, error) {
+	if enc.hrpc == hrpc {
+		return enc, nil
+	}
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+	if enc.other == nil {
+		other, err := encodeSpans(enc.spans, enc.metadata, enc.groups,
+			enc.authToken, hrpc)
+		if err != nil {
+			return nil, err
+		}
+		enc.other = other
+	}
+	return enc.other, nil
+}
+
+// Get the write groups to send with a range of spans.  Groups which list
+// their members only list the ones in the range, and are left out if there
+// are none.  Groups which don't list their members apply to every chunk.
+func (enc *encodedSpans) groupsFor(r SpanRange) []common.WriteGroup {
+	if len(enc.groups) == 0 {
+		return nil
+	}
+	var inRange map[string]bool
+	groups := make([]common.WriteGroup, 0, len(enc.groups))
+	for _, grp := range enc.groups {
+		if len(grp.SpanIds) == 0 {
+			groups = append(groups, grp)
+			continue
+		}
+		if inRange == nil {
+			inRange = make(map[string]bool, r.End-r.Begin)
+			for _, span := range enc.spans[r.Begin:r.End] {
+				if span != nil {
+					inRange[string(span.Id)] = true
+				}
+			}
+		}
+		ids := make([]common.SpanId, 0, len(grp.SpanIds))
+		for _, id := range grp.SpanIds {
+			if inRange[string(id)] {
+				ids = append(ids, id)
+			}
+		}
+		if len(ids) > 0 {
+			grp.SpanIds = ids
+			groups = append(groups, grp)
+		}
+	}
+	return groups
+}
+
+// Get the encoding of a range of spans.
+func (enc *encodedSpans) bytes(r SpanRange) []byte {
+	return enc.buf[enc.offs[r.Begin]:enc.offs[r.End]]
+}
+
+// Get the size of a request holding a range of spans, or an upper bound on
+// it.
+func (enc *encodedSpans) requestSize(r SpanRange) int {
+	return enc.hdrSize + enc.offs[r.End] - enc.offs[r.Begin]
+}
+
+// Split a range of spans into chunks which fit within the limits.  A span
+// which doesn't fit in a request on its own gets a chunk of its own.
+func (enc *encodedSpans) split(r SpanRange, lim writeLimits) []SpanRange {
+	chunks := make([]SpanRange, 0, 1)
+	begin := r.Begin
+	for i := r.Begin; i < r.End; i++ {
+		if i == begin {
+			continue
+		}
+		next := SpanRange{Begin: begin, End: i + 1}
+		if (lim.maxSpans > 0 && next.End-next.Begin > lim.maxSpans) ||
+			(lim.maxBytes > 0 && enc.requestSize(next) > lim.maxBytes) {
+			chunks = append(chunks, SpanRange{Begin: begin, End: i})
+			begin = i
+		}
+	}
+	return append(chunks, SpanRange{Begin: begin, End: r.End})
+}
+
+// Write spans, and return the outcome.  The spans are split into several
+// requests if they don't fit in one; see batch.go.  If some of the requests
+// fail, the error is a WriteSpansError which says which spans were not
+// delivered, and the result has the responses to the requests which
+// succeeded.  If the spans fit in one request, the error is the error that
+// request failed with.
+func (hcl *Client) WriteSpansDetailed(spans []*common.Span,
+	metadata map[string]string) (*WriteResult, error) {
+	return hcl.writeSpansDetailed(spans, nil, metadata)
+}
+
+// Write spans which belong to write groups, and return the outcome.  The
+// server counts the members of each group which it accepts, across writes, so
+// that GetWriteGroup can tell whether some of them never arrived.  Otherwise
+// this is the same as WriteSpansDetailed.
+func (hcl *Client) WriteSpanGroups(spans []*common.Span,
+	groups []common.WriteGroup, metadata map[string]string) (*WriteResult,
+	error) {
+	return hcl.writeSpansDetailed(spans, groups, metadata)
+}
+
+func (hcl *Client) writeSpansDetailed(spans []*common.Span,
+	groups []common.WriteGroup, metadata map[string]string) (_ *WriteResult,
+	err error) {
+	tgts, all := hcl.writeTargets()
+	if len(tgts) == 0 {
+		if len(all) == 0 {
+			return nil, errors.New("Error: the client has no servers to " +
+				"write to.")
+		}
+		return nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't write spans: the server at %s is read-only.",
+			all[0].restAddr)
+	}
+	hrpc := hcl.hrpcWrites(tgts[0])
+	transport := TRANSPORT_REST
+	if hrpc {
+		transport = TRANSPORT_HRPC
+	}
+	prep := hcl.getWritePrep()
+	ps := prep.prepare(spans)
+	hcl.mtr.recordPrepared(ps.numDuplicate, ps.numInvalid)
+	if len(ps.spans) == 0 && len(spans) > 0 {
+		// Every span was dropped, so there is nothing to send.
+		return &WriteResult{Undelivered: make([]SpanRange, 0)}, nil
+	}
+	defer hcl.mtr.recordWriteSpans(transport, len(ps.spans), time.Now(), &err)
+	if groups == nil && prep.groupByTrace {
+		groups = groupsByTrace(ps.spans)
+	}
+	enc, err := encodeSpans(ps.spans, metadata, groups, hcl.authToken, hrpc)
+	if err != nil {
+		return nil, err
+	}
+	cw := &chunkWriter{
+		hcl:      hcl,
+		enc:      enc,
+		metadata: metadata,
+		lim:      hcl.writeLimitsFor(tgts[0]),
+	}
+	single := true
+	if hcl.adaptiveConf.enabled {
+		cw.writeAdaptive(len(ps.spans))
+	} else {
+		chunks := enc.split(SpanRange{Begin: 0, End: len(ps.spans)}, cw.lim)
+		single = len(chunks) == 1
+		if single {
+			cw.write(chunks[0], 0)
+		} else if !cw.writePipelined(chunks) {
+			cw.writeAll(chunks, hcl.writeRetries)
+		}
+	}
+	hcl.mtr.recordQuotaDropped(&cw.result.Resp)
+	result, err := cw.finish(len(ps.spans), single)
+	result.Undelivered = ps.origRanges(result.Undelivered)
+	if werr, ok := err.(*WriteSpansError); ok {
+		werr.Undelivered = result.Undelivered
+		werr.NumSpans = len(spans)
+	}
+	return result, err
+}
+
+// Writes the chunks of a write, and adds up the outcome.
+type chunkWriter struct {
+	hcl      *Client
+	enc      *encodedSpans
+	metadata map[string]string
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The limits which the chunks were split to fit.
+	lim writeLimits
+
+	// The outcome so far.
+	result WriteResult
+
+	// The chunks which could not be delivered, and the errors they failed
+	// with.
+	failed []failedChunk
+
+	// When the write stops waiting for a paused server, or the zero time if
+	// no server has said it was paused yet.
+	pauseDeadline time.Time
+}
+
+type failedChunk struct {
+	r   SpanRange
+	err error
+}
+
+// Write the chunks, client.write.parallelism at a time, retrying each up to
+// retries times.
+func (cw *chunkWriter) writeAll(chunks []SpanRange, retries int) {
+	if len(chunks) == 0 {
+		return
+	}
+	numWorkers := cw.hcl.writeParallelism
+	if numWorkers > len(chunks) {
+		numWorkers = len(chunks)
+	}
+	todo := make(chan SpanRange, len(chunks))
+	for i := range chunks {
+		todo <- chunks[i]
+	}
+	close(todo)
+	var wg sync.WaitGroup
+	wg.Add(numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for r := range todo {
+				cw.write(r, retries)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Check that a chunk can be sent.  A single span which is bigger than the
+// limit can't be, and is recorded as undelivered.
+func (cw *chunkWriter) checkSize(r SpanRange) bool {
+	cw.lock.Lock()
+	lim := cw.lim
+	cw.lock.Unlock()
+	if r.End-r.Begin == 1 && lim.maxBytes > 0 &&
+		cw.enc.requestSize(r) > lim.maxBytes {
+		cw.fail(r, errors.New(fmt.Sprintf("Span %d is too big to send: a "+
+			"request containing it would be %d bytes long, but the limit "+
+			"is %d.", r.Begin, cw.enc.requestSize(r), lim.maxBytes)))
+		return false
+	}
+	return true
+}
+
+// Write a chunk, retrying failed requests up to retries times.  If the server
+// says the chunk is too large, it is split again, and the pieces are written
+// with the full number of retries.
+func (cw *chunkWriter) write(r SpanRange, retries int) {
+	if !cw.checkSize(r) {
+		return
+	}
+	for attempt := 0; ; attempt++ {
+		resp, tgt, err := cw.hcl.writeChunk(cw.enc, r, cw.metadata)
+		if err == nil {
+			cw.deliver(resp)
+			return
+		}
+		if common.ErrorCodeOf(err) == common.ERR_INGEST_PAUSED {
+			if !cw.waitForResume(err) {
+				cw.fail(r, err)
+				return
+			}
+			// Waiting for the server doesn't use up an attempt.
+			attempt--
+			continue
+		}
+		if !cw.handleFailure(r, tgt, err, attempt >= retries) {
+			return
+		}
+	}
+}
+
+// Wait before writing to a server which said its ingestion was paused.
+// Returns false if the write has already waited as long as it may.
+func (cw *chunkWriter) waitForResume(err error) bool {
+	delay := err.(*common.HtraceError).RetryAfter()
+	if delay <= 0 {
+		delay = DEFAULT_PAUSE_RETRY_DELAY
+	}
+	now := time.Now()
+	cw.lock.Lock()
+	if cw.pauseDeadline.IsZero() {
+		cw.pauseDeadline = now.Add(cw.hcl.pauseMaxWait)
+	}
+	deadline := cw.pauseDeadline
+	cw.lock.Unlock()
+	if !now.Before(deadline) {
+		return false
+	}
+	if now.Add(delay).After(deadline) {
+		delay = deadline.Sub(now)
+	}
+	time.Sleep(delay)
+	return true
+}
+
+// Handle a request for a chunk which failed.  Returns true if the request
+// should be sent again.  Otherwise, the chunk has either been split and
+// written again, or recorded as undelivered.
+func (cw *chunkWriter) handleFailure(r SpanRange, tgt *serverTarget,
+	err error, lastAttempt bool) bool {
+	switch common.ErrorCodeOf(err) {
+	case common.ERR_TOO_LARGE, common.ERR_MESSAGE_TOO_LARGE:
+		pieces := cw.resplit(r, tgt)
+		if pieces == nil {
+			cw.fail(r, err)
+			return false
+		}
+		for _, piece := range pieces {
+			cw.write(piece, cw.hcl.writeRetries)
+		}
+		return false
+	case common.ERR_BAD_REQUEST, common.ERR_BAD_PARAMETER,
+		common.ERR_READ_ONLY:
+		// Trying again won't help.
+		cw.fail(r, err)
+		return false
+	}
+	if lastAttempt {
+		cw.fail(r, err)
+		return false
+	}
+	return true
+}
+
+// Write the chunks over one HRPC connection to the first writable server,
+// without waiting for each request to be answered before sending the next.
+// Returns false, having sent nothing, if the server doesn't allow pipelining,
+// or can't be reached.  The chunks should then be written the usual way.
+func (cw *chunkWriter) writePipelined(chunks []SpanRange) bool {
+	hcl := cw.hcl
+	if hcl.hrpcMaxInFlight <= 1 {
+		return false
+	}
+	tgts, _ := hcl.writeTargets()
+	if len(tgts) == 0 || !hcl.hrpcWrites(tgts[0]) {
+		return false
+	}
+	tgt := tgts[0]
+	enc, err := cw.enc.forTransport(true)
+	if err != nil {
+		return false
+	}
+	hcr, err := hcl.dialHrpc(tgt)
+	if err != nil {
+		// Let the usual path record the failure, and fail over.
+		return false
+	}
+	// We only know whether the server allows pipelining once we have
+	// negotiated with it.
+	depth := hcl.hrpcPipelineDepth(tgt)
+	if depth <= 1 || !hcl.hrpcWrites(tgt) {
+		hcr.Close()
+		return false
+	}
+	done := make(chan *rpc.Call, depth)
+	inFlight := make(map[*rpc.Call]SpanRange, depth)
+	// Chunks which failed, and chunks which were never sent, or were sent to
+	// a server which can't take them.  Only the first kind used up an
+	// attempt.
+	failed := make([]failedChunk, 0)
+	unsent := make([]SpanRange, 0)
+	lost := false
+	finish := func(call *rpc.Call) {
+		r := inFlight[call]
+		delete(inFlight, call)
+		resp, err := hcr.writeSpansResult(call)
+		if err == nil {
+			cw.deliver(resp)
+			return
+		}
+		if herr, ok := err.(*common.HtraceError); ok {
+			herr.Addr = tgt.hrpcAddr
+		}
+		switch common.ErrorCodeOf(err) {
+		case common.ERR_CONNECTION_LOST:
+			lost = true
+		case common.ERR_READ_ONLY:
+			hcl.setReadOnly(tgt, true)
+			unsent = append(unsent, r)
+			return
+		case common.ERR_INGEST_PAUSED:
+			// The usual path waits for the server to resume.
+			unsent = append(unsent, r)
+			return
+		case common.ERR_UNSUPPORTED_METHOD:
+			hcl.removeHrpcMethod(tgt, common.METHOD_ID_WRITE_SPANS)
+			unsent = append(unsent, r)
+			return
+		}
+		failed = append(failed, failedChunk{r: r, err: err})
+	}
+	for _, r := range chunks {
+		if lost {
+			unsent = append(unsent, r)
+			continue
+		}
+		if !cw.checkSize(r) {
+			continue
+		}
+		if len(inFlight) == depth {
+			finish(<-done)
+		}
+		call := hcr.startWriteSpans(r.End-r.Begin, enc.bytes(r),
+			cw.metadata, enc.groupsFor(r), done)
+		inFlight[call] = r
+	}
+	for len(inFlight) > 0 {
+		finish(<-done)
+	}
+	hcr.Close()
+	hcl.recordAttempt(tgt, lost)
+
+	// Each failed chunk has used up one attempt.
+	retry := make([]SpanRange, 0, len(failed))
+	for _, fc := range failed {
+		if cw.handleFailure(fc.r, tgt, fc.err, hcl.writeRetries == 0) {
+			retry = append(retry, fc.r)
+		}
+	}
+	cw.writeAll(unsent, hcl.writeRetries)
+	cw.writeAll(retry, hcl.writeRetries-1)
+	return true
+}
+
+// Split a chunk which a server rejected as too large.  We fetch the server's
+// limits first, in case they have changed, or we didn't know them.  If that
+// doesn't make the chunk smaller, we split it in half.  Returns nil if the
+// chunk is a single span, which can't be split.
+func (cw *chunkWriter) resplit(r SpanRange, tgt *serverTarget) []SpanRange {
+	if tgt != nil {
+		_, err := cw.hcl.getServerVersion([]*serverTarget{tgt})
+		if err == nil {
+			cw.lock.Lock()
+			cw.lim = cw.hcl.writeLimitsFor(tgt)
+			cw.lock.Unlock()
+		}
+	}
+	cw.lock.Lock()
+	lim := cw.lim
+	cw.lock.Unlock()
+	pieces := cw.enc.split(r, lim)
+	if len(pieces) > 1 {
+		return pieces
+	}
+	if r.End-r.Begin == 1 {
+		// The server won't take a single span, even though it fits
+		// within the limits we know about.  Give up on it.
+		return nil
+	}
+	mid := r.Begin + (r.End-r.Begin)/2
+	return []SpanRange{SpanRange{Begin: r.Begin, End: mid},
+		SpanRange{Begin: mid, End: r.End}}
+}
+
+// Record the response to a chunk which was delivered.
+func (cw *chunkWriter) deliver(resp *common.WriteSpansResp) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.result.NumChunks++
+	if resp != nil {
+		cw.result.Resp.QuotaRejected += resp.QuotaRejected
+		cw.result.Resp.QuotaSampledOut += resp.QuotaSampledOut
+		cw.result.Resp.Accepted += resp.Accepted
+		cw.result.Resp.Rejected += resp.Rejected
+	}
+}
+
+// Record a chunk which could not be delivered.
+func (cw *chunkWriter) fail(r SpanRange, err error) {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	cw.failed = append(cw.failed, failedChunk{r: r, err: err})
+}
+
+type failedChunksByBegin []failedChunk
+
+func (fcs failedChunksByBegin) Len() int {
+	return len(fcs)
+}
+
+func (fcs failedChunksByBegin) Less(i, j int) bool {
+	return fcs[i].r.Begin < fcs[j].r.Begin
+}
+
+func (fcs failedChunksByBegin) Swap(i, j int) {
+	fcs[i], fcs[j] = fcs[j], fcs[i]
+}
+
+// Get the outcome of the write, once all the chunks have been written.
+func (cw *chunkWriter) finish(numSpans int, single bool) (*WriteResult, error) {
+	result := &cw.result
+	result.Undelivered = make([]SpanRange, 0)
+	if len(cw.failed) == 0 {
+		return result, nil
+	}
+	sort.Sort(failedChunksByBegin(cw.failed))
+	for _, fc := range cw.failed {
+		last := len(result.Undelivered) - 1
+		if last >= 0 && result.Undelivered[last].End == fc.r.Begin {
+			result.Undelivered[last].End = fc.r.End
+		} else {
+			result.Undelivered = append(result.Undelivered, fc.r)
+		}
+	}
+	err := cw.failed[0].err
+	if single && len(cw.failed) == 1 && cw.failed[0].r.Begin == 0 &&
+		cw.failed[0].r.End == numSpans {
+		// The write was never split, so return the error as it is.
+		return result, err
+	}
+	return result, &WriteSpansError{
+		Undelivered: result.Undelivered,
+		NumSpans:    numSpans,
+		Err:         err,
+	}
+}
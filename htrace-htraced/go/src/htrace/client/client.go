@@ -29,17 +29,70 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 )
 
 // A golang client for htraced.
 // TODO: fancier APIs for streaming spans in the background, optimize TCP stuff
+// The addresses are checked here, so that a bad address is reported when the
+// client is created rather than on its first request.  web.address and
+// hrpc.address may list several servers; see failover.go.
 func NewClient(cnf *conf.Config, testHooks *TestHooks) (*Client, error) {
-	hcl := Client{testHooks: testHooks}
-	hcl.restAddr = cnf.Get(conf.HTRACE_WEB_ADDRESS)
-	if testHooks != nil && testHooks.HrpcDisabled {
-		hcl.hrpcAddr = ""
-	} else {
-		hcl.hrpcAddr = cnf.Get(conf.HTRACE_HRPC_ADDRESS)
+	hrpcDisabled := testHooks != nil && testHooks.HrpcDisabled
+	servers, err := newServerTargets(cnf, hrpcDisabled)
+	if err != nil {
+		return nil, err
+	}
+	maxFailures := cnf.GetInt(conf.HTRACE_CLIENT_FAILOVER_MAX_FAILURES)
+	if maxFailures < 1 {
+		maxFailures = 1
+	}
+	writeParallelism := cnf.GetInt(conf.HTRACE_CLIENT_WRITE_PARALLELISM)
+	if writeParallelism < 1 {
+		writeParallelism = 1
+	}
+	hrpcIoTimeo := time.Millisecond *
+		time.Duration(cnf.GetInt64(conf.HTRACE_CLIENT_HRPC_IO_TIMEOUT_MS))
+	pauseMaxWait := time.Millisecond *
+		time.Duration(cnf.GetInt64(conf.HTRACE_CLIENT_PAUSE_MAX_WAIT_MS))
+	hrpcMaxInFlight := cnf.GetInt(conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT)
+	if hrpcMaxInFlight < 1 {
+		hrpcMaxInFlight = 1
+	}
+	clock := Clock(realClock{})
+	if testHooks != nil && testHooks.Clock != nil {
+		clock = testHooks.Clock
+	}
+	prep := writePrep{
+		dedupe:   cnf.GetBool(conf.HTRACE_CLIENT_WRITE_DEDUPE),
+		sort:     cnf.GetBool(conf.HTRACE_CLIENT_WRITE_SORT),
+		validate: cnf.GetBool(conf.HTRACE_CLIENT_WRITE_VALIDATE),
+		groupByTrace: cnf.GetBool(
+			conf.HTRACE_CLIENT_WRITE_GROUP_BY_TRACE),
+	}
+	hcl := Client{
+		servers:     servers,
+		maxFailures: maxFailures,
+		cooldown: time.Millisecond * time.Duration(
+			cnf.GetInt64(conf.HTRACE_CLIENT_FAILOVER_COOLDOWN_MS)),
+		writeLimits: writeLimits{
+			maxSpans: cnf.GetInt(conf.HTRACE_CLIENT_WRITE_MAX_SPANS),
+			maxBytes: cnf.GetInt(conf.HTRACE_CLIENT_WRITE_MAX_BYTES),
+		},
+		writeParallelism: writeParallelism,
+		writeRetries:     cnf.GetInt(conf.HTRACE_CLIENT_WRITE_RETRIES),
+		pauseMaxWait:     pauseMaxWait,
+		writePrep:        prep,
+		adaptiveConf:     newAdaptiveConf(cnf),
+		clock:            clock,
+		authToken:        cnf.Get(conf.HTRACE_CLIENT_AUTH_TOKEN),
+		hrpcIoTimeo:      hrpcIoTimeo,
+		hrpcMaxInFlight:  hrpcMaxInFlight,
+		testHooks:        testHooks,
+		mtr:              newMetricsTracker(),
 	}
 	return &hcl, nil
 }
@@ -51,22 +104,146 @@ type TestHooks struct {
 	// A function which gets called after we connect to the server and send the
 	// message frame, but before we write the message body.
 	HandleWriteRequestBody func()
+
+	// The clock which adaptive writes use to time requests, to wait between
+	// them, and to decide when to probe a server.  If nil, the real clock is
+	// used.
+	Clock Clock
 }
 
 type Client struct {
-	// REST address of the htraced server.
-	restAddr string
+	// The htraced servers, in the order they were configured.
+	servers []*serverTarget
+
+	// Protects the health of the servers, nextRead, and writePrep.
+	lock sync.Mutex
+
+	// The index of the server the next read should try first.
+	nextRead int
+
+	// The number of times in a row we must fail to reach a server before we
+	// consider it dead.
+	maxFailures int
+
+	// How long we wait before trying a dead server again.
+	cooldown time.Duration
+
+	// The limits on the size of a WriteSpans request to use for servers
+	// which don't advertise their own.  See batch.go.
+	writeLimits writeLimits
+
+	// The number of requests to send at once when a write is split.
+	writeParallelism int
+
+	// The number of times to retry a failed request when a write is split.
+	writeRetries int
 
-	// HRPC address of the htraced server.
-	hrpcAddr string
+	// The longest a write waits for a paused server to resume ingestion.
+	pauseMaxWait time.Duration
+
+	// What to do to the spans of a write before sending them.  See
+	// prepare.go.
+	writePrep writePrep
+
+	// The configuration of adaptive writes.  See adaptive.go.
+	adaptiveConf adaptiveConf
+
+	// The clock which adaptive writes use.
+	clock Clock
+
+	// The token we send with each request, or the empty string if we don't
+	// send one.
+	authToken string
+
+	// The I/O timeout for HRPC connections, or 0 if there is none.
+	hrpcIoTimeo time.Duration
+
+	// The most WriteSpans requests to have in flight at once on one HRPC
+	// connection.  See negotiate.go.
+	hrpcMaxInFlight int
 
 	// The test hooks to use, or nil if test hooks are not enabled.
 	testHooks *TestHooks
+
+	// The client metrics.
+	mtr *metricsTracker
+}
+
+// Get a snapshot of the client metrics.  This is safe to call concurrently
+// with other client operations.
+func (hcl *Client) Metrics() *ClientMetrics {
+	mtx := hcl.mtr.snapshot()
+	hcl.fillServerMetrics(mtx)
+	return mtx
+}
+
+// Set a callback which will be invoked each time a request fails.  Pass nil
+// to remove the callback.  The callback may be invoked concurrently from
+// multiple goroutines.
+func (hcl *Client) SetRequestFailureCallback(cb RequestFailureCallback) {
+	hcl.mtr.setFailureCallback(cb)
+}
+
+// Set a callback which will be invoked each time the adaptive state of a
+// server changes: its circuit opens or closes, or the number of spans the
+// client sends it in one request changes.  Pass nil to remove the callback.
+// See client.adaptive.enabled.
+func (hcl *Client) SetAdaptiveStateCallback(cb AdaptiveStateCallback) {
+	hcl.mtr.setStateCallback(cb)
+}
+
+// Set whether WriteSpans drops spans with the same ID as a later span in
+// the same call.  This overrides client.write.dedupe.
+func (hcl *Client) SetWriteDedupe(dedupe bool) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	hcl.writePrep.dedupe = dedupe
+}
+
+// Set whether WriteSpans sorts spans by span ID before sending them.  This
+// overrides client.write.sort.
+func (hcl *Client) SetWriteSort(sort bool) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	hcl.writePrep.sort = sort
+}
+
+// Set whether WriteSpans drops spans which the server would reject, rather
+// than sending them.  This overrides client.write.validate.
+func (hcl *Client) SetWriteValidate(validate bool) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	hcl.writePrep.validate = validate
+}
+
+// Set whether WriteSpans declares a write group for each trace with more than
+// one span in the write.  This overrides client.write.group.by.trace.
+func (hcl *Client) SetWriteGroupByTrace(groupByTrace bool) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	hcl.writePrep.groupByTrace = groupByTrace
 }
 
 // Get the htraced server version information.
 func (hcl *Client) GetServerVersion() (*common.ServerVersion, error) {
-	buf, _, err := hcl.makeGetRequest("server/info")
+	return hcl.getServerVersion(hcl.targets(false))
+}
+
+// Get the version information of the server at the given REST address,
+// rather than whichever server is next in turn.
+func (hcl *Client) GetServerVersionAt(restAddr string) (*common.ServerVersion,
+	error) {
+	tgts, err := hcl.targetAt(restAddr)
+	if err != nil {
+		return nil, err
+	}
+	return hcl.getServerVersion(tgts)
+}
+
+func (hcl *Client) getServerVersion(
+	tgts []*serverTarget) (_ *common.ServerVersion, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_INFO, TRANSPORT_REST, time.Now(), &err)
+	buf, _, tgt, err := hcl.tryRestRequest(tgts, "GET", "server/info", nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -76,11 +253,13 @@ func (hcl *Client) GetServerVersion() (*common.ServerVersion, error) {
 		return nil, errors.New(fmt.Sprintf("Error: error unmarshalling response "+
 			"body %s: %s", string(buf), err.Error()))
 	}
+	hcl.setServerInfo(tgt, &info)
 	return &info, nil
 }
 
 // Get the htraced server debug information.
-func (hcl *Client) GetServerDebugInfo() (*common.ServerDebugInfo, error) {
+func (hcl *Client) GetServerDebugInfo() (_ *common.ServerDebugInfo, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_DEBUGINFO, TRANSPORT_REST, time.Now(), &err)
 	buf, _, err := hcl.makeGetRequest("server/debugInfo")
 	if err != nil {
 		return nil, err
@@ -96,7 +275,24 @@ func (hcl *Client) GetServerDebugInfo() (*common.ServerDebugInfo, error) {
 
 // Get the htraced server statistics.
 func (hcl *Client) GetServerStats() (*common.ServerStats, error) {
-	buf, _, err := hcl.makeGetRequest("server/stats")
+	return hcl.getServerStats(hcl.targets(false))
+}
+
+// Get the statistics of the server at the given REST address, rather than
+// whichever server is next in turn.
+func (hcl *Client) GetServerStatsAt(restAddr string) (*common.ServerStats,
+	error) {
+	tgts, err := hcl.targetAt(restAddr)
+	if err != nil {
+		return nil, err
+	}
+	return hcl.getServerStats(tgts)
+}
+
+func (hcl *Client) getServerStats(
+	tgts []*serverTarget) (_ *common.ServerStats, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_STATS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, _, err := hcl.tryRestRequest(tgts, "GET", "server/stats", nil, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -109,8 +305,57 @@ func (hcl *Client) GetServerStats() (*common.ServerStats, error) {
 	return &stats, nil
 }
 
+// Get the approximate number of spans stored on the server, and the range of
+// their begin times.
+func (hcl *Client) GetSpanCounts() (*common.SpanCounts, error) {
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		return nil, err
+	}
+	return &stats.SpanCounts, nil
+}
+
+// Get the span metrics for up to lim client addresses which come after the
+// given address in sorted order.  If prefix is non-empty, only addresses which
+// start with it are returned.  Pass resp.Next as after to get the next page.
+func (hcl *Client) GetClientStats(after string, prefix string,
+	lim int) (_ *common.ClientStatsResp, err error) {
+	defer hcl.mtr.record(ENDPOINT_CLIENT_STATS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"server/stats/clients?after=%s&prefix=%s&lim=%d",
+		url.QueryEscape(after), url.QueryEscape(prefix), lim))
+	if err != nil {
+		return nil, err
+	}
+	var resp common.ClientStatsResp
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &resp, nil
+}
+
+// Get the history of the server's ingest counters, oldest bucket first.  The
+// last bucket is the current one, which is not complete yet.
+func (hcl *Client) GetStatsHistory() (_ []common.StatsBucket, err error) {
+	defer hcl.mtr.record(ENDPOINT_STATS_HISTORY, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/stats/history")
+	if err != nil {
+		return nil, err
+	}
+	var buckets []common.StatsBucket
+	err = json.Unmarshal(buf, &buckets)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return buckets, nil
+}
+
 // Get the htraced server statistics.
-func (hcl *Client) GetServerConf() (map[string]string, error) {
+func (hcl *Client) GetServerConf() (_ map[string]string, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_CONF, TRANSPORT_REST, time.Now(), &err)
 	buf, _, err := hcl.makeGetRequest("server/conf")
 	if err != nil {
 		return nil, err
@@ -126,9 +371,25 @@ func (hcl *Client) GetServerConf() (map[string]string, error) {
 
 // Get information about a trace span.  Returns nil, nil if the span was not found.
 func (hcl *Client) FindSpan(sid common.SpanId) (*common.Span, error) {
-	buf, rc, err := hcl.makeGetRequest(fmt.Sprintf("span/%s", sid.String()))
+	return hcl.FindSpanWithMaxParents(sid, 0)
+}
+
+// Get information about a span, with at most maxParents of its parents.  The
+// span's NumParents still holds the number of parents it has.  If maxParents
+// is 0, all of the parents are returned, as with FindSpan.
+func (hcl *Client) FindSpanWithMaxParents(sid common.SpanId,
+	maxParents int) (_ *common.Span, err error) {
+	defer hcl.mtr.record(ENDPOINT_FIND_SPAN, TRANSPORT_REST, time.Now(), &err)
+	reqPath := fmt.Sprintf("span/%s", sid.String())
+	if maxParents > 0 {
+		reqPath += fmt.Sprintf("?maxParents=%d", maxParents)
+	}
+	buf, rc, err := hcl.makeGetRequest(reqPath)
 	if err != nil {
-		if rc == http.StatusNoContent {
+		// The server returns 404 when the span doesn't exist.  Older servers
+		// returned 204 No Content instead.  We accept both for now.
+		if rc == http.StatusNotFound || rc == http.StatusNoContent ||
+			common.ErrorCodeOf(err) == common.ERR_SPAN_NOT_FOUND {
 			return nil, nil
 		}
 		return nil, err
@@ -142,45 +403,135 @@ func (hcl *Client) FindSpan(sid common.SpanId) (*common.Span, error) {
 	return &span, nil
 }
 
-func (hcl *Client) WriteSpans(spans []*common.Span) error {
-	if hcl.hrpcAddr == "" {
-		return hcl.writeSpansHttp(spans)
+// Write spans to the server.  Big writes may be split into several requests;
+// see batch.go.  If only some of those requests succeed, the error is a
+// WriteSpansError which says which spans were not delivered.
+func (hcl *Client) WriteSpans(spans []*common.Span) (err error) {
+	return hcl.WriteSpansWithMetadata(spans, nil)
+}
+
+// Write spans, attaching metadata to the batch.  The server records the
+// metadata in its audit log, along with the number of spans it accepted.  The
+// metadata is not stored with the spans.  Typical keys are the user or
+// service writing the spans, the job id, and the client version.
+//
+// The spans go to the first server which can be reached and is not
+// read-only.  If every server is known to be read-only, this fails with an
+// ERR_READ_ONLY HtraceError without contacting any of them.
+func (hcl *Client) WriteSpansWithMetadata(spans []*common.Span,
+	metadata map[string]string) error {
+	_, err := hcl.WriteSpansDetailed(spans, metadata)
+	return err
+}
+
+// Send one chunk of an encoded write to the first writable server which can
+// be reached.  Returns the server's response, and the server which sent it.
+func (hcl *Client) writeChunk(enc *encodedSpans, r SpanRange,
+	metadata map[string]string) (*common.WriteSpansResp, *serverTarget, error) {
+	tgts, all := hcl.writeTargets()
+	if len(tgts) == 0 {
+		if len(all) == 0 {
+			return nil, nil, errors.New("Error: the client has no servers " +
+				"to write to.")
+		}
+		return nil, nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't write spans: the server at %s is read-only.",
+			all[0].restAddr)
+	}
+	var err error
+	for _, tgt := range tgts {
+		var unreachable bool
+		var resp *common.WriteSpansResp
+		if hcl.hrpcWrites(tgt) {
+			resp, unreachable, err = hcl.writeSpansHrpc(tgt, enc, r, metadata)
+			if common.ErrorCodeOf(err) == common.ERR_UNSUPPORTED_METHOD {
+				// The server doesn't take writes over HRPC.  Use REST
+				// instead, from now on.
+				hcl.removeHrpcMethod(tgt, common.METHOD_ID_WRITE_SPANS)
+				resp, unreachable, err = hcl.writeSpansHttp(tgt, enc, r,
+					metadata)
+			}
+		} else {
+			resp, unreachable, err = hcl.writeSpansHttp(tgt, enc, r, metadata)
+		}
+		hcl.recordAttempt(tgt, unreachable)
+		if unreachable {
+			continue
+		}
+		if common.ErrorCodeOf(err) == common.ERR_READ_ONLY {
+			hcl.setReadOnly(tgt, true)
+			continue
+		}
+		return resp, tgt, err
+	}
+	return nil, nil, err
+}
+
+// Write a chunk of encoded spans to a server over HRPC.  Returns the server's
+// response, and true if the server could not be reached.
+func (hcl *Client) writeSpansHrpc(tgt *serverTarget, enc *encodedSpans,
+	r SpanRange, metadata map[string]string) (*common.WriteSpansResp, bool, error) {
+	enc, err := enc.forTransport(true)
+	if err != nil {
+		return nil, false, err
 	}
-	hcr, err := newHClient(hcl.hrpcAddr, hcl.testHooks)
+	hcr, err := hcl.dialHrpc(tgt)
 	if err != nil {
-		return err
+		return nil, true, err
 	}
 	defer hcr.Close()
-	return hcr.writeSpans(spans)
+	resp, err := hcr.writeSpans(r.End-r.Begin, enc.bytes(r), metadata,
+		enc.groupsFor(r))
+	if herr, ok := err.(*common.HtraceError); ok {
+		herr.Addr = tgt.hrpcAddr
+		return nil, false, herr
+	}
+	// Errors which didn't come from the server mean that the connection
+	// broke.  Spans are identified by their ids, so writing them again
+	// somewhere else is harmless.
+	return resp, err != nil && !hcr.isServerError(err), err
 }
 
-func (hcl *Client) writeSpansHttp(spans []*common.Span) error {
+// Write a chunk of encoded spans to a server over REST.  Returns the server's
+// response, and true if the server could not be reached.
+func (hcl *Client) writeSpansHttp(tgt *serverTarget, enc *encodedSpans,
+	r SpanRange, metadata map[string]string) (*common.WriteSpansResp, bool, error) {
+	enc, err := enc.forTransport(false)
+	if err != nil {
+		return nil, false, err
+	}
 	req := common.WriteSpansReq{
-		NumSpans: len(spans),
+		NumSpans: r.End - r.Begin,
+		Metadata: metadata,
+		Groups:   enc.groupsFor(r),
 	}
 	var w bytes.Buffer
-	enc := json.NewEncoder(&w)
-	err := enc.Encode(req)
+	err = json.NewEncoder(&w).Encode(req)
 	if err != nil {
-		return errors.New(fmt.Sprintf("Error serializing WriteSpansReq: %s",
-			err.Error()))
+		return nil, false, errors.New(fmt.Sprintf("Error serializing "+
+			"WriteSpansReq: %s", err.Error()))
+	}
+	w.Write(enc.bytes(r))
+	buf, _, unreachable, err := hcl.restRequestTo(tgt.restAddr, "POST",
+		"writeSpans", w.Bytes(), nil)
+	if err != nil {
+		return nil, unreachable, err
 	}
-	for spanIdx := range spans {
-		err := enc.Encode(spans[spanIdx])
+	var resp common.WriteSpansResp
+	// Older servers send an empty response body.
+	if len(buf) > 0 {
+		err = json.Unmarshal(buf, &resp)
 		if err != nil {
-			return errors.New(fmt.Sprintf("Error serializing span %d out "+
-				"of %d: %s", spanIdx, len(spans), err.Error()))
+			return nil, false, errors.New(fmt.Sprintf("Error unmarshalling "+
+				"response body %s: %s", string(buf), err.Error()))
 		}
 	}
-	_, _, err = hcl.makeRestRequest("POST", "writeSpans", &w)
-	if err != nil {
-		return err
-	}
-	return nil
+	return &resp, false, nil
 }
 
 // Find the child IDs of a given span ID.
-func (hcl *Client) FindChildren(sid common.SpanId, lim int) ([]common.SpanId, error) {
+func (hcl *Client) FindChildren(sid common.SpanId, lim int) (_ []common.SpanId, err error) {
+	defer hcl.mtr.record(ENDPOINT_FIND_CHILDREN, TRANSPORT_REST, time.Now(), &err)
 	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("span/%s/children?lim=%d",
 		sid.String(), lim))
 	if err != nil {
@@ -197,89 +548,1075 @@ func (hcl *Client) FindChildren(sid common.SpanId, lim int) ([]common.SpanId, er
 
 // Make a query
 func (hcl *Client) Query(query *common.Query) ([]common.Span, error) {
+	spans, _, err := hcl.QueryWithLim(query)
+	return spans, err
+}
+
+// Make a query, and return the limit which the server applied to it.  If the
+// query has no limit, the server uses its default limit; limits above the
+// server's maximum are lowered to the maximum.  Servers which don't report
+// the limit they used are assumed to have used query.Lim.
+func (hcl *Client) QueryWithLim(query *common.Query) (_ []common.Span, _ int, err error) {
+	defer hcl.mtr.record(ENDPOINT_QUERY, TRANSPORT_REST, time.Now(), &err)
+	in, err := json.Marshal(query)
+	if err != nil {
+		return nil, 0, errors.New(fmt.Sprintf("Error marshalling query: %s", err.Error()))
+	}
+	// Predicate values can contain anything, such as spaces or ampersands,
+	// so the query must be escaped.
+	reqName := fmt.Sprintf("query?query=%s", url.QueryEscape(string(in)))
+	hdr := make(http.Header)
+	out, _, _, err := hcl.tryRestRequest(hcl.targets(false), "GET",
+		reqName, nil, hdr)
+	if err != nil {
+		return nil, 0, err
+	}
+	lim := query.Lim
+	if str := hdr.Get(common.QUERY_LIM_HEADER); str != "" {
+		lim, err = strconv.Atoi(str)
+		if err != nil {
+			return nil, 0, errors.New(fmt.Sprintf("Error parsing %s header "+
+				"%s: %s", common.QUERY_LIM_HEADER, str, err.Error()))
+		}
+	}
+	var spans []common.Span
+	err = json.Unmarshal(out, &spans)
+	if err != nil {
+		return nil, 0, errors.New(fmt.Sprintf("Error unmarshalling results: %s", err.Error()))
+	}
+	return spans, lim, nil
+}
+
+// Make a query, and return a page of results which says whether more spans
+// match.  To get the next page, set query.After to the page's Next token, and
+// make the query again.
+func (hcl *Client) QueryPage(query *common.Query) (_ *common.QueryPage, err error) {
+	defer hcl.mtr.record(ENDPOINT_QUERY_PAGE, TRANSPORT_REST, time.Now(), &err)
+	in, err := json.Marshal(query)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error marshalling query: %s", err.Error()))
+	}
+	out, _, err := hcl.makeGetRequest(fmt.Sprintf("query?query=%s&paged=true",
+		url.QueryEscape(string(in))))
+	if err != nil {
+		return nil, err
+	}
+	var page common.QueryPage
+	err = json.Unmarshal(out, &page)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling results: %s", err.Error()))
+	}
+	return &page, nil
+}
+
+// Make a query, and group the results by the trace they belong to.  At most
+// groupLim groups are returned, ordered by their newest match.  The query
+// limit still applies to the number of matching spans.
+func (hcl *Client) QueryGrouped(query *common.Query,
+	groupLim int) (_ []*common.TraceGroup, err error) {
+	defer hcl.mtr.record(ENDPOINT_QUERY_GROUPED, TRANSPORT_REST, time.Now(), &err)
 	in, err := json.Marshal(query)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error marshalling query: %s", err.Error()))
 	}
 	var out []byte
-	var url = fmt.Sprintf("query?query=%s", in)
-	out, _, err = hcl.makeGetRequest(url)
+	reqName := fmt.Sprintf("query?query=%s&groupByTrace=true&groupLim=%d",
+		url.QueryEscape(string(in)), groupLim)
+	out, _, err = hcl.makeGetRequest(reqName)
 	if err != nil {
 		return nil, err
 	}
-	var spans []common.Span
-	err = json.Unmarshal(out, &spans)
+	var groups []*common.TraceGroup
+	err = json.Unmarshal(out, &groups)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error unmarshalling results: %s", err.Error()))
 	}
-	return spans, nil
+	return groups, nil
 }
 
-func (hcl *Client) makeGetRequest(reqName string) ([]byte, int, error) {
-	return hcl.makeRestRequest("GET", reqName, nil)
+// Make a query, and write the results to out as a JSON array of spans in
+// Zipkin v2 format.
+func (hcl *Client) ExportZipkin(query *common.Query, out io.Writer) (err error) {
+	defer hcl.mtr.record(ENDPOINT_EXPORT_ZIPKIN, TRANSPORT_REST, time.Now(), &err)
+	in, err := json.Marshal(query)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error marshalling query: %s", err.Error()))
+	}
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("query/zipkin?query=%s",
+		url.QueryEscape(string(in))))
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(buf)
+	return err
 }
 
-// Make a general JSON REST request.
-// Returns the request body, the response code, and the error.
-// Note: if the response code is non-zero, the error will also be non-zero.
-func (hcl *Client) makeRestRequest(reqType string, reqName string,
-	reqBody io.Reader) ([]byte, int, error) {
-	url := fmt.Sprintf("http://%s/%s",
-		hcl.restAddr, reqName)
-	req, err := http.NewRequest(reqType, url, reqBody)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// Get the flame tree rooted at the given span.  At most lim spans will be
+// included.  Returns nil if the span could not be found.
+func (hcl *Client) GetFlameTree(sid common.SpanId,
+	lim int) (_ *common.FlameTree, err error) {
+	defer hcl.mtr.record(ENDPOINT_FLAME_TREE, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("span/%s/flame?lim=%d",
+		sid.String(), lim))
+	if err != nil {
+		if common.ErrorCodeOf(err) == common.ERR_SPAN_NOT_FOUND {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var tree common.FlameTree
+	err = json.Unmarshal(buf, &tree)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &tree, nil
+}
+
+// Export the whole trace which a span belongs to as a trace bundle, and write
+// the bundle's JSON to w.  The server limits the size of the bundle; check
+// the Truncated field of the returned manifest.
+func (hcl *Client) ExportTraceBundle(sid common.SpanId,
+	w io.Writer) (_ *common.TraceBundleManifest, err error) {
+	defer hcl.mtr.record(ENDPOINT_TRACE_BUNDLE, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("span/%s/bundle",
+		sid.String()))
+	if err != nil {
+		return nil, err
+	}
+	var bundle struct {
+		Manifest common.TraceBundleManifest
+	}
+	err = json.Unmarshal(buf, &bundle)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	_, err = w.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle.Manifest, nil
+}
+
+// Read a trace bundle created by ExportTraceBundle, and write its spans to
+// the server.  This is meant for reproducing problems on a test server.
+func (hcl *Client) ImportTraceBundle(r io.Reader) (*common.TraceBundleManifest,
+	error) {
+	var bundle common.TraceBundle
+	err := json.NewDecoder(r).Decode(&bundle)
 	if err != nil {
-		return nil, -1, errors.New(fmt.Sprintf("Error: error making http request to %s: %s\n", url,
+		return nil, errors.New(fmt.Sprintf("Error reading trace bundle: %s",
 			err.Error()))
 	}
-	defer resp.Body.Close()
-	body, err2 := ioutil.ReadAll(resp.Body)
-	if err2 != nil {
-		return nil, -1, errors.New(fmt.Sprintf("Error: error reading response body: %s\n", err2.Error()))
+	err = bundle.Validate()
+	if err != nil {
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, resp.StatusCode,
-			errors.New(fmt.Sprintf("Error: got bad response status from "+
-				"%s: %s\n%s\n", url, resp.Status, body))
+	spans := make([]*common.Span, len(bundle.Spans))
+	for i := range bundle.Spans {
+		spans[i] = bundle.Spans[i].ToSpan()
 	}
-	return body, 0, nil
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle.Manifest, nil
 }
 
-// Dump all spans from the htraced daemon.
-func (hcl *Client) DumpAll(lim int, out chan *common.Span) error {
-	defer func() {
-		close(out)
-	}()
-	searchId := common.INVALID_SPAN_ID
-	for {
-		q := common.Query{
-			Lim: lim,
-			Predicates: []common.Predicate{
-				common.Predicate{
-					Op:    "ge",
-					Field: "spanid",
-					Val:   searchId.String(),
-				},
-			},
-		}
-		spans, err := hcl.Query(&q)
-		if err != nil {
-			return errors.New(fmt.Sprintf("Error querying spans with IDs at or after "+
-				"%s: %s", searchId.String(), err.Error()))
-		}
-		if len(spans) == 0 {
-			return nil
-		}
-		for i := range spans {
-			out <- &spans[i]
-		}
-		searchId = spans[len(spans)-1].Id.Next()
+// Get the service map for spans which begin in [beginMs, endMs).  At most lim
+// spans are scanned; if there were more, the map is marked as partial.
+func (hcl *Client) GetServiceMap(beginMs int64, endMs int64,
+	lim int) (_ *common.ServiceMap, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVICE_MAP, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"servicemap?begin=%d&end=%d&lim=%d", beginMs, endMs, lim))
+	if err != nil {
+		return nil, err
+	}
+	var smap common.ServiceMap
+	err = json.Unmarshal(buf, &smap)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
 	}
+	return &smap, nil
+}
+
+// Find the most common values of a field for spans which begin in
+// [beginMs, endMs), along with the number of spans which had each one.  The
+// field must be common.TRACER_ID or common.DESCRIPTION.  At most lim values
+// are returned.  At most scanLim spans are scanned; if there were more, the
+// result is marked as partial.
+func (hcl *Client) DistinctValues(field common.Field, beginMs int64,
+	endMs int64, lim int, scanLim int) (_ *common.DistinctValues, err error) {
+	defer hcl.mtr.record(ENDPOINT_DISTINCT_VALUES, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"query/values?field=%s&begin=%d&end=%d&lim=%d&scanLim=%d",
+		url.QueryEscape(string(field)), beginMs, endMs, lim, scanLim))
+	if err != nil {
+		return nil, err
+	}
+	var dv common.DistinctValues
+	err = json.Unmarshal(buf, &dv)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &dv, nil
+}
+
+// Get the latency statistics of the lim most common descriptions of the
+// finished spans which begin in [beginMs, endMs), widened to whole hours.  The
+// spans with other descriptions are summarized in the Other field.
+func (hcl *Client) DescriptionStats(beginMs int64, endMs int64,
+	lim int) (_ *common.DescriptionStatsResponse, err error) {
+	defer hcl.mtr.record(ENDPOINT_DESCRIPTION_STATS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"stats/descriptions?begin=%d&end=%d&lim=%d", beginMs, endMs, lim))
+	if err != nil {
+		return nil, err
+	}
+	var resp common.DescriptionStatsResponse
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &resp, nil
+}
+
+// Find up to lim spans which the given span links to, and up to lim spans
+// which link to it.
+func (hcl *Client) FindLinkedSpans(sid common.SpanId,
+	lim int) (_ *common.LinkedSpans, err error) {
+	defer hcl.mtr.record(ENDPOINT_FIND_LINKED_SPANS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("span/%s/links?lim=%d",
+		sid.String(), lim))
+	if err != nil {
+		return nil, err
+	}
+	var linked common.LinkedSpans
+	err = json.Unmarshal(buf, &linked)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &linked, nil
+}
+
+// Find spans which arrived at the server at or after the given time, in
+// milliseconds since the epoch.  If cursor is non-empty, the search continues
+// from where a previous search left off and sinceMs is ignored.
+func (hcl *Client) FindSpansChangedSince(sinceMs int64, cursor string,
+	lim int) (_ *common.SpansChangedResp, err error) {
+	defer hcl.mtr.record(ENDPOINT_SPANS_CHANGED, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"spans/changed?since=%d&cursor=%s&lim=%d", sinceMs, cursor, lim))
+	if err != nil {
+		return nil, err
+	}
+	var resp common.SpansChangedResp
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &resp, nil
+}
+
+// Find up to lim spans whose sequence numbers are at least fromSeq, in
+// sequence number order.  Pass resp.NextSeq to the next call to continue where
+// this one left off.  The server must have sequence numbers enabled.
+func (hcl *Client) FindSpansBySeq(fromSeq uint64,
+	lim int) (_ *common.SpansBySeqResp, err error) {
+	defer hcl.mtr.record(ENDPOINT_SPANS_BY_SEQ, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"spans/seq?from=%d&lim=%d", fromSeq, lim))
+	if err != nil {
+		return nil, err
+	}
+	var resp common.SpansBySeqResp
+	err = json.Unmarshal(buf, &resp)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &resp, nil
+}
+
+// Find up to lim spans which have started but not finished, and which began at
+// least olderThanMs milliseconds ago.  The longest-running spans come first.
+func (hcl *Client) ActiveSpans(olderThanMs int64,
+	lim int) (_ []*common.Span, err error) {
+	defer hcl.mtr.record(ENDPOINT_ACTIVE_SPANS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"spans/active?olderThanMs=%d&lim=%d", olderThanMs, lim))
+	if err != nil {
+		return nil, err
+	}
+	var spans []*common.Span
+	err = json.Unmarshal(buf, &spans)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return spans, nil
+}
+
+// Get the heartbeat markers which the server wrote at or after the given time,
+// in milliseconds since the epoch.  Returns at most lim markers.
+func (hcl *Client) GetHeartbeatMarkers(sinceMs int64,
+	lim int) (_ []*common.HeartbeatMarker, err error) {
+	defer hcl.mtr.record(ENDPOINT_HEARTBEATS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"server/heartbeats?since=%d&lim=%d", sinceMs, lim))
+	if err != nil {
+		return nil, err
+	}
+	var markers []*common.HeartbeatMarker
+	err = json.Unmarshal(buf, &markers)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return markers, nil
+}
+
+// Get up to lim of the most recent entries in the server's audit log, newest
+// first.
+func (hcl *Client) GetAuditEntries(lim int) (_ []*common.AuditEntry, err error) {
+	defer hcl.mtr.record(ENDPOINT_AUDIT, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("server/audit?lim=%d", lim))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*common.AuditEntry
+	err = json.Unmarshal(buf, &entries)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return entries, nil
+}
+
+// Get up to lim of the spans the server most recently rejected as invalid,
+// newest first, along with the number of spans rejected for each reason.  If
+// reason is non-empty, only spans rejected for that reason are returned.
+func (hcl *Client) GetRejections(reason string,
+	lim int) (_ *common.Rejections, err error) {
+	defer hcl.mtr.record(ENDPOINT_REJECTIONS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf(
+		"server/rejections?reason=%s&lim=%d", url.QueryEscape(reason), lim))
+	if err != nil {
+		return nil, err
+	}
+	var rej common.Rejections
+	err = json.Unmarshal(buf, &rej)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &rej, nil
+}
+
+// Remove the rejected spans the server has kept, and reset its counts.
+func (hcl *Client) ClearRejections() (err error) {
+	defer hcl.mtr.record(ENDPOINT_CLEAR_REJECTIONS, TRANSPORT_REST, time.Now(), &err)
+	_, _, err = hcl.makeRestRequest("POST", "server/rejections/clear", nil)
+	return err
+}
+
+// Get the shard directory locks which the server holds.
+func (hcl *Client) GetLocks() (_ []common.ShardLock, err error) {
+	defer hcl.mtr.record(ENDPOINT_LOCKS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/locks")
+	if err != nil {
+		return nil, err
+	}
+	var locks []common.ShardLock
+	err = json.Unmarshal(buf, &locks)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return locks, nil
+}
+
+// Ask the server to reload its configuration.  The result describes which
+// changes were applied and which were ignored.
+func (hcl *Client) ReloadServerConf() (_ *common.ConfReloadResult, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_CONF_RELOAD, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST", "server/conf/reload", nil)
+	if err != nil {
+		return nil, err
+	}
+	var result common.ConfReloadResult
+	err = json.Unmarshal(buf, &result)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &result, nil
+}
+
+// Get the health of each of the server's shards.
+func (hcl *Client) GetServerHealth() (_ *common.ServerHealth, err error) {
+	defer hcl.mtr.record(ENDPOINT_SERVER_HEALTH, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/health")
+	if err != nil {
+		return nil, err
+	}
+	var health common.ServerHealth
+	err = json.Unmarshal(buf, &health)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &health, nil
+}
+
+// Get the server's visibility watermark.  Every span with a begin time before
+// WatermarkMs which the server will accept has been written, and will show up
+// in queries.
+func (hcl *Client) GetWatermark() (_ *common.Watermark, err error) {
+	defer hcl.mtr.record(ENDPOINT_WATERMARK, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/watermark")
+	if err != nil {
+		return nil, err
+	}
+	var wm common.Watermark
+	err = json.Unmarshal(buf, &wm)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &wm, nil
+}
+
+// Get the results of the server's read-after-write canary, including its most
+// recent failures.  See canary.sample.percent.
+func (hcl *Client) GetCanaryStatus() (_ *common.CanaryStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_CANARY, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/canary")
+	if err != nil {
+		return nil, err
+	}
+	var status common.CanaryStatus
+	err = json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Get the state of the server's span quotas.  See quota.rules.
+func (hcl *Client) GetQuotas() (_ []common.QuotaStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_QUOTAS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/quotas")
+	if err != nil {
+		return nil, err
+	}
+	var quotas []common.QuotaStatus
+	err = json.Unmarshal(buf, &quotas)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return quotas, nil
+}
+
+// Get the faults which the server has injected in chaos mode.  See
+// chaos.enabled.
+func (hcl *Client) GetChaosStats() (_ *common.ChaosStats, err error) {
+	defer hcl.mtr.record(ENDPOINT_CHAOS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/chaos")
+	if err != nil {
+		return nil, err
+	}
+	var stats common.ChaosStats
+	err = json.Unmarshal(buf, &stats)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &stats, nil
+}
+
+// Ask the server to reopen a quarantined shard.  Returns the health of the
+// shard after the retry.
+func (hcl *Client) RetryShard(shardIdx int) (_ *common.ShardHealth, err error) {
+	defer hcl.mtr.record(ENDPOINT_SHARD_RETRY, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST",
+		fmt.Sprintf("server/shards/%d/retry", shardIdx), nil)
+	if err != nil {
+		return nil, err
+	}
+	var health common.ShardHealth
+	err = json.Unmarshal(buf, &health)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &health, nil
+}
+
+// Stop the server accepting spans, while it goes on serving queries.  If dur
+// is positive, the server resumes ingestion by itself after dur; otherwise it
+// stays paused until ResumeIngest is called.  Needs the admin permission.
+func (hcl *Client) PauseIngest(dur time.Duration) (_ *common.IngestPause, err error) {
+	defer hcl.mtr.record(ENDPOINT_INGEST_PAUSE, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST",
+		fmt.Sprintf("server/ingest/pause?durationMs=%d",
+			int64(dur/time.Millisecond)), nil)
+	if err != nil {
+		return nil, err
+	}
+	var status common.IngestPause
+	err = json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Make the server accept spans again after PauseIngest.  Needs the admin
+// permission.
+func (hcl *Client) ResumeIngest() (_ *common.IngestPause, err error) {
+	defer hcl.mtr.record(ENDPOINT_INGEST_RESUME, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST", "server/ingest/resume", nil)
+	if err != nil {
+		return nil, err
+	}
+	var status common.IngestPause
+	err = json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Start taking a snapshot of the datastore in dest, a directory on the
+// server which must be empty or not exist.  The shards are copied in the
+// background; use SnapshotStatus to find out when the snapshot is done.
+func (hcl *Client) Snapshot(dest string) (_ *common.SnapshotStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_SNAPSHOT, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST",
+		"server/snapshot?dest="+url.QueryEscape(dest), nil)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSnapshotStatus(buf)
+}
+
+// Get the status of the most recent snapshot.
+func (hcl *Client) SnapshotStatus() (_ *common.SnapshotStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_SNAPSHOT_STATUS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/snapshot/status")
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSnapshotStatus(buf)
+}
+
+func unmarshalSnapshotStatus(buf []byte) (*common.SnapshotStatus, error) {
+	var status common.SnapshotStatus
+	err := json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Start renaming the tracer ID from to to in the spans stored on the server.
+// The spans are rewritten in the background; use TracerRenameStatus to find
+// out when the rename is done.  If dryRun is set, the spans are only counted.
+// If alias is set, spans which are sent with the old tracer ID from now on
+// are stored under the new one.
+func (hcl *Client) RenameTracer(from string, to string, dryRun bool,
+	alias bool) (_ *common.TracerRenameStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_TRACER_RENAME, TRANSPORT_REST, time.Now(), &err)
+	params := url.Values{}
+	params.Set("from", from)
+	params.Set("to", to)
+	params.Set("dryRun", strconv.FormatBool(dryRun))
+	params.Set("alias", strconv.FormatBool(alias))
+	buf, _, err := hcl.makeRestRequest("POST",
+		"server/tracers/rename?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTracerRenameStatus(buf)
+}
+
+// Get the status of the most recent tracer rename.
+func (hcl *Client) TracerRenameStatus() (_ *common.TracerRenameStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_RENAME_STATUS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/tracers/rename/status")
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTracerRenameStatus(buf)
+}
+
+func unmarshalTracerRenameStatus(buf []byte) (*common.TracerRenameStatus, error) {
+	var status common.TracerRenameStatus
+	err := json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Start the scan job with the given name on the server.  The job runs in the
+// background; use ScanJobStatus to find out when it is done, and to get its
+// result.
+func (hcl *Client) StartScanJob(name string) (_ *common.ScanJobStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_SCAN_JOB, TRANSPORT_REST, time.Now(), &err)
+	params := url.Values{}
+	params.Set("name", name)
+	buf, _, err := hcl.makeRestRequest("POST",
+		"server/scan?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalScanJobStatus(buf)
+}
+
+// Get the status of the most recent scan job.
+func (hcl *Client) ScanJobStatus() (_ *common.ScanJobStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_SCAN_JOB_STATUS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/scan/status")
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalScanJobStatus(buf)
+}
+
+// Cancel the running scan job.  Returns once the job has stopped.
+func (hcl *Client) CancelScanJob() (_ *common.ScanJobStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_CANCEL_SCAN_JOB, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeRestRequest("POST", "server/scan/cancel", nil)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalScanJobStatus(buf)
+}
+
+func unmarshalScanJobStatus(buf []byte) (*common.ScanJobStatus, error) {
+	var status common.ScanJobStatus
+	err := json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Get the state of every latency SLO, sorted by name.
+func (hcl *Client) GetSlos() (_ []common.SloStatus, err error) {
+	defer hcl.mtr.record(ENDPOINT_SLOS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("server/slos")
+	if err != nil {
+		return nil, err
+	}
+	var statuses []common.SloStatus
+	err = json.Unmarshal(buf, &statuses)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return statuses, nil
+}
+
+// Define a latency SLO, replacing any SLO with the same name.
+func (hcl *Client) DefineSlo(def *common.SloDefinition) (_ *common.SloStatus,
+	err error) {
+	defer hcl.mtr.record(ENDPOINT_DEFINE_SLO, TRANSPORT_REST, time.Now(), &err)
+	reqBody, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	buf, _, err := hcl.makeRestRequest("POST", "server/slos",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	var status common.SloStatus
+	err = json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Delete a latency SLO.
+func (hcl *Client) DeleteSlo(name string) (err error) {
+	defer hcl.mtr.record(ENDPOINT_DELETE_SLO, TRANSPORT_REST, time.Now(), &err)
+	_, _, err = hcl.makeRestRequest("POST",
+		"server/slos/"+url.PathEscape(name)+"/delete", nil)
+	return err
+}
+
+// Add tags to, and remove tags from, the trace with the given root.  Returns
+// the tags the trace carries afterwards.
+func (hcl *Client) TagTrace(root common.SpanId,
+	req *common.TagTraceReq) (_ *common.TraceTags, err error) {
+	defer hcl.mtr.record(ENDPOINT_TAG_TRACE, TRANSPORT_REST, time.Now(), &err)
+	reqBody, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	buf, _, err := hcl.makeRestRequest("POST",
+		fmt.Sprintf("span/%s/tags", root.String()), bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTraceTags(buf)
+}
+
+// Get the tags of the trace with the given root.
+func (hcl *Client) GetTraceTags(root common.SpanId) (_ *common.TraceTags,
+	err error) {
+	defer hcl.mtr.record(ENDPOINT_TRACE_TAGS, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("span/%s/tags",
+		root.String()))
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTraceTags(buf)
+}
+
+func unmarshalTraceTags(buf []byte) (*common.TraceTags, error) {
+	var tags common.TraceTags
+	err := json.Unmarshal(buf, &tags)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &tags, nil
+}
+
+// Get the state of a write group.  If the server doesn't know the group,
+// because no request declared it, or it has expired, the error is an
+// ERR_GROUP_NOT_FOUND HtraceError.
+func (hcl *Client) GetWriteGroup(id string) (_ *common.WriteGroupStatus,
+	err error) {
+	defer hcl.mtr.record(ENDPOINT_WRITE_GROUP, TRANSPORT_REST, time.Now(), &err)
+	buf, _, err := hcl.makeGetRequest("groups/" + url.PathEscape(id))
+	if err != nil {
+		return nil, err
+	}
+	var status common.WriteGroupStatus
+	err = json.Unmarshal(buf, &status)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &status, nil
+}
+
+// Find the roots of the traces which carry a tag, in span ID order.  At most
+// lim roots after the given root are returned; pass nil to start at the
+// beginning, and the Next field of the result to get the next page.
+func (hcl *Client) FindTracesByTag(tag string, after common.SpanId,
+	lim int) (_ *common.TaggedTraces, err error) {
+	defer hcl.mtr.record(ENDPOINT_FIND_TAGGED_TRACES, TRANSPORT_REST,
+		time.Now(), &err)
+	reqName := fmt.Sprintf("tags/%s?lim=%d", url.PathEscape(tag), lim)
+	if after != nil {
+		reqName += "&after=" + after.String()
+	}
+	buf, _, err := hcl.makeGetRequest(reqName)
+	if err != nil {
+		return nil, err
+	}
+	var traces common.TaggedTraces
+	err = json.Unmarshal(buf, &traces)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &traces, nil
+}
+
+// Save a search, replacing any search with the same name.  Returns the
+// search as the server saved it.
+func (hcl *Client) SaveSearch(search *common.SavedSearch) (
+	_ *common.SavedSearch, err error) {
+	defer hcl.mtr.record(ENDPOINT_SAVE_SEARCH, TRANSPORT_REST, time.Now(), &err)
+	reqBody, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+	buf, _, err := hcl.makeRestRequest("POST", "searches",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	var saved common.SavedSearch
+	err = json.Unmarshal(buf, &saved)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &saved, nil
+}
+
+// Get the saved searches, sorted by name.
+func (hcl *Client) GetSavedSearches() (_ []common.SavedSearch, err error) {
+	defer hcl.mtr.record(ENDPOINT_SAVED_SEARCHES, TRANSPORT_REST, time.Now(),
+		&err)
+	buf, _, err := hcl.makeGetRequest("searches")
+	if err != nil {
+		return nil, err
+	}
+	var searches []common.SavedSearch
+	err = json.Unmarshal(buf, &searches)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return searches, nil
+}
+
+// Run a saved search, and get a page of its results.  params overrides the
+// defaults of the search's template parameters.  If lim is positive, it
+// replaces the saved query limit.  Pass the Next field of a page as after to
+// get the next page, or the empty string to get the first.
+func (hcl *Client) RunSavedSearch(name string, params map[string]string,
+	lim int, after string) (_ *common.QueryPage, err error) {
+	defer hcl.mtr.record(ENDPOINT_RUN_SAVED_SEARCH, TRANSPORT_REST,
+		time.Now(), &err)
+	vals := url.Values{}
+	vals.Set("paged", "true")
+	for key, val := range params {
+		vals.Set(common.SAVED_SEARCH_PARAM_PREFIX+key, val)
+	}
+	if lim > 0 {
+		vals.Set("lim", strconv.Itoa(lim))
+	}
+	if after != "" {
+		vals.Set("after", after)
+	}
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("searches/%s/run?%s",
+		url.PathEscape(name), vals.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	var page common.QueryPage
+	err = json.Unmarshal(buf, &page)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling results: %s",
+			err.Error()))
+	}
+	return &page, nil
+}
+
+// Delete a saved search.
+func (hcl *Client) DeleteSavedSearch(name string) (err error) {
+	defer hcl.mtr.record(ENDPOINT_DELETE_SEARCH, TRANSPORT_REST, time.Now(),
+		&err)
+	_, _, err = hcl.makeRestRequest("DELETE",
+		"searches/"+url.PathEscape(name), nil)
+	return err
+}
+
+// Replay a query plan from the Plan field of a QueryPage.  The server runs the
+// query again with the plan, and plans it again, and says what changed.
+func (hcl *Client) ReplayQueryPlan(plan *common.QueryPlan) (
+	_ *common.PlanReplay, err error) {
+	defer hcl.mtr.record(ENDPOINT_REPLAY_PLAN, TRANSPORT_REST, time.Now(),
+		&err)
+	reqBody, err := json.Marshal(plan)
+	if err != nil {
+		return nil, err
+	}
+	buf, _, err := hcl.makeRestRequest("POST", "query/replay",
+		bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	var replay common.PlanReplay
+	err = json.Unmarshal(buf, &replay)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &replay, nil
+}
+
+// Ask the server how it would run a query, without running it.  If the
+// server keeps planner statistics, the explanation also estimates how many
+// spans match.
+func (hcl *Client) ExplainQuery(query *common.Query) (
+	_ *common.QueryExplanation, err error) {
+	defer hcl.mtr.record(ENDPOINT_EXPLAIN_QUERY, TRANSPORT_REST, time.Now(),
+		&err)
+	in, err := json.Marshal(query)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error marshalling query: %s", err.Error()))
+	}
+	buf, _, err := hcl.makeGetRequest(fmt.Sprintf("query/explain?query=%s",
+		url.QueryEscape(string(in))))
+	if err != nil {
+		return nil, err
+	}
+	var exp common.QueryExplanation
+	err = json.Unmarshal(buf, &exp)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &exp, nil
+}
+
+// Count the spans which begin in [beginMs, endMs), in the given number of
+// buckets of equal width.  If query is non-nil, only the spans which match its
+// predicates are counted; it can't have begin time predicates.  At most
+// scanLim spans are scanned; if there were more, the result is marked as
+// partial.
+func (hcl *Client) QueryTimeSeries(query *common.Query, beginMs int64,
+	endMs int64, buckets int, scanLim int) (_ *common.TimeSeries, err error) {
+	defer hcl.mtr.record(ENDPOINT_QUERY_TIME_SERIES, TRANSPORT_REST,
+		time.Now(), &err)
+	reqName := fmt.Sprintf("query/timeseries?field=%s&begin=%d&end=%d"+
+		"&buckets=%d&scanLim=%d", url.QueryEscape(string(common.BEGIN_TIME)),
+		beginMs, endMs, buckets, scanLim)
+	if query != nil {
+		in, err := json.Marshal(query)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error marshalling query: %s",
+				err.Error()))
+		}
+		reqName += "&query=" + url.QueryEscape(string(in))
+	}
+	buf, _, err := hcl.makeGetRequest(reqName)
+	if err != nil {
+		return nil, err
+	}
+	var ts common.TimeSeries
+	err = json.Unmarshal(buf, &ts)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error unmarshalling response "+
+			"body %s: %s", string(buf), err.Error()))
+	}
+	return &ts, nil
+}
+
+func (hcl *Client) makeGetRequest(reqName string) ([]byte, int, error) {
+	return hcl.makeRestRequest("GET", reqName, nil)
+}
+
+// Make a general JSON REST request.  GET requests go to whichever server is
+// next in turn; other requests go to the first server which can be reached.
+// Returns the request body, the response code, and the error.
+// Note: if the response code is non-zero, the error will also be non-zero.
+// Error responses from the server are returned as *common.HtraceError.
+func (hcl *Client) makeRestRequest(reqType string, reqName string,
+	reqBody io.Reader) ([]byte, int, error) {
+	var body []byte
+	if reqBody != nil {
+		var err error
+		body, err = ioutil.ReadAll(reqBody)
+		if err != nil {
+			return nil, -1, errors.New(fmt.Sprintf("Error: error reading "+
+				"request body: %s\n", err.Error()))
+		}
+	}
+	buf, rc, _, err := hcl.tryRestRequest(hcl.targets(reqType != "GET"),
+		reqType, reqName, body, nil)
+	return buf, rc, err
+}
+
+// Try a REST request on each server in turn, until one of them can be
+// reached.  Returns the request body, the response code, the server which
+// handled the request, and the error.  If respHdr is non-nil, the headers of
+// a successful response are copied into it.
+func (hcl *Client) tryRestRequest(tgts []*serverTarget, reqType string,
+	reqName string, body []byte, respHdr http.Header) ([]byte, int, *serverTarget, error) {
+	err := errors.New("Error: the client has no servers to send requests to.")
+	for _, tgt := range tgts {
+		var buf []byte
+		var rc int
+		var unreachable bool
+		buf, rc, unreachable, err = hcl.restRequestTo(tgt.restAddr, reqType,
+			reqName, body, respHdr)
+		hcl.recordAttempt(tgt, unreachable)
+		if !unreachable {
+			return buf, rc, tgt, err
+		}
+	}
+	return nil, -1, nil, err
+}
+
+// Make a REST request to a particular server.  Returns the request body, the
+// response code, whether the server could not be reached, and the error.
+// If respHdr is non-nil, the headers of a successful response are copied
+// into it.
+func (hcl *Client) restRequestTo(restAddr string, reqType string,
+	reqName string, body []byte, respHdr http.Header) ([]byte, int, bool, error) {
+	url, client := restEndpoint(restAddr, reqName)
+	var reqBody io.Reader
+	if body != nil {
+		reqBody = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(reqType, url, reqBody)
+	req.Header.Set("Content-Type", "application/json")
+	if hcl.authToken != "" {
+		req.Header.Set("Authorization", common.AUTH_HEADER_PREFIX+hcl.authToken)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if conf.IsUnixAddress(restAddr) {
+			url = restAddr + " (" + url + ")"
+		}
+		return nil, -1, true, errors.New(fmt.Sprintf("Error: error making "+
+			"http request to %s: %s\n", url, err.Error()))
+	}
+	defer resp.Body.Close()
+	respBody, err2 := ioutil.ReadAll(resp.Body)
+	if err2 != nil {
+		return nil, -1, true, errors.New(fmt.Sprintf("Error: error reading "+
+			"response body from %s: %s\n", restAddr, err2.Error()))
+	}
+	if resp.StatusCode != http.StatusOK {
+		herr := common.DecodeErrorResp(resp.StatusCode, respBody)
+		herr.Addr = restAddr
+		return nil, resp.StatusCode, false, herr
+	}
+	if respHdr != nil {
+		for k, v := range resp.Header {
+			respHdr[k] = v
+		}
+	}
+	return respBody, 0, false, nil
+}
+
+// Dump all spans from the htraced daemon to a channel.
+//
+// The channel is not closed.  The caller should close it, if needed, after
+// DumpAll returns, so that consumers which stop when the channel is closed
+// can check the returned error.  See DumpAllTo for a variant which writes
+// directly to an io.Writer.
+func (hcl *Client) DumpAll(lim int, out chan *common.Span) error {
+	return hcl.dumpPages(common.INVALID_SPAN_ID, lim,
+		func(spans []common.Span) error {
+			for i := range spans {
+				out <- &spans[i]
+			}
+			return nil
+		})
 }
 
 func (hcl *Client) Close() {
-	hcl.restAddr = ""
-	hcl.hrpcAddr = ""
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	hcl.servers = nil
 }
@@ -0,0 +1,241 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"io"
+	"time"
+)
+
+//
+// DumpAllTo writes every span on the server to an io.Writer as JSON lines,
+// one span per line, in span ID order.  Unlike DumpAll, it fetches the next
+// page of spans only after the previous one has been written, so a slow
+// writer slows down the dump rather than pinning spans in memory.
+//
+// Spans are written in chunks of roughly DumpOpts.FlushBytes.  After each
+// chunk is written (and flushed, if the writer has a Flush method), the
+// checkpoint callback is invoked with the ID of the last span which was
+// written completely.  If the dump is interrupted, the output can be
+// truncated to the checkpointed byte count and resumed with DumpAllFrom.
+//
+
+// The default number of bytes to buffer before writing to the output.
+const DEFAULT_DUMP_FLUSH_BYTES = 64 * 1024
+
+type DumpOpts struct {
+	// The number of spans to fetch from the server at once.
+	Lim int
+
+	// The number of bytes to buffer before writing to the output.  If this
+	// is 0, DEFAULT_DUMP_FLUSH_BYTES is used.  The buffer is also written out
+	// at the end of every page.
+	FlushBytes int
+
+	// If non-nil, called after each write with the ID of the last span which
+	// was written completely and the number of bytes of complete spans which
+	// this call has written so far.  If the callback returns an error, the
+	// dump stops.
+	Checkpoint func(lastId common.SpanId, numBytes int64) error
+}
+
+type DumpReport struct {
+	// The number of spans which were written completely.
+	NumSpans int64
+
+	// The number of bytes of complete spans which were written.  If the dump
+	// failed part of the way through a write, the output may contain a
+	// partial span after this offset.
+	NumBytes int64
+
+	// The number of pages fetched from the server.
+	NumPages int
+
+	// How long the dump took.
+	Duration time.Duration
+
+	// The ID of the last span which was written completely, or nil if no
+	// spans were written.
+	LastId common.SpanId
+}
+
+// Dump all spans from the htraced daemon to a writer.
+func (hcl *Client) DumpAllTo(w io.Writer, opts DumpOpts) (DumpReport, error) {
+	return hcl.DumpAllFrom(nil, w, opts)
+}
+
+// Dump all spans with IDs after lastId to a writer.  If lastId is nil, all
+// spans are dumped.
+func (hcl *Client) DumpAllFrom(lastId common.SpanId, w io.Writer,
+	opts DumpOpts) (DumpReport, error) {
+	dmp := &spanDumper{
+		w:          w,
+		flushBytes: opts.FlushBytes,
+		checkpoint: opts.Checkpoint,
+	}
+	if dmp.flushBytes <= 0 {
+		dmp.flushBytes = DEFAULT_DUMP_FLUSH_BYTES
+	}
+	if flusher, ok := w.(interface {
+		Flush() error
+	}); ok {
+		dmp.flusher = flusher
+	}
+	start := time.Now()
+	searchId := common.INVALID_SPAN_ID
+	if lastId != nil {
+		searchId = lastId.Next()
+		if searchId.Compare(lastId) <= 0 {
+			// lastId is the maximum span ID, so there is nothing after it.
+			return dmp.report, nil
+		}
+	}
+	err := hcl.dumpPages(searchId, opts.Lim, func(spans []common.Span) error {
+		dmp.report.NumPages++
+		for i := range spans {
+			err := dmp.add(&spans[i])
+			if err != nil {
+				return err
+			}
+		}
+		return dmp.flush()
+	})
+	dmp.report.Duration = time.Since(start)
+	return dmp.report, err
+}
+
+type spanDumper struct {
+	// The output.
+	w io.Writer
+
+	// The output's Flush method, or nil if it doesn't have one.
+	flusher interface {
+		Flush() error
+	}
+
+	// The number of bytes to buffer before writing.
+	flushBytes int
+
+	// The checkpoint callback, or nil.
+	checkpoint func(lastId common.SpanId, numBytes int64) error
+
+	// The spans which haven't been written yet.
+	buf bytes.Buffer
+
+	// The IDs of the spans in buf.
+	ids []common.SpanId
+
+	// The offsets in buf where each span ends.
+	ends []int
+
+	// The dump report so far.
+	report DumpReport
+}
+
+func (dmp *spanDumper) add(span *common.Span) error {
+	dmp.buf.Write(span.ToJson())
+	dmp.buf.WriteByte('\n')
+	dmp.ids = append(dmp.ids, span.Id)
+	dmp.ends = append(dmp.ends, dmp.buf.Len())
+	if dmp.buf.Len() >= dmp.flushBytes {
+		return dmp.flush()
+	}
+	return nil
+}
+
+// Write out the buffered spans and update the checkpoint.
+func (dmp *spanDumper) flush() error {
+	if len(dmp.ids) == 0 {
+		return nil
+	}
+	n, err := dmp.w.Write(dmp.buf.Bytes())
+	if err == nil && dmp.flusher != nil {
+		err = dmp.flusher.Flush()
+		if err != nil {
+			// We don't know how much of the data made it out.
+			n = 0
+		}
+	}
+	// Count the spans which were written completely.
+	var numSpans, numBytes int
+	for numSpans < len(dmp.ends) && dmp.ends[numSpans] <= n {
+		numBytes = dmp.ends[numSpans]
+		numSpans++
+	}
+	if numSpans > 0 {
+		dmp.report.NumSpans += int64(numSpans)
+		dmp.report.NumBytes += int64(numBytes)
+		dmp.report.LastId = dmp.ids[numSpans-1]
+		if dmp.checkpoint != nil {
+			cerr := dmp.checkpoint(dmp.report.LastId, dmp.report.NumBytes)
+			if err == nil && cerr != nil {
+				err = errors.New(fmt.Sprintf("Checkpoint error: %s",
+					cerr.Error()))
+			}
+		}
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error writing spans after %d "+
+			"byte(s): %s", dmp.report.NumBytes, err.Error()))
+	}
+	dmp.buf.Reset()
+	dmp.ids = dmp.ids[:0]
+	dmp.ends = dmp.ends[:0]
+	return nil
+}
+
+// Fetch pages of spans with IDs at or after searchId, in ID order, and pass
+// each one to the callback until there are no more spans or the callback
+// returns an error.
+func (hcl *Client) dumpPages(searchId common.SpanId, lim int,
+	cb func(spans []common.Span) error) error {
+	for {
+		q := common.Query{
+			Lim: lim,
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    "ge",
+					Field: "spanid",
+					Val:   searchId.String(),
+				},
+			},
+		}
+		spans, err := hcl.Query(&q)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error querying spans with IDs at or after "+
+				"%s: %s", searchId.String(), err.Error()))
+		}
+		if len(spans) == 0 {
+			return nil
+		}
+		err = cb(spans)
+		if err != nil {
+			return err
+		}
+		lastId := spans[len(spans)-1].Id
+		searchId = lastId.Next()
+		if searchId.Compare(lastId) <= 0 {
+			return nil
+		}
+	}
+}
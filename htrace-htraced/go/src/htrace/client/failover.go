@@ -0,0 +1,248 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"time"
+)
+
+//
+// Failover between htraced servers.
+//
+// A client can be given a comma-separated list of servers in web.address, and
+// a matching list in hrpc.address.  Writes, and other requests which change
+// the server, go to the first healthy server in the order the servers were
+// configured.  Reads are spread across the healthy servers round-robin.  If a
+// server can't be reached, the request is tried on the next server.  Errors
+// returned by a server are not retried, except that writes skip read-only
+// servers.
+//
+// Health is tracked with a simple circuit breaker.  A server which we fail to
+// reach maxFailures times in a row is considered dead, and is skipped until
+// the cooldown has passed.  After that, it is tried again; one more failure
+// makes it dead again, and a success makes it healthy.  If every server is
+// dead, we try them all anyway, rather than failing without trying.
+//
+
+// A server the client can send requests to.
+type serverTarget struct {
+	// The REST address of the server.
+	restAddr string
+
+	// The HRPC address of the server, or the empty string if we don't use
+	// HRPC.
+	hrpcAddr string
+
+	// The fields below are protected by the client lock.
+
+	// The number of times in a row we have failed to reach the server.
+	failures int
+
+	// If the server is dead, when we should try it again.
+	deadUntil time.Time
+
+	// True if we know that the server is read-only, either because
+	// GetServerVersion said so, or because it rejected a write.
+	readOnly bool
+
+	// The limits on WriteSpans requests which the server advertised in its
+	// last GetServerVersion response.  0 if there is no limit, or we don't
+	// know.
+	maxWriteSpans int
+	maxWriteBytes int
+
+	// True if we know which HRPC methods the server supports.  See
+	// negotiate.go.
+	hrpcNegotiated bool
+
+	// The HRPC protocol version the server said it has, and the HRPC methods
+	// which both it and we support.
+	hrpcVersion uint32
+	hrpcMethods common.HrpcMethodSet
+
+	// The number of WriteSpans requests the server lets us have in flight at
+	// once on one HRPC connection.  0 if it doesn't allow pipelining.
+	hrpcMaxInFlight uint32
+
+	// How adaptive writes treat the server.  See adaptive.go.
+	adaptive adaptiveState
+}
+
+// Create the server targets from the client configuration.
+func newServerTargets(cnf *conf.Config,
+	hrpcDisabled bool) ([]*serverTarget, error) {
+	restAddrs, err := cnf.GetAddressList(conf.HTRACE_WEB_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+	if len(restAddrs) == 0 {
+		// Let NormalizeAddress explain what is missing.
+		_, err = cnf.GetAddress(conf.HTRACE_WEB_ADDRESS)
+		return nil, err
+	}
+	hrpcAddrs := []string{}
+	if !hrpcDisabled {
+		hrpcAddrs, err = cnf.GetAddressList(conf.HTRACE_HRPC_ADDRESS)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(hrpcAddrs) != 0 && len(hrpcAddrs) != len(restAddrs) {
+		return nil, errors.New(fmt.Sprintf("The client was given %d "+
+			"address(es) in %s, but %d in %s.  There should be one HRPC "+
+			"address for each server, or none to use REST only.",
+			len(restAddrs), conf.HTRACE_WEB_ADDRESS, len(hrpcAddrs),
+			conf.HTRACE_HRPC_ADDRESS))
+	}
+	tgts := make([]*serverTarget, len(restAddrs))
+	for i := range restAddrs {
+		tgts[i] = &serverTarget{restAddr: restAddrs[i]}
+		if len(hrpcAddrs) != 0 {
+			tgts[i].hrpcAddr = hrpcAddrs[i]
+		}
+	}
+	return tgts, nil
+}
+
+// Get the servers to try a request on, in the order to try them.  Write
+// requests start with the first configured server; reads take turns.  Dead
+// servers are left out, unless all of them are dead.
+func (hcl *Client) targets(write bool) []*serverTarget {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	numServers := len(hcl.servers)
+	if numServers == 0 {
+		return nil
+	}
+	start := 0
+	if !write {
+		start = hcl.nextRead
+		hcl.nextRead = (hcl.nextRead + 1) % numServers
+	}
+	now := time.Now()
+	live := make([]*serverTarget, 0, numServers)
+	dead := make([]*serverTarget, 0)
+	for i := 0; i < numServers; i++ {
+		tgt := hcl.servers[(start+i)%numServers]
+		if now.Before(tgt.deadUntil) {
+			dead = append(dead, tgt)
+		} else {
+			live = append(live, tgt)
+		}
+	}
+	if len(live) == 0 {
+		return dead
+	}
+	return live
+}
+
+// Get the target for a specific REST address.  If the address is not one of
+// the configured servers, the target is not tracked.
+func (hcl *Client) targetAt(restAddr string) ([]*serverTarget, error) {
+	addr, err := conf.NormalizeAddress(conf.HTRACE_WEB_ADDRESS, restAddr)
+	if err != nil {
+		return nil, err
+	}
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	for _, tgt := range hcl.servers {
+		if tgt.restAddr == addr {
+			return []*serverTarget{tgt}, nil
+		}
+	}
+	return []*serverTarget{&serverTarget{restAddr: addr}}, nil
+}
+
+// Record whether we managed to reach a server.
+func (hcl *Client) recordAttempt(tgt *serverTarget, unreachable bool) {
+	hcl.mtr.recordServer(tgt.restAddr, unreachable)
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	if !unreachable {
+		tgt.failures = 0
+		tgt.deadUntil = time.Time{}
+		return
+	}
+	tgt.failures++
+	// The server may be restarted with a different version before we reach
+	// it again.
+	tgt.hrpcNegotiated = false
+	if tgt.failures >= hcl.maxFailures {
+		tgt.deadUntil = time.Now().Add(hcl.cooldown)
+	}
+}
+
+// Record whether a server is read-only.
+func (hcl *Client) setReadOnly(tgt *serverTarget, readOnly bool) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	tgt.readOnly = readOnly
+}
+
+// Record what a GetServerVersion response said about a server.
+func (hcl *Client) setServerInfo(tgt *serverTarget, info *common.ServerVersion) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	tgt.readOnly = info.ReadOnly
+	tgt.maxWriteSpans = info.MaxWriteSpans
+	tgt.maxWriteBytes = info.MaxWriteBytes
+}
+
+// Get the servers to try a write on.  Read-only servers are left out.
+func (hcl *Client) writeTargets() ([]*serverTarget, []*serverTarget) {
+	all := hcl.targets(true)
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	writable := make([]*serverTarget, 0, len(all))
+	for _, tgt := range all {
+		if !tgt.readOnly {
+			writable = append(writable, tgt)
+		}
+	}
+	return writable, all
+}
+
+// Fill in the health of each server in a metrics snapshot.
+func (hcl *Client) fillServerMetrics(mtx *ClientMetrics) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	now := time.Now()
+	for _, tgt := range hcl.servers {
+		smtx := mtx.Servers[tgt.restAddr]
+		if smtx == nil {
+			smtx = &ServerMetrics{}
+			mtx.Servers[tgt.restAddr] = smtx
+		}
+		smtx.Dead = now.Before(tgt.deadUntil)
+		smtx.ReadOnly = tgt.readOnly
+		if st := &tgt.adaptive; st.batchSpans != 0 {
+			smtx.Circuit = st.circuit
+			smtx.BatchSpans = st.batchSpans
+			smtx.WriteDelayMs = int64(st.delay / time.Millisecond)
+			smtx.CircuitOpened = st.numOpened
+			smtx.BatchShrunk = st.numShrunk
+			smtx.BatchGrown = st.numGrown
+		}
+	}
+}
@@ -26,18 +26,51 @@ import (
 	"fmt"
 	"github.com/ugorji/go/codec"
 	"htrace/common"
+	"htrace/conf"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
+	"time"
 )
 
 type hClient struct {
 	rpcClient *rpc.Client
+	cdc       *HrpcClientCodec
+}
+
+// The arguments to a WriteSpans call.  The spans are already encoded as
+// msgpack.
+type writeSpansArgs struct {
+	numSpans int
+	encoded  []byte
+	metadata map[string]string
+	groups   []common.WriteGroup
 }
 
 type HrpcClientCodec struct {
-	rwc       io.ReadWriteCloser
-	length    uint32
+	rwc    net.Conn
+	length uint32
+
+	// The I/O timeout, or 0 if there is none.  Once we start writing a
+	// request, or reading a response, the rest of it must be transferred
+	// within this time, so that a stalled server can't hang the client.
+	ioTimeo time.Duration
+
+	// The buffer for reading response headers.
+	hdrBuf []byte
+
+	// The client metrics, which count oversized and malformed messages.
+	mtr *metricsTracker
+
+	// The methods we may call on this connection.  Until we have sent a
+	// Hello, we don't know which methods the server supports, so this has
+	// every method we know.
+	methods common.HrpcMethodSet
+
+	// The token to send with each WriteSpans request, or the empty string.
+	authToken string
+
 	testHooks *TestHooks
 }
 
@@ -47,6 +80,11 @@ func (cdc *HrpcClientCodec) WriteRequest(rr *rpc.Request, msg interface{}) error
 		return errors.New(fmt.Sprintf("HrpcClientCodec: Unknown method name %s",
 			rr.ServiceMethod))
 	}
+	if !cdc.methods.Contains(methodId) {
+		return common.NewHtraceError(common.ERR_UNSUPPORTED_METHOD, nil,
+			"HrpcClientCodec: the server doesn't support %s.",
+			rr.ServiceMethod)
+	}
 	mh := new(codec.MsgpackHandle)
 	mh.WriteExt = true
 	w := bytes.NewBuffer(make([]byte, 0, 2048))
@@ -54,22 +92,19 @@ func (cdc *HrpcClientCodec) WriteRequest(rr *rpc.Request, msg interface{}) error
 	var err error
 	enc := codec.NewEncoder(w, mh)
 	if methodId == common.METHOD_ID_WRITE_SPANS {
-		spans := msg.([]*common.Span)
+		args := msg.(*writeSpansArgs)
 		req := &common.WriteSpansReq{
-			NumSpans: len(spans),
+			NumSpans:  args.numSpans,
+			Metadata:  args.metadata,
+			AuthToken: cdc.authToken,
+			Groups:    args.groups,
 		}
 		err = enc.Encode(req)
 		if err != nil {
 			return errors.New(fmt.Sprintf("HrpcClientCodec: Unable to marshal "+
 				"message as msgpack: %s", err.Error()))
 		}
-		for spanIdx := range spans {
-			err = enc.Encode(spans[spanIdx])
-			if err != nil {
-				return errors.New(fmt.Sprintf("HrpcClientCodec: Unable to marshal "+
-					"span %d out of %d as msgpack: %s", spanIdx, len(spans), err.Error()))
-			}
-		}
+		w.Write(args.encoded)
 	} else {
 		err = enc.Encode(msg)
 		if err != nil {
@@ -79,9 +114,10 @@ func (cdc *HrpcClientCodec) WriteRequest(rr *rpc.Request, msg interface{}) error
 	}
 	buf := w.Bytes()
 	if len(buf) > common.MAX_HRPC_BODY_LENGTH {
-		return errors.New(fmt.Sprintf("HrpcClientCodec: message body is %d "+
-			"bytes, but the maximum message size is %d bytes.",
-			len(buf), common.MAX_HRPC_BODY_LENGTH))
+		return common.NewHtraceError(common.ERR_MESSAGE_TOO_LARGE, nil,
+			"HrpcClientCodec: message body is %d bytes, but the maximum "+
+				"message size is %d bytes.", len(buf),
+			common.MAX_HRPC_BODY_LENGTH)
 	}
 	hdr := common.HrpcRequestHeader{
 		Magic:    common.HRPC_MAGIC,
@@ -89,6 +125,7 @@ func (cdc *HrpcClientCodec) WriteRequest(rr *rpc.Request, msg interface{}) error
 		Seq:      rr.Seq,
 		Length:   uint32(len(buf)),
 	}
+	cdc.setDeadline(cdc.rwc.SetWriteDeadline)
 	err = binary.Write(cdc.rwc, binary.LittleEndian, &hdr)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error writing header bytes: %s",
@@ -105,21 +142,45 @@ func (cdc *HrpcClientCodec) WriteRequest(rr *rpc.Request, msg interface{}) error
 	return nil
 }
 
+// Set a read or write deadline of ioTimeo from now, if there is an I/O
+// timeout.
+func (cdc *HrpcClientCodec) setDeadline(set func(time.Time) error) {
+	if cdc.ioTimeo > 0 {
+		set(time.Now().Add(cdc.ioTimeo))
+	}
+}
+
 func (cdc *HrpcClientCodec) ReadResponseHeader(resp *rpc.Response) error {
 	hdr := common.HrpcResponseHeader{}
-	err := binary.Read(cdc.rwc, binary.LittleEndian, &hdr)
+	// The server may take a while to process the request before it starts
+	// sending the response, so the I/O timeout starts after the first byte.
+	var zeroTime time.Time
+	cdc.rwc.SetReadDeadline(zeroTime)
+	_, err := io.ReadFull(cdc.rwc, cdc.hdrBuf[0:1])
+	if err == nil {
+		cdc.setDeadline(cdc.rwc.SetReadDeadline)
+		_, err = io.ReadFull(cdc.rwc, cdc.hdrBuf[1:])
+	}
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error reading response header "+
 			"bytes: %s", err.Error()))
 	}
+	err = binary.Read(bytes.NewReader(cdc.hdrBuf), binary.LittleEndian, &hdr)
+	if err != nil {
+		cdc.mtr.recordMalformedFrame()
+		return errors.New(fmt.Sprintf("Error decoding response header: %s",
+			err.Error()))
+	}
 	resp.ServiceMethod = common.HrpcMethodIdToMethodName(hdr.MethodId)
 	if resp.ServiceMethod == "" {
+		cdc.mtr.recordMalformedFrame()
 		return errors.New(fmt.Sprintf("Error reading response header: "+
 			"invalid method ID %d.", hdr.MethodId))
 	}
 	resp.Seq = hdr.Seq
 	if hdr.ErrLength > 0 {
 		if hdr.ErrLength > common.MAX_HRPC_ERROR_LENGTH {
+			cdc.mtr.recordMalformedFrame()
 			return errors.New(fmt.Sprintf("Error reading response header: "+
 				"error message was %d bytes long, but "+
 				"MAX_HRPC_ERROR_LENGTH is %d.",
@@ -127,25 +188,36 @@ func (cdc *HrpcClientCodec) ReadResponseHeader(resp *rpc.Response) error {
 		}
 		buf := make([]byte, hdr.ErrLength)
 		var nread int
-		nread, err = cdc.rwc.Read(buf)
-		if uint32(nread) != hdr.ErrLength {
-			return errors.New(fmt.Sprintf("Error reading response header: "+
-				"failed to read %d bytes of error message.", nread))
-		}
+		nread, err = io.ReadFull(cdc.rwc, buf)
 		if err != nil {
 			return errors.New(fmt.Sprintf("Error reading response header: "+
-				"failed to read %d bytes of error message: %s",
-				nread, err.Error()))
+				"failed to read %d bytes of error message: only got %d: %s",
+				hdr.ErrLength, nread, err.Error()))
 		}
 		resp.Error = string(buf)
 	} else {
 		resp.Error = ""
 	}
 	cdc.length = hdr.Length
+	if cdc.length > common.MAX_HRPC_BODY_LENGTH {
+		cdc.mtr.recordMalformedFrame()
+		return errors.New(fmt.Sprintf("Error reading response header: "+
+			"response body was %d bytes long, but MAX_HRPC_BODY_LENGTH "+
+			"is %d.", cdc.length, common.MAX_HRPC_BODY_LENGTH))
+	}
 	return nil
 }
 
 func (cdc *HrpcClientCodec) ReadResponseBody(body interface{}) error {
+	if body == nil {
+		// net/rpc is skipping the body of an error response.
+		_, err := io.CopyN(ioutil.Discard, cdc.rwc, int64(cdc.length))
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to skip response body: %s",
+				err.Error()))
+		}
+		return nil
+	}
 	mh := new(codec.MsgpackHandle)
 	mh.WriteExt = true
 	dec := codec.NewDecoder(io.LimitReader(cdc.rwc, int64(cdc.length)), mh)
@@ -154,6 +226,8 @@ func (cdc *HrpcClientCodec) ReadResponseBody(body interface{}) error {
 		return errors.New(fmt.Sprintf("Failed to read response body: %s",
 			err.Error()))
 	}
+	var zeroTime time.Time
+	cdc.rwc.SetReadDeadline(zeroTime)
 	return nil
 }
 
@@ -161,23 +235,120 @@ func (cdc *HrpcClientCodec) Close() error {
 	return cdc.rwc.Close()
 }
 
-func newHClient(hrpcAddr string, testHooks *TestHooks) (*hClient, error) {
+func newHClient(hrpcAddr string, authToken string, ioTimeo time.Duration,
+	mtr *metricsTracker, testHooks *TestHooks) (*hClient, error) {
 	hcr := hClient{}
-	conn, err := net.Dial("tcp", hrpcAddr)
+	network, addr := conf.NetworkAddress(hrpcAddr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("Error contacting the HRPC server "+
 			"at %s: %s", hrpcAddr, err.Error()))
 	}
-	hcr.rpcClient = rpc.NewClientWithCodec(&HrpcClientCodec{
+	hcr.cdc = &HrpcClientCodec{
 		rwc:       conn,
+		ioTimeo:   ioTimeo,
+		hdrBuf:    make([]byte, binary.Size(&common.HrpcResponseHeader{})),
+		mtr:       mtr,
+		methods:   common.HRPC_ALL_METHODS,
+		authToken: authToken,
 		testHooks: testHooks,
-	})
+	}
+	hcr.rpcClient = rpc.NewClientWithCodec(hcr.cdc)
 	return &hcr, nil
 }
 
-func (hcr *hClient) writeSpans(spans []*common.Span) error {
+// Make an HRPC call.
+func (hcr *hClient) call(method string, args interface{},
+	reply interface{}) error {
+	return hcr.checkError(hcr.rpcClient.Call(method, args, reply))
+}
+
+// Turn the error from an HRPC call into an HtraceError, if the server sent a
+// code with it.
+func (hcr *hClient) checkError(err error) error {
+	if serr, ok := err.(rpc.ServerError); ok {
+		// Errors from newer servers start with an error code.
+		herr := common.ParseHtraceError(string(serr))
+		if herr != nil {
+			err = herr
+		}
+	}
+	if common.ErrorCodeOf(err) == common.ERR_MESSAGE_TOO_LARGE {
+		hcr.cdc.mtr.recordOversizedMessage()
+	}
+	return err
+}
+
+// Tell the server which methods we support, and find out which methods it
+// supports.  From then on, we only call methods which both sides support.
+func (hcr *hClient) hello() (*common.HrpcHelloResp, error) {
+	resp := common.HrpcHelloResp{}
+	err := hcr.call(common.METHOD_NAME_HELLO, &common.HrpcHelloReq{
+		ProtocolVersion: common.HRPC_PROTOCOL_VERSION,
+		Methods:         common.HRPC_ALL_METHODS,
+	}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	hcr.setMethods(resp.Methods)
+	return &resp, nil
+}
+
+// Limit the methods we call on this connection.  This must not be called
+// concurrently with requests.
+func (hcr *hClient) setMethods(methods common.HrpcMethodSet) {
+	hcr.cdc.methods = methods & common.HRPC_ALL_METHODS
+}
+
+// Send a WriteSpans request without waiting for the answer.  The call is sent
+// on done once the server answers it, or the connection breaks.  Calls may
+// finish in a different order than they were started.  Use writeSpansResult
+// to get the outcome.
+func (hcr *hClient) startWriteSpans(numSpans int, encoded []byte,
+	metadata map[string]string, groups []common.WriteGroup,
+	done chan *rpc.Call) *rpc.Call {
+	return hcr.rpcClient.Go(common.METHOD_NAME_WRITE_SPANS,
+		&writeSpansArgs{numSpans: numSpans, encoded: encoded,
+			metadata: metadata, groups: groups}, &common.WriteSpansResp{},
+		done)
+}
+
+// Get the outcome of a call started by startWriteSpans.  If the connection
+// broke before the server answered, the error is ERR_CONNECTION_LOST, since
+// the request can be sent again.  This is also the error for calls started
+// after the connection broke.
+func (hcr *hClient) writeSpansResult(call *rpc.Call) (*common.WriteSpansResp,
+	error) {
+	if call.Error == nil {
+		return call.Reply.(*common.WriteSpansResp), nil
+	}
+	err := hcr.checkError(call.Error)
+	if _, ok := err.(*common.HtraceError); ok || hcr.isServerError(err) {
+		return nil, err
+	}
+	return nil, common.NewHtraceError(common.ERR_CONNECTION_LOST, nil,
+		"The HRPC connection broke before the server answered: %s",
+		err.Error())
+}
+
+func (hcr *hClient) writeSpans(numSpans int, encoded []byte,
+	metadata map[string]string,
+	groups []common.WriteGroup) (*common.WriteSpansResp, error) {
 	resp := common.WriteSpansResp{}
-	return hcr.rpcClient.Call(common.METHOD_NAME_WRITE_SPANS, spans, &resp)
+	err := hcr.call(common.METHOD_NAME_WRITE_SPANS,
+		&writeSpansArgs{numSpans: numSpans, encoded: encoded,
+			metadata: metadata, groups: groups}, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Returns true if the error was sent by the server, rather than coming from a
+// broken connection.
+func (hcr *hClient) isServerError(err error) bool {
+	_, ok := err.(rpc.ServerError)
+	return ok
 }
 
 func (hcr *hClient) Close() {
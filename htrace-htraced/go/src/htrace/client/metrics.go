@@ -0,0 +1,414 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"htrace/common"
+	"math"
+	"sync"
+	"time"
+)
+
+//
+// Client-side metrics.
+//
+// The client keeps track of how many requests it has made, how many of them
+// failed, and how long they took.  Applications which embed the client can
+// retrieve a snapshot of these metrics via Client#Metrics.
+//
+
+// The names of the endpoints we keep metrics for.
+const (
+	ENDPOINT_WRITE_SPANS        = "writeSpans"
+	ENDPOINT_QUERY              = "query"
+	ENDPOINT_QUERY_GROUPED      = "queryGrouped"
+	ENDPOINT_QUERY_PAGE         = "queryPage"
+	ENDPOINT_FIND_SPAN          = "findSpan"
+	ENDPOINT_FIND_CHILDREN      = "findChildren"
+	ENDPOINT_SERVER_INFO        = "serverInfo"
+	ENDPOINT_SERVER_STATS       = "serverStats"
+	ENDPOINT_CLIENT_STATS       = "clientStats"
+	ENDPOINT_SERVER_CONF        = "serverConf"
+	ENDPOINT_SERVER_CONF_RELOAD = "serverConfReload"
+	ENDPOINT_SERVER_DEBUGINFO   = "serverDebugInfo"
+	ENDPOINT_SPANS_CHANGED      = "spansChanged"
+	ENDPOINT_HEARTBEATS         = "heartbeats"
+	ENDPOINT_FLAME_TREE         = "flameTree"
+	ENDPOINT_TRACE_BUNDLE       = "traceBundle"
+	ENDPOINT_FIND_LINKED_SPANS  = "findLinkedSpans"
+	ENDPOINT_SERVER_HEALTH      = "serverHealth"
+	ENDPOINT_WATERMARK          = "watermark"
+	ENDPOINT_SHARD_RETRY        = "shardRetry"
+	ENDPOINT_INGEST_PAUSE       = "ingestPause"
+	ENDPOINT_INGEST_RESUME      = "ingestResume"
+	ENDPOINT_SPANS_BY_SEQ       = "spansBySeq"
+	ENDPOINT_SERVICE_MAP        = "serviceMap"
+	ENDPOINT_AUDIT              = "audit"
+	ENDPOINT_ACTIVE_SPANS       = "activeSpans"
+	ENDPOINT_SNAPSHOT           = "snapshot"
+	ENDPOINT_SNAPSHOT_STATUS    = "snapshotStatus"
+	ENDPOINT_QUOTAS             = "quotas"
+	ENDPOINT_CANARY             = "canary"
+	ENDPOINT_CHAOS              = "chaos"
+	ENDPOINT_STATS_HISTORY      = "statsHistory"
+	ENDPOINT_REJECTIONS         = "rejections"
+	ENDPOINT_CLEAR_REJECTIONS   = "clearRejections"
+	ENDPOINT_LOCKS              = "locks"
+	ENDPOINT_DISTINCT_VALUES    = "distinctValues"
+	ENDPOINT_DESCRIPTION_STATS  = "descriptionStats"
+	ENDPOINT_TRACER_RENAME      = "tracerRename"
+	ENDPOINT_RENAME_STATUS      = "renameStatus"
+	ENDPOINT_SLOS               = "slos"
+	ENDPOINT_DEFINE_SLO         = "defineSlo"
+	ENDPOINT_DELETE_SLO         = "deleteSlo"
+	ENDPOINT_SCAN_JOB           = "scanJob"
+	ENDPOINT_SCAN_JOB_STATUS    = "scanJobStatus"
+	ENDPOINT_CANCEL_SCAN_JOB    = "cancelScanJob"
+	ENDPOINT_EXPORT_ZIPKIN      = "exportZipkin"
+	ENDPOINT_TAG_TRACE          = "tagTrace"
+	ENDPOINT_TRACE_TAGS         = "traceTags"
+	ENDPOINT_FIND_TAGGED_TRACES = "findTracesByTag"
+	ENDPOINT_SAVE_SEARCH        = "saveSearch"
+	ENDPOINT_SAVED_SEARCHES     = "savedSearches"
+	ENDPOINT_RUN_SAVED_SEARCH   = "runSavedSearch"
+	ENDPOINT_DELETE_SEARCH      = "deleteSavedSearch"
+	ENDPOINT_REPLAY_PLAN        = "replayQueryPlan"
+	ENDPOINT_EXPLAIN_QUERY      = "explainQuery"
+	ENDPOINT_QUERY_TIME_SERIES  = "queryTimeSeries"
+	ENDPOINT_WRITE_GROUP        = "writeGroup"
+)
+
+// The transports that a request can be made over.
+const (
+	TRANSPORT_REST = "rest"
+	TRANSPORT_HRPC = "hrpc"
+)
+
+// The number of latencies we keep for each endpoint.
+const CLIENT_LATENCY_CIRC_BUF_SIZE = 256
+
+// A function which the client calls each time a request fails.
+// The endpoint is one of the ENDPOINT_* constants.
+type RequestFailureCallback func(endpoint string, err error)
+
+// Metrics about a particular endpoint.
+type EndpointMetrics struct {
+	// The total number of requests made to this endpoint.
+	Requests uint64
+
+	// The total number of requests to this endpoint which failed.
+	Failures uint64
+
+	// The maximum latency of a recent request, in milliseconds.
+	MaxLatencyMs uint32
+
+	// The average latency of recent requests, in milliseconds.
+	AverageLatencyMs uint32
+}
+
+// Metrics about a particular server.
+type ServerMetrics struct {
+	// The total number of requests we tried to send to this server.
+	Requests uint64
+
+	// The total number of those requests which failed because the server
+	// could not be reached.
+	Unreachable uint64
+
+	// True if the server is currently considered dead, so that requests skip
+	// it.
+	Dead bool
+
+	// True if the server is known to be read-only, so that writes skip it.
+	ReadOnly bool
+
+	// The rest is only filled in once an adaptive write has been sent to
+	// the server.  See client.adaptive.enabled.
+
+	// The state of the circuit to the server: one of the CIRCUIT_*
+	// constants.
+	Circuit string
+
+	// The number of spans the next request to the server will hold, and
+	// how long to wait between requests.
+	BatchSpans   int
+	WriteDelayMs int64
+
+	// The number of times the circuit has opened, and the number of times
+	// the request size shrank and grew.
+	CircuitOpened uint64
+	BatchShrunk   uint64
+	BatchGrown    uint64
+}
+
+// A snapshot of the client metrics.
+type ClientMetrics struct {
+	// The total number of spans which were successfully written.
+	SpansWritten uint64
+
+	// The total number of spans which we failed to write.
+	SpansFailed uint64
+
+	// The total number of spans which the server accepted, but dropped
+	// because their tracer was over a quota with the reject policy.  These
+	// are also counted in SpansWritten.
+	QuotaRejectedSpans uint64
+
+	// The total number of spans which the server accepted, but dropped
+	// because their tracer was over a quota with the sample policy.  These
+	// are also counted in SpansWritten.
+	QuotaSampledOutSpans uint64
+
+	// The total number of spans which WriteSpans dropped before sending
+	// them, because a later span in the same call had the same ID.  See
+	// client.write.dedupe.
+	DuplicateSpansDropped uint64
+
+	// The total number of spans which WriteSpans dropped before sending
+	// them, because the server would have rejected them.  See
+	// client.write.validate.
+	InvalidSpansDropped uint64
+
+	// The total number of requests made over REST.
+	RestRequests uint64
+
+	// The total number of requests made over HRPC.
+	HrpcRequests uint64
+
+	// The total number of HRPC requests which were too big to send, or which
+	// the server rejected as too big.
+	HrpcOversizedMessages uint64
+
+	// The total number of HRPC responses whose frames we couldn't parse.
+	HrpcMalformedFrames uint64
+
+	// Metrics for each endpoint, keyed by endpoint name.
+	Endpoints map[string]*EndpointMetrics
+
+	// Metrics for each server, keyed by REST address.
+	Servers map[string]*ServerMetrics
+}
+
+// The metrics tracked for a single endpoint.
+type endpointTracker struct {
+	requests  uint64
+	failures  uint64
+	latencies *common.CircBufU32
+}
+
+// Keeps track of client metrics.  All fields are protected by the lock, so
+// that Client#Metrics can return a consistent snapshot.
+type metricsTracker struct {
+	lock sync.Mutex
+
+	spansWritten uint64
+
+	spansFailed uint64
+
+	quotaRejectedSpans uint64
+
+	quotaSampledOutSpans uint64
+
+	duplicateSpansDropped uint64
+
+	invalidSpansDropped uint64
+
+	restRequests uint64
+
+	hrpcRequests uint64
+
+	hrpcOversizedMessages uint64
+
+	hrpcMalformedFrames uint64
+
+	endpoints map[string]*endpointTracker
+
+	servers map[string]*ServerMetrics
+
+	// The callback to invoke on failed requests, or nil.
+	failureCb RequestFailureCallback
+
+	// The callback to invoke on adaptive state changes, or nil.
+	stateCb AdaptiveStateCallback
+}
+
+func newMetricsTracker() *metricsTracker {
+	return &metricsTracker{
+		endpoints: make(map[string]*endpointTracker),
+		servers:   make(map[string]*ServerMetrics),
+	}
+}
+
+func (mtr *metricsTracker) setFailureCallback(cb RequestFailureCallback) {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.failureCb = cb
+}
+
+func (mtr *metricsTracker) setStateCallback(cb AdaptiveStateCallback) {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.stateCb = cb
+}
+
+// Report a change to the adaptive state of a server, unless nothing changed.
+func (mtr *metricsTracker) reportStateChange(change *AdaptiveStateChange) {
+	if change.Server == "" {
+		return
+	}
+	mtr.lock.Lock()
+	cb := mtr.stateCb
+	mtr.lock.Unlock()
+	if cb != nil {
+		cb(change)
+	}
+}
+
+// Record the result of a request.  This is intended to be deferred, so it
+// takes a pointer to the request's error return value.
+func (mtr *metricsTracker) record(endpoint string, transport string,
+	startTime time.Time, err *error) {
+	mtr.recordImpl(endpoint, transport, 0, startTime, *err)
+}
+
+// Record the result of a WriteSpans request.
+func (mtr *metricsTracker) recordWriteSpans(transport string, numSpans int,
+	startTime time.Time, err *error) {
+	mtr.recordImpl(ENDPOINT_WRITE_SPANS, transport, numSpans, startTime, *err)
+}
+
+// Record the spans which a server dropped because of quotas.
+func (mtr *metricsTracker) recordQuotaDropped(resp *common.WriteSpansResp) {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.quotaRejectedSpans += uint64(resp.QuotaRejected)
+	mtr.quotaSampledOutSpans += uint64(resp.QuotaSampledOut)
+}
+
+// Record the spans which a write dropped before sending them.
+func (mtr *metricsTracker) recordPrepared(numDuplicate, numInvalid int) {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.duplicateSpansDropped += uint64(numDuplicate)
+	mtr.invalidSpansDropped += uint64(numInvalid)
+}
+
+// Record an HRPC request which was too big to send, or which the server
+// rejected as too big.
+func (mtr *metricsTracker) recordOversizedMessage() {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.hrpcOversizedMessages++
+}
+
+// Record an HRPC response frame which we couldn't parse.
+func (mtr *metricsTracker) recordMalformedFrame() {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtr.hrpcMalformedFrames++
+}
+
+// Record an attempt to send a request to a server.
+func (mtr *metricsTracker) recordServer(restAddr string, unreachable bool) {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	smtx := mtr.servers[restAddr]
+	if smtx == nil {
+		smtx = &ServerMetrics{}
+		mtr.servers[restAddr] = smtx
+	}
+	smtx.Requests++
+	if unreachable {
+		smtx.Unreachable++
+	}
+}
+
+func (mtr *metricsTracker) recordImpl(endpoint string, transport string,
+	numSpans int, startTime time.Time, err error) {
+	latencyMs := time.Since(startTime).Nanoseconds() / 1000000
+	var latency32 uint32
+	if latencyMs > math.MaxUint32 {
+		latency32 = math.MaxUint32
+	} else {
+		latency32 = uint32(latencyMs)
+	}
+	cb := func() RequestFailureCallback {
+		mtr.lock.Lock()
+		defer mtr.lock.Unlock()
+		if transport == TRANSPORT_HRPC {
+			mtr.hrpcRequests++
+		} else {
+			mtr.restRequests++
+		}
+		etr := mtr.endpoints[endpoint]
+		if etr == nil {
+			etr = &endpointTracker{
+				latencies: common.NewCircBufU32(CLIENT_LATENCY_CIRC_BUF_SIZE),
+			}
+			mtr.endpoints[endpoint] = etr
+		}
+		etr.requests++
+		etr.latencies.Append(latency32)
+		if err == nil {
+			mtr.spansWritten += uint64(numSpans)
+			return nil
+		}
+		mtr.spansFailed += uint64(numSpans)
+		etr.failures++
+		return mtr.failureCb
+	}()
+	// Invoke the callback without holding the lock, so that it can call
+	// Client#Metrics if it wants to.
+	if cb != nil {
+		cb(endpoint, err)
+	}
+}
+
+func (mtr *metricsTracker) snapshot() *ClientMetrics {
+	mtr.lock.Lock()
+	defer mtr.lock.Unlock()
+	mtx := &ClientMetrics{
+		SpansWritten:          mtr.spansWritten,
+		SpansFailed:           mtr.spansFailed,
+		QuotaRejectedSpans:    mtr.quotaRejectedSpans,
+		QuotaSampledOutSpans:  mtr.quotaSampledOutSpans,
+		DuplicateSpansDropped: mtr.duplicateSpansDropped,
+		InvalidSpansDropped:   mtr.invalidSpansDropped,
+		RestRequests:          mtr.restRequests,
+		HrpcRequests:          mtr.hrpcRequests,
+		HrpcOversizedMessages: mtr.hrpcOversizedMessages,
+		HrpcMalformedFrames:   mtr.hrpcMalformedFrames,
+		Endpoints:             make(map[string]*EndpointMetrics, len(mtr.endpoints)),
+		Servers:               make(map[string]*ServerMetrics, len(mtr.servers)),
+	}
+	for k, v := range mtr.servers {
+		smtx := *v
+		mtx.Servers[k] = &smtx
+	}
+	for k, v := range mtr.endpoints {
+		mtx.Endpoints[k] = &EndpointMetrics{
+			Requests:         v.requests,
+			Failures:         v.failures,
+			MaxLatencyMs:     v.latencies.Max(),
+			AverageLatencyMs: v.latencies.Average(),
+		}
+	}
+	return mtx
+}
@@ -0,0 +1,187 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"htrace/common"
+)
+
+//
+// HRPC method negotiation.
+//
+// Servers and clients of different versions support different HRPC methods.
+// The first time the client connects to a server over HRPC, it sends a Hello
+// saying which methods it supports, and the server answers with the methods
+// it supports.  The client remembers the methods which both sides support for
+// each server, and only calls those methods.  Requests which would need a
+// method the server doesn't support go over REST instead.
+//
+// Version 0 servers don't know Hello, and close the connection when they get
+// one.  When that happens, the client connects again, and assumes that the
+// server supports only WriteSpans.  Version 1 servers answer requests for
+// methods they don't support with ERR_UNSUPPORTED_METHOD, and keep the
+// connection open.  If a server rejects a method which we thought it
+// supported, we stop using it.
+//
+// Version 2 servers also say in the Hello response how many WriteSpans
+// requests the client may have in flight at once on the connection.  When a
+// write is split into several requests, the client sends them over one
+// connection, up to that many at a time, or client.hrpc.max.in.flight if that
+// is fewer; see batch.go.  Older servers don't say, and get one request at a
+// time on each connection, as before.
+//
+// Since the server may be upgraded or downgraded while it is down, the client
+// forgets what it learned about a server whenever it fails to reach it.
+//
+
+// What the client knows about how it talks to a server.
+type TransportInfo struct {
+	// The REST address of the server.
+	RestAddr string
+
+	// The HRPC address of the server, or the empty string if the client
+	// doesn't use HRPC.
+	HrpcAddr string
+
+	// True if the client has found out which HRPC methods the server
+	// supports.  The client does this the first time it needs HRPC.
+	Negotiated bool
+
+	// The HRPC protocol version of the server.  This is 0 for servers which
+	// don't support negotiation.
+	HrpcProtocolVersion uint32
+
+	// The HRPC methods which both the client and the server support.
+	HrpcMethods []string
+
+	// The number of WriteSpans requests the server lets the client have in
+	// flight at once on one connection.  This is 0 for servers which don't
+	// support pipelining.
+	HrpcMaxInFlight uint32
+}
+
+// Get what the client knows about how it talks to each server, in the order
+// the servers were configured.
+func (hcl *Client) TransportInfo() []TransportInfo {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	infos := make([]TransportInfo, len(hcl.servers))
+	for i, tgt := range hcl.servers {
+		infos[i] = TransportInfo{
+			RestAddr:   tgt.restAddr,
+			HrpcAddr:   tgt.hrpcAddr,
+			Negotiated: tgt.hrpcNegotiated,
+		}
+		if tgt.hrpcNegotiated {
+			infos[i].HrpcProtocolVersion = tgt.hrpcVersion
+			infos[i].HrpcMethods = tgt.hrpcMethods.Names()
+			infos[i].HrpcMaxInFlight = tgt.hrpcMaxInFlight
+		}
+	}
+	return infos
+}
+
+// Returns true if writes to the server should use HRPC.  If we haven't
+// negotiated with the server yet, we assume that it supports HRPC writes,
+// since every version of the server does unless it has been told otherwise.
+func (hcl *Client) hrpcWrites(tgt *serverTarget) bool {
+	if tgt.hrpcAddr == "" {
+		return false
+	}
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	return !tgt.hrpcNegotiated ||
+		tgt.hrpcMethods.Contains(common.METHOD_ID_WRITE_SPANS)
+}
+
+// Record the HRPC methods which we can use with a server, and how many
+// requests it lets us pipeline.
+func (hcl *Client) setHrpcMethods(tgt *serverTarget, version uint32,
+	methods common.HrpcMethodSet, maxInFlight uint32) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	tgt.hrpcNegotiated = true
+	tgt.hrpcVersion = version
+	tgt.hrpcMethods = methods
+	tgt.hrpcMaxInFlight = maxInFlight
+}
+
+// Get the number of WriteSpans requests to have in flight at once on one HRPC
+// connection to a server.  Returns 1 if we haven't negotiated with the server
+// yet, since we don't know whether it allows pipelining.
+func (hcl *Client) hrpcPipelineDepth(tgt *serverTarget) int {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	if !tgt.hrpcNegotiated || tgt.hrpcMaxInFlight == 0 {
+		return 1
+	}
+	depth := hcl.hrpcMaxInFlight
+	if uint32(depth) > tgt.hrpcMaxInFlight {
+		depth = int(tgt.hrpcMaxInFlight)
+	}
+	return depth
+}
+
+// Record that a server rejected a method which we thought it supported.
+func (hcl *Client) removeHrpcMethod(tgt *serverTarget, methodId uint32) {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	if tgt.hrpcNegotiated {
+		tgt.hrpcMethods &^= 1 << methodId
+	}
+}
+
+// Connect to a server over HRPC.  If we don't know yet which methods the
+// server supports, we find out first.  An error means that the server could
+// not be reached.
+func (hcl *Client) dialHrpc(tgt *serverTarget) (*hClient, error) {
+	hcr, err := newHClient(tgt.hrpcAddr, hcl.authToken, hcl.hrpcIoTimeo,
+		hcl.mtr, hcl.testHooks)
+	if err != nil {
+		return nil, err
+	}
+	hcl.lock.Lock()
+	negotiated := tgt.hrpcNegotiated
+	methods := tgt.hrpcMethods
+	hcl.lock.Unlock()
+	if negotiated {
+		hcr.setMethods(methods)
+		return hcr, nil
+	}
+	resp, err := hcr.hello()
+	if err == nil {
+		hcl.setHrpcMethods(tgt, resp.ProtocolVersion, hcr.cdc.methods,
+			resp.MaxInFlight)
+		return hcr, nil
+	}
+	if common.ErrorCodeOf(err) == common.ERR_UNKNOWN && !hcr.isServerError(err) {
+		// Version 0 servers close the connection when they get a Hello.
+		// Connect again, without one.
+		hcr.Close()
+		hcr, err = newHClient(tgt.hrpcAddr, hcl.authToken, hcl.hrpcIoTimeo,
+			hcl.mtr, hcl.testHooks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hcr.setMethods(common.HRPC_LEGACY_METHODS)
+	hcl.setHrpcMethods(tgt, 0, common.HRPC_LEGACY_METHODS, 0)
+	return hcr, nil
+}
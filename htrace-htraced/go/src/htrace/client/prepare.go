@@ -0,0 +1,210 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"htrace/common"
+	"sort"
+)
+
+//
+// Preparing the spans of a write.
+//
+// Before the spans of a write are encoded, the client can clean them up.
+// Each step is off by default, and has its own configuration key and setter:
+//
+// * client.write.validate drops nil spans, and spans which the server would
+//   reject for their span ID or the size of their unknown fields.  The checks
+//   are the ones the server makes; see common.FindSpanProblem.  Spans which
+//   end before they begin are left to the server, since whether it rejects
+//   them depends on its configuration.
+//
+// * client.write.dedupe drops spans with the same ID as a later span in the
+//   write, so that only the last one is sent.
+//
+// * client.write.sort sorts the spans by span ID, so that the server's writes
+//   are closer together.
+//
+// * client.write.group.by.trace declares a write group for each trace with
+//   more than one span in the write.  A span's trace is found by following
+//   its first parent for as long as the parent is in the write.  The group
+//   is named after the span this ends at, and its members are the spans
+//   which end there.  Writes which declare their own groups are left alone.
+//
+// The dropped spans are counted in the client metrics, but are not reported
+// as undelivered.  Undelivered ranges are given in terms of the spans the
+// caller passed in, not the prepared ones.
+//
+
+// What to do to the spans of a write before sending them.
+type writePrep struct {
+	dedupe       bool
+	sort         bool
+	validate     bool
+	groupByTrace bool
+}
+
+// Declare a write group for each trace with more than one span.  See
+// client.write.group.by.trace.
+func groupsByTrace(spans []*common.Span) []common.WriteGroup {
+	last := make(map[string]int, len(spans))
+	for i, span := range spans {
+		if span != nil {
+			last[string(span.Id)] = i
+		}
+	}
+	members := make(map[string][]common.SpanId)
+	order := make([]string, 0)
+	for i, span := range spans {
+		if span == nil || last[string(span.Id)] != i {
+			continue
+		}
+		root := span
+		for steps := 0; steps < len(spans) && len(root.Parents) > 0; steps++ {
+			j, ok := last[string(root.Parents[0])]
+			if !ok {
+				break
+			}
+			root = spans[j]
+		}
+		key := string(root.Id)
+		if members[key] == nil {
+			order = append(order, key)
+		}
+		members[key] = append(members[key], span.Id)
+	}
+	groups := make([]common.WriteGroup, 0)
+	for _, key := range order {
+		ids := members[key]
+		if len(ids) < 2 {
+			continue
+		}
+		groups = append(groups, common.WriteGroup{
+			Id:      common.SpanId(key).String(),
+			Size:    len(ids),
+			SpanIds: ids,
+		})
+	}
+	return groups
+}
+
+// The spans of a write, ready to be sent.
+type preparedSpans struct {
+	spans []*common.Span
+
+	// The index each span had in the spans passed to the write, or nil if
+	// the spans were not changed.
+	origIdx []int
+
+	// The number of spans dropped because a later span had the same ID.
+	numDuplicate int
+
+	// The number of spans dropped because the server would reject them.
+	numInvalid int
+}
+
+// Get the write preparation settings.
+func (hcl *Client) getWritePrep() writePrep {
+	hcl.lock.Lock()
+	defer hcl.lock.Unlock()
+	return hcl.writePrep
+}
+
+func (prep writePrep) prepare(spans []*common.Span) *preparedSpans {
+	ps := &preparedSpans{spans: spans}
+	if !(prep.dedupe || prep.sort || prep.validate) {
+		return ps
+	}
+	ps.spans = make([]*common.Span, 0, len(spans))
+	ps.origIdx = make([]int, 0, len(spans))
+	var last map[string]int
+	if prep.dedupe {
+		last = make(map[string]int, len(spans))
+		for i, span := range spans {
+			if span != nil {
+				last[string(span.Id)] = i
+			}
+		}
+	}
+	for i, span := range spans {
+		if prep.validate {
+			if span == nil {
+				ps.numInvalid++
+				continue
+			}
+			if reason, _ := common.FindSpanProblem(span, false); reason != "" {
+				ps.numInvalid++
+				continue
+			}
+		}
+		if prep.dedupe && span != nil && last[string(span.Id)] != i {
+			ps.numDuplicate++
+			continue
+		}
+		ps.spans = append(ps.spans, span)
+		ps.origIdx = append(ps.origIdx, i)
+	}
+	if prep.sort {
+		sort.Stable(ps)
+	}
+	return ps
+}
+
+func (ps *preparedSpans) Len() int {
+	return len(ps.spans)
+}
+
+// Nil spans sort first.  They can only be here if validation is off, and the
+// write will fail anyway.
+func (ps *preparedSpans) Less(i, j int) bool {
+	if ps.spans[i] == nil || ps.spans[j] == nil {
+		return ps.spans[j] != nil
+	}
+	return ps.spans[i].Id.Compare(ps.spans[j].Id) < 0
+}
+
+func (ps *preparedSpans) Swap(i, j int) {
+	ps.spans[i], ps.spans[j] = ps.spans[j], ps.spans[i]
+	ps.origIdx[i], ps.origIdx[j] = ps.origIdx[j], ps.origIdx[i]
+}
+
+// Translate ranges of indexes into the prepared spans into ranges of indexes
+// into the spans passed to the write.  The result is in order, with adjacent
+// ranges merged.
+func (ps *preparedSpans) origRanges(ranges []SpanRange) []SpanRange {
+	if ps.origIdx == nil {
+		return ranges
+	}
+	idxs := make([]int, 0)
+	for _, r := range ranges {
+		idxs = append(idxs, ps.origIdx[r.Begin:r.End]...)
+	}
+	sort.Ints(idxs)
+	orig := make([]SpanRange, 0, len(ranges))
+	for _, idx := range idxs {
+		last := len(orig) - 1
+		if last >= 0 && orig[last].End == idx {
+			orig[last].End = idx + 1
+		} else {
+			orig = append(orig, SpanRange{Begin: idx, End: idx + 1})
+		}
+	}
+	return orig
+}
@@ -0,0 +1,265 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// The replicator tails the spans arriving at one htraced server and writes
+// them to another.  This can be used to keep a warm standby server up to date.
+//
+// The replicator keeps track of its position in the source server's span
+// stream with an opaque cursor.  If a cursor path is configured, the cursor is
+// persisted there after each batch is written to the destination, so that the
+// replicator can resume where it left off after a restart.  Because the cursor
+// is only saved after the batch has been written, a batch may be written more
+// than once after a crash.  This is harmless, since writing the same span
+// twice just overwrites it.
+//
+// Deletions and expiry are not replicated.
+//
+
+type Replicator struct {
+	lg *common.Logger
+
+	// The client for the server we are replicating from.
+	src *Client
+
+	// The client for the server we are replicating to.
+	dst *Client
+
+	// How long to wait before polling again when there is nothing to do.
+	pollInterval time.Duration
+
+	// The maximum number of spans to fetch at once.
+	batchSize int
+
+	// The path to persist the cursor to, or the empty string if the cursor
+	// should not be persisted.
+	cursorPath string
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The current cursor.
+	cursor string
+
+	// The number of spans we have replicated.
+	replicatedSpans uint64
+
+	// True if the last poll found no new spans.
+	idle bool
+
+	// Closed when the replicator should exit.
+	shutdown chan interface{}
+
+	// Closed when the replicator goroutine has exited.
+	exited chan interface{}
+}
+
+// The contents of the cursor file.
+type replicatorState struct {
+	Cursor string
+}
+
+// Start replicating spans from the server described by srcCnf to the server
+// described by dstCnf.  The batch size and cursor path are taken from dstCnf.
+func ReplicateFrom(srcCnf *conf.Config, dstCnf *conf.Config,
+	pollInterval time.Duration) (*Replicator, error) {
+	batchSize, err := strconv.Atoi(dstCnf.Get(conf.HTRACE_REPLICATION_BATCH_SIZE))
+	if err != nil || batchSize <= 0 {
+		return nil, errors.New(fmt.Sprintf("Invalid %s: '%s'",
+			conf.HTRACE_REPLICATION_BATCH_SIZE,
+			dstCnf.Get(conf.HTRACE_REPLICATION_BATCH_SIZE)))
+	}
+	rep := &Replicator{
+		lg:           common.NewLogger("replicator", dstCnf),
+		pollInterval: pollInterval,
+		batchSize:    batchSize,
+		cursorPath:   dstCnf.Get(conf.HTRACE_REPLICATION_CURSOR_PATH),
+		shutdown:     make(chan interface{}),
+		exited:       make(chan interface{}),
+	}
+	rep.cursor, err = rep.loadCursor()
+	if err != nil {
+		rep.lg.Close()
+		return nil, err
+	}
+	rep.src, err = NewClient(srcCnf, nil)
+	if err != nil {
+		rep.lg.Close()
+		return nil, err
+	}
+	rep.dst, err = NewClient(dstCnf, nil)
+	if err != nil {
+		rep.src.Close()
+		rep.lg.Close()
+		return nil, err
+	}
+	rep.lg.Infof("Replicating from %s to %s, starting at cursor '%s'\n",
+		srcCnf.Get(conf.HTRACE_WEB_ADDRESS), dstCnf.Get(conf.HTRACE_WEB_ADDRESS),
+		rep.cursor)
+	go rep.run()
+	return rep, nil
+}
+
+// Load the cursor from the cursor file.  If there is no cursor file, we start
+// from the beginning.
+func (rep *Replicator) loadCursor() (string, error) {
+	if rep.cursorPath == "" {
+		return "", nil
+	}
+	buf, err := ioutil.ReadFile(rep.cursorPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", errors.New(fmt.Sprintf("Error reading replication cursor "+
+			"file %s: %s", rep.cursorPath, err.Error()))
+	}
+	var state replicatorState
+	err = json.Unmarshal(buf, &state)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Error parsing replication cursor "+
+			"file %s: %s", rep.cursorPath, err.Error()))
+	}
+	return state.Cursor, nil
+}
+
+// Save the cursor to the cursor file.  We write to a temporary file and then
+// rename it into place, so that the cursor file is never left half-written.
+func (rep *Replicator) saveCursor(cursor string) error {
+	if rep.cursorPath == "" {
+		return nil
+	}
+	buf, err := json.Marshal(&replicatorState{Cursor: cursor})
+	if err != nil {
+		return err
+	}
+	tmpPath := rep.cursorPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, rep.cursorPath)
+}
+
+func (rep *Replicator) run() {
+	defer func() {
+		rep.lg.Infof("Replicator exiting at cursor '%s'\n", rep.Cursor())
+		close(rep.exited)
+	}()
+	for {
+		progress, err := rep.replicateBatch()
+		if err != nil {
+			rep.lg.Errorf("Replication error: %s\n", err.Error())
+		}
+		rep.lock.Lock()
+		rep.idle = (err == nil) && !progress
+		rep.lock.Unlock()
+		if progress {
+			select {
+			case <-rep.shutdown:
+				return
+			default:
+				continue
+			}
+		}
+		select {
+		case <-rep.shutdown:
+			return
+		case <-time.After(rep.pollInterval):
+		}
+	}
+}
+
+// Fetch a batch of spans from the source and write them to the destination.
+// Returns true if the cursor advanced.
+func (rep *Replicator) replicateBatch() (bool, error) {
+	cursor := rep.Cursor()
+	resp, err := rep.src.FindSpansChangedSince(0, cursor, rep.batchSize)
+	if err != nil {
+		return false, err
+	}
+	if len(resp.Spans) > 0 {
+		err = rep.dst.WriteSpans(resp.Spans)
+		if err != nil {
+			return false, err
+		}
+	}
+	if resp.Cursor == cursor {
+		return false, nil
+	}
+	err = rep.saveCursor(resp.Cursor)
+	if err != nil {
+		return false, errors.New(fmt.Sprintf("Error saving replication "+
+			"cursor to %s: %s", rep.cursorPath, err.Error()))
+	}
+	rep.lock.Lock()
+	rep.cursor = resp.Cursor
+	rep.replicatedSpans += uint64(len(resp.Spans))
+	rep.lock.Unlock()
+	if rep.lg.DebugEnabled() {
+		rep.lg.Debugf("Replicated %d span(s).  New cursor is '%s'\n",
+			len(resp.Spans), resp.Cursor)
+	}
+	return true, nil
+}
+
+// Get the current replication cursor.
+func (rep *Replicator) Cursor() string {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	return rep.cursor
+}
+
+// Get the number of spans this replicator has written to the destination.
+func (rep *Replicator) ReplicatedSpans() uint64 {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	return rep.replicatedSpans
+}
+
+// Returns true if the last poll of the source found no new spans.
+func (rep *Replicator) Idle() bool {
+	rep.lock.Lock()
+	defer rep.lock.Unlock()
+	return rep.idle
+}
+
+// Stop replicating and release our resources.
+func (rep *Replicator) Close() {
+	close(rep.shutdown)
+	<-rep.exited
+	rep.src.Close()
+	rep.dst.Close()
+	rep.lg.Close()
+}
@@ -0,0 +1,78 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package client
+
+import (
+	"context"
+	"htrace/conf"
+	"net"
+	"net/http"
+	"sync"
+)
+
+//
+// Unix domain socket support.
+//
+// web.address and hrpc.address may name unix sockets, such as
+// "unix:///var/run/htraced.sock", for clients on the same host as htraced.
+// HRPC connections just dial the socket.  REST requests go through an HTTP
+// transport whose dialer connects to the socket, whatever host the request
+// URL names.  Like http.DefaultTransport, the transports are shared by every
+// client, so that their idle connections can be reused.
+//
+
+// The host we put in the URLs of REST requests sent over a unix socket.  The
+// transport ignores it.
+const UNIX_SOCKET_URL_HOST = "unix"
+
+var unixTransports struct {
+	lock sync.Mutex
+
+	// Maps socket paths to the transports which dial them.
+	byPath map[string]*http.Transport
+}
+
+// Get the URL and the HTTP client to use for a REST request to a server.
+func restEndpoint(restAddr string, reqName string) (string, *http.Client) {
+	network, path := conf.NetworkAddress(restAddr)
+	if network != "unix" {
+		return "http://" + restAddr + "/" + reqName, &http.Client{}
+	}
+	return "http://" + UNIX_SOCKET_URL_HOST + "/" + reqName,
+		&http.Client{Transport: unixTransport(path)}
+}
+
+func unixTransport(path string) *http.Transport {
+	unixTransports.lock.Lock()
+	defer unixTransports.lock.Unlock()
+	if unixTransports.byPath == nil {
+		unixTransports.byPath = make(map[string]*http.Transport)
+	}
+	transport := unixTransports.byPath[path]
+	if transport == nil {
+		transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", path)
+			},
+		}
+		unixTransports.byPath[path] = transport
+	}
+	return transport
+}
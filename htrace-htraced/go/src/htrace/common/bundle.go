@@ -0,0 +1,202 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A trace bundle is a single trace, exported from one htraced so that it can
+// be attached to a bug report and imported into another.  Since bundles are
+// meant to be read by people as well as programs, the spans use the Go field
+// names rather than the compact JSON names which the rest of the API uses.
+
+// The version of the trace bundle format.  Importers refuse bundles with a
+// newer version than they know about.
+const TRACE_BUNDLE_VERSION = 1
+
+// Describes the contents of a trace bundle.
+type TraceBundleManifest struct {
+	// The version of the bundle format.  See TRACE_BUNDLE_VERSION.
+	Version int
+
+	// The root of the trace.  If the parent chain of the requested span was
+	// broken, this is the highest ancestor which could be found.
+	RootId SpanId
+
+	// The span which was requested.
+	RequestedId SpanId
+
+	// The number of spans in the bundle.
+	NumSpans int
+
+	// The earliest begin time and the latest end time of the spans in the
+	// bundle, in milliseconds since the epoch.
+	BeginMs int64
+	EndMs   int64
+
+	// The time the bundle was created, in milliseconds since the epoch.
+	CreatedMs int64
+
+	// The version of the server which created the bundle.
+	ReleaseVersion string
+	GitVersion     string
+
+	// True if RootId is not a real root, because one of its parents could
+	// not be found, or the parent chain looped back on itself.
+	Incomplete bool `json:",omitempty"`
+
+	// The number of child span IDs which were in the parent index, but
+	// whose spans could not be found.
+	NumMissing int `json:",omitempty"`
+
+	// True if the trace had more spans than the server's bundle limit.
+	Truncated bool `json:",omitempty"`
+
+	// The tags of the trace.  Importing a bundle doesn't tag the trace.
+	Tags []string `json:",omitempty"`
+}
+
+// A span as it appears in a trace bundle.  Fields which the server computes
+// when a span is ingested are left out, since the importing server computes
+// them again.
+type VerboseSpan struct {
+	Id                  SpanId
+	Begin               int64
+	End                 int64
+	BeginNs             int64 `json:",omitempty"`
+	EndNs               int64 `json:",omitempty"`
+	Description         string
+	TracerId            string
+	Parents             []SpanId
+	Info                TraceInfoMap                `json:",omitempty"`
+	TimelineAnnotations []VerboseTimelineAnnotation `json:",omitempty"`
+	Links               []VerboseSpanLink           `json:",omitempty"`
+	Flags               SpanFlags                   `json:",omitempty"`
+	Extras              SpanExtras                  `json:",omitempty"`
+}
+
+type VerboseTimelineAnnotation struct {
+	Time int64
+	Msg  string
+}
+
+type VerboseSpanLink struct {
+	Id   SpanId
+	Type string `json:",omitempty"`
+}
+
+// Info returned by /span/{id}/bundle
+type TraceBundle struct {
+	Manifest TraceBundleManifest
+	Spans    []*VerboseSpan
+}
+
+func NewVerboseSpan(span *Span) *VerboseSpan {
+	vspan := &VerboseSpan{
+		Id:          span.Id,
+		Begin:       span.Begin,
+		End:         span.End,
+		BeginNs:     span.BeginNs,
+		EndNs:       span.EndNs,
+		Description: span.Description,
+		TracerId:    span.TracerId,
+		Parents:     span.Parents,
+		Info:        span.Info,
+		Flags:       span.Flags,
+		Extras:      span.Extras,
+	}
+	if vspan.Parents == nil {
+		vspan.Parents = []SpanId{}
+	}
+	for i := range span.TimelineAnnotations {
+		vspan.TimelineAnnotations = append(vspan.TimelineAnnotations,
+			VerboseTimelineAnnotation{
+				Time: span.TimelineAnnotations[i].Time,
+				Msg:  span.TimelineAnnotations[i].Msg,
+			})
+	}
+	for i := range span.Links {
+		vspan.Links = append(vspan.Links, VerboseSpanLink{
+			Id:   span.Links[i].Id,
+			Type: span.Links[i].Type,
+		})
+	}
+	return vspan
+}
+
+func (vspan *VerboseSpan) ToSpan() *Span {
+	span := &Span{
+		Id: vspan.Id,
+		SpanData: SpanData{
+			Begin:       vspan.Begin,
+			End:         vspan.End,
+			BeginNs:     vspan.BeginNs,
+			EndNs:       vspan.EndNs,
+			Description: vspan.Description,
+			TracerId:    vspan.TracerId,
+			Parents:     vspan.Parents,
+			Info:        vspan.Info,
+			Flags:       vspan.Flags,
+			Extras:      vspan.Extras,
+		},
+	}
+	if span.Parents == nil {
+		span.Parents = []SpanId{}
+	}
+	for i := range vspan.TimelineAnnotations {
+		span.TimelineAnnotations = append(span.TimelineAnnotations,
+			TimelineAnnotation{
+				Time: vspan.TimelineAnnotations[i].Time,
+				Msg:  vspan.TimelineAnnotations[i].Msg,
+			})
+	}
+	for i := range vspan.Links {
+		span.Links = append(span.Links, SpanLink{
+			Id:   vspan.Links[i].Id,
+			Type: vspan.Links[i].Type,
+		})
+	}
+	return span
+}
+
+// Check that a bundle can be imported.
+func (bundle *TraceBundle) Validate() error {
+	if bundle.Manifest.Version <= 0 ||
+		bundle.Manifest.Version > TRACE_BUNDLE_VERSION {
+		return errors.New(fmt.Sprintf("Unsupported trace bundle version %d.  "+
+			"This version of HTrace supports versions up to %d.",
+			bundle.Manifest.Version, TRACE_BUNDLE_VERSION))
+	}
+	if bundle.Manifest.NumSpans != len(bundle.Spans) {
+		return errors.New(fmt.Sprintf("The trace bundle manifest lists %d "+
+			"spans, but the bundle contains %d.",
+			bundle.Manifest.NumSpans, len(bundle.Spans)))
+	}
+	for i := range bundle.Spans {
+		problem := bundle.Spans[i].Id.FindProblem()
+		if problem != "" {
+			return errors.New(fmt.Sprintf("Span %d in the trace bundle has "+
+				"an invalid ID: %s", i, problem))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// An ArrivalCursor identifies a position in the stream of spans ingested by an
+// htraced server, ordered by the time they arrived at the server.  Spans which
+// arrived at the same millisecond are ordered by span ID.
+//
+// Cursors are passed over the wire as opaque strings.  The empty string
+// represents the beginning of the stream.
+type ArrivalCursor struct {
+	// The arrival time, in milliseconds since the epoch.
+	ArrivalMs int64
+
+	// The ID of the last span returned at that arrival time.
+	Id SpanId
+}
+
+func (cur *ArrivalCursor) String() string {
+	if cur.Id == nil {
+		return ""
+	}
+	return fmt.Sprintf("%016x%s", uint64(cur.ArrivalMs), cur.Id.String())
+}
+
+func (cur *ArrivalCursor) FromString(str string) error {
+	if str == "" {
+		*cur = ArrivalCursor{}
+		return nil
+	}
+	if len(str) != 48 {
+		return errors.New(fmt.Sprintf("Invalid cursor '%s': expected 48 "+
+			"hex digits, but got %d characters.", str, len(str)))
+	}
+	arrivalMs, err := strconv.ParseUint(str[0:16], 16, 64)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid cursor '%s': failed to parse "+
+			"arrival time: %s", str, err.Error()))
+	}
+	var id SpanId
+	err = id.FromString(str[16:])
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid cursor '%s': failed to parse "+
+			"span id: %s", str, err.Error()))
+	}
+	cur.ArrivalMs = int64(arrivalMs)
+	cur.Id = id
+	return nil
+}
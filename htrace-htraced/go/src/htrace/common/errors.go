@@ -0,0 +1,315 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A machine-readable code describing an error returned by the REST API.
+// Unlike error messages, codes are stable across releases, so programs should
+// use them to decide what to do about an error.
+type ErrorCode string
+
+const (
+	// The request was malformed.
+	ERR_BAD_REQUEST ErrorCode = "BAD_REQUEST"
+
+	// A request parameter had an invalid value.
+	ERR_BAD_PARAMETER ErrorCode = "BAD_PARAMETER"
+
+	// A span ID could not be parsed.
+	ERR_BAD_SPAN_ID ErrorCode = "BAD_SPAN_ID"
+
+	// A query could not be parsed or was not valid.
+	ERR_QUERY_VALIDATION ErrorCode = "QUERY_VALIDATION"
+
+	// The requested span does not exist.
+	ERR_SPAN_NOT_FOUND ErrorCode = "SPAN_NOT_FOUND"
+
+	// The requested write group does not exist, or has expired.
+	ERR_GROUP_NOT_FOUND ErrorCode = "GROUP_NOT_FOUND"
+
+	// The server does not handle the requested path or method.
+	ERR_UNKNOWN_REQUEST ErrorCode = "UNKNOWN_REQUEST"
+
+	// The request took too long.
+	ERR_DEADLINE_EXCEEDED ErrorCode = "DEADLINE_EXCEEDED"
+
+	// The request needs a shard which is quarantined.
+	ERR_SHARD_QUARANTINED ErrorCode = "SHARD_QUARANTINED"
+
+	// The request conflicts with an operation which is already in progress.
+	ERR_CONFLICT ErrorCode = "CONFLICT"
+
+	// The request writes spans, but the server is read-only.
+	ERR_READ_ONLY ErrorCode = "READ_ONLY"
+
+	// The request writes spans, but an administrator has paused ingestion.
+	// Unlike ERR_READ_ONLY, this is temporary, and the request should be
+	// sent again later.  See HtraceError#RetryAfter.
+	ERR_INGEST_PAUSED ErrorCode = "INGEST_PAUSED"
+
+	// The request has more spans, or more bytes, than the server accepts in
+	// one request.
+	ERR_TOO_LARGE ErrorCode = "TOO_LARGE"
+
+	// The request's token doesn't grant the permission which the request
+	// needs, or the request didn't include a token.
+	ERR_PERMISSION_DENIED ErrorCode = "PERMISSION_DENIED"
+
+	// The HRPC method is not one which both sides of the connection
+	// support.
+	ERR_UNSUPPORTED_METHOD ErrorCode = "UNSUPPORTED_METHOD"
+
+	// The HRPC message is bigger than the server's frame limit.  Like
+	// ERR_TOO_LARGE, the request should be split.
+	ERR_MESSAGE_TOO_LARGE ErrorCode = "MESSAGE_TOO_LARGE"
+
+	// The HRPC connection broke before the server answered the request.  The
+	// server may or may not have carried it out, so it can be sent again.
+	// Servers never send this code.
+	ERR_CONNECTION_LOST ErrorCode = "CONNECTION_LOST"
+
+	// The client has stopped writing to the server, because too many recent
+	// writes to it failed.  The spans can be written again later.  Servers
+	// never send this code.
+	ERR_CIRCUIT_OPEN ErrorCode = "CIRCUIT_OPEN"
+
+	// The server hit an internal error.
+	ERR_INTERNAL ErrorCode = "INTERNAL"
+
+	// The error did not include a code.  Servers never send this code; the
+	// client uses it for error responses from older servers which it can't
+	// otherwise classify.
+	ERR_UNKNOWN ErrorCode = "UNKNOWN"
+)
+
+// The key in HtraceError#Details which holds the index of the query
+// predicate that an ERR_QUERY_VALIDATION error is about.
+const ERR_DETAIL_PREDICATE = "predicate"
+
+// The key in HtraceError#Details which holds the number of milliseconds the
+// client should wait before sending the request again.
+const ERR_DETAIL_RETRY_AFTER_MS = "retryAfterMs"
+
+// Maps each error code to the HTTP status which the server sends with it.
+var errorCodeStatus = map[ErrorCode]int{
+	ERR_BAD_REQUEST:        http.StatusBadRequest,
+	ERR_BAD_PARAMETER:      http.StatusBadRequest,
+	ERR_BAD_SPAN_ID:        http.StatusBadRequest,
+	ERR_QUERY_VALIDATION:   http.StatusBadRequest,
+	ERR_SPAN_NOT_FOUND:     http.StatusNotFound,
+	ERR_GROUP_NOT_FOUND:    http.StatusNotFound,
+	ERR_UNKNOWN_REQUEST:    http.StatusNotFound,
+	ERR_DEADLINE_EXCEEDED:  http.StatusGatewayTimeout,
+	ERR_SHARD_QUARANTINED:  http.StatusServiceUnavailable,
+	ERR_CONFLICT:           http.StatusConflict,
+	ERR_READ_ONLY:          http.StatusForbidden,
+	ERR_INGEST_PAUSED:      http.StatusServiceUnavailable,
+	ERR_TOO_LARGE:          http.StatusRequestEntityTooLarge,
+	ERR_PERMISSION_DENIED:  http.StatusForbidden,
+	ERR_UNSUPPORTED_METHOD: http.StatusNotImplemented,
+	ERR_MESSAGE_TOO_LARGE:  http.StatusRequestEntityTooLarge,
+	ERR_CONNECTION_LOST:    http.StatusServiceUnavailable,
+	ERR_CIRCUIT_OPEN:       http.StatusServiceUnavailable,
+	ERR_INTERNAL:           http.StatusInternalServerError,
+	ERR_UNKNOWN:            http.StatusInternalServerError,
+}
+
+// Get all the error codes, sorted.
+func ValidErrorCodes() []ErrorCode {
+	codes := make([]ErrorCode, 0, len(errorCodeStatus))
+	for code := range errorCodeStatus {
+		codes = append(codes, code)
+	}
+	sort.Sort(errorCodeSlice(codes))
+	return codes
+}
+
+type errorCodeSlice []ErrorCode
+
+func (s errorCodeSlice) Len() int           { return len(s) }
+func (s errorCodeSlice) Less(i, j int) bool { return s[i] < s[j] }
+func (s errorCodeSlice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Get the HTTP status which the server sends with errors with this code.
+func (code ErrorCode) HttpStatus() int {
+	status, ok := errorCodeStatus[code]
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// The body of an error response from the REST API.
+type ErrorResp struct {
+	Error ErrorInfo `json:"error"`
+}
+
+// Information about an error returned by the REST API.
+type ErrorInfo struct {
+	Code    ErrorCode         `json:"code"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// An error returned by htraced.
+type HtraceError struct {
+	code ErrorCode
+
+	// The human-readable error message.  This may change between releases.
+	Message string
+
+	// Additional information about the error, or nil.
+	Details map[string]string
+
+	// The HTTP status of the response, or 0 if there was no response.
+	HttpStatus int
+
+	// The address of the server which returned the error.  This is set by
+	// the client, and is empty for errors the client made up itself.
+	Addr string
+}
+
+// Create a new HtraceError with the HTTP status that goes with its code.
+func NewHtraceError(code ErrorCode, details map[string]string,
+	fstr string, args ...interface{}) *HtraceError {
+	return &HtraceError{
+		code:       code,
+		Message:    fmt.Sprintf(fstr, args...),
+		Details:    details,
+		HttpStatus: code.HttpStatus(),
+	}
+}
+
+// Get the error code.
+func (herr *HtraceError) Code() ErrorCode {
+	return herr.code
+}
+
+// Get the index of the query predicate which this error is about, or -1 if
+// the error is not about a particular predicate.
+func (herr *HtraceError) PredicateIndex() int {
+	idx, err := strconv.Atoi(herr.Details[ERR_DETAIL_PREDICATE])
+	if err != nil {
+		return -1
+	}
+	return idx
+}
+
+// Get how long the server asked the client to wait before sending the
+// request again, or 0 if it didn't say.  HRPC errors never say.
+func (herr *HtraceError) RetryAfter() time.Duration {
+	ms, err := strconv.ParseInt(herr.Details[ERR_DETAIL_RETRY_AFTER_MS], 10, 64)
+	if err != nil || ms <= 0 {
+		return 0
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (herr *HtraceError) Error() string {
+	return fmt.Sprintf("%s: %s", herr.code, herr.Message)
+}
+
+// Get the body of the error response to send for this error.
+func (herr *HtraceError) ToResp() *ErrorResp {
+	return &ErrorResp{
+		Error: ErrorInfo{
+			Code:    herr.code,
+			Message: herr.Message,
+			Details: herr.Details,
+		},
+	}
+}
+
+// Get the error code of an error, or ERR_UNKNOWN if it is not an HtraceError.
+func ErrorCodeOf(err error) ErrorCode {
+	herr, ok := err.(*HtraceError)
+	if !ok {
+		return ERR_UNKNOWN
+	}
+	return herr.code
+}
+
+// Parse an error message of the form "CODE: message", as sent by HRPC, which
+// has no separate field for the code.  Returns nil if the message doesn't
+// start with a known code.
+func ParseHtraceError(str string) *HtraceError {
+	idx := strings.Index(str, ": ")
+	if idx < 0 {
+		return nil
+	}
+	code := ErrorCode(str[:idx])
+	if _, ok := errorCodeStatus[code]; !ok {
+		return nil
+	}
+	return &HtraceError{code: code, Message: str[idx+2:]}
+}
+
+// Guess the error code of an error response from an older server, which only
+// sent a message.
+func legacyErrorCode(status int) ErrorCode {
+	switch status {
+	case http.StatusNoContent:
+		// Older servers returned 204 when a span could not be found.  Newer
+		// servers return 404 with a SPAN_NOT_FOUND error.
+		return ERR_SPAN_NOT_FOUND
+	case http.StatusBadRequest:
+		return ERR_BAD_REQUEST
+	case http.StatusNotFound:
+		return ERR_UNKNOWN_REQUEST
+	case http.StatusInternalServerError:
+		return ERR_INTERNAL
+	}
+	return ERR_UNKNOWN
+}
+
+// Decode the body of an error response.  Older servers sent bodies of the
+// form {"error": "message"}, or no body at all; these are given a code based
+// on the HTTP status.
+func DecodeErrorResp(status int, body []byte) *HtraceError {
+	herr := &HtraceError{HttpStatus: status}
+	var resp ErrorResp
+	if json.Unmarshal(body, &resp) == nil && resp.Error.Code != "" {
+		herr.code = resp.Error.Code
+		herr.Message = resp.Error.Message
+		herr.Details = resp.Error.Details
+		return herr
+	}
+	herr.code = legacyErrorCode(status)
+	var legacy struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &legacy) == nil && legacy.Error != "" {
+		herr.Message = legacy.Error
+	} else if len(body) > 0 {
+		herr.Message = strings.TrimSpace(string(body))
+	} else {
+		herr.Message = http.StatusText(status)
+	}
+	return herr
+}
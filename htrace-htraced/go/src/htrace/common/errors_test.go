@@ -0,0 +1,66 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestErrorRespRoundTrip(t *testing.T) {
+	herr := NewHtraceError(ERR_SPAN_NOT_FOUND, map[string]string{"id": "abc"},
+		"No such span as %s", "abc")
+	if herr.HttpStatus != http.StatusNotFound {
+		t.Fatalf("expected status %d, got %d\n", http.StatusNotFound,
+			herr.HttpStatus)
+	}
+	buf, err := json.Marshal(herr.ToResp())
+	if err != nil {
+		t.Fatalf("failed to marshal error response: %s\n", err.Error())
+	}
+	decoded := DecodeErrorResp(herr.HttpStatus, buf)
+	if decoded.Code() != ERR_SPAN_NOT_FOUND {
+		t.Fatalf("expected code %s, got %s\n", ERR_SPAN_NOT_FOUND, decoded.Code())
+	}
+	ExpectStrEqual(t, "No such span as abc", decoded.Message)
+	ExpectStrEqual(t, "abc", decoded.Details["id"])
+}
+
+func TestDecodeLegacyErrorResp(t *testing.T) {
+	herr := DecodeErrorResp(http.StatusBadRequest,
+		[]byte(`{ "error" : "No spans were specified."}`))
+	if herr.Code() != ERR_BAD_REQUEST {
+		t.Fatalf("expected code %s, got %s\n", ERR_BAD_REQUEST, herr.Code())
+	}
+	ExpectStrEqual(t, "No spans were specified.", herr.Message)
+
+	// Older servers returned 204 with no body for missing spans.
+	herr = DecodeErrorResp(http.StatusNoContent, []byte{})
+	if herr.Code() != ERR_SPAN_NOT_FOUND {
+		t.Fatalf("expected code %s, got %s\n", ERR_SPAN_NOT_FOUND, herr.Code())
+	}
+
+	herr = DecodeErrorResp(http.StatusBadGateway, []byte("not json"))
+	if herr.Code() != ERR_UNKNOWN {
+		t.Fatalf("expected code %s, got %s\n", ERR_UNKNOWN, herr.Code())
+	}
+	ExpectStrEqual(t, "not json", herr.Message)
+}
@@ -38,18 +38,107 @@ type logSink struct {
 	file     *os.File
 	lock     sync.Mutex
 	refCount int // protected by logFilesLock
+
+	// The number of bytes in the current log file.  Protected by lock.
+	size int64
+
+	// The maximum size of the log file before we rotate it, or 0 if the log
+	// file should not be rotated.
+	maxSize int64
+
+	// The number of rotated log files to keep.
+	maxRotated int
 }
 
 // Write to the logSink.
+//
+// We never split a single message across two log files.  If writing the
+// message would make the log file too big, we rotate the log file first.
 func (sink *logSink) write(str string) {
 	sink.lock.Lock()
 	defer sink.lock.Unlock()
-	_, err := sink.file.Write([]byte(str))
+	if (sink.maxSize > 0) && (sink.size > 0) &&
+		(sink.size+int64(len(str)) > sink.maxSize) {
+		sink.rotate()
+	}
+	n, err := sink.file.Write([]byte(str))
+	sink.size += int64(n)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error logging to '%s': %s\n", sink.path, err.Error())
 	}
 }
 
+// Rotate the log file.  The current log file becomes <path>.1, the previous
+// <path>.1 becomes <path>.2, and so on.  Must be called with the lock held.
+func (sink *logSink) rotate() {
+	sink.closeFile()
+	oldest := sink.path.rotatedName(sink.maxRotated)
+	err := os.Remove(oldest)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error removing old log file %s: %s\n",
+			oldest, err.Error())
+	}
+	for i := sink.maxRotated - 1; i >= 0; i-- {
+		src := sink.path.rotatedName(i)
+		err = os.Rename(src, sink.path.rotatedName(i+1))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Error renaming log file %s: %s\n",
+				src, err.Error())
+		}
+	}
+	sink.openFile()
+}
+
+// Close and reopen the log file.  This is used when an external program has
+// renamed the log file out from under us.
+func (sink *logSink) reopen() {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if !sink.path.IsCloseable() {
+		return
+	}
+	sink.closeFile()
+	sink.openFile()
+}
+
+// Open the log file.  If we can't, we fall back on logging to stdout.  Must be
+// called with the lock held.
+func (sink *logSink) openFile() {
+	file, err := os.OpenFile(string(sink.path),
+		os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open log file %s: %s\n",
+			sink.path, err.Error())
+		sink.file = os.Stdout
+		sink.size = 0
+		sink.maxSize = 0
+		return
+	}
+	sink.file = file
+	sink.size = 0
+	info, err := file.Stat()
+	if err == nil {
+		sink.size = info.Size()
+	}
+}
+
+// Flush and close the log file.  Must be called with the lock held.
+func (sink *logSink) closeFile() {
+	if sink.file == os.Stdout {
+		return
+	}
+	err := sink.file.Sync()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error flushing log file %s: %s\n",
+			sink.path, err.Error())
+	}
+	err = sink.file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error closing log file %s: %s\n",
+			sink.path, err.Error())
+	}
+}
+
 // Unreference the logSink.  If there are no more references, and the logSink is
 // closeable, then we will close it here.
 func (sink *logSink) Unref() {
@@ -58,11 +147,9 @@ func (sink *logSink) Unref() {
 	sink.refCount--
 	if sink.refCount <= 0 {
 		if sink.path.IsCloseable() {
-			err := sink.file.Close()
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error closing log file %s: %s\n",
-					sink.path, err.Error())
-			}
+			sink.lock.Lock()
+			sink.closeFile()
+			sink.lock.Unlock()
 		}
 		logSinks[sink.path] = nil
 	}
@@ -101,37 +188,59 @@ func (path logPath) IsCloseable() bool {
 	return path != STDOUT_LOG_PATH
 }
 
-func (path logPath) Open() *logSink {
+// Get the name of the given rotated log file.  Rotated log file 0 is the
+// current log file.
+func (path logPath) rotatedName(idx int) string {
+	if idx == 0 {
+		return string(path)
+	}
+	return fmt.Sprintf("%s.%d", string(path), idx)
+}
+
+func (path logPath) Open(maxSize int64, maxRotated int) *logSink {
 	if path == STDOUT_LOG_PATH {
 		return &logSink{path: path, file: os.Stdout}
 	}
-	file, err := os.OpenFile(string(path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-	if err != nil {
-		sink := &logSink{path: STDOUT_LOG_PATH, file: os.Stdout}
-		fmt.Fprintf(os.Stderr, "Failed to open log file %s: %s\n",
-			path, err.Error())
-		return sink
+	sink := &logSink{path: path, maxSize: maxSize, maxRotated: maxRotated}
+	sink.openFile()
+	if sink.file == os.Stdout {
+		sink.path = STDOUT_LOG_PATH
 	}
-	return &logSink{path: path, file: file}
+	return sink
 }
 
 var logFilesLock sync.Mutex
 
 var logSinks map[logPath]*logSink = make(map[logPath]*logSink)
 
-func getOrCreateLogSink(pathStr string) *logSink {
+// Get the log sink for a path, creating it if needed.  The rotation settings
+// only take effect when the sink is created; loggers which share a path share
+// the settings of the first logger to open it.
+func getOrCreateLogSink(pathStr string, maxSize int64, maxRotated int) *logSink {
 	path := logPathFromString(pathStr)
 	logFilesLock.Lock()
 	defer logFilesLock.Unlock()
 	sink := logSinks[path]
 	if sink == nil {
-		sink = path.Open()
+		sink = path.Open(maxSize, maxRotated)
 		logSinks[path] = sink
 	}
 	sink.refCount++
 	return sink
 }
 
+// Close and reopen all log files.  This should be called after an external
+// program such as logrotate has renamed the log files.
+func ReopenLogFiles() {
+	logFilesLock.Lock()
+	defer logFilesLock.Unlock()
+	for _, sink := range logSinks {
+		if sink != nil {
+			sink.reopen()
+		}
+	}
+}
+
 type Level int
 
 const (
@@ -179,12 +288,17 @@ func LevelFromString(str string) (Level, error) {
 type Logger struct {
 	sink  *logSink
 	Level Level
+
+	// If true, messages at ERROR level are also written to stderr.
+	errorsToStderr bool
 }
 
 func NewLogger(faculty string, cnf *conf.Config) *Logger {
 	path, level := parseConf(faculty, cnf)
-	sink := getOrCreateLogSink(path)
-	return &Logger{sink: sink, Level: level}
+	sink := getOrCreateLogSink(path, cnf.GetInt64(conf.HTRACE_LOG_MAX_FILE_SIZE),
+		cnf.GetInt(conf.HTRACE_LOG_MAX_ROTATED_FILES))
+	return &Logger{sink: sink, Level: level,
+		errorsToStderr: cnf.GetBool(conf.HTRACE_LOG_ERRORS_TO_STDERR)}
 }
 
 func parseConf(faculty string, cnf *conf.Config) (string, Level) {
@@ -258,8 +372,12 @@ func (lg *Logger) Errorf(format string, v ...interface{}) error {
 
 func (lg *Logger) Write(level Level, str string) {
 	if level >= lg.Level {
-		lg.sink.write(time.Now().UTC().Format(time.RFC3339) + " " +
-			level.LogString() + ": " + str)
+		msg := time.Now().UTC().Format(time.RFC3339) + " " +
+			level.LogString() + ": " + str
+		lg.sink.write(msg)
+		if lg.errorsToStderr && level >= ERROR {
+			os.Stderr.Write([]byte(msg))
+		}
 	}
 }
 
@@ -0,0 +1,215 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// A LogSuppressor keeps a flood of identical log messages from becoming a
+// performance problem of its own.  Messages are keyed by their format string
+// and by a source, such as the address of the client which caused them.  Only
+// the first message for each key is written.  The rest are counted, and
+// periodically written out as a single summary line per key.  After the
+// summary is written, the next message for the key is logged again.
+//
+// The number of keys tracked between summaries is bounded.  Once the limit is
+// reached, messages for new keys are suppressed and counted together.
+//
+
+type logSuppressionKey struct {
+	// The source of the message, or the empty string.
+	source string
+
+	// The format string of the message.
+	template string
+}
+
+type suppressedMessages struct {
+	// The level the messages were logged at.
+	level Level
+
+	// The number of messages which were suppressed.
+	count uint64
+}
+
+type LogSuppressor struct {
+	// The logger to write messages to.
+	lg *Logger
+
+	// The maximum number of keys to track.
+	maxKeys int
+
+	// Protects entries and overflow.
+	lock sync.Mutex
+
+	// The messages we have logged since the last summary.
+	entries map[logSuppressionKey]*suppressedMessages
+
+	// The number of messages which were suppressed because there were
+	// already maxKeys keys.
+	overflow uint64
+
+	// Closed to shut down the summary goroutine.
+	shutdown chan interface{}
+
+	// Tracks whether the summary goroutine has exited.
+	exited sync.WaitGroup
+}
+
+// Create a new LogSuppressor which writes to the given logger.  If periodMs
+// is positive, summaries are written every periodMs milliseconds.  Otherwise,
+// they are only written when Flush is called.
+func NewLogSuppressor(lg *Logger, periodMs int64, maxKeys int) *LogSuppressor {
+	sup := &LogSuppressor{
+		lg:       lg,
+		maxKeys:  maxKeys,
+		entries:  make(map[logSuppressionKey]*suppressedMessages),
+		shutdown: make(chan interface{}),
+	}
+	if periodMs > 0 {
+		sup.exited.Add(1)
+		go sup.run(time.Duration(periodMs) * time.Millisecond)
+	}
+	return sup
+}
+
+func (sup *LogSuppressor) run(period time.Duration) {
+	defer sup.exited.Done()
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sup.Flush()
+		case <-sup.shutdown:
+			return
+		}
+	}
+}
+
+// Log a message, unless a message with the same format string and source has
+// already been logged since the last summary.
+func (sup *LogSuppressor) Logf(level Level, source string, format string,
+	v ...interface{}) {
+	if !sup.lg.LevelEnabled(level) {
+		return
+	}
+	key := logSuppressionKey{source: source, template: format}
+	sup.lock.Lock()
+	ent := sup.entries[key]
+	if ent != nil {
+		ent.count++
+		sup.lock.Unlock()
+		return
+	}
+	if len(sup.entries) >= sup.maxKeys {
+		sup.overflow++
+		sup.lock.Unlock()
+		return
+	}
+	sup.entries[key] = &suppressedMessages{level: level}
+	sup.lock.Unlock()
+	sup.lg.Write(level, fmt.Sprintf(format, v...))
+}
+
+func (sup *LogSuppressor) Warnf(source string, format string, v ...interface{}) {
+	sup.Logf(WARN, source, format, v...)
+}
+
+func (sup *LogSuppressor) Errorf(source string, format string, v ...interface{}) {
+	sup.Logf(ERROR, source, format, v...)
+}
+
+// Write a summary line for each key which had messages suppressed, and start
+// logging messages for every key again.
+func (sup *LogSuppressor) Flush() {
+	sup.lock.Lock()
+	entries := sup.entries
+	overflow := sup.overflow
+	sup.entries = make(map[logSuppressionKey]*suppressedMessages)
+	sup.overflow = 0
+	sup.lock.Unlock()
+
+	keys := make([]logSuppressionKey, 0, len(entries))
+	for key, ent := range entries {
+		if ent.count > 0 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Sort(logSuppressionKeySlice(keys))
+	for i := range keys {
+		ent := entries[keys[i]]
+		from := ""
+		if keys[i].source != "" {
+			from = " from " + keys[i].source
+		}
+		sup.lg.Write(ent.level, fmt.Sprintf("previous message repeated %s "+
+			"times%s: %s\n", formatCount(ent.count), from,
+			strings.TrimSpace(keys[i].template)))
+	}
+	if overflow > 0 {
+		sup.lg.Write(WARN, fmt.Sprintf("%s more message(s) were suppressed "+
+			"because more than %d kinds of message were being tracked.\n",
+			formatCount(overflow), sup.maxKeys))
+	}
+}
+
+// Stop writing periodic summaries, and write a final one.
+func (sup *LogSuppressor) Close() {
+	close(sup.shutdown)
+	sup.exited.Wait()
+	sup.Flush()
+}
+
+type logSuppressionKeySlice []logSuppressionKey
+
+func (s logSuppressionKeySlice) Len() int {
+	return len(s)
+}
+
+func (s logSuppressionKeySlice) Less(i, j int) bool {
+	if s[i].source != s[j].source {
+		return s[i].source < s[j].source
+	}
+	return s[i].template < s[j].template
+}
+
+func (s logSuppressionKeySlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Format a count with commas between each group of three digits.
+func formatCount(count uint64) string {
+	str := fmt.Sprintf("%d", count)
+	var buf []byte
+	for i := range str {
+		if i > 0 && (len(str)-i)%3 == 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, str[i])
+	}
+	return string(buf)
+}
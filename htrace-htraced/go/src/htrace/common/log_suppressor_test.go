@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"fmt"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Read the lines of a log file.
+func readLogLines(t *testing.T, logPath string) []string {
+	buf, err := ioutil.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("failed to read log file %s: %s\n", logPath, err.Error())
+	}
+	return strings.Split(strings.TrimRight(string(buf), "\n"), "\n")
+}
+
+func TestLogSuppressorBurst(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestLogSuppressorBurst")
+	if err != nil {
+		panic(fmt.Sprintf("error creating tempdir: %s\n", err.Error()))
+	}
+	defer os.RemoveAll(tempDir)
+	logPath := tempDir + conf.PATH_SEP + "log"
+	lg := newLogger("foo", "log.level", "INFO", "log.path", logPath)
+	defer lg.Close()
+	sup := NewLogSuppressor(lg, 0, 100)
+	for i := 0; i < 12404; i++ {
+		sup.Warnf("10.4.2.17", "Invalid span ID %d from %s\n", i, "10.4.2.17")
+	}
+	sup.Flush()
+	lines := readLogLines(t, logPath)
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 log lines, but got %d: %v\n", len(lines), lines)
+	}
+	if !strings.HasSuffix(lines[0], "W: Invalid span ID 0 from 10.4.2.17") {
+		t.Fatalf("Unexpected first line: %s\n", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "W: previous message repeated 12,403 "+
+		"times from 10.4.2.17: Invalid span ID %d from %s") {
+		t.Fatalf("Unexpected summary line: %s\n", lines[1])
+	}
+
+	// After the summary, the message is logged again.  A message which was
+	// not repeated gets no summary.
+	sup.Warnf("10.4.2.17", "Invalid span ID %d from %s\n", 1, "10.4.2.17")
+	sup.Flush()
+	lines = readLogLines(t, logPath)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, but got %d: %v\n", len(lines), lines)
+	}
+	sup.Close()
+}
+
+func TestLogSuppressorMaxKeys(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestLogSuppressorMaxKeys")
+	if err != nil {
+		panic(fmt.Sprintf("error creating tempdir: %s\n", err.Error()))
+	}
+	defer os.RemoveAll(tempDir)
+	logPath := tempDir + conf.PATH_SEP + "log"
+	lg := newLogger("foo", "log.level", "INFO", "log.path", logPath)
+	defer lg.Close()
+	sup := NewLogSuppressor(lg, 0, 2)
+	for i := 0; i < 5; i++ {
+		sup.Warnf(fmt.Sprintf("10.0.0.%d", i), "Bad span\n")
+	}
+	sup.Close()
+	lines := readLogLines(t, logPath)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, but got %d: %v\n", len(lines), lines)
+	}
+	if !strings.Contains(lines[2], "3 more message(s) were suppressed") {
+		t.Fatalf("Unexpected overflow line: %s\n", lines[2])
+	}
+}
+
+func TestLogSuppressorConcurrency(t *testing.T) {
+	const NUM_GOROUTINES = 20
+	const NUM_MESSAGES = 5000
+	lg := newLogger("foo", "log.level", "INFO")
+	defer lg.Close()
+	sup := NewLogSuppressor(lg, 0, 100)
+	var wg sync.WaitGroup
+	for i := 0; i < NUM_GOROUTINES; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < NUM_MESSAGES; j++ {
+				sup.Warnf("10.4.2.17", "Invalid span\n")
+			}
+		}()
+	}
+	wg.Wait()
+	sup.lock.Lock()
+	ent := sup.entries[logSuppressionKey{source: "10.4.2.17",
+		template: "Invalid span\n"}]
+	sup.lock.Unlock()
+	if ent == nil {
+		t.Fatalf("No suppression entry found.\n")
+	}
+	if ent.count != NUM_GOROUTINES*NUM_MESSAGES-1 {
+		t.Fatalf("Expected %d suppressed messages, but got %d\n",
+			NUM_GOROUTINES*NUM_MESSAGES-1, ent.count)
+	}
+	sup.Close()
+}
+
+func TestFormatCount(t *testing.T) {
+	ExpectStrEqual(t, "0", formatCount(0))
+	ExpectStrEqual(t, "999", formatCount(999))
+	ExpectStrEqual(t, "1,000", formatCount(1000))
+	ExpectStrEqual(t, "12,403", formatCount(12403))
+	ExpectStrEqual(t, "1,234,567", formatCount(1234567))
+}
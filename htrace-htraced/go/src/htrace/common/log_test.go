@@ -168,3 +168,131 @@ func TestLogLevelEnabled(t *testing.T) {
 	}
 	lg.Close()
 }
+
+// Read all the lines in a file.
+func readLines(t *testing.T, path string) []string {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s\n", path, err.Error())
+	}
+	str := string(buf)
+	if !strings.HasSuffix(str, "\n") {
+		t.Fatalf("log file %s ends with a partial line.\n", path)
+	}
+	return strings.Split(strings.TrimSuffix(str, "\n"), "\n")
+}
+
+func TestLogRotation(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestLogRotation")
+	if err != nil {
+		panic(fmt.Sprintf("error creating tempdir: %s\n", err.Error()))
+	}
+	defer os.RemoveAll(tempDir)
+	logPath := tempDir + conf.PATH_SEP + "log"
+	const MAX_FILE_SIZE = 1000
+	const MAX_ROTATED_FILES = 3
+	const NUM_LINES = 500
+	lg := newLogger("foo", "log.level", "INFO",
+		"log.path", logPath,
+		conf.HTRACE_LOG_MAX_FILE_SIZE, fmt.Sprintf("%d", MAX_FILE_SIZE),
+		conf.HTRACE_LOG_MAX_ROTATED_FILES, fmt.Sprintf("%d", MAX_ROTATED_FILES))
+	for i := 0; i < NUM_LINES; i++ {
+		lg.Infof("log line %05d\n", i)
+	}
+	lg.Close()
+	_, err = os.Stat(fmt.Sprintf("%s.%d", logPath, MAX_ROTATED_FILES+1))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected only %d rotated log files to be kept.\n",
+			MAX_ROTATED_FILES)
+	}
+	// Read the log files from oldest to newest.  Every line should be
+	// complete, and the line numbers should be consecutive, ending with the
+	// last line we wrote.
+	var lines []string
+	for i := MAX_ROTATED_FILES; i >= 0; i-- {
+		path := logPath
+		if i > 0 {
+			path = fmt.Sprintf("%s.%d", logPath, i)
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s\n", path, err.Error())
+		}
+		if info.Size() > MAX_FILE_SIZE {
+			t.Fatalf("log file %s has size %d, which is more than the "+
+				"maximum of %d\n", path, info.Size(), MAX_FILE_SIZE)
+		}
+		lines = append(lines, readLines(t, path)...)
+	}
+	first := NUM_LINES - len(lines)
+	for i := range lines {
+		expected := fmt.Sprintf("I: log line %05d", first+i)
+		if !strings.HasSuffix(lines[i], expected) {
+			t.Fatalf("expected line ending in '%s', but got '%s'\n",
+				expected, lines[i])
+		}
+	}
+}
+
+func TestReopenLogFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestReopenLogFiles")
+	if err != nil {
+		panic(fmt.Sprintf("error creating tempdir: %s\n", err.Error()))
+	}
+	defer os.RemoveAll(tempDir)
+	logPath := tempDir + conf.PATH_SEP + "log"
+	lg := newLogger("foo", "log.level", "INFO", "log.path", logPath)
+	defer lg.Close()
+	lg.Infof("before the rename\n")
+	// Simulate an external log rotation tool.
+	err = os.Rename(logPath, logPath+".old")
+	if err != nil {
+		t.Fatalf("failed to rename %s: %s\n", logPath, err.Error())
+	}
+	lg.Infof("after the rename\n")
+	ReopenLogFiles()
+	lg.Infof("after reopening\n")
+	oldLines := readLines(t, logPath+".old")
+	if len(oldLines) != 2 {
+		t.Fatalf("expected 2 lines in the old log file, but got %d\n",
+			len(oldLines))
+	}
+	newLines := readLines(t, logPath)
+	if len(newLines) != 1 || !strings.Contains(newLines[0], "after reopening") {
+		t.Fatalf("unexpected lines in the new log file: %v\n", newLines)
+	}
+}
+
+func TestLogErrorsToStderr(t *testing.T) {
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestLogErrorsToStderr")
+	if err != nil {
+		panic(fmt.Sprintf("error creating tempdir: %s\n", err.Error()))
+	}
+	defer os.RemoveAll(tempDir)
+	stderrPath := tempDir + conf.PATH_SEP + "stderr"
+	stderr, err := os.Create(stderrPath)
+	if err != nil {
+		t.Fatalf("failed to create %s: %s\n", stderrPath, err.Error())
+	}
+	oldStderr := os.Stderr
+	os.Stderr = stderr
+	defer func() {
+		os.Stderr = oldStderr
+		stderr.Close()
+	}()
+	logPath := tempDir + conf.PATH_SEP + "log"
+	lg := newLogger("foo", "log.level", "INFO", "log.path", logPath,
+		conf.HTRACE_LOG_ERRORS_TO_STDERR, "true")
+	lg.Infof("just some information\n")
+	lg.Errorf("something went wrong\n")
+	lg.Close()
+	stderrLines := readLines(t, stderrPath)
+	if len(stderrLines) != 1 ||
+		!strings.Contains(stderrLines[0], "something went wrong") {
+		t.Fatalf("expected only the error to be written to stderr, but "+
+			"got %v\n", stderrLines)
+	}
+	if len(readLines(t, logPath)) != 2 {
+		t.Fatalf("expected both messages to be written to the log file.\n")
+	}
+}
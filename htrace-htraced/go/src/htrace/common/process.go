@@ -27,9 +27,33 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/debug"
+	"sync"
 	"syscall"
 )
 
+// The functions to run before the process exits on a fatal signal.
+var exitHooks struct {
+	lock  sync.Mutex
+	hooks []func()
+}
+
+// Register a function to run if the process is terminated by a signal, such as
+// SIGTERM.  This is for cleaning up things which outlive the process, such as
+// unix socket files.  The hooks run in the order they were added.
+func AddSignalExitHook(hook func()) {
+	exitHooks.lock.Lock()
+	defer exitHooks.lock.Unlock()
+	exitHooks.hooks = append(exitHooks.hooks, hook)
+}
+
+func runSignalExitHooks() {
+	exitHooks.lock.Lock()
+	defer exitHooks.lock.Unlock()
+	for i := range exitHooks.hooks {
+		exitHooks.hooks[i]()
+	}
+}
+
 func InstallSignalHandlers(cnf *conf.Config) {
 	fatalSigs := []os.Signal{
 		os.Interrupt,
@@ -49,6 +73,7 @@ func InstallSignalHandlers(cnf *conf.Config) {
 	go func() {
 		sig := <-fatalSigChan
 		lg.Errorf("Terminating on signal: %v\n", sig)
+		runSignalExitHooks()
 		lg.Close()
 		os.Exit(1)
 	}()
@@ -69,6 +94,18 @@ func InstallSignalHandlers(cnf *conf.Config) {
 			lg.Info("=== END GC STATISTICS ===\n")
 		}
 	}()
+
+	if cnf.GetBool(conf.HTRACE_LOG_REOPEN_ON_SIGHUP) {
+		sigHupChan := make(chan os.Signal, 1)
+		signal.Notify(sigHupChan, syscall.SIGHUP)
+		go func() {
+			for {
+				<-sigHupChan
+				ReopenLogFiles()
+				lg.Info("Reopened log files on SIGHUP.\n")
+			}
+		}()
+	}
 }
 
 func GetStackTraces(buf *[]byte) {
@@ -20,7 +20,11 @@
 package common
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
 )
 
 //
@@ -30,6 +34,14 @@ import (
 // return a set of spans.  Predicates contain an operation, a field, and a
 // value.
 //
+// A predicate can be negated, either with one of the NOT_ operations or by
+// setting its negate flag, so that it matches the spans its positive form
+// doesn't.  Negated predicates never choose which index the server reads.
+// They only filter the spans which the other predicates select, or which a
+// scan in span ID order produces if no other predicate is indexed.  A query
+// whose predicates are all negated would have to read every span, so the
+// server rejects it.
+//
 // For example, a query might be "return the first 100 spans between 5:00pm
 // and 5:01pm"  This query would have two predicates: time greater than or
 // equal to 5:00pm, and time less than or equal to 5:01pm.
@@ -52,8 +64,29 @@ const (
 	LESS_THAN_OR_EQUALS    Op = "le"
 	GREATER_THAN_OR_EQUALS Op = "ge"
 	GREATER_THAN           Op = "gt"
+
+	// Matches spans which have all of the given flags.  This can only be
+	// used with the FLAGS field.
+	HAS Op = "has"
+
+	// The negations of EQUALS and CONTAINS.  These are the same as setting
+	// the negate flag on an EQUALS or CONTAINS predicate.
+	NOT_EQUALS   Op = "ne"
+	NOT_CONTAINS Op = "nc"
 )
 
+// If op is one of the NOT_ operations, get the operation it negates.
+func (op Op) Negates() (Op, bool) {
+	switch op {
+	case NOT_EQUALS:
+		return EQUALS, true
+	case NOT_CONTAINS:
+		return CONTAINS, true
+	default:
+		return op, false
+	}
+}
+
 func (op Op) IsDescending() bool {
 	return op == LESS_THAN_OR_EQUALS
 }
@@ -70,9 +103,22 @@ func (op Op) IsValid() bool {
 
 func ValidOps() []Op {
 	return []Op{CONTAINS, EQUALS, LESS_THAN_OR_EQUALS, GREATER_THAN_OR_EQUALS,
-		GREATER_THAN}
+		GREATER_THAN, HAS, NOT_EQUALS, NOT_CONTAINS}
 }
 
+// Values of numeric fields (BEGIN_TIME, END_TIME, DURATION, and NUM_PARENTS)
+// must be base-10 integers, with an optional minus sign and nothing else.
+// BEGIN_TIME and END_TIME values may also be RFC3339 times or relative times
+// such as "now-30m" (see ParseHumanTime.)  The server resolves relative times
+// against its own clock when the query runs.
+// SPAN_ID values must be span IDs in their usual hex form.  Queries with any
+// other values are rejected, rather than matched against a guess.
+//
+// DESCRIPTION, TRACER_ID, and PRINCIPAL values are compared byte by byte, without any
+// case folding or Unicode normalization.  An empty value is an ordinary
+// string: EQUALS matches only spans where the field is empty, CONTAINS
+// matches every span, and the ordering operations treat it as less than every
+// other value.
 type Field string
 
 const (
@@ -82,6 +128,31 @@ const (
 	END_TIME    Field = "end"
 	DURATION    Field = "duration"
 	TRACER_ID   Field = "tracerid"
+
+	// Whether the span is a root span, that is, a span with no parents.
+	// The value is "true" or "false".  Only EQUALS can be used with this field.
+	IS_ROOT Field = "isroot"
+
+	// The number of parents the span has.  Spans with more than one parent
+	// are fan-in spans, such as joins.  There is no index on this field, so
+	// it can only filter the spans which other predicates select.
+	NUM_PARENTS Field = "numparents"
+
+	// The span flags.  The value is a comma-separated list of flag names,
+	// such as "debug,synthetic".  Only HAS can be used with this field.
+	// Like NUM_PARENTS, this field has no index.
+	FLAGS Field = "flags"
+
+	// The principal which wrote the span, as recorded under
+	// PRINCIPAL_INFO_KEY.  Spans written without a known principal have an
+	// empty principal.  Like NUM_PARENTS, this field has no index.
+	PRINCIPAL Field = "principal"
+
+	// Whether the span failed.  See SpanData#Error.  The value is "true" or
+	// "false".  Only EQUALS can be used with this field.  The failed spans
+	// are indexed by begin time, so finding the failures in a time range
+	// only reads the failed spans.
+	IS_ERROR Field = "error"
 )
 
 func (field Field) IsValid() bool {
@@ -96,13 +167,25 @@ func (field Field) IsValid() bool {
 
 func ValidFields() []Field {
 	return []Field{SPAN_ID, DESCRIPTION, BEGIN_TIME, END_TIME,
-		DURATION, TRACER_ID}
+		DURATION, TRACER_ID, IS_ROOT, NUM_PARENTS, FLAGS, PRINCIPAL,
+		IS_ERROR}
 }
 
 type Predicate struct {
 	Op    Op     `json:"op"`
 	Field Field  `json:"field"`
 	Val   string `val:"val"`
+
+	// If true, the predicate matches the spans which it would not match
+	// otherwise.  This can't be combined with the NOT_ operations.
+	Negate bool `json:"negate,omitempty"`
+}
+
+// Returns true if the predicate is negated, either by its operation or by its
+// negate flag.
+func (pred *Predicate) IsNegated() bool {
+	_, negatedOp := pred.Op.Negates()
+	return negatedOp || pred.Negate
 }
 
 func (pred *Predicate) String() string {
@@ -115,8 +198,272 @@ func (pred *Predicate) String() string {
 
 type Query struct {
 	Predicates []Predicate `json:"pred"`
-	Lim        int         `json:"lim"`
-	Prev       *Span       `json:"prev"`
+
+	// The maximum number of spans to return.  If this is 0 or missing, the
+	// server uses query.default.lim.  Limits above query.max.lim are lowered
+	// to it, and the REST response sets QUERY_LIM_HEADER to the limit which
+	// was used.  Negative limits are invalid.
+	Lim int `json:"lim"`
+
+	Prev *Span `json:"prev"`
+
+	// A continuation token from the Next field of a QueryPage.  The query
+	// resumes after the last span of that page, as if Prev were set to it.
+	// It can't be combined with Prev.
+	After string `json:"after,omitempty"`
+
+	// If non-empty, only the listed shards are scanned, so the results are
+	// partial.  Each entry is a shard index or the path of a shard.  This is
+	// for debugging, and is rejected unless query.shard.filter.enabled is
+	// set.
+	ShardFilter []string `json:"shards,omitempty"`
+
+	// If this is positive, the spans returned have at most this many
+	// parents.  NumParents still holds the number of parents each span
+	// really has.  This keeps very wide spans from bloating the response.
+	// If it is 0 or missing, spans are returned with all of their parents.
+	MaxParents int `json:"maxParents,omitempty"`
+
+	// If true, the server records how it ran the query, and returns the
+	// record in the Plan field of the QueryPage.  Only paged queries return
+	// plans.
+	Plan bool `json:"plan,omitempty"`
+}
+
+// The REST response header which holds the limit the server applied to a
+// query.
+const QUERY_LIM_HEADER = "X-HTraced-Query-Lim"
+
+// The REST response header which lists the time predicates whose values the
+// server resolved to milliseconds since the epoch.  It is a comma-separated
+// list of predicate index=milliseconds pairs, for example "0=1445540632000".
+// It is only set when at least one value was an RFC3339 or relative time.
+const QUERY_RESOLVED_TIMES_HEADER = "X-HTraced-Query-Resolved-Times"
+
+// Returns a predicate which matches spans that began at most d ago, according
+// to the server's clock.
+func TimePredicateSince(d time.Duration) Predicate {
+	return Predicate{
+		Op:    GREATER_THAN_OR_EQUALS,
+		Field: BEGIN_TIME,
+		Val:   fmt.Sprintf("now-%dms", int64(d/time.Millisecond)),
+	}
+}
+
+// A page of query results, returned by /query when paged is set.
+type QueryPage struct {
+	// The matching spans.
+	Spans []*Span `json:"spans"`
+
+	// True if more spans match the query after these.
+	HasMore bool `json:"hasMore"`
+
+	// If HasMore is true, the continuation token to put in the After field
+	// of the query to get the next page.
+	Next string `json:"next,omitempty"`
+
+	// The limit the server applied to the query.
+	Lim int `json:"lim"`
+
+	// The number of index rows the server read to find these spans, across
+	// all shards.
+	Scanned int `json:"scanned"`
+
+	// How the server ran the query, if the query asked for it.
+	Plan *QueryPlan `json:"plan,omitempty"`
+}
+
+// How the server ran a query.  A plan can be saved, and sent back to
+// /query/replay later, to run the query the same way again, and to find out
+// whether the server would still plan it the same way.
+type QueryPlan struct {
+	// The query, with its limit applied, and its time predicates resolved to
+	// milliseconds since the epoch.
+	Query Query `json:"query"`
+
+	// The index the rows were read from: spanId, beginTime, endTime,
+	// duration, description, root, or error.
+	Index string `json:"index"`
+
+	// The predicate the rows were read with.  This is not always one of the
+	// query's predicates, since queries without an indexed predicate read
+	// the whole span id index.
+	Source Predicate `json:"source"`
+
+	// The index key the read started at, and the prefix which bounded it,
+	// if any, in hex.  These include the adjustment for the query's
+	// continuation token.
+	SeekKey  string `json:"seekKey"`
+	KeyBound string `json:"keyBound,omitempty"`
+
+	// The predicates the rows were filtered with, in the order they were
+	// applied.
+	Filters []Predicate `json:"filters"`
+
+	// The estimates the source was chosen with.  This is empty unless
+	// query.planner.stats is on, and more than one predicate could have been
+	// the source.
+	Estimates []PlanEstimate `json:"estimates,omitempty"`
+
+	// The number of rows each stage of the query handled.  The first stage
+	// is the source, and the rest are the filters, in order.
+	Stages []PlanStage `json:"stages"`
+
+	// The ids of the spans the query returned, in order.
+	Results []SpanId `json:"results"`
+
+	// When the plan was captured, in milliseconds since the epoch.
+	CapturedMs int64 `json:"capturedMs"`
+}
+
+// How many rows the planner expected a predicate to read, if it were the
+// source of a query.
+type PlanEstimate struct {
+	// The predicate.
+	Pred Predicate `json:"pred"`
+
+	// The number of index entries in the predicate's range, counting at
+	// most query.planner.sample.max in each shard.
+	Rows int64 `json:"rows"`
+
+	// True if no shard had query.planner.sample.max entries in the range, so
+	// that Rows is the exact number of entries.
+	Exact bool `json:"exact,omitempty"`
+}
+
+// The rows one stage of a query handled.
+type PlanStage struct {
+	// "source", or the filter predicate.
+	Name string `json:"name"`
+
+	// The rows the stage read, and the rows it passed on.  The source reads
+	// index rows, and passes on the spans which satisfy its predicate.
+	In  int `json:"in"`
+	Out int `json:"out"`
+}
+
+// The outcome of replaying a QueryPlan.
+type PlanReplay struct {
+	// The captured plan, run again as it was.  The stages and results are
+	// the ones from this run.
+	Verbatim *QueryPlan `json:"verbatim"`
+
+	// The plan the server chooses for the query now, and its results.
+	Replanned *QueryPlan `json:"replanned"`
+
+	// How the plan the server chooses now differs from the captured one.
+	// Empty if they are the same.
+	PlanDifferences []string `json:"planDifferences"`
+
+	// True if running the captured plan again returned different spans, or
+	// the same spans in a different order, than when it was captured.
+	VerbatimResultsDiffer bool `json:"verbatimResultsDiffer"`
+
+	// True if the plan chosen now returned a different set of spans than
+	// the captured plan did.  Different indexes return spans in different
+	// orders, so the order doesn't count.
+	ReplannedResultsDiffer bool `json:"replannedResultsDiffer"`
+}
+
+// The value of a QueryEstimate field which the server can't estimate.
+const UNKNOWN_ROWS = -1
+
+// How a query would run, returned by /query/explain.  Nothing is read from
+// the source, so explaining a query is cheap even when running it isn't.
+type QueryExplanation struct {
+	// The plan the query would run with.  Its stages and results are empty.
+	Plan QueryPlan `json:"plan"`
+
+	// True if the query has no predicate which can be read from an index,
+	// so running it would read every span.
+	FullScan bool `json:"fullScan"`
+
+	// True if the query's limit is above query.max.lim, and would be
+	// lowered to it.  The plan holds the limit which would be used.
+	LimLowered bool `json:"limLowered"`
+
+	// True if more spans are known to match than the limit allows, so that
+	// running the query would return a full page.
+	MoreThanLim bool `json:"moreThanLim"`
+
+	// If the server would refuse to run the query, why.  Queries whose
+	// predicates are all negated are explained, but not run.
+	Rejection string `json:"rejection,omitempty"`
+
+	// The index entries counted to make the estimate: the source's range,
+	// then the range of each filter which can be read from an index.
+	Probes []PlanEstimate `json:"probes,omitempty"`
+
+	// How many spans match the query, or nil if query.planner.stats is off.
+	Estimate *QueryEstimate `json:"estimate,omitempty"`
+}
+
+// An estimate of how many spans match a query, ignoring its limit and its
+// continuation token.  The number matching is always between Low and High.
+type QueryEstimate struct {
+	// The most likely number of matching spans.  Filters are assumed to be
+	// independent of each other and of the source, and filters which can't
+	// be read from an index are assumed to match every span.  UNKNOWN_ROWS
+	// if the source or the span id index had too many entries to count.
+	Rows int64 `json:"rows"`
+
+	// The fewest spans which can match.  This is 0 unless the query has no
+	// filters, and its source had few enough entries to count.
+	Low int64 `json:"low"`
+
+	// The most spans which can match, or UNKNOWN_ROWS if the source had too
+	// many entries to count.
+	High int64 `json:"high"`
+
+	// The number of spans in the datastore, or UNKNOWN_ROWS if there were
+	// too many to count.
+	TotalSpans int64 `json:"totalSpans"`
+}
+
+// Make a continuation token which resumes a query after the given span.  The
+// token only holds the fields which the indexes are ordered by.
+func NewQueryToken(span *Span) string {
+	prev := Span{Id: span.Id,
+		SpanData: SpanData{
+			Begin:       span.Begin,
+			End:         span.End,
+			BeginNs:     span.BeginNs,
+			EndNs:       span.EndNs,
+			Description: span.Description,
+			TracerId:    span.TracerId,
+			NumParents:  span.NumParents,
+			Flags:       span.Flags,
+		},
+	}
+	// Only whether the span has parents matters.
+	if len(span.Parents) > 0 {
+		prev.Parents = span.Parents[0:1]
+	}
+	buf, err := json.Marshal(&prev)
+	if err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// Decode a continuation token made by NewQueryToken.
+func ParseQueryToken(token string) (*Span, error) {
+	buf, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid continuation token: %s",
+			err.Error()))
+	}
+	var prev Span
+	err = json.Unmarshal(buf, &prev)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid continuation token: %s",
+			err.Error()))
+	}
+	if problem := prev.Id.FindProblem(); problem != "" {
+		return nil, errors.New(fmt.Sprintf("Invalid continuation token: "+
+			"%s", problem))
+	}
+	return &prev, nil
 }
 
 func (query *Query) String() string {
@@ -20,6 +20,7 @@
 package common
 
 import (
+	"encoding/json"
 	"testing"
 )
 
@@ -48,3 +49,30 @@ func TestValidFields(t *testing.T) {
 		t.Fatalf("field %s was invalid, but IsValid returned true.\n", invalidField)
 	}
 }
+
+func TestNegatedPredicateJson(t *testing.T) {
+	var pred Predicate
+	err := json.Unmarshal([]byte(`{"op":"nc","field":"description",`+
+		`"Val":"heartbeat"}`), &pred)
+	if err != nil {
+		t.Fatalf("failed to unmarshal predicate: %s\n", err.Error())
+	}
+	if pred.Op != NOT_CONTAINS || !pred.IsNegated() || pred.Negate {
+		t.Fatalf("unexpected predicate %s\n", pred.String())
+	}
+	err = json.Unmarshal([]byte(`{"op":"cn","field":"description",`+
+		`"Val":"heartbeat","negate":true}`), &pred)
+	if err != nil {
+		t.Fatalf("failed to unmarshal predicate: %s\n", err.Error())
+	}
+	if pred.Op != CONTAINS || !pred.IsNegated() {
+		t.Fatalf("unexpected predicate %s\n", pred.String())
+	}
+	// Predicates which aren't negated look the same as they always did.
+	pred = Predicate{Op: EQUALS, Field: DESCRIPTION, Val: "x"}
+	ExpectStrEqual(t, `{"op":"eq","field":"description","Val":"x"}`,
+		pred.String())
+	if pred.IsNegated() {
+		t.Fatalf("predicate %s should not be negated.\n", pred.String())
+	}
+}
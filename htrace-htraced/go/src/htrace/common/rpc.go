@@ -19,16 +19,83 @@
 
 package common
 
+import (
+	"encoding/json"
+)
+
 // The 4-byte magic number which is sent first in the HRPC header
 const HRPC_MAGIC = 0x43525448
 
+// The version of the HRPC protocol.  Version 0 servers predate
+// METHOD_ID_HELLO, and close the connection when they get a request for a
+// method they don't know.  Version 1 servers answer such requests with an
+// ERR_UNSUPPORTED_METHOD error, and keep the connection open.  Version 2
+// servers let a client have several WriteSpans requests in flight at once on
+// one connection, and say how many in their Hello response.  Their responses
+// may come back in a different order than the requests were sent.
+const HRPC_PROTOCOL_VERSION = 2
+
+// The number of requests which a version 2 server lets a client have in
+// flight at once on one connection.
+const HRPC_MAX_IN_FLIGHT = 64
+
 // Method ID codes.  Do not reorder these.
 const (
 	METHOD_ID_NONE        = 0
 	METHOD_ID_WRITE_SPANS = iota
+	METHOD_ID_HELLO
 )
 
 const METHOD_NAME_WRITE_SPANS = "HrpcHandler.WriteSpans"
+const METHOD_NAME_HELLO = "HrpcHandler.Hello"
+
+// A set of HRPC methods.  Bit N is set if the method with ID N is in the set.
+type HrpcMethodSet uint64
+
+// The methods which this version of HRPC has.
+const HRPC_ALL_METHODS = HrpcMethodSet(1<<METHOD_ID_WRITE_SPANS |
+	1<<METHOD_ID_HELLO)
+
+// The methods which version 0 servers support.
+const HRPC_LEGACY_METHODS = HrpcMethodSet(1 << METHOD_ID_WRITE_SPANS)
+
+func (set HrpcMethodSet) Contains(id uint32) bool {
+	return id < 64 && set&(1<<id) != 0
+}
+
+// Get the names of the methods in the set, in method ID order.  Methods which
+// this version of HRPC doesn't know are left out.
+func (set HrpcMethodSet) Names() []string {
+	names := make([]string, 0)
+	for id := uint32(0); id < 64; id++ {
+		if set.Contains(id) {
+			name := HrpcMethodIdToMethodName(id)
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// The first request on an HRPC connection.  The client says which methods it
+// supports, and the server answers with the methods it supports.  From then
+// on, each side rejects requests for methods which the other side doesn't
+// support with ERR_UNSUPPORTED_METHOD.  A client which doesn't send a Hello
+// may use any method the server supports.
+type HrpcHelloReq struct {
+	ProtocolVersion uint32
+	Methods         HrpcMethodSet
+}
+
+// The response to an HrpcHelloReq.  MaxInFlight is the number of requests
+// the client may have in flight at once on the connection.  Servers older
+// than version 2 don't send it, and must be sent one request at a time.
+type HrpcHelloResp struct {
+	ProtocolVersion uint32
+	Methods         HrpcMethodSet
+	MaxInFlight     uint32
+}
 
 // Maximum length of the error message passed in an HRPC response
 const MAX_HRPC_ERROR_LENGTH = 4 * 1024 * 1024
@@ -41,6 +108,115 @@ const MAX_HRPC_BODY_LENGTH = 32 * 1024 * 1024
 type WriteSpansReq struct {
 	DefaultTrid string `json:",omitempty"`
 	NumSpans    int
+
+	// Optional metadata about the batch, such as the user or job which wrote
+	// it.  The metadata is recorded in the audit log, and is not stored with
+	// the spans.
+	Metadata map[string]string `json:",omitempty"`
+
+	// The token which authorizes the write, for HRPC requests.  REST
+	// requests send their token in the Authorization header instead.
+	AuthToken string `json:",omitempty"`
+
+	// The write groups which spans of this request belong to.  See
+	// WriteGroup.
+	Groups []WriteGroup `json:",omitempty"`
+}
+
+// A group of spans which the client expects to be delivered together, such as
+// the spans of a trace.  The server counts the members of the group which it
+// accepts, across requests, so that /groups/{id} can tell whether some of
+// them never arrived.  Invalid groups are ignored; they never cause spans to
+// be rejected.
+type WriteGroup struct {
+	// The ID of the group, chosen by the client.  It should be unique, for
+	// example the ID of the trace's root span.
+	Id string
+
+	// The number of spans in the group.  This should be the same in every
+	// request which declares the group.
+	Size int
+
+	// The IDs of the spans in this request which belong to the group.  If
+	// this is empty, every span in the request belongs to it.
+	SpanIds []SpanId `json:",omitempty"`
+}
+
+// Info returned by /groups/{id}
+type WriteGroupStatus struct {
+	Id string
+
+	// The number of spans in the group, as first declared.
+	Size int
+
+	// The number of distinct members the server has accepted, and the
+	// number it is still waiting for.
+	Received int
+	Missing  int
+
+	// True once every member has been accepted.
+	Complete bool
+
+	// When the group was first declared, and when a member last arrived, in
+	// UTC milliseconds since the epoch.
+	CreatedMs int64
+	UpdatedMs int64
+
+	// When the last member arrived, or 0 if the group is not complete.
+	CompletedMs int64 `json:",omitempty"`
+
+	// When the server will forget the group, unless more members arrive.
+	ExpiresMs int64
+}
+
+// A permission which a request needs.
+type Permission string
+
+const (
+	// Queries, span lookups, and stats.
+	PERM_READ Permission = "read"
+
+	// Writing spans.
+	PERM_WRITE Permission = "write"
+
+	// Operations which change the server, or reveal its configuration.
+	PERM_ADMIN Permission = "admin"
+)
+
+// The permissions, in order.
+var ALL_PERMISSIONS = []Permission{PERM_READ, PERM_WRITE, PERM_ADMIN}
+
+// The prefix of the Authorization header value which carries a token.
+const AUTH_HEADER_PREFIX = "Bearer "
+
+// An entry in the audit log, as returned by /server/audit.  There is one entry
+// for each WriteSpans request.
+type AuditEntry struct {
+	// The sequence number of the entry.  Later entries have higher sequence
+	// numbers.
+	Seq uint64
+
+	// When the request was handled, in milliseconds since the epoch.
+	TimeMs int64
+
+	// The address of the client which sent the request.
+	Addr string
+
+	// The transport the request came in on: "rest", "hrpc", or "zipkin".
+	Transport string
+
+	// The number of spans in the request.
+	NumSpans int
+
+	// The number of spans which were accepted and rejected.
+	Accepted int
+	Rejected int
+
+	// The metadata which the client attached to the request.
+	Metadata map[string]string `json:",omitempty"`
+
+	// True if some of the metadata was dropped because it was too large.
+	MetadataTruncated bool `json:",omitempty"`
 }
 
 // Info returned by /server/version
@@ -50,10 +226,95 @@ type ServerVersion struct {
 
 	// The git hash that this software was built with.
 	GitVersion string
+
+	// The datastore backend, "leveldb" or "memory".
+	DatastoreBackend string
+
+	// True if the datastore keeps spans across restarts.  The memory
+	// datastore doesn't.
+	Persistent bool
+
+	// The maximum number of spans the datastore will hold, or 0 if there is
+	// no limit.  Once the datastore is full, the spans with the oldest begin
+	// times are evicted to make room for new ones.
+	MaxSpans uint64
+
+	// True if the server was started with read.only set, and rejects span
+	// writes.
+	ReadOnly bool
+
+	// The DaemonId of the datastore, as a hex string like
+	// 0x0123456789abcdef.  Older servers don't send this.
+	DaemonId string `json:",omitempty"`
+
+	// The maximum number of spans, and bytes, which the server accepts in a
+	// single WriteSpans request, or 0 if there is no limit.  Older servers
+	// don't send these.
+	MaxWriteSpans int `json:",omitempty"`
+	MaxWriteBytes int `json:",omitempty"`
+
+	// The addresses the REST and HRPC servers listen on, such as
+	// "0.0.0.0:9096" or "unix:///var/run/htraced.sock".  HrpcAddr is empty
+	// if the server isn't running HRPC.  Older servers don't send these.
+	RestAddr string `json:",omitempty"`
+	HrpcAddr string `json:",omitempty"`
+
+	// The HRPC protocol version, and the HRPC methods, which the server
+	// supports.  These are empty if the server isn't running HRPC, or is too
+	// old to send them.
+	HrpcProtocolVersion uint32   `json:",omitempty"`
+	HrpcMethods         []string `json:",omitempty"`
 }
 
 // A response to a WriteSpansReq
 type WriteSpansResp struct {
+	// The number of spans which were dropped because their tracer is over a
+	// quota with the reject policy.
+	QuotaRejected int `json:",omitempty"`
+
+	// The number of spans which were dropped because their tracer is over a
+	// quota with the sample policy.
+	QuotaSampledOut int `json:",omitempty"`
+
+	// The number of spans which were accepted, and the number which were
+	// dropped for any reason, including quotas.  Only REST responses set
+	// these.
+	Accepted int `json:",omitempty"`
+	Rejected int `json:",omitempty"`
+
+	// The number of span documents in a REST request which could not be
+	// parsed, and were skipped.  These are not counted in Rejected.
+	ParseSkipped int `json:",omitempty"`
+
+	// The first MAX_PARSE_FAILURES of the skipped documents.
+	ParseFailures []SpanParseFailure `json:",omitempty"`
+}
+
+// The maximum number of skipped span documents which a WriteSpansResp lists.
+const MAX_PARSE_FAILURES = 100
+
+// A span document in a REST WriteSpans request which could not be parsed.
+type SpanParseFailure struct {
+	// The index of the document in the request, starting at 0.
+	Index int
+
+	// Why the document could not be parsed.
+	Error string
+}
+
+// The 4-byte magic number which starts every UDP span datagram.
+const UDP_MAGIC = 0x55525448
+
+// The version of the UDP datagram format.  The header is followed by
+// NumSpans msgpack-encoded spans.
+const UDP_VERSION_MSGPACK = 1
+
+// The header at the start of a UDP span datagram.  Like the HRPC headers, it
+// is sent in little-endian byte order.
+type UdpDatagramHeader struct {
+	Magic    uint32
+	Version  uint16
+	NumSpans uint16
 }
 
 // The header which is sent over the wire for HRPC
@@ -76,6 +337,8 @@ func HrpcMethodIdToMethodName(id uint32) string {
 	switch id {
 	case METHOD_ID_WRITE_SPANS:
 		return METHOD_NAME_WRITE_SPANS
+	case METHOD_ID_HELLO:
+		return METHOD_NAME_HELLO
 	default:
 		return ""
 	}
@@ -85,6 +348,8 @@ func HrpcMethodNameToId(name string) uint32 {
 	switch name {
 	case METHOD_NAME_WRITE_SPANS:
 		return METHOD_ID_WRITE_SPANS
+	case METHOD_NAME_HELLO:
+		return METHOD_ID_HELLO
 	default:
 		return METHOD_ID_NONE
 	}
@@ -96,18 +361,78 @@ type SpanMetrics struct {
 
 	// The total number of spans dropped by the server.
 	ServerDropped uint64
+
+	// The total number of duplicate parent IDs which the server removed
+	// from incoming spans.
+	DuplicateParents uint64
+
+	// The total number of self-referencing parent IDs which the server
+	// removed from incoming spans.
+	SelfParents uint64
+
+	// The total number of span documents in REST WriteSpans requests which
+	// could not be parsed, and were skipped.
+	ParseSkipped uint64
+
+	// The total number of info keys with the reserved prefix which the
+	// client tried to set.
+	ReservedInfoKeys uint64
+
+	// The total number of spans the client sent which ended before they
+	// began.  See ingest.negative.duration.policy.
+	NegativeDurations uint64
 }
 
 // A map from network address strings to SpanMetrics structures.
 type SpanMetricsMap map[string]*SpanMetrics
 
+// The span metrics for a single client address.
+type ClientSpanMetrics struct {
+	// The network address of the client.
+	Addr string
+
+	SpanMetrics
+}
+
+// A client which sent spans that ended before they began.
+type NegativeDurationOffender struct {
+	// The network address of the client.
+	Addr string
+
+	// The number of such spans the client sent.
+	NumSpans uint64
+
+	// The span which ended the furthest before it began, and by how much, in
+	// milliseconds, rounded up.  The span ID is omitted if it isn't known.
+	WorstSpanId   SpanId `json:",omitempty"`
+	WorstTracerId string
+	WorstMs       int64
+
+	// When the client last sent such a span, in UTC milliseconds since the
+	// epoch.
+	LastMs int64
+}
+
+// Info returned by /server/stats/clients
+type ClientStatsResp struct {
+	// The span metrics for each client, sorted by address.
+	Clients []*ClientSpanMetrics
+
+	// The address to pass as "after" in the next request in order to
+	// continue where this one left off, or the empty string if there are no
+	// more clients.
+	Next string
+}
+
 // Info returned by /server/stats
 type ServerStats struct {
 	// Statistics for each shard (directory)
 	Dirs []StorageDirectoryStats
 
-	// Per-host Span Metrics
-	HostSpanMetrics SpanMetricsMap
+	// The number of client addresses which the server is tracking span
+	// metrics for.  The metrics themselves are returned by
+	// /server/stats/clients.
+	NumClients int
 
 	// The time (in UTC milliseconds since the epoch) when the
 	// datastore was last started.
@@ -119,6 +444,26 @@ type ServerStats struct {
 	// The total number of spans which have been reaped.
 	ReapedSpans uint64
 
+	// The total number of spans which have been deleted, and kept, by
+	// downsampling.  See span.downsample.age.ms.
+	DownsampledSpans    uint64
+	DownsampleKeptSpans uint64
+
+	// The number of write groups the server is tracking, and the total
+	// number it has forgotten because they expired, or to make room for
+	// others.  See write.groups.max.
+	WriteGroups        int
+	ExpiredWriteGroups uint64
+	EvictedWriteGroups uint64
+
+	// The total number of spans which have been evicted because the memory
+	// datastore was full.
+	EvictedSpans uint64
+
+	// The total number of spans which were dropped from the active span index
+	// because they didn't finish within the maximum age.
+	ExpiredActiveSpans uint64
+
 	// The total number of spans which have been ingested since the server started, by WriteSpans
 	// requests.  This number counts spans that didn't get written to persistent storage as well as
 	// those that did.
@@ -130,11 +475,653 @@ type ServerStats struct {
 	// The total number of spans dropped by the server since the server started.
 	ServerDroppedSpans uint64
 
+	// The total number of spans dropped because their shard was quarantined.
+	// These are also counted in ServerDroppedSpans.
+	QuarantineDroppedSpans uint64
+
+	// The total number of ingested spans which were left out of the duration
+	// index because they were shorter than index.min.duration.ms.
+	IndexSkippedSpans uint64
+
+	// The total number of ingested spans which ended before they began, and
+	// what the server does with them.  See ingest.negative.duration.policy.
+	NegativeDurationSpans  uint64
+	NegativeDurationPolicy string
+
+	// The clients which most recently sent spans that ended before they
+	// began, with the worst offenders first.
+	NegativeDurationOffenders []NegativeDurationOffender `json:",omitempty"`
+
+	// The total number of ingested spans which had more parents than
+	// index.max.parents, so that only the first index.max.parents of them
+	// got parent index entries.
+	ParentIndexTruncatedSpans uint64
+
+	// The total number of invalid info entries which were removed from
+	// ingested spans.  See ingest.info.policy.
+	InfoEntriesStripped uint64
+
+	// The most parents any span ingested since the server started had, and
+	// the ID and tracer ID of that span.
+	MaxNumParents         uint64
+	MaxNumParentsSpanId   SpanId `json:",omitempty"`
+	MaxNumParentsTracerId string `json:",omitempty"`
+
+	// The maximum and average number of parents of the last few spans
+	// ingested.
+	RecentMaxNumParents     uint32
+	RecentAverageNumParents uint32
+
+	// The total number of ingested spans with each span flag set, keyed by
+	// flag name.  Spans with several flags are counted once for each.
+	FlaggedSpans map[string]uint64 `json:",omitempty"`
+
+	// The total number of failed spans ingested.  See SpanData#Error.
+	ErrorSpans uint64
+
+	// The total number of spans which arrived too late to be covered by the
+	// visibility watermark.  See /server/watermark.
+	LateSpans uint64
+
+	// The number of span and children lookups which were and weren't
+	// answered from the in-memory read caches.
+	SpanCacheHits       uint64
+	SpanCacheMisses     uint64
+	ChildrenCacheHits   uint64
+	ChildrenCacheMisses uint64
+
+	// The number of span lookups which asked every shard at once, the number
+	// of shard probes which those lookups abandoned because another shard
+	// answered first, and the number of lookups which gave up on a slow
+	// shard and reported the span as not found.
+	HedgedLookups        uint64
+	HedgeCancels         uint64
+	LookupDeadlineMisses uint64
+
+	// The number of sampled spans which the read-after-write canary read
+	// back correctly, could not find, and read back with different data.
+	// See /server/canary.
+	CanaryVerified   uint64
+	CanaryNotFound   uint64
+	CanaryMismatches uint64
+
+	// The number of spans which were replayed from the intake logs when the
+	// server started, and how long the replay took, in milliseconds.
+	IntakeReplayedSpans uint64
+	IntakeReplayMs      uint64
+
+	// The number of times a batch of spans had to wait for room in a full
+	// intake log.
+	IntakeLogWaits uint64
+
 	// The maximum latency of a writeSpans request, in milliseconds.
 	MaxWriteSpansLatencyMs uint32
 
 	// The average latency of a writeSpans request, in milliseconds.
 	AverageWriteSpansLatencyMs uint32
+
+	// The total time the REST ingest pipeline has spent decoding spans, and
+	// validating them and handing them to the shards, in milliseconds.  The
+	// time spent by each goroutine of a stage is added up.  Small requests
+	// don't use the pipeline, and are not counted.
+	IngestDecodeMs   uint64
+	IngestValidateMs uint64
+
+	// The number of HRPC connections which are currently open.
+	HrpcOpenConnections int64
+
+	// The total number of HRPC connections which were closed because they
+	// were idle for too long.
+	HrpcIdleCloses uint64
+
+	// The total number of HRPC requests which were aborted because the client
+	// took too long to send the request or receive the response.
+	HrpcDeadlineAborts uint64
+
+	// The total number of HRPC connections which were rejected because there
+	// were too many connections open.
+	HrpcAcceptRejections uint64
+
+	// The total number of HRPC requests which were rejected because they
+	// were bigger than hrpc.max.message.bytes.
+	HrpcOversizedMessages uint64
+
+	// The total number of HRPC connections which were closed because they
+	// sent a request frame we couldn't parse.
+	HrpcMalformedFrames uint64
+
+	// The total number of spans which were dropped because their tracer was
+	// over a quota with the reject policy.
+	QuotaRejectedSpans uint64
+
+	// The total number of spans which were dropped because their tracer was
+	// over a quota with the sample policy.
+	QuotaSampledOutSpans uint64
+
+	// The total number of UDP datagrams the server has received.
+	UdpDatagrams uint64
+
+	// The total number of UDP datagrams with a bad header, or a span which
+	// could not be decoded.
+	UdpDecodeFailures uint64
+
+	// The total number of UDP datagrams which ended before all the spans in
+	// the header.
+	UdpTruncatedDatagrams uint64
+
+	// The total number of UDP datagrams which were dropped because they were
+	// larger than udp.max.datagram.bytes.
+	UdpOversizedDatagrams uint64
+
+	// The total number of UDP datagrams which were dropped because ingestion
+	// was paused.
+	UdpPausedDatagrams uint64
+
+	// The number of requests which were denied because their token didn't
+	// grant the read, write, or admin permission.
+	AuthReadDenials  uint64
+	AuthWriteDenials uint64
+	AuthAdminDenials uint64
+
+	// Statistics about the Go runtime of the server process.
+	Runtime RuntimeStats
+
+	// The response times of the REST endpoints, by class.
+	Endpoints []EndpointSli
+
+	// The tracers which have used more distinct span descriptions than
+	// metrics.description.cardinality.limit, sorted by tracer ID.
+	HighCardinalityTracers []HighCardinalityTracer
+
+	// The number of spans each principal has written, for the principals
+	// which wrote spans most recently.  See metrics.max.principal.entries.
+	SpansByPrincipal map[string]uint64
+
+	// The number of failed spans ingested from each tracer, for the tracers
+	// which sent failed spans most recently.  See
+	// metrics.max.tracer.entries.
+	ErrorSpansByTracer map[string]uint64
+
+	// The number of stored spans, and the range of their begin times.
+	SpanCounts
+}
+
+// A tracer whose span descriptions are nearly all different, usually because
+// they contain ids or numbers.
+type HighCardinalityTracer struct {
+	// The tracer ID.
+	TracerId string
+
+	// The number of distinct descriptions we saw before we stopped counting.
+	// This is the cardinality limit.
+	DistinctDescriptions uint64
+
+	// The number of spans from this tracer we have seen since it reached the
+	// limit.  Those whose descriptions had ids or numbers in them were
+	// indexed by their normalized descriptions.
+	SpansOverLimit uint64
+
+	// The description of the span which reached the limit.
+	Description string
+
+	// The same description, with ids and numbers replaced by '*'.  This
+	// shows what the description probably looks like without the parts
+	// which vary.
+	NormalizedDescription string
+}
+
+// The REST endpoint classes which response times are tracked for.
+const (
+	ENDPOINT_CLASS_SPAN     = "span"
+	ENDPOINT_CLASS_CHILDREN = "children"
+	ENDPOINT_CLASS_QUERY    = "query"
+	ENDPOINT_CLASS_WRITE    = "write"
+	ENDPOINT_CLASS_ADMIN    = "admin"
+)
+
+// How quickly a class of REST endpoints has been answering requests, scored
+// the way Apdex scores them.  Requests which fail with a 5xx status count as
+// frustrated, however quickly they fail.
+type EndpointSli struct {
+	// The endpoint class.  One of the ENDPOINT_CLASS_* constants.
+	Class string
+
+	// The number of requests answered since the server started.
+	Requests uint64
+
+	// The number of requests answered within rest.sli.satisfied.ms, within
+	// rest.sli.tolerating.ms, and the rest.
+	Satisfied  uint64
+	Tolerating uint64
+	Frustrated uint64
+
+	// (Satisfied + Tolerating / 2) / Requests, or 1 if there have been no
+	// requests.
+	Apdex float64
+
+	// The number of requests which failed with a 4xx or 5xx status, and
+	// their percentages of all requests.
+	ClientErrors       uint64
+	ServerErrors       uint64
+	ClientErrorPercent float64
+	ServerErrorPercent float64
+
+	// The maximum and average response times of recent requests, in
+	// milliseconds.
+	MaxLatencyMs     uint32
+	AverageLatencyMs uint32
+}
+
+// Statistics about the Go runtime of the server process.  These are sampled
+// periodically rather than on every request, so they may be a few seconds old.
+type RuntimeStats struct {
+	// When these statistics were sampled (in UTC milliseconds since the
+	// epoch.)
+	CollectedMs int64
+
+	// The number of goroutines which currently exist.
+	NumGoroutines int
+
+	// The number of open file descriptors, or -1 if this could not be
+	// determined on this platform.
+	NumOpenFds int
+
+	// The number of bytes in heap spans which are in use.
+	HeapInuseBytes uint64
+
+	// The number of bytes of allocated heap objects.
+	HeapAllocBytes uint64
+
+	// The number of completed garbage collection cycles.
+	NumGc uint32
+
+	// The total time spent in garbage collection pauses since the server
+	// started, in nanoseconds.
+	GcPauseTotalNs uint64
+
+	// The maximum duration of a recent garbage collection pause, in
+	// microseconds.
+	MaxGcPauseUs uint32
+
+	// The average duration of a recent garbage collection pause, in
+	// microseconds.
+	AverageGcPauseUs uint32
+}
+
+// Approximate information about the spans stored in the datastore.  This is
+// maintained incrementally, so it is cheap to fetch.
+type SpanCounts struct {
+	// The approximate number of spans stored in the datastore.  This can be
+	// off by the number of spans which are being written or reaped while it
+	// is computed.
+	NumSpans uint64
+
+	// True if NumSpans may be further off than usual, because a shard is
+	// quarantined or still recounting its spans after an unclean shutdown.
+	NumSpansApproximate bool
+
+	// The earliest begin time of any stored span, in UTC milliseconds since
+	// the epoch.  0 if there are no spans.
+	OldestBeginMs int64
+
+	// The latest begin time of any stored span, in UTC milliseconds since the
+	// epoch.  0 if there are no spans.
+	NewestBeginMs int64
+}
+
+// Info returned by /span/{id}/links
+type LinkedSpans struct {
+	// The spans which the requested span links to.
+	LinksTo []*Span
+
+	// The spans which link to the requested span.
+	LinkedFrom []*Span
+}
+
+// Info returned by /spans/seq
+type SpansBySeqResp struct {
+	// The spans, in sequence number order.  Each span has its Seq field set.
+	Spans []*Span
+
+	// The sequence number to pass to the next request in order to continue
+	// where this one left off.
+	NextSeq uint64
+}
+
+// Info returned by /spans/changed
+type SpansChangedResp struct {
+	// The spans which arrived at or after the requested time, in arrival
+	// order.
+	Spans []*Span
+
+	// The cursor to pass to the next request in order to continue where
+	// this one left off.  If no spans were returned, this is the same as the
+	// cursor that was passed in.
+	Cursor string
+}
+
+// A node in a flame tree, as returned by /span/{id}/flame
+type FlameNode struct {
+	Id          SpanId `json:"a"`
+	Description string `json:"d"`
+
+	// The begin and end times of the span, clamped to lie within the begin
+	// and end times of its parent.
+	Begin int64 `json:"b"`
+	End   int64 `json:"e"`
+
+	// The clamped begin and end times in nanoseconds.  These are only set
+	// when some span in the tree had nanosecond times.  Spans without them
+	// are treated as beginning and ending on a millisecond boundary.
+	BeginNs int64 `json:"bn,omitempty"`
+	EndNs   int64 `json:"en,omitempty"`
+
+	// True if Begin or End had to be adjusted to fit within the parent.
+	// This usually indicates clock skew between processes.
+	Clamped bool `json:"c,omitempty"`
+
+	// The time in milliseconds which the span spent outside of any of its
+	// children.  This is never negative.
+	SelfMs int64 `json:"s"`
+
+	// The self time in nanoseconds.  Like BeginNs and EndNs, this is only
+	// set when some span in the tree had nanosecond times.
+	SelfNs int64 `json:"sn,omitempty"`
+
+	// The children of the span, sorted by begin time.
+	Children []*FlameNode `json:"k"`
+}
+
+// A group of query results which belong to the same trace.  Returned by
+// /query when groupByTrace is set.
+type TraceGroup struct {
+	// The root of the trace.  If the parent chain of the matches was broken,
+	// this is the highest ancestor which could be found.
+	Root *Span `json:"root"`
+
+	// The matching spans in this trace, in the order the query returned them.
+	Matches []*Span `json:"matches"`
+
+	// True if Root is not a real root, because a parent could not be found,
+	// or the parent chain was too long to follow.
+	Incomplete bool `json:"incomplete,omitempty"`
+}
+
+// Info returned by /span/{id}/flame
+type FlameTree struct {
+	// The root of the tree.
+	Root *FlameNode
+
+	// The number of spans in the tree.
+	NumSpans int
+
+	// The number of child span IDs which we found in the parent index, but
+	// could not find the spans for.
+	NumMissing int
+
+	// True if there were more descendants than the limit allowed.
+	Truncated bool
+}
+
+// The tracer id used in the service map for parent spans which could not be
+// found.
+const SERVICE_MAP_UNKNOWN_TRACER = "unknown"
+
+// An edge in the service map.  Each edge aggregates the spans of one tracer
+// which have a parent span from another (or the same) tracer.
+type ServiceMapEdge struct {
+	// The tracer id of the parent spans.
+	Parent string
+
+	// The tracer id of the child spans.
+	Child string
+
+	// The number of parent-child relationships.  A span with several parents
+	// is counted once for each of them.
+	Count uint64
+
+	// The total, average, minimum, and maximum durations of the child spans,
+	// in milliseconds.
+	TotalDurationMs int64
+	AvgDurationMs   int64
+	MinDurationMs   int64
+	MaxDurationMs   int64
+}
+
+// The latency statistics of the finished spans with one description.
+type DescriptionStats struct {
+	Description string
+
+	// The number of spans.
+	Count uint64
+
+	// The total, minimum, and maximum duration of the spans, in nanoseconds.
+	SumNs int64
+	MinNs int64
+	MaxNs int64
+
+	// Estimates of the median, 90th, and 99th percentile duration, in
+	// nanoseconds.  They are within SKETCH_RELATIVE_ACCURACY of the true
+	// values.
+	P50Ns int64
+	P90Ns int64
+	P99Ns int64
+
+	// The number of the spans which failed.  See SpanData#Error.
+	Errors uint64
+
+	// The number of the spans which were deleted by downsampling.  These are
+	// still included in the other statistics.
+	Downsampled uint64
+}
+
+// Info returned by /stats/descriptions
+type DescriptionStatsResponse struct {
+	// The time window the statistics cover, in milliseconds since the epoch.
+	// The statistics are kept per hour, so this is the requested window,
+	// widened to whole hours.  It includes spans which begin at or after
+	// BeginMs, and before EndMs.
+	BeginMs int64
+	EndMs   int64
+
+	// The statistics of the most common descriptions, most common first.
+	Descriptions []DescriptionStats
+
+	// The statistics of the spans with all other descriptions.  Its
+	// Description is empty.
+	Other DescriptionStats
+}
+
+// Info returned by /servicemap
+type ServiceMap struct {
+	// The time window which was scanned, in milliseconds since the epoch.
+	// It includes spans which begin at or after BeginMs, and before EndMs.
+	BeginMs int64
+	EndMs   int64
+
+	// The edges of the map, sorted by parent and then by child.
+	Edges []ServiceMapEdge
+
+	// The number of spans which were scanned.
+	NumSpans int
+
+	// The number of parent spans which could not be found.  Each of these is
+	// counted in an edge from SERVICE_MAP_UNKNOWN_TRACER.
+	NumUnknownParents int
+
+	// True if the window held more spans than the scan limit, so that only
+	// some of them were counted.
+	Partial bool
+}
+
+// A span in Zipkin v2 JSON format, as returned by /span/{id}/zipkin and
+// /query/zipkin, and accepted by /api/v2/spans.  Times are in microseconds,
+// and ids are hex strings.
+type ZipkinSpan struct {
+	TraceId        string             `json:"traceId"`
+	Id             string             `json:"id"`
+	ParentId       string             `json:"parentId,omitempty"`
+	Kind           string             `json:"kind,omitempty"`
+	Name           string             `json:"name,omitempty"`
+	Timestamp      int64              `json:"timestamp,omitempty"`
+	Duration       int64              `json:"duration,omitempty"`
+	Debug          bool               `json:"debug,omitempty"`
+	Shared         bool               `json:"shared,omitempty"`
+	LocalEndpoint  *ZipkinEndpoint    `json:"localEndpoint,omitempty"`
+	RemoteEndpoint *ZipkinEndpoint    `json:"remoteEndpoint,omitempty"`
+	Annotations    []ZipkinAnnotation `json:"annotations,omitempty"`
+	Tags           map[string]string  `json:"tags,omitempty"`
+}
+
+type ZipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+	Ipv4        string `json:"ipv4,omitempty"`
+	Ipv6        string `json:"ipv6,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type ZipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+// The Zipkin tag which holds the ids of the parents of a span after the
+// first, separated by commas.  Zipkin spans can only have one parent.
+const ZIPKIN_EXTRA_PARENTS_TAG = "htrace.extraParents"
+
+// The Info keys under which spans received in Zipkin format keep the Zipkin
+// fields which have no place in our spans.  The endpoints are stored as JSON.
+const ZIPKIN_KIND_INFO_KEY = "zipkin.kind"
+const ZIPKIN_SHARED_INFO_KEY = "zipkin.shared"
+const ZIPKIN_TRACE_ID_INFO_KEY = "zipkin.traceId"
+const ZIPKIN_LOCAL_ENDPOINT_INFO_KEY = "zipkin.localEndpoint"
+const ZIPKIN_REMOTE_ENDPOINT_INFO_KEY = "zipkin.remoteEndpoint"
+
+// A value of a span field, and the number of spans which had it.
+type ValueCount struct {
+	Value string
+	Count int
+}
+
+// Info returned by /query/values
+type DistinctValues struct {
+	// The field whose values were collected.
+	Field Field
+
+	// The time window which was scanned, in milliseconds since the epoch.
+	// It includes spans which begin at or after BeginMs, and before EndMs.
+	BeginMs int64
+	EndMs   int64
+
+	// The most common values, ordered by count and then by value.
+	Values []ValueCount
+
+	// The number of distinct values which were found.  This may be more
+	// than the number of values returned.
+	NumValues int
+
+	// The number of spans which were scanned.
+	NumScanned int
+
+	// True if the window held more spans than the scan limit, so that only
+	// some of them were counted.
+	Partial bool
+}
+
+// Info returned by /query/timeseries
+type TimeSeries struct {
+	// The field the spans were bucketed by.
+	Field Field
+
+	// The time window which was counted, in milliseconds since the epoch.
+	// It includes spans which begin at or after BeginMs, and before EndMs.
+	BeginMs int64
+	EndMs   int64
+
+	// The width of each bucket, in milliseconds.  Bucket i counts the spans
+	// in [BeginMs + i * BucketMs, BeginMs + (i + 1) * BucketMs).  The buckets
+	// stop at EndMs, so the last ones may be narrower, or empty.
+	BucketMs int64
+
+	// The number of spans in each bucket.
+	Counts []uint64
+
+	// The number of spans which were scanned.
+	NumScanned int
+
+	// True if the window held more spans than the scan limit, so that only
+	// some of them were counted.
+	Partial bool
+
+	// True if the counts were taken from the description statistics, rather
+	// than from a scan.
+	FromStats bool
+}
+
+// The possible outcomes of a configuration reload, or of a change to a single
+// configuration key during a reload.
+const (
+	// All changes were applied.
+	CONF_RELOAD_OK = "ok"
+
+	// Some changes were ignored or failed to apply.
+	CONF_RELOAD_PARTIAL = "partial"
+
+	// The configuration could not be loaded, so nothing was changed.
+	CONF_RELOAD_FAILED = "failed"
+
+	// The change was applied to the running server.
+	CONF_CHANGE_APPLIED = "applied"
+
+	// The key can't be changed without restarting the server.
+	CONF_CHANGE_IGNORED = "ignored"
+
+	// The key can be changed without restarting, but the new value was
+	// rejected.
+	CONF_CHANGE_FAILED = "failed"
+)
+
+// Info returned by /server/conf/reload
+type ConfReloadResult struct {
+	// The time (in UTC milliseconds since the epoch) of the reload.
+	TimeMs int64
+
+	// One of the CONF_RELOAD_* constants.
+	Outcome string
+
+	// If the configuration could not be loaded, the reason why.
+	Error string `json:",omitempty"`
+
+	// The keys whose values changed, sorted by key.
+	Changes []ConfChange
+}
+
+// A change to a single configuration key during a reload.
+type ConfChange struct {
+	Key      string
+	OldValue string
+	NewValue string
+
+	// One of the CONF_CHANGE_* constants.
+	Outcome string
+
+	// If the change was not applied, the reason why.
+	Reason string `json:",omitempty"`
+}
+
+// A heartbeat marker, as returned by /server/heartbeats
+type HeartbeatMarker struct {
+	// The time (in UTC milliseconds since the epoch) when the marker was
+	// written.
+	TimeMs int64
+
+	// The time (in UTC milliseconds since the epoch) when the datastore was
+	// last started.  IngestedSpans is reset to 0 when this changes.
+	StartMs int64
+
+	// The total number of spans which had been ingested since the server
+	// started, at the time the marker was written.
+	IngestedSpans uint64
 }
 
 type StorageDirectoryStats struct {
@@ -143,10 +1130,496 @@ type StorageDirectoryStats struct {
 	// The approximate number of bytes on disk present in this shard.
 	ApproximateBytes uint64
 
+	// The approximate number of spans stored in this shard.
+	NumSpans uint64
+
 	// leveldb.stats information
 	LevelDbStats string
+
+	// If the shard is quarantined, the error which caused it to be
+	// quarantined.
+	QuarantineError string
+
+	// The size of the shard's bloom filter, or 0 if bloom filters are
+	// disabled.
+	BloomFilterBytes uint64
+
+	// True if the bloom filter is in use.  After an unclean shutdown, the
+	// filter is not used until it has been brought up to date.
+	BloomFilterReady bool
+
+	// The estimated false positive rate of the bloom filter.
+	BloomFilterFpp float64
+
+	// The number of span lookups which skipped this shard because of the
+	// bloom filter.
+	BloomFilterSkips uint64
+
+	// The number of span lookups which the bloom filter let through.
+	BloomFilterProbes uint64
+
+	// The latency of the slowest span lookup this shard has answered, in
+	// milliseconds.
+	MaxLookupMs uint64
+
+	// The size of the shard's intake log, in bytes.  This is 0 if the intake
+	// log is disabled.
+	IntakeLogBytes uint64
+
+	// The number of level 0 files in the shard's leveldb instance.  Span
+	// lookups may have to read each of them, and leveldb slows down writes
+	// once there are too many.
+	Level0Files uint64
+
+	// Leveldb's compaction score for the shard: the biggest ratio of the
+	// size of a level to the size at which leveldb compacts it.  If this is
+	// 1 or more, compactions are behind.
+	CompactionScore float64
+
+	// The number of lookups of spans placed in this shard which the span
+	// cache answered, and which had to read the shards.  Leveldb doesn't
+	// count the hits of its own block cache.
+	SpanCacheHits   uint64
+	SpanCacheMisses uint64
+}
+
+// The health of a shard.
+type ShardHealth struct {
+	// The path to the shard's leveldb directory.
+	Path string
+
+	// True if the shard is healthy; false if it is quarantined.
+	Healthy bool
+
+	// The error which caused the shard to be quarantined, or the empty string
+	// if it is healthy.
+	Error string
+
+	// When the shard was quarantined, in UTC milliseconds since the epoch, or
+	// 0 if it is healthy.
+	QuarantinedMs int64
 }
 
+// Info returned by /server/health
+type ServerHealth struct {
+	// True if all shards are healthy.  Pausing ingestion doesn't make the
+	// server unhealthy.
+	Healthy bool
+
+	// The health of each shard, in shard index order.
+	Shards []ShardHealth
+
+	// Whether ingestion is paused.
+	IngestPause IngestPause
+}
+
+// Whether the server has stopped accepting spans, returned by
+// /server/ingest/pause and /server/ingest/resume.  The pause is not
+// persisted, so a server which restarts while paused starts up unpaused.
+type IngestPause struct {
+	// True if the server is rejecting span writes with ERR_INGEST_PAUSED.
+	Paused bool
+
+	// The principal which paused ingestion, or its address if the principal
+	// isn't known.
+	PausedBy string
+
+	// When ingestion was paused, in UTC milliseconds since the epoch.
+	PausedMs int64
+
+	// When the server will resume ingestion by itself, in UTC milliseconds
+	// since the epoch, or 0 if it will stay paused until it is resumed.
+	ResumeMs int64
+}
+
+// Info returned by /server/watermark
+type Watermark struct {
+	// Every span with a begin time before this (in UTC milliseconds since the
+	// epoch) which the server will accept has been written, and can be
+	// queried.  Spans which arrive more than LatenessMs late are not covered.
+	WatermarkMs int64
+
+	// How late, in milliseconds, a span can arrive and still be covered by
+	// the watermark.
+	LatenessMs int64
+
+	// True if the server rejects spans which arrive too late.
+	RejectLate bool
+
+	// The number of batches of spans which are waiting to be written.
+	PendingBatches int
+
+	// The total number of spans which arrived too late since the server
+	// started.
+	LateSpans uint64
+}
+
+// The ingest counters for a period of time, returned by
+// /server/stats/history.
+type StatsBucket struct {
+	// When the bucket starts, in UTC milliseconds since the epoch.
+	StartMs int64
+
+	// When the bucket ends, in UTC milliseconds since the epoch.  The bucket
+	// covers times before EndMs.
+	EndMs int64
+
+	// False if this is the current bucket, whose counters are still going
+	// up.
+	Complete bool
+
+	// The number of spans ingested, including dropped spans.
+	IngestedSpans uint64
+
+	// The number of spans written to the datastore.
+	WrittenSpans uint64
+
+	// The number of spans dropped by the server, for any reason.
+	ServerDroppedSpans uint64
+
+	// The number of spans dropped because their shard was quarantined.
+	QuarantineDroppedSpans uint64
+
+	// The number of spans dropped because their tracer was over a quota.
+	QuotaRejectedSpans   uint64
+	QuotaSampledOutSpans uint64
+
+	// The number of bytes of WriteSpans requests and UDP datagrams received.
+	BytesReceived uint64
+}
+
+// The faults injected by chaos mode, returned by /server/chaos.  See
+// chaos.enabled.
+type ChaosStats struct {
+	// True if chaos mode is enabled.  If it isn't, the counts are all 0.
+	Enabled bool
+
+	// The number of span batches whose shard write was delayed.
+	ShardWriteDelays uint64
+
+	// The total time shard writes were delayed, in milliseconds.
+	ShardWriteDelayMs uint64
+
+	// The number of WriteSpans requests which were rejected.
+	RejectedWriteSpans uint64
+
+	// The number of HRPC connections which were closed early.
+	HrpcEarlyCloses uint64
+
+	// The number of shard heartbeats which were delayed.
+	HeartbeatDelays uint64
+
+	// The total time shard heartbeats were delayed, in milliseconds.
+	HeartbeatDelayMs uint64
+}
+
+// The quota policies.  See quota.rules.
+const QUOTA_POLICY_REJECT = "reject"
+const QUOTA_POLICY_SAMPLE = "sample"
+
+// The state of a span quota, returned by /server/quotas.
+type QuotaStatus struct {
+	// The pattern which tracer IDs are matched against.
+	Pattern string
+
+	// The number of stored spans the matching tracers may have.
+	Limit uint64
+
+	// What happens to new spans once the limit is reached.  One of the
+	// QUOTA_POLICY_* constants.
+	Policy string
+
+	// The percentage of spans kept while a quota with the sample policy is
+	// being enforced.
+	SamplePercent int
+
+	// The number of stored spans which count against the quota, as of the
+	// last datastore heartbeat.
+	Usage uint64
+
+	// False if some shards haven't counted their spans yet, so that the
+	// usage may be too low.
+	UsageComplete bool
+
+	// True if usage has reached the limit, so that the policy is applied to
+	// new spans.
+	Enforcing bool
+
+	// The number of spans rejected because of this quota since the server
+	// started.
+	RejectedSpans uint64
+
+	// The number of spans sampled out because of this quota since the server
+	// started.
+	SampledOutSpans uint64
+}
+
+// Defines a latency service level objective.  The SLO is met if at least
+// TargetPercent percent of the matching spans which ended in the last
+// WindowMs milliseconds took at most ThresholdMs milliseconds.
+type SloDefinition struct {
+	// The name of the SLO.
+	Name string
+
+	// If non-empty, only spans with exactly this description count.
+	Description string `json:",omitempty"`
+
+	// If non-empty, only spans with exactly this tracer ID count.
+	TracerId string `json:",omitempty"`
+
+	// The longest duration a compliant span can have, in milliseconds.
+	ThresholdMs int64
+
+	// The percentage of spans which must be compliant.
+	TargetPercent float64
+
+	// The length of the window the SLO is evaluated over, in milliseconds.
+	WindowMs int64
+}
+
+// The counts for an SLO in part of its window.
+type SloBucket struct {
+	// When the bucket starts, in UTC milliseconds since the epoch.
+	StartMs int64
+
+	// When the bucket ends, in UTC milliseconds since the epoch.  The bucket
+	// covers spans which ended before EndMs.
+	EndMs int64
+
+	// False until the grace period for late spans after the end of the
+	// bucket has passed.  Until then, the counts may still go up.
+	Complete bool
+
+	// The number of spans which took at most the threshold.
+	CompliantSpans uint64
+
+	// The number of spans which took longer than the threshold.
+	ViolatingSpans uint64
+}
+
+// The state of an SLO, returned by /server/slos.
+type SloStatus struct {
+	Definition SloDefinition
+
+	// The number of compliant and violating spans in the window.
+	CompliantSpans uint64
+	ViolatingSpans uint64
+
+	// The percentage of the spans in the window which were compliant, or
+	// 100 if there were none.
+	CompliancePercent float64
+
+	// True if CompliancePercent is at least the target.
+	Met bool
+
+	// The number of matching spans which arrived too late to be counted,
+	// because the grace period for their bucket had passed.
+	LateSpans uint64
+
+	// The arrival time up to which spans have been evaluated, in UTC
+	// milliseconds since the epoch.
+	EvaluatedMs int64
+
+	// The buckets of the window, oldest first.
+	Buckets []SloBucket
+}
+
+// Describes a datastore snapshot.  This is written to the snapshot directory
+// once all the shards have been copied, and returned by /server/snapshot.
+type SnapshotManifest struct {
+	// The DaemonId of the datastore.
+	DaemonId uint64
+
+	// The layout version of the datastore.
+	LayoutVersion uint64
+
+	// The datastore backend which created the shards.
+	Backend string
+
+	// The placement strategy of the datastore.
+	Placement string
+
+	// The shard directories, relative to the snapshot directory, in shard
+	// index order.
+	Shards []string
+
+	// The snapshot holds exactly the spans whose sequence numbers are less
+	// than this, or 0 if sequence numbers are not enabled.
+	SeqWatermark uint64
+
+	// When the snapshot was taken, in UTC milliseconds since the epoch.
+	TimeMs int64
+}
+
+// The possible states of a snapshot.
+const (
+	// No snapshot has been taken since the server started.
+	SNAPSHOT_NONE = "none"
+
+	// The shards are being copied.
+	SNAPSHOT_RUNNING = "running"
+
+	// The snapshot is complete.
+	SNAPSHOT_DONE = "done"
+
+	// The snapshot failed.
+	SNAPSHOT_FAILED = "failed"
+)
+
+// Info returned by /server/snapshot and /server/snapshot/status
+type SnapshotStatus struct {
+	// One of the SNAPSHOT_* constants.
+	State string
+
+	// The snapshot directory.
+	Dest string `json:",omitempty"`
+
+	// When the snapshot was started and finished, in UTC milliseconds since
+	// the epoch.  EndMs is 0 while the snapshot is running.
+	StartMs int64 `json:",omitempty"`
+	EndMs   int64 `json:",omitempty"`
+
+	// The number of shards which have been copied so far.
+	ShardsDone int
+
+	// The total number of shards.
+	TotalShards int
+
+	// If the snapshot failed, the reason why.
+	Error string `json:",omitempty"`
+
+	// The manifest of the snapshot.  This is filled in as soon as the
+	// snapshot starts, but is only written to the snapshot directory once
+	// all the shards have been copied.
+	Manifest *SnapshotManifest `json:",omitempty"`
+}
+
+// The possible states of a tracer rename.
+const (
+	// No tracer rename has run since the server started.
+	TRACER_RENAME_NONE = "none"
+
+	// The shards are being scanned.
+	TRACER_RENAME_RUNNING = "running"
+
+	// Every shard has been scanned.
+	TRACER_RENAME_DONE = "done"
+
+	// The rename failed or was interrupted.  Starting it again resumes it
+	// where it stopped.
+	TRACER_RENAME_FAILED = "failed"
+)
+
+// Info returned by /server/tracers/rename and /server/tracers/rename/status
+type TracerRenameStatus struct {
+	// One of the TRACER_RENAME_* constants.
+	State string
+
+	// The tracer ID being renamed, and its new name.
+	From string `json:",omitempty"`
+	To   string `json:",omitempty"`
+
+	// True if this is a dry run, which counts the spans that would be
+	// renamed without changing them.
+	DryRun bool `json:",omitempty"`
+
+	// True if an alias was installed, so that spans which arrive with the
+	// old tracer ID are stored under the new one.
+	Alias bool `json:",omitempty"`
+
+	// True if this rename picked up where an earlier one, which was
+	// interrupted, left off.
+	Resumed bool `json:",omitempty"`
+
+	// When the rename was started and finished, in UTC milliseconds since
+	// the epoch.  EndMs is 0 while the rename is running.
+	StartMs int64 `json:",omitempty"`
+	EndMs   int64 `json:",omitempty"`
+
+	// The number of shards which have been scanned so far.
+	ShardsDone int
+
+	// The total number of shards.
+	TotalShards int
+
+	// The number of spans scanned so far.
+	ScannedSpans uint64
+
+	// The number of spans with the old tracer ID found so far.  Unless this
+	// is a dry run, they have all been renamed.
+	MatchedSpans uint64
+
+	// If the rename failed, the reason why.
+	Error string `json:",omitempty"`
+}
+
+// The possible states of a scan job.
+const (
+	// No scan job has run since the server started.
+	SCAN_JOB_NONE = "none"
+
+	// The shards are being scanned.
+	SCAN_JOB_RUNNING = "running"
+
+	// Every shard has been scanned, and the result is ready.
+	SCAN_JOB_DONE = "done"
+
+	// The job failed.
+	SCAN_JOB_FAILED = "failed"
+
+	// The job was cancelled, or interrupted because the server shut down.
+	SCAN_JOB_CANCELLED = "cancelled"
+)
+
+// Info returned by /server/scan, /server/scan/status, and /server/scan/cancel
+type ScanJobStatus struct {
+	// One of the SCAN_JOB_* constants.
+	State string
+
+	// The name of the job.
+	Name string `json:",omitempty"`
+
+	// When the job was started and finished, in UTC milliseconds since the
+	// epoch.  EndMs is 0 while the job is running.
+	StartMs int64 `json:",omitempty"`
+	EndMs   int64 `json:",omitempty"`
+
+	// The number of shards which have been scanned so far.
+	ShardsDone int
+
+	// The total number of shards.
+	TotalShards int
+
+	// The number of spans scanned so far.
+	ScannedSpans uint64
+
+	// The result of the job, once it is done.  The format depends on the
+	// job; see ScanJobDurations and ScanJobCounts.
+	Result json.RawMessage `json:",omitempty"`
+
+	// If the job failed, the reason why.
+	Error string `json:",omitempty"`
+}
+
+// The durations of a group of spans.
+type DurationSummary struct {
+	// The number of spans.
+	Count uint64
+
+	// The total, minimum, and maximum span durations, in milliseconds.
+	TotalMs int64
+	MinMs   int64
+	MaxMs   int64
+}
+
+// The result of the durationByDescription scan job: the durations of the
+// spans with each description.
+type ScanJobDurations map[string]*DurationSummary
+
+// The result of the countByTracer scan job: the number of spans with each
+// tracer ID.
+type ScanJobCounts map[string]uint64
+
 type ServerDebugInfoReq struct {
 }
 
@@ -157,3 +1630,218 @@ type ServerDebugInfo struct {
 	// Garbage collection statistics
 	GCStats string
 }
+
+// The reasons why htraced rejects spans as invalid.  See /server/rejections.
+const (
+	// The request, or a span in it, could not be decoded.  The rest of the
+	// request is dropped along with it.
+	REJECT_REASON_DECODE = "decode"
+
+	// The span has an invalid span ID.
+	REJECT_REASON_SPAN_ID = "spanId"
+
+	// The span, or the UDP datagram it came in, is too big.
+	REJECT_REASON_OVERSIZED = "oversized"
+
+	// The span ends before it begins.  This is only checked if
+	// ingest.validate.times is set, or ingest.negative.duration.policy is
+	// reject.
+	REJECT_REASON_TIMES = "times"
+
+	// An info key is empty, or longer than ingest.info.max.key.bytes.  This
+	// and the other info reasons are only used if ingest.info.policy is
+	// "reject".
+	REJECT_REASON_INFO_KEY = "infoKey"
+
+	// The info map has more than ingest.info.max.keys keys.
+	REJECT_REASON_INFO_COUNT = "infoCount"
+
+	// An info key or value is not valid UTF-8.
+	REJECT_REASON_INFO_UTF8 = "infoUtf8"
+
+	// An info key starts with the reserved prefix.
+	REJECT_REASON_INFO_RESERVED = "infoReserved"
+)
+
+// A span which htraced rejected, as returned by /server/rejections.
+type RejectedSpan struct {
+	// When the span was rejected, in milliseconds since the epoch.
+	TimeMs int64
+
+	// Why the span was rejected.  One of the REJECT_REASON_* constants.
+	Reason string
+
+	// The address of the client which sent the span.
+	Addr string
+
+	// The transport the span came in on: "rest", "hrpc", "zipkin", or
+	// "udp".
+	Transport string
+
+	// A description of the problem.
+	Message string
+
+	// The rejected data, if rejections.capture.payload is set.  If the span
+	// could be decoded, this is the span encoded as JSON.  Otherwise, it is
+	// the raw bytes which could not be decoded.
+	Payload []byte `json:",omitempty"`
+
+	// True if the payload was cut off at rejections.payload.max.bytes.
+	PayloadTruncated bool `json:",omitempty"`
+}
+
+// The rejected spans returned by /server/rejections.
+type Rejections struct {
+	// The number of spans rejected for each reason since the server started,
+	// or since the rejections were last cleared.
+	Counts map[string]uint64
+
+	// The most recent rejected spans, newest first.
+	Entries []RejectedSpan
+}
+
+// The kinds of read-after-write canary failure.
+const (
+	// The span could not be found.
+	CANARY_FAILURE_NOT_FOUND = "notFound"
+
+	// The span data read back was different from the data written.
+	CANARY_FAILURE_MISMATCH = "mismatch"
+)
+
+// A sampled span which the read-after-write canary could not read back
+// correctly.
+type CanaryFailure struct {
+	// When the span was checked, in milliseconds since the epoch.
+	TimeMs int64
+
+	// The ID of the span.
+	SpanId SpanId
+
+	// What went wrong.  One of the CANARY_FAILURE_* constants.
+	Kind string
+
+	// When the span was written, in milliseconds since the epoch.
+	WrittenMs int64
+
+	// A description of the failure.
+	Message string
+}
+
+// The state of the read-after-write canary, as returned by /server/canary.
+type CanaryStatus struct {
+	// True if the canary is enabled.
+	Enabled bool
+
+	// The number of sampled spans waiting to be checked.
+	Pending int
+
+	// The number of sampled spans which were read back correctly, could
+	// not be found, and were read back with different data.
+	Verified   uint64
+	NotFound   uint64
+	Mismatches uint64
+
+	// The number of sampled spans which were deleted before they could be
+	// checked, for example by the reaper.
+	Removed uint64
+
+	// The number of spans which were not sampled because the queue of
+	// pending spans was full.
+	Dropped uint64
+
+	// The most recent failures, newest first.
+	Failures []CanaryFailure
+}
+
+// The process which holds a shard directory lock, as recorded in the lock's
+// metadata file.
+type LockHolder struct {
+	Pid int
+
+	Hostname string
+
+	// The time (in UTC milliseconds since the epoch) when the process
+	// started.
+	StartMs int64
+}
+
+// A shard directory lock held by the server, as returned by /server/locks.
+type ShardLock struct {
+	// The shard directory.
+	Path string
+
+	// This server.
+	Holder LockHolder
+
+	// The time (in UTC milliseconds since the epoch) when the lock was
+	// acquired.
+	AcquiredMs int64
+
+	// If the lock was broken because its previous holder was no longer
+	// running, the previous holder.
+	StolenFrom *LockHolder `json:",omitempty"`
+}
+
+// A request to change the tags of a trace, sent to /span/{id}/tags.  The
+// tags in Remove are removed after the tags in Add are added.
+type TagTraceReq struct {
+	Add []string `json:",omitempty"`
+
+	Remove []string `json:",omitempty"`
+
+	// If true, the trace root doesn't have to exist yet.  Otherwise, tagging
+	// a span which can't be found, or which isn't a root, is an error.
+	Speculative bool `json:",omitempty"`
+}
+
+// The tags of a trace, returned by /span/{id}/tags.
+type TraceTags struct {
+	// The root of the trace.
+	RootId SpanId
+
+	// The tags, sorted.
+	Tags []string
+}
+
+// The traces which carry a tag, returned by /tags/{tag}.
+type TaggedTraces struct {
+	Tag string
+
+	// The ids of the trace roots, sorted.
+	RootIds []SpanId
+
+	// If more traces carry the tag, the id to pass as the after parameter
+	// of the next request.
+	Next SpanId `json:",omitempty"`
+}
+
+// A named query kept by the server, sent to and returned by /searches.
+type SavedSearch struct {
+	// The name of the search.  It can't be empty, or contain /, ?, or #.
+	Name string
+
+	Description string `json:",omitempty"`
+
+	// Who saved the search.  If the request which saved it had an auth
+	// token, the server replaces this with a fingerprint of the token.
+	Owner string `json:",omitempty"`
+
+	// The query.  The value of a BEGIN_TIME or END_TIME predicate can be a
+	// template parameter, written ${name}, which is replaced by the value
+	// of the parameter when the search runs.
+	Query Query
+
+	// The default value of each template parameter.  Each parameter which
+	// the query uses must have a default, and each default must be used.
+	Params map[string]string `json:",omitempty"`
+
+	// When the search was saved, in UTC milliseconds since the epoch.  Set
+	// by the server.
+	SavedMs int64
+}
+
+// The prefix of the /searches/{name}/run request parameters which set the
+// template parameters of a saved search.  For example, param.start=now-2h
+// sets the start parameter.
+const SAVED_SEARCH_PARAM_PREFIX = "param."
@@ -0,0 +1,228 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// Package schema generates JSON schemas for Go types, by reflection.
+//
+// The schemas describe the JSON which encoding/json produces for a type, and
+// use the subset of JSON Schema which OpenAPI 3.0 understands.  Structs get a
+// named definition, which other schemas refer to with $ref, so that
+// recursive types work.  Other types are described inline.
+//
+// encoding/json follows the struct tags of a type, but types which implement
+// json.Marshaler can produce anything at all.  We assume that non-struct
+// marshalers produce strings, like span IDs do, and that struct marshalers
+// produce the fields of the struct.  Types which do something else need an
+// override; see Generator#Override.
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A JSON schema.
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+}
+
+var marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+var rawMessageType = reflect.TypeOf(json.RawMessage{})
+
+// Generates schemas, and keeps track of the definitions they refer to.
+type Generator struct {
+	// The prefix of $ref values.  The definition name is appended to it.
+	refPrefix string
+
+	// Maps definition names to definitions.
+	defs map[string]*Schema
+
+	// Maps struct types to their definition names.
+	names map[reflect.Type]string
+
+	// Schemas to use for particular types, instead of generating them.
+	overrides map[reflect.Type]*Schema
+}
+
+// Create a new generator.  refPrefix is the prefix of $ref values, for
+// example "#/components/schemas/" for OpenAPI.
+func NewGenerator(refPrefix string) *Generator {
+	return &Generator{
+		refPrefix: refPrefix,
+		defs:      make(map[string]*Schema),
+		names:     make(map[reflect.Type]string),
+		overrides: make(map[reflect.Type]*Schema),
+	}
+}
+
+// Use the given schema for a type, rather than generating one.  This must be
+// called before the type is first used.
+func (gen *Generator) Override(ty reflect.Type, schema *Schema) {
+	gen.overrides[ty] = schema
+}
+
+// Get the definitions which the schemas generated so far refer to.
+func (gen *Generator) Definitions() map[string]*Schema {
+	return gen.defs
+}
+
+// Get the schema for the JSON encoding of a value.  A nil value has an empty
+// schema, which matches anything.
+func (gen *Generator) ValueOf(val interface{}) *Schema {
+	if val == nil {
+		return &Schema{}
+	}
+	return gen.Of(reflect.TypeOf(val))
+}
+
+// Get the schema for the JSON encoding of a type.
+func (gen *Generator) Of(ty reflect.Type) *Schema {
+	if schema := gen.overrides[ty]; schema != nil {
+		return schema
+	}
+	if ty.Kind() == reflect.Ptr {
+		return gen.Of(ty.Elem())
+	}
+	if ty == rawMessageType {
+		return &Schema{}
+	}
+	if ty.Kind() != reflect.Struct && ty.Implements(marshalerType) {
+		return &Schema{Type: "string"}
+	}
+	switch ty.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8,
+		reflect.Uint16, reflect.Uint32:
+		return &Schema{Type: "integer", Format: "int32"}
+	case reflect.Int, reflect.Int64, reflect.Uint, reflect.Uint64,
+		reflect.Uintptr:
+		return &Schema{Type: "integer", Format: "int64"}
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if ty.Elem().Kind() == reflect.Uint8 {
+			// encoding/json encodes byte slices as base64 strings.
+			return &Schema{Type: "string", Format: "byte"}
+		}
+		return &Schema{Type: "array", Items: gen.Of(ty.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: gen.Of(ty.Elem())}
+	case reflect.Struct:
+		return &Schema{Ref: gen.refPrefix + gen.define(ty)}
+	}
+	// Interfaces, and anything else we can't say anything about.
+	return &Schema{}
+}
+
+// Get the definition name for a struct type, generating the definition if
+// we haven't already.
+func (gen *Generator) define(ty reflect.Type) string {
+	if name, ok := gen.names[ty]; ok {
+		return name
+	}
+	name := ty.Name()
+	if name == "" {
+		name = "Anonymous"
+	}
+	// Types from different packages may have the same name.
+	base := name
+	for i := 2; gen.defs[name] != nil; i++ {
+		name = base + "_" + strconv.Itoa(i)
+	}
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+	gen.names[ty] = name
+	gen.defs[name] = schema
+	gen.addFields(schema, ty)
+	sort.Strings(schema.Required)
+	return name
+}
+
+// Add the fields of a struct to an object schema.  The fields of embedded
+// structs are promoted, unless the outer struct has a field with the same
+// name.
+func (gen *Generator) addFields(schema *Schema, ty reflect.Type) {
+	var embedded []reflect.Type
+	for i := 0; i < ty.NumField(); i++ {
+		field := ty.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		opts := strings.Split(tag, ",")
+		name := opts[0]
+		if field.Anonymous && name == "" {
+			fty := field.Type
+			if fty.Kind() == reflect.Ptr {
+				fty = fty.Elem()
+			}
+			if fty.Kind() == reflect.Struct {
+				embedded = append(embedded, fty)
+				continue
+			}
+		}
+		if field.PkgPath != "" && !field.Anonymous {
+			// Unexported fields aren't encoded.
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		if schema.Properties[name] != nil {
+			continue
+		}
+		var fschema *Schema
+		if hasOpt(opts[1:], "string") {
+			fschema = &Schema{Type: "string"}
+		} else {
+			fschema = gen.Of(field.Type)
+		}
+		schema.Properties[name] = fschema
+		if !hasOpt(opts[1:], "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	for i := range embedded {
+		gen.addFields(schema, embedded[i])
+	}
+}
+
+func hasOpt(opts []string, opt string) bool {
+	for i := range opts {
+		if opts[i] == opt {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package schema
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+type testId []byte
+
+func (id testId) MarshalJSON() ([]byte, error) {
+	return []byte(`"id"`), nil
+}
+
+type testInner struct {
+	Count int64 `json:"c"`
+	Name  string
+}
+
+type testNode struct {
+	Id       testId            `json:"i"`
+	Children []*testNode       `json:"ch,omitempty"`
+	Info     map[string]string `json:"n,omitempty"`
+	Raw      json.RawMessage   `json:"raw,omitempty"`
+	Ratio    float64           `json:"r,string"`
+	Skipped  string            `json:"-"`
+	hidden   int
+	testInner
+}
+
+func TestSchemaOfStruct(t *testing.T) {
+	gen := NewGenerator("#/defs/")
+	schema := gen.Of(reflect.TypeOf(&testNode{}))
+	if schema.Ref != "#/defs/testNode" {
+		t.Fatalf("Unexpected schema %v\n", schema)
+	}
+	defs := gen.Definitions()
+	if len(defs) != 1 {
+		t.Fatalf("Expected 1 definition, but got %d\n", len(defs))
+	}
+	buf, err := json.Marshal(defs["testNode"])
+	if err != nil {
+		t.Fatalf("Failed to marshal schema: %s\n", err.Error())
+	}
+	expected := `{"type":"object","properties":{` +
+		`"Name":{"type":"string"},` +
+		`"c":{"type":"integer","format":"int64"},` +
+		`"ch":{"type":"array","items":{"$ref":"#/defs/testNode"}},` +
+		`"i":{"type":"string"},` +
+		`"n":{"type":"object","additionalProperties":{"type":"string"}},` +
+		`"r":{"type":"string"},` +
+		`"raw":{}},` +
+		`"required":["Name","c","i","r"]}`
+	if string(buf) != expected {
+		t.Fatalf("Expected:\n%s\nGot:\n%s\n", expected, string(buf))
+	}
+}
+
+func TestSchemaOverride(t *testing.T) {
+	gen := NewGenerator("#/defs/")
+	gen.Override(reflect.TypeOf(testId{}), &Schema{Type: "string",
+		Format: "hex"})
+	schema := gen.Of(reflect.TypeOf([]testId{}))
+	if schema.Type != "array" || schema.Items.Format != "hex" {
+		t.Fatalf("Unexpected schema %v\n", schema)
+	}
+	if len(gen.Definitions()) != 0 {
+		t.Fatalf("Expected no definitions, but got %v\n", gen.Definitions())
+	}
+	if gen.ValueOf(nil).Type != "" {
+		t.Fatalf("Expected an empty schema for nil.\n")
+	}
+}
@@ -20,14 +20,30 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"sync"
+	"time"
 )
 
 // A simple lock-and-condition-variable based semaphore implementation.
+//
+// Posts may carry a label, saying what they were for.  WaitsWithTimeout
+// reports the labels of the posts it consumed.
 type Semaphore struct {
 	lock  sync.Mutex
 	cond  *sync.Cond
 	count int64
+
+	// The labels of the posts which haven't been consumed yet, oldest first.
+	// Consecutive posts with the same label are merged.  There is one entry
+	// for each unit of positive count.
+	labels []labeledPosts
+}
+
+type labeledPosts struct {
+	label string
+	count int64
 }
 
 func NewSemaphore(count int64) *Semaphore {
@@ -37,32 +53,71 @@ func NewSemaphore(count int64) *Semaphore {
 	sem.cond = &sync.Cond{
 		L: &sem.lock,
 	}
+	if count > 0 {
+		sem.labels = append(sem.labels, labeledPosts{count: count})
+	}
 	return sem
 }
 
 func (sem *Semaphore) Post() {
-	sem.lock.Lock()
-	sem.count++
-	if sem.count > 0 {
-		sem.cond.Broadcast()
-	}
-	sem.lock.Unlock()
+	sem.PostsLabeled("", 1)
 }
 
 func (sem *Semaphore) Posts(amt int64) {
+	sem.PostsLabeled("", amt)
+}
+
+// Post amt times, with a label.
+func (sem *Semaphore) PostsLabeled(label string, amt int64) {
 	sem.lock.Lock()
+	// Posts which only bring a negative count up towards zero can't be
+	// consumed, so they don't get labels.
+	prev := sem.count
+	if prev < 0 {
+		prev = 0
+	}
 	sem.count += amt
+	if sem.count > prev {
+		num := sem.count - prev
+		last := len(sem.labels) - 1
+		if last >= 0 && sem.labels[last].label == label {
+			sem.labels[last].count += num
+		} else {
+			sem.labels = append(sem.labels, labeledPosts{label, num})
+		}
+	}
 	if sem.count > 0 {
 		sem.cond.Broadcast()
 	}
 	sem.lock.Unlock()
 }
 
+// Consume amt posts, and add their labels to counts.  The lock must be held,
+// and the count must be at least amt.
+func (sem *Semaphore) consume(amt int64, counts map[string]int64) {
+	sem.count -= amt
+	for amt > 0 {
+		head := &sem.labels[0]
+		num := head.count
+		if num > amt {
+			num = amt
+		}
+		if counts != nil {
+			counts[head.label] += num
+		}
+		head.count -= num
+		if head.count == 0 {
+			sem.labels = sem.labels[1:]
+		}
+		amt -= num
+	}
+}
+
 func (sem *Semaphore) Wait() {
 	sem.lock.Lock()
 	for {
 		if sem.count > 0 {
-			sem.count--
+			sem.consume(1, nil)
 			sem.lock.Unlock()
 			return
 		}
@@ -76,3 +131,36 @@ func (sem *Semaphore) Waits(amt int64) {
 		sem.Wait()
 	}
 }
+
+// Wait for amt posts, and return the number of them with each label.  If
+// there aren't amt posts within the timeout, nothing is consumed, and the
+// counts of the posts which are available are returned with an error.
+func (sem *Semaphore) WaitsWithTimeout(amt int64,
+	timeout time.Duration) (map[string]int64, error) {
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		sem.lock.Lock()
+		timedOut = true
+		sem.cond.Broadcast()
+		sem.lock.Unlock()
+	})
+	defer timer.Stop()
+	counts := make(map[string]int64)
+	sem.lock.Lock()
+	defer sem.lock.Unlock()
+	for sem.count < amt {
+		if timedOut {
+			var avail int64
+			for i := range sem.labels {
+				counts[sem.labels[i].label] += sem.labels[i].count
+				avail += sem.labels[i].count
+			}
+			return counts, errors.New(fmt.Sprintf("Timed out after %s "+
+				"waiting for %d post(s).  Only %d arrived: %v", timeout,
+				amt, avail, counts))
+		}
+		sem.cond.Wait()
+	}
+	sem.consume(amt, counts)
+	return counts, nil
+}
@@ -84,3 +84,33 @@ func TestSemaphoreMultipleGoroutines(t *testing.T) {
 		t.Fatalf("sem.Wait did not wait for sem.Posts")
 	}
 }
+
+func TestSemaphoreWaitsWithTimeout(t *testing.T) {
+	sem := NewSemaphore(-1)
+	sem.PostsLabeled("a", 3)
+	sem.PostsLabeled("b", 1)
+	sem.PostsLabeled("a", 1)
+	counts, err := sem.WaitsWithTimeout(5, 10*time.Millisecond)
+	if err == nil {
+		t.Fatalf("Expected WaitsWithTimeout to time out.\n")
+	}
+	if counts["a"] != 3 || counts["b"] != 1 {
+		t.Fatalf("Unexpected counts after a timeout: %v\n", counts)
+	}
+	counts, err = sem.WaitsWithTimeout(3, time.Minute)
+	if err != nil {
+		t.Fatalf("WaitsWithTimeout failed: %s\n", err.Error())
+	}
+	if counts["a"] != 2 || counts["b"] != 1 {
+		t.Fatalf("Unexpected counts: %v\n", counts)
+	}
+	sem.Wait()
+	go sem.Posts(2)
+	counts, err = sem.WaitsWithTimeout(2, time.Minute)
+	if err != nil {
+		t.Fatalf("WaitsWithTimeout failed: %s\n", err.Error())
+	}
+	if counts[""] != 2 {
+		t.Fatalf("Unexpected counts: %v\n", counts)
+	}
+}
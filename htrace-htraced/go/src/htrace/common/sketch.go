@@ -0,0 +1,163 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"math"
+	"sort"
+)
+
+//
+// A QuantileSketch estimates the quantiles of a stream of values, such as
+// span durations, in a small amount of space.  It is a histogram with
+// logarithmic bins, in the style of DDSketch.  A positive value v is counted
+// in bin ceil(log_gamma(v)), where
+//
+//   gamma = (1 + SKETCH_RELATIVE_ACCURACY) / (1 - SKETCH_RELATIVE_ACCURACY)
+//
+// Every value in bin i lies in (gamma^(i-1), gamma^i], so estimating it as
+// 2 * gamma^i / (gamma + 1) is off by at most SKETCH_RELATIVE_ACCURACY of the
+// value.  Quantile(q) estimates the value of rank floor(q * (Count - 1)) in
+// sorted order this way, and rounds it to a whole number.  So the estimate is
+// within SKETCH_RELATIVE_ACCURACY of the true quantile, give or take the
+// rounding.  Values of 0 or less are counted as 0, exactly.
+//
+// Two sketches are merged by adding up their bins, which gives the same
+// sketch as adding all the values to one.  That is what lets the server keep
+// a sketch per hour, and answer for any range of hours.
+//
+// Values from 1 to a few days' worth of nanoseconds fit in fewer than
+// SKETCH_MAX_BINS bins.  If a sketch ever has more bins than that, its lowest
+// bins are merged, which makes only the lowest quantiles less accurate.
+//
+
+// The maximum relative error of the quantiles a QuantileSketch estimates.
+const SKETCH_RELATIVE_ACCURACY = 0.01
+
+// The maximum number of bins in a QuantileSketch.
+const SKETCH_MAX_BINS = 2048
+
+var sketchGamma = (1 + SKETCH_RELATIVE_ACCURACY) / (1 - SKETCH_RELATIVE_ACCURACY)
+
+var sketchLnGamma = math.Log(sketchGamma)
+
+type QuantileSketch struct {
+	// The number of values in the sketch.
+	Count uint64 `json:"c"`
+
+	// The number of values which were 0 or less.
+	Zeros uint64 `json:"z,omitempty"`
+
+	// The number of positive values in each bin, by bin index.
+	Bins map[int32]uint64 `json:"b,omitempty"`
+}
+
+func sketchBin(val int64) int32 {
+	return int32(math.Ceil(math.Log(float64(val)) / sketchLnGamma))
+}
+
+func sketchBinValue(bin int32) float64 {
+	return 2 * math.Pow(sketchGamma, float64(bin)) / (sketchGamma + 1)
+}
+
+// Add a value to the sketch.
+func (sk *QuantileSketch) Add(val int64) {
+	sk.Count++
+	if val <= 0 {
+		sk.Zeros++
+		return
+	}
+	if sk.Bins == nil {
+		sk.Bins = make(map[int32]uint64)
+	}
+	sk.Bins[sketchBin(val)]++
+	if len(sk.Bins) > SKETCH_MAX_BINS {
+		sk.collapse()
+	}
+}
+
+// Add the values of another sketch to this one.
+func (sk *QuantileSketch) Merge(other *QuantileSketch) {
+	sk.Count += other.Count
+	sk.Zeros += other.Zeros
+	if len(other.Bins) == 0 {
+		return
+	}
+	if sk.Bins == nil {
+		sk.Bins = make(map[int32]uint64, len(other.Bins))
+	}
+	for bin, count := range other.Bins {
+		sk.Bins[bin] += count
+	}
+	if len(sk.Bins) > SKETCH_MAX_BINS {
+		sk.collapse()
+	}
+}
+
+// Get the bin indices, in ascending order.
+func (sk *QuantileSketch) sortedBins() []int32 {
+	bins := make([]int32, 0, len(sk.Bins))
+	for bin := range sk.Bins {
+		bins = append(bins, bin)
+	}
+	sort.Slice(bins, func(i, j int) bool { return bins[i] < bins[j] })
+	return bins
+}
+
+// Merge the lowest bins until there are at most SKETCH_MAX_BINS.
+func (sk *QuantileSketch) collapse() {
+	bins := sk.sortedBins()
+	excess := len(bins) - SKETCH_MAX_BINS
+	into := bins[excess]
+	for _, bin := range bins[:excess] {
+		sk.Bins[into] += sk.Bins[bin]
+		delete(sk.Bins, bin)
+	}
+}
+
+// Estimate the value below which a fraction q of the values lie.  q is
+// clamped to [0, 1].  An empty sketch returns 0.
+func (sk *QuantileSketch) Quantile(q float64) int64 {
+	if sk.Count == 0 {
+		return 0
+	}
+	if q < 0 {
+		q = 0
+	} else if q > 1 {
+		q = 1
+	}
+	rank := uint64(q * float64(sk.Count-1))
+	if rank < sk.Zeros {
+		return 0
+	}
+	seen := sk.Zeros
+	bins := sk.sortedBins()
+	for _, bin := range bins {
+		seen += sk.Bins[bin]
+		if rank < seen {
+			return int64(math.Floor(sketchBinValue(bin) + 0.5))
+		}
+	}
+	// Only reachable if Count doesn't match the bins.
+	if len(bins) == 0 {
+		return 0
+	}
+	return int64(math.Floor(sketchBinValue(bins[len(bins)-1]) + 0.5))
+}
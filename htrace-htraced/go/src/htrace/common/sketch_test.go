@@ -0,0 +1,162 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package common
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Check that a quantile estimate is within the documented error of the true
+// value.  The estimate is rounded to a whole number, so it may be off by
+// another half.  Values right on the edge of a bin can be off by a little more
+// because of floating point error.
+func expectQuantileWithin(t *testing.T, q float64, expected int64,
+	actual int64) {
+	maxErr := SKETCH_RELATIVE_ACCURACY*float64(expected)*(1+1e-9) + 0.5
+	if math.Abs(float64(actual-expected)) > maxErr {
+		t.Fatalf("Quantile(%g): expected %d, within %g, but got %d\n",
+			q, expected, maxErr, actual)
+	}
+}
+
+func checkSketchQuantiles(t *testing.T, sk *QuantileSketch, vals []int64) {
+	sorted := make([]int64, len(vals))
+	copy(sorted, vals)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if sk.Count != uint64(len(vals)) {
+		t.Fatalf("Expected a count of %d, but got %d\n", len(vals), sk.Count)
+	}
+	for _, q := range []float64{0, 0.01, 0.25, 0.5, 0.9, 0.99, 0.999, 1} {
+		expected := sorted[int(q*float64(len(sorted)-1))]
+		if expected < 0 {
+			expected = 0
+		}
+		expectQuantileWithin(t, q, expected, sk.Quantile(q))
+	}
+}
+
+func TestQuantileSketchEmpty(t *testing.T) {
+	var sk QuantileSketch
+	if sk.Quantile(0.5) != 0 {
+		t.Fatalf("Expected an empty sketch to return 0.\n")
+	}
+	sk.Merge(&QuantileSketch{})
+	if sk.Count != 0 || sk.Quantile(0.99) != 0 {
+		t.Fatalf("Expected merging empty sketches to give an empty sketch.\n")
+	}
+}
+
+func TestQuantileSketchSmallValues(t *testing.T) {
+	// Small whole numbers are estimated exactly.
+	var sk QuantileSketch
+	vals := make([]int64, 0, 50)
+	for i := int64(-2); i < 48; i++ {
+		vals = append(vals, i)
+		sk.Add(i)
+	}
+	if sk.Zeros != 3 {
+		t.Fatalf("Expected 3 zeros, but got %d\n", sk.Zeros)
+	}
+	for i := range vals {
+		// Ask for the middle of each rank, so that rounding can't move us to
+		// the one before.
+		q := (float64(i) + 0.5) / float64(len(vals)-1)
+		expected := vals[i]
+		if expected < 0 {
+			expected = 0
+		}
+		if actual := sk.Quantile(q); actual != expected {
+			t.Fatalf("Quantile(%g): expected %d, but got %d\n", q, expected,
+				actual)
+		}
+	}
+}
+
+func TestQuantileSketchAccuracy(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1936))
+	// Durations with a long tail, from about a microsecond to a minute.
+	var sk QuantileSketch
+	vals := make([]int64, 100000)
+	for i := range vals {
+		vals[i] = int64(math.Exp(rnd.NormFloat64()*2.5 + 14))
+		sk.Add(vals[i])
+	}
+	checkSketchQuantiles(t, &sk, vals)
+
+	// Uniformly distributed durations.
+	sk = QuantileSketch{}
+	for i := range vals {
+		vals[i] = rnd.Int63n(1000000000)
+		sk.Add(vals[i])
+	}
+	checkSketchQuantiles(t, &sk, vals)
+}
+
+func TestQuantileSketchMerge(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	var all QuantileSketch
+	parts := make([]QuantileSketch, 5)
+	vals := make([]int64, 20000)
+	for i := range vals {
+		vals[i] = rnd.Int63n(10000000)
+		all.Add(vals[i])
+		parts[i%len(parts)].Add(vals[i])
+	}
+	var merged QuantileSketch
+	for i := range parts {
+		merged.Merge(&parts[i])
+	}
+	if !reflect.DeepEqual(all, merged) {
+		t.Fatalf("Expected the merged sketch to be the same as a sketch " +
+			"of all the values.\n")
+	}
+	checkSketchQuantiles(t, &merged, vals)
+}
+
+func TestQuantileSketchCollapse(t *testing.T) {
+	// Values spread over the whole int64 range need more than
+	// SKETCH_MAX_BINS bins.  There is one value in the middle of each bin.
+	var sk QuantileSketch
+	vals := make([]int64, 0, 2500)
+	for v := math.Sqrt(sketchGamma); v < math.MaxInt64/2; v *= sketchGamma {
+		vals = append(vals, int64(v))
+		sk.Add(int64(v))
+	}
+	if len(vals) <= SKETCH_MAX_BINS {
+		t.Fatalf("Expected more than %d values, but got %d\n",
+			SKETCH_MAX_BINS, len(vals))
+	}
+	if len(sk.Bins) > SKETCH_MAX_BINS {
+		t.Fatalf("Expected at most %d bins, but got %d\n", SKETCH_MAX_BINS,
+			len(sk.Bins))
+	}
+	if sk.Count != uint64(len(vals)) {
+		t.Fatalf("Expected a count of %d, but got %d\n", len(vals), sk.Count)
+	}
+	// Only the lowest quantiles lose accuracy.
+	for _, q := range []float64{0.5, 0.9, 0.99, 1} {
+		expected := vals[int(q*float64(len(vals)-1))]
+		expectQuantileWithin(t, q, expected, sk.Quantile(q))
+	}
+}
@@ -25,6 +25,10 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
 )
 
 //
@@ -39,6 +43,35 @@ import (
 
 type TraceInfoMap map[string]string
 
+// Info keys starting with this prefix are reserved for the server.  Clients
+// can't set them; see ingest.info.policy.
+const RESERVED_INFO_KEY_PREFIX = "_"
+
+// The info key under which the server records the address of the client which
+// sent a span, if span.source.addr is enabled.
+const SOURCE_ADDR_INFO_KEY = "_src_addr"
+
+// The info key under which the server records the principal whose token was
+// used to write a span.  It is only set when the server's Authenticator knows
+// the principal, so it is absent when auth.mode is allow-all.
+const PRINCIPAL_INFO_KEY = "_principal"
+
+// The info key under which the server records how many of a span's parents
+// are in the parent index, if that is fewer than all of them.  See
+// index.max.parents.  The server sets or removes it each time the span is
+// written, so clients can't set it.
+const PARENTS_INDEXED_INFO_KEY = "_parents_indexed"
+
+// The info key under which the server records the sampling weight of a span
+// which was kept when old spans were downsampled.  A span with weight 10
+// stands for 10 spans like it.  See span.downsample.age.ms.
+const DOWNSAMPLE_WEIGHT_INFO_KEY = "_downsample_weight"
+
+// The info key under which the server records the duration, in nanoseconds,
+// of a span which ended before it began, when the span's end time was moved
+// to its begin time.  See ingest.negative.duration.policy.
+const NEGATIVE_DURATION_INFO_KEY = "_negative_duration_ns"
+
 type TimelineAnnotation struct {
 	Time int64  `json:"t"`
 	Msg  string `json:"m"`
@@ -48,11 +81,45 @@ type SpanId []byte
 
 var INVALID_SPAN_ID SpanId = make([]byte, 16) // all zeroes
 
+// The length of a span ID in bytes.
+const SPAN_ID_LEN = 16
+
+// The length of a span ID in hex digits.
+const SPAN_ID_HEX_LEN = 2 * SPAN_ID_LEN
+
+const hexDigits = "0123456789abcdef"
+
+// Maps each character to the value of the lowercase hex digit it represents,
+// or to 0xff if it isn't one.
+var hexValues = func() [256]byte {
+	var vals [256]byte
+	for i := range vals {
+		vals[i] = 0xff
+	}
+	for i := 0; i < len(hexDigits); i++ {
+		vals[hexDigits[i]] = byte(i)
+	}
+	return vals
+}()
+
+// Append the 32 hex digits of the span ID to a buffer.
+func (id SpanId) AppendHex(buf []byte) []byte {
+	for i := 0; i < SPAN_ID_LEN; i++ {
+		buf = append(buf, hexDigits[id[i]>>4], hexDigits[id[i]&0xf])
+	}
+	return buf
+}
+
+// Append the span ID to a buffer as a quoted JSON string.
+func (id SpanId) AppendJSON(buf []byte) []byte {
+	buf = append(buf, DOUBLE_QUOTE)
+	buf = id.AppendHex(buf)
+	return append(buf, DOUBLE_QUOTE)
+}
+
 func (id SpanId) String() string {
-	return fmt.Sprintf("%02x%02x%02x%02x"+
-		"%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x",
-		id[0], id[1], id[2], id[3], id[4], id[5], id[6], id[7], id[8],
-		id[9], id[10], id[11], id[12], id[13], id[14], id[15])
+	var buf [SPAN_ID_HEX_LEN]byte
+	return string(id.AppendHex(buf[:0]))
 }
 
 func (id SpanId) Val() []byte {
@@ -111,7 +178,31 @@ func (id SpanId) Prev() SpanId {
 }
 
 func (id SpanId) MarshalJSON() ([]byte, error) {
-	return []byte(`"` + id.String() + `"`), nil
+	return id.AppendJSON(make([]byte, 0, SPAN_ID_HEX_LEN+2)), nil
+}
+
+// Write the 16 bytes of the span ID.  This is a fixed-size binary encoding
+// for pipelines which don't need JSON.  Note that msgpack already encodes span
+// IDs as raw bytes, since SpanId is a byte slice.
+func (id SpanId) WriteBinary(w io.Writer) error {
+	if len(id) != SPAN_ID_LEN {
+		return errors.New(fmt.Sprintf("Can't write a span ID of length %d.  "+
+			"Span IDs must be %d bytes long.", len(id), SPAN_ID_LEN))
+	}
+	_, err := w.Write(id)
+	return err
+}
+
+// Read a span ID written by WriteBinary.
+func (id *SpanId) ReadBinary(r io.Reader) error {
+	i := SpanId(make([]byte, SPAN_ID_LEN))
+	_, err := io.ReadFull(r, i)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to read a %d-byte span ID: %s",
+			SPAN_ID_LEN, err.Error()))
+	}
+	*id = i
+	return nil
 }
 
 func (id SpanId) Compare(other SpanId) int {
@@ -159,31 +250,52 @@ func (s SpanIdSlice) Swap(i, j int) {
 const DOUBLE_QUOTE = 0x22
 
 func (id *SpanId) UnmarshalJSON(b []byte) error {
-	if b[0] != DOUBLE_QUOTE {
+	if len(b) == 0 || b[0] != DOUBLE_QUOTE {
 		return errors.New("Expected spanID to start with a string quote.")
 	}
-	if b[len(b)-1] != DOUBLE_QUOTE {
+	if len(b) < 2 || b[len(b)-1] != DOUBLE_QUOTE {
 		return errors.New("Expected spanID to end with a string quote.")
 	}
-	return id.FromString(string(b[1 : len(b)-1]))
+	return id.fromHex(b[1 : len(b)-1])
 }
 
+// Parse a span ID from exactly 32 lowercase hex digits.
 func (id *SpanId) FromString(str string) error {
-	i := SpanId(make([]byte, 16))
-	n, err := fmt.Sscanf(str, "%02x%02x%02x%02x"+
-		"%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x",
-		&i[0], &i[1], &i[2], &i[3], &i[4], &i[5], &i[6], &i[7], &i[8],
-		&i[9], &i[10], &i[11], &i[12], &i[13], &i[14], &i[15])
-	if err != nil {
-		return err
+	return id.fromHex([]byte(str))
+}
+
+func (id *SpanId) fromHex(hex []byte) error {
+	if len(hex) != SPAN_ID_HEX_LEN {
+		return errors.New(fmt.Sprintf("Invalid span ID '%s': expected %d "+
+			"hex digits, but got %d characters.", string(hex),
+			SPAN_ID_HEX_LEN, len(hex)))
 	}
-	if n != 16 {
-		return errors.New("Failed to find 16 hex digits in the SpanId")
+	i := SpanId(make([]byte, SPAN_ID_LEN))
+	for j := range hex {
+		val := hexValues[hex[j]]
+		if val == 0xff {
+			return errors.New(fmt.Sprintf("Invalid span ID '%s': the "+
+				"character at position %d is not a lowercase hex digit.",
+				string(hex), j))
+		}
+		i[j/2] = (i[j/2] << 4) | val
 	}
 	*id = i
 	return nil
 }
 
+// The link type for a span which was caused by another span, but does not
+// depend on its result, such as a message consumer and the producer which
+// enqueued the message.
+const LINK_TYPE_FOLLOWS_FROM = "follows_from"
+
+// A reference from one span to another which is not a parent-child
+// relationship.  The linked span may be part of a different trace.
+type SpanLink struct {
+	Id   SpanId `json:"i"`
+	Type string `json:"t,omitempty"`
+}
+
 type SpanData struct {
 	Begin               int64                `json:"b"`
 	End                 int64                `json:"e"`
@@ -192,11 +304,306 @@ type SpanData struct {
 	Info                TraceInfoMap         `json:"n,omitempty"`
 	TracerId            string               `json:"r"`
 	TimelineAnnotations []TimelineAnnotation `json:"t,omitempty"`
+	Links               []SpanLink           `json:"l,omitempty"`
+
+	// Optional begin and end times in nanoseconds since the epoch.  Begin
+	// and End are always in milliseconds.  Clients which have nanosecond
+	// timestamps may set these as well, and the server then derives Begin
+	// and End from them when the span is ingested.  Spans without them have
+	// millisecond precision.
+	BeginNs int64 `json:"bn,omitempty"`
+	EndNs   int64 `json:"en,omitempty"`
+
+	// The number of parents.  The server fills this in when the span is
+	// ingested, so that it can filter on it without decoding the parents.
+	NumParents int `json:"np,omitempty"`
+
+	// True if the server left the span out of the duration index, because it
+	// was shorter than index.min.duration.ms, or ended before it began.  The
+	// server fills this in when the span is ingested.  Such spans never match
+	// duration predicates.  This is only kept in the stored span, and is never
+	// sent to clients.
+	IndexSkipped bool `codec:"xs,omitempty" json:"-"`
+
+	// True if the server indexed the span by its normalized description,
+	// because its tracer had used more than
+	// metrics.description.cardinality.limit distinct descriptions.  The
+	// server fills this in when the span is ingested.  The span still keeps
+	// its original description.  Like IndexSkipped, this is only kept in the
+	// stored span.
+	DescriptionNormalized bool `codec:"dn,omitempty" json:"-"`
+
+	// The version of the span schema the span was stored with.  The server
+	// sets this to SPAN_SCHEMA_VERSION when the span is ingested.  Spans
+	// stored before the field existed have version 0.
+	SchemaVersion int `json:"sv,omitempty"`
+
+	// Flags which mark the span for special treatment.  See SpanFlags.
+	// Spans stored before the field existed have no flags set.
+	Flags SpanFlags `json:"fl,omitempty"`
+
+	// Whether the span failed.  Clients may leave this out, in which case
+	// the server decides when the span is ingested, going by the info keys
+	// in span.error.info.keys and the timeline annotations which start with
+	// span.error.timeline.prefixes.  The server only stores it when it is
+	// true.
+	Error *bool `json:"er,omitempty"`
+
+	// Fields which this version of HTrace doesn't know about, keyed by their
+	// JSON name.  In JSON, they appear alongside the other fields, so that a
+	// span can pass through this code without losing fields added by newer
+	// clients.  In the packed (msgpack) encoding, they are kept in a map
+	// under "x", which is how HRPC clients send them as well.
+	Extras SpanExtras `codec:"x,omitempty" json:"-"`
+}
+
+// A set of span flags.
+type SpanFlags uint32
+
+const (
+	// The span was traced regardless of the sampling rate, so that a request
+	// can be debugged.  Server-side sampling never drops debug spans.
+	SPAN_FLAG_DEBUG SpanFlags = 1 << iota
+
+	// The span was generated by a load test or a probe, rather than by real
+	// traffic.  Latency SLOs don't count synthetic spans.
+	SPAN_FLAG_SYNTHETIC
+
+	// Sensitive information was scrubbed from the span before it was sent.
+	SPAN_FLAG_SCRUBBED
+)
+
+// The number of span flags which this version of HTrace knows about.  Other
+// bits are kept, but have no names.
+const NUM_SPAN_FLAGS = 3
+
+// The names of the span flags, indexed by bit.
+var spanFlagNames = [NUM_SPAN_FLAGS]string{"debug", "synthetic", "scrubbed"}
+
+// Get the names of the span flags, in bit order.
+func SpanFlagNames() []string {
+	return spanFlagNames[:]
+}
+
+// Returns true if all of the given flags are set.
+func (flags SpanFlags) Has(other SpanFlags) bool {
+	return flags&other == other
+}
+
+// Get the flags as a comma-separated list of names.  Bits without names are
+// listed in hex.
+func (flags SpanFlags) String() string {
+	names := make([]string, 0, NUM_SPAN_FLAGS)
+	for i := range spanFlagNames {
+		if flags.Has(1 << uint(i)) {
+			names = append(names, spanFlagNames[i])
+		}
+	}
+	unknown := flags &^ (1<<NUM_SPAN_FLAGS - 1)
+	if unknown != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(unknown)))
+	}
+	return strings.Join(names, ",")
+}
+
+// Parse a comma-separated list of span flag names.
+func ParseSpanFlags(str string) (SpanFlags, error) {
+	var flags SpanFlags
+	for _, name := range strings.Split(str, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for i := range spanFlagNames {
+			if name == spanFlagNames[i] {
+				flags |= 1 << uint(i)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, errors.New(fmt.Sprintf("Unknown span flag '%s'.  "+
+				"Valid flags are %s.", name,
+				strings.Join(SpanFlagNames(), ", ")))
+		}
+	}
+	return flags, nil
+}
+
+// The current version of the span schema.  See SpanData#SchemaVersion.
+const SPAN_SCHEMA_VERSION = 1
+
+// The maximum total size of the unknown fields of a span, counting both
+// their names and their JSON values.  The server drops spans with bigger
+// extras.
+const MAX_SPAN_EXTRAS_BYTES = 16 * 1024
+
+// Unknown span fields, mapping the field name to its raw JSON value.
+type SpanExtras map[string]json.RawMessage
+
+// Get the total size of the names and values of the extras.
+func (extras SpanExtras) Bytes() int {
+	total := 0
+	for k, v := range extras {
+		total += len(k) + len(v)
+	}
+	return total
 }
 
 type Span struct {
 	Id SpanId `json:"a"`
 	SpanData
+
+	// The sequence number which the server assigned to this span, or 0.  This
+	// is only filled in by the requests which return sequence numbers.
+	Seq uint64 `json:"q,omitempty"`
+}
+
+// SpanData and Span without their JSON methods, so that we can use the
+// default encoding for the known fields.
+type spanDataFields SpanData
+
+type spanFields struct {
+	Id SpanId `json:"a"`
+	spanDataFields
+	Seq uint64 `json:"q,omitempty"`
+}
+
+// The JSON names of the known fields.  Any other field is an extra.
+var spanDataKeys = jsonFieldNames(reflect.TypeOf(spanDataFields{}))
+var spanKeys = jsonFieldNames(reflect.TypeOf(spanFields{}))
+
+// Get the JSON names of the fields of a struct, including the fields of
+// embedded structs.
+func jsonFieldNames(ty reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < ty.NumField(); i++ {
+		field := ty.Field(i)
+		if field.Anonymous {
+			for name := range jsonFieldNames(field.Type) {
+				names[name] = true
+			}
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+func (data SpanData) MarshalJSON() ([]byte, error) {
+	extras := data.Extras
+	buf, err := json.Marshal(spanDataFields(data))
+	if err != nil {
+		return nil, err
+	}
+	return appendExtras(buf, extras, spanDataKeys)
+}
+
+func (data *SpanData) UnmarshalJSON(b []byte) error {
+	var fields spanDataFields
+	extras, err := unmarshalWithExtras(b, &fields, spanDataKeys)
+	if err != nil {
+		return err
+	}
+	*data = SpanData(fields)
+	data.Extras = extras
+	return nil
+}
+
+func (span Span) MarshalJSON() ([]byte, error) {
+	buf, err := json.Marshal(&spanFields{
+		Id:             span.Id,
+		spanDataFields: spanDataFields(span.SpanData),
+		Seq:            span.Seq,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return appendExtras(buf, span.Extras, spanKeys)
+}
+
+func (span *Span) UnmarshalJSON(b []byte) error {
+	var fields spanFields
+	extras, err := unmarshalWithExtras(b, &fields, spanKeys)
+	if err != nil {
+		return err
+	}
+	*span = Span{
+		Id:       fields.Id,
+		SpanData: SpanData(fields.spanDataFields),
+		Seq:      fields.Seq,
+	}
+	span.Extras = extras
+	return nil
+}
+
+// Append the extras to a JSON object.  Extras which have the same name as a
+// known field are left out.
+func appendExtras(buf []byte, extras SpanExtras, known map[string]bool) ([]byte,
+	error) {
+	if len(extras) == 0 {
+		return buf, nil
+	}
+	names := make([]string, 0, len(extras))
+	for name := range extras {
+		if !known[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	// Drop the closing brace.
+	buf = buf[:len(buf)-1]
+	for _, name := range names {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		nameBytes, err := json.Marshal(name)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, nameBytes...)
+		buf = append(buf, ':')
+		buf = append(buf, extras[name]...)
+	}
+	return append(buf, '}'), nil
+}
+
+// Decode a JSON object, and return the fields which were not known.
+func unmarshalWithExtras(b []byte, out interface{},
+	known map[string]bool) (SpanExtras, error) {
+	// Usually there are no unknown fields, and one pass is enough.
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(out)
+	if err == nil {
+		return nil, nil
+	}
+	err = json.Unmarshal(b, out)
+	if err != nil {
+		return nil, err
+	}
+	var all map[string]json.RawMessage
+	err = json.Unmarshal(b, &all)
+	if err != nil {
+		return nil, err
+	}
+	var extras SpanExtras
+	for name, val := range all {
+		if known[name] {
+			continue
+		}
+		if extras == nil {
+			extras = make(SpanExtras)
+		}
+		var compact bytes.Buffer
+		err = json.Compact(&compact, val)
+		if err != nil {
+			return nil, err
+		}
+		extras[name] = json.RawMessage(compact.Bytes())
+	}
+	return extras, nil
 }
 
 func (span *Span) ToJson() []byte {
@@ -211,7 +618,138 @@ func (span *Span) String() string {
 	return string(span.ToJson())
 }
 
+// Returns true if the span failed.  See SpanData#Error.
+func (span *Span) IsError() bool {
+	return span.Error != nil && *span.Error
+}
+
 // Compute the span duration.  We ignore overflow since we never deal with negative times.
 func (span *Span) Duration() int64 {
 	return span.End - span.Begin
 }
+
+// Returns true if the span has a nanosecond-precision begin or end time.
+func (span *Span) HasNsTimes() bool {
+	return span.BeginNs != 0 || span.EndNs != 0
+}
+
+// Set the begin time of the span in nanoseconds, along with the millisecond
+// begin time derived from it.
+func (span *Span) SetBeginNs(ns int64) {
+	span.BeginNs = ns
+	span.Begin, _ = SplitNs(ns)
+}
+
+// Set the end time of the span in nanoseconds, along with the millisecond
+// end time derived from it.
+func (span *Span) SetEndNs(ns int64) {
+	span.EndNs = ns
+	span.End, _ = SplitNs(ns)
+}
+
+// Replace the millisecond times of the span with the ones derived from its
+// nanosecond times, where it has them.
+func (span *Span) DeriveMsTimes() {
+	if span.BeginNs != 0 {
+		span.Begin, _ = SplitNs(span.BeginNs)
+	}
+	if span.EndNs != 0 {
+		span.End, _ = SplitNs(span.EndNs)
+	}
+}
+
+// Get the begin time as whole milliseconds, plus the nanoseconds past the
+// last millisecond.  The nanoseconds are 0 unless BeginNs is set.
+func (span *Span) BeginParts() (int64, int64) {
+	if span.BeginNs != 0 {
+		return SplitNs(span.BeginNs)
+	}
+	return span.Begin, 0
+}
+
+// Get the end time as whole milliseconds, plus the nanoseconds past the last
+// millisecond.  The nanoseconds are 0 unless EndNs is set.
+func (span *Span) EndParts() (int64, int64) {
+	if span.EndNs != 0 {
+		return SplitNs(span.EndNs)
+	}
+	return span.End, 0
+}
+
+// Compute the span duration with the best precision available, as whole
+// milliseconds plus the nanoseconds left over, which are between 0 and
+// 999999.  For spans without nanosecond times, this is just Duration() and 0.
+// Unlike DurationNs, this can't overflow for spans with millisecond times.
+func (span *Span) DurationParts() (int64, int64) {
+	beginMs, beginNs := span.BeginParts()
+	endMs, endNs := span.EndParts()
+	ms := endMs - beginMs
+	ns := endNs - beginNs
+	if ns < 0 {
+		ns += NS_PER_MS
+		ms--
+	}
+	return ms, ns
+}
+
+// Compute the span duration in nanoseconds.  Like Duration, we ignore
+// overflow.
+func (span *Span) DurationNs() int64 {
+	ms, ns := span.DurationParts()
+	return ms*NS_PER_MS + ns
+}
+
+// Returns true if the span has ended, but its end time is before its begin
+// time.  This usually means that the client's clock stepped backwards while
+// the span was open.
+func (span *Span) HasNegativeDuration() bool {
+	if span.End == 0 && span.EndNs == 0 {
+		return false
+	}
+	ms, _ := span.DurationParts()
+	return ms < 0
+}
+
+// Find the problem with a span which htraced would reject it for, before
+// looking at its info map.  Returns one of the REJECT_REASON_* constants and
+// a description of the problem, or "" if there is no problem.  Spans which
+// end before they begin are only a problem if validateTimes is set, as with
+// ingest.validate.times.  The server and the client both use this, so that
+// they agree on which spans are invalid.
+func FindSpanProblem(span *Span, validateTimes bool) (string, string) {
+	// The description can't include an invalid span ID, because String()
+	// might fail.
+	if problem := span.Id.FindProblem(); problem != "" {
+		return REJECT_REASON_SPAN_ID, "Invalid span ID: " + problem
+	}
+	// Unknown fields are kept, but only up to a limit.
+	if extrasBytes := span.Extras.Bytes(); extrasBytes > MAX_SPAN_EXTRAS_BYTES {
+		return REJECT_REASON_OVERSIZED, fmt.Sprintf("The unknown fields "+
+			"take up %d bytes, but the limit is %d.", extrasBytes,
+			MAX_SPAN_EXTRAS_BYTES)
+	}
+	// Spans which haven't ended have an end time of 0.
+	if validateTimes {
+		beginMs, _ := span.BeginParts()
+		endMs, _ := span.EndParts()
+		if endMs != 0 && span.HasNegativeDuration() {
+			return REJECT_REASON_TIMES, fmt.Sprintf("The span ends at %d, "+
+				"before it begins at %d.", endMs, beginMs)
+		}
+	}
+	return "", ""
+}
+
+// Drop all but the first max parents of the span, for readers which don't
+// want very wide spans to bloat their responses.  NumParents still holds the
+// number of parents the span really has.  If max is 0, the parents are left
+// alone.
+func (span *Span) TruncateParents(max int) {
+	if max <= 0 || len(span.Parents) <= max {
+		return
+	}
+	if span.NumParents == 0 {
+		span.NumParents = len(span.Parents)
+	}
+	span.Parents = span.Parents[0:max]
+}
@@ -22,8 +22,11 @@ package common
 import (
 	"bytes"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/ugorji/go/codec"
+	"math/rand"
+	"strings"
 	"testing"
 )
 
@@ -67,6 +70,44 @@ func TestAnnotatedSpanToJson(t *testing.T) {
 		string(span.ToJson()))
 }
 
+func TestLinkedSpanToJson(t *testing.T) {
+	t.Parallel()
+	span := Span{Id: TestId("5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19"),
+		SpanData: SpanData{
+			Begin:       100,
+			End:         200,
+			Description: "consume",
+			Parents:     []SpanId{},
+			TracerId:    "consumer",
+			Links: []SpanLink{
+				SpanLink{
+					Id:   TestId("33f25a1a750a471db5bafa59309d7d6f"),
+					Type: LINK_TYPE_FOLLOWS_FROM,
+				},
+			},
+		}}
+	str := `{"a":"5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19","b":100,"e":200,"d":"consume","p":[],"r":"consumer","l":[{"i":"33f25a1a750a471db5bafa59309d7d6f","t":"follows_from"}]}`
+	ExpectStrEqual(t, str, string(span.ToJson()))
+	var span2 Span
+	err := json.Unmarshal([]byte(str), &span2)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal %s: %s\n", str, err.Error())
+	}
+	ExpectSpansEqual(t, &span, &span2)
+
+	// Spans which were written before links existed have no links field.
+	str = `{"a":"5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19","b":100,"e":200,"d":"consume","p":[],"r":"consumer"}`
+	var span3 Span
+	err = json.Unmarshal([]byte(str), &span3)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal %s: %s\n", str, err.Error())
+	}
+	if span3.Links != nil {
+		t.Fatalf("Expected no links, but got %v\n", span3.Links)
+	}
+	ExpectStrEqual(t, str, string(span3.ToJson()))
+}
+
 func TestSpanNext(t *testing.T) {
 	ExpectStrEqual(t, TestId("00000000000000000000000000000001").String(),
 		TestId("00000000000000000000000000000000").Next().String())
@@ -85,6 +126,55 @@ func TestSpanPrev(t *testing.T) {
 		TestId("00000000000000000000000000000000").Prev().String())
 }
 
+func TestSpanExtrasRoundTrip(t *testing.T) {
+	t.Parallel()
+	str := `{"a":"5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19","b":100,"e":200,"d":"op","p":[],"r":"tracer","xf":7,"zz":{"k":[1,"two",null]}}`
+	var span Span
+	err := json.Unmarshal([]byte(str), &span)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal %s: %s\n", str, err.Error())
+	}
+	if len(span.Extras) != 2 || string(span.Extras["xf"]) != "7" ||
+		string(span.Extras["zz"]) != `{"k":[1,"two",null]}` {
+		t.Fatalf("Unexpected extras %v\n", span.Extras)
+	}
+	if span.Extras.Bytes() != len("xf7zz")+len(`{"k":[1,"two",null]}`) {
+		t.Fatalf("Unexpected extras size %d\n", span.Extras.Bytes())
+	}
+	ExpectStrEqual(t, str, string(span.ToJson()))
+
+	// The extras of the span data are kept the same way.
+	var data SpanData
+	err = json.Unmarshal([]byte(str), &data)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal %s: %s\n", str, err.Error())
+	}
+	if _, present := data.Extras["a"]; !present {
+		t.Fatalf("Expected the span ID to be an extra of SpanData.\n")
+	}
+	buf, err := json.Marshal(data)
+	if err != nil {
+		t.Fatalf("Failed to marshal span data: %s\n", err.Error())
+	}
+	ExpectStrEqual(t, `{"b":100,"e":200,"d":"op","p":[],"r":"tracer",`+
+		`"a":"5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19","xf":7,"zz":{"k":[1,"two",null]}}`,
+		string(buf))
+
+	// Extras survive the packed encoding too.
+	mh := &codec.MsgpackHandle{WriteExt: true}
+	var packed []byte
+	err = codec.NewEncoderBytes(&packed, mh).Encode(&span)
+	if err != nil {
+		t.Fatalf("Error encoding span as msgpack: %s\n", err.Error())
+	}
+	var span2 Span
+	err = codec.NewDecoderBytes(packed, mh).Decode(&span2)
+	if err != nil {
+		t.Fatalf("Error decoding span from msgpack: %s\n", err.Error())
+	}
+	ExpectStrEqual(t, str, string(span2.ToJson()))
+}
+
 func TestSpanMsgPack(t *testing.T) {
 	span := Span{Id: TestId("33f25a1a750a471db5bafa59309d7d6f"),
 		SpanData: SpanData{
@@ -114,3 +204,332 @@ func TestSpanMsgPack(t *testing.T) {
 	}
 	ExpectSpansEqual(t, &span, &span2)
 }
+
+func TestSpanNsTimes(t *testing.T) {
+	t.Parallel()
+	span := Span{Id: TestId("33f25a1a750a471db5bafa59309d7d6f"),
+		SpanData: SpanData{
+			Description: "getFileDescriptors",
+			Parents:     []SpanId{},
+			TracerId:    "testTracerId",
+		}}
+	span.SetBeginNs(1234000250)
+	span.SetEndNs(1234001100)
+	if span.Begin != 1234 || span.End != 1234 {
+		t.Fatalf("Expected Begin and End of 1234, but got %d and %d\n",
+			span.Begin, span.End)
+	}
+	ms, ns := span.DurationParts()
+	if ms != 0 || ns != 850 || span.DurationNs() != 850 {
+		t.Fatalf("Expected a duration of 850 ns, but got %d ms and %d ns\n",
+			ms, ns)
+	}
+	ExpectStrEqual(t, `{"a":"33f25a1a750a471db5bafa59309d7d6f","b":1234,`+
+		`"e":1234,"d":"getFileDescriptors","p":[],"r":"testTracerId",`+
+		`"bn":1234000250,"en":1234001100}`, string(span.ToJson()))
+
+	// The nanosecond times survive the packed encoding.
+	mh := &codec.MsgpackHandle{WriteExt: true}
+	var packed []byte
+	err := codec.NewEncoderBytes(&packed, mh).Encode(&span)
+	if err != nil {
+		t.Fatalf("Error encoding span as msgpack: %s\n", err.Error())
+	}
+	var span2 Span
+	err = codec.NewDecoderBytes(packed, mh).Decode(&span2)
+	if err != nil {
+		t.Fatalf("Error decoding span from msgpack: %s\n", err.Error())
+	}
+	ExpectSpansEqual(t, &span, &span2)
+
+	// Spans without nanosecond times have millisecond precision.
+	var old Span
+	err = json.Unmarshal([]byte(`{"a":"33f25a1a750a471db5bafa59309d7d6f",`+
+		`"b":1234,"e":1236,"d":"op","p":[],"r":"tracer"}`), &old)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal span: %s\n", err.Error())
+	}
+	ms, ns = old.DurationParts()
+	if old.HasNsTimes() || ms != 2 || ns != 0 || old.DurationNs() != 2000000 {
+		t.Fatalf("Unexpected duration for old-format span: %d ms and %d "+
+			"ns\n", ms, ns)
+	}
+	old.DeriveMsTimes()
+	if old.Begin != 1234 || old.End != 1236 {
+		t.Fatalf("DeriveMsTimes changed the times of an old-format span.\n")
+	}
+
+	// The nanosecond part of a duration is never negative.
+	span.SetBeginNs(1000999999)
+	span.SetEndNs(1002000001)
+	ms, ns = span.DurationParts()
+	if ms != 1 || ns != 2 {
+		t.Fatalf("Expected a duration of 1 ms and 2 ns, but got %d ms and "+
+			"%d ns\n", ms, ns)
+	}
+}
+
+func TestSpanFlags(t *testing.T) {
+	t.Parallel()
+	flags, err := ParseSpanFlags(" Debug,scrubbed")
+	if err != nil {
+		t.Fatalf("ParseSpanFlags failed: %s\n", err.Error())
+	}
+	if flags != SPAN_FLAG_DEBUG|SPAN_FLAG_SCRUBBED ||
+		!flags.Has(SPAN_FLAG_SCRUBBED) || flags.Has(SPAN_FLAG_SYNTHETIC) {
+		t.Fatalf("Unexpected flags %d\n", flags)
+	}
+	ExpectStrEqual(t, "debug,scrubbed", flags.String())
+	ExpectStrEqual(t, "synthetic,0x10", (SPAN_FLAG_SYNTHETIC | 0x10).String())
+	_, err = ParseSpanFlags("debug,sampled")
+	AssertErrContains(t, err, "Unknown span flag 'sampled'")
+
+	span := Span{Id: TestId("33f25a1a750a471db5bafa59309d7d6f"),
+		SpanData: SpanData{
+			Begin:       1234,
+			End:         5678,
+			Description: "getFileDescriptors",
+			Parents:     []SpanId{},
+			TracerId:    "testTracerId",
+			Flags:       SPAN_FLAG_SYNTHETIC,
+		}}
+	ExpectStrEqual(t, `{"a":"33f25a1a750a471db5bafa59309d7d6f","b":1234,`+
+		`"e":5678,"d":"getFileDescriptors","p":[],"r":"testTracerId",`+
+		`"fl":2}`, string(span.ToJson()))
+	mh := &codec.MsgpackHandle{WriteExt: true}
+	var packed []byte
+	err = codec.NewEncoderBytes(&packed, mh).Encode(&span)
+	if err != nil {
+		t.Fatalf("Error encoding span as msgpack: %s\n", err.Error())
+	}
+	var span2 Span
+	err = codec.NewDecoderBytes(packed, mh).Decode(&span2)
+	if err != nil {
+		t.Fatalf("Error decoding span from msgpack: %s\n", err.Error())
+	}
+	ExpectSpansEqual(t, &span, &span2)
+
+	// Spans written before there were flags have none.
+	var old Span
+	err = json.Unmarshal([]byte(`{"a":"33f25a1a750a471db5bafa59309d7d6f",`+
+		`"b":1234,"e":1236,"d":"op","p":[],"r":"tracer"}`), &old)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal span: %s\n", err.Error())
+	}
+	if old.Flags != 0 {
+		t.Fatalf("Expected no flags, but got %s\n", old.Flags.String())
+	}
+}
+
+// Format a span ID the way we did before we had AppendHex.
+func legacySpanIdString(id SpanId) string {
+	return fmt.Sprintf("%02x%02x%02x%02x"+
+		"%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x%02x",
+		id[0], id[1], id[2], id[3], id[4], id[5], id[6], id[7], id[8],
+		id[9], id[10], id[11], id[12], id[13], id[14], id[15])
+}
+
+func expectSpanIdRoundTrip(t *testing.T, id SpanId) {
+	str := id.String()
+	if str != legacySpanIdString(id) {
+		t.Fatalf("Expected %s, but got %s\n", legacySpanIdString(id), str)
+	}
+	buf, err := json.Marshal(id)
+	if err != nil {
+		t.Fatalf("Error marshalling %s: %s\n", str, err.Error())
+	}
+	if string(buf) != `"`+str+`"` {
+		t.Fatalf("Expected JSON \"%s\", but got %s\n", str, string(buf))
+	}
+	var id2 SpanId
+	err = json.Unmarshal(buf, &id2)
+	if err != nil {
+		t.Fatalf("Error unmarshalling %s: %s\n", string(buf), err.Error())
+	}
+	if !id.Equal(id2) {
+		t.Fatalf("Expected %s after a JSON round trip, but got %s\n",
+			str, id2.String())
+	}
+	var id3 SpanId
+	err = id3.FromString(str)
+	if err != nil || !id.Equal(id3) {
+		t.Fatalf("Expected FromString(%s) to return %s\n", str, str)
+	}
+}
+
+func TestSpanIdRoundTrip(t *testing.T) {
+	// Try every byte value in every position.
+	for pos := 0; pos < SPAN_ID_LEN; pos++ {
+		for val := 0; val < 256; val++ {
+			id := SpanId(make([]byte, SPAN_ID_LEN))
+			id[pos] = byte(val)
+			expectSpanIdRoundTrip(t, id)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1878))
+	for i := 0; i < 10000; i++ {
+		id := SpanId(make([]byte, SPAN_ID_LEN))
+		rnd.Read(id)
+		expectSpanIdRoundTrip(t, id)
+	}
+}
+
+func expectSpanIdParseError(t *testing.T, str string, expected string) {
+	var id SpanId
+	err := id.FromString(str)
+	if err == nil {
+		t.Fatalf("Expected FromString(%s) to fail\n", str)
+	}
+	if !strings.Contains(err.Error(), expected) {
+		t.Fatalf("Expected FromString(%s) to fail with '%s', but got '%s'\n",
+			str, expected, err.Error())
+	}
+	err = json.Unmarshal([]byte(`"`+str+`"`), &id)
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Fatalf("Expected unmarshalling \"%s\" to fail with '%s', but "+
+			"got %v\n", str, expected, err)
+	}
+}
+
+func TestSpanIdValidation(t *testing.T) {
+	expectSpanIdParseError(t, "", "expected 32 hex digits, but got 0")
+	expectSpanIdParseError(t, "33f25a1a750a471db5bafa59309d7d6",
+		"expected 32 hex digits, but got 31")
+	expectSpanIdParseError(t, "33f25a1a750a471db5bafa59309d7d6f0",
+		"expected 32 hex digits, but got 33")
+	expectSpanIdParseError(t, "33F25A1A750A471DB5BAFA59309D7D6F",
+		"position 2 is not a lowercase hex digit")
+	expectSpanIdParseError(t, "33f25a1a750a471db5bafa59309d7d6G",
+		"position 31 is not a lowercase hex digit")
+	expectSpanIdParseError(t, "33f25a1a750a471db5bafa59309d7d 6",
+		"position 30 is not a lowercase hex digit")
+	expectSpanIdParseError(t, "0x3f25a1a750a471db5bafa59309d7d6",
+		"position 1 is not a lowercase hex digit")
+	var id SpanId
+	for _, buf := range []string{``, `"`, `33f25a1a750a471db5bafa59309d7d6f`,
+		`"33f25a1a750a471db5bafa59309d7d6f`} {
+		if id.UnmarshalJSON([]byte(buf)) == nil {
+			t.Fatalf("Expected UnmarshalJSON(%s) to fail\n", buf)
+		}
+	}
+
+	// Random strings are only accepted if they are 32 lowercase hex digits.
+	rnd := rand.New(rand.NewSource(1878))
+	alphabet := "0123456789abcdefABCDEFxyz -\""
+	for i := 0; i < 10000; i++ {
+		buf := make([]byte, SPAN_ID_HEX_LEN-1+rnd.Intn(3))
+		for j := range buf {
+			if rnd.Intn(20) == 0 {
+				buf[j] = alphabet[rnd.Intn(len(alphabet))]
+			} else {
+				buf[j] = alphabet[rnd.Intn(16)]
+			}
+		}
+		str := string(buf)
+		valid := len(str) == SPAN_ID_HEX_LEN &&
+			strings.Trim(str, "0123456789abcdef") == ""
+		err := id.FromString(str)
+		if valid != (err == nil) {
+			t.Fatalf("FromString(%s) returned %v, but valid = %v\n",
+				str, err, valid)
+		}
+		if valid && id.String() != str {
+			t.Fatalf("FromString(%s) parsed %s\n", str, id.String())
+		}
+	}
+}
+
+func TestSpanIdBinary(t *testing.T) {
+	ids := []SpanId{TestId("33f25a1a750a471db5bafa59309d7d6f"),
+		TestId("00000000000000000000000000000001"),
+		TestId("ffffffffffffffffffffffffffffffff")}
+	buf := new(bytes.Buffer)
+	for i := range ids {
+		err := ids[i].WriteBinary(buf)
+		if err != nil {
+			t.Fatalf("WriteBinary(%s) failed: %s\n", ids[i].String(),
+				err.Error())
+		}
+	}
+	if buf.Len() != len(ids)*SPAN_ID_LEN {
+		t.Fatalf("Expected %d bytes, but got %d\n", len(ids)*SPAN_ID_LEN,
+			buf.Len())
+	}
+	for i := range ids {
+		var id SpanId
+		err := id.ReadBinary(buf)
+		if err != nil {
+			t.Fatalf("ReadBinary failed: %s\n", err.Error())
+		}
+		if !id.Equal(ids[i]) {
+			t.Fatalf("Expected %s, but read %s\n", ids[i].String(), id.String())
+		}
+	}
+	var id SpanId
+	if id.ReadBinary(bytes.NewReader([]byte{1, 2, 3})) == nil {
+		t.Fatalf("Expected ReadBinary of a truncated span ID to fail\n")
+	}
+	if SpanId([]byte{1, 2, 3}).WriteBinary(buf) == nil {
+		t.Fatalf("Expected WriteBinary of a short span ID to fail\n")
+	}
+}
+
+func TestSpanIdAllocations(t *testing.T) {
+	id := TestId("33f25a1a750a471db5bafa59309d7d6f")
+	buf := make([]byte, 0, 64)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = id.AppendJSON(buf[:0])
+	})
+	if allocs != 0 {
+		t.Fatalf("Expected AppendJSON to make no allocations, but it made "+
+			"%f\n", allocs)
+	}
+	jbuf := []byte(`"33f25a1a750a471db5bafa59309d7d6f"`)
+	var id2 SpanId
+	allocs = testing.AllocsPerRun(100, func() {
+		id2.UnmarshalJSON(jbuf)
+	})
+	if allocs != 1 {
+		t.Fatalf("Expected UnmarshalJSON to make one allocation, but it "+
+			"made %f\n", allocs)
+	}
+}
+
+func createSpanWithParents(numParents int) *Span {
+	rnd := rand.New(rand.NewSource(1878))
+	span := &Span{Id: TestId("33f25a1a750a471db5bafa59309d7d6f"),
+		SpanData: SpanData{
+			Begin:       1234,
+			End:         5678,
+			Description: "getFileDescriptors",
+			Parents:     make([]SpanId, numParents),
+			TracerId:    "testTracerId",
+		}}
+	for i := range span.Parents {
+		span.Parents[i] = SpanId(make([]byte, SPAN_ID_LEN))
+		rnd.Read(span.Parents[i])
+	}
+	return span
+}
+
+func BenchmarkSpanWithParentsToJson(b *testing.B) {
+	span := createSpanWithParents(10)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		span.ToJson()
+	}
+}
+
+func BenchmarkSpanWithParentsFromJson(b *testing.B) {
+	buf := createSpanWithParents(10).ToJson()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var span Span
+		err := json.Unmarshal(buf, &span)
+		if err != nil {
+			b.Fatalf("Error unmarshalling span: %s\n", err.Error())
+		}
+	}
+}
@@ -70,8 +70,20 @@ func ExpectStrEqual(t *testing.T, expect string, actual string) {
 }
 
 // Trigger a test failure if the JSON representation of two spans are not equals.
+// The server fills in NumParents and SchemaVersion, so spans which lack them
+// are compared as if they had them.
 func ExpectSpansEqual(t *testing.T, spanA *Span, spanB *Span) {
-	ExpectStrEqual(t, string(spanA.ToJson()), string(spanB.ToJson()))
+	ExpectStrEqual(t, string(withServerFields(spanA).ToJson()),
+		string(withServerFields(spanB).ToJson()))
+}
+
+func withServerFields(span *Span) *Span {
+	spanCopy := *span
+	if spanCopy.NumParents == 0 {
+		spanCopy.NumParents = len(span.Parents)
+	}
+	spanCopy.SchemaVersion = SPAN_SCHEMA_VERSION
+	return &spanCopy
 }
 
 func TestId(str string) SpanId {
@@ -20,9 +20,28 @@
 package common
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// The number of nanoseconds in a millisecond.
+const NS_PER_MS = 1000000
+
+// Split a time in nanoseconds into whole milliseconds, rounding down, and the
+// nanoseconds past the last millisecond.
+func SplitNs(ns int64) (int64, int64) {
+	ms := ns / NS_PER_MS
+	rem := ns - (ms * NS_PER_MS)
+	if rem < 0 {
+		rem += NS_PER_MS
+		ms--
+	}
+	return ms, rem
+}
+
 func TimeToUnixMs(t time.Time) int64 {
 	return t.UnixNano() / 1000000
 }
@@ -32,3 +51,62 @@ func UnixMsToTime(u int64) time.Time {
 	nanos := u - (secs * 1000)
 	return time.Unix(secs, nanos)
 }
+
+var relativeTimeUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second,
+	"m":  time.Minute,
+	"h":  time.Hour,
+	"d":  24 * time.Hour,
+}
+
+// Parse a time which is given either as an RFC3339 timestamp, or relative to
+// the current time, and return it in milliseconds since the epoch.
+//
+// RFC3339 timestamps must include a time zone, either "Z" or an offset such
+// as "+05:30".  Relative times are "now", or "now" followed by a sign, a
+// base-10 integer, and one of the units ms, s, m, h, or d.  For example,
+// "now-2h" is two hours before 'now'.  Anything else is an error.
+func ParseHumanTime(str string, now time.Time) (int64, error) {
+	if strings.HasPrefix(str, "now") {
+		return parseRelativeTime(str, now)
+	}
+	t, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("'%s' is not an RFC3339 time with "+
+			"a time zone, or a relative time such as now-2h.", str))
+	}
+	return TimeToUnixMs(t), nil
+}
+
+func parseRelativeTime(str string, now time.Time) (int64, error) {
+	rest := str[len("now"):]
+	if rest == "" {
+		return TimeToUnixMs(now), nil
+	}
+	sign := time.Duration(1)
+	switch rest[0] {
+	case '-':
+		sign = -1
+	case '+':
+	default:
+		return 0, errors.New(fmt.Sprintf("Invalid relative time '%s': "+
+			"expected '+' or '-' after 'now'.", str))
+	}
+	rest = rest[1:]
+	numLen := 0
+	for numLen < len(rest) && rest[numLen] >= '0' && rest[numLen] <= '9' {
+		numLen++
+	}
+	unit, ok := relativeTimeUnits[rest[numLen:]]
+	if numLen == 0 || !ok {
+		return 0, errors.New(fmt.Sprintf("Invalid relative time '%s': "+
+			"expected an integer followed by ms, s, m, h, or d.", str))
+	}
+	n, err := strconv.ParseInt(rest[:numLen], 10, 64)
+	if err != nil || n > int64((1<<63-1)/unit) {
+		return 0, errors.New(fmt.Sprintf("Invalid relative time '%s': "+
+			"the offset is out of range.", str))
+	}
+	return TimeToUnixMs(now.Add(sign * time.Duration(n) * unit)), nil
+}
@@ -36,3 +36,52 @@ func TestTimeConversions(t *testing.T) {
 	testRoundTrip(t, 0)
 	testRoundTrip(t, 1445540632000)
 }
+
+func TestSplitNs(t *testing.T) {
+	for _, c := range [][]int64{{0, 0, 0}, {999999, 0, 999999},
+		{1000000, 1, 0}, {1445540632000123456, 1445540632000, 123456},
+		{-1, -1, 999999}, {-1000000, -1, 0}, {-1000001, -2, 999999}} {
+		ms, ns := SplitNs(c[0])
+		if ms != c[1] || ns != c[2] {
+			t.Fatalf("SplitNs(%d): expected %d ms and %d ns, but got %d "+
+				"and %d\n", c[0], c[1], c[2], ms, ns)
+		}
+	}
+}
+
+func TestParseHumanTime(t *testing.T) {
+	now := UnixMsToTime(1445540632000)
+	for _, tc := range []struct {
+		str      string
+		expected int64
+	}{
+		{"2015-10-22T19:03:52Z", 1445540632000},
+		{"2015-10-22T19:03:52.123Z", 1445540632123},
+		{"2015-10-23T00:33:52+05:30", 1445540632000},
+		{"2015-10-22T12:03:52-07:00", 1445540632000},
+		{"now", 1445540632000},
+		{"now-2h", 1445540632000 - 2*3600*1000},
+		{"now-30m", 1445540632000 - 30*60*1000},
+		{"now+15s", 1445540632000 + 15*1000},
+		{"now-250ms", 1445540632000 - 250},
+		{"now-1d", 1445540632000 - 24*3600*1000},
+	} {
+		v, err := ParseHumanTime(tc.str, now)
+		if err != nil {
+			t.Fatalf("failed to parse '%s': %s\n", tc.str, err.Error())
+		}
+		if v != tc.expected {
+			t.Fatalf("expected '%s' to be %d, but got %d\n", tc.str,
+				tc.expected, v)
+		}
+	}
+	for _, str := range []string{"", "yesterday", "now-", "now-h", "now-2",
+		"now-2w", "now-1.5h", "now - 2h", "now-1h30m", "2h",
+		"2015-10-22T19:03:52", "2015-10-22 19:03:52Z", "1445540632000",
+		"now-99999999999999999999d", "now-9999999999d"} {
+		_, err := ParseHumanTime(str, now)
+		if err == nil {
+			t.Fatalf("expected '%s' to be rejected\n", str)
+		}
+	}
+}
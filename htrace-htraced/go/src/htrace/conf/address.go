@@ -0,0 +1,175 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The address formats which NormalizeAddress accepts, for error messages.
+const ADDRESS_FORMATS = "':port', 'host:port', '[ipv6-host]:port', or " +
+	"'unix:///path/to/socket'"
+
+// The prefix of addresses which name a unix domain socket rather than a TCP
+// host and port, such as "unix:///var/run/htraced.sock".  The REST and HRPC
+// servers can listen on unix sockets, which is cheaper than going through
+// the loopback interface for clients on the same host.
+const UNIX_ADDRESS_PREFIX = "unix://"
+
+// Returns true if an address names a unix domain socket.
+func IsUnixAddress(addr string) bool {
+	return strings.HasPrefix(addr, UNIX_ADDRESS_PREFIX)
+}
+
+// Get the network and the address to pass to net.Listen or net.Dial for a
+// normalized address.  For a unix socket, the address is the socket path.
+func NetworkAddress(addr string) (string, string) {
+	if IsUnixAddress(addr) {
+		return "unix", addr[len(UNIX_ADDRESS_PREFIX):]
+	}
+	return "tcp", addr
+}
+
+// Check and normalize a host:port address, such as web.address or
+// hrpc.address.  Surrounding whitespace is removed, and an empty host, which
+// means all interfaces, is left empty.  A bare port such as "8080" is an
+// error, rather than something that happens to fail later.  Unix socket
+// addresses must have an absolute path, which is cleaned.  The key is only
+// used in error messages.
+func NormalizeAddress(key string, val string) (string, error) {
+	addr := strings.TrimSpace(val)
+	if addr == "" {
+		return "", errors.New(fmt.Sprintf("No value was given for %s.  "+
+			"Expected %s.", key, ADDRESS_FORMATS))
+	}
+	if strings.Contains(addr, ",") {
+		return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: "+
+			"expected a single address, not a list.", val, key))
+	}
+	if IsUnixAddress(addr) {
+		path := addr[len(UNIX_ADDRESS_PREFIX):]
+		if !filepath.IsAbs(path) {
+			return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: "+
+				"the socket path must be absolute, as in "+
+				"'unix:///var/run/htraced.sock'.", val, key))
+		}
+		return UNIX_ADDRESS_PREFIX + filepath.Clean(path), nil
+	}
+	if _, err := strconv.ParseUint(addr, 10, 16); err == nil {
+		return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: a "+
+			"port must be preceded by a colon.  Use ':%s' to listen on all "+
+			"interfaces, or 'localhost:%s' for loopback only.",
+			val, key, addr, addr))
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: %s.  "+
+			"Expected %s.", val, key, err.Error(), ADDRESS_FORMATS))
+	}
+	if strings.ContainsAny(host, " \t") {
+		return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: the "+
+			"host contains whitespace.  Expected %s.", val, key,
+			ADDRESS_FORMATS))
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("Invalid value '%s' for %s: "+
+			"invalid port '%s'.  Expected %s.", val, key, port,
+			ADDRESS_FORMATS))
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(portNum, 10)), nil
+}
+
+// Get an address configuration key, normalized with NormalizeAddress.
+func (cnf *Config) GetAddress(key string) (string, error) {
+	return NormalizeAddress(key, cnf.Get(key))
+}
+
+// Get a configuration key which holds a comma-separated list of addresses.
+// Clients accept a list of servers in web.address and hrpc.address.  Each
+// address is normalized with NormalizeAddress.  An empty value gives an empty
+// list.
+func (cnf *Config) GetAddressList(key string) ([]string, error) {
+	val := cnf.Get(key)
+	if strings.TrimSpace(val) == "" {
+		return []string{}, nil
+	}
+	parts := strings.Split(val, ",")
+	addrs := make([]string, len(parts))
+	for i := range parts {
+		addr, err := NormalizeAddress(key, parts[i])
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+	return addrs, nil
+}
+
+// Returns true if a host binds all interfaces.
+func isWildcardHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// Check that the REST and HRPC servers aren't configured to listen on the same
+// address, so that we can fail before binding either of them.  Both addresses
+// must have been normalized.  Port 0 picks a free port, so it never conflicts.
+// An empty HRPC address means that the HRPC server is disabled.
+func CheckListenAddresses(webAddr string, hrpcAddr string) error {
+	if hrpcAddr == "" {
+		return nil
+	}
+	if IsUnixAddress(webAddr) || IsUnixAddress(hrpcAddr) {
+		if webAddr == hrpcAddr {
+			return errors.New(fmt.Sprintf("%s and %s both use the unix "+
+				"socket %s.  The REST and HRPC servers need different "+
+				"sockets.", HTRACE_WEB_ADDRESS, HTRACE_HRPC_ADDRESS, webAddr))
+		}
+		return nil
+	}
+	webHost, webPort, err := net.SplitHostPort(webAddr)
+	if err != nil {
+		return err
+	}
+	hrpcHost, hrpcPort, err := net.SplitHostPort(hrpcAddr)
+	if err != nil {
+		return err
+	}
+	if webPort != hrpcPort || webPort == "0" {
+		return nil
+	}
+	if webHost == hrpcHost || isWildcardHost(webHost) ||
+		isWildcardHost(hrpcHost) {
+		return errors.New(fmt.Sprintf("%s (%s) and %s (%s) both use port "+
+			"%s on the same interface.  The REST and HRPC servers need "+
+			"different ports.", HTRACE_WEB_ADDRESS, webAddr,
+			HTRACE_HRPC_ADDRESS, hrpcAddr, webPort))
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeAddress(t *testing.T) {
+	t.Parallel()
+	good := map[string]string{
+		":9096":                          ":9096",
+		" :9096 ":                        ":9096",
+		"localhost:8080":                 "localhost:8080",
+		"127.0.0.1:0":                    "127.0.0.1:0",
+		"0.0.0.0:09075":                  "0.0.0.0:9075",
+		"[::1]:9096":                     "[::1]:9096",
+		"[::]:9096":                      "[::]:9096",
+		"[fe80::1%lo]:9096":              "[fe80::1%lo]:9096",
+		"unix:///var/run/htraced.sock":   "unix:///var/run/htraced.sock",
+		"unix:///var/run//htraced.sock/": "unix:///var/run/htraced.sock",
+	}
+	for val, expected := range good {
+		addr, err := NormalizeAddress(HTRACE_WEB_ADDRESS, val)
+		if err != nil {
+			t.Fatalf("Unexpected error normalizing '%s': %s\n", val,
+				err.Error())
+		}
+		if addr != expected {
+			t.Fatalf("Expected '%s' to normalize to '%s', but got '%s'.\n",
+				val, expected, addr)
+		}
+	}
+	bad := map[string]string{
+		"":                    "No value was given for web.address",
+		"8080":                "Use ':8080' to listen on all interfaces",
+		"localhost":           "missing port",
+		"::1:9096":            "too many colons",
+		"localhost:http":      "invalid port 'http'",
+		"localhost:":          "invalid port ''",
+		"localhost:-1":        "invalid port '-1'",
+		"localhost:0x50":      "invalid port '0x50'",
+		"localhost:7000000":   "invalid port '7000000'",
+		"my host:8080":        "the host contains whitespace",
+		"a:8080,b:8080":       "expected a single address, not a list",
+		"unix://":             "the socket path must be absolute",
+		"unix://htraced.sock": "the socket path must be absolute",
+	}
+	for val, expected := range bad {
+		_, err := NormalizeAddress(HTRACE_WEB_ADDRESS, val)
+		if err == nil {
+			t.Fatalf("Expected an error normalizing '%s'.\n", val)
+		}
+		if !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected the error for '%s' to contain '%s', but "+
+				"got '%s'\n", val, expected, err.Error())
+		}
+		if val != "" && !strings.Contains(err.Error(), HTRACE_WEB_ADDRESS) {
+			t.Fatalf("Expected the error for '%s' to name %s, but got "+
+				"'%s'\n", val, HTRACE_WEB_ADDRESS, err.Error())
+		}
+	}
+}
+
+func TestGetAddressList(t *testing.T) {
+	t.Parallel()
+	cnfBld := Builder{Values: TEST_VALUES(), Defaults: DEFAULTS}
+	cnfBld.Values[HTRACE_WEB_ADDRESS] = "localhost:8080, 127.0.0.1:09080"
+	cnfBld.Values[HTRACE_HRPC_ADDRESS] = ""
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
+	}
+	addrs, err := cnf.GetAddressList(HTRACE_WEB_ADDRESS)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	if len(addrs) != 2 || addrs[0] != "localhost:8080" ||
+		addrs[1] != "127.0.0.1:9080" {
+		t.Fatalf("Unexpected address list %v\n", addrs)
+	}
+	addrs, err = cnf.GetAddressList(HTRACE_HRPC_ADDRESS)
+	if err != nil || len(addrs) != 0 {
+		t.Fatalf("Expected an empty list, but got %v, %v\n", addrs, err)
+	}
+	cnf = cnf.Clone(HTRACE_WEB_ADDRESS, "localhost:8080,,localhost:8081")
+	_, err = cnf.GetAddressList(HTRACE_WEB_ADDRESS)
+	if err == nil || !strings.Contains(err.Error(), "No value was given") {
+		t.Fatalf("Expected an error for an empty list entry, but got %v\n",
+			err)
+	}
+}
+
+func TestCheckListenAddresses(t *testing.T) {
+	t.Parallel()
+	conflicts := [][]string{
+		{":9096", ":9096"},
+		{"127.0.0.1:9096", "127.0.0.1:9096"},
+		{":9096", "127.0.0.1:9096"},
+		{"0.0.0.0:9096", "[::1]:9096"},
+		{"[::1]:9096", "[::]:9096"},
+	}
+	for i := range conflicts {
+		err := CheckListenAddresses(conflicts[i][0], conflicts[i][1])
+		if err == nil || !strings.Contains(err.Error(), "both use port") {
+			t.Fatalf("Expected %v to conflict, but got %v\n", conflicts[i], err)
+		}
+	}
+	err := CheckListenAddresses("unix:///tmp/htraced.sock",
+		"unix:///tmp/htraced.sock")
+	if err == nil || !strings.Contains(err.Error(), "both use the unix socket") {
+		t.Fatalf("Expected the unix sockets to conflict, but got %v\n", err)
+	}
+	ok := [][]string{
+		{":9096", ":9075"},
+		{":0", ":0"},
+		{"127.0.0.1:9096", "127.0.0.2:9096"},
+		{":9096", ""},
+		{"unix:///tmp/htraced.sock", ":9096"},
+		{"unix:///tmp/htraced.sock", "unix:///tmp/htraced-hrpc.sock"},
+	}
+	for i := range ok {
+		err := CheckListenAddresses(ok[i][0], ok[i][1])
+		if err != nil {
+			t.Fatalf("Unexpected error checking %v: %s\n", ok[i], err.Error())
+		}
+	}
+}
@@ -43,7 +43,8 @@ import (
 // Configuration key constants should be defined in config_keys.go.  Each key should have a default,
 // which will be used if the user supplies no value, or supplies an invalid value.
 // For that reason, it is not necessary for the Get, GetInt, etc. functions to take a default value
-// argument.
+// argument.  The defaults also serve as the registry of known keys when validating the
+// configuration; see validate.go.
 //
 // Configuration objects are immutable.  However, you can make a copy of a configuration which adds
 // some changes using Configuration#Clone().
@@ -70,6 +71,15 @@ type Builder struct {
 	// The name of the application.  Configuration keys that start with this
 	// string will be converted to their unprefixed forms.
 	AppPrefix string
+
+	// If true, validate the configuration against the defaults.  Build will
+	// fail if a known key has a value of the wrong type, or if an unknown key
+	// is set and HTRACE_CONF_STRICT is true.
+	Validate bool
+
+	// Warnings about unknown keys found during validation.  Filled in by
+	// Build.
+	Warnings []string
 }
 
 func getDefaultHTracedConfDir() string {
@@ -92,19 +102,14 @@ func getHTracedConfDirs(dlog io.Writer) []string {
 // defaults.
 func LoadApplicationConfig(appPrefix string) (*Config, io.Reader) {
 	dlog := new(bytes.Buffer)
-	reader := openFile(CONFIG_FILE_NAME, getHTracedConfDirs(dlog), dlog)
-	bld := Builder{}
-	if reader != nil {
-		defer reader.Close()
-		bld.Reader = bufio.NewReader(reader)
-	}
-	bld.Argv = os.Args[1:]
-	bld.Defaults = DEFAULTS
-	bld.AppPrefix = appPrefix
-	cnf, err := bld.Build()
+	bld := Builder{Argv: os.Args[1:]}
+	cnf, err := bld.buildApplicationConfig(appPrefix, dlog)
 	if err != nil {
 		log.Fatal("Error building configuration: " + err.Error())
 	}
+	for i := range bld.Warnings {
+		fmt.Fprintf(os.Stderr, "WARNING: %s\n", bld.Warnings[i])
+	}
 	os.Args = append(os.Args[0:1], bld.Argv...)
 	keys := make(sort.StringSlice, 0, 20)
 	for k, _ := range cnf.settings {
@@ -121,6 +126,38 @@ func LoadApplicationConfig(appPrefix string) (*Config, io.Reader) {
 	return cnf, dlog
 }
 
+// Load the application configuration again.  The configuration file is re-read, but the
+// command-line arguments should be the ones the application was started with, so that -D arguments
+// still take precedence over the file.  Unlike LoadApplicationConfig, errors are returned rather
+// than being fatal.
+func ReloadApplicationConfig(appPrefix string, argv []string,
+	dlog io.Writer) (*Config, error) {
+	bld := Builder{Argv: append([]string{}, argv...)}
+	return bld.buildApplicationConfig(appPrefix, dlog)
+}
+
+// Build the application configuration from the configuration file, the
+// builder's command-line arguments, and the standard defaults.
+func (bld *Builder) buildApplicationConfig(appPrefix string,
+	dlog io.Writer) (*Config, error) {
+	reader := openFile(CONFIG_FILE_NAME, getHTracedConfDirs(dlog), dlog)
+	if reader != nil {
+		defer reader.Close()
+		bld.Reader = bufio.NewReader(reader)
+	}
+	bld.Defaults = DEFAULTS
+	bld.AppPrefix = appPrefix
+	bld.Validate = true
+	cnf, err := bld.Build()
+	if err != nil {
+		return nil, err
+	}
+	for i := range bld.Warnings {
+		io.WriteString(dlog, fmt.Sprintf("WARNING: %s\n", bld.Warnings[i]))
+	}
+	return cnf, nil
+}
+
 // Attempt to open a configuration file somewhere on the provided list of paths.
 func openFile(cnfName string, paths []string, dlog io.Writer) io.ReadCloser {
 	for p := range paths {
@@ -194,6 +231,14 @@ func (bld *Builder) Build() (*Config, error) {
 	}
 	cnf.settings = bld.removeApplicationPrefixes(cnf.settings)
 	cnf.defaults = bld.removeApplicationPrefixes(cnf.defaults)
+	if bld.Validate {
+		warnings, err := validateSettings(cnf.settings, cnf.defaults,
+			cnf.GetBool(HTRACE_CONF_STRICT))
+		if err != nil {
+			return nil, err
+		}
+		bld.Warnings = warnings
+	}
 	return &cnf, nil
 }
 
@@ -41,24 +41,92 @@ const CONFIG_FILE_NAME = "htraced-conf.xml"
 // configuration file in.
 const HTRACED_CONF_DIR = "HTRACED_CONF_DIR"
 
+// Boolean key which indicates whether unknown configuration keys should be
+// treated as errors rather than warnings.
+const HTRACE_CONF_STRICT = "conf.strict"
+
 // The web address to start the REST server on.
 const HTRACE_WEB_ADDRESS = "web.address"
 
 // The default port for the Htrace web address.
 const HTRACE_WEB_ADDRESS_DEFAULT_PORT = 9096
 
+// The number of seconds that browsers may cache the static web UI resources
+// for before revalidating them.
+const HTRACE_WEB_STATIC_MAX_AGE_SEC = "web.static.max.age.sec"
+
 // The web address to start the REST server on.
 const HTRACE_HRPC_ADDRESS = "hrpc.address"
 
 // The default port for the Htrace HRPC address.
 const HTRACE_HRPC_ADDRESS_DEFAULT_PORT = 9075
 
+// The permissions, in octal, to give the unix sockets which the REST and HRPC
+// servers listen on when web.address or hrpc.address is a unix socket
+// address.  Clients need write permission on the socket to connect.
+const HTRACE_UNIX_SOCKET_MODE = "unix.socket.mode"
+
+// The address to receive spans on over UDP, or the empty string to disable
+// the UDP listener.  UDP gives clients no acknowledgement, so spans can be
+// lost.
+const HTRACE_UDP_ADDRESS = "udp.address"
+
+// The largest UDP datagram we will accept.  Larger datagrams are dropped.
+const HTRACE_UDP_MAX_DATAGRAM_BYTES = "udp.max.datagram.bytes"
+
+// The size of the operating system receive buffer for the UDP socket, or 0
+// to use the system default.  A bigger buffer loses fewer datagrams when
+// spans arrive in bursts.
+const HTRACE_UDP_RECV_BUFFER_BYTES = "udp.recv.buffer.bytes"
+
 // The directories to put the data store into.  Separated by PATH_LIST_SEP.
 const HTRACE_DATA_STORE_DIRECTORIES = "data.store.directories"
 
 // Boolean key which indicates whether we should clear data on startup.
 const HTRACE_DATA_STORE_CLEAR = "data.store.clear"
 
+// Finished spans shorter than this many milliseconds are left out of the
+// duration index, which saves an index write for each of them.  They are
+// still stored and reachable through the other indexes, but never match
+// duration predicates.  0 disables this.
+const HTRACE_INDEX_MIN_DURATION_MS = "index.min.duration.ms"
+
+// A comma-separated list of tracer IDs whose spans are always fully indexed,
+// regardless of index.min.duration.ms.
+const HTRACE_INDEX_FULL_TRACERS = "index.full.tracers"
+
+// The maximum number of a span's parents which get parent index entries.
+// Only the first this many parents of a wider span can find it as a child.
+// The stored span always keeps all of its parents.  0 disables the limit.
+const HTRACE_INDEX_MAX_PARENTS = "index.max.parents"
+
+// The maximum number of bytes of a span description which go into its
+// description index key.  Longer descriptions are indexed by their first this
+// many bytes and a hash, and queries check the spans found that way against
+// their full descriptions.  The stored span always keeps its whole
+// description.  Changing this rebuilds the description index of an existing
+// datastore the next time htraced starts.
+const HTRACE_INDEX_DESCRIPTION_MAX_BYTES = "index.description.max.bytes"
+
+// A comma-separated list of info keys which mark a span as failed, for spans
+// whose clients didn't say whether they failed.  A span with one of these
+// keys failed unless the value is empty, "false", "no", or "0".  Changing
+// this doesn't affect the spans which were already stored.
+const HTRACE_SPAN_ERROR_INFO_KEYS = "span.error.info.keys"
+
+// A comma-separated list of prefixes.  A span with a timeline annotation
+// whose message starts with one of them is marked as failed, like one with
+// an error info key.  Empty if timeline annotations never mark spans as
+// failed.
+const HTRACE_SPAN_ERROR_TIMELINE_PREFIXES = "span.error.timeline.prefixes"
+
+// If true, serve an existing datastore without writing to it.  Span writes
+// are rejected, and the shards are never reaped or recounted.  This is useful
+// for serving a restored snapshot, or a copy of another daemon's data
+// directories.  The shards are still locked while they are open, so a
+// read-only daemon can't share directories with a daemon that writes to them.
+const HTRACE_READ_ONLY = "read.only"
+
 // How many writes to buffer before applying backpressure to span senders.
 const HTRACE_DATA_STORE_SPAN_BUFFER_SIZE = "data.store.span.buffer.size"
 
@@ -68,22 +136,451 @@ const HTRACE_LOG_PATH = "log.path"
 // The log level to use for the logs in htrace.
 const HTRACE_LOG_LEVEL = "log.level"
 
+// The maximum size of a log file in bytes, or 0 to let log files grow without
+// bound.  When a log file would grow larger than this, it is renamed to
+// <path>.1 and a new log file is started.
+const HTRACE_LOG_MAX_FILE_SIZE = "log.max.file.size"
+
+// The number of rotated log files to keep.  The oldest rotated log file is
+// deleted when there would be more than this many.
+const HTRACE_LOG_MAX_ROTATED_FILES = "log.max.rotated.files"
+
+// Boolean key which indicates whether we should reopen the log files when we
+// receive SIGHUP.  This is useful when an external tool such as logrotate is
+// used to rotate the log files.
+const HTRACE_LOG_REOPEN_ON_SIGHUP = "log.reopen.on.sighup"
+
+// Boolean key which indicates whether messages at ERROR level should also be
+// written to stderr, no matter where the log file is.
+const HTRACE_LOG_ERRORS_TO_STDERR = "log.errors.to.stderr"
+
+// How often to write a summary of the log messages which were suppressed
+// because they repeated an earlier message, in milliseconds.  Until the
+// summary is written, only the first of a run of messages with the same
+// template and source is logged.
+const HTRACE_LOG_SUPPRESSION_PERIOD_MS = "log.suppression.period.ms"
+
+// The maximum number of distinct message templates and sources to track
+// suppressed log messages for.  Messages beyond this are suppressed and
+// counted together.
+const HTRACE_LOG_SUPPRESSION_MAX_KEYS = "log.suppression.max.keys"
+
 // The period between datastore heartbeats.  This is the approximate interval at which we will
 // prune expired spans.
 const HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS = "datastore.heartbeat.period.ms"
 
+// Boolean key which indicates whether the datastore should write a heartbeat
+// marker on each datastore heartbeat.  Heartbeat markers record the number of
+// spans ingested so far, so that consumers can detect gaps in ingest.
+const HTRACE_DATASTORE_HEARTBEAT_MARKERS = "datastore.heartbeat.markers"
+
+// Boolean key which indicates whether the datastore should assign a sequence
+// number to each span it writes.  Sequence numbers give a total order over the
+// spans written by this htraced, and can be scanned with /spans/seq.
+const HTRACE_DATASTORE_SEQUENCE_NUMBERS = "datastore.sequence.numbers"
+
+// What to do with spans destined for a quarantined shard.  "redirect" writes
+// them to the next healthy shard; "drop" drops them.
+const HTRACE_DATASTORE_QUARANTINE_POLICY = "datastore.quarantine.policy"
+
+// The datastore backend to use.  "leveldb" stores spans in leveldb instances
+// in the data.store.directories.  "journal" stores them in the
+// data.store.directories too, using a pure Go store which doesn't need the
+// native leveldb library, but which holds all the spans in memory.  "memory"
+// keeps spans in memory, and loses them when htraced exits.  It is meant for
+// development and tests.
+const HTRACE_DATASTORE_BACKEND = "datastore.backend"
+
+// The number of shards to use with the memory datastore backend.
+const HTRACE_DATASTORE_MEMORY_SHARDS = "datastore.memory.shards"
+
+// The maximum number of spans the memory datastore backend will hold.  When
+// it is full, the spans with the oldest begin times are evicted to make room
+// for new ones.  0 means there is no limit.
+const HTRACE_DATASTORE_MEMORY_MAX_SPANS = "datastore.memory.max.spans"
+
+// How spans are assigned to shards when a datastore is created.  "modulo"
+// takes a hash of the span id modulo the number of shards.  "jump" uses jump
+// consistent hashing, which moves fewer spans when shards are added.  The
+// strategy is recorded in the datastore, and an existing datastore always uses
+// the strategy it was created with.
+const HTRACE_DATASTORE_PLACEMENT = "datastore.placement"
+
+// If true, htraced will open a datastore which was created with a different
+// placement strategy than datastore.placement, using the recorded strategy.
+// Otherwise, a mismatch is an error.
+const HTRACE_DATASTORE_PLACEMENT_MIGRATE = "datastore.placement.migrate"
+
+// The DaemonId to give a new datastore, as a hex number like
+// 0x0123456789abcdef.  If this is set, an existing datastore must already
+// have this DaemonId, or htraced refuses to open it.  If it is empty, new
+// datastores get a random DaemonId.
+const HTRACE_DATASTORE_DAEMON_ID = "datastore.daemon.id"
+
+// If true, htraced will break a shard directory lock whose metadata names a
+// process on this host which is no longer running.  Otherwise, such a stale
+// lock is an error, which names the process which held it.  Locks held by
+// processes on other hosts, or by processes which are still running, are
+// never broken.
+const HTRACE_DATASTORE_LOCK_STEAL = "datastore.lock.steal"
+
+// The path to a file holding the master key used to encrypt span data on
+// disk, as 64 hexadecimal digits, or the empty string to not encrypt spans.
+// Only the span records are encrypted.  The index keys still contain span
+// ids, parent ids, begin and end times, and durations in plain text.  The
+// memory datastore backend ignores this key.
+const HTRACE_ENCRYPTION_KEY_FILE = "datastore.encryption.key.file"
+
+// The path to a file holding the previous master key, or the empty string.
+// Shards whose data keys were wrapped with the previous key can still be
+// opened, and their data keys are rewrapped with the current key in the
+// background.  Once that is done, the previous key is no longer needed.
+const HTRACE_ENCRYPTION_PREVIOUS_KEY_FILE = "datastore.encryption.previous.key.file"
+
+// The maximum number of entries to keep in the audit log.  Each WriteSpans
+// request adds an entry, and the oldest entries are removed once there are
+// more than this.  0 disables the audit log.
+const HTRACE_AUDIT_LOG_MAX_ENTRIES = "audit.log.max.entries"
+
+// The maximum number of bytes of WriteSpans metadata to record in each audit
+// log entry.  Metadata beyond this is dropped.
+const HTRACE_AUDIT_METADATA_MAX_BYTES = "audit.metadata.max.bytes"
+
+// The number of recently rejected spans to keep for each rejection reason, so
+// that /server/rejections can show examples.  0 means that only the number of
+// rejected spans is kept.
+const HTRACE_REJECTIONS_MAX_ENTRIES = "rejections.max.entries"
+
+// If true, the rejected spans kept for /server/rejections include the data
+// which was rejected.  Spans can contain sensitive information, so this is
+// off by default.
+const HTRACE_REJECTIONS_CAPTURE_PAYLOAD = "rejections.capture.payload"
+
+// The maximum number of bytes of data to keep for each rejected span.
+const HTRACE_REJECTIONS_PAYLOAD_MAX_BYTES = "rejections.payload.max.bytes"
+
+// If true, spans which end before they begin are rejected.  Spans which
+// haven't ended, and so have an end time of 0, are still accepted.
+const HTRACE_INGEST_VALIDATE_TIMES = "ingest.validate.times"
+
+// What to do with spans which end before they begin, usually because the
+// client's clock stepped backwards: "reject" drops them, "clamp" moves their
+// end time to their begin time, and "exclude" stores them as they are, but
+// leaves them out of the duration index and of duration statistics.  If
+// ingest.validate.times is set, they are always rejected.
+const HTRACE_INGEST_NEG_DURATION_POLICY = "ingest.negative.duration.policy"
+
+// The maximum number of bytes in an info key, and the maximum number of keys
+// in a span's info map.  0 means there is no limit.
+const HTRACE_INGEST_INFO_MAX_KEY_BYTES = "ingest.info.max.key.bytes"
+const HTRACE_INGEST_INFO_MAX_KEYS = "ingest.info.max.keys"
+
+// What to do with spans whose info maps are invalid: "strip" removes the
+// offending entries, and "reject" drops the whole span.  Info keys starting
+// with an underscore are reserved for the server, and are treated as invalid
+// when a client sends them.
+const HTRACE_INGEST_INFO_POLICY = "ingest.info.policy"
+
+// The number of goroutines which decode the spans of a large REST WriteSpans
+// request, and the number which validate them and hand them to the shards.
+// Smaller requests are handled on the request goroutine.  0 means the number
+// of CPUs Go may use.
+const HTRACE_INGEST_DECODE_CONCURRENCY = "ingest.decode.concurrency"
+const HTRACE_INGEST_VALIDATE_CONCURRENCY = "ingest.validate.concurrency"
+
+// The maximum number of spans, and the maximum number of bytes, in the body
+// of a single WriteSpans request.  Bigger requests are rejected with a
+// TOO_LARGE error.  The limits are advertised in /server/info, so that clients
+// can split their writes to fit.  0 means there is no limit, although HRPC
+// requests can never be bigger than 32 MB.
+const HTRACE_WRITE_SPANS_MAX_SPANS = "write.spans.max.spans"
+const HTRACE_WRITE_SPANS_MAX_BYTES = "write.spans.max.bytes"
+
+// The maximum number of milliseconds a span which hasn't finished is tracked
+// as an active span.  Older spans are dropped from the active span index, but
+// not deleted.  0 means there is no limit.
+const HTRACE_ACTIVE_SPAN_MAX_AGE_MS = "active.span.max.age.ms"
+
+// If true, htraced records the address of the client which sent each span in
+// the span's info map, under the _src_addr key.
+const HTRACE_SPAN_SOURCE_ADDR = "span.source.addr"
+
+// If true, queries can set a shard filter to scan only some of the shards.
+// This is meant for debugging a misbehaving shard, so it is off by default.
+const HTRACE_QUERY_SHARD_FILTER_ENABLED = "query.shard.filter.enabled"
+
+// The number of results a query returns if it doesn't set a limit, or sets a
+// limit of 0.
+const HTRACE_QUERY_DEFAULT_LIM = "query.default.lim"
+
+// The maximum number of results a query can return.  Larger limits are
+// lowered to this, and the REST response says which limit was used, so that
+// clients know to fetch the rest of the results a page at a time.
+const HTRACE_QUERY_MAX_LIM = "query.max.lim"
+
+// REST requests answered within this many milliseconds are satisfied, for the
+// purposes of the endpoint response time statistics in /server/stats.
+const HTRACE_REST_SLI_SATISFIED_MS = "rest.sli.satisfied.ms"
+
+// REST requests answered within this many milliseconds, but not within
+// rest.sli.satisfied.ms, are tolerating.  Slower requests are frustrated.
+const HTRACE_REST_SLI_TOLERATING_MS = "rest.sli.tolerating.ms"
+
+// If true, when more than one indexed predicate of a query could be read
+// from, htraced samples each one's index range, and reads from the one with
+// the fewest entries.  Otherwise, it reads from the first one.  Since each
+// index returns spans in its own order, this can change the order of a
+// query's results.
+const HTRACE_QUERY_PLANNER_STATS = "query.planner.stats"
+
+// The maximum number of index entries the query planner counts in each shard
+// when it estimates how many rows a predicate would read.
+const HTRACE_QUERY_PLANNER_SAMPLE_MAX = "query.planner.sample.max"
+
+// A comma-separated list of span quotas.  Each quota looks like
+// "pattern:limit:policy".  The pattern is matched against tracer IDs, using
+// the syntax of Go's path.Match, so "teamA-*" matches every tracer ID which
+// starts with "teamA-".  The limit is the number of stored spans the tracers
+// which match the pattern may have between them.  Each tracer ID counts
+// against the first quota it matches.  The policy says what happens to new
+// spans once the limit has been reached: "reject" drops them, and "sample"
+// keeps quota.sample.percent of them.  Usage is refreshed on each datastore
+// heartbeat.
+const HTRACE_QUOTA_RULES = "quota.rules"
+
+// The percentage of spans to keep for tracers which are over a quota with
+// the "sample" policy.
+const HTRACE_QUOTA_SAMPLE_PERCENT = "quota.sample.percent"
+
+// The percentage of written spans which the read-after-write canary reads back
+// to check that they were stored correctly.  0 disables the canary.  See
+// /server/canary.
+const HTRACE_CANARY_SAMPLE_PERCENT = "canary.sample.percent"
+
+// How long the canary waits after a sampled span is written before reading
+// it back.
+const HTRACE_CANARY_DELAY_MS = "canary.delay.ms"
+
+// The maximum number of spans per second the canary reads back.  0 means
+// there is no limit.
+const HTRACE_CANARY_MAX_RATE = "canary.max.spans.per.sec"
+
+// The maximum number of sampled spans waiting to be read back.  Spans
+// sampled while the queue is full are not checked.
+const HTRACE_CANARY_QUEUE_SIZE = "canary.queue.size"
+
+// The maximum number of span descriptions which /stats/descriptions keeps
+// latency statistics for in each hour.  The spans with other descriptions
+// are counted together.  0 disables the statistics.
+const HTRACE_DESC_STATS_MAX_DESCRIPTIONS = "description.stats.max.descriptions"
+
+// The maximum number of hours of description statistics to keep.  Hours
+// which only hold expired spans are dropped anyway.
+const HTRACE_DESC_STATS_MAX_HOURS = "description.stats.max.hours"
+
+// The maximum number of spans which /span/{id}/bundle puts in a trace bundle.
+// Bigger traces are truncated.
+const HTRACE_BUNDLE_MAX_SPANS = "bundle.max.spans"
+
+// If true, each batch of spans we accept is appended to an intake log in its
+// shard's data directory before the request is acknowledged.  Spans which
+// were acknowledged, but not yet written, are replayed from the log when the
+// server restarts.
+const HTRACE_INTAKE_LOG_ENABLED = "intake.log.enabled"
+
+// The maximum size of each shard's intake log, in bytes.  When a log is full,
+// writeSpans requests wait for the shard to catch up.
+const HTRACE_INTAKE_LOG_MAX_BYTES = "intake.log.max.bytes"
+
+// When the intake log is synced to disk.  "always" syncs after each batch is
+// appended.  "never" leaves it to the operating system, so acknowledged spans
+// survive a crash of htraced, but not of the machine.
+const HTRACE_INTAKE_LOG_SYNC = "intake.log.sync"
+
+// The number of buckets each SLO window is divided into.  Older buckets are
+// dropped as the window moves.  See /server/slos.
+const HTRACE_SLO_BUCKETS = "slo.buckets"
+
+// How long after the end of an SLO bucket spans which ended in it are still
+// counted.  Spans which arrive later than that are counted as late.
+const HTRACE_SLO_GRACE_MS = "slo.grace.ms"
+
+// The maximum number of spans each SLO evaluates on each datastore heartbeat.
+// If more arrived, the rest are evaluated on the next heartbeat.
+const HTRACE_SLO_SCAN_MAX_SPANS = "slo.scan.max.spans"
+
+// The maximum number of SLOs which can be defined.
+const HTRACE_SLO_MAX_SLOS = "slo.max.slos"
+
+// If true, the tags of a trace are removed once its root span has expired.
+// Otherwise they are kept, so that a tagged trace can still be found, even
+// though its spans are gone.  See /span/{id}/tags.
+const HTRACE_TRACE_TAGS_REAP_ORPHANS = "trace.tags.reap.orphans"
+
+// The maximum number of tags a single trace can carry.
+const HTRACE_TRACE_TAGS_MAX_PER_TRACE = "trace.tags.max.per.trace"
+
+// The maximum number of write groups the server keeps track of.  When a new
+// group arrives and there are already this many, the one which was updated
+// least recently is forgotten.  If this is 0, write groups are ignored.  See
+// /groups/{id}.
+const HTRACE_WRITE_GROUPS_MAX = "write.groups.max"
+
+// How long the server keeps track of a write group after its last member
+// arrived, in milliseconds.
+const HTRACE_WRITE_GROUPS_TTL_MS = "write.groups.ttl.ms"
+
+// The largest size a write group can declare.  Larger groups are ignored.
+const HTRACE_WRITE_GROUPS_MAX_SIZE = "write.groups.max.size"
+
+// The maximum number of saved searches.  See /searches.
+const HTRACE_SAVED_SEARCHES_MAX = "saved.searches.max"
+
+// If true, spans which arrive with a tracer ID that was renamed with an alias
+// are stored under the new tracer ID.  The aliases are kept in the datastore,
+// so they survive restarts, and setting this to false just stops applying
+// them.
+const HTRACE_TRACER_ALIASES_ENABLED = "tracer.aliases.enabled"
+
+// The number of spans a tracer rename scans in each shard before saving its
+// place.
+const HTRACE_TRACER_RENAME_BATCH_SIZE = "tracer.rename.batch.size"
+
+// The maximum number of spans per second a tracer rename scans, across all
+// shards.  0 means there is no limit.
+const HTRACE_TRACER_RENAME_MAX_RATE = "tracer.rename.max.spans.per.sec"
+
+// The number of spans a scan job reads from a shard at a time.
+const HTRACE_SCAN_JOB_BATCH_SIZE = "scan.job.batch.size"
+
+// The maximum number of spans per second a scan job reads, across all
+// shards.  0 means there is no limit.
+const HTRACE_SCAN_JOB_MAX_RATE = "scan.job.max.spans.per.sec"
+
+// The number of bytes of recently read spans which htraced keeps in memory,
+// so that repeated lookups of the same spans don't go to leveldb.  0
+// disables the cache.
+const HTRACE_SPAN_CACHE_BYTES = "datastore.span.cache.bytes"
+
+// The number of bytes of recently read FindChildren results which htraced
+// keeps in memory.  0 disables the cache.
+const HTRACE_CHILDREN_CACHE_BYTES = "datastore.children.cache.bytes"
+
+// How long a span lookup which has to ask every shard waits for the slowest
+// shard before deciding that the span doesn't exist, in milliseconds.  0
+// means wait as long as it takes.
+const HTRACE_FIND_SPAN_DEADLINE_MS = "datastore.find.span.deadline.ms"
+
+// The maximum number of span lookups which a batch lookup, such as assembling
+// a flame tree, can have in flight across the whole server.
+const HTRACE_FIND_SPANS_CONCURRENCY = "datastore.find.spans.concurrency"
+
+// If true, htraced injects faults at runtime, for soak testing.  This is
+// refused unless chaos.i.really.mean.it is also set, since it makes the
+// server drop writes on purpose.  Never set these in production.
+const HTRACE_CHAOS_ENABLED = "chaos.enabled"
+
+// Must be set to true along with chaos.enabled.
+const HTRACE_CHAOS_I_REALLY_MEAN_IT = "chaos.i.really.mean.it"
+
+// In chaos mode, the percentage of span batches which a shard waits for a
+// random time, up to chaos.shard.write.delay.max.ms, before writing.
+const HTRACE_CHAOS_WRITE_DELAY_PERCENT = "chaos.shard.write.delay.percent"
+
+const HTRACE_CHAOS_WRITE_DELAY_MAX_MS = "chaos.shard.write.delay.max.ms"
+
+// In chaos mode, the percentage of WriteSpans requests which are rejected.
+const HTRACE_CHAOS_REJECT_PERCENT = "chaos.write.reject.percent"
+
+// In chaos mode, the percentage of HRPC requests whose connection is closed
+// before the request is read.
+const HTRACE_CHAOS_HRPC_CLOSE_PERCENT = "chaos.hrpc.close.percent"
+
+// In chaos mode, the percentage of shard heartbeats which are handled after
+// a random delay, up to chaos.heartbeat.delay.max.ms.  The span counts and
+// other metrics which the shards update on each heartbeat fall behind.
+const HTRACE_CHAOS_HB_DELAY_PERCENT = "chaos.heartbeat.delay.percent"
+
+const HTRACE_CHAOS_HB_DELAY_MAX_MS = "chaos.heartbeat.delay.max.ms"
+
+// How late, in milliseconds, a span can arrive at htraced and still be covered
+// by the visibility watermark returned by /server/watermark.  Spans whose
+// begin time is further in the past than this are counted as late.
+const HTRACE_WATERMARK_LATENESS_MS = "watermark.lateness.ms"
+
+// If true, htraced drops spans which arrive too late to be covered by the
+// visibility watermark, rather than writing them.
+const HTRACE_WATERMARK_REJECT_LATE = "watermark.reject.late"
+
+// If true, each shard keeps a bloom filter over the ids of the spans stored in
+// it, so that lookups of spans which aren't there can skip the shard.
+const HTRACE_BLOOM_FILTER_ENABLED = "bloom.filter.enabled"
+
+// The size of each shard's bloom filter, in bytes.
+const HTRACE_BLOOM_FILTER_BYTES = "bloom.filter.bytes"
+
+// The false positive rate the bloom filters are tuned for, in parts per
+// million.  This decides the number of hash functions.  The actual rate
+// depends on how many spans each shard holds, and is reported in the server
+// stats.
+const HTRACE_BLOOM_FILTER_FPP_PER_MILLION = "bloom.filter.fpp.per.million"
+
 // The maximum number of addresses for which we will maintain metrics.
 const HTRACE_METRICS_MAX_ADDR_ENTRIES = "metrics.max.addr.entries"
 
+// How often, in milliseconds, we sample the Go runtime statistics (heap, GC,
+// goroutines, file descriptors) reported in the server stats.  Reading the
+// memory statistics briefly stops the world, so this is never allowed to be
+// less than one second.
+const HTRACE_METRICS_RUNTIME_PERIOD_MS = "metrics.runtime.period.ms"
+
+// The number of recent garbage collection pauses we keep track of in order to
+// report the maximum and average pause time.
+const HTRACE_METRICS_GC_PAUSE_BUF_SIZE = "metrics.gc.pause.buf.size"
+
+// The number of distinct descriptions a tracer may use before the server
+// reports it as having high description cardinality.  This usually means the
+// tracer puts ids or numbers into its span descriptions.  After that, the
+// tracer's spans are indexed by their descriptions with the ids and numbers
+// replaced by '*', so that they don't fill the description index with
+// distinct entries.  0 disables the check.
+const HTRACE_METRICS_DESC_CARDINALITY = "metrics.description.cardinality.limit"
+
+// The maximum number of tracer IDs for which we will count distinct
+// descriptions.
+const HTRACE_METRICS_MAX_TRACER_ENTRIES = "metrics.max.tracer.entries"
+
+// The maximum number of principals for which we will count the spans they
+// wrote.  When there are more, the least recently seen ones are forgotten.
+const HTRACE_METRICS_MAX_PRINCIPAL_ENTRIES = "metrics.max.principal.entries"
+
+// The number of buckets of ingest counters which /server/stats/history
+// returns, including the current bucket.
+const HTRACE_METRICS_HISTORY_BUCKETS = "metrics.history.buckets"
+
+// The length of each bucket returned by /server/stats/history, in
+// milliseconds.  Buckets start at multiples of this length since the epoch.
+const HTRACE_METRICS_HISTORY_BUCKET_MS = "metrics.history.bucket.ms"
+
 // The number of milliseconds we should keep spans before discarding them.
 const HTRACE_SPAN_EXPIRY_MS = "span.expiry.ms"
 
+// The age, in milliseconds, after which spans are downsampled, or 0 to keep
+// every span until it expires.  Spans older than this are reduced to
+// span.downsample.percent percent of the traces, until they expire.  This
+// must be less than span.expiry.ms.
+const HTRACE_SPAN_DOWNSAMPLE_AGE_MS = "span.downsample.age.ms"
+
+// The percentage of traces to keep when spans are downsampled, between 0 and
+// 100.  Whole traces are kept or deleted, by a hash of the root span ID.
+const HTRACE_SPAN_DOWNSAMPLE_PERCENT = "span.downsample.percent"
+
 // The period between updates to the span reaper
 const HTRACE_REAPER_HEARTBEAT_PERIOD_MS = "reaper.heartbeat.period.ms"
 
-// A host:port pair to send information to on startup.  This is used in unit
-// tests to determine the (random) port of the htraced process that has been
-// started.
+// A host:port pair, or a unix:// socket address, to send information to on
+// startup.  This is used in unit tests to determine the (random) port of the
+// htraced process that has been started.
 const HTRACE_STARTUP_NOTIFICATION_ADDRESS = "startup.notification.address"
 
 // The maximum number of HRPC handler goroutines we will create at once.  If
@@ -96,6 +593,19 @@ const HTRACE_NUM_HRPC_HANDLERS = "num.hrpc.handlers"
 // this to read or write a message, we will abort the connection.
 const HTRACE_HRPC_IO_TIMEOUT_MS = "hrpc.io.timeout.ms"
 
+// How long, in milliseconds, an HRPC connection may sit idle between requests
+// before we close it.
+const HTRACE_HRPC_IDLE_TIMEOUT_MS = "hrpc.idle.timeout.ms"
+
+// The maximum number of HRPC connections we will keep open at once.  New
+// connections beyond this limit are closed as soon as they are accepted.
+const HTRACE_HRPC_MAX_CONNECTIONS = "hrpc.max.connections"
+
+// The largest HRPC request body the server accepts, in bytes.  It can't be
+// more than 32 MB.  Bigger requests are skipped, and answered with a
+// MESSAGE_TOO_LARGE error, so that the client can split them.
+const HTRACE_HRPC_MAX_MESSAGE_BYTES = "hrpc.max.message.bytes"
+
 // The leveldb write buffer size, or 0 to use the library default, which is 4
 // MB in leveldb 1.16.  See leveldb's options.h for more details.
 const HTRACE_LEVELDB_WRITE_BUFFER_SIZE = "leveldb.write.buffer.size"
@@ -103,24 +613,316 @@ const HTRACE_LEVELDB_WRITE_BUFFER_SIZE = "leveldb.write.buffer.size"
 // The LRU cache size for leveldb, in bytes.
 const HTRACE_LEVELDB_CACHE_SIZE = "leveldb.cache.size"
 
-// Default values for HTrace configuration keys.
+// If true, each shard has its own leveldb block cache of leveldb.cache.size
+// bytes, so that a shard which is busy with a big ingest backlog or scan
+// can't evict the blocks of the others.  Otherwise, all the shards share one
+// cache of that size.
+const HTRACE_LEVELDB_CACHE_PER_SHARD = "leveldb.cache.per.shard"
+
+// The number of bits per key in the leveldb bloom filters, or 0 for no bloom
+// filters.  The filters let span lookups skip the sstables which can't hold
+// the span, which matters most while compactions are behind and a shard has
+// many level 0 files.  10 bits per key gives about 1% false positives.
+// Existing sstables get filters as they are compacted.
+const HTRACE_LEVELDB_BLOOM_BITS_PER_KEY = "leveldb.bloom.bits.per.key"
+
+// If true, the range scans of queries add the blocks they read to the
+// leveldb block cache.  Setting this to false keeps big scans from evicting
+// the blocks which span lookups use.  Maintenance scans, such as those of the
+// reaper and scan jobs, never add blocks to the cache.
+//
+// Leveldb runs compactions on a single background thread which all the
+// shards share, so compactions never run concurrently, and a leveldb
+// instance can only be opened once, so there are no separate read-only
+// handles.
+const HTRACE_LEVELDB_SCAN_FILL_CACHE = "leveldb.scan.fill.cache"
+
+// How htraced decides whether a request is allowed.  "allow-all" allows every
+// request.  "token-file" requires requests to carry a token listed in
+// auth.token.file, which grants the permissions the request needs.
+const HTRACE_AUTH_MODE = "auth.mode"
+
+// The file listing the tokens which htraced accepts, when auth.mode is
+// "token-file".  Each line holds a token, followed by whitespace and a
+// comma-separated list of the permissions it grants: read, write, and admin.
+// A third field may name the principal the token belongs to, which is
+// recorded in the spans written with it.  Blank lines, and lines starting with #, are ignored.  Changes to the file
+// are picked up without restarting.
+const HTRACE_AUTH_TOKEN_FILE = "auth.token.file"
+
+// How often, in milliseconds, htraced checks whether auth.token.file has
+// changed.
+const HTRACE_AUTH_TOKEN_FILE_RECHECK_MS = "auth.token.file.recheck.ms"
+
+// The path to the file where the replicator persists its position in the
+// source server's span stream, or the empty string to not persist it.
+const HTRACE_REPLICATION_CURSOR_PATH = "replication.cursor.path"
+
+// The maximum number of spans the replicator will transfer at once.
+const HTRACE_REPLICATION_BATCH_SIZE = "replication.batch.size"
+
+// The number of requests in a row which a client must fail to get through to
+// a server before it considers the server dead.  This only matters when the
+// client is given several servers in web.address.
+const HTRACE_CLIENT_FAILOVER_MAX_FAILURES = "client.failover.max.failures"
+
+// How long, in milliseconds, a client waits before trying a dead server
+// again.
+const HTRACE_CLIENT_FAILOVER_COOLDOWN_MS = "client.failover.cooldown.ms"
+
+// The maximum number of spans, and bytes, which a client puts in a single
+// WriteSpans request, for servers which don't advertise their own limits.
+// Bigger writes are split into several requests.  0 means there is no limit.
+const HTRACE_CLIENT_WRITE_MAX_SPANS = "client.write.max.spans"
+const HTRACE_CLIENT_WRITE_MAX_BYTES = "client.write.max.bytes"
+
+// The number of requests a client sends at once when a write has been split
+// into several requests.
+const HTRACE_CLIENT_WRITE_PARALLELISM = "client.write.parallelism"
+
+// The number of times a client retries a request which failed, when a write
+// has been split into several requests.  Requests which were rejected as
+// malformed are not retried.
+const HTRACE_CLIENT_WRITE_RETRIES = "client.write.retries"
+
+// The longest, in milliseconds, a client write waits for a server whose
+// ingestion is paused to resume.  Waiting doesn't use up any of the write's
+// retries.  0 makes writes to a paused server fail straight away.
+const HTRACE_CLIENT_PAUSE_MAX_WAIT_MS = "client.pause.max.wait.ms"
+
+// Whether a client drops spans with the same ID as a later span in the same
+// WriteSpans call, keeping only the last one.
+const HTRACE_CLIENT_WRITE_DEDUPE = "client.write.dedupe"
+
+// Whether a client sorts the spans in a WriteSpans call by span ID before
+// sending them, so that the server's writes are closer together.
+const HTRACE_CLIENT_WRITE_SORT = "client.write.sort"
+
+// Whether a client drops spans which the server would reject for their span
+// ID or the size of their unknown fields, rather than sending them.
+const HTRACE_CLIENT_WRITE_VALIDATE = "client.write.validate"
+
+// Whether a client declares a write group for each trace with more than one
+// span in a WriteSpans call, so that the server can tell whether all of its
+// spans arrived.  See write.groups.max.
+const HTRACE_CLIENT_WRITE_GROUP_BY_TRACE = "client.write.group.by.trace"
+
+// Whether a client adapts its writes to how each server is coping.  The
+// client shrinks its requests and waits between them when a server is slow
+// or failing, and stops writing to a server which fails too often, except for
+// occasional probes.  Adaptive writes send one request at a time.
+const HTRACE_CLIENT_ADAPTIVE_ENABLED = "client.adaptive.enabled"
+
+// The most and fewest spans an adaptive write puts in one request.  Writes
+// start at the most, and probes of a failing server use the fewest.
+const HTRACE_CLIENT_ADAPTIVE_MAX_SPANS = "client.adaptive.max.spans"
+const HTRACE_CLIENT_ADAPTIVE_MIN_SPANS = "client.adaptive.min.spans"
+
+// How many spans an adaptive write adds to its request size after each
+// request which was quick and succeeded.  Slow or failed requests halve it.
+const HTRACE_CLIENT_ADAPTIVE_STEP_SPANS = "client.adaptive.step.spans"
+
+// How long, in milliseconds, a request may take before an adaptive write
+// treats the server as slow.
+const HTRACE_CLIENT_ADAPTIVE_SLOW_MS = "client.adaptive.slow.ms"
+
+// The longest, in milliseconds, an adaptive write waits between requests.
+// The wait doubles after each slow or failed request, and halves after each
+// other one.
+const HTRACE_CLIENT_ADAPTIVE_MAX_DELAY_MS = "client.adaptive.max.delay.ms"
+
+// The number of recent requests to a server which an adaptive write looks
+// at, and the percentage of them which must fail for the client to stop
+// writing to the server.
+const HTRACE_CLIENT_CIRCUIT_WINDOW = "client.circuit.window"
+const HTRACE_CLIENT_CIRCUIT_FAILURE_PCT = "client.circuit.failure.pct"
+
+// How long, in milliseconds, a client waits before probing a server it has
+// stopped writing to.
+const HTRACE_CLIENT_CIRCUIT_PROBE_MS = "client.circuit.probe.ms"
+
+// The token which a client sends with its requests, or the empty string to
+// not send one.
+const HTRACE_CLIENT_AUTH_TOKEN = "client.auth.token"
+
+// The I/O timeout a client uses for HRPC, in milliseconds, or 0 for no
+// timeout.  Once the client starts sending a request, or the server starts
+// sending the response, the rest of it must arrive within this time.  The
+// time the server spends processing the request doesn't count.
+const HTRACE_CLIENT_HRPC_IO_TIMEOUT_MS = "client.hrpc.io.timeout.ms"
+
+// The number of WriteSpans requests a client may have in flight at once on
+// one HRPC connection, when a write has been split into several requests.
+// The client sends the next request without waiting for the answer to the
+// last one, up to this many, or as many as the server allows if that is
+// fewer.  Servers which predate pipelining are sent one request at a time,
+// client.write.parallelism at once, over separate connections.  1 turns
+// pipelining off.
+const HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT = "client.hrpc.max.in.flight"
+
+// Default values for HTrace configuration keys.  Every key should have an
+// entry here, since this map is also the registry of known keys used to
+// validate the configuration.  The type of each key is inferred from its
+// default value.
 var DEFAULTS = map[string]string{
 	HTRACE_WEB_ADDRESS:  fmt.Sprintf("0.0.0.0:%d", HTRACE_WEB_ADDRESS_DEFAULT_PORT),
 	HTRACE_HRPC_ADDRESS: fmt.Sprintf("0.0.0.0:%d", HTRACE_HRPC_ADDRESS_DEFAULT_PORT),
 	HTRACE_DATA_STORE_DIRECTORIES: PATH_SEP + "tmp" + PATH_SEP + "htrace1" +
 		PATH_LIST_SEP + PATH_SEP + "tmp" + PATH_SEP + "htrace2",
+	HTRACE_CONF_STRICT:                   "false",
+	HTRACE_UNIX_SOCKET_MODE:              "0660",
+	HTRACE_WEB_STATIC_MAX_AGE_SEC:        "600",
 	HTRACE_DATA_STORE_CLEAR:              "false",
 	HTRACE_DATA_STORE_SPAN_BUFFER_SIZE:   "100",
 	HTRACE_LOG_PATH:                      "",
 	HTRACE_LOG_LEVEL:                     "INFO",
+	HTRACE_LOG_MAX_FILE_SIZE:             "0",
+	HTRACE_LOG_MAX_ROTATED_FILES:         "5",
+	HTRACE_LOG_REOPEN_ON_SIGHUP:          "false",
+	HTRACE_LOG_ERRORS_TO_STDERR:          "false",
+	HTRACE_LOG_SUPPRESSION_PERIOD_MS:     "60000",
+	HTRACE_LOG_SUPPRESSION_MAX_KEYS:      "1000",
 	HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: fmt.Sprintf("%d", 45*1000),
+	HTRACE_DATASTORE_HEARTBEAT_MARKERS:   "false",
+	HTRACE_DATASTORE_QUARANTINE_POLICY:   "redirect",
+	HTRACE_DATASTORE_SEQUENCE_NUMBERS:    "false",
+	HTRACE_DATASTORE_BACKEND:             "leveldb",
+	HTRACE_DATASTORE_MEMORY_SHARDS:       "2",
+	HTRACE_DATASTORE_MEMORY_MAX_SPANS:    "1000000",
+	HTRACE_DATASTORE_PLACEMENT:           "modulo",
+	HTRACE_DATASTORE_PLACEMENT_MIGRATE:   "false",
+	HTRACE_DATASTORE_DAEMON_ID:           "",
+	HTRACE_DATASTORE_LOCK_STEAL:          "false",
+	HTRACE_ENCRYPTION_KEY_FILE:           "",
+	HTRACE_ENCRYPTION_PREVIOUS_KEY_FILE:  "",
+	HTRACE_AUDIT_LOG_MAX_ENTRIES:         "10000",
+	HTRACE_AUDIT_METADATA_MAX_BYTES:      "1024",
+	HTRACE_REJECTIONS_MAX_ENTRIES:        "0",
+	HTRACE_REJECTIONS_CAPTURE_PAYLOAD:    "false",
+	HTRACE_REJECTIONS_PAYLOAD_MAX_BYTES:  "4096",
+	HTRACE_INGEST_VALIDATE_TIMES:         "false",
+	HTRACE_INGEST_INFO_MAX_KEY_BYTES:     "256",
+	HTRACE_INGEST_INFO_MAX_KEYS:          "128",
+	HTRACE_INGEST_INFO_POLICY:            "strip",
+	HTRACE_INGEST_NEG_DURATION_POLICY:    "exclude",
+	HTRACE_INGEST_DECODE_CONCURRENCY:     "0",
+	HTRACE_INGEST_VALIDATE_CONCURRENCY:   "0",
+	HTRACE_WRITE_SPANS_MAX_SPANS:         "0",
+	HTRACE_WRITE_SPANS_MAX_BYTES:         "0",
+	HTRACE_ACTIVE_SPAN_MAX_AGE_MS:        "86400000",
+	HTRACE_SPAN_SOURCE_ADDR:              "false",
+	HTRACE_QUERY_SHARD_FILTER_ENABLED:    "false",
+	HTRACE_QUERY_DEFAULT_LIM:             "100",
+	HTRACE_QUERY_MAX_LIM:                 "10000",
+	HTRACE_QUERY_PLANNER_STATS:           "false",
+	HTRACE_QUERY_PLANNER_SAMPLE_MAX:      "1000",
+	HTRACE_REST_SLI_SATISFIED_MS:         "100",
+	HTRACE_REST_SLI_TOLERATING_MS:        "400",
+	HTRACE_READ_ONLY:                     "false",
+	HTRACE_INDEX_MIN_DURATION_MS:         "0",
+	HTRACE_INDEX_FULL_TRACERS:            "",
+	HTRACE_INDEX_MAX_PARENTS:             "1000",
+	HTRACE_INDEX_DESCRIPTION_MAX_BYTES:   "256",
+	HTRACE_SPAN_ERROR_INFO_KEYS:          "error,exception",
+	HTRACE_SPAN_ERROR_TIMELINE_PREFIXES:  "",
+	HTRACE_CHAOS_ENABLED:                 "false",
+	HTRACE_CHAOS_I_REALLY_MEAN_IT:        "false",
+	HTRACE_CHAOS_WRITE_DELAY_PERCENT:     "0",
+	HTRACE_CHAOS_WRITE_DELAY_MAX_MS:      "100",
+	HTRACE_CHAOS_REJECT_PERCENT:          "0",
+	HTRACE_CHAOS_HRPC_CLOSE_PERCENT:      "0",
+	HTRACE_CHAOS_HB_DELAY_PERCENT:        "0",
+	HTRACE_CHAOS_HB_DELAY_MAX_MS:         "1000",
+	HTRACE_QUOTA_RULES:                   "",
+	HTRACE_QUOTA_SAMPLE_PERCENT:          "1",
+	HTRACE_TRACER_ALIASES_ENABLED:        "true",
+	HTRACE_SLO_BUCKETS:                   "12",
+	HTRACE_SLO_GRACE_MS:                  "60000",
+	HTRACE_SLO_SCAN_MAX_SPANS:            "100000",
+	HTRACE_SLO_MAX_SLOS:                  "100",
+	HTRACE_TRACE_TAGS_REAP_ORPHANS:       "false",
+	HTRACE_TRACE_TAGS_MAX_PER_TRACE:      "100",
+	HTRACE_SAVED_SEARCHES_MAX:            "1000",
+	HTRACE_WRITE_GROUPS_MAX:              "10000",
+	HTRACE_WRITE_GROUPS_TTL_MS:           "3600000",
+	HTRACE_WRITE_GROUPS_MAX_SIZE:         "10000",
+	HTRACE_CANARY_SAMPLE_PERCENT:         "1",
+	HTRACE_CANARY_DELAY_MS:               "5000",
+	HTRACE_CANARY_MAX_RATE:               "100",
+	HTRACE_CANARY_QUEUE_SIZE:             "10000",
+	HTRACE_DESC_STATS_MAX_DESCRIPTIONS:   "100",
+	HTRACE_DESC_STATS_MAX_HOURS:          "168",
+	HTRACE_BUNDLE_MAX_SPANS:              "10000",
+	HTRACE_INTAKE_LOG_ENABLED:            "false",
+	HTRACE_INTAKE_LOG_MAX_BYTES:          fmt.Sprintf("%d", 64*1024*1024),
+	HTRACE_INTAKE_LOG_SYNC:               "always",
+	HTRACE_TRACER_RENAME_BATCH_SIZE:      "1000",
+	HTRACE_TRACER_RENAME_MAX_RATE:        "10000",
+	HTRACE_SCAN_JOB_BATCH_SIZE:           "1000",
+	HTRACE_SCAN_JOB_MAX_RATE:             "50000",
+	HTRACE_SPAN_CACHE_BYTES:              fmt.Sprintf("%d", 8*1024*1024),
+	HTRACE_CHILDREN_CACHE_BYTES:          fmt.Sprintf("%d", 2*1024*1024),
+	HTRACE_FIND_SPAN_DEADLINE_MS:         "500",
+	HTRACE_FIND_SPANS_CONCURRENCY:        "16",
+	HTRACE_WATERMARK_LATENESS_MS:         "60000",
+	HTRACE_WATERMARK_REJECT_LATE:         "false",
+	HTRACE_BLOOM_FILTER_ENABLED:          "false",
+	HTRACE_BLOOM_FILTER_BYTES:            fmt.Sprintf("%d", 4*1024*1024),
+	HTRACE_BLOOM_FILTER_FPP_PER_MILLION:  "10000",
 	HTRACE_METRICS_MAX_ADDR_ENTRIES:      "100000",
+	HTRACE_METRICS_RUNTIME_PERIOD_MS:     "10000",
+	HTRACE_METRICS_GC_PAUSE_BUF_SIZE:     "256",
+	HTRACE_METRICS_DESC_CARDINALITY:      "1000",
+	HTRACE_METRICS_MAX_TRACER_ENTRIES:    "10000",
+	HTRACE_METRICS_MAX_PRINCIPAL_ENTRIES: "1000",
+	HTRACE_METRICS_HISTORY_BUCKETS:       "24",
+	HTRACE_METRICS_HISTORY_BUCKET_MS:     "3600000",
 	HTRACE_SPAN_EXPIRY_MS:                "0",
+	HTRACE_SPAN_DOWNSAMPLE_AGE_MS:        "0",
+	HTRACE_SPAN_DOWNSAMPLE_PERCENT:       "10",
 	HTRACE_REAPER_HEARTBEAT_PERIOD_MS:    fmt.Sprintf("%d", 90*1000),
+	HTRACE_STARTUP_NOTIFICATION_ADDRESS:  "",
 	HTRACE_NUM_HRPC_HANDLERS:             "20",
 	HTRACE_HRPC_IO_TIMEOUT_MS:            "60000",
+	HTRACE_HRPC_IDLE_TIMEOUT_MS:          "120000",
+	HTRACE_HRPC_MAX_CONNECTIONS:          "1000",
+	HTRACE_HRPC_MAX_MESSAGE_BYTES:        "33554432",
 	HTRACE_LEVELDB_WRITE_BUFFER_SIZE:     "0",
 	HTRACE_LEVELDB_CACHE_SIZE:            fmt.Sprintf("%d", 100*1024*1024),
+	HTRACE_LEVELDB_CACHE_PER_SHARD:       "false",
+	HTRACE_LEVELDB_BLOOM_BITS_PER_KEY:    "0",
+	HTRACE_LEVELDB_SCAN_FILL_CACHE:       "true",
+	HTRACE_AUTH_MODE:                     "allow-all",
+	HTRACE_AUTH_TOKEN_FILE:               "",
+	HTRACE_AUTH_TOKEN_FILE_RECHECK_MS:    "1000",
+	HTRACE_REPLICATION_CURSOR_PATH:       "",
+	HTRACE_REPLICATION_BATCH_SIZE:        "1000",
+	HTRACE_CLIENT_FAILOVER_MAX_FAILURES:  "3",
+	HTRACE_CLIENT_FAILOVER_COOLDOWN_MS:   "10000",
+	HTRACE_CLIENT_WRITE_MAX_SPANS:        "0",
+	HTRACE_CLIENT_WRITE_MAX_BYTES:        "0",
+	HTRACE_CLIENT_WRITE_PARALLELISM:      "1",
+	HTRACE_CLIENT_WRITE_RETRIES:          "2",
+	HTRACE_CLIENT_PAUSE_MAX_WAIT_MS:      "60000",
+	HTRACE_CLIENT_WRITE_DEDUPE:           "false",
+	HTRACE_CLIENT_WRITE_SORT:             "false",
+	HTRACE_CLIENT_WRITE_VALIDATE:         "false",
+	HTRACE_CLIENT_WRITE_GROUP_BY_TRACE:   "false",
+	HTRACE_CLIENT_ADAPTIVE_ENABLED:       "false",
+	HTRACE_CLIENT_ADAPTIVE_MAX_SPANS:     "1000",
+	HTRACE_CLIENT_ADAPTIVE_MIN_SPANS:     "10",
+	HTRACE_CLIENT_ADAPTIVE_STEP_SPANS:    "50",
+	HTRACE_CLIENT_ADAPTIVE_SLOW_MS:       "1000",
+	HTRACE_CLIENT_ADAPTIVE_MAX_DELAY_MS:  "2000",
+	HTRACE_CLIENT_CIRCUIT_WINDOW:         "20",
+	HTRACE_CLIENT_CIRCUIT_FAILURE_PCT:    "50",
+	HTRACE_CLIENT_CIRCUIT_PROBE_MS:       "10000",
+	HTRACE_CLIENT_AUTH_TOKEN:             "",
+	HTRACE_CLIENT_HRPC_IO_TIMEOUT_MS:     "60000",
+	HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT:     "1",
+	HTRACE_UDP_ADDRESS:                   "",
+	HTRACE_UDP_MAX_DATAGRAM_BYTES:        "65507",
+	HTRACE_UDP_RECV_BUFFER_BYTES:         "0",
 }
 
 // Values to be used when creating test configurations
@@ -0,0 +1,214 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package conf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Configuration validation.
+//
+// The set of known configuration keys is the set of keys which have defaults.  The type of each
+// key is inferred from its default value: integers, booleans, and host:port addresses are checked;
+// anything else is treated as a free-form string.  Keys which are set but unknown produce warnings,
+// or errors if HTRACE_CONF_STRICT is set.  Values which can't be parsed as the type of their key
+// always produce errors, since otherwise we would silently fall back to the default.
+//
+
+type valueType int
+
+const (
+	STRING_VALUE valueType = iota
+	INT_VALUE
+	BOOL_VALUE
+	ADDRESS_VALUE
+)
+
+func (ty valueType) String() string {
+	switch ty {
+	case INT_VALUE:
+		return "an integer"
+	case BOOL_VALUE:
+		return "true or false"
+	case ADDRESS_VALUE:
+		return "a host:port or unix:// address, or a comma-separated list " +
+			"of them"
+	default:
+		return "a string"
+	}
+}
+
+// Infer the type of a configuration key from its default value.
+func inferValueType(def string) valueType {
+	if _, err := strconv.ParseInt(def, 10, 64); err == nil {
+		return INT_VALUE
+	}
+	if strings.EqualFold(def, "true") || strings.EqualFold(def, "false") {
+		return BOOL_VALUE
+	}
+	if checkAddress(def) == nil {
+		return ADDRESS_VALUE
+	}
+	return STRING_VALUE
+}
+
+func checkAddress(val string) error {
+	if IsUnixAddress(val) {
+		if !filepath.IsAbs(val[len(UNIX_ADDRESS_PREFIX):]) {
+			return errors.New("the socket path must be absolute")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(val)
+	if err != nil {
+		return err
+	}
+	_, err = strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid port '%s'", port))
+	}
+	return nil
+}
+
+// Check that a value can be parsed as the given type.
+func checkValue(ty valueType, val string) error {
+	switch ty {
+	case INT_VALUE:
+		_, err := strconv.ParseInt(val, 10, 64)
+		return err
+	case BOOL_VALUE:
+		_, err := strconv.ParseBool(val)
+		return err
+	case ADDRESS_VALUE:
+		// Clients accept a list of addresses.
+		for _, addr := range strings.Split(val, ",") {
+			err := checkAddress(strings.TrimSpace(addr))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Validate configuration settings against the known keys in the defaults
+// map.  Returns a list of warnings about unknown keys, or an error describing
+// the first invalid setting.
+func validateSettings(settings map[string]string,
+	defaults map[string]string, strict bool) ([]string, error) {
+	keys := make(sort.StringSlice, 0, len(settings))
+	for k := range settings {
+		keys = append(keys, k)
+	}
+	sort.Sort(keys)
+	warnings := make([]string, 0)
+	for i := range keys {
+		key := keys[i]
+		val := settings[key]
+		def, known := defaults[key]
+		if !known {
+			msg := fmt.Sprintf("Unknown configuration key '%s'.", key)
+			suggestion := suggestKey(key, defaults)
+			if suggestion != "" {
+				msg = msg + fmt.Sprintf("  Did you mean '%s'?", suggestion)
+			}
+			if strict {
+				return nil, errors.New(msg + fmt.Sprintf("  Set %s to false "+
+					"to allow unknown keys.", HTRACE_CONF_STRICT))
+			}
+			warnings = append(warnings, msg)
+			continue
+		}
+		ty := inferValueType(def)
+		err := checkValue(ty, val)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid value '%s' for "+
+				"configuration key '%s': expected %s.", val, key, ty.String()))
+		}
+	}
+	return warnings, nil
+}
+
+// Find the known key which the user most likely meant, or the empty string if
+// there is no plausible candidate.
+func suggestKey(key string, defaults map[string]string) string {
+	// Check whether the key is a known key with an extra prefix, such as
+	// "htrace.data.store.directories" for "data.store.directories".
+	best := ""
+	for k := range defaults {
+		if strings.HasSuffix(key, "."+k) && len(k) > len(best) {
+			best = k
+		}
+	}
+	if best != "" {
+		return best
+	}
+	// Otherwise, look for the key with the smallest edit distance.
+	maxDist := len(key) / 4
+	if maxDist < 2 {
+		maxDist = 2
+	}
+	bestDist := maxDist + 1
+	for k := range defaults {
+		dist := editDistance(key, k)
+		if dist < bestDist || (dist == bestDist && k < best) {
+			best = k
+			bestDist = dist
+		}
+	}
+	if bestDist > maxDist {
+		return ""
+	}
+	return best
+}
+
+// Compute the Levenshtein distance between two strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,150 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func buildValidated(argv []string, values map[string]string) (*Builder, error) {
+	bld := &Builder{Argv: argv, Values: values, Defaults: DEFAULTS,
+		AppPrefix: "htraced.", Validate: true}
+	_, err := bld.Build()
+	return bld, err
+}
+
+// Test that a valid configuration produces no warnings.
+func TestValidateValidConfiguration(t *testing.T) {
+	t.Parallel()
+	bld, err := buildValidated([]string{"-Dhtraced.web.address=127.0.0.1:9000",
+		"-Ddata.store.clear", "-Dspan.expiry.ms=1000"},
+		map[string]string{HTRACE_LOG_PATH: "/var/log/htraced.log"})
+	if err != nil {
+		t.Fatalf("Unexpected error validating configuration: %s\n", err.Error())
+	}
+	if len(bld.Warnings) != 0 {
+		t.Fatalf("Unexpected warnings: %v\n", bld.Warnings)
+	}
+}
+
+// Test that unknown keys produce warnings with suggestions.
+func TestValidateUnknownKeys(t *testing.T) {
+	t.Parallel()
+	bld, err := buildValidated([]string{
+		"-Dhtrace.data.store.directories=/data/1"},
+		map[string]string{"log.levle": "DEBUG", "completely.unrelated": "1"})
+	if err != nil {
+		t.Fatalf("Unexpected error validating configuration: %s\n", err.Error())
+	}
+	if len(bld.Warnings) != 3 {
+		t.Fatalf("Expected 3 warnings, but got %v\n", bld.Warnings)
+	}
+	expected := []string{
+		"Unknown configuration key 'completely.unrelated'.",
+		"Unknown configuration key 'htrace.data.store.directories'.  " +
+			"Did you mean 'data.store.directories'?",
+		"Unknown configuration key 'log.levle'.  Did you mean 'log.level'?",
+	}
+	for i := range expected {
+		if bld.Warnings[i] != expected[i] {
+			t.Fatalf("Expected warning %d to be %q, but got %q\n", i,
+				expected[i], bld.Warnings[i])
+		}
+	}
+}
+
+// Test that unknown keys are errors in strict mode.
+func TestValidateStrictMode(t *testing.T) {
+	t.Parallel()
+	_, err := buildValidated([]string{"-Dconf.strict",
+		"-Dweb.adress=127.0.0.1:9000"}, nil)
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown key in strict mode.\n")
+	}
+	if !strings.Contains(err.Error(), "'web.adress'") ||
+		!strings.Contains(err.Error(), "Did you mean 'web.address'?") {
+		t.Fatalf("Unexpected error message: %s\n", err.Error())
+	}
+}
+
+// Test that values of the wrong type are errors.
+func TestValidateValueTypes(t *testing.T) {
+	t.Parallel()
+	invalid := map[string]string{
+		HTRACE_SPAN_EXPIRY_MS:       "10s",
+		HTRACE_NUM_HRPC_HANDLERS:    "twenty",
+		HTRACE_DATA_STORE_CLEAR:     "yes",
+		HTRACE_WEB_ADDRESS:          "localhost",
+		HTRACE_HRPC_ADDRESS:         "localhost:http",
+		HTRACE_LOG_REOPEN_ON_SIGHUP: "",
+	}
+	for key, val := range invalid {
+		_, err := buildValidated([]string{"-D" + key + "=" + val}, nil)
+		if err == nil {
+			t.Fatalf("Expected an error for %s = '%s'\n", key, val)
+		}
+		if !strings.Contains(err.Error(), "'"+key+"'") ||
+			!strings.Contains(err.Error(), "'"+val+"'") {
+			t.Fatalf("Error message for %s = '%s' does not name the key "+
+				"and value: %s\n", key, val, err.Error())
+		}
+	}
+}
+
+// Test that every key in DEFAULTS has a default of the type we expect.
+func TestInferValueType(t *testing.T) {
+	t.Parallel()
+	expected := map[string]valueType{
+		HTRACE_WEB_ADDRESS:            ADDRESS_VALUE,
+		HTRACE_DATA_STORE_CLEAR:       BOOL_VALUE,
+		HTRACE_HRPC_IO_TIMEOUT_MS:     INT_VALUE,
+		HTRACE_LOG_LEVEL:              STRING_VALUE,
+		HTRACE_DATA_STORE_DIRECTORIES: STRING_VALUE,
+	}
+	for key, ty := range expected {
+		if inferValueType(DEFAULTS[key]) != ty {
+			t.Fatalf("Expected %s to be %s, but got %s\n", key, ty.String(),
+				inferValueType(DEFAULTS[key]).String())
+		}
+	}
+}
+
+func TestSuggestKey(t *testing.T) {
+	t.Parallel()
+	suggestions := map[string]string{
+		"htrace.data.store.directories": "data.store.directories",
+		"datastore.directories":         "data.store.directories",
+		"hrpc.io.timeout":               "hrpc.io.timeout.ms",
+		"log.levl":                      "log.level",
+		"foo":                           "",
+		"something.else.entirely":       "",
+	}
+	for key, expected := range suggestions {
+		suggestion := suggestKey(key, DEFAULTS)
+		if suggestion != expected {
+			t.Fatalf("Expected suggestion for %s to be '%s', but got '%s'\n",
+				key, expected, suggestion)
+		}
+	}
+	if editDistance("kitten", "sitting") != 3 {
+		t.Fatalf("Expected editDistance(kitten, sitting) to be 3\n")
+	}
+}
@@ -0,0 +1,138 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Active spans are spans which have started, but not finished.  A client
+// which reports spans in two phases first writes a span with End == 0 when it
+// starts, and then rewrites it with the real end time when it finishes.
+//
+// Each shard keeps an index of the active spans it holds, ordered by begin
+// time.  Since the active index entry is one of the span's secondary index
+// keys, it is added when a span with End == 0 is written, and removed when the
+// span is rewritten with an end time or deleted.  Spans which never finish are
+// dropped from the index (but not deleted) once they are older than
+// active.span.max.age.ms.
+
+// Get the active span index key for a span.
+func activeSpanKey(begin int64, sid common.SpanId) []byte {
+	return append(append([]byte{ACTIVE_SPAN_INDEX_PREFIX},
+		u64toSlice(s2u64(begin))...), sid.Val()...)
+}
+
+// Remove active span index entries which are older than the maximum age.
+func (shd *shard) pruneExpiredActiveSpans() {
+	maxAgeMs := shd.store.activeSpanMaxAgeMs
+	if maxAgeMs <= 0 {
+		return
+	}
+	cutoffMs := common.TimeToUnixMs(time.Now().UTC()) - maxAgeMs
+	numPruned := shd.pruneExpiredKeys(ACTIVE_SPAN_INDEX_PREFIX,
+		s2u64(cutoffMs), "active span")
+	if numPruned > 0 {
+		atomic.AddUint64(&shd.store.expiredActiveSpans, uint64(numPruned))
+	}
+}
+
+// An entry in the active span index.
+type activeSpanEntry struct {
+	// The active span index key.
+	key []byte
+
+	// The shard containing the entry.
+	shd *shard
+}
+
+type activeSpanEntries []activeSpanEntry
+
+func (entries activeSpanEntries) Len() int {
+	return len(entries)
+}
+
+func (entries activeSpanEntries) Less(i, j int) bool {
+	return bytes.Compare(entries[i].key, entries[j].key) < 0
+}
+
+func (entries activeSpanEntries) Swap(i, j int) {
+	entries[i], entries[j] = entries[j], entries[i]
+}
+
+// Find up to lim active index entries in this shard for spans which began at
+// or before endKey.
+func (shd *shard) findActiveSpanEntries(entries activeSpanEntries,
+	endKey []byte, lim int) activeSpanEntries {
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	for iter.Seek([]byte{ACTIVE_SPAN_INDEX_PREFIX}); iter.Valid() && lim > 0; iter.Next() {
+		key := iter.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		entries = append(entries, activeSpanEntry{
+			key: append([]byte(nil), key...),
+			shd: shd,
+		})
+		lim--
+	}
+	return entries
+}
+
+// Find up to lim spans which have not finished, and which began at least
+// olderThanMs milliseconds ago.  The spans are sorted by begin time, so the
+// longest-running spans come first.
+func (store *dataStore) FindActiveSpans(olderThanMs int64,
+	lim int) []*common.Span {
+	cutoffMs := common.TimeToUnixMs(time.Now().UTC()) - olderThanMs
+	endKey := append([]byte{ACTIVE_SPAN_INDEX_PREFIX},
+		u64toSlice(s2u64(cutoffMs)+1)...)
+	entries := make(activeSpanEntries, 0)
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if shd.acquire() {
+			entries = shd.findActiveSpanEntries(entries, endKey, lim)
+			shd.release()
+		}
+	}
+	sort.Sort(entries)
+	if len(entries) > lim {
+		entries = entries[0:lim]
+	}
+	spans := make([]*common.Span, 0, len(entries))
+	for i := range entries {
+		shd := entries[i].shd
+		if !shd.acquire() {
+			continue
+		}
+		span := shd.FindSpan(common.SpanId(entries[i].key[9:]))
+		shd.release()
+		if span == nil || span.End != 0 {
+			// The span was finished or deleted after we scanned the index.
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
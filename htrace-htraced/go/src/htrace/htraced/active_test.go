@@ -0,0 +1,135 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"testing"
+	"time"
+)
+
+func expectActiveSpans(t *testing.T, hcl *htrace.Client, olderThanMs int64,
+	lim int, expected ...*common.Span) {
+	spans, err := hcl.ActiveSpans(olderThanMs, lim)
+	if err != nil {
+		t.Fatalf("ActiveSpans(%d, %d) failed: %s\n", olderThanMs, lim,
+			err.Error())
+	}
+	if len(spans) != len(expected) {
+		t.Fatalf("ActiveSpans(%d, %d): expected %d spans, but got %s\n",
+			olderThanMs, lim, len(expected), asJson(spans))
+	}
+	for i := range spans {
+		if !spans[i].Id.Equal(expected[i].Id) {
+			t.Fatalf("ActiveSpans(%d, %d): expected span %d to be %s, but "+
+				"got %s\n", olderThanMs, lim, i, expected[i].Id.String(),
+				asJson(spans))
+		}
+	}
+}
+
+func TestActiveSpans(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestActiveSpans",
+		Cnf: map[string]string{
+			conf.HTRACE_ACTIVE_SPAN_MAX_AGE_MS: "420000",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	minuteMs := int64(60 * 1000)
+	newSpan := func(id string, beginMs int64, endMs int64) *common.Span {
+		return &common.Span{Id: common.TestId(id),
+			SpanData: common.SpanData{
+				Begin:       beginMs,
+				End:         endMs,
+				Description: id,
+				Parents:     []common.SpanId{},
+				TracerId:    "active",
+			}}
+	}
+	stuck := newSpan("00000000000000000000000000000001", nowMs-10*minuteMs, 0)
+	slow := newSpan("00000000000000000000000000000002", nowMs-8*minuteMs, 0)
+	stalled := newSpan("00000000000000000000000000000003", nowMs-6*minuteMs, 0)
+	recent := newSpan("00000000000000000000000000000004", nowMs-minuteMs, 0)
+	done := newSpan("00000000000000000000000000000005",
+		nowMs-9*minuteMs, nowMs-9*minuteMs+5)
+	err = hcl.WriteSpans([]*common.Span{recent, stalled, done, slow, stuck})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(5)
+
+	// Only unfinished spans are returned, longest-running first.
+	expectActiveSpans(t, hcl, 0, 10, stuck, slow, stalled, recent)
+	expectActiveSpans(t, hcl, 5*minuteMs, 10, stuck, slow, stalled)
+	expectActiveSpans(t, hcl, 5*minuteMs, 2, stuck, slow)
+	expectActiveSpans(t, hcl, 20*minuteMs, 10)
+
+	// Finishing a span removes it from the active set.
+	slow.End = nowMs
+	recent.End = nowMs
+	err = hcl.WriteSpans([]*common.Span{slow, recent})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(2)
+	expectActiveSpans(t, hcl, 0, 10, stuck, stalled)
+
+	// Spans older than the maximum age are dropped from the active set, but
+	// not deleted.
+	for shdIdx := range ht.Store.shards {
+		shd := ht.Store.shards[shdIdx]
+		if shd.acquire() {
+			shd.pruneExpiredActiveSpans()
+			shd.release()
+		}
+	}
+	expectActiveSpans(t, hcl, 0, 10, stalled)
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.ExpiredActiveSpans != 1 {
+		t.Fatalf("Expected 1 expired active span, but got %d\n",
+			stats.ExpiredActiveSpans)
+	}
+	span, err := hcl.FindSpan(stuck.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	common.ExpectSpansEqual(t, stuck, span)
+
+	_, err = hcl.ActiveSpans(-1, 10)
+	common.AssertErrContains(t, err, "Invalid olderThanMs")
+}
@@ -0,0 +1,244 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock which only moves when something sleeps.
+type testClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (clk *testClock) Now() time.Time {
+	clk.lock.Lock()
+	defer clk.lock.Unlock()
+	return clk.now
+}
+
+func (clk *testClock) Sleep(d time.Duration) {
+	clk.lock.Lock()
+	defer clk.lock.Unlock()
+	clk.now = clk.now.Add(d)
+}
+
+const (
+	INGEST_HEALTHY = iota
+	INGEST_SLOW
+	INGEST_FAILING
+)
+
+// Makes WriteSpans requests slow, by moving the test clock forward while they
+// are handled, or makes them fail.
+type slowIngestFaults struct {
+	noFaults
+	clock   *testClock
+	lock    sync.Mutex
+	mode    int
+	numReqs int
+}
+
+func (sif *slowIngestFaults) setMode(mode int) {
+	sif.lock.Lock()
+	defer sif.lock.Unlock()
+	sif.mode = mode
+}
+
+func (sif *slowIngestFaults) requests() int {
+	sif.lock.Lock()
+	defer sif.lock.Unlock()
+	return sif.numReqs
+}
+
+func (sif *slowIngestFaults) RejectWriteSpans() bool {
+	sif.lock.Lock()
+	defer sif.lock.Unlock()
+	sif.numReqs++
+	switch sif.mode {
+	case INGEST_SLOW:
+		sif.clock.Sleep(2 * time.Second)
+	case INGEST_FAILING:
+		return true
+	}
+	return false
+}
+
+func TestAdaptiveWrites(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestAdaptiveWrites",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	clock := &testClock{now: time.Unix(1000, 0)}
+	faults := &slowIngestFaults{clock: clock}
+	ht.Store.faults = faults
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf().Clone(
+		conf.HTRACE_CLIENT_ADAPTIVE_ENABLED, "true",
+		conf.HTRACE_CLIENT_ADAPTIVE_MAX_SPANS, "100",
+		conf.HTRACE_CLIENT_ADAPTIVE_MIN_SPANS, "5",
+		conf.HTRACE_CLIENT_ADAPTIVE_STEP_SPANS, "10",
+		conf.HTRACE_CLIENT_ADAPTIVE_SLOW_MS, "1000",
+		conf.HTRACE_CLIENT_ADAPTIVE_MAX_DELAY_MS, "1000",
+		conf.HTRACE_CLIENT_CIRCUIT_WINDOW, "4",
+		conf.HTRACE_CLIENT_CIRCUIT_FAILURE_PCT, "50",
+		conf.HTRACE_CLIENT_CIRCUIT_PROBE_MS, "5000",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "0"),
+		&htrace.TestHooks{HrpcDisabled: true, Clock: clock})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	var changesLock sync.Mutex
+	changes := make([]htrace.AdaptiveStateChange, 0)
+	hcl.SetAdaptiveStateCallback(func(change *htrace.AdaptiveStateChange) {
+		changesLock.Lock()
+		defer changesLock.Unlock()
+		changes = append(changes, *change)
+	})
+	takeChanges := func() []htrace.AdaptiveStateChange {
+		changesLock.Lock()
+		defer changesLock.Unlock()
+		ret := changes
+		changes = make([]htrace.AdaptiveStateChange, 0)
+		return ret
+	}
+	serverMetrics := func() *htrace.ServerMetrics {
+		mtx := hcl.Metrics()
+		if len(mtx.Servers) != 1 {
+			t.Fatalf("Expected metrics for one server, but got %s\n",
+				asJson(mtx.Servers))
+		}
+		for _, smtx := range mtx.Servers {
+			return smtx
+		}
+		return nil
+	}
+	allSpans := createRandomTestSpans(550)
+
+	// While the server is healthy, requests are as big as they may be.
+	res, err := hcl.WriteSpansDetailed(allSpans[0:300], nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 3 || len(takeChanges()) != 0 {
+		t.Fatalf("Expected 3 full-size requests, but got %s\n", asJson(res))
+	}
+
+	// Slow requests halve the request size, and add a wait between them.
+	faults.setMode(INGEST_SLOW)
+	res, err = hcl.WriteSpansDetailed(allSpans[300:450], nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 2 {
+		t.Fatalf("Expected requests of 100 and 50 spans, but got %s\n",
+			asJson(res))
+	}
+	smtx := serverMetrics()
+	if smtx.Circuit != htrace.CIRCUIT_CLOSED || smtx.BatchSpans != 25 ||
+		smtx.WriteDelayMs != 20 || smtx.BatchShrunk != 2 {
+		t.Fatalf("Unexpected server metrics %s\n", asJson(smtx))
+	}
+	if chg := takeChanges(); len(chg) != 2 || chg[0].BatchSpans != 50 ||
+		chg[1].OldBatchSpans != 50 || chg[1].BatchSpans != 25 {
+		t.Fatalf("Unexpected state changes %s\n", asJson(chg))
+	}
+
+	// When half the recent requests have failed, the circuit opens, and the
+	// rest of the write fails without being sent.
+	faults.setMode(INGEST_FAILING)
+	reqsBefore := faults.requests()
+	retrySpans := allSpans[450:550]
+	res, err = hcl.WriteSpansDetailed(retrySpans, nil)
+	werr, ok := err.(*htrace.WriteSpansError)
+	if !ok {
+		t.Fatalf("Expected a WriteSpansError, but got %v\n", err)
+	}
+	if werr.NumUndelivered() != 100 || res.NumChunks != 0 {
+		t.Fatalf("Expected every span to be undelivered, but got %s\n",
+			asJson(res))
+	}
+	if faults.requests()-reqsBefore != 2 {
+		t.Fatalf("Expected 2 requests before the circuit opened, but got "+
+			"%d\n", faults.requests()-reqsBefore)
+	}
+	smtx = serverMetrics()
+	if smtx.Circuit != htrace.CIRCUIT_OPEN || smtx.CircuitOpened != 1 ||
+		smtx.BatchSpans != 6 {
+		t.Fatalf("Unexpected server metrics %s\n", asJson(smtx))
+	}
+	chg := takeChanges()
+	if len(chg) != 2 || chg[1].OldCircuit != htrace.CIRCUIT_CLOSED ||
+		chg[1].Circuit != htrace.CIRCUIT_OPEN {
+		t.Fatalf("Unexpected state changes %s\n", asJson(chg))
+	}
+
+	// Until it is time to probe, writes fail without a request.
+	faults.setMode(INGEST_HEALTHY)
+	reqsBefore = faults.requests()
+	err = hcl.WriteSpans(retrySpans)
+	expectErrorCode(t, err, common.ERR_CIRCUIT_OPEN)
+	if err.(*common.HtraceError).RetryAfter() != 5*time.Second {
+		t.Fatalf("Expected to be told to retry in 5s, but got %s\n",
+			err.Error())
+	}
+	if faults.requests() != reqsBefore {
+		t.Fatalf("Expected no requests while the circuit is open.\n")
+	}
+
+	// A successful probe closes the circuit, and the requests grow again.
+	clock.Sleep(5 * time.Second)
+	res, err = hcl.WriteSpansDetailed(retrySpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 5 {
+		t.Fatalf("Expected requests of 5, 15, 25, 35, and 20 spans, but got "+
+			"%s\n", asJson(res))
+	}
+	chg = takeChanges()
+	if len(chg) < 2 || chg[0].Circuit != htrace.CIRCUIT_HALF_OPEN ||
+		chg[0].BatchSpans != 5 || chg[1].Circuit != htrace.CIRCUIT_CLOSED {
+		t.Fatalf("Unexpected state changes %s\n", asJson(chg))
+	}
+	smtx = serverMetrics()
+	if smtx.Circuit != htrace.CIRCUIT_CLOSED || smtx.BatchSpans != 55 {
+		t.Fatalf("Unexpected server metrics %s\n", asJson(smtx))
+	}
+
+	// Every span was delivered in the end.
+	ht.Store.WrittenSpans.Waits(int64(len(allSpans)))
+	for i := range allSpans {
+		if ht.Store.FindSpan(allSpans[i].Id) == nil {
+			t.Fatalf("Span %d was lost.\n", i)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gorilla/mux"
+	"htrace/common"
+	"htrace/common/schema"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// The REST API description.
+//
+// Every REST route is registered through restRoutes#handle, which takes a
+// routeDoc describing the route along with the handler.  /api/spec serves an
+// OpenAPI 3.0 description of the API, generated from those descriptions, and
+// from the Go types of the request and response bodies.  Since the spec comes
+// from the same calls which register the routes, it can't drift from what the
+// server actually serves.  The server refuses to start if a route is missing
+// its description; see restRoutes#validate.
+//
+// Every route may also return ERR_INTERNAL, and routes which need a
+// permission may return ERR_PERMISSION_DENIED, so the descriptions leave
+// those out, and the spec adds them.
+//
+
+const API_SPEC_OPENAPI_VERSION = "3.0.0"
+
+const API_SPEC_SCHEMA_PREFIX = "#/components/schemas/"
+
+// Describes a query or path parameter of a REST route.
+type paramDoc struct {
+	Name string
+
+	// "string", "integer", or "boolean".  Ignored if Json is set.
+	Type string
+
+	Desc string
+
+	// True if the parameter must be supplied.  Path parameters always must.
+	Required bool
+
+	// If non-empty, the values which the parameter may have.
+	Enum []string
+
+	// If non-nil, the parameter is a JSON document, which decodes to the
+	// type of this value.
+	Json interface{}
+}
+
+// Describes a REST route.
+type routeDoc struct {
+	Summary string
+
+	// A longer description, or the empty string.
+	Desc string
+
+	Params []paramDoc
+
+	// A value of the type of the request body, or nil if there is none.
+	Request interface{}
+
+	// Values of the types of the response body.  If there are several, the
+	// body is one of them.  If there are none, the response has no body.
+	Responses []interface{}
+
+	// The error codes which the route may return, besides ERR_INTERNAL and
+	// ERR_PERMISSION_DENIED.
+	Errors []common.ErrorCode
+
+	// The HTTP status of a successful response, or 0 for 200.
+	SuccessStatus int
+
+	// The endpoint class whose response time statistics the route's
+	// requests count towards.  One of the common.ENDPOINT_CLASS_*
+	// constants, or the empty string for an admin route.  See
+	// endpoint_sli.go.
+	Class string
+}
+
+type restRoute struct {
+	method string
+	path   string
+	doc    *routeDoc
+}
+
+// Registers the REST routes with the router, and keeps their descriptions.
+type restRoutes struct {
+	router *mux.Router
+	routes []*restRoute
+
+	// If non-nil, the response times of the routes' requests are recorded
+	// here.
+	slis *endpointSlis
+}
+
+func newRestRoutes(router *mux.Router) *restRoutes {
+	return &restRoutes{router: router}
+}
+
+// Register a handler for a method and path, along with its description.
+func (rr *restRoutes) handle(method string, path string, h http.Handler,
+	doc *routeDoc) {
+	if rr.slis != nil && doc != nil {
+		h = &sliHandler{sli: rr.slis.get(doc.Class), next: h}
+	}
+	rr.router.Handle(path, h).Methods(method)
+	rr.routes = append(rr.routes, &restRoute{
+		method: method,
+		path:   path,
+		doc:    doc,
+	})
+}
+
+var pathVarRegexp = regexp.MustCompile(`{([^}:]+)(:[^}]*)?}`)
+
+// Get the names of the variables in a path template.
+func pathVars(path string) []string {
+	matches := pathVarRegexp.FindAllStringSubmatch(path, -1)
+	vars := make([]string, len(matches))
+	for i := range matches {
+		vars[i] = matches[i][1]
+	}
+	return vars
+}
+
+// Check that every route has a description, and that the descriptions make
+// sense.
+func (rr *restRoutes) validate() error {
+	seen := make(map[string]bool)
+	for _, route := range rr.routes {
+		name := route.method + " " + route.path
+		if seen[name] {
+			return errors.New(fmt.Sprintf("The REST route %s was "+
+				"registered more than once.", name))
+		}
+		seen[name] = true
+		doc := route.doc
+		if doc == nil || doc.Summary == "" {
+			return errors.New(fmt.Sprintf("The REST route %s has no "+
+				"description.  Every route needs a routeDoc, so that it "+
+				"appears in /api/spec.", name))
+		}
+		params := make(map[string]*paramDoc)
+		for i := range doc.Params {
+			param := &doc.Params[i]
+			if params[param.Name] != nil {
+				return errors.New(fmt.Sprintf("The REST route %s describes "+
+					"parameter %s more than once.", name, param.Name))
+			}
+			params[param.Name] = param
+			if param.Json != nil {
+				continue
+			}
+			switch param.Type {
+			case "string", "integer", "boolean":
+			default:
+				return errors.New(fmt.Sprintf("The REST route %s gives "+
+					"parameter %s the invalid type '%s'.", name,
+					param.Name, param.Type))
+			}
+		}
+		for _, v := range pathVars(route.path) {
+			if params[v] == nil {
+				return errors.New(fmt.Sprintf("The REST route %s doesn't "+
+					"describe its path parameter %s.", name, v))
+			}
+		}
+	}
+	return nil
+}
+
+// An OpenAPI 3.0 document.  Only the parts which we use are here.
+type apiSpec struct {
+	OpenApi    string                              `json:"openapi"`
+	Info       apiInfo                             `json:"info"`
+	Paths      map[string]map[string]*apiOperation `json:"paths"`
+	Components apiComponents                       `json:"components"`
+}
+
+type apiInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type apiComponents struct {
+	Schemas map[string]*schema.Schema `json:"schemas"`
+}
+
+type apiOperation struct {
+	Summary     string                  `json:"summary"`
+	Description string                  `json:"description,omitempty"`
+	Parameters  []*apiParameter         `json:"parameters,omitempty"`
+	RequestBody *apiRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*apiResponse `json:"responses"`
+
+	// The error codes which the operation may return.
+	ErrorCodes []common.ErrorCode `json:"x-htraced-error-codes"`
+
+	// The permission which the operation needs, if auth.mode requires
+	// tokens.  Empty if the operation is open to everyone.
+	Permission common.Permission `json:"x-htraced-permission,omitempty"`
+}
+
+type apiParameter struct {
+	Name        string                   `json:"name"`
+	In          string                   `json:"in"`
+	Description string                   `json:"description,omitempty"`
+	Required    bool                     `json:"required"`
+	Schema      *schema.Schema           `json:"schema,omitempty"`
+	Content     map[string]*apiMediaType `json:"content,omitempty"`
+}
+
+type apiRequestBody struct {
+	Required bool                     `json:"required"`
+	Content  map[string]*apiMediaType `json:"content"`
+}
+
+type apiResponse struct {
+	Description string                   `json:"description"`
+	Content     map[string]*apiMediaType `json:"content,omitempty"`
+}
+
+type apiMediaType struct {
+	Schema *schema.Schema `json:"schema"`
+}
+
+// Create a schema generator which knows about the types whose JSON encoding
+// it can't work out from their Go types.
+func newApiSchemaGenerator() *schema.Generator {
+	gen := schema.NewGenerator(API_SPEC_SCHEMA_PREFIX)
+	gen.Override(reflect.TypeOf(common.SpanId{}), &schema.Schema{
+		Type:        "string",
+		Description: "A 128-bit span ID, as 32 hex digits.",
+	})
+	codes := common.ValidErrorCodes()
+	codeNames := make([]string, len(codes))
+	for i := range codes {
+		codeNames[i] = string(codes[i])
+	}
+	gen.Override(reflect.TypeOf(common.ErrorCode("")),
+		&schema.Schema{Type: "string", Enum: codeNames})
+	ops := common.ValidOps()
+	opNames := make([]string, len(ops))
+	for i := range ops {
+		opNames[i] = string(ops[i])
+	}
+	gen.Override(reflect.TypeOf(common.Op("")),
+		&schema.Schema{Type: "string", Enum: opNames})
+	fields := common.ValidFields()
+	fieldNames := make([]string, len(fields))
+	for i := range fields {
+		fieldNames[i] = string(fields[i])
+	}
+	gen.Override(reflect.TypeOf(common.Field("")),
+		&schema.Schema{Type: "string", Enum: fieldNames})
+	return gen
+}
+
+func jsonContent(sch *schema.Schema) map[string]*apiMediaType {
+	return map[string]*apiMediaType{
+		"application/json": &apiMediaType{Schema: sch},
+	}
+}
+
+// Generate the OpenAPI description of the routes.
+func (rr *restRoutes) spec(version string) *apiSpec {
+	if version == "" {
+		version = "unknown"
+	}
+	spec := &apiSpec{
+		OpenApi: API_SPEC_OPENAPI_VERSION,
+		Info: apiInfo{
+			Title:   "htraced REST API",
+			Version: version,
+		},
+		Paths: make(map[string]map[string]*apiOperation),
+	}
+	gen := newApiSchemaGenerator()
+	for _, route := range rr.routes {
+		ops := spec.Paths[route.path]
+		if ops == nil {
+			ops = make(map[string]*apiOperation)
+			spec.Paths[route.path] = ops
+		}
+		ops[strings.ToLower(route.method)] = rr.operation(gen, route)
+	}
+	spec.Components.Schemas = gen.Definitions()
+	return spec
+}
+
+func (rr *restRoutes) operation(gen *schema.Generator,
+	route *restRoute) *apiOperation {
+	doc := route.doc
+	op := &apiOperation{
+		Summary:     doc.Summary,
+		Description: doc.Desc,
+		Responses:   make(map[string]*apiResponse),
+		Permission:  routePermission(route),
+	}
+	isPathVar := make(map[string]bool)
+	for _, v := range pathVars(route.path) {
+		isPathVar[v] = true
+	}
+	for i := range doc.Params {
+		param := &doc.Params[i]
+		aparam := &apiParameter{
+			Name:        param.Name,
+			In:          "query",
+			Description: param.Desc,
+			Required:    param.Required,
+		}
+		if isPathVar[param.Name] {
+			aparam.In = "path"
+			aparam.Required = true
+		}
+		if param.Json != nil {
+			aparam.Content = jsonContent(gen.ValueOf(param.Json))
+		} else {
+			aparam.Schema = &schema.Schema{Type: param.Type, Enum: param.Enum}
+		}
+		op.Parameters = append(op.Parameters, aparam)
+	}
+	if doc.Request != nil {
+		op.RequestBody = &apiRequestBody{
+			Required: true,
+			Content:  jsonContent(gen.ValueOf(doc.Request)),
+		}
+	}
+	success := "200"
+	if doc.SuccessStatus != 0 {
+		success = strconv.Itoa(doc.SuccessStatus)
+	}
+	switch len(doc.Responses) {
+	case 0:
+		op.Responses[success] = &apiResponse{Description: "Success."}
+	case 1:
+		op.Responses[success] = &apiResponse{Description: "Success.",
+			Content: jsonContent(gen.ValueOf(doc.Responses[0]))}
+	default:
+		alts := make([]*schema.Schema, len(doc.Responses))
+		for i := range doc.Responses {
+			alts[i] = gen.ValueOf(doc.Responses[i])
+		}
+		op.Responses[success] = &apiResponse{Description: "Success.",
+			Content: jsonContent(&schema.Schema{OneOf: alts})}
+	}
+
+	// Group the error codes by their HTTP status.
+	codes := append([]common.ErrorCode{common.ERR_INTERNAL}, doc.Errors...)
+	if op.Permission != "" {
+		codes = append(codes, common.ERR_PERMISSION_DENIED)
+	}
+	seen := make(map[common.ErrorCode]bool)
+	names := make([]string, 0, len(codes))
+	for _, code := range codes {
+		if !seen[code] {
+			seen[code] = true
+			names = append(names, string(code))
+		}
+	}
+	sort.Strings(names)
+	byStatus := make(map[int][]string)
+	for _, name := range names {
+		code := common.ErrorCode(name)
+		op.ErrorCodes = append(op.ErrorCodes, code)
+		status := code.HttpStatus()
+		byStatus[status] = append(byStatus[status], name)
+	}
+	errSchema := gen.ValueOf(&common.ErrorResp{})
+	for status, names := range byStatus {
+		op.Responses[strconv.Itoa(status)] = &apiResponse{
+			Description: strings.Join(names, ", "),
+			Content:     jsonContent(errSchema),
+		}
+	}
+	return op
+}
+
+// Get the permission which a route needs.
+func routePermission(route *restRoute) common.Permission {
+	path := pathVarRegexp.ReplaceAllString(route.path, "0")
+	return restPermission(&http.Request{
+		Method: route.method,
+		URL:    &url.URL{Path: path},
+	})
+}
+
+// Serves the OpenAPI description of the REST API.
+type apiSpecHandler struct {
+	lg *common.Logger
+
+	// The JSON spec.  This is generated once all the routes are registered.
+	buf []byte
+}
+
+func (hand *apiSpecHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("apiSpecHandler\n")
+	w.Write(hand.buf)
+}
@@ -0,0 +1,178 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"htrace/common"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Check that every $ref in a decoded JSON document refers to a schema which
+// is in the spec.
+func checkRefs(t *testing.T, spec *apiSpec, val interface{}) {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			// "$ref" is also the name of a property of the schema of
+			// schemas.
+			if ref, ok := child.(string); ok && key == "$ref" {
+				name := strings.TrimPrefix(ref, API_SPEC_SCHEMA_PREFIX)
+				if spec.Components.Schemas[name] == nil {
+					t.Fatalf("The spec refers to the missing schema %s\n", ref)
+				}
+				continue
+			}
+			checkRefs(t, spec, child)
+		}
+	case []interface{}:
+		for i := range v {
+			checkRefs(t, spec, v[i])
+		}
+	}
+}
+
+func TestApiSpec(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestApiSpec",
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	status, _, body := fetchWithEtag(t,
+		"http://"+ht.Rsv.Addr().String()+"/api/spec", "")
+	if status != http.StatusOK {
+		t.Fatalf("Fetching /api/spec returned %d: %s\n", status, string(body))
+	}
+	var spec apiSpec
+	err = json.Unmarshal(body, &spec)
+	if err != nil {
+		t.Fatalf("Failed to parse the spec: %s\n", err.Error())
+	}
+	var raw interface{}
+	err = json.Unmarshal(body, &raw)
+	if err != nil {
+		t.Fatalf("Failed to parse the spec: %s\n", err.Error())
+	}
+	if spec.OpenApi != API_SPEC_OPENAPI_VERSION {
+		t.Fatalf("Unexpected OpenAPI version %s\n", spec.OpenApi)
+	}
+	checkRefs(t, &spec, raw)
+	for _, name := range []string{"Span", "Query", "ServerStats",
+		"ErrorResp"} {
+		if spec.Components.Schemas[name] == nil {
+			t.Fatalf("The spec has no schema for %s\n", name)
+		}
+	}
+
+	// Every route in the router is in the spec, and vice versa.  The
+	// catch-all routes for static files and unknown requests aren't part of
+	// the API.
+	inRouter := make(map[string]bool)
+	err = ht.Rsv.router.Walk(func(route *mux.Route, router *mux.Router,
+		ancestors []*mux.Route) error {
+		tmpl, err := route.GetPathTemplate()
+		if err != nil || tmpl == "/" {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			t.Fatalf("Route %s has no methods: %s\n", tmpl, err.Error())
+		}
+		for _, method := range methods {
+			name := strings.ToLower(method) + " " + tmpl
+			if spec.Paths[tmpl][strings.ToLower(method)] == nil {
+				t.Fatalf("The route %s is not in the spec.\n", name)
+			}
+			inRouter[name] = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk failed: %s\n", err.Error())
+	}
+	numOps := 0
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			numOps++
+			name := method + " " + path
+			if !inRouter[name] {
+				t.Fatalf("The spec has %s, which is not in the router.\n", name)
+			}
+			if op.Summary == "" {
+				t.Fatalf("%s has no summary.\n", name)
+			}
+			if op.Responses["200"] == nil && op.Responses["202"] == nil {
+				t.Fatalf("%s has no success response.\n", name)
+			}
+			if op.Responses["500"] == nil {
+				t.Fatalf("%s doesn't list ERR_INTERNAL.\n", name)
+			}
+		}
+	}
+	if numOps != len(inRouter) {
+		t.Fatalf("The spec has %d operations, but the router has %d "+
+			"routes.\n", numOps, len(inRouter))
+	}
+
+	// Spot check a few operations.
+	op := spec.Paths["/span/{id}"]["get"]
+	if op.Parameters[0].In != "path" || !op.Parameters[0].Required {
+		t.Fatalf("Unexpected span ID parameter %s\n", asJson(op.Parameters[0]))
+	}
+	if op.Responses["404"] == nil ||
+		op.Responses["404"].Description != string(common.ERR_SPAN_NOT_FOUND) {
+		t.Fatalf("Unexpected 404 response for /span/{id}: %s\n",
+			asJson(op.Responses["404"]))
+	}
+	if op.Permission != common.PERM_READ {
+		t.Fatalf("Expected /span/{id} to need %s, but got '%s'\n",
+			common.PERM_READ, op.Permission)
+	}
+	op = spec.Paths["/writeSpans"]["post"]
+	if op.RequestBody == nil || op.Permission != common.PERM_WRITE {
+		t.Fatalf("Unexpected /writeSpans operation %s\n", asJson(op))
+	}
+	if spec.Paths["/api/spec"]["get"].Permission != "" {
+		t.Fatalf("Expected /api/spec to be public.\n")
+	}
+}
+
+func TestApiSpecRejectsUndocumentedRoutes(t *testing.T) {
+	hand := &logErrorHandler{}
+	routes := newRestRoutes(mux.NewRouter())
+	routes.handle("GET", "/foo", hand, &routeDoc{Summary: "Foo."})
+	err := routes.validate()
+	if err != nil {
+		t.Fatalf("Unexpected validation error: %s\n", err.Error())
+	}
+	routes.handle("GET", "/bar/{id}", hand, &routeDoc{Summary: "Bar."})
+	common.AssertErrContains(t, routes.validate(),
+		"doesn't describe its path parameter id")
+
+	routes = newRestRoutes(mux.NewRouter())
+	routes.handle("GET", "/baz", hand, nil)
+	common.AssertErrContains(t, routes.validate(), "has no description")
+}
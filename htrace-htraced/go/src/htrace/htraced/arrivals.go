@@ -0,0 +1,205 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sort"
+	"time"
+)
+
+// Arrival times are assigned by the shard goroutine right before it writes a
+// batch of spans to leveldb.  Since each shard has only one writer, the
+// arrival times within a shard become visible in non-decreasing order.  Across
+// shards, we can only be sure that we have seen every span with an arrival
+// time older than the oldest batch which is currently being written.  The
+// arrival watermark is that time.
+
+// Mark the start of writing a batch of spans.  Returns the arrival time to use
+// for the batch.
+func (shd *shard) beginArrival() int64 {
+	shd.arrivalLock.Lock()
+	defer shd.arrivalLock.Unlock()
+	shd.writingArrivalMs = common.TimeToUnixMs(time.Now().UTC())
+	return shd.writingArrivalMs
+}
+
+// Mark the end of writing a batch of spans.
+func (shd *shard) endArrival() {
+	shd.arrivalLock.Lock()
+	defer shd.arrivalLock.Unlock()
+	shd.writingArrivalMs = 0
+}
+
+// Get the arrival watermark of this shard.  All spans with an arrival time
+// strictly less than the watermark are visible.
+func (shd *shard) arrivalWatermark() int64 {
+	shd.arrivalLock.Lock()
+	defer shd.arrivalLock.Unlock()
+	if shd.writingArrivalMs != 0 {
+		return shd.writingArrivalMs
+	}
+	return common.TimeToUnixMs(time.Now().UTC())
+}
+
+// Get the arrival watermark of the whole datastore.
+func (store *dataStore) arrivalWatermark() int64 {
+	var watermark int64
+	for shdIdx := range store.shards {
+		shdWatermark := store.shards[shdIdx].arrivalWatermark()
+		if shdIdx == 0 || shdWatermark < watermark {
+			watermark = shdWatermark
+		}
+	}
+	return watermark
+}
+
+// An entry in the arrival time index.
+type arrivalEntry struct {
+	// The arrival time index key.
+	key []byte
+
+	// The shard containing the entry.
+	shd *shard
+}
+
+type arrivalEntrySlice []arrivalEntry
+
+func (s arrivalEntrySlice) Len() int {
+	return len(s)
+}
+
+func (s arrivalEntrySlice) Less(i, j int) bool {
+	return bytes.Compare(s[i].key, s[j].key) < 0
+}
+
+func (s arrivalEntrySlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+func (ent *arrivalEntry) cursor() common.ArrivalCursor {
+	return common.ArrivalCursor{
+		ArrivalMs: int64(keyToU64(ent.key[1:9]) ^ 0x8000000000000000),
+		Id:        common.SpanId(ent.key[9:25]),
+	}
+}
+
+func keyToU64(b []byte) uint64 {
+	var ret uint64
+	for i := 0; i < 8; i++ {
+		ret = (ret << 8) | uint64(b[i])
+	}
+	return ret
+}
+
+// Read up to lim arrival time index entries which come at or after startKey
+// and before endKey.  If exclusive is true, an entry which exactly matches
+// startKey is skipped.
+func (shd *shard) findArrivals(startKey []byte, endKey []byte, exclusive bool,
+	lim int, entries []arrivalEntry) []arrivalEntry {
+	iter := shd.ldb.NewIterator(shd.store.bulkOpts)
+	defer iter.Close()
+	numFound := 0
+	for iter.Seek(startKey); iter.Valid() && numFound < lim; iter.Next() {
+		key := iter.Key()
+		if len(key) != 25 || bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if exclusive && bytes.Equal(key, startKey) {
+			continue
+		}
+		entries = append(entries, arrivalEntry{key: key, shd: shd})
+		numFound++
+	}
+	return entries
+}
+
+// Find up to lim arrival time index entries which come at or after startKey,
+// across all shards, in arrival order.  Entries for spans which arrived at or
+// after watermarkMs are not returned.  Otherwise, a span which was being
+// written while we searched could show up later with an arrival time before
+// the entries we return.
+func (store *dataStore) findArrivals(startKey []byte, exclusive bool, lim int,
+	watermarkMs int64) []arrivalEntry {
+	endKey := append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(watermarkMs))...)
+	entries := make([]arrivalEntry, 0, lim)
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if shd.acquire() {
+			entries = shd.findArrivals(startKey, endKey, exclusive, lim, entries)
+			shd.release()
+		}
+	}
+	sort.Sort(arrivalEntrySlice(entries))
+	if len(entries) > lim {
+		entries = entries[0:lim]
+	}
+	return entries
+}
+
+// Find up to lim spans which arrived at or after sinceMs, in arrival order.
+// Spans which arrived after the arrival watermark are not returned.
+// If cur is non-nil, we return the spans which come after the cursor instead.
+// Returns the spans and the cursor to use to continue the search.
+//
+// Spans can be deleted between the time we read the arrival time index and
+// the time we look up the span.  Those spans are skipped, so fewer than lim
+// spans may be returned even if there are more to come.  Callers should keep
+// going until the cursor stops advancing.
+func (store *dataStore) FindSpansChangedSince(sinceMs int64,
+	cur *common.ArrivalCursor, lim int) ([]*common.Span, common.ArrivalCursor) {
+	var startKey []byte
+	exclusive := false
+	var next common.ArrivalCursor
+	if cur != nil && cur.Id != nil {
+		startKey = append(append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+			u64toSlice(s2u64(cur.ArrivalMs))...), cur.Id.Val()...)
+		exclusive = true
+		next = *cur
+	} else {
+		startKey = append(append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+			u64toSlice(s2u64(sinceMs))...), common.INVALID_SPAN_ID.Val()...)
+	}
+	spans := make([]*common.Span, 0, lim)
+	if lim <= 0 {
+		return spans, next
+	}
+	entries := store.findArrivals(startKey, exclusive, lim,
+		store.arrivalWatermark())
+	for i := range entries {
+		next = entries[i].cursor()
+		var span *common.Span
+		if entries[i].shd.acquire() {
+			span = entries[i].shd.FindSpan(next.Id)
+			entries[i].shd.release()
+		}
+		if span == nil {
+			if store.lg.DebugEnabled() {
+				store.lg.Debugf("FindSpansChangedSince: span %s was deleted "+
+					"before we could read it.\n", next.Id.String())
+			}
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans, next
+}
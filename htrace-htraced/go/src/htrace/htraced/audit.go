@@ -0,0 +1,223 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"sync"
+)
+
+// The audit log records who wrote which spans.  Clients can attach metadata,
+// such as the user, job id, or client version, to each WriteSpans request.
+// Once the request has been ingested, we write an audit entry with the
+// metadata and the number of spans which were accepted and rejected.  The
+// metadata describes the request as a whole; it is never stored with the
+// spans themselves.
+//
+// Like heartbeat markers, audit entries live in their own key range in the
+// first shard.  They are keyed by sequence number.  Once there are more than
+// audit.log.max.entries entries, the oldest are deleted.  Since the metadata
+// in each entry is limited to audit.metadata.max.bytes, this bounds the size
+// of the log.
+
+// The transports which WriteSpans requests can arrive on.
+const AUDIT_TRANSPORT_REST = "rest"
+const AUDIT_TRANSPORT_HRPC = "hrpc"
+const AUDIT_TRANSPORT_ZIPKIN = "zipkin"
+
+// The maximum number of metadata keys to record in each audit entry.
+const AUDIT_METADATA_MAX_KEYS = 64
+
+type auditLog struct {
+	// Serializes writes to the log, and protects the fields below.
+	lock sync.Mutex
+
+	// The datastore which holds the log.
+	store *dataStore
+
+	// The maximum number of entries to keep, or 0 if the log is disabled.
+	maxEntries uint64
+
+	// The maximum number of bytes of metadata to record in each entry.
+	maxMetadataBytes int
+
+	// True once we have found the range of sequence numbers in the log.
+	loaded bool
+
+	// The sequence number of the oldest entry in the log.
+	firstSeq uint64
+
+	// The sequence number to give to the next entry.
+	nextSeq uint64
+}
+
+func newAuditLog(store *dataStore, cnf *conf.Config) *auditLog {
+	alog := &auditLog{
+		store:            store,
+		maxMetadataBytes: cnf.GetInt(conf.HTRACE_AUDIT_METADATA_MAX_BYTES),
+	}
+	maxEntries := cnf.GetInt64(conf.HTRACE_AUDIT_LOG_MAX_ENTRIES)
+	if maxEntries > 0 {
+		alog.maxEntries = uint64(maxEntries)
+	}
+	return alog
+}
+
+func auditKey(seq uint64) []byte {
+	return append([]byte{AUDIT_LOG_PREFIX}, u64toSlice(seq)...)
+}
+
+// Find the range of sequence numbers in the log.  The lock must be held, and
+// the shard must be acquired.
+func (alog *auditLog) load(shd *shard) {
+	prefix := []byte{AUDIT_LOG_PREFIX}
+	iter := shd.ldb.NewIterator(alog.store.readOpts)
+	defer iter.Close()
+	alog.firstSeq, alog.nextSeq = 1, 1
+	iter.Seek(prefix)
+	if !iter.Valid() || !bytes.HasPrefix(iter.Key(), prefix) {
+		return
+	}
+	alog.firstSeq = keyToU64(iter.Key()[1:9])
+	iter.Seek([]byte{AUDIT_LOG_PREFIX + 1})
+	if iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+	alog.nextSeq = keyToU64(iter.Key()[1:9]) + 1
+}
+
+// Add an entry to the audit log, and remove the oldest entries if the log is
+// full.  The entry's sequence number is filled in.
+func (alog *auditLog) record(entry *common.AuditEntry) {
+	if alog.maxEntries == 0 {
+		return
+	}
+	lg := alog.store.lg
+	shd := alog.store.shards[0]
+	if !shd.acquire() {
+		lg.Warnf("Unable to write an audit entry for a request from %s, "+
+			"because shard %s is quarantined.\n", entry.Addr, shd.path)
+		return
+	}
+	defer shd.release()
+	alog.lock.Lock()
+	defer alog.lock.Unlock()
+	if !alog.loaded {
+		alog.load(shd)
+		alog.loaded = true
+	}
+	entry.Seq = alog.nextSeq
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		lg.Errorf("Error marshalling audit entry: %s\n", err.Error())
+		return
+	}
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	batch.Put(auditKey(entry.Seq), buf)
+	firstSeq := alog.firstSeq
+	for entry.Seq+1-firstSeq > alog.maxEntries {
+		batch.Delete(auditKey(firstSeq))
+		firstSeq++
+	}
+	err = shd.ldb.Write(alog.store.writeOpts, batch)
+	if err != nil {
+		lg.Errorf("Error writing audit entry to shard %s: %s\n", shd.path,
+			err.Error())
+		shd.checkCorruption(err)
+		return
+	}
+	alog.firstSeq = firstSeq
+	alog.nextSeq++
+	lg.Tracef("Wrote audit entry %s\n", string(buf))
+}
+
+// Limit the metadata of a WriteSpans request to maxBytes bytes of keys and
+// values, and AUDIT_METADATA_MAX_KEYS keys.  Keys are taken in sorted order
+// until the limit is reached.  Returns the metadata to record, and true if
+// some of it was dropped.
+func limitAuditMetadata(metadata map[string]string,
+	maxBytes int) (map[string]string, bool) {
+	if len(metadata) == 0 {
+		return nil, false
+	}
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	limited := make(map[string]string)
+	numBytes := 0
+	for i := range keys {
+		val := metadata[keys[i]]
+		numBytes += len(keys[i]) + len(val)
+		if numBytes > maxBytes || i >= AUDIT_METADATA_MAX_KEYS {
+			if len(limited) == 0 {
+				limited = nil
+			}
+			return limited, true
+		}
+		limited[keys[i]] = val
+	}
+	return limited, false
+}
+
+// Find the most recent audit entries, newest first.  Returns at most lim
+// entries.
+func (store *dataStore) FindAuditEntries(lim int) ([]*common.AuditEntry,
+	error) {
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Shard %s, which holds the audit log, is quarantined.", shd.path)
+	}
+	defer shd.release()
+	entries := make([]*common.AuditEntry, 0)
+	prefix := []byte{AUDIT_LOG_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	iter.Seek([]byte{AUDIT_LOG_PREFIX + 1})
+	if iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+	for ; iter.Valid() && len(entries) < lim; iter.Prev() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		var entry common.AuditEntry
+		err := json.Unmarshal(iter.Value(), &entry)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error unmarshalling audit "+
+				"entry in shard %s: %s", shd.path, err.Error()))
+		}
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
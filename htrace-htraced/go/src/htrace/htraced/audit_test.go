@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"reflect"
+	"testing"
+)
+
+func expectAuditEntry(t *testing.T, entry *common.AuditEntry, transport string,
+	accepted int, rejected int, metadata map[string]string, truncated bool) {
+	if entry.Transport != transport || entry.NumSpans != accepted+rejected ||
+		entry.Accepted != accepted || entry.Rejected != rejected ||
+		entry.MetadataTruncated != truncated || entry.Addr == "" ||
+		entry.TimeMs == 0 {
+		t.Fatalf("Expected an audit entry with transport=%s, accepted=%d, "+
+			"rejected=%d, truncated=%t, but got %s\n", transport, accepted,
+			rejected, truncated, asJson(entry))
+	}
+	if !reflect.DeepEqual(metadata, entry.Metadata) {
+		t.Fatalf("Expected audit metadata %s, but got %s\n", asJson(metadata),
+			asJson(entry.Metadata))
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestAuditLog",
+		Cnf: map[string]string{
+			conf.HTRACE_AUDIT_LOG_MAX_ENTRIES:    "3",
+			conf.HTRACE_AUDIT_METADATA_MAX_BYTES: "40",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	restCl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client: %s", err.Error())
+	}
+	defer restCl.Close()
+	hrpcCl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create HRPC client: %s", err.Error())
+	}
+	defer hrpcCl.Close()
+
+	entries, err := restCl.GetAuditEntries(10)
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %s\n", err.Error())
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expected an empty audit log, but got %s\n", asJson(entries))
+	}
+
+	// Write a batch over REST, including a span with an invalid id.
+	spans := createRandomTestSpans(5)
+	invalid := &common.Span{Id: common.INVALID_SPAN_ID,
+		SpanData: common.SpanData{TracerId: "invalid"}}
+	restMeta := map[string]string{
+		"user":          "alice",
+		"jobId":         "job_1",
+		"clientVersion": "4.1.0",
+	}
+	err = restCl.WriteSpansWithMetadata([]*common.Span{spans[0], spans[1],
+		invalid}, restMeta)
+	if err != nil {
+		t.Fatalf("WriteSpansWithMetadata failed: %s\n", err.Error())
+	}
+
+	// Write a batch over HRPC.
+	hrpcMeta := map[string]string{"user": "bob", "jobId": "job_2"}
+	err = hrpcCl.WriteSpansWithMetadata([]*common.Span{spans[2], spans[3]},
+		hrpcMeta)
+	if err != nil {
+		t.Fatalf("WriteSpansWithMetadata failed: %s\n", err.Error())
+	}
+	entries, err = restCl.GetAuditEntries(10)
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %s\n", err.Error())
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 audit entries, but got %s\n", asJson(entries))
+	}
+	// Entries come back newest first.
+	expectAuditEntry(t, entries[0], AUDIT_TRANSPORT_HRPC, 2, 0, hrpcMeta, false)
+	expectAuditEntry(t, entries[1], AUDIT_TRANSPORT_REST, 2, 1, restMeta, false)
+	if entries[0].Seq <= entries[1].Seq {
+		t.Fatalf("Expected sequence numbers to increase, but got %s\n",
+			asJson(entries))
+	}
+
+	// The metadata is not stored with the spans.
+	ht.Store.WrittenSpans.Waits(4)
+	span := ht.Store.FindSpan(spans[0].Id)
+	if span == nil {
+		t.Fatalf("Failed to find span %s\n", spans[0].Id.String())
+	}
+	common.ExpectSpansEqual(t, spans[0], span)
+
+	// Metadata beyond 40 bytes is dropped, in key order.
+	err = hrpcCl.WriteSpansWithMetadata([]*common.Span{spans[4]},
+		map[string]string{
+			"a": "0123456789",
+			"b": "0123456789",
+			"c": "0123456789",
+			"d": "0123456789",
+		})
+	if err != nil {
+		t.Fatalf("WriteSpansWithMetadata failed: %s\n", err.Error())
+	}
+	// Batches without metadata are audited too.
+	err = restCl.WriteSpans([]*common.Span{})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+
+	// The log only holds 3 entries, so the oldest one is gone.
+	entries, err = hrpcCl.GetAuditEntries(10)
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %s\n", err.Error())
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 audit entries, but got %s\n", asJson(entries))
+	}
+	expectAuditEntry(t, entries[0], AUDIT_TRANSPORT_REST, 0, 0, nil, false)
+	expectAuditEntry(t, entries[1], AUDIT_TRANSPORT_HRPC, 1, 0,
+		map[string]string{
+			"a": "0123456789",
+			"b": "0123456789",
+			"c": "0123456789",
+		}, true)
+	expectAuditEntry(t, entries[2], AUDIT_TRANSPORT_HRPC, 2, 0, hrpcMeta, false)
+
+	// The lim parameter limits the number of entries returned.
+	entries, err = restCl.GetAuditEntries(1)
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %s\n", err.Error())
+	}
+	if len(entries) != 1 || entries[0].Transport != AUDIT_TRANSPORT_REST {
+		t.Fatalf("Expected only the newest audit entry, but got %s\n",
+			asJson(entries))
+	}
+}
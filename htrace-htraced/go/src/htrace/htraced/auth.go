@@ -0,0 +1,407 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Authorization.
+//
+// Each REST request, and each HRPC WriteSpans call, needs one of three
+// permissions: read for queries, span lookups and stats, write for writing
+// spans, tagging traces, and saving searches, and admin for requests which
+// change the server, or which reveal its configuration or the details of
+// what clients sent.  An Authenticator decides whether the token which came
+// with a request grants the permission it needs.  auth.mode picks the
+// Authenticator:
+//
+//   allow-all    Every request is allowed, with or without a token.  This is
+//                the default, and is how htraced behaved before it had
+//                authorization.
+//   token-file   auth.token.file lists the accepted tokens, the
+//                permissions which each of them grants, and optionally the
+//                name of the principal each one belongs to.  The file is read
+//                again when it changes.
+//
+// When a request is allowed, the Authenticator also says which principal
+// made it, if it knows.  Spans written by a known principal have it recorded
+// in their info map, under _principal, so that they can be found without
+// trusting their tracer IDs.  Tokens without a principal name belong to a
+// principal named after a hash of the token, so that the token itself never
+// appears in the spans.  With allow-all, there are no principals, and the key
+// is not set.
+//
+// REST requests send their token in an "Authorization: Bearer <token>"
+// header.  HRPC requests send it in the WriteSpansReq.  Denied requests get a
+// PERMISSION_DENIED error, which REST sends with HTTP status 403, and are
+// counted in the server stats by permission.
+//
+// A few requests need no permission: the server version, which clients read
+// before anything else to find out what the server supports, and the static
+// files of the web UI.  The UDP listener can't carry a token, so it can't be
+// used unless every request is allowed.
+//
+
+const AUTH_MODE_ALLOW_ALL = "allow-all"
+const AUTH_MODE_TOKEN_FILE = "token-file"
+
+// Decides whether requests are allowed.
+type Authenticator interface {
+	// Returns the principal the token belongs to, and nil if the token grants
+	// the permission, or an error saying why not.  The token is empty if the
+	// request didn't include one.  The principal is empty if the
+	// Authenticator doesn't know who made the request.
+	Authorize(token string, perm common.Permission) (string, error)
+}
+
+// An Authenticator which allows every request.
+type allowAllAuthenticator struct {
+}
+
+func (authn *allowAllAuthenticator) Authorize(token string,
+	perm common.Permission) (string, error) {
+	return "", nil
+}
+
+// What a token in a token file grants.
+type tokenGrant struct {
+	perms map[common.Permission]bool
+
+	// The principal the token belongs to.
+	principal string
+}
+
+// Get the name of the principal a token without a principal name belongs to.
+func defaultPrincipal(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token-" + hex.EncodeToString(sum[:6])
+}
+
+// An Authenticator which allows requests whose tokens are listed in a file.
+type tokenFileAuthenticator struct {
+	lg *common.Logger
+
+	// The path to the token file.
+	path string
+
+	// How often we check whether the file has changed.
+	recheck time.Duration
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// When we last checked whether the file has changed.
+	lastCheck time.Time
+
+	// The modification time and size of the file when we last read it.
+	modTime time.Time
+	size    int64
+
+	// Maps each token to what it grants.
+	tokens map[string]*tokenGrant
+}
+
+func newTokenFileAuthenticator(lg *common.Logger, path string,
+	recheck time.Duration) (*tokenFileAuthenticator, error) {
+	if path == "" {
+		return nil, errors.New(fmt.Sprintf("%s must be set when %s is '%s'.",
+			conf.HTRACE_AUTH_TOKEN_FILE, conf.HTRACE_AUTH_MODE,
+			AUTH_MODE_TOKEN_FILE))
+	}
+	authn := &tokenFileAuthenticator{
+		lg:      lg,
+		path:    path,
+		recheck: recheck,
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to stat token file %s: %s",
+			path, err.Error()))
+	}
+	authn.tokens, err = readTokenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	authn.lastCheck = time.Now()
+	authn.modTime = info.ModTime()
+	authn.size = info.Size()
+	lg.Infof("Read %d token(s) from %s\n", len(authn.tokens), path)
+	return authn, nil
+}
+
+// Read a token file.
+func readTokenFile(path string) (map[string]*tokenGrant, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to open token file %s: %s",
+			path, err.Error()))
+	}
+	defer file.Close()
+	tokens := make(map[string]*tokenGrant)
+	scanner := bufio.NewScanner(file)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, errors.New(fmt.Sprintf("%s:%d: expected a token "+
+				"followed by a comma-separated list of permissions, and "+
+				"optionally a principal name.", path, lineNo))
+		}
+		perms := make(map[common.Permission]bool)
+		for _, str := range strings.Split(fields[1], ",") {
+			perm := common.Permission(str)
+			if perm != common.PERM_READ && perm != common.PERM_WRITE &&
+				perm != common.PERM_ADMIN {
+				return nil, errors.New(fmt.Sprintf("%s:%d: unknown "+
+					"permission '%s'.  Expected one of %v.", path, lineNo,
+					str, common.ALL_PERMISSIONS))
+			}
+			perms[perm] = true
+		}
+		grant := &tokenGrant{perms: perms}
+		if len(fields) == 3 {
+			grant.principal = fields[2]
+		} else {
+			grant.principal = defaultPrincipal(fields[0])
+		}
+		tokens[fields[0]] = grant
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Error reading token file %s: %s",
+			path, err.Error()))
+	}
+	return tokens, nil
+}
+
+// Read the token file again if it has changed.  If it can't be read, we keep
+// using the tokens we already have.  The lock must be held.
+func (authn *tokenFileAuthenticator) maybeReload(now time.Time) {
+	if now.Sub(authn.lastCheck) < authn.recheck {
+		return
+	}
+	authn.lastCheck = now
+	info, err := os.Stat(authn.path)
+	if err != nil {
+		authn.lg.Errorf("Unable to stat token file %s: %s\n", authn.path,
+			err.Error())
+		return
+	}
+	if info.ModTime().Equal(authn.modTime) && info.Size() == authn.size {
+		return
+	}
+	tokens, err := readTokenFile(authn.path)
+	if err != nil {
+		authn.lg.Errorf("Unable to reload the token file: %s\n", err.Error())
+		return
+	}
+	authn.tokens = tokens
+	authn.modTime = info.ModTime()
+	authn.size = info.Size()
+	authn.lg.Infof("Reloaded %d token(s) from %s\n", len(tokens), authn.path)
+}
+
+func (authn *tokenFileAuthenticator) Authorize(token string,
+	perm common.Permission) (string, error) {
+	authn.lock.Lock()
+	defer authn.lock.Unlock()
+	authn.maybeReload(time.Now())
+	if token == "" {
+		return "", common.NewHtraceError(common.ERR_PERMISSION_DENIED, nil,
+			"This request needs the %s permission, but it has no token.",
+			perm)
+	}
+	grant, found := authn.tokens[token]
+	if !found {
+		return "", common.NewHtraceError(common.ERR_PERMISSION_DENIED, nil,
+			"This request needs the %s permission, but its token is not "+
+				"valid.", perm)
+	}
+	if !grant.perms[perm] {
+		return "", common.NewHtraceError(common.ERR_PERMISSION_DENIED, nil,
+			"This request needs the %s permission, which its token doesn't "+
+				"grant.", perm)
+	}
+	return grant.principal, nil
+}
+
+// Checks requests with an Authenticator, and counts the denials.
+type authorizer struct {
+	lg *common.Logger
+
+	authn Authenticator
+
+	msink *MetricsSink
+}
+
+func newAuthorizer(cnf *conf.Config, lg *common.Logger,
+	msink *MetricsSink) (*authorizer, error) {
+	az := &authorizer{
+		lg:    lg,
+		msink: msink,
+	}
+	mode := cnf.Get(conf.HTRACE_AUTH_MODE)
+	switch mode {
+	case AUTH_MODE_ALLOW_ALL:
+		az.authn = &allowAllAuthenticator{}
+	case AUTH_MODE_TOKEN_FILE:
+		if cnf.Get(conf.HTRACE_UDP_ADDRESS) != "" {
+			return nil, errors.New(fmt.Sprintf("%s can't be used when %s "+
+				"is '%s', since UDP datagrams can't carry a token.",
+				conf.HTRACE_UDP_ADDRESS, conf.HTRACE_AUTH_MODE, mode))
+		}
+		authn, err := newTokenFileAuthenticator(lg,
+			cnf.Get(conf.HTRACE_AUTH_TOKEN_FILE), time.Millisecond*
+				time.Duration(cnf.GetInt64(conf.HTRACE_AUTH_TOKEN_FILE_RECHECK_MS)))
+		if err != nil {
+			return nil, err
+		}
+		az.authn = authn
+	default:
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+			"Expected '%s' or '%s'.", conf.HTRACE_AUTH_MODE, mode,
+			AUTH_MODE_ALLOW_ALL, AUTH_MODE_TOKEN_FILE))
+	}
+	return az, nil
+}
+
+// Check whether a request from addr may do something which needs perm.
+// Returns the principal which made the request, or the empty string if it
+// isn't known.
+func (az *authorizer) check(addr string, token string,
+	perm common.Permission) (string, error) {
+	principal, err := az.authn.Authorize(token, perm)
+	if err == nil {
+		return principal, nil
+	}
+	switch perm {
+	case common.PERM_READ:
+		atomic.AddUint64(&az.msink.AuthReadDenials, 1)
+	case common.PERM_WRITE:
+		atomic.AddUint64(&az.msink.AuthWriteDenials, 1)
+	default:
+		atomic.AddUint64(&az.msink.AuthAdminDenials, 1)
+	}
+	if _, ok := err.(*common.HtraceError); !ok {
+		err = common.NewHtraceError(common.ERR_PERMISSION_DENIED, nil,
+			"%s", err.Error())
+	}
+	az.lg.Debugf("%s: denied a request which needs the %s permission: %s\n",
+		addr, perm, err.Error())
+	return "", err
+}
+
+// Get the permission which a REST request needs, or the empty string if it
+// needs none.
+func restPermission(req *http.Request) common.Permission {
+	path := req.URL.Path
+	switch {
+	case path == "/server/info" || path == "/server/version":
+		return ""
+	case req.Method == "POST" &&
+		(path == "/writeSpans" || path == ZIPKIN_SPANS_PATH):
+		return common.PERM_WRITE
+	case req.Method == "POST" && strings.HasPrefix(path, "/span/") &&
+		strings.HasSuffix(path, "/tags"):
+		// Tagging a trace is like writing spans: it changes the data, not
+		// the server.
+		return common.PERM_WRITE
+	case (req.Method == "POST" && path == "/searches") ||
+		(req.Method == "DELETE" && strings.HasPrefix(path, "/searches/")):
+		return common.PERM_WRITE
+	case req.Method != "GET":
+		return common.PERM_ADMIN
+	case path == "/server/conf" || path == "/server/debugInfo" ||
+		path == "/server/audit" || path == "/server/rejections":
+		return common.PERM_ADMIN
+	case strings.HasPrefix(path, "/server/") || path == "/query" ||
+		strings.HasPrefix(path, "/query/") ||
+		strings.HasPrefix(path, "/span/") ||
+		strings.HasPrefix(path, "/spans/") ||
+		strings.HasPrefix(path, "/tags/") || path == "/servicemap" ||
+		path == "/searches" || strings.HasPrefix(path, "/searches/"):
+		return common.PERM_READ
+	}
+	// Static files.
+	return ""
+}
+
+// Get the token from a REST request, or the empty string if there is none.
+func restToken(req *http.Request) string {
+	hdr := req.Header.Get("Authorization")
+	if !strings.HasPrefix(hdr, common.AUTH_HEADER_PREFIX) {
+		return ""
+	}
+	return strings.TrimSpace(hdr[len(common.AUTH_HEADER_PREFIX):])
+}
+
+// Checks the permissions of REST requests before passing them on.
+type authHandler struct {
+	lg   *common.Logger
+	az   *authorizer
+	next http.Handler
+}
+
+func (hand *authHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	perm := restPermission(req)
+	if perm != "" {
+		principal, err := hand.az.check(req.RemoteAddr, restToken(req), perm)
+		if err != nil {
+			setResponseHeaders(w.Header())
+			writeHtraceError(hand.lg, w, err)
+			return
+		}
+		if principal != "" {
+			req = req.WithContext(context.WithValue(req.Context(),
+				principalContextKey{}, principal))
+		}
+	}
+	hand.next.ServeHTTP(w, req)
+}
+
+// The key of the principal in the context of an authorized REST request.
+type principalContextKey struct{}
+
+// Get the principal which made a REST request, or the empty string if it
+// isn't known.
+func restPrincipal(req *http.Request) string {
+	principal, _ := req.Context().Value(principalContextKey{}).(string)
+	return principal
+}
@@ -0,0 +1,218 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTokenFile(t *testing.T, path string, contents string) {
+	err := ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s\n", path, err.Error())
+	}
+}
+
+// Check that an error is nil if allowed is true, or a PERMISSION_DENIED
+// error otherwise.
+func expectAllowed(t *testing.T, what string, err error, allowed bool) {
+	if allowed {
+		if err != nil {
+			t.Fatalf("%s: expected success, but got %s\n", what, err.Error())
+		}
+		return
+	}
+	if common.ErrorCodeOf(err) != common.ERR_PERMISSION_DENIED {
+		t.Fatalf("%s: expected a %s error, but got %v\n", what,
+			common.ERR_PERMISSION_DENIED, err)
+	}
+	herr := err.(*common.HtraceError)
+	if herr.HttpStatus != 0 && herr.HttpStatus != 403 {
+		t.Fatalf("%s: expected HTTP status 403, but got %d\n", what,
+			herr.HttpStatus)
+	}
+}
+
+func TestAuthTokenFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "TestAuthTokenFile")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "tokens")
+	writeTokenFile(t, tokenFile, "# Test tokens\n"+
+		"readtok read\n"+
+		"\n"+
+		"writetok write\n"+
+		"admintok read,write,admin\n")
+	htraceBld := &MiniHTracedBuilder{Name: "TestAuthTokenFile",
+		Cnf: map[string]string{
+			conf.HTRACE_AUTH_MODE:                  AUTH_MODE_TOKEN_FILE,
+			conf.HTRACE_AUTH_TOKEN_FILE:            tokenFile,
+			conf.HTRACE_AUTH_TOKEN_FILE_RECHECK_MS: "0",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	spans := createRandomTestSpans(2)
+	ingestSpans(ht, spans)
+
+	clients := make(map[string]*htrace.Client)
+	for _, token := range []string{"", "readtok", "writetok", "admintok",
+		"badtok"} {
+		for _, hrpc := range []bool{false, true} {
+			name := token
+			if hrpc {
+				name = token + "/hrpc"
+			}
+			hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+				conf.HTRACE_CLIENT_AUTH_TOKEN, token), &htrace.TestHooks{
+				HrpcDisabled: !hrpc,
+			})
+			if err != nil {
+				t.Fatalf("failed to create client: %s", err.Error())
+			}
+			defer hcl.Close()
+			clients[name] = hcl
+		}
+	}
+	type expected struct {
+		token string
+		read  bool
+		write bool
+		admin bool
+	}
+	matrix := []expected{
+		{token: "", read: false, write: false, admin: false},
+		{token: "badtok", read: false, write: false, admin: false},
+		{token: "readtok", read: true, write: false, admin: false},
+		{token: "writetok", read: false, write: true, admin: false},
+		{token: "admintok", read: true, write: true, admin: true},
+	}
+	for _, exp := range matrix {
+		hcl := clients[exp.token]
+		what := "token '" + exp.token + "'"
+
+		// Anyone can get the server version.
+		_, err = hcl.GetServerVersion()
+		expectAllowed(t, what+": GetServerVersion", err, true)
+
+		_, err = hcl.FindSpan(spans[0].Id)
+		expectAllowed(t, what+": FindSpan", err, exp.read)
+		_, err = hcl.Query(&common.Query{Lim: 10})
+		expectAllowed(t, what+": Query", err, exp.read)
+		_, err = hcl.GetServerStats()
+		expectAllowed(t, what+": GetServerStats", err, exp.read)
+		_, err = hcl.FindTracesByTag("incident", nil, 10)
+		expectAllowed(t, what+": FindTracesByTag", err, exp.read)
+		_, err = hcl.GetSavedSearches()
+		expectAllowed(t, what+": GetSavedSearches", err, exp.read)
+
+		err = hcl.WriteSpans(createRandomTestSpans(2))
+		expectAllowed(t, what+": REST WriteSpans", err, exp.write)
+		err = clients[exp.token+"/hrpc"].WriteSpans(createRandomTestSpans(2))
+		expectAllowed(t, what+": HRPC WriteSpans", err, exp.write)
+		_, err = hcl.TagTrace(spans[0].Id, &common.TagTraceReq{
+			Add: []string{"incident"}, Speculative: true})
+		expectAllowed(t, what+": TagTrace", err, exp.write)
+		_, err = hcl.SaveSearch(&common.SavedSearch{Name: "all",
+			Query: common.Query{Lim: 10}})
+		expectAllowed(t, what+": SaveSearch", err, exp.write)
+
+		_, err = hcl.GetServerConf()
+		expectAllowed(t, what+": GetServerConf", err, exp.admin)
+		err = hcl.ClearRejections()
+		expectAllowed(t, what+": ClearRejections", err, exp.admin)
+		_, err = hcl.GetAuditEntries(10)
+		expectAllowed(t, what+": GetAuditEntries", err, exp.admin)
+	}
+
+	// The allowed HRPC writes really went over HRPC.
+	admin := clients["admintok"]
+	entries, err := admin.GetAuditEntries(100)
+	if err != nil {
+		t.Fatalf("GetAuditEntries failed: %s\n", err.Error())
+	}
+	numHrpc := 0
+	for i := range entries {
+		if entries[i].Transport == "hrpc" {
+			numHrpc++
+		}
+	}
+	if numHrpc != 2 {
+		t.Fatalf("Expected 2 HRPC writes in the audit log, but got %s\n",
+			asJson(entries))
+	}
+
+	// Denials are counted by permission.
+	stats, err := admin.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.AuthReadDenials != 15 || stats.AuthWriteDenials != 12 ||
+		stats.AuthAdminDenials != 12 {
+		t.Fatalf("Unexpected denial counts: read=%d, write=%d, admin=%d\n",
+			stats.AuthReadDenials, stats.AuthWriteDenials,
+			stats.AuthAdminDenials)
+	}
+
+	// Changes to the token file are picked up without a restart.
+	writeTokenFile(t, tokenFile, "readtok read,write\n"+
+		"admintok read,write,admin\n")
+	err = clients["readtok/hrpc"].WriteSpans(createRandomTestSpans(2))
+	expectAllowed(t, "readtok after reload: HRPC WriteSpans", err, true)
+	_, err = clients["writetok"].FindSpan(spans[0].Id)
+	expectAllowed(t, "writetok after reload: FindSpan", err, false)
+
+	// A token file which can't be parsed is ignored.
+	writeTokenFile(t, tokenFile, "readtok fly\n")
+	_, err = clients["readtok"].FindSpan(spans[0].Id)
+	expectAllowed(t, "readtok after bad reload: FindSpan", err, true)
+}
+
+func TestAuthConfValidation(t *testing.T) {
+	for _, vals := range []map[string]string{
+		{conf.HTRACE_AUTH_MODE: "open-sesame"},
+		{conf.HTRACE_AUTH_MODE: AUTH_MODE_TOKEN_FILE},
+		{conf.HTRACE_AUTH_MODE: AUTH_MODE_TOKEN_FILE,
+			conf.HTRACE_AUTH_TOKEN_FILE: "/nonexistent/tokens"},
+	} {
+		htraceBld := &MiniHTracedBuilder{Name: "TestAuthConfValidation",
+			Cnf:      vals,
+			DataDirs: make([]string, 2),
+		}
+		ht, err := htraceBld.Build()
+		if err == nil {
+			ht.Close()
+			t.Fatalf("Expected building with %s to fail.\n", asJson(vals))
+		}
+	}
+}
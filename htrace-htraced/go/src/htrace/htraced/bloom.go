@@ -0,0 +1,384 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"htrace/common"
+	"htrace/conf"
+	"math"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+// Each shard can keep a bloom filter over the ids of the spans stored in it.
+// FindSpan consults the filter before looking a span up in a shard, so that
+// lookups of ids which aren't stored don't have to touch leveldb.  Spans
+// which are deleted stay in the filter, which is harmless: it just means the
+// shard gets probed.
+//
+// The filter is saved in the shard itself, under BLOOM_FILTER_KEY.  The shard
+// goroutine saves it on each heartbeat if it has changed, and when the shard
+// is closed.  The saved filter records whether it was saved by a clean close,
+// and the arrival time when it was saved.  A filter saved on a heartbeat may
+// be missing the spans written after that, so after an unclean shutdown, the
+// first heartbeat adds the spans in the arrival time index from that point on.
+// If there is no usable saved filter, the first heartbeat rebuilds the filter
+// by scanning the primary index.  Until then, the filter is not consulted.
+
+const BLOOM_FILTER_KEY = 'm'
+
+const BLOOM_FILTER_VERSION = 1
+
+// version, clean, numHashes, numBits, savedArrivalMs
+const BLOOM_FILTER_HEADER_LEN = 1 + 1 + 4 + 8 + 8
+
+// How far before the saved arrival time we start adding spans after an
+// unclean shutdown.  This covers small clock adjustments.
+const BLOOM_FILTER_CATCH_UP_SLACK_MS = 5 * 60 * 1000
+
+// The maximum number of hash functions we will use.
+const BLOOM_FILTER_MAX_HASHES = 30
+
+type spanBloom struct {
+	// The number of bits in the filter.  This is a multiple of 64.
+	numBits uint64
+
+	// The number of hash functions.
+	numHashes uint32
+
+	// The filter bits.  Accessed atomically, since spans are added by the
+	// shard goroutine while lookups read the filter.
+	words []uint64
+
+	// Non-zero if the filter contains every span in the shard, so that it
+	// can be consulted.  Accessed atomically.
+	ready int32
+
+	// Non-zero if spans were added since the filter was last saved.
+	// Accessed atomically.
+	dirty int32
+
+	// If the filter is not ready, and this is non-zero, the arrival time to
+	// start adding spans from.  Otherwise, the filter is rebuilt from
+	// scratch.  Only accessed from the shard goroutine.
+	catchUpFromMs int64
+
+	// The number of lookups which skipped the shard because of the filter.
+	// Accessed atomically.
+	skips uint64
+
+	// The number of lookups which the filter let through.  Accessed
+	// atomically.
+	probes uint64
+}
+
+// Compute the filter size and number of hash functions from the
+// configuration.  Returns 0 bits if bloom filters are disabled.
+func bloomParamsFromConf(cnf *conf.Config) (uint64, uint32) {
+	if !cnf.GetBool(conf.HTRACE_BLOOM_FILTER_ENABLED) {
+		return 0, 0
+	}
+	numBytes := cnf.GetInt64(conf.HTRACE_BLOOM_FILTER_BYTES)
+	if numBytes < 8 {
+		numBytes = 8
+	}
+	fpp := float64(cnf.GetInt64(conf.HTRACE_BLOOM_FILTER_FPP_PER_MILLION)) /
+		1000000.0
+	numHashes := uint32(1)
+	if fpp > 0 && fpp < 1 {
+		numHashes = uint32(math.Ceil(-math.Log2(fpp)))
+	}
+	if numHashes > BLOOM_FILTER_MAX_HASHES {
+		numHashes = BLOOM_FILTER_MAX_HASHES
+	}
+	return uint64(numBytes/8) * 64, numHashes
+}
+
+func newSpanBloom(numBits uint64, numHashes uint32) *spanBloom {
+	return &spanBloom{
+		numBits:   numBits,
+		numHashes: numHashes,
+		words:     make([]uint64, numBits/64),
+	}
+}
+
+// Compute the two base hashes of a span id.  The k hash functions are derived
+// from them by double hashing.
+func bloomHashes(sid common.SpanId) (uint64, uint64) {
+	h := fnv.New128a()
+	h.Write(sid.Val())
+	sum := h.Sum(nil)
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16])
+}
+
+func (bf *spanBloom) add(sid common.SpanId) {
+	h1, h2 := bloomHashes(sid)
+	for i := uint32(0); i < bf.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.numBits
+		word := &bf.words[bit/64]
+		mask := uint64(1) << (bit % 64)
+		for {
+			old := atomic.LoadUint64(word)
+			if old&mask != 0 ||
+				atomic.CompareAndSwapUint64(word, old, old|mask) {
+				break
+			}
+		}
+	}
+	atomic.StoreInt32(&bf.dirty, 1)
+}
+
+// Returns false if the span is definitely not in the filter.
+func (bf *spanBloom) mayContain(sid common.SpanId) bool {
+	h1, h2 := bloomHashes(sid)
+	for i := uint32(0); i < bf.numHashes; i++ {
+		bit := (h1 + uint64(i)*h2) % bf.numBits
+		if atomic.LoadUint64(&bf.words[bit/64])&(uint64(1)<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Estimate the false positive rate of the filter from the fraction of bits
+// which are set.
+func (bf *spanBloom) estimatedFpp() float64 {
+	var numSet int
+	for i := range bf.words {
+		numSet += bits.OnesCount64(atomic.LoadUint64(&bf.words[i]))
+	}
+	return math.Pow(float64(numSet)/float64(bf.numBits), float64(bf.numHashes))
+}
+
+func (bf *spanBloom) isReady() bool {
+	return atomic.LoadInt32(&bf.ready) != 0
+}
+
+// Serialize the filter.
+func (bf *spanBloom) encode(clean bool, savedArrivalMs int64) []byte {
+	buf := make([]byte, BLOOM_FILTER_HEADER_LEN+8*len(bf.words))
+	buf[0] = BLOOM_FILTER_VERSION
+	if clean {
+		buf[1] = 1
+	}
+	binary.BigEndian.PutUint32(buf[2:6], bf.numHashes)
+	binary.BigEndian.PutUint64(buf[6:14], bf.numBits)
+	binary.BigEndian.PutUint64(buf[14:22], uint64(savedArrivalMs))
+	for i := range bf.words {
+		off := BLOOM_FILTER_HEADER_LEN + 8*i
+		binary.BigEndian.PutUint64(buf[off:off+8],
+			atomic.LoadUint64(&bf.words[i]))
+	}
+	return buf
+}
+
+// Deserialize a filter.  Returns the filter, whether it was saved by a clean
+// close, and the arrival time when it was saved.
+func decodeSpanBloom(buf []byte) (*spanBloom, bool, int64, error) {
+	if len(buf) < BLOOM_FILTER_HEADER_LEN {
+		return nil, false, 0, errors.New(fmt.Sprintf("The saved bloom "+
+			"filter is only %d bytes long.", len(buf)))
+	}
+	if buf[0] != BLOOM_FILTER_VERSION {
+		return nil, false, 0, errors.New(fmt.Sprintf("The saved bloom "+
+			"filter has unknown version %d.", buf[0]))
+	}
+	numHashes := binary.BigEndian.Uint32(buf[2:6])
+	numBits := binary.BigEndian.Uint64(buf[6:14])
+	if numBits == 0 || numBits%64 != 0 ||
+		uint64(len(buf)-BLOOM_FILTER_HEADER_LEN) != numBits/8 {
+		return nil, false, 0, errors.New(fmt.Sprintf("The saved bloom "+
+			"filter has %d bits, but %d bytes of data.", numBits,
+			len(buf)-BLOOM_FILTER_HEADER_LEN))
+	}
+	bf := newSpanBloom(numBits, numHashes)
+	for i := range bf.words {
+		off := BLOOM_FILTER_HEADER_LEN + 8*i
+		bf.words[i] = binary.BigEndian.Uint64(buf[off : off+8])
+	}
+	return bf, buf[1] != 0, int64(binary.BigEndian.Uint64(buf[14:22])), nil
+}
+
+// Load the shard's saved bloom filter, or set up a new one.  This is called
+// when the shard is opened, after loadSpanCount.
+func (shd *shard) loadBloom() {
+	store := shd.store
+	lg := store.lg
+	shd.bloom = nil
+	if store.bloomBits == 0 {
+		return
+	}
+	buf, err := shd.ldb.Get(store.readOpts, []byte{BLOOM_FILTER_KEY})
+	if err != nil {
+		lg.Warnf("Error reading the bloom filter of shard %s: %s\n",
+			shd.path, err.Error())
+		buf = nil
+	}
+	var bf *spanBloom
+	if buf != nil {
+		saved, clean, savedArrivalMs, err := decodeSpanBloom(buf)
+		if err != nil {
+			lg.Warnf("Discarding the bloom filter of shard %s: %s\n",
+				shd.path, err.Error())
+		} else if saved.numBits != store.bloomBits ||
+			saved.numHashes != store.bloomHashes {
+			lg.Infof("The bloom filter of shard %s has a different size "+
+				"than configured.  It will be rebuilt.\n", shd.path)
+		} else {
+			bf = saved
+			if clean {
+				bf.ready = 1
+			} else {
+				bf.catchUpFromMs = savedArrivalMs -
+					BLOOM_FILTER_CATCH_UP_SLACK_MS
+				if bf.catchUpFromMs == 0 {
+					bf.catchUpFromMs = -1
+				}
+				savedAt := common.UnixMsToTime(savedArrivalMs)
+				lg.Infof("The bloom filter of shard %s was not saved "+
+					"cleanly.  Spans which arrived after %s will be "+
+					"added to it.\n", shd.path, savedAt.Format(time.RFC3339))
+			}
+		}
+	}
+	if bf == nil {
+		bf = newSpanBloom(store.bloomBits, store.bloomHashes)
+		if buf == nil && atomic.LoadUint64(&shd.numSpans) == 0 &&
+			atomic.LoadInt32(&shd.recountPending) == 0 {
+			// A new shard doesn't need to be scanned.
+			bf.ready = 1
+		} else {
+			lg.Infof("The bloom filter of shard %s will be rebuilt.\n",
+				shd.path)
+		}
+	}
+	shd.bloom = bf
+	if bf.isReady() && !store.readOnly {
+		// If we crash from now on, the filter can't be trusted as it is.
+		shd.saveBloom(false)
+	}
+}
+
+// Save the bloom filter in the shard.  Filters which are not ready are not
+// saved, since they are missing spans.
+func (shd *shard) saveBloom(clean bool) {
+	bf := shd.bloom
+	if bf == nil || !bf.isReady() ||
+		shd.store.backend == DATASTORE_BACKEND_MEMORY {
+		return
+	}
+	atomic.StoreInt32(&bf.dirty, 0)
+	buf := bf.encode(clean, common.TimeToUnixMs(time.Now().UTC()))
+	err := shd.ldb.Put(shd.store.writeOpts, []byte{BLOOM_FILTER_KEY}, buf)
+	if err != nil {
+		shd.store.lg.Errorf("Error saving the bloom filter of shard %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+	}
+}
+
+// Finish loading the bloom filter if necessary, and save it if it has
+// changed.  This is called from the shard goroutine, so no spans can be
+// written concurrently.
+func (shd *shard) updateBloom() {
+	bf := shd.bloom
+	if bf == nil {
+		return
+	}
+	if !bf.isReady() {
+		var prefix, start []byte
+		if bf.catchUpFromMs != 0 {
+			prefix = []byte{ARRIVAL_TIME_INDEX_PREFIX}
+			start = append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+				u64toSlice(s2u64(bf.catchUpFromMs))...)
+		} else {
+			prefix = []byte{SPAN_ID_INDEX_PREFIX}
+			start = prefix
+		}
+		numAdded, err := shd.addSpansToBloom(prefix, start)
+		if err != nil {
+			shd.store.lg.Errorf("Error loading the bloom filter of shard "+
+				"%s: %s\n", shd.path, err.Error())
+			shd.checkCorruption(err)
+			return
+		}
+		shd.store.lg.Infof("Added %d span(s) to the bloom filter of shard "+
+			"%s.\n", numAdded, shd.path)
+		atomic.StoreInt32(&bf.ready, 1)
+		atomic.StoreInt32(&bf.dirty, 1)
+	}
+	if atomic.LoadInt32(&bf.dirty) != 0 {
+		shd.saveBloom(false)
+	}
+}
+
+// Add the span ids at the end of the index keys with the given prefix to the
+// bloom filter, starting at the given key.
+func (shd *shard) addSpansToBloom(prefix []byte, start []byte) (int, error) {
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	numAdded := 0
+	for iter.Seek(start); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if len(key) < 17 {
+			continue
+		}
+		shd.bloom.add(common.SpanId(key[len(key)-16:]))
+		numAdded++
+	}
+	return numAdded, iter.GetError()
+}
+
+// Returns false if the shard definitely doesn't contain the span.  The shard
+// must be held.
+func (shd *shard) mayContainSpan(sid common.SpanId) bool {
+	bf := shd.bloom
+	if bf == nil || !bf.isReady() {
+		return true
+	}
+	if !bf.mayContain(sid) {
+		atomic.AddUint64(&bf.skips, 1)
+		return false
+	}
+	atomic.AddUint64(&bf.probes, 1)
+	return true
+}
+
+// Fill in the bloom filter statistics of a shard.  The shard must be held.
+func (shd *shard) bloomStats(stats *common.StorageDirectoryStats) {
+	bf := shd.bloom
+	if bf == nil {
+		return
+	}
+	stats.BloomFilterBytes = bf.numBits / 8
+	stats.BloomFilterReady = bf.isReady()
+	stats.BloomFilterFpp = bf.estimatedFpp()
+	stats.BloomFilterSkips = atomic.LoadUint64(&bf.skips)
+	stats.BloomFilterProbes = atomic.LoadUint64(&bf.probes)
+}
@@ -0,0 +1,203 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBloomFilter(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testBloomFilter(t, backend)
+	}
+}
+
+func buildBloomHTraced(t *testing.T, name string, backend string,
+	dataDirs []string) *MiniHTraced {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "300000",
+			conf.HTRACE_BLOOM_FILTER_ENABLED:          "true",
+			conf.HTRACE_BLOOM_FILTER_BYTES:            "4096",
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	return ht
+}
+
+// Get the total number of lookups which the bloom filters skipped and let
+// through.
+func getBloomCounts(ht *MiniHTraced) (uint64, uint64) {
+	var skips, probes uint64
+	for _, dir := range ht.Store.ServerStats().Dirs {
+		skips += dir.BloomFilterSkips
+		probes += dir.BloomFilterProbes
+	}
+	return skips, probes
+}
+
+func expectBloomReady(t *testing.T, ht *MiniHTraced, ready bool) {
+	for _, dir := range ht.Store.ServerStats().Dirs {
+		if dir.BloomFilterBytes != 4096 {
+			t.Fatalf("Expected a 4096-byte bloom filter for shard %s, but "+
+				"got %d bytes\n", dir.Path, dir.BloomFilterBytes)
+		}
+		if dir.BloomFilterReady != ready {
+			t.Fatalf("Expected BloomFilterReady = %t for shard %s\n",
+				ready, dir.Path)
+		}
+	}
+}
+
+// Check that all the spans can be found, and that looking up spans which are
+// absent hardly ever touches a shard.
+func expectBloomLookups(t *testing.T, ht *MiniHTraced, spans []*common.Span) {
+	for i := range spans {
+		if ht.Store.FindSpan(spans[i].Id) == nil {
+			t.Fatalf("Failed to find span %s\n", spans[i].Id.String())
+		}
+	}
+	const NUM_ABSENT = 1000
+	rnd := rand.New(rand.NewSource(1896))
+	skipsBefore, probesBefore := getBloomCounts(ht)
+	for i := 0; i < NUM_ABSENT; i++ {
+		sid := test.NewRandomSpan(rnd, nil).Id
+		if ht.Store.FindSpan(sid) != nil {
+			t.Fatalf("Unexpectedly found span %s\n", sid.String())
+		}
+	}
+	skipsAfter, probesAfter := getBloomCounts(ht)
+	skips := skipsAfter - skipsBefore
+	probes := probesAfter - probesBefore
+	if skips+probes != NUM_ABSENT {
+		t.Fatalf("Expected %d lookups to consult the bloom filters, but "+
+			"%d skipped and %d probed\n", NUM_ABSENT, skips, probes)
+	}
+	if probes > 5 {
+		t.Fatalf("Expected lookups of absent spans to skip the shards, but "+
+			"%d of %d probed a shard\n", probes, NUM_ABSENT)
+	}
+}
+
+func testBloomFilter(t *testing.T, backend string) {
+	dataDirs := make([]string, 4)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(),
+			fmt.Sprintf("TestBloomFilter%s%d", backend, i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+	ht := buildBloomHTraced(t, "TestBloomFilter", backend, dataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+	}()
+
+	// A new shard's bloom filter is ready right away.
+	expectBloomReady(t, ht, true)
+	allSpans := createRandomTestSpans(150)
+	ingestSpans(ht, allSpans[0:100])
+	expectBloomLookups(t, ht, allSpans[0:100])
+
+	// The filters are saved on a clean shutdown, and used right away after
+	// a restart.
+	ht.Close()
+	ht = buildBloomHTraced(t, "TestBloomFilter2", backend, dataDirs)
+	expectBloomReady(t, ht, true)
+	expectBloomLookups(t, ht, allSpans[0:100])
+
+	// Simulate an unclean shutdown after a heartbeat.  The saved filters
+	// are missing the spans written after the heartbeat.  One shard has no
+	// saved filter at all.
+	saved := make(map[string][]byte)
+	for _, shd := range ht.Store.shards {
+		saved[shd.path] = shd.bloom.encode(false,
+			common.TimeToUnixMs(time.Now().UTC()))
+	}
+	ingestSpans(ht, allSpans[100:150])
+	hcnf := ht.Cnf.Clone()
+	ht.Close()
+	ht = nil
+	dld := NewDataStoreLoader(hcnf)
+	dld.LoadShards()
+	for i, shd := range dld.shards {
+		if i == 0 {
+			batch := shd.ldb.NewWriteBatch()
+			batch.Delete([]byte{BLOOM_FILTER_KEY})
+			err := shd.ldb.Write(dld.writeOpts, batch)
+			batch.Close()
+			if err != nil {
+				dld.Close()
+				t.Fatalf("failed to delete the bloom filter of shard %s: %s\n",
+					shd.path, err.Error())
+			}
+			continue
+		}
+		err := shd.ldb.Put(dld.writeOpts, []byte{BLOOM_FILTER_KEY},
+			saved[shd.path])
+		if err != nil {
+			dld.Close()
+			t.Fatalf("failed to write the bloom filter of shard %s: %s\n",
+				shd.path, err.Error())
+		}
+	}
+	dld.Close()
+
+	// The filters aren't used until the next heartbeat brings them up to
+	// date, so every span can still be found.
+	ht = buildBloomHTraced(t, "TestBloomFilter3", backend, dataDirs)
+	expectBloomReady(t, ht, false)
+	for i := range allSpans {
+		if ht.Store.FindSpan(allSpans[i].Id) == nil {
+			t.Fatalf("Failed to find span %s\n", allSpans[i].Id.String())
+		}
+	}
+	for i := range ht.Store.shards {
+		ht.Store.shards[i].heartbeats <- nil
+	}
+	common.WaitFor(time.Minute*1, time.Millisecond*10, func() bool {
+		for _, dir := range ht.Store.ServerStats().Dirs {
+			if !dir.BloomFilterReady {
+				return false
+			}
+		}
+		return true
+	})
+	expectBloomLookups(t, ht, allSpans)
+}
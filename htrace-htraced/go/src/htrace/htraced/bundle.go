@@ -0,0 +1,129 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"sort"
+	"time"
+)
+
+// A trace bundle holds the root of a span's trace and all of the root's
+// descendants.  The root is found the same way as when grouping query results
+// by trace, so a broken or cyclic parent chain just makes the bundle start at
+// the highest ancestor we could find.  The ancestors of the requested span are
+// always included, even when the bundle is truncated, so that the span the
+// user asked about is never left out.
+
+// Assemble the trace bundle for the given span.  At most lim spans will be
+// included.  Returns nil if the span could not be found.
+func (store *dataStore) AssembleTraceBundle(sid common.SpanId,
+	lim int) *common.TraceBundle {
+	span := store.FindSpan(sid)
+	if span == nil {
+		return nil
+	}
+	rsv := newTraceRootResolver(store)
+	root, incomplete := rsv.resolve(span)
+	path := []*common.Span{span}
+	for cur := span; !cur.Id.Equal(root.Id); {
+		cur = rsv.spans[string(cur.Parents[0])]
+		path = append(path, cur)
+	}
+	bundle := &common.TraceBundle{
+		Manifest: common.TraceBundleManifest{
+			Version:        common.TRACE_BUNDLE_VERSION,
+			RootId:         root.Id,
+			RequestedId:    sid,
+			CreatedMs:      common.TimeToUnixMs(time.Now()),
+			ReleaseVersion: RELEASE_VERSION,
+			GitVersion:     GIT_VERSION,
+			Incomplete:     incomplete,
+		},
+		Spans: make([]*common.VerboseSpan, 0, len(path)),
+	}
+	manifest := &bundle.Manifest
+	spans := make([]*common.Span, 0, len(path))
+	visited := make(map[string]bool)
+	for i := len(path) - 1; i >= 0; i-- {
+		visited[string(path[i].Id)] = true
+		spans = append(spans, path[i])
+	}
+	if len(spans) > lim {
+		lim = len(spans)
+	}
+	// Since the parent index is written by clients, it may contain cycles.
+	// Never visit a span more than once.
+	queue := append([]*common.Span{}, spans...)
+	for len(queue) > 0 && !manifest.Truncated {
+		cur := queue[0]
+		queue = queue[1:]
+		childIds := store.FindChildren(cur.Id, int32(lim-len(spans)+1))
+		children := store.FindSpans(childIds)
+		for i := range childIds {
+			if visited[string(childIds[i])] {
+				continue
+			}
+			if len(spans) >= lim {
+				manifest.Truncated = true
+				break
+			}
+			child := children[i]
+			if child == nil {
+				manifest.NumMissing++
+				continue
+			}
+			visited[string(childIds[i])] = true
+			spans = append(spans, child)
+			queue = append(queue, child)
+		}
+	}
+	sort.Sort(spansByBegin(spans))
+	manifest.BeginMs = spans[0].Begin
+	for i := range spans {
+		if spans[i].End > manifest.EndMs {
+			manifest.EndMs = spans[i].End
+		}
+		bundle.Spans = append(bundle.Spans, common.NewVerboseSpan(spans[i]))
+	}
+	manifest.NumSpans = len(bundle.Spans)
+	tags, err := store.tags.Get(root.Id)
+	if err == nil && len(tags.Tags) > 0 {
+		manifest.Tags = tags.Tags
+	}
+	return bundle
+}
+
+type spansByBegin []*common.Span
+
+func (spans spansByBegin) Len() int {
+	return len(spans)
+}
+
+func (spans spansByBegin) Less(i, j int) bool {
+	if spans[i].Begin != spans[j].Begin {
+		return spans[i].Begin < spans[j].Begin
+	}
+	return spans[i].Id.Compare(spans[j].Id) < 0
+}
+
+func (spans spansByBegin) Swap(i, j int) {
+	spans[i], spans[j] = spans[j], spans[i]
+}
@@ -0,0 +1,294 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// Fetch a trace bundle over HTTP, optionally asking for it to be gzipped.
+func fetchTraceBundle(t *testing.T, ht *MiniHTraced, sid common.SpanId,
+	lim int, useGzip bool) *common.TraceBundle {
+	url := fmt.Sprintf("http://%s/span/%s/bundle", ht.Rsv.Addr().String(),
+		sid.String())
+	if lim > 0 {
+		url = fmt.Sprintf("%s?lim=%d", url, lim)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %s\n", err.Error())
+	}
+	if useGzip {
+		// Setting the header ourselves stops the transport from
+		// decompressing the response for us.
+		req.Header.Set("Accept-Encoding", "gzip")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %s\n", url, err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s returned status %d\n", url, resp.StatusCode)
+	}
+	body := resp.Body
+	if useGzip {
+		if resp.Header.Get("Content-Encoding") != "gzip" {
+			t.Fatalf("Expected a gzipped bundle, but Content-Encoding "+
+				"was '%s'\n", resp.Header.Get("Content-Encoding"))
+		}
+		body, err = gzip.NewReader(resp.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader failed: %s\n", err.Error())
+		}
+	}
+	buf, err := ioutil.ReadAll(body)
+	if err != nil {
+		t.Fatalf("Error reading bundle: %s\n", err.Error())
+	}
+	var bundle common.TraceBundle
+	err = json.Unmarshal(buf, &bundle)
+	if err != nil {
+		t.Fatalf("Error unmarshalling bundle: %s\n", err.Error())
+	}
+	return &bundle
+}
+
+func TestTraceBundle(t *testing.T) {
+	gen := &test.SpanTreeGenerator{
+		Seed:          1938,
+		Depth:         4,
+		NumRoots:      2,
+		MinFanOut:     2,
+		MaxFanOut:     3,
+		MinDurationMs: 1000,
+		MaxDurationMs: 10000,
+		StartMs:       123456789,
+		Nested:        true,
+	}
+	tree := gen.Generate()
+	// Give some spans the optional fields, to check that they survive the
+	// round trip through the verbose format.
+	tree.Spans[1].Info = common.TraceInfoMap{"host": "a.example.com"}
+	tree.Spans[1].TimelineAnnotations = []common.TimelineAnnotation{
+		{Time: tree.Spans[1].Begin + 1, Msg: "started"},
+	}
+	tree.Spans[2].Links = []common.SpanLink{
+		{Id: tree.Spans[1].Id, Type: "follows"},
+	}
+	tree.Spans[2].Flags = common.SpanFlags(1)
+	tree.Spans[2].Extras = common.SpanExtras{
+		"futureField": json.RawMessage(`"future value"`),
+	}
+	rootId := tree.Roots[0]
+	var traceSpans []*common.Span
+	var leaf *common.Span
+	for i := range tree.Spans {
+		span := tree.Spans[i]
+		cur := span
+		for len(cur.Parents) > 0 {
+			for j := range tree.Spans {
+				if tree.Spans[j].Id.Equal(cur.Parents[0]) {
+					cur = tree.Spans[j]
+					break
+				}
+			}
+		}
+		if cur.Id.Equal(rootId) {
+			traceSpans = append(traceSpans, span)
+			if tree.Levels[span.Id.String()] == gen.Depth-1 {
+				leaf = span
+			}
+		}
+	}
+
+	htraceBld := &MiniHTracedBuilder{Name: "TestTraceBundle",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, tree.Spans)
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Exporting a leaf should walk up to the root, and include the whole
+	// trace, but not the other one.
+	var buf bytes.Buffer
+	manifest, err := hcl.ExportTraceBundle(leaf.Id, &buf)
+	if err != nil {
+		t.Fatalf("ExportTraceBundle failed: %s\n", err.Error())
+	}
+	if !manifest.RootId.Equal(rootId) || !manifest.RequestedId.Equal(leaf.Id) ||
+		manifest.NumSpans != len(traceSpans) || manifest.Truncated ||
+		manifest.Incomplete || manifest.NumMissing != 0 ||
+		manifest.Version != common.TRACE_BUNDLE_VERSION {
+		t.Fatalf("Unexpected manifest for a complete trace of %d spans "+
+			"rooted at %s: %s\n", len(traceSpans), rootId.String(),
+			asJson(manifest))
+	}
+	for i := range traceSpans {
+		if traceSpans[i].Begin < manifest.BeginMs ||
+			traceSpans[i].End > manifest.EndMs {
+			t.Fatalf("Span %s lies outside the manifest's time range "+
+				"[%d, %d]\n", traceSpans[i].Id.String(), manifest.BeginMs,
+				manifest.EndMs)
+		}
+	}
+
+	// Import the bundle into a second server, and check that every span
+	// came through unchanged.
+	htraceBld2 := &MiniHTracedBuilder{Name: "TestTraceBundle2",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht2, err := htraceBld2.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht2.Close()
+	var hcl2 *htrace.Client
+	hcl2, err = htrace.NewClient(ht2.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl2.Close()
+	manifest2, err := hcl2.ImportTraceBundle(&buf)
+	if err != nil {
+		t.Fatalf("ImportTraceBundle failed: %s\n", err.Error())
+	}
+	if manifest2.NumSpans != manifest.NumSpans {
+		t.Fatalf("Expected the imported manifest to list %d spans, but it "+
+			"listed %d\n", manifest.NumSpans, manifest2.NumSpans)
+	}
+	ht2.Store.WrittenSpans.Waits(int64(len(traceSpans)))
+	for i := range traceSpans {
+		sid := traceSpans[i].Id
+		span2 := ht2.Store.FindSpan(sid)
+		if span2 == nil {
+			t.Fatalf("Span %s was not imported.\n", sid.String())
+		}
+		common.ExpectSpansEqual(t, ht.Store.FindSpan(sid), span2)
+	}
+
+	// A bundle of the imported trace should have the same manifest counts.
+	bundle2 := fetchTraceBundle(t, ht2, leaf.Id, 0, true)
+	if !bundle2.Manifest.RootId.Equal(rootId) ||
+		bundle2.Manifest.NumSpans != manifest.NumSpans ||
+		len(bundle2.Spans) != manifest.NumSpans ||
+		bundle2.Manifest.BeginMs != manifest.BeginMs ||
+		bundle2.Manifest.EndMs != manifest.EndMs {
+		t.Fatalf("Expected the re-exported manifest to match %s, but got "+
+			"%s\n", asJson(manifest), asJson(&bundle2.Manifest))
+	}
+
+	// A truncated bundle still includes the path from the root to the
+	// requested span.
+	bundle := fetchTraceBundle(t, ht, leaf.Id, 2, false)
+	if !bundle.Manifest.Truncated || bundle.Manifest.NumSpans != gen.Depth {
+		t.Fatalf("Expected a truncated bundle of %d spans, but got %s\n",
+			gen.Depth, asJson(&bundle.Manifest))
+	}
+	found := false
+	for i := range bundle.Spans {
+		if bundle.Spans[i].Id.Equal(leaf.Id) {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("The truncated bundle left out the requested span %s\n",
+			leaf.Id.String())
+	}
+
+	// Bundling a span which doesn't exist fails.
+	_, err = hcl.ExportTraceBundle(common.TestId("00000000000000000000000000000001"),
+		&buf)
+	expectErrorCode(t, err, common.ERR_SPAN_NOT_FOUND)
+}
+
+func TestTraceBundleBrokenChains(t *testing.T) {
+	t.Parallel()
+	// 0002 has a parent which doesn't exist, and 0003 is its child.  0004
+	// and 0005 are each other's parents, and 0006 is a child of 0005.
+	newSpan := func(id string, parent string) *common.Span {
+		return &common.Span{Id: common.TestId(id),
+			SpanData: common.SpanData{
+				Begin:       1000,
+				End:         2000,
+				Description: "span " + id,
+				TracerId:    "tracer",
+				Parents:     []common.SpanId{common.TestId(parent)},
+			}}
+	}
+	spans := []*common.Span{
+		newSpan("00000000000000000000000000000002",
+			"00000000000000000000000000000001"),
+		newSpan("00000000000000000000000000000003",
+			"00000000000000000000000000000002"),
+		newSpan("00000000000000000000000000000004",
+			"00000000000000000000000000000005"),
+		newSpan("00000000000000000000000000000005",
+			"00000000000000000000000000000004"),
+		newSpan("00000000000000000000000000000006",
+			"00000000000000000000000000000005"),
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestTraceBundleBrokenChains",
+		WrittenSpans: common.NewSemaphore(0),
+		Cnf: map[string]string{
+			conf.HTRACE_BUNDLE_MAX_SPANS: "100",
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, spans)
+
+	bundle := fetchTraceBundle(t, ht, spans[1].Id, 0, false)
+	if !bundle.Manifest.RootId.Equal(spans[0].Id) ||
+		!bundle.Manifest.Incomplete || bundle.Manifest.NumSpans != 2 {
+		t.Fatalf("Unexpected manifest for a broken chain: %s\n",
+			asJson(&bundle.Manifest))
+	}
+	bundle = fetchTraceBundle(t, ht, spans[4].Id, 0, false)
+	if !bundle.Manifest.Incomplete || bundle.Manifest.NumSpans != 3 ||
+		bundle.Manifest.Truncated {
+		t.Fatalf("Unexpected manifest for a cycle: %s\n",
+			asJson(&bundle.Manifest))
+	}
+}
@@ -0,0 +1,378 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The read-after-write canary.
+//
+// A span which was acknowledged but can't be read back is the worst kind of
+// storage bug, since nobody notices until someone goes looking for that span.
+// So htraced checks a sample of the spans it writes.  Once a shard has
+// committed a sampled span, it gives the canary the span ID and a checksum of
+// the span data.  canary.delay.ms later, a background goroutine reads the
+// span back through the normal read path and compares checksums.  The
+// results are counted in the server stats, and the most recent failures are
+// kept for /server/canary.  Only the first few failures are logged at ERROR,
+// so that a bug which breaks every span doesn't flood the log.
+//
+// Spans are sampled by hashing their IDs, so every version of a sampled span
+// is sampled too.  A span can legitimately change or disappear between being
+// written and being checked: clients rewrite spans, tracer renames rewrite
+// them, and the reaper and eviction delete them.  The shard tells the canary
+// before it commits any of these changes to a sampled span, and again
+// afterwards if it rewrote the span.  A check which overlaps a change is
+// discarded, and a rewritten span is checked again after the delay.  A span
+// which isn't found because a lookup missed its deadline is checked again
+// too.
+//
+// The sampled spans wait in a bounded queue, in the order in which they are
+// due.  Spans sampled while the queue is full are dropped, and counted.  The
+// canary reads back at most canary.max.spans.per.sec spans per second, so
+// that it doesn't get in the way of queries.
+//
+
+// The number of failures kept for /server/canary.
+const CANARY_MAX_FAILURES = 100
+
+// The number of failures logged at ERROR.  Later failures are only logged at
+// DEBUG.
+const CANARY_MAX_ERROR_LOGS = 10
+
+var canaryCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A sampled span waiting to be checked.
+type canaryEntry struct {
+	id common.SpanId
+
+	// The checksum of the span data which was written.
+	checksum uint32
+
+	// When the span was written, in milliseconds since the epoch.
+	writtenMs int64
+
+	// When the span should be checked.
+	due time.Time
+
+	// Incremented whenever the span changes, so that the verifier can tell
+	// whether its check overlapped a change.
+	gen uint64
+
+	// The entry's place in the queue, or nil if it isn't queued, because it
+	// is being checked or written.
+	elem *list.Element
+}
+
+type canary struct {
+	store *dataStore
+
+	lg *common.Logger
+
+	samplePercent uint32
+
+	delay time.Duration
+
+	maxRate int
+
+	queueSize int
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// Maps span IDs to the entries for the sampled spans.
+	pending map[string]*canaryEntry
+
+	// The entries waiting to be checked, in the order they are due.
+	queue *list.List
+
+	// The check counts.
+	status common.CanaryStatus
+
+	// The most recent failures, oldest first.
+	failures []common.CanaryFailure
+
+	// The number of failures logged at ERROR so far.
+	numLogged int
+
+	// Wakes up the verifier when an entry is added to an empty queue.
+	wake chan struct{}
+
+	// Closed to stop the verifier.
+	stop chan struct{}
+
+	exited sync.WaitGroup
+}
+
+// Create the canary and start its verifier, or return nil if it is disabled.
+func newCanary(store *dataStore, cnf *conf.Config) *canary {
+	samplePercent := cnf.GetInt(conf.HTRACE_CANARY_SAMPLE_PERCENT)
+	if samplePercent <= 0 || store.readOnly {
+		return nil
+	}
+	if samplePercent > 100 {
+		samplePercent = 100
+	}
+	cn := &canary{
+		store:         store,
+		lg:            store.lg,
+		samplePercent: uint32(samplePercent),
+		delay: time.Millisecond *
+			time.Duration(cnf.GetInt64(conf.HTRACE_CANARY_DELAY_MS)),
+		maxRate:   cnf.GetInt(conf.HTRACE_CANARY_MAX_RATE),
+		queueSize: cnf.GetInt(conf.HTRACE_CANARY_QUEUE_SIZE),
+		pending:   make(map[string]*canaryEntry),
+		queue:     list.New(),
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+	}
+	cn.exited.Add(1)
+	go cn.run()
+	return cn
+}
+
+// Stop the verifier.  Spans which haven't been checked yet never will be.
+func (cn *canary) Stop() {
+	close(cn.stop)
+	cn.exited.Wait()
+}
+
+// Returns true if a span should be checked.
+func (cn *canary) sampled(sid common.SpanId) bool {
+	h := fnv.New32a()
+	h.Write(sid.Val())
+	return h.Sum32()%100 < cn.samplePercent
+}
+
+// Called by the shard goroutine before it writes a span.
+func (cn *canary) beginWrite(sid common.SpanId) {
+	if !cn.sampled(sid) {
+		return
+	}
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	entry := cn.pending[string(sid)]
+	if entry == nil {
+		return
+	}
+	entry.gen++
+	if entry.elem != nil {
+		cn.queue.Remove(entry.elem)
+		entry.elem = nil
+	}
+}
+
+// Called by the shard goroutine after it writes a span.  data is the span
+// data which was written, or nil if the write failed.
+func (cn *canary) endWrite(sid common.SpanId, data []byte) {
+	if !cn.sampled(sid) {
+		return
+	}
+	now := time.Now()
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	entry := cn.pending[string(sid)]
+	if entry == nil {
+		if data == nil {
+			return
+		}
+		if cn.queueSize > 0 && len(cn.pending) >= cn.queueSize {
+			cn.status.Dropped++
+			return
+		}
+		entry = &canaryEntry{id: sid}
+		cn.pending[string(sid)] = entry
+	}
+	entry.gen++
+	if data != nil {
+		entry.checksum = crc32.Checksum(data, canaryCrcTable)
+		entry.writtenMs = common.TimeToUnixMs(now.UTC())
+	}
+	entry.due = now.Add(cn.delay)
+	if entry.elem != nil {
+		cn.queue.Remove(entry.elem)
+	}
+	entry.elem = cn.queue.PushBack(entry)
+	if cn.queue.Len() == 1 {
+		select {
+		case cn.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Called by the shard goroutine before it deletes a span.
+func (cn *canary) removed(sid common.SpanId) {
+	if !cn.sampled(sid) {
+		return
+	}
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	entry := cn.pending[string(sid)]
+	if entry == nil {
+		return
+	}
+	delete(cn.pending, string(sid))
+	entry.gen++
+	if entry.elem != nil {
+		cn.queue.Remove(entry.elem)
+		entry.elem = nil
+	}
+	cn.status.Removed++
+}
+
+func (cn *canary) run() {
+	defer cn.exited.Done()
+	for {
+		entry, gen, ok := cn.next()
+		if !ok {
+			return
+		}
+		startTime := time.Now()
+		cn.check(entry, gen)
+		if cn.maxRate > 0 {
+			delay := time.Second/time.Duration(cn.maxRate) -
+				time.Since(startTime)
+			if delay > 0 {
+				select {
+				case <-time.After(delay):
+				case <-cn.stop:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Wait for the next entry to be due, and take it off the queue.  Returns
+// false if the canary is stopping.
+func (cn *canary) next() (*canaryEntry, uint64, bool) {
+	for {
+		var wait <-chan time.Time
+		cn.lock.Lock()
+		front := cn.queue.Front()
+		if front != nil {
+			entry := front.Value.(*canaryEntry)
+			delay := entry.due.Sub(time.Now())
+			if delay <= 0 {
+				cn.queue.Remove(front)
+				entry.elem = nil
+				gen := entry.gen
+				cn.lock.Unlock()
+				return entry, gen, true
+			}
+			wait = time.After(delay)
+		}
+		cn.lock.Unlock()
+		select {
+		case <-wait:
+		case <-cn.wake:
+		case <-cn.stop:
+			return nil, 0, false
+		}
+	}
+}
+
+// Read a span back, and record the result, unless the span changed while we
+// were reading it.
+func (cn *canary) check(entry *canaryEntry, gen uint64) {
+	store := cn.store
+	deadlineMisses := atomic.LoadUint64(&store.lookupDeadlineMisses)
+	buf := store.FindSpanBytes(entry.id)
+	failure := common.CanaryFailure{
+		SpanId:    entry.id,
+		WrittenMs: entry.writtenMs,
+	}
+	var checksum uint32
+	if buf == nil {
+		failure.Kind = common.CANARY_FAILURE_NOT_FOUND
+		failure.Message = "The span could not be found."
+	} else {
+		checksum = crc32.Checksum(buf, canaryCrcTable)
+		if checksum != entry.checksum {
+			failure.Kind = common.CANARY_FAILURE_MISMATCH
+			failure.Message = fmt.Sprintf("Read %d bytes of span data "+
+				"with checksum %08x, but the data written had checksum "+
+				"%08x.", len(buf), checksum, entry.checksum)
+		}
+	}
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	if cn.pending[string(entry.id)] != entry || entry.gen != gen {
+		// The span was rewritten or deleted while we were reading it.
+		return
+	}
+	if failure.Kind == common.CANARY_FAILURE_NOT_FOUND &&
+		atomic.LoadUint64(&store.lookupDeadlineMisses) != deadlineMisses {
+		// A slow shard may have the span.  Try again later.
+		entry.due = time.Now().Add(cn.delay)
+		entry.elem = cn.queue.PushBack(entry)
+		return
+	}
+	delete(cn.pending, string(entry.id))
+	switch failure.Kind {
+	case "":
+		cn.status.Verified++
+		return
+	case common.CANARY_FAILURE_NOT_FOUND:
+		cn.status.NotFound++
+	case common.CANARY_FAILURE_MISMATCH:
+		cn.status.Mismatches++
+	}
+	failure.TimeMs = common.TimeToUnixMs(time.Now().UTC())
+	if len(cn.failures) >= CANARY_MAX_FAILURES {
+		cn.failures = append(cn.failures[:0], cn.failures[1:]...)
+	}
+	cn.failures = append(cn.failures, failure)
+	if cn.numLogged < CANARY_MAX_ERROR_LOGS {
+		cn.numLogged++
+		cn.lg.Errorf("Canary check of span %s, written at %s, failed: "+
+			"%s\n", entry.id.String(),
+			common.UnixMsToTime(entry.writtenMs).Format(time.RFC3339),
+			failure.Message)
+	} else {
+		cn.lg.Debugf("Canary check of span %s failed: %s\n",
+			entry.id.String(), failure.Message)
+	}
+}
+
+// Get the state of the canary.
+func (cn *canary) Status() *common.CanaryStatus {
+	cn.lock.Lock()
+	defer cn.lock.Unlock()
+	status := cn.status
+	status.Enabled = true
+	status.Pending = len(cn.pending)
+	status.Failures = make([]common.CanaryFailure, len(cn.failures))
+	for i := range cn.failures {
+		status.Failures[i] = cn.failures[len(cn.failures)-1-i]
+	}
+	return &status
+}
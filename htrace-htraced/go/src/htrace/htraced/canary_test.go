@@ -0,0 +1,193 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"testing"
+	"time"
+)
+
+func buildCanaryHTraced(t *testing.T, name string, delayMs string,
+	hooks *datastoreTestHooks) (*MiniHTraced, *htrace.Client) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_CANARY_SAMPLE_PERCENT: "100",
+			conf.HTRACE_CANARY_DELAY_MS:       delayMs,
+			conf.HTRACE_CANARY_MAX_RATE:       "0",
+		},
+		DataDirs:           make([]string, 2),
+		WrittenSpans:       common.NewSemaphore(0),
+		DatastoreTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		ht.Close()
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	return ht, hcl
+}
+
+// Wait for the canary to check every span it sampled, and return its status.
+func waitForCanary(t *testing.T, hcl *htrace.Client) *common.CanaryStatus {
+	for {
+		status, err := hcl.GetCanaryStatus()
+		if err != nil {
+			t.Fatalf("GetCanaryStatus failed: %s\n", err.Error())
+		}
+		if status.Pending == 0 {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCanaryVerifiesWrittenSpans(t *testing.T) {
+	ht, hcl := buildCanaryHTraced(t, "TestCanaryVerifiesWrittenSpans", "0",
+		nil)
+	defer ht.Close()
+	defer hcl.Close()
+	spans := createRandomTestSpans(300)
+	ingestSpans(ht, spans)
+
+	// Rewriting spans doesn't make their earlier checks fail.
+	for i := 0; i < 10; i++ {
+		spans[i].End++
+	}
+	ingestSpans(ht, spans[0:10])
+	status := waitForCanary(t, hcl)
+	if !status.Enabled || status.NotFound != 0 || status.Mismatches != 0 ||
+		len(status.Failures) != 0 {
+		t.Fatalf("expected no canary failures, but got %s\n",
+			asJson(status))
+	}
+	if status.Verified < 300 {
+		t.Fatalf("expected at least 300 verified spans, but got %s\n",
+			asJson(status))
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.CanaryVerified != status.Verified ||
+		stats.CanaryNotFound != 0 || stats.CanaryMismatches != 0 {
+		t.Fatalf("unexpected canary stats %s\n", asJson(stats))
+	}
+}
+
+func TestCanaryDetectsCorruptWrite(t *testing.T) {
+	spans := createRandomTestSpans(20)
+	corruptId := spans[7].Id
+	hooks := &datastoreTestHooks{
+		BeforeWriteSpan: func(span *common.Span, record []byte) []byte {
+			if !span.Id.Equal(corruptId) {
+				return record
+			}
+			corrupt := append([]byte{}, record...)
+			corrupt[len(corrupt)/2] ^= 0xff
+			return corrupt
+		},
+	}
+	ht, hcl := buildCanaryHTraced(t, "TestCanaryDetectsCorruptWrite", "0",
+		hooks)
+	defer ht.Close()
+	defer hcl.Close()
+	ingestSpans(ht, spans)
+	status := waitForCanary(t, hcl)
+	if status.Verified != 19 || status.Mismatches != 1 ||
+		status.NotFound != 0 || len(status.Failures) != 1 {
+		t.Fatalf("expected one mismatch, but got %s\n", asJson(status))
+	}
+	failure := status.Failures[0]
+	if !failure.SpanId.Equal(corruptId) ||
+		failure.Kind != common.CANARY_FAILURE_MISMATCH ||
+		failure.WrittenMs == 0 || failure.TimeMs < failure.WrittenMs {
+		t.Fatalf("unexpected failure %s\n", asJson(&failure))
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.CanaryMismatches != 1 {
+		t.Fatalf("expected 1 canary mismatch in the stats, but got %d\n",
+			stats.CanaryMismatches)
+	}
+}
+
+func TestCanaryToleratesDeletedSpans(t *testing.T) {
+	ht, hcl := buildCanaryHTraced(t, "TestCanaryToleratesDeletedSpans",
+		"3600000", nil)
+	defer ht.Close()
+	defer hcl.Close()
+	spans := createRandomTestSpans(5)
+	ingestSpans(ht, spans)
+
+	// Delete a span the way the reaper does, before the canary checks it.
+	shd := ht.Store.shards[ht.Store.getShardIndex(spans[2].Id)]
+	err := shd.DeleteSpan(spans[2])
+	if err != nil {
+		t.Fatalf("DeleteSpan failed: %s\n", err.Error())
+	}
+	status, err := hcl.GetCanaryStatus()
+	if err != nil {
+		t.Fatalf("GetCanaryStatus failed: %s\n", err.Error())
+	}
+	if status.Pending != 4 || status.Removed != 1 || status.NotFound != 0 {
+		t.Fatalf("expected the deleted span to be forgotten, but got %s\n",
+			asJson(status))
+	}
+}
+
+func TestCanaryDisabled(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestCanaryDisabled",
+		Cnf: map[string]string{
+			conf.HTRACE_CANARY_SAMPLE_PERCENT: "0",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ingestSpans(ht, createRandomTestSpans(10))
+	if ht.Store.canary != nil {
+		t.Fatalf("expected the canary to be disabled\n")
+	}
+	status, err := hcl.GetCanaryStatus()
+	if err != nil {
+		t.Fatalf("GetCanaryStatus failed: %s\n", err.Error())
+	}
+	if status.Enabled || status.Pending != 0 || status.Verified != 0 {
+		t.Fatalf("unexpected status for a disabled canary: %s\n",
+			asJson(status))
+	}
+}
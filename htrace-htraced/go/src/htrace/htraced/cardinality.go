@@ -0,0 +1,266 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"hash/fnv"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"sync"
+)
+
+//
+// Description cardinality tracking.
+//
+// Span descriptions are meant to name an operation, like "processRequest".
+// Some tracers put ids or numbers into them instead, so that nearly every
+// span has a different description.  That makes the descriptions useless for
+// grouping spans, and is usually a bug in the instrumentation.  We count the
+// distinct descriptions each tracer uses, and report the tracers which go
+// over the limit in the server stats so that they can be fixed.
+//
+// Until they are fixed, the spans such a tracer sends after it reaches the
+// limit are indexed by their normalized descriptions, with the ids and numbers
+// replaced by '*', and marked with DescriptionNormalized.  Their records keep
+// the original descriptions.  An EQUALS query on a description reads the
+// description index entries of its normalized form as well, and checks each
+// span found that way against the query, since many descriptions share a
+// normalized form.  The counts are only kept in memory, so after a restart, a
+// tracer's spans are indexed by their full descriptions until it reaches the
+// limit again.
+//
+// We only keep a 64-bit hash of each description, and we stop counting once
+// a tracer reaches the limit, so the memory used is bounded by the limit
+// times the maximum number of tracers.
+//
+
+type tracerDescriptions struct {
+	// The hashes of the distinct descriptions we have seen.  This is nil
+	// once the tracer has reached the limit.
+	hashes map[uint64]struct{}
+
+	// The number of spans we have seen since the tracer reached the limit.
+	spansOverLimit uint64
+
+	// The description which took the tracer over the limit.
+	description string
+}
+
+type descriptionTracker struct {
+	lg *common.Logger
+
+	// The number of distinct descriptions a tracer may use.  0 if we are not
+	// tracking descriptions.
+	limit int
+
+	// The maximum number of tracers we will track.
+	maxTracers int
+
+	// Protects tracers.
+	lock sync.Mutex
+
+	// The tracers we are tracking, by tracer ID.
+	tracers map[string]*tracerDescriptions
+}
+
+func newDescriptionTracker(lg *common.Logger,
+	cnf *conf.Config) *descriptionTracker {
+	limit := cnf.GetInt(conf.HTRACE_METRICS_DESC_CARDINALITY)
+	if limit < 0 {
+		limit = 0
+	}
+	return &descriptionTracker{
+		lg:         lg,
+		limit:      limit,
+		maxTracers: cnf.GetInt(conf.HTRACE_METRICS_MAX_TRACER_ENTRIES),
+		tracers:    make(map[string]*tracerDescriptions),
+	}
+}
+
+// Record the description of a span.  Returns true if the tracer had already
+// reached the limit, so that the span should be indexed by its normalized
+// description.
+func (dtr *descriptionTracker) observe(tracerId string, desc string) bool {
+	if dtr.limit == 0 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(desc))
+	hash := h.Sum64()
+	dtr.lock.Lock()
+	defer dtr.lock.Unlock()
+	tds := dtr.tracers[tracerId]
+	if tds == nil {
+		if len(dtr.tracers) >= dtr.maxTracers {
+			// Unlike per-address metrics, we don't evict entries here, since
+			// that would forget the tracers which went over the limit.
+			return false
+		}
+		tds = &tracerDescriptions{hashes: make(map[uint64]struct{})}
+		dtr.tracers[tracerId] = tds
+	}
+	if tds.hashes == nil {
+		tds.spansOverLimit++
+		return true
+	}
+	tds.hashes[hash] = struct{}{}
+	if len(tds.hashes) >= dtr.limit {
+		dtr.lg.Warnf("Tracer '%s' has used %d distinct span descriptions.  "+
+			"The descriptions probably contain ids or numbers, like '%s'.\n",
+			tracerId, dtr.limit, desc)
+		tds.hashes = nil
+		tds.description = desc
+	}
+	return false
+}
+
+// Move what we know about the descriptions of one tracer to another, when the
+// tracer is renamed.  If we were tracking both, the descriptions are merged.
+func (dtr *descriptionTracker) rename(from string, to string) {
+	dtr.lock.Lock()
+	defer dtr.lock.Unlock()
+	old := dtr.tracers[from]
+	if old == nil {
+		return
+	}
+	delete(dtr.tracers, from)
+	tds := dtr.tracers[to]
+	if tds == nil {
+		dtr.tracers[to] = old
+		return
+	}
+	tds.spansOverLimit += old.spansOverLimit
+	if tds.hashes == nil {
+		return
+	}
+	if old.hashes == nil {
+		tds.hashes = nil
+		tds.description = old.description
+		return
+	}
+	for hash := range old.hashes {
+		tds.hashes[hash] = struct{}{}
+	}
+	if len(tds.hashes) >= dtr.limit {
+		tds.hashes = nil
+		tds.description = old.description
+	}
+}
+
+// Get the tracers which have reached the limit, sorted by tracer ID.
+func (dtr *descriptionTracker) getHighCardinality() []common.HighCardinalityTracer {
+	dtr.lock.Lock()
+	defer dtr.lock.Unlock()
+	hct := make([]common.HighCardinalityTracer, 0)
+	for tracerId, tds := range dtr.tracers {
+		if tds.hashes != nil {
+			continue
+		}
+		hct = append(hct, common.HighCardinalityTracer{
+			TracerId:              tracerId,
+			DistinctDescriptions:  uint64(dtr.limit),
+			SpansOverLimit:        tds.spansOverLimit,
+			Description:           tds.description,
+			NormalizedDescription: normalizeDescription(tds.description),
+		})
+	}
+	sort.Sort(highCardinalityTracers(hct))
+	return hct
+}
+
+type highCardinalityTracers []common.HighCardinalityTracer
+
+func (hct highCardinalityTracers) Len() int {
+	return len(hct)
+}
+
+func (hct highCardinalityTracers) Less(i, j int) bool {
+	return hct[i].TracerId < hct[j].TracerId
+}
+
+func (hct highCardinalityTracers) Swap(i, j int) {
+	hct[i], hct[j] = hct[j], hct[i]
+}
+
+// Replace the parts of a description which look like ids or numbers with
+// '*'.  UUIDs, runs of at least 8 hex digits which contain a decimal digit,
+// and runs of decimal digits are replaced.
+func normalizeDescription(desc string) string {
+	buf := make([]byte, 0, len(desc))
+	for i := 0; i < len(desc); {
+		if isUuidAt(desc, i) {
+			buf = append(buf, '*')
+			i += 36
+			continue
+		}
+		if isHexDigit(desc[i]) && (i == 0 || !isHexDigit(desc[i-1])) {
+			end, hasDigit := i, false
+			for end < len(desc) && isHexDigit(desc[end]) {
+				hasDigit = hasDigit || isDigit(desc[end])
+				end++
+			}
+			if hasDigit && end-i >= 8 {
+				buf = append(buf, '*')
+				i = end
+				continue
+			}
+		}
+		if isDigit(desc[i]) {
+			for i < len(desc) && isDigit(desc[i]) {
+				i++
+			}
+			buf = append(buf, '*')
+			continue
+		}
+		buf = append(buf, desc[i])
+		i++
+	}
+	return string(buf)
+}
+
+// Returns true if there is a UUID, like 3f9a1b2c-0d4e-4f5a-8b6c-7d8e9f0a1b2c,
+// at the given offset in a string.
+func isUuidAt(str string, off int) bool {
+	if len(str)-off < 36 {
+		return false
+	}
+	for i := 0; i < 36; i++ {
+		c := str[off+i]
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !isHexDigit(c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
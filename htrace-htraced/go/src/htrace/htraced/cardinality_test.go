@@ -0,0 +1,224 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDescription(t *testing.T) {
+	t.Parallel()
+	cases := map[string]string{
+		"":               "",
+		"processRequest": "processRequest",
+		"processRequest-3f9a1b2c-0d4e-4f5a-8b6c-7d8e9f0a1b2c": "processRequest-*",
+		"getBlock blk_1073741825":                             "getBlock blk_*",
+		"read 0xdeadbeef01":                                   "read *x*",
+		"scan row 00ab12cd34ef in region 7":                   "scan row * in region *",
+		"deadbeef":                                            "deadbeef",
+		"http2":                                               "http*",
+	}
+	for desc, expected := range cases {
+		normalized := normalizeDescription(desc)
+		if normalized != expected {
+			t.Fatalf("Expected '%s' to normalize to '%s', but got '%s'\n",
+				desc, expected, normalized)
+		}
+	}
+}
+
+// Make a random UUID-like string.
+func randomUuid(rnd *rand.Rand) string {
+	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x", rnd.Uint32(),
+		rnd.Uint32()&0xffff, rnd.Uint32()&0xffff, rnd.Uint32()&0xffff,
+		rnd.Int63()&0xffffffffffff)
+}
+
+func TestHighCardinalityTracers(t *testing.T) {
+	const LIMIT = 10
+	const NUM_SPANS = 30
+	htraceBld := &MiniHTracedBuilder{Name: "TestHighCardinalityTracers",
+		Cnf: map[string]string{
+			conf.HTRACE_METRICS_DESC_CARDINALITY: fmt.Sprintf("%d", LIMIT),
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	rnd := rand.New(rand.NewSource(1898))
+	spans := createRandomTestSpans(2 * NUM_SPANS)
+	for i := 0; i < NUM_SPANS; i++ {
+		spans[i].TracerId = "uuidTracer"
+		spans[i].Description = "processRequest-" + randomUuid(rnd)
+		spans[NUM_SPANS+i].TracerId = "goodTracer"
+		spans[NUM_SPANS+i].Description = fmt.Sprintf("op%c", 'A'+i%3)
+	}
+	ingestSpans(ht, spans)
+
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if len(stats.HighCardinalityTracers) != 1 {
+		t.Fatalf("Expected one high cardinality tracer, but got %s\n",
+			asJson(stats.HighCardinalityTracers))
+	}
+	hct := stats.HighCardinalityTracers[0]
+	if hct.TracerId != "uuidTracer" || hct.DistinctDescriptions != LIMIT ||
+		hct.SpansOverLimit != NUM_SPANS-LIMIT ||
+		hct.Description != spans[LIMIT-1].Description ||
+		hct.NormalizedDescription != "processRequest-*" {
+		t.Fatalf("Unexpected high cardinality tracer %s\n", asJson(hct))
+	}
+
+	// The original descriptions are stored untouched.
+	span, err := hcl.FindSpan(spans[0].Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if span.Description != spans[0].Description {
+		t.Fatalf("Expected description '%s', but got '%s'\n",
+			spans[0].Description, span.Description)
+	}
+}
+
+// Count the distinct descriptions in the description index.
+func distinctIndexedDescriptions(ht *MiniHTraced) int {
+	distinct := make(map[string]bool)
+	for _, key := range descriptionIndexKeys(ht) {
+		distinct[string(key[1:len(key)-common.SPAN_ID_LEN])] = true
+	}
+	return len(distinct)
+}
+
+// Once a tracer reaches the cardinality limit, its spans are indexed by their
+// normalized descriptions, but EQUALS queries on the original descriptions
+// still find them.
+func TestNormalizedDescriptionIndex(t *testing.T) {
+	const LIMIT = 10
+	const NUM_SPANS = 30
+	htraceBld := &MiniHTracedBuilder{Name: "TestNormalizedDescriptionIndex",
+		Cnf: map[string]string{
+			conf.HTRACE_METRICS_DESC_CARDINALITY: fmt.Sprintf("%d", LIMIT),
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	rnd := rand.New(rand.NewSource(1898))
+	spans := createRandomTestSpans(NUM_SPANS + 1)
+	for i := 0; i < NUM_SPANS; i++ {
+		spans[i].TracerId = "uuidTracer"
+		spans[i].Description = "processRequest-" + randomUuid(rnd)
+	}
+	// A tracer under the limit which happens to use the same description as
+	// one of the normalized spans.
+	spans[NUM_SPANS].TracerId = "goodTracer"
+	spans[NUM_SPANS].Description = spans[NUM_SPANS-1].Description
+	descQuery := func(desc string, prev *common.Span) []*common.Span {
+		results, err, _ := ht.Store.HandleQuery(&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: common.EQUALS,
+					Field: common.DESCRIPTION, Val: desc},
+			},
+			Prev: prev,
+			Lim:  NUM_SPANS,
+		})
+		if err != nil {
+			t.Fatalf("query failed: %s\n", err.Error())
+		}
+		return results
+	}
+
+	// Before the tracer reaches the limit, each description has its own
+	// entry.
+	ingestSpans(ht, spans[0:LIMIT])
+	if distinct := distinctIndexedDescriptions(ht); distinct != LIMIT {
+		t.Fatalf("Expected %d distinct indexed descriptions, but got %d\n",
+			LIMIT, distinct)
+	}
+	expectSpanIds(t, descQuery(spans[3].Description, nil), spans[3].Id)
+
+	// After that, the tracer's spans share the normalized entry.
+	ingestSpans(ht, spans[LIMIT:])
+	numKeys := len(descriptionIndexKeys(ht))
+	if numKeys != len(spans) {
+		t.Fatalf("Expected %d description index keys, but got %d\n",
+			len(spans), numKeys)
+	}
+	if distinct := distinctIndexedDescriptions(ht); distinct != LIMIT+2 {
+		t.Fatalf("Expected %d distinct indexed descriptions, but got %d\n",
+			LIMIT+2, distinct)
+	}
+	for i := range spans {
+		span := ht.Store.FindSpan(spans[i].Id)
+		if span.Description != spans[i].Description {
+			t.Fatalf("Expected description '%s', but got '%s'\n",
+				spans[i].Description, span.Description)
+		}
+		expectNormalized := (i >= LIMIT && i < NUM_SPANS)
+		if span.DescriptionNormalized != expectNormalized {
+			t.Fatalf("Expected span %d to have DescriptionNormalized = %t\n",
+				i, expectNormalized)
+		}
+	}
+	// Clients never see the marker.
+	body := expectRestResponse(t, fmt.Sprintf("http://%s/span/%s",
+		ht.Rsv.Addr().String(), spans[LIMIT].Id.String()), http.StatusOK, "")
+	if strings.Contains(string(body), `"dn"`) {
+		t.Fatalf("Expected the span sent to clients to leave out the "+
+			"normalized description marker, but got %s\n", string(body))
+	}
+	expectSpanIds(t, descQuery(spans[3].Description, nil), spans[3].Id)
+	expectSpanIds(t, descQuery(spans[LIMIT+5].Description, nil),
+		spans[LIMIT+5].Id)
+	expectSpanIds(t, descQuery("processRequest-*", nil))
+
+	// Spans indexed by the full and the normalized description come back in
+	// span id order, and continuing from the first finds the second.
+	first, second := spans[NUM_SPANS-1].Id, spans[NUM_SPANS].Id
+	if second.Compare(first) < 0 {
+		first, second = second, first
+	}
+	results := descQuery(spans[NUM_SPANS].Description, nil)
+	expectSpanIds(t, results, first, second)
+	expectSpanIds(t, descQuery(spans[NUM_SPANS].Description, results[0]),
+		second)
+}
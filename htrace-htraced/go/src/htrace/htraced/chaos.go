@@ -0,0 +1,221 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Injects faults into the server.  The datastore, the REST server, and the
+// HRPC server consult it at the points where failures can happen.  During
+// normal operation, this is noFaults, which never injects anything.
+type FaultInjector interface {
+	// How long a shard should wait before writing a batch of spans.
+	ShardWriteDelay() time.Duration
+
+	// How long a span lookup should wait before reading from the given
+	// shard.
+	ShardReadDelay(shardIdx int) time.Duration
+
+	// How long a shard should wait before handling a heartbeat.
+	HeartbeatDelay() time.Duration
+
+	// Returns true if a WriteSpans request should be rejected.
+	RejectWriteSpans() bool
+
+	// Returns true if an HRPC connection should be closed before its next
+	// request is read.
+	CloseHrpcConn() bool
+
+	// Returns an error if a shard should fail to write a span, or nil.
+	ShardWriteError(span *common.Span) error
+
+	// Get the faults injected so far.
+	Stats() *common.ChaosStats
+}
+
+type noFaults struct {
+}
+
+func (nf noFaults) ShardWriteDelay() time.Duration {
+	return 0
+}
+
+func (nf noFaults) ShardReadDelay(shardIdx int) time.Duration {
+	return 0
+}
+
+func (nf noFaults) HeartbeatDelay() time.Duration {
+	return 0
+}
+
+func (nf noFaults) RejectWriteSpans() bool {
+	return false
+}
+
+func (nf noFaults) CloseHrpcConn() bool {
+	return false
+}
+
+func (nf noFaults) ShardWriteError(span *common.Span) error {
+	return nil
+}
+
+func (nf noFaults) Stats() *common.ChaosStats {
+	return &common.ChaosStats{}
+}
+
+// Injects random faults, for soak testing.  See chaos.enabled.
+type chaosInjector struct {
+	// Protects rnd.
+	lock sync.Mutex
+
+	rnd *rand.Rand
+
+	// The configured percentages and maximum delays.
+	writeDelayPercent int
+	writeDelayMaxMs   int64
+	rejectPercent     int
+	hrpcClosePercent  int
+	hbDelayPercent    int
+	hbDelayMaxMs      int64
+
+	// The fault counts.  Accessed atomically.
+	shardWriteDelays   uint64
+	shardWriteDelayMs  uint64
+	rejectedWriteSpans uint64
+	hrpcEarlyCloses    uint64
+	heartbeatDelays    uint64
+	heartbeatDelayMs   uint64
+}
+
+// Create the FaultInjector for a configuration.
+func NewFaultInjector(cnf *conf.Config, lg *common.Logger) (FaultInjector, error) {
+	if !cnf.GetBool(conf.HTRACE_CHAOS_ENABLED) {
+		return noFaults{}, nil
+	}
+	if !cnf.GetBool(conf.HTRACE_CHAOS_I_REALLY_MEAN_IT) {
+		return nil, errors.New(fmt.Sprintf("Refusing to enable chaos mode: "+
+			"%s is set, but %s is not.  Chaos mode drops writes on purpose, "+
+			"and is only meant for soak tests.", conf.HTRACE_CHAOS_ENABLED,
+			conf.HTRACE_CHAOS_I_REALLY_MEAN_IT))
+	}
+	cin := &chaosInjector{
+		rnd:               rand.New(rand.NewSource(time.Now().UnixNano())),
+		writeDelayPercent: cnf.GetInt(conf.HTRACE_CHAOS_WRITE_DELAY_PERCENT),
+		writeDelayMaxMs:   cnf.GetInt64(conf.HTRACE_CHAOS_WRITE_DELAY_MAX_MS),
+		rejectPercent:     cnf.GetInt(conf.HTRACE_CHAOS_REJECT_PERCENT),
+		hrpcClosePercent:  cnf.GetInt(conf.HTRACE_CHAOS_HRPC_CLOSE_PERCENT),
+		hbDelayPercent:    cnf.GetInt(conf.HTRACE_CHAOS_HB_DELAY_PERCENT),
+		hbDelayMaxMs:      cnf.GetInt64(conf.HTRACE_CHAOS_HB_DELAY_MAX_MS),
+	}
+	lg.Warnf("CHAOS MODE IS ENABLED.  Shard write delays: %d%% (up to %dms), "+
+		"WriteSpans rejections: %d%%, HRPC early closes: %d%%, heartbeat "+
+		"delays: %d%% (up to %dms).\n", cin.writeDelayPercent,
+		cin.writeDelayMaxMs, cin.rejectPercent, cin.hrpcClosePercent,
+		cin.hbDelayPercent, cin.hbDelayMaxMs)
+	return cin, nil
+}
+
+// Returns true with the given percent probability.
+func (cin *chaosInjector) roll(percent int) bool {
+	if percent <= 0 {
+		return false
+	}
+	cin.lock.Lock()
+	defer cin.lock.Unlock()
+	return cin.rnd.Intn(100) < percent
+}
+
+// Pick a random delay of at least 1 millisecond, up to maxMs.
+func (cin *chaosInjector) randomDelayMs(maxMs int64) int64 {
+	if maxMs <= 1 {
+		return 1
+	}
+	cin.lock.Lock()
+	defer cin.lock.Unlock()
+	return 1 + cin.rnd.Int63n(maxMs)
+}
+
+func (cin *chaosInjector) ShardWriteDelay() time.Duration {
+	if !cin.roll(cin.writeDelayPercent) {
+		return 0
+	}
+	delayMs := cin.randomDelayMs(cin.writeDelayMaxMs)
+	atomic.AddUint64(&cin.shardWriteDelays, 1)
+	atomic.AddUint64(&cin.shardWriteDelayMs, uint64(delayMs))
+	return time.Duration(delayMs) * time.Millisecond
+}
+
+// Chaos mode doesn't delay reads; the hedged lookups in hedged_reads.go are
+// exercised by the unit tests instead.
+func (cin *chaosInjector) ShardReadDelay(shardIdx int) time.Duration {
+	return 0
+}
+
+func (cin *chaosInjector) HeartbeatDelay() time.Duration {
+	if !cin.roll(cin.hbDelayPercent) {
+		return 0
+	}
+	delayMs := cin.randomDelayMs(cin.hbDelayMaxMs)
+	atomic.AddUint64(&cin.heartbeatDelays, 1)
+	atomic.AddUint64(&cin.heartbeatDelayMs, uint64(delayMs))
+	return time.Duration(delayMs) * time.Millisecond
+}
+
+func (cin *chaosInjector) RejectWriteSpans() bool {
+	if !cin.roll(cin.rejectPercent) {
+		return false
+	}
+	atomic.AddUint64(&cin.rejectedWriteSpans, 1)
+	return true
+}
+
+func (cin *chaosInjector) CloseHrpcConn() bool {
+	if !cin.roll(cin.hrpcClosePercent) {
+		return false
+	}
+	atomic.AddUint64(&cin.hrpcEarlyCloses, 1)
+	return true
+}
+
+// Chaos mode doesn't fail span writes, since that would lose data.
+func (cin *chaosInjector) ShardWriteError(span *common.Span) error {
+	return nil
+}
+
+func (cin *chaosInjector) Stats() *common.ChaosStats {
+	return &common.ChaosStats{
+		Enabled:            true,
+		ShardWriteDelays:   atomic.LoadUint64(&cin.shardWriteDelays),
+		ShardWriteDelayMs:  atomic.LoadUint64(&cin.shardWriteDelayMs),
+		RejectedWriteSpans: atomic.LoadUint64(&cin.rejectedWriteSpans),
+		HrpcEarlyCloses:    atomic.LoadUint64(&cin.hrpcEarlyCloses),
+		HeartbeatDelays:    atomic.LoadUint64(&cin.heartbeatDelays),
+		HeartbeatDelayMs:   atomic.LoadUint64(&cin.heartbeatDelayMs),
+	}
+}
@@ -0,0 +1,205 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestChaosModeRequiresConfirmation(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestChaosModeRequiresConfirmation",
+		Cnf: map[string]string{
+			conf.HTRACE_CHAOS_ENABLED: "true",
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err == nil {
+		ht.Close()
+		t.Fatalf("Expected chaos mode to be refused without %s\n",
+			conf.HTRACE_CHAOS_I_REALLY_MEAN_IT)
+	}
+	if !strings.Contains(err.Error(), conf.HTRACE_CHAOS_I_REALLY_MEAN_IT) {
+		t.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+}
+
+const CHAOS_SOAK_DURATION = 3 * time.Second
+
+// Run concurrent writes and queries against a server in chaos mode, and check
+// that every span whose write was acknowledged can be found afterwards.
+func TestChaosSoak(t *testing.T) {
+	const NUM_WRITERS = 4
+	const NUM_QUERIERS = 2
+	htraceBld := &MiniHTracedBuilder{Name: "TestChaosSoak",
+		Cnf: map[string]string{
+			conf.HTRACE_CHAOS_ENABLED:                 "true",
+			conf.HTRACE_CHAOS_I_REALLY_MEAN_IT:        "true",
+			conf.HTRACE_CHAOS_WRITE_DELAY_PERCENT:     "20",
+			conf.HTRACE_CHAOS_WRITE_DELAY_MAX_MS:      "5",
+			conf.HTRACE_CHAOS_REJECT_PERCENT:          "20",
+			conf.HTRACE_CHAOS_HRPC_CLOSE_PERCENT:      "20",
+			conf.HTRACE_CHAOS_HB_DELAY_PERCENT:        "50",
+			conf.HTRACE_CHAOS_HB_DELAY_MAX_MS:         "20",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "50",
+		},
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+
+	var lock sync.Mutex
+	acked := make([]*common.Span, 0)
+	numFailedWrites := 0
+	errs := make(chan error, NUM_WRITERS+NUM_QUERIERS)
+	deadline := time.Now().Add(CHAOS_SOAK_DURATION)
+	var wg sync.WaitGroup
+	for i := 0; i < NUM_WRITERS; i++ {
+		// Half of the writers use HRPC, and half use REST.
+		cnf := ht.ClientConf()
+		if i%2 == 1 {
+			cnf = ht.RestOnlyClientConf()
+		}
+		hcl, err := htrace.NewClient(cnf, nil)
+		if err != nil {
+			t.Fatalf("failed to create client: %s", err.Error())
+		}
+		defer hcl.Close()
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(1903 + i)))
+			for time.Now().Before(deadline) {
+				spans := make([]*common.Span, 10)
+				for j := range spans {
+					spans[j] = test.NewRandomSpan(rnd, spans[0:j])
+				}
+				err := hcl.WriteSpans(spans)
+				lock.Lock()
+				if err == nil {
+					acked = append(acked, spans...)
+				} else {
+					numFailedWrites++
+				}
+				lock.Unlock()
+			}
+		}(i)
+	}
+	for i := 0; i < NUM_QUERIERS; i++ {
+		hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+		if err != nil {
+			t.Fatalf("failed to create client: %s", err.Error())
+		}
+		defer hcl.Close()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				_, err := hcl.Query(&common.Query{
+					Predicates: []common.Predicate{
+						common.Predicate{
+							Op:    common.GREATER_THAN_OR_EQUALS,
+							Field: common.BEGIN_TIME,
+							Val:   "0",
+						},
+					},
+					Lim: 20,
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Query failed during the soak test: %s\n", err.Error())
+	}
+
+	// Every acknowledged span must eventually be queryable.
+	if len(acked) == 0 {
+		t.Fatalf("No writes were acknowledged.\n")
+	}
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	for _, span := range acked {
+		var found *common.Span
+		common.WaitFor(time.Minute*1, time.Millisecond*10, func() bool {
+			found, err = hcl.FindSpan(span.Id)
+			return err == nil && found != nil
+		})
+		expectSpanStored(t, span, found)
+	}
+
+	// Every kind of fault must have fired.
+	stats, err := hcl.GetChaosStats()
+	if err != nil {
+		t.Fatalf("GetChaosStats failed: %s\n", err.Error())
+	}
+	if !stats.Enabled || stats.ShardWriteDelays == 0 ||
+		stats.RejectedWriteSpans == 0 || stats.HrpcEarlyCloses == 0 ||
+		stats.HeartbeatDelays == 0 {
+		t.Fatalf("Expected every kind of fault to fire, but got %s\n",
+			asJson(stats))
+	}
+	if numFailedWrites == 0 {
+		t.Fatalf("Expected some writes to fail.\n")
+	}
+	t.Logf("%d span(s) acknowledged, %d write(s) failed, faults: %s\n",
+		len(acked), numFailedWrites, asJson(stats))
+}
+
+func TestChaosStatsWhenDisabled(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestChaosStatsWhenDisabled"}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	stats, err := hcl.GetChaosStats()
+	if err != nil {
+		t.Fatalf("GetChaosStats failed: %s\n", err.Error())
+	}
+	if *stats != (common.ChaosStats{}) {
+		t.Fatalf("Expected no faults, but got %s\n", asJson(stats))
+	}
+}
@@ -20,14 +20,22 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"github.com/ugorji/go/codec"
 	htrace "htrace/client"
 	"htrace/common"
 	"htrace/conf"
 	"htrace/test"
+	"io"
+	"io/ioutil"
 	"math"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
 	"sort"
 	"sync"
 	"sync/atomic"
@@ -55,6 +63,41 @@ func TestClientGetServerVersion(t *testing.T) {
 	}
 }
 
+// Test that configuring the REST and HRPC servers onto the same address
+// fails before either server binds it, and that the client rejects bad
+// addresses when it is created.
+func TestDuplicateListenAddress(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %s", err.Error())
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+	htraceBld := &MiniHTracedBuilder{Name: "TestDuplicateListenAddress",
+		Cnf: map[string]string{
+			conf.HTRACE_WEB_ADDRESS:  addr,
+			conf.HTRACE_HRPC_ADDRESS: addr,
+		},
+		DataDirs: make([]string, 2),
+	}
+	_, err = htraceBld.Build()
+	common.AssertErrContains(t, err, "both use port")
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("Expected %s to be left unbound, but: %s", addr, err.Error())
+	}
+	lis.Close()
+	cnfBld := conf.Builder{Values: map[string]string{
+		conf.HTRACE_WEB_ADDRESS: "9096",
+	}, Defaults: conf.DEFAULTS}
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to build the configuration: %s", err.Error())
+	}
+	_, err = htrace.NewClient(cnf, nil)
+	common.AssertErrContains(t, err, conf.HTRACE_WEB_ADDRESS)
+}
+
 func TestClientGetServerDebugInfo(t *testing.T) {
 	htraceBld := &MiniHTracedBuilder{Name: "TestClientGetServerDebugInfo",
 		DataDirs: make([]string, 2)}
@@ -92,6 +135,14 @@ func createRandomTestSpans(amount int) common.SpanSlice {
 	return allSpans
 }
 
+// Check that the server stored a span as it was sent.  Under the default
+// ingest.negative.duration.policy, the server also marks spans which end
+// before they begin as IndexSkipped, and many random spans do.  The marker
+// is never part of the span's JSON, so it doesn't make the spans differ.
+func expectSpanStored(t *testing.T, sent *common.Span, stored *common.Span) {
+	common.ExpectSpansEqual(t, sent, stored)
+}
+
 func TestClientOperations(t *testing.T) {
 	htraceBld := &MiniHTracedBuilder{Name: "TestClientOperations",
 		DataDirs:     make([]string, 2),
@@ -128,7 +179,7 @@ func TestClientOperations(t *testing.T) {
 		if err != nil {
 			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
 		}
-		common.ExpectSpansEqual(t, allSpans[i], span)
+		expectSpanStored(t, allSpans[i], span)
 	}
 
 	// Look up the second half of the spans.  They should not be found.
@@ -216,6 +267,7 @@ func TestDumpAll(t *testing.T) {
 	var dumpErr error
 	go func() {
 		dumpErr = hcl.DumpAll(3, out)
+		close(out)
 	}()
 	var numSpans int
 	nextLogTime := time.Now().Add(time.Millisecond * 5)
@@ -224,7 +276,7 @@ func TestDumpAll(t *testing.T) {
 		if !channelOpen {
 			break
 		}
-		common.ExpectSpansEqual(t, allSpans[numSpans], span)
+		expectSpanStored(t, allSpans[numSpans], span)
 		numSpans++
 		if testing.Verbose() {
 			now := time.Now()
@@ -244,6 +296,223 @@ func TestDumpAll(t *testing.T) {
 	}
 }
 
+// A writer which fails after a fixed number of bytes have been written.
+type failingWriter struct {
+	bytes.Buffer
+	remaining int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.remaining {
+		n, _ := w.Buffer.Write(p[:w.remaining])
+		w.remaining = 0
+		return n, fmt.Errorf("injected write failure")
+	}
+	w.remaining -= len(p)
+	return w.Buffer.Write(p)
+}
+
+func TestDumpAllTo(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDumpAllTo",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	NUM_TEST_SPANS := 100
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	sort.Sort(allSpans)
+	err = hcl.WriteSpans(allSpans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(NUM_TEST_SPANS))
+
+	// A complete dump.
+	var full bytes.Buffer
+	report, err := hcl.DumpAllTo(&full, htrace.DumpOpts{Lim: 7})
+	if err != nil {
+		t.Fatalf("DumpAllTo failed: %s\n", err.Error())
+	}
+	if report.NumSpans != int64(NUM_TEST_SPANS) {
+		t.Fatalf("Expected to dump %d spans, but dumped %d\n",
+			NUM_TEST_SPANS, report.NumSpans)
+	}
+	if report.NumBytes != int64(full.Len()) {
+		t.Fatalf("Expected NumBytes to be %d, but it was %d\n",
+			full.Len(), report.NumBytes)
+	}
+	// 15 pages of spans, plus the final empty page.
+	if report.NumPages != 15 {
+		t.Fatalf("Expected to fetch 15 pages, but fetched %d\n",
+			report.NumPages)
+	}
+	if !report.LastId.Equal(allSpans[NUM_TEST_SPANS-1].Id) {
+		t.Fatalf("Expected LastId to be %s, but it was %s\n",
+			allSpans[NUM_TEST_SPANS-1].Id.String(), report.LastId.String())
+	}
+
+	// Interrupt a dump part of the way through a span, and then resume it
+	// from the last checkpoint.
+	out := &failingWriter{remaining: full.Len() / 2}
+	var cpId common.SpanId
+	var cpBytes, baseBytes int64
+	checkpoint := func(lastId common.SpanId, numBytes int64) error {
+		if baseBytes+numBytes <= cpBytes {
+			t.Fatalf("Expected the checkpoint to advance past %d bytes, "+
+				"but got %d\n", cpBytes, baseBytes+numBytes)
+		}
+		cpId = lastId
+		cpBytes = baseBytes + numBytes
+		return nil
+	}
+	report, err = hcl.DumpAllTo(out, htrace.DumpOpts{Lim: 7, FlushBytes: 500,
+		Checkpoint: checkpoint})
+	common.AssertErrContains(t, err, "injected write failure")
+	if cpId == nil || cpBytes != report.NumBytes ||
+		!cpId.Equal(report.LastId) {
+		t.Fatalf("Expected the last checkpoint (%v, %d) to match the report "+
+			"(%v, %d)\n", cpId, cpBytes, report.LastId, report.NumBytes)
+	}
+	if cpBytes > int64(out.Len()) || cpBytes == int64(out.Len()) {
+		t.Fatalf("Expected the output (%d bytes) to include a partial span "+
+			"after the checkpoint at %d bytes\n", out.Len(), cpBytes)
+	}
+	out.Truncate(int(cpBytes))
+	out.remaining = math.MaxInt32
+	baseBytes = cpBytes
+	report, err = hcl.DumpAllFrom(cpId, out, htrace.DumpOpts{Lim: 7,
+		FlushBytes: 500, Checkpoint: checkpoint})
+	if err != nil {
+		t.Fatalf("DumpAllFrom failed: %s\n", err.Error())
+	}
+	if !bytes.Equal(full.Bytes(), out.Bytes()) {
+		t.Fatalf("The resumed dump did not match the complete dump.\n")
+	}
+	numSpans := 0
+	dec := json.NewDecoder(out)
+	for {
+		var span common.Span
+		err = dec.Decode(&span)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("failed to decode span: %s\n", err.Error())
+		}
+		expectSpanStored(t, allSpans[numSpans], &span)
+		numSpans++
+	}
+	if numSpans != NUM_TEST_SPANS {
+		t.Fatalf("Expected %d spans, but got %d\n", NUM_TEST_SPANS, numSpans)
+	}
+
+	// Resuming from the last span dumps nothing.
+	var empty bytes.Buffer
+	report, err = hcl.DumpAllFrom(allSpans[NUM_TEST_SPANS-1].Id, &empty,
+		htrace.DumpOpts{Lim: 7})
+	if err != nil {
+		t.Fatalf("DumpAllFrom failed: %s\n", err.Error())
+	}
+	if report.NumSpans != 0 || empty.Len() != 0 {
+		t.Fatalf("Expected an empty dump, but got %d span(s)\n",
+			report.NumSpans)
+	}
+}
+
+// Write spans over REST and HRPC, and return the stored versions.  The second
+// span written over each transport tries to set its own source address.
+func writeSourceAddrSpans(t *testing.T, ht *MiniHTraced) []*common.Span {
+	restCl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client: %s", err.Error())
+	}
+	defer restCl.Close()
+	hrpcCl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create HRPC client: %s", err.Error())
+	}
+	defer hrpcCl.Close()
+	spans := createRandomTestSpans(4)
+	for i := range spans {
+		spans[i].Info = nil
+	}
+	spans[1].Info = common.TraceInfoMap{
+		common.SOURCE_ADDR_INFO_KEY: "rest.example.com",
+	}
+	spans[3].Info = common.TraceInfoMap{
+		common.SOURCE_ADDR_INFO_KEY: "hrpc.example.com",
+	}
+	err = restCl.WriteSpans(spans[0:2])
+	if err != nil {
+		t.Fatalf("WriteSpans over REST failed: %s\n", err.Error())
+	}
+	err = hrpcCl.WriteSpans(spans[2:4])
+	if err != nil {
+		t.Fatalf("WriteSpans over HRPC failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+	stored := make([]*common.Span, len(spans))
+	for i := range spans {
+		stored[i] = ht.Store.FindSpan(spans[i].Id)
+		if stored[i] == nil {
+			t.Fatalf("Failed to find span %s\n", spans[i].Id.String())
+		}
+	}
+	return stored
+}
+
+func TestSpanSourceAddr(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanSourceAddr",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_SOURCE_ADDR: "true",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	stored := writeSourceAddrSpans(t, ht)
+	// Values set by the client are replaced, since the key is reserved.
+	for i := range stored {
+		addr := stored[i].Info[common.SOURCE_ADDR_INFO_KEY]
+		ip := net.ParseIP(addr)
+		if ip == nil || !ip.IsLoopback() {
+			t.Fatalf("Expected span %d to have a loopback source address, "+
+				"but got %s\n", i, asJson(stored[i]))
+		}
+	}
+
+	// By default, the source address isn't recorded.
+	htraceBld = &MiniHTracedBuilder{Name: "TestSpanSourceAddrOff",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht2, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht2.Close()
+	stored = writeSourceAddrSpans(t, ht2)
+	for i := range stored {
+		if len(stored[i].Info) != 0 {
+			t.Fatalf("Expected span %d to have no info, but got %s\n", i,
+				asJson(stored[i]))
+		}
+	}
+}
+
 const EXAMPLE_CONF_KEY = "example.conf.key"
 const EXAMPLE_CONF_VALUE = "foo.bar.baz"
 
@@ -386,6 +655,113 @@ func TestHrpcIoTimeout(t *testing.T) {
 	wg.Wait()
 }
 
+// Tests that the HRPC server closes idle connections, aborts requests which
+// stall, and rejects connections beyond the connection limit.
+func TestHrpcIdleConnections(t *testing.T) {
+	const NUM_IDLE_CONNS = 30
+	const MAX_CONNS = 40
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcIdleConnections",
+		DataDirs: make([]string, 2),
+		Cnf: map[string]string{
+			conf.HTRACE_NUM_HRPC_HANDLERS:    fmt.Sprintf("%d", MAX_CONNS),
+			conf.HTRACE_HRPC_MAX_CONNECTIONS: fmt.Sprintf("%d", MAX_CONNS),
+			conf.HTRACE_HRPC_IDLE_TIMEOUT_MS: "500",
+			conf.HTRACE_HRPC_IO_TIMEOUT_MS:   "100",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	msink := ht.Store.msink
+	hrpcAddr := ht.Hsv.Addr().String()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", hrpcAddr)
+		if err != nil {
+			t.Fatalf("failed to connect to %s: %s\n", hrpcAddr, err.Error())
+		}
+		return conn
+	}
+	// Open some connections which never send anything.
+	idleConns := make([]net.Conn, NUM_IDLE_CONNS)
+	for i := range idleConns {
+		idleConns[i] = dial()
+		defer idleConns[i].Close()
+	}
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return atomic.LoadInt64(&msink.HrpcOpenConnections) == NUM_IDLE_CONNS
+	})
+
+	// An active client should be able to write spans while the idle
+	// connections are open.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	allSpans := createRandomTestSpans(10)
+	for i := range allSpans {
+		err = hcl.WriteSpans(allSpans[i : i+1])
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(allSpans)))
+
+	// The idle connections should get closed.
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return atomic.LoadInt64(&msink.HrpcOpenConnections) == 0
+	})
+	if idleCloses := atomic.LoadUint64(&msink.HrpcIdleCloses); idleCloses <
+		NUM_IDLE_CONNS {
+		t.Fatalf("expected at least %d idle closes, but got %d\n",
+			NUM_IDLE_CONNS, idleCloses)
+	}
+	buf := make([]byte, 1)
+	for i := range idleConns {
+		_, err = idleConns[i].Read(buf)
+		if err != io.EOF {
+			t.Fatalf("expected idle connection %d to be closed by the "+
+				"server, but got %v\n", i, err)
+		}
+	}
+
+	// A connection which stalls partway through a request should be aborted.
+	stalledConn := dial()
+	defer stalledConn.Close()
+	_, err = stalledConn.Write([]byte{0x1})
+	if err != nil {
+		t.Fatalf("failed to write to stalled connection: %s\n", err.Error())
+	}
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return atomic.LoadUint64(&msink.HrpcDeadlineAborts) == 1
+	})
+
+	// Connections beyond the limit should be rejected.
+	extraConns := make([]net.Conn, MAX_CONNS+5)
+	for i := range extraConns {
+		extraConns[i] = dial()
+		defer extraConns[i].Close()
+	}
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return atomic.LoadUint64(&msink.HrpcAcceptRejections) == 5
+	})
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.HrpcAcceptRejections != 5 {
+		t.Fatalf("expected 5 accept rejections in the server stats, but "+
+			"got %d\n", stats.HrpcAcceptRejections)
+	}
+	if stats.HrpcIdleCloses < NUM_IDLE_CONNS {
+		t.Fatalf("expected at least %d idle closes in the server stats, "+
+			"but got %d\n", NUM_IDLE_CONNS, stats.HrpcIdleCloses)
+	}
+}
+
 func doWriteSpans(name string, N int, maxSpansPerRpc uint32, b *testing.B) {
 	htraceBld := &MiniHTracedBuilder{Name: "doWriteSpans",
 		Cnf: map[string]string{
@@ -482,3 +858,614 @@ func BenchmarkWriteSpans(b *testing.B) {
 func TestWriteSpansRpcs(t *testing.T) {
 	doWriteSpans("TestWriteSpansRpcs", 3000, 1000, nil)
 }
+
+// Get the address of a port which nothing is listening on.
+func getClosedPortAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s\n", err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	return addr
+}
+
+func TestClientMetrics(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestClientMetrics",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+		Cnf: map[string]string{
+			conf.HTRACE_LOG_LEVEL: "INFO",
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	var restHcl *htrace.Client
+	restHcl, err = htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer restHcl.Close()
+	var numCallbacks int32
+	restHcl.SetRequestFailureCallback(func(endpoint string, err error) {
+		t.Fatalf("unexpected failure of %s: %s\n", endpoint, err.Error())
+	})
+
+	const NUM_BATCHES = 100
+	const SPANS_PER_BATCH = 2
+	allSpans := createRandomTestSpans(NUM_BATCHES * SPANS_PER_BATCH)
+	for i := 0; i < NUM_BATCHES; i++ {
+		batch := allSpans[i*SPANS_PER_BATCH : (i+1)*SPANS_PER_BATCH]
+		if i%2 == 0 {
+			err = hcl.WriteSpans(batch)
+		} else {
+			err = restHcl.WriteSpans(batch)
+		}
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(allSpans)))
+	for i := range allSpans {
+		var span *common.Span
+		span, err = restHcl.FindSpan(allSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
+		}
+		expectSpanStored(t, allSpans[i], span)
+	}
+	_, err = restHcl.Query(&common.Query{Lim: 10})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+
+	// Check the metrics for the HRPC client.
+	mtx := hcl.Metrics()
+	if mtx.SpansWritten != NUM_BATCHES*SPANS_PER_BATCH/2 {
+		t.Fatalf("expected SpansWritten = %d, got %d\n",
+			NUM_BATCHES*SPANS_PER_BATCH/2, mtx.SpansWritten)
+	}
+	if mtx.HrpcRequests != NUM_BATCHES/2 || mtx.RestRequests != 0 {
+		t.Fatalf("expected %d HRPC requests and 0 REST requests, but got "+
+			"%d and %d\n", NUM_BATCHES/2, mtx.HrpcRequests, mtx.RestRequests)
+	}
+
+	// Check the metrics for the REST client.
+	mtx = restHcl.Metrics()
+	if mtx.SpansWritten != NUM_BATCHES*SPANS_PER_BATCH/2 {
+		t.Fatalf("expected SpansWritten = %d, got %d\n",
+			NUM_BATCHES*SPANS_PER_BATCH/2, mtx.SpansWritten)
+	}
+	expectedRest := uint64(NUM_BATCHES/2 + len(allSpans) + 1)
+	if mtx.RestRequests != expectedRest || mtx.HrpcRequests != 0 {
+		t.Fatalf("expected %d REST requests and 0 HRPC requests, but got "+
+			"%d and %d\n", expectedRest, mtx.RestRequests, mtx.HrpcRequests)
+	}
+	if mtx.Endpoints[htrace.ENDPOINT_FIND_SPAN].Requests != uint64(len(allSpans)) {
+		t.Fatalf("expected %d findSpan requests, got %d\n", len(allSpans),
+			mtx.Endpoints[htrace.ENDPOINT_FIND_SPAN].Requests)
+	}
+	if mtx.Endpoints[htrace.ENDPOINT_QUERY].Requests != 1 {
+		t.Fatalf("expected 1 query request, got %d\n",
+			mtx.Endpoints[htrace.ENDPOINT_QUERY].Requests)
+	}
+	for endpoint, emtx := range mtx.Endpoints {
+		if emtx.Failures != 0 {
+			t.Fatalf("expected no failures for %s, but got %d\n",
+				endpoint, emtx.Failures)
+		}
+	}
+
+	// Make some requests against a closed port.  They should all fail.
+	closedAddr := getClosedPortAddr(t)
+	var badHcl *htrace.Client
+	badHcl, err = htrace.NewClient(ht.Cnf.Clone(
+		conf.HTRACE_WEB_ADDRESS, closedAddr,
+		conf.HTRACE_HRPC_ADDRESS, closedAddr), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer badHcl.Close()
+	failedEndpoints := make(map[string]int)
+	badHcl.SetRequestFailureCallback(func(endpoint string, err error) {
+		atomic.AddInt32(&numCallbacks, 1)
+		failedEndpoints[endpoint]++
+	})
+	const NUM_FAILURES = 10
+	for i := 0; i < NUM_FAILURES; i++ {
+		if badHcl.WriteSpans(allSpans[0:SPANS_PER_BATCH]) == nil {
+			t.Fatalf("expected WriteSpans to a closed port to fail.\n")
+		}
+		if _, err = badHcl.FindSpan(allSpans[0].Id); err == nil {
+			t.Fatalf("expected FindSpan to a closed port to fail.\n")
+		}
+	}
+	if atomic.LoadInt32(&numCallbacks) != 2*NUM_FAILURES {
+		t.Fatalf("expected %d failure callbacks, but got %d\n",
+			2*NUM_FAILURES, numCallbacks)
+	}
+	if failedEndpoints[htrace.ENDPOINT_WRITE_SPANS] != NUM_FAILURES ||
+		failedEndpoints[htrace.ENDPOINT_FIND_SPAN] != NUM_FAILURES {
+		t.Fatalf("unexpected failed endpoints: %v\n", failedEndpoints)
+	}
+	mtx = badHcl.Metrics()
+	if mtx.SpansWritten != 0 || mtx.SpansFailed != NUM_FAILURES*SPANS_PER_BATCH {
+		t.Fatalf("expected SpansWritten = 0 and SpansFailed = %d, but got "+
+			"%d and %d\n", NUM_FAILURES*SPANS_PER_BATCH, mtx.SpansWritten,
+			mtx.SpansFailed)
+	}
+	if mtx.Endpoints[htrace.ENDPOINT_WRITE_SPANS].Failures != NUM_FAILURES ||
+		mtx.Endpoints[htrace.ENDPOINT_FIND_SPAN].Failures != NUM_FAILURES {
+		t.Fatalf("expected %d failures for each endpoint, but got %d and %d\n",
+			NUM_FAILURES, mtx.Endpoints[htrace.ENDPOINT_WRITE_SPANS].Failures,
+			mtx.Endpoints[htrace.ENDPOINT_FIND_SPAN].Failures)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	srcBld := &MiniHTracedBuilder{Name: "TestReplicationSrc",
+		DataDirs: make([]string, 2)}
+	src, err := srcBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create source datastore: %s", err.Error())
+	}
+	defer src.Close()
+	dstBld := &MiniHTracedBuilder{Name: "TestReplicationDst",
+		DataDirs: make([]string, 2)}
+	dst, err := dstBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create destination datastore: %s", err.Error())
+	}
+	defer dst.Close()
+	tempDir, err := ioutil.TempDir(os.TempDir(), "TestReplication")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	dstCnf := dst.ClientConf().Clone(
+		conf.HTRACE_REPLICATION_CURSOR_PATH, tempDir+"/cursor",
+		conf.HTRACE_REPLICATION_BATCH_SIZE, "7")
+	srcHcl, err := htrace.NewClient(src.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer srcHcl.Close()
+	dstHcl, err := htrace.NewClient(dst.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer dstHcl.Close()
+	const NUM_TEST_SPANS = 90
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+
+	// Write some spans before the replicator starts.
+	err = srcHcl.WriteSpans(allSpans[0:30])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	waitForReplication := func(rep *htrace.Replicator, expected uint64) {
+		common.WaitFor(time.Minute, time.Millisecond, func() bool {
+			return rep.Idle() && (rep.ReplicatedSpans() >= expected)
+		})
+		if rep.ReplicatedSpans() != expected {
+			t.Fatalf("Expected to replicate %d spans, but replicated %d.\n",
+				expected, rep.ReplicatedSpans())
+		}
+	}
+	rep, err := htrace.ReplicateFrom(src.ClientConf(), dstCnf, time.Millisecond)
+	if err != nil {
+		t.Fatalf("ReplicateFrom failed: %s\n", err.Error())
+	}
+	waitForReplication(rep, 30)
+
+	// Write some spans while the replicator is running.
+	for i := 30; i < 60; i += 10 {
+		err = srcHcl.WriteSpans(allSpans[i : i+10])
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+	}
+	waitForReplication(rep, 60)
+	rep.Close()
+
+	// A new replicator should resume from the persisted cursor, rather than
+	// replicating everything again.
+	err = srcHcl.WriteSpans(allSpans[60:NUM_TEST_SPANS])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	rep, err = htrace.ReplicateFrom(src.ClientConf(), dstCnf, time.Millisecond)
+	if err != nil {
+		t.Fatalf("ReplicateFrom failed: %s\n", err.Error())
+	}
+	defer rep.Close()
+	waitForReplication(rep, NUM_TEST_SPANS-60)
+
+	for i := range allSpans {
+		span, err := dstHcl.FindSpan(allSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", allSpans[i].Id.String(),
+				err.Error())
+		}
+		expectSpanStored(t, allSpans[i], span)
+	}
+}
+
+func TestHeartbeatMarkers(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHeartbeatMarkers",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "20",
+			conf.HTRACE_DATASTORE_HEARTBEAT_MARKERS:   "true",
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Wait for a marker with the given number of ingested spans, and return
+	// all the markers so far.
+	waitForMarker := func(ingested uint64) []*common.HeartbeatMarker {
+		var markers []*common.HeartbeatMarker
+		common.WaitFor(10*time.Second, time.Millisecond, func() bool {
+			markers, err = hcl.GetHeartbeatMarkers(0, 10000)
+			if err != nil {
+				t.Fatalf("GetHeartbeatMarkers failed: %s\n", err.Error())
+			}
+			return len(markers) > 0 &&
+				markers[len(markers)-1].IngestedSpans == ingested
+		})
+		if len(markers) == 0 ||
+			markers[len(markers)-1].IngestedSpans != ingested {
+			t.Fatalf("Timed out waiting for a heartbeat marker with %d "+
+				"ingested span(s).\n", ingested)
+		}
+		return markers
+	}
+	waitForMarker(0)
+
+	// Write spans in several rounds, waiting for a marker after each one.
+	const NUM_ROUNDS = 3
+	const SPANS_PER_ROUND = 10
+	allSpans := createRandomTestSpans(NUM_ROUNDS * SPANS_PER_ROUND)
+	for round := 0; round < NUM_ROUNDS; round++ {
+		err = hcl.WriteSpans(allSpans[round*SPANS_PER_ROUND : (round+1)*SPANS_PER_ROUND])
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+		ht.Store.WrittenSpans.Waits(SPANS_PER_ROUND)
+		waitForMarker(uint64((round + 1) * SPANS_PER_ROUND))
+	}
+	markers := waitForMarker(uint64(len(allSpans)))
+
+	// The counter deltas between consecutive markers should add up to the
+	// total number of spans ingested.
+	var total uint64
+	for i := 1; i < len(markers); i++ {
+		if markers[i].TimeMs < markers[i-1].TimeMs {
+			t.Fatalf("Heartbeat markers are out of order: %d came after %d\n",
+				markers[i].TimeMs, markers[i-1].TimeMs)
+		}
+		if markers[i].StartMs != ht.Store.startMs {
+			t.Fatalf("Expected marker StartMs to be %d, but got %d\n",
+				ht.Store.startMs, markers[i].StartMs)
+		}
+		total += markers[i].IngestedSpans - markers[i-1].IngestedSpans
+	}
+	if total != uint64(len(allSpans)) {
+		t.Fatalf("Expected the heartbeat marker deltas to add up to %d, "+
+			"but they added up to %d\n", len(allSpans), total)
+	}
+
+	// The since parameter should skip older markers.
+	last := markers[len(markers)-1]
+	later, err := hcl.GetHeartbeatMarkers(last.TimeMs, 10000)
+	if err != nil {
+		t.Fatalf("GetHeartbeatMarkers failed: %s\n", err.Error())
+	}
+	if len(later) == 0 || later[0].TimeMs != last.TimeMs {
+		t.Fatalf("Expected the markers since %d to start with %d, but got "+
+			"%v\n", last.TimeMs, last.TimeMs, later)
+	}
+
+	// Heartbeat markers should not show up in queries or span metrics.
+	spans, err := hcl.Query(&common.Query{Lim: 1000})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(spans) != len(allSpans) {
+		t.Fatalf("Expected the query to return %d spans, but got %d\n",
+			len(allSpans), len(spans))
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.WrittenSpans != uint64(len(allSpans)) {
+		t.Fatalf("Expected %d written spans, but got %d\n",
+			len(allSpans), stats.WrittenSpans)
+	}
+}
+
+func writeTestConfFile(t *testing.T, path string, cnf map[string]string) {
+	var buf bytes.Buffer
+	buf.WriteString("<?xml version=\"1.0\"?>\n<configuration>\n")
+	for k, v := range cnf {
+		buf.WriteString(fmt.Sprintf("  <property>\n    <name>%s</name>\n"+
+			"    <value>%s</value>\n  </property>\n", k, v))
+	}
+	buf.WriteString("</configuration>\n")
+	err := ioutil.WriteFile(path, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s\n", path, err.Error())
+	}
+}
+
+func TestReloadServerConf(t *testing.T) {
+	confDir, err := ioutil.TempDir(os.TempDir(), "TestReloadServerConf")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s\n", err.Error())
+	}
+	defer os.RemoveAll(confDir)
+	confPath := confDir + conf.PATH_SEP + conf.CONFIG_FILE_NAME
+	writeTestConfFile(t, confPath, map[string]string{
+		conf.HTRACE_HRPC_IO_TIMEOUT_MS: "60000",
+	})
+	htraceBld := &MiniHTracedBuilder{Name: "TestReloadServerConf",
+		DataDirs: make([]string, 2),
+		ConfPath: confPath,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	webAddr := ht.Cnf.Get(conf.HTRACE_WEB_ADDRESS)
+
+	// Change a hot key, a cold key, and a hot key with an invalid value.
+	writeTestConfFile(t, confPath, map[string]string{
+		conf.HTRACE_HRPC_IO_TIMEOUT_MS:            "1234",
+		conf.HTRACE_WEB_ADDRESS:                   "127.0.0.1:1",
+		conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "0",
+	})
+	result, err := hcl.ReloadServerConf()
+	if err != nil {
+		t.Fatalf("ReloadServerConf failed: %s\n", err.Error())
+	}
+	if result.Outcome != common.CONF_RELOAD_PARTIAL {
+		t.Fatalf("Expected outcome %s, but got %s\n",
+			common.CONF_RELOAD_PARTIAL, result.Outcome)
+	}
+	expectedOutcomes := []string{
+		conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS, common.CONF_CHANGE_FAILED,
+		conf.HTRACE_HRPC_IO_TIMEOUT_MS, common.CONF_CHANGE_APPLIED,
+		conf.HTRACE_WEB_ADDRESS, common.CONF_CHANGE_IGNORED,
+	}
+	if len(result.Changes) != len(expectedOutcomes)/2 {
+		t.Fatalf("Expected %d changes, but got %v\n",
+			len(expectedOutcomes)/2, result.Changes)
+	}
+	for i := range result.Changes {
+		change := result.Changes[i]
+		if change.Key != expectedOutcomes[2*i] ||
+			change.Outcome != expectedOutcomes[2*i+1] {
+			t.Fatalf("Expected change %d to be %s: %s, but got %s: %s\n", i,
+				expectedOutcomes[2*i], expectedOutcomes[2*i+1], change.Key,
+				change.Outcome)
+		}
+	}
+	if ht.Hsv.getIoTimeo() != 1234*time.Millisecond {
+		t.Fatalf("Expected the HRPC I/O timeout to be 1234ms, but it was %s\n",
+			ht.Hsv.getIoTimeo().String())
+	}
+	cnfMap, err := hcl.GetServerConf()
+	if err != nil {
+		t.Fatalf("GetServerConf failed: %s\n", err.Error())
+	}
+	if cnfMap[conf.HTRACE_HRPC_IO_TIMEOUT_MS] != "1234" {
+		t.Fatalf("Expected the effective %s to be 1234, but got %s\n",
+			conf.HTRACE_HRPC_IO_TIMEOUT_MS, cnfMap[conf.HTRACE_HRPC_IO_TIMEOUT_MS])
+	}
+	if cnfMap[conf.HTRACE_WEB_ADDRESS] != webAddr {
+		t.Fatalf("Expected the effective %s to be unchanged, but got %s\n",
+			conf.HTRACE_WEB_ADDRESS, cnfMap[conf.HTRACE_WEB_ADDRESS])
+	}
+	if ht.Rld.LastResult().TimeMs != result.TimeMs {
+		t.Fatalf("The last reload result was not recorded.\n")
+	}
+
+	// If the configuration file can't be loaded, nothing should change.
+	writeTestConfFile(t, confPath, map[string]string{
+		conf.HTRACE_HRPC_IO_TIMEOUT_MS: "not.a.number",
+	})
+	result, err = hcl.ReloadServerConf()
+	if err != nil {
+		t.Fatalf("ReloadServerConf failed: %s\n", err.Error())
+	}
+	if result.Outcome != common.CONF_RELOAD_FAILED || result.Error == "" {
+		t.Fatalf("Expected the reload to fail, but got outcome %s\n",
+			result.Outcome)
+	}
+	if ht.Hsv.getIoTimeo() != 1234*time.Millisecond {
+		t.Fatalf("Expected the HRPC I/O timeout to still be 1234ms, but it "+
+			"was %s\n", ht.Hsv.getIoTimeo().String())
+	}
+}
+
+// Check that an error returned by the client has the given code.
+func expectErrorCode(t *testing.T, err error, code common.ErrorCode) {
+	if err == nil {
+		t.Fatalf("expected an error with code %s, but got no error.\n", code)
+	}
+	herr, ok := err.(*common.HtraceError)
+	if !ok {
+		t.Fatalf("expected an HtraceError with code %s, but got %T: %s\n",
+			code, err, err.Error())
+	}
+	if herr.Code() != code {
+		t.Fatalf("expected error code %s, but got %s: %s\n",
+			code, herr.Code(), herr.Message)
+	}
+	if herr.HttpStatus != code.HttpStatus() {
+		t.Fatalf("expected HTTP status %d for error code %s, but got %d\n",
+			code.HttpStatus(), code, herr.HttpStatus)
+	}
+}
+
+// Check that an error returned by an HRPC client has the given code.  HRPC
+// errors have no HTTP status.
+func expectHrpcErrorCode(t *testing.T, err error, code common.ErrorCode) {
+	if common.ErrorCodeOf(err) != code {
+		t.Fatalf("expected an error with code %s, but got %v\n", code, err)
+	}
+}
+
+func TestClientErrorCodes(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestClientErrorCodes",
+		DataDirs: make([]string, 2)}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Missing spans are reported as nil rather than as errors.
+	sid := test.NonZeroRandSpanId(rand.New(rand.NewSource(1870)))
+	span, err := hcl.FindSpan(sid)
+	if err != nil || span != nil {
+		t.Fatalf("expected FindSpan of a missing span to return nil, nil, "+
+			"but got %v, %v\n", span, err)
+	}
+	tree, err := hcl.GetFlameTree(sid, 10)
+	if err != nil || tree != nil {
+		t.Fatalf("expected GetFlameTree of a missing span to return nil, nil, "+
+			"but got %v, %v\n", tree, err)
+	}
+
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: "nonexistent",
+				Val:   "1",
+			},
+		},
+		Lim: 10,
+	})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	_, err = hcl.FindSpansChangedSince(0, "notacursor", 10)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.GetHeartbeatMarkers(0, -1)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.RetryShard(100)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+
+	// The client doesn't send bad span IDs, so make the request directly.
+	resp, err := http.Get(fmt.Sprintf("http://%s/span/notaspanid",
+		ht.Rsv.Addr().String()))
+	if err != nil {
+		t.Fatalf("failed to fetch span: %s\n", err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read response body: %s\n", err.Error())
+	}
+	herr := common.DecodeErrorResp(resp.StatusCode, body)
+	expectErrorCode(t, herr, common.ERR_BAD_SPAN_ID)
+	common.ExpectStrEqual(t, "notaspanid", herr.Details["id"])
+}
+
+// Test that the server stats include the Go runtime statistics, and that they
+// are refreshed periodically.
+func TestClientGetRuntimeStats(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestClientGetRuntimeStats",
+		Cnf: map[string]string{
+			conf.HTRACE_METRICS_RUNTIME_PERIOD_MS: "1000",
+			conf.HTRACE_METRICS_GC_PAUSE_BUF_SIZE: "16",
+		},
+		DataDirs: make([]string, 2)}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	prev := stats.Runtime
+	if prev.CollectedMs <= 0 {
+		t.Fatalf("expected the runtime stats to have been collected, but "+
+			"CollectedMs = %d\n", prev.CollectedMs)
+	}
+	if prev.NumGoroutines <= 0 {
+		t.Fatalf("expected a positive number of goroutines, but got %d\n",
+			prev.NumGoroutines)
+	}
+	if prev.HeapInuseBytes == 0 || prev.HeapAllocBytes == 0 {
+		t.Fatalf("expected a non-empty heap, but got %s\n", asJson(&prev))
+	}
+	if prev.NumOpenFds == 0 {
+		t.Fatalf("expected NumOpenFds to be positive or -1, but got 0\n")
+	}
+	for i := 0; i < 2; i++ {
+		runtime.GC()
+		common.WaitFor(time.Minute, time.Millisecond*50, func() bool {
+			stats, err = hcl.GetServerStats()
+			if err != nil {
+				t.Fatalf("GetServerStats failed: %s\n", err.Error())
+			}
+			return stats.Runtime.CollectedMs > prev.CollectedMs
+		})
+		cur := stats.Runtime
+		if cur.NumGc <= prev.NumGc {
+			t.Fatalf("expected NumGc to increase after runtime.GC, but it "+
+				"went from %d to %d\n", prev.NumGc, cur.NumGc)
+		}
+		if cur.GcPauseTotalNs < prev.GcPauseTotalNs {
+			t.Fatalf("GcPauseTotalNs went backwards from %d to %d\n",
+				prev.GcPauseTotalNs, cur.GcPauseTotalNs)
+		}
+		if cur.MaxGcPauseUs < cur.AverageGcPauseUs {
+			t.Fatalf("MaxGcPauseUs = %d is less than AverageGcPauseUs = %d\n",
+				cur.MaxGcPauseUs, cur.AverageGcPauseUs)
+		}
+		prev = cur
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"sync"
+	"time"
+)
+
+//
+// Span completion accounting.
+//
+// Every span handed to a SpanIngestor is accounted for exactly once, when we
+// are done with it.  It was either written to its shard, rejected by the
+// ingestor because it was invalid, over a quota, or too late for the
+// watermark, or it failed because its shard was quarantined or the write
+// returned an error.  Rejected spans are accounted for when the ingestor is
+// closed.  The others are accounted for when their shard has handled the
+// batch they are in, whether or not the write worked.
+//
+// The totals are always kept; see dataStore#SpanOutcomes.  When the datastore
+// was created with a WrittenSpans semaphore, as tests do, the semaphore is
+// posted once for every span, labelled with its outcome.  So a test can use
+// dataStore#WaitSpanOutcomes to find out what happened to the spans it handed
+// over, rather than blocking forever when some of them were never written.
+//
+
+// The labels of WrittenSpans semaphore posts.
+const SPAN_OUTCOME_WRITTEN = "written"
+const SPAN_OUTCOME_REJECTED = "rejected"
+const SPAN_OUTCOME_FAILED = "failed"
+
+// What happened to spans handed to the datastore.
+type SpanOutcomes struct {
+	Written  int64
+	Rejected int64
+	Failed   int64
+}
+
+func (outcomes *SpanOutcomes) Total() int64 {
+	return outcomes.Written + outcomes.Rejected + outcomes.Failed
+}
+
+func (outcomes *SpanOutcomes) String() string {
+	return fmt.Sprintf("%d written, %d rejected, %d failed", outcomes.Written,
+		outcomes.Rejected, outcomes.Failed)
+}
+
+type spanCompletions struct {
+	// Protects totals.
+	lock sync.Mutex
+
+	// The outcomes of every span so far.
+	totals SpanOutcomes
+
+	// The semaphore to post for every span, or nil.
+	sem *common.Semaphore
+}
+
+// Record the outcomes of some spans.
+func (cpl *spanCompletions) record(outcomes SpanOutcomes) {
+	// Post the semaphore first, so that anyone who sees the new totals can
+	// also wait for these spans without blocking.
+	if cpl.sem != nil {
+		if outcomes.Written > 0 {
+			cpl.sem.PostsLabeled(SPAN_OUTCOME_WRITTEN, outcomes.Written)
+		}
+		if outcomes.Rejected > 0 {
+			cpl.sem.PostsLabeled(SPAN_OUTCOME_REJECTED, outcomes.Rejected)
+		}
+		if outcomes.Failed > 0 {
+			cpl.sem.PostsLabeled(SPAN_OUTCOME_FAILED, outcomes.Failed)
+		}
+	}
+	cpl.lock.Lock()
+	cpl.totals.Written += outcomes.Written
+	cpl.totals.Rejected += outcomes.Rejected
+	cpl.totals.Failed += outcomes.Failed
+	cpl.lock.Unlock()
+}
+
+// Get the outcomes of every span so far.
+func (cpl *spanCompletions) Totals() SpanOutcomes {
+	cpl.lock.Lock()
+	defer cpl.lock.Unlock()
+	return cpl.totals
+}
+
+// Get the outcomes of every span the datastore has received.
+func (store *dataStore) SpanOutcomes() SpanOutcomes {
+	return store.completions.Totals()
+}
+
+// Wait for n spans to be accounted for on the WrittenSpans semaphore, and
+// return what happened to them.  If they aren't accounted for within the
+// timeout, nothing is consumed, and the outcomes of the spans which were are
+// returned with an error.
+func (store *dataStore) WaitSpanOutcomes(n int64,
+	timeout time.Duration) (SpanOutcomes, error) {
+	counts, err := store.WrittenSpans.WaitsWithTimeout(n, timeout)
+	return SpanOutcomes{
+		Written:  counts[SPAN_OUTCOME_WRITTEN],
+		Rejected: counts[SPAN_OUTCOME_REJECTED],
+		Failed:   counts[SPAN_OUTCOME_FAILED],
+	}, err
+}
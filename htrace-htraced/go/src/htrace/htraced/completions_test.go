@@ -0,0 +1,114 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"htrace/common"
+	"testing"
+	"time"
+)
+
+// Wait for the spans handed to the datastore to be accounted for, and check
+// what happened to them.
+func expectSpanOutcomes(t *testing.T, ht *MiniHTraced, expected SpanOutcomes) {
+	outcomes, err := ht.Store.WaitSpanOutcomes(expected.Total(),
+		time.Minute)
+	if err != nil {
+		t.Fatalf("WaitSpanOutcomes failed: %s\n", err.Error())
+	}
+	if outcomes != expected {
+		t.Fatalf("Expected %s, but got %s\n", expected.String(),
+			outcomes.String())
+	}
+}
+
+// Fails the writes of particular spans.
+type failWritesFaults struct {
+	noFaults
+
+	fail map[string]bool
+}
+
+func (fwf *failWritesFaults) ShardWriteError(span *common.Span) error {
+	if fwf.fail[span.Id.String()] {
+		return errors.New("Injected write failure")
+	}
+	return nil
+}
+
+func TestSpanOutcomes(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanOutcomes",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+
+	// Mix invalid spans, and a span whose write fails, in with good ones.
+	spans := createRandomTestSpans(7)
+	spans[2].Id = common.INVALID_SPAN_ID
+	spans[4].Id = common.INVALID_SPAN_ID
+	ht.Store.faults = &failWritesFaults{
+		fail: map[string]bool{spans[6].Id.String(): true},
+	}
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range spans {
+		ing.IngestSpan(spans[i])
+	}
+	ing.Close(time.Now())
+	expectSpanOutcomes(t, ht, SpanOutcomes{Written: 4, Rejected: 2,
+		Failed: 1})
+	if ht.Store.FindSpan(spans[6].Id) != nil {
+		t.Fatalf("Found span %s, whose write should have failed.\n",
+			spans[6].Id.String())
+	}
+	totals := ht.Store.SpanOutcomes()
+	if totals != (SpanOutcomes{Written: 4, Rejected: 2, Failed: 1}) {
+		t.Fatalf("Unexpected totals: %s\n", totals.String())
+	}
+
+	// Waiting for more spans than were handed over times out promptly,
+	// rather than hanging, and reports the spans which were accounted for.
+	ht.Store.faults = noFaults{}
+	ing = ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	ing.IngestSpan(spans[0])
+	ing.Close(time.Now())
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return ht.Store.SpanOutcomes().Written == 5
+	})
+	start := time.Now()
+	outcomes, err := ht.Store.WaitSpanOutcomes(3,
+		50*time.Millisecond)
+	common.AssertErrContains(t, err, "Only 1 arrived")
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("WaitSpanOutcomes took %s to time out.\n",
+			time.Since(start).String())
+	}
+	if outcomes != (SpanOutcomes{Written: 1}) {
+		t.Fatalf("Expected 1 written span, but got %s\n", outcomes.String())
+	}
+
+	// Nothing was consumed by the timed out wait.
+	expectSpanOutcomes(t, ht, SpanOutcomes{Written: 1})
+}
@@ -0,0 +1,203 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"htrace/conf"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//
+// The DaemonId.
+//
+// Every shard records the DaemonId of the datastore it belongs to, so that
+// shards from two different datastores can't be mixed up.  Normally a new
+// datastore gets a random DaemonId.  If datastore.daemon.id is set, a new
+// datastore gets that DaemonId instead, and an existing datastore must
+// already have it.  This lets a redeployed daemon, whose configuration is
+// generated from scratch, state which shards it expects to adopt.
+//
+// RewriteDaemonId changes the DaemonId of an existing datastore, for the rare
+// case where a daemon has to adopt shards which were created with a different
+// id.  It runs offline, with the shards locked, and only if the caller names
+// the DaemonId the shards have now.  It first saves a copy of every shard's
+// ShardInfo under SHARD_INFO_BACKUP_KEY, then rewrites them.  If any rewrite
+// fails, the shards which were already rewritten are put back, so the shards
+// never disagree about their DaemonId.
+//
+
+// The leveldb key which holds the ShardInfo from before the last DaemonId
+// rewrite.
+const SHARD_INFO_BACKUP_KEY = 'x'
+
+// Format a DaemonId the way we log it.
+func formatDaemonId(daemonId uint64) string {
+	return fmt.Sprintf("0x%016x", daemonId)
+}
+
+// Parse a DaemonId, which may be given in hex with a 0x prefix, or in
+// decimal.
+func parseDaemonId(str string) (uint64, error) {
+	daemonId, err := strconv.ParseUint(strings.TrimSpace(str), 0, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid DaemonId '%s': expected "+
+			"a number like 0x0123456789abcdef.", str))
+	}
+	if daemonId == 0 {
+		return 0, errors.New("Invalid DaemonId '0': the DaemonId must not " +
+			"be zero.")
+	}
+	return daemonId, nil
+}
+
+// Get the DaemonId we were configured with, or 0 if there is none.
+func (dld *DataStoreLoader) configuredDaemonId() (uint64, error) {
+	if dld.daemonIdStr == "" {
+		return 0, nil
+	}
+	daemonId, err := parseDaemonId(dld.daemonIdStr)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid value for %s: %s",
+			conf.HTRACE_DATASTORE_DAEMON_ID, err.Error()))
+	}
+	return daemonId, nil
+}
+
+// Get the DaemonId for a new datastore.
+func (dld *DataStoreLoader) newDaemonId() (uint64, error) {
+	daemonId, err := dld.configuredDaemonId()
+	if err != nil || daemonId != 0 {
+		return daemonId, err
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return uint64(rnd.Int63()), nil
+}
+
+// Check that an existing datastore has the DaemonId we were configured with,
+// if any.
+func (dld *DataStoreLoader) checkDaemonId(info *ShardInfo) error {
+	daemonId, err := dld.configuredDaemonId()
+	if err != nil {
+		return err
+	}
+	if daemonId == 0 || daemonId == info.DaemonId {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("DaemonId mismatch.  The datastore has "+
+		"daemonId %s, but %s is %s.", formatDaemonId(info.DaemonId),
+		conf.HTRACE_DATASTORE_DAEMON_ID, formatDaemonId(daemonId)))
+}
+
+// Change the DaemonId of the datastore configured in cnf from oldId to
+// newId.  The datastore must not be in use.
+func RewriteDaemonId(cnf *conf.Config, oldId uint64, newId uint64) error {
+	if newId == 0 {
+		return errors.New("The new DaemonId must not be zero.")
+	}
+	dld := NewDataStoreLoader(cnf)
+	defer dld.Close()
+	switch dld.backend {
+	case DATASTORE_BACKEND_LEVELDB, DATASTORE_BACKEND_JOURNAL:
+	default:
+		return errors.New(fmt.Sprintf("The %s datastore backend doesn't "+
+			"keep a DaemonId across restarts.", dld.backend))
+	}
+	dld.LoadShards()
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.quarantineErr != nil {
+			return errors.New(fmt.Sprintf("Refusing to rewrite the DaemonId "+
+				"while shard %s can't be loaded: %s", shd.path,
+				shd.quarantineErr.Error()))
+		}
+	}
+	err := dld.VerifyShardInfos()
+	if err != nil {
+		return err
+	}
+	info := dld.firstShardInfo()
+	if info == nil {
+		return errors.New(fmt.Sprintf("There is no existing datastore in %s.",
+			dld.shardPaths()))
+	}
+	if info.DaemonId != oldId {
+		return errors.New(fmt.Sprintf("DaemonId mismatch.  The datastore has "+
+			"daemonId %s, not %s.", formatDaemonId(info.DaemonId),
+			formatDaemonId(oldId)))
+	}
+	syncOpts := levigo.NewWriteOptions()
+	defer syncOpts.Close()
+	syncOpts.SetSync(true)
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		err = writeShardInfoKey(shd.ldb, syncOpts, SHARD_INFO_BACKUP_KEY,
+			shd.info)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to back up the shard info "+
+				"of %s: %s.  No DaemonIds were changed.", shd.path,
+				err.Error()))
+		}
+	}
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		newInfo := *shd.info
+		newInfo.DaemonId = newId
+		err = writeShardInfoKey(shd.ldb, syncOpts, SHARD_INFO_KEY, &newInfo)
+		if err == nil {
+			continue
+		}
+		err = errors.New(fmt.Sprintf("Failed to rewrite the shard info of "+
+			"%s: %s", shd.path, err.Error()))
+		return dld.restoreShardInfos(syncOpts, i, err)
+	}
+	dld.lg.Infof("Rewrote the DaemonId of %d %s shards from %s to %s.\n",
+		len(dld.shards), dld.backend, formatDaemonId(oldId),
+		formatDaemonId(newId))
+	return nil
+}
+
+// Put back the original ShardInfo of the first num shards after a failed
+// DaemonId rewrite.  Returns an error describing what happened.
+func (dld *DataStoreLoader) restoreShardInfos(syncOpts *levigo.WriteOptions,
+	num int, cause error) error {
+	unrestored := make([]string, 0)
+	for i := 0; i < num; i++ {
+		shd := dld.shards[i]
+		err := writeShardInfoKey(shd.ldb, syncOpts, SHARD_INFO_KEY, shd.info)
+		if err != nil {
+			dld.lg.Errorf("Failed to restore the shard info of %s: %s\n",
+				shd.path, err.Error())
+			unrestored = append(unrestored, shd.path)
+		}
+	}
+	if len(unrestored) > 0 {
+		return errors.New(fmt.Sprintf("%s.  The shard info of %s could not "+
+			"be restored; the original is saved under key '%c'.",
+			cause.Error(), strings.Join(unrestored, ", "),
+			SHARD_INFO_BACKUP_KEY))
+	}
+	return errors.New(fmt.Sprintf("%s.  No DaemonIds were changed.",
+		cause.Error()))
+}
@@ -0,0 +1,163 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"os"
+	"testing"
+)
+
+const TEST_DAEMON_ID = 0x0123456789abcdef
+
+// Open the datastore in dataDirs, expecting the given DaemonId.
+func openWithDaemonId(backend string, dataDirs []string,
+	daemonId uint64) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDaemonId",
+		Cnf:                 map[string]string{conf.HTRACE_DATASTORE_BACKEND: backend},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		DaemonId:            daemonId,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+func expectServerDaemonId(t *testing.T, ht *MiniHTraced, expected string) {
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ver, err := hcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	common.ExpectStrEqual(t, expected, ver.DaemonId)
+}
+
+func TestConfiguredDaemonId(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testConfiguredDaemonId(t, backend)
+	}
+}
+
+func testConfiguredDaemonId(t *testing.T, backend string) {
+	ht, err := openWithDaemonId(backend, make([]string, 2), TEST_DAEMON_ID)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := append([]string{}, ht.DataDirs...)
+	cnf := ht.Cnf.Clone()
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	if ht.Store.shardInfo.DaemonId != TEST_DAEMON_ID {
+		t.Fatalf("Expected DaemonId 0x%016x, got 0x%016x.\n",
+			uint64(TEST_DAEMON_ID), ht.Store.shardInfo.DaemonId)
+	}
+	expectServerDaemonId(t, ht, "0x0123456789abcdef")
+	spans := createRandomTestSpans(3)
+	ingestSpans(ht, spans)
+	ht.Close()
+	ht = nil
+
+	// Reopening with the same DaemonId works.
+	ht, err = openWithDaemonId(backend, dataDirs, TEST_DAEMON_ID)
+	if err != nil {
+		t.Fatalf("failed to reload datastore: %s", err.Error())
+	}
+	ht.Close()
+	ht = nil
+
+	// Reopening with a different DaemonId fails.
+	_, err = openWithDaemonId(backend, dataDirs, TEST_DAEMON_ID+1)
+	if err == nil {
+		t.Fatalf("expected failure to load with the wrong DaemonId.")
+	}
+	common.AssertErrContains(t, err, "DaemonId mismatch.")
+
+	// The rewrite refuses to run unless it is given the current DaemonId.
+	err = RewriteDaemonId(cnf, TEST_DAEMON_ID+2, TEST_DAEMON_ID+1)
+	if err == nil {
+		t.Fatalf("expected RewriteDaemonId to fail with the wrong old id.")
+	}
+	common.AssertErrContains(t, err, "DaemonId mismatch.")
+
+	// After a rewrite, the datastore opens with the new DaemonId, and not
+	// the old one.
+	err = RewriteDaemonId(cnf, TEST_DAEMON_ID, TEST_DAEMON_ID+1)
+	if err != nil {
+		t.Fatalf("RewriteDaemonId failed: %s", err.Error())
+	}
+	_, err = openWithDaemonId(backend, dataDirs, TEST_DAEMON_ID)
+	if err == nil {
+		t.Fatalf("expected failure to load with the old DaemonId.")
+	}
+	common.AssertErrContains(t, err, "DaemonId mismatch.")
+	ht, err = openWithDaemonId(backend, dataDirs, TEST_DAEMON_ID+1)
+	if err != nil {
+		t.Fatalf("failed to reload rewritten datastore: %s", err.Error())
+	}
+	expectServerDaemonId(t, ht, "0x0123456789abcdf0")
+	for i := range spans {
+		common.ExpectSpansEqual(t, spans[i], ht.Store.FindSpan(spans[i].Id))
+	}
+
+	// Each shard kept a backup of its old shard info.
+	for i := range ht.Store.shards {
+		shd := ht.Store.shards[i]
+		info, err := readShardInfoKey(shd.ldb, ht.Store.readOpts, shd.path,
+			SHARD_INFO_BACKUP_KEY)
+		if err != nil {
+			t.Fatalf("failed to read backup shard info of %s: %s",
+				shd.path, err.Error())
+		}
+		if info.DaemonId != TEST_DAEMON_ID {
+			t.Fatalf("Expected the backup shard info of %s to have "+
+				"DaemonId 0x%016x, got 0x%016x.\n", shd.path,
+				uint64(TEST_DAEMON_ID), info.DaemonId)
+		}
+	}
+}
+
+func TestParseDaemonId(t *testing.T) {
+	for _, str := range []string{"0x0123456789abcdef", "81985529216486895"} {
+		daemonId, err := parseDaemonId(str)
+		if err != nil {
+			t.Fatalf("failed to parse %s: %s", str, err.Error())
+		}
+		if daemonId != TEST_DAEMON_ID {
+			t.Fatalf("Parsed %s as 0x%016x.\n", str, daemonId)
+		}
+	}
+	for _, str := range []string{"0", "0x", "bogus", "-1"} {
+		_, err := parseDaemonId(str)
+		if err == nil {
+			t.Fatalf("expected %s to fail to parse.", str)
+		}
+	}
+}
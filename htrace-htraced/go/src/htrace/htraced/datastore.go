@@ -26,8 +26,10 @@ import (
 	"fmt"
 	"github.com/jmhodges/levigo"
 	"github.com/ugorji/go/codec"
+	"hash/fnv"
 	"htrace/common"
 	"htrace/conf"
+	"math"
 	"strconv"
 	"strings"
 	"sync"
@@ -54,6 +56,47 @@ import (
 // e[8-byte-big-endian-end-time][8-byte-big-endian-child-sid] -> {}
 // d[8-byte-big-endian-duration][8-byte-big-endian-child-sid] -> {}
 // p[8-byte-big-endian-parent-sid][8-byte-big-endian-child-sid] -> {}
+// a[8-byte-big-endian-arrival-time][8-byte-big-endian-child-sid] -> {}
+// r[8-byte-big-endian-begin-time][8-byte-big-endian-child-sid] -> {}
+// c[escaped-description][0][8-byte-big-endian-child-sid] -> {}
+// c[escaped-description-prefix][1][3][8-byte-hash][8-byte-big-endian-child-sid] -> {}
+// E[8-byte-big-endian-begin-time][8-byte-big-endian-child-sid] -> {}
+// h[8-byte-big-endian-time] -> HeartbeatMarker (JSON)
+//
+// The r index contains only the spans which have no parents (root spans).
+// Likewise, the E index contains only the spans which failed.  See
+// span_errors.go.
+//
+// In the c index, each 0 byte in the description is escaped as 1 1, and each
+// 1 byte as 1 2, so that the 0 byte after the description always ends it.
+// The escaping preserves the order of descriptions, and the spans with the
+// same description are ordered by span id, so an EQUALS query on the
+// description only reads the keys which start with the escaped description
+// and its 0 byte.  Descriptions longer than index.description.max.bytes are
+// cut short, so that they don't bloat the keys, and the 0 byte is replaced by
+// 1 3 and a 64-bit FNV-1a hash of the whole description.  The limit is
+// recorded in the ShardInfo, since the keys can't be found again with a
+// different one.  Such keys can match a span with a different description
+// whose hash is the same, so the spans they point to are always checked
+// against the query.  Spans marked DescriptionNormalized are indexed by their
+// normalized descriptions instead; see cardinality.go.  Shards which encrypt
+// their spans don't write c entries, since they would give away the
+// descriptions.  See encryption.go.
+// When a span is rewritten, the index entries of the old version which don't
+// apply to the new version are removed.
+//
+// The arrival time is the time, in milliseconds since the epoch, at which the
+// shard wrote the span to leveldb.  Unlike the other indices, arrival time
+// entries are not removed when the span is deleted; instead, the reaper prunes
+// arrival time entries which are older than the reaper date.  Spans written by
+// older versions of htraced have no arrival time entries.
+//
+// Heartbeat markers are only written to the first shard.  See markers.go.
+// So are trace tags.  See trace_tags.go.  So are saved searches.  See
+// saved_searches.go.
+//
+// If encryption is configured, the SpanData in the s records is encrypted.
+// The other records are not.  See encryption.go.
 //
 // Note that span IDs are unsigned 64-bit numbers.
 // Begin times, end times, and durations are signed 64-bit numbers.
@@ -71,6 +114,26 @@ const BEGIN_TIME_INDEX_PREFIX = 'b'
 const END_TIME_INDEX_PREFIX = 'e'
 const DURATION_INDEX_PREFIX = 'd'
 const PARENT_ID_INDEX_PREFIX = 'p'
+const ARRIVAL_TIME_INDEX_PREFIX = 'a'
+const ROOT_INDEX_PREFIX = 'r'
+const DESCRIPTION_INDEX_PREFIX = 'c'
+const HEARTBEAT_MARKER_PREFIX = 'h'
+const SEQUENCE_INDEX_PREFIX = 'q'
+const SPAN_SEQUENCE_PREFIX = 'n'
+const LINKED_TO_INDEX_PREFIX = 'k'
+const LINKED_FROM_INDEX_PREFIX = 'f'
+const AUDIT_LOG_PREFIX = 'u'
+const ACTIVE_SPAN_INDEX_PREFIX = 'o'
+const TRACER_ALIAS_PREFIX = 'i'
+const SLO_DEFINITION_PREFIX = 'v'
+const DESCRIPTION_STATS_PREFIX = 'g'
+const TRACE_TAG_PREFIX = 'j'
+const TRACE_TAGS_BY_ROOT_PREFIX = 'y'
+const SAVED_SEARCH_PREFIX = 'z'
+
+// The lower case letters are all taken.
+const ERROR_INDEX_PREFIX = 'E'
+const WRITE_GROUP_PREFIX = 'W'
 const INVALID_INDEX_PREFIX = 0
 
 // The maximum span expiry time, in milliseconds.
@@ -88,25 +151,117 @@ type IncomingSpan struct {
 	SpanDataBytes []byte
 }
 
+// A batch of spans sent to a shard goroutine.
+type IncomingBatch struct {
+	Spans []*IncomingSpan
+
+	// Tracks the spans for the visibility watermark, or nil if none of them
+	// are tracked.
+	pending *pendingBatch
+
+	// The position of the end of this batch in the shard's intake log, or 0
+	// if it was not logged.
+	intakeEnd int64
+}
+
 // A single directory containing a levelDB instance.
 type shard struct {
 	// The data store that this shard is part of
 	store *dataStore
 
-	// The LevelDB instance.
-	ldb *levigo.DB
+	// The LevelDB instance.  This is nil if the shard could not be opened.
+	ldb shardDB
+
+	// The options for opening the LevelDB instance, if the shard has its own
+	// block cache, or nil if it uses the store's openOpts.
+	openOpts *levigo.Options
+
+	// Protects the lifetime of ldb.  See acquire.
+	ldbLock sync.RWMutex
+
+	// Protects qerr and qtimeMs.
+	qlock sync.Mutex
+
+	// If non-nil, the error which caused this shard to be quarantined.
+	qerr error
+
+	// When the shard was quarantined, in UTC milliseconds since the epoch.
+	qtimeMs int64
 
 	// The path to the leveldb directory this shard is managing.
 	path string
 
 	// Incoming requests to write Spans.
-	incoming chan []*IncomingSpan
+	incoming chan *IncomingBatch
 
 	// A channel for incoming heartbeats
 	heartbeats chan interface{}
 
+	// Batches of tracer renames to run.  See rename.go.
+	renames chan *tracerRenameBatch
+
 	// Tracks whether the shard goroutine has exited.
 	exited sync.WaitGroup
+
+	// Protects writingArrivalMs.
+	arrivalLock sync.Mutex
+
+	// The arrival time of the batch of spans we are currently writing, or 0
+	// if we are not writing anything.
+	writingArrivalMs int64
+
+	// The first sequence number of the batch of spans we are currently
+	// writing, or 0 if we are not writing anything.  Protected by the
+	// sequence number allocator lock.
+	writingSeq uint64
+
+	// True if this shard should write a heartbeat marker on each heartbeat.
+	writeMarkers bool
+
+	// The ShardInfo of this shard, or nil if it has never been loaded.
+	info *ShardInfo
+
+	// The number of spans in this shard.  Accessed atomically.
+	numSpans uint64
+
+	// Non-zero if numSpans needs to be recounted.  Accessed atomically.
+	recountPending int32
+
+	// The bloom filter over the ids of the spans in this shard, or nil if
+	// bloom filters are disabled.  See bloom.go.
+	bloom *spanBloom
+
+	// The latency of the slowest span lookup this shard has answered, in
+	// nanoseconds.  Accessed atomically.  See hedged_reads.go.
+	maxLookupNs uint64
+
+	// The number of lookups of spans placed in this shard which the span
+	// cache did and didn't answer.  Accessed atomically.  See read_cache.go.
+	spanCacheHits   uint64
+	spanCacheMisses uint64
+
+	// The number of spans in this shard per tracer ID, if quotas are
+	// configured.  Only the shard goroutine uses this.  See quotas.go.
+	tracerCounts map[string]uint64
+
+	// True once tracerCounts has been counted from the stored spans.
+	tracerCountsReady bool
+
+	// The cipher for the span records, or nil if the shard has no data key.
+	// See encryption.go.
+	cipher *spanCipher
+
+	// Non-nil if the data key still needs to be rewrapped with the current
+	// master key.  Only the shard goroutine uses this.
+	rewrap *dataKeyRewrap
+
+	// The intake log, or nil if the shard doesn't have one.  See
+	// intake_log.go.
+	intake *intakeLog
+
+	// The begin time before which the spans in this shard have been
+	// downsampled.  Only the shard goroutine uses this.  See downsample.go.
+	downsampledTo int64
 }
 
 // Process incoming spans for a shard.
@@ -116,36 +271,100 @@ func (shd *shard) processIncoming() {
 		lg.Infof("Shard processor for %s exiting.\n", shd.path)
 		shd.exited.Done()
 	}()
+	shd.rewrapDataKey()
 	for {
 		select {
-		case spans := <-shd.incoming:
-			if spans == nil {
+		case ibatch := <-shd.incoming:
+			if ibatch == nil {
 				return
 			}
+			spans := ibatch.Spans
+			if shd.store.testHooks != nil &&
+				shd.store.testHooks.BeforeWriteBatch != nil {
+				shd.store.testHooks.BeforeWriteBatch()
+			}
+			if delay := shd.store.faults.ShardWriteDelay(); delay > 0 {
+				time.Sleep(delay)
+			}
 			totalWritten := 0
 			totalDropped := 0
-			for spanIdx := range spans {
-				err := shd.writeSpan(spans[spanIdx])
-				if err != nil {
-					lg.Errorf("Shard processor for %s got fatal error %s.\n",
-						shd.path, err.Error())
-					totalDropped++
-				} else {
-					if lg.TraceEnabled() {
-						lg.Tracef("Shard processor for %s wrote span %s.\n",
-							shd.path, spans[spanIdx].ToJson())
+			shd.store.writePause.RLock()
+			if shd.acquire() {
+				arrivalMs := shd.beginArrival()
+				var seq, seqLimit uint64
+				if shd.store.seqsEnabled {
+					seq, seqLimit = shd.store.beginSeqs(shd, len(spans))
+				}
+				for spanIdx := range spans {
+					err := shd.store.faults.ShardWriteError(spans[spanIdx].Span)
+					if err == nil {
+						err = shd.writeSpan(spans[spanIdx], arrivalMs, seq,
+							seqLimit)
+					}
+					if seq != 0 {
+						seq++
 					}
-					totalWritten++
+					if err != nil {
+						lg.Errorf("Shard processor for %s got fatal error %s.\n",
+							shd.path, err.Error())
+						shd.checkCorruption(err)
+						totalDropped++
+					} else {
+						if lg.TraceEnabled() {
+							lg.Tracef("Shard processor for %s wrote span %s.\n",
+								shd.path, spans[spanIdx].ToJson())
+						}
+						totalWritten++
+					}
+				}
+				if shd.store.seqsEnabled {
+					shd.store.endSeqs(shd)
 				}
+				if shd.store.maxShardSpans > 0 {
+					shd.evictOldestSpans()
+				}
+				shd.endArrival()
+				shd.release()
+			} else {
+				lg.Warnf("Shard processor for %s dropped %d span(s) because "+
+					"the shard is quarantined.\n", shd.path, len(spans))
+				totalDropped = len(spans)
+				shd.store.msink.UpdateQuarantineDropped(totalDropped)
 			}
-			shd.store.msink.UpdatePersisted(spans[0].Addr, totalWritten, totalDropped)
-			if shd.store.WrittenSpans != nil {
-				lg.Debugf("Shard %s incrementing WrittenSpans by %d\n", shd.path, len(spans))
-				shd.store.WrittenSpans.Posts(int64(len(spans)))
+			shd.store.writePause.RUnlock()
+			if ibatch.intakeEnd != 0 {
+				shd.intake.trim(ibatch.intakeEnd)
 			}
+			shd.store.wmk.done(ibatch.pending)
+			shd.store.msink.UpdatePersisted(spans[0].Addr, totalWritten, totalDropped)
+			shd.store.completions.record(SpanOutcomes{
+				Written: int64(totalWritten),
+				Failed:  int64(totalDropped),
+			})
+		case rb := <-shd.renames:
+			rb.done <- shd.renameTracerBatch(rb)
 		case <-shd.heartbeats:
 			lg.Tracef("Shard processor for %s handling heartbeat.\n", shd.path)
+			if delay := shd.store.faults.HeartbeatDelay(); delay > 0 {
+				time.Sleep(delay)
+			}
+			shd.store.writePause.RLock()
+			if !shd.acquire() {
+				shd.store.writePause.RUnlock()
+				continue
+			}
+			if shd.writeMarkers {
+				shd.writeHeartbeatMarker()
+			}
 			shd.pruneExpired()
+			shd.downsample()
+			shd.pruneExpiredActiveSpans()
+			shd.updateSpanCount()
+			shd.updateQuotaUsage()
+			shd.updateBloom()
+			shd.rewrapDataKey()
+			shd.release()
+			shd.store.writePause.RUnlock()
 		}
 	}
 }
@@ -166,6 +385,8 @@ func (shd *shard) pruneExpired() {
 		}
 	}()
 	urdate := s2u64(shd.store.rpr.GetReaperDate())
+	shd.pruneExpiredKeys(ARRIVAL_TIME_INDEX_PREFIX, urdate, "arrival time")
+	shd.pruneExpiredKeys(HEARTBEAT_MARKER_PREFIX, urdate, "heartbeat marker")
 	for {
 		span := src.next()
 		if span == nil {
@@ -193,32 +414,66 @@ func (shd *shard) pruneExpired() {
 	}
 }
 
+// Remove entries with the given prefix whose time is older than the reaper
+// date.  This is used for key ranges which are ordered by time, such as
+// arrival time index entries.  Returns the number of entries removed.
+func (shd *shard) pruneExpiredKeys(prefix byte, urdate uint64, what string) int {
+	lg := shd.store.rpr.lg
+	endKey := append([]byte{prefix}, u64toSlice(urdate)...)
+	iter := shd.ldb.NewIterator(shd.store.bulkOpts)
+	defer iter.Close()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	numPruned := 0
+	for iter.Seek([]byte{prefix}); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		batch.Delete(key)
+		numPruned++
+	}
+	if numPruned == 0 {
+		return 0
+	}
+	err := shd.ldb.Write(shd.store.writeOpts, batch)
+	if err != nil {
+		lg.Errorf("Error pruning %d %s entries from shd(%s): %s\n",
+			numPruned, what, shd.path, err.Error())
+		return 0
+	}
+	lg.Debugf("Pruned %d %s entries from shard %s\n",
+		numPruned, what, shd.path)
+	return numPruned
+}
+
 // Delete a span from the shard.  Note that leveldb may retain the data until
 // compaction(s) remove it.
 func (shd *shard) DeleteSpan(span *common.Span) error {
-	batch := levigo.NewWriteBatch()
+	batch := shd.ldb.NewWriteBatch()
 	defer batch.Close()
 	primaryKey :=
 		append([]byte{SPAN_ID_INDEX_PREFIX}, span.Id.Val()...)
 	batch.Delete(primaryKey)
-	for parentIdx := range span.Parents {
-		key := append(append([]byte{PARENT_ID_INDEX_PREFIX},
-			span.Parents[parentIdx].Val()...), span.Id.Val()...)
+	for _, key := range spanIndexKeys(span) {
 		batch.Delete(key)
 	}
-	beginTimeKey := append(append([]byte{BEGIN_TIME_INDEX_PREFIX},
-		u64toSlice(s2u64(span.Begin))...), span.Id.Val()...)
-	batch.Delete(beginTimeKey)
-	endTimeKey := append(append([]byte{END_TIME_INDEX_PREFIX},
-		u64toSlice(s2u64(span.End))...), span.Id.Val()...)
-	batch.Delete(endTimeKey)
-	durationKey := append(append([]byte{DURATION_INDEX_PREFIX},
-		u64toSlice(s2u64(span.Duration()))...), span.Id.Val()...)
-	batch.Delete(durationKey)
+	batch.Delete(descriptionIndexKey(span, shd.store.descIndexMaxBytes))
+	seq := shd.findSpanSeq(span.Id)
+	if seq != 0 {
+		batch.Delete(seqIndexKey(seq, span.Id))
+		batch.Delete(spanSeqKey(span.Id))
+	}
+	if shd.store.canary != nil {
+		shd.store.canary.removed(span.Id)
+	}
 	err := shd.ldb.Write(shd.store.writeOpts, batch)
 	if err != nil {
 		return err
 	}
+	shd.store.invalidateCachedSpan(span)
+	shd.decrementSpanCount()
+	shd.adjustTracerCount(span.TracerId, -1)
 	return nil
 }
 
@@ -243,43 +498,229 @@ func u64toSlice(val uint64) []byte {
 		byte(0xff & (val >> 0))}
 }
 
-func (shd *shard) writeSpan(ispan *IncomingSpan) error {
-	batch := levigo.NewWriteBatch()
+func u32toSlice(val uint32) []byte {
+	return []byte{
+		byte(0xff & (val >> 24)),
+		byte(0xff & (val >> 16)),
+		byte(0xff & (val >> 8)),
+		byte(0xff & (val >> 0))}
+}
+
+// Get the value which a span is sorted by in the duration index: the
+// duration in whole milliseconds, followed by the nanoseconds left over.  The
+// nanoseconds are always 0 for spans without nanosecond times, so they sort
+// exactly as they did when the index only held milliseconds.
+func durationIndexValue(span *common.Span) []byte {
+	ms, ns := span.DurationParts()
+	return append(u64toSlice(s2u64(ms)), u32toSlice(uint32(ns))...)
+}
+
+// The maximum number of bytes of a description which go into its description
+// index keys, in shards which don't record it.
+const DEFAULT_DESCRIPTION_INDEX_MAX_BYTES = 256
+
+// Get the value which a description is sorted by in the description index.
+// This is the escaped description, followed by the 0 byte which ends it.  If
+// the description is longer than maxBytes, only that much of it is escaped,
+// followed by 1 3 and a hash of the whole description.  Neither 0 nor 1 3
+// appears in an escaped description, so the value of one description is never
+// a prefix of the value of another.
+func descriptionIndexValue(desc string, maxBytes int) []byte {
+	prefix := desc
+	if len(desc) > maxBytes {
+		prefix = desc[0:maxBytes]
+	}
+	val := make([]byte, 0, len(prefix)+11)
+	for i := 0; i < len(prefix); i++ {
+		switch prefix[i] {
+		case 0:
+			val = append(val, 1, 1)
+		case 1:
+			val = append(val, 1, 2)
+		default:
+			val = append(val, prefix[i])
+		}
+	}
+	if len(prefix) == len(desc) {
+		return append(val, 0)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(desc))
+	return append(append(val, 1, 3), u64toSlice(h.Sum64())...)
+}
+
+func descriptionIndexKey(span *common.Span, maxBytes int) []byte {
+	desc := indexedDescription(span.Description, span.DescriptionNormalized)
+	return append(append([]byte{DESCRIPTION_INDEX_PREFIX},
+		descriptionIndexValue(desc, maxBytes)...), span.Id.Val()...)
+}
+
+// Get the description which a span is indexed by.  We go by the marker stored
+// in the span rather than the current cardinality of its tracer, so that the
+// index entry of a span can be found again after a restart.
+func indexedDescription(desc string, normalized bool) string {
+	if normalized {
+		return normalizeDescription(desc)
+	}
+	return desc
+}
+
+// Get the secondary index keys for a span.  This does not include the arrival
+// time index, which is maintained separately, or the description index, which
+// only some shards have.
+func spanIndexKeys(span *common.Span) [][]byte {
+	parents := indexedParents(span)
+	keys := make([][]byte, 0, len(parents)+4)
+	for parentIdx := range parents {
+		keys = append(keys, append(append([]byte{PARENT_ID_INDEX_PREFIX},
+			parents[parentIdx].Val()...), span.Id.Val()...))
+	}
+	keys = append(keys, append(append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(span.Begin))...), span.Id.Val()...))
+	keys = append(keys, append(append([]byte{END_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(span.End))...), span.Id.Val()...))
+	if !span.IndexSkipped {
+		keys = append(keys, append(append([]byte{DURATION_INDEX_PREFIX},
+			durationIndexValue(span)...), span.Id.Val()...))
+	}
+	if len(span.Parents) == 0 {
+		keys = append(keys, append(append([]byte{ROOT_INDEX_PREFIX},
+			u64toSlice(s2u64(span.Begin))...), span.Id.Val()...))
+	}
+	if span.IsError() {
+		keys = append(keys, errorIndexKey(span))
+	}
+	if span.End == 0 {
+		keys = append(keys, activeSpanKey(span.Begin, span.Id))
+	}
+	return spanLinkKeys(span, keys)
+}
+
+// Get the parents of a span which have parent index entries.  This is all of
+// them, unless the span was wider than index.max.parents when it was written.
+// We go by the marker stored in the span rather than the current limit, so
+// that the index entries of a span can be found again after the limit
+// changes.
+func indexedParents(span *common.Span) []common.SpanId {
+	val, present := span.Info[common.PARENTS_INDEXED_INFO_KEY]
+	if !present {
+		return span.Parents
+	}
+	numIndexed, err := strconv.Atoi(val)
+	if err != nil || numIndexed < 0 || numIndexed >= len(span.Parents) {
+		return span.Parents
+	}
+	return span.Parents[0:numIndexed]
+}
+
+// Write a span to the shard.  If seq is non-zero, the span is given that
+// sequence number, and seqLimit is recorded as the end of the sequence number
+// reservation.
+func (shd *shard) writeSpan(ispan *IncomingSpan, arrivalMs int64,
+	seq uint64, seqLimit uint64) error {
+	batch := shd.ldb.NewWriteBatch()
 	defer batch.Close()
 	span := ispan.Span
 	primaryKey :=
 		append([]byte{SPAN_ID_INDEX_PREFIX}, span.Id.Val()...)
-	batch.Put(primaryKey, ispan.SpanDataBytes)
-
-	// Add this to the parent index.
-	for parentIdx := range span.Parents {
-		key := append(append([]byte{PARENT_ID_INDEX_PREFIX},
-			span.Parents[parentIdx].Val()...), span.Id.Val()...)
-		batch.Put(key, EMPTY_BYTE_BUF)
-	}
-
-	// Add to the other secondary indices.
-	beginTimeKey := append(append([]byte{BEGIN_TIME_INDEX_PREFIX},
-		u64toSlice(s2u64(span.Begin))...), span.Id.Val()...)
-	batch.Put(beginTimeKey, EMPTY_BYTE_BUF)
-	endTimeKey := append(append([]byte{END_TIME_INDEX_PREFIX},
-		u64toSlice(s2u64(span.End))...), span.Id.Val()...)
-	batch.Put(endTimeKey, EMPTY_BYTE_BUF)
-	durationKey := append(append([]byte{DURATION_INDEX_PREFIX},
-		u64toSlice(s2u64(span.Duration()))...), span.Id.Val()...)
-	batch.Put(durationKey, EMPTY_BYTE_BUF)
+	keys := spanIndexKeys(span)
+	if shd.cipher == nil {
+		keys = append(keys,
+			descriptionIndexKey(span, shd.store.descIndexMaxBytes))
+	}
+
+	// If we are rewriting a span, remove the index entries of the old version
+	// which don't apply to the new one.  For example, a span which gains a
+	// parent must be removed from the root index.  The shard goroutine is the
+	// only writer for this shard, so the old version can't change under us.
+	oldSpan := shd.FindSpan(span.Id)
+	if oldSpan != nil {
+		oldKeys := append(spanIndexKeys(oldSpan),
+			descriptionIndexKey(oldSpan, shd.store.descIndexMaxBytes))
+		for _, oldKey := range oldKeys {
+			stale := true
+			for i := range keys {
+				if bytes.Equal(oldKey, keys[i]) {
+					stale = false
+					break
+				}
+			}
+			if stale {
+				batch.Delete(oldKey)
+			}
+		}
+	}
+
+	record := ispan.SpanDataBytes
+	if shd.store.testHooks != nil && shd.store.testHooks.BeforeWriteSpan != nil {
+		record = shd.store.testHooks.BeforeWriteSpan(span, record)
+	}
+	if shd.cipher != nil {
+		var err error
+		record, err = shd.cipher.seal(primaryKey, record)
+		if err != nil {
+			shd.store.lg.Errorf("Error encrypting span %s for %s: %s\n",
+				span.String(), shd.path, err.Error())
+			return err
+		}
+	}
+	batch.Put(primaryKey, record)
+	for i := range keys {
+		batch.Put(keys[i], EMPTY_BYTE_BUF)
+	}
+	arrivalTimeKey := append(append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(arrivalMs))...), span.Id.Val()...)
+	batch.Put(arrivalTimeKey, EMPTY_BYTE_BUF)
+	if seq != 0 {
+		// A rewritten span gets a new sequence number.
+		if oldSpan != nil {
+			oldSeq := shd.findSpanSeq(span.Id)
+			if oldSeq != 0 {
+				batch.Delete(seqIndexKey(oldSeq, span.Id))
+			}
+		}
+		batch.Put(seqIndexKey(seq, span.Id), EMPTY_BYTE_BUF)
+		batch.Put(spanSeqKey(span.Id), u64toSlice(seq))
+		batch.Put([]byte{SEQUENCE_LIMIT_KEY}, u64toSlice(seqLimit))
+	}
 
+	cn := shd.store.canary
+	if cn != nil {
+		cn.beginWrite(span.Id)
+	}
 	err := shd.ldb.Write(shd.store.writeOpts, batch)
 	if err != nil {
+		if cn != nil {
+			cn.endWrite(span.Id, nil)
+		}
 		shd.store.lg.Errorf("Error writing span %s to leveldb at %s: %s\n",
 			span.String(), shd.path, err.Error())
 		return err
 	}
+	if cn != nil {
+		cn.endWrite(span.Id, ispan.SpanDataBytes)
+	}
+	shd.store.invalidateCachedSpan(span)
+	shd.noteDownsampleBegin(span.Begin)
+	if oldSpan != nil {
+		// The old version may have had parents the new one doesn't.
+		shd.store.invalidateCachedSpan(oldSpan)
+	}
+	if oldSpan == nil {
+		atomic.AddUint64(&shd.numSpans, 1)
+		if shd.bloom != nil {
+			shd.bloom.add(span.Id)
+		}
+		shd.adjustTracerCount(span.TracerId, 1)
+	} else if oldSpan.TracerId != span.TracerId {
+		shd.adjustTracerCount(oldSpan.TracerId, -1)
+		shd.adjustTracerCount(span.TracerId, 1)
+	}
 	return nil
 }
 
 func (shd *shard) FindChildren(sid common.SpanId, childIds []common.SpanId,
-	lim int32) ([]common.SpanId, int32, error) {
+	seen map[string]bool, lim int32) ([]common.SpanId, int32, error) {
 	searchKey := append([]byte{PARENT_ID_INDEX_PREFIX}, sid.Val()...)
 	iter := shd.ldb.NewIterator(shd.store.readOpts)
 	defer iter.Close()
@@ -296,8 +737,13 @@ func (shd *shard) FindChildren(sid common.SpanId, childIds []common.SpanId,
 			break
 		}
 		id := common.SpanId(key[17:])
-		childIds = append(childIds, id)
-		lim--
+		// Spans written by older versions of htraced may list themselves
+		// as their own parents, or list the same parent more than once.
+		if !id.Equal(sid) && !seen[string(id)] {
+			seen[string(id)] = true
+			childIds = append(childIds, id)
+			lim--
+		}
 		iter.Next()
 	}
 	return childIds, lim, nil
@@ -306,10 +752,28 @@ func (shd *shard) FindChildren(sid common.SpanId, childIds []common.SpanId,
 // Close a shard.
 func (shd *shard) Close() {
 	lg := shd.store.lg
-	shd.incoming <- nil
-	lg.Infof("Waiting for %s to exit...\n", shd.path)
-	shd.exited.Wait()
-	shd.ldb.Close()
+	if !shd.store.readOnly {
+		shd.incoming <- nil
+		lg.Infof("Waiting for %s to exit...\n", shd.path)
+		shd.exited.Wait()
+	}
+	shd.ldbLock.Lock()
+	if shd.ldb != nil {
+		if !shd.isQuarantined() && !shd.store.readOnly {
+			shd.saveBloom(true)
+			shd.saveSpanCount(true)
+		}
+		shd.ldb.Close()
+		shd.ldb = nil
+	}
+	shd.ldbLock.Unlock()
+	if shd.openOpts != nil {
+		shd.openOpts.Close()
+		shd.openOpts = nil
+	}
+	if shd.intake != nil {
+		shd.intake.Close()
+	}
 	lg.Infof("Closed %s...\n", shd.path)
 }
 
@@ -408,6 +872,17 @@ func (rpr *Reaper) handleHeartbeat() {
 	}
 }
 
+// Change the number of milliseconds to keep spans around.  The reaper date is
+// never moved backwards, so spans which have already been reaped stay reaped.
+func (rpr *Reaper) SetSpanExpiryMs(spanExpiryMs int64) {
+	if spanExpiryMs <= 0 || spanExpiryMs >= MAX_SPAN_EXPIRY_MS {
+		spanExpiryMs = MAX_SPAN_EXPIRY_MS
+	}
+	rpr.lock.Lock()
+	defer rpr.lock.Unlock()
+	rpr.spanExpiryMs = spanExpiryMs
+}
+
 func (rpr *Reaper) GetReaperDate() int64 {
 	rpr.lock.Lock()
 	defer rpr.lock.Unlock()
@@ -435,13 +910,27 @@ type dataStore struct {
 	// The read options to use for LevelDB.
 	readOpts *levigo.ReadOptions
 
+	// The read options for the range scans of queries.  These only fill the
+	// block cache if leveldb.scan.fill.cache is set, so that big scans don't
+	// evict the blocks which span lookups use.
+	scanOpts *levigo.ReadOptions
+
+	// The read options for maintenance scans, such as those of the reaper
+	// and scan jobs, which read many blocks once.  These never fill the
+	// block cache.
+	bulkOpts *levigo.ReadOptions
+
 	// The write options to use for LevelDB.
 	writeOpts *levigo.WriteOptions
 
-	// If non-null, a semaphore we will increment once for each span we receive.
-	// Used for testing.
+	// If non-null, a semaphore we will increment once for each span we receive,
+	// whether it is written, rejected, or fails.  Used for testing.
 	WrittenSpans *common.Semaphore
 
+	// Accounts for what happened to each span we receive.  See
+	// completions.go.
+	completions *spanCompletions
+
 	// The metrics sink.
 	msink *MetricsSink
 
@@ -451,8 +940,285 @@ type dataStore struct {
 	// The reaper for this datastore
 	rpr *Reaper
 
+	// Samples the Go runtime statistics for ServerStats.
+	rsc *RuntimeStatsCollector
+
 	// When this datastore was started (in UTC milliseconds since the epoch)
 	startMs int64
+
+	// The options to use for reopening quarantined shards.
+	openOpts *levigo.Options
+
+	// The ShardInfo which all shards are expected to have, apart from the
+	// ShardIndex.
+	shardInfo ShardInfo
+
+	// Decides which shard each span is stored in.
+	placement Placement
+
+	// What to do with spans destined for a quarantined shard.  One of the
+	// QUARANTINE_POLICY_* constants.
+	quarantinePolicy string
+
+	// Set to 1 once any span has been redirected away from a quarantined
+	// shard.  After that, a span may not be in the shard its id hashes to.
+	redirected int32
+
+	// True if we assign sequence numbers to the spans we write.
+	seqsEnabled bool
+
+	// Allocates sequence numbers.  See sequence.go.
+	seqs seqAllocator
+
+	// Suppresses repeated log messages about the spans we ingest.
+	ingestLog *common.LogSuppressor
+
+	// The datastore backend.  One of the DATASTORE_BACKEND_* constants.
+	backend string
+
+	// True if we should break stale shard directory locks when reopening a
+	// quarantined shard.
+	stealLocks bool
+
+	// The maximum number of spans we will hold, or 0 if there is no limit.
+	// Only the memory backend has a limit.
+	maxSpans uint64
+
+	// The maximum number of spans each shard will hold, or 0 if there is no
+	// limit.
+	maxShardSpans uint64
+
+	// The total number of spans evicted because the datastore was full.
+	// Accessed atomically.
+	evictedSpans uint64
+
+	// The number of spans replayed from the intake logs at startup, and how
+	// long it took.  See intake_log.go.
+	intakeReplayedSpans uint64
+	intakeReplayMs      uint64
+
+	// The number of times a batch of spans waited for room in a full intake
+	// log.  Accessed atomically.
+	intakeLogWaits uint64
+
+	// Records the WriteSpans requests we handle.  See audit.go.
+	audit *auditLog
+
+	// Keeps examples of the spans we reject as invalid.  See rejections.go.
+	rejections *rejectionLog
+
+	// True if spans which end before they begin are rejected.
+	validateTimes bool
+
+	// What to do with spans which end before they begin.  One of the
+	// NEGATIVE_DURATION_POLICY_* constants.  See negative_durations.go.
+	negDurationPolicy string
+
+	// The limits on the info maps of incoming spans, and what to do with
+	// spans which break them.  One of the INFO_POLICY_* constants.  See
+	// info_validation.go.
+	infoMaxKeyBytes int
+	infoMaxKeys     int
+	infoPolicy      string
+
+	// The number of goroutines in each stage of the REST ingest pipeline.
+	// See ingest_pipeline.go.
+	ingestDecodeWorkers   int
+	ingestValidateWorkers int
+
+	// Checks that a sample of the spans we write can be read back.  Nil if
+	// the canary is disabled.  See canary.go.
+	canary *canary
+
+	// Recently read spans and children lists.  Nil if the cache is
+	// disabled.  See read_cache.go.
+	spanCache     *readCache
+	childrenCache *readCache
+
+	// How long a lookup which asks every shard waits for the slowest one, or
+	// 0 to wait indefinitely.  See hedged_reads.go.
+	findSpanDeadline time.Duration
+
+	// Bounds the number of lookups which FindSpans has in flight.
+	findSpansSem chan struct{}
+
+	// Hedged lookup counters.  Accessed atomically.
+	hedgedLookups        uint64
+	hedgeCancels         uint64
+	lookupDeadlineMisses uint64
+
+	// The maximum number of spans and bytes in a single WriteSpans request,
+	// or 0 if there is no limit.
+	writeMaxSpans int
+	writeMaxBytes int
+
+	// How long a span can stay in the active span index, or 0 if there is no
+	// limit.  See active.go.
+	activeSpanMaxAgeMs int64
+
+	// The total number of spans removed from the active span index because
+	// they never finished.  Accessed atomically.
+	expiredActiveSpans uint64
+
+	// True if we record the address of the client which sent each span in
+	// the span's info map.
+	stampSourceAddr bool
+
+	// True if queries may scan only some of the shards.
+	shardFilterEnabled bool
+
+	// The limit used for queries which don't set one.
+	queryDefaultLim int
+
+	// The maximum limit a query can have.
+	queryMaxLim int
+
+	// If true, queries read from the indexed predicate which is estimated to
+	// read the fewest rows.  See query_plan.go.
+	plannerStats bool
+
+	// The maximum number of index entries counted in each shard when
+	// estimating rows.
+	plannerSampleMax int
+
+	// Finished spans shorter than this are left out of the duration index.
+	indexMinDurationMs int64
+
+	// Tracer IDs whose spans are always fully indexed.
+	indexFullTracers map[string]bool
+
+	// The maximum number of parents of a span which are indexed, or 0 if
+	// there is no limit.
+	indexMaxParents int
+
+	// The maximum number of bytes of a description in its description index
+	// key.  This is index.description.max.bytes, unless we are read-only and
+	// the shards recorded a different limit.
+	descIndexMaxBytes int
+
+	// Decides which of the spans we ingest failed.
+	errorRules *spanErrorRules
+
+	// The size of each shard's bloom filter, or 0 if bloom filters are
+	// disabled.
+	bloomBits uint64
+
+	// The number of hash functions the bloom filters use.
+	bloomHashes uint32
+
+	// True if the datastore was opened with read.only set.  There are no
+	// shard goroutines, and nothing writes to the shards, so callers must
+	// reject span writes rather than calling WriteSpans.
+	readOnly bool
+
+	// The shard goroutines hold this for reading while they write.  Taking it
+	// for writing pauses all writes, so that every shard is at the same
+	// point.  See snapshot.go.
+	writePause sync.RWMutex
+
+	// Protects snap.
+	snapLock sync.Mutex
+
+	// The most recent snapshot, or nil if we have not taken one.
+	snap *snapshotJob
+
+	// Tracks the spans which have not been written yet, for the visibility
+	// watermark.  See watermark.go.
+	wmk *watermarkTracker
+
+	// The span quotas, or nil if none are configured.  See quotas.go.
+	quotas *quotaTracker
+
+	// Downsamples old spans, or nil if downsampling is disabled.  See
+	// downsample.go.
+	dsmp *downsampler
+
+	// Injects faults in chaos mode.  See chaos.go.
+	faults FaultInjector
+
+	// Decides which requests are allowed.  See auth.go.
+	auth *authorizer
+
+	// Whether ingestion is paused.  See ingest_pause.go.
+	pause *ingestPause
+
+	// Protects rename.
+	renameLock sync.Mutex
+
+	// The most recent tracer rename, or nil if we have not run one.  See
+	// rename.go.
+	rename *tracerRenameJob
+
+	// The number of spans a tracer rename scans in each batch.
+	renameBatchSize int
+
+	// The maximum number of spans per second a tracer rename scans, or 0 if
+	// there is no limit.
+	renameMaxRate int
+
+	// Protects scan.
+	scanLock sync.Mutex
+
+	// The most recent scan job, or nil if we have not run one.  See
+	// scan_jobs.go.
+	scan *scanJob
+
+	// The number of spans a scan job reads from a shard at a time.
+	scanBatchSize int
+
+	// The maximum number of spans per second a scan job reads, or 0 if there
+	// is no limit.
+	scanMaxRate int
+
+	// The tracer aliases.  See rename.go.
+	aliases *tracerAliases
+
+	// True if the ingestors apply the tracer aliases.
+	aliasesEnabled bool
+
+	// The latency SLOs.  See slo.go.
+	slos *sloTracker
+
+	// The trace tags.  See trace_tags.go.
+	tags *traceTagger
+
+	// The saved searches.  See saved_searches.go.
+	searches *savedSearches
+
+	// The write groups.  See write_groups.go.
+	writeGroups *writeGroupTracker
+
+	// The per-description latency statistics, or nil if they are disabled.
+	// See description_stats.go.
+	descStats *descStatsTracker
+
+	// The HRPC methods which the HRPC server supports, or 0 if there is no
+	// HRPC server.  Accessed via sync/atomic.
+	hrpcMethods uint64
+
+	// The address the HRPC server listens on, or the empty string if there
+	// is no HRPC server.  Holds a string.
+	hrpcAddr atomic.Value
+
+	// The test hooks to use, or nil during normal operation.
+	testHooks *datastoreTestHooks
+}
+
+type datastoreTestHooks struct {
+	// A callback the shard goroutines make before writing each batch of
+	// spans.
+	BeforeWriteBatch func()
+
+	// A callback which can replace the span data a shard is about to write.
+	BeforeWriteSpan func(span *common.Span, record []byte) []byte
+
+	// A callback which can change the query planner's row estimates before
+	// it chooses a source.
+	PlannerEstimates func(estimates []common.PlanEstimate)
+
+	// A callback made before each query runs.  If it returns an error, the
+	// query fails with that error.
+	BeforeQuery func(query *common.Query) error
 }
 
 func CreateDataStore(cnf *conf.Config, writtenSpans *common.Semaphore) (*dataStore, error) {
@@ -463,44 +1229,277 @@ func CreateDataStore(cnf *conf.Config, writtenSpans *common.Semaphore) (*dataSto
 		dld.lg.Errorf("Error loading datastore: %s\n", err.Error())
 		return nil, err
 	}
+	quarantinePolicy := cnf.Get(conf.HTRACE_DATASTORE_QUARANTINE_POLICY)
+	if quarantinePolicy != QUARANTINE_POLICY_REDIRECT &&
+		quarantinePolicy != QUARANTINE_POLICY_DROP {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+			"Expected '%s' or '%s'.", conf.HTRACE_DATASTORE_QUARANTINE_POLICY,
+			quarantinePolicy, QUARANTINE_POLICY_REDIRECT, QUARANTINE_POLICY_DROP))
+	}
+	infoPolicy := cnf.Get(conf.HTRACE_INGEST_INFO_POLICY)
+	if infoPolicy != INFO_POLICY_STRIP && infoPolicy != INFO_POLICY_REJECT {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+			"Expected '%s' or '%s'.", conf.HTRACE_INGEST_INFO_POLICY,
+			infoPolicy, INFO_POLICY_STRIP, INFO_POLICY_REJECT))
+	}
+	negDurationPolicy := cnf.Get(conf.HTRACE_INGEST_NEG_DURATION_POLICY)
+	if negDurationPolicy != NEGATIVE_DURATION_POLICY_REJECT &&
+		negDurationPolicy != NEGATIVE_DURATION_POLICY_CLAMP &&
+		negDurationPolicy != NEGATIVE_DURATION_POLICY_EXCLUDE {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+			"Expected '%s', '%s', or '%s'.",
+			conf.HTRACE_INGEST_NEG_DURATION_POLICY, negDurationPolicy,
+			NEGATIVE_DURATION_POLICY_REJECT, NEGATIVE_DURATION_POLICY_CLAMP,
+			NEGATIVE_DURATION_POLICY_EXCLUDE))
+	}
+	intakeSyncAlways, err := checkIntakeSyncPolicy(cnf)
+	if err != nil {
+		return nil, err
+	}
 	store := &dataStore{
 		lg:           dld.lg,
 		shards:       make([]*shard, len(dld.shards)),
 		readOpts:     dld.readOpts,
 		writeOpts:    dld.writeOpts,
 		WrittenSpans: writtenSpans,
+		completions:  &spanCompletions{sem: writtenSpans},
 		msink:        NewMetricsSink(cnf),
 		hb: NewHeartbeater("DatastoreHeartbeater",
 			cnf.GetInt64(conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS), dld.lg),
-		rpr:     NewReaper(cnf),
-		startMs: common.TimeToUnixMs(time.Now().UTC()),
+		rpr:                NewReaper(cnf),
+		rsc:                NewRuntimeStatsCollector(cnf),
+		startMs:            common.TimeToUnixMs(time.Now().UTC()),
+		openOpts:           dld.openOpts,
+		shardInfo:          *dld.firstShardInfo(),
+		quarantinePolicy:   quarantinePolicy,
+		seqsEnabled:        cnf.GetBool(conf.HTRACE_DATASTORE_SEQUENCE_NUMBERS),
+		backend:            dld.backend,
+		stealLocks:         dld.stealLocks,
+		activeSpanMaxAgeMs: cnf.GetInt64(conf.HTRACE_ACTIVE_SPAN_MAX_AGE_MS),
+		stampSourceAddr:    cnf.GetBool(conf.HTRACE_SPAN_SOURCE_ADDR),
+		shardFilterEnabled: cnf.GetBool(conf.HTRACE_QUERY_SHARD_FILTER_ENABLED),
+		readOnly:           cnf.GetBool(conf.HTRACE_READ_ONLY),
+		renameBatchSize:    cnf.GetInt(conf.HTRACE_TRACER_RENAME_BATCH_SIZE),
+		renameMaxRate:      cnf.GetInt(conf.HTRACE_TRACER_RENAME_MAX_RATE),
+		scanBatchSize:      cnf.GetInt(conf.HTRACE_SCAN_JOB_BATCH_SIZE),
+		scanMaxRate:        cnf.GetInt(conf.HTRACE_SCAN_JOB_MAX_RATE),
+		spanCache:          newReadCache(cnf.GetInt64(conf.HTRACE_SPAN_CACHE_BYTES)),
+		childrenCache: newReadCache(
+			cnf.GetInt64(conf.HTRACE_CHILDREN_CACHE_BYTES)),
+		findSpanDeadline: time.Millisecond *
+			time.Duration(cnf.GetInt64(conf.HTRACE_FIND_SPAN_DEADLINE_MS)),
+		findSpansSem: make(chan struct{},
+			findSpansConcurrency(cnf.GetInt(conf.HTRACE_FIND_SPANS_CONCURRENCY))),
+		aliasesEnabled:     cnf.GetBool(conf.HTRACE_TRACER_ALIASES_ENABLED),
+		indexMinDurationMs: cnf.GetInt64(conf.HTRACE_INDEX_MIN_DURATION_MS),
+		indexFullTracers:   make(map[string]bool),
+		indexMaxParents:    cnf.GetInt(conf.HTRACE_INDEX_MAX_PARENTS),
+		descIndexMaxBytes:  dld.descIndexMaxBytes,
+		errorRules:         newSpanErrorRules(cnf),
+		wmk: newWatermarkTracker(
+			cnf.GetInt64(conf.HTRACE_WATERMARK_LATENESS_MS),
+			cnf.GetBool(conf.HTRACE_WATERMARK_REJECT_LATE)),
+	}
+	store.scanOpts = levigo.NewReadOptions()
+	store.scanOpts.SetFillCache(
+		cnf.GetBool(conf.HTRACE_LEVELDB_SCAN_FILL_CACHE))
+	store.scanOpts.SetVerifyChecksums(false)
+	store.bulkOpts = levigo.NewReadOptions()
+	store.bulkOpts.SetFillCache(false)
+	store.bulkOpts.SetVerifyChecksums(false)
+	for _, trid := range strings.Split(
+		cnf.Get(conf.HTRACE_INDEX_FULL_TRACERS), ",") {
+		trid = strings.TrimSpace(trid)
+		if trid != "" {
+			store.indexFullTracers[trid] = true
+		}
+	}
+	if store.renameBatchSize < 1 {
+		store.renameBatchSize = 1
+	}
+	if store.scanBatchSize < 1 {
+		store.scanBatchSize = 1
+	}
+	store.bloomBits, store.bloomHashes = bloomParamsFromConf(cnf)
+	store.queryMaxLim = cnf.GetInt(conf.HTRACE_QUERY_MAX_LIM)
+	if store.queryMaxLim < 1 {
+		store.queryMaxLim = 1
+	}
+	store.queryDefaultLim = cnf.GetInt(conf.HTRACE_QUERY_DEFAULT_LIM)
+	if store.queryDefaultLim < 1 || store.queryDefaultLim > store.queryMaxLim {
+		store.queryDefaultLim = store.queryMaxLim
+	}
+	store.plannerStats = cnf.GetBool(conf.HTRACE_QUERY_PLANNER_STATS)
+	store.plannerSampleMax = cnf.GetInt(conf.HTRACE_QUERY_PLANNER_SAMPLE_MAX)
+	if store.plannerSampleMax < 1 {
+		store.plannerSampleMax = 1
+	}
+	store.faults, err = NewFaultInjector(cnf, store.lg)
+	if err != nil {
+		return nil, err
+	}
+	store.auth, err = newAuthorizer(cnf, store.lg, store.msink)
+	if err != nil {
+		return nil, err
+	}
+	if !store.readOnly {
+		store.quotas, err = newQuotaTracker(cnf, len(store.shards))
+		if err != nil {
+			return nil, err
+		}
+		store.dsmp, err = newDownsampler(cnf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	store.placement, err = NewPlacement(store.shardInfo.placementName(),
+		len(store.shards))
+	if err != nil {
+		return nil, err
+	}
+	if store.backend == DATASTORE_BACKEND_MEMORY {
+		maxSpans := cnf.GetInt64(conf.HTRACE_DATASTORE_MEMORY_MAX_SPANS)
+		if maxSpans > 0 {
+			numShards := uint64(len(store.shards))
+			store.maxSpans = uint64(maxSpans)
+			store.maxShardSpans = (store.maxSpans + numShards - 1) / numShards
+		}
+	}
+	store.audit = newAuditLog(store, cnf)
+	store.rejections = newRejectionLog(cnf)
+	store.pause = newIngestPause(store.lg)
+	store.validateTimes = cnf.GetBool(conf.HTRACE_INGEST_VALIDATE_TIMES)
+	if store.validateTimes {
+		negDurationPolicy = NEGATIVE_DURATION_POLICY_REJECT
+	}
+	store.validateTimes = negDurationPolicy == NEGATIVE_DURATION_POLICY_REJECT
+	store.negDurationPolicy = negDurationPolicy
+	store.infoMaxKeyBytes = cnf.GetInt(conf.HTRACE_INGEST_INFO_MAX_KEY_BYTES)
+	store.infoMaxKeys = cnf.GetInt(conf.HTRACE_INGEST_INFO_MAX_KEYS)
+	store.infoPolicy = infoPolicy
+	store.ingestDecodeWorkers = ingestConcurrency(cnf,
+		conf.HTRACE_INGEST_DECODE_CONCURRENCY)
+	store.ingestValidateWorkers = ingestConcurrency(cnf,
+		conf.HTRACE_INGEST_VALIDATE_CONCURRENCY)
+	store.writeMaxSpans = cnf.GetInt(conf.HTRACE_WRITE_SPANS_MAX_SPANS)
+	if store.writeMaxSpans < 0 {
+		store.writeMaxSpans = 0
 	}
+	store.writeMaxBytes = cnf.GetInt(conf.HTRACE_WRITE_SPANS_MAX_BYTES)
+	if store.writeMaxBytes < 0 {
+		store.writeMaxBytes = 0
+	}
+	store.ingestLog = common.NewLogSuppressor(store.lg,
+		cnf.GetInt64(conf.HTRACE_LOG_SUPPRESSION_PERIOD_MS),
+		cnf.GetInt(conf.HTRACE_LOG_SUPPRESSION_MAX_KEYS))
 	spanBufferSize := cnf.GetInt(conf.HTRACE_DATA_STORE_SPAN_BUFFER_SIZE)
 	for shdIdx := range store.shards {
 		shd := &shard{
 			store:      store,
 			ldb:        dld.shards[shdIdx].ldb,
+			openOpts:   dld.shards[shdIdx].openOpts,
 			path:       dld.shards[shdIdx].path,
-			incoming:   make(chan []*IncomingSpan, spanBufferSize),
+			incoming:   make(chan *IncomingBatch, spanBufferSize),
 			heartbeats: make(chan interface{}, 1),
+			renames:    make(chan *tracerRenameBatch),
+			writeMarkers: shdIdx == 0 &&
+				cnf.GetBool(conf.HTRACE_DATASTORE_HEARTBEAT_MARKERS),
+			qerr:   dld.shards[shdIdx].quarantineErr,
+			cipher: dld.shards[shdIdx].cipher,
+			rewrap: dld.shards[shdIdx].rewrap,
+		}
+		if store.quotas != nil {
+			shd.tracerCounts = make(map[string]uint64)
+		}
+		if shd.qerr != nil {
+			shd.qtimeMs = store.startMs
+		} else {
+			shd.loadSpanCount(dld.shards[shdIdx].info)
+			shd.loadBloom()
+		}
+		store.shards[shdIdx] = shd
+	}
+	if cnf.GetBool(conf.HTRACE_INTAKE_LOG_ENABLED) && !store.readOnly &&
+		store.backend != DATASTORE_BACKEND_MEMORY {
+		err = store.openIntakeLogs(
+			cnf.GetInt64(conf.HTRACE_INTAKE_LOG_MAX_BYTES), intakeSyncAlways)
+		if err != nil {
+			store.closeIntakeLogs()
+			return nil, err
+		}
+	}
+	// The shard goroutines report to the canary, so it must exist before
+	// they start.
+	store.canary = newCanary(store, cnf)
+	// Without shard goroutines, nothing ingests, reaps, or recounts spans in
+	// a read-only datastore.
+	for _, shd := range store.shards {
+		if store.readOnly {
+			break
 		}
 		shd.exited.Add(1)
 		go shd.processIncoming()
-		store.shards[shdIdx] = shd
 		store.hb.AddHeartbeatTarget(&HeartbeatTarget{
 			name:       fmt.Sprintf("shard(%s)", shd.path),
 			targetChan: shd.heartbeats,
 		})
 	}
-	dld.DisownResources()
-	return store, nil
-}
-
+	if store.seqsEnabled {
+		store.loadSeqLimit()
+	}
+	store.replayIntakeLogs()
+	store.loadTracerAliases()
+	if !store.readOnly {
+		store.resumeTracerRename()
+	}
+	store.msink.StartHistoryRotation(store.hb)
+	store.slos = newSloTracker(store, cnf)
+	store.slos.load()
+	store.slos.Start(store.hb)
+	store.tags = newTraceTagger(store, cnf)
+	store.tags.Start(store.hb)
+	store.searches = newSavedSearches(store, cnf)
+	store.searches.load()
+	store.writeGroups = newWriteGroupTracker(store, cnf)
+	store.writeGroups.load()
+	if !store.readOnly {
+		store.writeGroups.Start(store.hb)
+	}
+	store.descStats = newDescStatsTracker(store, cnf)
+	if store.descStats != nil {
+		store.descStats.load()
+		if !store.readOnly {
+			store.descStats.Start(store.hb)
+		}
+	}
+	dld.DisownResources()
+	return store, nil
+}
+
 // Close the DataStore.
 func (store *dataStore) Close() {
+	store.stopTracerRename()
+	store.stopScanJob()
+	if store.canary != nil {
+		store.canary.Stop()
+		store.canary = nil
+	}
 	if store.hb != nil {
 		store.hb.Shutdown()
 		store.hb = nil
+		store.msink.StopHistoryRotation()
+		if store.slos != nil {
+			store.slos.Stop()
+		}
+		if store.tags != nil {
+			store.tags.Stop()
+		}
+		if store.writeGroups != nil {
+			store.writeGroups.Stop()
+		}
+		if store.descStats != nil {
+			store.descStats.Stop()
+		}
 	}
 	for idx := range store.shards {
 		if store.shards[idx] != nil {
@@ -512,14 +1511,34 @@ func (store *dataStore) Close() {
 		store.rpr.Shutdown()
 		store.rpr = nil
 	}
+	if store.rsc != nil {
+		store.rsc.Shutdown()
+		store.rsc = nil
+	}
 	if store.readOpts != nil {
 		store.readOpts.Close()
 		store.readOpts = nil
 	}
+	if store.scanOpts != nil {
+		store.scanOpts.Close()
+		store.scanOpts = nil
+	}
+	if store.bulkOpts != nil {
+		store.bulkOpts.Close()
+		store.bulkOpts = nil
+	}
 	if store.writeOpts != nil {
 		store.writeOpts.Close()
 		store.writeOpts = nil
 	}
+	if store.openOpts != nil {
+		store.openOpts.Close()
+		store.openOpts = nil
+	}
+	if store.ingestLog != nil {
+		store.ingestLog.Close()
+		store.ingestLog = nil
+	}
 	if store.lg != nil {
 		store.lg.Close()
 		store.lg = nil
@@ -528,7 +1547,87 @@ func (store *dataStore) Close() {
 
 // Get the index of the shard which stores the given spanId.
 func (store *dataStore) getShardIndex(sid common.SpanId) int {
-	return int(sid.Hash32() % uint32(len(store.shards)))
+	return store.placement.Choose(sid)
+}
+
+// A Placement decides which shard each span is stored in.
+//
+// The placement strategy is chosen when the datastore is created, and recorded
+// in the ShardInfo of every shard.  Changing the strategy of an existing
+// datastore would make most spans unreachable, so we always use the recorded
+// strategy, rather than the configured one.
+type Placement interface {
+	// Get the index of the shard which stores the given span.
+	Choose(sid common.SpanId) int
+
+	// Get the name of the strategy, as recorded in the ShardInfo.
+	Name() string
+}
+
+// Place spans by taking the 32-bit FNV hash of their id modulo the number of
+// shards.  This is what htraced has always done.  Adding a shard moves almost
+// every span.
+const PLACEMENT_MODULO = "modulo"
+
+// Place spans with jump consistent hashing.  Adding a shard moves only the
+// spans which belong in the new shard.
+const PLACEMENT_JUMP = "jump"
+
+// Create a placement for the given number of shards.
+func NewPlacement(name string, numShards int) (Placement, error) {
+	if numShards <= 0 {
+		return nil, errors.New(fmt.Sprintf("Can't place spans in %d shards.",
+			numShards))
+	}
+	switch name {
+	case PLACEMENT_MODULO:
+		return &moduloPlacement{numShards: uint32(numShards)}, nil
+	case PLACEMENT_JUMP:
+		return &jumpPlacement{numShards: int64(numShards)}, nil
+	default:
+		return nil, errors.New(fmt.Sprintf("Unknown placement strategy "+
+			"'%s'.  Expected '%s' or '%s'.", name, PLACEMENT_MODULO,
+			PLACEMENT_JUMP))
+	}
+}
+
+type moduloPlacement struct {
+	numShards uint32
+}
+
+func (plc *moduloPlacement) Choose(sid common.SpanId) int {
+	return int(sid.Hash32() % plc.numShards)
+}
+
+func (plc *moduloPlacement) Name() string {
+	return PLACEMENT_MODULO
+}
+
+type jumpPlacement struct {
+	numShards int64
+}
+
+// Choose a shard using the algorithm from "A Fast, Minimal Memory, Consistent
+// Hash Algorithm" by Lamping and Veach.  The key is the 64-bit FNV-1a hash of
+// the span id.
+func (plc *jumpPlacement) Choose(sid common.SpanId) int {
+	key := uint64(14695981039346656037)
+	for _, b := range sid.Val() {
+		key ^= uint64(b)
+		key *= 1099511628211
+	}
+	var b, j int64 = -1, 0
+	for j < plc.numShards {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) /
+			float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+func (plc *jumpPlacement) Name() string {
+	return PLACEMENT_JUMP
 }
 
 const WRITESPANS_BATCH_SIZE = 128
@@ -546,6 +1645,10 @@ type SpanIngestor struct {
 	// The logger to use.
 	lg *common.Logger
 
+	// The log suppressor to use for warnings about the spans we ingest.  A
+	// misbehaving client can trigger a lot of these.
+	slg *common.LogSuppressor
+
 	// The dataStore we are ingesting spans into.
 	store *dataStore
 
@@ -576,17 +1679,115 @@ type SpanIngestor struct {
 
 	// The total number of spans the ingestor dropped because of a server-side error.
 	serverDropped int
+
+	// The total number of duplicate parent IDs the ingestor removed.
+	duplicateParents int
+
+	// The total number of self-referencing parent IDs the ingestor removed.
+	selfParents int
+
+	// The total number of invalid, duplicate, or self-referencing links the
+	// ingestor removed.
+	badLinks int
+
+	// The total number of spans the ingestor dropped because their shard was
+	// quarantined.  These are also counted in serverDropped.
+	quarantineDropped int
+
+	// The total number of spans the ingestor dropped because of a failure,
+	// rather than because there was something wrong with them.  These are
+	// also counted in serverDropped.
+	failed int
+
+	// The total number of spans the ingestor left out of the duration index
+	// because they were shorter than index.min.duration.ms.
+	indexSkipped int
+
+	// The total number of spans the ingestor saw which ended before they
+	// began, and the one which ended the furthest before it began.
+	negativeDurations int
+	worstNegative     *common.Span
+	worstNegativeMs   int64
+
+	// The total number of spans which had more parents than
+	// index.max.parents, so that only some of them were indexed.
+	parentIndexTruncated int
+
+	// The number of parents of each span the ingestor accepted, in order.
+	parentCounts []uint32
+
+	// The span with the most parents the ingestor has seen, or nil.
+	widestSpan *common.Span
+
+	// The total number of invalid info entries the ingestor removed, not
+	// counting reserved keys.
+	infoStripped int
+
+	// The total number of info keys with the reserved prefix which the
+	// client sent.
+	reservedInfoKeys int
+
+	// The total number of spans the ingestor dropped because their tracer was
+	// over a quota with the reject policy.  These are also counted in
+	// serverDropped.
+	quotaRejected int
+
+	// The total number of spans the ingestor dropped because their tracer was
+	// over a quota with the sample policy.  These are also counted in
+	// serverDropped.
+	quotaSampledOut int
+
+	// The number of spans the ingestor accepted with each span flag set,
+	// indexed by flag bit.
+	flagged [common.NUM_SPAN_FLAGS]int
+
+	// Maps tracer IDs to the index of the quota rule they count against, or
+	// -1 if there is none.  Matching the patterns for every span would be
+	// expensive, and an ingestor usually sees only a few tracer IDs.
+	quotaRules map[string]int
+
+	// If this is non-empty, we write an audit entry for the spans we ingested
+	// when the ingestor is closed.  It is one of the AUDIT_TRANSPORT_*
+	// constants.
+	auditTransport string
+
+	// The metadata to record in the audit entry.
+	auditMetadata map[string]string
+
+	// The transport the spans arrive on, for the rejection log.
+	transport string
+
+	// The principal which sent the spans, or the empty string if it isn't
+	// known.
+	principal string
+
+	// The number of spans the ingestor stamped with the principal.
+	principalSpans int
+
+	// The number of failed spans the ingestor accepted from each tracer, or
+	// nil if there were none.
+	errors map[string]int
+
+	// The write groups declared by the request, or nil if there are none.
+	writeGroups []common.WriteGroup
+
+	// The IDs of the spans the ingestor accepted, if there are write groups.
+	grouped []common.SpanId
 }
 
 // A batch of spans destined for a particular shard.
 type SpanIngestorBatch struct {
 	incoming []*IncomingSpan
+
+	// Tracks the spans in this batch for the visibility watermark.
+	pending *pendingBatch
 }
 
 func (store *dataStore) NewSpanIngestor(lg *common.Logger,
 	addr string, defaultTrid string) *SpanIngestor {
 	ing := &SpanIngestor{
 		lg:            lg,
+		slg:           store.ingestLog,
 		store:         store,
 		addr:          addr,
 		defaultTrid:   defaultTrid,
@@ -594,6 +1795,7 @@ func (store *dataStore) NewSpanIngestor(lg *common.Logger,
 		batches:       make([]*SpanIngestorBatch, len(store.shards)),
 	}
 	ing.mh.WriteExt = true
+	ing.mh.Canonical = true
 	ing.enc = codec.NewEncoderBytes(&ing.spanDataBytes, &ing.mh)
 	for batchIdx := range ing.batches {
 		ing.batches[batchIdx] = &SpanIngestorBatch{
@@ -603,65 +1805,332 @@ func (store *dataStore) NewSpanIngestor(lg *common.Logger,
 	return ing
 }
 
+// Write an audit entry for the spans ingested by this ingestor when it is
+// closed.  The metadata is recorded in the entry.
+func (ing *SpanIngestor) EnableAudit(transport string,
+	metadata map[string]string) {
+	ing.auditTransport = transport
+	ing.auditMetadata = metadata
+}
+
+// Set the transport which the spans arrive on.  It is recorded in the
+// rejection log.
+func (ing *SpanIngestor) SetTransport(transport string) {
+	ing.transport = transport
+}
+
+// Set the principal which sent the spans.  If it is non-empty, it is recorded
+// in the info map of each span, under PRINCIPAL_INFO_KEY.
+func (ing *SpanIngestor) SetPrincipal(principal string) {
+	ing.principal = principal
+}
+
+// Set the write groups declared by the request which the spans came from.
+// When the ingestor is closed, the spans it accepted are added to them.
+func (ing *SpanIngestor) SetWriteGroups(groups []common.WriteGroup) {
+	if len(groups) > 0 {
+		ing.writeGroups = groups
+	}
+}
+
+// Drop an invalid span, and record it in the rejection log.
+func (ing *SpanIngestor) rejectSpan(span *common.Span, reason string,
+	msg string) {
+	ing.serverDropped++
+	ing.store.rejections.recordSpan(reason, ing.addr, ing.transport, msg,
+		span)
+}
+
 func (ing *SpanIngestor) IngestSpan(span *common.Span) {
 	ing.totalIngested++
-	// Make sure the span ID is valid.
-	spanIdProblem := span.Id.FindProblem()
-	if spanIdProblem != "" {
-		// Can't print the invalid span ID because String() might fail.
-		ing.lg.Warnf("Invalid span ID: %s\n", spanIdProblem)
-		ing.serverDropped++
+	// Check the span ID, the unknown fields, and the times.
+	reason, problem := common.FindSpanProblem(span, ing.store.validateTimes)
+	if reason != "" {
+		if reason == common.REJECT_REASON_SPAN_ID {
+			// Can't print the invalid span ID because String() might fail.
+			ing.slg.Warnf(ing.addr, "Dropping a span sent by %s: %s\n",
+				ing.addr, problem)
+		} else {
+			ing.slg.Warnf(ing.addr, "Dropping span %s sent by %s: %s\n",
+				span.Id.String(), ing.addr, problem)
+		}
+		if reason == common.REJECT_REASON_TIMES {
+			ing.noteNegativeDuration(span)
+		}
+		ing.rejectSpan(span, reason, problem)
 		return
 	}
 
+	// Clients which send nanosecond times may not fill in the millisecond
+	// ones, so we always derive them.
+	span.DeriveMsTimes()
+
+	// Check the info map before we add any reserved keys of our own.
+	if !ing.validateInfo(span) {
+		return
+	}
+	span.SchemaVersion = common.SPAN_SCHEMA_VERSION
+	if span.Flags != 0 {
+		for i := range ing.flagged {
+			if span.Flags.Has(1 << uint(i)) {
+				ing.flagged[i]++
+			}
+		}
+	}
+
 	// Set the default tracer id, if needed.
 	if span.TracerId == "" {
 		span.TracerId = ing.defaultTrid
 	}
 
+	// Store the span under the new tracer id if its tracer was renamed.
+	if ing.store.aliasesEnabled {
+		span.TracerId = ing.store.aliases.resolve(span.TracerId)
+	}
+
+	// Apply the quota for this tracer, if there is one.
+	if ing.store.quotas != nil && !ing.checkQuota(span) {
+		ing.serverDropped++
+		return
+	}
+
+	// Record where the span came from.
+	if ing.store.stampSourceAddr && ing.addr != "" {
+		if span.Info == nil {
+			span.Info = make(common.TraceInfoMap)
+		}
+		span.Info[common.SOURCE_ADDR_INFO_KEY] = ing.addr
+	}
+
+	// Record who sent the span.  Any principal the client sent was removed
+	// along with the other reserved keys.
+	if ing.principal != "" {
+		if span.Info == nil {
+			span.Info = make(common.TraceInfoMap)
+		}
+		span.Info[common.PRINCIPAL_INFO_KEY] = ing.principal
+		ing.principalSpans++
+	}
+
+	// Remove duplicate and self-referencing parent IDs.  We do this before
+	// encoding, so that the stored span contains the cleaned parents.
+	numDuplicate, numSelf := normalizeParents(span)
+	if numDuplicate > 0 || numSelf > 0 {
+		ing.slg.Warnf(ing.addr, "Removed %d duplicate and %d self-referencing "+
+			"parent ID(s) from span %s sent by %s.\n", numDuplicate,
+			numSelf, span.Id.String(), ing.addr)
+		ing.duplicateParents += numDuplicate
+		ing.selfParents += numSelf
+	}
+	// Tracers which use too many distinct descriptions get their spans
+	// indexed by the normalized descriptions.  Like NumParents, the marker
+	// is always recomputed.
+	overLimit := ing.store.msink.UpdateDescription(span.TracerId,
+		span.Description)
+	span.DescriptionNormalized = overLimit &&
+		normalizeDescription(span.Description) != span.Description
+
+	// NumParents is derived from the parents, so we recompute it each time a
+	// span is written, ignoring whatever the client sent.
+	span.NumParents = len(span.Parents)
+
+	// Only the first few parents of a very wide span are indexed.  Like
+	// NumParents, the marker is always recomputed.
+	if ing.store.markIndexedParents(span) {
+		ing.parentIndexTruncated++
+	}
+	ing.recordParentCount(span)
+
+	// Spans which end before they begin are clamped, or left out of the
+	// duration index.  Like NumParents, IndexSkipped is always recomputed.
+	negative := span.HasNegativeDuration()
+	if negative {
+		ing.noteNegativeDuration(span)
+		if ing.store.negDurationPolicy == NEGATIVE_DURATION_POLICY_CLAMP {
+			clampNegativeDuration(span)
+			negative = false
+		}
+	}
+	span.IndexSkipped = negative || ing.store.shouldSkipIndexes(span)
+	if span.IndexSkipped && !negative {
+		ing.indexSkipped++
+	}
+
+	// Remove invalid, duplicate, and self-referencing links.
+	numBadLinks := normalizeLinks(span)
+	if numBadLinks > 0 {
+		ing.slg.Warnf(ing.addr, "Removed %d invalid, duplicate, or "+
+			"self-referencing link(s) from span %s sent by %s.\n",
+			numBadLinks, span.Id.String(), ing.addr)
+		ing.badLinks += numBadLinks
+	}
+
+	// Like NumParents, whether the span failed is decided each time it is
+	// written, although the client's say is kept.
+	if ing.store.errorRules.apply(span) {
+		ing.recordError(span.TracerId)
+	}
+
+	// Determine which shard this span should go to.
+	shardIdx := ing.store.getWriteShardIndex(span.Id)
+	if shardIdx < 0 {
+		ing.slg.Warnf(ing.addr, "Dropping span %s sent by %s, because its "+
+			"shard is quarantined.\n", span.Id.String(), ing.addr)
+		ing.quarantineDropped++
+		ing.failed++
+		ing.serverDropped++
+		return
+	}
+
+	// Flush the batch for this shard if it is full.
+	batch := ing.batches[shardIdx]
+	if len(batch.incoming)+1 == cap(batch.incoming) {
+		if ing.lg.TraceEnabled() {
+			ing.lg.Tracef("SpanIngestor#IngestSpan: flushing %d spans for "+
+				"shard %d\n", len(batch.incoming), shardIdx)
+		}
+		ing.store.WriteSpans(shardIdx, batch.incoming, batch.pending)
+		batch.incoming = make([]*IncomingSpan, 0, WRITESPANS_BATCH_SIZE)
+		batch.pending = nil
+	}
+
+	// Track the span for the visibility watermark, unless it is late.
+	var onTime bool
+	batch.pending, onTime = ing.store.wmk.admit(batch.pending, span.Begin)
+	if !onTime && ing.store.FindSpan(span.Id) == nil {
+		ing.store.wmk.recordLate()
+		if ing.store.wmk.rejectLate {
+			ing.slg.Warnf(ing.addr, "Dropping span %s sent by %s, because it "+
+				"arrived too late for the visibility watermark.\n",
+				span.Id.String(), ing.addr)
+			ing.serverDropped++
+			return
+		}
+	}
+
 	// Encode the span data.  Doing the encoding here is better than doing it
 	// in the shard goroutine, because we can achieve more parallelism.
 	// There is one shard goroutine per shard, but potentially many more
 	// ingestors per shard.
 	err := ing.enc.Encode(span.SpanData)
 	if err != nil {
-		ing.lg.Warnf("Failed to encode span ID %s: %s\n",
-			span.Id.String(), err.Error())
+		ing.slg.Warnf(ing.addr, "Failed to encode span ID %s sent by %s: %s\n",
+			span.Id.String(), ing.addr, err.Error())
+		ing.failed++
 		ing.serverDropped++
 		return
 	}
 	spanDataBytes := ing.spanDataBytes
 	ing.spanDataBytes = make([]byte, 0, 1024)
 	ing.enc.ResetBytes(&ing.spanDataBytes)
+	if ing.store.descStats != nil {
+		ing.store.descStats.observe(span)
+	}
 
-	// Determine which shard this span should go to.
-	shardIdx := ing.store.getShardIndex(span.Id)
-	batch := ing.batches[shardIdx]
-	incomingLen := len(batch.incoming)
 	if ing.lg.TraceEnabled() {
 		ing.lg.Tracef("SpanIngestor#IngestSpan: spanId=%s, shardIdx=%d, "+
 			"incomingLen=%d, cap(batch.incoming)=%d\n",
-			span.Id.String(), shardIdx, incomingLen, cap(batch.incoming))
-	}
-	if incomingLen+1 == cap(batch.incoming) {
-		if ing.lg.TraceEnabled() {
-			ing.lg.Tracef("SpanIngestor#IngestSpan: flushing %d spans for "+
-				"shard %d\n", len(batch.incoming), shardIdx)
-		}
-		ing.store.WriteSpans(shardIdx, batch.incoming)
-		batch.incoming = make([]*IncomingSpan, 1, WRITESPANS_BATCH_SIZE)
-		incomingLen = 0
-	} else {
-		batch.incoming = batch.incoming[0 : incomingLen+1]
+			span.Id.String(), shardIdx, len(batch.incoming),
+			cap(batch.incoming))
 	}
-	batch.incoming[incomingLen] = &IncomingSpan{
+	batch.incoming = append(batch.incoming, &IncomingSpan{
 		Addr:          ing.addr,
 		Span:          span,
 		SpanDataBytes: spanDataBytes,
+	})
+	if ing.writeGroups != nil {
+		ing.grouped = append(ing.grouped, span.Id)
 	}
 }
 
-func (ing *SpanIngestor) Close(startTime time.Time) {
+// Check whether a span is allowed by the quota for its tracer.
+func (ing *SpanIngestor) checkQuota(span *common.Span) bool {
+	qtr := ing.store.quotas
+	if ing.quotaRules == nil {
+		ing.quotaRules = make(map[string]int)
+	}
+	ruleIdx, present := ing.quotaRules[span.TracerId]
+	if !present {
+		ruleIdx = qtr.ruleFor(span.TracerId)
+		ing.quotaRules[span.TracerId] = ruleIdx
+	}
+	if ruleIdx < 0 {
+		return true
+	}
+	switch qtr.check(ruleIdx, span) {
+	case common.QUOTA_POLICY_REJECT:
+		ing.quotaRejected++
+		return false
+	case common.QUOTA_POLICY_SAMPLE:
+		ing.quotaSampledOut++
+		return false
+	}
+	return true
+}
+
+// Get the number of spans this ingestor dropped because of quotas.  The
+// first number is the spans rejected, and the second is the spans sampled
+// out.
+func (ing *SpanIngestor) QuotaDropped() (int, int) {
+	return ing.quotaRejected, ing.quotaSampledOut
+}
+
+// Get the number of spans this ingestor accepted, and the number it dropped.
+func (ing *SpanIngestor) Counts() (int, int) {
+	return ing.totalIngested - ing.serverDropped, ing.serverDropped
+}
+
+// Create an ingestor for the same client, which can ingest spans on another
+// goroutine.  When it is done, it must be flushed, and then absorbed by this
+// ingestor, which reports on the spans of both when it is closed.
+func (ing *SpanIngestor) fork() *SpanIngestor {
+	child := ing.store.NewSpanIngestor(ing.lg, ing.addr, ing.defaultTrid)
+	child.SetTransport(ing.transport)
+	child.SetPrincipal(ing.principal)
+	child.SetWriteGroups(ing.writeGroups)
+	return child
+}
+
+// Add the counts of a forked ingestor to this one.
+func (ing *SpanIngestor) absorb(child *SpanIngestor) {
+	ing.totalIngested += child.totalIngested
+	ing.serverDropped += child.serverDropped
+	ing.duplicateParents += child.duplicateParents
+	ing.selfParents += child.selfParents
+	ing.badLinks += child.badLinks
+	ing.quarantineDropped += child.quarantineDropped
+	ing.failed += child.failed
+	ing.indexSkipped += child.indexSkipped
+	ing.negativeDurations += child.negativeDurations
+	if child.worstNegative != nil && (ing.worstNegative == nil ||
+		child.worstNegativeMs > ing.worstNegativeMs) {
+		ing.worstNegative = child.worstNegative
+		ing.worstNegativeMs = child.worstNegativeMs
+	}
+	ing.parentIndexTruncated += child.parentIndexTruncated
+	ing.parentCounts = append(ing.parentCounts, child.parentCounts...)
+	ing.grouped = append(ing.grouped, child.grouped...)
+	ing.infoStripped += child.infoStripped
+	ing.reservedInfoKeys += child.reservedInfoKeys
+	if child.widestSpan != nil && (ing.widestSpan == nil ||
+		len(child.widestSpan.Parents) > len(ing.widestSpan.Parents)) {
+		ing.widestSpan = child.widestSpan
+	}
+	ing.quotaRejected += child.quotaRejected
+	ing.quotaSampledOut += child.quotaSampledOut
+	for i := range ing.flagged {
+		ing.flagged[i] += child.flagged[i]
+	}
+	for trid, numSpans := range child.errors {
+		if ing.errors == nil {
+			ing.errors = make(map[string]int)
+		}
+		ing.errors[trid] += numSpans
+	}
+}
+
+// Send the spans the ingestor is holding to their shards.
+func (ing *SpanIngestor) flush() {
 	for shardIdx := range ing.batches {
 		batch := ing.batches[shardIdx]
 		if len(batch.incoming) > 0 {
@@ -669,67 +2138,467 @@ func (ing *SpanIngestor) Close(startTime time.Time) {
 				ing.lg.Tracef("SpanIngestor#Close: flushing %d span(s) for "+
 					"shard %d\n", len(batch.incoming), shardIdx)
 			}
-			ing.store.WriteSpans(shardIdx, batch.incoming)
+			ing.store.WriteSpans(shardIdx, batch.incoming, batch.pending)
+		} else {
+			ing.store.wmk.done(batch.pending)
 		}
 		batch.incoming = nil
+		batch.pending = nil
 	}
+}
+
+func (ing *SpanIngestor) Close(startTime time.Time) {
+	ing.flush()
 	ing.lg.Debugf("Closed span ingestor for %s.  Ingested %d span(s); dropped "+
 		"%d span(s).\n", ing.addr, ing.totalIngested, ing.serverDropped)
+	if ing.duplicateParents > 0 || ing.selfParents > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s removed %d duplicate "+
+			"and %d self-referencing parent ID(s) in total.\n", ing.addr,
+			ing.duplicateParents, ing.selfParents)
+	}
+
+	if ing.badLinks > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s removed %d invalid, "+
+			"duplicate, or self-referencing link(s) in total.\n", ing.addr,
+			ing.badLinks)
+	}
+
+	if ing.indexSkipped > 0 {
+		ing.store.msink.UpdateIndexSkipped(ing.indexSkipped)
+	}
+
+	if ing.negativeDurations > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s saw %d span(s) in "+
+			"total which ended before they began, and applied the %s "+
+			"policy.  Span %s ended %d ms before it began.\n", ing.addr,
+			ing.negativeDurations, ing.store.negDurationPolicy,
+			ing.worstNegative.Id.String(), ing.worstNegativeMs)
+		ing.store.msink.UpdateNegativeDurations(ing.addr,
+			ing.negativeDurations, ing.worstNegative, ing.worstNegativeMs)
+	}
+
+	if ing.parentIndexTruncated > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s indexed only the first "+
+			"%d parents of %d span(s) in total.  The widest span was %s, "+
+			"from tracer %s, with %d parents.\n", ing.addr,
+			ing.store.indexMaxParents, ing.parentIndexTruncated,
+			ing.widestSpan.Id.String(), ing.widestSpan.TracerId,
+			len(ing.widestSpan.Parents))
+	}
+	if len(ing.parentCounts) > 0 {
+		ing.store.msink.UpdateParentCounts(ing.parentCounts,
+			ing.parentIndexTruncated, ing.widestSpan)
+	}
+
+	if ing.infoStripped > 0 || ing.reservedInfoKeys > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s removed %d invalid "+
+			"info entries, and saw %d reserved info key(s), in total.\n",
+			ing.addr, ing.infoStripped, ing.reservedInfoKeys)
+		ing.store.msink.UpdateInfoValidation(ing.addr, ing.infoStripped,
+			ing.reservedInfoKeys)
+	}
+
+	if ing.quarantineDropped > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s dropped %d span(s) in "+
+			"total because their shard was quarantined.\n", ing.addr,
+			ing.quarantineDropped)
+		ing.store.msink.UpdateQuarantineDropped(ing.quarantineDropped)
+	}
+
+	if ing.flagged != [common.NUM_SPAN_FLAGS]int{} {
+		ing.store.msink.UpdateFlagged(&ing.flagged)
+	}
+
+	if ing.principalSpans > 0 {
+		ing.store.msink.UpdatePrincipal(ing.principal, ing.principalSpans)
+	}
+
+	if len(ing.errors) > 0 {
+		ing.store.msink.UpdateErrors(ing.errors)
+	}
+
+	if ing.quotaRejected > 0 || ing.quotaSampledOut > 0 {
+		ing.slg.Warnf(ing.addr, "Span ingestor for %s rejected %d span(s) "+
+			"and sampled out %d span(s) in total because their tracers "+
+			"were over quota.\n", ing.addr, ing.quotaRejected,
+			ing.quotaSampledOut)
+		ing.store.msink.UpdateQuotaDropped(ing.quotaRejected,
+			ing.quotaSampledOut)
+	}
+
+	// The spans which made it to a shard are accounted for by the shard.
+	ing.store.completions.record(SpanOutcomes{
+		Rejected: int64(ing.serverDropped - ing.failed),
+		Failed:   int64(ing.failed),
+	})
 
 	endTime := time.Now()
+	if ing.writeGroups != nil {
+		ing.store.writeGroups.record(ing.slg, ing.addr, ing.writeGroups,
+			ing.grouped, common.TimeToUnixMs(endTime.UTC()))
+	}
 	ing.store.msink.UpdateIngested(ing.addr, ing.totalIngested,
-		ing.serverDropped, endTime.Sub(startTime))
+		ing.serverDropped, ing.duplicateParents, ing.selfParents,
+		endTime.Sub(startTime))
+
+	if ing.auditTransport != "" {
+		entry := &common.AuditEntry{
+			TimeMs:    common.TimeToUnixMs(endTime.UTC()),
+			Addr:      ing.addr,
+			Transport: ing.auditTransport,
+			NumSpans:  ing.totalIngested,
+			Accepted:  ing.totalIngested - ing.serverDropped,
+			Rejected:  ing.serverDropped,
+		}
+		entry.Metadata, entry.MetadataTruncated = limitAuditMetadata(
+			ing.auditMetadata, ing.store.audit.maxMetadataBytes)
+		if entry.MetadataTruncated {
+			ing.slg.Warnf(ing.addr, "Truncated the WriteSpans metadata sent "+
+				"by %s to %d bytes.\n", ing.addr,
+				ing.store.audit.maxMetadataBytes)
+		}
+		ing.store.audit.record(entry)
+	}
 }
 
-func (store *dataStore) WriteSpans(shardIdx int, ispans []*IncomingSpan) {
-	store.shards[shardIdx].incoming <- ispans
+// Remove duplicate and self-referencing IDs from a span's parents, preserving
+// the order of the remaining IDs.  Returns the number of duplicate and
+// self-referencing IDs which were removed.
+func normalizeParents(span *common.Span) (int, int) {
+	numDuplicate, numSelf := 0, 0
+	parents := span.Parents
+	j := 0
+	for i := range parents {
+		if parents[i].Equal(span.Id) {
+			numSelf++
+			continue
+		}
+		duplicate := false
+		for k := 0; k < j; k++ {
+			if parents[k].Equal(parents[i]) {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			numDuplicate++
+			continue
+		}
+		parents[j] = parents[i]
+		j++
+	}
+	if j != len(parents) {
+		span.Parents = parents[0:j]
+	}
+	return numDuplicate, numSelf
+}
+
+// Check a WriteSpans request against the configured size limits.  Returns a
+// TOO_LARGE error if it has too many spans, or too many bytes.  A negative
+// numBytes means the size isn't known yet.
+func (store *dataStore) checkWriteSize(numSpans int,
+	numBytes int64) *common.HtraceError {
+	if store.writeMaxSpans > 0 && numSpans > store.writeMaxSpans {
+		return common.NewHtraceError(common.ERR_TOO_LARGE, nil,
+			"The request has %d spans, but the limit is %d.  Split the "+
+				"spans into several requests.", numSpans, store.writeMaxSpans)
+	}
+	if store.writeMaxBytes > 0 && numBytes > int64(store.writeMaxBytes) {
+		return common.NewHtraceError(common.ERR_TOO_LARGE, nil,
+			"The request is %d bytes long, but the limit is %d.  Split the "+
+				"spans into several requests.", numBytes, store.writeMaxBytes)
+	}
+	return nil
+}
+
+// Set or remove the marker which records how many of a span's parents are
+// indexed.  Returns true if the span has more parents than
+// index.max.parents.
+func (store *dataStore) markIndexedParents(span *common.Span) bool {
+	if store.indexMaxParents <= 0 || len(span.Parents) <= store.indexMaxParents {
+		delete(span.Info, common.PARENTS_INDEXED_INFO_KEY)
+		return false
+	}
+	if span.Info == nil {
+		span.Info = make(common.TraceInfoMap)
+	}
+	span.Info[common.PARENTS_INDEXED_INFO_KEY] =
+		strconv.Itoa(store.indexMaxParents)
+	return true
+}
+
+// Record the number of parents a span has, for the parent count metrics.
+func (ing *SpanIngestor) recordParentCount(span *common.Span) {
+	ing.parentCounts = append(ing.parentCounts, uint32(len(span.Parents)))
+	if len(span.Parents) > 1 && (ing.widestSpan == nil ||
+		len(span.Parents) > len(ing.widestSpan.Parents)) {
+		ing.widestSpan = span
+	}
+}
+
+// Returns true if a span should be left out of the duration index.  Spans
+// which are still active don't have a duration yet, so they are always
+// indexed.
+func (store *dataStore) shouldSkipIndexes(span *common.Span) bool {
+	if store.indexMinDurationMs <= 0 || span.End == 0 {
+		return false
+	}
+	durMs, _ := span.DurationParts()
+	if durMs >= store.indexMinDurationMs {
+		return false
+	}
+	return !store.indexFullTracers[span.TracerId]
+}
+
+func (store *dataStore) WriteSpans(shardIdx int, ispans []*IncomingSpan,
+	pending *pendingBatch) {
+	store.shards[shardIdx].logAndQueue(&IncomingBatch{
+		Spans:   ispans,
+		pending: pending,
+	})
 }
 
 func (store *dataStore) FindSpan(sid common.SpanId) *common.Span {
-	return store.shards[store.getShardIndex(sid)].FindSpan(sid)
+	buf := store.FindSpanBytes(sid)
+	if buf == nil {
+		return nil
+	}
+	span, err := decodeSpan(sid, buf)
+	if err != nil {
+		store.lg.Errorf("FindSpan(%s) decode error: %s decoding [%s]\n",
+			sid.String(), err.Error(), hex.EncodeToString(buf))
+		return nil
+	}
+	return span
+}
+
+// Find the encoded span data for a span, or nil if the span was not found.
+// The encoded data changes whenever the span is rewritten.
+func (store *dataStore) FindSpanBytes(sid common.SpanId) []byte {
+	return store.cachedSpanBytes(sid, func() []byte {
+		val, found := store.findInSpanShards(sid,
+			func(shd *shard) (interface{}, bool) {
+				if !shd.mayContainSpan(sid) {
+					return nil, false
+				}
+				buf := shd.findSpanBytes(sid)
+				return buf, buf != nil
+			})
+		if !found {
+			return nil
+		}
+		return val.([]byte)
+	})
 }
 
 func (shd *shard) FindSpan(sid common.SpanId) *common.Span {
 	lg := shd.store.lg
+	buf := shd.findSpanBytes(sid)
+	if buf == nil {
+		return nil
+	}
+	span, err := decodeSpan(sid, buf)
+	if err != nil {
+		lg.Errorf("Shard(%s): FindSpan(%s) decode error: %s decoding [%s]\n",
+			shd.path, sid.String(), err.Error(), hex.EncodeToString(buf))
+		return nil
+	}
+	return span
+}
+
+// Find the encoded span data for a span, or nil if the span was not found.
+func (shd *shard) findSpanBytes(sid common.SpanId) []byte {
 	primaryKey := append([]byte{SPAN_ID_INDEX_PREFIX}, sid.Val()...)
 	buf, err := shd.ldb.Get(shd.store.readOpts, primaryKey)
 	if err != nil {
 		if strings.Index(err.Error(), "NotFound:") != -1 {
 			return nil
 		}
-		lg.Warnf("Shard(%s): FindSpan(%s) error: %s\n",
+		shd.store.lg.Warnf("Shard(%s): FindSpan(%s) error: %s\n",
 			shd.path, sid.String(), err.Error())
+		shd.checkCorruption(err)
+		return nil
+	}
+	// levigo returns a nil buffer when the key is not found.
+	if buf == nil {
 		return nil
 	}
-	var span *common.Span
-	span, err = shd.decodeSpan(sid, buf)
+	buf, err = shd.openSpanRecord(sid, buf)
 	if err != nil {
-		lg.Errorf("Shard(%s): FindSpan(%s) decode error: %s decoding [%s]\n",
-			shd.path, sid.String(), err.Error(), hex.EncodeToString(buf))
+		shd.store.lg.Warnf("Shard(%s): FindSpan(%s) error: %s\n",
+			shd.path, sid.String(), err.Error())
 		return nil
 	}
-	return span
+	return buf
 }
 
-func (shd *shard) decodeSpan(sid common.SpanId, buf []byte) (*common.Span, error) {
-	r := bytes.NewBuffer(buf)
-	mh := new(codec.MsgpackHandle)
-	mh.WriteExt = true
-	decoder := codec.NewDecoder(r, mh)
+// A msgpack decoder which can be reused to decode many spans.
+type spanDecoder struct {
+	mh  codec.MsgpackHandle
+	dec *codec.Decoder
+}
+
+// Decoders are expensive to create, so we keep a pool of them around rather
+// than creating a new one for each span we decode.
+var spanDecoderPool = sync.Pool{
+	New: func() interface{} {
+		sd := &spanDecoder{}
+		sd.mh.WriteExt = true
+		sd.dec = codec.NewDecoderBytes(nil, &sd.mh)
+		return sd
+	},
+}
+
+// Decode an encoded span into the given object.
+func decodeSpanBytes(buf []byte, out interface{}) error {
+	sd := spanDecoderPool.Get().(*spanDecoder)
+	defer spanDecoderPool.Put(sd)
+	sd.dec.ResetBytes(buf)
+	return sd.dec.Decode(out)
+}
+
+func decodeSpan(sid common.SpanId, buf []byte) (*common.Span, error) {
 	data := common.SpanData{}
-	err := decoder.Decode(&data)
+	err := decodeSpanBytes(buf, &data)
 	if err != nil {
 		return nil, err
 	}
 	if data.Parents == nil {
 		data.Parents = []common.SpanId{}
 	}
+	// Spans written before NumParents existed don't have it.
+	data.NumParents = len(data.Parents)
 	return &common.Span{Id: common.SpanId(sid), SpanData: data}, nil
 }
 
+// The fields of a span which predicates can be evaluated against.  Decoding
+// only these fields is much cheaper than decoding the whole span, since we
+// don't have to allocate the parents, info, or timeline annotations.  The
+// field tags must match those of common.SpanData.
+type partialSpanData struct {
+	Begin       int64  `json:"b"`
+	End         int64  `json:"e"`
+	BeginNs     int64  `json:"bn"`
+	EndNs       int64  `json:"en"`
+	Description string `json:"d"`
+	TracerId    string `json:"r"`
+
+	IndexSkipped bool `json:"xs"`
+
+	DescriptionNormalized bool `json:"dn"`
+
+	// Only failed spans store this.
+	Error bool `json:"er"`
+
+	// Root spans don't store NumParents, and neither do spans written before
+	// the field existed.  We set this to -1 before decoding, so that we can
+	// tell when it was missing.
+	NumParents int `json:"np"`
+
+	Flags common.SpanFlags `json:"fl"`
+}
+
+// Just the parents of a span.  The field tag must match that of
+// common.SpanData.
+type spanParentsData struct {
+	Parents []common.SpanId `json:"p"`
+}
+
+// A span which we have read from the datastore, but not fully decoded.
+//
+// When handling a query, we evaluate the predicates against the partially
+// decoded span, and only fully decode spans which satisfy all of them.
+type spanCandidate struct {
+	// The span, with only the fields in partialSpanData filled in.
+	span common.Span
+
+	// The shard which the span came from.
+	shd *shard
+
+	// The encoded span data.
+	buf []byte
+
+	// Scratch space for decoding.
+	partial partialSpanData
+}
+
+var spanCandidatePool = sync.Pool{
+	New: func() interface{} {
+		return &spanCandidate{}
+	},
+}
+
+// Get a span candidate from the pool and partially decode it.
+func newSpanCandidate(shd *shard, sid common.SpanId,
+	buf []byte) (*spanCandidate, error) {
+	cand := spanCandidatePool.Get().(*spanCandidate)
+	cand.partial = partialSpanData{NumParents: -1}
+	err := decodeSpanBytes(buf, &cand.partial)
+	if err != nil {
+		cand.release()
+		return nil, err
+	}
+	cand.span.Id = sid
+	cand.span.Begin = cand.partial.Begin
+	cand.span.End = cand.partial.End
+	cand.span.BeginNs = cand.partial.BeginNs
+	cand.span.EndNs = cand.partial.EndNs
+	cand.span.Description = cand.partial.Description
+	cand.span.TracerId = cand.partial.TracerId
+	cand.span.NumParents = cand.partial.NumParents
+	cand.span.Flags = cand.partial.Flags
+	cand.span.IndexSkipped = cand.partial.IndexSkipped
+	cand.span.DescriptionNormalized = cand.partial.DescriptionNormalized
+	cand.span.Error = nil
+	if cand.partial.Error {
+		cand.span.Error = &cand.partial.Error
+	}
+	cand.shd = shd
+	cand.buf = buf
+	return cand, nil
+}
+
+// Fill in the number of parents of the partially decoded span, if the stored
+// span didn't have it.  This means decoding the parents.
+func (cand *spanCandidate) loadNumParents() error {
+	if cand.span.NumParents >= 0 {
+		return nil
+	}
+	var data spanParentsData
+	err := decodeSpanBytes(cand.buf, &data)
+	if err != nil {
+		return err
+	}
+	cand.span.NumParents = len(data.Parents)
+	return nil
+}
+
+// Fully decode the span.
+func (cand *spanCandidate) materialize() (*common.Span, error) {
+	return decodeSpan(cand.span.Id, cand.buf)
+}
+
+// Return the candidate to the pool.  It must not be used after this.
+func (cand *spanCandidate) release() {
+	cand.span = common.Span{}
+	cand.shd = nil
+	cand.buf = nil
+	spanCandidatePool.Put(cand)
+}
+
 // Find the children of a given span id.
 func (store *dataStore) FindChildren(sid common.SpanId, lim int32) []common.SpanId {
+	return store.cachedChildren(sid, lim, func() ([]common.SpanId, bool) {
+		return store.findChildrenUncached(sid, lim)
+	})
+}
+
+// Find the children of a given span id in the shards.  Also returns true if
+// we stopped because we reached the limit.
+func (store *dataStore) findChildrenUncached(sid common.SpanId,
+	lim int32) ([]common.SpanId, bool) {
 	childIds := make([]common.SpanId, 0)
+	seen := make(map[string]bool)
 	var err error
 
 	startIdx := store.getShardIndex(sid)
@@ -740,10 +2609,13 @@ func (store *dataStore) FindChildren(sid common.SpanId, lim int32) []common.Span
 			break
 		}
 		shd := store.shards[idx]
-		childIds, lim, err = shd.FindChildren(sid, childIds, lim)
-		if err != nil {
-			store.lg.Errorf("Shard(%s): FindChildren(%s) error: %s\n",
-				shd.path, sid.String(), err.Error())
+		if shd.acquire() {
+			childIds, lim, err = shd.FindChildren(sid, childIds, seen, lim)
+			shd.release()
+			if err != nil {
+				store.lg.Errorf("Shard(%s): FindChildren(%s) error: %s\n",
+					shd.path, sid.String(), err.Error())
+			}
 		}
 		idx++
 		if idx >= numShards {
@@ -753,16 +2625,46 @@ func (store *dataStore) FindChildren(sid common.SpanId, lim int32) []common.Span
 			break
 		}
 	}
-	return childIds
+	return childIds, lim == 0
 }
 
 type predicateData struct {
 	*common.Predicate
 	key []byte
+
+	// If true, this is a begin time predicate which should read from the root
+	// index rather than the begin time index.
+	rootsOnly bool
+
+	// Likewise, if true, this is a begin time predicate which should read
+	// from the error index.
+	errorsOnly bool
+
+	// If true, the predicate matches the spans which its positive form, in
+	// Predicate, doesn't.  Negated predicates are only used as filters, never
+	// as the source of a query.
+	negated bool
 }
 
+var IS_ROOT_TRUE []byte = []byte("true")
+var IS_ROOT_FALSE []byte = []byte("false")
+var IS_ERROR_TRUE []byte = []byte("true")
+var IS_ERROR_FALSE []byte = []byte("false")
+
 func loadPredicateData(pred *common.Predicate) (*predicateData, error) {
-	p := predicateData{Predicate: pred}
+	p := predicateData{Predicate: pred, negated: pred.Negate}
+	if positiveOp, negatedOp := pred.Op.Negates(); negatedOp {
+		if pred.Negate {
+			return nil, errors.New(fmt.Sprintf("Can't set negate on a '%s' "+
+				"predicate, which is already negated.", pred.Op))
+		}
+		// From here on, work with the positive form of the predicate.
+		positive := *pred
+		positive.Op = positiveOp
+		pred = &positive
+		p.Predicate = pred
+		p.negated = true
+	}
 
 	// Parse the input value given to make sure it matches up with the field
 	// type.
@@ -780,18 +2682,78 @@ func loadPredicateData(pred *common.Predicate) (*predicateData, error) {
 		// Any string is valid for a description.
 		p.key = []byte(pred.Val)
 		break
-	case common.BEGIN_TIME, common.END_TIME, common.DURATION:
+	case common.NUM_PARENTS:
+		v, err := parseStrictInt(pred.Val, 32)
+		if err != nil || v < 0 {
+			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': "+
+				"expected a non-negative integer.", pred.Field, pred.Val))
+		}
+		p.key = u64toSlice(s2u64(v))
+		break
+	case common.DURATION:
+		// Durations are in milliseconds, but may have a fractional part,
+		// so that they can be compared with nanosecond-precision spans.
+		ms, ns, err := parseDurationMs(pred.Val)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': %s",
+				pred.Field, pred.Val, err.Error()))
+		}
+		p.key = append(u64toSlice(s2u64(ms)), u32toSlice(uint32(ns))...)
+		break
+	case common.BEGIN_TIME, common.END_TIME:
 		// Parse a base-10 signed numeric field.
-		v, err := strconv.ParseInt(pred.Val, 10, 64)
+		v, err := parseStrictInt(pred.Val, 64)
 		if err != nil {
 			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': %s",
 				pred.Field, pred.Val, err.Error()))
 		}
 		p.key = u64toSlice(s2u64(v))
 		break
-	case common.TRACER_ID:
-		// Any string is valid for a tracer ID.
-		p.key = []byte(pred.Val)
+	case common.TRACER_ID, common.PRINCIPAL:
+		// Any string is valid for a tracer ID or a principal.
+		p.key = []byte(pred.Val)
+		break
+	case common.FLAGS:
+		flags, err := common.ParseSpanFlags(pred.Val)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': %s",
+				pred.Field, pred.Val, err.Error()))
+		}
+		if pred.Op != common.HAS {
+			return nil, errors.New(fmt.Sprintf("Only HAS can be used "+
+				"with the %s field.", pred.Field))
+		}
+		p.key = u32toSlice(uint32(flags))
+		break
+	case common.IS_ROOT:
+		switch strings.ToLower(pred.Val) {
+		case "true":
+			p.key = IS_ROOT_TRUE
+		case "false":
+			p.key = IS_ROOT_FALSE
+		default:
+			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': "+
+				"expected true or false.", pred.Field, pred.Val))
+		}
+		if pred.Op != common.EQUALS {
+			return nil, errors.New(fmt.Sprintf("Only EQUALS can be used "+
+				"with the %s field.", pred.Field))
+		}
+		break
+	case common.IS_ERROR:
+		switch strings.ToLower(pred.Val) {
+		case "true":
+			p.key = IS_ERROR_TRUE
+		case "false":
+			p.key = IS_ERROR_FALSE
+		default:
+			return nil, errors.New(fmt.Sprintf("Unable to parse %s '%s': "+
+				"expected true or false.", pred.Field, pred.Val))
+		}
+		if pred.Op != common.EQUALS {
+			return nil, errors.New(fmt.Sprintf("Only EQUALS can be used "+
+				"with the %s field.", pred.Field))
+		}
 		break
 	default:
 		return nil, errors.New(fmt.Sprintf("Unknown field %s", pred.Field))
@@ -807,6 +2769,12 @@ func loadPredicateData(pred *common.Predicate) (*predicateData, error) {
 			return nil, errors.New(fmt.Sprintf("Can't use CONTAINS on a "+
 				"numeric field like '%s'", pred.Field))
 		}
+	case common.HAS:
+		if pred.Field != common.FLAGS {
+			return nil, errors.New(fmt.Sprintf("Can't use HAS on the %s "+
+				"field.  Only %s can be used with HAS.", pred.Field,
+				common.FLAGS))
+		}
 	default:
 		return nil, errors.New(fmt.Sprintf("Unknown predicate operation '%s'",
 			pred.Op))
@@ -815,12 +2783,117 @@ func loadPredicateData(pred *common.Predicate) (*predicateData, error) {
 	return &p, nil
 }
 
+// Parse a predicate value for a numeric field.  Only an optional minus sign
+// followed by decimal digits is accepted.  strconv.ParseInt would also accept
+// a leading plus sign, which we don't want to promise to support.  Values
+// like " 125" or "0x7d" must be errors rather than being compared as
+// something else.
+func parseStrictInt(str string, bitSize int) (int64, error) {
+	digits := str
+	if strings.HasPrefix(digits, "-") {
+		digits = digits[1:]
+	}
+	if digits == "" {
+		return 0, errors.New("expected a base-10 integer, but got an " +
+			"empty value.")
+	}
+	for i := range digits {
+		if digits[i] < '0' || digits[i] > '9' {
+			return 0, errors.New(fmt.Sprintf("expected a base-10 integer, "+
+				"but found '%c' at position %d.", digits[i],
+				i+len(str)-len(digits)))
+		}
+	}
+	v, err := strconv.ParseInt(str, 10, bitSize)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("the value is out of range for a "+
+			"%d-bit integer.", bitSize))
+	}
+	return v, nil
+}
+
+// Parse a DURATION predicate value.  This is a number of milliseconds, which
+// is parsed like parseStrictInt, optionally followed by a decimal point and up
+// to 6 more digits, as in "0.25".  Returns the whole milliseconds and the
+// nanoseconds left over, in the same form as Span#DurationParts.
+func parseDurationMs(str string) (int64, int64, error) {
+	whole := str
+	frac := ""
+	dot := strings.IndexByte(str, '.')
+	if dot >= 0 {
+		whole = str[:dot]
+		frac = str[dot+1:]
+		if frac == "" || len(frac) > 6 {
+			return 0, 0, errors.New("expected between 1 and 6 digits after " +
+				"the decimal point.")
+		}
+		for i := range frac {
+			if frac[i] < '0' || frac[i] > '9' {
+				return 0, 0, errors.New(fmt.Sprintf("expected a decimal "+
+					"digit, but found '%c' at position %d.", frac[i],
+					dot+1+i))
+			}
+		}
+	}
+	ms, err := parseStrictInt(whole, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	ns := int64(0)
+	if frac != "" {
+		ns, _ = strconv.ParseInt(frac+strings.Repeat("0", 6-len(frac)), 10, 64)
+	}
+	if strings.HasPrefix(whole, "-") && ns != 0 {
+		// -1.25 milliseconds is -2 milliseconds plus 750000 nanoseconds.
+		if ms == math.MinInt64 {
+			return 0, 0, errors.New("the value is out of range for a " +
+				"64-bit integer.")
+		}
+		ms--
+		ns = common.NS_PER_MS - ns
+	}
+	return ms, ns, nil
+}
+
+// If this is a BEGIN_TIME or END_TIME predicate whose value is an RFC3339 or
+// relative time, replace the value with the equivalent number of milliseconds
+// since the epoch.  Plain integers are left alone.
+func resolveTimePredicate(pred *common.Predicate, now time.Time) error {
+	if pred.Field != common.BEGIN_TIME && pred.Field != common.END_TIME {
+		return nil
+	}
+	if _, err := parseStrictInt(pred.Val, 64); err == nil {
+		return nil
+	}
+	v, err := common.ParseHumanTime(pred.Val, now)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Unable to parse %s '%s': expected "+
+			"milliseconds since the epoch, an RFC3339 time with a time zone, "+
+			"or a relative time such as now-2h.", pred.Field, pred.Val))
+	}
+	pred.Val = strconv.FormatInt(v, 10)
+	return nil
+}
+
 // Get the index prefix for this predicate, or 0 if it is not indexed.
+// Tracer IDs are not indexed, and descriptions are only indexed for EQUALS, so
+// other predicates on them are always checked against the full span record.
 func (pred *predicateData) getIndexPrefix() byte {
 	switch pred.Field {
 	case common.SPAN_ID:
 		return SPAN_ID_INDEX_PREFIX
+	case common.DESCRIPTION:
+		if pred.Op == common.EQUALS {
+			return DESCRIPTION_INDEX_PREFIX
+		}
+		return INVALID_INDEX_PREFIX
 	case common.BEGIN_TIME:
+		if pred.rootsOnly {
+			return ROOT_INDEX_PREFIX
+		}
+		if pred.errorsOnly {
+			return ERROR_INDEX_PREFIX
+		}
 		return BEGIN_TIME_INDEX_PREFIX
 	case common.END_TIME:
 		return END_TIME_INDEX_PREFIX
@@ -831,16 +2904,47 @@ func (pred *predicateData) getIndexPrefix() byte {
 	}
 }
 
+// Get the value which the predicate's key is sorted by in its index.
+// descMaxBytes is the index.description.max.bytes of the datastore.
+func (pred *predicateData) indexValue(descMaxBytes int) []byte {
+	if pred.Field == common.DESCRIPTION {
+		return descriptionIndexValue(string(pred.key), descMaxBytes)
+	}
+	return pred.key
+}
+
+// Get the value of the normalized description in the description index, if
+// the predicate is an EQUALS predicate on a description which normalizes to
+// something else.  Spans with that description may be indexed by the
+// normalized one.  Returns nil otherwise.  See cardinality.go.
+func (pred *predicateData) fallbackIndexValue(descMaxBytes int) []byte {
+	if pred.Field != common.DESCRIPTION || pred.Op != common.EQUALS {
+		return nil
+	}
+	normalized := normalizeDescription(string(pred.key))
+	if normalized == string(pred.key) {
+		return nil
+	}
+	return descriptionIndexValue(normalized, descMaxBytes)
+}
+
 // Returns true if the predicate type is numeric.
 func (pred *predicateData) fieldIsNumeric() bool {
 	switch pred.Field {
-	case common.SPAN_ID, common.BEGIN_TIME, common.END_TIME, common.DURATION:
+	case common.SPAN_ID, common.BEGIN_TIME, common.END_TIME, common.DURATION,
+		common.NUM_PARENTS:
 		return true
 	default:
 		return false
 	}
 }
 
+// Returns true if the predicate must be evaluated against the fully decoded
+// span, rather than the partially decoded one.
+func (pred *predicateData) needsFullSpan() bool {
+	return pred.Field == common.IS_ROOT || pred.Field == common.PRINCIPAL
+}
+
 // Get the values that this predicate cares about for a given span.
 func (pred *predicateData) extractRelevantSpanData(span *common.Span) []byte {
 	switch pred.Field {
@@ -853,9 +2957,25 @@ func (pred *predicateData) extractRelevantSpanData(span *common.Span) []byte {
 	case common.END_TIME:
 		return u64toSlice(s2u64(span.End))
 	case common.DURATION:
-		return u64toSlice(s2u64(span.Duration()))
+		return durationIndexValue(span)
 	case common.TRACER_ID:
 		return []byte(span.TracerId)
+	case common.IS_ROOT:
+		if len(span.Parents) == 0 {
+			return IS_ROOT_TRUE
+		}
+		return IS_ROOT_FALSE
+	case common.IS_ERROR:
+		if span.IsError() {
+			return IS_ERROR_TRUE
+		}
+		return IS_ERROR_FALSE
+	case common.NUM_PARENTS:
+		return u64toSlice(s2u64(int64(span.NumParents)))
+	case common.FLAGS:
+		return u32toSlice(uint32(span.Flags))
+	case common.PRINCIPAL:
+		return []byte(span.Info[common.PRINCIPAL_INFO_KEY])
 	default:
 		panic(fmt.Sprintf("Unknown field type %s.", pred.Field))
 	}
@@ -871,10 +2991,15 @@ func (pred *predicateData) spanPtrIsBefore(a *common.Span, b *common.Span) bool
 	} else if b == nil {
 		return true
 	}
-	// Compare the spans according to this predicate.
+	// Compare the spans according to this predicate.  Spans with the same
+	// value are ordered by span id, the way the indices order them, so that
+	// the order doesn't depend on which shards the spans are in.
 	aVal := pred.extractRelevantSpanData(a)
 	bVal := pred.extractRelevantSpanData(b)
 	cmp := bytes.Compare(aVal, bVal)
+	if cmp == 0 {
+		cmp = a.Id.Compare(b.Id)
+	}
 	if pred.Op.IsDescending() {
 		return cmp > 0
 	} else {
@@ -905,6 +3030,11 @@ func (r satisfiedByReturn) String() string {
 
 // Determine whether the predicate is satisfied by the given span.
 func (pred *predicateData) satisfiedBy(span *common.Span) satisfiedByReturn {
+	if pred.Field == common.DURATION && span.IndexSkipped {
+		// Spans left out of the duration index never match duration
+		// predicates, whichever index the query reads from.
+		return NOT_SATISFIED
+	}
 	val := pred.extractRelevantSpanData(span)
 	switch pred.Op {
 	case common.CONTAINS:
@@ -931,6 +3061,14 @@ func (pred *predicateData) satisfiedBy(span *common.Span) satisfiedByReturn {
 		} else {
 			return NOT_SATISFIED
 		}
+	case common.HAS:
+		// Every bit which is set in the key must be set in the value.
+		for i := range pred.key {
+			if val[i]&pred.key[i] != pred.key[i] {
+				return NOT_SATISFIED
+			}
+		}
+		return SATISFIED
 	case common.GREATER_THAN:
 		cmp := bytes.Compare(val, pred.key)
 		if cmp <= 0 {
@@ -944,15 +3082,35 @@ func (pred *predicateData) satisfiedBy(span *common.Span) satisfiedByReturn {
 	}
 }
 
-func (pred *predicateData) createSource(store *dataStore, prev *common.Span) (*source, error) {
+// Determine whether a candidate span passes the predicate, when the predicate
+// is used as a filter rather than as the source of the query.
+func (pred *predicateData) accepts(span *common.Span) bool {
+	if !pred.negated {
+		return pred.satisfiedBy(span) == SATISFIED
+	}
+	if pred.Field == common.DURATION && span.IndexSkipped {
+		// Negating a duration predicate doesn't make it match spans which
+		// were left out of the duration index.
+		return false
+	}
+	return pred.satisfiedBy(span) != SATISFIED
+}
+
+// Create a source which reads the spans satisfying the predicate.  If scope is
+// non-nil, only the shards whose entries are true are read.
+func (pred *predicateData) createSource(store *dataStore, prev *common.Span,
+	scope []bool) (*source, error) {
 	var ret *source
 	src := source{store: store,
 		pred:      pred,
 		shards:    make([]*shard, len(store.shards)),
-		iters:     make([]*levigo.Iterator, 0, len(store.shards)),
-		nexts:     make([]*common.Span, len(store.shards)),
+		iters:     make([]shardIterator, 0, len(store.shards)),
+		nexts:     make([]*spanCandidate, len(store.shards)),
 		numRead:   make([]int, len(store.shards)),
+		readTime:  make([]time.Duration, len(store.shards)),
+		acquired:  make([]bool, len(store.shards)),
 		keyPrefix: pred.getIndexPrefix(),
+		origin:    *pred.Predicate,
 	}
 	if src.keyPrefix == INVALID_INDEX_PREFIX {
 		return nil, errors.New(fmt.Sprintf("Can't create source from unindexed "+
@@ -966,7 +3124,15 @@ func (pred *predicateData) createSource(store *dataStore, prev *common.Span) (*s
 	for shardIdx := range store.shards {
 		shd := store.shards[shardIdx]
 		src.shards[shardIdx] = shd
-		src.iters = append(src.iters, shd.ldb.NewIterator(store.readOpts))
+		if scope != nil && !scope[shardIdx] {
+			src.iters = append(src.iters, nil)
+		} else if shd.acquire() {
+			src.acquired[shardIdx] = true
+			src.iters = append(src.iters, shd.ldb.NewIterator(store.scanOpts))
+		} else {
+			// Quarantined shards are treated as empty.
+			src.iters = append(src.iters, nil)
+		}
 	}
 	var searchKey []byte
 	lg := store.lg
@@ -1030,7 +3196,8 @@ func (pred *predicateData) createSource(store *dataStore, prev *common.Span) (*s
 			// Start where the previous query left off.  This means adjusting
 			// our uintKey.
 			pred.key = pred.extractRelevantSpanData(prev)
-			searchKey = append(append([]byte{src.keyPrefix}, pred.key...),
+			searchKey = append(append([]byte{src.keyPrefix},
+				pred.indexValue(store.descIndexMaxBytes)...),
 				startId.Val()...)
 		}
 		if lg.TraceEnabled() {
@@ -1039,10 +3206,38 @@ func (pred *predicateData) createSource(store *dataStore, prev *common.Span) (*s
 				hex.EncodeToString(pred.key))
 		}
 	} else {
-		searchKey = append([]byte{src.keyPrefix}, pred.key...)
+		searchKey = append([]byte{src.keyPrefix},
+			pred.indexValue(store.descIndexMaxBytes)...)
 	}
+	if pred.Field == common.DESCRIPTION {
+		// All the index entries of the description share a prefix, so we
+		// can stop at the first key without it, rather than reading the
+		// span it points to.
+		src.keyBound = append([]byte{src.keyPrefix},
+			pred.indexValue(store.descIndexMaxBytes)...)
+	}
+	src.seekKey = searchKey
 	for i := range src.iters {
-		src.iters[i].Seek(searchKey)
+		if src.iters[i] != nil {
+			src.iters[i].Seek(searchKey)
+		}
+	}
+	fallback := pred.fallbackIndexValue(store.descIndexMaxBytes)
+	if fallback != nil {
+		// Also read the entries of the normalized description, starting
+		// after the same span id as the entries of the description itself.
+		src.fallbackBound = append([]byte{src.keyPrefix}, fallback...)
+		fallbackKey := append(append([]byte{}, src.fallbackBound...),
+			searchKey[len(src.keyBound):]...)
+		src.fallbackIters = make([]shardIterator, len(src.iters))
+		src.fallbackNexts = make([]*spanCandidate, len(src.iters))
+		for i := range src.iters {
+			if src.iters[i] != nil {
+				src.fallbackIters[i] = src.shards[i].ldb.NewIterator(
+					store.scanOpts)
+				src.fallbackIters[i].Seek(fallbackKey)
+			}
+		}
 	}
 	ret = &src
 	return ret, nil
@@ -1053,18 +3248,56 @@ type source struct {
 	store     *dataStore
 	pred      *predicateData
 	shards    []*shard
-	iters     []*levigo.Iterator
-	nexts     []*common.Span
+	iters     []shardIterator
+	nexts     []*spanCandidate
 	numRead   []int
 	keyPrefix byte
+
+	// If non-nil, the source ends at the first key which doesn't start with
+	// this.
+	keyBound []byte
+
+	// For an EQUALS predicate on a description which normalizes to something
+	// else, the source also reads the entries of the normalized description
+	// from each shard, up to the first key which doesn't start with
+	// fallbackBound.  Otherwise, these are nil.  See cardinality.go.
+	fallbackBound []byte
+	fallbackIters []shardIterator
+	fallbackNexts []*spanCandidate
+
+	// The predicate the source was created with, before it was adjusted for
+	// the query's continuation token, and the key it started reading at.
+	origin  common.Predicate
+	seekKey []byte
+
+	// The row estimates the source was chosen with, if any.
+	estimates []common.PlanEstimate
+
+	// True if the query had no predicate which could be read from an index,
+	// so the source reads every span.
+	fullScan bool
+
+	// The time spent reading from each shard.
+	readTime []time.Duration
+
+	// Which shards the source has acquired, and must release when closed.
+	// The reaper source doesn't acquire its shard, since the shard
+	// goroutine already holds it.
+	acquired []bool
 }
 
 func CreateReaperSource(shd *shard) (*source, error) {
+	return createBeginTimeSource(shd, common.INVALID_SPAN_ID.String())
+}
+
+// Create a source which returns the spans in a shard in order of begin time,
+// starting at the given begin time.
+func createBeginTimeSource(shd *shard, begin string) (*source, error) {
 	store := shd.store
 	p := &common.Predicate{
 		Op:    common.GREATER_THAN_OR_EQUALS,
 		Field: common.BEGIN_TIME,
-		Val:   common.INVALID_SPAN_ID.String(),
+		Val:   begin,
 	}
 	pred, err := loadPredicateData(p)
 	if err != nil {
@@ -1074,30 +3307,42 @@ func CreateReaperSource(shd *shard) (*source, error) {
 		store:     store,
 		pred:      pred,
 		shards:    []*shard{shd},
-		iters:     make([]*levigo.Iterator, 1),
-		nexts:     make([]*common.Span, 1),
+		iters:     make([]shardIterator, 1),
+		nexts:     make([]*spanCandidate, 1),
 		numRead:   make([]int, 1),
+		readTime:  make([]time.Duration, 1),
 		keyPrefix: pred.getIndexPrefix(),
 	}
-	iter := shd.ldb.NewIterator(store.readOpts)
+	iter := shd.ldb.NewIterator(store.scanOpts)
 	src.iters[0] = iter
-	searchKey := append(append([]byte{src.keyPrefix}, pred.key...),
-		pred.key...)
-	iter.Seek(searchKey)
+	iter.Seek(append([]byte{src.keyPrefix},
+		pred.indexValue(store.descIndexMaxBytes)...))
 	return src, nil
 }
 
 // Fill in the entry in the 'next' array for a specific shard.
 func (src *source) populateNextFromShard(shardIdx int) {
+	src.populateNext(shardIdx, src.iters, src.nexts, src.keyBound)
+	if src.fallbackIters != nil {
+		src.populateNext(shardIdx, src.fallbackIters, src.fallbackNexts,
+			src.fallbackBound)
+	}
+}
+
+// Read the next span candidate from a shard's entry in iters into its entry
+// in nexts, if there isn't one there already.  If keyBound is non-nil, the
+// iterator ends at the first key which doesn't start with it.
+func (src *source) populateNext(shardIdx int, iters []shardIterator,
+	nexts []*spanCandidate, keyBound []byte) {
 	lg := src.store.lg
-	var err error
-	iter := src.iters[shardIdx]
-	shdPath := src.shards[shardIdx].path
+	iter := iters[shardIdx]
+	shd := src.shards[shardIdx]
+	shdPath := shd.path
 	if iter == nil {
 		lg.Debugf("Can't populate: No more entries in shard %s\n", shdPath)
 		return // There are no more entries in this shard.
 	}
-	if src.nexts[shardIdx] != nil {
+	if nexts[shardIdx] != nil {
 		lg.Debugf("No need to populate shard %s\n", shdPath)
 		return // We already have a valid entry for this shard.
 	}
@@ -1106,8 +3351,11 @@ func (src *source) populateNextFromShard(shardIdx int) {
 			lg.Debugf("Can't populate: Iterator for shard %s is no longer valid.\n", shdPath)
 			break // Can't read past end of DB
 		}
-		src.numRead[shardIdx]++
 		key := iter.Key()
+		if keyBound != nil && !bytes.HasPrefix(key, keyBound) {
+			break // Can't read past the end of the bounded section
+		}
+		src.numRead[shardIdx]++
 		if len(key) < 1 {
 			lg.Warnf("Encountered invalid zero-byte key in shard %s.\n", shdPath)
 			break
@@ -1123,24 +3371,23 @@ func (src *source) populateNextFromShard(shardIdx int) {
 			}
 			continue // Try again because we are not yet at the indexed section.
 		}
-		var span *common.Span
+		var buf []byte
 		var sid common.SpanId
 		if src.keyPrefix == SPAN_ID_INDEX_PREFIX {
 			// The span id maps to the span itself.
 			sid = common.SpanId(key[1:17])
-			span, err = src.shards[shardIdx].decodeSpan(sid, iter.Value())
+			var err error
+			buf, err = shd.openSpanRecord(sid, iter.Value())
 			if err != nil {
-				if lg.DebugEnabled() {
-					lg.Debugf("Internal error decoding span %s in shard %s: %s\n",
-						sid.String(), shdPath, err.Error())
-				}
+				lg.Warnf("Shard(%s): %s\n", shdPath, err.Error())
 				break
 			}
 		} else {
 			// With a secondary index, we have to look up the span by id.
-			sid = common.SpanId(key[9:25])
-			span = src.shards[shardIdx].FindSpan(sid)
-			if span == nil {
+			// The span id is always at the end of the key.
+			sid = common.SpanId(key[len(key)-common.SPAN_ID_LEN:])
+			buf = shd.findSpanBytes(sid)
+			if buf == nil {
 				if lg.DebugEnabled() {
 					lg.Debugf("Internal error rehydrating span %s in shard %s\n",
 						sid.String(), shdPath)
@@ -1148,31 +3395,53 @@ func (src *source) populateNextFromShard(shardIdx int) {
 				break
 			}
 		}
+		// Only decode the fields we need to evaluate predicates.  The span
+		// is fully decoded later, if it satisfies all of them.
+		cand, err := newSpanCandidate(shd, sid, buf)
+		if err != nil {
+			if lg.DebugEnabled() {
+				lg.Debugf("Internal error decoding span %s in shard %s: %s\n",
+					sid.String(), shdPath, err.Error())
+			}
+			break
+		}
 		if src.pred.Op.IsDescending() {
 			iter.Prev()
 		} else {
 			iter.Next()
 		}
-		ret = src.pred.satisfiedBy(span)
+		ret = src.pred.satisfiedBy(&cand.span)
 		if ret == SATISFIED {
 			if lg.DebugEnabled() {
 				lg.Debugf("Populated valid span %v from shard %s.\n", sid, shdPath)
 			}
-			src.nexts[shardIdx] = span // Found valid entry
+			nexts[shardIdx] = cand // Found valid entry
 			return
 		}
+		cand.release()
 		if ret == NOT_SATISFIED {
+			if keyBound != nil {
+				// In a bounded section, such an entry is for a long
+				// description with the same hash as the one we want.  The
+				// entries after it may still satisfy the predicate.
+				continue
+			}
 			// This and subsequent entries don't satisfy predicate
 			break
 		}
 	}
+	err := iter.GetError()
+	if err != nil {
+		lg.Errorf("Error iterating over shard %s: %s\n", shdPath, err.Error())
+		shd.checkCorruption(err)
+	}
 	lg.Debugf("Closing iterator for shard %s.\n", shdPath)
 	iter.Close()
-	src.iters[shardIdx] = nil
+	iters[shardIdx] = nil
 }
 
 // Check the key prefix against the key prefix of the query.
-func (src *source) checkKeyPrefix(kp byte, iter *levigo.Iterator) satisfiedByReturn {
+func (src *source) checkKeyPrefix(kp byte, iter shardIterator) satisfiedByReturn {
 	if kp == src.keyPrefix {
 		return SATISFIED
 	} else if kp < src.keyPrefix {
@@ -1190,25 +3459,57 @@ func (src *source) checkKeyPrefix(kp byte, iter *levigo.Iterator) satisfiedByRet
 	}
 }
 
-func (src *source) next() *common.Span {
+// Get the next span candidate from the source, or nil if there are no more.
+// The caller is responsible for releasing the candidate.
+func (src *source) nextCandidate() *spanCandidate {
 	for shardIdx := range src.shards {
+		start := time.Now()
 		src.populateNextFromShard(shardIdx)
+		src.readTime[shardIdx] += time.Since(start)
 	}
-	var best *common.Span
+	var best *spanCandidate
+	var bestNexts []*spanCandidate
 	bestIdx := -1
-	for shardIdx := range src.iters {
-		span := src.nexts[shardIdx]
-		if src.pred.spanPtrIsBefore(span, best) {
-			best = span
-			bestIdx = shardIdx
+	for _, nexts := range [][]*spanCandidate{src.nexts, src.fallbackNexts} {
+		for shardIdx := range nexts {
+			cand := nexts[shardIdx]
+			if cand == nil {
+				continue
+			}
+			if best == nil ||
+				src.pred.spanPtrIsBefore(&cand.span, &best.span) {
+				best = cand
+				bestNexts = nexts
+				bestIdx = shardIdx
+			}
 		}
 	}
 	if bestIdx >= 0 {
-		src.nexts[bestIdx] = nil
+		bestNexts[bestIdx] = nil
 	}
 	return best
 }
 
+// Get the next fully decoded span from the source, or nil if there are no
+// more.
+func (src *source) next() *common.Span {
+	for {
+		cand := src.nextCandidate()
+		if cand == nil {
+			return nil
+		}
+		span, err := cand.materialize()
+		if err != nil {
+			src.store.lg.Errorf("Internal error decoding span %s in shard "+
+				"%s: %s\n", cand.span.Id.String(), cand.shd.path, err.Error())
+		}
+		cand.release()
+		if span != nil {
+			return span
+		}
+	}
+}
+
 func (src *source) Close() {
 	for i := range src.iters {
 		if src.iters[i] != nil {
@@ -1216,80 +3517,387 @@ func (src *source) Close() {
 		}
 	}
 	src.iters = nil
+	for i := range src.fallbackIters {
+		if src.fallbackIters[i] != nil {
+			src.fallbackIters[i].Close()
+		}
+	}
+	src.fallbackIters = nil
+	for _, nexts := range [][]*spanCandidate{src.nexts, src.fallbackNexts} {
+		for i := range nexts {
+			if nexts[i] != nil {
+				nexts[i].release()
+				nexts[i] = nil
+			}
+		}
+	}
+	for i := range src.acquired {
+		if src.acquired[i] {
+			src.shards[i].release()
+			src.acquired[i] = false
+		}
+	}
 }
 
 func (src *source) getStats() string {
 	ret := fmt.Sprintf("Source stats: pred = %s", src.pred.String())
 	prefix := ". "
 	for shardIdx := range src.shards {
-		next := fmt.Sprintf("%sRead %d spans from %s", prefix,
-			src.numRead[shardIdx], src.shards[shardIdx].path)
+		next := fmt.Sprintf("%sRead %d spans from %s in %s", prefix,
+			src.numRead[shardIdx], src.shards[shardIdx].path,
+			src.readTime[shardIdx].String())
 		prefix = ", "
 		ret = ret + next
 	}
 	return ret
 }
 
-func (store *dataStore) obtainSource(preds *[]*predicateData, span *common.Span) (*source, error) {
-	// Read spans from the first predicate that is indexed.
+func (store *dataStore) obtainSource(preds *[]*predicateData, span *common.Span,
+	scope []bool) (*source, error) {
+	// If we only want root spans, read them from the root index.  Failing
+	// that, if we only want failed spans, read them from the error index.
+	src, err := store.obtainRootSource(preds, span, scope)
+	if src != nil || err != nil {
+		return src, err
+	}
+	src, err = store.obtainErrorSource(preds, span, scope)
+	if src != nil || err != nil {
+		return src, err
+	}
+	// Read spans from the first predicate that is indexed, or, if the
+	// planner keeps statistics, the one estimated to read the fewest rows.
+	// Negated predicates can't be read from an index, since they match
+	// everything outside a range.
 	p := *preds
+	candidates := make([]int, 0, len(p))
 	for i := range p {
 		pred := p[i]
-		if pred.getIndexPrefix() != INVALID_INDEX_PREFIX {
-			*preds = append(p[0:i], p[i+1:]...)
-			return pred.createSource(store, span)
+		if !pred.negated && pred.Field != common.DESCRIPTION &&
+			pred.getIndexPrefix() != INVALID_INDEX_PREFIX {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) > 0 {
+		chosen := candidates[0]
+		var estimates []common.PlanEstimate
+		if store.plannerStats && len(candidates) > 1 {
+			chosen, estimates = store.chooseByEstimate(p, candidates, scope)
+		}
+		pred := p[chosen]
+		*preds = append(p[0:chosen], p[chosen+1:]...)
+		src, err = pred.createSource(store, span, scope)
+		if src != nil {
+			src.estimates = estimates
+		}
+		return src, err
+	}
+	// The description index returns spans in span id order, just like the
+	// span id scan below, so it only reads fewer rows.  We only use it when
+	// there is no other index to read from, so that adding it didn't change
+	// the order of any query's results.
+	if store.indexesDescriptions() {
+		for i := range p {
+			pred := p[i]
+			if !pred.negated && pred.Field == common.DESCRIPTION &&
+				pred.getIndexPrefix() != INVALID_INDEX_PREFIX {
+				*preds = append(p[0:i], p[i+1:]...)
+				return pred.createSource(store, span, scope)
+			}
 		}
 	}
 	// If there are no predicates that are indexed, read rows in order of span id.
+	spanIdPredData, err := allSpansPredicate()
+	if err != nil {
+		return nil, err
+	}
+	src, err = spanIdPredData.createSource(store, span, scope)
+	if src != nil {
+		src.fullScan = true
+	}
+	return src, err
+}
+
+// Get a predicate which every span satisfies, and which reads the span id
+// index from the start.
+func allSpansPredicate() (*predicateData, error) {
 	spanIdPred := common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
 		Field: common.SPAN_ID,
 		Val:   common.INVALID_SPAN_ID.String(),
 	}
-	spanIdPredData, err := loadPredicateData(&spanIdPred)
+	return loadPredicateData(&spanIdPred)
+}
+
+// If the query contains an "isroot = true" predicate, create a source which
+// reads from the root index.  Otherwise, return nil.
+func (store *dataStore) obtainRootSource(preds *[]*predicateData,
+	span *common.Span, scope []bool) (*source, error) {
+	return store.obtainSubsetSource(preds, span, scope, common.IS_ROOT,
+		IS_ROOT_TRUE, func(pred *predicateData) {
+			pred.rootsOnly = true
+		})
+}
+
+// If the query contains an "error = true" predicate, create a source which
+// reads from the error index.  Otherwise, return nil.
+func (store *dataStore) obtainErrorSource(preds *[]*predicateData,
+	span *common.Span, scope []bool) (*source, error) {
+	return store.obtainSubsetSource(preds, span, scope, common.IS_ERROR,
+		IS_ERROR_TRUE, func(pred *predicateData) {
+			pred.errorsOnly = true
+		})
+}
+
+// If the query contains a predicate which selects the spans in one of the
+// indices which only hold some of the spans, create a source which reads
+// from that index.  Otherwise, return nil.  The predicate is removed from the
+// query, since every span in the index satisfies it, and setIndex makes a
+// begin time predicate read from the index.
+//
+// The index is ordered by begin time, so if there is also a begin time
+// predicate, we use it to decide where to start reading.
+func (store *dataStore) obtainSubsetSource(preds *[]*predicateData,
+	span *common.Span, scope []bool, field common.Field, key []byte,
+	setIndex func(pred *predicateData)) (*source, error) {
+	p := *preds
+	subsetIdx := -1
+	for i := range p {
+		if p[i].Field == field && !p[i].negated &&
+			bytes.Equal(p[i].key, key) {
+			subsetIdx = i
+			break
+		}
+	}
+	if subsetIdx < 0 {
+		return nil, nil
+	}
+	p = append(p[0:subsetIdx], p[subsetIdx+1:]...)
+	*preds = p
+	for i := range p {
+		if p[i].Field == common.BEGIN_TIME && !p[i].negated &&
+			p[i].Op != common.CONTAINS && p[i].Op != common.EQUALS {
+			pred := p[i]
+			*preds = append(p[0:i], p[i+1:]...)
+			setIndex(pred)
+			return pred.createSource(store, span, scope)
+		}
+	}
+	beginPred := common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+		Field: common.BEGIN_TIME,
+		Val:   strconv.FormatInt(math.MinInt64, 10),
+	}
+	beginPredData, err := loadPredicateData(&beginPred)
 	if err != nil {
 		return nil, err
 	}
-	return spanIdPredData.createSource(store, span)
+	setIndex(beginPredData)
+	return beginPredData.createSource(store, span, scope)
+}
+
+// Set the limit of a query to the limit we will actually use.  A missing or
+// zero limit becomes the default limit, and limits above the maximum are
+// lowered to it.
+func (store *dataStore) applyQueryLim(query *common.Query) error {
+	if query.Lim < 0 {
+		return common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid query limit %d: the limit can't be negative.", query.Lim)
+	}
+	if query.Lim == 0 {
+		query.Lim = store.queryDefaultLim
+	} else if query.Lim > store.queryMaxLim {
+		if store.lg.DebugEnabled() {
+			store.lg.Debugf("Lowering the limit of query %s to %d.\n",
+				query.String(), store.queryMaxLim)
+		}
+		query.Lim = store.queryMaxLim
+	}
+	return nil
 }
 
+// Run a query.  The query's limit is changed to the limit which was used,
+// and time predicate values are resolved to milliseconds since the epoch.
+// See applyQueryLim.
 func (store *dataStore) HandleQuery(query *common.Query) ([]*common.Span, error, []int) {
-	lg := store.lg
+	ret, _, err, numRead := store.handleQuery(query, false, nil)
+	return ret, err, numRead
+}
+
+// Run a query, and find out whether more spans match it than the limit
+// allowed.  To find out, we look for one more matching span than the limit,
+// which can mean reading many more rows when few spans match.  That's why
+// HandleQuery doesn't do it.
+func (store *dataStore) HandleQueryPage(query *common.Query) (*common.QueryPage, error) {
+	var plan *common.QueryPlan
+	if query.Plan {
+		plan = &common.QueryPlan{}
+	}
+	ret, hasMore, err, numRead := store.handleQuery(query, true, plan)
+	if err != nil {
+		return nil, err
+	}
+	page := &common.QueryPage{
+		Spans:   ret,
+		HasMore: hasMore,
+		Lim:     query.Lim,
+		Plan:    plan,
+	}
+	for i := range numRead {
+		page.Scanned += numRead[i]
+	}
+	if hasMore {
+		page.Next = common.NewQueryToken(ret[len(ret)-1])
+	}
+	return page, nil
+}
+
+// A query which has been validated, and is ready to run.
+type preparedQuery struct {
+	// The span to resume after, or nil to start at the beginning.
+	prev *common.Span
+
+	preds []*predicateData
+
+	// Which shards to scan.
+	scope []bool
+}
+
+// Validate a query, apply its limit, and resolve its time predicates against
+// now.  Saved searches are checked with this too, so that a search which
+// could never run is rejected when it is saved.
+func (store *dataStore) prepareQuery(query *common.Query,
+	now time.Time) (*preparedQuery, error) {
+	pq, err := store.loadQuery(query, now)
+	if err != nil {
+		return nil, err
+	}
+	err = checkNotOnlyNegated(pq.preds)
+	if err != nil {
+		return nil, err
+	}
+	return pq, nil
+}
+
+// Do everything prepareQuery does, except rejecting queries whose predicates
+// are all negated.  Such queries can still be explained.
+func (store *dataStore) loadQuery(query *common.Query,
+	now time.Time) (*preparedQuery, error) {
+	err := store.applyQueryLim(query)
+	if err != nil {
+		return nil, err
+	}
+	if query.MaxParents < 0 {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION,
+			nil, "Invalid maxParents %d: the value can't be negative.",
+			query.MaxParents)
+	}
+	prev := query.Prev
+	if query.After != "" {
+		if prev != nil {
+			return nil, common.NewHtraceError(
+				common.ERR_QUERY_VALIDATION, nil, "A query can't have both "+
+					"a continuation token and a previous span.")
+		}
+		prev, err = common.ParseQueryToken(query.After)
+		if err != nil {
+			return nil, common.NewHtraceError(
+				common.ERR_QUERY_VALIDATION, nil, "%s", err.Error())
+		}
+	}
 	// Parse predicate data.
-	var err error
 	preds := make([]*predicateData, len(query.Predicates))
 	for i := range query.Predicates {
-		preds[i], err = loadPredicateData(&query.Predicates[i])
+		err = resolveTimePredicate(&query.Predicates[i], now)
+		if err == nil {
+			preds[i], err = loadPredicateData(&query.Predicates[i])
+		}
+		if err != nil {
+			return nil, common.NewHtraceError(
+				common.ERR_QUERY_VALIDATION, map[string]string{
+					common.ERR_DETAIL_PREDICATE: strconv.Itoa(i),
+				}, "Invalid predicate %d: %s", i, err.Error())
+		}
+	}
+	scope, err := store.resolveShardFilter(query.ShardFilter)
+	if err != nil {
+		return nil, err
+	}
+	return &preparedQuery{prev: prev, preds: preds, scope: scope}, nil
+}
+
+// Run a query.  If peek is true, also returns whether there is at least one
+// more matching span after the ones returned.  If plan is non-nil, it is
+// filled in with how the query ran.
+func (store *dataStore) handleQuery(query *common.Query, peek bool,
+	plan *common.QueryPlan) ([]*common.Span, bool, error, []int) {
+	if store.testHooks != nil && store.testHooks.BeforeQuery != nil {
+		err := store.testHooks.BeforeQuery(query)
 		if err != nil {
-			return nil, err, nil
+			return nil, false, err, nil
 		}
 	}
+	// Relative times are all resolved against the same 'now', so that a
+	// query like now-1h..now covers exactly an hour.
+	now := time.Now()
+	pq, err := store.prepareQuery(query, now)
+	if err != nil {
+		return nil, false, err, nil
+	}
+	if plan != nil {
+		// Copy the query before the source adjusts its predicates for the
+		// continuation token.
+		plan.Query = *query
+		plan.Query.Predicates = append([]common.Predicate(nil),
+			query.Predicates...)
+		plan.CapturedMs = common.TimeToUnixMs(now)
+	}
+	preds := pq.preds
 	// Get a source of rows.
 	var src *source
-	src, err = store.obtainSource(&preds, query.Prev)
+	src, err = store.obtainSource(&preds, pq.prev, pq.scope)
 	if err != nil {
-		return nil, err, nil
+		return nil, false, err, nil
 	}
 	defer src.Close()
+	ret, hasMore := store.runSource(query, src, preds, peek, plan)
+	return ret, hasMore, nil, src.numRead
+}
+
+// Read the spans from a source which satisfy the predicates, up to the
+// query's limit.  If peek is true, also returns whether there is at least one
+// more matching span after the ones returned.
+func (store *dataStore) runSource(query *common.Query, src *source,
+	preds []*predicateData, peek bool,
+	plan *common.QueryPlan) ([]*common.Span, bool) {
+	lg := store.lg
 	if lg.DebugEnabled() {
 		lg.Debugf("HandleQuery %s: preds = %s, src = %v\n", query, preds, src)
 	}
+	// The number of spans which reached each stage, and passed it.  Stage 0
+	// is the source.
+	var stageIn, stageOut []int
+	if plan != nil {
+		stageIn = make([]int, len(preds)+1)
+		stageOut = make([]int, len(preds)+1)
+	}
 
-	// Filter the spans through the remaining predicates.
+	// Filter the spans through the remaining predicates.  Don't trust the
+	// limit to size the result slice, since most queries return fewer spans.
+	var err error
 	reserved := 32
 	if query.Lim < reserved {
 		reserved = query.Lim
 	}
 	ret := make([]*common.Span, 0, reserved)
-	for {
-		if len(ret) >= query.Lim {
+	hasMore := false
+	for !hasMore {
+		if len(ret) >= query.Lim && !peek {
 			if lg.DebugEnabled() {
 				lg.Debugf("HandleQuery %s: hit query limit after obtaining "+
 					"%d results. %s\n.", query, query.Lim, src.getStats())
 			}
 			break // we hit the result size limit
 		}
-		span := src.next()
-		if span == nil {
+		cand := src.nextCandidate()
+		if cand == nil {
 			if lg.DebugEnabled() {
 				lg.Debugf("HandleQuery %s: found %d result(s), which are "+
 					"all that exist. %s\n", query, len(ret), src.getStats())
@@ -1297,20 +3905,141 @@ func (store *dataStore) HandleQuery(query *common.Query) ([]*common.Span, error,
 			break // the source has no more spans to give
 		}
 		if lg.DebugEnabled() {
-			lg.Debugf("src.next returned span %s\n", span.ToJson())
+			lg.Debugf("src.nextCandidate returned span %s\n",
+				cand.span.Id.String())
 		}
+		if plan != nil {
+			stageOut[0]++
+		}
+		// Only fully decode the spans we are going to return, or which we
+		// need to fully decode to evaluate a predicate.
+		var span *common.Span
 		satisfied := true
 		for predIdx := range preds {
-			if preds[predIdx].satisfiedBy(span) != SATISFIED {
+			if plan != nil {
+				stageIn[predIdx+1]++
+			}
+			target := &cand.span
+			if preds[predIdx].Field == common.NUM_PARENTS {
+				err = cand.loadNumParents()
+				if err != nil {
+					store.lg.Errorf("HandleQuery %s: error decoding the "+
+						"parents of span %s: %s\n", query,
+						cand.span.Id.String(), err.Error())
+					satisfied = false
+					break
+				}
+			}
+			if preds[predIdx].needsFullSpan() {
+				span, err = store.materializeCandidate(query, cand, span)
+				if span == nil {
+					satisfied = false
+					break
+				}
+				target = span
+			}
+			if !preds[predIdx].accepts(target) {
 				satisfied = false
 				break
 			}
+			if plan != nil {
+				stageOut[predIdx+1]++
+			}
 		}
 		if satisfied {
-			ret = append(ret, span)
+			span, err = store.materializeCandidate(query, cand, span)
+			if span != nil {
+				if len(ret) >= query.Lim {
+					// We were only looking for whether there are more.
+					if lg.DebugEnabled() {
+						lg.Debugf("HandleQuery %s: found more than %d "+
+							"result(s). %s\n", query, query.Lim,
+							src.getStats())
+					}
+					hasMore = true
+				} else {
+					span.TruncateParents(query.MaxParents)
+					ret = append(ret, span)
+				}
+			}
+		}
+		cand.release()
+	}
+	if plan != nil {
+		for i := range src.numRead {
+			stageIn[0] += src.numRead[i]
+		}
+		fillPlan(plan, src, preds, stageIn, stageOut, ret)
+	}
+	return ret, hasMore
+}
+
+// Reject queries whose predicates are all negated.  Negated predicates only
+// filter the spans which other predicates select, so such a query would read
+// every span in the datastore.
+func checkNotOnlyNegated(preds []*predicateData) error {
+	if len(preds) == 0 {
+		return nil
+	}
+	for i := range preds {
+		if !preds[i].negated {
+			return nil
+		}
+	}
+	return common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+		"Every predicate in the query is negated.  Negated predicates can "+
+			"only filter the spans which other predicates select, so this "+
+			"query would scan every span.  Add a predicate which is not "+
+			"negated, such as a begin time range.")
+}
+
+// Find which shards a query's shard filter selects.  Returns nil if the query
+// has no shard filter, so that every shard is read.
+func (store *dataStore) resolveShardFilter(filter []string) ([]bool, error) {
+	if len(filter) == 0 {
+		return nil, nil
+	}
+	if !store.shardFilterEnabled {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Shard filters are disabled.  Set %s to true to enable them.",
+			conf.HTRACE_QUERY_SHARD_FILTER_ENABLED)
+	}
+	scope := make([]bool, len(store.shards))
+	for i := range filter {
+		shardIdx, err := strconv.Atoi(filter[i])
+		if err != nil {
+			shardIdx = -1
+			for j := range store.shards {
+				if store.shards[j].path == filter[i] {
+					shardIdx = j
+					break
+				}
+			}
+		}
+		if shardIdx < 0 || shardIdx >= len(store.shards) {
+			return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION,
+				nil, "Invalid shard filter entry '%s': there is no shard "+
+					"with that index or path.", filter[i])
 		}
+		scope[shardIdx] = true
+	}
+	return scope, nil
+}
+
+// Fully decode a span candidate, unless we already have.  Returns nil if the
+// span could not be decoded.
+func (store *dataStore) materializeCandidate(query *common.Query,
+	cand *spanCandidate, span *common.Span) (*common.Span, error) {
+	if span != nil {
+		return span, nil
+	}
+	span, err := cand.materialize()
+	if err != nil {
+		store.lg.Errorf("HandleQuery %s: error decoding span %s: %s\n",
+			query, cand.span.Id.String(), err.Error())
+		return nil, err
 	}
-	return ret, nil, src.numRead
+	return span, nil
 }
 
 func (store *dataStore) ServerStats() *common.ServerStats {
@@ -1320,20 +4049,71 @@ func (store *dataStore) ServerStats() *common.ServerStats {
 	for shardIdx := range store.shards {
 		shard := store.shards[shardIdx]
 		serverStats.Dirs[shardIdx].Path = shard.path
+		serverStats.Dirs[shardIdx].MaxLookupMs =
+			atomic.LoadUint64(&shard.maxLookupNs) / 1000000
+		serverStats.Dirs[shardIdx].SpanCacheHits =
+			atomic.LoadUint64(&shard.spanCacheHits)
+		serverStats.Dirs[shardIdx].SpanCacheMisses =
+			atomic.LoadUint64(&shard.spanCacheMisses)
+		if shard.intake != nil {
+			serverStats.Dirs[shardIdx].IntakeLogBytes = shard.intake.Size()
+		}
+		if !shard.acquire() {
+			serverStats.Dirs[shardIdx].QuarantineError = shard.health().Error
+			continue
+		}
 		r := levigo.Range{
 			Start: []byte{0},
 			Limit: []byte{0xff},
 		}
 		vals := shard.ldb.GetApproximateSizes([]levigo.Range{r})
 		serverStats.Dirs[shardIdx].ApproximateBytes = vals[0]
+		serverStats.Dirs[shardIdx].NumSpans = atomic.LoadUint64(&shard.numSpans)
 		serverStats.Dirs[shardIdx].LevelDbStats =
 			shard.ldb.PropertyValue("leveldb.stats")
+		serverStats.Dirs[shardIdx].Level0Files,
+			serverStats.Dirs[shardIdx].CompactionScore =
+			parseLevelDbStats(serverStats.Dirs[shardIdx].LevelDbStats)
+		shard.bloomStats(&serverStats.Dirs[shardIdx])
 		store.msink.lg.Debugf("levedb.stats for %s: %s\n",
 			shard.path, shard.ldb.PropertyValue("leveldb.stats"))
+		shard.release()
 	}
 	serverStats.LastStartMs = store.startMs
 	serverStats.CurMs = common.TimeToUnixMs(time.Now().UTC())
 	serverStats.ReapedSpans = atomic.LoadUint64(&store.rpr.ReapedSpans)
+	if store.dsmp != nil {
+		serverStats.DownsampledSpans =
+			atomic.LoadUint64(&store.dsmp.DroppedSpans)
+		serverStats.DownsampleKeptSpans =
+			atomic.LoadUint64(&store.dsmp.KeptSpans)
+	}
+	serverStats.NegativeDurationPolicy = store.negDurationPolicy
+	serverStats.WriteGroups, serverStats.ExpiredWriteGroups,
+		serverStats.EvictedWriteGroups = store.writeGroups.Stats()
+	serverStats.EvictedSpans = atomic.LoadUint64(&store.evictedSpans)
+	serverStats.ExpiredActiveSpans =
+		atomic.LoadUint64(&store.expiredActiveSpans)
+	serverStats.LateSpans = store.wmk.LateSpans()
+	serverStats.SpanCacheHits, serverStats.SpanCacheMisses =
+		store.spanCache.stats()
+	serverStats.ChildrenCacheHits, serverStats.ChildrenCacheMisses =
+		store.childrenCache.stats()
+	serverStats.HedgedLookups = atomic.LoadUint64(&store.hedgedLookups)
+	serverStats.HedgeCancels = atomic.LoadUint64(&store.hedgeCancels)
+	serverStats.LookupDeadlineMisses =
+		atomic.LoadUint64(&store.lookupDeadlineMisses)
+	serverStats.IntakeReplayedSpans = store.intakeReplayedSpans
+	serverStats.IntakeReplayMs = store.intakeReplayMs
+	serverStats.IntakeLogWaits = atomic.LoadUint64(&store.intakeLogWaits)
+	if store.canary != nil {
+		canaryStatus := store.canary.Status()
+		serverStats.CanaryVerified = canaryStatus.Verified
+		serverStats.CanaryNotFound = canaryStatus.NotFound
+		serverStats.CanaryMismatches = canaryStatus.Mismatches
+	}
+	serverStats.SpanCounts = *store.SpanCounts()
+	serverStats.Runtime = store.rsc.Get()
 	store.msink.PopulateServerStats(&serverStats)
 	return &serverStats
 }
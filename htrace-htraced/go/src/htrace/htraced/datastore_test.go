@@ -22,14 +22,21 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"github.com/ugorji/go/codec"
 	htrace "htrace/client"
 	"htrace/common"
 	"htrace/conf"
 	"htrace/test"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"os"
 	"reflect"
 	"sort"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -156,11 +163,23 @@ func testQueryExt(t *testing.T, ht *MiniHTraced, query *common.Query,
 	}
 }
 
+// The persistent datastore backends.  Tests of the on-disk datastore run
+// against each of them.
+var TEST_DISK_BACKENDS = []string{DATASTORE_BACKEND_LEVELDB,
+	DATASTORE_BACKEND_JOURNAL}
+
 // Test queries on the datastore.
 func TestSimpleQuery(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestSimpleQuery",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testSimpleQuery(t, backend)
+	}
+}
+
+func testSimpleQuery(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSimpleQuery" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		WrittenSpans: common.NewSemaphore(0),
@@ -188,8 +207,15 @@ func TestSimpleQuery(t *testing.T) {
 
 func TestQueries2(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestQueries2",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testQueries2(t, backend)
+	}
+}
+
+func testQueries2(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueries2" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		WrittenSpans: common.NewSemaphore(0),
@@ -242,8 +268,15 @@ func TestQueries2(t *testing.T) {
 
 func TestQueries3(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestQueries3",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testQueries3(t, backend)
+	}
+}
+
+func testQueries3(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueries3" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		WrittenSpans: common.NewSemaphore(0),
@@ -296,8 +329,15 @@ func TestQueries3(t *testing.T) {
 
 func TestQueries4(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestQueries4",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testQueries4(t, backend)
+	}
+}
+
+func testQueries4(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueries4" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		WrittenSpans: common.NewSemaphore(0),
@@ -370,7 +410,16 @@ var TEST_QUERIES5_SPANS []common.Span = []common.Span{
 
 func TestQueries5(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestQueries5",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testQueries5(t, backend)
+	}
+}
+
+func testQueries5(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueries5" + backend,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND: backend,
+		},
 		WrittenSpans: common.NewSemaphore(0),
 		DataDirs:     make([]string, 1),
 	}
@@ -418,8 +467,17 @@ func TestQueries5(t *testing.T) {
 }
 
 func BenchmarkDatastoreWrites(b *testing.B) {
-	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkDatastoreWrites",
+	benchmarkDatastoreWrites(b, DATASTORE_BACKEND_LEVELDB)
+}
+
+func BenchmarkDatastoreWritesJournal(b *testing.B) {
+	benchmarkDatastoreWrites(b, DATASTORE_BACKEND_JOURNAL)
+}
+
+func benchmarkDatastoreWrites(b *testing.B, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkDatastoreWrites" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 			conf.HTRACE_LOG_LEVEL:                     "INFO",
 		},
@@ -429,18 +487,27 @@ func BenchmarkDatastoreWrites(b *testing.B) {
 	if err != nil {
 		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
 	}
-	ht.Store.lg.Infof("BenchmarkDatastoreWrites: b.N = %d\n", b.N)
+	ht.Store.lg.Infof("BenchmarkDatastoreWrites(%s): b.N = %d\n", backend, b.N)
 	defer func() {
 		if r := recover(); r != nil {
 			ht.Store.lg.Infof("panic: %s\n", r.(error))
 		}
 		ht.Close()
 	}()
-	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-	allSpans := make([]*common.Span, b.N)
-	for n := range allSpans {
-		allSpans[n] = test.NewRandomSpan(rnd, allSpans[0:n])
+	gen := &test.SpanTreeGenerator{
+		Seed:            time.Now().UnixNano(),
+		Depth:           4,
+		MaxSpans:        b.N,
+		MinFanOut:       1,
+		MaxFanOut:       8,
+		MinDurationMs:   1,
+		MaxDurationMs:   60 * 1000,
+		StartMs:         common.TimeToUnixMs(time.Now().UTC()),
+		Nested:          true,
+		NumDescriptions: 20,
+		NumTracerIds:    10,
 	}
+	allSpans := gen.Generate().Spans
 
 	// Reset the timer to avoid including the time required to create new
 	// random spans in the benchmark total.
@@ -457,10 +524,179 @@ func BenchmarkDatastoreWrites(b *testing.B) {
 	assertNumWrittenEquals(b, ht.Store.msink, b.N)
 }
 
-func verifySuccessfulLoad(t *testing.T, allSpans common.SpanSlice,
-	dataDirs []string) {
+// Benchmark writing sub-millisecond spans, with and without the duration
+// index.
+func BenchmarkDatastoreWritesTinySpans(b *testing.B) {
+	benchmarkTinySpanWrites(b, "0")
+}
+
+func BenchmarkDatastoreWritesTinySpansUnindexed(b *testing.B) {
+	benchmarkTinySpanWrites(b, "1")
+}
+
+func benchmarkTinySpanWrites(b *testing.B, minDurationMs string) {
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkTinySpanWrites",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+			conf.HTRACE_LOG_LEVEL:                     "INFO",
+			conf.HTRACE_INDEX_MIN_DURATION_MS:         minDurationMs,
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	rnd := rand.New(rand.NewSource(2))
+	allSpans := make([]*common.Span, b.N)
+	for n := range allSpans {
+		allSpans[n] = test.NewRandomSpan(rnd, allSpans[0:n])
+		allSpans[n].End = allSpans[n].Begin
+	}
+	b.ResetTimer()
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for n := range allSpans {
+		ing.IngestSpan(allSpans[n])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(int64(b.N))
+	assertNumWrittenEquals(b, ht.Store.msink, b.N)
+}
+
+func BenchmarkDatastoreQueries(b *testing.B) {
+	const NUM_SPANS = 100000
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkDatastoreQueries",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+			conf.HTRACE_LOG_LEVEL:                     "INFO",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	rnd := rand.New(rand.NewSource(2))
+	allSpans := make([]*common.Span, NUM_SPANS)
+	numRare := 0
+	for n := range allSpans {
+		allSpans[n] = test.NewRandomSpan(rnd, allSpans[0:n])
+		if n%100 == 0 {
+			allSpans[n].Description = "rareDescription"
+			numRare++
+		}
+	}
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for n := range allSpans {
+		ing.IngestSpan(allSpans[n])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(NUM_SPANS)
+
+	// Scan every span by begin time, but only return the few which match
+	// the description filter.
+	query := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   fmt.Sprintf("%d", int64(math.MinInt64)),
+			},
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "rareDescription",
+			},
+		},
+		Lim: NUM_SPANS,
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		spans, err, _ := ht.Store.HandleQuery(query)
+		if err != nil {
+			b.Fatalf("Query failed: %s\n", err.Error())
+		}
+		if len(spans) != numRare {
+			b.Fatalf("Expected %d results, but got %d\n", numRare, len(spans))
+		}
+	}
+}
+
+func testFindChildrenOfSpanTree(t *testing.T, order test.EmissionOrder) {
+	gen := &test.SpanTreeGenerator{
+		Seed:            int64(order) + 1,
+		Depth:           4,
+		NumRoots:        1,
+		MinFanOut:       10,
+		MaxFanOut:       10,
+		MinDurationMs:   1000,
+		MaxDurationMs:   10000,
+		StartMs:         123456789,
+		Nested:          true,
+		NumDescriptions: 5,
+		NumTracerIds:    3,
+		Order:           order,
+	}
+	tree := gen.Generate()
+	if len(tree.Spans) != 1111 {
+		t.Fatalf("Expected 1111 spans, but generated %d\n", len(tree.Spans))
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestFindChildrenOfSpanTree",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 3),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range tree.Spans {
+		ing.IngestSpan(tree.Spans[i])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(int64(len(tree.Spans)))
+	for i := range tree.Spans {
+		span := tree.Spans[i]
+		expected := tree.ChildrenOf(span.Id)
+		children := ht.Store.FindChildren(span.Id, 100)
+		sort.Sort(common.SpanIdSlice(children))
+		if len(expected) != len(children) ||
+			(len(expected) > 0 && !reflect.DeepEqual(expected, children)) {
+			t.Fatalf("Expected children of %s at level %d to be %v, but "+
+				"got %v\n", span.Id.String(), tree.Levels[span.Id.String()],
+				expected, children)
+		}
+		for j := range children {
+			child := ht.Store.FindSpan(children[j])
+			if child == nil {
+				t.Fatalf("Failed to find child %s of %s\n",
+					children[j].String(), span.Id.String())
+			}
+			if child.Begin < span.Begin || child.End > span.End {
+				t.Fatalf("Child %s does not nest within its parent %s\n",
+					child.String(), span.String())
+			}
+		}
+	}
+}
+
+func TestFindChildrenOfSpanTreeParentFirst(t *testing.T) {
+	testFindChildrenOfSpanTree(t, test.PARENT_FIRST)
+}
+
+func TestFindChildrenOfSpanTreeChildFirst(t *testing.T) {
+	testFindChildrenOfSpanTree(t, test.CHILD_FIRST)
+}
+
+func verifySuccessfulLoad(t *testing.T, backend string,
+	allSpans common.SpanSlice, dataDirs []string) {
 	htraceBld := &MiniHTracedBuilder{
 		Name:                "TestReloadDataStore#verifySuccessfulLoad",
+		Cnf:                 map[string]string{conf.HTRACE_DATASTORE_BACKEND: backend},
 		DataDirs:            dataDirs,
 		KeepDataDirsOnClose: true,
 	}
@@ -480,7 +716,7 @@ func verifySuccessfulLoad(t *testing.T, allSpans common.SpanSlice,
 		if err != nil {
 			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
 		}
-		common.ExpectSpansEqual(t, allSpans[i], span)
+		expectSpanStored(t, allSpans[i], span)
 	}
 	// Look up the spans we wrote.
 	var span *common.Span
@@ -489,13 +725,15 @@ func verifySuccessfulLoad(t *testing.T, allSpans common.SpanSlice,
 		if err != nil {
 			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
 		}
-		common.ExpectSpansEqual(t, allSpans[i], span)
+		expectSpanStored(t, allSpans[i], span)
 	}
 }
 
-func verifyFailedLoad(t *testing.T, dataDirs []string, expectedErr string) {
+func verifyFailedLoad(t *testing.T, backend string, dataDirs []string,
+	expectedErr string) {
 	htraceBld := &MiniHTracedBuilder{
 		Name:                "TestReloadDataStore#verifyFailedLoad",
+		Cnf:                 map[string]string{conf.HTRACE_DATASTORE_BACKEND: backend},
 		DataDirs:            dataDirs,
 		KeepDataDirsOnClose: true,
 	}
@@ -507,8 +745,15 @@ func verifyFailedLoad(t *testing.T, dataDirs []string, expectedErr string) {
 }
 
 func TestReloadDataStore(t *testing.T) {
-	htraceBld := &MiniHTracedBuilder{Name: "TestReloadDataStore",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testReloadDataStore(t, backend)
+	}
+}
+
+func testReloadDataStore(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestReloadDataStore" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		DataDirs:            make([]string, 2),
@@ -552,7 +797,7 @@ func TestReloadDataStore(t *testing.T) {
 		if err != nil {
 			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
 		}
-		common.ExpectSpansEqual(t, allSpans[i], span)
+		expectSpanStored(t, allSpans[i], span)
 	}
 	hcl.Close()
 	ht.Close()
@@ -560,20 +805,28 @@ func TestReloadDataStore(t *testing.T) {
 
 	// Verify that we can reload the datastore, even if we configure the data
 	// directories in a different order.
-	verifySuccessfulLoad(t, allSpans, []string{dataDirs[1], dataDirs[0]})
+	verifySuccessfulLoad(t, backend, allSpans, []string{dataDirs[1], dataDirs[0]})
+
+	// The other persistent backend refuses to open the shards.
+	for _, other := range TEST_DISK_BACKENDS {
+		if other != backend {
+			verifyFailedLoad(t, other, dataDirs, "was created by the "+
+				backend+" datastore backend")
+		}
+	}
 
 	// If we try to reload the datastore with only one directory, it won't work
 	// (we need both).
-	verifyFailedLoad(t, []string{dataDirs[1]},
+	verifyFailedLoad(t, backend, []string{dataDirs[1]},
 		"The TotalShards field of all shards is 2, but we have 1 shards.")
 
 	// Test that we give an intelligent error message when 0 directories are
 	// configured.
-	verifyFailedLoad(t, []string{}, "No shard directories found.")
+	verifyFailedLoad(t, backend, []string{}, "No shard directories found.")
 
 	// Can't specify the same directory more than once... will get "lock
 	// already held by process"
-	verifyFailedLoad(t, []string{dataDirs[0], dataDirs[1], dataDirs[1]},
+	verifyFailedLoad(t, backend, []string{dataDirs[0], dataDirs[1], dataDirs[1]},
 		" already held by process.")
 
 	// Open the datastore and modify it to have the wrong DaemonId
@@ -601,7 +854,7 @@ func TestReloadDataStore(t *testing.T) {
 	}
 	dld.Close()
 	dld = nil
-	verifyFailedLoad(t, dataDirs, "DaemonId mismatch.")
+	verifyFailedLoad(t, backend, dataDirs, "DaemonId mismatch.")
 
 	// Open the datastore and modify it to have the wrong TotalShards
 	dld = NewDataStoreLoader(hcnf)
@@ -624,7 +877,7 @@ func TestReloadDataStore(t *testing.T) {
 	}
 	dld.Close()
 	dld = nil
-	verifyFailedLoad(t, dataDirs, "TotalShards mismatch.")
+	verifyFailedLoad(t, backend, dataDirs, "TotalShards mismatch.")
 
 	// Open the datastore and modify it to have the wrong LayoutVersion
 	dld = NewDataStoreLoader(hcnf)
@@ -647,7 +900,7 @@ func TestReloadDataStore(t *testing.T) {
 	}
 	dld.Close()
 	dld = nil
-	verifyFailedLoad(t, dataDirs, "The layout version of all shards is 2, "+
+	verifyFailedLoad(t, backend, dataDirs, "The layout version of all shards is 2, "+
 		"but we only support")
 
 	// It should work with data.store.clear set.
@@ -655,7 +908,10 @@ func TestReloadDataStore(t *testing.T) {
 		Name:                "TestReloadDataStore#clear",
 		DataDirs:            dataDirs,
 		KeepDataDirsOnClose: true,
-		Cnf:                 map[string]string{conf.HTRACE_DATA_STORE_CLEAR: "true"},
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND: backend,
+			conf.HTRACE_DATA_STORE_CLEAR:  "true",
+		},
 	}
 	ht, err = htraceBld.Build()
 	if err != nil {
@@ -665,8 +921,16 @@ func TestReloadDataStore(t *testing.T) {
 
 func TestQueriesWithContinuationTokens1(t *testing.T) {
 	t.Parallel()
-	htraceBld := &MiniHTracedBuilder{Name: "TestQueriesWithContinuationTokens1",
+	for _, backend := range TEST_DISK_BACKENDS {
+		testQueriesWithContinuationTokens1(t, backend)
+	}
+}
+
+func testQueriesWithContinuationTokens1(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{
+		Name: "TestQueriesWithContinuationTokens1" + backend,
 		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
 			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
 		},
 		WrittenSpans: common.NewSemaphore(0),
@@ -759,3 +1023,1735 @@ func TestQueryRowsScanned(t *testing.T) {
 	}, []common.Span{SIMPLE_TEST_SPANS[0]},
 		[]int{2, 1})
 }
+
+func countRootQueryResults(t *testing.T, ht *MiniHTraced, isRoot string,
+	beginMs int64) ([]*common.Span, int) {
+	spans, err, numScanned := ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.IS_ROOT,
+				Val:   isRoot,
+			},
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   strconv.FormatInt(beginMs, 10),
+			},
+		},
+		Lim: 10000,
+	})
+	if err != nil {
+		t.Fatalf("Query for isroot=%s failed: %s\n", isRoot, err.Error())
+	}
+	totalScanned := 0
+	for i := range numScanned {
+		totalScanned += numScanned[i]
+	}
+	return spans, totalScanned
+}
+
+func TestRootSpanQueries(t *testing.T) {
+	gen := &test.SpanTreeGenerator{
+		Seed:          1863,
+		Depth:         3,
+		NumRoots:      20,
+		MinFanOut:     3,
+		MaxFanOut:     3,
+		MinDurationMs: 1000,
+		MaxDurationMs: 10000,
+		StartMs:       123456789,
+		Nested:        true,
+		Order:         test.CHILD_FIRST,
+	}
+	tree := gen.Generate()
+	htraceBld := &MiniHTracedBuilder{Name: "TestRootSpanQueries",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range tree.Spans {
+		ing.IngestSpan(tree.Spans[i])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(int64(len(tree.Spans)))
+
+	// Only the roots should be returned, and only the root index should be
+	// scanned.
+	roots, numScanned := countRootQueryResults(t, ht, "true", 0)
+	if len(roots) != len(tree.Roots) {
+		t.Fatalf("Expected %d roots, but got %d\n", len(tree.Roots), len(roots))
+	}
+	for i := range roots {
+		if len(roots[i].Parents) != 0 {
+			t.Fatalf("Span %s is not a root.\n", roots[i].String())
+		}
+		if tree.Levels[roots[i].Id.String()] != 0 {
+			t.Fatalf("Span %s is not at level 0.\n", roots[i].String())
+		}
+	}
+	if numScanned > len(tree.Roots)+len(ht.Store.shards) {
+		t.Fatalf("Scanned %d rows to find %d roots.\n", numScanned,
+			len(tree.Roots))
+	}
+	nonRoots, _ := countRootQueryResults(t, ht, "false", 0)
+	if len(nonRoots) != len(tree.Spans)-len(tree.Roots) {
+		t.Fatalf("Expected %d non-root spans, but got %d\n",
+			len(tree.Spans)-len(tree.Roots), len(nonRoots))
+	}
+
+	// The begin time predicate should bound the scan of the root index.
+	lastRoot := roots[len(roots)-1]
+	later, _ := countRootQueryResults(t, ht, "true", lastRoot.Begin)
+	if len(later) != 1 || !later[0].Id.Equal(lastRoot.Id) {
+		t.Fatalf("Expected only %s to begin at or after %d, but got %v\n",
+			lastRoot.Id.String(), lastRoot.Begin, later)
+	}
+
+	// Rewriting a root span so that it has a parent should remove it from
+	// the root index.
+	rewritten := *lastRoot
+	rewritten.Parents = []common.SpanId{roots[0].Id}
+	ing = ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	ing.IngestSpan(&rewritten)
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(1)
+	roots, _ = countRootQueryResults(t, ht, "true", 0)
+	if len(roots) != len(tree.Roots)-1 {
+		t.Fatalf("Expected %d roots after the rewrite, but got %d\n",
+			len(tree.Roots)-1, len(roots))
+	}
+	for i := range roots {
+		if roots[i].Id.Equal(rewritten.Id) {
+			t.Fatalf("Rewritten span %s is still in the root index.\n",
+				rewritten.Id.String())
+		}
+	}
+}
+
+func queryNumParents(t *testing.T, ht *MiniHTraced, beginMs int64,
+	numParentsPreds ...common.Predicate) ([]*common.Span, []int) {
+	query := &common.Query{
+		Predicates: append([]common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   strconv.FormatInt(beginMs, 10),
+			},
+		}, numParentsPreds...),
+		Lim: 100,
+	}
+	spans, err, numScanned := ht.Store.HandleQuery(query)
+	if err != nil {
+		t.Fatalf("Query %s failed: %s\n", query.String(), err.Error())
+	}
+	return spans, numScanned
+}
+
+func expectSpanIds(t *testing.T, spans []*common.Span,
+	expected ...common.SpanId) {
+	if len(spans) != len(expected) {
+		t.Fatalf("Expected %d spans, but got %d: %v\n", len(expected),
+			len(spans), spans)
+	}
+	for i := range spans {
+		if !spans[i].Id.Equal(expected[i]) {
+			t.Fatalf("Expected span %d to be %s, but got %s\n", i,
+				expected[i].String(), spans[i].Id.String())
+		}
+	}
+}
+
+func TestNumParentsQueries(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestNumParentsQueries",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	aId := common.TestId("00000000000000000000000000000001")
+	bId := common.TestId("00000000000000000000000000000002")
+	cId := common.TestId("00000000000000000000000000000003")
+	dId := common.TestId("00000000000000000000000000000004")
+	eId := common.TestId("00000000000000000000000000000005")
+	fId := common.TestId("00000000000000000000000000000006")
+	newSpan := func(id common.SpanId, begin int64,
+		parents ...common.SpanId) *common.Span {
+		return &common.Span{Id: id, SpanData: common.SpanData{
+			Begin: begin, End: begin + 10, Description: id.String(),
+			TracerId: "tr", Parents: parents}}
+	}
+	ingestSpans(ht, []*common.Span{
+		newSpan(aId, 100),
+		newSpan(bId, 110),
+		newSpan(cId, 120, aId),
+		newSpan(dId, 130, aId, bId, cId),
+		newSpan(eId, 140, bId),
+		// f is a fan-in span which begins before the time range we query.
+		newSpan(fId, 90, aId, bId, cId),
+	})
+
+	// Only the fan-in span should be returned, and the numParents predicate
+	// should not change the number of rows we scan.
+	all, allScanned := queryNumParents(t, ht, 100)
+	expectSpanIds(t, all, aId, bId, cId, dId, eId)
+	fanIn, fanInScanned := queryNumParents(t, ht, 100, common.Predicate{
+		Op: common.GREATER_THAN_OR_EQUALS, Field: common.NUM_PARENTS, Val: "2"})
+	expectSpanIds(t, fanIn, dId)
+	if !reflect.DeepEqual(allScanned, fanInScanned) {
+		t.Fatalf("Expected the numParents predicate to scan %v rows, but it "+
+			"scanned %v\n", allScanned, fanInScanned)
+	}
+	if fanIn[0].NumParents != 3 ||
+		!strings.Contains(string(fanIn[0].ToJson()), `"np":3`) {
+		t.Fatalf("Expected the span JSON to include np=3, but got %s\n",
+			string(fanIn[0].ToJson()))
+	}
+	if strings.Contains(string(all[0].ToJson()), `"np"`) {
+		t.Fatalf("Expected the JSON of a root span to omit np, but got %s\n",
+			string(all[0].ToJson()))
+	}
+	roots, _ := queryNumParents(t, ht, 100, common.Predicate{
+		Op: common.EQUALS, Field: common.NUM_PARENTS, Val: "0"})
+	expectSpanIds(t, roots, aId, bId)
+	single, _ := queryNumParents(t, ht, 100,
+		common.Predicate{Op: common.GREATER_THAN,
+			Field: common.NUM_PARENTS, Val: "0"},
+		common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+			Field: common.NUM_PARENTS, Val: "1"})
+	expectSpanIds(t, single, cId, eId)
+
+	// Rewriting a span with fewer parents should update its parent count.
+	ingestSpans(ht, []*common.Span{newSpan(dId, 130, aId)})
+	fanIn, _ = queryNumParents(t, ht, 100, common.Predicate{
+		Op: common.GREATER_THAN_OR_EQUALS, Field: common.NUM_PARENTS, Val: "2"})
+	expectSpanIds(t, fanIn)
+	span := ht.Store.FindSpan(dId)
+	if span == nil || span.NumParents != 1 {
+		t.Fatalf("Expected the rewritten span to have NumParents = 1, but "+
+			"got %v\n", span)
+	}
+
+	// Spans written before NumParents existed don't store it, but we can
+	// still filter on it.
+	legacy := newSpan(common.TestId("00000000000000000000000000000007"),
+		150, aId, bId)
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+	var buf []byte
+	err = codec.NewEncoderBytes(&buf, &mh).Encode(legacy.SpanData)
+	if err != nil {
+		t.Fatalf("failed to encode span: %s\n", err.Error())
+	}
+	shd := ht.Store.shards[ht.Store.getShardIndex(legacy.Id)]
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	batch.Put(append([]byte{SPAN_ID_INDEX_PREFIX}, legacy.Id.Val()...), buf)
+	for _, key := range spanIndexKeys(legacy) {
+		batch.Put(key, EMPTY_BYTE_BUF)
+	}
+	err = shd.ldb.Write(ht.Store.writeOpts, batch)
+	if err != nil {
+		t.Fatalf("failed to write legacy span: %s\n", err.Error())
+	}
+	fanIn, _ = queryNumParents(t, ht, 100, common.Predicate{
+		Op: common.GREATER_THAN_OR_EQUALS, Field: common.NUM_PARENTS, Val: "2"})
+	expectSpanIds(t, fanIn, legacy.Id)
+	if fanIn[0].NumParents != 2 {
+		t.Fatalf("Expected the legacy span to have NumParents = 2, but got "+
+			"%d\n", fanIn[0].NumParents)
+	}
+
+	// Negative and non-numeric values are rejected.
+	for _, val := range []string{"-1", "two"} {
+		_, err, _ = ht.Store.HandleQuery(&common.Query{
+			Predicates: []common.Predicate{common.Predicate{
+				Op: common.EQUALS, Field: common.NUM_PARENTS, Val: val}},
+			Lim: 10,
+		})
+		if err == nil {
+			t.Fatalf("Expected numparents = %s to be rejected.\n", val)
+		}
+	}
+}
+
+func TestMalformedParents(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestMalformedParents",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	parentId := common.TestId("00000000000000000000000000000001")
+	otherParentId := common.TestId("00000000000000000000000000000002")
+	childId := common.TestId("00000000000000000000000000000003")
+	selfId := common.TestId("00000000000000000000000000000004")
+	spans := []*common.Span{
+		&common.Span{Id: parentId, SpanData: common.SpanData{
+			Begin: 123, End: 456, Description: "parent",
+			TracerId: "tr", Parents: []common.SpanId{}}},
+		&common.Span{Id: otherParentId, SpanData: common.SpanData{
+			Begin: 123, End: 456, Description: "otherParent",
+			TracerId: "tr", Parents: []common.SpanId{}}},
+		&common.Span{Id: childId, SpanData: common.SpanData{
+			Begin: 200, End: 300, Description: "child", TracerId: "tr",
+			Parents: []common.SpanId{parentId, otherParentId, parentId,
+				childId, parentId}}},
+		&common.Span{Id: selfId, SpanData: common.SpanData{
+			Begin: 200, End: 300, Description: "self", TracerId: "tr",
+			Parents: []common.SpanId{selfId}}},
+	}
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range spans {
+		ing.IngestSpan(spans[i])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+
+	// The stored spans should contain the cleaned parents.
+	child := ht.Store.FindSpan(childId)
+	if child == nil {
+		t.Fatalf("failed to find child span.\n")
+	}
+	expectedParents := []common.SpanId{parentId, otherParentId}
+	if !reflect.DeepEqual(expectedParents, child.Parents) {
+		t.Fatalf("Expected child parents to be %v, but got %v\n",
+			expectedParents, child.Parents)
+	}
+	self := ht.Store.FindSpan(selfId)
+	if self == nil {
+		t.Fatalf("failed to find self-referencing span.\n")
+	}
+	if len(self.Parents) != 0 {
+		t.Fatalf("Expected self-referencing span to have no parents, but "+
+			"got %v\n", self.Parents)
+	}
+	children := ht.Store.FindChildren(parentId, 100)
+	if !reflect.DeepEqual([]common.SpanId{childId}, children) {
+		t.Fatalf("Expected the children of %s to be [%s], but got %v\n",
+			parentId.String(), childId.String(), children)
+	}
+	children = ht.Store.FindChildren(selfId, 100)
+	if len(children) != 0 {
+		t.Fatalf("Expected no children of %s, but got %v\n",
+			selfId.String(), children)
+	}
+
+	// Both kinds of problem should be counted for the client address.
+	mtx := getClientSpanMetrics(ht.Store.msink, "127.0.0.1")
+	if mtx == nil {
+		t.Fatalf("no span metrics for 127.0.0.1 found.")
+	}
+	if mtx.DuplicateParents != 2 {
+		t.Fatalf("Expected 2 duplicate parents, but got %d\n",
+			mtx.DuplicateParents)
+	}
+	if mtx.SelfParents != 2 {
+		t.Fatalf("Expected 2 self parents, but got %d\n", mtx.SelfParents)
+	}
+
+	// Parent index entries written by older versions of htraced may refer
+	// to the span itself.  FindChildren should skip them.
+	shd := ht.Store.shards[ht.Store.getShardIndex(selfId)]
+	key := append(append([]byte{PARENT_ID_INDEX_PREFIX}, selfId.Val()...),
+		selfId.Val()...)
+	err = shd.ldb.Put(ht.Store.writeOpts, key, EMPTY_BYTE_BUF)
+	if err != nil {
+		t.Fatalf("failed to write legacy parent index entry: %s\n",
+			err.Error())
+	}
+	children = ht.Store.FindChildren(selfId, 100)
+	if len(children) != 0 {
+		t.Fatalf("Expected no children of %s after writing a legacy "+
+			"self-reference, but got %v\n", selfId.String(), children)
+	}
+}
+
+func TestPlacementDistribution(t *testing.T) {
+	const NUM_IDS = 1000000
+	const NUM_SHARDS = 7
+	for _, name := range []string{PLACEMENT_MODULO, PLACEMENT_JUMP} {
+		plc, err := NewPlacement(name, NUM_SHARDS)
+		if err != nil {
+			t.Fatalf("NewPlacement(%s) failed: %s\n", name, err.Error())
+		}
+		rnd := rand.New(rand.NewSource(1880))
+		sid := common.SpanId(make([]byte, 16))
+		counts := make([]int, NUM_SHARDS)
+		for i := 0; i < NUM_IDS; i++ {
+			rnd.Read(sid)
+			shardIdx := plc.Choose(sid)
+			if shardIdx < 0 || shardIdx >= NUM_SHARDS {
+				t.Fatalf("Placement %s chose invalid shard %d for %s\n",
+					name, shardIdx, sid.String())
+			}
+			counts[shardIdx]++
+		}
+		// Each shard should get within 2% of its fair share.
+		expected := float64(NUM_IDS) / NUM_SHARDS
+		for i := range counts {
+			if math.Abs(float64(counts[i])-expected) > expected*0.02 {
+				t.Fatalf("Placement %s put %d spans in shard %d, but we "+
+					"expected about %.0f.  Counts: %v\n", name, counts[i], i,
+					expected, counts)
+			}
+		}
+	}
+}
+
+func TestJumpPlacementMovement(t *testing.T) {
+	const NUM_IDS = 100000
+	before, _ := NewPlacement(PLACEMENT_JUMP, 7)
+	after, _ := NewPlacement(PLACEMENT_JUMP, 8)
+	rnd := rand.New(rand.NewSource(1880))
+	sid := common.SpanId(make([]byte, 16))
+	moved := 0
+	for i := 0; i < NUM_IDS; i++ {
+		rnd.Read(sid)
+		oldIdx, newIdx := before.Choose(sid), after.Choose(sid)
+		if oldIdx == newIdx {
+			continue
+		}
+		if newIdx != 7 {
+			t.Fatalf("Adding a shard moved %s from shard %d to shard %d.\n",
+				sid.String(), oldIdx, newIdx)
+		}
+		moved++
+	}
+	// Only the spans which belong in the new shard should move.
+	fraction := float64(moved) / NUM_IDS
+	if math.Abs(fraction-0.125) > 0.01 {
+		t.Fatalf("Expected about 1/8 of the spans to move, but %.3f did.\n",
+			fraction)
+	}
+}
+
+func buildPlacementHTraced(dataDirs []string,
+	cnf map[string]string) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDataStorePlacement",
+		Cnf:                 cnf,
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+func TestDataStorePlacement(t *testing.T) {
+	ht, err := buildPlacementHTraced(make([]string, 3), map[string]string{
+		conf.HTRACE_DATASTORE_PLACEMENT: PLACEMENT_JUMP,
+	})
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	if ht.Store.placement.Name() != PLACEMENT_JUMP {
+		t.Fatalf("Expected placement %s, but got %s\n", PLACEMENT_JUMP,
+			ht.Store.placement.Name())
+	}
+	NUM_TEST_SPANS := 30
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	ingestSpans(ht, allSpans)
+	ht.Close()
+	ht = nil
+
+	// The default placement doesn't match the one the datastore was created
+	// with.
+	_, err = buildPlacementHTraced(dataDirs, map[string]string{})
+	if err == nil {
+		t.Fatalf("Expected the datastore to refuse to open with the wrong " +
+			"placement.\n")
+	}
+	common.AssertErrContains(t, err, "The datastore was created with "+
+		"placement jump, but datastore.placement is modulo.")
+
+	// With the migration flag set, the datastore opens with the recorded
+	// placement, and we can still find every span.
+	ht, err = buildPlacementHTraced(dataDirs, map[string]string{
+		conf.HTRACE_DATASTORE_PLACEMENT_MIGRATE: "true",
+	})
+	if err != nil {
+		t.Fatalf("failed to reopen datastore: %s", err.Error())
+	}
+	if ht.Store.placement.Name() != PLACEMENT_JUMP {
+		t.Fatalf("Expected the recorded placement %s, but got %s\n",
+			PLACEMENT_JUMP, ht.Store.placement.Name())
+	}
+	for i := range allSpans {
+		span := ht.Store.FindSpan(allSpans[i].Id)
+		if span == nil {
+			t.Fatalf("Failed to find span %s after reopening.\n",
+				allSpans[i].Id.String())
+		}
+		common.ExpectSpansEqual(t, allSpans[i], span)
+	}
+
+	// An unknown placement is rejected.
+	_, err = buildPlacementHTraced([]string{"", ""}, map[string]string{
+		conf.HTRACE_DATASTORE_PLACEMENT: "random",
+	})
+	common.AssertErrContains(t, err, "Unknown placement strategy 'random'")
+}
+
+// Run a query over REST, and return the value of the partial results header.
+func queryPartialHeader(t *testing.T, ht *MiniHTraced, query *common.Query) string {
+	resp, err := http.Get("http://" + ht.Rsv.Addr().String() + "/query?query=" +
+		url.QueryEscape(query.String()))
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("query failed with status %d\n", resp.StatusCode)
+	}
+	return resp.Header.Get("X-HTraced-Partial-Results")
+}
+
+func TestShardFilterQueries(t *testing.T) {
+	const NUM_TEST_SPANS = 60
+	htraceBld := &MiniHTracedBuilder{Name: "TestShardFilterQueries",
+		Cnf: map[string]string{
+			conf.HTRACE_QUERY_SHARD_FILTER_ENABLED:    "true",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		DataDirs:     make([]string, 3),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ingestSpans(ht, createRandomTestSpans(NUM_TEST_SPANS))
+
+	query := &common.Query{Predicates: []common.Predicate{}, Lim: 100}
+	global, err := hcl.Query(query)
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(global) != NUM_TEST_SPANS {
+		t.Fatalf("Expected %d spans, but got %d\n", NUM_TEST_SPANS, len(global))
+	}
+	common.ExpectStrEqual(t, "", queryPartialHeader(t, ht, query))
+
+	// Query each shard on its own, by index or by path.
+	union := make(common.SpanSlice, 0, NUM_TEST_SPANS)
+	for shardIdx := range ht.Store.shards {
+		filter := strconv.Itoa(shardIdx)
+		if shardIdx == 2 {
+			filter = ht.Store.shards[shardIdx].path
+		}
+		scoped := &common.Query{Predicates: []common.Predicate{}, Lim: 100,
+			ShardFilter: []string{filter}}
+		spans, err := hcl.Query(scoped)
+		if err != nil {
+			t.Fatalf("Query(%s) failed: %s\n", scoped.String(), err.Error())
+		}
+		for i := range spans {
+			if ht.Store.getShardIndex(spans[i].Id) != shardIdx {
+				t.Fatalf("Query(%s) returned span %s, which is not in "+
+					"shard %d.\n", scoped.String(), spans[i].Id.String(),
+					shardIdx)
+			}
+			union = append(union, &spans[i])
+		}
+		common.ExpectStrEqual(t, "true", queryPartialHeader(t, ht, scoped))
+	}
+	sort.Sort(union)
+	if len(union) != len(global) {
+		t.Fatalf("Expected the per-shard queries to return %d spans, but "+
+			"they returned %d\n", len(global), len(union))
+	}
+	for i := range global {
+		common.ExpectSpansEqual(t, &global[i], union[i])
+	}
+
+	_, err = hcl.Query(&common.Query{Predicates: []common.Predicate{},
+		Lim: 100, ShardFilter: []string{"3"}})
+	common.AssertErrContains(t, err, "Invalid shard filter entry '3'")
+}
+
+func TestShardFilterDisabled(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestShardFilterDisabled",
+		InMemory: true}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	_, err, _ = ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{}, Lim: 10, ShardFilter: []string{"0"}})
+	common.AssertErrContains(t, err, "Shard filters are disabled")
+}
+
+// Get all the description index keys in the datastore.
+func descriptionIndexKeys(ht *MiniHTraced) [][]byte {
+	keys := make([][]byte, 0)
+	for _, shd := range ht.Store.shards {
+		iter := shd.ldb.NewIterator(ht.Store.readOpts)
+		for iter.Seek([]byte{DESCRIPTION_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if key[0] != DESCRIPTION_INDEX_PREFIX {
+				break
+			}
+			keys = append(keys, append([]byte{}, key...))
+		}
+		iter.Close()
+	}
+	return keys
+}
+
+// The description index only holds a prefix of each long description, plus a
+// hash of the whole thing, so EQUALS queries check the spans it returns
+// against the full description in the span record.  The other description
+// predicates are always checked that way.  Long descriptions which only
+// differ at the end must still be told apart.
+func TestLongDescriptionQueries(t *testing.T) {
+	const MAX_BYTES = 64
+	htraceBld := &MiniHTracedBuilder{Name: "TestLongDescriptionQueries",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES:   strconv.Itoa(MAX_BYTES),
+		},
+		DataDirs:     make([]string, 1),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	prefix := "SELECT " + strings.Repeat("column, ", 1024) + "FROM t WHERE k = "
+	spans := []common.Span{
+		common.Span{Id: common.TestId("00000000000000000000000000000001"),
+			SpanData: common.SpanData{Begin: 1, End: 2,
+				Description: prefix + "'A'", Parents: []common.SpanId{},
+				TracerId: "db"}},
+		common.Span{Id: common.TestId("00000000000000000000000000000002"),
+			SpanData: common.SpanData{Begin: 1, End: 2,
+				Description: prefix + "'B'", Parents: []common.SpanId{},
+				TracerId: "db"}},
+		common.Span{Id: common.TestId("00000000000000000000000000000003"),
+			SpanData: common.SpanData{Begin: 1, End: 2,
+				Description: "short", Parents: []common.SpanId{},
+				TracerId: "db"}},
+	}
+	createSpans(spans, ht.Store)
+	descQuery := func(op common.Op, val string) *common.Query {
+		return &common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: op, Field: common.DESCRIPTION, Val: val},
+			},
+			Lim: 10,
+		}
+	}
+	testQuery(t, ht, descQuery(common.EQUALS, prefix+"'A'"), spans[0:1])
+	testQuery(t, ht, descQuery(common.EQUALS, prefix+"'B'"), spans[1:2])
+	testQuery(t, ht, descQuery(common.EQUALS, prefix), []common.Span{})
+	testQuery(t, ht, descQuery(common.GREATER_THAN_OR_EQUALS, prefix+"'B'"),
+		spans[1:3])
+	testQuery(t, ht, descQuery(common.LESS_THAN_OR_EQUALS, prefix+"'A'"),
+		spans[0:1])
+	testQuery(t, ht, descQuery(common.CONTAINS, "WHERE k = 'B'"), spans[1:2])
+
+	// The long descriptions don't make long keys.
+	keys := descriptionIndexKeys(ht)
+	if len(keys) != len(spans) {
+		t.Fatalf("Expected %d description index keys, but got %d\n",
+			len(spans), len(keys))
+	}
+	maxKeyLen := 1 + MAX_BYTES + 2 + 8 + common.SPAN_ID_LEN
+	for i := range keys {
+		if len(keys[i]) > maxKeyLen {
+			t.Fatalf("Expected description index keys of at most %d bytes, "+
+				"but got one of %d bytes.\n", maxKeyLen, len(keys[i]))
+		}
+	}
+
+	// An entry which points at a span with another description, as an entry
+	// for a description with the same hash would, is skipped, and the scan
+	// goes on to the next entry.
+	shd := ht.Store.shards[0]
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	batch.Put(append(append([]byte{DESCRIPTION_INDEX_PREFIX},
+		descriptionIndexValue(prefix+"'B'", MAX_BYTES)...),
+		spans[0].Id.Val()...),
+		EMPTY_BYTE_BUF)
+	err = shd.ldb.Write(ht.Store.writeOpts, batch)
+	if err != nil {
+		t.Fatalf("failed to write description index entry: %s\n",
+			err.Error())
+	}
+	testQuery(t, ht, descQuery(common.EQUALS, prefix+"'B'"), spans[1:2])
+}
+
+func TestNegatedPredicates(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestNegatedPredicates",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	descs := []string{"getFile", "heartbeat", "getFile", "heartbeat check",
+		"putFile", "heartbeat", "getFile"}
+	spans := make([]common.Span, len(descs))
+	for i := range descs {
+		spans[i] = common.Span{
+			Id: common.TestId(fmt.Sprintf("%032x", i+1)),
+			SpanData: common.SpanData{Begin: int64(10 + i),
+				End: int64(20 + i), Description: descs[i],
+				Parents: []common.SpanId{}, TracerId: "dn"},
+		}
+	}
+	createSpans(spans, ht.Store)
+	rangeQuery := func(preds ...common.Predicate) *common.Query {
+		return &common.Query{
+			Predicates: append([]common.Predicate{
+				common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME, Val: "11"},
+				common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME, Val: "15"},
+			}, preds...),
+			Lim: 100,
+		}
+	}
+	noise := common.Predicate{Op: common.NOT_CONTAINS,
+		Field: common.DESCRIPTION, Val: "heartbeat"}
+	query := rangeQuery(noise)
+	testQuery(t, ht, query, []common.Span{spans[2], spans[4]})
+
+	// The rows which the negated predicate filtered out still count as
+	// scanned, so the query scans as many rows as it would without it.
+	_, err, filteredScanned := ht.Store.HandleQuery(rangeQuery(noise))
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	_, err, unfilteredScanned := ht.Store.HandleQuery(rangeQuery())
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(filteredScanned, unfilteredScanned) {
+		t.Fatalf("Expected the filtered query to scan %v rows, like the "+
+			"unfiltered one, but it scanned %v\n", unfilteredScanned,
+			filteredScanned)
+	}
+
+	// The negate flag means the same thing as the NOT_ operations.
+	testQuery(t, ht, rangeQuery(common.Predicate{Op: common.CONTAINS,
+		Field: common.DESCRIPTION, Val: "heartbeat", Negate: true}),
+		[]common.Span{spans[2], spans[4]})
+	testQuery(t, ht, rangeQuery(common.Predicate{Op: common.NOT_EQUALS,
+		Field: common.DESCRIPTION, Val: "heartbeat"}),
+		[]common.Span{spans[2], spans[3], spans[4]})
+	testQuery(t, ht, rangeQuery(common.Predicate{Op: common.EQUALS,
+		Field: common.SPAN_ID, Val: spans[2].Id.String(), Negate: true},
+		noise), []common.Span{spans[4]})
+
+	// A negated predicate on an indexed field doesn't become the source of
+	// the query.
+	testQuery(t, ht, &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "13", Negate: true},
+			common.Predicate{Op: common.CONTAINS,
+				Field: common.DESCRIPTION, Val: "File"},
+		},
+		Lim: 100,
+	}, []common.Span{spans[0], spans[2]})
+
+	// The existing operations are unchanged.
+	testQuery(t, ht, rangeQuery(common.Predicate{Op: common.CONTAINS,
+		Field: common.DESCRIPTION, Val: "heartbeat"}),
+		[]common.Span{spans[1], spans[3], spans[5]})
+	testQuery(t, ht, rangeQuery(common.Predicate{Op: common.EQUALS,
+		Field: common.DESCRIPTION, Val: "heartbeat"}),
+		[]common.Span{spans[1], spans[5]})
+
+	// Queries made only of negated predicates would scan everything, so
+	// they are rejected.
+	_, err, _ = ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{noise,
+			common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "15", Negate: true}},
+		Lim: 100,
+	})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	common.AssertErrContains(t, err, "Every predicate in the query is negated")
+
+	// A NOT_ operation can't also have the negate flag.
+	_, err, _ = ht.Store.HandleQuery(rangeQuery(common.Predicate{
+		Op: common.NOT_CONTAINS, Field: common.DESCRIPTION,
+		Val: "heartbeat", Negate: true}))
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+
+	// The client passes negated predicates through to the server.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	results, err := hcl.Query(rangeQuery(noise))
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(results) != 2 || !results[0].Id.Equal(spans[2].Id) ||
+		!results[1].Id.Equal(spans[4].Id) {
+		t.Fatalf("Unexpected query results %s\n", asJson(results))
+	}
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{noise},
+		Lim:        100,
+	})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+}
+
+// Test that spans shorter than index.min.duration.ms are left out of the
+// duration index, but can still be found by ID, as children, and by begin
+// time.
+func TestIndexMinDuration(t *testing.T) {
+	t.Parallel()
+	for _, backend := range TEST_DISK_BACKENDS {
+		testIndexMinDuration(t, backend)
+	}
+}
+
+func testIndexMinDuration(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestIndexMinDuration" + backend,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:     backend,
+			conf.HTRACE_INDEX_MIN_DURATION_MS: "2",
+			conf.HTRACE_INDEX_FULL_TRACERS:    "billing, auth",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	parentId := common.TestId("00000000000000000000000000000001")
+	spans := []*common.Span{
+		&common.Span{Id: parentId,
+			SpanData: common.SpanData{Begin: 100, End: 200,
+				Description: "parent", Parents: []common.SpanId{},
+				TracerId: "web"}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000002"),
+			SpanData: common.SpanData{Begin: 110, End: 110,
+				Description: "tiny", Parents: []common.SpanId{parentId},
+				TracerId: "web"}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000003"),
+			SpanData: common.SpanData{Begin: 120, End: 121,
+				Description: "tiny", Parents: []common.SpanId{parentId},
+				TracerId: "web"}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000004"),
+			SpanData: common.SpanData{Begin: 130, End: 130,
+				Description: "tiny", Parents: []common.SpanId{parentId},
+				TracerId: "billing"}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000005"),
+			SpanData: common.SpanData{Begin: 140, End: 142,
+				Description: "short", Parents: []common.SpanId{parentId},
+				TracerId: "web"}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000006"),
+			SpanData: common.SpanData{Begin: 150, End: 0,
+				Description: "active", Parents: []common.SpanId{parentId},
+				TracerId: "web"}},
+	}
+	ingestSpans(ht, spans)
+	expectSkipped := []bool{false, true, true, false, false, false}
+	for i := range spans {
+		span := ht.Store.FindSpan(spans[i].Id)
+		if span == nil {
+			t.Fatalf("Failed to find span %s\n", spans[i].Id.String())
+		}
+		common.ExpectSpansEqual(t, spans[i], span)
+		if span.IndexSkipped != expectSkipped[i] {
+			t.Fatalf("Expected span %s to have IndexSkipped = %t\n",
+				span.Id.String(), expectSkipped[i])
+		}
+	}
+	// Clients never see the marker.
+	body := expectRestResponse(t, fmt.Sprintf("http://%s/span/%s",
+		ht.Rsv.Addr().String(), spans[1].Id.String()), http.StatusOK, "")
+	if strings.Contains(string(body), `"xs"`) {
+		t.Fatalf("Expected the span sent to clients to leave out the "+
+			"index skip marker, but got %s\n", string(body))
+	}
+	children := ht.Store.FindChildren(parentId, 10)
+	if len(children) != len(spans)-1 {
+		t.Fatalf("Expected %d children, but got %d\n", len(spans)-1,
+			len(children))
+	}
+	stats := ht.Store.ServerStats()
+	if stats.IndexSkippedSpans != 2 {
+		t.Fatalf("Expected 2 index-skipped spans, but got %d\n",
+			stats.IndexSkippedSpans)
+	}
+
+	// Queries read from the duration index exclude the tiny spans.
+	testQuery(t, ht, &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.LESS_THAN_OR_EQUALS,
+				Field: common.DURATION,
+				Val:   "50",
+			},
+		},
+		Lim: 10,
+	}, []common.Span{*spans[4], *spans[3], *spans[5]})
+
+	// So do queries which read from another index and filter on duration.
+	testQuery(t, ht, &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   "110",
+			},
+			common.Predicate{
+				Op:    common.LESS_THAN_OR_EQUALS,
+				Field: common.DURATION,
+				Val:   "50",
+			},
+		},
+		Lim: 10,
+	}, []common.Span{*spans[3], *spans[4], *spans[5]})
+
+	// Queries which don't involve the duration find all the spans.
+	testQuery(t, ht, &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "tiny",
+			},
+		},
+		Lim: 10,
+	}, []common.Span{*spans[1], *spans[2], *spans[3]})
+}
+
+// Test that only the first index.max.parents parents of a wide span are
+// indexed, while the stored span keeps all of them.
+func TestIndexMaxParents(t *testing.T) {
+	t.Parallel()
+	for _, backend := range TEST_DISK_BACKENDS {
+		testIndexMaxParents(t, backend)
+	}
+}
+
+// Count the parent index entries which point at the given child.
+func countParentIndexEntries(ht *MiniHTraced, child common.SpanId) int {
+	count := 0
+	for _, shd := range ht.Store.shards {
+		iter := shd.ldb.NewIterator(ht.Store.readOpts)
+		for iter.Seek([]byte{PARENT_ID_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if key[0] != PARENT_ID_INDEX_PREFIX {
+				break
+			}
+			if bytes.Equal(key[len(key)-common.SPAN_ID_LEN:], child.Val()) {
+				count++
+			}
+		}
+		iter.Close()
+	}
+	return count
+}
+
+func expectChild(t *testing.T, ht *MiniHTraced, parent common.SpanId,
+	child common.SpanId, expected bool) {
+	found := false
+	for _, sid := range ht.Store.FindChildren(parent, 100) {
+		if sid.Equal(child) {
+			found = true
+		}
+	}
+	if found != expected {
+		t.Fatalf("Expected FindChildren(%s) to return %s: %t, but it "+
+			"returned it: %t\n", parent.String(), child.String(), expected,
+			found)
+	}
+}
+
+func testIndexMaxParents(t *testing.T, backend string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestIndexMaxParents" + backend,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND: backend,
+			conf.HTRACE_INDEX_MAX_PARENTS: "3",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	parents := make([]common.SpanId, 5)
+	for i := range parents {
+		parents[i] = common.TestId(fmt.Sprintf("000000000000000000000000000000%02x",
+			0x10+i))
+	}
+	wide := &common.Span{Id: common.TestId("00000000000000000000000000000001"),
+		SpanData: common.SpanData{Begin: 100, End: 200,
+			Description: "wide", Parents: parents, TracerId: "barrier"}}
+	// Clients can't set the marker themselves.
+	narrow := &common.Span{Id: common.TestId("00000000000000000000000000000002"),
+		SpanData: common.SpanData{Begin: 110, End: 120,
+			Description: "narrow", Parents: parents[3:5], TracerId: "web",
+			Info: common.TraceInfoMap{
+				common.PARENTS_INDEXED_INFO_KEY: "0",
+			}}}
+	ingestSpans(ht, []*common.Span{wide, narrow})
+
+	// The stored span keeps all of its parents, and is marked.
+	span := ht.Store.FindSpan(wide.Id)
+	if span == nil {
+		t.Fatalf("Failed to find span %s\n", wide.Id.String())
+	}
+	if !reflect.DeepEqual(span.Parents, parents) {
+		t.Fatalf("Expected the stored span to have parents %v, but got %v\n",
+			parents, span.Parents)
+	}
+	common.ExpectStrEqual(t, "3", span.Info[common.PARENTS_INDEXED_INFO_KEY])
+	span = ht.Store.FindSpan(narrow.Id)
+	if _, present := span.Info[common.PARENTS_INDEXED_INFO_KEY]; present {
+		t.Fatalf("Expected the narrow span not to be marked.\n")
+	}
+
+	// Only the first three parents are indexed.
+	if count := countParentIndexEntries(ht, wide.Id); count != 3 {
+		t.Fatalf("Expected 3 parent index entries for the wide span, but "+
+			"found %d\n", count)
+	}
+	if count := countParentIndexEntries(ht, narrow.Id); count != 2 {
+		t.Fatalf("Expected 2 parent index entries for the narrow span, but "+
+			"found %d\n", count)
+	}
+	expectChild(t, ht, parents[0], wide.Id, true)
+	expectChild(t, ht, parents[2], wide.Id, true)
+	expectChild(t, ht, parents[3], wide.Id, false)
+	expectChild(t, ht, parents[4], wide.Id, false)
+	expectChild(t, ht, parents[4], narrow.Id, true)
+
+	stats := ht.Store.ServerStats()
+	if stats.ParentIndexTruncatedSpans != 1 {
+		t.Fatalf("Expected 1 truncated span, but got %d\n",
+			stats.ParentIndexTruncatedSpans)
+	}
+	if stats.MaxNumParents != 5 || !stats.MaxNumParentsSpanId.Equal(wide.Id) ||
+		stats.MaxNumParentsTracerId != "barrier" {
+		t.Fatalf("Expected the widest span to be %s from barrier, with 5 "+
+			"parents, but got %s from %s, with %d parents\n", wide.Id.String(),
+			stats.MaxNumParentsSpanId.String(), stats.MaxNumParentsTracerId,
+			stats.MaxNumParents)
+	}
+	if stats.RecentMaxNumParents != 5 {
+		t.Fatalf("Expected RecentMaxNumParents = 5, but got %d\n",
+			stats.RecentMaxNumParents)
+	}
+
+	// Queries can ask for fewer parents.  NumParents still holds the real
+	// number.
+	spans, err, _ := ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "wide",
+			},
+		},
+		Lim:        10,
+		MaxParents: 2,
+	})
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	expectSpanIds(t, spans, wide.Id)
+	if !reflect.DeepEqual(spans[0].Parents, parents[0:2]) ||
+		spans[0].NumParents != 5 {
+		t.Fatalf("Expected 2 of 5 parents, but got %v of %d\n",
+			spans[0].Parents, spans[0].NumParents)
+	}
+	_, err, _ = ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "wide",
+			},
+		},
+		Lim:        10,
+		MaxParents: -1,
+	})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+
+	// So can REST lookups.  By default, all of the parents are returned.
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	span, err = hcl.FindSpanWithMaxParents(wide.Id, 2)
+	if err != nil {
+		t.Fatalf("FindSpanWithMaxParents failed: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(span.Parents, parents[0:2]) || span.NumParents != 5 {
+		t.Fatalf("Expected 2 of 5 parents, but got %v of %d\n",
+			span.Parents, span.NumParents)
+	}
+	span, err = hcl.FindSpan(wide.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if !reflect.DeepEqual(span.Parents, parents) {
+		t.Fatalf("Expected all 5 parents, but got %v\n", span.Parents)
+	}
+
+	// Rewriting the span with fewer parents removes the marker and the
+	// index entries it no longer needs.
+	rewritten := &common.Span{Id: wide.Id,
+		SpanData: common.SpanData{Begin: 100, End: 200,
+			Description: "wide", Parents: parents[3:5], TracerId: "barrier"}}
+	ingestSpans(ht, []*common.Span{rewritten})
+	span = ht.Store.FindSpan(wide.Id)
+	if _, present := span.Info[common.PARENTS_INDEXED_INFO_KEY]; present {
+		t.Fatalf("Expected the rewritten span not to be marked.\n")
+	}
+	if count := countParentIndexEntries(ht, wide.Id); count != 2 {
+		t.Fatalf("Expected 2 parent index entries for the rewritten span, "+
+			"but found %d\n", count)
+	}
+	expectChild(t, ht, parents[0], wide.Id, false)
+	expectChild(t, ht, parents[4], wide.Id, true)
+}
+
+// Test that malformed predicate values are rejected with an error naming the
+// predicate, rather than being parsed leniently or compared as strings.
+func TestMalformedPredicateValues(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestMalformedPredicateValues",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ingestSpans(ht, createRandomTestSpans(5))
+
+	numericVals := []string{"", " ", " 125", "125 ", "0x7d", "+125", "1e3",
+		"12.5", "1_000", "--1", "-", "９", "9223372036854775808"}
+	badVals := map[common.Field][]string{
+		common.BEGIN_TIME: numericVals,
+		common.END_TIME:   numericVals,
+		// Durations may have a fractional part, so "12.5" is valid.
+		common.DURATION: []string{"", " ", " 125", "125 ", "0x7d", "+125",
+			"1e3", "1_000", "--1", "-", "９", "9223372036854775808", ".5",
+			"-.5", "1.", "1.0000001", "1.-5", "1.5 ", "1..5",
+			"-9223372036854775808.5"},
+		common.NUM_PARENTS: append(numericVals, "-1", "2147483648"),
+		common.SPAN_ID: []string{"", "0x7d", "7d",
+			"00000000000000000000000000000001 ",
+			"0000000000000000000000000000000g",
+			"000000000000000000000000000000001",
+			"0000000000000000000000000000000A"},
+		common.IS_ROOT: []string{"", "yes", "1", " true"},
+	}
+	goodPred := common.Predicate{
+		Op:    common.GREATER_THAN_OR_EQUALS,
+		Field: common.BEGIN_TIME,
+		Val:   "0",
+	}
+	for field, vals := range badVals {
+		for _, op := range common.ValidOps() {
+			for _, val := range vals {
+				query := &common.Query{
+					Predicates: []common.Predicate{goodPred,
+						common.Predicate{Op: op, Field: field, Val: val}},
+					Lim: 10,
+				}
+				_, err, _ := ht.Store.HandleQuery(query)
+				if common.ErrorCodeOf(err) != common.ERR_QUERY_VALIDATION ||
+					err.(*common.HtraceError).PredicateIndex() != 1 {
+					t.Fatalf("Expected a validation error for predicate 1 "+
+						"of %s, but got %v\n", query.String(), err)
+				}
+			}
+		}
+	}
+
+	// Over REST, the errors are 400s which carry the predicate index.
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   " 125",
+			},
+		},
+		Lim: 10,
+	})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	if idx := err.(*common.HtraceError).PredicateIndex(); idx != 0 {
+		t.Fatalf("Expected the error to be about predicate 0, but got %d\n",
+			idx)
+	}
+
+	// Well-formed values still work, including negative numbers and empty
+	// descriptions.
+	for _, pred := range []common.Predicate{
+		{Op: common.GREATER_THAN_OR_EQUALS, Field: common.BEGIN_TIME,
+			Val: "-9223372036854775808"},
+		{Op: common.LESS_THAN_OR_EQUALS, Field: common.NUM_PARENTS,
+			Val: "007"},
+		{Op: common.CONTAINS, Field: common.DESCRIPTION, Val: ""},
+	} {
+		spans, err := hcl.Query(&common.Query{
+			Predicates: []common.Predicate{pred},
+			Lim:        10,
+		})
+		if err != nil || len(spans) != 5 {
+			t.Fatalf("Expected %s to match all 5 spans, but got %d, %v\n",
+				pred.String(), len(spans), err)
+		}
+	}
+	spans, err := hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "",
+			},
+		},
+		Lim: 10,
+	})
+	if err != nil || len(spans) != 0 {
+		t.Fatalf("Expected an empty description to match nothing, but got "+
+			"%d, %v\n", len(spans), err)
+	}
+}
+
+func TestDescriptionIndexQueries(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDescriptionIndexQueries",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	const NUM_SHARED = 5000
+	// The other descriptions sort right before and after the shared one, and
+	// one of them contains the byte which ends descriptions in the index.
+	others := []string{"getFileInf", "getFileInfo\x00", "getFileInfo\x01",
+		"getFileInfo2"}
+	spans := make([]common.Span, 0, NUM_SHARED+len(others)*100)
+	expectedIds := make([]common.SpanId, 0, NUM_SHARED)
+	for i := 0; i < NUM_SHARED; i++ {
+		sid := common.TestId(fmt.Sprintf("%016x%016x", i+1, 1))
+		spans = append(spans, common.Span{Id: sid,
+			SpanData: common.SpanData{Begin: int64(NUM_SHARED - i),
+				End: int64(NUM_SHARED + i), Description: "getFileInfo",
+				Parents: []common.SpanId{}, TracerId: "namenode"}})
+		expectedIds = append(expectedIds, sid)
+		if i%50 == 0 {
+			desc := others[(i/50)%len(others)]
+			spans = append(spans, common.Span{
+				Id: common.TestId(fmt.Sprintf("%016x%016x", i+1, 2)),
+				SpanData: common.SpanData{Begin: 1, End: 2,
+					Description: desc, Parents: []common.SpanId{},
+					TracerId: "namenode"}})
+		}
+	}
+	createSpans(spans, ht.Store)
+	descQuery := func(lim int, prev *common.Span) *common.Query {
+		return &common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: common.EQUALS, Field: common.DESCRIPTION,
+					Val: "getFileInfo"},
+			},
+			Lim:  lim,
+			Prev: prev,
+		}
+	}
+
+	// The spans come back in span id order, and only the matching spans are
+	// scanned.  Repeating the query gives the same result.
+	for i := 0; i < 3; i++ {
+		results, err, numScanned := ht.Store.HandleQuery(
+			descQuery(NUM_SHARED+1, nil))
+		if err != nil {
+			t.Fatalf("query failed: %s\n", err.Error())
+		}
+		expectSpanIds(t, results, expectedIds...)
+		totalScanned := 0
+		for j := range numScanned {
+			totalScanned += numScanned[j]
+		}
+		if totalScanned != NUM_SHARED {
+			t.Fatalf("Scanned %d rows to find %d spans.\n", totalScanned,
+				NUM_SHARED)
+		}
+	}
+
+	// Paging through the results with a small limit returns every span once.
+	var prev *common.Span
+	pagedIds := make([]common.SpanId, 0, NUM_SHARED)
+	for {
+		results, err, numScanned := ht.Store.HandleQuery(descQuery(7, prev))
+		if err != nil {
+			t.Fatalf("query failed: %s\n", err.Error())
+		}
+		totalScanned := 0
+		for j := range numScanned {
+			totalScanned += numScanned[j]
+		}
+		if totalScanned > 7+len(numScanned) {
+			t.Fatalf("Scanned %d rows to return a page of %d spans.\n",
+				totalScanned, len(results))
+		}
+		for j := range results {
+			pagedIds = append(pagedIds, results[j].Id)
+		}
+		if len(results) < 7 {
+			break
+		}
+		prev = results[len(results)-1]
+	}
+	if !reflect.DeepEqual(pagedIds, expectedIds) {
+		t.Fatalf("Paging returned %d spans, but expected %d, in span id "+
+			"order.\n", len(pagedIds), len(expectedIds))
+	}
+
+	// The descriptions around the shared one are still found exactly.
+	for _, desc := range others {
+		results, err, _ := ht.Store.HandleQuery(&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: common.EQUALS, Field: common.DESCRIPTION,
+					Val: desc},
+			},
+			Lim: NUM_SHARED,
+		})
+		if err != nil {
+			t.Fatalf("query failed: %s\n", err.Error())
+		}
+		if len(results) != 25 {
+			t.Fatalf("Expected 25 spans with description %q, but got %d\n",
+				desc, len(results))
+		}
+		for j := range results {
+			if results[j].Description != desc {
+				t.Fatalf("Query for description %q returned span %s with "+
+					"description %q\n", desc, results[j].Id.String(),
+					results[j].Description)
+			}
+		}
+	}
+}
+
+// Remove the description index of a shard, and mark the shard as having
+// layout version 4.
+func downgradeShardToV4(t *testing.T, shd *ShardLoader) {
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	batch := shd.ldb.NewWriteBatch()
+	for iter.Seek([]byte{DESCRIPTION_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key[0] != DESCRIPTION_INDEX_PREFIX {
+			break
+		}
+		batch.Delete(append([]byte{}, key...))
+	}
+	iter.Close()
+	err := shd.ldb.Write(shd.dld.writeOpts, batch)
+	batch.Close()
+	if err != nil {
+		t.Fatalf("failed to remove the description index of %s: %s\n",
+			shd.path, err.Error())
+	}
+	info := *shd.info
+	info.LayoutVersion = 4
+	err = shd.writeShardInfo(&info)
+	if err != nil {
+		t.Fatalf("failed to write shard info for %s: %s\n",
+			shd.path, err.Error())
+	}
+}
+
+func TestUpgradeLayoutV4(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testUpgradeLayoutV4(t, backend)
+	}
+}
+
+func testUpgradeLayoutV4(t *testing.T, backend string) {
+	ht, err := buildOnDataDirs("TestUpgradeLayoutV4"+backend, backend,
+		make([]string, 2), false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	hcnf := ht.Cnf.Clone()
+	allSpans := createRandomTestSpans(20)
+	ingestSpans(ht, allSpans)
+	ht.Close()
+	ht = nil
+
+	dld := NewDataStoreLoader(hcnf)
+	dld.LoadShards()
+	for i := range dld.shards {
+		downgradeShardToV4(t, dld.shards[i])
+	}
+	dld.Close()
+
+	ht, err = buildOnDataDirs("TestUpgradeLayoutV4"+backend+"#upgrade",
+		backend, dataDirs, false)
+	if err != nil {
+		t.Fatalf("failed to upgrade the datastore: %s", err.Error())
+	}
+	if ht.Store.shardInfo.LayoutVersion != CURRENT_LAYOUT_VERSION {
+		t.Fatalf("Expected layout version %d after the upgrade, but got %d\n",
+			CURRENT_LAYOUT_VERSION, ht.Store.shardInfo.LayoutVersion)
+	}
+	// Every span can be found through the rebuilt description index.
+	for i := range allSpans {
+		spans, err, numScanned := ht.Store.HandleQuery(&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: common.EQUALS,
+					Field: common.DESCRIPTION, Val: allSpans[i].Description},
+			},
+			Lim: len(allSpans),
+		})
+		if err != nil {
+			t.Fatalf("query failed: %s\n", err.Error())
+		}
+		found := false
+		for j := range spans {
+			if spans[j].Id.Equal(allSpans[i].Id) {
+				found = true
+			}
+		}
+		totalScanned := 0
+		for j := range numScanned {
+			totalScanned += numScanned[j]
+		}
+		if !found || totalScanned != len(spans) {
+			t.Fatalf("Expected to find span %s by its description, scanning "+
+				"only the matching spans, but got %d span(s) after scanning "+
+				"%d.\n", allSpans[i].Id.String(), len(spans), totalScanned)
+		}
+	}
+}
+
+// Replace the description index of a shard with one in the layout version 5
+// format, where each key holds the whole escaped description, and mark the
+// shard as having layout version 5.
+func downgradeShardToV5(t *testing.T, shd *ShardLoader) {
+	_, err := shd.clearDescriptionIndex()
+	if err != nil {
+		t.Fatalf("failed to remove the description index of %s: %s\n",
+			shd.path, err.Error())
+	}
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	batch := shd.ldb.NewWriteBatch()
+	for iter.Seek([]byte{SPAN_ID_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key[0] != SPAN_ID_INDEX_PREFIX {
+			break
+		}
+		var data partialSpanData
+		err = decodeSpanBytes(iter.Value(), &data)
+		if err != nil {
+			t.Fatalf("failed to decode span in %s: %s\n", shd.path,
+				err.Error())
+		}
+		v5Key := []byte{DESCRIPTION_INDEX_PREFIX}
+		for i := 0; i < len(data.Description); i++ {
+			switch data.Description[i] {
+			case 0:
+				v5Key = append(v5Key, 1, 1)
+			case 1:
+				v5Key = append(v5Key, 1, 2)
+			default:
+				v5Key = append(v5Key, data.Description[i])
+			}
+		}
+		v5Key = append(append(v5Key, 0), key[1:]...)
+		batch.Put(v5Key, EMPTY_BYTE_BUF)
+	}
+	iter.Close()
+	err = shd.ldb.Write(shd.dld.writeOpts, batch)
+	batch.Close()
+	if err != nil {
+		t.Fatalf("failed to write the description index of %s: %s\n",
+			shd.path, err.Error())
+	}
+	info := *shd.info
+	info.LayoutVersion = 5
+	info.DescriptionIndexMaxBytes = 0
+	err = shd.writeShardInfo(&info)
+	if err != nil {
+		t.Fatalf("failed to write shard info for %s: %s\n",
+			shd.path, err.Error())
+	}
+}
+
+func TestUpgradeLayoutV5(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testUpgradeLayoutV5(t, backend)
+	}
+}
+
+func testUpgradeLayoutV5(t *testing.T, backend string) {
+	ht, err := buildOnDataDirs("TestUpgradeLayoutV5"+backend, backend,
+		make([]string, 2), false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	hcnf := ht.Cnf.Clone()
+	allSpans := createRandomTestSpans(20)
+	longDesc := strings.Repeat("stack frame\n", 1000)
+	allSpans[3].Description = longDesc
+	ingestSpans(ht, allSpans)
+	ht.Close()
+	ht = nil
+
+	dld := NewDataStoreLoader(hcnf)
+	dld.LoadShards()
+	for i := range dld.shards {
+		downgradeShardToV5(t, dld.shards[i])
+	}
+	dld.Close()
+
+	ht, err = buildOnDataDirs("TestUpgradeLayoutV5"+backend+"#upgrade",
+		backend, dataDirs, false)
+	if err != nil {
+		t.Fatalf("failed to upgrade the datastore: %s", err.Error())
+	}
+	if ht.Store.shardInfo.LayoutVersion != CURRENT_LAYOUT_VERSION {
+		t.Fatalf("Expected layout version %d after the upgrade, but got %d\n",
+			CURRENT_LAYOUT_VERSION, ht.Store.shardInfo.LayoutVersion)
+	}
+	if ht.Store.shardInfo.DescriptionIndexMaxBytes !=
+		DEFAULT_DESCRIPTION_INDEX_MAX_BYTES {
+		t.Fatalf("Expected the upgrade to record %s = %d, but got %d\n",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES,
+			DEFAULT_DESCRIPTION_INDEX_MAX_BYTES,
+			ht.Store.shardInfo.DescriptionIndexMaxBytes)
+	}
+	// The whole-description keys were replaced.
+	keys := descriptionIndexKeys(ht)
+	if len(keys) != len(allSpans) {
+		t.Fatalf("Expected %d description index keys after the upgrade, "+
+			"but got %d\n", len(allSpans), len(keys))
+	}
+	for i := range keys {
+		if len(keys[i]) > 1+DEFAULT_DESCRIPTION_INDEX_MAX_BYTES+2+8+
+			common.SPAN_ID_LEN {
+			t.Fatalf("Found a description index key of %d bytes after "+
+				"the upgrade.\n", len(keys[i]))
+		}
+	}
+	spans, err, _ := ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.EQUALS,
+				Field: common.DESCRIPTION, Val: longDesc},
+		},
+		Lim: len(allSpans),
+	})
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	expectSpanIds(t, spans, allSpans[3].Id)
+}
+
+// Open the datastore in dataDirs with the given index.description.max.bytes.
+func buildWithDescriptionMaxBytes(name string, dataDirs []string,
+	maxBytes int, readOnly bool) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES: strconv.Itoa(maxBytes),
+			conf.HTRACE_READ_ONLY:                   fmt.Sprintf("%t", readOnly),
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+// Get the total size of the description index keys in the datastore.
+func descriptionIndexBytes(ht *MiniHTraced) int {
+	total := 0
+	for _, key := range descriptionIndexKeys(ht) {
+		total += len(key)
+	}
+	return total
+}
+
+// Changing index.description.max.bytes rebuilds the description index the
+// next time the datastore is opened, unless it is opened read-only.
+func TestDescriptionIndexMaxBytesChange(t *testing.T) {
+	const BIG_MAX_BYTES = 4096
+	const SMALL_MAX_BYTES = 32
+	ht, err := buildWithDescriptionMaxBytes(
+		"TestDescriptionIndexMaxBytesChange", make([]string, 2),
+		BIG_MAX_BYTES, false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	prefix := strings.Repeat("GET /api/v1/objects/", 100)
+	allSpans := createRandomTestSpans(10)
+	for i := range allSpans {
+		allSpans[i].Description = prefix + strconv.Itoa(i)
+	}
+	ingestSpans(ht, allSpans)
+	bigBytes := descriptionIndexBytes(ht)
+	ht.Close()
+	ht = nil
+
+	expectQueries := func(ht *MiniHTraced) {
+		for i := range allSpans {
+			spans, err, _ := ht.Store.HandleQuery(&common.Query{
+				Predicates: []common.Predicate{
+					common.Predicate{Op: common.EQUALS,
+						Field: common.DESCRIPTION,
+						Val:   allSpans[i].Description},
+				},
+				Lim: len(allSpans),
+			})
+			if err != nil {
+				t.Fatalf("query failed: %s\n", err.Error())
+			}
+			expectSpanIds(t, spans, allSpans[i].Id)
+		}
+	}
+	ht, err = buildWithDescriptionMaxBytes(
+		"TestDescriptionIndexMaxBytesChange#shrink", dataDirs,
+		SMALL_MAX_BYTES, false)
+	if err != nil {
+		t.Fatalf("failed to reopen the datastore: %s", err.Error())
+	}
+	if ht.Store.shardInfo.DescriptionIndexMaxBytes != SMALL_MAX_BYTES {
+		t.Fatalf("Expected the datastore to record %s = %d, but got %d\n",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES, SMALL_MAX_BYTES,
+			ht.Store.shardInfo.DescriptionIndexMaxBytes)
+	}
+	keys := descriptionIndexKeys(ht)
+	if len(keys) != len(allSpans) {
+		t.Fatalf("Expected %d description index keys after the rebuild, "+
+			"but got %d\n", len(allSpans), len(keys))
+	}
+	for i := range keys {
+		if len(keys[i]) > 1+SMALL_MAX_BYTES+2+8+common.SPAN_ID_LEN {
+			t.Fatalf("Found a description index key of %d bytes after "+
+				"the rebuild.\n", len(keys[i]))
+		}
+	}
+	smallBytes := descriptionIndexBytes(ht)
+	if smallBytes*10 > bigBytes {
+		t.Fatalf("Expected the rebuilt description index to be at least 10 "+
+			"times smaller than %d bytes, but it is %d bytes.\n",
+			bigBytes, smallBytes)
+	}
+	expectQueries(ht)
+	ht.Close()
+	ht = nil
+
+	// A read-only datastore keeps using the limit it was built with.
+	ht, err = buildWithDescriptionMaxBytes(
+		"TestDescriptionIndexMaxBytesChange#readOnly", dataDirs,
+		BIG_MAX_BYTES, true)
+	if err != nil {
+		t.Fatalf("failed to reopen the datastore read-only: %s", err.Error())
+	}
+	if ht.Store.descIndexMaxBytes != SMALL_MAX_BYTES {
+		t.Fatalf("Expected a read-only datastore to use %s = %d, but it "+
+			"uses %d\n", conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES,
+			SMALL_MAX_BYTES, ht.Store.descIndexMaxBytes)
+	}
+	if descriptionIndexBytes(ht) != smallBytes {
+		t.Fatalf("Expected a read-only datastore to leave its description " +
+			"index alone.\n")
+	}
+	expectQueries(ht)
+	ht.Close()
+	ht = nil
+
+	_, err = buildWithDescriptionMaxBytes(
+		"TestDescriptionIndexMaxBytesChange#invalid", dataDirs, 0, false)
+	if err == nil {
+		t.Fatalf("Expected building with %s = 0 to fail.\n",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES)
+	}
+	common.AssertErrContains(t, err, "Invalid value for "+
+		conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES)
+}
@@ -0,0 +1,650 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"sync"
+)
+
+//
+// Per-description latency statistics.
+//
+// Dashboards want the latency of the most common operations all the time, so
+// rather than scanning spans, the ingestors keep statistics as they go.  For
+// each hour, by the begin time of the span, we keep the count, the total,
+// minimum and maximum duration, and a QuantileSketch of the durations of the
+// finished spans with each description.  /stats/descriptions merges the hours
+// in the window it is asked about.  Active spans are left out, since they
+// don't have a duration yet, and so are spans which end before they begin.  A span which is written more than once is
+// counted each time.  We also count the spans which failed, so that
+// dashboards can show error rates next to the latencies, and the spans which
+// were deleted by downsampling.
+//
+// Each hour tracks at most description.stats.max.descriptions descriptions.
+// The spans with other descriptions are counted in the hour's "other"
+// statistics, and we remember how many spans we saw with each of them, up to
+// a limit.  Once an untracked description has been seen more often than the
+// least common tracked one, the two swap places: the statistics of the
+// demoted description are merged into "other", and the promoted one starts
+// afresh.  So the tracked descriptions are the most common ones, and their
+// statistics are exact unless they were promoted.
+//
+// The statistics of the hours which changed are saved in the first shard on
+// each datastore heartbeat, and when the datastore is closed, so a crash loses
+// at most one heartbeat's worth.  Spans are not removed from the statistics
+// when they are deleted.  Instead, an hour is dropped once the reaper has
+// expired all the spans which begin in it, or when there are more than
+// description.stats.max.hours hours.  Since the statistics contain span
+// descriptions, they are encrypted with the first shard's data key when span
+// encryption is on.
+//
+
+// The number of milliseconds in each bucket of the statistics.
+const DESC_STATS_HOUR_MS = 60 * 60 * 1000
+
+// How many untracked descriptions we remember for each tracked one.
+const DESC_STATS_UNTRACKED_FACTOR = 4
+
+// The statistics of some spans.
+type descAggregate struct {
+	// The number of spans seen with this description in this hour, including
+	// those counted in "other" before the description was tracked.
+	Seen uint64 `json:"e,omitempty"`
+
+	Count  uint64                `json:"c"`
+	SumNs  int64                 `json:"s"`
+	MinNs  int64                 `json:"n"`
+	MaxNs  int64                 `json:"x"`
+	Sketch common.QuantileSketch `json:"k"`
+
+	// The number of the spans which failed.
+	Errors uint64 `json:"f,omitempty"`
+
+	// The number of the spans which were deleted by downsampling.
+	Downsampled uint64 `json:"d,omitempty"`
+}
+
+func (agg *descAggregate) add(durNs int64, failed bool) {
+	if agg.Count == 0 || durNs < agg.MinNs {
+		agg.MinNs = durNs
+	}
+	if agg.Count == 0 || durNs > agg.MaxNs {
+		agg.MaxNs = durNs
+	}
+	agg.Count++
+	agg.SumNs += durNs
+	agg.Sketch.Add(durNs)
+	if failed {
+		agg.Errors++
+	}
+}
+
+func (agg *descAggregate) merge(other *descAggregate) {
+	agg.Downsampled += other.Downsampled
+	if other.Count == 0 {
+		return
+	}
+	if agg.Count == 0 || other.MinNs < agg.MinNs {
+		agg.MinNs = other.MinNs
+	}
+	if agg.Count == 0 || other.MaxNs > agg.MaxNs {
+		agg.MaxNs = other.MaxNs
+	}
+	agg.Count += other.Count
+	agg.SumNs += other.SumNs
+	agg.Sketch.Merge(&other.Sketch)
+	agg.Errors += other.Errors
+}
+
+// Get the number of the spans which were not deleted by downsampling.
+func (agg *descAggregate) remaining() uint64 {
+	if agg.Downsampled >= agg.Count {
+		return 0
+	}
+	return agg.Count - agg.Downsampled
+}
+
+func (agg *descAggregate) toStats(desc string) common.DescriptionStats {
+	return common.DescriptionStats{
+		Description: desc,
+		Count:       agg.Count,
+		SumNs:       agg.SumNs,
+		MinNs:       agg.MinNs,
+		MaxNs:       agg.MaxNs,
+		P50Ns:       agg.Sketch.Quantile(0.5),
+		P90Ns:       agg.Sketch.Quantile(0.9),
+		P99Ns:       agg.Sketch.Quantile(0.99),
+		Errors:      agg.Errors,
+		Downsampled: agg.Downsampled,
+	}
+}
+
+// The statistics of the spans which begin in one hour.
+type descStatsHour struct {
+	// The statistics of the tracked descriptions.
+	Tracked map[string]*descAggregate `json:"t"`
+
+	// The statistics of the spans whose descriptions weren't tracked.
+	Other descAggregate `json:"o"`
+
+	// The number of spans seen with each untracked description.
+	Untracked map[string]uint64 `json:"u,omitempty"`
+
+	// At most the Seen count of the least common tracked description.
+	minSeen uint64
+
+	// True if the hour changed since it was saved.
+	dirty bool
+}
+
+func newDescStatsHour() *descStatsHour {
+	return &descStatsHour{
+		Tracked:   make(map[string]*descAggregate),
+		Untracked: make(map[string]uint64),
+	}
+}
+
+type descStatsTracker struct {
+	store *dataStore
+
+	// The maximum number of descriptions tracked in each hour.
+	maxDescs int
+
+	// The maximum number of hours to keep.
+	maxHours int
+
+	// Encrypts the saved statistics, or nil if the first shard has no data
+	// key.  It has its own nonces, since we don't save from the shard
+	// goroutine.
+	cipher *spanCipher
+
+	// Protects hours and removed.
+	lock sync.Mutex
+
+	// The statistics, by hour since the epoch.
+	hours map[int64]*descStatsHour
+
+	// The hours which were dropped since the statistics were saved.
+	removed []int64
+
+	// The channel on which we receive datastore heartbeats.
+	heartbeats chan interface{}
+
+	// Tracks whether the goroutine which saves the statistics has exited.
+	exited sync.WaitGroup
+}
+
+// Create the description statistics tracker, or return nil if the
+// statistics are disabled.
+func newDescStatsTracker(store *dataStore, cnf *conf.Config) *descStatsTracker {
+	dst := &descStatsTracker{
+		store:    store,
+		maxDescs: cnf.GetInt(conf.HTRACE_DESC_STATS_MAX_DESCRIPTIONS),
+		maxHours: cnf.GetInt(conf.HTRACE_DESC_STATS_MAX_HOURS),
+		hours:    make(map[int64]*descStatsHour),
+	}
+	if dst.maxDescs <= 0 {
+		return nil
+	}
+	if dst.maxHours < 1 {
+		dst.maxHours = 1
+	}
+	return dst
+}
+
+// Get the hour a time in milliseconds since the epoch falls in.
+func descStatsHourOf(ms int64) int64 {
+	hour := ms / DESC_STATS_HOUR_MS
+	if ms < 0 && ms%DESC_STATS_HOUR_MS != 0 {
+		hour--
+	}
+	return hour
+}
+
+func descStatsKey(hour int64) []byte {
+	return append([]byte{DESCRIPTION_STATS_PREFIX}, u64toSlice(s2u64(hour))...)
+}
+
+// Add a span we are ingesting to the statistics.
+func (dst *descStatsTracker) observe(span *common.Span) {
+	if span.End == 0 || span.HasNegativeDuration() {
+		return
+	}
+	durNs := span.DurationNs()
+	failed := span.IsError()
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+	hr := dst.getHourLocked(descStatsHourOf(span.Begin))
+	if hr == nil {
+		return
+	}
+	hr.dirty = true
+	desc := span.Description
+	agg := hr.Tracked[desc]
+	if agg != nil {
+		agg.Seen++
+		agg.add(durNs, failed)
+		return
+	}
+	seen := hr.Untracked[desc] + 1
+	if len(hr.Tracked) < dst.maxDescs {
+		delete(hr.Untracked, desc)
+		agg = &descAggregate{Seen: seen}
+		agg.add(durNs, failed)
+		hr.Tracked[desc] = agg
+		return
+	}
+	hr.Other.add(durNs, failed)
+	if seen > hr.minSeen {
+		minDesc, minAgg := hr.leastCommon()
+		hr.minSeen = minAgg.Seen
+		if seen > minAgg.Seen {
+			delete(hr.Tracked, minDesc)
+			hr.Other.merge(minAgg)
+			dst.setUntrackedLocked(hr, minDesc, minAgg.Seen)
+			delete(hr.Untracked, desc)
+			// This span was counted in "other" already.
+			hr.Tracked[desc] = &descAggregate{Seen: seen}
+			hr.minSeen = 0
+			return
+		}
+	}
+	dst.setUntrackedLocked(hr, desc, seen)
+}
+
+// Count a span which was deleted by downsampling.  The span stays in the
+// other statistics, which describe the spans as they were ingested.
+func (dst *descStatsTracker) downsampled(span *common.Span) {
+	if span.End == 0 {
+		return
+	}
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+	hr := dst.hours[descStatsHourOf(span.Begin)]
+	if hr == nil {
+		return
+	}
+	hr.dirty = true
+	agg := hr.Tracked[span.Description]
+	if agg == nil {
+		agg = &hr.Other
+	}
+	agg.Downsampled++
+}
+
+// Find the tracked description which was seen least often.
+func (hr *descStatsHour) leastCommon() (string, *descAggregate) {
+	var minDesc string
+	var minAgg *descAggregate
+	for desc, agg := range hr.Tracked {
+		if minAgg == nil || agg.Seen < minAgg.Seen ||
+			(agg.Seen == minAgg.Seen && desc < minDesc) {
+			minDesc, minAgg = desc, agg
+		}
+	}
+	return minDesc, minAgg
+}
+
+// Remember how many spans we saw with an untracked description.  If we
+// already remember too many, forget the least common one.
+func (dst *descStatsTracker) setUntrackedLocked(hr *descStatsHour,
+	desc string, seen uint64) {
+	if _, present := hr.Untracked[desc]; !present &&
+		len(hr.Untracked) >= dst.maxDescs*DESC_STATS_UNTRACKED_FACTOR {
+		var minDesc string
+		minSeen := seen
+		for udesc, useen := range hr.Untracked {
+			if useen < minSeen {
+				minDesc, minSeen = udesc, useen
+			}
+		}
+		if minSeen == seen {
+			return
+		}
+		delete(hr.Untracked, minDesc)
+	}
+	hr.Untracked[desc] = seen
+}
+
+// Get the statistics of an hour, creating them if needed.  Returns nil if
+// the hour is too old to keep.
+func (dst *descStatsTracker) getHourLocked(hour int64) *descStatsHour {
+	hr := dst.hours[hour]
+	if hr != nil {
+		return hr
+	}
+	if (hour+1)*DESC_STATS_HOUR_MS <= dst.store.rpr.GetReaperDate() {
+		return nil
+	}
+	if len(dst.hours) >= dst.maxHours {
+		oldest := hour
+		for h := range dst.hours {
+			if h < oldest {
+				oldest = h
+			}
+		}
+		if oldest == hour {
+			return nil
+		}
+		dst.removeHourLocked(oldest)
+	}
+	hr = newDescStatsHour()
+	dst.hours[hour] = hr
+	return hr
+}
+
+func (dst *descStatsTracker) removeHourLocked(hour int64) {
+	delete(dst.hours, hour)
+	dst.removed = append(dst.removed, hour)
+}
+
+// Load the saved statistics.
+func (dst *descStatsTracker) load() {
+	store := dst.store
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to load the description statistics, because "+
+			"shard %s is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	if shd.cipher != nil {
+		dst.cipher = &spanCipher{
+			aead:   shd.cipher.aead,
+			nonces: bufio.NewReaderSize(rand.Reader, 4096),
+		}
+	}
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+	prefix := []byte{DESCRIPTION_STATS_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if len(key) != 9 {
+			store.lg.Errorf("Ignoring description statistics with an invalid "+
+				"key of length %d.\n", len(key))
+			continue
+		}
+		hour := int64(keyToU64(key[1:9]) ^ 0x8000000000000000)
+		hr := newDescStatsHour()
+		buf, err := dst.openRecord(key, iter.Value())
+		if err == nil {
+			err = json.Unmarshal(buf, hr)
+		}
+		if err != nil {
+			store.lg.Errorf("Error parsing the description statistics of "+
+				"hour %d: %s\n", hour, err.Error())
+			continue
+		}
+		if hr.Untracked == nil {
+			hr.Untracked = make(map[string]uint64)
+		}
+		// Keys are in hour order, so the newest hours win.
+		if len(dst.hours) >= dst.maxHours {
+			oldest := hour
+			for h := range dst.hours {
+				if h < oldest {
+					oldest = h
+				}
+			}
+			dst.removeHourLocked(oldest)
+		}
+		dst.hours[hour] = hr
+	}
+	if len(dst.hours) > 0 {
+		store.lg.Infof("Loaded %d hour(s) of description statistics.\n",
+			len(dst.hours))
+	}
+}
+
+// Decrypt the saved statistics of an hour, if they are encrypted.
+func (dst *descStatsTracker) openRecord(key []byte, buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != SPAN_ENCRYPTED_MAGIC {
+		return buf, nil
+	}
+	if dst.cipher == nil {
+		return nil, errors.New("The statistics are encrypted, but the " +
+			"shard has no data key.")
+	}
+	nonceLen := dst.cipher.aead.NonceSize()
+	if len(buf) < 1+nonceLen+dst.cipher.aead.Overhead() {
+		return nil, errors.New("The encrypted statistics are truncated.")
+	}
+	return dst.cipher.aead.Open(nil, buf[1:1+nonceLen], buf[1+nonceLen:], key)
+}
+
+// Save the hours which changed, and remove the ones which were dropped or
+// have expired.
+func (dst *descStatsTracker) save() {
+	store := dst.store
+	dst.lock.Lock()
+	rdate := store.rpr.GetReaperDate()
+	for hour := range dst.hours {
+		if (hour+1)*DESC_STATS_HOUR_MS <= rdate {
+			dst.removeHourLocked(hour)
+		}
+	}
+	puts := make(map[int64][]byte)
+	for hour, hr := range dst.hours {
+		if !hr.dirty {
+			continue
+		}
+		buf, err := json.Marshal(hr)
+		if err == nil && dst.cipher != nil {
+			buf, err = dst.cipher.seal(descStatsKey(hour), buf)
+		}
+		if err != nil {
+			store.lg.Errorf("Error encoding the description statistics of "+
+				"hour %d: %s\n", hour, err.Error())
+			continue
+		}
+		puts[hour] = buf
+		hr.dirty = false
+	}
+	removed := dst.removed
+	dst.removed = nil
+	dst.lock.Unlock()
+	if len(puts) == 0 && len(removed) == 0 {
+		return
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to save the description statistics, because "+
+			"shard %s is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	for _, hour := range removed {
+		batch.Delete(descStatsKey(hour))
+	}
+	for hour, buf := range puts {
+		batch.Put(descStatsKey(hour), buf)
+	}
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		store.lg.Errorf("Error saving the description statistics to %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+		return
+	}
+	store.lg.Debugf("Saved %d hour(s) of description statistics, and "+
+		"removed %d.\n", len(puts), len(removed))
+}
+
+// Get the statistics of the spans which begin in [beginMs, endMs), widened
+// to whole hours.  At most lim descriptions are returned; the rest are
+// counted in Other.
+func (dst *descStatsTracker) Get(beginMs int64, endMs int64,
+	lim int) *common.DescriptionStatsResponse {
+	firstHour := descStatsHourOf(beginMs)
+	endHour := descStatsHourOf(endMs)
+	if endHour*DESC_STATS_HOUR_MS < endMs {
+		endHour++
+	}
+	resp := &common.DescriptionStatsResponse{
+		BeginMs:      firstHour * DESC_STATS_HOUR_MS,
+		EndMs:        endHour * DESC_STATS_HOUR_MS,
+		Descriptions: []common.DescriptionStats{},
+	}
+	if dst == nil {
+		return resp
+	}
+	merged := make(map[string]*descAggregate)
+	var other descAggregate
+	dst.lock.Lock()
+	for hour, hr := range dst.hours {
+		if hour < firstHour || hour >= endHour {
+			continue
+		}
+		for desc, agg := range hr.Tracked {
+			if agg.Count == 0 {
+				continue
+			}
+			magg := merged[desc]
+			if magg == nil {
+				magg = &descAggregate{}
+				merged[desc] = magg
+			}
+			magg.merge(agg)
+		}
+		other.merge(&hr.Other)
+	}
+	dst.lock.Unlock()
+	stats := make(descStatsByCount, 0, len(merged))
+	for desc, agg := range merged {
+		stats = append(stats, agg.toStats(desc))
+	}
+	sort.Sort(stats)
+	for i := range stats {
+		if i < lim {
+			resp.Descriptions = append(resp.Descriptions, stats[i])
+		} else {
+			other.merge(merged[stats[i].Description])
+		}
+	}
+	resp.Other = other.toStats("")
+	return resp
+}
+
+// Count the finished spans which begin in each hour of [firstHour, endHour)
+// and were not deleted by downsampling.  If desc is non-nil, only the spans
+// with that description are counted.  Returns false if the statistics can't
+// say: an hour is missing, or the description wasn't tracked for all of an
+// hour.
+func (dst *descStatsTracker) countByHour(firstHour int64, endHour int64,
+	desc *string) ([]uint64, bool) {
+	counts := make([]uint64, endHour-firstHour)
+	dst.lock.Lock()
+	defer dst.lock.Unlock()
+	for hour := firstHour; hour < endHour; hour++ {
+		hr := dst.hours[hour]
+		if hr == nil {
+			return nil, false
+		}
+		if desc == nil {
+			count := hr.Other.remaining()
+			for _, agg := range hr.Tracked {
+				count += agg.remaining()
+			}
+			counts[hour-firstHour] = count
+			continue
+		}
+		agg := hr.Tracked[*desc]
+		if agg == nil {
+			// If there was room to track the description, it was never
+			// seen in this hour.
+			if _, seen := hr.Untracked[*desc]; seen ||
+				len(hr.Tracked) >= dst.maxDescs {
+				return nil, false
+			}
+			continue
+		}
+		if agg.Seen != agg.Count {
+			// Some of the spans were counted in "other".
+			return nil, false
+		}
+		counts[hour-firstHour] = agg.remaining()
+	}
+	return counts, true
+}
+
+// Sorts description statistics by descending count, and then by description.
+type descStatsByCount []common.DescriptionStats
+
+func (dsc descStatsByCount) Len() int {
+	return len(dsc)
+}
+
+func (dsc descStatsByCount) Less(i, j int) bool {
+	if dsc[i].Count != dsc[j].Count {
+		return dsc[i].Count > dsc[j].Count
+	}
+	return dsc[i].Description < dsc[j].Description
+}
+
+func (dsc descStatsByCount) Swap(i, j int) {
+	dsc[i], dsc[j] = dsc[j], dsc[i]
+}
+
+// Start saving the statistics on each heartbeat.
+func (dst *descStatsTracker) Start(hb *Heartbeater) {
+	dst.heartbeats = make(chan interface{}, 1)
+	dst.exited.Add(1)
+	go func() {
+		defer dst.exited.Done()
+		for {
+			_, isOpen := <-dst.heartbeats
+			if !isOpen {
+				return
+			}
+			dst.save()
+		}
+	}()
+	hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "descStatsTracker",
+		targetChan: dst.heartbeats,
+	})
+}
+
+// Stop saving the statistics on each heartbeat, and save them one last time.
+// The heartbeater must already have been shut down.
+func (dst *descStatsTracker) Stop() {
+	if dst.heartbeats == nil {
+		return
+	}
+	close(dst.heartbeats)
+	dst.exited.Wait()
+	dst.heartbeats = nil
+	dst.save()
+}
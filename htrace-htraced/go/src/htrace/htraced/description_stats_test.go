@@ -0,0 +1,231 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func buildDescStatsHTraced(t *testing.T, dataDirs []string) *MiniHTraced {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDescriptionStats",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "300000",
+			conf.HTRACE_DESC_STATS_MAX_DESCRIPTIONS:   "2",
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	return ht
+}
+
+// Make the given spans finished spans with the given description which begin
+// in the given hour.  The i-th span lasts (i + 1) * stepNs nanoseconds.
+func setDescStatsSpans(spans []*common.Span, desc string, hour int64,
+	stepNs int64) []*common.Span {
+	for i := range spans {
+		spans[i].Description = desc
+		beginNs := (hour*DESC_STATS_HOUR_MS + int64(i)) * common.NS_PER_MS
+		spans[i].SetBeginNs(beginNs)
+		spans[i].SetEndNs(beginNs + int64(i+1)*stepNs)
+	}
+	return spans
+}
+
+// Check the statistics of count spans created by createDescStatsSpans.
+func expectDescStats(t *testing.T, stats *common.DescriptionStats,
+	desc string, count int, stepNs int64) {
+	if stats.Description != desc || stats.Count != uint64(count) ||
+		stats.SumNs != stepNs*int64(count*(count+1)/2) ||
+		stats.MinNs != stepNs || stats.MaxNs != stepNs*int64(count) {
+		t.Fatalf("Unexpected statistics for %d spans of %s: %s\n", count,
+			desc, asJson(stats))
+	}
+	quantiles := []struct {
+		q   float64
+		val int64
+	}{{0.5, stats.P50Ns}, {0.9, stats.P90Ns}, {0.99, stats.P99Ns}}
+	for _, qt := range quantiles {
+		exact := stepNs * int64(1+int(qt.q*float64(count-1)))
+		maxErr := common.SKETCH_RELATIVE_ACCURACY*float64(exact) + 1
+		diff := float64(qt.val - exact)
+		if diff < -maxErr || diff > maxErr {
+			t.Fatalf("Expected quantile %g of %s to be about %d, but got "+
+				"%s\n", qt.q, desc, exact, asJson(stats))
+		}
+	}
+}
+
+func getDescStats(t *testing.T, hcl *htrace.Client, beginMs int64,
+	endMs int64, lim int) *common.DescriptionStatsResponse {
+	resp, err := hcl.DescriptionStats(beginMs, endMs, lim)
+	if err != nil {
+		t.Fatalf("DescriptionStats failed: %s\n", err.Error())
+	}
+	return resp
+}
+
+func TestDescriptionStats(t *testing.T) {
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(),
+			fmt.Sprintf("TestDescriptionStats%d", i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+	ht := buildDescStatsHTraced(t, dataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+	}()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer func() {
+		hcl.Close()
+	}()
+
+	// In the first hour, "read" and "write" are the most common descriptions,
+	// so they are tracked, and the rest are counted in "other".  Active spans
+	// are left out.
+	const hour = 400000
+	allSpans := createRandomTestSpans(418)
+	setDescStatsSpans(allSpans[0:300], "read", hour, 1000)
+	setDescStatsSpans(allSpans[300:400], "write", hour, 7000)
+	setDescStatsSpans(allSpans[400:401], "rare1", hour, 5)
+	setDescStatsSpans(allSpans[401:403], "rare2", hour, 3)
+	active := allSpans[403]
+	active.Description = "rare1"
+	active.Begin = hour * DESC_STATS_HOUR_MS
+	active.End = 0
+	active.BeginNs = 0
+	active.EndNs = 0
+
+	// In the second hour, "hot" becomes common after "a" and "b" were
+	// tracked, so it replaces one of them.
+	setDescStatsSpans(allSpans[404:405], "a", hour+1, 1000)
+	setDescStatsSpans(allSpans[405:407], "b", hour+1, 1000)
+	setDescStatsSpans(allSpans[407:417], "hot", hour+1, 1000)
+	ingestSpans(ht, allSpans[0:417])
+
+	expectFirstHour := func(resp *common.DescriptionStatsResponse) {
+		if resp.BeginMs != hour*DESC_STATS_HOUR_MS ||
+			resp.EndMs != (hour+1)*DESC_STATS_HOUR_MS ||
+			len(resp.Descriptions) != 2 {
+			t.Fatalf("Unexpected statistics for the first hour: %s\n",
+				asJson(resp))
+		}
+		expectDescStats(t, &resp.Descriptions[0], "read", 300, 1000)
+		expectDescStats(t, &resp.Descriptions[1], "write", 100, 7000)
+		if resp.Other.Count != 3 || resp.Other.SumNs != 5+3+6 ||
+			resp.Other.MinNs != 3 || resp.Other.MaxNs != 6 {
+			t.Fatalf("Unexpected other statistics for the first hour: %s\n",
+				asJson(resp))
+		}
+	}
+	expectFirstHour(getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS+10,
+		hour*DESC_STATS_HOUR_MS+20, 10))
+
+	// The descriptions beyond lim are counted in "other".
+	resp := getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS,
+		(hour+1)*DESC_STATS_HOUR_MS, 1)
+	if len(resp.Descriptions) != 1 || resp.Other.Count != 103 ||
+		resp.Other.MaxNs != 700000 {
+		t.Fatalf("Unexpected statistics with lim=1: %s\n", asJson(resp))
+	}
+
+	// "hot" replaces "a" once it has been seen more often.  The spans of "hot"
+	// before that are counted in "other", along with those of "a".
+	resp = getDescStats(t, hcl, (hour+1)*DESC_STATS_HOUR_MS,
+		(hour+2)*DESC_STATS_HOUR_MS, 10)
+	if len(resp.Descriptions) != 2 ||
+		resp.Descriptions[0].Description != "hot" ||
+		resp.Descriptions[0].Count != 8 ||
+		resp.Descriptions[1].Description != "b" ||
+		resp.Descriptions[1].Count != 2 || resp.Other.Count != 3 {
+		t.Fatalf("Unexpected statistics for the second hour: %s\n",
+			asJson(resp))
+	}
+
+	// Both hours together.
+	resp = getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS,
+		(hour+2)*DESC_STATS_HOUR_MS, 10)
+	if len(resp.Descriptions) != 4 || resp.Other.Count != 6 {
+		t.Fatalf("Unexpected statistics for both hours: %s\n", asJson(resp))
+	}
+
+	// Invalid parameters are rejected.
+	_, err = hcl.DescriptionStats(hour*DESC_STATS_HOUR_MS,
+		hour*DESC_STATS_HOUR_MS-1, 10)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.DescriptionStats(0, 1, -1)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+
+	// The statistics survive a restart.
+	hcl.Close()
+	ht.Close()
+	ht = buildDescStatsHTraced(t, dataDirs)
+	hcl, err = htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	expectFirstHour(getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS,
+		(hour+1)*DESC_STATS_HOUR_MS, 10))
+
+	// Once the reaper has expired the first hour, its statistics are removed,
+	// and don't come back after a restart.  Spans in expired hours are not
+	// counted.
+	ht.Store.rpr.SetReaperDate((hour + 1) * DESC_STATS_HOUR_MS)
+	ht.Store.descStats.save()
+	ingestSpans(ht, setDescStatsSpans(allSpans[417:418], "read", hour, 1000))
+	resp = getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS,
+		(hour+2)*DESC_STATS_HOUR_MS, 10)
+	if len(resp.Descriptions) != 2 || resp.Descriptions[0].Description != "hot" {
+		t.Fatalf("Unexpected statistics after expiry: %s\n", asJson(resp))
+	}
+	hcl.Close()
+	ht.Close()
+	ht = buildDescStatsHTraced(t, dataDirs)
+	hcl, err = htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	resp = getDescStats(t, hcl, hour*DESC_STATS_HOUR_MS,
+		(hour+1)*DESC_STATS_HOUR_MS, 10)
+	if len(resp.Descriptions) != 0 || resp.Other.Count != 0 {
+		t.Fatalf("Unexpected statistics after expiry and restart: %s\n",
+			asJson(resp))
+	}
+}
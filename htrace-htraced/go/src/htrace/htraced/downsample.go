@@ -0,0 +1,279 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Downsampling of old spans.
+//
+// Recent spans are the ones people look at one by one.  Older spans are
+// mostly used for trends, so rather than keeping every span until
+// span.expiry.ms, we can keep only some of the traces once the spans are
+// older than span.downsample.age.ms.  On each datastore heartbeat, after the
+// expired spans are reaped, each shard goroutine looks at the spans which
+// begin between the reaper date and the downsample date.  It keeps the spans
+// whose trace root hashes into the first span.downsample.percent of 100
+// buckets, and deletes the rest.  Since the decision depends only on the
+// root, the spans of a trace are kept or deleted together.
+//
+// The roots are found by following the first parents, as /traces does.  A
+// child may be looked at after its parent was deleted, by another shard or in
+// an earlier heartbeat.  So we remember the IDs of the spans we recently
+// deleted, and delete a span whose parent is one of them.  A span which is
+// written before its parent is decided by its own ID.
+//
+// The spans which are kept get a DOWNSAMPLE_WEIGHT_INFO_KEY info entry, so
+// that readers can scale what they count, and so that we can skip them the
+// next time.  The spans which are deleted are counted by description in the
+// description statistics.  Each shard remembers how far it has got, so the
+// spans are only looked at once.  A span which is written with an older
+// begin time makes the shard go back to it.
+//
+
+// The maximum number of recently deleted span IDs we remember.
+const DOWNSAMPLE_MAX_DROPPED_IDS = 100000
+
+type downsampler struct {
+	// The age after which spans are downsampled, in milliseconds.
+	ageMs int64
+
+	// The percentage of traces we keep.
+	percent uint32
+
+	// The weight we give the spans we keep.
+	weight string
+
+	// Protects date and the dropped IDs.
+	lock sync.Mutex
+
+	// The begin time before which spans are downsampled.  This never moves
+	// backwards.
+	date int64
+
+	// The IDs of the spans we recently deleted.  When there are too many, we
+	// forget the oldest ones first.
+	dropped     map[string]bool
+	droppedRing []string
+	droppedNext int
+
+	// The total number of spans which have been deleted and kept.  Accessed
+	// atomically.
+	DroppedSpans uint64
+	KeptSpans    uint64
+}
+
+// Create the downsampler, or return nil if downsampling is disabled.
+func newDownsampler(cnf *conf.Config) (*downsampler, error) {
+	ageMs := cnf.GetInt64(conf.HTRACE_SPAN_DOWNSAMPLE_AGE_MS)
+	if ageMs <= 0 {
+		return nil, nil
+	}
+	percent := cnf.GetInt(conf.HTRACE_SPAN_DOWNSAMPLE_PERCENT)
+	if percent < 0 || percent > 100 {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: %d.  "+
+			"Expected a percentage between 0 and 100.",
+			conf.HTRACE_SPAN_DOWNSAMPLE_PERCENT, percent))
+	}
+	expiryMs := cnf.GetInt64(conf.HTRACE_SPAN_EXPIRY_MS)
+	if expiryMs > 0 && expiryMs < MAX_SPAN_EXPIRY_MS && ageMs >= expiryMs {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: %d.  "+
+			"Spans must be downsampled before they expire, but %s is %d.",
+			conf.HTRACE_SPAN_DOWNSAMPLE_AGE_MS, ageMs,
+			conf.HTRACE_SPAN_EXPIRY_MS, expiryMs))
+	}
+	dsmp := &downsampler{
+		ageMs:       ageMs,
+		percent:     uint32(percent),
+		dropped:     make(map[string]bool),
+		droppedRing: make([]string, DOWNSAMPLE_MAX_DROPPED_IDS),
+	}
+	if percent > 0 {
+		dsmp.weight = strconv.FormatFloat(100.0/float64(percent), 'g', 6, 64)
+	}
+	return dsmp, nil
+}
+
+// Get the begin time before which spans are downsampled.
+func (dsmp *downsampler) GetDate() int64 {
+	now := common.TimeToUnixMs(time.Now().UTC())
+	dsmp.lock.Lock()
+	defer dsmp.lock.Unlock()
+	if now-dsmp.ageMs > dsmp.date {
+		dsmp.date = now - dsmp.ageMs
+	}
+	return dsmp.date
+}
+
+func (dsmp *downsampler) SetDate(date int64) {
+	dsmp.lock.Lock()
+	defer dsmp.lock.Unlock()
+	dsmp.date = date
+}
+
+func (dsmp *downsampler) addDropped(sid common.SpanId) {
+	dsmp.lock.Lock()
+	defer dsmp.lock.Unlock()
+	if old := dsmp.droppedRing[dsmp.droppedNext]; old != "" {
+		delete(dsmp.dropped, old)
+	}
+	dsmp.droppedRing[dsmp.droppedNext] = string(sid)
+	dsmp.droppedNext = (dsmp.droppedNext + 1) % len(dsmp.droppedRing)
+	dsmp.dropped[string(sid)] = true
+}
+
+func (dsmp *downsampler) wasDropped(sid common.SpanId) bool {
+	dsmp.lock.Lock()
+	defer dsmp.lock.Unlock()
+	return dsmp.dropped[string(sid)]
+}
+
+// Decide whether to keep a span, by the root of its trace.
+func (dsmp *downsampler) keeps(rsv *traceRootResolver, span *common.Span) bool {
+	root, incomplete := rsv.resolve(span)
+	if incomplete && len(root.Parents) > 0 &&
+		dsmp.wasDropped(root.Parents[0]) {
+		return false
+	}
+	return root.Id.Hash32()%100 < dsmp.percent
+}
+
+// Downsample the spans in the shard which begin before the downsample date.
+// This runs in the shard goroutine, after the expired spans are reaped.
+func (shd *shard) downsample() {
+	dsmp := shd.store.dsmp
+	if dsmp == nil {
+		return
+	}
+	lg := shd.store.rpr.lg
+	date := dsmp.GetDate()
+	start := shd.store.rpr.GetReaperDate()
+	if shd.downsampledTo > start {
+		start = shd.downsampledTo
+	}
+	if start >= date {
+		return
+	}
+	src, err := createBeginTimeSource(shd, strconv.FormatInt(start, 10))
+	if err != nil {
+		lg.Errorf("Error creating downsampling source for shd(%s): %s\n",
+			shd.path, err.Error())
+		return
+	}
+	var numDropped, numKept uint64
+	defer func() {
+		src.Close()
+		atomic.AddUint64(&dsmp.DroppedSpans, numDropped)
+		atomic.AddUint64(&dsmp.KeptSpans, numKept)
+		if numDropped+numKept > 0 {
+			lg.Debugf("Downsampling shard %s deleted %d span(s) and kept "+
+				"%d.\n", shd.path, numDropped, numKept)
+		}
+	}()
+	rsv := newTraceRootResolver(shd.store)
+	for {
+		span := src.next()
+		if span == nil || span.Begin >= date {
+			break
+		}
+		if _, marked := span.Info[common.DOWNSAMPLE_WEIGHT_INFO_KEY]; marked {
+			continue
+		}
+		if dsmp.keeps(rsv, span) {
+			err = shd.setDownsampleWeight(span, dsmp.weight)
+			if err != nil {
+				lg.Errorf("Error marking downsampled span %s in shd(%s): "+
+					"%s\n", span.String(), shd.path, err.Error())
+				return
+			}
+			numKept++
+		} else {
+			err = shd.DeleteSpan(span)
+			if err != nil {
+				lg.Errorf("Error deleting downsampled span %s from shd(%s): "+
+					"%s\n", span.String(), shd.path, err.Error())
+				return
+			}
+			dsmp.addDropped(span.Id)
+			if shd.store.descStats != nil {
+				shd.store.descStats.downsampled(span)
+			}
+			numDropped++
+		}
+	}
+	shd.downsampledTo = date
+}
+
+// Note that a span was written, so that we downsample it if it is old.
+func (shd *shard) noteDownsampleBegin(begin int64) {
+	if begin < shd.downsampledTo {
+		shd.downsampledTo = begin
+	}
+}
+
+// Rewrite a span with its downsampling weight.  The info map isn't indexed,
+// so only the span record changes.
+func (shd *shard) setDownsampleWeight(span *common.Span, weight string) error {
+	info := make(common.TraceInfoMap, len(span.Info)+1)
+	for k, v := range span.Info {
+		info[k] = v
+	}
+	info[common.DOWNSAMPLE_WEIGHT_INFO_KEY] = weight
+	span.Info = info
+	plain, err := encodeSpanData(&span.SpanData)
+	if err != nil {
+		return err
+	}
+	primaryKey := append([]byte{SPAN_ID_INDEX_PREFIX}, span.Id.Val()...)
+	record := plain
+	if shd.cipher != nil {
+		record, err = shd.cipher.seal(primaryKey, record)
+		if err != nil {
+			return err
+		}
+	}
+	cn := shd.store.canary
+	if cn != nil {
+		cn.beginWrite(span.Id)
+	}
+	err = shd.ldb.Put(shd.store.writeOpts, primaryKey, record)
+	if cn != nil {
+		if err == nil {
+			cn.endWrite(span.Id, plain)
+		} else {
+			cn.endWrite(span.Id, nil)
+		}
+	}
+	if err != nil {
+		shd.checkCorruption(err)
+		return err
+	}
+	shd.store.invalidateCachedSpan(span)
+	return nil
+}
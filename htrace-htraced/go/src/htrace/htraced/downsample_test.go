@@ -0,0 +1,259 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"testing"
+	"time"
+)
+
+// Generate 20 traces of 7 spans which begin around startMs, and give all the
+// spans the same description.
+func downsampleTestTraces(seed int64, startMs int64,
+	desc string) *test.SpanTree {
+	gen := &test.SpanTreeGenerator{
+		Seed:          seed,
+		Depth:         3,
+		NumRoots:      20,
+		MinFanOut:     2,
+		MaxFanOut:     2,
+		MinDurationMs: 10,
+		MaxDurationMs: 1000,
+		StartMs:       startMs,
+		Nested:        true,
+	}
+	tree := gen.Generate()
+	for i := range tree.Spans {
+		tree.Spans[i].Description = desc
+	}
+	return tree
+}
+
+// Ingest the spans of some trees one level at a time, so that the parent of
+// each span is written before it.
+func ingestByLevel(ht *MiniHTraced, trees ...*test.SpanTree) {
+	for level := 0; ; level++ {
+		spans := make([]*common.Span, 0)
+		for _, tree := range trees {
+			for i := range tree.Spans {
+				if tree.Levels[tree.Spans[i].Id.String()] == level {
+					spans = append(spans, tree.Spans[i])
+				}
+			}
+		}
+		if len(spans) == 0 {
+			return
+		}
+		ingestSpans(ht, spans)
+	}
+}
+
+// Get the root of the trace each span of a tree belongs to.
+func rootsOfTree(tree *test.SpanTree) map[string]common.SpanId {
+	parents := make(map[string]common.SpanId)
+	for i := range tree.Spans {
+		if len(tree.Spans[i].Parents) > 0 {
+			parents[string(tree.Spans[i].Id)] = tree.Spans[i].Parents[0]
+		}
+	}
+	roots := make(map[string]common.SpanId)
+	for i := range tree.Spans {
+		root := tree.Spans[i].Id
+		for parents[string(root)] != nil {
+			root = parents[string(root)]
+		}
+		roots[string(tree.Spans[i].Id)] = root
+	}
+	return roots
+}
+
+func TestDownsampleOldSpans(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDownsampleOldSpans",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_EXPIRY_MS:                "36000000",
+			conf.HTRACE_SPAN_DOWNSAMPLE_AGE_MS:        "3600000",
+			conf.HTRACE_SPAN_DOWNSAMPLE_PERCENT:       "50",
+			conf.HTRACE_REAPER_HEARTBEAT_PERIOD_MS:    "1",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "1",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	// Wait for the first reaper date, so that the spans which are older than
+	// span.expiry.ms are reaped rather than downsampled.
+	common.WaitFor(5*time.Minute, time.Millisecond, func() bool {
+		return ht.Store.rpr.GetReaperDate() > 0
+	})
+
+	const hourMs = int64(60 * 60 * 1000)
+	now := common.TimeToUnixMs(time.Now().UTC())
+	young := downsampleTestTraces(1, now-hourMs/6, "young")
+	middle := downsampleTestTraces(2, now-3*hourMs, "middle")
+	old := downsampleTestTraces(3, now-20*hourMs, "old")
+	ingestByLevel(ht, young, middle, old)
+
+	common.WaitFor(5*time.Minute, time.Millisecond, func() bool {
+		for i := range old.Spans {
+			if ht.Store.FindSpan(old.Spans[i].Id) != nil {
+				return false
+			}
+		}
+		for i := range middle.Spans {
+			span := ht.Store.FindSpan(middle.Spans[i].Id)
+			if span != nil &&
+				span.Info[common.DOWNSAMPLE_WEIGHT_INFO_KEY] == "" {
+				return false
+			}
+		}
+		stats := ht.Store.ServerStats()
+		return stats.DownsampledSpans+stats.DownsampleKeptSpans ==
+			uint64(len(middle.Spans))
+	})
+
+	// The young spans are untouched.
+	for i := range young.Spans {
+		span := ht.Store.FindSpan(young.Spans[i].Id)
+		if span == nil {
+			t.Fatalf("Young span %s was deleted.\n", young.Spans[i].String())
+		}
+		if _, marked := span.Info[common.DOWNSAMPLE_WEIGHT_INFO_KEY]; marked {
+			t.Fatalf("Young span %s was downsampled.\n", span.String())
+		}
+	}
+
+	// The middle spans are kept or deleted by the root of their trace.
+	roots := rootsOfTree(middle)
+	keptTraces := make(map[string]bool)
+	numDropped := 0
+	for i := range middle.Spans {
+		sid := middle.Spans[i].Id
+		root := roots[string(sid)]
+		keep := root.Hash32()%100 < 50
+		span := ht.Store.FindSpan(sid)
+		if !keep {
+			if span != nil {
+				t.Fatalf("Expected span %s of trace %s to be deleted.\n",
+					sid.String(), root.String())
+			}
+			numDropped++
+			continue
+		}
+		if span == nil {
+			t.Fatalf("Expected span %s of trace %s to be kept.\n",
+				sid.String(), root.String())
+		}
+		if weight := span.Info[common.DOWNSAMPLE_WEIGHT_INFO_KEY]; weight != "2" {
+			t.Fatalf("Expected span %s to have weight 2, but it had '%s'.\n",
+				sid.String(), weight)
+		}
+		keptTraces[string(root)] = true
+	}
+	if len(keptTraces) == 0 || len(keptTraces) == len(middle.Roots) {
+		t.Fatalf("Expected some of the %d middle traces to be kept, but "+
+			"%d were.\n", len(middle.Roots), len(keptTraces))
+	}
+
+	stats := ht.Store.ServerStats()
+	if stats.DownsampledSpans != uint64(numDropped) ||
+		stats.DownsampleKeptSpans != uint64(len(middle.Spans)-numDropped) {
+		t.Fatalf("Expected %d spans to be deleted and %d kept by "+
+			"downsampling, but got %d and %d.\n", numDropped,
+			len(middle.Spans)-numDropped, stats.DownsampledSpans,
+			stats.DownsampleKeptSpans)
+	}
+	if stats.ReapedSpans != uint64(len(old.Spans)) {
+		t.Fatalf("Expected %d spans to be reaped, but got %d.\n",
+			len(old.Spans), stats.ReapedSpans)
+	}
+
+	// The deleted spans are counted in the description statistics, which
+	// still describe every span which was ingested.
+	descStats := ht.Store.descStats.Get(now-4*hourMs, now+hourMs, 10)
+	for _, ds := range descStats.Descriptions {
+		var expected uint64
+		if ds.Description == "middle" {
+			expected = uint64(numDropped)
+			if ds.Count != uint64(len(middle.Spans)) {
+				t.Fatalf("Expected %d middle spans in the statistics, but "+
+					"got %s\n", len(middle.Spans), asJson(ds))
+			}
+		}
+		if ds.Downsampled != expected {
+			t.Fatalf("Expected %d downsampled spans, but got %s\n",
+				expected, asJson(ds))
+		}
+	}
+
+	// A trace which arrives late is downsampled too.
+	late := downsampleTestTraces(4, now-2*hourMs, "late")
+	ingestByLevel(ht, late)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var unweighted *common.Span
+		for i := range late.Spans {
+			span := ht.Store.FindSpan(late.Spans[i].Id)
+			if span != nil &&
+				span.Info[common.DOWNSAMPLE_WEIGHT_INFO_KEY] == "" {
+				unweighted = span
+				break
+			}
+		}
+		if unweighted == nil {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			t.Fatalf("Late span %s was never downsampled.\n",
+				unweighted.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDownsampleConfigValidation(t *testing.T) {
+	for _, vals := range []map[string]string{
+		{
+			conf.HTRACE_SPAN_EXPIRY_MS:          "3600000",
+			conf.HTRACE_SPAN_DOWNSAMPLE_AGE_MS:  "3600000",
+			conf.HTRACE_SPAN_DOWNSAMPLE_PERCENT: "10",
+		},
+		{
+			conf.HTRACE_SPAN_DOWNSAMPLE_AGE_MS:  "3600000",
+			conf.HTRACE_SPAN_DOWNSAMPLE_PERCENT: "101",
+		},
+	} {
+		htraceBld := &MiniHTracedBuilder{
+			Name: "TestDownsampleConfigValidation",
+			Cnf:  vals,
+		}
+		ht, err := htraceBld.Build()
+		if err == nil {
+			ht.Close()
+			t.Fatalf("Expected building with %s to fail.\n", asJson(vals))
+		}
+	}
+}
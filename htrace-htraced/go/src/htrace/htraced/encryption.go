@@ -0,0 +1,363 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Encryption of span data at rest.
+//
+// When datastore.encryption.key.file is set, the span records in the primary
+// index are encrypted with AES-256-GCM.  Each shard has its own random data
+// key, which is stored in its ShardInfo wrapped (encrypted) with the master
+// key.  Rotating the master key only means rewrapping the data keys, so the
+// spans themselves never have to be rewritten.
+//
+// An encrypted span record is SPAN_ENCRYPTED_MAGIC, followed by the nonce,
+// followed by the ciphertext and the GCM tag.  The primary key of the span is
+// authenticated along with the record, so that a record can't be moved to a
+// different span id.  The magic byte is never the first byte of an encoded
+// SpanData, so span records written before encryption was turned on can
+// still be read as they are.
+//
+// Only the span records are encrypted.  The index keys are built from span
+// ids, parent ids, links, begin and end times, and durations, and they are
+// stored in plain text.  Anyone who can read the shard directories can learn
+// those values, and the number of spans in each shard, but not the
+// descriptions, tracer ids, info, or timeline annotations of the spans.
+// Heartbeat markers and audit log entries are not encrypted either.
+//
+// Shards with a data key don't write description index entries.  Entries
+// written before the shard got its data key are left alone, like the span
+// records, until their spans are deleted or rewritten.  Since the index is
+// then incomplete, queries don't use it while any shard has a data key.
+
+// The length of master keys and data keys, in bytes.
+const ENCRYPTION_KEY_LEN = 32
+
+// The first byte of an encrypted span record.  0xc1 is never used in
+// msgpack.
+const SPAN_ENCRYPTED_MAGIC = 0xc1
+
+// The additional data used when wrapping a data key.
+var DATA_KEY_WRAP_AD = []byte("htraced shard data key")
+
+// A master key, which wraps the data keys of the shards.
+type masterKey struct {
+	// The path of the file the key was read from.
+	path string
+
+	// Identifies the key without revealing it.  This is recorded in the
+	// ShardInfo of the shards whose data keys the key wraps.
+	id string
+
+	aead cipher.AEAD
+}
+
+// Read a master key from a file containing 64 hexadecimal digits.
+func loadMasterKey(path string) (*masterKey, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to read encryption key "+
+			"file %s: %s", path, err.Error()))
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(key) != ENCRYPTION_KEY_LEN {
+		return nil, errors.New(fmt.Sprintf("Encryption key file %s must "+
+			"contain a %d-byte key as %d hexadecimal digits.", path,
+			ENCRYPTION_KEY_LEN, 2*ENCRYPTION_KEY_LEN))
+	}
+	aead, err := newAead(key)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(key)
+	return &masterKey{
+		path: path,
+		id:   hex.EncodeToString(sum[:8]),
+		aead: aead,
+	}, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Wrap a data key with the master key.
+func (mk *masterKey) wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, mk.aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return mk.aead.Seal(nonce, nonce, dataKey, DATA_KEY_WRAP_AD), nil
+}
+
+// Unwrap a data key which was wrapped with the master key.
+func (mk *masterKey) unwrap(wrapped []byte) ([]byte, error) {
+	nonceLen := mk.aead.NonceSize()
+	if len(wrapped) < nonceLen {
+		return nil, errors.New("The wrapped data key is too short.")
+	}
+	dataKey, err := mk.aead.Open(nil, wrapped[:nonceLen],
+		wrapped[nonceLen:], DATA_KEY_WRAP_AD)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to unwrap the data key "+
+			"with the key in %s: %s", mk.path, err.Error()))
+	}
+	return dataKey, nil
+}
+
+// Encrypts and decrypts the span records of a shard with its data key.  The
+// cipher is set up once per shard, rather than once per span.
+type spanCipher struct {
+	aead cipher.AEAD
+
+	// The source of nonces.  Buffering it means we don't need a system call
+	// for each span we encrypt.  Only the shard goroutine encrypts spans, so
+	// this needs no lock.  Decrypting is safe to do concurrently.
+	nonces *bufio.Reader
+}
+
+func newSpanCipher(dataKey []byte) (*spanCipher, error) {
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &spanCipher{
+		aead:   aead,
+		nonces: bufio.NewReaderSize(rand.Reader, 4096),
+	}, nil
+}
+
+// Encrypt an encoded span, which will be stored under primaryKey.
+func (sc *spanCipher) seal(primaryKey []byte, buf []byte) ([]byte, error) {
+	nonceLen := sc.aead.NonceSize()
+	out := make([]byte, 1+nonceLen, 1+nonceLen+len(buf)+sc.aead.Overhead())
+	out[0] = SPAN_ENCRYPTED_MAGIC
+	nonce := out[1:]
+	_, err := io.ReadFull(sc.nonces, nonce)
+	if err != nil {
+		return nil, err
+	}
+	return sc.aead.Seal(out, nonce, buf, primaryKey), nil
+}
+
+// Get the encoded span from a span record in the primary index.  Records
+// which aren't encrypted are returned as they are.  sc may be nil if the
+// shard has no data key.
+func openSpanRecord(sc *spanCipher, sid common.SpanId,
+	buf []byte) ([]byte, error) {
+	if len(buf) == 0 || buf[0] != SPAN_ENCRYPTED_MAGIC {
+		return buf, nil
+	}
+	if sc == nil {
+		return nil, errors.New(fmt.Sprintf("Span %s is encrypted, but the "+
+			"shard has no data key.", sid.String()))
+	}
+	nonceLen := sc.aead.NonceSize()
+	if len(buf) < 1+nonceLen+sc.aead.Overhead() {
+		return nil, errors.New(fmt.Sprintf("The encrypted record of span "+
+			"%s is truncated.", sid.String()))
+	}
+	primaryKey := append([]byte{SPAN_ID_INDEX_PREFIX}, sid.Val()...)
+	out, err := sc.aead.Open(nil, buf[1:1+nonceLen], buf[1+nonceLen:],
+		primaryKey)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to decrypt span %s: %s",
+			sid.String(), err.Error()))
+	}
+	return out, nil
+}
+
+// A data key which is wrapped with the previous master key, and which the
+// shard goroutine should rewrap with the current one.
+type dataKeyRewrap struct {
+	dataKey []byte
+	newKey  *masterKey
+}
+
+// Set up the span ciphers of the loaded shards.  If canWrite is true, data
+// keys are created for shards which don't have one yet, so that the spans
+// written from now on are encrypted.
+func (dld *DataStoreLoader) setupEncryption(canWrite bool) error {
+	var cur, prev *masterKey
+	var err error
+	if dld.keyFile != "" {
+		cur, err = loadMasterKey(dld.keyFile)
+		if err != nil {
+			return err
+		}
+	}
+	if dld.prevKeyFile != "" {
+		if cur == nil {
+			return errors.New(fmt.Sprintf("%s is set, but %s is not.",
+				conf.HTRACE_ENCRYPTION_PREVIOUS_KEY_FILE,
+				conf.HTRACE_ENCRYPTION_KEY_FILE))
+		}
+		prev, err = loadMasterKey(dld.prevKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.info == nil || shd.quarantineErr != nil {
+			continue
+		}
+		if len(shd.info.WrappedDataKey) == 0 {
+			if cur == nil || !canWrite {
+				continue
+			}
+			err = shd.createDataKey(cur)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var dataKey []byte
+		switch {
+		case cur == nil:
+			return errors.New(fmt.Sprintf("Shard %s is encrypted, but %s "+
+				"is not set.  Set it to the file containing the master key "+
+				"%s.", shd.path, conf.HTRACE_ENCRYPTION_KEY_FILE,
+				shd.info.MasterKeyId))
+		case shd.info.MasterKeyId == cur.id:
+			dataKey, err = cur.unwrap(shd.info.WrappedDataKey)
+		case prev != nil && shd.info.MasterKeyId == prev.id:
+			dataKey, err = prev.unwrap(shd.info.WrappedDataKey)
+			if err == nil && canWrite {
+				shd.rewrap = &dataKeyRewrap{dataKey: dataKey, newKey: cur}
+			}
+		default:
+			msg := fmt.Sprintf("Shard %s is encrypted with the master key "+
+				"%s, but the key in %s is %s", shd.path, shd.info.MasterKeyId,
+				cur.path, cur.id)
+			if prev != nil {
+				msg += fmt.Sprintf(", and the key in %s is %s", prev.path,
+					prev.id)
+			}
+			return errors.New(msg + ".")
+		}
+		if err != nil {
+			return errors.New(fmt.Sprintf("Shard %s: %s", shd.path,
+				err.Error()))
+		}
+		shd.cipher, err = newSpanCipher(dataKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Create a data key for a shard which doesn't have one, and record it in the
+// ShardInfo.
+func (shd *ShardLoader) createDataKey(mk *masterKey) error {
+	dataKey := make([]byte, ENCRYPTION_KEY_LEN)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return err
+	}
+	info := *shd.info
+	info.WrappedDataKey, err = mk.wrap(dataKey)
+	if err != nil {
+		return err
+	}
+	info.MasterKeyId = mk.id
+	err = shd.writeShardInfo(&info)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to write the data key of "+
+			"shard %s: %s", shd.path, err.Error()))
+	}
+	shd.cipher, err = newSpanCipher(dataKey)
+	if err != nil {
+		return err
+	}
+	shd.info = &info
+	shd.dld.lg.Infof("Created a data key for shard %s, wrapped with the "+
+		"master key %s.\n", shd.path, mk.id)
+	return nil
+}
+
+// Rewrap the data key of the shard with the current master key, if it was
+// wrapped with the previous one.  This is called from the shard goroutine.
+// If it fails, it is tried again on the next heartbeat.
+func (shd *shard) rewrapDataKey() {
+	rw := shd.rewrap
+	if rw == nil {
+		return
+	}
+	lg := shd.store.lg
+	wrapped, err := rw.newKey.wrap(rw.dataKey)
+	if err != nil {
+		lg.Errorf("Error rewrapping the data key of shard %s: %s\n",
+			shd.path, err.Error())
+		return
+	}
+	info := *shd.info
+	oldKeyId := info.MasterKeyId
+	info.WrappedDataKey = wrapped
+	info.MasterKeyId = rw.newKey.id
+	err = writeShardInfo(shd.ldb, shd.store.writeOpts, &info)
+	if err != nil {
+		lg.Errorf("Error saving the rewrapped data key of shard %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+		return
+	}
+	shd.info = &info
+	shd.rewrap = nil
+	lg.Infof("Rewrapped the data key of shard %s from master key %s to "+
+		"master key %s.\n", shd.path, oldKeyId, rw.newKey.id)
+}
+
+// Get the encoded span from a span record read from this shard.
+func (shd *shard) openSpanRecord(sid common.SpanId, buf []byte) ([]byte, error) {
+	return openSpanRecord(shd.cipher, sid, buf)
+}
+
+// Returns true if the description index can be used for queries.  Shards
+// which encrypt their spans don't write description index entries, so once
+// any shard has a data key, the index is incomplete.
+func (store *dataStore) indexesDescriptions() bool {
+	for i := range store.shards {
+		if store.shards[i].cipher != nil {
+			return false
+		}
+	}
+	return true
+}
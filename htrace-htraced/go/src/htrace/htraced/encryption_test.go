@@ -0,0 +1,202 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Write a master key file whose key bytes are all keyByte.
+func writeMasterKeyFile(t *testing.T, dir string, keyByte byte) string {
+	path := filepath.Join(dir, fmt.Sprintf("key%d", keyByte))
+	key := strings.Repeat(fmt.Sprintf("%02x", keyByte), ENCRYPTION_KEY_LEN)
+	err := ioutil.WriteFile(path, []byte(key+"\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write key file %s: %s\n", path, err.Error())
+	}
+	return path
+}
+
+func buildEncryptedHTraced(backend string, dataDirs []string, keyFile string,
+	prevKeyFile string) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestEncryption" + backend,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:            backend,
+			conf.HTRACE_ENCRYPTION_KEY_FILE:          keyFile,
+			conf.HTRACE_ENCRYPTION_PREVIOUS_KEY_FILE: prevKeyFile,
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+// Check that the spans can be found by id, by a query on the primary index,
+// and by a query on a secondary index.
+func expectEncryptedSpans(t *testing.T, ht *MiniHTraced, spans []*common.Span) {
+	for i := range spans {
+		span := ht.Store.FindSpan(spans[i].Id)
+		if span == nil {
+			t.Fatalf("failed to find span %s\n", spans[i].Id.String())
+		}
+		common.ExpectSpansEqual(t, spans[i], span)
+	}
+	results, err, _ := ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   spans[0].Description,
+			},
+		},
+		Lim: 10,
+	})
+	if err != nil || len(results) != 1 ||
+		!results[0].Id.Equal(spans[0].Id) {
+		t.Fatalf("expected the description query to find span %s, but "+
+			"got %v, %v\n", spans[0].Id.String(), results, err)
+	}
+	results, err, _ = ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   "0",
+			},
+		},
+		Lim: len(spans) + 1,
+	})
+	if err != nil || len(results) != len(spans) {
+		t.Fatalf("expected the begin time query to find %d spans, but "+
+			"got %d, %v\n", len(spans), len(results), err)
+	}
+}
+
+// Check that none of the files in the data directories contain the
+// description of any of the spans.
+func expectNotInFiles(t *testing.T, dataDirs []string, spans []*common.Span) {
+	numFiles := 0
+	for _, dir := range dataDirs {
+		err := filepath.Walk(dir, func(path string, fi os.FileInfo,
+			err error) error {
+			if err != nil || fi.IsDir() {
+				return err
+			}
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			numFiles++
+			for i := range spans {
+				if bytes.Contains(buf, []byte(spans[i].Description)) {
+					t.Fatalf("found the description %s in %s\n",
+						spans[i].Description, path)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to scan %s: %s\n", dir, err.Error())
+		}
+	}
+	if numFiles == 0 {
+		t.Fatalf("found no files to scan in %v\n", dataDirs)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testEncryption(t, backend)
+	}
+}
+
+func testEncryption(t *testing.T, backend string) {
+	keyDir, err := ioutil.TempDir(os.TempDir(), "TestEncryptionKeys")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(keyDir)
+	key1 := writeMasterKeyFile(t, keyDir, 1)
+	key2 := writeMasterKeyFile(t, keyDir, 2)
+	key3 := writeMasterKeyFile(t, keyDir, 3)
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dataDirs[i], err = ioutil.TempDir(os.TempDir(),
+			fmt.Sprintf("TestEncryption%s%d", backend, i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dataDirs[i])
+	}
+	ht, err := buildEncryptedHTraced(backend, dataDirs, key1, "")
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s\n", err.Error())
+	}
+	// Give each span a random description with nothing in common with the
+	// others, so that leveldb's compression can't hide a plain text copy.
+	rnd := rand.New(rand.NewSource(1906))
+	spans := createRandomTestSpans(20)
+	for i := range spans {
+		spans[i].Description = fmt.Sprintf("%016x", rnd.Uint64())
+	}
+	ingestSpans(ht, spans)
+	expectEncryptedSpans(t, ht, spans)
+	ht.Close()
+	expectNotInFiles(t, dataDirs, spans)
+
+	// The datastore can't be opened without the key, or with the wrong key.
+	_, err = buildEncryptedHTraced(backend, dataDirs, "", "")
+	common.AssertErrContains(t, err, "is encrypted, but "+
+		conf.HTRACE_ENCRYPTION_KEY_FILE+" is not set")
+	_, err = buildEncryptedHTraced(backend, dataDirs, key2, "")
+	common.AssertErrContains(t, err, "is encrypted with the master key")
+
+	// Rotate the master key from key1 to key2.  The spans can be read while
+	// the data keys are being rewrapped.
+	ht, err = buildEncryptedHTraced(backend, dataDirs, key2, key1)
+	if err != nil {
+		t.Fatalf("failed to open datastore during key rotation: %s\n",
+			err.Error())
+	}
+	expectEncryptedSpans(t, ht, spans)
+	ht.Close()
+
+	// Once the data keys have been rewrapped, key1 is no longer needed.
+	ht, err = buildEncryptedHTraced(backend, dataDirs, key2, "")
+	if err != nil {
+		t.Fatalf("failed to open datastore after key rotation: %s\n",
+			err.Error())
+	}
+	expectEncryptedSpans(t, ht, spans)
+	ht.Close()
+	_, err = buildEncryptedHTraced(backend, dataDirs, key1, "")
+	common.AssertErrContains(t, err, "is encrypted with the master key")
+	_, err = buildEncryptedHTraced(backend, dataDirs, key3, key1)
+	common.AssertErrContains(t, err, "is encrypted with the master key")
+}
@@ -0,0 +1,199 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//
+// REST endpoint response times.
+//
+// Each REST route belongs to an endpoint class, which is set when the route
+// is registered.  The time each request takes is recorded against its
+// class, and scored against the rest.sli.* thresholds, the way Apdex scores
+// response times.
+//
+
+// The number of recent response times kept for each endpoint class.
+const ENDPOINT_SLI_CIRC_BUF_SIZE = 1024
+
+// The endpoint classes, in the order they appear in /server/stats.
+var ENDPOINT_CLASSES = []string{
+	common.ENDPOINT_CLASS_SPAN,
+	common.ENDPOINT_CLASS_CHILDREN,
+	common.ENDPOINT_CLASS_QUERY,
+	common.ENDPOINT_CLASS_WRITE,
+	common.ENDPOINT_CLASS_ADMIN,
+}
+
+// The response times of one endpoint class.
+type endpointSli struct {
+	class string
+
+	// The thresholds, in nanoseconds.
+	satisfiedNs  int64
+	toleratingNs int64
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	requests     uint64
+	satisfied    uint64
+	tolerating   uint64
+	frustrated   uint64
+	clientErrors uint64
+	serverErrors uint64
+
+	// The recent response times, in milliseconds.
+	latencies *common.CircBufU32
+}
+
+// The response times of every endpoint class.
+type endpointSlis struct {
+	classes map[string]*endpointSli
+}
+
+func newEndpointSlis(cnf *conf.Config) *endpointSlis {
+	satisfiedMs := cnf.GetInt64(conf.HTRACE_REST_SLI_SATISFIED_MS)
+	toleratingMs := cnf.GetInt64(conf.HTRACE_REST_SLI_TOLERATING_MS)
+	if toleratingMs < satisfiedMs {
+		toleratingMs = satisfiedMs
+	}
+	slis := &endpointSlis{
+		classes: make(map[string]*endpointSli, len(ENDPOINT_CLASSES)),
+	}
+	for _, class := range ENDPOINT_CLASSES {
+		slis.classes[class] = &endpointSli{
+			class:        class,
+			satisfiedNs:  satisfiedMs * int64(time.Millisecond),
+			toleratingNs: toleratingMs * int64(time.Millisecond),
+			latencies:    common.NewCircBufU32(ENDPOINT_SLI_CIRC_BUF_SIZE),
+		}
+	}
+	return slis
+}
+
+// Get the response times of an endpoint class.  Routes which don't name a
+// known class are admin routes.
+func (slis *endpointSlis) get(class string) *endpointSli {
+	sli := slis.classes[class]
+	if sli == nil {
+		sli = slis.classes[common.ENDPOINT_CLASS_ADMIN]
+	}
+	return sli
+}
+
+// Record a request which took dur, and was answered with the given status.
+func (sli *endpointSli) record(dur time.Duration, status int) {
+	ms := dur.Nanoseconds() / int64(time.Millisecond)
+	if ms > math.MaxUint32 {
+		ms = math.MaxUint32
+	}
+	sli.lock.Lock()
+	defer sli.lock.Unlock()
+	sli.requests++
+	if status >= 500 {
+		sli.serverErrors++
+		sli.frustrated++
+	} else {
+		if status >= 400 {
+			sli.clientErrors++
+		}
+		if dur.Nanoseconds() <= sli.satisfiedNs {
+			sli.satisfied++
+		} else if dur.Nanoseconds() <= sli.toleratingNs {
+			sli.tolerating++
+		} else {
+			sli.frustrated++
+		}
+	}
+	sli.latencies.Append(uint32(ms))
+}
+
+// Get the statistics of an endpoint class.
+func (sli *endpointSli) stats() common.EndpointSli {
+	sli.lock.Lock()
+	defer sli.lock.Unlock()
+	ret := common.EndpointSli{
+		Class:        sli.class,
+		Requests:     sli.requests,
+		Satisfied:    sli.satisfied,
+		Tolerating:   sli.tolerating,
+		Frustrated:   sli.frustrated,
+		Apdex:        1,
+		ClientErrors: sli.clientErrors,
+		ServerErrors: sli.serverErrors,
+	}
+	if sli.requests > 0 {
+		total := float64(sli.requests)
+		ret.Apdex = (float64(sli.satisfied) + float64(sli.tolerating)/2) /
+			total
+		ret.ClientErrorPercent = float64(sli.clientErrors) * 100 / total
+		ret.ServerErrorPercent = float64(sli.serverErrors) * 100 / total
+		ret.MaxLatencyMs = sli.latencies.Max()
+		ret.AverageLatencyMs = sli.latencies.Average()
+	}
+	return ret
+}
+
+// Get the statistics of every endpoint class.
+func (slis *endpointSlis) stats() []common.EndpointSli {
+	ret := make([]common.EndpointSli, len(ENDPOINT_CLASSES))
+	for i, class := range ENDPOINT_CLASSES {
+		ret[i] = slis.classes[class].stats()
+	}
+	return ret
+}
+
+// Remembers the status a handler answered with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Records how long a route's handler takes to answer each request.
+type sliHandler struct {
+	sli  *endpointSli
+	next http.Handler
+}
+
+func (hand *sliHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	hand.next.ServeHTTP(rec, req)
+	status := rec.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	hand.sli.record(time.Since(start), status)
+}
@@ -0,0 +1,153 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Find the statistics of an endpoint class.
+func findEndpointSli(t *testing.T, stats *common.ServerStats,
+	class string) *common.EndpointSli {
+	for i := range stats.Endpoints {
+		if stats.Endpoints[i].Class == class {
+			return &stats.Endpoints[i]
+		}
+	}
+	t.Fatalf("No statistics for endpoint class %s in %s\n", class,
+		asJson(stats.Endpoints))
+	return nil
+}
+
+func TestEndpointSlis(t *testing.T) {
+	// Each query sleeps for delayMs, and then fails if fail is set.
+	var delayMs, fail int64
+	hooks := &datastoreTestHooks{
+		BeforeQuery: func(query *common.Query) error {
+			time.Sleep(time.Duration(atomic.LoadInt64(&delayMs)) *
+				time.Millisecond)
+			if atomic.LoadInt64(&fail) != 0 {
+				return errors.New("injected query failure")
+			}
+			return nil
+		},
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestEndpointSlis",
+		Cnf: map[string]string{
+			conf.HTRACE_REST_SLI_SATISFIED_MS:  "100",
+			conf.HTRACE_REST_SLI_TOLERATING_MS: "1000",
+		},
+		DataDirs:           make([]string, 2),
+		WrittenSpans:       common.NewSemaphore(0),
+		DatastoreTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(2)
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(2)
+
+	query := &common.Query{Lim: 10}
+	runQueries := func(n int) {
+		for i := 0; i < n; i++ {
+			hcl.Query(query)
+		}
+	}
+	// Three fast queries, two slow ones, and one very slow one.
+	runQueries(3)
+	atomic.StoreInt64(&delayMs, 300)
+	runQueries(2)
+	atomic.StoreInt64(&delayMs, 1200)
+	runQueries(1)
+	atomic.StoreInt64(&delayMs, 0)
+
+	// Two queries which are rejected, and two which fail on the server.
+	_, err = hcl.Query(&common.Query{Lim: -1})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	_, err = hcl.Query(&common.Query{Lim: -1})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	atomic.StoreInt64(&fail, 1)
+	_, err = hcl.Query(query)
+	expectErrorCode(t, err, common.ERR_INTERNAL)
+	_, err = hcl.Query(query)
+	expectErrorCode(t, err, common.ERR_INTERNAL)
+	atomic.StoreInt64(&fail, 0)
+
+	_, err = hcl.FindSpan(spans[0].Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	_, err = hcl.FindChildren(spans[0].Id, 10)
+	if err != nil {
+		t.Fatalf("FindChildren failed: %s\n", err.Error())
+	}
+
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	// The rejected queries were fast, so they are satisfied.  The failed
+	// ones are frustrated.
+	sli := findEndpointSli(t, stats, common.ENDPOINT_CLASS_QUERY)
+	if sli.Requests != 10 || sli.Satisfied != 5 || sli.Tolerating != 2 ||
+		sli.Frustrated != 3 {
+		t.Fatalf("Unexpected query statistics %s\n", asJson(sli))
+	}
+	if sli.ClientErrors != 2 || sli.ServerErrors != 2 ||
+		sli.ClientErrorPercent != 20 || sli.ServerErrorPercent != 20 {
+		t.Fatalf("Unexpected query error rates %s\n", asJson(sli))
+	}
+	if sli.Apdex != 0.6 {
+		t.Fatalf("Expected an apdex score of 0.6, but got %s\n", asJson(sli))
+	}
+	if sli.MaxLatencyMs < 1200 {
+		t.Fatalf("Expected the slowest query to take at least 1200ms, but "+
+			"got %s\n", asJson(sli))
+	}
+	sli = findEndpointSli(t, stats, common.ENDPOINT_CLASS_SPAN)
+	if sli.Requests != 1 || sli.Apdex != 1 {
+		t.Fatalf("Unexpected span statistics %s\n", asJson(sli))
+	}
+	sli = findEndpointSli(t, stats, common.ENDPOINT_CLASS_CHILDREN)
+	if sli.Requests != 1 {
+		t.Fatalf("Unexpected children statistics %s\n", asJson(sli))
+	}
+	sli = findEndpointSli(t, stats, common.ENDPOINT_CLASS_WRITE)
+	if sli.Requests != 1 || sli.ClientErrors != 0 || sli.ServerErrors != 0 {
+		t.Fatalf("Unexpected write statistics %s\n", asJson(sli))
+	}
+}
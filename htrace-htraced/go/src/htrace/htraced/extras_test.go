@@ -0,0 +1,104 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	htrace "htrace/client"
+	"htrace/common"
+	"strings"
+	"testing"
+)
+
+func TestSpanExtras(t *testing.T) {
+	testSpanExtras(t, false)
+}
+
+func TestSpanExtrasRest(t *testing.T) {
+	testSpanExtras(t, true)
+}
+
+func testSpanExtras(t *testing.T, restOnly bool) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanExtras",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(),
+		&htrace.TestHooks{HrpcDisabled: restOnly})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// A span from a newer client, with fields we don't know about.
+	futureJson := `{"a":"5b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19","b":100,"e":200,` +
+		`"d":"op","p":[],"r":"tracer","fl":7,"zz":{"k":[1,"two",null]}}`
+	var future common.Span
+	err = json.Unmarshal([]byte(futureJson), &future)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal %s: %s\n", futureJson, err.Error())
+	}
+	// A span whose unknown fields are too big.
+	var huge common.Span
+	err = json.Unmarshal([]byte(`{"a":"6b1e2c5e0d1f4e9a8c7b6a5d4c3b2a19",`+
+		`"b":100,"e":200,"d":"op","p":[],"r":"tracer","big":"`+
+		strings.Repeat("x", common.MAX_SPAN_EXTRAS_BYTES)+`"}`), &huge)
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the huge span: %s\n", err.Error())
+	}
+	err = hcl.WriteSpans([]*common.Span{&future, &huge})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+
+	// The server stamps the schema version, and keeps the unknown fields.
+	expectedJson := strings.Replace(futureJson, `"r":"tracer"`,
+		`"r":"tracer","sv":1`, 1)
+	span, err := hcl.FindSpan(future.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	common.ExpectStrEqual(t, expectedJson, string(span.ToJson()))
+	var dump bytes.Buffer
+	_, err = hcl.DumpAllTo(&dump, htrace.DumpOpts{Lim: 10})
+	if err != nil {
+		t.Fatalf("DumpAllTo failed: %s\n", err.Error())
+	}
+	common.ExpectStrEqual(t, expectedJson+"\n", dump.String())
+
+	// The span with too many extras was dropped.
+	if ht.Store.FindSpan(huge.Id) != nil {
+		t.Fatalf("Expected the span with huge extras to be dropped.\n")
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.ServerDroppedSpans != 1 {
+		t.Fatalf("Expected 1 dropped span, but got %d\n",
+			stats.ServerDroppedSpans)
+	}
+}
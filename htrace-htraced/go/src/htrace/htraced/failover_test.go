@@ -0,0 +1,149 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"testing"
+)
+
+// Build a client configuration which lists both servers.
+func failoverClientConf(ht1, ht2 *MiniHTraced,
+	cooldownMs string) *conf.Config {
+	return ht1.Cnf.Clone(
+		conf.HTRACE_WEB_ADDRESS, ht1.Rsv.Addr().String()+","+
+			ht2.Rsv.Addr().String(),
+		conf.HTRACE_HRPC_ADDRESS, ht1.Hsv.Addr().String()+","+
+			ht2.Hsv.Addr().String(),
+		conf.HTRACE_CLIENT_FAILOVER_MAX_FAILURES, "1",
+		conf.HTRACE_CLIENT_FAILOVER_COOLDOWN_MS, cooldownMs)
+}
+
+func TestClientFailover(t *testing.T) {
+	var hts [2]*MiniHTraced
+	for i := range hts {
+		htraceBld := &MiniHTracedBuilder{Name: "TestClientFailover",
+			DataDirs:     make([]string, 2),
+			WrittenSpans: common.NewSemaphore(0),
+		}
+		ht, err := htraceBld.Build()
+		if err != nil {
+			t.Fatalf("failed to create datastore: %s", err.Error())
+		}
+		hts[i] = ht
+	}
+	defer hts[1].Close()
+	addr0 := hts[0].Rsv.Addr().String()
+	addr1 := hts[1].Rsv.Addr().String()
+	hcl, err := htrace.NewClient(failoverClientConf(hts[0], hts[1],
+		"3600000"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// The addresses in the two lists must match up.
+	_, err = htrace.NewClient(hts[0].Cnf.Clone(
+		conf.HTRACE_WEB_ADDRESS, addr0+","+addr1,
+		conf.HTRACE_HRPC_ADDRESS, hts[0].Hsv.Addr().String()), nil)
+	common.AssertErrContains(t, err, "There should be one HRPC address")
+
+	// Reads take turns.
+	for i := 0; i < 4; i++ {
+		_, err = hcl.GetServerStats()
+		if err != nil {
+			t.Fatalf("GetServerStats failed: %s\n", err.Error())
+		}
+	}
+	mtx := hcl.Metrics()
+	if mtx.Servers[addr0].Requests != 2 || mtx.Servers[addr1].Requests != 2 {
+		t.Fatalf("Expected 2 requests to each server, but got %s\n",
+			asJson(mtx.Servers))
+	}
+
+	// Writes go to the first server.
+	spans := createRandomTestSpans(4)
+	err = hcl.WriteSpans(spans[0:2])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	hts[0].Store.WrittenSpans.Waits(2)
+
+	// When the first server goes away, writes fail over to the second, and
+	// the first is skipped until the cooldown has passed.
+	hts[0].Close()
+	err = hcl.WriteSpans(spans[2:4])
+	if err != nil {
+		t.Fatalf("WriteSpans failed to fail over: %s\n", err.Error())
+	}
+	hts[1].Store.WrittenSpans.Waits(2)
+	for i := 0; i < 4; i++ {
+		_, err = hcl.GetServerStats()
+		if err != nil {
+			t.Fatalf("GetServerStats failed: %s\n", err.Error())
+		}
+	}
+	mtx = hcl.Metrics()
+	smtx := mtx.Servers[addr0]
+	if !smtx.Dead || smtx.Unreachable != 1 || smtx.Requests != 4 {
+		t.Fatalf("Unexpected metrics for the dead server: %s\n",
+			asJson(smtx))
+	}
+	if mtx.Servers[addr1].Dead || mtx.Servers[addr1].Unreachable != 0 {
+		t.Fatalf("Unexpected metrics for the live server: %s\n",
+			asJson(mtx.Servers[addr1]))
+	}
+	_, err = hcl.FindSpan(spans[3].Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+
+	// A request for a particular server doesn't fail over.
+	_, err = hcl.GetServerVersionAt("127.0.0.1:1")
+	if err == nil {
+		t.Fatalf("Expected GetServerVersionAt to fail for an address " +
+			"nothing listens on.\n")
+	}
+	_, err = hcl.GetServerVersionAt(addr1)
+	if err != nil {
+		t.Fatalf("GetServerVersionAt(%s) failed: %s\n", addr1, err.Error())
+	}
+
+	// Once the cooldown has passed, the dead server is tried again.  Writes
+	// are used here because each one dials a new HRPC connection, whereas
+	// REST connections to the closed server may be kept alive.
+	hcl2, err := htrace.NewClient(failoverClientConf(hts[0], hts[1], "0"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl2.Close()
+	for i := 0; i < 2; i++ {
+		err = hcl2.WriteSpans(spans[i : i+1])
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+	}
+	hts[1].Store.WrittenSpans.Waits(2)
+	if smtx = hcl2.Metrics().Servers[addr0]; smtx.Unreachable != 2 {
+		t.Fatalf("Expected the dead server to be tried twice, but got %s\n",
+			asJson(smtx))
+	}
+}
@@ -0,0 +1,236 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"testing"
+	"time"
+)
+
+func queryFlagged(t *testing.T, hcl *htrace.Client, flags string) []string {
+	spans, err := hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.HAS,
+				Field: common.FLAGS,
+				Val:   flags,
+			},
+		},
+		Lim: 100,
+	})
+	if err != nil {
+		t.Fatalf("Query for flags %s failed: %s\n", flags, err.Error())
+	}
+	ids := make([]string, len(spans))
+	for i := range spans {
+		ids[i] = spans[i].Id.String()
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSpanFlags(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanFlags",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Span i has the flags whose bits are set in i.
+	spans := createRandomTestSpans(8)
+	for i := range spans {
+		spans[i].Flags = common.SpanFlags(i)
+	}
+	ingestSpans(ht, spans)
+	for i := range spans {
+		span := ht.Store.FindSpan(spans[i].Id)
+		if span == nil || span.Flags != spans[i].Flags {
+			t.Fatalf("Expected span %s to have flags %s, but got %s\n",
+				spans[i].Id.String(), spans[i].Flags.String(), asJson(span))
+		}
+	}
+
+	for _, flags := range []string{"synthetic", "debug,scrubbed"} {
+		want, err := common.ParseSpanFlags(flags)
+		if err != nil {
+			t.Fatalf("ParseSpanFlags failed: %s\n", err.Error())
+		}
+		expected := make([]string, 0)
+		for i := range spans {
+			if spans[i].Flags.Has(want) {
+				expected = append(expected, spans[i].Id.String())
+			}
+		}
+		sort.Strings(expected)
+		common.ExpectStrEqual(t, asJson(expected),
+			asJson(queryFlagged(t, hcl, flags)))
+	}
+
+	// Unknown flags, and operations other than HAS, are rejected.
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.HAS, Field: common.FLAGS, Val: "odd"},
+		},
+		Lim: 10,
+	})
+	common.AssertErrContains(t, err, "Unknown span flag 'odd'")
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.EQUALS, Field: common.FLAGS,
+				Val: "debug"},
+		},
+		Lim: 10,
+	})
+	if err == nil {
+		t.Fatalf("Expected an EQUALS predicate on flags to be rejected.\n")
+	}
+	_, err = hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.HAS, Field: common.DESCRIPTION,
+				Val: "debug"},
+		},
+		Lim: 10,
+	})
+	if err == nil {
+		t.Fatalf("Expected a HAS predicate on a description to be rejected.\n")
+	}
+
+	// Each flag was set on half of the spans.
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	for _, name := range common.SpanFlagNames() {
+		if stats.FlaggedSpans[name] != 4 {
+			t.Fatalf("Expected 4 spans flagged %s, but got %s\n", name,
+				asJson(stats.FlaggedSpans))
+		}
+	}
+}
+
+func TestSpanQuotasKeepDebugSpans(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanQuotasKeepDebugSpans",
+		Cnf: map[string]string{
+			conf.HTRACE_QUOTA_RULES:          "teamB*:2:sample",
+			conf.HTRACE_QUOTA_SAMPLE_PERCENT: "0",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	spans := createRandomTestSpans(7)
+	for i := range spans {
+		spans[i].Begin = int64(1000 + i)
+		spans[i].End = int64(2000 + i)
+		spans[i].TracerId = "teamB-backend"
+	}
+	ingestSpans(ht, spans[:3])
+	expectSpanOutcomes(t, ht, SpanOutcomes{})
+	waitForQuotas(t, ht, true)
+
+	// Once the quota is enforced, every ordinary span is sampled out, but the
+	// debug spans are kept.
+	spans[3].Flags = common.SPAN_FLAG_DEBUG
+	spans[4].Flags = common.SPAN_FLAG_DEBUG | common.SPAN_FLAG_SYNTHETIC
+	spans[5].Flags = common.SPAN_FLAG_SYNTHETIC
+	err = hcl.WriteSpans(spans[3:])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	expectSpanOutcomes(t, ht, SpanOutcomes{Written: 2, Rejected: 2})
+	for i := 3; i < len(spans); i++ {
+		written := ht.Store.FindSpan(spans[i].Id) != nil
+		if written != spans[i].Flags.Has(common.SPAN_FLAG_DEBUG) {
+			t.Fatalf("Unexpected outcome for span %s with flags '%s': "+
+				"written=%t\n", spans[i].Id.String(),
+				spans[i].Flags.String(), written)
+		}
+	}
+	stats := ht.Store.ServerStats()
+	if stats.QuotaSampledOutSpans != 2 {
+		t.Fatalf("Unexpected server stats %s\n", asJson(stats))
+	}
+}
+
+func TestSlosSkipSyntheticSpans(t *testing.T) {
+	ht := buildSloHTraced(t, make([]string, 2))
+	ht.KeepDataDirsOnClose = false
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	_, err = hcl.DefineSlo(&common.SloDefinition{
+		Name:          "createFile",
+		Description:   "createFile",
+		ThresholdMs:   50,
+		TargetPercent: 99,
+		WindowMs:      10000,
+	})
+	if err != nil {
+		t.Fatalf("DefineSlo failed: %s\n", err.Error())
+	}
+
+	// The synthetic spans are all too slow, but they don't count against
+	// the SLO.  The debug span does count.
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	spans := createRandomTestSpans(6)
+	for i := range spans {
+		spans[i].Description = "createFile"
+		spans[i].End = nowMs - 3000
+		spans[i].Begin = spans[i].End - 10
+		spans[i].BeginNs = 0
+		spans[i].EndNs = 0
+		switch i {
+		case 0:
+			spans[i].Flags = common.SPAN_FLAG_DEBUG
+		case 1, 2, 3:
+			spans[i].Begin = spans[i].End - 500
+			spans[i].Flags = common.SPAN_FLAG_SYNTHETIC
+		}
+	}
+	ingestSpans(ht, spans)
+	evaluateSlos(ht)
+	expectSloCounts(t, getSlos(t, hcl)["createFile"], 3, 0, 0, true)
+}
@@ -0,0 +1,221 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"sort"
+)
+
+// Flame trees are the descendants of a span, assembled into a nested
+// structure which is ready to be rendered.  Since spans can come from many
+// processes, clock skew can make a child appear to begin before its parent,
+// or end after it.  We clamp each child to the interval of its parent, so that
+// self times are never negative and the tree nests properly.
+//
+// If any span in the tree has nanosecond times, the whole tree is laid out in
+// nanoseconds, and the millisecond times are derived from the result.
+// Otherwise, it is laid out in milliseconds, since nanosecond times could
+// overflow for spans with arbitrary millisecond times.
+
+// Assemble the flame tree rooted at the given span.  At most lim spans will be
+// included, closest to the root first.  Returns nil if the root span could not
+// be found.
+func (store *dataStore) AssembleFlameTree(sid common.SpanId,
+	lim int) *common.FlameTree {
+	span := store.FindSpan(sid)
+	if span == nil {
+		return nil
+	}
+	tree := &common.FlameTree{
+		Root:     newFlameNode(span),
+		NumSpans: 1,
+	}
+	spans := map[*common.FlameNode]*common.Span{tree.Root: span}
+	// Since the parent index is written by clients, it may contain cycles.
+	// Never visit a span more than once.
+	visited := map[string]bool{string(sid): true}
+	queue := []*common.FlameNode{tree.Root}
+	for len(queue) > 0 && !tree.Truncated {
+		node := queue[0]
+		queue = queue[1:]
+		childIds := store.FindChildren(node.Id, int32(lim-tree.NumSpans+1))
+		children := store.FindSpans(childIds)
+		for i := range childIds {
+			if visited[string(childIds[i])] {
+				continue
+			}
+			if tree.NumSpans >= lim {
+				tree.Truncated = true
+				break
+			}
+			child := children[i]
+			if child == nil {
+				tree.NumMissing++
+				continue
+			}
+			visited[string(childIds[i])] = true
+			childNode := newFlameNode(child)
+			spans[childNode] = child
+			node.Children = append(node.Children, childNode)
+			queue = append(queue, childNode)
+			tree.NumSpans++
+		}
+	}
+	useNs := false
+	for _, span := range spans {
+		if span.HasNsTimes() {
+			useNs = true
+			break
+		}
+	}
+	if useNs {
+		for node, span := range spans {
+			node.BeginNs = flameTimeNs(span.BeginParts())
+			node.EndNs = flameTimeNs(span.EndParts())
+		}
+		layoutFlameNodeNs(tree.Root, tree.Root.BeginNs, tree.Root.EndNs)
+	} else {
+		layoutFlameNode(tree.Root, tree.Root.Begin, tree.Root.End)
+	}
+	return tree
+}
+
+// Convert a time split into milliseconds and nanoseconds back to nanoseconds.
+func flameTimeNs(ms int64, ns int64) int64 {
+	return ms*common.NS_PER_MS + ns
+}
+
+func newFlameNode(span *common.Span) *common.FlameNode {
+	return &common.FlameNode{
+		Id:          span.Id,
+		Description: span.Description,
+		Begin:       span.Begin,
+		End:         span.End,
+		Children:    make([]*common.FlameNode, 0),
+	}
+}
+
+type flameNodesByBegin []*common.FlameNode
+
+func (nodes flameNodesByBegin) Len() int {
+	return len(nodes)
+}
+
+func (nodes flameNodesByBegin) Less(i, j int) bool {
+	if nodes[i].Begin != nodes[j].Begin {
+		return nodes[i].Begin < nodes[j].Begin
+	}
+	if nodes[i].BeginNs != nodes[j].BeginNs {
+		return nodes[i].BeginNs < nodes[j].BeginNs
+	}
+	return nodes[i].Id.String() < nodes[j].Id.String()
+}
+
+func (nodes flameNodesByBegin) Swap(i, j int) {
+	nodes[i], nodes[j] = nodes[j], nodes[i]
+}
+
+// Clamp a node to the interval [lo, hi], sort its children, and compute its
+// self time.  The children are laid out recursively.
+func layoutFlameNode(node *common.FlameNode, lo int64, hi int64) {
+	if hi < lo {
+		hi = lo
+	}
+	begin, end := clampInterval(node.Begin, node.End, lo, hi)
+	if begin != node.Begin || end != node.End {
+		node.Begin = begin
+		node.End = end
+		node.Clamped = true
+	}
+	for i := range node.Children {
+		layoutFlameNode(node.Children[i], node.Begin, node.End)
+	}
+	sort.Sort(flameNodesByBegin(node.Children))
+	node.SelfMs = selfTime(node.Begin, node.End, node.Children,
+		func(child *common.FlameNode) (int64, int64) {
+			return child.Begin, child.End
+		})
+}
+
+// Like layoutFlameNode, but using the nanosecond times of the nodes.  The
+// millisecond times and self time are derived from the nanosecond ones.
+func layoutFlameNodeNs(node *common.FlameNode, lo int64, hi int64) {
+	if hi < lo {
+		hi = lo
+	}
+	begin, end := clampInterval(node.BeginNs, node.EndNs, lo, hi)
+	if begin != node.BeginNs || end != node.EndNs {
+		node.BeginNs = begin
+		node.EndNs = end
+		node.Clamped = true
+	}
+	node.Begin, _ = common.SplitNs(node.BeginNs)
+	node.End, _ = common.SplitNs(node.EndNs)
+	for i := range node.Children {
+		layoutFlameNodeNs(node.Children[i], node.BeginNs, node.EndNs)
+	}
+	sort.Sort(flameNodesByBegin(node.Children))
+	node.SelfNs = selfTime(node.BeginNs, node.EndNs, node.Children,
+		func(child *common.FlameNode) (int64, int64) {
+			return child.BeginNs, child.EndNs
+		})
+	node.SelfMs, _ = common.SplitNs(node.SelfNs)
+}
+
+// Compute the self time of a node, which is the part of its interval which is
+// not covered by any of its children.  The children must already be clamped
+// and sorted.  Children may overlap each other, so we subtract the union of
+// their intervals.
+func selfTime(begin int64, end int64, children []*common.FlameNode,
+	interval func(*common.FlameNode) (int64, int64)) int64 {
+	covered := int64(0)
+	curBegin, curEnd := begin, begin
+	for i := range children {
+		childBegin, childEnd := interval(children[i])
+		if childBegin > curEnd {
+			covered += curEnd - curBegin
+			curBegin = childBegin
+			curEnd = childEnd
+		} else if childEnd > curEnd {
+			curEnd = childEnd
+		}
+	}
+	covered += curEnd - curBegin
+	return (end - begin) - covered
+}
+
+// Clamp the interval [begin, end] to lie within [lo, hi].
+func clampInterval(begin int64, end int64, lo int64, hi int64) (int64, int64) {
+	if end < begin {
+		end = begin
+	}
+	if begin < lo {
+		begin = lo
+	} else if begin > hi {
+		begin = hi
+	}
+	if end < begin {
+		end = begin
+	} else if end > hi {
+		end = hi
+	}
+	return begin, end
+}
@@ -0,0 +1,226 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/test"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func ingestSpans(ht *MiniHTraced, spans []*common.Span) {
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range spans {
+		ing.IngestSpan(spans[i])
+	}
+	ing.Close(time.Now())
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+}
+
+func TestFlameTreeOfSpanTree(t *testing.T) {
+	gen := &test.SpanTreeGenerator{
+		Seed:          1867,
+		Depth:         3,
+		NumRoots:      1,
+		MinFanOut:     3,
+		MaxFanOut:     3,
+		MinDurationMs: 1000,
+		MaxDurationMs: 10000,
+		StartMs:       123456789,
+		Nested:        true,
+	}
+	tree := gen.Generate()
+	htraceBld := &MiniHTracedBuilder{Name: "TestFlameTreeOfSpanTree",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, tree.Spans)
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	flame, err := hcl.GetFlameTree(tree.Roots[0], 1000)
+	if err != nil {
+		t.Fatalf("GetFlameTree failed: %s\n", err.Error())
+	}
+	if flame.NumSpans != len(tree.Spans) || flame.Truncated ||
+		flame.NumMissing != 0 {
+		t.Fatalf("Expected a complete tree of %d spans, but got NumSpans=%d, "+
+			"Truncated=%t, NumMissing=%d\n", len(tree.Spans), flame.NumSpans,
+			flame.Truncated, flame.NumMissing)
+	}
+	var verify func(node *common.FlameNode)
+	verify = func(node *common.FlameNode) {
+		expected := tree.ChildrenOf(node.Id)
+		children := make([]common.SpanId, len(node.Children))
+		for i := range node.Children {
+			child := node.Children[i]
+			if i > 0 && child.Begin < node.Children[i-1].Begin {
+				t.Fatalf("Children of %s are not sorted by begin time.\n",
+					node.Id.String())
+			}
+			if child.Begin < node.Begin || child.End > node.End ||
+				child.Clamped {
+				t.Fatalf("Child %s does not nest within %s\n",
+					child.Id.String(), node.Id.String())
+			}
+			children[i] = child.Id
+			verify(child)
+		}
+		sort.Sort(common.SpanIdSlice(children))
+		if len(expected) != len(children) ||
+			(len(expected) > 0 && !reflect.DeepEqual(expected, children)) {
+			t.Fatalf("Expected children of %s to be %v, but got %v\n",
+				node.Id.String(), expected, children)
+		}
+		if node.SelfMs < 0 || node.SelfMs > node.End-node.Begin {
+			t.Fatalf("Invalid self time %d for %s\n", node.SelfMs,
+				node.Id.String())
+		}
+		if len(node.Children) == 0 && node.SelfMs != node.End-node.Begin {
+			t.Fatalf("Expected leaf %s to have a self time of %d, but got "+
+				"%d\n", node.Id.String(), node.End-node.Begin, node.SelfMs)
+		}
+	}
+	verify(flame.Root)
+
+	// Limiting the number of spans should truncate the tree.
+	flame, err = hcl.GetFlameTree(tree.Roots[0], 3)
+	if err != nil {
+		t.Fatalf("GetFlameTree failed: %s\n", err.Error())
+	}
+	if flame.NumSpans != 3 || !flame.Truncated {
+		t.Fatalf("Expected a truncated tree of 3 spans, but got NumSpans=%d, "+
+			"Truncated=%t\n", flame.NumSpans, flame.Truncated)
+	}
+
+	// Looking up a span which doesn't exist should return nil.
+	flame, err = hcl.GetFlameTree(common.TestId("ffffffffffffffffffffffffffffffff"), 10)
+	if err != nil {
+		t.Fatalf("GetFlameTree failed: %s\n", err.Error())
+	}
+	if flame != nil {
+		t.Fatalf("Expected no flame tree for a missing span, but got %v\n",
+			flame)
+	}
+}
+
+func TestFlameTreeSelfTimes(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestFlameTreeSelfTimes",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	rootId := common.TestId("00000000000000000000000000000001")
+	aId := common.TestId("00000000000000000000000000000002")
+	bId := common.TestId("00000000000000000000000000000003")
+	cId := common.TestId("00000000000000000000000000000004")
+	gId := common.TestId("00000000000000000000000000000005")
+	newSpan := func(id common.SpanId, begin int64, end int64,
+		parents ...common.SpanId) *common.Span {
+		return &common.Span{Id: id, SpanData: common.SpanData{
+			Begin: begin, End: end, Description: id.String(),
+			TracerId: "tr", Parents: parents}}
+	}
+	ingestSpans(ht, []*common.Span{
+		// The root lists its own grandchild as a parent, creating a cycle.
+		newSpan(rootId, 0, 100, gId),
+		// a and b overlap each other.
+		newSpan(aId, 10, 30, rootId),
+		newSpan(bId, 20, 50, rootId),
+		// c ends after its parent.
+		newSpan(cId, 90, 130, rootId),
+		// g ends after its parent, a.
+		newSpan(gId, 25, 35, aId),
+	})
+	// Add a parent index entry for a child which doesn't exist.
+	missingId := common.TestId("00000000000000000000000000000006")
+	shd := ht.Store.shards[ht.Store.getShardIndex(missingId)]
+	key := append(append([]byte{PARENT_ID_INDEX_PREFIX}, rootId.Val()...),
+		missingId.Val()...)
+	err = shd.ldb.Put(ht.Store.writeOpts, key, EMPTY_BYTE_BUF)
+	if err != nil {
+		t.Fatalf("failed to write parent index entry: %s\n", err.Error())
+	}
+
+	flame := ht.Store.AssembleFlameTree(rootId, 100)
+	if flame == nil {
+		t.Fatalf("failed to assemble flame tree.\n")
+	}
+	if flame.NumSpans != 5 || flame.NumMissing != 1 || flame.Truncated {
+		t.Fatalf("Expected NumSpans=5, NumMissing=1, Truncated=false, but "+
+			"got NumSpans=%d, NumMissing=%d, Truncated=%t\n", flame.NumSpans,
+			flame.NumMissing, flame.Truncated)
+	}
+	type expectedNode struct {
+		begin, end, selfMs int64
+		clamped            bool
+		children           []common.SpanId
+	}
+	expected := map[string]expectedNode{
+		// 100 - (10..50) - (90..100)
+		rootId.String(): {0, 100, 50, false, []common.SpanId{aId, bId, cId}},
+		// 20 - (25..30)
+		aId.String(): {10, 30, 15, false, []common.SpanId{gId}},
+		bId.String(): {20, 50, 30, false, []common.SpanId{}},
+		cId.String(): {90, 100, 10, true, []common.SpanId{}},
+		gId.String(): {25, 30, 5, true, []common.SpanId{}},
+	}
+	var verify func(node *common.FlameNode)
+	verify = func(node *common.FlameNode) {
+		exp := expected[node.Id.String()]
+		if node.Begin != exp.begin || node.End != exp.end ||
+			node.SelfMs != exp.selfMs || node.Clamped != exp.clamped {
+			t.Fatalf("Expected %s to have begin=%d, end=%d, self=%d, "+
+				"clamped=%t, but got begin=%d, end=%d, self=%d, clamped=%t\n",
+				node.Id.String(), exp.begin, exp.end, exp.selfMs, exp.clamped,
+				node.Begin, node.End, node.SelfMs, node.Clamped)
+		}
+		if len(node.Children) != len(exp.children) {
+			t.Fatalf("Expected %s to have %d children, but got %d\n",
+				node.Id.String(), len(exp.children), len(node.Children))
+		}
+		for i := range node.Children {
+			if !node.Children[i].Id.Equal(exp.children[i]) {
+				t.Fatalf("Expected child %d of %s to be %s, but got %s\n", i,
+					node.Id.String(), exp.children[i].String(),
+					node.Children[i].Id.String())
+			}
+			verify(node.Children[i])
+		}
+	}
+	verify(flame.Root)
+}
@@ -22,6 +22,7 @@ package main
 import (
 	"htrace/common"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,7 +30,8 @@ type Heartbeater struct {
 	// The name of this heartbeater
 	name string
 
-	// How long to sleep between heartbeats, in milliseconds.
+	// How long to sleep between heartbeats, in milliseconds.  Accessed via
+	// sync/atomic, since it can be changed while the heartbeater is running.
 	periodMs int64
 
 	// The logger to use.
@@ -74,6 +76,12 @@ func (hb *Heartbeater) AddHeartbeatTarget(tgt *HeartbeatTarget) {
 	hb.req <- tgt
 }
 
+// Change the heartbeat period.  The new period takes effect after the next
+// heartbeat.
+func (hb *Heartbeater) SetPeriodMs(periodMs int64) {
+	atomic.StoreInt64(&hb.periodMs, periodMs)
+}
+
 func (hb *Heartbeater) Shutdown() {
 	close(hb.req)
 	hb.wg.Wait()
@@ -88,8 +96,8 @@ func (hb *Heartbeater) run() {
 		hb.lg.Debugf("%s: exiting.\n", hb.String())
 		hb.wg.Done()
 	}()
-	period := time.Duration(hb.periodMs) * time.Millisecond
 	for {
+		period := time.Duration(atomic.LoadInt64(&hb.periodMs)) * time.Millisecond
 		periodEnd := time.Now().Add(period)
 		for {
 			timeToWait := periodEnd.Sub(time.Now())
@@ -0,0 +1,205 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"htrace/common"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Hedged span lookups.
+//
+// Normally a span lives in the shard its id hashes to, and a lookup only has
+// to ask that one shard.  Once a span has been redirected away from a
+// quarantined shard, though, any shard may hold any span, and a lookup has to
+// ask all of them.  Asking them one after another means that a single shard
+// with a sick disk makes every lookup slow.  Instead, we probe every candidate
+// shard at once and take the first answer which finds the span.  The other
+// probes are cancelled: those which haven't reached their shard yet never
+// touch it, and the rest finish in the background without anyone waiting for
+// them.
+//
+// If no shard has the span, we can't know that until every shard has
+// answered.  We wait at most datastore.find.span.deadline.ms for the
+// stragglers.  When the deadline passes, we report the span as not found and
+// count a deadline miss.  That answer is wrong if the slow shard did have the
+// span, but it keeps one bad disk from turning every "not found" into a
+// multi-second request.
+//
+// When only the span's own shard can hold it, we probe that shard directly
+// and don't apply the deadline.  There is nothing to hedge against, and
+// giving up would just turn a slow answer into a wrong one.
+//
+// FindSpans looks up a batch of spans concurrently.  Since each of those
+// lookups can fan out to every shard, the number in flight across the whole
+// server is bounded by datastore.find.spans.concurrency.
+//
+
+// Looks for something in a shard.  Returns the value and true if the shard
+// has it.  The shard is held while the probe runs.
+type shardProbe func(shd *shard) (interface{}, bool)
+
+// The answer from a single shard.
+type probeResult struct {
+	shardIdx int
+	val      interface{}
+	found    bool
+}
+
+func findSpansConcurrency(n int) int {
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// Run probe on the shards which could hold the given span, and return the
+// first value found.  Quarantined shards are skipped.
+func (store *dataStore) findInSpanShards(sid common.SpanId,
+	probe shardProbe) (interface{}, bool) {
+	startIdx := store.getShardIndex(sid)
+	// Spans are only written to a shard other than the one their id hashes
+	// to if a shard was quarantined.
+	if atomic.LoadInt32(&store.redirected) == 0 || len(store.shards) == 1 {
+		res := store.probeShard(startIdx, probe, nil)
+		return res.val, res.found
+	}
+	return store.hedgedFind(sid, startIdx, probe)
+}
+
+func (store *dataStore) hedgedFind(sid common.SpanId, startIdx int,
+	probe shardProbe) (interface{}, bool) {
+	atomic.AddUint64(&store.hedgedLookups, 1)
+	numShards := len(store.shards)
+	// The channel is big enough to hold every answer, so that abandoned
+	// probes never block.
+	results := make(chan probeResult, numShards)
+	cancel := make(chan struct{})
+	defer close(cancel)
+	for i := 0; i < numShards; i++ {
+		go func(shardIdx int) {
+			results <- store.probeShard(shardIdx, probe, cancel)
+		}((startIdx + i) % numShards)
+	}
+	var deadline <-chan time.Time
+	if store.findSpanDeadline > 0 {
+		timer := time.NewTimer(store.findSpanDeadline)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	answered := make(map[int]bool, numShards)
+	for len(answered) < numShards {
+		select {
+		case res := <-results:
+			answered[res.shardIdx] = true
+			if res.found {
+				atomic.AddUint64(&store.hedgeCancels,
+					uint64(numShards-len(answered)))
+				return res.val, true
+			}
+		case <-deadline:
+			atomic.AddUint64(&store.hedgeCancels,
+				uint64(numShards-len(answered)))
+			atomic.AddUint64(&store.lookupDeadlineMisses, 1)
+			slow := store.unansweredShardPaths(answered)
+			store.ingestLog.Warnf(slow, "Lookup of span %s gave up after "+
+				"%s waiting for shard(s) %s.  Reporting it as not found.\n",
+				sid.String(), store.findSpanDeadline.String(), slow)
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// Get a comma-separated list of the shards which haven't answered.
+func (store *dataStore) unansweredShardPaths(answered map[int]bool) string {
+	paths := make([]string, 0, len(store.shards)-len(answered))
+	for shardIdx := range store.shards {
+		if !answered[shardIdx] {
+			paths = append(paths, store.shards[shardIdx].path)
+		}
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, ", ")
+}
+
+// Run probe on a single shard.  If cancel is closed before the shard has been
+// read, the probe is skipped.
+func (store *dataStore) probeShard(shardIdx int, probe shardProbe,
+	cancel <-chan struct{}) probeResult {
+	res := probeResult{shardIdx: shardIdx}
+	start := time.Now()
+	delay := store.faults.ShardReadDelay(shardIdx)
+	if delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-cancel:
+			return res
+		}
+	}
+	select {
+	case <-cancel:
+		return res
+	default:
+	}
+	shd := store.shards[shardIdx]
+	if !shd.acquire() {
+		return res
+	}
+	res.val, res.found = probe(shd)
+	shd.release()
+	shd.recordLookupLatency(time.Since(start))
+	return res
+}
+
+func (shd *shard) recordLookupLatency(latency time.Duration) {
+	ns := uint64(latency.Nanoseconds())
+	for {
+		prev := atomic.LoadUint64(&shd.maxLookupNs)
+		if ns <= prev ||
+			atomic.CompareAndSwapUint64(&shd.maxLookupNs, prev, ns) {
+			return
+		}
+	}
+}
+
+// Find a batch of spans.  The result has an entry for each id, which is nil if
+// that span was not found.
+func (store *dataStore) FindSpans(sids []common.SpanId) []*common.Span {
+	spans := make([]*common.Span, len(sids))
+	var wg sync.WaitGroup
+	for i := range sids {
+		store.findSpansSem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-store.findSpansSem
+				wg.Done()
+			}()
+			spans[i] = store.FindSpan(sids[i])
+		}(i)
+	}
+	wg.Wait()
+	return spans
+}
@@ -0,0 +1,181 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Delays every read from one shard.
+type slowReadFaults struct {
+	noFaults
+
+	slowIdx int
+
+	delay time.Duration
+}
+
+func (srf *slowReadFaults) ShardReadDelay(shardIdx int) time.Duration {
+	if shardIdx == srf.slowIdx {
+		return srf.delay
+	}
+	return 0
+}
+
+func TestHedgedFindSpan(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHedgedFindSpan",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_CACHE_BYTES:      "0",
+			conf.HTRACE_FIND_SPAN_DEADLINE_MS: "200",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 3),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	spans := createRandomTestSpans(20)
+	ingestSpans(ht, spans)
+
+	// Pretend that a shard was quarantined at some point, so that every
+	// lookup has to ask every shard.  Then make one shard very slow.
+	atomic.StoreInt32(&ht.Store.redirected, 1)
+	const slowIdx = 0
+	ht.Store.faults = &slowReadFaults{slowIdx: slowIdx, delay: 10 * time.Second}
+
+	// Spans held by the fast shards are found without waiting for the slow
+	// one.
+	var fast []common.SpanId
+	for i := range spans {
+		if ht.Store.getShardIndex(spans[i].Id) != slowIdx {
+			fast = append(fast, spans[i].Id)
+		}
+	}
+	if len(fast) == 0 {
+		t.Fatalf("All test spans hashed to the slow shard.\n")
+	}
+	for i := range fast {
+		start := time.Now()
+		span := ht.Store.FindSpan(fast[i])
+		if span == nil {
+			t.Fatalf("Failed to find span %s.\n", fast[i].String())
+		}
+		if elapsed := time.Since(start); elapsed > 150*time.Millisecond {
+			t.Fatalf("Finding span %s took %s; it should not have waited "+
+				"for the slow shard.\n", fast[i].String(), elapsed.String())
+		}
+	}
+	stats := ht.Store.ServerStats()
+	if stats.HedgedLookups != uint64(len(fast)) {
+		t.Fatalf("Expected %d hedged lookups, got %d.\n", len(fast),
+			stats.HedgedLookups)
+	}
+	if stats.HedgeCancels < uint64(len(fast)) {
+		t.Fatalf("Expected at least %d hedge cancels, got %d.\n", len(fast),
+			stats.HedgeCancels)
+	}
+	if stats.LookupDeadlineMisses != 0 {
+		t.Fatalf("Expected no deadline misses, got %d.\n",
+			stats.LookupDeadlineMisses)
+	}
+
+	// A span which doesn't exist is reported as not found once the deadline
+	// passes, rather than when the slow shard finally answers.
+	missing := common.TestId("00000000000000000000000000000001")
+	start := time.Now()
+	if span := ht.Store.FindSpan(missing); span != nil {
+		t.Fatalf("Unexpectedly found span %s.\n", missing.String())
+	}
+	elapsed := time.Since(start)
+	if elapsed < 200*time.Millisecond || elapsed > 5*time.Second {
+		t.Fatalf("Expected the not-found lookup to take about 200ms, but "+
+			"it took %s.\n", elapsed.String())
+	}
+	stats = ht.Store.ServerStats()
+	if stats.LookupDeadlineMisses != 1 {
+		t.Fatalf("Expected 1 deadline miss, got %d.\n",
+			stats.LookupDeadlineMisses)
+	}
+
+	// Without the slow shard, not-found lookups don't miss the deadline.
+	ht.Store.faults = noFaults{}
+	if span := ht.Store.FindSpan(missing); span != nil {
+		t.Fatalf("Unexpectedly found span %s.\n", missing.String())
+	}
+	stats = ht.Store.ServerStats()
+	if stats.LookupDeadlineMisses != 1 {
+		t.Fatalf("Expected 1 deadline miss, got %d.\n",
+			stats.LookupDeadlineMisses)
+	}
+	for i := range stats.Dirs {
+		if i != slowIdx && stats.Dirs[i].MaxLookupMs >= 150 {
+			t.Fatalf("Shard %d had a %dms lookup, but it wasn't slow.\n",
+				i, stats.Dirs[i].MaxLookupMs)
+		}
+	}
+}
+
+func TestFindSpans(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestFindSpans",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_CACHE_BYTES:       "0",
+			conf.HTRACE_FIND_SPAN_DEADLINE_MS:  "200",
+			conf.HTRACE_FIND_SPANS_CONCURRENCY: "2",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 3),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	spans := createRandomTestSpans(20)
+	ingestSpans(ht, spans)
+	atomic.StoreInt32(&ht.Store.redirected, 1)
+	sids := make([]common.SpanId, 0, len(spans)+1)
+	for i := range spans {
+		sids = append(sids, spans[i].Id)
+	}
+	missing := common.TestId("00000000000000000000000000000001")
+	sids = append(sids, missing)
+	found := ht.Store.FindSpans(sids)
+	if len(found) != len(sids) {
+		t.Fatalf("Expected %d results, got %d.\n", len(sids), len(found))
+	}
+	for i := range spans {
+		if found[i] == nil {
+			t.Fatalf("Failed to find span %s.\n", spans[i].Id.String())
+		}
+		common.ExpectSpansEqual(t, spans[i], found[i])
+	}
+	if found[len(spans)] != nil {
+		t.Fatalf("Unexpectedly found span %s.\n", missing.String())
+	}
+	if len(ht.Store.findSpansSem) != 0 {
+		t.Fatalf("FindSpans leaked %d concurrency slot(s).\n",
+			len(ht.Store.findSpansSem))
+	}
+}
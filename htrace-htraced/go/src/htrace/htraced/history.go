@@ -0,0 +1,216 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"time"
+)
+
+// The MetricsSink keeps a history of its ingest counters in fixed-length
+// buckets, so that we can tell what the ingest rate was at some point in the
+// past without relying on external scraping.  Buckets are aligned to
+// multiples of their length since the epoch.  Each update goes into the
+// bucket for the current time, and the datastore heartbeat rotates the
+// buckets even when nothing is being ingested.  Periods where neither
+// happened, because the heartbeat was late, show up as empty buckets.
+
+type statsHistory struct {
+	// The length of each bucket, in milliseconds.
+	bucketMs int64
+
+	// The maximum number of buckets to keep.
+	maxBuckets int
+
+	// The buckets, oldest first.  The last one is the current bucket.
+	buckets []common.StatsBucket
+
+	// Returns the current time in UTC milliseconds since the epoch.  Tests
+	// replace this.
+	nowMs func() int64
+}
+
+func newStatsHistory(cnf *conf.Config) *statsHistory {
+	bucketMs := cnf.GetInt64(conf.HTRACE_METRICS_HISTORY_BUCKET_MS)
+	if bucketMs < 1 {
+		bucketMs = 1
+	}
+	maxBuckets := cnf.GetInt(conf.HTRACE_METRICS_HISTORY_BUCKETS)
+	if maxBuckets < 1 {
+		maxBuckets = 1
+	}
+	return &statsHistory{
+		bucketMs:   bucketMs,
+		maxBuckets: maxBuckets,
+		buckets:    make([]common.StatsBucket, 0, maxBuckets),
+		nowMs: func() int64 {
+			return common.TimeToUnixMs(time.Now().UTC())
+		},
+	}
+}
+
+// Make sure that the last bucket covers the current time, adding empty
+// buckets for any periods we skipped, and return it.  The MetricsSink lock
+// must be held.
+func (hist *statsHistory) current() *common.StatsBucket {
+	return hist.advance(hist.bucketStart(hist.nowMs()))
+}
+
+// Make sure that the last bucket starts at or after startMs, adding empty
+// buckets for any periods we skipped, and return it.  The MetricsSink lock
+// must be held.
+func (hist *statsHistory) advance(startMs int64) *common.StatsBucket {
+	if len(hist.buckets) > 0 {
+		last := &hist.buckets[len(hist.buckets)-1]
+		if last.StartMs >= startMs {
+			// If the clock went backwards, keep using the last bucket rather
+			// than rewriting the past.
+			return last
+		}
+		last.Complete = true
+		// Don't bother creating buckets which would be discarded straight
+		// away.
+		nextMs := last.StartMs + hist.bucketMs
+		oldestMs := startMs - int64(hist.maxBuckets-1)*hist.bucketMs
+		if nextMs < oldestMs {
+			nextMs = oldestMs
+		}
+		for ; nextMs < startMs; nextMs += hist.bucketMs {
+			hist.append(nextMs, true)
+		}
+	}
+	hist.append(startMs, false)
+	return &hist.buckets[len(hist.buckets)-1]
+}
+
+// Get the start of the bucket which covers a time.
+func (hist *statsHistory) bucketStart(nowMs int64) int64 {
+	startMs := nowMs - nowMs%hist.bucketMs
+	if nowMs < 0 && nowMs%hist.bucketMs != 0 {
+		startMs -= hist.bucketMs
+	}
+	return startMs
+}
+
+// Get the bucket which starts at the given time, or nil if it has already
+// been discarded.  If the clock went backwards, this may be the current
+// bucket.  The MetricsSink lock must be held.
+func (hist *statsHistory) bucketAt(startMs int64) *common.StatsBucket {
+	hist.advance(startMs)
+	hist.current()
+	for i := len(hist.buckets) - 1; i >= 0; i-- {
+		if hist.buckets[i].StartMs <= startMs {
+			return &hist.buckets[i]
+		}
+	}
+	return nil
+}
+
+func (hist *statsHistory) append(startMs int64, complete bool) {
+	if len(hist.buckets) == hist.maxBuckets {
+		copy(hist.buckets, hist.buckets[1:])
+		hist.buckets = hist.buckets[:len(hist.buckets)-1]
+	}
+	hist.buckets = append(hist.buckets, common.StatsBucket{
+		StartMs:  startMs,
+		EndMs:    startMs + hist.bucketMs,
+		Complete: complete,
+	})
+}
+
+// Get a copy of the buckets, oldest first.  The MetricsSink lock must be
+// held.
+func (hist *statsHistory) get() []common.StatsBucket {
+	hist.current()
+	buckets := make([]common.StatsBucket, len(hist.buckets))
+	copy(buckets, hist.buckets)
+	return buckets
+}
+
+// Rotate the history buckets on each heartbeat from the given heartbeater.
+func (msink *MetricsSink) StartHistoryRotation(hb *Heartbeater) {
+	msink.histHeartbeats = make(chan interface{}, 1)
+	msink.histExited.Add(1)
+	go func() {
+		defer msink.histExited.Done()
+		for {
+			_, isOpen := <-msink.histHeartbeats
+			if !isOpen {
+				return
+			}
+			msink.RotateHistory()
+		}
+	}()
+	hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "metricsHistory",
+		targetChan: msink.histHeartbeats,
+	})
+}
+
+// Stop rotating the history buckets.  The heartbeater must already have been
+// shut down.
+func (msink *MetricsSink) StopHistoryRotation() {
+	if msink.histHeartbeats == nil {
+		return
+	}
+	close(msink.histHeartbeats)
+	msink.histExited.Wait()
+	msink.histHeartbeats = nil
+}
+
+// Merge any pending updates, and rotate the history buckets.
+func (msink *MetricsSink) RotateHistory() {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	msink.history.current()
+}
+
+// Get the ingest counter history, oldest bucket first.
+func (msink *MetricsSink) GetHistory() []common.StatsBucket {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	return msink.history.get()
+}
+
+// Replace the clock which the history uses.  Pending updates are merged
+// first, and every stripe is locked, since updates read the clock without
+// taking the sink lock.  This is used by tests.
+func (msink *MetricsSink) setHistoryClock(nowMs func() int64) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	for i := range msink.stripes {
+		msink.stripes[i].lock.Lock()
+	}
+	msink.history.nowMs = nowMs
+	for i := range msink.stripes {
+		msink.stripes[i].lock.Unlock()
+	}
+}
+
+// Update the number of bytes of span data received.
+func (msink *MetricsSink) UpdateBytesReceived(numBytes int) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.history.current().BytesReceived += uint64(numBytes)
+}
@@ -0,0 +1,168 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync/atomic"
+	"testing"
+)
+
+// Describe the start times and completeness of some buckets.
+type expectedBucket struct {
+	startMs  int64
+	complete bool
+}
+
+func expectBuckets(t *testing.T, buckets []common.StatsBucket,
+	expected []expectedBucket) {
+	if len(buckets) != len(expected) {
+		t.Fatalf("Expected %d bucket(s), but got %s\n", len(expected),
+			asJson(buckets))
+	}
+	for i := range expected {
+		if buckets[i].StartMs != expected[i].startMs ||
+			buckets[i].EndMs != expected[i].startMs+1000 ||
+			buckets[i].Complete != expected[i].complete {
+			t.Fatalf("Expected bucket %d to start at %d with complete = %t, "+
+				"but got %s\n", i, expected[i].startMs, expected[i].complete,
+				asJson(buckets))
+		}
+	}
+}
+
+func TestStatsHistoryRotation(t *testing.T) {
+	t.Parallel()
+	cnf, err := (&conf.Builder{Values: map[string]string{
+		conf.HTRACE_METRICS_HISTORY_BUCKETS:   "4",
+		conf.HTRACE_METRICS_HISTORY_BUCKET_MS: "1000",
+	}, Defaults: conf.DEFAULTS}).Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
+	}
+	hist := newStatsHistory(cnf)
+	var nowMs int64
+	hist.nowMs = func() int64 { return nowMs }
+
+	nowMs = 5500
+	hist.current().IngestedSpans = 1
+	expectBuckets(t, hist.get(), []expectedBucket{{5000, false}})
+
+	// Updates in the same period go to the same bucket.
+	nowMs = 5999
+	hist.current().IngestedSpans++
+	buckets := hist.get()
+	if buckets[0].IngestedSpans != 2 {
+		t.Fatalf("Expected 2 ingested spans, but got %s\n", asJson(buckets))
+	}
+
+	// Skipped periods produce empty buckets.
+	nowMs = 8000
+	hist.current().IngestedSpans = 3
+	buckets = hist.get()
+	expectBuckets(t, buckets, []expectedBucket{{5000, true}, {6000, true},
+		{7000, true}, {8000, false}})
+	if buckets[1].IngestedSpans != 0 || buckets[2].IngestedSpans != 0 ||
+		buckets[3].IngestedSpans != 3 {
+		t.Fatalf("Unexpected buckets %s\n", asJson(buckets))
+	}
+
+	// If the clock goes backwards, we keep using the current bucket.
+	nowMs = 7500
+	hist.current().IngestedSpans++
+	buckets = hist.get()
+	if len(buckets) != 4 || buckets[3].IngestedSpans != 4 {
+		t.Fatalf("Unexpected buckets %s\n", asJson(buckets))
+	}
+
+	// Only the newest buckets are kept, even after a long gap.
+	nowMs = 1000000
+	expectBuckets(t, hist.get(), []expectedBucket{{997000, true},
+		{998000, true}, {999000, true}, {1000000, false}})
+}
+
+func TestStatsHistoryEndpoint(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestStatsHistoryEndpoint",
+		Cnf: map[string]string{
+			conf.HTRACE_METRICS_HISTORY_BUCKET_MS: "1000",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Drive the history with an artificial clock.
+	var nowMs int64 = 10000
+	msink := ht.Store.msink
+	msink.setHistoryClock(func() int64 { return atomic.LoadInt64(&nowMs) })
+	msink.lock.Lock()
+	msink.history.buckets = msink.history.buckets[:0]
+	msink.lock.Unlock()
+
+	spans := createRandomTestSpans(10)
+	ingestSpans(ht, spans[0:3])
+	atomic.StoreInt64(&nowMs, 11500)
+	ingestSpans(ht, spans[3:8])
+	atomic.StoreInt64(&nowMs, 14200)
+	ingestSpans(ht, spans[8:10])
+
+	buckets, err := hcl.GetStatsHistory()
+	if err != nil {
+		t.Fatalf("GetStatsHistory failed: %s\n", err.Error())
+	}
+	expectBuckets(t, buckets, []expectedBucket{{10000, true}, {11000, true},
+		{12000, true}, {13000, true}, {14000, false}})
+	expectedSpans := []uint64{3, 5, 0, 0, 2}
+	for i := range buckets {
+		if buckets[i].IngestedSpans != expectedSpans[i] ||
+			buckets[i].WrittenSpans != expectedSpans[i] ||
+			buckets[i].ServerDroppedSpans != 0 {
+			t.Fatalf("Expected bucket %d to have %d span(s), but got %s\n",
+				i, expectedSpans[i], asJson(buckets))
+		}
+	}
+
+	// Spans written by a client are counted, along with their bytes.
+	atomic.StoreInt64(&nowMs, 15000)
+	err = hcl.WriteSpans(createRandomTestSpans(4))
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	buckets, err = hcl.GetStatsHistory()
+	if err != nil {
+		t.Fatalf("GetStatsHistory failed: %s\n", err.Error())
+	}
+	last := buckets[len(buckets)-1]
+	if last.StartMs != 15000 || last.IngestedSpans != 4 ||
+		last.BytesReceived == 0 {
+		t.Fatalf("Unexpected current bucket %s\n", asJson(last))
+	}
+}
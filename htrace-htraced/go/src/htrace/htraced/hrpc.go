@@ -30,6 +30,7 @@ import (
 	"htrace/common"
 	"htrace/conf"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/rpc"
 	"sync"
@@ -43,6 +44,9 @@ const MAX_HRPC_HANDLERS = 32765
 type HrpcHandler struct {
 	lg    *common.Logger
 	store *dataStore
+
+	// The test hooks to use, or nil during normal operation.
+	testHooks *hrpcTestHooks
 }
 
 // The HRPC server
@@ -66,14 +70,34 @@ type HrpcServer struct {
 
 	// The I/O timeout to use when reading requests or sending responses.  This
 	// timeout does not apply to the time we spend processing the message.
+	// Accessed via sync/atomic, since it can be changed by a configuration
+	// reload.
 	ioTimeo time.Duration
 
+	// How long we will wait for a client to start sending the next request
+	// before closing the connection.  Accessed via sync/atomic, since it can
+	// be changed by a configuration reload.
+	idleTimeo time.Duration
+
+	// The maximum number of connections we will keep open at once.
+	maxConns int64
+
+	// The largest request body we accept.  Bigger requests are skipped and
+	// answered with ERR_MESSAGE_TOO_LARGE.
+	maxMsgBytes uint32
+
+	// The metrics sink we update connection metrics in.
+	msink *MetricsSink
+
 	// A count of all I/O errors that we have encountered since the server
 	// started.  This counts errors like improperly formatted message frames,
 	// but not errors like properly formatted but invalid messages.
 	// This count is updated from multiple goroutines via sync/atomic.
 	ioErrorCount uint64
 
+	// The methods which the server supports.
+	methods common.HrpcMethodSet
+
 	// The test hooks to use, or nil during normal operation.
 	testHooks *hrpcTestHooks
 }
@@ -82,6 +106,24 @@ type hrpcTestHooks struct {
 	// A callback we make right after calling Accept() but before reading from
 	// the new connection.
 	HandleAdmission func()
+
+	// Methods which the server pretends not to support, to simulate an older
+	// server.
+	MaskMethods common.HrpcMethodSet
+
+	// If true, the server closes the connection when it gets a request for a
+	// method it doesn't support, like version 0 servers did.
+	CloseOnUnsupported bool
+
+	// If positive, the server closes each connection once it has read this
+	// many requests from it, without answering any requests which the
+	// client sent after those.
+	CloseAfterRequests int
+
+	// A callback we make before answering each WriteSpans request which
+	// succeeded.  Each request is answered on its own goroutine, so delaying
+	// here delays only this response.
+	HandleWriteSpansResponse func()
 }
 
 // A codec which encodes HRPC data via JSON.  This structure holds the context
@@ -98,8 +140,52 @@ type HrpcServerCodec struct {
 	// The message length we read from the header.
 	length uint32
 
-	// The number of messages this connection has handled.
-	numHandled int
+	// The sequence number we read from the header.
+	seq uint64
+
+	// The method ID we read from the header.
+	methodId uint32
+
+	// The methods which the client may call on this connection.  This starts
+	// out as all the methods the server supports, and is narrowed down to
+	// the methods which both sides support when the client sends a Hello.
+	methods common.HrpcMethodSet
+
+	// Protects quotaResps and unsupported.
+	respLock sync.Mutex
+
+	// Maps request sequence numbers to the quota drops to report in the
+	// WriteSpansResp.  net/rpc creates the response object only after
+	// ReadRequestBody returns, and may read the next request before writing
+	// the response, so we can't fill it in directly.
+	quotaResps map[uint64]common.WriteSpansResp
+
+	// Maps the sequence numbers of requests for methods which the client may
+	// not call to their method IDs.  net/rpc answers these requests with a
+	// generic error, which we replace with ERR_UNSUPPORTED_METHOD when
+	// writing the response.
+	unsupported map[uint64]uint32
+
+	// Maps the sequence numbers of requests which were too big to the
+	// requests' headers.  Like unsupported requests, net/rpc skips their
+	// bodies, and we replace the generic error it sends back.
+	oversized map[uint64]common.HrpcRequestHeader
+
+	// The buffer for reading request headers.
+	hdrBuf []byte
+
+	// True if we failed to read a request body.  Once this happens, we can no
+	// longer find the start of the next request, so the connection must be
+	// closed.
+	bodyFailed bool
+
+	// The number of messages this connection has handled.  Accessed via
+	// sync/atomic, since responses are written on other goroutines while the
+	// next request is read.
+	numHandled int64
+
+	// The number of request headers this connection has read.
+	numRead int
 
 	// The buffer for reading requests.  These buffers are reused for multiple
 	// requests to avoid allocating memory.
@@ -131,40 +217,128 @@ func newIoError(cdc *HrpcServerCodec, val string, level common.Level) error {
 	return errors.New(val)
 }
 
+// Note that the client sent a request frame we can't parse.  We can't find
+// the start of the next request after this, so the connection is closed.
+func newMalformedFrameError(cdc *HrpcServerCodec, val string) error {
+	atomic.AddUint64(&cdc.hsv.msink.HrpcMalformedFrames, 1)
+	return newIoErrorWarn(cdc, val)
+}
+
+// Returns true if the error is the result of an I/O deadline passing.
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+// Note that an I/O error occurred.  If it was caused by a deadline passing,
+// we count it as a deadline abort.
+func (cdc *HrpcServerCodec) checkDeadlineAbort(err error) {
+	if isTimeout(err) {
+		atomic.AddUint64(&cdc.hsv.msink.HrpcDeadlineAborts, 1)
+	}
+}
+
 func (cdc *HrpcServerCodec) ReadRequestHeader(req *rpc.Request) error {
 	hdr := common.HrpcRequestHeader{}
 	if cdc.lg.TraceEnabled() {
 		cdc.lg.Tracef("%s: Reading HRPC request header.\n", cdc.conn.RemoteAddr())
 	}
-	cdc.conn.SetDeadline(time.Now().Add(cdc.hsv.ioTimeo))
-	err := binary.Read(cdc.conn, binary.LittleEndian, &hdr)
+	if cdc.bodyFailed {
+		return newIoError(cdc, "Closing connection after failing to read "+
+			"the previous request body", common.DEBUG)
+	}
+	// Wait for the client to start sending the next request.  If it doesn't
+	// do so within the idle timeout, close the connection.  This prevents
+	// clients which have gone away without closing their connections from
+	// using up our file descriptors.
+	//
+	// Clients which pipeline their requests may send the next request while
+	// we are still writing the response to the last one, so reads and writes
+	// have separate deadlines.
+	cdc.conn.SetReadDeadline(time.Now().Add(cdc.hsv.getIdleTimeo()))
+	_, err := io.ReadFull(cdc.conn, cdc.hdrBuf[0:1])
 	if err != nil {
-		if err == io.EOF && cdc.numHandled > 0 {
+		numHandled := atomic.LoadInt64(&cdc.numHandled)
+		if err == io.EOF && numHandled > 0 {
 			return newIoError(cdc, fmt.Sprintf("Remote closed connection "+
-				"after writing %d message(s)", cdc.numHandled), common.DEBUG)
+				"after writing %d message(s)", numHandled), common.DEBUG)
+		}
+		if isTimeout(err) {
+			atomic.AddUint64(&cdc.hsv.msink.HrpcIdleCloses, 1)
+			return newIoError(cdc, fmt.Sprintf("Closing connection which "+
+				"was idle for %s after %d message(s)", cdc.hsv.getIdleTimeo(),
+				numHandled), common.DEBUG)
 		}
 		return newIoError(cdc,
 			fmt.Sprintf("Error reading request header: %s", err.Error()), common.WARN)
 	}
+	if cdc.hsv.hand.store.faults.CloseHrpcConn() {
+		return newIoError(cdc, "Chaos mode closed the connection early",
+			common.DEBUG)
+	}
+	hooks := cdc.hsv.testHooks
+	if hooks != nil && hooks.CloseAfterRequests > 0 &&
+		cdc.numRead >= hooks.CloseAfterRequests {
+		return newIoError(cdc, fmt.Sprintf("Test hooks closed the "+
+			"connection after %d request(s)", cdc.numRead), common.DEBUG)
+	}
+	cdc.numRead++
+	// Once the client has started sending the request, it must finish within
+	// the I/O timeout.
+	cdc.conn.SetReadDeadline(time.Now().Add(cdc.hsv.getIoTimeo()))
+	_, err = io.ReadFull(cdc.conn, cdc.hdrBuf[1:])
+	if err != nil {
+		cdc.checkDeadlineAbort(err)
+		return newIoError(cdc,
+			fmt.Sprintf("Error reading request header: %s", err.Error()), common.WARN)
+	}
+	err = binary.Read(bytes.NewReader(cdc.hdrBuf), binary.LittleEndian, &hdr)
+	if err != nil {
+		return newMalformedFrameError(cdc,
+			fmt.Sprintf("Error decoding request header: %s", err.Error()))
+	}
 	if cdc.lg.TraceEnabled() {
 		cdc.lg.Tracef("%s: Read HRPC request header %s\n",
 			cdc.conn.RemoteAddr(), asJson(&hdr))
 	}
 	if hdr.Magic != common.HRPC_MAGIC {
-		return newIoErrorWarn(cdc, fmt.Sprintf("Invalid request header: expected "+
-			"magic number of 0x%04x, but got 0x%04x", common.HRPC_MAGIC, hdr.Magic))
-	}
-	if hdr.Length > common.MAX_HRPC_BODY_LENGTH {
-		return newIoErrorWarn(cdc, fmt.Sprintf("Length prefix was too long.  "+
-			"Maximum length is %d, but we got %d.", common.MAX_HRPC_BODY_LENGTH,
-			hdr.Length))
+		return newMalformedFrameError(cdc, fmt.Sprintf("Invalid request "+
+			"header: expected magic number of 0x%04x, but got 0x%04x",
+			common.HRPC_MAGIC, hdr.Magic))
 	}
 	req.ServiceMethod = common.HrpcMethodIdToMethodName(hdr.MethodId)
-	if req.ServiceMethod == "" {
-		return newIoErrorWarn(cdc, fmt.Sprintf("Unknown MethodID code 0x%04x",
-			hdr.MethodId))
+	if hdr.Length > cdc.hsv.maxMsgBytes {
+		// net/rpc will skip the request body, and we will send back an
+		// error which says how big a request may be.  The connection stays
+		// usable.  The I/O timeout still applies, so a client which claims
+		// a huge length can't tie up the connection for long.
+		atomic.AddUint64(&cdc.hsv.msink.HrpcOversizedMessages, 1)
+		cdc.lg.Warnf("%s: Rejecting %d-byte request for MethodID code "+
+			"0x%04x, because the limit is %d bytes.\n", cdc.conn.RemoteAddr(),
+			hdr.Length, hdr.MethodId, cdc.hsv.maxMsgBytes)
+		req.ServiceMethod = "HrpcHandler.oversized"
+		cdc.respLock.Lock()
+		cdc.oversized[hdr.Seq] = hdr
+		cdc.respLock.Unlock()
+	} else if req.ServiceMethod == "" || !cdc.methods.Contains(hdr.MethodId) {
+		if hooks != nil && hooks.CloseOnUnsupported {
+			return newIoErrorWarn(cdc, fmt.Sprintf("Unknown MethodID "+
+				"code 0x%04x", hdr.MethodId))
+		}
+		// net/rpc can't find this method, so it will skip the request body
+		// and send back an error.  The connection stays usable.
+		if cdc.lg.DebugEnabled() {
+			cdc.lg.Debugf("%s: Rejecting request for unsupported MethodID "+
+				"code 0x%04x\n", cdc.conn.RemoteAddr(), hdr.MethodId)
+		}
+		req.ServiceMethod = "HrpcHandler.unsupported"
+		cdc.respLock.Lock()
+		cdc.unsupported[hdr.Seq] = hdr.MethodId
+		cdc.respLock.Unlock()
 	}
 	req.Seq = hdr.Seq
+	cdc.seq = hdr.Seq
+	cdc.methodId = hdr.MethodId
 	cdc.length = hdr.Length
 	return nil
 }
@@ -175,6 +349,22 @@ func (cdc *HrpcServerCodec) ReadRequestBody(body interface{}) error {
 		cdc.lg.Tracef("%s: Reading HRPC %d-byte request body.\n",
 			remoteAddr, cdc.length)
 	}
+	var zeroTime time.Time
+	if body == nil {
+		// net/rpc is skipping the body of a request it can't handle.  This
+		// may be a request which is too big to buffer, so we discard it as we
+		// read it.
+		_, err := io.CopyN(ioutil.Discard, cdc.conn, int64(cdc.length))
+		if err != nil {
+			cdc.bodyFailed = true
+			cdc.checkDeadlineAbort(err)
+			return newIoErrorWarn(cdc, fmt.Sprintf("Failed to skip %d-byte "+
+				"request body: %s", cdc.length, err.Error()))
+		}
+		cdc.conn.SetReadDeadline(zeroTime)
+		cdc.hsv.msink.UpdateBytesReceived(int(cdc.length))
+		return nil
+	}
 	if cap(cdc.buf) < int(cdc.length) {
 		var pow uint
 		for pow = 0; (1 << pow) < int(cdc.length); pow++ {
@@ -183,11 +373,13 @@ func (cdc *HrpcServerCodec) ReadRequestBody(body interface{}) error {
 	}
 	_, err := io.ReadFull(cdc.conn, cdc.buf[:cdc.length])
 	if err != nil {
+		cdc.bodyFailed = true
+		cdc.checkDeadlineAbort(err)
 		return newIoErrorWarn(cdc, fmt.Sprintf("Failed to read %d-byte "+
 			"request body: %s", cdc.length, err.Error()))
 	}
-	var zeroTime time.Time
-	cdc.conn.SetDeadline(zeroTime)
+	cdc.conn.SetReadDeadline(zeroTime)
+	cdc.hsv.msink.UpdateBytesReceived(int(cdc.length))
 
 	dec := codec.NewDecoderBytes(cdc.buf[:cdc.length], &cdc.msgpackHandle)
 	err = dec.Decode(body)
@@ -195,39 +387,132 @@ func (cdc *HrpcServerCodec) ReadRequestBody(body interface{}) error {
 		cdc.lg.Tracef("%s: read HRPC message: %s\n",
 			remoteAddr, asJson(&body))
 	}
+	if cdc.methodId == common.METHOD_ID_HELLO {
+		if err != nil {
+			return newIoErrorWarn(cdc, fmt.Sprintf("Failed to decode "+
+				"Hello request: %s", err.Error()))
+		}
+		hello := body.(*common.HrpcHelloReq)
+		cdc.methods = cdc.hsv.methods & (hello.Methods |
+			1<<common.METHOD_ID_HELLO)
+		if cdc.lg.DebugEnabled() {
+			cdc.lg.Debugf("%s: Negotiated HRPC methods %s with a version "+
+				"%d client.\n", remoteAddr, asJson(cdc.methods.Names()),
+				hello.ProtocolVersion)
+		}
+		return nil
+	}
 	req := body.(*common.WriteSpansReq)
 	if req == nil {
 		return nil
 	}
+	hand := cdc.hsv.hand
+	principal, err := hand.store.auth.check(remoteAddr, req.AuthToken,
+		common.PERM_WRITE)
+	if err != nil {
+		return err
+	}
+	if hand.store.readOnly {
+		// net/rpc sends the error string back, so the client can recover the
+		// code with common.ParseHtraceError.
+		return common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't write spans: this server is read-only.")
+	}
+	if herr := hand.store.pause.check(); herr != nil {
+		return herr
+	}
+	if hand.store.faults.RejectWriteSpans() {
+		return common.NewHtraceError(common.ERR_INTERNAL, nil,
+			"Chaos mode rejected this WriteSpans request.")
+	}
+	herr := hand.store.checkWriteSize(req.NumSpans, int64(cdc.length))
+	if herr != nil {
+		return herr
+	}
 	// We decode WriteSpans requests in a streaming fashion, to avoid overloading the garbage
 	// collector with a ton of trace spans all at once.
 	startTime := time.Now()
-	client, _, err := net.SplitHostPort(remoteAddr)
+	client, err := remoteHost(remoteAddr)
 	if err != nil {
 		return newIoErrorWarn(cdc, fmt.Sprintf("Failed to split host and port "+
 			"for %s: %s\n", remoteAddr, err.Error()))
 	}
-	hand := cdc.hsv.hand
 	ing := hand.store.NewSpanIngestor(hand.lg, client, req.DefaultTrid)
+	ing.EnableAudit(AUDIT_TRANSPORT_HRPC, req.Metadata)
+	ing.SetTransport(AUDIT_TRANSPORT_HRPC)
+	ing.SetPrincipal(principal)
+	ing.SetWriteGroups(req.Groups)
 	for spanIdx := 0; spanIdx < req.NumSpans; spanIdx++ {
 		var span *common.Span
 		err := dec.Decode(&span)
 		if err != nil {
-			return newIoErrorWarn(cdc, fmt.Sprintf("Failed to decode span %d "+
-				"out of %d: %s\n", spanIdx, req.NumSpans, err.Error()))
+			// We can't tell where the span that failed to decode starts, so
+			// we keep the whole request body.
+			hand.store.rejections.recordBytes(common.REJECT_REASON_DECODE,
+				client, AUDIT_TRANSPORT_HRPC, fmt.Sprintf("Failed to decode "+
+					"span %d out of %d: %s", spanIdx, req.NumSpans,
+					err.Error()), cdc.buf[:cdc.length])
+			// Repeated decoding errors from the same client are suppressed.
+			hand.store.ingestLog.Warnf(client, "%s: Failed to decode span %d "+
+				"out of %d: %s\n", remoteAddr, spanIdx, req.NumSpans, err.Error())
+			atomic.AddUint64(&cdc.hsv.ioErrorCount, 1)
+			return errors.New(fmt.Sprintf("Failed to decode span %d out of "+
+				"%d: %s", spanIdx, req.NumSpans, err.Error()))
 		}
 		ing.IngestSpan(span)
 	}
 	ing.Close(startTime)
+	var quotaResp common.WriteSpansResp
+	quotaResp.QuotaRejected, quotaResp.QuotaSampledOut = ing.QuotaDropped()
+	if quotaResp.QuotaRejected > 0 || quotaResp.QuotaSampledOut > 0 {
+		cdc.respLock.Lock()
+		cdc.quotaResps[cdc.seq] = quotaResp
+		cdc.respLock.Unlock()
+	}
 	return nil
 }
 
 var EMPTY []byte = make([]byte, 0)
 
 func (cdc *HrpcServerCodec) WriteResponse(resp *rpc.Response, msg interface{}) error {
-	cdc.conn.SetDeadline(time.Now().Add(cdc.hsv.ioTimeo))
+	cdc.conn.SetWriteDeadline(time.Now().Add(cdc.hsv.getIoTimeo()))
 	var err error
 	buf := EMPTY
+	methodId := common.HrpcMethodNameToId(resp.ServiceMethod)
+	if wresp, ok := msg.(*common.WriteSpansResp); ok && wresp != nil {
+		cdc.respLock.Lock()
+		if quotaResp, present := cdc.quotaResps[resp.Seq]; present {
+			*wresp = quotaResp
+			delete(cdc.quotaResps, resp.Seq)
+		}
+		cdc.respLock.Unlock()
+	}
+	if hresp, ok := msg.(*common.HrpcHelloResp); ok && hresp != nil {
+		hresp.ProtocolVersion = common.HRPC_PROTOCOL_VERSION
+		hresp.Methods = cdc.hsv.methods
+		hresp.MaxInFlight = common.HRPC_MAX_IN_FLIGHT
+	}
+	cdc.respLock.Lock()
+	unsupportedId, unsupported := cdc.unsupported[resp.Seq]
+	delete(cdc.unsupported, resp.Seq)
+	cdc.respLock.Unlock()
+	if unsupported {
+		methodId = unsupportedId
+		resp.Error = common.NewHtraceError(common.ERR_UNSUPPORTED_METHOD, nil,
+			"MethodID code 0x%04x is not supported on this connection.",
+			unsupportedId).Error()
+	}
+	cdc.respLock.Lock()
+	oversizedHdr, oversized := cdc.oversized[resp.Seq]
+	delete(cdc.oversized, resp.Seq)
+	cdc.respLock.Unlock()
+	if oversized {
+		methodId = oversizedHdr.MethodId
+		resp.Error = common.NewHtraceError(common.ERR_MESSAGE_TOO_LARGE, nil,
+			"The request body is %d bytes long, but the limit is %d bytes.  "+
+				"Split the spans into several requests.", oversizedHdr.Length,
+			cdc.hsv.maxMsgBytes).Error()
+	}
 	if msg != nil {
 		w := bytes.NewBuffer(make([]byte, 0, 128))
 		enc := codec.NewEncoder(w, &cdc.msgpackHandle)
@@ -239,13 +524,14 @@ func (cdc *HrpcServerCodec) WriteResponse(resp *rpc.Response, msg interface{}) e
 		buf = w.Bytes()
 	}
 	hdr := common.HrpcResponseHeader{}
-	hdr.MethodId = common.HrpcMethodNameToId(resp.ServiceMethod)
+	hdr.MethodId = methodId
 	hdr.Seq = resp.Seq
 	hdr.ErrLength = uint32(len(resp.Error))
 	hdr.Length = uint32(len(buf))
 	writer := bufio.NewWriterSize(cdc.conn, 256)
 	err = binary.Write(writer, binary.LittleEndian, &hdr)
 	if err != nil {
+		cdc.checkDeadlineAbort(err)
 		return newIoErrorWarn(cdc, fmt.Sprintf("Failed to write response "+
 			"header: %s", err.Error()))
 	}
@@ -264,16 +550,17 @@ func (cdc *HrpcServerCodec) WriteResponse(resp *rpc.Response, msg interface{}) e
 				"message: %s", err.Error()))
 		}
 		if uint32(length) != hdr.Length {
-			return newIoErrorWarn(cdc, fmt.Sprintf("Failed to write all of "+
-				"response message: %s", err.Error()))
+			return newIoErrorWarn(cdc, fmt.Sprintf("Only wrote %d out of "+
+				"%d bytes of the response message", length, hdr.Length))
 		}
 	}
 	err = writer.Flush()
 	if err != nil {
+		cdc.checkDeadlineAbort(err)
 		return newIoErrorWarn(cdc, fmt.Sprintf("Failed to write the response "+
 			"bytes: %s", err.Error()))
 	}
-	cdc.numHandled++
+	atomic.AddInt64(&cdc.numHandled, 1)
 	return nil
 }
 
@@ -282,6 +569,14 @@ func (cdc *HrpcServerCodec) Close() error {
 	cdc.conn = nil
 	cdc.length = 0
 	cdc.numHandled = 0
+	cdc.numRead = 0
+	cdc.bodyFailed = false
+	cdc.respLock.Lock()
+	cdc.quotaResps = make(map[uint64]common.WriteSpansResp)
+	cdc.unsupported = make(map[uint64]uint32)
+	cdc.oversized = make(map[uint64]common.HrpcRequestHeader)
+	cdc.respLock.Unlock()
+	atomic.AddInt64(&cdc.hsv.msink.HrpcOpenConnections, -1)
 	cdc.hsv.cdcs <- cdc
 	return err
 }
@@ -289,6 +584,16 @@ func (cdc *HrpcServerCodec) Close() error {
 func (hand *HrpcHandler) WriteSpans(req *common.WriteSpansReq,
 	resp *common.WriteSpansResp) (err error) {
 	// Nothing to do here; WriteSpans is handled in ReadRequestBody.
+	if hand.testHooks != nil && hand.testHooks.HandleWriteSpansResponse != nil {
+		hand.testHooks.HandleWriteSpansResponse()
+	}
+	return nil
+}
+
+func (hand *HrpcHandler) Hello(req *common.HrpcHelloReq,
+	resp *common.HrpcHelloResp) (err error) {
+	// Nothing to do here; Hello is handled in ReadRequestBody and
+	// WriteResponse.
 	return nil
 }
 
@@ -308,35 +613,79 @@ func CreateHrpcServer(cnf *conf.Config, store *dataStore,
 	hsv := &HrpcServer{
 		Server: rpc.NewServer(),
 		hand: &HrpcHandler{
-			lg:    lg,
-			store: store,
+			lg:        lg,
+			store:     store,
+			testHooks: testHooks,
 		},
 		cdcs:     make(chan *HrpcServerCodec, numHandlers),
 		shutdown: make(chan interface{}),
 		ioTimeo: time.Millisecond *
 			time.Duration(cnf.GetInt64(conf.HTRACE_HRPC_IO_TIMEOUT_MS)),
+		idleTimeo: time.Millisecond *
+			time.Duration(cnf.GetInt64(conf.HTRACE_HRPC_IDLE_TIMEOUT_MS)),
+		maxConns:  cnf.GetInt64(conf.HTRACE_HRPC_MAX_CONNECTIONS),
+		msink:     store.msink,
+		methods:   common.HRPC_ALL_METHODS,
 		testHooks: testHooks,
 	}
+	if testHooks != nil {
+		hsv.methods &^= testHooks.MaskMethods
+	}
+	maxMsgBytes := cnf.GetInt64(conf.HTRACE_HRPC_MAX_MESSAGE_BYTES)
+	if maxMsgBytes <= 0 || maxMsgBytes > common.MAX_HRPC_BODY_LENGTH {
+		lg.Warnf("%s must be between 1 and %d: using %d.\n",
+			conf.HTRACE_HRPC_MAX_MESSAGE_BYTES, common.MAX_HRPC_BODY_LENGTH,
+			common.MAX_HRPC_BODY_LENGTH)
+		maxMsgBytes = common.MAX_HRPC_BODY_LENGTH
+	}
+	hsv.maxMsgBytes = uint32(maxMsgBytes)
+	if hsv.maxConns < int64(numHandlers) {
+		lg.Warnf("%s cannot be less than %s: using %d connections.\n",
+			conf.HTRACE_HRPC_MAX_CONNECTIONS, conf.HTRACE_NUM_HRPC_HANDLERS,
+			numHandlers)
+		hsv.maxConns = int64(numHandlers)
+	}
+	hdrLen := binary.Size(&common.HrpcRequestHeader{})
 	for i := 0; i < numHandlers; i++ {
 		hsv.cdcs <- &HrpcServerCodec{
-			lg:  lg,
-			hsv: hsv,
+			lg:          lg,
+			hsv:         hsv,
+			hdrBuf:      make([]byte, hdrLen),
+			quotaResps:  make(map[uint64]common.WriteSpansResp),
+			unsupported: make(map[uint64]uint32),
+			oversized:   make(map[uint64]common.HrpcRequestHeader),
 			msgpackHandle: codec.MsgpackHandle{
 				WriteExt: true,
 			},
 		}
 	}
-	var err error
-	hsv.listener, err = net.Listen("tcp", cnf.Get(conf.HTRACE_HRPC_ADDRESS))
+	_, addr, err := getListenAddresses(cnf)
+	if err != nil {
+		return nil, err
+	}
+	if addr == "" {
+		return nil, errors.New(fmt.Sprintf("No value was given for %s.",
+			conf.HTRACE_HRPC_ADDRESS))
+	}
+	var removedStale bool
+	hsv.listener, removedStale, err = listenOn(cnf, addr)
 	if err != nil {
 		return nil, err
 	}
+	if removedStale {
+		lg.Warnf("Removed the stale HRPC socket %s.\n", addr)
+	}
 	hsv.Server.Register(hsv.hand)
+	atomic.StoreUint64(&store.hrpcMethods, uint64(hsv.methods))
+	store.hrpcAddr.Store(hsv.listener.Addr().String())
 	hsv.exited.Add(1)
 	go hsv.run()
 	lg.Infof("Started HRPC server on %s with %d handler routines. "+
-		"ioTimeo=%s.\n", hsv.listener.Addr().String(), numHandlers,
-		hsv.ioTimeo.String())
+		"ioTimeo=%s, idleTimeo=%s, maxConns=%d, maxMsgBytes=%d, "+
+		"methods=%s.\n", describeListenAddr(hsv.listener.Addr()), numHandlers,
+		hsv.getIoTimeo().String(),
+		hsv.getIdleTimeo().String(), hsv.maxConns, hsv.maxMsgBytes,
+		asJson(hsv.methods.Names()))
 	return hsv, nil
 }
 
@@ -348,26 +697,48 @@ func (hsv *HrpcServer) run() {
 		hsv.exited.Done()
 	}()
 	for {
-		select {
-		case cdc := <-hsv.cdcs:
-			conn, err := hsv.listener.Accept()
-			if err != nil {
-				lg.Errorf("HrpcServer on %s got accept error: %s\n", srvAddr, err.Error())
-				hsv.cdcs <- cdc // never blocks; there is always sufficient buffer space
-				continue
-			}
-			if lg.TraceEnabled() {
-				lg.Tracef("%s: Accepted HRPC connection.\n", conn.RemoteAddr())
-			}
-			cdc.conn = conn
-			cdc.numHandled = 0
-			if hsv.testHooks != nil && hsv.testHooks.HandleAdmission != nil {
-				hsv.testHooks.HandleAdmission()
+		conn, err := hsv.listener.Accept()
+		if err != nil {
+			select {
+			case <-hsv.shutdown:
+				return
+			default:
 			}
-			go hsv.ServeCodec(cdc)
-		case <-hsv.shutdown:
-			return
+			lg.Errorf("HrpcServer on %s got accept error: %s\n", srvAddr, err.Error())
+			continue
+		}
+		if lg.TraceEnabled() {
+			lg.Tracef("%s: Accepted HRPC connection.\n", conn.RemoteAddr())
+		}
+		// Reject the connection right away if we have too many open.
+		if atomic.AddInt64(&hsv.msink.HrpcOpenConnections, 1) > hsv.maxConns {
+			atomic.AddInt64(&hsv.msink.HrpcOpenConnections, -1)
+			atomic.AddUint64(&hsv.msink.HrpcAcceptRejections, 1)
+			lg.Warnf("%s: Rejecting HRPC connection because there are "+
+				"already %d connections open.\n", conn.RemoteAddr(), hsv.maxConns)
+			conn.Close()
+			continue
 		}
+		go hsv.admit(conn)
+	}
+}
+
+// Wait for a codec to become available, and then serve the connection with it.
+// The number of codecs limits how many connections we serve at once.
+func (hsv *HrpcServer) admit(conn net.Conn) {
+	select {
+	case cdc := <-hsv.cdcs:
+		cdc.conn = conn
+		cdc.numHandled = 0
+		cdc.numRead = 0
+		cdc.methods = hsv.methods
+		if hsv.testHooks != nil && hsv.testHooks.HandleAdmission != nil {
+			hsv.testHooks.HandleAdmission()
+		}
+		hsv.ServeCodec(cdc)
+	case <-hsv.shutdown:
+		atomic.AddInt64(&hsv.msink.HrpcOpenConnections, -1)
+		conn.Close()
 	}
 }
 
@@ -375,11 +746,29 @@ func (hsv *HrpcServer) Addr() net.Addr {
 	return hsv.listener.Addr()
 }
 
+func (hsv *HrpcServer) getIoTimeo() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&hsv.ioTimeo)))
+}
+
+func (hsv *HrpcServer) setIoTimeo(timeo time.Duration) {
+	atomic.StoreInt64((*int64)(&hsv.ioTimeo), int64(timeo))
+}
+
+func (hsv *HrpcServer) getIdleTimeo() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&hsv.idleTimeo)))
+}
+
+func (hsv *HrpcServer) setIdleTimeo(timeo time.Duration) {
+	atomic.StoreInt64((*int64)(&hsv.idleTimeo), int64(timeo))
+}
+
 func (hsv *HrpcServer) GetNumIoErrors() uint64 {
 	return atomic.LoadUint64(&hsv.ioErrorCount)
 }
 
 func (hsv *HrpcServer) Close() {
+	atomic.StoreUint64(&hsv.hand.store.hrpcMethods, 0)
+	hsv.hand.store.hrpcAddr.Store("")
 	close(hsv.shutdown)
 	hsv.listener.Close()
 	hsv.exited.Wait()
@@ -0,0 +1,244 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ugorji/go/codec"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Send a Hello on a raw connection, and check that the server answers it.
+func expectRawHello(t *testing.T, conn net.Conn, seq uint64) {
+	mh := codec.MsgpackHandle{WriteExt: true}
+	var w bytes.Buffer
+	err := codec.NewEncoder(&w, &mh).Encode(&common.HrpcHelloReq{
+		ProtocolVersion: common.HRPC_PROTOCOL_VERSION,
+		Methods:         common.HRPC_ALL_METHODS,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode Hello: %s\n", err.Error())
+	}
+	hdr, errStr, _ := sendRawHrpc(t, conn, common.METHOD_ID_HELLO, seq,
+		w.Bytes())
+	if hdr.Seq != seq || errStr != "" {
+		t.Fatalf("Hello failed: %s %s\n", asJson(hdr), errStr)
+	}
+}
+
+// Check that requests bigger than hrpc.max.message.bytes are rejected with
+// ERR_MESSAGE_TOO_LARGE, without closing the connection, and that the client
+// splits writes which the server rejects this way.
+func TestHrpcOversizedMessage(t *testing.T) {
+	const MAX_MSG_BYTES = 4096
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcOversizedMessage",
+		Cnf: map[string]string{
+			conf.HTRACE_HRPC_MAX_MESSAGE_BYTES: "4096",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+
+	// The server skips the body of an oversized request, and the next
+	// request on the connection works.
+	conn, err := net.Dial("tcp", ht.Hsv.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s\n", err.Error())
+	}
+	defer conn.Close()
+	hdr, errStr, _ := sendRawHrpc(t, conn, common.METHOD_ID_WRITE_SPANS, 1,
+		make([]byte, 3*MAX_MSG_BYTES))
+	herr := common.ParseHtraceError(errStr)
+	if hdr.Seq != 1 || hdr.MethodId != common.METHOD_ID_WRITE_SPANS ||
+		herr == nil || herr.Code() != common.ERR_MESSAGE_TOO_LARGE ||
+		!strings.Contains(herr.Message, "12288 bytes long, but the limit "+
+			"is 4096 bytes") {
+		t.Fatalf("Expected an %s error, but got %s '%s'\n",
+			common.ERR_MESSAGE_TOO_LARGE, asJson(hdr), errStr)
+	}
+	expectRawHello(t, conn, 2)
+
+	// A single span which is too big fails with ERR_MESSAGE_TOO_LARGE.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(21)
+	spans[20].Description = strings.Repeat("x", 2*MAX_MSG_BYTES)
+	err = hcl.WriteSpans(spans[20:])
+	if common.ErrorCodeOf(err) != common.ERR_MESSAGE_TOO_LARGE {
+		t.Fatalf("Expected an %s error, but got %v\n",
+			common.ERR_MESSAGE_TOO_LARGE, err)
+	}
+	if mtx := hcl.Metrics(); mtx.HrpcOversizedMessages != 1 {
+		t.Fatalf("Expected 1 oversized message in the client metrics, but "+
+			"got %d\n", mtx.HrpcOversizedMessages)
+	}
+
+	// A batch which is too big is split until the pieces fit.
+	for i := 0; i < 20; i++ {
+		spans[i].Description = strings.Repeat("y", MAX_MSG_BYTES/8)
+	}
+	err = hcl.WriteSpans(spans[:20])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(20)
+	for i := 0; i < 20; i++ {
+		if ht.Store.FindSpan(spans[i].Id) == nil {
+			t.Fatalf("Failed to find span %s\n", spans[i].Id.String())
+		}
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.HrpcOversizedMessages < 3 || stats.HrpcMalformedFrames != 0 {
+		t.Fatalf("Expected at least 3 oversized messages and no malformed "+
+			"frames, but got %d and %d\n", stats.HrpcOversizedMessages,
+			stats.HrpcMalformedFrames)
+	}
+	if ht.Hsv.GetNumIoErrors() != 0 {
+		t.Fatalf("Expected no I/O errors, but got %d\n",
+			ht.Hsv.GetNumIoErrors())
+	}
+}
+
+// Check that the server closes a connection which sends garbage instead of an
+// HRPC frame, and keeps serving other connections.
+func TestHrpcMalformedFrame(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcMalformedFrame",
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	conn, err := net.Dial("tcp", ht.Hsv.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s\n", err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if err != nil {
+		t.Fatalf("failed to write garbage: %s\n", err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Minute))
+	buf := make([]byte, 1)
+	_, err = conn.Read(buf)
+	// Since the server didn't read all of the garbage, closing the
+	// connection may reset it.
+	if err == nil || isTimeout(err) {
+		t.Fatalf("Expected the server to close the connection, but got "+
+			"%v\n", err)
+	}
+	malformed := atomic.LoadUint64(&ht.Store.msink.HrpcMalformedFrames)
+	if malformed != 1 || ht.Hsv.GetNumIoErrors() != 1 {
+		t.Fatalf("Expected 1 malformed frame and 1 I/O error, but got %d "+
+			"and %d\n", malformed, ht.Hsv.GetNumIoErrors())
+	}
+
+	// Other connections still work.
+	conn2, err := net.Dial("tcp", ht.Hsv.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s\n", err.Error())
+	}
+	defer conn2.Close()
+	expectRawHello(t, conn2, 1)
+}
+
+// Check that the client gives up on a server which stalls partway through a
+// response, rather than waiting forever.
+func TestHrpcClientIoTimeout(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcClientIoTimeout",
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+
+	// This server reads each request header, sends the first byte of a
+	// response header, and then stalls.
+	lsn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s\n", err.Error())
+	}
+	var conns []net.Conn
+	var connsLock sync.Mutex
+	defer func() {
+		lsn.Close()
+		connsLock.Lock()
+		for i := range conns {
+			conns[i].Close()
+		}
+		connsLock.Unlock()
+	}()
+	go func() {
+		for {
+			conn, err := lsn.Accept()
+			if err != nil {
+				return
+			}
+			connsLock.Lock()
+			conns = append(conns, conn)
+			connsLock.Unlock()
+			go func() {
+				var hdr common.HrpcRequestHeader
+				if binary.Read(conn, binary.LittleEndian, &hdr) == nil {
+					conn.Write([]byte{0})
+				}
+			}()
+		}
+	}()
+	cnf := ht.Cnf.Clone(conf.HTRACE_WEB_ADDRESS, ht.Rsv.Addr().String(),
+		conf.HTRACE_HRPC_ADDRESS, lsn.Addr().String(),
+		conf.HTRACE_CLIENT_HRPC_IO_TIMEOUT_MS, "100")
+	hcl, err := htrace.NewClient(cnf, nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	startTime := time.Now()
+	err = hcl.WriteSpans(createRandomTestSpans(2))
+	if err == nil || !strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("Expected WriteSpans to time out, but got %v\n", err)
+	}
+	if elapsed := time.Since(startTime); elapsed > time.Minute {
+		t.Fatalf("WriteSpans took %s to time out\n", elapsed)
+	}
+}
@@ -21,6 +21,7 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/alecthomas/kingpin"
@@ -61,12 +62,21 @@ of setting configuration when launching the daemon.
 func main() {
 	// Load the htraced configuration.
 	// This also parses the -Dfoo=bar command line arguments and removes them
-	// from os.Argv.
+	// from os.Argv.  We keep a copy of the original arguments, so that they
+	// still take precedence if the configuration is reloaded.
+	reloadArgv := append([]string{}, os.Args[1:]...)
 	cnf, cnfLog := conf.LoadApplicationConfig("htraced.")
 
 	// Parse the remaining command-line arguments.
 	app := kingpin.New(os.Args[0], USAGE)
 	version := app.Command("version", "Print server version and exit.")
+	rewriteId := app.Command("rewriteDaemonId", "Change the DaemonId of "+
+		"the configured datastore and exit.  The datastore must not be in "+
+		"use.")
+	rewriteOld := rewriteId.Arg("old", "The current DaemonId of the "+
+		"datastore.").Required().String()
+	rewriteNew := rewriteId.Arg("new", "The DaemonId to give the "+
+		"datastore.").Required().String()
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	// Handle the "version" command-line argument.
@@ -75,12 +85,22 @@ func main() {
 		os.Exit(0)
 	}
 
+	// Handle the "rewriteDaemonId" command-line argument.
+	if cmd == rewriteId.FullCommand() {
+		os.Exit(rewriteDaemonIdCmd(cnf, *rewriteOld, *rewriteNew))
+	}
+
 	// Open the HTTP port.
 	// We want to do this first, before initializing the datastore or setting up
 	// logging.  That way, if someone accidentally starts two daemons with the
 	// same config file, the second invocation will exit with a "port in use"
 	// error rather than potentially disrupting the first invocation.
-	rstListener, listenErr := net.Listen("tcp", cnf.Get(conf.HTRACE_WEB_ADDRESS))
+	webAddr, _, err := getListenAddresses(cnf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		os.Exit(1)
+	}
+	rstListener, removedStale, listenErr := listenOn(cnf, webAddr)
 	if listenErr != nil {
 		fmt.Fprintf(os.Stderr, "Error opening HTTP port: %s\n",
 			listenErr.Error())
@@ -96,6 +116,9 @@ func main() {
 	for scanner.Scan() {
 		lg.Infof(scanner.Text() + "\n")
 	}
+	if removedStale {
+		lg.Warnf("Removed the stale REST socket %s.\n", webAddr)
+	}
 	common.InstallSignalHandlers(cnf)
 	if runtime.GOMAXPROCS(0) == 1 {
 		ncpu := runtime.NumCPU()
@@ -113,8 +136,17 @@ func main() {
 		lg.Errorf("Error creating datastore: %s\n", err.Error())
 		os.Exit(1)
 	}
+	rld := NewConfReloader(cnf, lg, func() (*conf.Config, error) {
+		dlog := new(bytes.Buffer)
+		ncnf, err := conf.ReloadApplicationConfig("htraced.", reloadArgv, dlog)
+		scanner := bufio.NewScanner(dlog)
+		for scanner.Scan() {
+			lg.Info(scanner.Text() + "\n")
+		}
+		return ncnf, err
+	})
 	var rsv *RestServer
-	rsv, err = CreateRestServer(cnf, store, rstListener)
+	rsv, err = CreateRestServer(cnf, store, rld, rstListener)
 	if err != nil {
 		lg.Errorf("Error creating REST server: %s\n", err.Error())
 		os.Exit(1)
@@ -130,6 +162,24 @@ func main() {
 		lg.Infof("Not starting HRPC server because no value was given for %s.\n",
 			conf.HTRACE_HRPC_ADDRESS)
 	}
+	if cnf.Get(conf.HTRACE_UDP_ADDRESS) != "" {
+		_, err = CreateUdpServer(cnf, store)
+		if err != nil {
+			lg.Errorf("Error creating UDP server: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	registerHotConfKeys(rld, store, hsv)
+	rld.ReloadOnSighup()
+
+	// Closing the listeners removes our unix sockets, if we have any, so
+	// that the next htraced doesn't have to treat them as stale.
+	common.AddSignalExitHook(func() {
+		rsv.Close()
+		if hsv != nil {
+			hsv.listener.Close()
+		}
+	})
 	naddr := cnf.Get(conf.HTRACE_STARTUP_NOTIFICATION_ADDRESS)
 	if naddr != "" {
 		notif := StartupNotification{
@@ -151,6 +201,23 @@ func main() {
 	}
 }
 
+func rewriteDaemonIdCmd(cnf *conf.Config, oldStr string, newStr string) int {
+	oldId, err := parseDaemonId(oldStr)
+	if err == nil {
+		var newId uint64
+		newId, err = parseDaemonId(newStr)
+		if err == nil {
+			err = RewriteDaemonId(cnf, oldId, newId)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Changed the DaemonId from %s to %s.\n", oldStr, newStr)
+	return 0
+}
+
 // A startup notification message that we optionally send on startup.
 // Used by unit tests.
 type StartupNotification struct {
@@ -160,7 +227,8 @@ type StartupNotification struct {
 }
 
 func sendStartupNotification(naddr string, notif *StartupNotification) error {
-	conn, err := net.Dial("tcp", naddr)
+	network, addr := conf.NetworkAddress(naddr)
+	conn, err := net.Dial(network, addr)
 	if err != nil {
 		return err
 	}
@@ -179,3 +247,35 @@ func sendStartupNotification(naddr string, notif *StartupNotification) error {
 	conn = nil
 	return nil
 }
+
+// Get the normalized REST and HRPC server addresses, and check that they
+// don't conflict.  The HRPC address is empty if the HRPC server is disabled.
+func getListenAddresses(cnf *conf.Config) (string, string, error) {
+	webAddr, err := cnf.GetAddress(conf.HTRACE_WEB_ADDRESS)
+	if err != nil {
+		return "", "", err
+	}
+	hrpcAddr := ""
+	if cnf.Get(conf.HTRACE_HRPC_ADDRESS) != "" {
+		hrpcAddr, err = cnf.GetAddress(conf.HTRACE_HRPC_ADDRESS)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	err = conf.CheckListenAddresses(webAddr, hrpcAddr)
+	if err != nil {
+		return "", "", err
+	}
+	return webAddr, hrpcAddr, nil
+}
+
+// Describe the address a server is listening on.  Servers configured without
+// a host listen on every interface, which is worth pointing out.  Unix socket
+// addresses are in the unix:// form.
+func describeListenAddr(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if ok && tcpAddr.IP.IsUnspecified() {
+		return addr.String() + " (all interfaces)"
+	}
+	return addr.String()
+}
@@ -0,0 +1,158 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+//
+// Info validation.
+//
+// Clients can put whatever they like in a span's info map, but some of it
+// breaks things further down the line: empty keys, huge keys, huge numbers of
+// keys, and strings which aren't valid UTF-8, which JSON consumers can't round
+// trip.  Keys starting with an underscore are reserved for information which
+// the server adds itself, such as _src_addr and _parents_indexed, so clients
+// mustn't be able to spoof them.
+//
+// So each span's info map is checked as it is ingested, on every transport,
+// before the server adds any reserved keys of its own.  What happens to a map
+// which fails the check depends on ingest.info.policy.  With the strip policy,
+// the offending entries are removed and the span is kept.  If there are still
+// too many keys after that, the ones which sort first are kept, so that the
+// result doesn't depend on the order in which the client sent them.  With the
+// reject policy, the span is dropped and recorded in the rejection log, with
+// a reason saying what the first problem was, in key order.  Either way, the
+// number of reserved keys each client tries to set is tracked in its metrics.
+//
+// The ingestors encode maps with their keys in sorted order, so that the
+// stored bytes of a span, and so its ETag, only depend on its contents.
+//
+
+// Remove the invalid entries from info maps.
+const INFO_POLICY_STRIP = "strip"
+
+// Reject spans whose info maps have invalid entries.
+const INFO_POLICY_REJECT = "reject"
+
+// Find the problem with an info entry, if there is one.  Returns the reject
+// reason and a description of the problem, or "" if the entry is valid.
+func findInfoProblem(key string, val string, maxKeyBytes int) (string, string) {
+	if key == "" {
+		return common.REJECT_REASON_INFO_KEY, "An info key is empty."
+	}
+	if maxKeyBytes > 0 && len(key) > maxKeyBytes {
+		return common.REJECT_REASON_INFO_KEY, fmt.Sprintf("An info key "+
+			"is %d bytes long, but the limit is %d.", len(key), maxKeyBytes)
+	}
+	if !utf8.ValidString(key) {
+		return common.REJECT_REASON_INFO_UTF8, fmt.Sprintf("The info key "+
+			"%q is not valid UTF-8.", key)
+	}
+	if !utf8.ValidString(val) {
+		return common.REJECT_REASON_INFO_UTF8, fmt.Sprintf("The value of "+
+			"info key %q is not valid UTF-8.", key)
+	}
+	if strings.HasPrefix(key, common.RESERVED_INFO_KEY_PREFIX) {
+		return common.REJECT_REASON_INFO_RESERVED, fmt.Sprintf("The info "+
+			"key %q has the reserved prefix '%s'.", key,
+			common.RESERVED_INFO_KEY_PREFIX)
+	}
+	return "", ""
+}
+
+// Returns true if an info map needs to be fixed or rejected.
+func infoNeedsCheck(info common.TraceInfoMap, maxKeyBytes int,
+	maxKeys int) bool {
+	if maxKeys > 0 && len(info) > maxKeys {
+		return true
+	}
+	for key, val := range info {
+		if reason, _ := findInfoProblem(key, val, maxKeyBytes); reason != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate the info map of an incoming span according to ingest.info.policy.
+// Returns false if the span was rejected.
+func (ing *SpanIngestor) validateInfo(span *common.Span) bool {
+	maxKeyBytes := ing.store.infoMaxKeyBytes
+	maxKeys := ing.store.infoMaxKeys
+	// Most info maps are fine, so we only sort the keys of the ones which
+	// aren't.
+	if !infoNeedsCheck(span.Info, maxKeyBytes, maxKeys) {
+		return true
+	}
+	strip := ing.store.infoPolicy == INFO_POLICY_STRIP
+	keys := make([]string, 0, len(span.Info))
+	for key := range span.Info {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var firstReason, firstMsg string
+	numKept, numStripped := 0, 0
+	for _, key := range keys {
+		reason, msg := findInfoProblem(key, span.Info[key], maxKeyBytes)
+		if reason == common.REJECT_REASON_INFO_RESERVED {
+			ing.reservedInfoKeys++
+		}
+		if reason == "" && maxKeys > 0 && numKept >= maxKeys {
+			reason = common.REJECT_REASON_INFO_COUNT
+			msg = fmt.Sprintf("The info map has %d keys, but the limit "+
+				"is %d.", len(keys), maxKeys)
+		}
+		if reason == "" {
+			numKept++
+			continue
+		}
+		if firstReason == "" {
+			firstReason, firstMsg = reason, msg
+		}
+		if strip {
+			delete(span.Info, key)
+			if reason != common.REJECT_REASON_INFO_RESERVED {
+				numStripped++
+			}
+		}
+	}
+	if !strip {
+		ing.slg.Warnf(ing.addr, "Dropping span %s sent by %s, because of "+
+			"its info map: %s\n", span.Id.String(), ing.addr, firstMsg)
+		ing.rejectSpan(span, firstReason, firstMsg)
+		return false
+	}
+	if len(span.Info) == 0 {
+		span.Info = nil
+	}
+	if numStripped > 0 {
+		ing.slg.Warnf(ing.addr, "Removed %d invalid info entries from span "+
+			"%s sent by %s.  The first problem was: %s\n", numStripped,
+			span.Id.String(), ing.addr, firstMsg)
+		ing.infoStripped += numStripped
+	}
+	return true
+}
@@ -0,0 +1,295 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func buildInfoValidationHTraced(t *testing.T, name string,
+	policy string) (*MiniHTraced, *htrace.Client, *htrace.Client) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_INGEST_INFO_MAX_KEY_BYTES: "16",
+			conf.HTRACE_INGEST_INFO_MAX_KEYS:      "3",
+			conf.HTRACE_INGEST_INFO_POLICY:        policy,
+			conf.HTRACE_SPAN_SOURCE_ADDR:          "true",
+			conf.HTRACE_INDEX_MAX_PARENTS:         "1",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	restCl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		ht.Close()
+		t.Fatalf("failed to create REST client: %s", err.Error())
+	}
+	hrpcCl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		restCl.Close()
+		ht.Close()
+		t.Fatalf("failed to create HRPC client: %s", err.Error())
+	}
+	return ht, restCl, hrpcCl
+}
+
+// Create a span with the given info map.  The span ID is derived from idx.
+func infoSpan(idx int, info common.TraceInfoMap) *common.Span {
+	return &common.Span{
+		Id: common.TestId(fmt.Sprintf("%032x", idx+1)),
+		SpanData: common.SpanData{
+			Begin:       100,
+			End:         200,
+			Description: fmt.Sprintf("info%d", idx),
+			TracerId:    "infoTest",
+			Info:        info,
+		},
+	}
+}
+
+// Create spans which break each of the info rules.  The span IDs start at
+// base.
+func invalidInfoSpans(base int) []*common.Span {
+	return []*common.Span{
+		infoSpan(base, common.TraceInfoMap{
+			"":   "empty",
+			"ok": "v",
+		}),
+		infoSpan(base+1, common.TraceInfoMap{
+			strings.Repeat("k", 17): "long",
+			"ok":                    "v",
+		}),
+		infoSpan(base+2, common.TraceInfoMap{
+			"d": "4", "c": "3", "b": "2", "a": "1",
+		}),
+		infoSpan(base+3, common.TraceInfoMap{
+			common.SOURCE_ADDR_INFO_KEY:     "spoofed.example.com",
+			common.PARENTS_INDEXED_INFO_KEY: "0",
+			"ok":                            "v",
+		}),
+	}
+}
+
+// Write spans over a client, and wait for all of them to be handled.
+func writeInfoSpans(t *testing.T, ht *MiniHTraced, hcl *htrace.Client,
+	spans []*common.Span) {
+	err := hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+}
+
+// Check that a stored span has the expected info, apart from the source
+// address, which must be a loopback address.
+func expectStoredInfo(t *testing.T, ht *MiniHTraced, id common.SpanId,
+	expected common.TraceInfoMap) {
+	span := ht.Store.FindSpan(id)
+	if span == nil {
+		t.Fatalf("failed to find span %s\n", id.String())
+	}
+	ip := net.ParseIP(span.Info[common.SOURCE_ADDR_INFO_KEY])
+	if ip == nil || !ip.IsLoopback() {
+		t.Fatalf("expected span %s to have a loopback source address, but "+
+			"got %s\n", id.String(), asJson(span))
+	}
+	if len(span.Info) != len(expected)+1 {
+		t.Fatalf("expected span %s to have info %s, but got %s\n",
+			id.String(), asJson(expected), asJson(span.Info))
+	}
+	for key, val := range expected {
+		if span.Info[key] != val {
+			t.Fatalf("expected span %s to have info %s, but got %s\n",
+				id.String(), asJson(expected), asJson(span.Info))
+		}
+	}
+}
+
+// Get the total number of reserved info keys sent by all clients.
+func totalReservedInfoKeys(t *testing.T, hcl *htrace.Client) uint64 {
+	resp, err := hcl.GetClientStats("", "", 100)
+	if err != nil {
+		t.Fatalf("GetClientStats failed: %s\n", err.Error())
+	}
+	var total uint64
+	for i := range resp.Clients {
+		total += resp.Clients[i].ReservedInfoKeys
+	}
+	return total
+}
+
+func TestInfoValidationStrip(t *testing.T) {
+	t.Parallel()
+	ht, restCl, hrpcCl := buildInfoValidationHTraced(t,
+		"TestInfoValidationStrip", INFO_POLICY_STRIP)
+	defer ht.Close()
+	defer restCl.Close()
+	defer hrpcCl.Close()
+
+	// The last span has two parents, so the server marks it as having only
+	// one of them indexed.  That reserved key is added after validation.
+	restSpans := invalidInfoSpans(0)
+	hrpcSpans := invalidInfoSpans(10)
+	restSpans[3].Parents = []common.SpanId{restSpans[0].Id, restSpans[1].Id}
+	hrpcSpans[3].Parents = []common.SpanId{hrpcSpans[0].Id, hrpcSpans[1].Id}
+	writeInfoSpans(t, ht, restCl, restSpans)
+	writeInfoSpans(t, ht, hrpcCl, hrpcSpans)
+
+	// Invalid UTF-8 can't get through JSON, so hand it to an ingestor
+	// directly, as the HRPC handler would.
+	utf8Spans := []*common.Span{
+		infoSpan(20, common.TraceInfoMap{"bad": "\xff", "ok": "v"}),
+		infoSpan(21, common.TraceInfoMap{"\xfe": "bad", "ok": "v"}),
+	}
+	ingestSpans(ht, utf8Spans)
+
+	for _, spans := range [][]*common.Span{restSpans, hrpcSpans} {
+		expectStoredInfo(t, ht, spans[0].Id, common.TraceInfoMap{"ok": "v"})
+		expectStoredInfo(t, ht, spans[1].Id, common.TraceInfoMap{"ok": "v"})
+		// The keys which sort first are kept.
+		expectStoredInfo(t, ht, spans[2].Id, common.TraceInfoMap{
+			"a": "1", "b": "2", "c": "3",
+		})
+		// The client's reserved keys are replaced by the server's.
+		expectStoredInfo(t, ht, spans[3].Id, common.TraceInfoMap{
+			"ok":                            "v",
+			common.PARENTS_INDEXED_INFO_KEY: "1",
+		})
+	}
+	for i := range utf8Spans {
+		expectStoredInfo(t, ht, utf8Spans[i].Id,
+			common.TraceInfoMap{"ok": "v"})
+	}
+
+	// 3 entries were stripped over each client transport, and 2 more when
+	// ingesting directly.  The reserved keys aren't counted as stripped.
+	stats, err := restCl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.InfoEntriesStripped != 8 {
+		t.Fatalf("expected 8 stripped info entries, but got %d\n",
+			stats.InfoEntriesStripped)
+	}
+	if total := totalReservedInfoKeys(t, restCl); total != 4 {
+		t.Fatalf("expected 4 reserved info keys, but got %d\n", total)
+	}
+	rej, err := restCl.GetRejections("", 100)
+	if err != nil {
+		t.Fatalf("GetRejections failed: %s\n", err.Error())
+	}
+	if len(rej.Counts) != 0 {
+		t.Fatalf("expected no rejections, but got %s\n", asJson(rej))
+	}
+}
+
+func TestInfoValidationReject(t *testing.T) {
+	t.Parallel()
+	ht, restCl, hrpcCl := buildInfoValidationHTraced(t,
+		"TestInfoValidationReject", INFO_POLICY_REJECT)
+	defer ht.Close()
+	defer restCl.Close()
+	defer hrpcCl.Close()
+
+	restSpans := append(invalidInfoSpans(0),
+		infoSpan(4, common.TraceInfoMap{"ok": "v"}))
+	hrpcSpans := append(invalidInfoSpans(10),
+		infoSpan(14, common.TraceInfoMap{"ok": "v"}))
+	writeInfoSpans(t, ht, restCl, restSpans)
+	writeInfoSpans(t, ht, hrpcCl, hrpcSpans)
+	ingestSpans(ht, []*common.Span{
+		infoSpan(20, common.TraceInfoMap{"bad": "\xff"}),
+	})
+
+	// Spans written by Zipkin tracers are checked too.
+	code, body := postZipkinSpans(t, ht, `[{"traceId":"1","id":"2",`+
+		`"name":"zipkin","timestamp":1000,"duration":10,`+
+		`"localEndpoint":{"serviceName":"zipkinTest"},`+
+		`"tags":{"_src_addr":"spoofed.example.com"}}]`)
+	if code != http.StatusAccepted {
+		t.Fatalf("expected a 202 response, but got %d: %s\n", code, body)
+	}
+
+	for _, spans := range [][]*common.Span{restSpans, hrpcSpans} {
+		for i := 0; i < 4; i++ {
+			if ht.Store.FindSpan(spans[i].Id) != nil {
+				t.Fatalf("expected span %d to be rejected\n", i)
+			}
+		}
+		expectStoredInfo(t, ht, spans[4].Id, common.TraceInfoMap{"ok": "v"})
+	}
+	rej, err := restCl.GetRejections("", 100)
+	if err != nil {
+		t.Fatalf("GetRejections failed: %s\n", err.Error())
+	}
+	expectedCounts := map[string]uint64{
+		common.REJECT_REASON_INFO_KEY:      4,
+		common.REJECT_REASON_INFO_COUNT:    2,
+		common.REJECT_REASON_INFO_RESERVED: 3,
+		common.REJECT_REASON_INFO_UTF8:     1,
+	}
+	if len(rej.Counts) != len(expectedCounts) {
+		t.Fatalf("expected counts %v, but got %v\n", expectedCounts,
+			rej.Counts)
+	}
+	for reason, count := range expectedCounts {
+		if rej.Counts[reason] != count {
+			t.Fatalf("expected counts %v, but got %v\n", expectedCounts,
+				rej.Counts)
+		}
+	}
+	// Both reserved keys of each spoofing span are counted.
+	if total := totalReservedInfoKeys(t, restCl); total != 5 {
+		t.Fatalf("expected 5 reserved info keys, but got %d\n", total)
+	}
+	stats, err := restCl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.InfoEntriesStripped != 0 {
+		t.Fatalf("expected no stripped info entries, but got %d\n",
+			stats.InfoEntriesStripped)
+	}
+}
+
+func TestInfoPolicyValidation(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestInfoPolicyValidation",
+		Cnf: map[string]string{
+			conf.HTRACE_INGEST_INFO_POLICY: "truncate",
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err == nil {
+		ht.Close()
+		t.Fatalf("expected an invalid info policy to be rejected\n")
+	}
+	common.AssertErrContains(t, err, conf.HTRACE_INGEST_INFO_POLICY)
+}
@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//
+// Pausing ingestion.
+//
+// An administrator can stop the server accepting spans for a while, for
+// example during a compaction storm or a disk swap, without stopping it
+// serving queries.  While ingestion is paused, span writes over REST fail with
+// ERR_INGEST_PAUSED and a Retry-After header, HRPC writes fail with
+// ERR_INGEST_PAUSED, and UDP datagrams are dropped.  The pause may have a
+// duration, after which ingestion resumes by itself.
+//
+// The pause is kept in memory only.  A server which restarts while paused
+// starts up accepting spans, so a pause set just before a restart doesn't
+// outlive it.
+//
+
+// The longest a client is asked to wait before writing again.  Clients of a
+// server paused with no duration check back this often.
+const INGEST_PAUSE_MAX_RETRY_MS = 10000
+
+type ingestPause struct {
+	lg *common.Logger
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	paused   bool
+	pausedBy string
+	pausedAt time.Time
+
+	// When ingestion resumes by itself, or the zero time if it doesn't.
+	resumeAt time.Time
+}
+
+func newIngestPause(lg *common.Logger) *ingestPause {
+	return &ingestPause{lg: lg}
+}
+
+// Resume ingestion if the pause has run out.  Must be called with the lock
+// held.
+func (ip *ingestPause) expire(now time.Time) {
+	if ip.paused && !ip.resumeAt.IsZero() && !now.Before(ip.resumeAt) {
+		ip.lg.Infof("Resuming ingestion, which %s paused at %s.\n",
+			ip.pausedBy, ip.pausedAt.UTC().Format(time.RFC3339))
+		ip.paused = false
+	}
+}
+
+// Get the state of the pause.  Must be called with the lock held.
+func (ip *ingestPause) status() common.IngestPause {
+	if !ip.paused {
+		return common.IngestPause{}
+	}
+	ret := common.IngestPause{
+		Paused:   true,
+		PausedBy: ip.pausedBy,
+		PausedMs: common.TimeToUnixMs(ip.pausedAt.UTC()),
+	}
+	if !ip.resumeAt.IsZero() {
+		ret.ResumeMs = common.TimeToUnixMs(ip.resumeAt.UTC())
+	}
+	return ret
+}
+
+// Pause ingestion.  If dur is positive, ingestion resumes by itself after
+// dur.  Pausing again replaces the earlier pause.
+func (ip *ingestPause) pause(by string, dur time.Duration) common.IngestPause {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+	now := time.Now()
+	ip.paused = true
+	ip.pausedBy = by
+	ip.pausedAt = now
+	ip.resumeAt = time.Time{}
+	if dur > 0 {
+		ip.resumeAt = now.Add(dur)
+		ip.lg.Warnf("%s paused ingestion for %s.\n", by, dur.String())
+	} else {
+		ip.lg.Warnf("%s paused ingestion until it is resumed.\n", by)
+	}
+	return ip.status()
+}
+
+// Resume ingestion.  Resuming when ingestion isn't paused does nothing.
+func (ip *ingestPause) resume(by string) common.IngestPause {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+	ip.expire(time.Now())
+	if ip.paused {
+		ip.lg.Infof("%s resumed ingestion, which %s paused at %s.\n", by,
+			ip.pausedBy, ip.pausedAt.UTC().Format(time.RFC3339))
+		ip.paused = false
+	}
+	return ip.status()
+}
+
+// Get the state of the pause.
+func (ip *ingestPause) get() common.IngestPause {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+	ip.expire(time.Now())
+	return ip.status()
+}
+
+// Returns an ERR_INGEST_PAUSED error if ingestion is paused, or nil if it
+// isn't.  The error says how long the client should wait before trying
+// again.
+func (ip *ingestPause) check() *common.HtraceError {
+	ip.lock.Lock()
+	defer ip.lock.Unlock()
+	now := time.Now()
+	ip.expire(now)
+	if !ip.paused {
+		return nil
+	}
+	retryMs := int64(INGEST_PAUSE_MAX_RETRY_MS)
+	if !ip.resumeAt.IsZero() {
+		remainingMs := int64((ip.resumeAt.Sub(now) + time.Millisecond - 1) /
+			time.Millisecond)
+		if remainingMs < retryMs {
+			retryMs = remainingMs
+		}
+	}
+	return common.NewHtraceError(common.ERR_INGEST_PAUSED,
+		map[string]string{
+			common.ERR_DETAIL_RETRY_AFTER_MS: strconv.FormatInt(retryMs, 10),
+		}, "Can't write spans: %s paused ingestion at %s.  Try again in %d "+
+			"ms.", ip.pausedBy, ip.pausedAt.UTC().Format(time.RFC3339),
+		retryMs)
+}
+
+// Write an ERR_INGEST_PAUSED error response, with a Retry-After header.
+func writeIngestPausedError(lg *common.Logger, w http.ResponseWriter,
+	herr *common.HtraceError) {
+	// Retry-After is in whole seconds, so we round up.
+	secs := (herr.RetryAfter() + time.Second - 1) / time.Second
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", secs))
+	writeHtraceError(lg, w, herr)
+}
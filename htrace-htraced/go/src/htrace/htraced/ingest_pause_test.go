@@ -0,0 +1,158 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestIngestPause(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestIngestPause",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	// These clients give up as soon as the server says it is paused.
+	restHcl, err := htrace.NewClient(ht.RestOnlyClientConf().Clone(
+		conf.HTRACE_CLIENT_PAUSE_MAX_WAIT_MS, "0"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer restHcl.Close()
+	hrpcHcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_PAUSE_MAX_WAIT_MS, "0"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hrpcHcl.Close()
+	// This one waits for the server to resume.
+	waitingHcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer waitingHcl.Close()
+	// Each batch gets spans of its own, so that we can tell which ones were
+	// written.
+	rnd := rand.New(rand.NewSource(1947))
+	newSpans := func(n int) []*common.Span {
+		spans := make([]*common.Span, n)
+		for i := range spans {
+			spans[i] = test.NewRandomSpan(rnd, spans[0:i])
+		}
+		return spans
+	}
+	before := newSpans(2)
+	ingestSpans(ht, before)
+
+	start := time.Now()
+	pause, err := restHcl.PauseIngest(1500 * time.Millisecond)
+	if err != nil {
+		t.Fatalf("PauseIngest failed: %s\n", err.Error())
+	}
+	if !pause.Paused || pause.ResumeMs == 0 || pause.PausedBy == "" {
+		t.Fatalf("Unexpected pause %s\n", asJson(pause))
+	}
+	err = restHcl.WriteSpans(newSpans(1))
+	expectErrorCode(t, err, common.ERR_INGEST_PAUSED)
+	herr := err.(*common.HtraceError)
+	if herr.HttpStatus != 503 || herr.RetryAfter() <= 0 ||
+		herr.RetryAfter() > 1500*time.Millisecond {
+		t.Fatalf("Expected a 503 response with a retry delay of at most "+
+			"1500 ms, but got %s\n", asJson(herr))
+	}
+	err = hrpcHcl.WriteSpans(newSpans(1))
+	expectHrpcErrorCode(t, err, common.ERR_INGEST_PAUSED)
+
+	// Reads still work.
+	if ht.Store.FindSpan(before[0].Id) == nil {
+		t.Fatalf("Failed to find span %s\n", before[0].Id.String())
+	}
+	_, err = restHcl.Query(&common.Query{Lim: 10})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	health, err := restHcl.GetServerHealth()
+	if err != nil {
+		t.Fatalf("GetServerHealth failed: %s\n", err.Error())
+	}
+	if !health.Healthy || !health.IngestPause.Paused ||
+		health.IngestPause.ResumeMs != pause.ResumeMs {
+		t.Fatalf("Unexpected health %s\n", asJson(health))
+	}
+
+	// The waiting client's spans arrive once the pause is over.
+	during := newSpans(3)
+	err = waitingHcl.WriteSpans(during)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	if time.Since(start) < 1500*time.Millisecond {
+		t.Fatalf("Expected the write to wait for the pause to end, but it "+
+			"finished after %s\n", time.Since(start).String())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(during)))
+	for i := range during {
+		if ht.Store.FindSpan(during[i].Id) == nil {
+			t.Fatalf("Failed to find span %s\n", during[i].Id.String())
+		}
+	}
+	health, err = restHcl.GetServerHealth()
+	if err != nil {
+		t.Fatalf("GetServerHealth failed: %s\n", err.Error())
+	}
+	if health.IngestPause.Paused {
+		t.Fatalf("Expected ingestion to have resumed, but got %s\n",
+			asJson(health))
+	}
+
+	// A pause with no duration lasts until it is resumed.
+	pause, err = restHcl.PauseIngest(0)
+	if err != nil {
+		t.Fatalf("PauseIngest failed: %s\n", err.Error())
+	}
+	if !pause.Paused || pause.ResumeMs != 0 {
+		t.Fatalf("Unexpected pause %s\n", asJson(pause))
+	}
+	err = hrpcHcl.WriteSpans(newSpans(1))
+	expectHrpcErrorCode(t, err, common.ERR_INGEST_PAUSED)
+	pause, err = restHcl.ResumeIngest()
+	if err != nil {
+		t.Fatalf("ResumeIngest failed: %s\n", err.Error())
+	}
+	if pause.Paused {
+		t.Fatalf("Expected ingestion to have resumed, but got %s\n",
+			asJson(pause))
+	}
+	err = hrpcHcl.WriteSpans(newSpans(1))
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+}
@@ -0,0 +1,262 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"htrace/common"
+	"htrace/conf"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+//
+// The REST WriteSpans ingest pipeline.
+//
+// Most of the CPU time spent on a WriteSpans request goes to decoding the
+// spans and validating them.  For large requests, we spread that work over
+// several goroutines.  The request goroutine splits the body into chunks of
+// raw JSON spans.  The decode stage turns the chunks into spans, and the
+// validate stage runs them through forked SpanIngestors, which hand them to
+// the shards.  The channels between the stages are bounded, so only a few
+// chunks are in memory at once.  The spans of a request may reach the shards
+// in any order.
+//
+
+// The number of spans in each chunk passed between the pipeline stages.
+const INGEST_CHUNK_SIZE = 64
+
+// Requests with fewer spans than this are handled on the request goroutine.
+const INGEST_PIPELINE_MIN_SPANS = 2 * INGEST_CHUNK_SIZE
+
+// Get the number of goroutines to use for an ingest pipeline stage.
+func ingestConcurrency(cnf *conf.Config, key string) int {
+	n := cnf.GetInt(key)
+	if n <= 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	return n
+}
+
+type ingestChunk struct {
+	// The index in the request of the first span in the chunk.
+	startIdx int
+
+	// The spans, before and after decoding.
+	raw   []json.RawMessage
+	spans []*common.Span
+}
+
+// A span in a WriteSpans request which could not be decoded.
+type ingestDecodeError struct {
+	// The index of the span in the request.
+	spanIdx int
+
+	// The data which could not be decoded, for the rejection log.
+	raw []byte
+
+	err error
+
+	// True if the rest of the request could not be read after this span.
+	stopped bool
+}
+
+type ingestPipeline struct {
+	// The ingestor for the request.  The forks are absorbed by it.
+	ing *SpanIngestor
+
+	decodeCh   chan *ingestChunk
+	validateCh chan *ingestChunk
+	decodeWg   sync.WaitGroup
+	validateWg sync.WaitGroup
+
+	// The ingestors used by the validate stage, one per goroutine.
+	forks []*SpanIngestor
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The spans which could not be decoded, in no particular order.
+	skipped []*ingestDecodeError
+
+	// The time the goroutines of each stage spent working.
+	decodeTime   time.Duration
+	validateTime time.Duration
+}
+
+// Ingest the spans of a REST WriteSpans request, which the reader is
+// positioned at.  Spans which can't be decoded are skipped.  If the reader
+// can't go on after a span, the rest of the request is not read.  Returns the
+// spans which were skipped, sorted by index.  The last one is the span the
+// reader stopped at, if it stopped early.  The caller must close the
+// ingestor.
+func ingestRestSpans(ing *SpanIngestor, rdr *restSpanReader,
+	numSpans int) []*ingestDecodeError {
+	store := ing.store
+	if numSpans < INGEST_PIPELINE_MIN_SPANS {
+		var skipped []*ingestDecodeError
+		for spanIdx := 0; spanIdx < numSpans; spanIdx++ {
+			span, raw, fatal, err := decodeRestSpan(rdr)
+			if err != nil {
+				skipped = append(skipped, &ingestDecodeError{
+					spanIdx: spanIdx, raw: raw, err: err, stopped: fatal})
+				if fatal {
+					break
+				}
+				continue
+			}
+			ing.IngestSpan(span)
+		}
+		return skipped
+	}
+	pip := newIngestPipeline(ing, store.ingestDecodeWorkers,
+		store.ingestValidateWorkers)
+	var chunk *ingestChunk
+	for spanIdx := 0; spanIdx < numSpans; spanIdx++ {
+		if chunk == nil {
+			chunk = &ingestChunk{
+				startIdx: spanIdx,
+				raw:      make([]json.RawMessage, 0, INGEST_CHUNK_SIZE),
+			}
+		}
+		raw, bad, fatal, err := rdr.next()
+		if err != nil {
+			pip.skip(&ingestDecodeError{spanIdx: spanIdx, raw: bad, err: err,
+				stopped: fatal})
+			if fatal {
+				break
+			}
+		}
+		// Skipped spans keep their place in the chunk, so that the indexes
+		// of the spans after them stay right.
+		chunk.raw = append(chunk.raw, raw)
+		if len(chunk.raw) == INGEST_CHUNK_SIZE {
+			pip.decodeCh <- chunk
+			chunk = nil
+		}
+	}
+	if chunk != nil && len(chunk.raw) > 0 {
+		pip.decodeCh <- chunk
+	}
+	return pip.finish()
+}
+
+func newIngestPipeline(ing *SpanIngestor, decodeWorkers int,
+	validateWorkers int) *ingestPipeline {
+	pip := &ingestPipeline{
+		ing:        ing,
+		decodeCh:   make(chan *ingestChunk, decodeWorkers),
+		validateCh: make(chan *ingestChunk, validateWorkers),
+		forks:      make([]*SpanIngestor, validateWorkers),
+	}
+	pip.decodeWg.Add(decodeWorkers)
+	for i := 0; i < decodeWorkers; i++ {
+		go pip.decode()
+	}
+	pip.validateWg.Add(validateWorkers)
+	for i := range pip.forks {
+		pip.forks[i] = ing.fork()
+		go pip.validate(pip.forks[i])
+	}
+	return pip
+}
+
+// Record a span which could not be decoded.
+func (pip *ingestPipeline) skip(derr *ingestDecodeError) {
+	pip.lock.Lock()
+	defer pip.lock.Unlock()
+	pip.skipped = append(pip.skipped, derr)
+}
+
+func (pip *ingestPipeline) decode() {
+	defer pip.decodeWg.Done()
+	var busy time.Duration
+	for chunk := range pip.decodeCh {
+		start := time.Now()
+		chunk.spans = make([]*common.Span, len(chunk.raw))
+		for i := range chunk.raw {
+			if chunk.raw[i] == nil {
+				continue // the request goroutine already skipped it
+			}
+			err := json.Unmarshal(chunk.raw[i], &chunk.spans[i])
+			if err != nil {
+				pip.skip(&ingestDecodeError{spanIdx: chunk.startIdx + i,
+					raw: chunk.raw[i], err: err})
+				chunk.spans[i] = nil
+			}
+		}
+		busy += time.Since(start)
+		chunk.raw = nil
+		pip.validateCh <- chunk
+	}
+	pip.lock.Lock()
+	pip.decodeTime += busy
+	pip.lock.Unlock()
+}
+
+func (pip *ingestPipeline) validate(fork *SpanIngestor) {
+	defer pip.validateWg.Done()
+	var busy time.Duration
+	for chunk := range pip.validateCh {
+		start := time.Now()
+		for i := range chunk.spans {
+			if chunk.spans[i] != nil {
+				fork.IngestSpan(chunk.spans[i])
+			}
+		}
+		busy += time.Since(start)
+	}
+	pip.lock.Lock()
+	pip.validateTime += busy
+	pip.lock.Unlock()
+}
+
+// Wait for the stages to finish, and hand the remaining spans to the shards.
+// Returns the spans which could not be decoded, sorted by index.
+func (pip *ingestPipeline) finish() []*ingestDecodeError {
+	close(pip.decodeCh)
+	pip.decodeWg.Wait()
+	close(pip.validateCh)
+	pip.validateWg.Wait()
+	for i := range pip.forks {
+		pip.forks[i].flush()
+		pip.ing.absorb(pip.forks[i])
+	}
+	pip.ing.store.msink.UpdateIngestStages(pip.decodeTime, pip.validateTime)
+	sort.Sort(ingestDecodeErrorSlice(pip.skipped))
+	return pip.skipped
+}
+
+// Sorts ingest decode errors by span index.
+type ingestDecodeErrorSlice []*ingestDecodeError
+
+func (s ingestDecodeErrorSlice) Len() int {
+	return len(s)
+}
+
+func (s ingestDecodeErrorSlice) Less(i, j int) bool {
+	return s[i].spanIdx < s[j].spanIdx
+}
+
+func (s ingestDecodeErrorSlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
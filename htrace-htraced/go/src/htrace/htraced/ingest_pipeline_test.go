@@ -0,0 +1,375 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Encode a REST WriteSpans request.  If badSpan is non-negative, the span with
+// that index is replaced by badJson.
+func encodeWriteSpansReq(t Fatalfer, spans []*common.Span, badSpan int,
+	badJson string) []byte {
+	return encodeWriteSpansReqWithBad(t, spans,
+		map[int]string{badSpan: badJson})
+}
+
+// Encode a REST WriteSpans request, replacing the spans at the indexes in bad
+// with the given data.
+func encodeWriteSpansReqWithBad(t Fatalfer, spans []*common.Span,
+	bad map[int]string) []byte {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	err := enc.Encode(&common.WriteSpansReq{NumSpans: len(spans)})
+	if err != nil {
+		t.Fatalf("failed to encode WriteSpansReq: %s\n", err.Error())
+	}
+	for i := range spans {
+		if badJson, ok := bad[i]; ok {
+			buf.WriteString(badJson + "\n")
+			continue
+		}
+		err = enc.Encode(spans[i])
+		if err != nil {
+			t.Fatalf("failed to encode span %d: %s\n", i, err.Error())
+		}
+	}
+	return buf.Bytes()
+}
+
+// Post a REST WriteSpans request.  Returns the status code and the body.
+func postWriteSpans(t Fatalfer, ht *MiniHTraced, body []byte) (int, []byte) {
+	return postWriteSpansWithParams(t, ht, "", body)
+}
+
+// Like postWriteSpans, but adds the given query string to the URL.
+func postWriteSpansWithParams(t Fatalfer, ht *MiniHTraced, params string,
+	body []byte) (int, []byte) {
+	url := fmt.Sprintf("http://%s/writeSpans%s", ht.Rsv.Addr().String(),
+		params)
+	resp, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to post to %s: %s\n", url, err.Error())
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read the response from %s: %s\n", url,
+			err.Error())
+	}
+	return resp.StatusCode, respBody
+}
+
+// Create spans, some of which the server will reject because their unknown
+// fields are too big, or because they end before they begin.
+func createMixedTestSpans(amount int) []*common.Span {
+	spans := createRandomTestSpans(amount)
+	junk := json.RawMessage(`"` +
+		strings.Repeat("x", common.MAX_SPAN_EXTRAS_BYTES) + `"`)
+	for i, span := range spans {
+		span.Begin = 1445540632000 + int64(i)
+		span.End = span.Begin + int64(i%50)
+		switch {
+		case i%7 == 3:
+			span.Extras = common.SpanExtras{"junk": junk}
+		case i%11 == 5:
+			span.End = span.Begin - 1
+		case i%13 == 0 && i > 0:
+			span.Parents = []common.SpanId{spans[i-1].Id, spans[i-1].Id}
+		}
+	}
+	return spans
+}
+
+func buildForPipelineTest(t *testing.T, name string,
+	concurrency string) *MiniHTraced {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_INGEST_VALIDATE_TIMES:       "true",
+			conf.HTRACE_INGEST_DECODE_CONCURRENCY:   concurrency,
+			conf.HTRACE_INGEST_VALIDATE_CONCURRENCY: concurrency,
+			conf.HTRACE_REJECTIONS_MAX_ENTRIES:      "10",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	return ht
+}
+
+// The pipeline should accept, reject, and store the same spans as the
+// request goroutine does on its own.
+func TestIngestPipelineMatchesSerial(t *testing.T) {
+	const NUM_SPANS = 1000
+	spans := createMixedTestSpans(NUM_SPANS)
+	serial := buildForPipelineTest(t, "TestIngestPipelineSerial", "1")
+	defer serial.Close()
+	piped := buildForPipelineTest(t, "TestIngestPipelinePiped", "4")
+	defer piped.Close()
+
+	var serialResp common.WriteSpansResp
+	const SERIAL_BATCH = INGEST_PIPELINE_MIN_SPANS - 1
+	for start := 0; start < NUM_SPANS; start += SERIAL_BATCH {
+		end := start + SERIAL_BATCH
+		if end > NUM_SPANS {
+			end = NUM_SPANS
+		}
+		code, body := postWriteSpans(t, serial,
+			encodeWriteSpansReq(t, spans[start:end], -1, ""))
+		var resp common.WriteSpansResp
+		if code != http.StatusOK || json.Unmarshal(body, &resp) != nil {
+			t.Fatalf("serial WriteSpans failed with %d: %s\n", code,
+				string(body))
+		}
+		serialResp.Accepted += resp.Accepted
+		serialResp.Rejected += resp.Rejected
+	}
+	code, body := postWriteSpans(t, piped,
+		encodeWriteSpansReq(t, spans, -1, ""))
+	var pipedResp common.WriteSpansResp
+	if code != http.StatusOK || json.Unmarshal(body, &pipedResp) != nil {
+		t.Fatalf("pipelined WriteSpans failed with %d: %s\n", code,
+			string(body))
+	}
+	if asJson(&pipedResp) != asJson(&serialResp) || pipedResp.Rejected == 0 ||
+		pipedResp.Accepted+pipedResp.Rejected != NUM_SPANS {
+		t.Fatalf("expected the pipeline to respond like the serial path, "+
+			"but got %s, rather than %s\n", asJson(&pipedResp),
+			asJson(&serialResp))
+	}
+	serial.Store.WrittenSpans.Waits(int64(serialResp.Accepted))
+	piped.Store.WrittenSpans.Waits(int64(pipedResp.Accepted))
+
+	for i := range spans {
+		expected := asJson(serial.Store.FindSpan(spans[i].Id))
+		found := asJson(piped.Store.FindSpan(spans[i].Id))
+		if found != expected {
+			t.Fatalf("span %d differs: the serial path stored %s, but the "+
+				"pipeline stored %s\n", i, expected, found)
+		}
+	}
+	serialRej := serial.Store.rejections.Get("", 10)
+	pipedRej := piped.Store.rejections.Get("", 10)
+	if asJson(pipedRej.Counts) != asJson(serialRej.Counts) {
+		t.Fatalf("expected rejection counts %s, but got %s\n",
+			asJson(serialRej.Counts), asJson(pipedRej.Counts))
+	}
+	entries, err := piped.Store.FindAuditEntries(10)
+	if err != nil || len(entries) != 1 || entries[0].NumSpans != NUM_SPANS ||
+		entries[0].Accepted != pipedResp.Accepted {
+		t.Fatalf("expected one audit entry for the request, but got %s, "+
+			"%v\n", asJson(entries), err)
+	}
+	var stats common.ServerStats
+	piped.Store.msink.PopulateServerStats(&stats)
+	if stats.IngestedSpans != NUM_SPANS {
+		t.Fatalf("expected %d ingested spans, but got %d\n", NUM_SPANS,
+			stats.IngestedSpans)
+	}
+}
+
+// In strict mode, a span which can't be decoded fails the request, and is
+// reported by its index in the request.  None of the spans are stored.
+func TestIngestPipelineDecodeErrors(t *testing.T) {
+	const NUM_SPANS = 500
+	ht := buildForPipelineTest(t, "TestIngestPipelineDecodeErrors", "4")
+	defer ht.Close()
+	spans := createMixedTestSpans(NUM_SPANS)
+	for _, tc := range []struct {
+		badSpan int
+		badJson string
+	}{
+		{321, `{"a":5}`},
+		{456, `{"a":`},
+		{0, `[]`},
+	} {
+		code, body := postWriteSpansWithParams(t, ht, "?strict=true",
+			encodeWriteSpansReq(t, spans, tc.badSpan, tc.badJson))
+		if code != http.StatusBadRequest {
+			t.Fatalf("expected status %d for bad span %d, but got %d: %s\n",
+				http.StatusBadRequest, tc.badSpan, code, string(body))
+		}
+		expected := fmt.Sprintf("Failed to decode span %d out of %d",
+			tc.badSpan, NUM_SPANS)
+		if !strings.Contains(string(body), expected) {
+			t.Fatalf("expected the error to contain '%s', but got %s\n",
+				expected, string(body))
+		}
+	}
+	rej := ht.Store.rejections.Get(common.REJECT_REASON_DECODE, 10)
+	if rej.Counts[common.REJECT_REASON_DECODE] != 3 {
+		t.Fatalf("expected 3 decode rejections, but got %s\n", asJson(rej))
+	}
+	for i := range spans {
+		if ht.Store.FindSpan(spans[i].Id) != nil {
+			t.Fatalf("span %d was stored by a failed strict request\n", i)
+		}
+	}
+	code, body := postWriteSpansWithParams(t, ht, "?strict=maybe",
+		encodeWriteSpansReq(t, spans, -1, ""))
+	if code != http.StatusBadRequest ||
+		!strings.Contains(string(body), "Invalid strict") {
+		t.Fatalf("expected an invalid strict parameter to be rejected, but "+
+			"got %d: %s\n", code, string(body))
+	}
+
+	// A strict request with no bad spans succeeds.
+	code, body = postWriteSpansWithParams(t, ht, "?strict=true",
+		encodeWriteSpansReq(t, spans, -1, ""))
+	var resp common.WriteSpansResp
+	if code != http.StatusOK || json.Unmarshal(body, &resp) != nil ||
+		resp.Accepted+resp.Rejected != NUM_SPANS || resp.ParseSkipped != 0 {
+		t.Fatalf("strict WriteSpans failed with %d: %s\n", code,
+			string(body))
+	}
+}
+
+// By default, spans which can't be decoded are skipped, and listed in the
+// response by their index in the request.
+func TestWriteSpansSkipsBadSpans(t *testing.T) {
+	ht := buildForPipelineTest(t, "TestWriteSpansSkipsBadSpans", "4")
+	defer ht.Close()
+	var totalSkipped uint64
+	for _, numSpans := range []int{INGEST_PIPELINE_MIN_SPANS - 1, 500} {
+		spans := createRandomTestSpans(numSpans)
+		for i := range spans {
+			spans[i].Begin = 1445540632000 + int64(i)
+			spans[i].End = spans[i].Begin + 10
+		}
+		// The lines at 20 and at the end stop in the middle of a span.
+		bad := map[int]string{
+			0:            `[]`,
+			7:            `{"a":"00000000000000000000000000000001","b":1,"e":NaN}`,
+			12:           `{"a":5}`,
+			20:           `{"a":`,
+			numSpans - 1: `{"a":`,
+		}
+		code, body := postWriteSpans(t, ht,
+			encodeWriteSpansReqWithBad(t, spans, bad))
+		var resp common.WriteSpansResp
+		if code != http.StatusOK || json.Unmarshal(body, &resp) != nil {
+			t.Fatalf("WriteSpans of %d spans failed with %d: %s\n",
+				numSpans, code, string(body))
+		}
+		expectedIdx := []int{0, 7, 12, 20, numSpans - 1}
+		if resp.Accepted != numSpans-len(bad) || resp.Rejected != 0 ||
+			resp.ParseSkipped != len(bad) ||
+			len(resp.ParseFailures) != len(expectedIdx) {
+			t.Fatalf("unexpected response for %d spans: %s\n", numSpans,
+				asJson(&resp))
+		}
+		for i := range expectedIdx {
+			if resp.ParseFailures[i].Index != expectedIdx[i] {
+				t.Fatalf("expected failures at %v, but got %s\n",
+					expectedIdx, asJson(&resp))
+			}
+		}
+		common.AssertErrContains(t,
+			errors.New(resp.ParseFailures[1].Error), "invalid character 'N'")
+		totalSkipped += uint64(len(bad))
+		expectSpanOutcomes(t, ht, SpanOutcomes{Written: int64(resp.Accepted)})
+		for i := range spans {
+			_, isBad := bad[i]
+			if (ht.Store.FindSpan(spans[i].Id) == nil) != isBad {
+				t.Fatalf("expected span %d to be stored=%t\n", i, !isBad)
+			}
+		}
+	}
+
+	// A request in which nothing can be decoded fails.
+	spans := createRandomTestSpans(3)
+	code, body := postWriteSpans(t, ht, encodeWriteSpansReqWithBad(t, spans,
+		map[int]string{0: `{"a":NaN}`, 1: `[]`, 2: `{"a":`}))
+	if code != http.StatusBadRequest ||
+		!strings.Contains(string(body), "Failed to decode span 0 out of 3") {
+		t.Fatalf("expected a request with no good spans to fail, but got "+
+			"%d: %s\n", code, string(body))
+	}
+	totalSkipped += 3
+
+	// The skipped spans are counted for the client.
+	resp := ht.Store.msink.GetClientStats("", "", 10)
+	if len(resp.Clients) != 1 || resp.Clients[0].ParseSkipped != totalSkipped {
+		t.Fatalf("expected %d skipped spans, but got %s\n", totalSkipped,
+			asJson(resp))
+	}
+}
+
+func BenchmarkRestWriteSpans(b *testing.B) {
+	benchmarkRestWriteSpans(b, "0")
+}
+
+// Like BenchmarkRestWriteSpans, but with one goroutine per pipeline stage.
+func BenchmarkRestWriteSpansOneWorker(b *testing.B) {
+	benchmarkRestWriteSpans(b, "1")
+}
+
+func benchmarkRestWriteSpans(b *testing.B, concurrency string) {
+	const BATCH_SIZE = 5000
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkRestWriteSpans",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+			conf.HTRACE_LOG_LEVEL:                     "INFO",
+			conf.HTRACE_INGEST_DECODE_CONCURRENCY:     concurrency,
+			conf.HTRACE_INGEST_VALIDATE_CONCURRENCY:   concurrency,
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	rnd := rand.New(rand.NewSource(2))
+	allSpans := make([]*common.Span, b.N)
+	for n := range allSpans {
+		allSpans[n] = test.NewRandomSpan(rnd, allSpans[0:n])
+	}
+	bodies := make([][]byte, 0, b.N/BATCH_SIZE+1)
+	for start := 0; start < b.N; start += BATCH_SIZE {
+		end := start + BATCH_SIZE
+		if end > b.N {
+			end = b.N
+		}
+		bodies = append(bodies, encodeWriteSpansReq(b, allSpans[start:end],
+			-1, ""))
+	}
+	b.ResetTimer()
+	for i := range bodies {
+		code, body := postWriteSpans(b, ht, bodies[i])
+		if code != http.StatusOK {
+			b.Fatalf("WriteSpans failed with %d: %s\n", code, string(body))
+		}
+	}
+	ht.Store.WrittenSpans.Waits(int64(b.N))
+}
@@ -0,0 +1,542 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"hash/crc32"
+	"htrace/common"
+	"htrace/conf"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The intake log.
+//
+// The ingestors acknowledge a request once they have handed its spans to the
+// shard goroutines, which may not have written them yet.  Without the intake
+// log, a crash, or a restart which doesn't wait for the shard queues to
+// drain, loses spans the client was told were fine.
+//
+// Each shard has its own log, in intake.log next to the shard's db directory.
+// WriteSpans appends each batch to the log before queueing it for the shard
+// goroutine, so by the time a request is acknowledged, its spans are in the
+// log.  A record holds the encoded span data, exactly as the shard will write
+// it, along with the address the batch came from.  Records start with their
+// length and a CRC32C, so a record torn by a crash is detected, and dropped
+// along with everything after it.  If the shard is encrypted, the span data
+// is sealed with the shard's data key.
+//
+// Batches are appended and queued in the same order, so the batches a shard
+// has written are always a prefix of its log.  After each batch, the shard
+// goroutine trims the log.  When everything in it has been written, the log
+// is truncated.  If the written prefix grows large while newer batches are
+// still queued, the rest is copied to a new file, which is renamed over the
+// log.  Either way, a crash leaves a log which holds every batch that wasn't
+// written, and maybe some which were.
+//
+// The log is capped at intake.log.max.bytes.  When it is full, WriteSpans
+// waits for the shard goroutine to trim it, which slows down the clients
+// rather than losing spans.  A batch bigger than the cap is let in once the
+// log is empty.
+//
+// On startup, the batches left in the logs are written to their shards
+// before the datastore is returned, and so before we accept any requests.
+// The spans were validated and normalized before they were logged, so they go
+// straight to the shard goroutines.  Going through a SpanIngestor again could
+// drop them for arriving late, or for being over a quota.  Writing a span
+// twice with the same data leaves the same keys, so replaying a batch which
+// was written before the crash, but not trimmed, is harmless.
+//
+
+// The name of the intake log file in a shard's data directory.
+const INTAKE_LOG_FILE_NAME = "intake.log"
+
+// Sync the intake log after each batch is appended.
+const INTAKE_SYNC_ALWAYS = "always"
+
+// Leave syncing the intake log to the operating system.
+const INTAKE_SYNC_NEVER = "never"
+
+// The length of a record header: the payload length, and its CRC32C.
+const INTAKE_RECORD_HEADER_LEN = 8
+
+// The largest record we will read back.  Anything bigger is corrupt.
+const INTAKE_MAX_RECORD_BYTES = 256 * 1024 * 1024
+
+var intakeCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// A batch of spans in the intake log.
+type intakeRecord struct {
+	// The address the spans were sent from.
+	Addr string `json:"a"`
+
+	Spans []intakeSpan `json:"s"`
+}
+
+type intakeSpan struct {
+	Id common.SpanId `json:"i"`
+
+	// The encoded span data, sealed if the shard is encrypted.
+	Data []byte `json:"d"`
+}
+
+type intakeLog struct {
+	lg *common.Logger
+
+	// The path to the log file.
+	path string
+
+	// The maximum size of the log, in bytes.
+	maxBytes int64
+
+	// True if we sync the log after each append.
+	syncAlways bool
+
+	// Seals the span data, or nil if the shard is not encrypted.  This has
+	// its own source of nonces, since the shard goroutine's isn't safe to
+	// share.
+	cipher *spanCipher
+
+	// Held while a batch is appended and queued, so that the batches are
+	// queued in the order they are logged.
+	sendLock sync.Mutex
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// Signalled when the log is trimmed.
+	trimmed *sync.Cond
+
+	// The log file.
+	file *os.File
+
+	// The log position of the start of the file.  Positions count every
+	// byte ever appended, so they don't change when the log is trimmed.
+	base int64
+
+	// The log position of the end of the file.
+	end int64
+
+	// The log position up to which the shard has written the batches.
+	written int64
+
+	// The batches read from the log when it was opened.  See replay.
+	unwritten []*IncomingBatch
+
+	// The current size of the log, in bytes.  Accessed atomically.
+	size int64
+}
+
+// Check the intake.log.sync configuration.
+func checkIntakeSyncPolicy(cnf *conf.Config) (bool, error) {
+	policy := cnf.Get(conf.HTRACE_INTAKE_LOG_SYNC)
+	switch policy {
+	case INTAKE_SYNC_ALWAYS:
+		return true, nil
+	case INTAKE_SYNC_NEVER:
+		return false, nil
+	}
+	return false, errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+		"Expected '%s' or '%s'.", conf.HTRACE_INTAKE_LOG_SYNC, policy,
+		INTAKE_SYNC_ALWAYS, INTAKE_SYNC_NEVER))
+}
+
+// Get the path of the intake log of the shard at shardPath.
+func intakeLogPath(shardPath string) string {
+	return filepath.Join(filepath.Dir(shardPath), INTAKE_LOG_FILE_NAME)
+}
+
+// Open the intake log of a shard, and read back the batches in it.  Anything
+// after the last good record is cut off, so that new records follow it.
+func openIntakeLog(shd *shard, maxBytes int64,
+	syncAlways bool) (*intakeLog, error) {
+	ilg := &intakeLog{
+		lg:         shd.store.lg,
+		path:       intakeLogPath(shd.path),
+		maxBytes:   maxBytes,
+		syncAlways: syncAlways,
+	}
+	ilg.trimmed = sync.NewCond(&ilg.lock)
+	if shd.cipher != nil {
+		ilg.cipher = &spanCipher{
+			aead:   shd.cipher.aead,
+			nonces: bufio.NewReaderSize(rand.Reader, 4096),
+		}
+	}
+	var err error
+	ilg.file, err = os.OpenFile(ilg.path, os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		0666)
+	if err != nil {
+		return nil, err
+	}
+	err = ilg.load(shd)
+	if err != nil {
+		ilg.file.Close()
+		return nil, err
+	}
+	return ilg, nil
+}
+
+// Read the records in the log file.
+func (ilg *intakeLog) load(shd *shard) error {
+	rd := bufio.NewReader(ilg.file)
+	var pos int64
+	hdr := make([]byte, INTAKE_RECORD_HEADER_LEN)
+	for {
+		recordPos := pos
+		_, err := io.ReadFull(rd, hdr)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			ilg.lg.Warnf("Ignoring a torn record header at offset %d of "+
+				"%s: %s\n", pos, ilg.path, err.Error())
+			break
+		}
+		length := binary.BigEndian.Uint32(hdr[0:4])
+		if length > INTAKE_MAX_RECORD_BYTES {
+			ilg.lg.Warnf("Ignoring the rest of %s after offset %d, because "+
+				"the next record claims to be %d bytes long.\n", ilg.path,
+				pos, length)
+			break
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(rd, payload)
+		if err != nil {
+			ilg.lg.Warnf("Ignoring a torn record at offset %d of %s: %s\n",
+				pos, ilg.path, err.Error())
+			break
+		}
+		if crc32.Checksum(payload, intakeCrcTable) !=
+			binary.BigEndian.Uint32(hdr[4:8]) {
+			ilg.lg.Warnf("Ignoring the rest of %s after offset %d, because "+
+				"the next record has a bad checksum.\n", ilg.path, pos)
+			break
+		}
+		pos += INTAKE_RECORD_HEADER_LEN + int64(length)
+		ibatch, err := ilg.decodeRecord(shd, payload)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to decode the record at "+
+				"offset %d of %s: %s", recordPos, ilg.path, err.Error()))
+		}
+		if ibatch != nil {
+			ibatch.intakeEnd = pos
+			ilg.unwritten = append(ilg.unwritten, ibatch)
+		}
+	}
+	if len(ilg.unwritten) == 0 {
+		pos = 0
+	}
+	err := ilg.file.Truncate(pos)
+	if err != nil {
+		return err
+	}
+	ilg.end = pos
+	ilg.updateSize()
+	return nil
+}
+
+// Turn a record back into the batch of spans it was appended for.
+func (ilg *intakeLog) decodeRecord(shd *shard,
+	payload []byte) (*IncomingBatch, error) {
+	var rec intakeRecord
+	err := decodeSpanBytes(payload, &rec)
+	if err != nil {
+		return nil, err
+	}
+	if len(rec.Spans) == 0 {
+		return nil, nil
+	}
+	ibatch := &IncomingBatch{
+		Spans: make([]*IncomingSpan, len(rec.Spans)),
+	}
+	for i := range rec.Spans {
+		sid := rec.Spans[i].Id
+		if problem := sid.FindProblem(); problem != "" {
+			return nil, errors.New(fmt.Sprintf("Invalid span ID: %s",
+				problem))
+		}
+		data, err := shd.openSpanRecord(sid, rec.Spans[i].Data)
+		if err != nil {
+			return nil, err
+		}
+		span, err := decodeSpan(sid, data)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to decode span %s: %s",
+				sid.String(), err.Error()))
+		}
+		ibatch.Spans[i] = &IncomingSpan{
+			Addr:          rec.Addr,
+			Span:          span,
+			SpanDataBytes: data,
+		}
+	}
+	return ibatch, nil
+}
+
+// Write the batches read from the log to the shard, and wait until they have
+// been written.  Returns the number of spans replayed.
+func (ilg *intakeLog) replay(shd *shard) int {
+	numSpans := 0
+	for i := range ilg.unwritten {
+		numSpans += len(ilg.unwritten[i].Spans)
+		shd.incoming <- ilg.unwritten[i]
+	}
+	ilg.unwritten = nil
+	ilg.lock.Lock()
+	for ilg.written < ilg.end {
+		ilg.trimmed.Wait()
+	}
+	ilg.lock.Unlock()
+	return numSpans
+}
+
+// Append a batch of spans to the log, waiting for room if the log is full.
+// Returns the log position of the end of the batch.  The caller must hold
+// sendLock, and queue the batch before releasing it.
+func (ilg *intakeLog) append(ispans []*IncomingSpan) (int64, bool, error) {
+	rec := intakeRecord{
+		Addr:  ispans[0].Addr,
+		Spans: make([]intakeSpan, len(ispans)),
+	}
+	for i := range ispans {
+		rec.Spans[i].Id = ispans[i].Span.Id
+		rec.Spans[i].Data = ispans[i].SpanDataBytes
+		if ilg.cipher != nil {
+			primaryKey := append([]byte{SPAN_ID_INDEX_PREFIX},
+				ispans[i].Span.Id.Val()...)
+			var err error
+			rec.Spans[i].Data, err = ilg.cipher.seal(primaryKey,
+				ispans[i].SpanDataBytes)
+			if err != nil {
+				return 0, false, err
+			}
+		}
+	}
+	payload := make([]byte, 0, 1024)
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+	err := codec.NewEncoderBytes(&payload, &mh).Encode(&rec)
+	if err != nil {
+		return 0, false, err
+	}
+	buf := make([]byte, INTAKE_RECORD_HEADER_LEN,
+		INTAKE_RECORD_HEADER_LEN+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8],
+		crc32.Checksum(payload, intakeCrcTable))
+	buf = append(buf, payload...)
+
+	ilg.lock.Lock()
+	defer ilg.lock.Unlock()
+	waited := false
+	for ilg.end > ilg.base &&
+		ilg.end-ilg.base+int64(len(buf)) > ilg.maxBytes {
+		waited = true
+		ilg.trimmed.Wait()
+	}
+	_, err = ilg.file.Write(buf)
+	if err == nil && ilg.syncAlways {
+		err = ilg.file.Sync()
+	}
+	if err != nil {
+		// We don't know how much of the record made it to the file.  Cut it
+		// off, so that the records we append later can be read back.
+		ilg.file.Truncate(ilg.end - ilg.base)
+		return 0, waited, err
+	}
+	ilg.end += int64(len(buf))
+	ilg.updateSize()
+	return ilg.end, waited, nil
+}
+
+// Called by the shard goroutine once it has written the batches up to the
+// given log position.
+func (ilg *intakeLog) trim(pos int64) {
+	ilg.lock.Lock()
+	defer ilg.lock.Unlock()
+	if pos > ilg.written {
+		ilg.written = pos
+	}
+	if ilg.written == ilg.end {
+		err := ilg.file.Truncate(0)
+		if err != nil {
+			ilg.lg.Errorf("Failed to truncate %s: %s\n", ilg.path,
+				err.Error())
+		} else {
+			ilg.base = ilg.end
+		}
+	} else if ilg.written-ilg.base >= ilg.maxBytes/2 {
+		err := ilg.compact()
+		if err != nil {
+			ilg.lg.Errorf("Failed to compact %s: %s\n", ilg.path,
+				err.Error())
+		}
+	}
+	ilg.updateSize()
+	ilg.trimmed.Broadcast()
+}
+
+// Replace the log with a copy of the batches which haven't been written.
+// Called with the lock held.
+func (ilg *intakeLog) compact() error {
+	tmpPath := ilg.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(tmp, io.NewSectionReader(ilg.file,
+		ilg.written-ilg.base, ilg.end-ilg.written))
+	if err == nil && ilg.syncAlways {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, ilg.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	ilg.file.Close()
+	tmp.Close()
+	ilg.file, err = os.OpenFile(ilg.path, os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		// Appends will fail until the server is restarted.  The log still
+		// has every batch which hasn't been written.
+		return err
+	}
+	ilg.base = ilg.written
+	return nil
+}
+
+func (ilg *intakeLog) updateSize() {
+	atomic.StoreInt64(&ilg.size, ilg.end-ilg.base)
+}
+
+// Get the current size of the log, in bytes.
+func (ilg *intakeLog) Size() uint64 {
+	return uint64(atomic.LoadInt64(&ilg.size))
+}
+
+func (ilg *intakeLog) Close() {
+	ilg.lock.Lock()
+	defer ilg.lock.Unlock()
+	if ilg.file != nil {
+		ilg.file.Close()
+		ilg.file = nil
+	}
+}
+
+// Open the intake logs of the shards, and read back the batches left in them.
+func (store *dataStore) openIntakeLogs(maxBytes int64, syncAlways bool) error {
+	if maxBytes < 1 {
+		maxBytes = 1
+	}
+	var err error
+	for _, shd := range store.shards {
+		if shd.qerr != nil {
+			// Nothing will be written to a quarantined shard, so we leave its
+			// log alone.  Spans sent to it won't be logged.
+			store.lg.Warnf("Not opening the intake log of %s, because the "+
+				"shard is quarantined.\n", shd.path)
+			continue
+		}
+		shd.intake, err = openIntakeLog(shd, maxBytes, syncAlways)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to open the intake log of "+
+				"%s: %s", shd.path, err.Error()))
+		}
+	}
+	return nil
+}
+
+// Close the intake logs of the shards.  Only needed if the shard goroutines
+// were never started, since the shards close their own logs.
+func (store *dataStore) closeIntakeLogs() {
+	for _, shd := range store.shards {
+		if shd.intake != nil {
+			shd.intake.Close()
+			shd.intake = nil
+		}
+	}
+}
+
+// Write the spans left in the intake logs to their shards.  The shard
+// goroutines must be running.
+func (store *dataStore) replayIntakeLogs() {
+	startTime := time.Now()
+	var wg sync.WaitGroup
+	var replayed uint64
+	for _, shd := range store.shards {
+		if shd.intake == nil || len(shd.intake.unwritten) == 0 {
+			continue
+		}
+		wg.Add(1)
+		go func(shd *shard) {
+			defer wg.Done()
+			numSpans := shd.intake.replay(shd)
+			store.lg.Infof("Replayed %d span(s) from %s.\n", numSpans,
+				shd.intake.path)
+			atomic.AddUint64(&replayed, uint64(numSpans))
+		}(shd)
+	}
+	wg.Wait()
+	store.intakeReplayedSpans = replayed
+	store.intakeReplayMs = uint64(time.Since(startTime) / time.Millisecond)
+	if replayed > 0 {
+		store.lg.Infof("Replayed %d span(s) from the intake logs in %dms.\n",
+			replayed, store.intakeReplayMs)
+	}
+}
+
+// Append a batch of spans to the shard's intake log, if it has one, and
+// queue it for the shard goroutine.
+func (shd *shard) logAndQueue(ibatch *IncomingBatch) {
+	ilg := shd.intake
+	if ilg == nil {
+		shd.incoming <- ibatch
+		return
+	}
+	ilg.sendLock.Lock()
+	defer ilg.sendLock.Unlock()
+	end, waited, err := ilg.append(ibatch.Spans)
+	if waited {
+		atomic.AddUint64(&shd.store.intakeLogWaits, 1)
+	}
+	if err != nil {
+		// The spans are still written, but they won't survive a crash.
+		shd.store.lg.Errorf("Failed to append %d span(s) to %s: %s\n",
+			len(ibatch.Spans), ilg.path, err.Error())
+	} else {
+		ibatch.intakeEnd = end
+	}
+	shd.incoming <- ibatch
+}
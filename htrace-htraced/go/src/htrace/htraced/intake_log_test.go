@@ -0,0 +1,268 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Stalls the shard goroutines before they write each batch of spans, until
+// release is closed.  After that, the writes fail if fail is set.
+type stallWritesFaults struct {
+	noFaults
+
+	release chan struct{}
+
+	fail bool
+}
+
+func (swf *stallWritesFaults) ShardWriteDelay() time.Duration {
+	<-swf.release
+	return 0
+}
+
+func (swf *stallWritesFaults) ShardWriteError(span *common.Span) error {
+	if swf.fail {
+		return errors.New("Injected write failure")
+	}
+	return nil
+}
+
+func buildIntakeLogHTraced(t *testing.T, name string, backend string,
+	dataDirs []string, extra map[string]string) *MiniHTraced {
+	cnf := map[string]string{
+		conf.HTRACE_DATASTORE_BACKEND:  backend,
+		conf.HTRACE_INTAKE_LOG_ENABLED: "true",
+	}
+	for k, v := range extra {
+		cnf[k] = v
+	}
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf:                 cnf,
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	return ht
+}
+
+func readIntakeLogs(t *testing.T, dataDirs []string) [][]byte {
+	logs := make([][]byte, len(dataDirs))
+	for i := range dataDirs {
+		var err error
+		logs[i], err = ioutil.ReadFile(filepath.Join(dataDirs[i],
+			INTAKE_LOG_FILE_NAME))
+		if err != nil {
+			t.Fatalf("failed to read the intake log: %s\n", err.Error())
+		}
+	}
+	return logs
+}
+
+func writeIntakeLogs(t *testing.T, dataDirs []string, logs [][]byte) {
+	for i := range dataDirs {
+		err := ioutil.WriteFile(filepath.Join(dataDirs[i],
+			INTAKE_LOG_FILE_NAME), logs[i], 0666)
+		if err != nil {
+			t.Fatalf("failed to write the intake log: %s\n", err.Error())
+		}
+	}
+}
+
+func TestIntakeLogReplay(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testIntakeLogReplay(t, backend)
+	}
+}
+
+func testIntakeLogReplay(t *testing.T, backend string) {
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(), "TestIntakeLogReplay")
+		if err != nil {
+			t.Fatalf("failed to create a temporary directory: %s\n",
+				err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+	ht := buildIntakeLogHTraced(t, "TestIntakeLogReplay", backend, dataDirs,
+		nil)
+	faults := &stallWritesFaults{release: make(chan struct{})}
+	ht.Store.faults = faults
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+
+	// Every span is acknowledged, but none of them can be written.
+	NUM_TEST_SPANS := 300
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	for i := 0; i < NUM_TEST_SPANS; i += 100 {
+		err = hcl.WriteSpans(allSpans[i : i+100])
+		if err != nil {
+			t.Fatalf("WriteSpans failed: %s\n", err.Error())
+		}
+	}
+	hcl.Close()
+	stats := ht.Store.ServerStats()
+	for i := range stats.Dirs {
+		if stats.Dirs[i].IntakeLogBytes == 0 {
+			t.Fatalf("Expected the intake log of %s to hold the unwritten "+
+				"spans.\n", stats.Dirs[i].Path)
+		}
+	}
+
+	// Simulate a crash.  The shards never get to write the spans, and the
+	// logs are left as they were.  The last append was torn.
+	crashLogs := readIntakeLogs(t, dataDirs)
+	crashLogs[0] = append(crashLogs[0], 0, 0, 1, 0, 0xde, 0xad, 0xbe, 0xef)
+	faults.fail = true
+	close(faults.release)
+	ht.Close()
+	for i, log := range readIntakeLogs(t, dataDirs) {
+		if len(log) != 0 {
+			t.Fatalf("Expected the intake log in %s to be empty after the "+
+				"batches were handled, but it has %d bytes.\n", dataDirs[i],
+				len(log))
+		}
+	}
+	writeIntakeLogs(t, dataDirs, crashLogs)
+
+	// Every acknowledged span is replayed when the server restarts.
+	ht = buildIntakeLogHTraced(t, "TestIntakeLogReplay2", backend, dataDirs,
+		nil)
+	expectReplayed := func(ht *MiniHTraced) {
+		stats := ht.Store.ServerStats()
+		if stats.IntakeReplayedSpans != uint64(NUM_TEST_SPANS) {
+			t.Fatalf("Expected %d replayed spans, but got %d\n",
+				NUM_TEST_SPANS, stats.IntakeReplayedSpans)
+		}
+		numSpans := uint64(0)
+		for i := range stats.Dirs {
+			if stats.Dirs[i].IntakeLogBytes != 0 {
+				t.Fatalf("Expected the intake log of %s to be empty after "+
+					"replay, but it has %d bytes.\n", stats.Dirs[i].Path,
+					stats.Dirs[i].IntakeLogBytes)
+			}
+			numSpans += stats.Dirs[i].NumSpans
+		}
+		if numSpans != uint64(NUM_TEST_SPANS) {
+			t.Fatalf("Expected %d spans, but found %d\n", NUM_TEST_SPANS,
+				numSpans)
+		}
+		for i := range allSpans {
+			span := ht.Store.FindSpan(allSpans[i].Id)
+			if span == nil {
+				t.Fatalf("Span %s was acknowledged, but not replayed.\n",
+					allSpans[i].Id.String())
+			}
+			expectSpanStored(t, allSpans[i], span)
+		}
+	}
+	expectReplayed(ht)
+	ht.Close()
+
+	// A crash after the spans were written, but before the logs were
+	// trimmed, replays them again.  That is harmless.
+	writeIntakeLogs(t, dataDirs, crashLogs)
+	ht = buildIntakeLogHTraced(t, "TestIntakeLogReplay3", backend, dataDirs,
+		nil)
+	defer ht.Close()
+	expectReplayed(ht)
+}
+
+func TestIntakeLogBackpressure(t *testing.T) {
+	ht := buildIntakeLogHTraced(t, "TestIntakeLogBackpressure",
+		DATASTORE_BACKEND_LEVELDB, make([]string, 1),
+		map[string]string{conf.HTRACE_INTAKE_LOG_MAX_BYTES: "1"})
+	ht.KeepDataDirsOnClose = false
+	defer ht.Close()
+	faults := &stallWritesFaults{release: make(chan struct{})}
+	ht.Store.faults = faults
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	allSpans := createRandomTestSpans(20)
+
+	// A batch bigger than the log is let into an empty log.
+	err = hcl.WriteSpans(allSpans[0:10])
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+
+	// The next batch waits until the shard has written the first one.
+	done := make(chan error)
+	go func() {
+		done <- hcl.WriteSpans(allSpans[10:20])
+	}()
+	select {
+	case err = <-done:
+		t.Fatalf("WriteSpans returned before the intake log had room: %v\n",
+			err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(faults.release)
+	err = <-done
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(allSpans)))
+	if waits := ht.Store.ServerStats().IntakeLogWaits; waits == 0 {
+		t.Fatalf("Expected the second batch to wait for the intake log.\n")
+	}
+	for i := range allSpans {
+		expectSpanStored(t, allSpans[i],
+			ht.Store.FindSpan(allSpans[i].Id))
+	}
+}
+
+func TestIntakeLogSyncPolicy(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestIntakeLogSyncPolicy",
+		Cnf: map[string]string{
+			conf.HTRACE_INTAKE_LOG_ENABLED: "true",
+			conf.HTRACE_INTAKE_LOG_SYNC:    "sometimes",
+		},
+		DataDirs: make([]string, 1),
+	}
+	_, err := htraceBld.Build()
+	if err == nil {
+		t.Fatalf("Expected an invalid %s to be rejected.\n",
+			conf.HTRACE_INTAKE_LOG_SYNC)
+	}
+	common.AssertErrContains(t, err, conf.HTRACE_INTAKE_LOG_SYNC)
+	for _, dir := range htraceBld.DataDirs {
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,499 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"hash/crc32"
+	"htrace/common"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// The journal datastore backend stores each shard in a journalDB, a
+// persistent key-value store written in pure Go, so that it doesn't need the
+// native leveldb library.  A journalDB keeps all of its keys and values in a
+// memoryDB, and makes them durable by appending each write batch to a journal
+// file in the shard directory.  When the shard is opened, the journal is
+// replayed to rebuild the memoryDB.  Since all the data is held in memory,
+// the journal backend is only suitable for datastores which fit in RAM.
+//
+// Each journal record holds one write batch, so batches are atomic: a record
+// which was only partly written when htraced died is discarded when the
+// journal is replayed.  As with the leveldb backend, writes are not synced to
+// disk, so the most recent writes can be lost if the machine crashes.
+//
+// Once the journal is much larger than the data it holds, it is compacted by
+// writing the live keys to a new journal and renaming it over the old one.
+//
+// The journal format is not compatible with leveldb.  A shard directory
+// created by one backend can't be opened by the other.
+
+// The name of the journal file in a shard directory.
+const JOURNAL_FILE_NAME = "JOURNAL"
+
+// The name of the lock file in a shard directory.  This is the same name
+// leveldb uses.
+const JOURNAL_LOCK_FILE_NAME = "LOCK"
+
+// Each journal record starts with a header holding the length and CRC32C of
+// the record payload, as little-endian 32-bit numbers.
+const JOURNAL_RECORD_HEADER_LEN = 8
+
+// The largest journal record we will read.
+const JOURNAL_MAX_RECORD_LEN = 1024 * 1024 * 1024
+
+// The opcodes in a journal record payload.  A put is followed by the key and
+// the value; a delete is followed by the key.  Keys and values are preceded by
+// their length, as a uvarint.
+const JOURNAL_OP_PUT = 1
+const JOURNAL_OP_DELETE = 2
+
+// We don't compact journals smaller than this.
+const JOURNAL_COMPACTION_MIN_BYTES = 4 * 1024 * 1024
+
+// The approximate size of each record we write when compacting a journal.
+const JOURNAL_COMPACTION_RECORD_BYTES = 1024 * 1024
+
+var journalCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type journalDB struct {
+	*memoryDB
+
+	// The shard directory.
+	path string
+
+	// The locked lock file.
+	lockFile *os.File
+
+	// Protects the journal file.  This is held while appending a batch to the
+	// journal and applying it to the memoryDB, so that the batches are
+	// applied in the order they appear in the journal.
+	jlock sync.Mutex
+
+	// The journal file, opened for appending.
+	file *os.File
+
+	// The size of the journal file.
+	journalBytes int64
+
+	// The journal is compacted once it is larger than this, and more than
+	// twice the size of the live data.
+	compactionMinBytes int64
+
+	// The number of times we have compacted the journal.
+	numCompactions uint64
+}
+
+// Open the journalDB in the given shard directory.  If create is false, the
+// journal must already exist.
+func openJournalDB(lg *common.Logger, path string,
+	create bool) (*journalDB, error) {
+	db := &journalDB{
+		memoryDB:           newMemoryDB(),
+		path:               path,
+		compactionMinBytes: JOURNAL_COMPACTION_MIN_BYTES,
+	}
+	err := db.lock()
+	if err != nil {
+		return nil, err
+	}
+	journalPath := path + "/" + JOURNAL_FILE_NAME
+	flags := os.O_RDWR | os.O_APPEND
+	if create {
+		flags |= os.O_CREATE
+	}
+	db.file, err = os.OpenFile(journalPath, flags, 0644)
+	if err != nil {
+		db.unlock()
+		if os.IsNotExist(err) {
+			return nil, errors.New(fmt.Sprintf("%s does not exist.",
+				journalPath))
+		}
+		return nil, err
+	}
+	err = db.replay(lg)
+	if err == nil {
+		err = db.maybeCompact()
+	}
+	if err != nil {
+		db.file.Close()
+		db.unlock()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Lock the shard directory, so that only one journalDB can use it at once.
+func (db *journalDB) lock() error {
+	lockPath := db.path + "/" + JOURNAL_LOCK_FILE_NAME
+	file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("lock %s: %s", lockPath, err.Error()))
+	}
+	err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		file.Close()
+		// The error message matches leveldb's, so that isLockError
+		// recognizes it.
+		return errors.New(fmt.Sprintf("lock %s: already held by process",
+			lockPath))
+	}
+	db.lockFile = file
+	return nil
+}
+
+func (db *journalDB) unlock() {
+	syscall.Flock(int(db.lockFile.Fd()), syscall.LOCK_UN)
+	db.lockFile.Close()
+	db.lockFile = nil
+}
+
+// Replay the journal into the memoryDB.  A partial record at the end of the
+// journal is truncated away.
+func (db *journalDB) replay(lg *common.Logger) error {
+	_, err := db.file.Seek(0, os.SEEK_SET)
+	if err != nil {
+		return err
+	}
+	rd := bufio.NewReader(db.file)
+	var offset int64
+	var hdr [JOURNAL_RECORD_HEADER_LEN]byte
+	for {
+		_, err = io.ReadFull(rd, hdr[:])
+		if err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return db.truncateTornRecord(lg, offset)
+		} else if err != nil {
+			return err
+		}
+		length := binary.LittleEndian.Uint32(hdr[0:4])
+		if length > JOURNAL_MAX_RECORD_LEN {
+			return errors.New(fmt.Sprintf("The journal in %s is corrupt: the "+
+				"record at offset %d has an invalid length of %d.", db.path,
+				offset, length))
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(rd, payload)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return db.truncateTornRecord(lg, offset)
+		} else if err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, journalCrcTable) !=
+			binary.LittleEndian.Uint32(hdr[4:8]) {
+			return errors.New(fmt.Sprintf("The journal in %s is corrupt: the "+
+				"record at offset %d has an invalid checksum.", db.path,
+				offset))
+		}
+		err = db.applyRecord(payload)
+		if err != nil {
+			return errors.New(fmt.Sprintf("The journal in %s is corrupt: "+
+				"error decoding the record at offset %d: %s", db.path,
+				offset, err.Error()))
+		}
+		offset += int64(JOURNAL_RECORD_HEADER_LEN + len(payload))
+	}
+	db.journalBytes = offset
+	return nil
+}
+
+func (db *journalDB) truncateTornRecord(lg *common.Logger, offset int64) error {
+	lg.Warnf("Discarding the partially written record at offset %d of "+
+		"the journal in %s.\n", offset, db.path)
+	err := db.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	db.journalBytes = offset
+	return nil
+}
+
+// Apply a journal record payload to the memoryDB.
+func (db *journalDB) applyRecord(payload []byte) error {
+	for len(payload) > 0 {
+		op := payload[0]
+		var key, value []byte
+		var err error
+		key, payload, err = readJournalBytes(payload[1:])
+		if err != nil {
+			return err
+		}
+		switch op {
+		case JOURNAL_OP_PUT:
+			value, payload, err = readJournalBytes(payload)
+			if err != nil {
+				return err
+			}
+			db.put(key, value)
+		case JOURNAL_OP_DELETE:
+			db.delete(key)
+		default:
+			return errors.New(fmt.Sprintf("invalid opcode %d", op))
+		}
+	}
+	return nil
+}
+
+// Read a length-prefixed byte slice from a journal record payload.  Returns
+// the slice and the rest of the payload.
+func readJournalBytes(buf []byte) ([]byte, []byte, error) {
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return nil, nil, errors.New("truncated key or value")
+	}
+	end := n + int(length)
+	return buf[n:end], buf[end:], nil
+}
+
+func appendJournalBytes(buf []byte, val []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(val)))
+	buf = append(buf, lenBuf[0:n]...)
+	return append(buf, val...)
+}
+
+// Append a journal record with the given payload to a buffer.
+func appendJournalRecord(buf []byte, payload []byte) []byte {
+	var hdr [JOURNAL_RECORD_HEADER_LEN]byte
+	binary.LittleEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(hdr[4:8],
+		crc32.Checksum(payload, journalCrcTable))
+	buf = append(buf, hdr[:]...)
+	return append(buf, payload...)
+}
+
+func (db *journalDB) Put(wo *levigo.WriteOptions, key []byte, value []byte) error {
+	batch := &memoryBatch{}
+	batch.Put(key, value)
+	return db.Write(wo, batch)
+}
+
+func (db *journalDB) Write(wo *levigo.WriteOptions, batch shardBatch) error {
+	ops := batch.(*memoryBatch).ops
+	if len(ops) == 0 {
+		return nil
+	}
+	payload := make([]byte, 0, 128)
+	for i := range ops {
+		if ops[i].del {
+			payload = append(payload, JOURNAL_OP_DELETE)
+			payload = appendJournalBytes(payload, ops[i].key)
+		} else {
+			payload = append(payload, JOURNAL_OP_PUT)
+			payload = appendJournalBytes(payload, ops[i].key)
+			payload = appendJournalBytes(payload, ops[i].value)
+		}
+	}
+	record := appendJournalRecord(
+		make([]byte, 0, JOURNAL_RECORD_HEADER_LEN+len(payload)), payload)
+	db.jlock.Lock()
+	defer db.jlock.Unlock()
+	if db.file == nil {
+		return errors.New(fmt.Sprintf("The journal in %s is closed.", db.path))
+	}
+	_, err := db.file.Write(record)
+	if err != nil {
+		// Remove any partial record, so that later records can be read.
+		db.file.Truncate(db.journalBytes)
+		return errors.New(fmt.Sprintf("Error writing to the journal in %s: %s",
+			db.path, err.Error()))
+	}
+	db.journalBytes += int64(len(record))
+	db.memoryDB.Write(wo, batch)
+	return db.maybeCompact()
+}
+
+// Compact the journal if it has grown too large.  Must be called with jlock
+// held, or before the journalDB is shared.
+func (db *journalDB) maybeCompact() error {
+	if db.journalBytes < db.compactionMinBytes {
+		return nil
+	}
+	db.memoryDB.lock.RLock()
+	liveBytes := int64(db.memoryDB.size)
+	db.memoryDB.lock.RUnlock()
+	if db.journalBytes < 2*liveBytes {
+		return nil
+	}
+	return db.compact()
+}
+
+// Write the live keys to a new journal, and replace the old journal with it.
+// Must be called with jlock held, or before the journalDB is shared.
+func (db *journalDB) compact() error {
+	journalPath := db.path + "/" + JOURNAL_FILE_NAME
+	tmpPath := journalPath + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if tmp != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+	var written int64
+	err = func() error {
+		db.memoryDB.lock.RLock()
+		defer db.memoryDB.lock.RUnlock()
+		w := bufio.NewWriter(tmp)
+		payload := make([]byte, 0, JOURNAL_COMPACTION_RECORD_BYTES)
+		flushRecord := func() error {
+			record := appendJournalRecord(nil, payload)
+			_, err := w.Write(record)
+			written += int64(len(record))
+			payload = payload[:0]
+			return err
+		}
+		for x := db.memoryDB.head.next[0]; x != nil; x = x.next[0] {
+			payload = append(payload, JOURNAL_OP_PUT)
+			payload = appendJournalBytes(payload, x.key)
+			payload = appendJournalBytes(payload, x.value)
+			if len(payload) >= JOURNAL_COMPACTION_RECORD_BYTES {
+				err := flushRecord()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if len(payload) > 0 {
+			err := flushRecord()
+			if err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error compacting the journal in %s: %s",
+			db.path, err.Error()))
+	}
+	err = os.Rename(tmpPath, journalPath)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error replacing the journal in %s: %s",
+			db.path, err.Error()))
+	}
+	tmp.Close()
+	tmp = nil
+	syncDir(db.path)
+	file, err := os.OpenFile(journalPath, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error reopening the journal in %s: %s",
+			db.path, err.Error()))
+	}
+	db.file.Close()
+	db.file = file
+	db.journalBytes = written
+	db.numCompactions++
+	return nil
+}
+
+// Sync a directory, so that a rename in it is durable.
+func syncDir(path string) {
+	dir, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	dir.Sync()
+	dir.Close()
+}
+
+func (db *journalDB) PropertyValue(name string) string {
+	if name != "leveldb.stats" {
+		return ""
+	}
+	db.jlock.Lock()
+	defer db.jlock.Unlock()
+	db.memoryDB.lock.RLock()
+	defer db.memoryDB.lock.RUnlock()
+	return fmt.Sprintf("journal: %d bytes, live data: %d bytes, "+
+		"compactions: %d", db.journalBytes, db.memoryDB.size,
+		db.numCompactions)
+}
+
+func (db *journalDB) Close() {
+	db.jlock.Lock()
+	defer db.jlock.Unlock()
+	if db.file == nil {
+		return
+	}
+	db.file.Sync()
+	db.file.Close()
+	db.file = nil
+	db.unlock()
+	db.memoryDB.Close()
+}
+
+// A journalDB snapshot is a prefix of its journal.  We keep the journal open,
+// so that we can still read it if it is replaced by a compaction.
+type journalSnapshot struct {
+	file *os.File
+
+	// The length of the journal when the snapshot was taken.
+	numBytes int64
+}
+
+func (db *journalDB) snapshot() (shardSnapshot, error) {
+	db.jlock.Lock()
+	defer db.jlock.Unlock()
+	if db.file == nil {
+		return nil, errors.New(fmt.Sprintf("The journal in %s is closed.", db.path))
+	}
+	file, err := os.Open(db.path + "/" + JOURNAL_FILE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	return &journalSnapshot{file: file, numBytes: db.journalBytes}, nil
+}
+
+// Copy the journal prefix into a new shard directory.
+func (snap *journalSnapshot) writeTo(path string) error {
+	dst, err := os.OpenFile(path+"/"+JOURNAL_FILE_NAME,
+		os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	_, err = io.Copy(dst, io.NewSectionReader(snap.file, 0, snap.numBytes))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error copying the journal to %s: %s",
+			path, err.Error()))
+	}
+	syncDir(path)
+	return nil
+}
+
+func (snap *journalSnapshot) release() {
+	snap.file.Close()
+}
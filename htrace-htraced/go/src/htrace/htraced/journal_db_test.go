@@ -0,0 +1,183 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func newJournalTestLogger(t *testing.T) *common.Logger {
+	cnfBld := conf.Builder{
+		Values:   conf.TEST_VALUES(),
+		Defaults: conf.DEFAULTS,
+	}
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
+	}
+	return common.NewLogger("journal", cnf)
+}
+
+func openTestJournalDB(t *testing.T, lg *common.Logger, path string,
+	create bool) *journalDB {
+	db, err := openJournalDB(lg, path, create)
+	if err != nil {
+		t.Fatalf("failed to open journalDB %s: %s\n", path, err.Error())
+	}
+	return db
+}
+
+func TestJournalDB(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir(os.TempDir(), "TestJournalDB")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s\n", err.Error())
+	}
+	defer os.RemoveAll(path)
+	lg := newJournalTestLogger(t)
+	defer lg.Close()
+
+	_, err = openJournalDB(lg, path, false)
+	common.AssertErrContains(t, err, "does not exist")
+	db := openTestJournalDB(t, lg, path, true)
+
+	// Only one journalDB can use a directory at once.
+	_, err = openJournalDB(lg, path, false)
+	if !isLockError(err) {
+		t.Fatalf("Expected a lock error, but got %v\n", err)
+	}
+
+	rnd := rand.New(rand.NewSource(1885))
+	present := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		batch := db.NewWriteBatch()
+		for j := 0; j < 10; j++ {
+			key := fmt.Sprintf("%08d", rnd.Intn(10000))
+			if rnd.Intn(4) == 0 {
+				batch.Delete([]byte(key))
+				delete(present, key)
+			} else {
+				batch.Put([]byte(key), []byte("v"+key))
+				present[key] = true
+			}
+		}
+		err = db.Write(nil, batch)
+		if err != nil {
+			t.Fatalf("Write failed: %s\n", err.Error())
+		}
+		batch.Close()
+	}
+	keys := make([]string, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expectMemoryDbKeys(t, db.memoryDB, keys)
+	db.Close()
+
+	// The keys are still there after reopening the journal.
+	db = openTestJournalDB(t, lg, path, false)
+	expectMemoryDbKeys(t, db.memoryDB, keys)
+	db.Close()
+
+	// A partially written record at the end of the journal is discarded.
+	journalPath := path + "/" + JOURNAL_FILE_NAME
+	fi, err := os.Stat(journalPath)
+	if err != nil {
+		t.Fatalf("failed to stat %s: %s\n", journalPath, err.Error())
+	}
+	journalLen := fi.Size()
+	torn := appendJournalRecord(nil, []byte{JOURNAL_OP_PUT, 1, 'x', 1, 'y'})
+	file, err := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s\n", journalPath, err.Error())
+	}
+	file.Write(torn[0 : len(torn)-1])
+	file.Close()
+	db = openTestJournalDB(t, lg, path, false)
+	expectMemoryDbKeys(t, db.memoryDB, keys)
+	if db.journalBytes != journalLen {
+		t.Fatalf("Expected the torn record to be truncated, leaving %d "+
+			"bytes, but the journal has %d bytes\n", journalLen,
+			db.journalBytes)
+	}
+	db.Close()
+
+	// A record with a bad checksum is an error.
+	file, err = os.OpenFile(journalPath, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s\n", journalPath, err.Error())
+	}
+	file.WriteAt([]byte{0xff}, JOURNAL_RECORD_HEADER_LEN+1)
+	file.Close()
+	_, err = openJournalDB(lg, path, false)
+	common.AssertErrContains(t, err, "has an invalid checksum")
+}
+
+func TestJournalDBCompaction(t *testing.T) {
+	t.Parallel()
+	path, err := ioutil.TempDir(os.TempDir(), "TestJournalDBCompaction")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s\n", err.Error())
+	}
+	defer os.RemoveAll(path)
+	lg := newJournalTestLogger(t)
+	defer lg.Close()
+
+	db := openTestJournalDB(t, lg, path, true)
+	db.compactionMinBytes = 4096
+	keys := make([]string, 10)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%08d", i)
+	}
+	// Overwrite the same keys many times, so that most of the journal is
+	// garbage.
+	for round := 0; round < 100; round++ {
+		for i := range keys {
+			err = db.Put(nil, []byte(keys[i]), []byte("v"+keys[i]))
+			if err != nil {
+				t.Fatalf("Put failed: %s\n", err.Error())
+			}
+		}
+	}
+	if db.numCompactions == 0 {
+		t.Fatalf("Expected the journal to be compacted.\n")
+	}
+	if db.journalBytes >= 2*db.compactionMinBytes {
+		t.Fatalf("Expected the compacted journal to be smaller than %d "+
+			"bytes, but it was %d bytes\n", 2*db.compactionMinBytes,
+			db.journalBytes)
+	}
+	if !strings.Contains(db.PropertyValue("leveldb.stats"), "compactions: ") {
+		t.Fatalf("Unexpected stats: %s\n", db.PropertyValue("leveldb.stats"))
+	}
+	expectMemoryDbKeys(t, db.memoryDB, keys)
+	db.Close()
+	db = openTestJournalDB(t, lg, path, false)
+	defer db.Close()
+	expectMemoryDbKeys(t, db.memoryDB, keys)
+}
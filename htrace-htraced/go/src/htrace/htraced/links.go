@@ -0,0 +1,134 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+)
+
+// Span links relate spans which don't have a parent-child relationship, and
+// which may be in different traces.  The links of a span are stored with the
+// span itself.  Each link is also indexed in both directions, in the shard of
+// the span which holds the link: the linked-to index is keyed by the source
+// span, and the linked-from index is keyed by the target span.  As with the
+// parent index, finding the spans which link to a given span means scanning
+// every shard.
+
+// Remove links with invalid span IDs, duplicate links, and self-links from a
+// span, preserving the order of the remaining links.  Returns the number of
+// links which were removed.
+func normalizeLinks(span *common.Span) int {
+	links := span.Links
+	j := 0
+	for i := range links {
+		if links[i].Id.FindProblem() != "" || links[i].Id.Equal(span.Id) {
+			continue
+		}
+		duplicate := false
+		for k := 0; k < j; k++ {
+			if links[k].Id.Equal(links[i].Id) && links[k].Type == links[i].Type {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		links[j] = links[i]
+		j++
+	}
+	numRemoved := len(links) - j
+	if len(links) == 0 || j == 0 {
+		span.Links = nil
+	} else if numRemoved > 0 {
+		span.Links = links[0:j]
+	}
+	return numRemoved
+}
+
+// Get the link index keys for a span.
+func spanLinkKeys(span *common.Span, keys [][]byte) [][]byte {
+	for i := range span.Links {
+		target := span.Links[i].Id.Val()
+		keys = append(keys, append(append([]byte{LINKED_TO_INDEX_PREFIX},
+			span.Id.Val()...), target...))
+		keys = append(keys, append(append([]byte{LINKED_FROM_INDEX_PREFIX},
+			target...), span.Id.Val()...))
+	}
+	return keys
+}
+
+// Find the IDs of spans which are linked to or from the given span in this
+// shard.  prefix selects the direction.  Returns the updated list of IDs, and
+// the number of IDs we can still add.
+func (shd *shard) findLinkedIds(prefix byte, sid common.SpanId,
+	ids []common.SpanId, seen map[string]bool, lim int) ([]common.SpanId, int) {
+	searchKey := append([]byte{prefix}, sid.Val()...)
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	for iter.Seek(searchKey); iter.Valid() && lim > 0; iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, searchKey) {
+			break
+		}
+		id := common.SpanId(key[17:])
+		if !seen[string(id)] {
+			seen[string(id)] = true
+			ids = append(ids, id)
+			lim--
+		}
+	}
+	return ids, lim
+}
+
+// Find the spans which are linked to or from the given span in any shard.
+func (store *dataStore) findLinkedSpans(prefix byte, sid common.SpanId,
+	lim int) []*common.Span {
+	ids := make([]common.SpanId, 0)
+	seen := make(map[string]bool)
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if lim > 0 && shd.acquire() {
+			ids, lim = shd.findLinkedIds(prefix, sid, ids, seen, lim)
+			shd.release()
+		}
+	}
+	found := store.FindSpans(ids)
+	spans := make([]*common.Span, 0, len(ids))
+	for _, span := range found {
+		if span == nil {
+			// The target of a link may not have been written yet.
+			continue
+		}
+		spans = append(spans, span)
+	}
+	return spans
+}
+
+// Find up to lim spans which the given span links to, and up to lim spans
+// which link to it.
+func (store *dataStore) FindLinkedSpans(sid common.SpanId,
+	lim int) *common.LinkedSpans {
+	return &common.LinkedSpans{
+		LinksTo:    store.findLinkedSpans(LINKED_TO_INDEX_PREFIX, sid, lim),
+		LinkedFrom: store.findLinkedSpans(LINKED_FROM_INDEX_PREFIX, sid, lim),
+	}
+}
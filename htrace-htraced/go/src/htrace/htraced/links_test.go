@@ -0,0 +1,185 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"testing"
+)
+
+func TestSpanLinksRest(t *testing.T) {
+	testSpanLinksImpl(t, false)
+}
+
+func TestSpanLinksPacked(t *testing.T) {
+	testSpanLinksImpl(t, true)
+}
+
+func expectLinkedIds(t *testing.T, what string, expected []common.SpanId,
+	spans []*common.Span) {
+	if len(spans) != len(expected) {
+		t.Fatalf("Expected %d %s span(s), but got %d: %v\n", len(expected),
+			what, len(spans), spans)
+	}
+	for i := range expected {
+		if !spans[i].Id.Equal(expected[i]) {
+			t.Fatalf("Expected %s span %s, but got %s\n", what,
+				expected[i].String(), spans[i].Id.String())
+		}
+	}
+}
+
+func testSpanLinksImpl(t *testing.T, usePacked bool) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanLinks",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), &htrace.TestHooks{
+		HrpcDisabled: !usePacked,
+	})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// The producer and the consumer are in separate traces.  The consumer
+	// links to the producer which enqueued its message.
+	producerRootId := common.TestId("10000000000000000000000000000001")
+	producerId := common.TestId("10000000000000000000000000000002")
+	consumerRootId := common.TestId("20000000000000000000000000000001")
+	consumerId := common.TestId("20000000000000000000000000000002")
+	producerRoot := &common.Span{Id: producerRootId,
+		SpanData: common.SpanData{
+			Begin:       100,
+			End:         500,
+			Description: "handleRequest",
+			Parents:     []common.SpanId{},
+			TracerId:    "producer",
+		}}
+	producer := &common.Span{Id: producerId,
+		SpanData: common.SpanData{
+			Begin:       200,
+			End:         300,
+			Description: "enqueue",
+			Parents:     []common.SpanId{producerRootId},
+			TracerId:    "producer",
+		}}
+	consumerRoot := &common.Span{Id: consumerRootId,
+		SpanData: common.SpanData{
+			Begin:       1000,
+			End:         2000,
+			Description: "poll",
+			Parents:     []common.SpanId{},
+			TracerId:    "consumer",
+		}}
+	consumer := &common.Span{Id: consumerId,
+		SpanData: common.SpanData{
+			Begin:       1100,
+			End:         1200,
+			Description: "dequeue",
+			Parents:     []common.SpanId{consumerRootId},
+			TracerId:    "consumer",
+			Links: []common.SpanLink{
+				common.SpanLink{Id: producerId,
+					Type: common.LINK_TYPE_FOLLOWS_FROM},
+				// The duplicate link and the self-link should be removed.
+				common.SpanLink{Id: producerId,
+					Type: common.LINK_TYPE_FOLLOWS_FROM},
+				common.SpanLink{Id: consumerId,
+					Type: common.LINK_TYPE_FOLLOWS_FROM},
+			},
+		}}
+	spans := []*common.Span{producerRoot, producer, consumerRoot, consumer}
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+
+	// The stored consumer span should have the cleaned-up links.
+	span, err := hcl.FindSpan(consumerId)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if len(span.Links) != 1 || !span.Links[0].Id.Equal(producerId) ||
+		span.Links[0].Type != common.LINK_TYPE_FOLLOWS_FROM {
+		t.Fatalf("Unexpected links for the consumer span: %v\n", span.Links)
+	}
+
+	// Traverse the link from the consumer to the producer.
+	linked, err := hcl.FindLinkedSpans(consumerId, 10)
+	if err != nil {
+		t.Fatalf("FindLinkedSpans failed: %s\n", err.Error())
+	}
+	expectLinkedIds(t, "linked-to", []common.SpanId{producerId}, linked.LinksTo)
+	expectLinkedIds(t, "linked-from", []common.SpanId{}, linked.LinkedFrom)
+	common.ExpectSpansEqual(t, producer, linked.LinksTo[0])
+
+	// Traverse the link from the producer back to the consumer.
+	linked, err = hcl.FindLinkedSpans(producerId, 10)
+	if err != nil {
+		t.Fatalf("FindLinkedSpans failed: %s\n", err.Error())
+	}
+	expectLinkedIds(t, "linked-to", []common.SpanId{}, linked.LinksTo)
+	expectLinkedIds(t, "linked-from", []common.SpanId{consumerId},
+		linked.LinkedFrom)
+
+	// Spans without links are unaffected.
+	span, err = hcl.FindSpan(producerId)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	common.ExpectSpansEqual(t, producer, span)
+	linked, err = hcl.FindLinkedSpans(producerRootId, 10)
+	if err != nil {
+		t.Fatalf("FindLinkedSpans failed: %s\n", err.Error())
+	}
+	expectLinkedIds(t, "linked-to", []common.SpanId{}, linked.LinksTo)
+	expectLinkedIds(t, "linked-from", []common.SpanId{}, linked.LinkedFrom)
+	children, err := hcl.FindChildren(producerRootId, 10)
+	if err != nil {
+		t.Fatalf("FindChildren failed: %s\n", err.Error())
+	}
+	if len(children) != 1 || !children[0].Equal(producerId) {
+		t.Fatalf("Expected the children of %s to be [%s], but got %v\n",
+			producerRootId.String(), producerId.String(), children)
+	}
+
+	// Rewriting the consumer without the link removes it from the index.
+	rewritten := *consumer
+	rewritten.Links = nil
+	err = hcl.WriteSpans([]*common.Span{&rewritten})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	linked, err = hcl.FindLinkedSpans(producerId, 10)
+	if err != nil {
+		t.Fatalf("FindLinkedSpans failed: %s\n", err.Error())
+	}
+	expectLinkedIds(t, "linked-from", []common.SpanId{}, linked.LinkedFrom)
+}
@@ -29,11 +29,9 @@ import (
 	"htrace/conf"
 	"io"
 	"math"
-	"math/rand"
 	"os"
 	"strings"
 	"syscall"
-	"time"
 )
 
 // Routines for loading the datastore.
@@ -47,28 +45,70 @@ const UNKNOWN_LAYOUT_VERSION = 0
 // The current layout version.  We cannot read layout versions newer than this.
 // We may sometimes be able to read older versions, but only by doing an
 // upgrade.
-const CURRENT_LAYOUT_VERSION = 3
+const CURRENT_LAYOUT_VERSION = 6
 
 type DataStoreLoader struct {
 	// The dataStore logger.
 	lg *common.Logger
 
+	// The datastore backend.  One of the DATASTORE_BACKEND_* constants.
+	backend string
+
 	// True if we should clear the stored data.
 	ClearStored bool
 
+	// True if we should open an existing datastore without writing to it.
+	readOnly bool
+
+	// The placement strategy to record in new datastores.
+	placement string
+
+	// The configured DaemonId, or the empty string to create new
+	// datastores with a random one.  See daemon_id.go.
+	daemonIdStr string
+
+	// True if we should open a datastore which was created with a different
+	// placement strategy.
+	migratePlacement bool
+
+	// True if we should break stale shard directory locks.
+	stealLocks bool
+
+	// The index.description.max.bytes to build description indexes with.
+	descIndexMaxBytes int
+
 	// The shards that we're loading
 	shards []*ShardLoader
 
-	// The options to use for opening datastores in LevelDB.
+	// The options to use for opening datastores in LevelDB.  Shards with
+	// their own block cache have their own options.  See ShardLoader.opts.
 	openOpts *levigo.Options
 
+	// The leveldb bloom filter policy, or nil if the shards don't use bloom
+	// filters.  It must outlive the leveldb instances.
+	filterPolicy *levigo.FilterPolicy
+
 	// The read options to use for LevelDB.
 	readOpts *levigo.ReadOptions
 
 	// The write options to use for LevelDB.
 	writeOpts *levigo.WriteOptions
+
+	// The files holding the current and previous master keys, or empty
+	// strings.  See encryption.go.
+	keyFile     string
+	prevKeyFile string
 }
 
+// Store spans in leveldb instances.
+const DATASTORE_BACKEND_LEVELDB = "leveldb"
+
+// Store spans in memory.  See memory_db.go.
+const DATASTORE_BACKEND_MEMORY = "memory"
+
+// Store spans in journalDBs, which are written in pure Go.  See journal_db.go.
+const DATASTORE_BACKEND_JOURNAL = "journal"
+
 // Information about a Shard.
 type ShardInfo struct {
 	// The layout version of the datastore.
@@ -84,6 +124,70 @@ type ShardInfo struct {
 
 	// The index of this shard within the datastore.
 	ShardIndex uint32
+
+	// The number of spans in this shard.  This is only exact if
+	// SpanCountClean is set.
+	SpanCount uint64
+
+	// True if the shard was closed cleanly, so that SpanCount is exact.  This
+	// is cleared while the shard is open.
+	SpanCountClean bool
+
+	// The placement strategy, which decides which shard each span is stored
+	// in.  Datastores created before this field existed leave it empty, and
+	// use PLACEMENT_MODULO.
+	Placement string
+
+	// The datastore backend which created the shard.  Shards created before
+	// this field existed leave it empty, and were created by the leveldb
+	// backend.
+	Backend string
+
+	// The data key which encrypts the spans in this shard, wrapped with the
+	// master key, or empty if the spans are not encrypted.  See
+	// encryption.go.
+	WrappedDataKey []byte
+
+	// Identifies the master key which wrapped the data key.
+	MasterKeyId string
+
+	// The index.description.max.bytes which the description index of this
+	// shard was built with.  Shards created before this field existed leave
+	// it 0, and use DEFAULT_DESCRIPTION_INDEX_MAX_BYTES.
+	DescriptionIndexMaxBytes int
+}
+
+// Get the index.description.max.bytes recorded in the ShardInfo.
+func (info *ShardInfo) descriptionIndexMaxBytes() int {
+	if info.DescriptionIndexMaxBytes == 0 {
+		return DEFAULT_DESCRIPTION_INDEX_MAX_BYTES
+	}
+	return info.DescriptionIndexMaxBytes
+}
+
+// Get the name of the datastore backend recorded in the ShardInfo.
+func (info *ShardInfo) backendName() string {
+	if info.Backend == "" {
+		return DATASTORE_BACKEND_LEVELDB
+	}
+	return info.Backend
+}
+
+// Get the error to return when a shard directory was created by a different
+// datastore backend than the one we are configured to use.
+func backendMismatchError(path string, created string, configured string) error {
+	return errors.New(fmt.Sprintf("Shard %s was created by the %s datastore "+
+		"backend, but %s is %s.  The backends use different on-disk formats, "+
+		"so a shard can only be opened by the backend which created it.",
+		path, created, conf.HTRACE_DATASTORE_BACKEND, configured))
+}
+
+// Get the name of the placement strategy recorded in the ShardInfo.
+func (info *ShardInfo) placementName() string {
+	if info.Placement == "" {
+		return PLACEMENT_MODULO
+	}
+	return info.Placement
 }
 
 // Create a new datastore loader.
@@ -91,42 +195,89 @@ type ShardInfo struct {
 func NewDataStoreLoader(cnf *conf.Config) *DataStoreLoader {
 	dld := &DataStoreLoader{
 		lg:          common.NewLogger("datastore", cnf),
+		backend:     cnf.Get(conf.HTRACE_DATASTORE_BACKEND),
 		ClearStored: cnf.GetBool(conf.HTRACE_DATA_STORE_CLEAR),
+		readOnly:    cnf.GetBool(conf.HTRACE_READ_ONLY),
+		placement:   cnf.Get(conf.HTRACE_DATASTORE_PLACEMENT),
+		daemonIdStr: cnf.Get(conf.HTRACE_DATASTORE_DAEMON_ID),
+		migratePlacement: cnf.GetBool(
+			conf.HTRACE_DATASTORE_PLACEMENT_MIGRATE),
+		stealLocks:  cnf.GetBool(conf.HTRACE_DATASTORE_LOCK_STEAL),
+		keyFile:     cnf.Get(conf.HTRACE_ENCRYPTION_KEY_FILE),
+		prevKeyFile: cnf.Get(conf.HTRACE_ENCRYPTION_PREVIOUS_KEY_FILE),
+		descIndexMaxBytes: cnf.GetInt(
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES),
 	}
 	dld.readOpts = levigo.NewReadOptions()
 	dld.readOpts.SetFillCache(true)
 	dld.readOpts.SetVerifyChecksums(false)
 	dld.writeOpts = levigo.NewWriteOptions()
 	dld.writeOpts.SetSync(false)
-	dirsStr := cnf.Get(conf.HTRACE_DATA_STORE_DIRECTORIES)
-	rdirs := strings.Split(dirsStr, conf.PATH_LIST_SEP)
-	// Filter out empty entries
-	dirs := make([]string, 0, len(rdirs))
-	for i := range rdirs {
-		if strings.TrimSpace(rdirs[i]) != "" {
-			dirs = append(dirs, rdirs[i])
+	if dld.backend == DATASTORE_BACKEND_MEMORY {
+		numShards := cnf.GetInt(conf.HTRACE_DATASTORE_MEMORY_SHARDS)
+		if numShards < 0 {
+			numShards = 0
 		}
-	}
-	dld.shards = make([]*ShardLoader, len(dirs))
-	for i := range dirs {
-		dld.shards[i] = &ShardLoader{
-			dld:  dld,
-			path: dirs[i] + conf.PATH_SEP + "db",
+		dld.shards = make([]*ShardLoader, numShards)
+		for i := range dld.shards {
+			dld.shards[i] = &ShardLoader{
+				dld:  dld,
+				path: fmt.Sprintf("memory#%d", i),
+			}
+		}
+	} else {
+		dirsStr := cnf.Get(conf.HTRACE_DATA_STORE_DIRECTORIES)
+		rdirs := strings.Split(dirsStr, conf.PATH_LIST_SEP)
+		// Filter out empty entries
+		dirs := make([]string, 0, len(rdirs))
+		for i := range rdirs {
+			if strings.TrimSpace(rdirs[i]) != "" {
+				dirs = append(dirs, rdirs[i])
+			}
+		}
+		dld.shards = make([]*ShardLoader, len(dirs))
+		for i := range dirs {
+			dld.shards[i] = &ShardLoader{
+				dld:  dld,
+				path: dirs[i] + conf.PATH_SEP + "db",
+			}
 		}
 	}
-	dld.openOpts = levigo.NewOptions()
+	maxFdPerShard := dld.calculateMaxOpenFilesPerShard()
+	bloomBitsPerKey := cnf.GetInt(conf.HTRACE_LEVELDB_BLOOM_BITS_PER_KEY)
+	if bloomBitsPerKey > 0 {
+		dld.filterPolicy = levigo.NewBloomFilter(bloomBitsPerKey)
+	}
 	cacheSize := cnf.GetInt(conf.HTRACE_LEVELDB_CACHE_SIZE)
-	dld.openOpts.SetCache(levigo.NewLRUCache(cacheSize))
-	dld.openOpts.SetParanoidChecks(false)
+	dld.openOpts = dld.newOpenOpts(cnf, levigo.NewLRUCache(cacheSize),
+		maxFdPerShard)
+	if cnf.GetBool(conf.HTRACE_LEVELDB_CACHE_PER_SHARD) {
+		for i := range dld.shards {
+			dld.shards[i].openOpts = dld.newOpenOpts(cnf,
+				levigo.NewLRUCache(cacheSize), maxFdPerShard)
+		}
+	}
+	return dld
+}
+
+// Create the options for opening leveldb instances which use the given
+// block cache.
+func (dld *DataStoreLoader) newOpenOpts(cnf *conf.Config,
+	cache *levigo.Cache, maxFdPerShard int) *levigo.Options {
+	opts := levigo.NewOptions()
+	opts.SetCache(cache)
+	opts.SetParanoidChecks(false)
 	writeBufferSize := cnf.GetInt(conf.HTRACE_LEVELDB_WRITE_BUFFER_SIZE)
 	if writeBufferSize > 0 {
-		dld.openOpts.SetWriteBufferSize(writeBufferSize)
+		opts.SetWriteBufferSize(writeBufferSize)
 	}
-	maxFdPerShard := dld.calculateMaxOpenFilesPerShard()
 	if maxFdPerShard > 0 {
-		dld.openOpts.SetMaxOpenFiles(maxFdPerShard)
+		opts.SetMaxOpenFiles(maxFdPerShard)
 	}
-	return dld
+	if dld.filterPolicy != nil {
+		opts.SetFilterPolicy(dld.filterPolicy)
+	}
+	return opts
 }
 
 func (dld *DataStoreLoader) Close() {
@@ -216,6 +367,11 @@ func (dld *DataStoreLoader) LoadShards() {
 
 // Verify that the shard infos are consistent.
 // Reorders the shardInfo structures based on their ShardIndex.
+//
+// Shards which could not be opened are quarantined rather than causing the
+// whole datastore to fail, as long as the other shards contain data.
+// Quarantined shards take whichever shard indices the healthy shards don't
+// claim.
 func (dld *DataStoreLoader) VerifyShardInfos() error {
 	if len(dld.shards) < 1 {
 		return errors.New("No shard directories found.")
@@ -227,55 +383,85 @@ func (dld *DataStoreLoader) VerifyShardInfos() error {
 			return shd.infoErr
 		}
 	}
+	healthy := make([]*ShardLoader, 0, len(dld.shards))
+	quarantined := make([]*ShardLoader, 0)
+	for i := range dld.shards {
+		if dld.shards[i].quarantineErr != nil {
+			quarantined = append(quarantined, dld.shards[i])
+		} else {
+			healthy = append(healthy, dld.shards[i])
+		}
+	}
+	if len(healthy) == 0 {
+		return errors.New(fmt.Sprintf("None of the %d shard(s) could be "+
+			"loaded.  The first error was: %s", len(dld.shards),
+			quarantined[0].quarantineErr.Error()))
+	}
 	// Make sure that if any shards are empty, all shards are empty.
 	emptyShards := ""
 	prefix := ""
-	for i := range dld.shards {
-		if dld.shards[i].info == nil {
-			emptyShards = prefix + dld.shards[i].path
+	for i := range healthy {
+		if healthy[i].info == nil {
+			emptyShards = prefix + healthy[i].path
 			prefix = ", "
 		}
 	}
 	if emptyShards != "" {
-		for i := range dld.shards {
-			if dld.shards[i].info != nil {
+		for i := range healthy {
+			if healthy[i].info != nil {
 				return errors.New(fmt.Sprintf("Shards %s were empty, but "+
 					"the other shards had data.", emptyShards))
 			}
 		}
+		if len(quarantined) > 0 {
+			return errors.New(fmt.Sprintf("Shards %s were empty, but "+
+				"shard %s could not be loaded: %s", emptyShards,
+				quarantined[0].path, quarantined[0].quarantineErr.Error()))
+		}
 		// All shards are empty.
 		return nil
 	}
 	// Make sure that all shards have the same layout version, daemonId, and number of total
 	// shards.
-	layoutVersion := dld.shards[0].info.LayoutVersion
-	daemonId := dld.shards[0].info.DaemonId
-	totalShards := dld.shards[0].info.TotalShards
-	for i := 1; i < len(dld.shards); i++ {
-		shd := dld.shards[i]
+	layoutVersion := healthy[0].info.LayoutVersion
+	daemonId := healthy[0].info.DaemonId
+	totalShards := healthy[0].info.TotalShards
+	placement := healthy[0].info.placementName()
+	for i := 1; i < len(healthy); i++ {
+		shd := healthy[i]
 		if layoutVersion != shd.info.LayoutVersion {
 			return errors.New(fmt.Sprintf("Layout version mismatch.  Shard "+
 				"%s has layout version 0x%016x, but shard %s has layout "+
 				"version 0x%016x.",
-				dld.shards[0].path, layoutVersion, shd.path, shd.info.LayoutVersion))
+				healthy[0].path, layoutVersion, shd.path, shd.info.LayoutVersion))
 		}
 		if daemonId != shd.info.DaemonId {
 			return errors.New(fmt.Sprintf("DaemonId mismatch. Shard %s has "+
 				"daemonId 0x%016x, but shard %s has daemonId 0x%016x.",
-				dld.shards[0].path, daemonId, shd.path, shd.info.DaemonId))
+				healthy[0].path, daemonId, shd.path, shd.info.DaemonId))
 		}
 		if totalShards != shd.info.TotalShards {
 			return errors.New(fmt.Sprintf("TotalShards mismatch.  Shard %s has "+
 				"TotalShards = %d, but shard %s has TotalShards = %d.",
-				dld.shards[0].path, totalShards, shd.path, shd.info.TotalShards))
+				healthy[0].path, totalShards, shd.path, shd.info.TotalShards))
 		}
+		if placement != shd.info.placementName() {
+			return errors.New(fmt.Sprintf("Placement mismatch.  Shard %s has "+
+				"placement %s, but shard %s has placement %s.",
+				healthy[0].path, placement, shd.path,
+				shd.info.placementName()))
+		}
+	}
+	for i := range healthy {
+		shd := healthy[i]
 		if shd.info.ShardIndex >= totalShards {
 			return errors.New(fmt.Sprintf("Invalid ShardIndex.  Shard %s has "+
 				"ShardIndex = %d, but TotalShards = %d.",
 				shd.path, shd.info.ShardIndex, shd.info.TotalShards))
 		}
 	}
-	if layoutVersion != CURRENT_LAYOUT_VERSION {
+	if layoutVersion != CURRENT_LAYOUT_VERSION &&
+		!canUpgradeLayout(layoutVersion) {
 		return errors.New(fmt.Sprintf("The layout version of all shards "+
 			"is %d, but we only support version %d.",
 			layoutVersion, CURRENT_LAYOUT_VERSION))
@@ -286,8 +472,8 @@ func (dld *DataStoreLoader) VerifyShardInfos() error {
 	}
 	// Reorder shards in order of their ShardIndex.
 	reorderedShards := make([]*ShardLoader, len(dld.shards))
-	for i := 0; i < len(dld.shards); i++ {
-		shd := dld.shards[i]
+	for i := range healthy {
+		shd := healthy[i]
 		shardIdx := shd.info.ShardIndex
 		if reorderedShards[shardIdx] != nil {
 			return errors.New(fmt.Sprintf("Both shard %s and "+
@@ -296,12 +482,60 @@ func (dld *DataStoreLoader) VerifyShardInfos() error {
 		}
 		reorderedShards[shardIdx] = shd
 	}
+	shardIdx := 0
+	for i := range quarantined {
+		for reorderedShards[shardIdx] != nil {
+			shardIdx++
+		}
+		reorderedShards[shardIdx] = quarantined[i]
+		dld.lg.Errorf("QUARANTINED shard %s as shard index %d: %s\n",
+			quarantined[i].path, shardIdx, quarantined[i].quarantineErr.Error())
+	}
 	dld.shards = reorderedShards
 	return nil
 }
 
+// Get the ShardInfo of the first shard which has one, or nil if no shards
+// have been initialized.
+func (dld *DataStoreLoader) firstShardInfo() *ShardInfo {
+	for i := range dld.shards {
+		if dld.shards[i].info != nil {
+			return dld.shards[i].info
+		}
+	}
+	return nil
+}
+
 func (dld *DataStoreLoader) Load() error {
 	var err error
+	_, err = NewPlacement(dld.placement, 1)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Invalid value for %s: %s",
+			conf.HTRACE_DATASTORE_PLACEMENT, err.Error()))
+	}
+	if dld.descIndexMaxBytes < 1 {
+		return errors.New(fmt.Sprintf("Invalid value for %s: %d.  "+
+			"Expected a positive number of bytes.",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES, dld.descIndexMaxBytes))
+	}
+	switch dld.backend {
+	case DATASTORE_BACKEND_LEVELDB, DATASTORE_BACKEND_JOURNAL:
+	case DATASTORE_BACKEND_MEMORY:
+		if dld.readOnly {
+			return errors.New(fmt.Sprintf("The %s datastore backend starts "+
+				"out empty, so it can't be used when %s is set.",
+				DATASTORE_BACKEND_MEMORY, conf.HTRACE_READ_ONLY))
+		}
+		return dld.loadMemoryShards()
+	default:
+		return errors.New(fmt.Sprintf("Invalid value for %s: '%s'.  "+
+			"Expected '%s', '%s', or '%s'.", conf.HTRACE_DATASTORE_BACKEND,
+			dld.backend, DATASTORE_BACKEND_LEVELDB, DATASTORE_BACKEND_JOURNAL,
+			DATASTORE_BACKEND_MEMORY))
+	}
+	if dld.readOnly {
+		return dld.loadReadOnly()
+	}
 	// If data.store.clear was set, clear existing data.
 	if dld.ClearStored {
 		err = dld.clearStored()
@@ -323,39 +557,199 @@ func (dld *DataStoreLoader) Load() error {
 	if err != nil {
 		return err
 	}
-	if dld.shards[0].ldb != nil {
-		dld.lg.Infof("Loaded %d leveldb instances with "+
-			"DaemonId of 0x%016x\n", len(dld.shards),
-			dld.shards[0].info.DaemonId)
+	info := dld.firstShardInfo()
+	if info != nil {
+		err = dld.checkDaemonId(info)
+		if err != nil {
+			return err
+		}
+		err = dld.checkPlacement(info)
+		if err != nil {
+			return err
+		}
+		err = dld.upgradeShards()
+		if err != nil {
+			return err
+		}
+		err = dld.rebuildDescriptionIndexes()
+		if err != nil {
+			return err
+		}
+		dld.lg.Infof("Loaded %d %s shards with "+
+			"DaemonId of 0x%016x and placement %s\n", len(dld.shards),
+			dld.backend, info.DaemonId, info.placementName())
 	} else {
 		// Create leveldb instances if needed.
-		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
-		daemonId := uint64(rnd.Int63())
-		dld.lg.Infof("Initializing %d leveldb instances with a new "+
-			"DaemonId of 0x%016x\n", len(dld.shards), daemonId)
-		dld.openOpts.SetCreateIfMissing(true)
+		daemonId, err := dld.newDaemonId()
+		if err != nil {
+			return err
+		}
+		dld.lg.Infof("Initializing %d %s shards with a new "+
+			"DaemonId of 0x%016x\n", len(dld.shards), dld.backend, daemonId)
 		for i := range dld.shards {
 			shd := dld.shards[i]
-			shd.ldb, err = levigo.Open(shd.path, shd.dld.openOpts)
+			shd.opts().SetCreateIfMissing(true)
+			shd.ldb, err = openShardDB(dld.lg, dld.backend, shd.path,
+				shd.opts(), true, dld.stealLocks)
+			shd.opts().SetCreateIfMissing(false)
 			if err != nil {
-				return errors.New(fmt.Sprintf("levigo.Open(%s) failed to "+
+				return errors.New(fmt.Sprintf("Open(%s) failed to "+
 					"create the shard: %s", shd.path, err.Error()))
 			}
 			info := &ShardInfo{
-				LayoutVersion: CURRENT_LAYOUT_VERSION,
-				DaemonId:      daemonId,
-				TotalShards:   uint32(len(dld.shards)),
-				ShardIndex:    uint32(i),
+				LayoutVersion:  CURRENT_LAYOUT_VERSION,
+				DaemonId:       daemonId,
+				TotalShards:    uint32(len(dld.shards)),
+				ShardIndex:     uint32(i),
+				SpanCountClean: true,
+				Placement:      dld.placement,
+				Backend:        dld.backend,
+
+				DescriptionIndexMaxBytes: dld.descIndexMaxBytes,
 			}
 			err = shd.writeShardInfo(info)
 			if err != nil {
-				return errors.New(fmt.Sprintf("levigo.Open(%s) failed to "+
+				return errors.New(fmt.Sprintf("Open(%s) failed to "+
 					"write shard info: %s", shd.path, err.Error()))
 			}
 			dld.lg.Infof("Shard %s initialized with ShardInfo %s \n",
 				shd.path, asJson(info))
+			shd.info = info
 		}
 	}
+	return dld.setupEncryption(true)
+}
+
+// Load an existing datastore for read.only mode.  Unlike Load, this never
+// creates or clears shards.
+func (dld *DataStoreLoader) loadReadOnly() error {
+	if dld.ClearStored {
+		return errors.New(fmt.Sprintf("%s and %s can't both be set.",
+			conf.HTRACE_READ_ONLY, conf.HTRACE_DATA_STORE_CLEAR))
+	}
+	dld.LoadShards()
+	err := dld.VerifyShardInfos()
+	if err != nil {
+		return err
+	}
+	info := dld.firstShardInfo()
+	if info == nil {
+		return errors.New(fmt.Sprintf("%s is set, but there is no existing "+
+			"datastore in %s.", conf.HTRACE_READ_ONLY, dld.shardPaths()))
+	}
+	err = dld.checkDaemonId(info)
+	if err != nil {
+		return err
+	}
+	err = dld.checkPlacement(info)
+	if err != nil {
+		return err
+	}
+	err = checkNoUpgradeNeeded(info, conf.HTRACE_READ_ONLY+" is set")
+	if err != nil {
+		return err
+	}
+	err = dld.checkDescriptionIndexesMatch()
+	if err != nil {
+		return err
+	}
+	err = dld.setupEncryption(false)
+	if err != nil {
+		return err
+	}
+	dld.lg.Infof("Loaded %d %s shards read-only with DaemonId of "+
+		"0x%016x and placement %s\n", len(dld.shards), dld.backend,
+		info.DaemonId, info.placementName())
+	return nil
+}
+
+// Get a comma-separated list of the shard paths.
+func (dld *DataStoreLoader) shardPaths() string {
+	paths := make([]string, len(dld.shards))
+	for i := range dld.shards {
+		paths[i] = dld.shards[i].path
+	}
+	return strings.Join(paths, ", ")
+}
+
+// Load the shards of the datastore snapshot in dir, for verification.  Unlike
+// Load, this never creates or clears shards, and every shard must open
+// cleanly.  The caller must not write to the shards.
+func (dld *DataStoreLoader) LoadSnapshot(dir string) (*common.SnapshotManifest, error) {
+	manifest, err := readSnapshotManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	switch manifest.Backend {
+	case DATASTORE_BACKEND_LEVELDB, DATASTORE_BACKEND_JOURNAL:
+	default:
+		return nil, errors.New(fmt.Sprintf("The snapshot in %s was taken "+
+			"with the %s datastore backend, which does not support snapshots.",
+			dir, manifest.Backend))
+	}
+	if len(manifest.Shards) == 0 {
+		return nil, errors.New(fmt.Sprintf("The snapshot manifest in %s "+
+			"does not list any shards.", dir))
+	}
+	for i := range dld.shards {
+		dld.shards[i].Close()
+	}
+	dld.backend = manifest.Backend
+	dld.shards = make([]*ShardLoader, len(manifest.Shards))
+	for i := range manifest.Shards {
+		dld.shards[i] = &ShardLoader{
+			dld:  dld,
+			path: dir + conf.PATH_SEP + manifest.Shards[i],
+		}
+	}
+	dld.LoadShards()
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.quarantineErr != nil {
+			return nil, shd.quarantineErr
+		}
+		if shd.infoErr == nil && shd.info == nil {
+			return nil, errors.New(fmt.Sprintf("Snapshot shard %s is "+
+				"missing or empty.", shd.path))
+		}
+	}
+	err = dld.VerifyShardInfos()
+	if err != nil {
+		return nil, err
+	}
+	info := dld.firstShardInfo()
+	if info.DaemonId != manifest.DaemonId {
+		return nil, errors.New(fmt.Sprintf("The snapshot manifest in %s has "+
+			"DaemonId 0x%016x, but its shards have DaemonId 0x%016x.",
+			dir, manifest.DaemonId, info.DaemonId))
+	}
+	err = dld.setupEncryption(false)
+	if err != nil {
+		return nil, err
+	}
+	dld.lg.Infof("Loaded a snapshot of %d %s shards with DaemonId of "+
+		"0x%016x from %s\n", len(dld.shards), dld.backend, info.DaemonId, dir)
+	return manifest, nil
+}
+
+// Check that the placement strategy recorded in an existing datastore is the
+// one we were configured to use.  Reads always use the recorded strategy, so
+// a mismatch is only allowed if we were asked to migrate.
+func (dld *DataStoreLoader) checkPlacement(info *ShardInfo) error {
+	recorded := info.placementName()
+	if recorded == dld.placement {
+		return nil
+	}
+	if !dld.migratePlacement {
+		return errors.New(fmt.Sprintf("The datastore was created with "+
+			"placement %s, but %s is %s.  Set %s to true to open it with "+
+			"placement %s anyway.", recorded, conf.HTRACE_DATASTORE_PLACEMENT,
+			dld.placement, conf.HTRACE_DATASTORE_PLACEMENT_MIGRATE, recorded))
+	}
+	dld.lg.Warnf("The datastore was created with placement %s, but %s is "+
+		"%s.  Continuing to use placement %s, since %s is set.\n", recorded,
+		conf.HTRACE_DATASTORE_PLACEMENT, dld.placement, recorded,
+		conf.HTRACE_DATASTORE_PLACEMENT_MIGRATE)
 	return nil
 }
 
@@ -376,6 +770,14 @@ func (dld *DataStoreLoader) clearStored() error {
 			}
 			dld.lg.Infof("Cleared existing datastore directory %s\n", path)
 		}
+		// Spans left in the intake log would be replayed into the empty
+		// shard.
+		err = os.Remove(intakeLogPath(path))
+		if err != nil && !os.IsNotExist(err) {
+			dld.lg.Errorf("Failed to remove %s: %s\n", intakeLogPath(path),
+				err.Error())
+			return err
+		}
 	}
 	return nil
 }
@@ -387,17 +789,44 @@ type ShardLoader struct {
 	// Path to the shard
 	path string
 
-	// Leveldb instance of the shard
-	ldb *levigo.DB
+	// The leveldb instance or memoryDB of the shard
+	ldb shardDB
+
+	// The options for opening the leveldb instance, if the shard has its own
+	// block cache, or nil to use the options of the DataStoreLoader.
+	openOpts *levigo.Options
 
 	// Information about the shard
 	info *ShardInfo
 
 	// If non-null, the error we encountered trying to load the shard info.
 	infoErr error
+
+	// If non-null, the error we encountered trying to open the leveldb
+	// instance.  Shards with this error set are quarantined.
+	quarantineErr error
+
+	// The cipher for the span records, or nil if the shard has no data key.
+	cipher *spanCipher
+
+	// Non-nil if the data key needs to be rewrapped with the current master
+	// key.
+	rewrap *dataKeyRewrap
+}
+
+// Get the options for opening the leveldb instance of the shard.
+func (shd *ShardLoader) opts() *levigo.Options {
+	if shd.openOpts != nil {
+		return shd.openOpts
+	}
+	return shd.dld.openOpts
 }
 
 func (shd *ShardLoader) Close() {
+	if shd.openOpts != nil {
+		shd.openOpts.Close()
+		shd.openOpts = nil
+	}
 	if shd.ldb != nil {
 		shd.ldb.Close()
 		shd.ldb = nil
@@ -407,6 +836,7 @@ func (shd *ShardLoader) Close() {
 // Load information about a particular shard.
 func (shd *ShardLoader) load() {
 	shd.info = nil
+	shd.quarantineErr = nil
 	fi, err := os.Stat(shd.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -451,31 +881,61 @@ func (shd *ShardLoader) load() {
 	}
 	dbDir.Close()
 	dbDir = nil
-	shd.ldb, err = levigo.Open(shd.path, shd.dld.openOpts)
+	shd.infoErr = nil
+	created := shardDirBackend(shd.path)
+	if created != shd.dld.backend {
+		shd.infoErr = backendMismatchError(shd.path, created, shd.dld.backend)
+		return
+	}
+	shd.ldb, err = openShardDB(shd.dld.lg, shd.dld.backend, shd.path,
+		shd.opts(), false, shd.dld.stealLocks)
 	if err != nil {
-		shd.ldb = nil
-		shd.infoErr = errors.New(fmt.Sprintf(
-			"levigo.Open() error on leveldb directory "+
-				"%s: %s.", shd.path, err.Error()))
+		err = errors.New(fmt.Sprintf(
+			"Open() error on %s directory "+
+				"%s: %s.", shd.dld.backend, shd.path, err.Error()))
+		if isLockError(err) {
+			// Someone else is using this shard.  This is a configuration
+			// problem, not a problem with the shard itself.
+			shd.infoErr = err
+		} else {
+			shd.quarantineErr = err
+		}
 		return
 	}
 	shd.info, err = shd.readShardInfo()
 	if err != nil {
-		shd.infoErr = err
+		shd.ldb.Close()
+		shd.ldb = nil
+		shd.quarantineErr = err
 		return
 	}
-	shd.infoErr = nil
+	if shd.info.backendName() != shd.dld.backend {
+		shd.infoErr = backendMismatchError(shd.path,
+			shd.info.backendName(), shd.dld.backend)
+	}
 }
 
 func (shd *ShardLoader) readShardInfo() (*ShardInfo, error) {
-	buf, err := shd.ldb.Get(shd.dld.readOpts, []byte{SHARD_INFO_KEY})
+	return readShardInfo(shd.ldb, shd.dld.readOpts, shd.path)
+}
+
+// Read the ShardInfo from a leveldb instance.
+func readShardInfo(ldb shardDB, readOpts *levigo.ReadOptions,
+	path string) (*ShardInfo, error) {
+	return readShardInfoKey(ldb, readOpts, path, SHARD_INFO_KEY)
+}
+
+// Read a ShardInfo from the given key of a leveldb instance.
+func readShardInfoKey(ldb shardDB, readOpts *levigo.ReadOptions,
+	path string, key byte) (*ShardInfo, error) {
+	buf, err := ldb.Get(readOpts, []byte{key})
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("readShardInfo(%s): failed to "+
-			"read shard info key: %s", shd.path, err.Error()))
+			"read shard info key: %s", path, err.Error()))
 	}
 	if len(buf) == 0 {
 		return nil, errors.New(fmt.Sprintf("readShardInfo(%s): got zero-"+
-			"length value for shard info key.", shd.path))
+			"length value for shard info key.", path))
 	}
 	mh := new(codec.MsgpackHandle)
 	mh.WriteExt = true
@@ -487,12 +947,24 @@ func (shd *ShardLoader) readShardInfo() (*ShardInfo, error) {
 	err = decoder.Decode(shardInfo)
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("readShardInfo(%s): msgpack "+
-			"decoding failed for shard info key: %s", shd.path, err.Error()))
+			"decoding failed for shard info key: %s", path, err.Error()))
 	}
 	return shardInfo, nil
 }
 
 func (shd *ShardLoader) writeShardInfo(info *ShardInfo) error {
+	return writeShardInfo(shd.ldb, shd.dld.writeOpts, info)
+}
+
+// Write the ShardInfo to a leveldb instance.
+func writeShardInfo(ldb shardDB, writeOpts *levigo.WriteOptions,
+	info *ShardInfo) error {
+	return writeShardInfoKey(ldb, writeOpts, SHARD_INFO_KEY, info)
+}
+
+// Write a ShardInfo to the given key of a leveldb instance.
+func writeShardInfoKey(ldb shardDB, writeOpts *levigo.WriteOptions,
+	key byte, info *ShardInfo) error {
 	mh := new(codec.MsgpackHandle)
 	mh.WriteExt = true
 	w := new(bytes.Buffer)
@@ -502,7 +974,7 @@ func (shd *ShardLoader) writeShardInfo(info *ShardInfo) error {
 		return errors.New(fmt.Sprintf("msgpack encoding error: %s",
 			err.Error()))
 	}
-	err = shd.ldb.Put(shd.dld.writeOpts, []byte{SHARD_INFO_KEY}, w.Bytes())
+	err = ldb.Put(writeOpts, []byte{key}, w.Bytes())
 	if err != nil {
 		return errors.New(fmt.Sprintf("leveldb write error: %s",
 			err.Error()))
@@ -0,0 +1,212 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"time"
+)
+
+//
+// Shard directory locks.
+//
+// Both persistent backends lock a file named LOCK in each shard directory.
+// That lock says nothing about who holds it, so beside it we keep a metadata
+// file naming the process which does.  The metadata file is removed when the
+// shard is closed cleanly.  If we get the lock but find metadata left behind
+// by another process, that process exited without closing the shard.  We
+// only break such a stale lock when datastore.lock.steal is set, and when we
+// can prove that the process is gone: it ran on this host, and either no
+// process with its pid is running now, or the process with its pid is this
+// one, which started at a different time.  The latter is common in
+// containers, where the daemon is usually pid 1 every time.
+//
+
+// The name of the lock metadata file in a shard directory.
+const LOCK_INFO_FILE_NAME = "LOCK.info"
+
+// The time when this process started.
+var processStartMs = common.TimeToUnixMs(time.Now().UTC())
+
+// A shardDB whose shard directory lock has metadata.  The metadata is
+// removed when the shardDB is closed.
+type lockedShardDB struct {
+	shardDB
+	lk *common.ShardLock
+}
+
+func (db *lockedShardDB) Close() {
+	// Remove the metadata while we still hold the lock, so that the next
+	// holder doesn't see it.
+	os.Remove(db.lk.Path + "/" + LOCK_INFO_FILE_NAME)
+	db.shardDB.Close()
+}
+
+func (db *lockedShardDB) snapshot() (shardSnapshot, error) {
+	sdb, ok := db.shardDB.(snapshottableDB)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Shard %s does not support "+
+			"snapshots.", db.lk.Path))
+	}
+	return sdb.snapshot()
+}
+
+// Describe the process which holds a lock, for error messages.
+func describeLockHolder(holder *common.LockHolder) string {
+	return fmt.Sprintf("pid %d on host %s, started at %s", holder.Pid,
+		holder.Hostname, time.Unix(0, holder.StartMs*int64(time.Millisecond)).
+			UTC().Format(time.RFC3339))
+}
+
+// Returns the LockHolder which describes this process.
+func thisLockHolder() (*common.LockHolder, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to get the host name: %s",
+			err.Error()))
+	}
+	return &common.LockHolder{
+		Pid:      os.Getpid(),
+		Hostname: hostname,
+		StartMs:  processStartMs,
+	}, nil
+}
+
+// Read the lock metadata in a shard directory.  Returns nil if there is none.
+func readLockHolder(path string) (*common.LockHolder, error) {
+	buf, err := ioutil.ReadFile(path + "/" + LOCK_INFO_FILE_NAME)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var holder common.LockHolder
+	err = json.Unmarshal(buf, &holder)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Unable to parse %s/%s: %s",
+			path, LOCK_INFO_FILE_NAME, err.Error()))
+	}
+	return &holder, nil
+}
+
+// Write the lock metadata in a shard directory.  The metadata is written to
+// a temporary file and renamed into place, so readers never see part of it.
+func writeLockHolder(path string, holder *common.LockHolder) error {
+	buf, err := json.Marshal(holder)
+	if err != nil {
+		return err
+	}
+	tmpPath := path + "/" + LOCK_INFO_FILE_NAME + ".tmp"
+	err = ioutil.WriteFile(tmpPath, buf, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path+"/"+LOCK_INFO_FILE_NAME)
+}
+
+// Returns true if the given lock holder has provably exited.  We can only
+// tell for processes on this host.  A process we can't signal for lack of
+// permission is still running.  A holder with our pid is an earlier process
+// which had the same pid, unless it also has our start time.
+func lockHolderIsGone(holder *common.LockHolder, self *common.LockHolder) bool {
+	if holder.Hostname != self.Hostname || holder.Pid <= 0 {
+		return false
+	}
+	if holder.Pid == self.Pid {
+		return holder.StartMs != self.StartMs
+	}
+	return syscall.Kill(holder.Pid, syscall.Signal(0)) == syscall.ESRCH
+}
+
+// Add what we know about the holder of a shard directory lock to the error
+// from a failed attempt to get it.
+func describeLockError(path string, err error) error {
+	holder, herr := readLockHolder(path)
+	if herr != nil || holder == nil {
+		return err
+	}
+	return errors.New(fmt.Sprintf("%s.  The holder is %s", err.Error(),
+		describeLockHolder(holder)))
+}
+
+// Record that we hold the lock of a shard directory, which the backend has
+// just locked.  Fails if another process left metadata behind, unless that
+// process is gone and stealLock is set.
+func lockShardDir(lg *common.Logger, path string,
+	stealLock bool) (*common.ShardLock, error) {
+	self, err := thisLockHolder()
+	if err != nil {
+		return nil, err
+	}
+	lk := &common.ShardLock{
+		Path:   path,
+		Holder: *self,
+	}
+	prev, err := readLockHolder(path)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("lock %s/LOCK: unable to read "+
+			"the lock metadata, so the lock may still be held: %s",
+			path, err.Error()))
+	}
+	if prev != nil {
+		if !lockHolderIsGone(prev, self) {
+			return nil, errors.New(fmt.Sprintf("lock %s/LOCK: held by %s, "+
+				"which may still be running.  The lock will not be broken.",
+				path, describeLockHolder(prev)))
+		}
+		if !stealLock {
+			return nil, errors.New(fmt.Sprintf("lock %s/LOCK: held by %s, "+
+				"which is no longer running.  Set %s to break the lock.",
+				path, describeLockHolder(prev),
+				conf.HTRACE_DATASTORE_LOCK_STEAL))
+		}
+		lg.Warnf("Breaking the stale lock on %s, which was held by %s.\n",
+			path, describeLockHolder(prev))
+		lk.StolenFrom = prev
+	}
+	err = writeLockHolder(path, self)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("lock %s/LOCK: unable to write "+
+			"the lock metadata: %s", path, err.Error()))
+	}
+	lk.AcquiredMs = common.TimeToUnixMs(time.Now().UTC())
+	return lk, nil
+}
+
+// Get the shard directory locks which this datastore holds.
+func (store *dataStore) Locks() []common.ShardLock {
+	locks := make([]common.ShardLock, 0, len(store.shards))
+	for _, shd := range store.shards {
+		shd.ldbLock.RLock()
+		if ldb, ok := shd.ldb.(*lockedShardDB); ok {
+			locks = append(locks, *ldb.lk)
+		}
+		shd.ldbLock.RUnlock()
+	}
+	return locks
+}
@@ -0,0 +1,179 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func buildForLockTest(name string, backend string, dataDirs []string,
+	steal bool) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:    backend,
+			conf.HTRACE_DATASTORE_LOCK_STEAL: fmt.Sprintf("%t", steal),
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+// Get the pid of a process which has exited.
+func exitedPid(t *testing.T) int {
+	cmd := exec.Command("true")
+	err := cmd.Run()
+	if err != nil {
+		t.Fatalf("failed to run true: %s\n", err.Error())
+	}
+	return cmd.Process.Pid
+}
+
+func testLocks(t *testing.T, backend string) {
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(),
+			fmt.Sprintf("TestLocks%s%d", backend, i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+	ht, err := buildForLockTest("TestLocks"+backend, backend, dataDirs, false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	locks, err := hcl.GetLocks()
+	if err != nil {
+		t.Fatalf("GetLocks failed: %s\n", err.Error())
+	}
+	if len(locks) != 2 || locks[0].Holder.Pid != os.Getpid() ||
+		locks[0].StolenFrom != nil {
+		t.Fatalf("unexpected locks %s\n", asJson(locks))
+	}
+	shardPaths := []string{locks[0].Path, locks[1].Path}
+
+	// A second daemon can't use the shards, and is told who has them.
+	_, err = buildForLockTest("TestLocksSharer"+backend, backend, dataDirs,
+		true)
+	common.AssertErrContains(t, err, "/LOCK")
+	common.AssertErrContains(t, err, fmt.Sprintf("pid %d", os.Getpid()))
+	ht.Close()
+	for _, path := range shardPaths {
+		if _, err := os.Stat(path + "/" + LOCK_INFO_FILE_NAME); err == nil {
+			t.Fatalf("%s was not removed by a clean close.\n", path)
+		}
+	}
+
+	// Leave behind the metadata of a process which exited without closing
+	// the first shard.
+	hostname, _ := os.Hostname()
+	stale := &common.LockHolder{Pid: exitedPid(t), Hostname: hostname,
+		StartMs: 1445540632000}
+	err = writeLockHolder(shardPaths[0], stale)
+	if err != nil {
+		t.Fatalf("failed to write the lock metadata: %s\n", err.Error())
+	}
+	_, err = buildForLockTest("TestLocksNoSteal"+backend, backend, dataDirs,
+		false)
+	common.AssertErrContains(t, err, "no longer running")
+	common.AssertErrContains(t, err, conf.HTRACE_DATASTORE_LOCK_STEAL)
+	common.AssertErrContains(t, err, describeLockHolder(stale))
+
+	// Processes which may still be running keep their locks, even when
+	// we're allowed to steal stale ones.
+	for _, live := range []*common.LockHolder{
+		&common.LockHolder{Pid: os.Getppid(), Hostname: hostname},
+		&common.LockHolder{Pid: stale.Pid, Hostname: hostname + ".other"},
+		&common.LockHolder{Pid: os.Getpid(), Hostname: hostname,
+			StartMs: processStartMs},
+	} {
+		err = writeLockHolder(shardPaths[0], live)
+		if err != nil {
+			t.Fatalf("failed to write the lock metadata: %s\n", err.Error())
+		}
+		_, err = buildForLockTest("TestLocksLive"+backend, backend,
+			dataDirs, true)
+		common.AssertErrContains(t, err, "may still be running")
+		common.AssertErrContains(t, err, describeLockHolder(live))
+	}
+
+	// An earlier process which had our pid, as a daemon which is always
+	// pid 1 in its container does, is gone.
+	recycled := &common.LockHolder{Pid: os.Getpid(), Hostname: hostname,
+		StartMs: stale.StartMs}
+	err = writeLockHolder(shardPaths[0], recycled)
+	if err != nil {
+		t.Fatalf("failed to write the lock metadata: %s\n", err.Error())
+	}
+	ht, err = buildForLockTest("TestLocksRecycled"+backend, backend,
+		dataDirs, true)
+	if err != nil {
+		t.Fatalf("failed to break the lock of an earlier process with our "+
+			"pid: %s", err.Error())
+	}
+	locks = ht.Store.Locks()
+	if len(locks) != 2 || locks[0].StolenFrom == nil ||
+		*locks[0].StolenFrom != *recycled {
+		t.Fatalf("unexpected locks %s\n", asJson(locks))
+	}
+	ht.Close()
+
+	err = writeLockHolder(shardPaths[0], stale)
+	if err != nil {
+		t.Fatalf("failed to write the lock metadata: %s\n", err.Error())
+	}
+	ht, err = buildForLockTest("TestLocksSteal"+backend, backend, dataDirs,
+		true)
+	if err != nil {
+		t.Fatalf("failed to break the stale lock: %s", err.Error())
+	}
+	defer ht.Close()
+	locks = ht.Store.Locks()
+	if len(locks) != 2 || locks[0].StolenFrom == nil ||
+		*locks[0].StolenFrom != *stale || locks[1].StolenFrom != nil {
+		t.Fatalf("unexpected locks %s\n", asJson(locks))
+	}
+	holder, err := readLockHolder(shardPaths[0])
+	if err != nil || holder == nil || holder.Pid != os.Getpid() {
+		t.Fatalf("expected the lock metadata to name us, but got %v, %v\n",
+			holder, err)
+	}
+}
+
+func TestLocks(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testLocks(t, backend)
+	}
+}
@@ -0,0 +1,93 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"time"
+)
+
+// Heartbeat markers let consumers which tail the datastore tell the
+// difference between a period in which no spans were produced, and a period
+// in which htraced was not running or lost data.  If they are enabled, the
+// first shard writes a marker on each datastore heartbeat.  Each marker
+// records the server time and the cumulative number of spans ingested since
+// the server started.  Markers live in their own key range, so they never show
+// up in span queries or span metrics.  Like arrival time entries, the reaper
+// prunes markers which are older than the reaper date.
+
+// Write a heartbeat marker to this shard.
+func (shd *shard) writeHeartbeatMarker() {
+	lg := shd.store.lg
+	marker := common.HeartbeatMarker{
+		TimeMs:        common.TimeToUnixMs(time.Now().UTC()),
+		StartMs:       shd.store.startMs,
+		IngestedSpans: shd.store.msink.GetIngestedSpans(),
+	}
+	buf, err := json.Marshal(&marker)
+	if err != nil {
+		lg.Errorf("Error marshalling heartbeat marker: %s\n", err.Error())
+		return
+	}
+	key := append([]byte{HEARTBEAT_MARKER_PREFIX},
+		u64toSlice(s2u64(marker.TimeMs))...)
+	err = shd.ldb.Put(shd.store.writeOpts, key, buf)
+	if err != nil {
+		lg.Errorf("Error writing heartbeat marker to shard %s: %s\n",
+			shd.path, err.Error())
+		return
+	}
+	lg.Tracef("Wrote heartbeat marker %s to shard %s\n", string(buf), shd.path)
+}
+
+// Find heartbeat markers written at or after the given time, in milliseconds
+// since the epoch.  Returns at most lim markers, in time order.
+func (store *dataStore) FindHeartbeatMarkers(sinceMs int64,
+	lim int) ([]*common.HeartbeatMarker, error) {
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Shard %s, which holds the heartbeat markers, is quarantined.",
+			shd.path)
+	}
+	defer shd.release()
+	markers := make([]*common.HeartbeatMarker, 0)
+	prefix := []byte{HEARTBEAT_MARKER_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	iter.Seek(append([]byte{HEARTBEAT_MARKER_PREFIX}, u64toSlice(s2u64(sinceMs))...))
+	for ; iter.Valid() && len(markers) < lim; iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		var marker common.HeartbeatMarker
+		err := json.Unmarshal(iter.Value(), &marker)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error unmarshalling heartbeat "+
+				"marker in shard %s: %s", shd.path, err.Error()))
+		}
+		markers = append(markers, &marker)
+	}
+	return markers, nil
+}
@@ -0,0 +1,399 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"htrace/common"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The memory datastore backend keeps each shard in a memoryDB, a sorted
+// in-memory key-value store, instead of a leveldb instance.  The shards use
+// the same keys and indices as they do with leveldb, so queries, child
+// lookups, and everything else behave the same way.  Nothing is persisted,
+// and there are no shard directories, lock files, or ShardInfo to verify.
+//
+// Since memory is limited, the memory backend holds at most
+// datastore.memory.max.spans spans.  The limit is divided evenly between the
+// shards.  When a shard is over its limit, the shard goroutine evicts the
+// spans with the oldest begin times.
+
+// The maximum height of the memoryDB skip list.  With a branching factor of
+// 4, this is plenty for billions of keys.
+const MEMORY_DB_MAX_LEVEL = 16
+
+type memoryDbNode struct {
+	key   []byte
+	value []byte
+	next  []*memoryDbNode
+}
+
+// A sorted in-memory key-value store, implemented as a skip list.
+type memoryDB struct {
+	// Protects everything below.
+	lock sync.RWMutex
+
+	// The head of the skip list.  This node has no key.
+	head *memoryDbNode
+
+	// The current height of the skip list.
+	level int
+
+	// The random number generator used to pick node heights.
+	rnd *rand.Rand
+
+	// The total number of bytes of keys and values.
+	size uint64
+}
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		head: &memoryDbNode{
+			next: make([]*memoryDbNode, MEMORY_DB_MAX_LEVEL),
+		},
+		level: 1,
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Find the first node whose key is greater than or equal to the given key.
+// If prev is non-nil, it is filled in with the last node before that one at
+// each level.
+func (db *memoryDB) findGreaterOrEqual(key []byte,
+	prev []*memoryDbNode) *memoryDbNode {
+	x := db.head
+	for lvl := db.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil && bytes.Compare(x.next[lvl].key, key) < 0 {
+			x = x.next[lvl]
+		}
+		if prev != nil {
+			prev[lvl] = x
+		}
+	}
+	return x.next[0]
+}
+
+// Find the last node whose key is less than the given key, or nil if there is
+// none.
+func (db *memoryDB) findLessThan(key []byte) *memoryDbNode {
+	prev := make([]*memoryDbNode, MEMORY_DB_MAX_LEVEL)
+	db.findGreaterOrEqual(key, prev)
+	if prev[0] == db.head {
+		return nil
+	}
+	return prev[0]
+}
+
+// Find the last node, or nil if the memoryDB is empty.
+func (db *memoryDB) findLast() *memoryDbNode {
+	x := db.head
+	for lvl := db.level - 1; lvl >= 0; lvl-- {
+		for x.next[lvl] != nil {
+			x = x.next[lvl]
+		}
+	}
+	if x == db.head {
+		return nil
+	}
+	return x
+}
+
+func (db *memoryDB) put(key []byte, value []byte) {
+	prev := make([]*memoryDbNode, MEMORY_DB_MAX_LEVEL)
+	x := db.findGreaterOrEqual(key, prev)
+	value = append([]byte{}, value...)
+	if x != nil && bytes.Equal(x.key, key) {
+		db.size = db.size - uint64(len(x.value)) + uint64(len(value))
+		x.value = value
+		return
+	}
+	height := 1
+	for height < MEMORY_DB_MAX_LEVEL && db.rnd.Intn(4) == 0 {
+		height++
+	}
+	for ; db.level < height; db.level++ {
+		prev[db.level] = db.head
+	}
+	x = &memoryDbNode{
+		key:   append([]byte{}, key...),
+		value: value,
+		next:  make([]*memoryDbNode, height),
+	}
+	for lvl := 0; lvl < height; lvl++ {
+		x.next[lvl] = prev[lvl].next[lvl]
+		prev[lvl].next[lvl] = x
+	}
+	db.size += uint64(len(key) + len(value))
+}
+
+func (db *memoryDB) delete(key []byte) {
+	prev := make([]*memoryDbNode, MEMORY_DB_MAX_LEVEL)
+	x := db.findGreaterOrEqual(key, prev)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return
+	}
+	for lvl := range x.next {
+		prev[lvl].next[lvl] = x.next[lvl]
+	}
+	db.size -= uint64(len(x.key) + len(x.value))
+	for db.level > 1 && db.head.next[db.level-1] == nil {
+		db.level--
+	}
+}
+
+// Get the value of a key.  Like leveldb, returns nil if the key is not
+// present.
+func (db *memoryDB) Get(ro *levigo.ReadOptions, key []byte) ([]byte, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	x := db.findGreaterOrEqual(key, nil)
+	if x == nil || !bytes.Equal(x.key, key) {
+		return nil, nil
+	}
+	return append([]byte{}, x.value...), nil
+}
+
+func (db *memoryDB) Put(wo *levigo.WriteOptions, key []byte, value []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	db.put(key, value)
+	return nil
+}
+
+type memoryBatchOp struct {
+	key   []byte
+	value []byte
+	del   bool
+}
+
+// A batch of writes to a memoryDB.  The writes are applied atomically.
+type memoryBatch struct {
+	ops []memoryBatchOp
+}
+
+func (batch *memoryBatch) Put(key []byte, value []byte) {
+	batch.ops = append(batch.ops, memoryBatchOp{key: key, value: value})
+}
+
+func (batch *memoryBatch) Delete(key []byte) {
+	batch.ops = append(batch.ops, memoryBatchOp{key: key, del: true})
+}
+
+func (batch *memoryBatch) Close() {
+	batch.ops = nil
+}
+
+func (db *memoryDB) NewWriteBatch() shardBatch {
+	return &memoryBatch{}
+}
+
+func (db *memoryDB) Write(wo *levigo.WriteOptions, batch shardBatch) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for _, op := range batch.(*memoryBatch).ops {
+		if op.del {
+			db.delete(op.key)
+		} else {
+			db.put(op.key, op.value)
+		}
+	}
+	return nil
+}
+
+// An iterator over a memoryDB.  Rather than holding on to a node, which could
+// be removed from the skip list, the iterator remembers its current key, and
+// looks up the next or previous key as needed.  Like a leveldb iterator
+// without a snapshot, it may or may not see concurrent writes.
+type memoryIterator struct {
+	db    *memoryDB
+	key   []byte
+	value []byte
+}
+
+func (db *memoryDB) NewIterator(ro *levigo.ReadOptions) shardIterator {
+	return &memoryIterator{db: db}
+}
+
+func (iter *memoryIterator) setNode(x *memoryDbNode) {
+	if x == nil {
+		iter.key = nil
+		iter.value = nil
+	} else {
+		iter.key = x.key
+		iter.value = x.value
+	}
+}
+
+func (iter *memoryIterator) Seek(key []byte) {
+	iter.db.lock.RLock()
+	defer iter.db.lock.RUnlock()
+	iter.setNode(iter.db.findGreaterOrEqual(key, nil))
+}
+
+func (iter *memoryIterator) SeekToFirst() {
+	iter.db.lock.RLock()
+	defer iter.db.lock.RUnlock()
+	iter.setNode(iter.db.head.next[0])
+}
+
+func (iter *memoryIterator) SeekToLast() {
+	iter.db.lock.RLock()
+	defer iter.db.lock.RUnlock()
+	iter.setNode(iter.db.findLast())
+}
+
+func (iter *memoryIterator) Valid() bool {
+	return iter.key != nil
+}
+
+func (iter *memoryIterator) Key() []byte {
+	return append([]byte{}, iter.key...)
+}
+
+func (iter *memoryIterator) Value() []byte {
+	return append([]byte{}, iter.value...)
+}
+
+func (iter *memoryIterator) Next() {
+	iter.db.lock.RLock()
+	defer iter.db.lock.RUnlock()
+	x := iter.db.findGreaterOrEqual(iter.key, nil)
+	if x != nil && bytes.Equal(x.key, iter.key) {
+		x = x.next[0]
+	}
+	iter.setNode(x)
+}
+
+func (iter *memoryIterator) Prev() {
+	iter.db.lock.RLock()
+	defer iter.db.lock.RUnlock()
+	iter.setNode(iter.db.findLessThan(iter.key))
+}
+
+func (iter *memoryIterator) GetError() error {
+	return nil
+}
+
+func (iter *memoryIterator) Close() {
+}
+
+// Get the number of bytes of keys and values in each range.
+func (db *memoryDB) GetApproximateSizes(ranges []levigo.Range) []uint64 {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	sizes := make([]uint64, len(ranges))
+	for i := range ranges {
+		x := db.findGreaterOrEqual(ranges[i].Start, nil)
+		for ; x != nil && bytes.Compare(x.key, ranges[i].Limit) < 0; x = x.next[0] {
+			sizes[i] += uint64(len(x.key) + len(x.value))
+		}
+	}
+	return sizes
+}
+
+func (db *memoryDB) PropertyValue(name string) string {
+	return ""
+}
+
+func (db *memoryDB) Close() {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	for lvl := range db.head.next {
+		db.head.next[lvl] = nil
+	}
+	db.level = 1
+	db.size = 0
+}
+
+// Create the shards of a memory datastore.
+func (dld *DataStoreLoader) loadMemoryShards() error {
+	if len(dld.shards) == 0 {
+		return errors.New("The memory datastore backend needs at least " +
+			"one shard.")
+	}
+	daemonId, err := dld.newDaemonId()
+	if err != nil {
+		return err
+	}
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		shd.ldb = newMemoryDB()
+		shd.info = &ShardInfo{
+			LayoutVersion:  CURRENT_LAYOUT_VERSION,
+			DaemonId:       daemonId,
+			TotalShards:    uint32(len(dld.shards)),
+			ShardIndex:     uint32(i),
+			SpanCountClean: true,
+			Placement:      dld.placement,
+			Backend:        DATASTORE_BACKEND_MEMORY,
+
+			DescriptionIndexMaxBytes: dld.descIndexMaxBytes,
+		}
+		err := shd.writeShardInfo(shd.info)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to write shard info "+
+				"to %s: %s", shd.path, err.Error()))
+		}
+	}
+	dld.lg.Infof("Created %d memory shards with DaemonId 0x%016x\n",
+		len(dld.shards), daemonId)
+	return nil
+}
+
+// Evict the spans with the oldest begin times until the shard holds no more
+// than maxShardSpans spans.  This is called from the shard goroutine.
+func (shd *shard) evictOldestSpans() {
+	lg := shd.store.lg
+	numSpans := atomic.LoadUint64(&shd.numSpans)
+	if numSpans <= shd.store.maxShardSpans {
+		return
+	}
+	toEvict := numSpans - shd.store.maxShardSpans
+	var evicted uint64
+	prefix := []byte{BEGIN_TIME_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid() && evicted < toEvict; iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		span := shd.FindSpan(common.SpanId(key[9:]))
+		if span == nil {
+			continue
+		}
+		err := shd.DeleteSpan(span)
+		if err != nil {
+			lg.Errorf("Error evicting span %s from shard %s: %s\n",
+				span.String(), shd.path, err.Error())
+			break
+		}
+		evicted++
+	}
+	atomic.AddUint64(&shd.store.evictedSpans, evicted)
+	lg.Debugf("Evicted %d span(s) from shard %s.\n", evicted, shd.path)
+}
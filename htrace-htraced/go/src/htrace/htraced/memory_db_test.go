@@ -0,0 +1,361 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func expectMemoryDbKeys(t *testing.T, db *memoryDB, keys []string) {
+	iter := db.NewIterator(nil)
+	defer iter.Close()
+	idx := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		if idx >= len(keys) {
+			t.Fatalf("Found unexpected key %s\n", string(iter.Key()))
+		}
+		if string(iter.Key()) != keys[idx] {
+			t.Fatalf("Expected key %s at index %d, but got %s\n",
+				keys[idx], idx, string(iter.Key()))
+		}
+		if string(iter.Value()) != "v"+keys[idx] {
+			t.Fatalf("Expected value v%s for key %s, but got %s\n",
+				keys[idx], keys[idx], string(iter.Value()))
+		}
+		idx++
+	}
+	if idx != len(keys) {
+		t.Fatalf("Expected %d keys, but found %d\n", len(keys), idx)
+	}
+	idx = len(keys) - 1
+	for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+		if string(iter.Key()) != keys[idx] {
+			t.Fatalf("Expected key %s at index %d when iterating "+
+				"backwards, but got %s\n", keys[idx], idx, string(iter.Key()))
+		}
+		idx--
+	}
+	if idx != -1 {
+		t.Fatalf("Iterating backwards stopped at index %d\n", idx)
+	}
+}
+
+func TestMemoryDB(t *testing.T) {
+	db := newMemoryDB()
+	defer db.Close()
+	rnd := rand.New(rand.NewSource(1876))
+	present := make(map[string]bool)
+	batch := db.NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%08d", rnd.Intn(100000))
+		present[key] = true
+		if i%2 == 0 {
+			batch.Put([]byte(key), []byte("v"+key))
+		} else {
+			db.Put(nil, []byte(key), []byte("v"+key))
+		}
+	}
+	db.Write(nil, batch)
+	batch.Close()
+	keys := make([]string, 0, len(present))
+	for key := range present {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	expectMemoryDbKeys(t, db, keys)
+
+	// Seek finds the first key at or after the given one.
+	iter := db.NewIterator(nil)
+	defer iter.Close()
+	for i := 0; i < 100; i++ {
+		target := fmt.Sprintf("%08d", rnd.Intn(100000))
+		idx := sort.SearchStrings(keys, target)
+		iter.Seek([]byte(target))
+		if idx == len(keys) {
+			if iter.Valid() {
+				t.Fatalf("Expected seeking to %s to find nothing, but "+
+					"found %s\n", target, string(iter.Key()))
+			}
+			continue
+		}
+		if !iter.Valid() || string(iter.Key()) != keys[idx] {
+			t.Fatalf("Expected seeking to %s to find %s\n", target, keys[idx])
+		}
+	}
+
+	// Delete every other key.
+	batch = db.NewWriteBatch()
+	remaining := make([]string, 0, len(keys))
+	for i := range keys {
+		if i%2 == 0 {
+			batch.Delete([]byte(keys[i]))
+		} else {
+			remaining = append(remaining, keys[i])
+		}
+	}
+	db.Write(nil, batch)
+	batch.Close()
+	expectMemoryDbKeys(t, db, remaining)
+	val, err := db.Get(nil, []byte(keys[0]))
+	if err != nil || val != nil {
+		t.Fatalf("Expected Get to find nothing for deleted key %s\n", keys[0])
+	}
+	val, err = db.Get(nil, []byte(keys[1]))
+	if err != nil || string(val) != "v"+keys[1] {
+		t.Fatalf("Expected Get to find v%s for key %s\n", keys[1], keys[1])
+	}
+}
+
+func buildBackendHTraced(t *testing.T, name string, inMemory bool,
+	cnf map[string]string) *MiniHTraced {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		InMemory:     inMemory,
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	for k, v := range cnf {
+		htraceBld.Cnf[k] = v
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create %s: %s", name, err.Error())
+	}
+	return ht
+}
+
+func toJson(t *testing.T, val interface{}) string {
+	buf := new(bytes.Buffer)
+	err := json.NewEncoder(buf).Encode(val)
+	if err != nil {
+		t.Fatalf("Failed to encode %v to JSON: %s\n", val, err.Error())
+	}
+	return string(buf.Bytes())
+}
+
+// Run the same queries against the leveldb and memory backends, and check
+// that they return the same results.
+func TestMemoryBackendQueries(t *testing.T) {
+	t.Parallel()
+	cnf := map[string]string{
+		conf.HTRACE_DATASTORE_MEMORY_SHARDS: "2",
+	}
+	lht := buildBackendHTraced(t, "TestMemoryBackendQueriesLevelDb", false, cnf)
+	defer lht.Close()
+	mht := buildBackendHTraced(t, "TestMemoryBackendQueriesMemory", true, cnf)
+	defer mht.Close()
+	allSpans := make([]common.Span, 0)
+	allSpans = append(allSpans, SIMPLE_TEST_SPANS...)
+	randomSpans := createRandomTestSpans(100)
+	for i := range randomSpans {
+		allSpans = append(allSpans, *randomSpans[i])
+	}
+	createSpans(allSpans, lht.Store)
+	createSpans(allSpans, mht.Store)
+
+	queries := []*common.Query{
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.LESS_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME,
+					Val:   "125",
+				},
+				common.Predicate{
+					Op:    common.EQUALS,
+					Field: common.DESCRIPTION,
+					Val:   "getFileDescriptors",
+				},
+			},
+			Lim: 2,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.CONTAINS,
+					Field: common.DESCRIPTION,
+					Val:   "Fd",
+				},
+				common.Predicate{
+					Op:    common.GREATER_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME,
+					Val:   "100",
+				},
+			},
+			Lim: 5,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.LESS_THAN_OR_EQUALS,
+					Field: common.SPAN_ID,
+					Val:   common.TestId("00000000000000000000000000000002").String(),
+				},
+			},
+			Lim: 200,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.GREATER_THAN,
+					Field: common.DESCRIPTION,
+					Val:   "openFd",
+				},
+			},
+			Lim: 20,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.GREATER_THAN,
+					Field: common.END_TIME,
+					Val:   "200",
+				},
+			},
+			Lim: 500,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.GREATER_THAN_OR_EQUALS,
+					Field: common.DURATION,
+					Val:   "10",
+				},
+			},
+			Lim: 30,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.EQUALS,
+					Field: common.TRACER_ID,
+					Val:   allSpans[10].TracerId,
+				},
+			},
+			Lim: 30,
+		},
+		&common.Query{
+			Predicates: []common.Predicate{},
+			Lim:        1000,
+		},
+	}
+	for i := range queries {
+		query := queries[i]
+		for {
+			lspans, err, lscanned := lht.Store.HandleQuery(query)
+			if err != nil {
+				t.Fatalf("leveldb query %s failed: %s\n", query.String(),
+					err.Error())
+			}
+			mspans, err, mscanned := mht.Store.HandleQuery(query)
+			if err != nil {
+				t.Fatalf("memory query %s failed: %s\n", query.String(),
+					err.Error())
+			}
+			common.ExpectStrEqual(t, toJson(t, lspans), toJson(t, mspans))
+			if !reflect.DeepEqual(lscanned, mscanned) {
+				t.Fatalf("Query %s scanned %v rows with leveldb, but %v "+
+					"with memory\n", query.String(), lscanned, mscanned)
+			}
+			if len(lspans) < query.Lim || len(lspans) == 0 {
+				break
+			}
+			// Fetch the next page.
+			query = &common.Query{
+				Predicates: query.Predicates,
+				Lim:        query.Lim,
+				Prev:       lspans[len(lspans)-1],
+			}
+		}
+	}
+	for i := range randomSpans {
+		sid := randomSpans[i].Id
+		common.ExpectStrEqual(t,
+			toJson(t, lht.Store.FindChildren(sid, 100)),
+			toJson(t, mht.Store.FindChildren(sid, 100)))
+	}
+}
+
+func TestMemoryBackendEviction(t *testing.T) {
+	t.Parallel()
+	ht := buildBackendHTraced(t, "TestMemoryBackendEviction", true,
+		map[string]string{
+			conf.HTRACE_DATASTORE_MEMORY_SHARDS:    "1",
+			conf.HTRACE_DATASTORE_MEMORY_MAX_SPANS: "10",
+		})
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ver, err := hcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	if ver.DatastoreBackend != DATASTORE_BACKEND_MEMORY || ver.Persistent ||
+		ver.MaxSpans != 10 {
+		t.Fatalf("Unexpected server info for the memory backend: %s\n",
+			asJson(ver))
+	}
+	NUM_TEST_SPANS := 25
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	for i := range allSpans {
+		allSpans[i].Begin = int64(1000 + i)
+		allSpans[i].End = int64(2000 + i)
+	}
+	ingestSpans(ht, allSpans)
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.NumSpans != 10 {
+		t.Fatalf("Expected the memory datastore to hold 10 spans, but it "+
+			"holds %d\n", stats.NumSpans)
+	}
+	if stats.EvictedSpans != uint64(NUM_TEST_SPANS-10) {
+		t.Fatalf("Expected %d evicted spans, but got %d\n",
+			NUM_TEST_SPANS-10, stats.EvictedSpans)
+	}
+	if stats.OldestBeginMs != int64(1000+NUM_TEST_SPANS-10) {
+		t.Fatalf("Expected the oldest span to begin at %d, but got %d\n",
+			1000+NUM_TEST_SPANS-10, stats.OldestBeginMs)
+	}
+	for i := range allSpans {
+		span := ht.Store.FindSpan(allSpans[i].Id)
+		if i < NUM_TEST_SPANS-10 {
+			if span != nil {
+				t.Fatalf("Expected span %d to be evicted\n", i)
+			}
+		} else {
+			common.ExpectSpansEqual(t, allSpans[i], span)
+		}
+	}
+}
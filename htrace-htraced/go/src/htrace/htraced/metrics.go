@@ -23,7 +23,10 @@ import (
 	"htrace/common"
 	"htrace/conf"
 	"math"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,6 +42,8 @@ import (
 
 const LATENCY_CIRC_BUF_SIZE = 4096
 
+const NUM_PARENTS_CIRC_BUF_SIZE = 4096
+
 type MetricsSink struct {
 	// The metrics sink logger.
 	lg *common.Logger
@@ -55,34 +60,161 @@ type MetricsSink struct {
 	// The total number of spans dropped by the server.
 	ServerDropped uint64
 
+	// The total number of spans dropped because their shard was quarantined.
+	// These are also counted in ServerDropped.
+	QuarantineDropped uint64
+
+	// The total number of spans which were left out of the duration index.
+	IndexSkipped uint64
+
+	// The total number of spans which had more parents than
+	// index.max.parents.
+	ParentIndexTruncated uint64
+
+	// The total number of invalid info entries removed from ingested spans.
+	InfoStripped uint64
+
+	// The span with the most parents ingested since the server started, and
+	// how many parents it had.
+	MaxNumParents         uint64
+	MaxNumParentsSpanId   common.SpanId
+	MaxNumParentsTracerId string
+
+	// The total number of spans ingested with each span flag set, indexed by
+	// flag bit.
+	Flagged [common.NUM_SPAN_FLAGS]uint64
+
+	// The total number of failed spans ingested.  See SpanData#Error.
+	ErrorSpans uint64
+
+	// The total number of spans dropped because their tracer was over a
+	// quota.  These are also counted in ServerDropped.
+	QuotaRejected   uint64
+	QuotaSampledOut uint64
+
 	// Per-host Span Metrics
 	HostSpanMetrics common.SpanMetricsMap
 
+	// Tracks which of the keys of HostSpanMetrics was least recently updated,
+	// so that we know which one to evict.
+	hostLru *addrLru
+
+	// The keys of HostSpanMetrics, in sorted order.  This lets us return the
+	// per-host metrics a page at a time without copying or sorting the whole
+	// map.
+	hostAddrs []string
+
+	// Counts the distinct span descriptions used by each tracer.  This has
+	// its own lock.
+	descs *descriptionTracker
+
+	// Counts the spans written by each principal.  This has its own lock.
+	principals *spanCountTracker
+
+	// Counts the failed spans of each tracer.  This has its own lock.
+	tracerErrors *spanCountTracker
+
+	// Tracks the clients which send spans that end before they begin.  This
+	// has its own lock.  See negative_durations.go.
+	negDurations *negativeDurationTracker
+
 	// The last few writeSpan latencies
-	wsLatencyCircBuf *CircBufU32
+	wsLatencyCircBuf *common.CircBufU32
+
+	// The numbers of parents of the last few spans ingested.
+	numParentsCircBuf *common.CircBufU32
+
+	// The response times of the REST endpoints.  These have their own
+	// locks.  See endpoint_sli.go.
+	slis *endpointSlis
+
+	// The total time the REST ingest pipeline stages have spent working.
+	// See ingest_pipeline.go.
+	ingestDecodeTime   time.Duration
+	ingestValidateTime time.Duration
+
+	// The history of the ingest counters.  See history.go.
+	history *statsHistory
+
+	// The channel the datastore heartbeater uses to ask us to rotate the
+	// history buckets, or nil if nothing rotates them.
+	histHeartbeats chan interface{}
+
+	// Tracks whether the history rotation goroutine has exited.
+	histExited sync.WaitGroup
+
+	// The HRPC connection metrics.  These are updated via sync/atomic rather
+	// than under the lock.
+	HrpcOpenConnections   int64
+	HrpcIdleCloses        uint64
+	HrpcDeadlineAborts    uint64
+	HrpcAcceptRejections  uint64
+	HrpcOversizedMessages uint64
+	HrpcMalformedFrames   uint64
+
+	// The UDP listener metrics.  Like the HRPC metrics, these are updated
+	// via sync/atomic.
+	UdpDatagrams          uint64
+	UdpDecodeFailures     uint64
+	UdpTruncatedDatagrams uint64
+	UdpOversizedDatagrams uint64
+	UdpPausedDatagrams    uint64
+
+	// The number of requests denied for each permission.  See auth.go.  Like
+	// the HRPC metrics, these are updated via sync/atomic.
+	AuthReadDenials  uint64
+	AuthWriteDenials uint64
+	AuthAdminDenials uint64
+
+	// The ingest and persist updates which haven't been merged yet.  See
+	// metrics_delta.go.
+	stripes [METRICS_STRIPES]metricsStripe
+
+	// The sequence number of the last ingest or persist update.  This is
+	// updated via sync/atomic.
+	updateSeq uint64
+
+	// If true, every update is merged straight away.  Benchmarks set this.
+	unbatched bool
 
 	// Lock protecting all metrics
 	lock sync.Mutex
 }
 
 func NewMetricsSink(cnf *conf.Config) *MetricsSink {
-	return &MetricsSink{
-		lg:               common.NewLogger("metrics", cnf),
-		maxMtx:           cnf.GetInt(conf.HTRACE_METRICS_MAX_ADDR_ENTRIES),
-		HostSpanMetrics:  make(common.SpanMetricsMap),
-		wsLatencyCircBuf: NewCircBufU32(LATENCY_CIRC_BUF_SIZE),
+	lg := common.NewLogger("metrics", cnf)
+	msink := &MetricsSink{
+		lg:                lg,
+		maxMtx:            cnf.GetInt(conf.HTRACE_METRICS_MAX_ADDR_ENTRIES),
+		HostSpanMetrics:   make(common.SpanMetricsMap),
+		hostLru:           newAddrLru(),
+		descs:             newDescriptionTracker(lg, cnf),
+		principals:        newPrincipalTracker(lg, cnf),
+		tracerErrors:      newTracerErrorTracker(lg, cnf),
+		negDurations:      newNegativeDurationTracker(),
+		wsLatencyCircBuf:  common.NewCircBufU32(LATENCY_CIRC_BUF_SIZE),
+		numParentsCircBuf: common.NewCircBufU32(NUM_PARENTS_CIRC_BUF_SIZE),
+		slis:              newEndpointSlis(cnf),
+		history:           newStatsHistory(cnf),
 	}
+	for i := range msink.stripes {
+		msink.stripes[i].delta = newMetricsDelta()
+	}
+	return msink
 }
 
 // Update the total number of spans which were ingested, as well as other
 // metrics that get updated during span ingest.
 func (msink *MetricsSink) UpdateIngested(addr string, totalIngested int,
-	serverDropped int, wsLatency time.Duration) {
-	msink.lock.Lock()
-	defer msink.lock.Unlock()
-	msink.IngestedSpans += uint64(totalIngested)
-	msink.ServerDropped += uint64(serverDropped)
-	msink.updateSpanMetrics(addr, 0, serverDropped)
+	serverDropped int, duplicateParents int, selfParents int,
+	wsLatency time.Duration) {
+	stripe, mtx := msink.beginUpdate(addr)
+	delta := stripe.delta
+	delta.IngestedSpans += uint64(totalIngested)
+	delta.ServerDropped += uint64(serverDropped)
+	mtx.ServerDropped += uint64(serverDropped)
+	mtx.DuplicateParents += uint64(duplicateParents)
+	mtx.SelfParents += uint64(selfParents)
 	wsLatencyMs := wsLatency.Nanoseconds() / 1000000
 	var wsLatency32 uint32
 	if wsLatencyMs > math.MaxUint32 {
@@ -90,105 +222,273 @@ func (msink *MetricsSink) UpdateIngested(addr string, totalIngested int,
 	} else {
 		wsLatency32 = uint32(wsLatencyMs)
 	}
-	msink.wsLatencyCircBuf.Append(wsLatency32)
+	delta.wsLatencies = append(delta.wsLatencies, wsLatency32)
+	msink.finishUpdate(stripe)
 }
 
-// Update the per-host span metrics.  Must be called with the lock held.
-func (msink *MetricsSink) updateSpanMetrics(addr string, numWritten int,
-	serverDropped int) {
+// Update the number of spans from an address which ended before they began,
+// and record the worst of them.
+func (msink *MetricsSink) UpdateNegativeDurations(addr string, numSpans int,
+	worst *common.Span, worstMs int64) {
+	stripe, mtx := msink.beginUpdate(addr)
+	mtx.NegativeDurations += uint64(numSpans)
+	msink.finishUpdate(stripe)
+	msink.negDurations.observe(addr, numSpans, worst, worstMs,
+		common.TimeToUnixMs(time.Now().UTC()))
+}
+
+// Update the number of span documents from an address which could not be
+// parsed, and were skipped.
+func (msink *MetricsSink) UpdateParseSkipped(addr string, parseSkipped int) {
+	stripe, mtx := msink.beginUpdate(addr)
+	mtx.ParseSkipped += uint64(parseSkipped)
+	msink.finishUpdate(stripe)
+}
+
+// Update the number of invalid info entries removed from the spans sent by an
+// address, and the number of reserved info keys it sent.
+func (msink *MetricsSink) UpdateInfoValidation(addr string, infoStripped int,
+	reservedInfoKeys int) {
+	stripe, mtx := msink.beginUpdate(addr)
+	stripe.delta.InfoStripped += uint64(infoStripped)
+	mtx.ReservedInfoKeys += uint64(reservedInfoKeys)
+	msink.finishUpdate(stripe)
+}
+
+// Get the per-host span metrics for an address, creating them if needed.
+// seq is the sequence number of the latest update to the address.  Must be
+// called with the lock held.
+func (msink *MetricsSink) getSpanMetrics(addr string,
+	seq uint64) *common.SpanMetrics {
 	mtx, found := msink.HostSpanMetrics[addr]
 	if !found {
 		// Ensure that the per-host span metrics map doesn't grow too large.
-		if len(msink.HostSpanMetrics) >= msink.maxMtx {
-			// Delete a random entry
-			for k := range msink.HostSpanMetrics {
-				msink.lg.Warnf("Evicting metrics entry for addr %s "+
-					"because there are more than %d addrs.\n", k, msink.maxMtx)
-				delete(msink.HostSpanMetrics, k)
-				break
-			}
+		if len(msink.HostSpanMetrics) >= msink.maxMtx &&
+			msink.hostLru.Len() > 0 {
+			// Delete the least recently updated entry
+			k := msink.hostLru.evict()
+			msink.lg.Warnf("Evicting metrics entry for addr %s "+
+				"because there are more than %d addrs.\n", k, msink.maxMtx)
+			delete(msink.HostSpanMetrics, k)
+			idx := sort.SearchStrings(msink.hostAddrs, k)
+			msink.hostAddrs = append(msink.hostAddrs[:idx],
+				msink.hostAddrs[idx+1:]...)
 		}
 		mtx = &common.SpanMetrics{}
 		msink.HostSpanMetrics[addr] = mtx
+		idx := sort.SearchStrings(msink.hostAddrs, addr)
+		msink.hostAddrs = append(msink.hostAddrs, "")
+		copy(msink.hostAddrs[idx+1:], msink.hostAddrs[idx:])
+		msink.hostAddrs[idx] = addr
 	}
-	mtx.Written += uint64(numWritten)
-	mtx.ServerDropped += uint64(serverDropped)
+	msink.hostLru.touch(addr, seq)
+	return mtx
+}
+
+// Record the description of an ingested span, so that we can find tracers
+// which use too many distinct descriptions.  Returns true if the span's
+// tracer has reached metrics.description.cardinality.limit.
+func (msink *MetricsSink) UpdateDescription(tracerId string,
+	desc string) bool {
+	return msink.descs.observe(tracerId, desc)
+}
+
+// Record that a principal wrote some spans.
+func (msink *MetricsSink) UpdatePrincipal(principal string, numSpans int) {
+	msink.principals.observe(principal, numSpans)
+}
+
+// Move the description statistics of a tracer which is being renamed.
+func (msink *MetricsSink) RenameTracer(from string, to string) {
+	msink.descs.rename(from, to)
 }
 
 // Update the total number of spans which were persisted to disk.
 func (msink *MetricsSink) UpdatePersisted(addr string, totalWritten int,
 	serverDropped int) {
+	stripe, mtx := msink.beginUpdate(addr)
+	delta := stripe.delta
+	delta.WrittenSpans += uint64(totalWritten)
+	delta.ServerDropped += uint64(serverDropped)
+	mtx.Written += uint64(totalWritten)
+	mtx.ServerDropped += uint64(serverDropped)
+	msink.finishUpdate(stripe)
+}
+
+// Update the total number of spans which were dropped because their shard was
+// quarantined.
+func (msink *MetricsSink) UpdateQuarantineDropped(quarantineDropped int) {
 	msink.lock.Lock()
 	defer msink.lock.Unlock()
-	msink.WrittenSpans += uint64(totalWritten)
-	msink.ServerDropped += uint64(serverDropped)
-	msink.updateSpanMetrics(addr, totalWritten, serverDropped)
+	msink.QuarantineDropped += uint64(quarantineDropped)
+	msink.history.current().QuarantineDroppedSpans += uint64(quarantineDropped)
 }
 
-// Read the server stats.
-func (msink *MetricsSink) PopulateServerStats(stats *common.ServerStats) {
+// Update the total number of spans which were left out of the duration index.
+func (msink *MetricsSink) UpdateIndexSkipped(indexSkipped int) {
 	msink.lock.Lock()
 	defer msink.lock.Unlock()
-	stats.IngestedSpans = msink.IngestedSpans
-	stats.WrittenSpans = msink.WrittenSpans
-	stats.ServerDroppedSpans = msink.ServerDropped
-	stats.MaxWriteSpansLatencyMs = msink.wsLatencyCircBuf.Max()
-	stats.AverageWriteSpansLatencyMs = msink.wsLatencyCircBuf.Average()
-	stats.HostSpanMetrics = make(common.SpanMetricsMap)
-	for k, v := range msink.HostSpanMetrics {
-		stats.HostSpanMetrics[k] = &common.SpanMetrics{
-			Written:       v.Written,
-			ServerDropped: v.ServerDropped,
-		}
+	msink.IndexSkipped += uint64(indexSkipped)
+}
+
+// Update the parent count metrics with the number of parents of each span an
+// ingestor accepted.  widest is the span with the most parents, or nil if
+// none of them had more than one.
+func (msink *MetricsSink) UpdateParentCounts(counts []uint32,
+	truncated int, widest *common.Span) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	for i := range counts {
+		msink.numParentsCircBuf.Append(counts[i])
+	}
+	msink.ParentIndexTruncated += uint64(truncated)
+	if widest != nil && uint64(len(widest.Parents)) > msink.MaxNumParents {
+		msink.MaxNumParents = uint64(len(widest.Parents))
+		msink.MaxNumParentsSpanId = widest.Id
+		msink.MaxNumParentsTracerId = widest.TracerId
 	}
 }
 
-// A circular buffer of uint32s which supports appending and taking the
-// average, and some other things.
-type CircBufU32 struct {
-	// The next slot to fill
-	slot int
+// Update the number of spans ingested with each span flag set.
+func (msink *MetricsSink) UpdateFlagged(flagged *[common.NUM_SPAN_FLAGS]int) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	for i := range flagged {
+		msink.Flagged[i] += uint64(flagged[i])
+	}
+}
 
-	// The number of slots which are in use.  This number only ever
-	// increases until the buffer is full.
-	slotsUsed int
+// Update the number of failed spans ingested, in total and for each tracer.
+func (msink *MetricsSink) UpdateErrors(byTracer map[string]int) {
+	total := 0
+	for trid, numSpans := range byTracer {
+		msink.tracerErrors.observe(trid, numSpans)
+		total += numSpans
+	}
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.ErrorSpans += uint64(total)
+}
 
-	// The buffer
-	buf []uint32
+// Update the total number of spans which were dropped because their tracer
+// was over a quota.
+func (msink *MetricsSink) UpdateQuotaDropped(rejected int, sampledOut int) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.QuotaRejected += uint64(rejected)
+	msink.QuotaSampledOut += uint64(sampledOut)
+	bucket := msink.history.current()
+	bucket.QuotaRejectedSpans += uint64(rejected)
+	bucket.QuotaSampledOutSpans += uint64(sampledOut)
 }
 
-func NewCircBufU32(size int) *CircBufU32 {
-	return &CircBufU32{
-		slotsUsed: -1,
-		buf:       make([]uint32, size),
-	}
+// Add the time the stages of the REST ingest pipeline spent on a request.
+func (msink *MetricsSink) UpdateIngestStages(decode time.Duration,
+	validate time.Duration) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.ingestDecodeTime += decode
+	msink.ingestValidateTime += validate
 }
 
-func (cbuf *CircBufU32) Max() uint32 {
-	var max uint32
-	for bufIdx := 0; bufIdx < cbuf.slotsUsed; bufIdx++ {
-		if cbuf.buf[bufIdx] > max {
-			max = cbuf.buf[bufIdx]
-		}
-	}
-	return max
+// Get the total number of spans ingested since the server started.
+func (msink *MetricsSink) GetIngestedSpans() uint64 {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	return msink.IngestedSpans
 }
 
-func (cbuf *CircBufU32) Average() uint32 {
-	var total uint64
-	for bufIdx := 0; bufIdx < cbuf.slotsUsed; bufIdx++ {
-		total += uint64(cbuf.buf[bufIdx])
+// Read the server stats.
+func (msink *MetricsSink) PopulateServerStats(stats *common.ServerStats) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	stats.IngestedSpans = msink.IngestedSpans
+	stats.WrittenSpans = msink.WrittenSpans
+	stats.ServerDroppedSpans = msink.ServerDropped
+	stats.QuarantineDroppedSpans = msink.QuarantineDropped
+	stats.IndexSkippedSpans = msink.IndexSkipped
+	stats.NegativeDurationSpans, stats.NegativeDurationOffenders =
+		msink.negDurations.stats()
+	stats.ParentIndexTruncatedSpans = msink.ParentIndexTruncated
+	stats.InfoEntriesStripped = msink.InfoStripped
+	stats.MaxNumParents = msink.MaxNumParents
+	stats.MaxNumParentsSpanId = msink.MaxNumParentsSpanId
+	stats.MaxNumParentsTracerId = msink.MaxNumParentsTracerId
+	stats.RecentMaxNumParents = msink.numParentsCircBuf.Max()
+	stats.RecentAverageNumParents = msink.numParentsCircBuf.Average()
+	stats.FlaggedSpans = make(map[string]uint64, common.NUM_SPAN_FLAGS)
+	for i, name := range common.SpanFlagNames() {
+		stats.FlaggedSpans[name] = msink.Flagged[i]
 	}
-	return uint32(total / uint64(cbuf.slotsUsed))
+	stats.ErrorSpans = msink.ErrorSpans
+	stats.QuotaRejectedSpans = msink.QuotaRejected
+	stats.QuotaSampledOutSpans = msink.QuotaSampledOut
+	stats.MaxWriteSpansLatencyMs = msink.wsLatencyCircBuf.Max()
+	stats.AverageWriteSpansLatencyMs = msink.wsLatencyCircBuf.Average()
+	stats.IngestDecodeMs = uint64(msink.ingestDecodeTime / time.Millisecond)
+	stats.IngestValidateMs = uint64(msink.ingestValidateTime / time.Millisecond)
+	stats.HrpcOpenConnections = atomic.LoadInt64(&msink.HrpcOpenConnections)
+	stats.HrpcIdleCloses = atomic.LoadUint64(&msink.HrpcIdleCloses)
+	stats.HrpcDeadlineAborts = atomic.LoadUint64(&msink.HrpcDeadlineAborts)
+	stats.HrpcAcceptRejections = atomic.LoadUint64(&msink.HrpcAcceptRejections)
+	stats.HrpcOversizedMessages =
+		atomic.LoadUint64(&msink.HrpcOversizedMessages)
+	stats.HrpcMalformedFrames = atomic.LoadUint64(&msink.HrpcMalformedFrames)
+	stats.UdpDatagrams = atomic.LoadUint64(&msink.UdpDatagrams)
+	stats.UdpDecodeFailures = atomic.LoadUint64(&msink.UdpDecodeFailures)
+	stats.UdpTruncatedDatagrams =
+		atomic.LoadUint64(&msink.UdpTruncatedDatagrams)
+	stats.UdpOversizedDatagrams =
+		atomic.LoadUint64(&msink.UdpOversizedDatagrams)
+	stats.UdpPausedDatagrams = atomic.LoadUint64(&msink.UdpPausedDatagrams)
+	stats.AuthReadDenials = atomic.LoadUint64(&msink.AuthReadDenials)
+	stats.AuthWriteDenials = atomic.LoadUint64(&msink.AuthWriteDenials)
+	stats.AuthAdminDenials = atomic.LoadUint64(&msink.AuthAdminDenials)
+	stats.Endpoints = msink.slis.stats()
+	stats.NumClients = len(msink.HostSpanMetrics)
+	stats.HighCardinalityTracers = msink.descs.getHighCardinality()
+	stats.SpansByPrincipal = msink.principals.stats()
+	stats.ErrorSpansByTracer = msink.tracerErrors.stats()
 }
 
-func (cbuf *CircBufU32) Append(val uint32) {
-	cbuf.buf[cbuf.slot] = val
-	cbuf.slot++
-	if cbuf.slotsUsed < cbuf.slot {
-		cbuf.slotsUsed = cbuf.slot
+// Get the per-host span metrics for up to lim addresses which come after the
+// given address in sorted order.  If prefix is non-empty, only addresses
+// which start with it are returned.
+func (msink *MetricsSink) GetClientStats(after string, prefix string,
+	lim int) *common.ClientStatsResp {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.flushLocked()
+	resp := &common.ClientStatsResp{
+		Clients: make([]*common.ClientSpanMetrics, 0),
 	}
-	if cbuf.slot >= len(cbuf.buf) {
-		cbuf.slot = 0
+	if lim <= 0 {
+		return resp
+	}
+	start := after
+	if prefix > start {
+		start = prefix
+	}
+	idx := sort.SearchStrings(msink.hostAddrs, start)
+	if after != "" && idx < len(msink.hostAddrs) &&
+		msink.hostAddrs[idx] == after {
+		idx++
+	}
+	for ; idx < len(msink.hostAddrs); idx++ {
+		addr := msink.hostAddrs[idx]
+		if !strings.HasPrefix(addr, prefix) {
+			break
+		}
+		if len(resp.Clients) >= lim {
+			resp.Next = resp.Clients[len(resp.Clients)-1].Addr
+			break
+		}
+		resp.Clients = append(resp.Clients, &common.ClientSpanMetrics{
+			Addr:        addr,
+			SpanMetrics: *msink.HostSpanMetrics[addr],
+		})
 	}
+	return resp
 }
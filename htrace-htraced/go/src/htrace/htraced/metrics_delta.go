@@ -0,0 +1,297 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"container/heap"
+	"htrace/common"
+	"sync"
+	"sync/atomic"
+)
+
+//
+// Batched metrics updates.
+//
+// Every ingest request and every shard batch updates the metrics sink.  When
+// lots of clients are writing at once, having all of them take the sink lock
+// for every update makes that lock a bottleneck.  So UpdateIngested and
+// UpdatePersisted don't touch the sink directly.  Instead, they add their
+// counts to a pending delta in one of METRICS_STRIPES stripes, picked by
+// hashing the client address, each of which has its own lock.
+//
+// The deltas are merged into the sink, under the sink lock, before anything
+// reads the sink, on every history rotation heartbeat, and whenever a delta
+// holds METRICS_DELTA_MAX_UPDATES updates.  The last of these bounds the
+// memory used by the deltas during bursts.  Since each update goes into a
+// single delta as a whole, and readers merge every delta first, the totals and
+// the per-address metrics which readers see always agree with each other.
+//
+// A delta remembers which history bucket its updates belong in.  Before it
+// takes an update for a different bucket, it is merged, so that the history
+// comes out the same as if every update had been applied straight away.
+//
+// Once the sink is tracking HTRACE_METRICS_MAX_ADDR_ENTRIES addresses, merging
+// a new address evicts the address which was least recently updated.  Each
+// update is given a sequence number, so that the eviction order doesn't depend
+// on the order in which the stripes happen to be merged.
+//
+
+// The number of stripes which pending metrics updates are spread over.
+const METRICS_STRIPES = 16
+
+// The maximum number of updates a pending delta can hold before it is merged.
+const METRICS_DELTA_MAX_UPDATES = 256
+
+// The pending metrics updates for a single address.
+type pendingAddrMetrics struct {
+	common.SpanMetrics
+
+	// The sequence number of the last update to this address.
+	seq uint64
+}
+
+// Metrics updates which haven't been merged into the sink yet.
+type metricsDelta struct {
+	// The number of updates in this delta.
+	numUpdates int
+
+	// The start of the history bucket which these updates belong in.
+	bucketStartMs int64
+
+	IngestedSpans uint64
+	WrittenSpans  uint64
+	ServerDropped uint64
+	InfoStripped  uint64
+
+	// The addresses which were updated, in the order they were first updated.
+	addrs []string
+
+	// The per-address metrics updates.
+	mtxs map[string]*pendingAddrMetrics
+
+	// The writeSpans latencies in milliseconds, in the order they were
+	// recorded.
+	wsLatencies []uint32
+}
+
+func newMetricsDelta() *metricsDelta {
+	return &metricsDelta{
+		mtxs: make(map[string]*pendingAddrMetrics),
+	}
+}
+
+type metricsStripe struct {
+	// Lock protecting delta.  If the sink lock is also needed, it must be
+	// taken first.
+	lock sync.Mutex
+
+	// The pending updates.
+	delta *metricsDelta
+}
+
+// Take the stripe's pending updates, if it has any.  The stripe lock must be
+// held.
+func (stripe *metricsStripe) take() *metricsDelta {
+	if stripe.delta.numUpdates == 0 {
+		return nil
+	}
+	delta := stripe.delta
+	stripe.delta = newMetricsDelta()
+	return delta
+}
+
+// Get the stripe which holds the pending updates for an address.
+func (msink *MetricsSink) stripeFor(addr string) *metricsStripe {
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(addr); i++ {
+		hash ^= uint32(addr[i])
+		hash *= 16777619
+	}
+	return &msink.stripes[hash%METRICS_STRIPES]
+}
+
+// Lock the stripe for an address, and get the delta metrics for the address
+// which an update should be added to.  The caller must add the rest of the
+// update to stripe.delta, and then call finishUpdate.
+func (msink *MetricsSink) beginUpdate(addr string) (*metricsStripe,
+	*pendingAddrMetrics) {
+	stripe := msink.stripeFor(addr)
+	for {
+		stripe.lock.Lock()
+		startMs := msink.history.bucketStart(msink.history.nowMs())
+		delta := stripe.delta
+		if delta.numUpdates == 0 || delta.bucketStartMs == startMs {
+			delta.bucketStartMs = startMs
+			break
+		}
+		// The pending updates belong in an earlier history bucket.  Merge
+		// them before adding anything else.
+		stripe.take()
+		stripe.lock.Unlock()
+		msink.merge(delta)
+	}
+	delta := stripe.delta
+	delta.numUpdates++
+	mtx := delta.mtxs[addr]
+	if mtx == nil {
+		mtx = &pendingAddrMetrics{}
+		delta.mtxs[addr] = mtx
+		delta.addrs = append(delta.addrs, addr)
+	}
+	mtx.seq = atomic.AddUint64(&msink.updateSeq, 1)
+	return stripe, mtx
+}
+
+// Unlock a stripe after an update, merging its pending updates if there are
+// enough of them.
+func (msink *MetricsSink) finishUpdate(stripe *metricsStripe) {
+	var delta *metricsDelta
+	if msink.unbatched || stripe.delta.numUpdates >= METRICS_DELTA_MAX_UPDATES {
+		delta = stripe.take()
+	}
+	stripe.lock.Unlock()
+	if delta != nil {
+		msink.merge(delta)
+	}
+}
+
+// Merge a delta into the sink.
+func (msink *MetricsSink) merge(delta *metricsDelta) {
+	msink.lock.Lock()
+	defer msink.lock.Unlock()
+	msink.mergeLocked(delta)
+}
+
+// Merge the pending updates from every stripe into the sink.  The sink lock
+// must be held.
+func (msink *MetricsSink) flushLocked() {
+	for i := range msink.stripes {
+		stripe := &msink.stripes[i]
+		stripe.lock.Lock()
+		delta := stripe.take()
+		stripe.lock.Unlock()
+		if delta != nil {
+			msink.mergeLocked(delta)
+		}
+	}
+}
+
+// Merge a delta into the sink.  The sink lock must be held.
+func (msink *MetricsSink) mergeLocked(delta *metricsDelta) {
+	msink.IngestedSpans += delta.IngestedSpans
+	msink.WrittenSpans += delta.WrittenSpans
+	msink.ServerDropped += delta.ServerDropped
+	msink.InfoStripped += delta.InfoStripped
+	bucket := msink.history.bucketAt(delta.bucketStartMs)
+	if bucket != nil {
+		bucket.IngestedSpans += delta.IngestedSpans
+		bucket.WrittenSpans += delta.WrittenSpans
+		bucket.ServerDroppedSpans += delta.ServerDropped
+	}
+	for _, addr := range delta.addrs {
+		src := delta.mtxs[addr]
+		mtx := msink.getSpanMetrics(addr, src.seq)
+		mtx.Written += src.Written
+		mtx.ServerDropped += src.ServerDropped
+		mtx.DuplicateParents += src.DuplicateParents
+		mtx.SelfParents += src.SelfParents
+		mtx.ParseSkipped += src.ParseSkipped
+		mtx.ReservedInfoKeys += src.ReservedInfoKeys
+		mtx.NegativeDurations += src.NegativeDurations
+	}
+	for _, wsLatency := range delta.wsLatencies {
+		msink.wsLatencyCircBuf.Append(wsLatency)
+	}
+}
+
+// An address in the LRU.
+type addrLruEntry struct {
+	addr string
+
+	// The sequence number of the last update to this address.
+	seq uint64
+
+	// The index of this entry in the heap.
+	idx int
+}
+
+// Tracks which address was least recently updated.  This is a min-heap of
+// sequence numbers.
+type addrLru struct {
+	heap    []*addrLruEntry
+	entries map[string]*addrLruEntry
+}
+
+func newAddrLru() *addrLru {
+	return &addrLru{
+		heap:    make([]*addrLruEntry, 0),
+		entries: make(map[string]*addrLruEntry),
+	}
+}
+
+func (lru *addrLru) Len() int {
+	return len(lru.heap)
+}
+
+func (lru *addrLru) Less(i, j int) bool {
+	return lru.heap[i].seq < lru.heap[j].seq
+}
+
+func (lru *addrLru) Swap(i, j int) {
+	lru.heap[i], lru.heap[j] = lru.heap[j], lru.heap[i]
+	lru.heap[i].idx = i
+	lru.heap[j].idx = j
+}
+
+func (lru *addrLru) Push(x interface{}) {
+	entry := x.(*addrLruEntry)
+	entry.idx = len(lru.heap)
+	lru.heap = append(lru.heap, entry)
+}
+
+func (lru *addrLru) Pop() interface{} {
+	entry := lru.heap[len(lru.heap)-1]
+	lru.heap[len(lru.heap)-1] = nil
+	lru.heap = lru.heap[:len(lru.heap)-1]
+	return entry
+}
+
+// Record that an address was updated.
+func (lru *addrLru) touch(addr string, seq uint64) {
+	entry := lru.entries[addr]
+	if entry == nil {
+		entry = &addrLruEntry{addr: addr, seq: seq}
+		lru.entries[addr] = entry
+		heap.Push(lru, entry)
+		return
+	}
+	if seq > entry.seq {
+		entry.seq = seq
+		heap.Fix(lru, entry.idx)
+	}
+}
+
+// Remove the least recently updated address, and return it.
+func (lru *addrLru) evict() string {
+	entry := heap.Pop(lru).(*addrLruEntry)
+	delete(lru.entries, entry.addr)
+	return entry.addr
+}
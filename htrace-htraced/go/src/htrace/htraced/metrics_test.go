@@ -25,6 +25,8 @@ import (
 	"htrace/common"
 	"htrace/conf"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -47,6 +49,15 @@ type Fatalfer interface {
 	Fatalf(format string, args ...interface{})
 }
 
+// Get the span metrics for a client address, or nil if there are none.
+func getClientSpanMetrics(msink *MetricsSink, addr string) *common.SpanMetrics {
+	resp := msink.GetClientStats("", addr, 1)
+	if len(resp.Clients) == 0 || resp.Clients[0].Addr != addr {
+		return nil
+	}
+	return &resp.Clients[0].SpanMetrics
+}
+
 func assertNumWrittenEquals(t Fatalfer, msink *MetricsSink,
 	expectedNumWritten int) {
 	var sstats common.ServerStats
@@ -55,14 +66,13 @@ func assertNumWrittenEquals(t Fatalfer, msink *MetricsSink,
 		t.Fatalf("sstats.WrittenSpans = %d, but expected %d\n",
 			sstats.WrittenSpans, len(SIMPLE_TEST_SPANS))
 	}
-	if sstats.HostSpanMetrics["127.0.0.1"] == nil {
-		t.Fatalf("no entry for sstats.HostSpanMetrics[127.0.0.1] found.")
+	mtx := getClientSpanMetrics(msink, "127.0.0.1")
+	if mtx == nil {
+		t.Fatalf("no span metrics for 127.0.0.1 found.")
 	}
-	if sstats.HostSpanMetrics["127.0.0.1"].Written !=
-		uint64(expectedNumWritten) {
-		t.Fatalf("sstats.HostSpanMetrics[127.0.0.1].Written = %d, but "+
-			"expected %d\n", sstats.HostSpanMetrics["127.0.0.1"].Written,
-			len(SIMPLE_TEST_SPANS))
+	if mtx.Written != uint64(expectedNumWritten) {
+		t.Fatalf("span metrics for 127.0.0.1 have Written = %d, but "+
+			"expected %d\n", mtx.Written, len(SIMPLE_TEST_SPANS))
 	}
 }
 
@@ -82,6 +92,7 @@ func TestMetricsSinkPerHostEviction(t *testing.T) {
 	msink.UpdatePersisted("192.168.0.102", 20, 10)
 	msink.lock.Lock()
 	defer msink.lock.Unlock()
+	msink.flushLocked()
 	if len(msink.HostSpanMetrics) != 2 {
 		for k, v := range msink.HostSpanMetrics {
 			fmt.Printf("WATERMELON: [%s] = [%s]\n", k, v)
@@ -91,6 +102,157 @@ func TestMetricsSinkPerHostEviction(t *testing.T) {
 	}
 }
 
+func TestMetricsSinkEvictsLeastRecentlyUpdated(t *testing.T) {
+	cnfBld := conf.Builder{
+		Values:   conf.TEST_VALUES(),
+		Defaults: conf.DEFAULTS,
+	}
+	cnfBld.Values[conf.HTRACE_METRICS_MAX_ADDR_ENTRIES] = "3"
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
+	}
+	msink := NewMetricsSink(cnf)
+	msink.UpdatePersisted("192.168.0.100", 1, 0)
+	msink.UpdatePersisted("192.168.0.101", 1, 0)
+	msink.UpdatePersisted("192.168.0.102", 1, 0)
+	var sstats common.ServerStats
+	msink.PopulateServerStats(&sstats)
+
+	// The updates to 192.168.0.100 are the most recent, even though they
+	// haven't been merged yet.
+	msink.UpdatePersisted("192.168.0.101", 1, 0)
+	msink.UpdateIngested("192.168.0.100", 1, 0, 0, 0, 0)
+	msink.UpdatePersisted("192.168.0.103", 1, 0)
+	msink.UpdatePersisted("192.168.0.104", 1, 0)
+	resp := msink.GetClientStats("", "", 10)
+	addrs := make([]string, len(resp.Clients))
+	for i := range resp.Clients {
+		addrs[i] = resp.Clients[i].Addr
+	}
+	expected := []string{"192.168.0.100", "192.168.0.103", "192.168.0.104"}
+	if !reflect.DeepEqual(expected, addrs) {
+		t.Fatalf("Expected %v, but got %v\n", expected, addrs)
+	}
+}
+
+func TestMetricsSinkConcurrentUpdates(t *testing.T) {
+	const NUM_GOROUTINES = 32
+	const NUM_UPDATES = 2000
+	const NUM_ADDRS = 50
+	cnfBld := conf.Builder{
+		Values:   conf.TEST_VALUES(),
+		Defaults: conf.DEFAULTS,
+	}
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
+	}
+	msink := NewMetricsSink(cnf)
+	var wg sync.WaitGroup
+	for g := 0; g < NUM_GOROUTINES; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < NUM_UPDATES; i++ {
+				addr := fmt.Sprintf("10.0.0.%d", (g+i)%NUM_ADDRS)
+				msink.UpdateIngested(addr, 3, 1, 1, 0, time.Millisecond)
+				msink.UpdatePersisted(addr, 2, 1)
+				if i%500 == 0 {
+					// Every snapshot should be consistent.
+					var sstats common.ServerStats
+					msink.PopulateServerStats(&sstats)
+					if sstats.IngestedSpans%3 != 0 {
+						t.Errorf("IngestedSpans = %d is not a multiple "+
+							"of 3\n", sstats.IngestedSpans)
+					}
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	const NUM_TOTAL = NUM_GOROUTINES * NUM_UPDATES
+	var sstats common.ServerStats
+	msink.PopulateServerStats(&sstats)
+	if sstats.IngestedSpans != 3*NUM_TOTAL {
+		t.Fatalf("Expected IngestedSpans = %d, but got %d\n",
+			3*NUM_TOTAL, sstats.IngestedSpans)
+	}
+	if sstats.WrittenSpans != 2*NUM_TOTAL {
+		t.Fatalf("Expected WrittenSpans = %d, but got %d\n",
+			2*NUM_TOTAL, sstats.WrittenSpans)
+	}
+	if sstats.ServerDroppedSpans != 2*NUM_TOTAL {
+		t.Fatalf("Expected ServerDroppedSpans = %d, but got %d\n",
+			2*NUM_TOTAL, sstats.ServerDroppedSpans)
+	}
+	if sstats.NumClients != NUM_ADDRS {
+		t.Fatalf("Expected NumClients = %d, but got %d\n",
+			NUM_ADDRS, sstats.NumClients)
+	}
+	var sum common.SpanMetrics
+	resp := msink.GetClientStats("", "", NUM_ADDRS)
+	for i := range resp.Clients {
+		mtx := &resp.Clients[i].SpanMetrics
+		if mtx.Written != 2*NUM_TOTAL/NUM_ADDRS {
+			t.Fatalf("Expected Written = %d for %s, but got %d\n",
+				2*NUM_TOTAL/NUM_ADDRS, resp.Clients[i].Addr, mtx.Written)
+		}
+		sum.Written += mtx.Written
+		sum.ServerDropped += mtx.ServerDropped
+		sum.DuplicateParents += mtx.DuplicateParents
+	}
+	if sum.Written != 2*NUM_TOTAL || sum.ServerDropped != 2*NUM_TOTAL ||
+		sum.DuplicateParents != NUM_TOTAL {
+		t.Fatalf("Per-address metrics don't add up: %s\n", asJson(&sum))
+	}
+	buckets := msink.GetHistory()
+	var histIngested uint64
+	for i := range buckets {
+		histIngested += buckets[i].IngestedSpans
+	}
+	if histIngested != 3*NUM_TOTAL {
+		t.Fatalf("Expected %d ingested spans in the history, but got %d\n",
+			3*NUM_TOTAL, histIngested)
+	}
+}
+
+func benchmarkUpdateMetrics(b *testing.B, unbatched bool) {
+	cnfBld := conf.Builder{
+		Values:   conf.TEST_VALUES(),
+		Defaults: conf.DEFAULTS,
+	}
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		b.Fatalf("failed to create conf: %s", err.Error())
+	}
+	msink := NewMetricsSink(cnf)
+	msink.unbatched = unbatched
+	addrs := make([]string, 256)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("10.0.%d.%d", i/16, i%16)
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			msink.UpdatePersisted(addrs[i%len(addrs)], 10, 0)
+			i++
+		}
+	})
+}
+
+// Measures updates which are merged into the sink straight away, which is
+// how the sink used to work.
+func BenchmarkUpdateMetricsUnbatched(b *testing.B) {
+	benchmarkUpdateMetrics(b, true)
+}
+
+func BenchmarkUpdateMetricsBatched(b *testing.B) {
+	benchmarkUpdateMetrics(b, false)
+}
+
 func TestIngestedSpansMetricsRest(t *testing.T) {
 	testIngestedSpansMetricsImpl(t, false)
 }
@@ -135,38 +297,140 @@ func testIngestedSpansMetricsImpl(t *testing.T, usePacked bool) {
 	}
 }
 
-func TestCircBuf32(t *testing.T) {
-	cbuf := NewCircBufU32(3)
-	// We arbitrarily define that empty circular buffers have an average of 0.
-	if cbuf.Average() != 0 {
-		t.Fatalf("expected empty CircBufU32 to have an average of 0.\n")
+func TestClientStatsPaging(t *testing.T) {
+	const NUM_ADDRS = 5000
+	const PAGE_SIZE = 97
+	cnfBld := conf.Builder{
+		Values:   conf.TEST_VALUES(),
+		Defaults: conf.DEFAULTS,
 	}
-	if cbuf.Max() != 0 {
-		t.Fatalf("expected empty CircBufU32 to have a max of 0.\n")
+	cnfBld.Values[conf.HTRACE_METRICS_MAX_ADDR_ENTRIES] =
+		fmt.Sprintf("%d", NUM_ADDRS)
+	cnf, err := cnfBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create conf: %s", err.Error())
 	}
-	cbuf.Append(2)
-	if cbuf.Average() != 2 {
-		t.Fatalf("expected one-element CircBufU32 to have an average of 2.\n")
+	msink := NewMetricsSink(cnf)
+	for i := 0; i < NUM_ADDRS; i++ {
+		msink.UpdatePersisted(fmt.Sprintf("10.%d.%d.%d", i%7, i/256, i%256),
+			i, 1)
 	}
-	cbuf.Append(10)
-	if cbuf.Average() != 6 {
-		t.Fatalf("expected two-element CircBufU32 to have an average of 6.\n")
+	var sstats common.ServerStats
+	msink.PopulateServerStats(&sstats)
+	if sstats.NumClients != NUM_ADDRS {
+		t.Fatalf("Expected NumClients = %d, but got %d\n", NUM_ADDRS,
+			sstats.NumClients)
+	}
+
+	// Page through all the addresses.
+	seen := make(map[string]bool)
+	prev := ""
+	after := ""
+	for {
+		resp := msink.GetClientStats(after, "", PAGE_SIZE)
+		if len(resp.Clients) > PAGE_SIZE {
+			t.Fatalf("Got %d clients, but the limit was %d\n",
+				len(resp.Clients), PAGE_SIZE)
+		}
+		for i := range resp.Clients {
+			addr := resp.Clients[i].Addr
+			if addr <= prev {
+				t.Fatalf("Address %s came after %s\n", addr, prev)
+			}
+			if resp.Clients[i].ServerDropped != 1 {
+				t.Fatalf("Expected ServerDropped = 1 for %s, but got %d\n",
+					addr, resp.Clients[i].ServerDropped)
+			}
+			seen[addr] = true
+			prev = addr
+		}
+		if resp.Next == "" {
+			break
+		}
+		if resp.Next != prev {
+			t.Fatalf("Expected Next = %s, but got %s\n", prev, resp.Next)
+		}
+		after = resp.Next
+	}
+	if len(seen) != NUM_ADDRS {
+		t.Fatalf("Expected to see %d addresses, but saw %d\n",
+			NUM_ADDRS, len(seen))
+	}
+
+	// Page through the addresses with a given prefix.
+	numSeen := 0
+	after = ""
+	for {
+		resp := msink.GetClientStats(after, "10.3.", PAGE_SIZE)
+		for i := range resp.Clients {
+			if !strings.HasPrefix(resp.Clients[i].Addr, "10.3.") {
+				t.Fatalf("Address %s does not match the prefix.\n",
+					resp.Clients[i].Addr)
+			}
+			numSeen++
+		}
+		if resp.Next == "" {
+			break
+		}
+		after = resp.Next
+	}
+	expectedSeen := 0
+	for addr := range seen {
+		if strings.HasPrefix(addr, "10.3.") {
+			expectedSeen++
+		}
+	}
+	if numSeen != expectedSeen {
+		t.Fatalf("Expected %d addresses with the prefix, but got %d\n",
+			expectedSeen, numSeen)
+	}
+}
+
+func TestClientStatsRest(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestClientStatsRest",
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	for i := 0; i < 10; i++ {
+		ht.Store.msink.UpdatePersisted(fmt.Sprintf("192.168.0.%d", i), i, 0)
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.NumClients != 10 {
+		t.Fatalf("Expected NumClients = 10, but got %d\n", stats.NumClients)
+	}
+	resp, err := hcl.GetClientStats("192.168.0.3", "", 4)
+	if err != nil {
+		t.Fatalf("GetClientStats failed: %s\n", err.Error())
 	}
-	cbuf.Append(12)
-	if cbuf.Average() != 8 {
-		t.Fatalf("expected three-element CircBufU32 to have an average of 8.\n")
+	addrs := make([]string, len(resp.Clients))
+	for i := range resp.Clients {
+		addrs[i] = resp.Clients[i].Addr
 	}
-	cbuf.Append(14)
-	// The 14 overwrites the original 2 element.
-	if cbuf.Average() != 12 {
-		t.Fatalf("expected three-element CircBufU32 to have an average of 12.\n")
+	expected := []string{"192.168.0.4", "192.168.0.5", "192.168.0.6",
+		"192.168.0.7"}
+	if !reflect.DeepEqual(expected, addrs) {
+		t.Fatalf("Expected %v, but got %v\n", expected, addrs)
 	}
-	cbuf.Append(1)
-	// The 1 overwrites the original 10 element.
-	if cbuf.Average() != 9 {
-		t.Fatalf("expected three-element CircBufU32 to have an average of 12.\n")
+	if resp.Clients[1].Written != 5 {
+		t.Fatalf("Expected 5 spans written by 192.168.0.5, but got %d\n",
+			resp.Clients[1].Written)
 	}
-	if cbuf.Max() != 14 {
-		t.Fatalf("expected three-element CircBufU32 to have a max of 14.\n")
+	if resp.Next != "192.168.0.7" {
+		t.Fatalf("Expected Next = 192.168.0.7, but got %s\n", resp.Next)
 	}
+	_, err = hcl.GetClientStats("", "", -1)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
 }
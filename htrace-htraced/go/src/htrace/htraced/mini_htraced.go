@@ -24,7 +24,6 @@ import (
 	"htrace/common"
 	"htrace/conf"
 	"io/ioutil"
-	"net"
 	"os"
 	"strings"
 )
@@ -50,14 +49,29 @@ type MiniHTracedBuilder struct {
 	// The DataDirs to use.  Empty entries will turn into random names.
 	DataDirs []string
 
+	// If true, use the memory datastore backend.  DataDirs is ignored.
+	InMemory bool
+
 	// If true, we will keep the data dirs around after MiniHTraced#Close
 	KeepDataDirsOnClose bool
 
+	// If non-zero, the DaemonId to create the datastore with, or to expect
+	// when reopening it.
+	DaemonId uint64
+
 	// If non-null, the WrittenSpans semaphore to use when creating the DataStore.
 	WrittenSpans *common.Semaphore
 
 	// The test hooks to use for the HRPC server
 	HrpcTestHooks *hrpcTestHooks
+
+	// The test hooks to use for the datastore
+	DatastoreTestHooks *datastoreTestHooks
+
+	// If non-empty, the path to an XML configuration file.  Its values take
+	// precedence over Cnf.  The file is re-read when the configuration is
+	// reloaded.
+	ConfPath string
 }
 
 type MiniHTraced struct {
@@ -67,6 +81,8 @@ type MiniHTraced struct {
 	Store               *dataStore
 	Rsv                 *RestServer
 	Hsv                 *HrpcServer
+	Usv                 *UdpServer
+	Rld                 *ConfReloader
 	Lg                  *common.Logger
 	KeepDataDirsOnClose bool
 }
@@ -76,13 +92,17 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 	var store *dataStore
 	var rsv *RestServer
 	var hsv *HrpcServer
+	var usv *UdpServer
 	if bld.Name == "" {
 		bld.Name = "HTraceTest"
 	}
 	if bld.Cnf == nil {
 		bld.Cnf = make(map[string]string)
 	}
-	if bld.DataDirs == nil {
+	if bld.InMemory {
+		bld.DataDirs = []string{}
+		bld.Cnf[conf.HTRACE_DATASTORE_BACKEND] = DATASTORE_BACKEND_MEMORY
+	} else if bld.DataDirs == nil {
 		bld.DataDirs = make([]string, 2)
 	}
 	for idx := range bld.DataDirs {
@@ -103,8 +123,23 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 	}
 	bld.Cnf[conf.HTRACE_DATA_STORE_DIRECTORIES] =
 		strings.Join(bld.DataDirs, conf.PATH_LIST_SEP)
-	cnfBld := conf.Builder{Values: bld.Cnf, Defaults: conf.DEFAULTS}
-	cnf, err := cnfBld.Build()
+	if bld.DaemonId != 0 {
+		bld.Cnf[conf.HTRACE_DATASTORE_DAEMON_ID] = formatDaemonId(bld.DaemonId)
+	}
+	loadCnf := func() (*conf.Config, error) {
+		cnfBld := conf.Builder{Values: bld.Cnf, Defaults: conf.DEFAULTS,
+			Validate: true}
+		if bld.ConfPath != "" {
+			file, err := os.Open(bld.ConfPath)
+			if err != nil {
+				return nil, err
+			}
+			defer file.Close()
+			cnfBld.Reader = file
+		}
+		return cnfBld.Build()
+	}
+	cnf, err := loadCnf()
 	if err != nil {
 		return nil, err
 	}
@@ -124,6 +159,9 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 			if rsv != nil {
 				rsv.Close()
 			}
+			if hsv != nil {
+				hsv.Close()
+			}
 			lg.Infof("Failed to create MiniHTraced %s: %s\n", bld.Name, err.Error())
 			lg.Close()
 		}
@@ -132,7 +170,12 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 	if err != nil {
 		return nil, err
 	}
-	rstListener, listenErr := net.Listen("tcp", cnf.Get(conf.HTRACE_WEB_ADDRESS))
+	store.testHooks = bld.DatastoreTestHooks
+	webAddr, _, err := getListenAddresses(cnf)
+	if err != nil {
+		return nil, err
+	}
+	rstListener, _, listenErr := listenOn(cnf, webAddr)
 	if listenErr != nil {
 		return nil, listenErr
 	}
@@ -141,7 +184,8 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 			rstListener.Close()
 		}
 	}()
-	rsv, err = CreateRestServer(cnf, store, rstListener)
+	rld := NewConfReloader(cnf, lg, loadCnf)
+	rsv, err = CreateRestServer(cnf, store, rld, rstListener)
 	if err != nil {
 		return nil, err
 	}
@@ -150,6 +194,13 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 	if err != nil {
 		return nil, err
 	}
+	if cnf.Get(conf.HTRACE_UDP_ADDRESS) != "" {
+		usv, err = CreateUdpServer(cnf, store)
+		if err != nil {
+			return nil, err
+		}
+	}
+	registerHotConfKeys(rld, store, hsv)
 
 	lg.Infof("Created MiniHTraced %s\n", bld.Name)
 	return &MiniHTraced{
@@ -159,6 +210,8 @@ func (bld *MiniHTracedBuilder) Build() (*MiniHTraced, error) {
 		Store:               store,
 		Rsv:                 rsv,
 		Hsv:                 hsv,
+		Usv:                 usv,
+		Rld:                 rld,
 		Lg:                  lg,
 		KeepDataDirsOnClose: bld.KeepDataDirsOnClose,
 	}, nil
@@ -181,6 +234,9 @@ func (ht *MiniHTraced) Close() {
 	ht.Lg.Infof("Closing MiniHTraced %s\n", ht.Name)
 	ht.Rsv.Close()
 	ht.Hsv.Close()
+	if ht.Usv != nil {
+		ht.Usv.Close()
+	}
 	ht.Store.Close()
 	if !ht.KeepDataDirsOnClose {
 		for idx := range ht.DataDirs {
@@ -0,0 +1,340 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"os"
+	"sort"
+	"testing"
+)
+
+// The begin time of the nanosecond-precision test spans, in milliseconds.
+const NANOS_TEST_BEGIN_MS = 1424813349020
+
+// Create a span whose times are given in nanoseconds past
+// NANOS_TEST_BEGIN_MS.  Like a client with nanosecond timestamps, it doesn't
+// fill in the millisecond times.
+func newNanosTestSpan(id string, beginNs int64, endNs int64,
+	parents []common.SpanId) *common.Span {
+	return &common.Span{
+		Id: common.TestId(id),
+		SpanData: common.SpanData{
+			BeginNs:     NANOS_TEST_BEGIN_MS*common.NS_PER_MS + beginNs,
+			EndNs:       NANOS_TEST_BEGIN_MS*common.NS_PER_MS + endNs,
+			Description: "nanos",
+			TracerId:    "nanos",
+			Parents:     parents,
+		},
+	}
+}
+
+func queryDuration(t *testing.T, ht *MiniHTraced, op common.Op,
+	val string) []*common.Span {
+	query := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    op,
+				Field: common.DURATION,
+				Val:   val,
+			},
+		},
+		Lim: 100,
+	}
+	spans, err, _ := ht.Store.HandleQuery(query)
+	if err != nil {
+		t.Fatalf("Query %s failed: %s\n", query.String(), err.Error())
+	}
+	return spans
+}
+
+func TestNanosecondDurations(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestNanosecondDurations",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Spans a and b both last less than a millisecond, and old-format
+	// spans c and d have no nanosecond times.
+	a := newNanosTestSpan("00000000000000000000000000000001",
+		100000, 400000, []common.SpanId{})
+	b := newNanosTestSpan("00000000000000000000000000000002",
+		200000, 900000, []common.SpanId{})
+	c := &common.Span{Id: common.TestId("00000000000000000000000000000003"),
+		SpanData: common.SpanData{
+			Begin:    NANOS_TEST_BEGIN_MS,
+			End:      NANOS_TEST_BEGIN_MS,
+			TracerId: "old",
+			Parents:  []common.SpanId{},
+		}}
+	d := &common.Span{Id: common.TestId("00000000000000000000000000000004"),
+		SpanData: common.SpanData{
+			Begin:    NANOS_TEST_BEGIN_MS,
+			End:      NANOS_TEST_BEGIN_MS + 1,
+			TracerId: "old",
+			Parents:  []common.SpanId{},
+		}}
+	err = hcl.WriteSpans([]*common.Span{a, b, c, d})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(4)
+
+	// The millisecond times are derived from the nanosecond ones, and the
+	// nanosecond times are kept.
+	span, err := hcl.FindSpan(b.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if span.Begin != NANOS_TEST_BEGIN_MS || span.End != NANOS_TEST_BEGIN_MS ||
+		span.BeginNs != b.BeginNs || span.EndNs != b.EndNs {
+		t.Fatalf("Unexpected times for span b: %s\n", span.String())
+	}
+	if span.Duration() != 0 || span.DurationNs() != 700000 {
+		t.Fatalf("Expected span b to last 0 ms and 700000 ns, but got %d "+
+			"and %d\n", span.Duration(), span.DurationNs())
+	}
+	span, err = hcl.FindSpan(d.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	common.ExpectSpansEqual(t, d, span)
+
+	// The duration index orders the spans by their true durations.
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN_OR_EQUALS, "0"),
+		c.Id, a.Id, b.Id, d.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.LESS_THAN_OR_EQUALS, "1"),
+		d.Id, b.Id, a.Id, c.Id)
+
+	// Fractional milliseconds distinguish the sub-millisecond spans.
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN, "0"),
+		a.Id, b.Id, d.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN, "0.3"),
+		b.Id, d.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN, "0.7"),
+		d.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.LESS_THAN_OR_EQUALS, "0.3"),
+		a.Id, c.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.EQUALS, "0.7"), b.Id)
+
+	// Old-format spans match whole-millisecond predicates as before.
+	expectSpanIds(t, queryDuration(t, ht, common.EQUALS, "1"), d.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.EQUALS, "0"), c.Id)
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN_OR_EQUALS,
+		"1"), d.Id)
+}
+
+func TestNanosecondFlameTree(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestNanosecondFlameTree",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	rootId := common.TestId("00000000000000000000000000000001")
+	root := newNanosTestSpan(rootId.String(), 0, 1500000,
+		[]common.SpanId{})
+	// The children overlap, covering 100000 to 900000.  The second child
+	// ends after its parent, and is clamped.
+	a := newNanosTestSpan("00000000000000000000000000000002",
+		100000, 400000, []common.SpanId{rootId})
+	b := newNanosTestSpan("00000000000000000000000000000003",
+		200000, 900000, []common.SpanId{rootId})
+	c := newNanosTestSpan("00000000000000000000000000000004",
+		1400000, 1700000, []common.SpanId{rootId})
+	ingestSpans(ht, []*common.Span{root, a, b, c})
+
+	flame := ht.Store.AssembleFlameTree(rootId, 100)
+	if flame == nil {
+		t.Fatalf("failed to assemble flame tree.\n")
+	}
+	node := flame.Root
+	if node.SelfNs != 600000 || node.SelfMs != 0 || len(node.Children) != 3 {
+		t.Fatalf("Unexpected flame tree root: %s\n", asJson(node))
+	}
+	expectedIds := []common.SpanId{a.Id, b.Id, c.Id}
+	expectedSelfNs := []int64{300000, 700000, 100000}
+	for i := range node.Children {
+		child := node.Children[i]
+		if !child.Id.Equal(expectedIds[i]) ||
+			child.SelfNs != expectedSelfNs[i] {
+			t.Fatalf("Unexpected flame tree child %d: %s\n", i, asJson(child))
+		}
+	}
+	c2 := node.Children[2]
+	if !c2.Clamped || c2.EndNs != root.EndNs ||
+		c2.End != NANOS_TEST_BEGIN_MS+1 {
+		t.Fatalf("Expected the last child to be clamped to its parent: %s\n",
+			asJson(c2))
+	}
+}
+
+// Rewrite the duration index keys of a shard in the layout version 3 format,
+// and mark the shard as having that layout.
+func downgradeShardToV3(t *testing.T, shd *ShardLoader) {
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	batch := shd.ldb.NewWriteBatch()
+	for iter.Seek([]byte{DURATION_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if key[0] != DURATION_INDEX_PREFIX {
+			break
+		}
+		oldKey := append(append([]byte{}, key[0:9]...), key[13:]...)
+		batch.Delete(append([]byte{}, key...))
+		batch.Put(oldKey, append([]byte{}, iter.Value()...))
+	}
+	iter.Close()
+	err := shd.ldb.Write(shd.dld.writeOpts, batch)
+	batch.Close()
+	if err != nil {
+		t.Fatalf("failed to rewrite the duration index of %s: %s\n",
+			shd.path, err.Error())
+	}
+	info := *shd.info
+	info.LayoutVersion = 3
+	err = shd.writeShardInfo(&info)
+	if err != nil {
+		t.Fatalf("failed to write shard info for %s: %s\n",
+			shd.path, err.Error())
+	}
+}
+
+func TestUpgradeLayoutV3(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testUpgradeLayoutV3(t, backend)
+	}
+}
+
+func testUpgradeLayoutV3(t *testing.T, backend string) {
+	ht, err := buildOnDataDirs("TestUpgradeLayoutV3"+backend, backend,
+		make([]string, 2), false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	hcnf := ht.Cnf.Clone()
+	allSpans := createRandomTestSpans(20)
+	ingestSpans(ht, allSpans)
+	ht.Close()
+	ht = nil
+
+	dld := NewDataStoreLoader(hcnf)
+	dld.LoadShards()
+	for i := range dld.shards {
+		downgradeShardToV3(t, dld.shards[i])
+	}
+	dld.Close()
+
+	// A read-only server can't do the upgrade.
+	_, err = buildOnDataDirs("TestUpgradeLayoutV3"+backend+"#readOnly",
+		backend, dataDirs, true)
+	common.AssertErrContains(t, err, "must be upgraded to version 6")
+
+	ht, err = buildOnDataDirs("TestUpgradeLayoutV3"+backend+"#upgrade",
+		backend, dataDirs, false)
+	if err != nil {
+		t.Fatalf("failed to upgrade the datastore: %s", err.Error())
+	}
+	if ht.Store.shardInfo.LayoutVersion != CURRENT_LAYOUT_VERSION {
+		t.Fatalf("Expected layout version %d after the upgrade, but got %d\n",
+			CURRENT_LAYOUT_VERSION, ht.Store.shardInfo.LayoutVersion)
+	}
+	// Every duration index key was rewritten.
+	for _, shd := range ht.Store.shards {
+		iter := shd.ldb.NewIterator(ht.Store.readOpts)
+		for iter.Seek([]byte{DURATION_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if key[0] != DURATION_INDEX_PREFIX {
+				break
+			}
+			if len(key) != V3_DURATION_KEY_LEN+4 {
+				t.Fatalf("Found a duration index key of length %d in %s "+
+					"after the upgrade.\n", len(key), shd.path)
+			}
+		}
+		iter.Close()
+	}
+	// The duration index returns the spans in the same order as before.
+	// Spans which end before they begin were never in it.
+	sort.Sort(spansByDuration(allSpans))
+	expectedIds := make([]common.SpanId, 0, len(allSpans))
+	for i := range allSpans {
+		if !allSpans[i].HasNegativeDuration() {
+			expectedIds = append(expectedIds, allSpans[i].Id)
+		}
+	}
+	expectSpanIds(t, queryDuration(t, ht, common.GREATER_THAN_OR_EQUALS,
+		"-9223372036854775808"), expectedIds...)
+	ht.Close()
+
+	// Once upgraded, the datastore can be opened read-only.
+	ht, err = buildOnDataDirs("TestUpgradeLayoutV3"+backend+"#readOnly2",
+		backend, dataDirs, true)
+	if err != nil {
+		t.Fatalf("failed to open the upgraded datastore read-only: %s",
+			err.Error())
+	}
+}
+
+// Sorts spans in the order of the duration index.
+type spansByDuration []*common.Span
+
+func (s spansByDuration) Len() int {
+	return len(s)
+}
+
+func (s spansByDuration) Less(i, j int) bool {
+	iMs, iNs := s[i].DurationParts()
+	jMs, jNs := s[j].DurationParts()
+	if iMs != jMs {
+		return iMs < jMs
+	}
+	if iNs != jNs {
+		return iNs < jNs
+	}
+	return s[i].Id.Compare(s[j].Id) < 0
+}
+
+func (s spansByDuration) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
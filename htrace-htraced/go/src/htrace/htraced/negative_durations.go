@@ -0,0 +1,189 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+//
+// Spans which end before they begin.
+//
+// A client whose clock steps backwards while a span is open sends a span
+// which ends before it begins.  Its duration is negative, so it would sort
+// before every other span in the duration index, and drag down the duration
+// statistics.  What we do with such spans depends on
+// ingest.negative.duration.policy:
+//
+// * reject drops them, and records them in the rejection log with the times
+//   reason, as ingest.validate.times does.
+//
+// * clamp moves their end time to their begin time, so that their duration
+//   is 0, and records the real duration in NEGATIVE_DURATION_INFO_KEY.
+//
+// * exclude, the default, stores them as they are, but marks them as
+//   IndexSkipped, so that they are left out of the duration index and never
+//   match DURATION predicates.  Everything which aggregates durations skips
+//   them as well: the description statistics, the SLOs, the scan jobs, and
+//   the service map.
+//
+// Whatever the policy, each client's spans are counted in its metrics, and
+// the worst recent offenders are listed in /server/stats, so that the broken
+// clocks can be found.
+//
+
+// Drop spans which end before they begin.
+const NEGATIVE_DURATION_POLICY_REJECT = "reject"
+
+// Move the end time of spans which end before they begin to their begin time.
+const NEGATIVE_DURATION_POLICY_CLAMP = "clamp"
+
+// Store spans which end before they begin, but leave them out of the
+// duration index and statistics.
+const NEGATIVE_DURATION_POLICY_EXCLUDE = "exclude"
+
+// The number of client addresses we remember offenders for, and the number
+// we list in /server/stats.
+const NEGATIVE_DURATION_MAX_TRACKED = 100
+const NEGATIVE_DURATION_MAX_OFFENDERS = 10
+
+// Get how far a span ends before it begins, in whole milliseconds, rounded
+// up.  This is at least 1 for any span which ends before it begins.  Spans
+// with arbitrary times can end so far before they begin that the duration
+// doesn't fit in nanoseconds, so we use milliseconds, and saturate.
+func negativeDurationMs(span *common.Span) int64 {
+	ms, _ := span.DurationParts()
+	if ms == math.MinInt64 {
+		return math.MaxInt64
+	}
+	return -ms
+}
+
+// Get the duration of a span which ends before it begins, in nanoseconds.
+// Durations too long to fit saturate at math.MinInt64.
+func negativeDurationNsSaturated(span *common.Span) int64 {
+	ms, ns := span.DurationParts()
+	if ms < math.MinInt64/common.NS_PER_MS {
+		return math.MinInt64
+	}
+	return ms*common.NS_PER_MS + ns
+}
+
+// Move the end time of a span which ends before it begins to its begin time,
+// and record the duration it had.
+func clampNegativeDuration(span *common.Span) {
+	if span.Info == nil {
+		span.Info = make(common.TraceInfoMap)
+	}
+	span.Info[common.NEGATIVE_DURATION_INFO_KEY] =
+		strconv.FormatInt(negativeDurationNsSaturated(span), 10)
+	span.End = span.Begin
+	span.EndNs = span.BeginNs
+}
+
+// Count a span which ends before it begins.
+func (ing *SpanIngestor) noteNegativeDuration(span *common.Span) {
+	ing.negativeDurations++
+	magnitude := negativeDurationMs(span)
+	if ing.worstNegative == nil || magnitude > ing.worstNegativeMs {
+		ing.worstNegative = span
+		ing.worstNegativeMs = magnitude
+	}
+}
+
+// Tracks the clients which send spans that end before they begin.
+type negativeDurationTracker struct {
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The total number of spans which ended before they began.
+	total uint64
+
+	// The offenders, by client address.
+	offenders map[string]*common.NegativeDurationOffender
+
+	// Tracks which address offended least recently.
+	lru *addrLru
+
+	// Incremented each time an offender is recorded.
+	seq uint64
+}
+
+func newNegativeDurationTracker() *negativeDurationTracker {
+	return &negativeDurationTracker{
+		offenders: make(map[string]*common.NegativeDurationOffender),
+		lru:       newAddrLru(),
+	}
+}
+
+// Record the spans from an address which ended before they began, and the
+// worst of them.
+func (ndt *negativeDurationTracker) observe(addr string, numSpans int,
+	worst *common.Span, worstMs int64, nowMs int64) {
+	ndt.lock.Lock()
+	defer ndt.lock.Unlock()
+	ndt.total += uint64(numSpans)
+	off := ndt.offenders[addr]
+	first := off == nil
+	if first {
+		if len(ndt.offenders) >= NEGATIVE_DURATION_MAX_TRACKED &&
+			ndt.lru.Len() > 0 {
+			delete(ndt.offenders, ndt.lru.evict())
+		}
+		off = &common.NegativeDurationOffender{Addr: addr}
+		ndt.offenders[addr] = off
+	}
+	off.NumSpans += uint64(numSpans)
+	if first || worstMs > off.WorstMs {
+		off.WorstSpanId = worst.Id
+		off.WorstTracerId = worst.TracerId
+		off.WorstMs = worstMs
+	}
+	off.LastMs = nowMs
+	ndt.seq++
+	ndt.lru.touch(addr, ndt.seq)
+}
+
+// Get the total number of spans which ended before they began, and the worst
+// offenders.
+func (ndt *negativeDurationTracker) stats() (uint64,
+	[]common.NegativeDurationOffender) {
+	ndt.lock.Lock()
+	defer ndt.lock.Unlock()
+	offenders := make([]common.NegativeDurationOffender, 0,
+		len(ndt.offenders))
+	for _, off := range ndt.offenders {
+		offenders = append(offenders, *off)
+	}
+	sort.Slice(offenders, func(i, j int) bool {
+		if offenders[i].WorstMs != offenders[j].WorstMs {
+			return offenders[i].WorstMs > offenders[j].WorstMs
+		}
+		return offenders[i].Addr < offenders[j].Addr
+	})
+	if len(offenders) > NEGATIVE_DURATION_MAX_OFFENDERS {
+		offenders = offenders[0:NEGATIVE_DURATION_MAX_OFFENDERS]
+	}
+	return ndt.total, offenders
+}
@@ -0,0 +1,275 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"math"
+	"testing"
+	"time"
+)
+
+// Create a parent span, a child which ends 30 ms before it begins, and a
+// normal child.
+func negativeDurationTestSpans() []*common.Span {
+	parent := common.TestId("00000000000000000000000000000001")
+	return []*common.Span{
+		&common.Span{Id: parent,
+			SpanData: common.SpanData{
+				Begin:       100,
+				End:         200,
+				Description: "parent",
+				Parents:     []common.SpanId{},
+				TracerId:    "negd",
+			}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000002"),
+			SpanData: common.SpanData{
+				Begin:       150,
+				End:         120,
+				Description: "backwards",
+				Parents:     []common.SpanId{parent},
+				TracerId:    "negd",
+			}},
+		&common.Span{Id: common.TestId("00000000000000000000000000000003"),
+			SpanData: common.SpanData{
+				Begin:       130,
+				End:         140,
+				Description: "normal",
+				Parents:     []common.SpanId{parent},
+				TracerId:    "negd",
+			}},
+	}
+}
+
+// Count the duration index entries which point at the given span.
+func countDurationIndexEntries(ht *MiniHTraced, sid common.SpanId) int {
+	count := 0
+	for _, shd := range ht.Store.shards {
+		iter := shd.ldb.NewIterator(ht.Store.readOpts)
+		for iter.Seek([]byte{DURATION_INDEX_PREFIX}); iter.Valid(); iter.Next() {
+			key := iter.Key()
+			if key[0] != DURATION_INDEX_PREFIX {
+				break
+			}
+			if bytes.Equal(key[len(key)-common.SPAN_ID_LEN:], sid.Val()) {
+				count++
+			}
+		}
+		iter.Close()
+	}
+	return count
+}
+
+// Get the description statistics of the spans with the given description,
+// or nil if there are none.
+func findDescStats(ht *MiniHTraced,
+	desc string) *common.DescriptionStats {
+	resp := ht.Store.descStats.Get(0, DESC_STATS_HOUR_MS, 10)
+	for i := range resp.Descriptions {
+		if resp.Descriptions[i].Description == desc {
+			return &resp.Descriptions[i]
+		}
+	}
+	return nil
+}
+
+func TestNegativeDurationPolicies(t *testing.T) {
+	t.Parallel()
+	for _, policy := range []string{NEGATIVE_DURATION_POLICY_REJECT,
+		NEGATIVE_DURATION_POLICY_CLAMP, NEGATIVE_DURATION_POLICY_EXCLUDE} {
+		testNegativeDurationPolicy(t, policy)
+	}
+}
+
+func testNegativeDurationPolicy(t *testing.T, policy string) {
+	htraceBld := &MiniHTracedBuilder{
+		Name: "TestNegativeDurationPolicy" + policy,
+		Cnf: map[string]string{
+			conf.HTRACE_INGEST_NEG_DURATION_POLICY: policy,
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	spans := negativeDurationTestSpans()
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range spans {
+		ing.IngestSpan(spans[i])
+	}
+	ing.Close(time.Now())
+	backwards := spans[1]
+	if policy == NEGATIVE_DURATION_POLICY_REJECT {
+		ht.Store.WrittenSpans.Waits(int64(len(spans) - 1))
+		if ht.Store.FindSpan(backwards.Id) != nil {
+			t.Fatalf("%s: expected the backwards span to be dropped.\n",
+				policy)
+		}
+		rej := ht.Store.rejections.Get(common.REJECT_REASON_TIMES, 10)
+		if rej.Counts[common.REJECT_REASON_TIMES] != 1 {
+			t.Fatalf("%s: expected 1 times rejection, but got %s\n",
+				policy, asJson(rej))
+		}
+	} else {
+		ht.Store.WrittenSpans.Waits(int64(len(spans)))
+	}
+
+	// Only a clamped span is in the duration index.
+	expectedEntries := 0
+	expected := []common.Span{*spans[0], *spans[2]}
+	if policy == NEGATIVE_DURATION_POLICY_CLAMP {
+		expectedEntries = 1
+		expected = append(expected, *backwards)
+		if backwards.End != backwards.Begin ||
+			backwards.Info[common.NEGATIVE_DURATION_INFO_KEY] != "-30000000" {
+			t.Fatalf("%s: expected the backwards span to be clamped, but "+
+				"got %s\n", policy, asJson(backwards))
+		}
+	}
+	if entries := countDurationIndexEntries(ht, backwards.Id); entries !=
+		expectedEntries {
+		t.Fatalf("%s: expected %d duration index entries for the "+
+			"backwards span, but got %d.\n", policy, expectedEntries,
+			entries)
+	}
+	testQuery(t, ht, &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.LESS_THAN_OR_EQUALS,
+				Field: common.DURATION,
+				Val:   "1000",
+			},
+		},
+		Lim: 10,
+	}, expected)
+
+	// Only a clamped span is counted in the description statistics.
+	ds := findDescStats(ht, "backwards")
+	if policy == NEGATIVE_DURATION_POLICY_CLAMP {
+		if ds == nil || ds.Count != 1 || ds.MinNs != 0 {
+			t.Fatalf("%s: expected statistics for one zero-length "+
+				"backwards span, but got %s\n", policy, asJson(ds))
+		}
+	} else if ds != nil {
+		t.Fatalf("%s: expected no statistics for the backwards span, but "+
+			"got %s\n", policy, asJson(ds))
+	}
+
+	// Whatever the policy, the span is counted against its client.
+	stats := ht.Store.ServerStats()
+	if stats.NegativeDurationPolicy != policy ||
+		stats.NegativeDurationSpans != 1 ||
+		len(stats.NegativeDurationOffenders) != 1 {
+		t.Fatalf("%s: expected one span with a negative duration, but got "+
+			"%s\n", policy, asJson(stats))
+	}
+	off := stats.NegativeDurationOffenders[0]
+	if off.Addr != "127.0.0.1" || off.NumSpans != 1 ||
+		!off.WorstSpanId.Equal(backwards.Id) || off.WorstTracerId != "negd" ||
+		off.WorstMs != 30 {
+		t.Fatalf("%s: unexpected offender %s\n", policy, asJson(off))
+	}
+	clients := ht.Store.msink.GetClientStats("", "127.0.0.1", 10).Clients
+	if len(clients) != 1 || clients[0].NegativeDurations != 1 {
+		t.Fatalf("%s: expected the client metrics to count one negative "+
+			"duration, but got %s\n", policy, asJson(clients))
+	}
+	if stats.IndexSkippedSpans != 0 {
+		t.Fatalf("%s: expected the backwards span not to be counted as "+
+			"too short to index, but got %d.\n", policy,
+			stats.IndexSkippedSpans)
+	}
+}
+
+// Spans with arbitrary times can end so far before they begin that the
+// duration doesn't fit in nanoseconds.  They must still be reported.
+func TestNegativeDurationOverflow(t *testing.T) {
+	t.Parallel()
+	htraceBld := &MiniHTracedBuilder{Name: "TestNegativeDurationOverflow",
+		Cnf: map[string]string{
+			conf.HTRACE_INGEST_NEG_DURATION_POLICY: NEGATIVE_DURATION_POLICY_CLAMP,
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	span := &common.Span{Id: common.TestId("00000000000000000000000000000001"),
+		SpanData: common.SpanData{
+			Begin:       math.MaxInt64 - 1,
+			End:         1,
+			Description: "backwards",
+			Parents:     []common.SpanId{},
+			TracerId:    "negd",
+		}}
+	err = hcl.WriteSpans([]*common.Span{span})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	stored := ht.Store.FindSpan(span.Id)
+	if stored == nil || stored.End != stored.Begin ||
+		stored.Info[common.NEGATIVE_DURATION_INFO_KEY] !=
+			"-9223372036854775808" {
+		t.Fatalf("Expected the span to be clamped, but got %s\n",
+			asJson(stored))
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if len(stats.NegativeDurationOffenders) != 1 {
+		t.Fatalf("Expected one offender, but got %s\n", asJson(stats))
+	}
+	off := stats.NegativeDurationOffenders[0]
+	if !off.WorstSpanId.Equal(span.Id) || off.WorstMs != math.MaxInt64-2 {
+		t.Fatalf("unexpected offender %s\n", asJson(off))
+	}
+}
+
+func TestNegativeDurationConfigValidation(t *testing.T) {
+	t.Parallel()
+	for _, vals := range []map[string]string{
+		{conf.HTRACE_INGEST_NEG_DURATION_POLICY: "ignore"},
+		{conf.HTRACE_INGEST_NEG_DURATION_POLICY: "Clamp"},
+	} {
+		htraceBld := &MiniHTracedBuilder{
+			Name: "TestNegativeDurationConfigValidation",
+			Cnf:  vals,
+		}
+		ht, err := htraceBld.Build()
+		if err == nil {
+			ht.Close()
+			t.Fatalf("Expected building with %s to fail.\n", asJson(vals))
+		}
+	}
+}
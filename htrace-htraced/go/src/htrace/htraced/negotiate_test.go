@@ -0,0 +1,318 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ugorji/go/codec"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestHrpcNegotiation(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcNegotiation",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	allMethods := []string{common.METHOD_NAME_WRITE_SPANS,
+		common.METHOD_NAME_HELLO}
+	version, err := hcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	if version.HrpcProtocolVersion != common.HRPC_PROTOCOL_VERSION ||
+		!reflect.DeepEqual(version.HrpcMethods, allMethods) {
+		t.Fatalf("Unexpected HRPC info in %s\n", asJson(version))
+	}
+
+	// The client negotiates the first time it needs HRPC.
+	infos := hcl.TransportInfo()
+	if len(infos) != 1 || infos[0].Negotiated ||
+		infos[0].HrpcAddr != ht.Hsv.Addr().String() {
+		t.Fatalf("Unexpected transport info before writing %s\n",
+			asJson(infos))
+	}
+	spans := createRandomTestSpans(3)
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+	infos = hcl.TransportInfo()
+	if !infos[0].Negotiated ||
+		infos[0].HrpcProtocolVersion != common.HRPC_PROTOCOL_VERSION ||
+		!reflect.DeepEqual(infos[0].HrpcMethods, allMethods) {
+		t.Fatalf("Unexpected transport info after writing %s\n",
+			asJson(infos))
+	}
+}
+
+// Check that every client API works against a server which supports some
+// HRPC methods, and that writes use the expected transport.
+func testHrpcCompatibility(t *testing.T, name string, hooks *hrpcTestHooks,
+	expectedInfo *htrace.TransportInfo, expectedTransport string) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcCompatibility" + name,
+		DataDirs:      make([]string, 2),
+		WrittenSpans:  common.NewSemaphore(0),
+		HrpcTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	allSpans := createRandomTestSpans(12)
+	err = hcl.WriteSpans(allSpans[0:2])
+	if err != nil {
+		t.Fatalf("%s: WriteSpans failed: %s\n", name, err.Error())
+	}
+	err = hcl.WriteSpansWithMetadata(allSpans[2:4],
+		map[string]string{"job": name})
+	if err != nil {
+		t.Fatalf("%s: WriteSpansWithMetadata failed: %s\n", name, err.Error())
+	}
+	res, err := hcl.WriteSpansDetailed(allSpans[4:], nil)
+	if err != nil {
+		t.Fatalf("%s: WriteSpansDetailed failed: %s\n", name, err.Error())
+	}
+	if res.NumChunks != 2 {
+		t.Fatalf("%s: expected the write to be split in 2, but got %s\n",
+			name, asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(allSpans)))
+
+	infos := hcl.TransportInfo()
+	expectedInfo.RestAddr = infos[0].RestAddr
+	expectedInfo.HrpcAddr = ht.Hsv.Addr().String()
+	if !reflect.DeepEqual(&infos[0], expectedInfo) {
+		t.Fatalf("%s: expected transport info %s, but got %s\n", name,
+			asJson(expectedInfo), asJson(infos[0]))
+	}
+	entries, err := hcl.GetAuditEntries(100)
+	if err != nil {
+		t.Fatalf("%s: GetAuditEntries failed: %s\n", name, err.Error())
+	}
+	if len(entries) != 4 {
+		t.Fatalf("%s: expected 4 audit entries, but got %s\n", name,
+			asJson(entries))
+	}
+	for i := range entries {
+		if entries[i].Transport != expectedTransport {
+			t.Fatalf("%s: expected writes over %s, but got %s\n", name,
+				expectedTransport, asJson(entries))
+		}
+	}
+
+	// The reads only use REST.
+	span, err := hcl.FindSpan(allSpans[1].Id)
+	if err != nil {
+		t.Fatalf("%s: FindSpan failed: %s\n", name, err.Error())
+	}
+	expectSpanStored(t, allSpans[1], span)
+	children, err := hcl.FindChildren(allSpans[0].Id, 10)
+	if err != nil {
+		t.Fatalf("%s: FindChildren failed: %s\n", name, err.Error())
+	}
+	if len(children) != 1 || !children[0].Equal(allSpans[1].Id) {
+		t.Fatalf("%s: unexpected children %s\n", name, asJson(children))
+	}
+	spans, err := hcl.Query(&common.Query{Lim: 100})
+	if err != nil {
+		t.Fatalf("%s: Query failed: %s\n", name, err.Error())
+	}
+	if len(spans) != len(allSpans) {
+		t.Fatalf("%s: expected %d spans, but the query found %d\n", name,
+			len(allSpans), len(spans))
+	}
+	_, err = hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("%s: GetServerStats failed: %s\n", name, err.Error())
+	}
+}
+
+func TestHrpcCompatibility(t *testing.T) {
+	// A server which doesn't support Hello, but rejects it, rather than
+	// closing the connection.
+	testHrpcCompatibility(t, "NoHello", &hrpcTestHooks{
+		MaskMethods: 1 << common.METHOD_ID_HELLO,
+	}, &htrace.TransportInfo{
+		Negotiated:          true,
+		HrpcProtocolVersion: 0,
+		HrpcMethods:         []string{common.METHOD_NAME_WRITE_SPANS},
+	}, AUDIT_TRANSPORT_HRPC)
+
+	// A version 0 server, which closes the connection when it gets a Hello.
+	testHrpcCompatibility(t, "Version0", &hrpcTestHooks{
+		MaskMethods:        1 << common.METHOD_ID_HELLO,
+		CloseOnUnsupported: true,
+	}, &htrace.TransportInfo{
+		Negotiated:          true,
+		HrpcProtocolVersion: 0,
+		HrpcMethods:         []string{common.METHOD_NAME_WRITE_SPANS},
+	}, AUDIT_TRANSPORT_HRPC)
+
+	// A server which takes writes over REST only.
+	testHrpcCompatibility(t, "NoWriteSpans", &hrpcTestHooks{
+		MaskMethods: 1 << common.METHOD_ID_WRITE_SPANS,
+	}, &htrace.TransportInfo{
+		Negotiated:          true,
+		HrpcProtocolVersion: common.HRPC_PROTOCOL_VERSION,
+		HrpcMethods:         []string{common.METHOD_NAME_HELLO},
+		HrpcMaxInFlight:     common.HRPC_MAX_IN_FLIGHT,
+	}, AUDIT_TRANSPORT_REST)
+
+	// A server which supports no HRPC methods at all.
+	testHrpcCompatibility(t, "NoMethods", &hrpcTestHooks{
+		MaskMethods: common.HRPC_ALL_METHODS,
+	}, &htrace.TransportInfo{
+		Negotiated:          true,
+		HrpcProtocolVersion: 0,
+		HrpcMethods:         []string{},
+	}, AUDIT_TRANSPORT_REST)
+}
+
+// Send an HRPC request with a raw body, and read the response.  Returns the
+// response header, the error message, and the response body.
+func sendRawHrpc(t *testing.T, conn net.Conn, methodId uint32, seq uint64,
+	body []byte) (*common.HrpcResponseHeader, string, []byte) {
+	hdr := common.HrpcRequestHeader{
+		Magic:    common.HRPC_MAGIC,
+		MethodId: methodId,
+		Seq:      seq,
+		Length:   uint32(len(body)),
+	}
+	err := binary.Write(conn, binary.LittleEndian, &hdr)
+	if err != nil {
+		t.Fatalf("failed to write request header: %s\n", err.Error())
+	}
+	_, err = conn.Write(body)
+	if err != nil {
+		t.Fatalf("failed to write request body: %s\n", err.Error())
+	}
+	var resp common.HrpcResponseHeader
+	err = binary.Read(conn, binary.LittleEndian, &resp)
+	if err != nil {
+		t.Fatalf("failed to read response header: %s\n", err.Error())
+	}
+	errBuf := make([]byte, resp.ErrLength)
+	_, err = io.ReadFull(conn, errBuf)
+	if err != nil {
+		t.Fatalf("failed to read response error: %s\n", err.Error())
+	}
+	respBody := make([]byte, resp.Length)
+	_, err = io.ReadFull(conn, respBody)
+	if err != nil {
+		t.Fatalf("failed to read response body: %s\n", err.Error())
+	}
+	return &resp, string(errBuf), respBody
+}
+
+// Check that the server answers a request for an unknown method with
+// ERR_UNSUPPORTED_METHOD, and keeps the connection open.
+func TestHrpcUnknownMethod(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcUnknownMethod",
+		DataDirs: make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	conn, err := net.Dial("tcp", ht.Hsv.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect: %s\n", err.Error())
+	}
+	defer conn.Close()
+
+	const UNKNOWN_METHOD_ID = 0x77
+	hdr, errStr, _ := sendRawHrpc(t, conn, UNKNOWN_METHOD_ID, 5,
+		[]byte("not a real request"))
+	if hdr.Seq != 5 || hdr.MethodId != UNKNOWN_METHOD_ID {
+		t.Fatalf("Unexpected response header %s\n", asJson(hdr))
+	}
+	herr := common.ParseHtraceError(errStr)
+	if herr == nil || herr.Code() != common.ERR_UNSUPPORTED_METHOD {
+		t.Fatalf("Expected an %s error, but got '%s'\n",
+			common.ERR_UNSUPPORTED_METHOD, errStr)
+	}
+
+	// The connection can still be used.
+	mh := codec.MsgpackHandle{WriteExt: true}
+	var w bytes.Buffer
+	err = codec.NewEncoder(&w, &mh).Encode(&common.HrpcHelloReq{
+		ProtocolVersion: common.HRPC_PROTOCOL_VERSION,
+		Methods:         1 << common.METHOD_ID_HELLO,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode Hello: %s\n", err.Error())
+	}
+	hdr, errStr, body := sendRawHrpc(t, conn, common.METHOD_ID_HELLO, 6,
+		w.Bytes())
+	if hdr.Seq != 6 || errStr != "" {
+		t.Fatalf("Hello failed: %s %s\n", asJson(hdr), errStr)
+	}
+	var hello common.HrpcHelloResp
+	err = codec.NewDecoderBytes(body, &mh).Decode(&hello)
+	if err != nil {
+		t.Fatalf("failed to decode Hello response: %s\n", err.Error())
+	}
+	if hello.ProtocolVersion != common.HRPC_PROTOCOL_VERSION ||
+		hello.Methods != common.HRPC_ALL_METHODS {
+		t.Fatalf("Unexpected Hello response %s\n", asJson(hello))
+	}
+
+	// The client said that it doesn't support WriteSpans, so the server
+	// rejects it on this connection.
+	hdr, errStr, _ = sendRawHrpc(t, conn, common.METHOD_ID_WRITE_SPANS, 7,
+		[]byte("{}"))
+	herr = common.ParseHtraceError(errStr)
+	if hdr.Seq != 7 || herr == nil ||
+		herr.Code() != common.ERR_UNSUPPORTED_METHOD {
+		t.Fatalf("Expected WriteSpans to be rejected, but got %s '%s'\n",
+			asJson(hdr), errStr)
+	}
+	if ht.Hsv.GetNumIoErrors() != 0 {
+		t.Fatalf("Expected no I/O errors, but got %d\n",
+			ht.Hsv.GetNumIoErrors())
+	}
+}
@@ -0,0 +1,249 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Check that the spans in the delivered chunks of a write were stored, and
+// that the spans in the undelivered chunks were not.
+func expectDelivered(t *testing.T, ht *MiniHTraced, spans common.SpanSlice,
+	undelivered []htrace.SpanRange) {
+	isUndelivered := make([]bool, len(spans))
+	for _, r := range undelivered {
+		for i := r.Begin; i < r.End; i++ {
+			isUndelivered[i] = true
+		}
+	}
+	for i := range spans {
+		found := ht.Store.FindSpan(spans[i].Id) != nil
+		if found == isUndelivered[i] {
+			t.Fatalf("Span %d: expected found=%t, but got found=%t.  "+
+				"Undelivered: %s\n", i, !isUndelivered[i], found,
+				asJson(undelivered))
+		}
+	}
+}
+
+func TestHrpcPipelining(t *testing.T) {
+	// Answer every other request late, so that the responses come back out
+	// of order.
+	var numResponses int32
+	hooks := &hrpcTestHooks{
+		HandleWriteSpansResponse: func() {
+			if atomic.AddInt32(&numResponses, 1)%2 == 1 {
+				time.Sleep(20 * time.Millisecond)
+			}
+		},
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcPipelining",
+		DataDirs:      make([]string, 2),
+		WrittenSpans:  common.NewSemaphore(0),
+		HrpcTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "0",
+		conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT, "4"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// The requests are read in the order they were sent, so the rejected
+	// chunks are the ones with the same indexes.  The other chunks are
+	// delivered, whatever order they are answered in.
+	ht.Store.faults = &rejectWritesFaults{
+		reject: map[int]bool{2: true, 5: true, 6: true, 9: true},
+	}
+	allSpans := createRandomTestSpans(60)
+	res, err := hcl.WriteSpansDetailed(allSpans, nil)
+	werr, ok := err.(*htrace.WriteSpansError)
+	if !ok {
+		t.Fatalf("Expected a WriteSpansError, but got %v\n", err)
+	}
+	if common.ErrorCodeOf(werr.Err) != common.ERR_INTERNAL {
+		t.Fatalf("Expected the rejection error, but got %s\n",
+			werr.Err.Error())
+	}
+	expectedUndelivered := []htrace.SpanRange{
+		htrace.SpanRange{Begin: 10, End: 15},
+		htrace.SpanRange{Begin: 25, End: 35},
+		htrace.SpanRange{Begin: 45, End: 50},
+	}
+	if asJson(res.Undelivered) != asJson(expectedUndelivered) {
+		t.Fatalf("Expected undelivered spans %s, but got %s\n",
+			asJson(expectedUndelivered), asJson(res.Undelivered))
+	}
+	if res.NumChunks != 8 {
+		t.Fatalf("Expected 8 chunks to be delivered, but got %s\n",
+			asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(40)
+	expectDelivered(t, ht, allSpans, res.Undelivered)
+	infos := hcl.TransportInfo()
+	if infos[0].HrpcMaxInFlight != common.HRPC_MAX_IN_FLIGHT {
+		t.Fatalf("Expected the server to allow %d requests in flight, but "+
+			"got %s\n", common.HRPC_MAX_IN_FLIGHT, asJson(infos))
+	}
+
+	// With retries, the rejected chunks are sent again.
+	retryHcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "1",
+		conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT, "4"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer retryHcl.Close()
+	ht.Store.faults = &rejectWritesFaults{
+		reject: map[int]bool{0: true, 3: true, 4: true},
+	}
+	res, err = retryHcl.WriteSpansDetailed(allSpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 12 {
+		t.Fatalf("Expected 12 chunks to be delivered, but got %s\n",
+			asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(60)
+	expectDelivered(t, ht, allSpans, nil)
+}
+
+func TestHrpcPipelineConnectionLost(t *testing.T) {
+	// The server closes each connection after the Hello and three writes.
+	htraceBld := &MiniHTracedBuilder{Name: "TestHrpcPipelineConnectionLost",
+		DataDirs:      make([]string, 2),
+		WrittenSpans:  common.NewSemaphore(0),
+		HrpcTestHooks: &hrpcTestHooks{CloseAfterRequests: 4},
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "0",
+		conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT, "4"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// The first four chunks are sent before any of them is answered.  The
+	// fourth one is never read, so it fails when the connection closes.
+	// Without retries, it is reported as undelivered, along with any other
+	// chunks which were in flight.  Chunks which were never sent go over new
+	// connections.
+	allSpans := createRandomTestSpans(60)
+	res, err := hcl.WriteSpansDetailed(allSpans, nil)
+	werr, ok := err.(*htrace.WriteSpansError)
+	if !ok {
+		t.Fatalf("Expected a WriteSpansError, but got %v\n", err)
+	}
+	if common.ErrorCodeOf(werr.Err) != common.ERR_CONNECTION_LOST {
+		t.Fatalf("Expected a lost connection error, but got %s\n",
+			werr.Err.Error())
+	}
+	if res.Undelivered[0].Begin != 15 {
+		t.Fatalf("Expected the first three chunks to be delivered, and the "+
+			"fourth to be lost, but got %s\n", asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(int64(60 - werr.NumUndelivered()))
+	expectDelivered(t, ht, allSpans, res.Undelivered)
+
+	// With retries, the lost chunks are sent again.
+	retryHcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "1",
+		conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT, "4"), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer retryHcl.Close()
+	res, err = retryHcl.WriteSpansDetailed(allSpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 12 {
+		t.Fatalf("Expected 12 chunks to be delivered, but got %s\n",
+			asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(60)
+	expectDelivered(t, ht, allSpans, nil)
+}
+
+// Write spans split into many requests to a server which takes a while to
+// answer each one, with up to maxInFlight requests in flight at once.
+func benchmarkHrpcWriteLatency(b *testing.B, maxInFlight string) {
+	hooks := &hrpcTestHooks{
+		HandleWriteSpansResponse: func() {
+			time.Sleep(2 * time.Millisecond)
+		},
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkHrpcWriteLatency",
+		Cnf: map[string]string{
+			conf.HTRACE_LOG_LEVEL: "INFO",
+		},
+		DataDirs:      make([]string, 2),
+		HrpcTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "10",
+		conf.HTRACE_CLIENT_HRPC_MAX_IN_FLIGHT, maxInFlight), nil)
+	if err != nil {
+		b.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	allSpans := createRandomTestSpans(500)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, err = hcl.WriteSpansDetailed(allSpans, nil)
+		if err != nil {
+			b.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+		}
+	}
+}
+
+func BenchmarkHrpcWriteLatencySerial(b *testing.B) {
+	benchmarkHrpcWriteLatency(b, "1")
+}
+
+func BenchmarkHrpcWriteLatencyPipelined(b *testing.B) {
+	benchmarkHrpcWriteLatency(b, "16")
+}
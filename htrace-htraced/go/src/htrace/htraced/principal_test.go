@@ -0,0 +1,192 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Create spans which claim to have been written by mallory.  Each seed gives
+// a different set of spans.
+func createSpoofedTestSpans(seed int64, n int) []*common.Span {
+	rnd := rand.New(rand.NewSource(seed))
+	spans := make([]*common.Span, n)
+	for i := range spans {
+		spans[i] = test.NewRandomSpan(rnd, spans[0:i])
+		spans[i].Info = common.TraceInfoMap{
+			common.PRINCIPAL_INFO_KEY: "mallory",
+			"color":                   "red",
+		}
+	}
+	return spans
+}
+
+func expectPrincipal(t *testing.T, ht *MiniHTraced, spans []*common.Span,
+	principal string) {
+	for i := range spans {
+		span := ht.Store.FindSpan(spans[i].Id)
+		if span == nil {
+			t.Fatalf("Failed to find span %s\n", spans[i].Id.String())
+		}
+		val, found := span.Info[common.PRINCIPAL_INFO_KEY]
+		if principal == "" {
+			if found {
+				t.Fatalf("Expected span %s to have no principal, but got "+
+					"%s\n", span.Id.String(), asJson(span.Info))
+			}
+		} else if val != principal {
+			t.Fatalf("Expected span %s to have principal %s, but got %s\n",
+				span.Id.String(), principal, asJson(span.Info))
+		}
+		if span.Info["color"] != "red" {
+			t.Fatalf("Expected span %s to keep its other info, but got %s\n",
+				span.Id.String(), asJson(span.Info))
+		}
+	}
+}
+
+func TestSpanPrincipals(t *testing.T) {
+	tmpDir, err := ioutil.TempDir(os.TempDir(), "TestSpanPrincipals")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(tmpDir)
+	tokenFile := filepath.Join(tmpDir, "tokens")
+	writeTokenFile(t, tokenFile, "alicetok read,write alice\n"+
+		"anontok read,write\n")
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanPrincipals",
+		Cnf: map[string]string{
+			conf.HTRACE_AUTH_MODE:       AUTH_MODE_TOKEN_FILE,
+			conf.HTRACE_AUTH_TOKEN_FILE: tokenFile,
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	newClient := func(token string, hrpc bool) *htrace.Client {
+		hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+			conf.HTRACE_CLIENT_AUTH_TOKEN, token), &htrace.TestHooks{
+			HrpcDisabled: !hrpc,
+		})
+		if err != nil {
+			t.Fatalf("failed to create client: %s", err.Error())
+		}
+		return hcl
+	}
+	alice := newClient("alicetok", false)
+	defer alice.Close()
+	aliceHrpc := newClient("alicetok", true)
+	defer aliceHrpc.Close()
+	anonHrpc := newClient("anontok", true)
+	defer anonHrpc.Close()
+
+	// The principal the client claims is replaced by the one its token
+	// belongs to.
+	restSpans := createSpoofedTestSpans(1, 3)
+	err = alice.WriteSpans(restSpans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	hrpcSpans := createSpoofedTestSpans(2, 2)
+	err = aliceHrpc.WriteSpans(hrpcSpans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	anonSpans := createSpoofedTestSpans(3, 4)
+	err = anonHrpc.WriteSpans(anonSpans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(9)
+	expectPrincipal(t, ht, restSpans, "alice")
+	expectPrincipal(t, ht, hrpcSpans, "alice")
+	anon := defaultPrincipal("anontok")
+	expectPrincipal(t, ht, anonSpans, anon)
+
+	stats, err := alice.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if len(stats.SpansByPrincipal) != 2 ||
+		stats.SpansByPrincipal["alice"] != 5 ||
+		stats.SpansByPrincipal[anon] != 4 {
+		t.Fatalf("Unexpected per-principal span counts %s\n",
+			asJson(stats.SpansByPrincipal))
+	}
+
+	// The spans can be found by principal.
+	spans, err := alice.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.EQUALS, Field: common.PRINCIPAL,
+				Val: "alice"},
+		},
+		Lim: 100,
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(spans) != 5 {
+		t.Fatalf("Expected alice's 5 spans, but got %s\n", asJson(spans))
+	}
+}
+
+func TestSpanPrincipalsAllowAll(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanPrincipalsAllowAll",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createSpoofedTestSpans(1, 3)
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(3)
+	expectPrincipal(t, ht, spans, "")
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if len(stats.SpansByPrincipal) != 0 {
+		t.Fatalf("Expected no per-principal span counts, but got %s\n",
+			asJson(stats.SpansByPrincipal))
+	}
+}
@@ -0,0 +1,113 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+)
+
+//
+// Per-principal and per-tracer span counts.
+//
+// When the Authenticator knows which principal sent a write, we count the
+// spans it wrote, so that operators can see who is filling up the server.
+// Unlike addresses, principals are few and long-lived, so we keep a separate,
+// smaller bound on them.  When it is reached, the principal which wrote
+// spans least recently is forgotten.  The failed spans of each tracer are
+// counted the same way, bounded by metrics.max.tracer.entries.
+//
+
+type spanCountTracker struct {
+	lg *common.Logger
+
+	// What the keys are, for log messages.
+	what string
+
+	// The maximum number of keys we will track.
+	maxKeys int
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The number of spans counted for each key.
+	counts map[string]uint64
+
+	// Tracks which key was counted least recently.
+	lru *addrLru
+
+	// Incremented each time spans are counted.
+	seq uint64
+}
+
+func newSpanCountTracker(lg *common.Logger, what string,
+	maxKeys int) *spanCountTracker {
+	return &spanCountTracker{
+		lg:      lg,
+		what:    what,
+		maxKeys: maxKeys,
+		counts:  make(map[string]uint64),
+		lru:     newAddrLru(),
+	}
+}
+
+func newPrincipalTracker(lg *common.Logger,
+	cnf *conf.Config) *spanCountTracker {
+	return newSpanCountTracker(lg, "principal",
+		cnf.GetInt(conf.HTRACE_METRICS_MAX_PRINCIPAL_ENTRIES))
+}
+
+func newTracerErrorTracker(lg *common.Logger,
+	cnf *conf.Config) *spanCountTracker {
+	return newSpanCountTracker(lg, "tracer",
+		cnf.GetInt(conf.HTRACE_METRICS_MAX_TRACER_ENTRIES))
+}
+
+// Count some spans for a key.
+func (sct *spanCountTracker) observe(key string, numSpans int) {
+	if sct.maxKeys <= 0 {
+		return
+	}
+	sct.lock.Lock()
+	defer sct.lock.Unlock()
+	if _, found := sct.counts[key]; !found {
+		if len(sct.counts) >= sct.maxKeys && sct.lru.Len() > 0 {
+			k := sct.lru.evict()
+			sct.lg.Warnf("Evicting span count for %s %s because "+
+				"there are more than %d %ss.\n", sct.what, k, sct.maxKeys,
+				sct.what)
+			delete(sct.counts, k)
+		}
+	}
+	sct.counts[key] += uint64(numSpans)
+	sct.seq++
+	sct.lru.touch(key, sct.seq)
+}
+
+// Get the number of spans counted for each key we are tracking.
+func (sct *spanCountTracker) stats() map[string]uint64 {
+	sct.lock.Lock()
+	defer sct.lock.Unlock()
+	ret := make(map[string]uint64, len(sct.counts))
+	for key, count := range sct.counts {
+		ret[key] = count
+	}
+	return ret
+}
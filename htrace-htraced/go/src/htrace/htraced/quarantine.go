@@ -0,0 +1,260 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+//
+// Shard quarantine.
+//
+// A shard whose leveldb instance can't be opened, or which starts returning
+// corruption errors, is quarantined rather than taking down the whole
+// datastore.  Reads skip quarantined shards, and spans which hash to a
+// quarantined shard are either redirected to the next healthy shard or
+// dropped, depending on datastore.quarantine.policy.  A quarantined shard
+// can be retried once it has been repaired out of band.
+//
+
+// Write spans destined for a quarantined shard to the next healthy shard.
+const QUARANTINE_POLICY_REDIRECT = "redirect"
+
+// Drop spans destined for a quarantined shard.
+const QUARANTINE_POLICY_DROP = "drop"
+
+// Returns true if the given leveldb error indicates that the shard's files
+// are corrupt.
+func isCorruptionError(err error) bool {
+	return err != nil && strings.Index(err.Error(), "Corruption:") != -1
+}
+
+// Returns true if the given leveldb error indicates that the shard's lock
+// file is held by someone else.
+func isLockError(err error) bool {
+	return err != nil && strings.Index(err.Error(), "/LOCK:") != -1
+}
+
+// Acquire the shard's leveldb instance.  Returns false if the shard is
+// quarantined.  After a successful acquire, the caller must call release once
+// it is done with shd.ldb.  A goroutine must not acquire a shard it already
+// holds, since a pending retry could then deadlock it.
+func (shd *shard) acquire() bool {
+	shd.ldbLock.RLock()
+	if shd.ldb == nil || shd.isQuarantined() {
+		shd.ldbLock.RUnlock()
+		return false
+	}
+	return true
+}
+
+// Release a shard which was acquired with acquire.
+func (shd *shard) release() {
+	shd.ldbLock.RUnlock()
+}
+
+func (shd *shard) isQuarantined() bool {
+	shd.qlock.Lock()
+	defer shd.qlock.Unlock()
+	return shd.qerr != nil
+}
+
+// Quarantine the shard.  This does nothing if the shard is already
+// quarantined.
+func (shd *shard) quarantine(err error) {
+	shd.qlock.Lock()
+	defer shd.qlock.Unlock()
+	if shd.qerr != nil {
+		return
+	}
+	shd.qerr = err
+	shd.qtimeMs = common.TimeToUnixMs(time.Now().UTC())
+	shd.store.clearReadCaches()
+	shd.store.lg.Errorf("QUARANTINED shard %s: %s\n", shd.path, err.Error())
+}
+
+// Quarantine the shard if the given leveldb error indicates corruption.
+// Returns true if the shard was quarantined.
+func (shd *shard) checkCorruption(err error) bool {
+	if !isCorruptionError(err) {
+		return false
+	}
+	shd.quarantine(err)
+	return true
+}
+
+func (shd *shard) health() common.ShardHealth {
+	shd.qlock.Lock()
+	defer shd.qlock.Unlock()
+	health := common.ShardHealth{
+		Path:          shd.path,
+		Healthy:       shd.qerr == nil,
+		QuarantinedMs: shd.qtimeMs,
+	}
+	if shd.qerr != nil {
+		health.Error = shd.qerr.Error()
+	}
+	return health
+}
+
+// Get the index of the shard which a new span should be written to, or -1 if
+// the span should be dropped because its shard is quarantined.
+func (store *dataStore) getWriteShardIndex(sid common.SpanId) int {
+	shardIdx := store.getShardIndex(sid)
+	if !store.shards[shardIdx].isQuarantined() {
+		return shardIdx
+	}
+	if store.quarantinePolicy == QUARANTINE_POLICY_DROP {
+		return -1
+	}
+	numShards := len(store.shards)
+	for i := 1; i < numShards; i++ {
+		idx := (shardIdx + i) % numShards
+		if !store.shards[idx].isQuarantined() {
+			atomic.StoreInt32(&store.redirected, 1)
+			return idx
+		}
+	}
+	return -1
+}
+
+// Get the number of quarantined shards.
+func (store *dataStore) numQuarantined() int {
+	num := 0
+	for i := range store.shards {
+		if store.shards[i].isQuarantined() {
+			num++
+		}
+	}
+	return num
+}
+
+// Get the health of each shard.
+func (store *dataStore) Health() *common.ServerHealth {
+	health := &common.ServerHealth{
+		Healthy: true,
+		Shards:  make([]common.ShardHealth, len(store.shards)),
+	}
+	health.IngestPause = store.pause.get()
+	for i := range store.shards {
+		health.Shards[i] = store.shards[i].health()
+		if !health.Shards[i].Healthy {
+			health.Healthy = false
+		}
+	}
+	return health
+}
+
+// Try to reopen a quarantined shard, for example after its leveldb instance
+// has been repaired out of band.  The reopened shard must have the same
+// DaemonId and ShardIndex it had before.  Retrying a healthy shard does
+// nothing.  Returns the health of the shard after the retry.
+func (store *dataStore) RetryShard(shardIdx int) (*common.ShardHealth, error) {
+	if shardIdx < 0 || shardIdx >= len(store.shards) {
+		return nil, errors.New(fmt.Sprintf("Invalid shard index %d.  There "+
+			"are %d shards.", shardIdx, len(store.shards)))
+	}
+	shd := store.shards[shardIdx]
+	shd.ldbLock.Lock()
+	defer shd.ldbLock.Unlock()
+	if !shd.isQuarantined() {
+		health := shd.health()
+		return &health, nil
+	}
+	if shd.ldb != nil {
+		shd.ldb.Close()
+		shd.ldb = nil
+	}
+	ldb, info, err := store.reopenShard(shardIdx)
+	if err != nil {
+		store.lg.Errorf("Failed to reopen quarantined shard %s: %s\n",
+			shd.path, err.Error())
+		shd.qlock.Lock()
+		shd.qerr = err
+		shd.qlock.Unlock()
+		return nil, err
+	}
+	shd.ldb = ldb
+	shd.loadSpanCount(info)
+	shd.loadBloom()
+	if store.seqsEnabled {
+		// The shard may have recorded a reservation we haven't seen yet.
+		store.advanceSeqs(shd.readSeqLimit())
+	}
+	shd.qlock.Lock()
+	shd.qerr = nil
+	shd.qtimeMs = 0
+	shd.qlock.Unlock()
+	store.clearReadCaches()
+	store.lg.Infof("Shard %s is no longer quarantined.\n", shd.path)
+	health := shd.health()
+	return &health, nil
+}
+
+// Open the leveldb instance of a shard and verify its ShardInfo.
+func (store *dataStore) reopenShard(shardIdx int) (shardDB, *ShardInfo, error) {
+	path := store.shards[shardIdx].path
+	opts := store.shards[shardIdx].openOpts
+	if opts == nil {
+		opts = store.openOpts
+	}
+	ldb, err := openShardDB(store.lg, store.backend, path, opts, false,
+		store.stealLocks)
+	if err != nil {
+		return nil, nil, errors.New(fmt.Sprintf("Open() error on %s "+
+			"directory %s: %s.", store.backend, path, err.Error()))
+	}
+	info, err := readShardInfo(ldb, store.readOpts, path)
+	if err == nil {
+		if info.backendName() != store.backend {
+			err = backendMismatchError(path, info.backendName(),
+				store.backend)
+		} else if info.LayoutVersion != store.shardInfo.LayoutVersion {
+			err = errors.New(fmt.Sprintf("Shard %s has layout version "+
+				"0x%016x, but we expected 0x%016x.", path,
+				info.LayoutVersion, store.shardInfo.LayoutVersion))
+		} else if info.DaemonId != store.shardInfo.DaemonId {
+			err = errors.New(fmt.Sprintf("Shard %s has daemonId 0x%016x, "+
+				"but we expected 0x%016x.", path, info.DaemonId,
+				store.shardInfo.DaemonId))
+		} else if info.TotalShards != store.shardInfo.TotalShards {
+			err = errors.New(fmt.Sprintf("Shard %s has TotalShards = %d, "+
+				"but we expected %d.", path, info.TotalShards,
+				store.shardInfo.TotalShards))
+		} else if info.placementName() != store.shardInfo.placementName() {
+			err = errors.New(fmt.Sprintf("Shard %s has placement %s, but we "+
+				"expected %s.", path, info.placementName(),
+				store.shardInfo.placementName()))
+		} else if info.ShardIndex != uint32(shardIdx) {
+			err = errors.New(fmt.Sprintf("Shard %s has ShardIndex = %d, "+
+				"but we expected %d.", path, info.ShardIndex, shardIdx))
+		}
+	}
+	if err != nil {
+		ldb.Close()
+		return nil, nil, err
+	}
+	return ldb, info, nil
+}
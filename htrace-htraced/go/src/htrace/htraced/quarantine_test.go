@@ -0,0 +1,285 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Find the spans which hash to the given shard, and those which don't.
+func partitionSpansByShard(store *dataStore, spans []*common.Span,
+	shardIdx int) ([]*common.Span, []*common.Span) {
+	in := make([]*common.Span, 0)
+	out := make([]*common.Span, 0)
+	for i := range spans {
+		if store.getShardIndex(spans[i].Id) == shardIdx {
+			in = append(in, spans[i])
+		} else {
+			out = append(out, spans[i])
+		}
+	}
+	return in, out
+}
+
+func TestQuarantineCorruptShard(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQuarantineCorruptShard",
+		DataDirs:            make([]string, 3),
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	NUM_TEST_SPANS := 30
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	ingestSpans(ht, allSpans)
+	lost, kept := partitionSpansByShard(ht.Store, allSpans, 1)
+	if len(lost) == 0 || len(kept) == 0 {
+		t.Fatalf("expected the test spans to be spread over all shards.\n")
+	}
+	ht.Close()
+	ht = nil
+
+	// Corrupt the second shard.  The CURRENT file names the leveldb
+	// manifest, and must end with a newline.
+	currentPath := filepath.Join(dataDirs[1], "db", "CURRENT")
+	current, err := ioutil.ReadFile(currentPath)
+	if err != nil {
+		t.Fatalf("failed to read %s: %s\n", currentPath, err.Error())
+	}
+	err = ioutil.WriteFile(currentPath, []byte("garbage"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s\n", currentPath, err.Error())
+	}
+
+	// The datastore should load, with only the second shard quarantined.
+	htraceBld = &MiniHTracedBuilder{Name: "TestQuarantineCorruptShard2",
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err = htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to reopen datastore with a corrupt shard: %s",
+			err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	health, err := hcl.GetServerHealth()
+	if err != nil {
+		t.Fatalf("GetServerHealth failed: %s\n", err.Error())
+	}
+	if health.Healthy {
+		t.Fatalf("expected the server to be unhealthy.\n")
+	}
+	for i := range health.Shards {
+		shd := health.Shards[i]
+		if shd.Healthy != (i != 1) {
+			t.Fatalf("unexpected health for shard %d: %s\n", i, asJson(&shd))
+		}
+	}
+	common.ExpectStrEqual(t, filepath.Join(dataDirs[1], "db"),
+		health.Shards[1].Path)
+	common.AssertErrContains(t, errors.New(health.Shards[1].Error),
+		"Corruption:")
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.Dirs[1].QuarantineError == "" {
+		t.Fatalf("expected the stats for shard 1 to show it is quarantined.\n")
+	}
+
+	// Spans in the healthy shards can still be found.
+	for i := range kept {
+		span, err := hcl.FindSpan(kept[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", kept[i].Id.String(),
+				err.Error())
+		}
+		expectSpanStored(t, kept[i], span)
+	}
+	for i := range lost {
+		span, err := hcl.FindSpan(lost[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", lost[i].Id.String(),
+				err.Error())
+		}
+		if span != nil {
+			t.Fatalf("unexpectedly found span %s in a quarantined shard.\n",
+				lost[i].Id.String())
+		}
+	}
+
+	// Queries return the spans in the healthy shards, flagged as partial.
+	query := &common.Query{Predicates: []common.Predicate{}, Lim: 100}
+	resp, err := http.Get("http://" + ht.Rsv.Addr().String() + "/query?query=" +
+		url.QueryEscape(query.String()))
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	common.ExpectStrEqual(t, "true", resp.Header.Get("X-HTraced-Partial-Results"))
+	common.ExpectStrEqual(t, "1", resp.Header.Get("X-HTraced-Quarantined-Shards"))
+	results, err := hcl.Query(query)
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(results) != len(kept) {
+		t.Fatalf("expected %d query results, but got %d\n",
+			len(kept), len(results))
+	}
+
+	// New spans which hash to the quarantined shard are redirected.
+	newSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	err = hcl.WriteSpans(newSpans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(NUM_TEST_SPANS))
+	for i := range newSpans {
+		span, err := hcl.FindSpan(newSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", newSpans[i].Id.String(),
+				err.Error())
+		}
+		expectSpanStored(t, newSpans[i], span)
+	}
+
+	// Retrying the shard fails until it has been repaired.
+	_, err = hcl.RetryShard(1)
+	if err == nil {
+		t.Fatalf("expected retrying the corrupt shard to fail.\n")
+	}
+	err = ioutil.WriteFile(currentPath, current, 0644)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s\n", currentPath, err.Error())
+	}
+	shardHealth, err := hcl.RetryShard(1)
+	if err != nil {
+		t.Fatalf("RetryShard failed: %s\n", err.Error())
+	}
+	if !shardHealth.Healthy {
+		t.Fatalf("expected shard 1 to be healthy after the retry, but got "+
+			"%s\n", asJson(shardHealth))
+	}
+	for _, spans := range [][]*common.Span{allSpans, newSpans} {
+		for i := range spans {
+			span, err := hcl.FindSpan(spans[i].Id)
+			if err != nil {
+				t.Fatalf("FindSpan(%s) failed: %s\n", spans[i].Id.String(),
+					err.Error())
+			}
+			expectSpanStored(t, spans[i], span)
+		}
+	}
+	health, err = hcl.GetServerHealth()
+	if err != nil {
+		t.Fatalf("GetServerHealth failed: %s\n", err.Error())
+	}
+	if !health.Healthy {
+		t.Fatalf("expected the server to be healthy, but got %s\n",
+			asJson(health))
+	}
+}
+
+func TestQuarantineDropPolicy(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQuarantineDropPolicy",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_QUARANTINE_POLICY: QUARANTINE_POLICY_DROP,
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+
+	// Quarantine a shard while the datastore is running.
+	ht.Store.shards[1].checkCorruption(errors.New("Corruption: test"))
+	if !ht.Store.shards[1].isQuarantined() {
+		t.Fatalf("expected shard 1 to be quarantined.\n")
+	}
+	allSpans := createRandomTestSpans(20)
+	dropped, kept := partitionSpansByShard(ht.Store, allSpans, 1)
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range allSpans {
+		ing.IngestSpan(allSpans[i])
+	}
+	ing.Close(time.Now())
+	expectSpanOutcomes(t, ht, SpanOutcomes{
+		Written: int64(len(kept)),
+		Failed:  int64(len(dropped)),
+	})
+	stats := ht.Store.ServerStats()
+	if stats.QuarantineDroppedSpans != uint64(len(dropped)) {
+		t.Fatalf("expected %d spans to be dropped for the quarantined "+
+			"shard, but got %d\n", len(dropped), stats.QuarantineDroppedSpans)
+	}
+	if stats.ServerDroppedSpans != uint64(len(dropped)) {
+		t.Fatalf("expected %d spans to be dropped by the server, but got "+
+			"%d\n", len(dropped), stats.ServerDroppedSpans)
+	}
+	for i := range dropped {
+		if ht.Store.FindSpan(dropped[i].Id) != nil {
+			t.Fatalf("unexpectedly found dropped span %s\n",
+				dropped[i].Id.String())
+		}
+	}
+
+	// The shard was never actually corrupt, so retrying it should work.
+	_, err = ht.Store.RetryShard(1)
+	if err != nil {
+		t.Fatalf("RetryShard failed: %s\n", err.Error())
+	}
+	if ht.Store.numQuarantined() != 0 {
+		t.Fatalf("expected no quarantined shards after the retry.\n")
+	}
+	ingestSpans(ht, dropped)
+	for i := range allSpans {
+		common.ExpectSpansEqual(t, allSpans[i], ht.Store.FindSpan(allSpans[i].Id))
+	}
+}
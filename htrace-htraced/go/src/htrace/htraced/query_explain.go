@@ -0,0 +1,186 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"math"
+	"time"
+)
+
+//
+// Explaining queries.
+//
+// An explanation says how a query would run, without running it.  The query
+// is planned as usual, and its source is created, but nothing is read from
+// the source.
+//
+// If query.planner.stats is on, the explanation also estimates how many spans
+// match.  The index ranges of the source, of each filter which can be read
+// from an index, and of the whole span id index are counted, the same way the
+// planner counts them to choose a source.  Counting stops at
+// query.planner.sample.max entries in each shard, so a count is only exact
+// when no shard reached that limit.  Counts which aren't exact are never used
+// as bounds.  If query.planner.stats is off, nothing is counted, and the
+// estimate is left out rather than guessed.
+//
+// The source's count bounds the matching spans from above, since every match
+// is read from the source.  So do the counts of filters on begin time, end
+// time, and span id, since every span has an entry in those indexes.  Other
+// indexes may leave spans out, such as the duration index with
+// index.min.duration.ms.
+//
+
+// Explain how a query would run.  The query's limit is changed to the limit
+// which would be used, and its time predicates are resolved, as with
+// HandleQuery.
+func (store *dataStore) ExplainQuery(query *common.Query) (*common.QueryExplanation, error) {
+	requestedLim := query.Lim
+	now := time.Now()
+	pq, err := store.loadQuery(query, now)
+	if err != nil {
+		return nil, err
+	}
+	exp := &common.QueryExplanation{
+		LimLowered: requestedLim > query.Lim,
+	}
+	exp.Plan.Query = *query
+	exp.Plan.Query.Predicates = append([]common.Predicate(nil),
+		query.Predicates...)
+	exp.Plan.CapturedMs = common.TimeToUnixMs(now)
+	err = checkNotOnlyNegated(pq.preds)
+	if err != nil {
+		exp.Rejection = err.Error()
+	}
+	preds := pq.preds
+	src, err := store.obtainSource(&preds, pq.prev, pq.scope)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	fillPlanSource(&exp.Plan, src, preds)
+	exp.FullScan = src.fullScan
+	if store.plannerStats {
+		exp.Estimate, exp.Probes, err = store.estimateMatches(src, preds,
+			pq.scope)
+		if err != nil {
+			return nil, err
+		}
+		exp.MoreThanLim = exp.Estimate.Low > int64(query.Lim)
+	}
+	return exp, nil
+}
+
+// Estimate how many spans match a query with the given source and filters.
+// Also returns the counts the estimate was made from.
+func (store *dataStore) estimateMatches(src *source, preds []*predicateData,
+	scope []bool) (*common.QueryEstimate, []common.PlanEstimate, error) {
+	// The source's predicate may have been adjusted for the continuation
+	// token, so count the range it was created with.
+	origin := src.origin
+	srcPred, err := loadPredicateData(&origin)
+	if err != nil {
+		return nil, nil, err
+	}
+	srcPred.rootsOnly = (src.keyPrefix == ROOT_INDEX_PREFIX)
+	srcPred.errorsOnly = (src.keyPrefix == ERROR_INDEX_PREFIX)
+	probes := make([]common.PlanEstimate, 0, len(preds)+1)
+	srcRows, srcExact := store.estimateRows(srcPred, scope)
+	probes = append(probes, common.PlanEstimate{Pred: origin,
+		Rows: srcRows, Exact: srcExact})
+	est := &common.QueryEstimate{
+		Rows:       common.UNKNOWN_ROWS,
+		Low:        0,
+		High:       common.UNKNOWN_ROWS,
+		TotalSpans: common.UNKNOWN_ROWS,
+	}
+	if srcExact {
+		est.High = srcRows
+	}
+	var totalRows int64
+	totalExact := false
+	if src.fullScan {
+		totalRows, totalExact = srcRows, srcExact
+	} else {
+		allPred, err := allSpansPredicate()
+		if err != nil {
+			return nil, nil, err
+		}
+		totalRows, totalExact = store.estimateRows(allPred, scope)
+	}
+	if totalExact {
+		est.TotalSpans = totalRows
+	}
+	// The fraction of the source's spans which we expect to get through the
+	// filters.
+	selectivity := 1.0
+	for i := range preds {
+		pred := preds[i]
+		prefix := pred.getIndexPrefix()
+		if pred.Field == common.DESCRIPTION || prefix == INVALID_INDEX_PREFIX {
+			continue
+		}
+		rows, exact := store.estimateRows(pred, scope)
+		probes = append(probes, common.PlanEstimate{Pred: predicateOf(pred),
+			Rows: rows, Exact: exact})
+		if !exact || !totalExact || totalRows == 0 {
+			continue
+		}
+		if pred.negated {
+			selectivity *= float64(totalRows-rows) / float64(totalRows)
+		} else {
+			selectivity *= float64(rows) / float64(totalRows)
+		}
+		if !indexCoversAllSpans(prefix) {
+			continue
+		}
+		bound := rows
+		if pred.negated {
+			bound = totalRows - rows
+		}
+		if est.High == common.UNKNOWN_ROWS || bound < est.High {
+			est.High = bound
+		}
+	}
+	if srcExact {
+		if len(preds) == 0 {
+			est.Low = srcRows
+		}
+		est.Rows = int64(math.Floor(float64(srcRows)*selectivity + 0.5))
+	}
+	if est.Rows < est.Low && est.Rows != common.UNKNOWN_ROWS {
+		est.Rows = est.Low
+	}
+	if est.High != common.UNKNOWN_ROWS && est.Rows > est.High {
+		est.Rows = est.High
+	}
+	return est, probes, nil
+}
+
+// Returns true if every span has an entry in the index with the given
+// prefix.
+func indexCoversAllSpans(prefix byte) bool {
+	switch prefix {
+	case SPAN_ID_INDEX_PREFIX, BEGIN_TIME_INDEX_PREFIX, END_TIME_INDEX_PREFIX:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,259 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"math/rand"
+	"testing"
+)
+
+// Create spans whose times and tracers are skewed: most spans begin in a
+// narrow window, are short, and come from one tracer.
+func createSkewedTestSpans(amount int) []*common.Span {
+	rnd := rand.New(rand.NewSource(1949))
+	spans := make([]*common.Span, amount)
+	for i := range spans {
+		begin := int64(1000 + rnd.Intn(100))
+		if rnd.Intn(10) == 0 {
+			begin = int64(2000 + rnd.Intn(100000))
+		}
+		spans[i] = newTraceGroupTestSpan(i+1, begin, "op")
+		spans[i].End = begin + int64(rnd.Intn(20))
+		if rnd.Intn(10) == 0 {
+			spans[i].End = begin + int64(1000+rnd.Intn(100000))
+		}
+		if rnd.Intn(5) == 0 {
+			spans[i].TracerId = "cold"
+		} else {
+			spans[i].TracerId = "hot"
+		}
+	}
+	return spans
+}
+
+// Explain a query, run it, and check that the number of spans it returned is
+// within the bounds of the estimate.  Returns the explanation, and the number
+// of spans.
+func explainAndRun(t *testing.T, hcl *htrace.Client,
+	query *common.Query) (*common.QueryExplanation, int64) {
+	exp, err := hcl.ExplainQuery(query)
+	if err != nil {
+		t.Fatalf("ExplainQuery(%s) failed: %s\n", query.String(), err.Error())
+	}
+	spans, err := hcl.Query(query)
+	if err != nil {
+		t.Fatalf("Query(%s) failed: %s\n", query.String(), err.Error())
+	}
+	actual := int64(len(spans))
+	est := exp.Estimate
+	if est == nil {
+		t.Fatalf("Expected an estimate for %s, but got %s\n",
+			query.String(), asJson(exp))
+	}
+	if est.High == common.UNKNOWN_ROWS || est.Rows == common.UNKNOWN_ROWS {
+		t.Fatalf("Expected a known estimate for %s, but got %s\n",
+			query.String(), asJson(exp))
+	}
+	if actual < est.Low || actual > est.High {
+		t.Fatalf("Query %s returned %d spans, outside the estimate %s\n",
+			query.String(), actual, asJson(est))
+	}
+	if est.Rows < est.Low || est.Rows > est.High {
+		t.Fatalf("The estimate %s for %s is outside its own bounds.\n",
+			asJson(est), query.String())
+	}
+	return exp, actual
+}
+
+func TestExplainQuery(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestExplainQuery",
+		Cnf: map[string]string{
+			conf.HTRACE_QUERY_PLANNER_STATS: "true",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createSkewedTestSpans(500)
+	ingestSpans(ht, spans)
+
+	// With only a source, the estimate is exact.
+	beginPred := common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+		Field: common.BEGIN_TIME, Val: "1050"}
+	exp, actual := explainAndRun(t, hcl, &common.Query{
+		Predicates: []common.Predicate{beginPred},
+		Lim:        10000,
+	})
+	if exp.Estimate.Low != actual || exp.Estimate.High != actual ||
+		exp.Estimate.Rows != actual {
+		t.Fatalf("Expected an exact estimate of %d, but got %s\n", actual,
+			asJson(exp))
+	}
+	if exp.FullScan || exp.Plan.Index != "beginTime" ||
+		exp.Estimate.TotalSpans != 500 || exp.MoreThanLim {
+		t.Fatalf("Unexpected explanation %s\n", asJson(exp))
+	}
+	if len(exp.Plan.Stages) != 0 || len(exp.Plan.Results) != 0 {
+		t.Fatalf("Expected the query not to run, but got %s\n", asJson(exp))
+	}
+
+	// Filters on indexed fields narrow the bounds.
+	endPred := common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+		Field: common.END_TIME, Val: "1080"}
+	exp, _ = explainAndRun(t, hcl, &common.Query{
+		Predicates: []common.Predicate{beginPred, endPred},
+		Lim:        10000,
+	})
+	if len(exp.Probes) != 2 || !exp.Probes[0].Exact || !exp.Probes[1].Exact {
+		t.Fatalf("Expected two exact probes, but got %s\n", asJson(exp))
+	}
+	minRows := exp.Probes[0].Rows
+	if exp.Probes[1].Rows < minRows {
+		minRows = exp.Probes[1].Rows
+	}
+	if exp.Estimate.High != minRows {
+		t.Fatalf("Expected an upper bound of %d, but got %s\n", minRows,
+			asJson(exp))
+	}
+
+	// Filters which can't be read from an index don't change the bounds.
+	coldPred := common.Predicate{Op: common.EQUALS,
+		Field: common.TRACER_ID, Val: "cold"}
+	exp, _ = explainAndRun(t, hcl, &common.Query{
+		Predicates: []common.Predicate{beginPred, coldPred},
+		Lim:        10000,
+	})
+	if exp.Estimate.Low != 0 || exp.Estimate.High != exp.Probes[0].Rows {
+		t.Fatalf("Unexpected estimate %s\n", asJson(exp))
+	}
+
+	// A query without an indexed predicate reads every span.
+	exp, _ = explainAndRun(t, hcl, &common.Query{
+		Predicates: []common.Predicate{coldPred},
+		Lim:        10000,
+	})
+	if !exp.FullScan || exp.Plan.Index != "spanId" ||
+		exp.Estimate.High != 500 || exp.Rejection != "" {
+		t.Fatalf("Expected a full scan, but got %s\n", asJson(exp))
+	}
+
+	// So does a query whose predicates are all negated, which can't be run.
+	negatedQuery := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.NOT_EQUALS,
+				Field: common.BEGIN_TIME, Val: "1050"},
+		},
+		Lim: 10000,
+	}
+	exp, err = hcl.ExplainQuery(negatedQuery)
+	if err != nil {
+		t.Fatalf("ExplainQuery failed: %s\n", err.Error())
+	}
+	if !exp.FullScan || exp.Rejection == "" || len(exp.Probes) != 2 ||
+		exp.Estimate.High != 500-exp.Probes[1].Rows {
+		t.Fatalf("Expected a rejected full scan, but got %s\n", asJson(exp))
+	}
+	_, err = hcl.Query(negatedQuery)
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+
+	// The limit clamp, and queries which would fill their limit.
+	exp, err = hcl.ExplainQuery(&common.Query{
+		Predicates: []common.Predicate{beginPred},
+		Lim:        20000,
+	})
+	if err != nil {
+		t.Fatalf("ExplainQuery failed: %s\n", err.Error())
+	}
+	if !exp.LimLowered || exp.Plan.Query.Lim != 10000 {
+		t.Fatalf("Expected the limit to be lowered, but got %s\n",
+			asJson(exp))
+	}
+	exp, err = hcl.ExplainQuery(&common.Query{
+		Predicates: []common.Predicate{beginPred},
+		Lim:        10,
+	})
+	if err != nil {
+		t.Fatalf("ExplainQuery failed: %s\n", err.Error())
+	}
+	if exp.LimLowered || !exp.MoreThanLim {
+		t.Fatalf("Expected more matches than the limit, but got %s\n",
+			asJson(exp))
+	}
+}
+
+// Test that estimates are reported as unknown, rather than guessed, when the
+// server has no statistics, or too many entries to count.
+func TestExplainQueryUnknownEstimates(t *testing.T) {
+	beginPred := common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+		Field: common.BEGIN_TIME, Val: "1050"}
+	explain := func(cnf map[string]string) *common.QueryExplanation {
+		htraceBld := &MiniHTracedBuilder{
+			Name:         "TestExplainQueryUnknownEstimates",
+			Cnf:          cnf,
+			WrittenSpans: common.NewSemaphore(0),
+		}
+		ht, err := htraceBld.Build()
+		if err != nil {
+			t.Fatalf("failed to create datastore: %s", err.Error())
+		}
+		defer ht.Close()
+		hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+		if err != nil {
+			t.Fatalf("failed to create client: %s", err.Error())
+		}
+		defer hcl.Close()
+		ingestSpans(ht, createSkewedTestSpans(100))
+		exp, err := hcl.ExplainQuery(&common.Query{
+			Predicates: []common.Predicate{beginPred},
+		})
+		if err != nil {
+			t.Fatalf("ExplainQuery failed: %s\n", err.Error())
+		}
+		return exp
+	}
+	exp := explain(map[string]string{})
+	if exp.Estimate != nil || len(exp.Probes) != 0 ||
+		exp.Plan.Index != "beginTime" {
+		t.Fatalf("Expected a plan without an estimate, but got %s\n",
+			asJson(exp))
+	}
+	exp = explain(map[string]string{
+		conf.HTRACE_QUERY_PLANNER_STATS:      "true",
+		conf.HTRACE_QUERY_PLANNER_SAMPLE_MAX: "5",
+	})
+	est := exp.Estimate
+	if est == nil || est.Rows != common.UNKNOWN_ROWS ||
+		est.High != common.UNKNOWN_ROWS || est.Low != 0 ||
+		est.TotalSpans != common.UNKNOWN_ROWS || exp.MoreThanLim {
+		t.Fatalf("Expected an unknown estimate, but got %s\n", asJson(exp))
+	}
+}
@@ -0,0 +1,183 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"testing"
+)
+
+// Page through all the spans which match a query, checking the pagination
+// metadata of each page.
+func pageThroughQuery(t *testing.T, hcl *htrace.Client, query common.Query,
+	expectedPages int) []*common.Span {
+	var all []*common.Span
+	for numPages := 1; ; numPages++ {
+		page, err := hcl.QueryPage(&query)
+		if err != nil {
+			t.Fatalf("QueryPage(%s) failed: %s\n", query.String(), err.Error())
+		}
+		if page.Scanned < len(page.Spans) {
+			t.Fatalf("page %d: scanned %d spans, but returned %d\n",
+				numPages, page.Scanned, len(page.Spans))
+		}
+		all = append(all, page.Spans...)
+		if numPages == expectedPages {
+			if page.HasMore || page.Next != "" {
+				t.Fatalf("page %d: expected the last page, but got hasMore=%t, "+
+					"next=%s\n", numPages, page.HasMore, page.Next)
+			}
+			return all
+		}
+		if !page.HasMore || page.Next == "" {
+			t.Fatalf("page %d of %d: expected hasMore and a next token.\n",
+				numPages, expectedPages)
+		}
+		if len(page.Spans) != page.Lim {
+			t.Fatalf("page %d: expected %d spans, but got %d\n",
+				numPages, page.Lim, len(page.Spans))
+		}
+		query.After = page.Next
+	}
+}
+
+func TestQueryPages(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryPages",
+		Cnf: map[string]string{
+			conf.HTRACE_QUERY_MAX_LIM: "50",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	NUM_TEST_SPANS := 100
+	ingestSpans(ht, createRandomTestSpans(NUM_TEST_SPANS))
+
+	// The whole result set, fetched in one go.
+	expected, err := hcl.Query(&common.Query{Lim: NUM_TEST_SPANS})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(expected) != 50 {
+		t.Fatalf("expected the limit to be clamped to 50, but got %d spans\n",
+			len(expected))
+	}
+	rest := pageThroughQuery(t, hcl,
+		common.Query{Lim: 50, After: common.NewQueryToken(&expected[49])}, 1)
+	for i := range rest {
+		expected = append(expected, *rest[i])
+	}
+	if len(expected) != NUM_TEST_SPANS {
+		t.Fatalf("expected %d spans in total, but got %d\n",
+			NUM_TEST_SPANS, len(expected))
+	}
+
+	// Page sizes which divide the result set exactly, and which don't.
+	for _, lim := range []int{10, 25, 30, 50, 100} {
+		numPages := (NUM_TEST_SPANS + lim - 1) / lim
+		if lim > 50 {
+			numPages = 2
+		}
+		got := pageThroughQuery(t, hcl, common.Query{Lim: lim}, numPages)
+		if len(got) != len(expected) {
+			t.Fatalf("lim %d: expected %d spans, but got %d\n",
+				lim, len(expected), len(got))
+		}
+		for i := range got {
+			common.ExpectSpansEqual(t, &expected[i], got[i])
+		}
+	}
+
+	// Paging works with predicates too.
+	begin := expected[NUM_TEST_SPANS/2].Begin
+	query := common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   fmt.Sprintf("%d", begin),
+			},
+		},
+		Lim: 7,
+	}
+	all, err := hcl.Query(&common.Query{Predicates: query.Predicates,
+		Lim: NUM_TEST_SPANS})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	got := pageThroughQuery(t, hcl, query, (len(all)+6)/7)
+	if len(got) != len(all) {
+		t.Fatalf("expected %d spans, but got %d\n", len(all), len(got))
+	}
+	for i := range got {
+		common.ExpectSpansEqual(t, &all[i], got[i])
+	}
+}
+
+func TestQueryPageErrors(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryPageErrors",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(3)
+	ingestSpans(ht, spans)
+
+	_, err = hcl.QueryPage(&common.Query{Lim: 1, Prev: spans[0],
+		After: common.NewQueryToken(spans[1])})
+	if err == nil {
+		t.Fatalf("expected an error when combining prev and after.\n")
+	}
+	common.AssertErrContains(t, err, "continuation token")
+	_, err = hcl.QueryPage(&common.Query{Lim: 1, After: "!!notAToken"})
+	if err == nil {
+		t.Fatalf("expected an error for an invalid continuation token.\n")
+	}
+	common.AssertErrContains(t, err, "continuation token")
+	page, err := hcl.QueryPage(&common.Query{Lim: 3})
+	if err != nil {
+		t.Fatalf("QueryPage failed: %s\n", err.Error())
+	}
+	if page.HasMore || page.Next != "" || len(page.Spans) != 3 {
+		t.Fatalf("expected a single page of 3 spans, but got %s\n",
+			asJson(page))
+	}
+}
@@ -0,0 +1,392 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"htrace/common"
+	"time"
+)
+
+//
+// Query plans.
+//
+// A query reads rows from one index, its source, and filters them through
+// the rest of its predicates.  Normally the source is the first indexed
+// predicate.  When query.planner.stats is on, and more than one predicate
+// could be the source, each one's index range is sampled, and the one with
+// the fewest entries is read instead.
+//
+// A paged query can ask for its plan, which records the source, the filters,
+// the rows each of them handled, and the spans returned.  Replaying the plan
+// runs the query again exactly as it was planned, and also plans it again
+// with the current statistics, so that a change in the planner's choice can
+// be told apart from a change in the data.
+//
+
+// Get the name of the index with the given prefix, as it appears in plans.
+func indexName(prefix byte) string {
+	switch prefix {
+	case SPAN_ID_INDEX_PREFIX:
+		return "spanId"
+	case BEGIN_TIME_INDEX_PREFIX:
+		return "beginTime"
+	case END_TIME_INDEX_PREFIX:
+		return "endTime"
+	case DURATION_INDEX_PREFIX:
+		return "duration"
+	case ROOT_INDEX_PREFIX:
+		return "root"
+	case ERROR_INDEX_PREFIX:
+		return "error"
+	case DESCRIPTION_INDEX_PREFIX:
+		return "description"
+	default:
+		return ""
+	}
+}
+
+// Get the predicate which a predicateData was loaded from, or an equivalent
+// one.  Negated operations come back as their positive form, with the negate
+// flag set.
+func predicateOf(pred *predicateData) common.Predicate {
+	ret := *pred.Predicate
+	if pred.negated {
+		ret.Negate = true
+	}
+	return ret
+}
+
+// Choose which of the candidate predicates to read from, by estimating how
+// many rows each would read.  Ties go to the earlier predicate, so that the
+// choice is the same as without statistics when the estimates don't help.
+func (store *dataStore) chooseByEstimate(preds []*predicateData,
+	candidates []int, scope []bool) (int, []common.PlanEstimate) {
+	estimates := make([]common.PlanEstimate, len(candidates))
+	for i := range candidates {
+		pred := preds[candidates[i]]
+		estimates[i].Pred = predicateOf(pred)
+		estimates[i].Rows, estimates[i].Exact = store.estimateRows(pred, scope)
+	}
+	if store.testHooks != nil && store.testHooks.PlannerEstimates != nil {
+		store.testHooks.PlannerEstimates(estimates)
+	}
+	best := 0
+	for i := range estimates {
+		if estimates[i].Rows < estimates[best].Rows {
+			best = i
+		}
+	}
+	return candidates[best], estimates
+}
+
+// Estimate how many rows a predicate would read as the source of a query, by
+// counting the entries in its index range.  At most plannerSampleMax entries
+// are counted in each shard.  Returns true if no shard reached that limit, so
+// that the count is exact.
+func (store *dataStore) estimateRows(pred *predicateData,
+	scope []bool) (int64, bool) {
+	prefix := pred.getIndexPrefix()
+	indexVal := pred.indexValue(store.descIndexMaxBytes)
+	start := append([]byte{prefix}, indexVal...)
+	fallback := pred.fallbackIndexValue(store.descIndexMaxBytes)
+	if pred.Op.IsDescending() {
+		// Start after every entry with the predicate's value.
+		start = append(start, bytes.Repeat([]byte{0xff},
+			common.SPAN_ID_LEN)...)
+	}
+	var total int64
+	exact := true
+	for shardIdx, shd := range store.shards {
+		if scope != nil && !scope[shardIdx] {
+			continue
+		}
+		if !shd.acquire() {
+			continue // Quarantined shards are treated as empty.
+		}
+		count := shd.countIndexRows(pred, prefix, indexVal, start,
+			store.plannerSampleMax)
+		if fallback != nil {
+			// The source reads the entries of the normalized description
+			// as well.
+			count += shd.countIndexRows(pred, prefix, fallback,
+				append([]byte{prefix}, fallback...), store.plannerSampleMax)
+		}
+		shd.release()
+		if count >= int64(store.plannerSampleMax) {
+			exact = false
+		}
+		total += count
+	}
+	return total, exact
+}
+
+// Count the entries in a shard's index which satisfy a predicate, up to max.
+// indexVal is the value the predicate's entries have in the index.
+func (shd *shard) countIndexRows(pred *predicateData, prefix byte,
+	indexVal []byte, start []byte, max int) int64 {
+	descending := pred.Op.IsDescending()
+	iter := shd.ldb.NewIterator(shd.store.bulkOpts)
+	defer iter.Close()
+	iter.Seek(start)
+	if descending {
+		if !iter.Valid() {
+			iter.SeekToLast()
+		}
+	}
+	var count int64
+	for iter.Valid() && count < int64(max) {
+		key := iter.Key()
+		if len(key) < 1 || key[0] != prefix {
+			if descending && len(key) > 0 && key[0] > prefix {
+				iter.Prev()
+				continue
+			}
+			break
+		}
+		val := key[1:]
+		if prefix != SPAN_ID_INDEX_PREFIX {
+			if len(val) < common.SPAN_ID_LEN {
+				break
+			}
+			val = val[:len(val)-common.SPAN_ID_LEN]
+		}
+		cmp := bytes.Compare(val, indexVal)
+		switch pred.Op {
+		case common.EQUALS:
+			if cmp != 0 {
+				return count
+			}
+		case common.LESS_THAN_OR_EQUALS:
+			if cmp > 0 {
+				iter.Prev()
+				continue
+			}
+		case common.GREATER_THAN:
+			if cmp <= 0 {
+				iter.Next()
+				continue
+			}
+		}
+		count++
+		if descending {
+			iter.Prev()
+		} else {
+			iter.Next()
+		}
+	}
+	err := iter.GetError()
+	if err != nil {
+		shd.store.lg.Warnf("Shard(%s): error estimating rows for %s: %s\n",
+			shd.path, pred.Predicate.String(), err.Error())
+		shd.checkCorruption(err)
+	}
+	return count
+}
+
+// Record how a query ran in its plan.  stageIn and stageOut hold the number
+// of rows each stage read and passed on, starting with the source.
+func fillPlan(plan *common.QueryPlan, src *source, preds []*predicateData,
+	stageIn []int, stageOut []int, spans []*common.Span) {
+	fillPlanSource(plan, src, preds)
+	plan.Stages = make([]common.PlanStage, len(preds)+1)
+	plan.Stages[0] = common.PlanStage{Name: "source",
+		In: stageIn[0], Out: stageOut[0]}
+	for i := range preds {
+		plan.Stages[i+1] = common.PlanStage{Name: plan.Filters[i].String(),
+			In: stageIn[i+1], Out: stageOut[i+1]}
+	}
+	plan.Results = make([]common.SpanId, len(spans))
+	for i := range spans {
+		plan.Results[i] = spans[i].Id
+	}
+}
+
+// Record the source and filters of a query in its plan.
+func fillPlanSource(plan *common.QueryPlan, src *source,
+	preds []*predicateData) {
+	plan.Index = indexName(src.keyPrefix)
+	plan.Source = src.origin
+	plan.SeekKey = hex.EncodeToString(src.seekKey)
+	plan.KeyBound = ""
+	if src.keyBound != nil {
+		plan.KeyBound = hex.EncodeToString(src.keyBound)
+	}
+	plan.Estimates = src.estimates
+	plan.Filters = make([]common.Predicate, len(preds))
+	for i := range preds {
+		plan.Filters[i] = predicateOf(preds[i])
+	}
+}
+
+// Replay a query plan.  The plan is run again with the source and filters it
+// records, and the query is planned again, and run with the new plan.
+func (store *dataStore) ReplayPlan(plan *common.QueryPlan) (*common.PlanReplay, error) {
+	verbatim, err := store.runPlanVerbatim(plan)
+	if err != nil {
+		return nil, err
+	}
+	query := plan.Query
+	query.Predicates = append([]common.Predicate(nil), plan.Query.Predicates...)
+	replanned := &common.QueryPlan{}
+	_, _, err, _ = store.handleQuery(&query, false, replanned)
+	if err != nil {
+		return nil, err
+	}
+	return &common.PlanReplay{
+		Verbatim:               verbatim,
+		Replanned:              replanned,
+		PlanDifferences:        comparePlans(plan, replanned),
+		VerbatimResultsDiffer:  !sameSpanIds(plan.Results, verbatim.Results),
+		ReplannedResultsDiffer: !sameSpanIdSet(plan.Results, replanned.Results),
+	}, nil
+}
+
+// Run a query with the source and filters recorded in its plan, rather than
+// the ones the planner would choose now.
+func (store *dataStore) runPlanVerbatim(plan *common.QueryPlan) (*common.QueryPlan, error) {
+	now := time.Now()
+	query := plan.Query
+	query.Predicates = append([]common.Predicate(nil), plan.Query.Predicates...)
+	pq, err := store.prepareQuery(&query, now)
+	if err != nil {
+		return nil, err
+	}
+	ret := &common.QueryPlan{
+		Query:      query,
+		CapturedMs: common.TimeToUnixMs(now),
+	}
+	ret.Query.Predicates = append([]common.Predicate(nil), query.Predicates...)
+	sourcePred := plan.Source
+	srcData, err := loadPlanPredicate(&sourcePred, now, "source")
+	if err != nil {
+		return nil, err
+	}
+	if srcData.negated {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid plan source %s: a negated predicate can't be a source.",
+			sourcePred.String())
+	}
+	srcData.rootsOnly = (plan.Index == indexName(ROOT_INDEX_PREFIX))
+	srcData.errorsOnly = (plan.Index == indexName(ERROR_INDEX_PREFIX))
+	if indexName(srcData.getIndexPrefix()) != plan.Index {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid plan: the source %s can't be read from the %s index.",
+			sourcePred.String(), plan.Index)
+	}
+	filters := make([]*predicateData, len(plan.Filters))
+	for i := range plan.Filters {
+		filter := plan.Filters[i]
+		filters[i], err = loadPlanPredicate(&filter, now,
+			fmt.Sprintf("filter %d", i))
+		if err != nil {
+			return nil, err
+		}
+	}
+	src, err := srcData.createSource(store, pq.prev, pq.scope)
+	if err != nil {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid plan source %s: %s", sourcePred.String(), err.Error())
+	}
+	defer src.Close()
+	src.estimates = plan.Estimates
+	store.runSource(&query, src, filters, false, ret)
+	return ret, nil
+}
+
+// Load one of the predicates of a plan.
+func loadPlanPredicate(pred *common.Predicate, now time.Time,
+	what string) (*predicateData, error) {
+	err := resolveTimePredicate(pred, now)
+	if err != nil {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid plan %s: %s", what, err.Error())
+	}
+	ret, err := loadPredicateData(pred)
+	if err != nil {
+		return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION, nil,
+			"Invalid plan %s: %s", what, err.Error())
+	}
+	return ret, nil
+}
+
+// Describe how the second plan for a query differs from the first, ignoring
+// what happened when they ran.
+func comparePlans(a *common.QueryPlan, b *common.QueryPlan) []string {
+	diffs := make([]string, 0)
+	if a.Index != b.Index {
+		diffs = append(diffs, fmt.Sprintf("The index changed from %s to %s.",
+			a.Index, b.Index))
+	}
+	if a.Source.String() != b.Source.String() {
+		diffs = append(diffs, fmt.Sprintf("The source changed from %s to %s.",
+			a.Source.String(), b.Source.String()))
+	}
+	if predicatesString(a.Filters) != predicatesString(b.Filters) {
+		diffs = append(diffs, fmt.Sprintf("The filters changed from %s to %s.",
+			predicatesString(a.Filters), predicatesString(b.Filters)))
+	}
+	return diffs
+}
+
+func predicatesString(preds []common.Predicate) string {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for i := range preds {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(preds[i].String())
+	}
+	buf.WriteString("]")
+	return buf.String()
+}
+
+// Returns true if both lists hold the same span ids, in the same order.
+func sameSpanIds(a []common.SpanId, b []common.SpanId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns true if both lists hold the same span ids, in any order.
+func sameSpanIdSet(a []common.SpanId, b []common.SpanId) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	ids := make(map[string]bool, len(a))
+	for i := range a {
+		ids[a[i].String()] = true
+	}
+	for i := range b {
+		if !ids[b[i].String()] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync/atomic"
+	"testing"
+)
+
+func TestQueryPlanReplay(t *testing.T) {
+	// When perturb is set, the planner is told that the end time predicate
+	// would read more rows than the begin time one.
+	var perturb int32
+	hooks := &datastoreTestHooks{
+		PlannerEstimates: func(estimates []common.PlanEstimate) {
+			if atomic.LoadInt32(&perturb) == 0 {
+				return
+			}
+			for i := range estimates {
+				if estimates[i].Pred.Field == common.END_TIME {
+					estimates[i].Rows = 1000000
+				}
+			}
+		},
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryPlanReplay",
+		Cnf: map[string]string{
+			conf.HTRACE_QUERY_PLANNER_STATS: "true",
+		},
+		DataDirs:           make([]string, 2),
+		WrittenSpans:       common.NewSemaphore(0),
+		DatastoreTestHooks: hooks,
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Every span matches the begin time predicate, but only the first ten
+	// match the end time one.
+	spans := make([]*common.Span, 40)
+	for i := range spans {
+		spans[i] = newTraceGroupTestSpan(i+1, int64(1010+10*i), "op")
+	}
+	ingestSpans(ht, spans)
+	query := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "1000"},
+			common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+				Field: common.END_TIME, Val: "1105"},
+		},
+		Lim:  100,
+		Plan: true,
+	}
+	page, err := hcl.QueryPage(query)
+	if err != nil {
+		t.Fatalf("QueryPage failed: %s\n", err.Error())
+	}
+	plan := page.Plan
+	if plan == nil {
+		t.Fatalf("Expected a plan, but got none.\n")
+	}
+	if plan.Index != "endTime" {
+		t.Fatalf("Expected the query to read the end time index, but got "+
+			"%s\n", asJson(plan))
+	}
+	if len(plan.Estimates) != 2 || plan.Estimates[0].Rows != 40 ||
+		plan.Estimates[1].Rows != 10 {
+		t.Fatalf("Expected estimates of 40 and 10 rows, but got %s\n",
+			asJson(plan.Estimates))
+	}
+	if len(plan.Filters) != 1 || plan.Filters[0].Field != common.BEGIN_TIME {
+		t.Fatalf("Expected a begin time filter, but got %s\n",
+			asJson(plan.Filters))
+	}
+	if len(plan.Stages) != 2 || plan.Stages[0].Out != 10 ||
+		plan.Stages[1].In != 10 || plan.Stages[1].Out != 10 {
+		t.Fatalf("Unexpected stages %s\n", asJson(plan.Stages))
+	}
+	if len(plan.Results) != 10 || !plan.Results[0].Equal(spans[9].Id) {
+		t.Fatalf("Expected the first ten spans, latest first, but got %s\n",
+			asJson(plan.Results))
+	}
+	page, err = hcl.QueryPage(&common.Query{Predicates: query.Predicates})
+	if err != nil {
+		t.Fatalf("QueryPage failed: %s\n", err.Error())
+	}
+	if page.Plan != nil {
+		t.Fatalf("Expected no plan when the query doesn't ask for one.\n")
+	}
+
+	// Nothing has changed yet.
+	replay, err := hcl.ReplayQueryPlan(plan)
+	if err != nil {
+		t.Fatalf("ReplayQueryPlan failed: %s\n", err.Error())
+	}
+	if len(replay.PlanDifferences) != 0 || replay.VerbatimResultsDiffer ||
+		replay.ReplannedResultsDiffer {
+		t.Fatalf("Expected no differences, but got %s\n", asJson(replay))
+	}
+
+	// When the estimates change, the planner reads the begin time index
+	// instead.  The spans come back in a different order, but they are the
+	// same spans.
+	atomic.StoreInt32(&perturb, 1)
+	replay, err = hcl.ReplayQueryPlan(plan)
+	if err != nil {
+		t.Fatalf("ReplayQueryPlan failed: %s\n", err.Error())
+	}
+	if len(replay.PlanDifferences) == 0 ||
+		replay.Replanned.Index != "beginTime" {
+		t.Fatalf("Expected the plan to change, but got %s\n", asJson(replay))
+	}
+	if replay.Verbatim.Index != "endTime" {
+		t.Fatalf("Expected the verbatim replay to keep reading the end time "+
+			"index, but got %s\n", asJson(replay.Verbatim))
+	}
+	if replay.VerbatimResultsDiffer || replay.ReplannedResultsDiffer {
+		t.Fatalf("Expected the results not to change, but got %s\n",
+			asJson(replay))
+	}
+	if !replay.Replanned.Results[0].Equal(spans[0].Id) {
+		t.Fatalf("Expected the replanned query to return the earliest span "+
+			"first, but got %s\n", asJson(replay.Replanned.Results))
+	}
+
+	// When a matching span is written, the captured plan returns it too.
+	atomic.StoreInt32(&perturb, 0)
+	ingestSpans(ht, []*common.Span{newTraceGroupTestSpan(41, 1001, "op")})
+	replay, err = hcl.ReplayQueryPlan(plan)
+	if err != nil {
+		t.Fatalf("ReplayQueryPlan failed: %s\n", err.Error())
+	}
+	if len(replay.PlanDifferences) != 0 {
+		t.Fatalf("Expected the plan not to change, but got %s\n",
+			asJson(replay.PlanDifferences))
+	}
+	if !replay.VerbatimResultsDiffer || !replay.ReplannedResultsDiffer {
+		t.Fatalf("Expected the results to change, but got %s\n",
+			asJson(replay))
+	}
+	if len(replay.Verbatim.Results) != 11 {
+		t.Fatalf("Expected 11 results, but got %s\n",
+			asJson(replay.Verbatim.Results))
+	}
+
+	// A plan whose source can't be read from the index it names is rejected.
+	bad := *plan
+	bad.Index = "duration"
+	_, err = hcl.ReplayQueryPlan(&bad)
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+}
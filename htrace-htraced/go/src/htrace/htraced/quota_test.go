@@ -0,0 +1,178 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"testing"
+	"time"
+)
+
+func TestParseQuotaRules(t *testing.T) {
+	t.Parallel()
+	rules, err := parseQuotaRules(" teamA-*:100:reject, ns:b*:5:sample ,")
+	if err != nil {
+		t.Fatalf("parseQuotaRules failed: %s\n", err.Error())
+	}
+	if len(rules) != 2 ||
+		*rules[0] != (quotaRule{"teamA-*", 100, common.QUOTA_POLICY_REJECT}) ||
+		*rules[1] != (quotaRule{"ns:b*", 5, common.QUOTA_POLICY_SAMPLE}) {
+		t.Fatalf("Unexpected rules %+v\n", rules)
+	}
+	for _, bad := range []string{"teamA", "teamA:100", "teamA:x:reject",
+		"teamA:100:drop", "[:100:reject"} {
+		_, err = parseQuotaRules(bad)
+		if err == nil {
+			t.Fatalf("Expected parsing '%s' to fail.\n", bad)
+		}
+	}
+}
+
+// Send a heartbeat to every shard, and wait until the quotas are in the
+// expected state.
+func waitForQuotas(t *testing.T, ht *MiniHTraced, enforcing ...bool) {
+	for i := range ht.Store.shards {
+		ht.Store.shards[i].heartbeats <- nil
+	}
+	common.WaitFor(time.Minute*1, time.Millisecond*10, func() bool {
+		statuses := ht.Store.quotas.Get()
+		for i := range statuses {
+			if !statuses[i].UsageComplete ||
+				statuses[i].Enforcing != enforcing[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestSpanQuotas(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanQuotas",
+		Cnf: map[string]string{
+			conf.HTRACE_QUOTA_RULES:          "teamA*:5:reject,teamB*:5:sample",
+			conf.HTRACE_QUOTA_SAMPLE_PERCENT: "0",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	restHcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create REST client: %s", err.Error())
+	}
+	defer restHcl.Close()
+
+	spans := createRandomTestSpans(30)
+	for i := range spans {
+		spans[i].Begin = int64(1000 + i)
+		spans[i].End = int64(2000 + i)
+		switch i % 3 {
+		case 0:
+			spans[i].TracerId = "teamA-frontend"
+		case 1:
+			spans[i].TracerId = "teamB-backend"
+		default:
+			spans[i].TracerId = "other"
+		}
+	}
+
+	// Both teams go over their limits.  Nothing is enforced until the shards
+	// report their usage.
+	ingestSpans(ht, spans[:18])
+	waitForQuotas(t, ht, true, true)
+	quotas, err := hcl.GetQuotas()
+	if err != nil {
+		t.Fatalf("GetQuotas failed: %s\n", err.Error())
+	}
+	if len(quotas) != 2 || quotas[0].Pattern != "teamA*" ||
+		quotas[0].Usage != 6 || quotas[0].Limit != 5 ||
+		quotas[1].Policy != common.QUOTA_POLICY_SAMPLE || quotas[1].Usage != 6 {
+		t.Fatalf("Unexpected quotas %s\n", asJson(quotas))
+	}
+
+	// Now new spans from over-quota tracers are dropped.  teamA's spans are
+	// rejected, and teamB's are sampled out, since the sample percentage is 0.
+	var teamA, teamB, others []*common.Span
+	for _, span := range spans[18:] {
+		switch span.TracerId {
+		case "teamA-frontend":
+			teamA = append(teamA, span)
+		case "teamB-backend":
+			teamB = append(teamB, span)
+		default:
+			others = append(others, span)
+		}
+	}
+	err = hcl.WriteSpans(append(teamA, others...))
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	err = restHcl.WriteSpans(teamB)
+	if err != nil {
+		t.Fatalf("WriteSpans over REST failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(others)))
+	for _, span := range append(teamA, teamB...) {
+		if ht.Store.FindSpan(span.Id) != nil {
+			t.Fatalf("Span %s should have been dropped.\n", span.Id.String())
+		}
+	}
+	for _, span := range others {
+		if ht.Store.FindSpan(span.Id) == nil {
+			t.Fatalf("Span %s should have been written.\n", span.Id.String())
+		}
+	}
+	mtx := hcl.Metrics()
+	if mtx.QuotaRejectedSpans != uint64(len(teamA)) ||
+		mtx.QuotaSampledOutSpans != 0 {
+		t.Fatalf("Unexpected HRPC client metrics %s\n", asJson(mtx))
+	}
+	mtx = restHcl.Metrics()
+	if mtx.QuotaRejectedSpans != 0 ||
+		mtx.QuotaSampledOutSpans != uint64(len(teamB)) {
+		t.Fatalf("Unexpected REST client metrics %s\n", asJson(mtx))
+	}
+	stats := ht.Store.ServerStats()
+	if stats.QuotaRejectedSpans != uint64(len(teamA)) ||
+		stats.QuotaSampledOutSpans != uint64(len(teamB)) {
+		t.Fatalf("Unexpected server stats %s\n", asJson(stats))
+	}
+	quotas = ht.Store.quotas.Get()
+	if quotas[0].RejectedSpans != uint64(len(teamA)) ||
+		quotas[1].SampledOutSpans != uint64(len(teamB)) {
+		t.Fatalf("Unexpected quotas %s\n", asJson(quotas))
+	}
+
+	// Once the reaper removes the old spans, the quotas are lifted.
+	ht.Store.rpr.SetReaperDate(3000)
+	waitForQuotas(t, ht, false, false)
+	ingestSpans(ht, teamA)
+}
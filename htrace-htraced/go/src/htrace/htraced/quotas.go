@@ -0,0 +1,320 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Quotas limit the number of stored spans which the tracers matching a
+// pattern can have.  Each shard keeps a count of its spans per tracer ID,
+// which only the shard goroutine touches.  On each heartbeat, the shard adds
+// its counts up per quota and publishes them to the quotaTracker, which
+// decides whether each quota is being enforced.  The ingestors check that
+// decision before accepting a span.  This means that a quota can be exceeded
+// by the spans which arrive between two heartbeats, but the ingest path never
+// has to wait for the shards.
+
+// A single quota rule.  See quota.rules.
+type quotaRule struct {
+	// The pattern to match tracer IDs against, using path.Match.
+	pattern string
+
+	// The number of stored spans the matching tracers may have.
+	limit uint64
+
+	// One of the QUOTA_POLICY_* constants.
+	policy string
+}
+
+// Parse the value of quota.rules.
+func parseQuotaRules(str string) ([]*quotaRule, error) {
+	rules := make([]*quotaRule, 0)
+	for _, ruleStr := range strings.Split(str, ",") {
+		ruleStr = strings.TrimSpace(ruleStr)
+		if ruleStr == "" {
+			continue
+		}
+		// The pattern may contain colons, so split from the right.
+		policyIdx := strings.LastIndex(ruleStr, ":")
+		if policyIdx < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid quota rule '%s': "+
+				"expected pattern:limit:policy.", ruleStr))
+		}
+		limitIdx := strings.LastIndex(ruleStr[:policyIdx], ":")
+		if limitIdx < 0 {
+			return nil, errors.New(fmt.Sprintf("Invalid quota rule '%s': "+
+				"expected pattern:limit:policy.", ruleStr))
+		}
+		rule := &quotaRule{
+			pattern: ruleStr[:limitIdx],
+			policy:  ruleStr[policyIdx+1:],
+		}
+		if _, err := path.Match(rule.pattern, ""); err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid pattern in quota "+
+				"rule '%s': %s", ruleStr, err.Error()))
+		}
+		limit, err := strconv.ParseUint(ruleStr[limitIdx+1:policyIdx], 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid limit in quota "+
+				"rule '%s': %s", ruleStr, err.Error()))
+		}
+		rule.limit = limit
+		if rule.policy != common.QUOTA_POLICY_REJECT &&
+			rule.policy != common.QUOTA_POLICY_SAMPLE {
+			return nil, errors.New(fmt.Sprintf("Invalid policy in quota "+
+				"rule '%s': expected '%s' or '%s'.", ruleStr,
+				common.QUOTA_POLICY_REJECT, common.QUOTA_POLICY_SAMPLE))
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+type quotaTracker struct {
+	// The quota rules, in the order they were configured.
+	rules []*quotaRule
+
+	// The percentage of spans kept while a sample quota is being enforced.
+	samplePercent uint32
+
+	// Protects usage.
+	lock sync.Mutex
+
+	// Maps each shard to the number of its spans which count against each
+	// rule.  A shard which hasn't reported yet has no entry.
+	usage map[*shard][]uint64
+
+	// The number of shards.
+	numShards int
+
+	// Non-zero for each rule which is being enforced.  Accessed atomically.
+	enforcing []int32
+
+	// The number of spans rejected for each rule.  Accessed atomically.
+	rejected []uint64
+
+	// The number of spans sampled out for each rule.  Accessed atomically.
+	sampledOut []uint64
+}
+
+// Create a quotaTracker, or return nil if no quotas are configured.
+func newQuotaTracker(cnf *conf.Config, numShards int) (*quotaTracker, error) {
+	rules, err := parseQuotaRules(cnf.Get(conf.HTRACE_QUOTA_RULES))
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	samplePercent := cnf.GetInt(conf.HTRACE_QUOTA_SAMPLE_PERCENT)
+	if samplePercent < 0 || samplePercent > 100 {
+		return nil, errors.New(fmt.Sprintf("Invalid value for %s: %d.  "+
+			"Expected a percentage between 0 and 100.",
+			conf.HTRACE_QUOTA_SAMPLE_PERCENT, samplePercent))
+	}
+	return &quotaTracker{
+		rules:         rules,
+		samplePercent: uint32(samplePercent),
+		usage:         make(map[*shard][]uint64),
+		numShards:     numShards,
+		enforcing:     make([]int32, len(rules)),
+		rejected:      make([]uint64, len(rules)),
+		sampledOut:    make([]uint64, len(rules)),
+	}, nil
+}
+
+// Find the index of the first rule which matches a tracer ID, or -1 if there
+// is none.
+func (qtr *quotaTracker) ruleFor(trid string) int {
+	for ruleIdx, rule := range qtr.rules {
+		if matched, _ := path.Match(rule.pattern, trid); matched {
+			return ruleIdx
+		}
+	}
+	return -1
+}
+
+// Record the number of spans in a shard which count against each rule, and
+// decide which rules to enforce.
+func (qtr *quotaTracker) setShardUsage(shd *shard, shardUsage []uint64) {
+	qtr.lock.Lock()
+	defer qtr.lock.Unlock()
+	qtr.usage[shd] = shardUsage
+	totals := qtr.totalsLocked()
+	for ruleIdx, rule := range qtr.rules {
+		var enforcing int32
+		if totals[ruleIdx] >= rule.limit {
+			enforcing = 1
+		}
+		if atomic.SwapInt32(&qtr.enforcing[ruleIdx], enforcing) != enforcing {
+			if enforcing != 0 {
+				shd.store.lg.Warnf("Enforcing the %s quota for tracers "+
+					"matching '%s': %d stored span(s), limit %d.\n",
+					rule.policy, rule.pattern, totals[ruleIdx], rule.limit)
+			} else {
+				shd.store.lg.Infof("No longer enforcing the quota for "+
+					"tracers matching '%s': %d stored span(s), limit %d.\n",
+					rule.pattern, totals[ruleIdx], rule.limit)
+			}
+		}
+	}
+}
+
+func (qtr *quotaTracker) totalsLocked() []uint64 {
+	totals := make([]uint64, len(qtr.rules))
+	for _, shardUsage := range qtr.usage {
+		for ruleIdx := range shardUsage {
+			totals[ruleIdx] += shardUsage[ruleIdx]
+		}
+	}
+	return totals
+}
+
+// Decide whether to accept a span which counts against the given rule.
+// Returns the empty string if the span should be accepted, or else the
+// policy which dropped it.  Debug spans are never sampled out.
+func (qtr *quotaTracker) check(ruleIdx int, span *common.Span) string {
+	if atomic.LoadInt32(&qtr.enforcing[ruleIdx]) == 0 {
+		return ""
+	}
+	rule := qtr.rules[ruleIdx]
+	if rule.policy == common.QUOTA_POLICY_SAMPLE {
+		if span.Flags.Has(common.SPAN_FLAG_DEBUG) ||
+			span.Id.Hash32()%100 < qtr.samplePercent {
+			return ""
+		}
+		atomic.AddUint64(&qtr.sampledOut[ruleIdx], 1)
+	} else {
+		atomic.AddUint64(&qtr.rejected[ruleIdx], 1)
+	}
+	return rule.policy
+}
+
+// Get the status of each quota.
+func (qtr *quotaTracker) Get() []common.QuotaStatus {
+	qtr.lock.Lock()
+	totals := qtr.totalsLocked()
+	complete := len(qtr.usage) == qtr.numShards
+	qtr.lock.Unlock()
+	statuses := make([]common.QuotaStatus, len(qtr.rules))
+	for ruleIdx, rule := range qtr.rules {
+		statuses[ruleIdx] = common.QuotaStatus{
+			Pattern:         rule.pattern,
+			Limit:           rule.limit,
+			Policy:          rule.policy,
+			SamplePercent:   int(qtr.samplePercent),
+			Usage:           totals[ruleIdx],
+			UsageComplete:   complete,
+			Enforcing:       atomic.LoadInt32(&qtr.enforcing[ruleIdx]) != 0,
+			RejectedSpans:   atomic.LoadUint64(&qtr.rejected[ruleIdx]),
+			SampledOutSpans: atomic.LoadUint64(&qtr.sampledOut[ruleIdx]),
+		}
+	}
+	return statuses
+}
+
+// Just the tracer ID of a span.  Decoding this is cheaper than decoding the
+// whole span.
+type tracerIdData struct {
+	TracerId string `json:"r"`
+}
+
+// Adjust the number of spans in this shard with the given tracer ID.  This is
+// called from the shard goroutine.
+func (shd *shard) adjustTracerCount(trid string, delta int) {
+	if shd.store.quotas == nil {
+		return
+	}
+	if delta < 0 {
+		// The count can be too low before the first recount.
+		if shd.tracerCounts[trid] > 0 {
+			shd.tracerCounts[trid]--
+		}
+		if shd.tracerCounts[trid] == 0 {
+			delete(shd.tracerCounts, trid)
+		}
+		return
+	}
+	shd.tracerCounts[trid]++
+}
+
+// Count the spans in this shard per tracer ID by scanning the primary index.
+func (shd *shard) recountTracers() error {
+	counts := make(map[string]uint64)
+	prefix := []byte{SPAN_ID_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		buf, err := shd.openSpanRecord(common.SpanId(iter.Key()[1:]),
+			iter.Value())
+		if err != nil {
+			return err
+		}
+		var data tracerIdData
+		if err := decodeSpanBytes(buf, &data); err != nil {
+			return err
+		}
+		counts[data.TracerId]++
+	}
+	if err := iter.GetError(); err != nil {
+		return err
+	}
+	shd.tracerCounts = counts
+	shd.tracerCountsReady = true
+	return nil
+}
+
+// Publish this shard's quota usage.  The first call counts the spans already
+// stored in the shard.  This is called from the shard goroutine.
+func (shd *shard) updateQuotaUsage() {
+	qtr := shd.store.quotas
+	if qtr == nil {
+		return
+	}
+	if !shd.tracerCountsReady {
+		if err := shd.recountTracers(); err != nil {
+			shd.store.lg.Errorf("Error counting the spans per tracer in "+
+				"shard %s: %s\n", shd.path, err.Error())
+			shd.checkCorruption(err)
+			return
+		}
+	}
+	shardUsage := make([]uint64, len(qtr.rules))
+	for trid, count := range shd.tracerCounts {
+		ruleIdx := qtr.ruleFor(trid)
+		if ruleIdx >= 0 {
+			shardUsage[ruleIdx] += count
+		}
+	}
+	qtr.setShardUsage(shd, shardUsage)
+}
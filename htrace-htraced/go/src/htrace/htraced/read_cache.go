@@ -0,0 +1,288 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"container/list"
+	"hash/fnv"
+	"htrace/common"
+	"sync"
+	"sync/atomic"
+)
+
+// The read caches keep recently read spans and children lists in memory, so
+// that tools which read the same trace over and over, such as the web UI and
+// the flame graph builder, don't have to go to leveldb every time.
+//
+// There are two caches.  The span cache maps a span id to the encoded span
+// data, as returned by FindSpanBytes.  We cache the encoded data rather than
+// the decoded span, since callers are free to modify the spans we give them.
+// The children cache maps a parent span id to the child ids returned by
+// FindChildren.  Each cache has its own budget in bytes, and evicts the least
+// recently used entries when it is full.
+//
+// The shards invalidate entries after they write to leveldb: the span cache
+// entry of every span which is rewritten, renamed, or deleted, and the
+// children cache entries of its parents.  Both caches are cleared when a
+// shard is quarantined or reopened, since that changes which spans are
+// visible.
+//
+// A reader which misses the cache reads from leveldb and then inserts what it
+// read.  If the entry was invalidated in between, what it read may already be
+// stale.  To catch this, each key hashes to a generation number, which
+// invalidate increments.  The reader notes the generation before it reads
+// from leveldb, and the insert is skipped if the generation has changed.
+// Since shards invalidate after writing, a reader which saw the new
+// generation must have read the new data.
+type readCache struct {
+	// The maximum number of bytes of entries we hold.
+	maxBytes int
+
+	// Protects everything below.
+	lock sync.Mutex
+
+	// The number of bytes of entries we hold.
+	curBytes int
+
+	// Maps keys to elements of lru.
+	entries map[string]*list.Element
+
+	// The entries, from the most recently used to the least.  Each element
+	// holds a *readCacheEntry.
+	lru *list.List
+
+	// The generation numbers.  See above.
+	gens [READ_CACHE_GENERATIONS]uint64
+
+	// The total number of lookups which did and didn't find an entry.
+	// Accessed atomically.
+	hits   uint64
+	misses uint64
+}
+
+// The number of generation numbers each cache has.  Keys which hash to the
+// same generation number invalidate each other's in-progress inserts, which
+// is harmless but wasteful.
+const READ_CACHE_GENERATIONS = 64
+
+// The number of bytes we charge for each entry on top of the size of its
+// value, to account for the key, map entry and list element.
+const READ_CACHE_ENTRY_OVERHEAD = 96
+
+type readCacheEntry struct {
+	key  string
+	val  interface{}
+	size int
+}
+
+// Create a read cache holding at most maxBytes bytes, or nil if maxBytes is
+// not positive.  All the methods of a nil cache are no-ops.
+func newReadCache(maxBytes int64) *readCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &readCache{
+		maxBytes: int(maxBytes),
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+func readCacheGeneration(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % READ_CACHE_GENERATIONS)
+}
+
+// Look up a key.  An entry only counts as found if usable is nil or returns
+// true for its value.  If no usable entry is found, returns the generation to
+// pass to insert.
+func (rc *readCache) lookup(key string,
+	usable func(val interface{}) bool) (interface{}, uint64, bool) {
+	if rc == nil {
+		return nil, 0, false
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	elem := rc.entries[key]
+	if elem == nil || (usable != nil &&
+		!usable(elem.Value.(*readCacheEntry).val)) {
+		atomic.AddUint64(&rc.misses, 1)
+		return nil, rc.gens[readCacheGeneration(key)], false
+	}
+	atomic.AddUint64(&rc.hits, 1)
+	rc.lru.MoveToFront(elem)
+	return elem.Value.(*readCacheEntry).val, 0, true
+}
+
+// Insert an entry, unless the key has been invalidated since the lookup which
+// returned gen.  The value must not be modified after this.
+func (rc *readCache) insert(key string, val interface{}, size int,
+	gen uint64) {
+	if rc == nil {
+		return
+	}
+	size += READ_CACHE_ENTRY_OVERHEAD
+	if size > rc.maxBytes {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	if rc.gens[readCacheGeneration(key)] != gen {
+		return
+	}
+	rc.removeLocked(key)
+	rc.entries[key] = rc.lru.PushFront(&readCacheEntry{
+		key:  key,
+		val:  val,
+		size: size,
+	})
+	rc.curBytes += size
+	for rc.curBytes > rc.maxBytes {
+		rc.removeLocked(rc.lru.Back().Value.(*readCacheEntry).key)
+	}
+}
+
+// Remove the entry for a key, and stop any in-progress insert of it.
+func (rc *readCache) invalidate(key string) {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.gens[readCacheGeneration(key)]++
+	rc.removeLocked(key)
+}
+
+// Remove every entry, and stop all in-progress inserts.
+func (rc *readCache) clear() {
+	if rc == nil {
+		return
+	}
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for i := range rc.gens {
+		rc.gens[i]++
+	}
+	rc.entries = make(map[string]*list.Element)
+	rc.lru.Init()
+	rc.curBytes = 0
+}
+
+func (rc *readCache) removeLocked(key string) {
+	elem := rc.entries[key]
+	if elem == nil {
+		return
+	}
+	rc.curBytes -= elem.Value.(*readCacheEntry).size
+	rc.lru.Remove(elem)
+	delete(rc.entries, key)
+}
+
+// Get the number of lookups which did and didn't find an entry.
+func (rc *readCache) stats() (uint64, uint64) {
+	if rc == nil {
+		return 0, 0
+	}
+	return atomic.LoadUint64(&rc.hits), atomic.LoadUint64(&rc.misses)
+}
+
+// A cached FindChildren result.
+type cachedChildren struct {
+	// The child ids, in the order FindChildren returned them.
+	ids []common.SpanId
+
+	// True if ids holds every child, rather than stopping at the limit.
+	complete bool
+}
+
+// Find the encoded data of a span in the span cache, or read it with the
+// given function and cache it.
+func (store *dataStore) cachedSpanBytes(sid common.SpanId,
+	read func() []byte) []byte {
+	key := string(sid)
+	val, gen, ok := store.spanCache.lookup(key, nil)
+	if store.spanCache != nil && len(store.shards) > 0 {
+		shd := store.shards[store.getShardIndex(sid)]
+		if ok {
+			atomic.AddUint64(&shd.spanCacheHits, 1)
+		} else {
+			atomic.AddUint64(&shd.spanCacheMisses, 1)
+		}
+	}
+	if ok {
+		return val.([]byte)
+	}
+	buf := read()
+	if buf != nil {
+		// Limit the capacity, so that a caller which appends to the
+		// buffer doesn't write into memory other callers can see.
+		buf = buf[0:len(buf):len(buf)]
+		store.spanCache.insert(key, buf, len(buf), gen)
+	}
+	return buf
+}
+
+// Find the children of a span in the children cache, or read them with the
+// given function and cache them.  A negative limit means there is no limit.
+// read returns the children and whether it stopped because it reached the
+// limit.
+func (store *dataStore) cachedChildren(sid common.SpanId, lim int32,
+	read func() ([]common.SpanId, bool)) []common.SpanId {
+	key := string(sid)
+	val, gen, ok := store.childrenCache.lookup(key, func(val interface{}) bool {
+		// If the cached list stopped short of the limit, we need to read
+		// more children than we have.
+		cached := val.(*cachedChildren)
+		return cached.complete || (lim >= 0 && int32(len(cached.ids)) >= lim)
+	})
+	if ok {
+		ids := val.(*cachedChildren).ids
+		if lim >= 0 && int32(len(ids)) > lim {
+			ids = ids[0:lim]
+		}
+		return append(make([]common.SpanId, 0, len(ids)), ids...)
+	}
+	ids, limited := read()
+	size := 0
+	for i := range ids {
+		size += len(ids[i]) + 24
+	}
+	store.childrenCache.insert(key, &cachedChildren{
+		ids:      append([]common.SpanId{}, ids...),
+		complete: !limited,
+	}, size, gen)
+	return ids
+}
+
+// Invalidate the cached data of a span which is being rewritten or deleted.
+func (store *dataStore) invalidateCachedSpan(span *common.Span) {
+	store.spanCache.invalidate(string(span.Id))
+	parents := indexedParents(span)
+	for i := range parents {
+		store.childrenCache.invalidate(string(parents[i]))
+	}
+}
+
+// Clear the read caches, because the set of visible spans changed.
+func (store *dataStore) clearReadCaches() {
+	store.spanCache.clear()
+	store.childrenCache.clear()
+}
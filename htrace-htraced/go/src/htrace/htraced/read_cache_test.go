@@ -0,0 +1,310 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReadCacheEviction(t *testing.T) {
+	rc := newReadCache(3 * (READ_CACHE_ENTRY_OVERHEAD + 10))
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		_, gen, ok := rc.lookup(key, nil)
+		if ok {
+			t.Fatalf("Unexpectedly found %s in an empty cache.\n", key)
+		}
+		rc.insert(key, i, 10, gen)
+	}
+	// Using key0 makes key1 the least recently used entry.
+	if val, _, ok := rc.lookup("key0", nil); !ok || val.(int) != 0 {
+		t.Fatalf("Expected to find key0.\n")
+	}
+	_, gen, _ := rc.lookup("key3", nil)
+	rc.insert("key3", 3, 10, gen)
+	for i, expected := range []bool{true, false, true, true} {
+		_, _, ok := rc.lookup(fmt.Sprintf("key%d", i), nil)
+		if ok != expected {
+			t.Fatalf("Expected found=%t for key%d, but got %t\n", expected, i, ok)
+		}
+	}
+	if rc.curBytes != 3*(READ_CACHE_ENTRY_OVERHEAD+10) {
+		t.Fatalf("Unexpected curBytes %d\n", rc.curBytes)
+	}
+
+	// An entry which is bigger than the whole cache is never inserted.
+	_, gen, _ = rc.lookup("huge", nil)
+	rc.insert("huge", 4, 1000, gen)
+	if _, _, ok := rc.lookup("huge", nil); ok {
+		t.Fatalf("An entry bigger than the cache was inserted.\n")
+	}
+
+	// An insert which races with an invalidation is skipped.
+	_, gen, _ = rc.lookup("key1", nil)
+	rc.invalidate("key1")
+	rc.insert("key1", 1, 10, gen)
+	if _, _, ok := rc.lookup("key1", nil); ok {
+		t.Fatalf("A stale entry was inserted after an invalidation.\n")
+	}
+	rc.clear()
+	if _, _, ok := rc.lookup("key0", nil); ok || rc.curBytes != 0 {
+		t.Fatalf("The cache was not cleared.\n")
+	}
+
+	// A nil cache never finds anything.
+	var nilCache *readCache
+	nilCache.insert("key0", 0, 10, 0)
+	if _, _, ok := nilCache.lookup("key0", nil); ok {
+		t.Fatalf("A nil cache found an entry.\n")
+	}
+}
+
+func expectChildren(t *testing.T, store *dataStore, sid common.SpanId,
+	lim int32, expected ...common.SpanId) {
+	children := store.FindChildren(sid, lim)
+	common.ExpectStrEqual(t, fmt.Sprintf("%v", expected),
+		fmt.Sprintf("%v", children))
+}
+
+func TestReadCacheInvalidation(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestReadCacheInvalidation",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	parentA := common.TestId("00000000000000000000000000000001")
+	parentB := common.TestId("00000000000000000000000000000002")
+	childId := common.TestId("00000000000000000000000000000003")
+	newSpan := func(sid common.SpanId, desc string,
+		parents ...common.SpanId) *common.Span {
+		return &common.Span{Id: sid, SpanData: common.SpanData{
+			Begin:       100,
+			End:         200,
+			Description: desc,
+			Parents:     append([]common.SpanId{}, parents...),
+			TracerId:    "cachetest",
+		}}
+	}
+	ingestSpans(ht, []*common.Span{
+		newSpan(parentA, "parentA"),
+		newSpan(parentB, "parentB"),
+		newSpan(childId, "v1", parentA),
+	})
+	// Ingesting may look spans up too, so only count the lookups we do.
+	before := ht.Store.ServerStats()
+	for i := 0; i < 3; i++ {
+		span := ht.Store.FindSpan(childId)
+		if span == nil || span.Description != "v1" {
+			t.Fatalf("Expected v1 of the child, but got %s\n", asJson(span))
+		}
+		expectChildren(t, ht.Store, parentA, 10, childId)
+		expectChildren(t, ht.Store, parentB, 10)
+	}
+	stats := ht.Store.ServerStats()
+	if stats.SpanCacheHits-before.SpanCacheHits != 2 ||
+		stats.SpanCacheMisses-before.SpanCacheMisses != 1 ||
+		stats.ChildrenCacheHits-before.ChildrenCacheHits != 4 ||
+		stats.ChildrenCacheMisses-before.ChildrenCacheMisses != 2 {
+		t.Fatalf("Unexpected cache stats %s\n", asJson(stats))
+	}
+
+	// Rewrite the cached span, moving it to a different parent.  The next
+	// reads must see the new version.
+	ingestSpans(ht, []*common.Span{newSpan(childId, "v2", parentB)})
+	span := ht.Store.FindSpan(childId)
+	if span == nil || span.Description != "v2" {
+		t.Fatalf("Expected v2 of the child, but got %s\n", asJson(span))
+	}
+	expectChildren(t, ht.Store, parentA, 10)
+	expectChildren(t, ht.Store, parentB, 10, childId)
+
+	// A limited children list is only reused for limits it covers.
+	secondChild := common.TestId("00000000000000000000000000000004")
+	ingestSpans(ht, []*common.Span{newSpan(secondChild, "v1", parentB)})
+	first := ht.Store.FindChildren(parentB, 1)
+	if len(first) != 1 {
+		t.Fatalf("Expected 1 child, but got %v\n", first)
+	}
+	expectChildren(t, ht.Store, parentB, 1, first[0])
+	all := ht.Store.FindChildren(parentB, 2)
+	if len(all) != 2 || !all[0].Equal(first[0]) ||
+		!(all[1].Equal(childId) || all[1].Equal(secondChild)) ||
+		all[0].Equal(all[1]) {
+		t.Fatalf("Expected both children, starting with %s, but got %v\n",
+			first[0].String(), all)
+	}
+	expectChildren(t, ht.Store, parentB, -1, all...)
+
+	// Deleting the span removes it from both caches.
+	ht.Store.FindSpan(childId)
+	shd := ht.Store.shards[ht.Store.getShardIndex(childId)]
+	err = shd.DeleteSpan(span)
+	if err != nil {
+		t.Fatalf("DeleteSpan failed: %s\n", err.Error())
+	}
+	if span = ht.Store.FindSpan(childId); span != nil {
+		t.Fatalf("Found deleted span %s\n", asJson(span))
+	}
+	expectChildren(t, ht.Store, parentB, 10, secondChild)
+}
+
+func TestReadCacheDisabled(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestReadCacheDisabled",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_CACHE_BYTES:     "0",
+			conf.HTRACE_CHILDREN_CACHE_BYTES: "0",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	spans := createRandomTestSpans(5)
+	ingestSpans(ht, spans)
+	for i := 0; i < 2; i++ {
+		for j := range spans {
+			if ht.Store.FindSpan(spans[j].Id) == nil {
+				t.Fatalf("Failed to find span %s\n", spans[j].Id.String())
+			}
+			ht.Store.FindChildren(spans[j].Id, 10)
+		}
+	}
+	stats := ht.Store.ServerStats()
+	if stats.SpanCacheHits != 0 || stats.SpanCacheMisses != 0 ||
+		stats.ChildrenCacheHits != 0 || stats.ChildrenCacheMisses != 0 {
+		t.Fatalf("Unexpected cache stats %s\n", asJson(stats))
+	}
+}
+
+// Rewrite a span over and over while other goroutines read it, and check
+// that once each rewrite has been written, nobody reads an older version.
+func TestReadCacheConcurrentRewrites(t *testing.T) {
+	const NUM_REWRITES = 200
+	const NUM_READERS = 4
+	htraceBld := &MiniHTracedBuilder{Name: "TestReadCacheConcurrentRewrites",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	parents := []common.SpanId{
+		common.TestId("00000000000000000000000000000001"),
+		common.TestId("00000000000000000000000000000002"),
+	}
+	sid := common.TestId("00000000000000000000000000000003")
+	newVersion := func(version int) *common.Span {
+		return &common.Span{Id: sid, SpanData: common.SpanData{
+			Begin:       100,
+			End:         200,
+			Description: fmt.Sprintf("v%d", version),
+			Parents:     []common.SpanId{parents[version%2]},
+			TracerId:    "cachetest",
+		}}
+	}
+	ingestSpans(ht, []*common.Span{newVersion(0)})
+	var done int32
+	var wg sync.WaitGroup
+	for i := 0; i < NUM_READERS; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&done) == 0 {
+				ht.Store.FindSpan(sid)
+				ht.Store.FindChildren(parents[0], 10)
+				ht.Store.FindChildren(parents[1], 10)
+			}
+		}()
+	}
+	for version := 1; version <= NUM_REWRITES; version++ {
+		ingestSpans(ht, []*common.Span{newVersion(version)})
+		span := ht.Store.FindSpan(sid)
+		if span == nil || span.Description != fmt.Sprintf("v%d", version) {
+			atomic.StoreInt32(&done, 1)
+			t.Fatalf("Expected v%d, but read %s\n", version, asJson(span))
+		}
+		expectChildren(t, ht.Store, parents[version%2], 10, sid)
+		expectChildren(t, ht.Store, parents[(version+1)%2], 10)
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+}
+
+func benchmarkFindSpanHotTrace(b *testing.B, cacheBytes string) {
+	gen := &test.SpanTreeGenerator{
+		Seed:          1924,
+		Depth:         3,
+		NumRoots:      1,
+		MinFanOut:     8,
+		MaxFanOut:     8,
+		MinDurationMs: 1000,
+		MaxDurationMs: 10000,
+		StartMs:       123456789,
+		Nested:        true,
+	}
+	tree := gen.Generate()
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkFindSpanHotTrace",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+			conf.HTRACE_LOG_LEVEL:                     "INFO",
+			conf.HTRACE_SPAN_CACHE_BYTES:              cacheBytes,
+			conf.HTRACE_CHILDREN_CACHE_BYTES:          cacheBytes,
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, tree.Spans)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := range tree.Spans {
+			if ht.Store.FindSpan(tree.Spans[i].Id) == nil {
+				b.Fatalf("Failed to find span %s\n", tree.Spans[i].Id.String())
+			}
+			ht.Store.FindChildren(tree.Spans[i].Id, 100)
+		}
+	}
+}
+
+func BenchmarkFindSpanHotTrace(b *testing.B) {
+	benchmarkFindSpanHotTrace(b, fmt.Sprintf("%d", 8*1024*1024))
+}
+
+func BenchmarkFindSpanHotTraceUncached(b *testing.B) {
+	benchmarkFindSpanHotTrace(b, "0")
+}
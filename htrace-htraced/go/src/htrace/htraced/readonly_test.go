@@ -0,0 +1,188 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testReadOnly(t, backend)
+	}
+}
+
+// Build a MiniHTraced on existing data directories, which are kept on close.
+func buildOnDataDirs(name string, backend string, dataDirs []string,
+	readOnly bool) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND: backend,
+			conf.HTRACE_READ_ONLY:         fmt.Sprintf("%t", readOnly),
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+// Check that writes to a read-only server fail with ERR_READ_ONLY.
+func expectReadOnlyWrite(t *testing.T, hcl *htrace.Client, transport string) {
+	err := hcl.WriteSpans(createRandomTestSpans(2))
+	if common.ErrorCodeOf(err) != common.ERR_READ_ONLY {
+		t.Fatalf("Expected a %s write to fail with %s, but got %v\n",
+			transport, common.ERR_READ_ONLY, err)
+	}
+}
+
+func testReadOnly(t *testing.T, backend string) {
+	const NUM_TEST_SPANS = 20
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(),
+			fmt.Sprintf("TestReadOnly%s%d", backend, i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+
+	// There is nothing to serve until a writable daemon has created the
+	// datastore.
+	_, err := buildOnDataDirs("TestReadOnlyEmpty"+backend, backend,
+		dataDirs, true)
+	common.AssertErrContains(t, err, "there is no existing datastore")
+	ht, err := buildOnDataDirs("TestReadOnlyWriter"+backend, backend,
+		dataDirs, false)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	ingestSpans(ht, allSpans)
+	snapDir, err := ioutil.TempDir(os.TempDir(), "TestReadOnlySnap"+backend)
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(snapDir)
+	_, err = ht.Store.StartSnapshot(snapDir)
+	if err != nil {
+		t.Fatalf("StartSnapshot(%s) failed: %s\n", snapDir, err.Error())
+	}
+	for ht.Store.SnapshotStatus().State == common.SNAPSHOT_RUNNING {
+		time.Sleep(time.Millisecond)
+	}
+	ht.Close()
+
+	ht, err = buildOnDataDirs("TestReadOnly"+backend, backend, dataDirs, true)
+	if err != nil {
+		t.Fatalf("failed to open the datastore read-only: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	for i := range allSpans {
+		span, err := hcl.FindSpan(allSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", allSpans[i].Id.String(),
+				err.Error())
+		}
+		common.ExpectSpansEqual(t, allSpans[i], span)
+	}
+	children, err := hcl.FindChildren(allSpans[0].Id, NUM_TEST_SPANS)
+	if err != nil {
+		t.Fatalf("FindChildren failed: %s\n", err.Error())
+	}
+	if len(children) == 0 {
+		t.Fatalf("Expected span %s to have children.\n",
+			allSpans[0].Id.String())
+	}
+	spans, err := hcl.Query(&common.Query{Lim: NUM_TEST_SPANS + 1})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(spans) != NUM_TEST_SPANS {
+		t.Fatalf("Expected the query to return %d spans, but got %d.\n",
+			NUM_TEST_SPANS, len(spans))
+	}
+	_, err = hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+
+	// Writes are rejected over both transports.  Once the client has seen
+	// the rejection, it fails writes without contacting the server.
+	expectReadOnlyWrite(t, hcl, "HRPC")
+	restHcl, err := htrace.NewClient(ht.ClientConf(),
+		&htrace.TestHooks{HrpcDisabled: true})
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer restHcl.Close()
+	expectReadOnlyWrite(t, restHcl, "REST")
+	numRequests := restHcl.Metrics().RestRequests
+	expectReadOnlyWrite(t, restHcl, "REST")
+	if restHcl.Metrics().RestRequests != numRequests {
+		t.Fatalf("Expected the client to reject the write without sending it.\n")
+	}
+	info, err := restHcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	if !info.ReadOnly {
+		t.Fatalf("Expected the server to report that it is read-only, but "+
+			"got %s\n", asJson(info))
+	}
+
+	// The read-only daemon still locks its shards, so a writable daemon
+	// can't share them.  It can serve the snapshot, which is laid out like
+	// a set of data directories.
+	_, err = buildOnDataDirs("TestReadOnlySharer"+backend, backend,
+		dataDirs, false)
+	common.AssertErrContains(t, err, "/LOCK")
+	snapDirs := []string{snapDir + "/shard0", snapDir + "/shard1"}
+	cht, err := buildOnDataDirs("TestReadOnlyCopy"+backend, backend,
+		snapDirs, false)
+	if err != nil {
+		t.Fatalf("failed to open the snapshot: %s", err.Error())
+	}
+	defer cht.Close()
+	span := cht.Store.FindSpan(allSpans[0].Id)
+	if span == nil {
+		t.Fatalf("Failed to find span %s in the snapshot.\n",
+			allSpans[0].Id.String())
+	}
+	newSpans := createRandomTestSpans(NUM_TEST_SPANS + 1)
+	ingestSpans(cht, newSpans[NUM_TEST_SPANS:])
+	if cht.Store.FindSpan(newSpans[NUM_TEST_SPANS].Id) == nil {
+		t.Fatalf("Failed to write a span to the snapshot.\n")
+	}
+}
@@ -0,0 +1,210 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"encoding/json"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The rejection log keeps examples of the spans which were rejected as
+// invalid, so that problems in a client's serialization code can be debugged
+// without a packet capture.  The number of rejected spans is always counted
+// for each reason.  The most recent rejections for each reason are kept in a
+// ring of rejections.max.entries entries, which is 0 by default.  The data
+// which was rejected is only kept if rejections.capture.payload is set, since
+// spans can contain sensitive information.  The log is kept in memory, so it
+// starts out empty each time htraced starts.
+
+// The transports which spans can arrive on, apart from those in audit.go.
+const REJECTION_TRANSPORT_UDP = "udp"
+
+type rejectionLog struct {
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The number of rejections to keep for each reason.
+	maxEntries int
+
+	// True if we should keep the rejected data.
+	capturePayload bool
+
+	// The maximum number of bytes of rejected data to keep.
+	payloadMaxBytes int
+
+	// The number of rejections for each reason.
+	counts map[string]uint64
+
+	// Maps each reason to its ring of recent rejections.
+	rings map[string]*rejectionRing
+}
+
+// A fixed-size ring of rejections.  Once it is full, each new rejection
+// replaces the oldest one.
+type rejectionRing struct {
+	entries []common.RejectedSpan
+
+	// The index of the oldest entry, once the ring is full.
+	start int
+}
+
+func newRejectionLog(cnf *conf.Config) *rejectionLog {
+	rlog := &rejectionLog{
+		maxEntries:      cnf.GetInt(conf.HTRACE_REJECTIONS_MAX_ENTRIES),
+		capturePayload:  cnf.GetBool(conf.HTRACE_REJECTIONS_CAPTURE_PAYLOAD),
+		payloadMaxBytes: cnf.GetInt(conf.HTRACE_REJECTIONS_PAYLOAD_MAX_BYTES),
+		counts:          make(map[string]uint64),
+		rings:           make(map[string]*rejectionRing),
+	}
+	if rlog.maxEntries < 0 {
+		rlog.maxEntries = 0
+	}
+	if rlog.payloadMaxBytes < 0 {
+		rlog.payloadMaxBytes = 0
+	}
+	return rlog
+}
+
+// Check whether we keep the data of rejected spans.
+func (rlog *rejectionLog) keepsPayloads() bool {
+	return rlog.maxEntries > 0 && rlog.capturePayload
+}
+
+// Record a span which was rejected before it could be decoded.  buf holds
+// the data which could not be decoded.  The data is copied, so the caller may
+// reuse buf.
+func (rlog *rejectionLog) recordBytes(reason string, addr string,
+	transport string, msg string, buf []byte) {
+	rlog.record(reason, addr, transport, msg, func() []byte {
+		return buf
+	})
+}
+
+// Record a span which was rejected after it was decoded.
+func (rlog *rejectionLog) recordSpan(reason string, addr string,
+	transport string, msg string, span *common.Span) {
+	rlog.record(reason, addr, transport, msg, func() []byte {
+		// The span was decoded from a request, so it can be encoded again,
+		// unless its span ID is invalid.
+		buf, err := json.Marshal(span)
+		if err != nil {
+			return nil
+		}
+		return buf
+	})
+}
+
+// Record a rejection.  The payload function is only called if we are keeping
+// payloads, since encoding a span is not free.
+func (rlog *rejectionLog) record(reason string, addr string, transport string,
+	msg string, payload func() []byte) {
+	entry := common.RejectedSpan{
+		TimeMs:    common.TimeToUnixMs(time.Now().UTC()),
+		Reason:    reason,
+		Addr:      addr,
+		Transport: transport,
+		Message:   msg,
+	}
+	if rlog.keepsPayloads() {
+		buf := payload()
+		if len(buf) > rlog.payloadMaxBytes {
+			buf = buf[0:rlog.payloadMaxBytes]
+			entry.PayloadTruncated = true
+		}
+		entry.Payload = append([]byte(nil), buf...)
+	}
+	rlog.lock.Lock()
+	defer rlog.lock.Unlock()
+	rlog.counts[reason]++
+	if rlog.maxEntries == 0 {
+		return
+	}
+	ring := rlog.rings[reason]
+	if ring == nil {
+		ring = &rejectionRing{
+			entries: make([]common.RejectedSpan, 0, rlog.maxEntries),
+		}
+		rlog.rings[reason] = ring
+	}
+	if len(ring.entries) < rlog.maxEntries {
+		ring.entries = append(ring.entries, entry)
+	} else {
+		ring.entries[ring.start] = entry
+		ring.start = (ring.start + 1) % len(ring.entries)
+	}
+}
+
+// Sorts rejected spans so that the newest come first.
+type rejectedSpansNewestFirst []common.RejectedSpan
+
+func (s rejectedSpansNewestFirst) Len() int {
+	return len(s)
+}
+
+func (s rejectedSpansNewestFirst) Less(i, j int) bool {
+	return s[i].TimeMs > s[j].TimeMs
+}
+
+func (s rejectedSpansNewestFirst) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Get up to lim of the most recent rejections, newest first.  If reason is
+// non-empty, only rejections for that reason are returned.  The counts for
+// all reasons are returned either way.
+func (rlog *rejectionLog) Get(reason string, lim int) *common.Rejections {
+	rlog.lock.Lock()
+	defer rlog.lock.Unlock()
+	rej := &common.Rejections{
+		Counts:  make(map[string]uint64),
+		Entries: make([]common.RejectedSpan, 0),
+	}
+	for r, count := range rlog.counts {
+		rej.Counts[r] = count
+	}
+	for r, ring := range rlog.rings {
+		if reason != "" && r != reason {
+			continue
+		}
+		// Newest first, so that the stable sort keeps the order of
+		// rejections which happened in the same millisecond.
+		numEntries := len(ring.entries)
+		for i := numEntries - 1; i >= 0; i-- {
+			rej.Entries = append(rej.Entries,
+				ring.entries[(ring.start+i)%numEntries])
+		}
+	}
+	sort.Stable(rejectedSpansNewestFirst(rej.Entries))
+	if len(rej.Entries) > lim {
+		rej.Entries = rej.Entries[0:lim]
+	}
+	return rej
+}
+
+// Remove all the rejections, and reset the counts.
+func (rlog *rejectionLog) Clear() {
+	rlog.lock.Lock()
+	defer rlog.lock.Unlock()
+	rlog.counts = make(map[string]uint64)
+	rlog.rings = make(map[string]*rejectionRing)
+}
@@ -0,0 +1,260 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func buildRejectionsHTraced(t *testing.T, name string,
+	cnf map[string]string) (*MiniHTraced, *htrace.Client) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf:          cnf,
+		InMemory:     true,
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		ht.Close()
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	return ht, hcl
+}
+
+// Post a raw WriteSpans request body, and check that it fails.
+func postBadWriteSpans(t *testing.T, ht *MiniHTraced, body string) {
+	url := fmt.Sprintf("http://%s/writeSpans", ht.Rsv.Addr().String())
+	resp, err := http.Post(url, "application/json",
+		bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to post to %s: %s\n", url, err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected status %d for a bad WriteSpans request, but got "+
+			"%d\n", http.StatusBadRequest, resp.StatusCode)
+	}
+}
+
+// A span which ends before it begins.
+func backwardsSpan(idx int) *common.Span {
+	return &common.Span{
+		Id: common.TestId(fmt.Sprintf("%032x", idx+1)),
+		SpanData: common.SpanData{
+			Begin:       200,
+			End:         100,
+			Description: fmt.Sprintf("backwards%d", idx),
+			TracerId:    "rejectionTest",
+		},
+	}
+}
+
+func getRejections(t *testing.T, hcl *htrace.Client, reason string,
+	lim int) *common.Rejections {
+	rej, err := hcl.GetRejections(reason, lim)
+	if err != nil {
+		t.Fatalf("GetRejections(%s, %d) failed: %s\n", reason, lim,
+			err.Error())
+	}
+	return rej
+}
+
+func TestRejectionLog(t *testing.T) {
+	ht, hcl := buildRejectionsHTraced(t, "TestRejectionLog",
+		map[string]string{
+			conf.HTRACE_REJECTIONS_MAX_ENTRIES:       "2",
+			conf.HTRACE_REJECTIONS_CAPTURE_PAYLOAD:   "true",
+			conf.HTRACE_REJECTIONS_PAYLOAD_MAX_BYTES: "512",
+			conf.HTRACE_INGEST_VALIDATE_TIMES:        "true",
+		})
+	defer ht.Close()
+	defer hcl.Close()
+
+	// A span which isn't valid JSON.
+	postBadWriteSpans(t, ht, `{"NumSpans":1}{"a":"00000000000000000000000000000001",`+
+		`"b":1,"e":"notanumber"}`)
+
+	// Spans which end before they begin.  Only two are kept, but all three
+	// are counted.
+	spans := []*common.Span{backwardsSpan(0), backwardsSpan(1),
+		backwardsSpan(2)}
+	err := hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+
+	// A span whose unknown fields are too big.  Its payload is cut off.
+	big := &common.Span{
+		Id: common.TestId("00000000000000000000000000000010"),
+		SpanData: common.SpanData{
+			Begin:       100,
+			End:         200,
+			Description: "big",
+			TracerId:    "rejectionTest",
+			Extras: common.SpanExtras{
+				"huge": json.RawMessage(`"` + strings.Repeat("x",
+					common.MAX_SPAN_EXTRAS_BYTES) + `"`),
+			},
+		},
+	}
+	err = hcl.WriteSpans([]*common.Span{big})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+
+	rej := getRejections(t, hcl, "", 100)
+	expectedCounts := map[string]uint64{
+		common.REJECT_REASON_DECODE:    1,
+		common.REJECT_REASON_TIMES:     3,
+		common.REJECT_REASON_OVERSIZED: 1,
+	}
+	if len(rej.Counts) != len(expectedCounts) {
+		t.Fatalf("expected counts %v, but got %v\n", expectedCounts,
+			rej.Counts)
+	}
+	for reason, count := range expectedCounts {
+		if rej.Counts[reason] != count {
+			t.Fatalf("expected counts %v, but got %v\n", expectedCounts,
+				rej.Counts)
+		}
+	}
+	if len(rej.Entries) != 4 {
+		t.Fatalf("expected 4 entries, but got %d: %s\n", len(rej.Entries),
+			asJson(rej))
+	}
+	for i := range rej.Entries {
+		entry := &rej.Entries[i]
+		if entry.Addr == "" || entry.Transport != AUDIT_TRANSPORT_REST {
+			t.Fatalf("unexpected address or transport in %s\n", asJson(entry))
+		}
+		if i > 0 && entry.TimeMs > rej.Entries[i-1].TimeMs {
+			t.Fatalf("expected the newest entries first: %s\n", asJson(rej))
+		}
+	}
+
+	// The decode failure keeps the bytes which couldn't be decoded.
+	rej = getRejections(t, hcl, common.REJECT_REASON_DECODE, 100)
+	if len(rej.Entries) != 1 ||
+		!strings.Contains(string(rej.Entries[0].Payload), "notanumber") ||
+		rej.Entries[0].PayloadTruncated {
+		t.Fatalf("unexpected decode rejections: %s\n", asJson(rej))
+	}
+
+	// The ring for spans which end before they begin keeps the newest two.
+	rej = getRejections(t, hcl, common.REJECT_REASON_TIMES, 100)
+	if len(rej.Entries) != 2 {
+		t.Fatalf("expected 2 times rejections, but got %s\n", asJson(rej))
+	}
+	for i, desc := range []string{"backwards2", "backwards1"} {
+		var span common.Span
+		err = json.Unmarshal(rej.Entries[i].Payload, &span)
+		if err != nil {
+			t.Fatalf("failed to decode rejected span payload %s: %s\n",
+				string(rej.Entries[i].Payload), err.Error())
+		}
+		if span.Description != desc {
+			t.Fatalf("expected rejected span %d to be %s, but got %s\n",
+				i, desc, asJson(&span))
+		}
+	}
+	rej = getRejections(t, hcl, common.REJECT_REASON_TIMES, 1)
+	if len(rej.Entries) != 1 {
+		t.Fatalf("expected lim to limit the entries: %s\n", asJson(rej))
+	}
+
+	rej = getRejections(t, hcl, common.REJECT_REASON_OVERSIZED, 100)
+	if len(rej.Entries) != 1 || len(rej.Entries[0].Payload) != 512 ||
+		!rej.Entries[0].PayloadTruncated {
+		t.Fatalf("expected a truncated oversized rejection: %s\n",
+			asJson(rej))
+	}
+
+	// None of the rejected spans were stored.
+	for _, span := range append(spans, big) {
+		if ht.Store.FindSpan(span.Id) != nil {
+			t.Fatalf("rejected span %s was stored\n", span.Id.String())
+		}
+	}
+
+	_, err = hcl.GetRejections("nosuchreason", 10)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+
+	err = hcl.ClearRejections()
+	if err != nil {
+		t.Fatalf("ClearRejections failed: %s\n", err.Error())
+	}
+	rej = getRejections(t, hcl, "", 100)
+	if len(rej.Counts) != 0 || len(rej.Entries) != 0 {
+		t.Fatalf("expected no rejections after clearing, but got %s\n",
+			asJson(rej))
+	}
+}
+
+// By default, rejections are only counted, and spans which end before they
+// begin are accepted.
+func TestRejectionLogDefaults(t *testing.T) {
+	ht, hcl := buildRejectionsHTraced(t, "TestRejectionLogDefaults", nil)
+	defer ht.Close()
+	defer hcl.Close()
+	postBadWriteSpans(t, ht, `{"NumSpans":1}{"a":`)
+	err := hcl.WriteSpans([]*common.Span{backwardsSpan(0)})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	rej := getRejections(t, hcl, "", 100)
+	if len(rej.Counts) != 1 || rej.Counts[common.REJECT_REASON_DECODE] != 1 ||
+		len(rej.Entries) != 0 {
+		t.Fatalf("expected only a count of the decode failure, but got %s\n",
+			asJson(rej))
+	}
+}
+
+// With entries kept, but payload capture off, entries have no payloads.
+func TestRejectionLogWithoutPayloads(t *testing.T) {
+	ht, hcl := buildRejectionsHTraced(t, "TestRejectionLogWithoutPayloads",
+		map[string]string{
+			conf.HTRACE_REJECTIONS_MAX_ENTRIES: "10",
+			conf.HTRACE_INGEST_VALIDATE_TIMES:  "true",
+		})
+	defer ht.Close()
+	defer hcl.Close()
+	err := hcl.WriteSpans([]*common.Span{backwardsSpan(0)})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	rej := getRejections(t, hcl, common.REJECT_REASON_TIMES, 100)
+	if len(rej.Entries) != 1 || rej.Entries[0].Payload != nil ||
+		rej.Entries[0].Message == "" {
+		t.Fatalf("expected an entry without a payload, but got %s\n",
+			asJson(rej))
+	}
+}
@@ -0,0 +1,233 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+//
+// Configuration reloading.
+//
+// Most configuration keys are only read at startup, so changing them requires
+// a restart.  A few operational keys can be changed while htraced is running.
+// The subsystem which owns each of these "hot" keys registers a function which
+// applies a new value.  When the configuration is reloaded, we apply the
+// changes to the hot keys, and report the changes to all other keys as
+// ignored.
+//
+
+// Applies the value of a configuration key from a newly loaded configuration.
+// Returns an error if the new value can't be used.
+type ConfApplier func(cnf *conf.Config) error
+
+type ConfReloader struct {
+	// The logger to use.
+	lg *common.Logger
+
+	// Loads the configuration.
+	load func() (*conf.Config, error)
+
+	// The lock which protects the fields below, and serializes reloads.
+	lock sync.Mutex
+
+	// The effective configuration.
+	cnf *conf.Config
+
+	// Maps hot-reloadable keys to the functions which apply them.
+	hot map[string]ConfApplier
+
+	// The result of the last reload, or nil if there hasn't been one.
+	last *common.ConfReloadResult
+}
+
+func NewConfReloader(cnf *conf.Config, lg *common.Logger,
+	load func() (*conf.Config, error)) *ConfReloader {
+	return &ConfReloader{
+		lg:   lg,
+		load: load,
+		cnf:  cnf,
+		hot:  make(map[string]ConfApplier),
+	}
+}
+
+// Register a key which can be changed without restarting.
+func (rld *ConfReloader) RegisterHotKey(key string, apply ConfApplier) {
+	rld.lock.Lock()
+	defer rld.lock.Unlock()
+	rld.hot[key] = apply
+}
+
+// Get the effective configuration.
+func (rld *ConfReloader) Current() *conf.Config {
+	rld.lock.Lock()
+	defer rld.lock.Unlock()
+	return rld.cnf
+}
+
+// Get the result of the last reload, or nil if there hasn't been one.
+func (rld *ConfReloader) LastResult() *common.ConfReloadResult {
+	rld.lock.Lock()
+	defer rld.lock.Unlock()
+	return rld.last
+}
+
+// Reload the configuration, and apply the changes to hot keys.
+func (rld *ConfReloader) Reload() *common.ConfReloadResult {
+	rld.lock.Lock()
+	defer rld.lock.Unlock()
+	result := &common.ConfReloadResult{
+		TimeMs:  common.TimeToUnixMs(time.Now().UTC()),
+		Outcome: common.CONF_RELOAD_OK,
+		Changes: make([]common.ConfChange, 0),
+	}
+	rld.last = result
+	ncnf, err := rld.load()
+	if err != nil {
+		result.Outcome = common.CONF_RELOAD_FAILED
+		result.Error = err.Error()
+		rld.lg.Errorf("Failed to reload the configuration: %s\n", err.Error())
+		return result
+	}
+	oldVals := rld.cnf.Export()
+	newVals := ncnf.Export()
+	keys := make(sort.StringSlice, 0)
+	for k, v := range newVals {
+		if oldVals[k] != v {
+			keys = append(keys, k)
+		}
+	}
+	for k := range oldVals {
+		if _, found := newVals[k]; !found {
+			keys = append(keys, k)
+		}
+	}
+	sort.Sort(keys)
+	applied := make([]string, 0, 2*len(keys))
+	for i := range keys {
+		change := common.ConfChange{
+			Key:      keys[i],
+			OldValue: oldVals[keys[i]],
+			NewValue: newVals[keys[i]],
+		}
+		apply := rld.hot[keys[i]]
+		if apply == nil {
+			change.Outcome = common.CONF_CHANGE_IGNORED
+			change.Reason = "This key can only be changed by restarting htraced."
+		} else if err = apply(ncnf); err != nil {
+			change.Outcome = common.CONF_CHANGE_FAILED
+			change.Reason = err.Error()
+		} else {
+			change.Outcome = common.CONF_CHANGE_APPLIED
+			applied = append(applied, change.Key, change.NewValue)
+		}
+		if change.Outcome != common.CONF_CHANGE_APPLIED {
+			result.Outcome = common.CONF_RELOAD_PARTIAL
+		}
+		rld.lg.Infof("Configuration reload: %s changed from '%s' to '%s': "+
+			"%s.  %s\n", change.Key, change.OldValue, change.NewValue,
+			change.Outcome, change.Reason)
+		result.Changes = append(result.Changes, change)
+	}
+	rld.cnf = rld.cnf.Clone(applied...)
+	rld.lg.Infof("Reloaded the configuration with outcome %s: %d change(s).\n",
+		result.Outcome, len(result.Changes))
+	return result
+}
+
+// Reload the configuration whenever we receive SIGHUP.
+func (rld *ConfReloader) ReloadOnSighup() {
+	sigHupChan := make(chan os.Signal, 1)
+	signal.Notify(sigHupChan, syscall.SIGHUP)
+	go func() {
+		for {
+			<-sigHupChan
+			rld.lg.Info("Reloading the configuration on SIGHUP.\n")
+			rld.Reload()
+		}
+	}()
+}
+
+// Get a positive number of milliseconds from a configuration.
+func getPositiveMs(cnf *conf.Config, key string) (int64, error) {
+	ms := cnf.GetInt64(key)
+	if ms <= 0 {
+		return 0, errors.New(fmt.Sprintf("%s must be positive.", key))
+	}
+	return ms, nil
+}
+
+// Register the keys which can be changed without restarting htraced.  hsv may
+// be nil if the HRPC server is not running.
+func registerHotConfKeys(rld *ConfReloader, store *dataStore, hsv *HrpcServer) {
+	rld.RegisterHotKey(conf.HTRACE_SPAN_EXPIRY_MS,
+		func(cnf *conf.Config) error {
+			store.rpr.SetSpanExpiryMs(cnf.GetInt64(conf.HTRACE_SPAN_EXPIRY_MS))
+			return nil
+		})
+	rld.RegisterHotKey(conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS,
+		func(cnf *conf.Config) error {
+			ms, err := getPositiveMs(cnf, conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS)
+			if err != nil {
+				return err
+			}
+			store.hb.SetPeriodMs(ms)
+			return nil
+		})
+	rld.RegisterHotKey(conf.HTRACE_REAPER_HEARTBEAT_PERIOD_MS,
+		func(cnf *conf.Config) error {
+			ms, err := getPositiveMs(cnf, conf.HTRACE_REAPER_HEARTBEAT_PERIOD_MS)
+			if err != nil {
+				return err
+			}
+			store.rpr.hb.SetPeriodMs(ms)
+			return nil
+		})
+	if hsv == nil {
+		return
+	}
+	rld.RegisterHotKey(conf.HTRACE_HRPC_IO_TIMEOUT_MS,
+		func(cnf *conf.Config) error {
+			ms, err := getPositiveMs(cnf, conf.HTRACE_HRPC_IO_TIMEOUT_MS)
+			if err != nil {
+				return err
+			}
+			hsv.setIoTimeo(time.Duration(ms) * time.Millisecond)
+			return nil
+		})
+	rld.RegisterHotKey(conf.HTRACE_HRPC_IDLE_TIMEOUT_MS,
+		func(cnf *conf.Config) error {
+			ms, err := getPositiveMs(cnf, conf.HTRACE_HRPC_IDLE_TIMEOUT_MS)
+			if err != nil {
+				return err
+			}
+			hsv.setIdleTimeo(time.Duration(ms) * time.Millisecond)
+			return nil
+		})
+}
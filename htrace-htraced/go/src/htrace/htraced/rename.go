@@ -0,0 +1,668 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"time"
+)
+
+//
+// Tracer renames.
+//
+// When a service is renamed, the spans it already sent are stored under its
+// old tracer ID.  A tracer rename rewrites the tracer ID of those spans.  It
+// runs in the background, scanning the primary index of one shard at a time
+// in batches of tracer.rename.batch.size spans, at no more than
+// tracer.rename.max.spans.per.sec spans per second.  Each batch is handed to
+// the shard goroutine, since that is the only thing which may rewrite a span
+// in the shard.  The tracer ID is not part of any index key, so only the
+// span records themselves change, along with the per-tracer span counts used
+// by quotas.
+//
+// The rename saves its place in each shard under TRACER_RENAME_KEY, in the
+// same leveldb write as the spans it renamed.  If the rename fails, or the
+// server is restarted, starting the same rename again picks up exactly where
+// it stopped.  The server resumes an interrupted rename by itself when it
+// starts.  Once every shard has been scanned, the saved places are removed.
+// Only one rename can run at a time, and a different rename can't start
+// while one is unfinished.
+//
+// A dry run scans the shards in the same way, but only counts the spans
+// which would be renamed.  It saves nothing.
+//
+// A rename can also install an alias, so that spans which arrive with the
+// old tracer ID are stored under the new one.  Aliases are kept in the first
+// shard, under TRACER_ALIAS_PREFIX, and are applied by the ingestors if
+// tracer.aliases.enabled is set.  The alias is installed before the scan
+// starts, so that the scan doesn't miss spans which arrive while it runs.
+// Spans which were already being ingested when the rename started may still
+// be stored under the old name; running the rename again picks them up.
+//
+
+// The key under which each shard saves the state of an unfinished rename.
+const TRACER_RENAME_KEY = 't'
+
+// The state of a rename in one shard.  This is saved in the shard.
+type tracerRenameState struct {
+	From  string
+	To    string
+	Alias bool
+
+	// The primary key of the last span scanned, or nil if we haven't started.
+	Cursor []byte
+
+	// True once the whole shard has been scanned.
+	Done bool
+
+	// The number of spans scanned and matched in this shard so far.
+	ScannedSpans uint64
+	MatchedSpans uint64
+}
+
+// A batch of a rename, to be run by the shard goroutine.
+type tracerRenameBatch struct {
+	state  *tracerRenameState
+	dryRun bool
+
+	// The maximum number of spans to scan.
+	lim int
+
+	// Receives the result of the batch.
+	done chan error
+}
+
+// A tracer rename which is running or has finished.
+type tracerRenameJob struct {
+	// Protects status.
+	lock sync.Mutex
+
+	status common.TracerRenameStatus
+
+	// Closed to stop the rename when the datastore is closed.
+	stop chan struct{}
+
+	// Tracks whether the rename goroutine has exited.
+	exited sync.WaitGroup
+}
+
+func (job *tracerRenameJob) getStatus() *common.TracerRenameStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := job.status
+	return &status
+}
+
+// Get the status of the most recent tracer rename.
+func (store *dataStore) TracerRenameStatus() *common.TracerRenameStatus {
+	store.renameLock.Lock()
+	job := store.rename
+	store.renameLock.Unlock()
+	if job == nil {
+		return &common.TracerRenameStatus{
+			State:       common.TRACER_RENAME_NONE,
+			TotalShards: len(store.shards),
+		}
+	}
+	return job.getStatus()
+}
+
+// Start renaming the tracer ID from to to in the stored spans.  If alias is
+// set, spans which arrive with the old tracer ID from now on are stored under
+// the new one.  If dryRun is set, the spans are only counted.  The shards
+// are scanned in the background.
+func (store *dataStore) StartTracerRename(from string, to string,
+	dryRun bool, alias bool) (*common.TracerRenameStatus, error) {
+	if from == "" || to == "" {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Both the tracer ID to rename and its new name must be given.")
+	}
+	if from == to {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"The tracer ID %s can't be renamed to itself.", from)
+	}
+	if store.readOnly {
+		return nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't rename tracers: this server is read-only.")
+	}
+	if alias && !dryRun && !store.aliasesEnabled {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"Can't install a tracer alias, because %s is false.",
+			conf.HTRACE_TRACER_ALIASES_ENABLED)
+	}
+	store.renameLock.Lock()
+	defer store.renameLock.Unlock()
+	if store.rename != nil &&
+		store.rename.getStatus().State == common.TRACER_RENAME_RUNNING {
+		status := store.rename.getStatus()
+		return nil, common.NewHtraceError(common.ERR_CONFLICT, nil,
+			"A rename of tracer %s to %s is already running.",
+			status.From, status.To)
+	}
+	states := make([]*tracerRenameState, len(store.shards))
+	resumed := false
+	if !dryRun {
+		saved, err := store.loadTracerRenameStates()
+		if err != nil {
+			return nil, err
+		}
+		if saved != nil {
+			if saved.From != from || saved.To != to {
+				return nil, common.NewHtraceError(common.ERR_CONFLICT, nil,
+					"A rename of tracer %s to %s was interrupted.  It must "+
+						"be finished before another rename can start.",
+					saved.From, saved.To)
+			}
+			states = saved.states
+			alias = alias || saved.Alias
+			resumed = true
+		}
+	}
+	for shdIdx := range states {
+		if states[shdIdx] == nil {
+			states[shdIdx] = &tracerRenameState{
+				From:  from,
+				To:    to,
+				Alias: alias && !dryRun,
+			}
+		}
+	}
+	if alias && !dryRun {
+		err := store.installTracerAlias(from, to)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return store.startTracerRenameJob(states, dryRun, resumed), nil
+}
+
+// Resume a rename which was interrupted by a restart.  This is called when
+// the datastore is created.
+func (store *dataStore) resumeTracerRename() {
+	saved, err := store.loadTracerRenameStates()
+	if err != nil {
+		store.lg.Errorf("Unable to resume a tracer rename: %s\n", err.Error())
+		return
+	}
+	if saved == nil {
+		return
+	}
+	for shdIdx := range saved.states {
+		if saved.states[shdIdx] == nil {
+			saved.states[shdIdx] = &tracerRenameState{
+				From:  saved.From,
+				To:    saved.To,
+				Alias: saved.Alias,
+			}
+		}
+	}
+	store.renameLock.Lock()
+	defer store.renameLock.Unlock()
+	store.startTracerRenameJob(saved.states, false, true)
+}
+
+// Start the rename goroutine.  The rename lock must be held.
+func (store *dataStore) startTracerRenameJob(states []*tracerRenameState,
+	dryRun bool, resumed bool) *common.TracerRenameStatus {
+	job := &tracerRenameJob{
+		status: common.TracerRenameStatus{
+			State:       common.TRACER_RENAME_RUNNING,
+			From:        states[0].From,
+			To:          states[0].To,
+			DryRun:      dryRun,
+			Alias:       states[0].Alias,
+			Resumed:     resumed,
+			StartMs:     common.TimeToUnixMs(time.Now().UTC()),
+			TotalShards: len(states),
+		},
+		stop: make(chan struct{}),
+	}
+	job.addProgress(states)
+	if !dryRun {
+		store.msink.RenameTracer(job.status.From, job.status.To)
+	}
+	store.rename = job
+	verb := "Started"
+	if resumed {
+		verb = "Resumed"
+	}
+	if dryRun {
+		verb += " a dry run of"
+	}
+	store.lg.Infof("%s the rename of tracer %s to %s.\n", verb,
+		job.status.From, job.status.To)
+	job.exited.Add(1)
+	go job.run(store, states)
+	return job.getStatus()
+}
+
+// Stop the running rename, if there is one, and wait for it to exit.  Its
+// place is saved, so it will be resumed when the datastore is reopened.
+func (store *dataStore) stopTracerRename() {
+	store.renameLock.Lock()
+	job := store.rename
+	store.rename = nil
+	store.renameLock.Unlock()
+	if job != nil {
+		close(job.stop)
+		job.exited.Wait()
+	}
+}
+
+// Recompute the progress of the rename from the shard states.
+func (job *tracerRenameJob) addProgress(states []*tracerRenameState) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.ShardsDone = 0
+	job.status.ScannedSpans = 0
+	job.status.MatchedSpans = 0
+	for _, state := range states {
+		if state.Done {
+			job.status.ShardsDone++
+		}
+		job.status.ScannedSpans += state.ScannedSpans
+		job.status.MatchedSpans += state.MatchedSpans
+	}
+}
+
+var errTracerRenameStopped = errors.New("The rename was interrupted " +
+	"because the datastore is closing.")
+
+// Scan the shards one at a time.
+func (job *tracerRenameJob) run(store *dataStore,
+	states []*tracerRenameState) {
+	defer job.exited.Done()
+	var err error
+	for shdIdx := 0; shdIdx < len(states) && err == nil; shdIdx++ {
+		shd := store.shards[shdIdx]
+		for !states[shdIdx].Done {
+			startTime := time.Now()
+			scanned := states[shdIdx].ScannedSpans
+			err = job.runBatch(shd, &tracerRenameBatch{
+				state:  states[shdIdx],
+				dryRun: job.status.DryRun,
+				lim:    store.renameBatchSize,
+				done:   make(chan error, 1),
+			})
+			if err != nil {
+				break
+			}
+			job.addProgress(states)
+			err = job.throttle(store, states[shdIdx].ScannedSpans-scanned,
+				startTime)
+			if err != nil {
+				break
+			}
+		}
+	}
+	if err == nil && !job.status.DryRun {
+		err = store.clearTracerRenameStates()
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.EndMs = common.TimeToUnixMs(time.Now().UTC())
+	if err != nil {
+		job.status.State = common.TRACER_RENAME_FAILED
+		job.status.Error = err.Error()
+		store.lg.Errorf("The rename of tracer %s to %s failed: %s\n",
+			job.status.From, job.status.To, err.Error())
+		return
+	}
+	job.status.State = common.TRACER_RENAME_DONE
+	store.lg.Infof("Finished the rename of tracer %s to %s in %d ms.  "+
+		"Scanned %d span(s), and found %d with the old tracer ID.\n",
+		job.status.From, job.status.To, job.status.EndMs-job.status.StartMs,
+		job.status.ScannedSpans, job.status.MatchedSpans)
+}
+
+// Hand a batch to the shard goroutine, and wait for it to finish.
+func (job *tracerRenameJob) runBatch(shd *shard,
+	batch *tracerRenameBatch) error {
+	select {
+	case shd.renames <- batch:
+	case <-job.stop:
+		return errTracerRenameStopped
+	}
+	return <-batch.done
+}
+
+// Wait long enough that scanning numScanned spans since startTime stays
+// within tracer.rename.max.spans.per.sec.
+func (job *tracerRenameJob) throttle(store *dataStore, numScanned uint64,
+	startTime time.Time) error {
+	if store.renameMaxRate <= 0 {
+		return nil
+	}
+	delay := time.Duration(numScanned)*time.Second/
+		time.Duration(store.renameMaxRate) - time.Since(startTime)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-job.stop:
+		return errTracerRenameStopped
+	}
+}
+
+// Encode span data the way the ingestors do.
+func encodeSpanData(data *common.SpanData) ([]byte, error) {
+	var mh codec.MsgpackHandle
+	mh.WriteExt = true
+	mh.Canonical = true
+	buf := make([]byte, 0, 1024)
+	err := codec.NewEncoderBytes(&buf, &mh).Encode(data)
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// Run a batch of a rename.  This is called from the shard goroutine.  The
+// renamed spans and the new state are written together, so the saved state
+// always matches the spans.
+func (shd *shard) renameTracerBatch(rb *tracerRenameBatch) error {
+	shd.store.writePause.RLock()
+	defer shd.store.writePause.RUnlock()
+	if !shd.acquire() {
+		return common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't rename tracers in shard %s, because it is quarantined.",
+			shd.path)
+	}
+	defer shd.release()
+	state := *rb.state
+	prefix := []byte{SPAN_ID_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(shd.store.bulkOpts)
+	defer iter.Close()
+	if state.Cursor == nil {
+		iter.Seek(prefix)
+	} else {
+		iter.Seek(state.Cursor)
+		if iter.Valid() && bytes.Equal(iter.Key(), state.Cursor) {
+			iter.Next()
+		}
+	}
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	numScanned := 0
+	var renamedIds []common.SpanId
+	var renamedRecords [][]byte
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if numScanned >= rb.lim {
+			break
+		}
+		numScanned++
+		state.Cursor = append([]byte{}, key...)
+		sid := common.SpanId(key[1:])
+		buf, err := shd.openSpanRecord(sid, iter.Value())
+		if err != nil {
+			return err
+		}
+		var data tracerIdData
+		err = decodeSpanBytes(buf, &data)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error decoding span %s in "+
+				"shard %s: %s", sid.String(), shd.path, err.Error()))
+		}
+		if data.TracerId != state.From {
+			continue
+		}
+		state.MatchedSpans++
+		if rb.dryRun {
+			continue
+		}
+		span, err := decodeSpan(sid, buf)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error decoding span %s in "+
+				"shard %s: %s", sid.String(), shd.path, err.Error()))
+		}
+		span.TracerId = state.To
+		record, err := encodeSpanData(&span.SpanData)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Error encoding span %s: %s",
+				sid.String(), err.Error()))
+		}
+		renamedRecords = append(renamedRecords, record)
+		if shd.cipher != nil {
+			record, err = shd.cipher.seal(state.Cursor, record)
+			if err != nil {
+				return err
+			}
+		}
+		batch.Put(state.Cursor, record)
+		renamedIds = append(renamedIds, sid)
+	}
+	if err := iter.GetError(); err != nil {
+		shd.checkCorruption(err)
+		return err
+	}
+	state.ScannedSpans += uint64(numScanned)
+	if numScanned < rb.lim {
+		state.Done = true
+	}
+	if !rb.dryRun {
+		buf, err := json.Marshal(&state)
+		if err != nil {
+			return err
+		}
+		batch.Put([]byte{TRACER_RENAME_KEY}, buf)
+		cn := shd.store.canary
+		if cn != nil {
+			for i := range renamedIds {
+				cn.beginWrite(renamedIds[i])
+			}
+		}
+		err = shd.ldb.Write(shd.store.writeOpts, batch)
+		if cn != nil {
+			for i := range renamedIds {
+				if err == nil {
+					cn.endWrite(renamedIds[i], renamedRecords[i])
+				} else {
+					cn.endWrite(renamedIds[i], nil)
+				}
+			}
+		}
+		if err != nil {
+			shd.checkCorruption(err)
+			return errors.New(fmt.Sprintf("Error renaming tracer %s in "+
+				"shard %s: %s", state.From, shd.path, err.Error()))
+		}
+		for i := range renamedIds {
+			shd.store.spanCache.invalidate(string(renamedIds[i]))
+			shd.adjustTracerCount(state.From, -1)
+			shd.adjustTracerCount(state.To, 1)
+		}
+	}
+	*rb.state = state
+	return nil
+}
+
+// The saved states of an unfinished rename.
+type savedTracerRename struct {
+	From  string
+	To    string
+	Alias bool
+
+	// The state of each shard, or nil for shards which have no saved state.
+	states []*tracerRenameState
+}
+
+// Load the saved state of an unfinished rename from each shard.  Returns nil
+// if there is no unfinished rename.
+func (store *dataStore) loadTracerRenameStates() (*savedTracerRename, error) {
+	var saved *savedTracerRename
+	for shdIdx, shd := range store.shards {
+		if !shd.acquire() {
+			return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED,
+				nil, "Can't check for an unfinished tracer rename, because "+
+					"shard %s is quarantined.", shd.path)
+		}
+		buf, err := shd.ldb.Get(store.readOpts, []byte{TRACER_RENAME_KEY})
+		shd.release()
+		if err != nil {
+			return nil, err
+		}
+		if buf == nil {
+			continue
+		}
+		var state tracerRenameState
+		err = json.Unmarshal(buf, &state)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Error parsing the tracer "+
+				"rename state in shard %s: %s", shd.path, err.Error()))
+		}
+		if saved == nil {
+			saved = &savedTracerRename{
+				From:   state.From,
+				To:     state.To,
+				states: make([]*tracerRenameState, len(store.shards)),
+			}
+		} else if saved.From != state.From || saved.To != state.To {
+			return nil, errors.New(fmt.Sprintf("Shard %s has the state of "+
+				"a rename of tracer %s to %s, but other shards have the "+
+				"state of a rename of tracer %s to %s.", shd.path, state.From,
+				state.To, saved.From, saved.To))
+		}
+		saved.Alias = saved.Alias || state.Alias
+		saved.states[shdIdx] = &state
+	}
+	return saved, nil
+}
+
+// Remove the saved state of a finished rename from every shard.
+func (store *dataStore) clearTracerRenameStates() error {
+	for _, shd := range store.shards {
+		if !shd.acquire() {
+			return common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+				"Can't finish the tracer rename, because shard %s is "+
+					"quarantined.", shd.path)
+		}
+		batch := shd.ldb.NewWriteBatch()
+		batch.Delete([]byte{TRACER_RENAME_KEY})
+		err := shd.ldb.Write(store.writeOpts, batch)
+		batch.Close()
+		shd.release()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Maps old tracer IDs to the IDs they were renamed to.
+type tracerAliases struct {
+	lock sync.RWMutex
+
+	byOld map[string]string
+}
+
+// Get the tracer ID to store a span under.
+func (tal *tracerAliases) resolve(trid string) string {
+	tal.lock.RLock()
+	defer tal.lock.RUnlock()
+	if to, ok := tal.byOld[trid]; ok {
+		return to
+	}
+	return trid
+}
+
+func tracerAliasKey(from string) []byte {
+	return append([]byte{TRACER_ALIAS_PREFIX}, []byte(from)...)
+}
+
+// Load the tracer aliases from the first shard.
+func (store *dataStore) loadTracerAliases() {
+	store.aliases = &tracerAliases{byOld: make(map[string]string)}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to load the tracer aliases, because shard "+
+			"%s is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	prefix := []byte{TRACER_ALIAS_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		store.aliases.byOld[string(key[1:])] = string(iter.Value())
+	}
+	if len(store.aliases.byOld) > 0 {
+		store.lg.Infof("Loaded %d tracer alias(es).\n",
+			len(store.aliases.byOld))
+	}
+}
+
+// Install an alias from one tracer ID to another.  Aliases which led to from
+// are changed to lead to to, and any alias from to is removed, so that an
+// alias never leads to another alias.
+func (store *dataStore) installTracerAlias(from string, to string) error {
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't install a tracer alias, because shard %s, which holds "+
+				"the aliases, is quarantined.", shd.path)
+	}
+	defer shd.release()
+	tal := store.aliases
+	tal.lock.Lock()
+	defer tal.lock.Unlock()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	byOld := make(map[string]string)
+	for old, cur := range tal.byOld {
+		if old == to {
+			batch.Delete(tracerAliasKey(old))
+			continue
+		}
+		if cur == from {
+			cur = to
+			batch.Put(tracerAliasKey(old), []byte(cur))
+		}
+		byOld[old] = cur
+	}
+	byOld[from] = to
+	batch.Put(tracerAliasKey(from), []byte(to))
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		shd.checkCorruption(err)
+		return errors.New(fmt.Sprintf("Error saving the alias from tracer "+
+			"%s to %s: %s", from, to, err.Error()))
+	}
+	tal.byOld = byOld
+	store.lg.Infof("Spans sent with tracer ID %s will be stored under %s.\n",
+		from, to)
+	return nil
+}
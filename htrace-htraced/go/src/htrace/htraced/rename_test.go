@@ -0,0 +1,293 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Wait for the tracer rename to stop running, and return its status.
+func waitForTracerRename(t *testing.T,
+	hcl *htrace.Client) *common.TracerRenameStatus {
+	for {
+		status, err := hcl.TracerRenameStatus()
+		if err != nil {
+			t.Fatalf("TracerRenameStatus failed: %s\n", err.Error())
+		}
+		if status.State != common.TRACER_RENAME_RUNNING {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Find the ids of the spans with the given tracer ID.
+func findSpansOfTracer(t *testing.T, hcl *htrace.Client,
+	trid string) map[string]bool {
+	spans, err := hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.TRACER_ID,
+				Val:   trid,
+			},
+		},
+		Lim: 100,
+	})
+	if err != nil {
+		t.Fatalf("Query for tracer %s failed: %s\n", trid, err.Error())
+	}
+	sids := make(map[string]bool)
+	for i := range spans {
+		sids[spans[i].Id.String()] = true
+	}
+	return sids
+}
+
+func TestTracerRename(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestTracerRename",
+		Cnf: map[string]string{
+			conf.HTRACE_METRICS_DESC_CARDINALITY: "3",
+			conf.HTRACE_TRACER_RENAME_BATCH_SIZE: "4",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	status, err := hcl.TracerRenameStatus()
+	if err != nil {
+		t.Fatalf("TracerRenameStatus failed: %s\n", err.Error())
+	}
+	if status.State != common.TRACER_RENAME_NONE {
+		t.Fatalf("Expected no rename yet, but got %s\n", asJson(status))
+	}
+
+	// 10 spans from jobtracker, which uses too many descriptions, and 5 from
+	// another tracer.
+	spans := createRandomTestSpans(15)
+	oldSids := make(map[string]bool)
+	otherSids := make(map[string]bool)
+	for i := range spans {
+		spans[i].Begin = 1000 + int64(i)
+		spans[i].End = spans[i].Begin + 10
+		if i < 10 {
+			spans[i].TracerId = "jobtracker"
+			spans[i].Description = fmt.Sprintf("job%d", i)
+			oldSids[spans[i].Id.String()] = true
+		} else {
+			spans[i].TracerId = "other"
+			otherSids[spans[i].Id.String()] = true
+		}
+	}
+	ingestSpans(ht, spans)
+
+	// A dry run counts the spans, but doesn't change them.
+	status, err = hcl.RenameTracer("jobtracker", "resourcemanager", true, true)
+	if err != nil {
+		t.Fatalf("RenameTracer failed: %s\n", err.Error())
+	}
+	if !status.DryRun || status.Alias {
+		t.Fatalf("Expected a dry run without an alias, but got %s\n",
+			asJson(status))
+	}
+	status = waitForTracerRename(t, hcl)
+	if status.State != common.TRACER_RENAME_DONE ||
+		status.MatchedSpans != 10 || status.ScannedSpans != 15 ||
+		status.ShardsDone != 2 {
+		t.Fatalf("Unexpected dry run status %s\n", asJson(status))
+	}
+	if !reflect.DeepEqual(oldSids, findSpansOfTracer(t, hcl, "jobtracker")) {
+		t.Fatalf("The dry run renamed spans.\n")
+	}
+
+	// Rename the tracer, and install an alias.
+	status, err = hcl.RenameTracer("jobtracker", "resourcemanager", false, true)
+	if err != nil {
+		t.Fatalf("RenameTracer failed: %s\n", err.Error())
+	}
+	status = waitForTracerRename(t, hcl)
+	if status.State != common.TRACER_RENAME_DONE || status.DryRun ||
+		!status.Alias || status.MatchedSpans != 10 ||
+		status.ScannedSpans != 15 {
+		t.Fatalf("Unexpected rename status %s\n", asJson(status))
+	}
+	if sids := findSpansOfTracer(t, hcl, "jobtracker"); len(sids) != 0 {
+		t.Fatalf("Found %d span(s) under the old tracer ID.\n", len(sids))
+	}
+	if !reflect.DeepEqual(oldSids, findSpansOfTracer(t, hcl, "resourcemanager")) {
+		t.Fatalf("Expected the renamed spans under the new tracer ID.\n")
+	}
+	if !reflect.DeepEqual(otherSids, findSpansOfTracer(t, hcl, "other")) {
+		t.Fatalf("The rename changed the spans of another tracer.\n")
+	}
+	span, err := hcl.FindSpan(spans[0].Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	expected := *spans[0]
+	expected.TracerId = "resourcemanager"
+	common.ExpectSpansEqual(t, &expected, span)
+
+	// The stats only show the new name.
+	dv, err := hcl.DistinctValues(common.TRACER_ID, 1000, 2000, 10, 1000)
+	if err != nil {
+		t.Fatalf("DistinctValues failed: %s\n", err.Error())
+	}
+	expectedValues := []common.ValueCount{
+		{Value: "resourcemanager", Count: 10}, {Value: "other", Count: 5}}
+	if !reflect.DeepEqual(expectedValues, dv.Values) {
+		t.Fatalf("Unexpected tracer id values %s\n", asJson(dv))
+	}
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if len(stats.HighCardinalityTracers) != 1 ||
+		stats.HighCardinalityTracers[0].TracerId != "resourcemanager" {
+		t.Fatalf("Expected the high-cardinality tracer to be renamed, but "+
+			"got %s\n", asJson(stats.HighCardinalityTracers))
+	}
+
+	// A span written with the old name is stored under the new one.
+	late := createRandomTestSpans(2)[0]
+	late.TracerId = "jobtracker"
+	err = hcl.WriteSpans([]*common.Span{late})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	span, err = hcl.FindSpan(late.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if span == nil || span.TracerId != "resourcemanager" {
+		t.Fatalf("Expected the alias to rename the span, but got %s\n",
+			asJson(span))
+	}
+
+	// Bad renames are rejected.
+	_, err = hcl.RenameTracer("other", "other", false, false)
+	common.AssertErrContains(t, err, "can't be renamed to itself")
+	_, err = hcl.RenameTracer("", "other", false, false)
+	if common.ErrorCodeOf(err) != common.ERR_BAD_PARAMETER {
+		t.Fatalf("Expected BAD_PARAMETER, but got %v\n", err)
+	}
+}
+
+func TestTracerRenameResume(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestTracerRenameResume",
+		Cnf: map[string]string{
+			conf.HTRACE_TRACER_RENAME_BATCH_SIZE: "1",
+			conf.HTRACE_TRACER_RENAME_MAX_RATE:   "20",
+		},
+		DataDirs:            make([]string, 2),
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	spans := createRandomTestSpans(40)
+	for i := range spans {
+		spans[i].TracerId = "jobtracker"
+	}
+	ingestSpans(ht, spans)
+
+	// The rename is slow enough that we can stop it part of the way through.
+	_, err = hcl.RenameTracer("jobtracker", "resourcemanager", false, false)
+	if err != nil {
+		t.Fatalf("RenameTracer failed: %s\n", err.Error())
+	}
+	_, err = hcl.RenameTracer("other", "another", false, false)
+	if common.ErrorCodeOf(err) != common.ERR_CONFLICT {
+		t.Fatalf("Expected a conflict with the running rename, but got %v\n",
+			err)
+	}
+	for {
+		status, err := hcl.TracerRenameStatus()
+		if err != nil {
+			t.Fatalf("TracerRenameStatus failed: %s\n", err.Error())
+		}
+		if status.MatchedSpans >= 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	hcl.Close()
+	ht.Close()
+
+	// Reopening the datastore resumes the rename where it stopped.
+	htraceBld = &MiniHTracedBuilder{Name: "TestTracerRenameResume2",
+		DataDirs: dataDirs,
+	}
+	ht, err = htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to reopen datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	status := waitForTracerRename(t, hcl)
+	if status.State != common.TRACER_RENAME_DONE || !status.Resumed ||
+		status.From != "jobtracker" || status.To != "resourcemanager" ||
+		status.MatchedSpans != 40 || status.ScannedSpans != 40 {
+		t.Fatalf("Unexpected status of the resumed rename %s\n",
+			asJson(status))
+	}
+	if sids := findSpansOfTracer(t, hcl, "resourcemanager"); len(sids) != 40 {
+		t.Fatalf("Expected 40 renamed spans, but found %d.\n", len(sids))
+	}
+
+	// Once the rename is done, another one can run.
+	_, err = hcl.RenameTracer("other", "another", false, false)
+	if err != nil {
+		t.Fatalf("RenameTracer failed: %s\n", err.Error())
+	}
+	status = waitForTracerRename(t, hcl)
+	if status.State != common.TRACER_RENAME_DONE || status.Resumed ||
+		status.MatchedSpans != 0 {
+		t.Fatalf("Unexpected rename status %s\n", asJson(status))
+	}
+}
@@ -20,47 +20,202 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/gorilla/mux"
 	"htrace/common"
 	"htrace/conf"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
+// The default and maximum number of spans returned by /spans/changed.
+const DEFAULT_SPANS_CHANGED_LIM = 100
+const MAX_SPANS_CHANGED_LIM = 10000
+
+// The default and maximum number of spans returned by /spans/seq.
+const DEFAULT_SPANS_BY_SEQ_LIM = 100
+const MAX_SPANS_BY_SEQ_LIM = 10000
+
+// The default and maximum number of spans returned by /span/{id}/links, in
+// each direction.
+const DEFAULT_LINKS_LIM = 100
+const MAX_LINKS_LIM = 10000
+
+const DEFAULT_FLAME_LIM = 1000
+const MAX_FLAME_LIM = 10000
+
+// The default and maximum number of trace groups returned by /query when
+// groupByTrace is set.
+const DEFAULT_TRACE_GROUP_LIM = 100
+const MAX_TRACE_GROUP_LIM = 10000
+
+// The default and maximum number of spans scanned by /servicemap.
+const DEFAULT_SERVICE_MAP_LIM = 10000
+const MAX_SERVICE_MAP_LIM = 1000000
+
+// The default and maximum number of values returned by /query/values, and of
+// spans it scans.
+const DEFAULT_DISTINCT_VALUES_LIM = 100
+const MAX_DISTINCT_VALUES_LIM = 10000
+const DEFAULT_DISTINCT_VALUES_SCAN_LIM = 100000
+const MAX_DISTINCT_VALUES_SCAN_LIM = 10000000
+
+// The maximum number of buckets returned by /query/timeseries, and the
+// default and maximum number of spans it scans.
+const MAX_TIME_SERIES_BUCKETS = 10000
+const DEFAULT_TIME_SERIES_SCAN_LIM = 1000000
+const MAX_TIME_SERIES_SCAN_LIM = 10000000
+
+// The default and maximum number of clients returned by /server/stats/clients.
+const DEFAULT_CLIENT_STATS_LIM = 1000
+const MAX_CLIENT_STATS_LIM = 10000
+
+// The default and maximum number of descriptions returned by
+// /stats/descriptions.
+const DEFAULT_DESC_STATS_LIM = 20
+const MAX_DESC_STATS_LIM = 1000
+
+const DEFAULT_HEARTBEATS_LIM = 100
+const MAX_HEARTBEATS_LIM = 10000
+
+// The default and maximum number of entries returned by /server/audit.
+const DEFAULT_AUDIT_LIM = 100
+const MAX_AUDIT_LIM = 10000
+
+// The default and maximum number of rejected spans returned by
+// /server/rejections.
+const DEFAULT_REJECTIONS_LIM = 100
+const MAX_REJECTIONS_LIM = 10000
+
+// The number of active spans to return from /spans/active by default, and the
+// maximum number.
+const DEFAULT_ACTIVE_SPANS_LIM = 100
+const MAX_ACTIVE_SPANS_LIM = 10000
+
 // Set the response headers.
 func setResponseHeaders(hdr http.Header) {
 	hdr.Set("Content-Type", "application/json")
 }
 
-// Write a JSON error response.
-func writeError(lg *common.Logger, w http.ResponseWriter, errCode int,
-	errStr string) {
-	str := strings.Replace(errStr, `"`, `'`, -1)
-	lg.Info(str + "\n")
-	w.WriteHeader(errCode)
-	w.Write([]byte(`{ "error" : "` + str + `"}`))
+// Flag responses which may be missing results because some shards are
+// quarantined.
+func setQuarantineHeaders(hdr http.Header, store *dataStore) {
+	numQuarantined := store.numQuarantined()
+	if numQuarantined > 0 {
+		hdr.Set("X-HTraced-Partial-Results", "true")
+		hdr.Set("X-HTraced-Quarantined-Shards", strconv.Itoa(numQuarantined))
+	}
+}
+
+// Write a JSON error response.  The HTTP status is determined by the code.
+func writeError(lg *common.Logger, w http.ResponseWriter, code common.ErrorCode,
+	fstr string, args ...interface{}) {
+	writeHtraceError(lg, w, common.NewHtraceError(code, nil, fstr, args...))
+}
+
+// Write a JSON error response for an error.  Errors which are not
+// HtraceErrors are reported as internal errors.
+func writeHtraceError(lg *common.Logger, w http.ResponseWriter, err error) {
+	herr, ok := err.(*common.HtraceError)
+	if !ok {
+		herr = common.NewHtraceError(common.ERR_INTERNAL, nil, "%s", err.Error())
+	}
+	lg.Infof("%s\n", herr.Error())
+	sendHtraceError(lg, w, herr)
+}
+
+// Write a JSON error response for a request from a client which may be sending
+// a flood of bad requests.  Repeated errors from the same client are logged
+// through the log suppressor.
+func writeSuppressedError(lg *common.Logger, slg *common.LogSuppressor,
+	w http.ResponseWriter, client string, code common.ErrorCode,
+	fstr string, args ...interface{}) {
+	herr := common.NewHtraceError(code, nil, fstr, args...)
+	slg.Logf(common.INFO, client, string(code)+": "+fstr+"\n", args...)
+	sendHtraceError(lg, w, herr)
+}
+
+func sendHtraceError(lg *common.Logger, w http.ResponseWriter,
+	herr *common.HtraceError) {
+	buf, merr := json.Marshal(herr.ToResp())
+	if merr != nil {
+		// This should never happen, since the response only contains strings.
+		lg.Errorf("Error marshalling error response: %s\n", merr.Error())
+	}
+	w.WriteHeader(herr.HttpStatus)
+	w.Write(buf)
+}
+
+// Compute a strong ETag for some content.
+func computeEtag(buf []byte) string {
+	sum := sha1.Sum(buf)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Returns true if the If-None-Match header of a request matches the given
+// ETag.  The header may contain a comma-separated list of ETags, or "*".
+func etagMatches(req *http.Request, etag string) bool {
+	hdr := req.Header.Get("If-None-Match")
+	if hdr == "" {
+		return false
+	}
+	for _, tag := range strings.Split(hdr, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
 type serverVersionHandler struct {
-	lg *common.Logger
+	lg    *common.Logger
+	store *dataStore
+
+	// The address the REST server listens on.
+	restAddr string
 }
 
 func (hand *serverVersionHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
 	version := common.ServerVersion{ReleaseVersion: RELEASE_VERSION,
-		GitVersion: GIT_VERSION}
+		GitVersion:       GIT_VERSION,
+		DatastoreBackend: hand.store.backend,
+		Persistent:       hand.store.backend != DATASTORE_BACKEND_MEMORY,
+		MaxSpans:         hand.store.maxSpans,
+		ReadOnly:         hand.store.readOnly,
+		DaemonId:         formatDaemonId(hand.store.shardInfo.DaemonId),
+		MaxWriteSpans:    hand.store.writeMaxSpans,
+		MaxWriteBytes:    hand.store.writeMaxBytes,
+		RestAddr:         hand.restAddr,
+	}
+	if hrpcAddr, ok := hand.store.hrpcAddr.Load().(string); ok {
+		version.HrpcAddr = hrpcAddr
+	}
+	hrpcMethods := atomic.LoadUint64(&hand.store.hrpcMethods)
+	if hrpcMethods != 0 {
+		version.HrpcProtocolVersion = common.HRPC_PROTOCOL_VERSION
+		version.HrpcMethods = common.HrpcMethodSet(hrpcMethods).Names()
+	}
 	buf, err := json.Marshal(&version)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("error marshalling ServerVersion: %s\n", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ServerVersion: %s", err.Error())
 		return
 	}
 	if hand.lg.DebugEnabled() {
@@ -83,8 +238,8 @@ func (hand *serverDebugInfoHandler) ServeHTTP(w http.ResponseWriter, req *http.R
 	}
 	buf, err := json.Marshal(&resp)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("error marshalling ServerDebugInfo: %s\n", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ServerDebugInfo: %s", err.Error())
 		return
 	}
 	w.Write(buf)
@@ -101,269 +256,3189 @@ func (hand *serverStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Reque
 	stats := hand.store.ServerStats()
 	buf, err := json.Marshal(&stats)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("error marshalling ServerStats: %s\n", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ServerStats: %s", err.Error())
 		return
 	}
 	hand.lg.Debugf("Returned ServerStats %s\n", string(buf))
 	w.Write(buf)
 }
 
-type serverConfHandler struct {
-	cnf *conf.Config
-	lg  *common.Logger
+type statsHistoryHandler struct {
+	dataStoreHandler
 }
 
-func (hand *serverConfHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (hand *statsHistoryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
-	hand.lg.Debugf("serverConfHandler\n")
-	cnfMap := hand.cnf.Export()
-	buf, err := json.Marshal(&cnfMap)
+	hand.lg.Debugf("statsHistoryHandler\n")
+	buf, err := json.Marshal(hand.store.msink.GetHistory())
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("error marshalling serverConf: %s\n", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling StatsBucket: %s", err.Error())
 		return
 	}
-	hand.lg.Debugf("Returned server configuration %s\n", string(buf))
 	w.Write(buf)
 }
 
-type dataStoreHandler struct {
-	lg    *common.Logger
-	store *dataStore
+type clientStatsHandler struct {
+	dataStoreHandler
 }
 
-func (hand *dataStoreHandler) parseSid(w http.ResponseWriter,
-	str string) (common.SpanId, bool) {
-	var id common.SpanId
-	err := id.FromString(str)
+func (hand *clientStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	after := req.FormValue("after")
+	prefix := req.FormValue("prefix")
+	lim := DEFAULT_CLIENT_STATS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_CLIENT_STATS_LIM {
+		lim = MAX_CLIENT_STATS_LIM
+	}
+	hand.lg.Debugf("clientStatsHandler(after=%s, prefix=%s, lim=%d)\n",
+		after, prefix, lim)
+	resp := hand.store.msink.GetClientStats(after, prefix, lim)
+	buf, err := json.Marshal(resp)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusBadRequest,
-			fmt.Sprintf("Failed to parse span ID %s: %s", str, err.Error()))
-		w.Write([]byte("Error parsing : " + err.Error()))
-		return common.INVALID_SPAN_ID, false
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ClientStatsResp: %s", err.Error())
+		return
 	}
-	return id, true
+	w.Write(buf)
 }
 
-func (hand *dataStoreHandler) getReqField32(fieldName string, w http.ResponseWriter,
-	req *http.Request) (int32, bool) {
-	str := req.FormValue(fieldName)
-	if str == "" {
-		writeError(hand.lg, w, http.StatusBadRequest, fmt.Sprintf("No %s specified.", fieldName))
-		return -1, false
+type serverHealthHandler struct {
+	dataStoreHandler
+}
+
+func (hand *serverHealthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("serverHealthHandler\n")
+	health := hand.store.Health()
+	buf, err := json.Marshal(health)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ServerHealth: %s", err.Error())
+		return
 	}
-	val, err := strconv.ParseUint(str, 16, 32)
+	w.Write(buf)
+}
+
+type watermarkHandler struct {
+	dataStoreHandler
+}
+
+func (hand *watermarkHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("watermarkHandler\n")
+	wm := hand.store.wmk.Get()
+	buf, err := json.Marshal(wm)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusBadRequest,
-			fmt.Sprintf("Error parsing %s: %s.", fieldName, err.Error()))
-		return -1, false
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling Watermark: %s", err.Error())
+		return
 	}
-	return int32(val), true
+	w.Write(buf)
 }
 
-type findSidHandler struct {
+type canaryHandler struct {
 	dataStoreHandler
 }
 
-func (hand *findSidHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (hand *canaryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
-	req.ParseForm()
-	vars := mux.Vars(req)
-	stringSid := vars["id"]
-	sid, ok := hand.parseSid(w, stringSid)
-	if !ok {
+	hand.lg.Debugf("canaryHandler\n")
+	status := &common.CanaryStatus{}
+	if hand.store.canary != nil {
+		status = hand.store.canary.Status()
+	}
+	buf, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling CanaryStatus: %s", err.Error())
 		return
 	}
-	hand.lg.Debugf("findSidHandler(sid=%s)\n", sid.String())
-	span := hand.store.FindSpan(sid)
-	if span == nil {
-		writeError(hand.lg, w, http.StatusNoContent,
-			fmt.Sprintf("No such span as %s\n", sid.String()))
+	w.Write(buf)
+}
+
+type quotasHandler struct {
+	dataStoreHandler
+}
+
+func (hand *quotasHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("quotasHandler\n")
+	quotas := []common.QuotaStatus{}
+	if hand.store.quotas != nil {
+		quotas = hand.store.quotas.Get()
+	}
+	buf, err := json.Marshal(quotas)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling QuotaStatus: %s", err.Error())
 		return
 	}
-	w.Write(span.ToJson())
+	w.Write(buf)
 }
 
-type findChildrenHandler struct {
+type rejectionsHandler struct {
 	dataStoreHandler
 }
 
-func (hand *findChildrenHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (hand *rejectionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
 	req.ParseForm()
-	vars := mux.Vars(req)
-	stringSid := vars["id"]
-	sid, ok := hand.parseSid(w, stringSid)
-	if !ok {
+	reason := req.FormValue("reason")
+	switch reason {
+	case "", common.REJECT_REASON_DECODE, common.REJECT_REASON_SPAN_ID,
+		common.REJECT_REASON_OVERSIZED, common.REJECT_REASON_TIMES,
+		common.REJECT_REASON_INFO_KEY, common.REJECT_REASON_INFO_COUNT,
+		common.REJECT_REASON_INFO_UTF8, common.REJECT_REASON_INFO_RESERVED:
+	default:
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid reason '%s'.", reason)
 		return
 	}
-	var lim int32
-	lim, ok = hand.getReqField32("lim", w, req)
-	if !ok {
-		return
+	lim := DEFAULT_REJECTIONS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
 	}
-	hand.lg.Debugf("findChildrenHandler(sid=%s, lim=%d)\n", sid.String(), lim)
-	children := hand.store.FindChildren(sid, lim)
-	jbytes, err := json.Marshal(children)
+	if lim > MAX_REJECTIONS_LIM {
+		lim = MAX_REJECTIONS_LIM
+	}
+	hand.lg.Debugf("rejectionsHandler(reason=%s, lim=%d)\n", reason, lim)
+	buf, err := json.Marshal(hand.store.rejections.Get(reason, lim))
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("Error marshalling children: %s", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling Rejections: %s", err.Error())
 		return
 	}
-	w.Write(jbytes)
+	w.Write(buf)
 }
 
-type writeSpansHandler struct {
+type clearRejectionsHandler struct {
 	dataStoreHandler
 }
 
-func (hand *writeSpansHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	startTime := time.Now()
+func (hand *clearRejectionsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
-	client, _, serr := net.SplitHostPort(req.RemoteAddr)
-	if serr != nil {
-		writeError(hand.lg, w, http.StatusBadRequest,
-			fmt.Sprintf("Failed to split host and port for %s: %s\n",
-				req.RemoteAddr, serr.Error()))
+	hand.lg.Debugf("clearRejectionsHandler\n")
+	hand.store.rejections.Clear()
+}
+
+type locksHandler struct {
+	dataStoreHandler
+}
+
+func (hand *locksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("locksHandler\n")
+	buf, err := json.Marshal(hand.store.Locks())
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ShardLocks: %s", err.Error())
 		return
 	}
-	dec := json.NewDecoder(req.Body)
-	var msg common.WriteSpansReq
-	err := dec.Decode(&msg)
+	w.Write(buf)
+}
+
+type chaosHandler struct {
+	dataStoreHandler
+}
+
+func (hand *chaosHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("chaosHandler\n")
+	buf, err := json.Marshal(hand.store.faults.Stats())
 	if err != nil {
-		writeError(hand.lg, w, http.StatusBadRequest,
-			fmt.Sprintf("Error parsing WriteSpansReq: %s", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ChaosStats: %s", err.Error())
 		return
 	}
-	if hand.lg.TraceEnabled() {
-		hand.lg.Tracef("%s: read WriteSpans REST message: %s\n",
-			req.RemoteAddr, asJson(&msg))
-	}
-	ing := hand.store.NewSpanIngestor(hand.lg, client, msg.DefaultTrid)
-	for spanIdx := 0; spanIdx < msg.NumSpans; spanIdx++ {
-		var span *common.Span
-		err := dec.Decode(&span)
-		if err != nil {
-			writeError(hand.lg, w, http.StatusBadRequest,
-				fmt.Sprintf("Failed to decode span %d out of %d: ",
-					spanIdx, msg.NumSpans, err.Error()))
-			return
-		}
-		ing.IngestSpan(span)
-	}
-	ing.Close(startTime)
-	return
+	w.Write(buf)
 }
 
-type queryHandler struct {
-	lg *common.Logger
+type shardRetryHandler struct {
 	dataStoreHandler
 }
 
-func (hand *queryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+func (hand *shardRetryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	setResponseHeaders(w.Header())
-	queryString := req.FormValue("query")
-	if queryString == "" {
-		writeError(hand.lg, w, http.StatusBadRequest, "No query provided.\n")
+	idxStr := mux.Vars(req)["idx"]
+	shardIdx, err := strconv.Atoi(idxStr)
+	if err != nil || shardIdx < 0 || shardIdx >= len(hand.store.shards) {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid shard index '%s'.", idxStr)
 		return
 	}
-	var query common.Query
-	reader := bytes.NewBufferString(queryString)
-	dec := json.NewDecoder(reader)
-	err := dec.Decode(&query)
+	hand.lg.Infof("shardRetryHandler(idx=%d)\n", shardIdx)
+	health, err := hand.store.RetryShard(shardIdx)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusBadRequest,
-			fmt.Sprintf("Error parsing query '%s': %s", queryString, err.Error()))
+		writeError(hand.lg, w, common.ERR_SHARD_QUARANTINED,
+			"Failed to retry shard %d: %s", shardIdx, err.Error())
 		return
 	}
-	var results []*common.Span
-	results, err, _ = hand.store.HandleQuery(&query)
+	buf, err := json.Marshal(health)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("Internal error processing query %s: %s",
-				query.String(), err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ShardHealth: %s", err.Error())
 		return
 	}
-	var jbytes []byte
-	jbytes, err = json.Marshal(results)
+	w.Write(buf)
+}
+
+type ingestPauseHandler struct {
+	dataStoreHandler
+}
+
+func (hand *ingestPauseHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var durationMs int64
+	var err error
+	durationStr := req.FormValue("durationMs")
+	if durationStr != "" {
+		durationMs, err = strconv.ParseInt(durationStr, 10, 64)
+		if err != nil || durationMs < 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid durationMs '%s'.", durationStr)
+			return
+		}
+	}
+	hand.lg.Infof("ingestPauseHandler(durationMs=%d)\n", durationMs)
+	status := hand.store.pause.pause(requester(req),
+		time.Duration(durationMs)*time.Millisecond)
+	buf, err := json.Marshal(&status)
 	if err != nil {
-		writeError(hand.lg, w, http.StatusInternalServerError,
-			fmt.Sprintf("Error marshalling results: %s", err.Error()))
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling IngestPause: %s", err.Error())
 		return
 	}
-	w.Write(jbytes)
+	w.Write(buf)
 }
 
-type logErrorHandler struct {
-	lg *common.Logger
+type ingestResumeHandler struct {
+	dataStoreHandler
 }
 
-func (hand *logErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	hand.lg.Errorf("Got unknown request %s\n", req.RequestURI)
-	writeError(hand.lg, w, http.StatusBadRequest, "Unknown request.")
+func (hand *ingestResumeHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Infof("ingestResumeHandler\n")
+	status := hand.store.pause.resume(requester(req))
+	buf, err := json.Marshal(&status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling IngestPause: %s", err.Error())
+		return
+	}
+	w.Write(buf)
 }
 
-type RestServer struct {
-	http.Server
-	listener net.Listener
-	lg       *common.Logger
+// Describe who made a request, for the logs: its principal if it is known, or
+// else its address.
+func requester(req *http.Request) string {
+	principal := restPrincipal(req)
+	if principal != "" {
+		return principal
+	}
+	return req.RemoteAddr
 }
 
-func CreateRestServer(cnf *conf.Config, store *dataStore,
-	listener net.Listener) (*RestServer, error) {
-	var err error
-	rsv := &RestServer{}
-	rsv.lg = common.NewLogger("rest", cnf)
-
-	r := mux.NewRouter().StrictSlash(false)
-
-	r.Handle("/server/info", &serverVersionHandler{lg: rsv.lg}).Methods("GET")
-	r.Handle("/server/version", &serverVersionHandler{lg: rsv.lg}).Methods("GET")
-	r.Handle("/server/debugInfo", &serverDebugInfoHandler{lg: rsv.lg}).Methods("GET")
-
-	serverStatsH := &serverStatsHandler{dataStoreHandler: dataStoreHandler{
-		store: store, lg: rsv.lg}}
-	r.Handle("/server/stats", serverStatsH).Methods("GET")
+type snapshotHandler struct {
+	dataStoreHandler
+}
 
-	serverConfH := &serverConfHandler{cnf: cnf, lg: rsv.lg}
-	r.Handle("/server/conf", serverConfH).Methods("GET")
+func (hand *snapshotHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	dest := req.FormValue("dest")
+	if dest == "" {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"No snapshot directory was given in dest.")
+		return
+	}
+	hand.lg.Infof("snapshotHandler(dest=%s)\n", dest)
+	status, err := hand.store.StartSnapshot(dest)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	buf, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling SnapshotStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
 
-	writeSpansH := &writeSpansHandler{dataStoreHandler: dataStoreHandler{
-		store: store, lg: rsv.lg}}
-	r.Handle("/writeSpans", writeSpansH).Methods("POST")
+type snapshotStatusHandler struct {
+	dataStoreHandler
+}
 
-	queryH := &queryHandler{lg: rsv.lg, dataStoreHandler: dataStoreHandler{store: store}}
-	r.Handle("/query", queryH).Methods("GET")
+func (hand *snapshotStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("snapshotStatusHandler\n")
+	buf, err := json.Marshal(hand.store.SnapshotStatus())
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling SnapshotStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
 
-	span := r.PathPrefix("/span").Subrouter()
-	findSidH := &findSidHandler{dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
-	span.Handle("/{id}", findSidH).Methods("GET")
+type tracerRenameHandler struct {
+	dataStoreHandler
+}
 
-	findChildrenH := &findChildrenHandler{dataStoreHandler: dataStoreHandler{store: store,
-		lg: rsv.lg}}
-	span.Handle("/{id}/children", findChildrenH).Methods("GET")
+// Parse an optional boolean form value, which defaults to false.
+func parseBoolFormValue(req *http.Request, name string) (bool, error) {
+	str := req.FormValue(name)
+	if str == "" {
+		return false, nil
+	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Invalid %s '%s'.", name, str)
+	}
+	return val, nil
+}
 
-	// Default Handler. This will serve requests for static requests.
-	webdir := os.Getenv("HTRACED_WEB_DIR")
-	if webdir == "" {
-		webdir, err = filepath.Abs(filepath.Join(filepath.Dir(os.Args[0]), "..", "web"))
-		if err != nil {
-			return nil, err
-		}
+// Like parseBoolFormValue, but only looks at the URL, so that the request
+// body is left alone.
+func parseBoolQueryValue(req *http.Request, name string) (bool, error) {
+	str := req.URL.Query().Get(name)
+	if str == "" {
+		return false, nil
 	}
+	val, err := strconv.ParseBool(str)
+	if err != nil {
+		return false, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Invalid %s '%s'.", name, str)
+	}
+	return val, nil
+}
 
-	rsv.lg.Infof(`Serving static files from "%s"`+"\n", webdir)
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir(webdir))).Methods("GET")
+func (hand *tracerRenameHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	from := req.FormValue("from")
+	to := req.FormValue("to")
+	dryRun, err := parseBoolFormValue(req, "dryRun")
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	alias, err := parseBoolFormValue(req, "alias")
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	hand.lg.Infof("tracerRenameHandler(from=%s, to=%s, dryRun=%t, "+
+		"alias=%t)\n", from, to, dryRun, alias)
+	status, err := hand.store.StartTracerRename(from, to, dryRun, alias)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	buf, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling TracerRenameStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type tracerRenameStatusHandler struct {
+	dataStoreHandler
+}
+
+func (hand *tracerRenameStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("tracerRenameStatusHandler\n")
+	buf, err := json.Marshal(hand.store.TracerRenameStatus())
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling TracerRenameStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type scanJobHandler struct {
+	dataStoreHandler
+}
+
+func (hand *scanJobHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	name := req.FormValue("name")
+	hand.lg.Infof("scanJobHandler(name=%s)\n", name)
+	status, err := hand.store.StartScanJob(name)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	hand.writeScanJobStatus(w, status)
+}
+
+func (hand *dataStoreHandler) writeScanJobStatus(w http.ResponseWriter,
+	status *common.ScanJobStatus) {
+	buf, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ScanJobStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type scanJobStatusHandler struct {
+	dataStoreHandler
+}
+
+func (hand *scanJobStatusHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("scanJobStatusHandler\n")
+	hand.writeScanJobStatus(w, hand.store.ScanJobStatus())
+}
+
+type cancelScanJobHandler struct {
+	dataStoreHandler
+}
+
+func (hand *cancelScanJobHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Infof("cancelScanJobHandler\n")
+	status, err := hand.store.CancelScanJob()
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	hand.writeScanJobStatus(w, status)
+}
+
+// The maximum size of an SLO definition, in bytes.
+const MAX_SLO_DEFINITION_LENGTH = 64 * 1024
+
+type slosHandler struct {
+	dataStoreHandler
+}
+
+func (hand *slosHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("slosHandler\n")
+	buf, err := json.Marshal(hand.store.slos.Get())
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling SloStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type defineSloHandler struct {
+	dataStoreHandler
+}
+
+func (hand *defineSloHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	var def common.SloDefinition
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+		MAX_SLO_DEFINITION_LENGTH))
+	err := dec.Decode(&def)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Error parsing SloDefinition: %s", err.Error())
+		return
+	}
+	hand.lg.Infof("defineSloHandler(name=%s)\n", def.Name)
+	status, err := hand.store.slos.Define(&def)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	buf, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling SloStatus: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type deleteSloHandler struct {
+	dataStoreHandler
+}
+
+func (hand *deleteSloHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	name := mux.Vars(req)["name"]
+	hand.lg.Infof("deleteSloHandler(name=%s)\n", name)
+	err := hand.store.slos.Remove(name)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+}
+
+type serverConfHandler struct {
+	rld *ConfReloader
+	lg  *common.Logger
+}
+
+func (hand *serverConfHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("serverConfHandler\n")
+	last := hand.rld.LastResult()
+	if last != nil {
+		w.Header().Set("X-HTraced-Last-Reload-Ms",
+			strconv.FormatInt(last.TimeMs, 10))
+		w.Header().Set("X-HTraced-Last-Reload-Outcome", last.Outcome)
+	}
+	cnfMap := hand.rld.Current().Export()
+	buf, err := json.Marshal(&cnfMap)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling serverConf: %s", err.Error())
+		return
+	}
+	hand.lg.Debugf("Returned server configuration %s\n", string(buf))
+	w.Write(buf)
+}
+
+type dataStoreHandler struct {
+	lg    *common.Logger
+	store *dataStore
+}
+
+func (hand *dataStoreHandler) parseSid(w http.ResponseWriter,
+	str string) (common.SpanId, bool) {
+	var id common.SpanId
+	err := id.FromString(str)
+	if err != nil {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_BAD_SPAN_ID,
+			map[string]string{"id": str},
+			"Failed to parse span ID %s: %s", str, err.Error()))
+		return common.INVALID_SPAN_ID, false
+	}
+	return id, true
+}
+
+func (hand *dataStoreHandler) getReqField32(fieldName string, w http.ResponseWriter,
+	req *http.Request) (int32, bool) {
+	str := req.FormValue(fieldName)
+	if str == "" {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER, "No %s specified.", fieldName)
+		return -1, false
+	}
+	val, err := strconv.ParseUint(str, 16, 32)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Error parsing %s: %s.", fieldName, err.Error())
+		return -1, false
+	}
+	return int32(val), true
+}
+
+type findSidHandler struct {
+	dataStoreHandler
+}
+
+func (hand *findSidHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	maxParents := 0
+	maxParentsStr := req.FormValue("maxParents")
+	if maxParentsStr != "" {
+		var err error
+		maxParents, err = strconv.Atoi(maxParentsStr)
+		if err != nil || maxParents < 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid maxParents '%s'.", maxParentsStr)
+			return
+		}
+	}
+	hand.lg.Debugf("findSidHandler(sid=%s)\n", sid.String())
+	buf := hand.store.FindSpanBytes(sid)
+	if buf == nil {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+			map[string]string{"id": sid.String()}, "No such span as %s", sid.String()))
+		return
+	}
+	// The ETag is derived from the stored span data, so that it changes if
+	// the span is ever rewritten.  If the client already has this version of
+	// the span, we don't need to decode it at all.
+	var seq uint64
+	if hand.store.seqsEnabled {
+		seq = hand.store.FindSpanSeq(sid)
+		buf = append(buf, u64toSlice(seq)...)
+	}
+	etag := computeEtag(buf)
+	if maxParents > 0 {
+		// A span with truncated parents is a different representation of
+		// it, so it needs a different ETag.
+		etag = computeEtag([]byte(etag + "/" + strconv.Itoa(maxParents)))
+	}
+	w.Header().Set("ETag", etag)
+	if etagMatches(req, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if hand.store.seqsEnabled {
+		buf = buf[0 : len(buf)-8]
+	}
+	span, err := decodeSpan(sid, buf)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error decoding span %s: %s", sid.String(), err.Error())
+		return
+	}
+	span.Seq = seq
+	span.TruncateParents(maxParents)
+	w.Write(span.ToJson())
+}
+
+type findChildrenHandler struct {
+	dataStoreHandler
+}
+
+func (hand *findChildrenHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	var lim int32
+	lim, ok = hand.getReqField32("lim", w, req)
+	if !ok {
+		return
+	}
+	hand.lg.Debugf("findChildrenHandler(sid=%s, lim=%d)\n", sid.String(), lim)
+	children := hand.store.FindChildren(sid, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(children)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling children: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type confReloadHandler struct {
+	rld *ConfReloader
+	lg  *common.Logger
+}
+
+func (hand *confReloadHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("confReloadHandler\n")
+	result := hand.rld.Reload()
+	buf, err := json.Marshal(result)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling ConfReloadResult: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type writeSpansHandler struct {
+	dataStoreHandler
+}
+
+// Counts the bytes read through it.
+type byteCountingReader struct {
+	io.Reader
+	numBytes int
+}
+
+func (rdr *byteCountingReader) Read(p []byte) (int, error) {
+	n, err := rdr.Reader.Read(p)
+	rdr.numBytes += n
+	return n, err
+}
+
+// Get the error to return when a WriteSpans request body could not be read,
+// if the reason was that we stopped reading it at write.spans.max.bytes.
+// Returns nil otherwise.
+func (hand *writeSpansHandler) truncatedBodyError(
+	body *byteCountingReader) *common.HtraceError {
+	maxBytes := hand.store.writeMaxBytes
+	if maxBytes <= 0 || body.numBytes < maxBytes {
+		return nil
+	}
+	return common.NewHtraceError(common.ERR_TOO_LARGE, nil,
+		"The request is more than %d bytes long, which is the limit.  "+
+			"Split the spans into several requests.", maxBytes)
+}
+
+func (hand *writeSpansHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	setResponseHeaders(w.Header())
+	if hand.store.readOnly {
+		writeError(hand.lg, w, common.ERR_READ_ONLY,
+			"Can't write spans: this server is read-only.")
+		return
+	}
+	if herr := hand.store.pause.check(); herr != nil {
+		writeIngestPausedError(hand.lg, w, herr)
+		return
+	}
+	if hand.store.faults.RejectWriteSpans() {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Chaos mode rejected this WriteSpans request.")
+		return
+	}
+	client, serr := remoteHost(req.RemoteAddr)
+	if serr != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Failed to split host and port for %s: %s",
+			req.RemoteAddr, serr.Error())
+		return
+	}
+	strict, err := parseBoolQueryValue(req, "strict")
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	herr := hand.store.checkWriteSize(0, req.ContentLength)
+	if herr != nil {
+		writeHtraceError(hand.lg, w, herr)
+		return
+	}
+	reqBody := req.Body
+	if hand.store.writeMaxBytes > 0 {
+		// Requests without a Content-Length are cut off at the limit.
+		reqBody = http.MaxBytesReader(w, req.Body,
+			int64(hand.store.writeMaxBytes))
+	}
+	slg := hand.store.ingestLog
+	body := &byteCountingReader{Reader: reqBody}
+	defer func() {
+		hand.store.msink.UpdateBytesReceived(body.numBytes)
+	}()
+	dec := json.NewDecoder(body)
+	var msg common.WriteSpansReq
+	err = dec.Decode(&msg)
+	if err != nil {
+		if herr = hand.truncatedBodyError(body); herr != nil {
+			writeHtraceError(hand.lg, w, herr)
+			return
+		}
+		hand.store.rejections.record(common.REJECT_REASON_DECODE, client,
+			AUDIT_TRANSPORT_REST, "Error parsing WriteSpansReq: "+err.Error(),
+			func() []byte { return bufferedBytes(dec) })
+		writeSuppressedError(hand.lg, slg, w, client, common.ERR_BAD_REQUEST,
+			"Error parsing WriteSpansReq: %s", err.Error())
+		return
+	}
+	if hand.lg.TraceEnabled() {
+		hand.lg.Tracef("%s: read WriteSpans REST message: %s\n",
+			req.RemoteAddr, asJson(&msg))
+	}
+	herr = hand.store.checkWriteSize(msg.NumSpans, -1)
+	if herr != nil {
+		writeHtraceError(hand.lg, w, herr)
+		return
+	}
+	rdr := &restSpanReader{dec: dec, body: body, lenient: !strict}
+	var spans []*common.Span
+	if strict {
+		// Read every span before ingesting any, so that nothing is written
+		// unless everything can be.
+		spans = make([]*common.Span, 0, msg.NumSpans)
+		for spanIdx := 0; spanIdx < msg.NumSpans; spanIdx++ {
+			span, raw, _, err := decodeRestSpan(rdr)
+			if err != nil {
+				if herr = hand.truncatedBodyError(body); herr != nil {
+					writeHtraceError(hand.lg, w, herr)
+					return
+				}
+				hand.store.rejections.recordBytes(common.REJECT_REASON_DECODE,
+					client, AUDIT_TRANSPORT_REST, fmt.Sprintf("Failed to "+
+						"decode span %d out of %d: %s", spanIdx,
+						msg.NumSpans, err.Error()), raw)
+				writeSuppressedError(hand.lg, slg, w, client,
+					common.ERR_BAD_REQUEST, "Failed to decode span %d out of "+
+						"%d: %s", spanIdx, msg.NumSpans, err.Error())
+				return
+			}
+			spans = append(spans, span)
+		}
+	}
+	ing := hand.store.NewSpanIngestor(hand.lg, client, msg.DefaultTrid)
+	ing.EnableAudit(AUDIT_TRANSPORT_REST, msg.Metadata)
+	ing.SetTransport(AUDIT_TRANSPORT_REST)
+	ing.SetPrincipal(restPrincipal(req))
+	ing.SetWriteGroups(msg.Groups)
+	var skipped []*ingestDecodeError
+	if strict {
+		for i := range spans {
+			ing.IngestSpan(spans[i])
+		}
+	} else {
+		skipped = ingestRestSpans(ing, rdr, msg.NumSpans)
+	}
+	ing.Close(startTime)
+	var resp common.WriteSpansResp
+	resp.QuotaRejected, resp.QuotaSampledOut = ing.QuotaDropped()
+	resp.Accepted, resp.Rejected = ing.Counts()
+	if len(skipped) > 0 {
+		if herr = hand.truncatedBodyError(body); herr != nil {
+			writeHtraceError(hand.lg, w, herr)
+			return
+		}
+		hand.recordParseSkipped(&resp, client, msg.NumSpans, skipped)
+		if resp.Accepted == 0 {
+			first := skipped[0]
+			writeSuppressedError(hand.lg, slg, w, client,
+				common.ERR_BAD_REQUEST, "Failed to decode span %d out of %d: "+
+					"%s.  None of the spans were accepted.", first.spanIdx,
+				msg.NumSpans, first.err.Error())
+			return
+		}
+	}
+	buf, err := json.Marshal(&resp)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling WriteSpansResp: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+// Record the span documents which were skipped because they could not be
+// parsed, and list them in the response.
+func (hand *writeSpansHandler) recordParseSkipped(resp *common.WriteSpansResp,
+	client string, numSpans int, skipped []*ingestDecodeError) {
+	for _, derr := range skipped {
+		msg := fmt.Sprintf("Failed to decode span %d out of %d: %s",
+			derr.spanIdx, numSpans, derr.err.Error())
+		if derr.stopped && derr.spanIdx+1 < numSpans {
+			// The spans after this one were never read.
+			msg += fmt.Sprintf(".  The remaining %d span(s) could not be "+
+				"read.", numSpans-derr.spanIdx-1)
+			resp.ParseSkipped += numSpans - derr.spanIdx - 1
+		}
+		hand.store.rejections.recordBytes(common.REJECT_REASON_DECODE,
+			client, AUDIT_TRANSPORT_REST, msg, derr.raw)
+		resp.ParseSkipped++
+		if len(resp.ParseFailures) < common.MAX_PARSE_FAILURES {
+			resp.ParseFailures = append(resp.ParseFailures,
+				common.SpanParseFailure{Index: derr.spanIdx, Error: msg})
+		}
+	}
+	hand.store.msink.UpdateParseSkipped(client, resp.ParseSkipped)
+	hand.store.ingestLog.Warnf(client, "Skipped %d span document(s) in a "+
+		"WriteSpans request from %s, because they could not be parsed.  %s\n",
+		resp.ParseSkipped, client, resp.ParseFailures[0].Error)
+}
+
+// Receives spans in Zipkin v2 JSON format.  See zipkin.go.
+type zipkinSpansHandler struct {
+	writeSpansHandler
+}
+
+func (hand *zipkinSpansHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	startTime := time.Now()
+	setResponseHeaders(w.Header())
+	if hand.store.readOnly {
+		writeError(hand.lg, w, common.ERR_READ_ONLY,
+			"Can't write spans: this server is read-only.")
+		return
+	}
+	if herr := hand.store.pause.check(); herr != nil {
+		writeIngestPausedError(hand.lg, w, herr)
+		return
+	}
+	client, serr := remoteHost(req.RemoteAddr)
+	if serr != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Failed to split host and port for %s: %s",
+			req.RemoteAddr, serr.Error())
+		return
+	}
+	herr := hand.store.checkWriteSize(0, req.ContentLength)
+	if herr != nil {
+		writeHtraceError(hand.lg, w, herr)
+		return
+	}
+	reqBody := req.Body
+	if hand.store.writeMaxBytes > 0 {
+		reqBody = http.MaxBytesReader(w, req.Body,
+			int64(hand.store.writeMaxBytes))
+	}
+	slg := hand.store.ingestLog
+	body := &byteCountingReader{Reader: reqBody}
+	defer func() {
+		hand.store.msink.UpdateBytesReceived(body.numBytes)
+	}()
+	dec := json.NewDecoder(body)
+	var zspans []*common.ZipkinSpan
+	err := dec.Decode(&zspans)
+	if err != nil {
+		if herr = hand.truncatedBodyError(body); herr != nil {
+			writeHtraceError(hand.lg, w, herr)
+			return
+		}
+		hand.store.rejections.record(common.REJECT_REASON_DECODE, client,
+			AUDIT_TRANSPORT_ZIPKIN, "Error parsing Zipkin spans: "+err.Error(),
+			func() []byte { return bufferedBytes(dec) })
+		writeSuppressedError(hand.lg, slg, w, client, common.ERR_BAD_REQUEST,
+			"Error parsing Zipkin spans: %s", err.Error())
+		return
+	}
+	herr = hand.store.checkWriteSize(len(zspans), -1)
+	if herr != nil {
+		writeHtraceError(hand.lg, w, herr)
+		return
+	}
+	ing := hand.store.NewSpanIngestor(hand.lg, client, "")
+	ing.EnableAudit(AUDIT_TRANSPORT_ZIPKIN, nil)
+	ing.SetTransport(AUDIT_TRANSPORT_ZIPKIN)
+	ing.SetPrincipal(restPrincipal(req))
+	var firstMsg string
+	numSkipped := 0
+	for i := range zspans {
+		problem := "The span is null."
+		if zspans[i] != nil {
+			span, err := fromZipkinSpan(zspans[i])
+			if err == nil {
+				ing.IngestSpan(span)
+				continue
+			}
+			problem = err.Error()
+		}
+		msg := fmt.Sprintf("Failed to convert Zipkin span %d out of %d: %s",
+			i, len(zspans), problem)
+		hand.store.rejections.record(common.REJECT_REASON_DECODE, client,
+			AUDIT_TRANSPORT_ZIPKIN, msg, func() []byte {
+				buf, _ := json.Marshal(zspans[i])
+				return buf
+			})
+		if firstMsg == "" {
+			firstMsg = msg
+		}
+		numSkipped++
+	}
+	ing.Close(startTime)
+	if numSkipped > 0 {
+		hand.store.msink.UpdateParseSkipped(client, numSkipped)
+		accepted, _ := ing.Counts()
+		if accepted == 0 {
+			writeSuppressedError(hand.lg, slg, w, client,
+				common.ERR_BAD_REQUEST, "%s.  None of the spans were "+
+					"accepted.", strings.TrimSuffix(firstMsg, "."))
+			return
+		}
+		slg.Warnf(client, "Skipped %d Zipkin span(s) from %s, because they "+
+			"could not be converted.  %s\n", numSkipped, client, firstMsg)
+	}
+	// Zipkin tracers expect an empty response.
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Get the data which a JSON decoder has read, but not yet decoded.  After a
+// syntax error, this starts with the value which could not be decoded.
+func bufferedBytes(dec *json.Decoder) []byte {
+	buf, _ := ioutil.ReadAll(dec.Buffered())
+	return buf
+}
+
+// Reads the span documents which follow the WriteSpansReq in a REST
+// WriteSpans request.
+//
+// A JSON decoder can't go on after a syntax error, since it doesn't know
+// where the bad document ends.  So in lenient mode, the reader skips to the
+// end of the line the bad document starts on, and starts a new decoder
+// there.  The client puts each span on its own line, so this loses nothing
+// but the bad span.  Documents which are valid JSON, but not valid spans,
+// are consumed by the decoder, so nothing needs to be skipped after them.
+type restSpanReader struct {
+	dec *json.Decoder
+
+	// The request body.  The decoder may have buffered some of it.
+	body io.Reader
+
+	// True if the reader skips past syntax errors.
+	lenient bool
+}
+
+// Read the next span document as raw JSON.  If it can't be read, returns the
+// data which could not be read, for the rejection log, and true if the
+// reader can't go on.
+func (rdr *restSpanReader) next() (json.RawMessage, []byte, bool, error) {
+	var raw json.RawMessage
+	err := rdr.dec.Decode(&raw)
+	if err == nil {
+		return raw, nil, false, nil
+	}
+	bad := bufferedBytes(rdr.dec)
+	if _, ok := err.(*json.SyntaxError); !ok || !rdr.lenient {
+		return nil, bad, true, err
+	}
+	// After a syntax error, the buffered data starts with the document which
+	// could not be read, possibly after some whitespace.
+	bad = bad[len(bad)-len(bytes.TrimLeft(bad, " \t\r\n")):]
+	rest := bufio.NewReader(io.MultiReader(bytes.NewReader(bad), rdr.body))
+	for {
+		_, rerr := rest.ReadSlice('\n')
+		if rerr == bufio.ErrBufferFull {
+			continue
+		}
+		if rerr != nil && rerr != io.EOF {
+			return nil, bad, true, rerr
+		}
+		break
+	}
+	if idx := bytes.IndexByte(bad, '\n'); idx >= 0 {
+		bad = bad[:idx]
+	}
+	rdr.dec = json.NewDecoder(rest)
+	rdr.body = rest
+	return nil, bad, false, err
+}
+
+// Decode the next span in a WriteSpans request.  If it can't be decoded,
+// returns the data which could not be decoded, for the rejection log, and
+// true if the reader can't go on.
+func decodeRestSpan(rdr *restSpanReader) (*common.Span, []byte, bool, error) {
+	raw, bad, fatal, err := rdr.next()
+	if err != nil {
+		return nil, bad, fatal, err
+	}
+	var span *common.Span
+	err = json.Unmarshal(raw, &span)
+	if err != nil {
+		return nil, raw, false, err
+	}
+	return span, nil, false, nil
+}
+
+type queryHandler struct {
+	lg *common.Logger
+	dataStoreHandler
+}
+
+func (hand *queryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	query, ok := hand.parseQuery(w, req)
+	if !ok {
+		return
+	}
+	hand.serveQuery(w, req, query)
+}
+
+// Run a query, and write the results in the form which the groupByTrace,
+// paged, and tag parameters of the request ask for.
+func (hand *queryHandler) serveQuery(w http.ResponseWriter,
+	req *http.Request, query *common.Query) {
+	var err error
+	groupByTrace := false
+	groupByTraceStr := req.FormValue("groupByTrace")
+	if groupByTraceStr != "" {
+		groupByTrace, err = strconv.ParseBool(groupByTraceStr)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid groupByTrace '%s'.", groupByTraceStr)
+			return
+		}
+	}
+	groupLim := DEFAULT_TRACE_GROUP_LIM
+	groupLimStr := req.FormValue("groupLim")
+	if groupLimStr != "" {
+		groupLim, err = strconv.Atoi(groupLimStr)
+		if err != nil || groupLim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid groupLim '%s'.", groupLimStr)
+			return
+		}
+	}
+	if groupLim > MAX_TRACE_GROUP_LIM {
+		groupLim = MAX_TRACE_GROUP_LIM
+	}
+	paged := false
+	pagedStr := req.FormValue("paged")
+	if pagedStr != "" {
+		paged, err = strconv.ParseBool(pagedStr)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid paged '%s'.", pagedStr)
+			return
+		}
+	}
+	if paged && groupByTrace {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"paged and groupByTrace can't be used together.")
+		return
+	}
+	tag := req.FormValue("tag")
+	if tag != "" {
+		err = validateTraceTag(tag)
+		if err != nil {
+			writeHtraceError(hand.lg, w, err)
+			return
+		}
+	}
+	page, ok := hand.runQuery(w, query, paged)
+	if !ok {
+		return
+	}
+	var jbytes []byte
+	if groupByTrace {
+		groups := hand.store.GroupByTrace(page.Spans, groupLim)
+		if tag != "" {
+			groups = hand.store.tags.filterGroups(groups, tag)
+		}
+		jbytes, err = json.Marshal(groups)
+	} else if tag != "" {
+		// The page's continuation token still comes from the last span the
+		// query returned, so that paging skips over untagged spans.
+		page.Spans = hand.store.tags.filterSpans(page.Spans, tag)
+		if paged {
+			jbytes, err = json.Marshal(page)
+		} else {
+			jbytes, err = json.Marshal(page.Spans)
+		}
+	} else if paged {
+		jbytes, err = json.Marshal(page)
+	} else {
+		jbytes, err = json.Marshal(page.Spans)
+	}
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling results: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+// Parse the query in the query parameter of a request.
+func (hand *queryHandler) parseQuery(w http.ResponseWriter,
+	req *http.Request) (*common.Query, bool) {
+	queryString := req.FormValue("query")
+	if queryString == "" {
+		writeError(hand.lg, w, common.ERR_QUERY_VALIDATION, "No query provided.")
+		return nil, false
+	}
+	var query common.Query
+	reader := bytes.NewBufferString(queryString)
+	dec := json.NewDecoder(reader)
+	err := dec.Decode(&query)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_QUERY_VALIDATION,
+			"Error parsing query '%s': %s", queryString, err.Error())
+		return nil, false
+	}
+	return &query, true
+}
+
+// Run a query, and set the response headers which describe how it was run.
+// Only the spans of the page are filled in unless paged is true.
+func (hand *queryHandler) runQuery(w http.ResponseWriter,
+	query *common.Query, paged bool) (*common.QueryPage, bool) {
+	origVals := make([]string, len(query.Predicates))
+	for i := range query.Predicates {
+		origVals[i] = query.Predicates[i].Val
+	}
+	var page *common.QueryPage
+	var err error
+	if paged {
+		page, err = hand.store.HandleQueryPage(query)
+	} else {
+		page = &common.QueryPage{}
+		page.Spans, err, _ = hand.store.HandleQuery(query)
+	}
+	if err != nil {
+		if common.ErrorCodeOf(err) == common.ERR_UNKNOWN {
+			err = common.NewHtraceError(common.ERR_INTERNAL, nil,
+				"Internal error processing query %s: %s",
+				query.String(), err.Error())
+		}
+		writeHtraceError(hand.lg, w, err)
+		return nil, false
+	}
+	setQuarantineHeaders(w.Header(), hand.store)
+	w.Header().Set(common.QUERY_LIM_HEADER, strconv.Itoa(query.Lim))
+	resolved := make([]string, 0)
+	for i := range query.Predicates {
+		if query.Predicates[i].Val != origVals[i] {
+			resolved = append(resolved, fmt.Sprintf("%d=%s", i,
+				query.Predicates[i].Val))
+		}
+	}
+	if len(resolved) > 0 {
+		w.Header().Set(common.QUERY_RESOLVED_TIMES_HEADER,
+			strings.Join(resolved, ","))
+	}
+	if len(query.ShardFilter) > 0 {
+		// Only some of the shards were scanned.
+		w.Header().Set("X-HTraced-Partial-Results", "true")
+		w.Header().Set("X-HTraced-Shard-Filter",
+			strings.Join(query.ShardFilter, ","))
+	}
+	return page, true
+}
+
+type explainQueryHandler struct {
+	queryHandler
+}
+
+func (hand *explainQueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	query, ok := hand.parseQuery(w, req)
+	if !ok {
+		return
+	}
+	exp, err := hand.store.ExplainQuery(query)
+	if err != nil {
+		if common.ErrorCodeOf(err) == common.ERR_UNKNOWN {
+			err = common.NewHtraceError(common.ERR_INTERNAL, nil,
+				"Internal error explaining query %s: %s",
+				query.String(), err.Error())
+		}
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	jbytes, err := json.Marshal(exp)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling QueryExplanation: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type timeSeriesHandler struct {
+	queryHandler
+}
+
+func (hand *timeSeriesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	field := common.Field(req.FormValue("field"))
+	if field != "" && field != common.BEGIN_TIME {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid field '%s': expected %s.", field, common.BEGIN_TIME)
+		return
+	}
+	var beginMs, endMs int64
+	var err error
+	beginStr := req.FormValue("begin")
+	beginMs, err = strconv.ParseInt(beginStr, 10, 64)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid begin '%s'.", beginStr)
+		return
+	}
+	endStr := req.FormValue("end")
+	endMs, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || endMs <= beginMs {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid end '%s'.", endStr)
+		return
+	}
+	bucketsStr := req.FormValue("buckets")
+	buckets, err := strconv.Atoi(bucketsStr)
+	if err != nil || buckets <= 0 || buckets > MAX_TIME_SERIES_BUCKETS ||
+		int64(buckets) > endMs-beginMs {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid buckets '%s': expected between 1 and %d, and at most "+
+				"one per millisecond.", bucketsStr, MAX_TIME_SERIES_BUCKETS)
+		return
+	}
+	scanLim := DEFAULT_TIME_SERIES_SCAN_LIM
+	scanLimStr := req.FormValue("scanLim")
+	if scanLimStr != "" {
+		scanLim, err = strconv.Atoi(scanLimStr)
+		if err != nil || scanLim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid scanLim '%s'.", scanLimStr)
+			return
+		}
+	}
+	if scanLim > MAX_TIME_SERIES_SCAN_LIM {
+		scanLim = MAX_TIME_SERIES_SCAN_LIM
+	}
+	useStats := true
+	statsStr := req.FormValue("stats")
+	if statsStr != "" {
+		useStats, err = strconv.ParseBool(statsStr)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid stats '%s'.", statsStr)
+			return
+		}
+	}
+	var query *common.Query
+	if req.FormValue("query") != "" {
+		var ok bool
+		query, ok = hand.parseQuery(w, req)
+		if !ok {
+			return
+		}
+	}
+	hand.lg.Debugf("timeSeriesHandler(begin=%d, end=%d, buckets=%d, "+
+		"scanLim=%d, stats=%t, query=%s)\n", beginMs, endMs, buckets,
+		scanLim, useStats, query)
+	ts, err := hand.store.QueryTimeSeries(query, beginMs, endMs, buckets,
+		scanLim, useStats)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(ts)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling time series: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type zipkinQueryHandler struct {
+	queryHandler
+}
+
+func (hand *zipkinQueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	query, ok := hand.parseQuery(w, req)
+	if !ok {
+		return
+	}
+	page, ok := hand.runQuery(w, query, false)
+	if !ok {
+		return
+	}
+	jbytes, err := json.Marshal(hand.store.ToZipkin(page.Spans))
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling results: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type zipkinSpanHandler struct {
+	dataStoreHandler
+}
+
+func (hand *zipkinSpanHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	span := hand.store.FindSpan(sid)
+	if span == nil {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+			map[string]string{"id": sid.String()}, "No such span as %s", sid.String()))
+		return
+	}
+	// Zipkin tools expect an array of spans, even when there is only one.
+	jbytes, err := json.Marshal(hand.store.ToZipkin([]*common.Span{span}))
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling span: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type flameHandler struct {
+	dataStoreHandler
+}
+
+func (hand *flameHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	lim := DEFAULT_FLAME_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_FLAME_LIM {
+		lim = MAX_FLAME_LIM
+	}
+	hand.lg.Debugf("flameHandler(sid=%s, lim=%d)\n", sid.String(), lim)
+	tree := hand.store.AssembleFlameTree(sid, lim)
+	if tree == nil {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+			map[string]string{"id": sid.String()}, "No such span as %s", sid.String()))
+		return
+	}
+	jbytes, err := json.Marshal(tree)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling flame tree: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type bundleHandler struct {
+	dataStoreHandler
+
+	// The maximum number of spans in a bundle.
+	maxSpans int
+}
+
+func (hand *bundleHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	lim := hand.maxSpans
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+		if lim > hand.maxSpans {
+			lim = hand.maxSpans
+		}
+	}
+	tag := req.FormValue("tag")
+	if tag != "" {
+		err := validateTraceTag(tag)
+		if err != nil {
+			writeHtraceError(hand.lg, w, err)
+			return
+		}
+	}
+	hand.lg.Debugf("bundleHandler(sid=%s, lim=%d, tag=%s)\n", sid.String(),
+		lim, tag)
+	bundle := hand.store.AssembleTraceBundle(sid, lim)
+	if bundle == nil {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+			map[string]string{"id": sid.String()}, "No such span as %s", sid.String()))
+		return
+	}
+	if tag != "" && !hand.store.tags.HasTag(bundle.Manifest.RootId, tag) {
+		writeHtraceError(hand.lg, w, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+			map[string]string{"id": sid.String()},
+			"The trace of span %s is not tagged %s", sid.String(), tag))
+		return
+	}
+	jbytes, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling trace bundle: %s", err.Error())
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(
+		"attachment; filename=\"trace-%s.json\"", bundle.Manifest.RootId.String()))
+	w.Header().Set("Vary", "Accept-Encoding")
+	// Bundles of big traces compress very well, so send them gzipped when
+	// the client allows it.
+	if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		w.Write(jbytes)
+		return
+	}
+	w.Header().Set("Content-Encoding", "gzip")
+	gzw := gzip.NewWriter(w)
+	gzw.Write(jbytes)
+	gzw.Close()
+}
+
+type serviceMapHandler struct {
+	dataStoreHandler
+}
+
+func (hand *serviceMapHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var beginMs, endMs int64
+	var err error
+	beginStr := req.FormValue("begin")
+	beginMs, err = strconv.ParseInt(beginStr, 10, 64)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid begin '%s'.", beginStr)
+		return
+	}
+	endStr := req.FormValue("end")
+	endMs, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || endMs < beginMs {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid end '%s'.", endStr)
+		return
+	}
+	lim := DEFAULT_SERVICE_MAP_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_SERVICE_MAP_LIM {
+		lim = MAX_SERVICE_MAP_LIM
+	}
+	hand.lg.Debugf("serviceMapHandler(begin=%d, end=%d, lim=%d)\n",
+		beginMs, endMs, lim)
+	smap := hand.store.BuildServiceMap(beginMs, endMs, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(smap)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling service map: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type descriptionStatsHandler struct {
+	dataStoreHandler
+}
+
+func (hand *descriptionStatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var beginMs, endMs int64
+	var err error
+	beginStr := req.FormValue("begin")
+	beginMs, err = strconv.ParseInt(beginStr, 10, 64)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid begin '%s'.", beginStr)
+		return
+	}
+	endStr := req.FormValue("end")
+	endMs, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || endMs < beginMs {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid end '%s'.", endStr)
+		return
+	}
+	lim := DEFAULT_DESC_STATS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_DESC_STATS_LIM {
+		lim = MAX_DESC_STATS_LIM
+	}
+	hand.lg.Debugf("descriptionStatsHandler(begin=%d, end=%d, lim=%d)\n",
+		beginMs, endMs, lim)
+	resp := hand.store.descStats.Get(beginMs, endMs, lim)
+	jbytes, err := json.Marshal(resp)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling description statistics: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type distinctValuesHandler struct {
+	dataStoreHandler
+}
+
+func (hand *distinctValuesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	field := common.Field(req.FormValue("field"))
+	if !distinctValuesSupported(field) {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid field '%s': expected %s or %s.", field,
+			common.TRACER_ID, common.DESCRIPTION)
+		return
+	}
+	var beginMs, endMs int64
+	var err error
+	beginStr := req.FormValue("begin")
+	beginMs, err = strconv.ParseInt(beginStr, 10, 64)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid begin '%s'.", beginStr)
+		return
+	}
+	endStr := req.FormValue("end")
+	endMs, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || endMs < beginMs {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+			"Invalid end '%s'.", endStr)
+		return
+	}
+	lim := DEFAULT_DISTINCT_VALUES_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_DISTINCT_VALUES_LIM {
+		lim = MAX_DISTINCT_VALUES_LIM
+	}
+	scanLim := DEFAULT_DISTINCT_VALUES_SCAN_LIM
+	scanLimStr := req.FormValue("scanLim")
+	if scanLimStr != "" {
+		scanLim, err = strconv.Atoi(scanLimStr)
+		if err != nil || scanLim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid scanLim '%s'.", scanLimStr)
+			return
+		}
+	}
+	if scanLim > MAX_DISTINCT_VALUES_SCAN_LIM {
+		scanLim = MAX_DISTINCT_VALUES_SCAN_LIM
+	}
+	hand.lg.Debugf("distinctValuesHandler(field=%s, begin=%d, end=%d, "+
+		"lim=%d, scanLim=%d)\n", field, beginMs, endMs, lim, scanLim)
+	dv := hand.store.FindDistinctValues(field, beginMs, endMs, lim, scanLim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(dv)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling distinct values: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type linksHandler struct {
+	dataStoreHandler
+}
+
+func (hand *linksHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	vars := mux.Vars(req)
+	stringSid := vars["id"]
+	sid, ok := hand.parseSid(w, stringSid)
+	if !ok {
+		return
+	}
+	lim := DEFAULT_LINKS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_LINKS_LIM {
+		lim = MAX_LINKS_LIM
+	}
+	hand.lg.Debugf("linksHandler(sid=%s, lim=%d)\n", sid.String(), lim)
+	linked := hand.store.FindLinkedSpans(sid, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(linked)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling linked spans: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+// The maximum size of a request to change the tags of a trace, in bytes.
+const MAX_TAG_TRACE_REQ_LENGTH = 64 * 1024
+
+type tagTraceHandler struct {
+	dataStoreHandler
+}
+
+func (hand *tagTraceHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	sid, ok := hand.parseSid(w, mux.Vars(req)["id"])
+	if !ok {
+		return
+	}
+	var treq common.TagTraceReq
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+		MAX_TAG_TRACE_REQ_LENGTH))
+	err := dec.Decode(&treq)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Error parsing TagTraceReq: %s", err.Error())
+		return
+	}
+	hand.lg.Infof("tagTraceHandler(sid=%s, add=%v, remove=%v, "+
+		"speculative=%t)\n", sid.String(), treq.Add, treq.Remove,
+		treq.Speculative)
+	tags, err := hand.store.tags.Tag(sid, &treq)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	hand.writeTraceTags(w, tags)
+}
+
+func (hand *dataStoreHandler) writeTraceTags(w http.ResponseWriter,
+	tags *common.TraceTags) {
+	buf, err := json.Marshal(tags)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling TraceTags: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type traceTagsHandler struct {
+	dataStoreHandler
+}
+
+func (hand *traceTagsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	sid, ok := hand.parseSid(w, mux.Vars(req)["id"])
+	if !ok {
+		return
+	}
+	hand.lg.Debugf("traceTagsHandler(sid=%s)\n", sid.String())
+	tags, err := hand.store.tags.Get(sid)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	hand.writeTraceTags(w, tags)
+}
+
+type taggedTracesHandler struct {
+	dataStoreHandler
+}
+
+func (hand *taggedTracesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	tag := mux.Vars(req)["tag"]
+	var after common.SpanId
+	afterStr := req.FormValue("after")
+	if afterStr != "" {
+		var ok bool
+		after, ok = hand.parseSid(w, afterStr)
+		if !ok {
+			return
+		}
+	}
+	lim := DEFAULT_TAGGED_TRACES_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_TAGGED_TRACES_LIM {
+		lim = MAX_TAGGED_TRACES_LIM
+	}
+	hand.lg.Debugf("taggedTracesHandler(tag=%s, after=%s, lim=%d)\n",
+		tag, afterStr, lim)
+	traces, err := hand.store.tags.Find(tag, after, lim)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	jbytes, err := json.Marshal(traces)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling tagged traces: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type writeGroupHandler struct {
+	dataStoreHandler
+}
+
+func (hand *writeGroupHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	id := mux.Vars(req)["id"]
+	hand.lg.Debugf("writeGroupHandler(id=%s)\n", id)
+	status, err := hand.store.writeGroups.Get(id,
+		common.TimeToUnixMs(time.Now().UTC()))
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	jbytes, err := json.Marshal(status)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling write group: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+// The maximum size of a saved search, in bytes.
+const MAX_SAVED_SEARCH_LENGTH = 64 * 1024
+
+type savedSearchesHandler struct {
+	dataStoreHandler
+}
+
+func (hand *savedSearchesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	hand.lg.Debugf("savedSearchesHandler\n")
+	buf, err := json.Marshal(hand.store.searches.List())
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling saved searches: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type saveSearchHandler struct {
+	dataStoreHandler
+}
+
+func (hand *saveSearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	var search common.SavedSearch
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+		MAX_SAVED_SEARCH_LENGTH))
+	err := dec.Decode(&search)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Error parsing SavedSearch: %s", err.Error())
+		return
+	}
+	hand.lg.Infof("saveSearchHandler(name=%s)\n", search.Name)
+	saved, err := hand.store.searches.Save(&search, restToken(req))
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling SavedSearch: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type deleteSavedSearchHandler struct {
+	dataStoreHandler
+}
+
+func (hand *deleteSavedSearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	name := mux.Vars(req)["name"]
+	hand.lg.Infof("deleteSavedSearchHandler(name=%s)\n", name)
+	err := hand.store.searches.Remove(name)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+}
+
+// Runs a saved search.  The results are written the same way as those of
+// /query, so the groupByTrace, paged, and tag parameters work the same way.
+type runSavedSearchHandler struct {
+	queryHandler
+}
+
+func (hand *runSavedSearchHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	name := mux.Vars(req)["name"]
+	params := make(map[string]string)
+	for key, vals := range req.Form {
+		if strings.HasPrefix(key, common.SAVED_SEARCH_PARAM_PREFIX) &&
+			len(vals) > 0 {
+			params[key[len(common.SAVED_SEARCH_PARAM_PREFIX):]] = vals[0]
+		}
+	}
+	query, err := hand.store.searches.Instantiate(name, params)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		query.Lim, err = strconv.Atoi(limStr)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	after := req.FormValue("after")
+	if after != "" {
+		query.After = after
+		query.Prev = nil
+	}
+	hand.lg.Debugf("runSavedSearchHandler(name=%s, params=%v)\n", name,
+		params)
+	hand.serveQuery(w, req, query)
+}
+
+// The maximum size of a query plan to replay, in bytes.  A plan lists the ids
+// of the spans its query returned, so this allows for query.max.lim spans and
+// then some.
+const MAX_QUERY_PLAN_LENGTH = 4 * 1024 * 1024
+
+type replayQueryPlanHandler struct {
+	dataStoreHandler
+}
+
+func (hand *replayQueryPlanHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	var plan common.QueryPlan
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body,
+		MAX_QUERY_PLAN_LENGTH))
+	err := dec.Decode(&plan)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Error parsing QueryPlan: %s", err.Error())
+		return
+	}
+	hand.lg.Infof("replayQueryPlanHandler(query=%s, index=%s)\n",
+		plan.Query.String(), plan.Index)
+	replay, err := hand.store.ReplayPlan(&plan)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	buf, err := json.Marshal(replay)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"error marshalling PlanReplay: %s", err.Error())
+		return
+	}
+	w.Write(buf)
+}
+
+type heartbeatsHandler struct {
+	dataStoreHandler
+}
+
+func (hand *heartbeatsHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var sinceMs int64
+	var err error
+	sinceStr := req.FormValue("since")
+	if sinceStr != "" {
+		sinceMs, err = strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Error parsing since: %s.", err.Error())
+			return
+		}
+	}
+	lim := DEFAULT_HEARTBEATS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_HEARTBEATS_LIM {
+		lim = MAX_HEARTBEATS_LIM
+	}
+	hand.lg.Debugf("heartbeatsHandler(since=%d, lim=%d)\n", sinceMs, lim)
+	markers, err := hand.store.FindHeartbeatMarkers(sinceMs, lim)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	jbytes, err := json.Marshal(markers)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling heartbeat markers: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type auditHandler struct {
+	dataStoreHandler
+}
+
+func (hand *auditHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	lim := DEFAULT_AUDIT_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		var err error
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_AUDIT_LIM {
+		lim = MAX_AUDIT_LIM
+	}
+	hand.lg.Debugf("auditHandler(lim=%d)\n", lim)
+	entries, err := hand.store.FindAuditEntries(lim)
+	if err != nil {
+		writeHtraceError(hand.lg, w, err)
+		return
+	}
+	jbytes, err := json.Marshal(entries)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling audit entries: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type spansChangedHandler struct {
+	dataStoreHandler
+}
+
+func (hand *spansChangedHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var sinceMs int64
+	var err error
+	sinceStr := req.FormValue("since")
+	if sinceStr != "" {
+		sinceMs, err = strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Error parsing since: %s.", err.Error())
+			return
+		}
+	}
+	var cur common.ArrivalCursor
+	err = cur.FromString(req.FormValue("cursor"))
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_BAD_PARAMETER, "%s", err.Error())
+		return
+	}
+	lim := DEFAULT_SPANS_CHANGED_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_SPANS_CHANGED_LIM {
+		lim = MAX_SPANS_CHANGED_LIM
+	}
+	hand.lg.Debugf("spansChangedHandler(since=%d, cursor=%s, lim=%d)\n",
+		sinceMs, cur.String(), lim)
+	spans, next := hand.store.FindSpansChangedSince(sinceMs, &cur, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	resp := common.SpansChangedResp{
+		Spans:  spans,
+		Cursor: next.String(),
+	}
+	jbytes, err := json.Marshal(&resp)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling changed spans: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type activeSpansHandler struct {
+	dataStoreHandler
+}
+
+func (hand *activeSpansHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	req.ParseForm()
+	var olderThanMs int64
+	var err error
+	olderThanStr := req.FormValue("olderThanMs")
+	if olderThanStr != "" {
+		olderThanMs, err = strconv.ParseInt(olderThanStr, 10, 64)
+		if err != nil || olderThanMs < 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid olderThanMs '%s'.", olderThanStr)
+			return
+		}
+	}
+	lim := DEFAULT_ACTIVE_SPANS_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_ACTIVE_SPANS_LIM {
+		lim = MAX_ACTIVE_SPANS_LIM
+	}
+	hand.lg.Debugf("activeSpansHandler(olderThanMs=%d, lim=%d)\n",
+		olderThanMs, lim)
+	spans := hand.store.FindActiveSpans(olderThanMs, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	jbytes, err := json.Marshal(spans)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling active spans: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+type spansBySeqHandler struct {
+	dataStoreHandler
+}
+
+func (hand *spansBySeqHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	setResponseHeaders(w.Header())
+	if !hand.store.seqsEnabled {
+		writeError(hand.lg, w, common.ERR_BAD_REQUEST,
+			"Sequence numbers are not enabled.  Set %s to true to enable them.",
+			conf.HTRACE_DATASTORE_SEQUENCE_NUMBERS)
+		return
+	}
+	req.ParseForm()
+	var fromSeq uint64
+	var err error
+	fromStr := req.FormValue("from")
+	if fromStr != "" {
+		fromSeq, err = strconv.ParseUint(fromStr, 10, 64)
+		if err != nil {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Error parsing from: %s.", err.Error())
+			return
+		}
+	}
+	lim := DEFAULT_SPANS_BY_SEQ_LIM
+	limStr := req.FormValue("lim")
+	if limStr != "" {
+		lim, err = strconv.Atoi(limStr)
+		if err != nil || lim <= 0 {
+			writeError(hand.lg, w, common.ERR_BAD_PARAMETER,
+				"Invalid lim '%s'.", limStr)
+			return
+		}
+	}
+	if lim > MAX_SPANS_BY_SEQ_LIM {
+		lim = MAX_SPANS_BY_SEQ_LIM
+	}
+	hand.lg.Debugf("spansBySeqHandler(from=%d, lim=%d)\n", fromSeq, lim)
+	spans, nextSeq := hand.store.FindSpansBySeq(fromSeq, lim)
+	setQuarantineHeaders(w.Header(), hand.store)
+	resp := common.SpansBySeqResp{
+		Spans:   spans,
+		NextSeq: nextSeq,
+	}
+	jbytes, err := json.Marshal(&resp)
+	if err != nil {
+		writeError(hand.lg, w, common.ERR_INTERNAL,
+			"Error marshalling spans by sequence number: %s", err.Error())
+		return
+	}
+	w.Write(jbytes)
+}
+
+// Serves the static web UI resources.
+//
+// The web UI resources don't change while htraced is running, so we compute
+// their ETags once at startup.  Clients which already have the current version
+// of a resource get back a 304 rather than the whole resource.
+type staticHandler struct {
+	lg *common.Logger
+
+	// The handler which serves the files.
+	fileServer http.Handler
+
+	// Maps cleaned URL paths to ETags.
+	etags map[string]string
+
+	// The value of the Cache-Control header to send.
+	cacheControl string
+}
+
+func newStaticHandler(lg *common.Logger, webdir string,
+	maxAgeSec int) (*staticHandler, error) {
+	hand := &staticHandler{
+		lg:           lg,
+		fileServer:   http.FileServer(http.Dir(webdir)),
+		etags:        make(map[string]string),
+		cacheControl: fmt.Sprintf("max-age=%d", maxAgeSec),
+	}
+	err := filepath.Walk(webdir, func(fpath string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		buf, err := ioutil.ReadFile(fpath)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(webdir, fpath)
+		if err != nil {
+			return err
+		}
+		urlPath := path.Clean("/" + filepath.ToSlash(rel))
+		etag := computeEtag(buf)
+		hand.etags[urlPath] = etag
+		// Directories are served using their index.html file.
+		if path.Base(urlPath) == "index.html" {
+			hand.etags[path.Dir(urlPath)] = etag
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	lg.Debugf("Computed ETags for %d static resource(s) in %s\n",
+		len(hand.etags), webdir)
+	return hand, nil
+}
+
+func (hand *staticHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	etag, found := hand.etags[path.Clean(req.URL.Path)]
+	if found {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", hand.cacheControl)
+		if etagMatches(req, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	hand.fileServer.ServeHTTP(w, req)
+}
+
+type logErrorHandler struct {
+	lg *common.Logger
+}
+
+func (hand *logErrorHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	hand.lg.Errorf("Got unknown request %s\n", req.RequestURI)
+	writeError(hand.lg, w, common.ERR_UNKNOWN_REQUEST, "Unknown request.")
+}
+
+type RestServer struct {
+	http.Server
+	listener net.Listener
+	lg       *common.Logger
+	router   *mux.Router
+	routes   *restRoutes
+}
+
+func CreateRestServer(cnf *conf.Config, store *dataStore, rld *ConfReloader,
+	listener net.Listener) (*RestServer, error) {
+	var err error
+	rsv := &RestServer{}
+	rsv.lg = common.NewLogger("rest", cnf)
+
+	r := mux.NewRouter().StrictSlash(false)
+	routes := newRestRoutes(r)
+	routes.slis = store.msink.slis
+
+	serverVersionH := &serverVersionHandler{lg: rsv.lg, store: store,
+		restAddr: listener.Addr().String()}
+	routes.handle("GET", "/server/info", serverVersionH, &routeDoc{
+		Summary:   "Get the server version.",
+		Responses: []interface{}{&common.ServerVersion{}},
+	})
+	routes.handle("GET", "/server/version", serverVersionH, &routeDoc{
+		Summary:   "Get the server version.  The same as /server/info.",
+		Responses: []interface{}{&common.ServerVersion{}},
+	})
+	routes.handle("GET", "/server/debugInfo",
+		&serverDebugInfoHandler{lg: rsv.lg}, &routeDoc{
+			Summary:   "Get the stack traces and GC statistics of the server.",
+			Responses: []interface{}{&common.ServerDebugInfo{}},
+		})
+
+	serverStatsH := &serverStatsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/stats", serverStatsH, &routeDoc{
+		Summary:   "Get the server statistics.",
+		Responses: []interface{}{&common.ServerStats{}},
+	})
+
+	clientStatsH := &clientStatsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/stats/clients", clientStatsH, &routeDoc{
+		Summary: "Get the span metrics of each client, sorted by address.",
+		Params: []paramDoc{
+			{Name: "after", Type: "string",
+				Desc: "Only return clients whose address sorts after this."},
+			{Name: "prefix", Type: "string",
+				Desc: "Only return clients whose address starts with this."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of clients to return."},
+		},
+		Responses: []interface{}{&common.ClientStatsResp{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	statsHistoryH := &statsHistoryHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/stats/history", statsHistoryH, &routeDoc{
+		Summary:   "Get the recent history of the server statistics.",
+		Responses: []interface{}{[]common.StatsBucket{}},
+	})
+
+	heartbeatsH := &heartbeatsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/heartbeats", heartbeatsH, &routeDoc{
+		Summary: "Get the heartbeat markers written by the server.",
+		Params: []paramDoc{
+			{Name: "since", Type: "integer",
+				Desc: "Only return markers written after this time, in " +
+					"milliseconds since the epoch."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of markers to return."},
+		},
+		Responses: []interface{}{[]*common.HeartbeatMarker{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	auditH := &auditHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/audit", auditH, &routeDoc{
+		Summary: "Get the most recent entries in the write audit log.",
+		Params: []paramDoc{
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of entries to return."},
+		},
+		Responses: []interface{}{[]*common.AuditEntry{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	serverHealthH := &serverHealthHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/health", serverHealthH, &routeDoc{
+		Summary: "Get the health of the server's shards, and whether " +
+			"ingestion is paused.",
+		Responses: []interface{}{&common.ServerHealth{}},
+	})
+
+	watermarkH := &watermarkHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/watermark", watermarkH, &routeDoc{
+		Summary:   "Get the ingest watermark.",
+		Responses: []interface{}{&common.Watermark{}},
+	})
+
+	canaryH := &canaryHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/canary", canaryH, &routeDoc{
+		Summary: "Get the results of the read-after-write canary, " +
+			"including its most recent failures.",
+		Responses: []interface{}{&common.CanaryStatus{}},
+	})
+
+	quotasH := &quotasHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/quotas", quotasH, &routeDoc{
+		Summary:   "Get the status of the ingest quotas.",
+		Responses: []interface{}{[]common.QuotaStatus{}},
+	})
+
+	chaosH := &chaosHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/chaos", chaosH, &routeDoc{
+		Summary:   "Get the faults which chaos mode has injected.",
+		Responses: []interface{}{&common.ChaosStats{}},
+	})
+
+	rejectionsH := &rejectionsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/rejections", rejectionsH, &routeDoc{
+		Summary: "Get the most recently rejected spans.",
+		Params: []paramDoc{
+			{Name: "reason", Type: "string",
+				Desc: "Only return spans rejected for this reason.",
+				Enum: []string{common.REJECT_REASON_DECODE,
+					common.REJECT_REASON_SPAN_ID,
+					common.REJECT_REASON_OVERSIZED,
+					common.REJECT_REASON_TIMES,
+					common.REJECT_REASON_INFO_KEY,
+					common.REJECT_REASON_INFO_COUNT,
+					common.REJECT_REASON_INFO_UTF8,
+					common.REJECT_REASON_INFO_RESERVED}},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to return."},
+		},
+		Responses: []interface{}{&common.Rejections{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	clearRejectionsH := &clearRejectionsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/rejections/clear", clearRejectionsH,
+		&routeDoc{Summary: "Clear the rejected span log."})
+
+	locksH := &locksHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/locks", locksH, &routeDoc{
+		Summary:   "Get the holders of the shard locks.",
+		Responses: []interface{}{[]common.ShardLock{}},
+	})
+
+	shardRetryH := &shardRetryHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/shards/{idx}/retry", shardRetryH, &routeDoc{
+		Summary: "Try to bring a quarantined shard back into service.",
+		Params: []paramDoc{
+			{Name: "idx", Type: "integer", Desc: "The index of the shard."},
+		},
+		Responses: []interface{}{&common.ShardHealth{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	ingestPauseH := &ingestPauseHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/ingest/pause", ingestPauseH, &routeDoc{
+		Summary: "Stop accepting spans, while still serving queries.",
+		Desc: "While ingestion is paused, span writes fail with " +
+			"INGEST_PAUSED, and REST writes also get a Retry-After " +
+			"header.  The pause is not persisted: a server which " +
+			"restarts while paused starts up accepting spans.",
+		Params: []paramDoc{
+			{Name: "durationMs", Type: "integer",
+				Desc: "How long to pause for, in milliseconds.  If this " +
+					"is missing or 0, ingestion stays paused until it is " +
+					"resumed."},
+		},
+		Responses: []interface{}{&common.IngestPause{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	ingestResumeH := &ingestResumeHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/ingest/resume", ingestResumeH, &routeDoc{
+		Summary:   "Start accepting spans again after a pause.",
+		Responses: []interface{}{&common.IngestPause{}},
+	})
+
+	snapshotH := &snapshotHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/snapshot", snapshotH, &routeDoc{
+		Summary: "Start a snapshot of the datastore.",
+		Params: []paramDoc{
+			{Name: "dest", Type: "string", Required: true,
+				Desc: "The directory on the server to write the snapshot to."},
+		},
+		Responses: []interface{}{&common.SnapshotStatus{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_BAD_REQUEST, common.ERR_CONFLICT},
+	})
+
+	snapshotStatusH := &snapshotStatusHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/snapshot/status", snapshotStatusH, &routeDoc{
+		Summary:   "Get the status of the most recent snapshot.",
+		Responses: []interface{}{&common.SnapshotStatus{}},
+	})
+
+	tracerRenameH := &tracerRenameHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/tracers/rename", tracerRenameH, &routeDoc{
+		Summary: "Start renaming a tracer ID in the stored spans.",
+		Params: []paramDoc{
+			{Name: "from", Type: "string", Required: true,
+				Desc: "The tracer ID to rename."},
+			{Name: "to", Type: "string", Required: true,
+				Desc: "The new tracer ID."},
+			{Name: "dryRun", Type: "boolean",
+				Desc: "If true, count the spans, but don't rename them."},
+			{Name: "alias", Type: "boolean",
+				Desc: "If true, also rename spans which arrive later."},
+		},
+		Responses: []interface{}{&common.TracerRenameStatus{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_BAD_REQUEST, common.ERR_READ_ONLY,
+			common.ERR_CONFLICT},
+	})
+
+	tracerRenameStatusH := &tracerRenameStatusHandler{
+		dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/tracers/rename/status",
+		tracerRenameStatusH, &routeDoc{
+			Summary:   "Get the status of the most recent tracer rename.",
+			Responses: []interface{}{&common.TracerRenameStatus{}},
+		})
+
+	scanJobH := &scanJobHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/scan", scanJobH, &routeDoc{
+		Summary: "Start a scan job, which aggregates every stored span.",
+		Params: []paramDoc{
+			{Name: "name", Type: "string", Required: true,
+				Enum: scanJobNames(), Desc: "The scan job to run."},
+		},
+		Responses: []interface{}{&common.ScanJobStatus{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_CONFLICT},
+	})
+
+	scanJobStatusH := &scanJobStatusHandler{
+		dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/scan/status", scanJobStatusH, &routeDoc{
+		Summary: "Get the status of the most recent scan job, including " +
+			"its result once it is done.",
+		Responses: []interface{}{&common.ScanJobStatus{}},
+	})
+
+	cancelScanJobH := &cancelScanJobHandler{
+		dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/scan/cancel", cancelScanJobH, &routeDoc{
+		Summary:   "Cancel the running scan job, and wait for it to stop.",
+		Responses: []interface{}{&common.ScanJobStatus{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_REQUEST},
+	})
+
+	slosH := &slosHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/server/slos", slosH, &routeDoc{
+		Summary:   "Get the status of the latency SLOs.",
+		Responses: []interface{}{[]common.SloStatus{}},
+	})
+
+	defineSloH := &defineSloHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/slos", defineSloH, &routeDoc{
+		Summary:   "Define a latency SLO, or replace an existing one.",
+		Request:   &common.SloDefinition{},
+		Responses: []interface{}{&common.SloStatus{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_REQUEST,
+			common.ERR_BAD_PARAMETER, common.ERR_READ_ONLY,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	deleteSloH := &deleteSloHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/server/slos/{name}/delete", deleteSloH, &routeDoc{
+		Summary: "Delete a latency SLO.",
+		Params: []paramDoc{
+			{Name: "name", Type: "string", Desc: "The name of the SLO."},
+		},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_READ_ONLY, common.ERR_SHARD_QUARANTINED},
+	})
+
+	serverConfH := &serverConfHandler{rld: rld, lg: rsv.lg}
+	routes.handle("GET", "/server/conf", serverConfH, &routeDoc{
+		Summary:   "Get the server configuration.",
+		Responses: []interface{}{map[string]string{}},
+	})
+
+	confReloadH := &confReloadHandler{rld: rld, lg: rsv.lg}
+	routes.handle("POST", "/server/conf/reload", confReloadH, &routeDoc{
+		Summary:   "Reload the server configuration.",
+		Responses: []interface{}{&common.ConfReloadResult{}},
+	})
+
+	writeSpansH := &writeSpansHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/writeSpans", writeSpansH, &routeDoc{
+		Summary: "Write spans.",
+		Class:   common.ENDPOINT_CLASS_WRITE,
+		Desc: "The body is a WriteSpansReq, followed by NumSpans spans, " +
+			"each a separate JSON object on its own line.  Spans which " +
+			"can't be parsed are skipped, and listed in the response.  " +
+			"The request fails only if no span is accepted.",
+		Params: []paramDoc{
+			{Name: "strict", Type: "boolean",
+				Desc: "If true, fail the whole request, and write nothing, " +
+					"if any span can't be parsed."},
+		},
+		Request:   &common.WriteSpansReq{},
+		Responses: []interface{}{&common.WriteSpansResp{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_BAD_REQUEST, common.ERR_READ_ONLY,
+			common.ERR_INGEST_PAUSED, common.ERR_TOO_LARGE},
+	})
+
+	zipkinSpansH := &zipkinSpansHandler{writeSpansHandler: *writeSpansH}
+	routes.handle("POST", ZIPKIN_SPANS_PATH, zipkinSpansH, &routeDoc{
+		Summary: "Write spans in Zipkin v2 format.",
+		Class:   common.ENDPOINT_CLASS_WRITE,
+		Desc: "This is the path Zipkin tracers send spans to.  Spans " +
+			"which can't be converted are skipped.  The request fails " +
+			"only if no span is accepted.",
+		Request:       []*common.ZipkinSpan{},
+		SuccessStatus: http.StatusAccepted,
+		Errors: []common.ErrorCode{common.ERR_BAD_REQUEST,
+			common.ERR_READ_ONLY, common.ERR_INGEST_PAUSED,
+			common.ERR_TOO_LARGE},
+	})
+
+	queryH := &queryHandler{lg: rsv.lg, dataStoreHandler: dataStoreHandler{store: store}}
+	routes.handle("GET", "/query", queryH, &routeDoc{
+		Summary: "Find the spans which match a query.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Params: []paramDoc{
+			{Name: "query", Json: &common.Query{}, Required: true,
+				Desc: "The query."},
+			{Name: "groupByTrace", Type: "boolean",
+				Desc: "If true, group the spans by trace."},
+			{Name: "groupLim", Type: "integer",
+				Desc: "The maximum number of traces to return, if " +
+					"groupByTrace is set."},
+			{Name: "paged", Type: "boolean",
+				Desc: "If true, return the spans in a page which says " +
+					"whether there are more, and how to get them.  This " +
+					"can't be combined with groupByTrace.  If the query " +
+					"sets plan, the page also says how the query ran."},
+			{Name: "tag", Type: "string",
+				Desc: "If set, only return the trace roots which carry " +
+					"this tag, or with groupByTrace, the traces whose " +
+					"root carries it.  The query limit still applies to " +
+					"the spans matched before filtering."},
+		},
+		Responses: []interface{}{[]*common.Span{},
+			[]*common.TraceGroup{}, &common.QueryPage{}},
+		Errors: []common.ErrorCode{common.ERR_QUERY_VALIDATION,
+			common.ERR_BAD_PARAMETER},
+	})
+
+	explainQueryH := &explainQueryHandler{queryHandler: *queryH}
+	routes.handle("GET", "/query/explain", explainQueryH, &routeDoc{
+		Summary: "Say how a query would run, without running it.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Desc: "The response holds the plan the query would run with, " +
+			"and whether it would read every span.  If " +
+			conf.HTRACE_QUERY_PLANNER_STATS + " is on, it also estimates " +
+			"how many spans match, by counting index entries, at most " +
+			conf.HTRACE_QUERY_PLANNER_SAMPLE_MAX + " in each shard.  " +
+			"Estimates which would need more entries to be counted are " +
+			"reported as unknown.  Queries whose predicates are all " +
+			"negated are explained, though they can't be run.",
+		Params: []paramDoc{
+			{Name: "query", Json: &common.Query{}, Required: true,
+				Desc: "The query."},
+		},
+		Responses: []interface{}{&common.QueryExplanation{}},
+		Errors:    []common.ErrorCode{common.ERR_QUERY_VALIDATION},
+	})
+
+	timeSeriesH := &timeSeriesHandler{queryHandler: *queryH}
+	routes.handle("GET", "/query/timeseries", timeSeriesH, &routeDoc{
+		Summary: "Count the spans in a time range, in buckets of equal width.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Desc: "The begin time index is scanned once.  When there is no " +
+			"query, or the query only matches a description exactly, and " +
+			"the buckets are whole hours, the counts are taken from the " +
+			"description statistics instead.  These count the finished " +
+			"spans as they were ingested, so they leave out active spans.",
+		Params: []paramDoc{
+			{Name: "field", Type: "string",
+				Desc: "The field to bucket the spans by.",
+				Enum: []string{string(common.BEGIN_TIME)}},
+			{Name: "begin", Type: "integer", Required: true,
+				Desc: "The beginning of the range, in milliseconds since " +
+					"the epoch."},
+			{Name: "end", Type: "integer", Required: true,
+				Desc: "The end of the range, in milliseconds since the " +
+					"epoch."},
+			{Name: "buckets", Type: "integer", Required: true,
+				Desc: "The number of buckets."},
+			{Name: "query", Json: &common.Query{},
+				Desc: "If set, only count the spans which match this " +
+					"query.  It can't have begin time predicates."},
+			{Name: "scanLim", Type: "integer",
+				Desc: "The maximum number of spans to scan."},
+			{Name: "stats", Type: "boolean",
+				Desc: "If false, always scan, rather than using the " +
+					"description statistics."},
+		},
+		Responses: []interface{}{&common.TimeSeries{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+			common.ERR_QUERY_VALIDATION},
+	})
+
+	zipkinQueryH := &zipkinQueryHandler{queryHandler: *queryH}
+	routes.handle("GET", "/query/zipkin", zipkinQueryH, &routeDoc{
+		Summary: "Find the spans which match a query, in Zipkin v2 format.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Desc: "Zipkin span ids are the low 64 bits of our span ids, and " +
+			"Zipkin trace ids are the ids of the trace roots.  Parents " +
+			"after the first are listed in the " +
+			common.ZIPKIN_EXTRA_PARENTS_TAG + " tag.",
+		Params: []paramDoc{
+			{Name: "query", Json: &common.Query{}, Required: true,
+				Desc: "The query."},
+		},
+		Responses: []interface{}{[]*common.ZipkinSpan{}},
+		Errors:    []common.ErrorCode{common.ERR_QUERY_VALIDATION},
+	})
+
+	spansChangedH := &spansChangedHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/spans/changed", spansChangedH, &routeDoc{
+		Summary: "Get the spans which arrived after a time or cursor.",
+		Params: []paramDoc{
+			{Name: "since", Type: "integer",
+				Desc: "Only return spans which arrived after this time, " +
+					"in milliseconds since the epoch."},
+			{Name: "cursor", Type: "string",
+				Desc: "The cursor returned by the previous request."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to return."},
+		},
+		Responses: []interface{}{&common.SpansChangedResp{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	spansBySeqH := &spansBySeqHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/spans/seq", spansBySeqH, &routeDoc{
+		Summary: "Get spans in sequence number order.",
+		Params: []paramDoc{
+			{Name: "from", Type: "integer",
+				Desc: "The first sequence number to return."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to return."},
+		},
+		Responses: []interface{}{&common.SpansBySeqResp{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_REQUEST,
+			common.ERR_BAD_PARAMETER},
+	})
+
+	activeSpansH := &activeSpansHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/spans/active", activeSpansH, &routeDoc{
+		Summary: "Get the spans which have begun, but not ended.",
+		Params: []paramDoc{
+			{Name: "olderThanMs", Type: "integer",
+				Desc: "Only return spans which began at least this many " +
+					"milliseconds ago."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to return."},
+		},
+		Responses: []interface{}{[]*common.Span{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	serviceMapH := &serviceMapHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/servicemap", serviceMapH, &routeDoc{
+		Summary: "Get the calls between tracers in a time range.",
+		Params: []paramDoc{
+			{Name: "begin", Type: "integer", Required: true,
+				Desc: "The beginning of the range, in milliseconds since " +
+					"the epoch."},
+			{Name: "end", Type: "integer", Required: true,
+				Desc: "The end of the range, in milliseconds since the " +
+					"epoch."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to scan."},
+		},
+		Responses: []interface{}{&common.ServiceMap{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	descriptionStatsH := &descriptionStatsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/stats/descriptions", descriptionStatsH, &routeDoc{
+		Summary: "Get the latency statistics of the most common span " +
+			"descriptions in a time range.",
+		Params: []paramDoc{
+			{Name: "begin", Type: "integer", Required: true,
+				Desc: "The beginning of the range, in milliseconds since " +
+					"the epoch.  Rounded down to the hour."},
+			{Name: "end", Type: "integer", Required: true,
+				Desc: "The end of the range, in milliseconds since the " +
+					"epoch.  Rounded up to the hour."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of descriptions to return."},
+		},
+		Responses: []interface{}{&common.DescriptionStatsResponse{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	distinctValuesH := &distinctValuesHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/query/values", distinctValuesH, &routeDoc{
+		Summary: "Get the distinct values of a span field in a time range.",
+		Params: []paramDoc{
+			{Name: "field", Type: "string", Required: true,
+				Desc: "The field.",
+				Enum: []string{string(common.TRACER_ID),
+					string(common.DESCRIPTION)}},
+			{Name: "begin", Type: "integer", Required: true,
+				Desc: "The beginning of the range, in milliseconds since " +
+					"the epoch."},
+			{Name: "end", Type: "integer", Required: true,
+				Desc: "The end of the range, in milliseconds since the " +
+					"epoch."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of values to return."},
+			{Name: "scanLim", Type: "integer",
+				Desc: "The maximum number of spans to scan."},
+		},
+		Responses: []interface{}{&common.DistinctValues{}},
+		Errors:    []common.ErrorCode{common.ERR_BAD_PARAMETER},
+	})
+
+	// Lookups of a single span distinguish a missing span from an empty
+	// result:
+	//
+	//   /span/{id}           404 with a SPAN_NOT_FOUND error if the span
+	//                        doesn't exist.  Older servers returned 204.
+	//   /span/{id}/flame     404 with a SPAN_NOT_FOUND error if the span
+	//                        doesn't exist.
+	//   /span/{id}/bundle    404 with a SPAN_NOT_FOUND error if the span
+	//                        doesn't exist.
+	//   /span/{id}/children  200 with [] if the span has no children.  Since
+	//                        children can be written before their parents,
+	//                        this doesn't check whether the span exists.
+	//   /span/{id}/links     200 with empty lists if the span has no links.
+	//   /query               200 with [] if no spans match.
+	//
+	// Malformed span IDs and parameters are always errors.
+	spanIdParam := paramDoc{Name: "id", Type: "string",
+		Desc: "The span ID, as 32 hex digits."}
+	findSidH := &findSidHandler{dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}", findSidH, &routeDoc{
+		Summary: "Get a span.",
+		Class:   common.ENDPOINT_CLASS_SPAN,
+		Params: []paramDoc{spanIdParam,
+			{Name: "maxParents", Type: "integer",
+				Desc: "Return at most this many of the span's parents.  " +
+					"The np field still holds the number of parents the " +
+					"span has.  By default, all of them are returned."},
+		},
+		Responses: []interface{}{&common.Span{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_SPAN_NOT_FOUND, common.ERR_BAD_PARAMETER},
+	})
+
+	zipkinSpanH := &zipkinSpanHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}/zipkin", zipkinSpanH, &routeDoc{
+		Summary: "Get a span in Zipkin v2 format.",
+		Class:   common.ENDPOINT_CLASS_SPAN,
+		Desc: "The response is an array holding the span, which is how " +
+			"Zipkin tools expect spans.",
+		Params:    []paramDoc{spanIdParam},
+		Responses: []interface{}{[]*common.ZipkinSpan{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_SPAN_NOT_FOUND},
+	})
+
+	findChildrenH := &findChildrenHandler{dataStoreHandler: dataStoreHandler{store: store,
+		lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}/children", findChildrenH, &routeDoc{
+		Summary: "Get the IDs of the children of a span.",
+		Class:   common.ENDPOINT_CLASS_CHILDREN,
+		Params: []paramDoc{spanIdParam,
+			{Name: "lim", Type: "string", Required: true,
+				Desc: "The maximum number of children to return, in hex."},
+		},
+		Responses: []interface{}{[]common.SpanId{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_PARAMETER},
+	})
+
+	flameH := &flameHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}/flame", flameH, &routeDoc{
+		Summary: "Get the tree of spans under a span, for a flame graph.",
+		Params: []paramDoc{spanIdParam,
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans in the tree."},
+		},
+		Responses: []interface{}{&common.FlameTree{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_PARAMETER, common.ERR_SPAN_NOT_FOUND},
+	})
+
+	bundleH := &bundleHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg},
+		maxSpans: cnf.GetInt(conf.HTRACE_BUNDLE_MAX_SPANS)}
+	routes.handle("GET", "/span/{id}/bundle", bundleH, &routeDoc{
+		Summary: "Export the whole trace which a span belongs to.",
+		Desc: "The bundle holds the root of the span's trace, all of the " +
+			"root's descendants, and a manifest describing them.  It can " +
+			"be imported into another server with ImportTraceBundle.  " +
+			"The response is gzipped if the Accept-Encoding header " +
+			"allows it.",
+		Params: []paramDoc{spanIdParam,
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans in the bundle.  This " +
+					"cannot be more than bundle.max.spans, which is also " +
+					"the default."},
+			{Name: "tag", Type: "string",
+				Desc: "If set, the trace must carry this tag.  Otherwise " +
+					"the span is treated as not found."},
+		},
+		Responses: []interface{}{&common.TraceBundle{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_PARAMETER, common.ERR_SPAN_NOT_FOUND},
+	})
+
+	linksH := &linksHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}/links", linksH, &routeDoc{
+		Summary: "Get the spans which a span links to, and which link to it.",
+		Params: []paramDoc{spanIdParam,
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of spans to return in each " +
+					"direction."},
+		},
+		Responses: []interface{}{&common.LinkedSpans{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_PARAMETER},
+	})
+
+	traceTagsH := &traceTagsHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/span/{id}/tags", traceTagsH, &routeDoc{
+		Summary:   "Get the tags of the trace with this root.",
+		Params:    []paramDoc{spanIdParam},
+		Responses: []interface{}{&common.TraceTags{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	tagTraceH := &tagTraceHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/span/{id}/tags", tagTraceH, &routeDoc{
+		Summary: "Add tags to, or remove tags from, the trace with this root.",
+		Desc: "Unless the request is speculative, the span must exist, and " +
+			"must be a root.",
+		Params:    []paramDoc{spanIdParam},
+		Request:   &common.TagTraceReq{},
+		Responses: []interface{}{&common.TraceTags{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_REQUEST, common.ERR_BAD_PARAMETER,
+			common.ERR_SPAN_NOT_FOUND, common.ERR_READ_ONLY,
+			common.ERR_SHARD_QUARANTINED},
+	})
+
+	taggedTracesH := &taggedTracesHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/tags/{tag}", taggedTracesH, &routeDoc{
+		Summary: "Get the roots of the traces which carry a tag.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Params: []paramDoc{
+			{Name: "tag", Type: "string", Desc: "The tag."},
+			{Name: "after", Type: "string",
+				Desc: "Only return the roots after this span ID.  Pass " +
+					"the Next field of the previous response to get the " +
+					"next page."},
+			{Name: "lim", Type: "integer",
+				Desc: "The maximum number of roots to return."},
+		},
+		Responses: []interface{}{&common.TaggedTraces{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_SPAN_ID,
+			common.ERR_BAD_PARAMETER, common.ERR_SHARD_QUARANTINED},
+	})
+
+	writeGroupH := &writeGroupHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/groups/{id}", writeGroupH, &routeDoc{
+		Summary: "Get the state of a write group.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Desc: "A write group is declared in the Groups field of a " +
+			"WriteSpansReq.  The response says how many of its members " +
+			"have arrived, and how many are missing.",
+		Params: []paramDoc{
+			{Name: "id", Type: "string", Desc: "The ID of the group."},
+		},
+		Responses: []interface{}{&common.WriteGroupStatus{}},
+		Errors:    []common.ErrorCode{common.ERR_GROUP_NOT_FOUND},
+	})
+
+	savedSearchesH := &savedSearchesHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("GET", "/searches", savedSearchesH, &routeDoc{
+		Summary:   "Get the saved searches, sorted by name.",
+		Responses: []interface{}{[]common.SavedSearch{}},
+	})
+
+	saveSearchH := &saveSearchHandler{dataStoreHandler: dataStoreHandler{
+		store: store, lg: rsv.lg}}
+	routes.handle("POST", "/searches", saveSearchH, &routeDoc{
+		Summary: "Save a search, or replace an existing one.",
+		Desc: "The query is validated the same way as when it runs, with " +
+			"the defaults of its template parameters.",
+		Request:   &common.SavedSearch{},
+		Responses: []interface{}{&common.SavedSearch{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_REQUEST,
+			common.ERR_BAD_PARAMETER, common.ERR_QUERY_VALIDATION,
+			common.ERR_READ_ONLY, common.ERR_SHARD_QUARANTINED},
+	})
+
+	deleteSavedSearchH := &deleteSavedSearchHandler{
+		dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("DELETE", "/searches/{name}", deleteSavedSearchH,
+		&routeDoc{
+			Summary: "Delete a saved search.",
+			Params: []paramDoc{
+				{Name: "name", Type: "string",
+					Desc: "The name of the saved search."},
+			},
+			Errors: []common.ErrorCode{common.ERR_BAD_PARAMETER,
+				common.ERR_READ_ONLY, common.ERR_SHARD_QUARANTINED},
+		})
+
+	runSavedSearchH := &runSavedSearchHandler{queryHandler: *queryH}
+	routes.handle("GET", "/searches/{name}/run", runSavedSearchH, &routeDoc{
+		Summary: "Run a saved search.",
+		Class:   common.ENDPOINT_CLASS_QUERY,
+		Params: []paramDoc{
+			{Name: "name", Type: "string",
+				Desc: "The name of the saved search."},
+			{Name: common.SAVED_SEARCH_PARAM_PREFIX + "{param}",
+				Type: "string",
+				Desc: "The value of a template parameter, in place of " +
+					"its default."},
+			{Name: "lim", Type: "integer",
+				Desc: "The query limit, in place of the saved one."},
+			{Name: "after", Type: "string",
+				Desc: "A continuation token from the Next field of a " +
+					"previous page."},
+			{Name: "groupByTrace", Type: "boolean",
+				Desc: "As for /query."},
+			{Name: "groupLim", Type: "integer",
+				Desc: "As for /query."},
+			{Name: "paged", Type: "boolean",
+				Desc: "As for /query."},
+			{Name: "tag", Type: "string",
+				Desc: "As for /query."},
+		},
+		Responses: []interface{}{[]*common.Span{},
+			[]*common.TraceGroup{}, &common.QueryPage{}},
+		Errors: []common.ErrorCode{common.ERR_QUERY_VALIDATION,
+			common.ERR_BAD_PARAMETER},
+	})
+
+	replayQueryPlanH := &replayQueryPlanHandler{
+		dataStoreHandler: dataStoreHandler{store: store, lg: rsv.lg}}
+	routes.handle("POST", "/query/replay", replayQueryPlanH, &routeDoc{
+		Summary: "Run a query again with a plan captured earlier.",
+		Desc: "The query is run with the source and filters in the plan, " +
+			"and also planned and run again with the current planner " +
+			"statistics.  The response says whether the plan or the " +
+			"results changed.  Nothing is written, so this works on " +
+			"read-only servers.",
+		Request:   &common.QueryPlan{},
+		Responses: []interface{}{&common.PlanReplay{}},
+		Errors: []common.ErrorCode{common.ERR_BAD_REQUEST,
+			common.ERR_QUERY_VALIDATION},
+	})
+
+	apiSpecH := &apiSpecHandler{lg: rsv.lg}
+	routes.handle("GET", "/api/spec", apiSpecH, &routeDoc{
+		Summary:   "Get this description of the REST API.",
+		Responses: []interface{}{map[string]interface{}{}},
+	})
+	err = routes.validate()
+	if err != nil {
+		return nil, err
+	}
+	apiSpecH.buf, err = json.Marshal(routes.spec(RELEASE_VERSION))
+	if err != nil {
+		return nil, err
+	}
+
+	// Default Handler. This will serve requests for static requests.
+	webdir := os.Getenv("HTRACED_WEB_DIR")
+	if webdir == "" {
+		webdir, err = filepath.Abs(filepath.Join(filepath.Dir(os.Args[0]), "..", "web"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rsv.lg.Infof(`Serving static files from "%s"`+"\n", webdir)
+	staticH, err := newStaticHandler(rsv.lg, webdir,
+		cnf.GetInt(conf.HTRACE_WEB_STATIC_MAX_AGE_SEC))
+	if err != nil {
+		return nil, err
+	}
+	r.PathPrefix("/").Handler(staticH).Methods("GET")
 
 	// Log an error message for unknown non-GET requests.
 	r.PathPrefix("/").Handler(&logErrorHandler{lg: rsv.lg})
 
+	rsv.router = r
+	rsv.routes = routes
 	rsv.listener = listener
-	rsv.Handler = r
+	rsv.Handler = &authHandler{lg: rsv.lg, az: store.auth, next: r}
 	rsv.ErrorLog = rsv.lg.Wrap("[REST] ", common.INFO)
 	go rsv.Serve(rsv.listener)
-	rsv.lg.Infof("Started REST server on %s\n", rsv.listener.Addr().String())
+	rsv.lg.Infof("Started REST server on %s\n",
+		describeListenAddr(rsv.listener.Addr()))
 	return rsv, nil
 }
 
@@ -0,0 +1,450 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Fetch a URL, optionally with an If-None-Match header.  Returns the response
+// status code, ETag, and body.
+func fetchWithEtag(t *testing.T, url string, etag string) (int, string, []byte) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("failed to create request for %s: %s\n", url, err.Error())
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to fetch %s: %s\n", url, err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("failed to read response body from %s: %s\n", url, err.Error())
+	}
+	return resp.StatusCode, resp.Header.Get("ETag"), body
+}
+
+// Fetch a URL twice, the second time with the ETag returned the first time.
+// Returns the ETag.
+func expectNotModifiedOnRefetch(t *testing.T, url string) string {
+	code, etag, body := fetchWithEtag(t, url, "")
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200 from %s, but got %d\n", url, code)
+	}
+	if etag == "" {
+		t.Fatalf("no ETag returned from %s\n", url)
+	}
+	if len(body) == 0 {
+		t.Fatalf("empty body returned from %s\n", url)
+	}
+	code, _, body = fetchWithEtag(t, url, etag)
+	if code != http.StatusNotModified {
+		t.Fatalf("expected status 304 from %s, but got %d\n", url, code)
+	}
+	if len(body) != 0 {
+		t.Fatalf("expected an empty body with status 304 from %s, but "+
+			"got %d bytes\n", url, len(body))
+	}
+	return etag
+}
+
+func TestRestEtags(t *testing.T) {
+	webDir, err := ioutil.TempDir(os.TempDir(), "TestRestEtags")
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(webDir)
+	err = ioutil.WriteFile(filepath.Join(webDir, "app.js"),
+		[]byte("var foo = 1;\n"), 0644)
+	if err != nil {
+		t.Fatalf("failed to write app.js: %s\n", err.Error())
+	}
+	oldWebDir := os.Getenv("HTRACED_WEB_DIR")
+	os.Setenv("HTRACED_WEB_DIR", webDir)
+	defer os.Setenv("HTRACED_WEB_DIR", oldWebDir)
+	htraceBld := &MiniHTracedBuilder{Name: "TestRestEtags",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	baseUrl := fmt.Sprintf("http://%s", ht.Rsv.Addr().String())
+
+	// Static resources.
+	expectNotModifiedOnRefetch(t, baseUrl+"/app.js")
+
+	// Spans.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	span := createRandomTestSpans(2)[0]
+	err = hcl.WriteSpans([]*common.Span{span})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	spanUrl := fmt.Sprintf("%s/span/%s", baseUrl, span.Id.String())
+	etag := expectNotModifiedOnRefetch(t, spanUrl)
+
+	// The client never sends If-None-Match, so it should get the span.
+	foundSpan, err := hcl.FindSpan(span.Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	common.ExpectSpansEqual(t, span, foundSpan)
+
+	// If the span is rewritten, its ETag should change.
+	span.Description = "a new description"
+	err = hcl.WriteSpans([]*common.Span{span})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	code, newEtag, _ := fetchWithEtag(t, spanUrl, etag)
+	if code != http.StatusOK {
+		t.Fatalf("expected status 200 after rewriting the span, but got %d\n",
+			code)
+	}
+	if newEtag == etag {
+		t.Fatalf("expected the ETag to change after rewriting the span\n")
+	}
+}
+
+// Fetch a URL and check the status code and body.  If expectedBody is empty,
+// the body isn't checked.
+func expectRestResponse(t *testing.T, url string, expectedCode int,
+	expectedBody string) []byte {
+	code, _, body := fetchWithEtag(t, url, "")
+	if code != expectedCode {
+		t.Fatalf("expected status %d from %s, but got %d: %s\n",
+			expectedCode, url, code, string(body))
+	}
+	if expectedBody != "" && string(body) != expectedBody {
+		t.Fatalf("expected body %s from %s, but got %s\n",
+			expectedBody, url, string(body))
+	}
+	return body
+}
+
+// Fetch a URL and check that it returns an error with the given code.
+func expectRestError(t *testing.T, url string, expectedCode common.ErrorCode) {
+	body := expectRestResponse(t, url, expectedCode.HttpStatus(), "")
+	var resp common.ErrorResp
+	err := json.Unmarshal(body, &resp)
+	if err != nil {
+		t.Fatalf("error unmarshalling error response %s from %s: %s\n",
+			string(body), url, err.Error())
+	}
+	if resp.Error.Code != expectedCode {
+		t.Fatalf("expected error code %s from %s, but got %s\n",
+			expectedCode, url, resp.Error.Code)
+	}
+}
+
+func TestRestNotFoundAndEmptyResults(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestRestNotFoundAndEmptyResults",
+		InMemory:     true,
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	createSpans(SIMPLE_TEST_SPANS, ht.Store)
+	baseUrl := fmt.Sprintf("http://%s", ht.Rsv.Addr().String())
+	missing := common.TestId("ffffffffffffffffffffffffffffffff")
+	leaf := SIMPLE_TEST_SPANS[2].Id
+
+	// A missing span is a 404 with a SPAN_NOT_FOUND error.
+	expectRestError(t, baseUrl+"/span/"+missing.String(),
+		common.ERR_SPAN_NOT_FOUND)
+	span, err := hcl.FindSpan(missing)
+	if err != nil || span != nil {
+		t.Fatalf("expected FindSpan of a missing span to return nil, nil\n")
+	}
+	expectRestError(t, baseUrl+"/span/"+missing.String()+"/flame",
+		common.ERR_SPAN_NOT_FOUND)
+	tree, err := hcl.GetFlameTree(missing, 10)
+	if err != nil || tree != nil {
+		t.Fatalf("expected GetFlameTree of a missing span to return nil, nil\n")
+	}
+
+	// Missing children and links are empty results, not errors.
+	for _, sid := range []common.SpanId{missing, leaf} {
+		expectRestResponse(t, baseUrl+"/span/"+sid.String()+"/children?lim=10",
+			http.StatusOK, "[]")
+		children, err := hcl.FindChildren(sid, 10)
+		if err != nil || len(children) != 0 {
+			t.Fatalf("expected no children for %s, but got %v, %v\n",
+				sid.String(), children, err)
+		}
+		expectRestResponse(t, baseUrl+"/span/"+sid.String()+"/links",
+			http.StatusOK, `{"LinksTo":[],"LinkedFrom":[]}`)
+	}
+
+	// A query which matches nothing returns an empty array.
+	expectRestResponse(t, baseUrl+"/query?query="+
+		`{"lim":10,"pred":[{"op":"eq","field":"description","val":"nope"}]}`,
+		http.StatusOK, "[]")
+	spans, err := hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "nope",
+			},
+		},
+		Lim: 10,
+	})
+	if err != nil || len(spans) != 0 {
+		t.Fatalf("expected no query results, but got %v, %v\n", spans, err)
+	}
+
+	// Malformed requests are errors.
+	expectRestError(t, baseUrl+"/span/notanid", common.ERR_BAD_SPAN_ID)
+	expectRestError(t, baseUrl+"/span/"+leaf.String()+"/children",
+		common.ERR_BAD_PARAMETER)
+	expectRestError(t, baseUrl+"/query?query=notjson",
+		common.ERR_QUERY_VALIDATION)
+}
+
+// Test that the client handles both the current and the old server behavior
+// for missing spans.
+func TestClientFindSpanCompatibility(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/span/", func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/span/" + common.TestId("00000000000000000000000000000001").String():
+			// Older servers returned 204 for missing spans.
+			w.WriteHeader(http.StatusNoContent)
+		case "/span/" + common.TestId("00000000000000000000000000000002").String():
+			herr := common.NewHtraceError(common.ERR_SPAN_NOT_FOUND, nil,
+				"No such span")
+			buf, _ := json.Marshal(herr.ToResp())
+			w.WriteHeader(herr.HttpStatus)
+			w.Write(buf)
+		case "/span/" + common.TestId("00000000000000000000000000000003").String():
+			// A 404 without an error body still means the span is missing.
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	cnf := conf.TEST_VALUES()
+	cnf[conf.HTRACE_WEB_ADDRESS] = strings.TrimPrefix(srv.URL, "http://")
+	cnf[conf.HTRACE_HRPC_ADDRESS] = ""
+	hcnf, err := (&conf.Builder{Values: cnf, Defaults: conf.DEFAULTS}).Build()
+	if err != nil {
+		t.Fatalf("failed to build configuration: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(hcnf, nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	for _, id := range []string{"00000000000000000000000000000001",
+		"00000000000000000000000000000002",
+		"00000000000000000000000000000003"} {
+		span, err := hcl.FindSpan(common.TestId(id))
+		if err != nil || span != nil {
+			t.Fatalf("expected FindSpan(%s) to return nil, nil, but got "+
+				"%v, %v\n", id, span, err)
+		}
+	}
+	_, err = hcl.FindSpan(common.TestId("00000000000000000000000000000004"))
+	if common.ErrorCodeOf(err) != common.ERR_INTERNAL {
+		t.Fatalf("expected an internal error, but got %v\n", err)
+	}
+}
+
+// Test that queries without a limit use the default limit, that limits above
+// the maximum are lowered, and that negative limits are rejected.
+func TestQueryLimits(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryLimits",
+		Cnf: map[string]string{
+			conf.HTRACE_QUERY_DEFAULT_LIM: "3",
+			conf.HTRACE_QUERY_MAX_LIM:     "5",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	ingestSpans(ht, createRandomTestSpans(10))
+
+	for _, tc := range []struct {
+		lim         int
+		expectedLim int
+	}{
+		{0, 3},
+		{2, 2},
+		{5, 5},
+		{1000000, 5},
+	} {
+		spans, lim, err := hcl.QueryWithLim(&common.Query{Lim: tc.lim})
+		if err != nil {
+			t.Fatalf("query with limit %d failed: %s\n", tc.lim, err.Error())
+		}
+		if lim != tc.expectedLim || len(spans) != tc.expectedLim {
+			t.Fatalf("expected a query with limit %d to use limit %d and "+
+				"return %d spans, but it used limit %d and returned %d\n",
+				tc.lim, tc.expectedLim, tc.expectedLim, lim, len(spans))
+		}
+	}
+
+	// A query which leaves out the limit entirely uses the default limit.
+	baseUrl := fmt.Sprintf("http://%s", ht.Rsv.Addr().String())
+	body := expectRestResponse(t, baseUrl+"/query?query="+
+		`{"pred":[]}`, http.StatusOK, "")
+	var spans []common.Span
+	err = json.Unmarshal(body, &spans)
+	if err != nil || len(spans) != 3 {
+		t.Fatalf("expected 3 spans from a query without a limit, but got "+
+			"%d, %v\n", len(spans), err)
+	}
+
+	_, _, err = hcl.QueryWithLim(&common.Query{Lim: -1})
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	expectRestError(t, baseUrl+"/query?query="+`{"lim":-1,"pred":[]}`,
+		common.ERR_QUERY_VALIDATION)
+}
+
+func TestQueryHumanTimes(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryHumanTimes",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Spans which began 0, 25, 50, 75, ... minutes ago.
+	now := time.Now()
+	spans := createRandomTestSpans(8)
+	for i := range spans {
+		spans[i].Begin = common.TimeToUnixMs(now.Add(
+			-time.Duration(i) * 25 * time.Minute))
+		spans[i].End = spans[i].Begin + 1
+	}
+	ingestSpans(ht, spans)
+
+	results, err := hcl.Query(&common.Query{Lim: 100,
+		Predicates: []common.Predicate{common.TimePredicateSince(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	if len(results) != 3 {
+		t.Fatalf("expected 3 spans from the last hour, but got %d\n",
+			len(results))
+	}
+
+	// The REST response lists the resolved values.
+	baseUrl := fmt.Sprintf("http://%s", ht.Rsv.Addr().String())
+	begin := spans[2].Begin
+	rfc := time.Unix(0, begin*int64(time.Millisecond)).In(time.FixedZone("", 5*3600+1800)).
+		Format(time.RFC3339Nano)
+	query := fmt.Sprintf(`{"lim":100,"pred":[`+
+		`{"op":"ge","field":"begin","val":"%s"},`+
+		`{"op":"le","field":"begin","val":"now"}]}`, rfc)
+	resp, err := http.Get(baseUrl + "/query?query=" + url.QueryEscape(query))
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("query failed with status %d: %s\n", resp.StatusCode,
+			string(body))
+	}
+	var found []common.Span
+	err = json.Unmarshal(body, &found)
+	if err != nil || len(found) != 3 {
+		t.Fatalf("expected 3 spans since %s, but got %d, %v\n", rfc,
+			len(found), err)
+	}
+	resolved := resp.Header.Get(common.QUERY_RESOLVED_TIMES_HEADER)
+	if !strings.HasPrefix(resolved, fmt.Sprintf("0=%d,1=", begin)) {
+		t.Fatalf("unexpected %s header '%s'\n",
+			common.QUERY_RESOLVED_TIMES_HEADER, resolved)
+	}
+
+	// Integer values are not echoed, and garbage is rejected.
+	resp, err = http.Get(baseUrl + "/query?query=" + url.QueryEscape(
+		fmt.Sprintf(`{"pred":[{"op":"ge","field":"begin","val":"%d"}]}`,
+			begin)))
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if hdr := resp.Header.Get(common.QUERY_RESOLVED_TIMES_HEADER); hdr != "" {
+		t.Fatalf("expected no %s header for an integer time, but got '%s'\n",
+			common.QUERY_RESOLVED_TIMES_HEADER, hdr)
+	}
+	for _, val := range []string{"yesterday", "now-1w", "2024-01-01 10:00"} {
+		_, err = hcl.Query(&common.Query{Predicates: []common.Predicate{
+			common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: val}}})
+		expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// The minimum period between two samples of the Go runtime statistics.
+// runtime.ReadMemStats stops the world, so we don't want to call it too often.
+const MIN_RUNTIME_STATS_PERIOD_MS = 1000
+
+// Periodically samples the Go runtime statistics, so that /server/stats can
+// report them without reading them on every request.
+type RuntimeStatsCollector struct {
+	lg *common.Logger
+
+	// Sends us a message each time we should sample the runtime statistics.
+	hb *Heartbeater
+
+	// The channel which the heartbeater sends to.
+	heartbeats chan interface{}
+
+	// Used to wait for the collector goroutine to exit.
+	exited sync.WaitGroup
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The most recent sample.
+	stats common.RuntimeStats
+
+	// The durations of recent garbage collection pauses, in microseconds.
+	gcPauses *common.CircBufU32
+}
+
+func NewRuntimeStatsCollector(cnf *conf.Config) *RuntimeStatsCollector {
+	periodMs := cnf.GetInt64(conf.HTRACE_METRICS_RUNTIME_PERIOD_MS)
+	if periodMs < MIN_RUNTIME_STATS_PERIOD_MS {
+		periodMs = MIN_RUNTIME_STATS_PERIOD_MS
+	}
+	bufSize := cnf.GetInt(conf.HTRACE_METRICS_GC_PAUSE_BUF_SIZE)
+	if bufSize <= 0 {
+		bufSize = 1
+	}
+	rsc := &RuntimeStatsCollector{
+		lg:         common.NewLogger("metrics", cnf),
+		heartbeats: make(chan interface{}, 1),
+		gcPauses:   common.NewCircBufU32(bufSize),
+	}
+	rsc.collect()
+	rsc.hb = NewHeartbeater("RuntimeStatsHeartbeater", periodMs, rsc.lg)
+	rsc.exited.Add(1)
+	go rsc.run()
+	rsc.hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "runtimeStats",
+		targetChan: rsc.heartbeats,
+	})
+	return rsc
+}
+
+func (rsc *RuntimeStatsCollector) run() {
+	defer func() {
+		rsc.exited.Done()
+	}()
+	for {
+		_, isOpen := <-rsc.heartbeats
+		if !isOpen {
+			return
+		}
+		rsc.collect()
+	}
+}
+
+// Sample the runtime statistics.  The expensive part happens before we take
+// the lock, so that readers of the statistics are never held up by it.
+func (rsc *RuntimeStatsCollector) collect() {
+	var mstats runtime.MemStats
+	runtime.ReadMemStats(&mstats)
+	numGoroutines := runtime.NumGoroutine()
+	numOpenFds := countOpenFds()
+	now := common.TimeToUnixMs(time.Now().UTC())
+
+	rsc.lock.Lock()
+	defer rsc.lock.Unlock()
+	// MemStats.PauseNs holds the most recent pauses in a circular buffer
+	// indexed by GC number.  Pick up the ones we haven't seen yet.
+	first := rsc.stats.NumGc + 1
+	if mstats.NumGC > uint32(len(mstats.PauseNs)) &&
+		first <= mstats.NumGC-uint32(len(mstats.PauseNs)) {
+		first = mstats.NumGC - uint32(len(mstats.PauseNs)) + 1
+	}
+	for gc := first; gc <= mstats.NumGC; gc++ {
+		pauseNs := mstats.PauseNs[(gc+uint32(len(mstats.PauseNs))-1)%
+			uint32(len(mstats.PauseNs))]
+		rsc.gcPauses.Append(uint32(pauseNs / 1000))
+	}
+	rsc.stats = common.RuntimeStats{
+		CollectedMs:      now,
+		NumGoroutines:    numGoroutines,
+		NumOpenFds:       numOpenFds,
+		HeapInuseBytes:   mstats.HeapInuse,
+		HeapAllocBytes:   mstats.HeapAlloc,
+		NumGc:            mstats.NumGC,
+		GcPauseTotalNs:   mstats.PauseTotalNs,
+		MaxGcPauseUs:     rsc.gcPauses.Max(),
+		AverageGcPauseUs: rsc.gcPauses.Average(),
+	}
+}
+
+// Get the most recent sample of the runtime statistics.
+func (rsc *RuntimeStatsCollector) Get() common.RuntimeStats {
+	rsc.lock.Lock()
+	defer rsc.lock.Unlock()
+	return rsc.stats
+}
+
+func (rsc *RuntimeStatsCollector) Shutdown() {
+	rsc.hb.Shutdown()
+	close(rsc.heartbeats)
+	rsc.exited.Wait()
+}
+
+// Count the open file descriptors of this process, or return -1 if we can't.
+// This only works on platforms which have /proc/self/fd.
+func countOpenFds() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return -1
+	}
+	// Don't count the descriptor we opened to read the directory.
+	return len(names) - 1
+}
@@ -0,0 +1,322 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"htrace/common"
+	"htrace/conf"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Saved searches.
+//
+// A saved search is a named query, which is kept in the first shard under
+// SAVED_SEARCH_PREFIX, so that it survives restarts:
+//
+// z[name] -> SavedSearch (JSON)
+//
+// The value of a BEGIN_TIME or END_TIME predicate can be a template
+// parameter, written ${name}.  When the search runs, each parameter is
+// replaced by the value passed for it, or by its default.  A search is
+// validated when it is saved, with its defaults filled in, the same way a
+// query is validated when it runs.  So a search which is saved can always
+// run, unless the parameters passed to it are invalid.
+//
+
+// Matches a predicate value which is a template parameter.
+var searchParamRegexp = regexp.MustCompile(`^\$\{([A-Za-z0-9_]+)\}$`)
+
+// Matches a valid template parameter name.
+var searchParamNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+type savedSearches struct {
+	store *dataStore
+
+	// The maximum number of saved searches.
+	max int
+
+	// Protects searches.
+	lock sync.Mutex
+
+	// The saved searches, by name.
+	searches map[string]*common.SavedSearch
+}
+
+func newSavedSearches(store *dataStore, cnf *conf.Config) *savedSearches {
+	return &savedSearches{
+		store:    store,
+		max:      cnf.GetInt(conf.HTRACE_SAVED_SEARCHES_MAX),
+		searches: make(map[string]*common.SavedSearch),
+	}
+}
+
+func savedSearchKey(name string) []byte {
+	return append([]byte{SAVED_SEARCH_PREFIX}, []byte(name)...)
+}
+
+// Get a fingerprint of an auth token, which identifies the owner of a saved
+// search without giving the token away.
+func tokenOwner(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[0:4])
+}
+
+// Load the saved searches from the first shard.
+func (ss *savedSearches) load() {
+	store := ss.store
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to load the saved searches, because shard "+
+			"%s is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	prefix := []byte{SAVED_SEARCH_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		var search common.SavedSearch
+		err := json.Unmarshal(iter.Value(), &search)
+		if err != nil {
+			store.lg.Errorf("Error parsing saved search %s: %s\n",
+				string(iter.Key()[1:]), err.Error())
+			continue
+		}
+		ss.searches[search.Name] = &search
+	}
+	if len(ss.searches) > 0 {
+		store.lg.Infof("Loaded %d saved search(es).\n", len(ss.searches))
+	}
+}
+
+// Get the query of a saved search, with its template parameters replaced by
+// the values in params, or by their defaults.  The predicates of the query
+// are copied, so the search itself is left alone.
+func instantiateSearch(search *common.SavedSearch,
+	params map[string]string) (*common.Query, error) {
+	for name := range params {
+		if _, ok := search.Params[name]; !ok {
+			return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+				"Saved search %s has no parameter named %s.", search.Name,
+				name)
+		}
+	}
+	query := search.Query
+	query.Predicates = make([]common.Predicate, len(search.Query.Predicates))
+	copy(query.Predicates, search.Query.Predicates)
+	for i := range query.Predicates {
+		pred := &query.Predicates[i]
+		match := searchParamRegexp.FindStringSubmatch(pred.Val)
+		if match == nil {
+			continue
+		}
+		val, ok := params[match[1]]
+		if !ok {
+			val = search.Params[match[1]]
+		}
+		pred.Val = val
+	}
+	return &query, nil
+}
+
+// Check a saved search.  The query is checked by preparing it as if it were
+// about to run, with the defaults of its parameters.
+func (ss *savedSearches) validate(search *common.SavedSearch) error {
+	if search.Name == "" || strings.ContainsAny(search.Name, "/?#") {
+		return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Invalid saved search name '%s'.  The name must be non-empty, "+
+				"and can't contain /, ?, or #.", search.Name)
+	}
+	for name := range search.Params {
+		if !searchParamNameRegexp.MatchString(name) {
+			return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+				"Invalid parameter name '%s'.  Parameter names can only "+
+					"contain letters, digits, and underscores.", name)
+		}
+	}
+	used := make(map[string]bool)
+	for i := range search.Query.Predicates {
+		pred := &search.Query.Predicates[i]
+		match := searchParamRegexp.FindStringSubmatch(pred.Val)
+		if match == nil {
+			continue
+		}
+		problem := ""
+		if pred.Field != common.BEGIN_TIME && pred.Field != common.END_TIME {
+			problem = "only " + string(common.BEGIN_TIME) + " and " +
+				string(common.END_TIME) + " predicates can use template " +
+				"parameters."
+		} else if _, ok := search.Params[match[1]]; !ok {
+			problem = "parameter " + match[1] + " has no default."
+		}
+		if problem != "" {
+			return common.NewHtraceError(common.ERR_QUERY_VALIDATION,
+				map[string]string{
+					common.ERR_DETAIL_PREDICATE: strconv.Itoa(i),
+				}, "Invalid predicate %d: %s", i, problem)
+		}
+		used[match[1]] = true
+	}
+	for name := range search.Params {
+		if !used[name] {
+			return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+				"Parameter %s isn't used by any predicate.", name)
+		}
+	}
+	query, err := instantiateSearch(search, nil)
+	if err != nil {
+		return err
+	}
+	_, err = ss.store.prepareQuery(query, time.Now())
+	return err
+}
+
+// Save a search, replacing any search with the same name.  If token is not
+// empty, the owner of the search is set from it.
+func (ss *savedSearches) Save(search *common.SavedSearch,
+	token string) (*common.SavedSearch, error) {
+	store := ss.store
+	if store.readOnly {
+		return nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't save searches: this server is read-only.")
+	}
+	err := ss.validate(search)
+	if err != nil {
+		return nil, err
+	}
+	saved := *search
+	if token != "" {
+		saved.Owner = tokenOwner(token)
+	}
+	saved.SavedMs = common.TimeToUnixMs(time.Now().UTC())
+	buf, err := json.Marshal(&saved)
+	if err != nil {
+		return nil, err
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.searches[saved.Name] == nil && len(ss.searches) >= ss.max {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"Can't save search %s, because there are already %d saved "+
+				"searches, which is the limit.", saved.Name, ss.max)
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't save search %s, because shard %s, which holds the saved "+
+				"searches, is quarantined.", saved.Name, shd.path)
+	}
+	defer shd.release()
+	err = shd.ldb.Put(store.writeOpts, savedSearchKey(saved.Name), buf)
+	if err != nil {
+		shd.checkCorruption(err)
+		return nil, err
+	}
+	ss.searches[saved.Name] = &saved
+	store.lg.Infof("Saved search %s\n", string(buf))
+	return &saved, nil
+}
+
+// Remove a saved search.
+func (ss *savedSearches) Remove(name string) error {
+	store := ss.store
+	if store.readOnly {
+		return common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't remove saved searches: this server is read-only.")
+	}
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	if ss.searches[name] == nil {
+		return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"There is no saved search named %s.", name)
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't remove saved search %s, because shard %s, which holds "+
+				"the saved searches, is quarantined.", name, shd.path)
+	}
+	defer shd.release()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	batch.Delete(savedSearchKey(name))
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		shd.checkCorruption(err)
+		return err
+	}
+	delete(ss.searches, name)
+	store.lg.Infof("Removed saved search %s\n", name)
+	return nil
+}
+
+type savedSearchList []common.SavedSearch
+
+func (list savedSearchList) Len() int {
+	return len(list)
+}
+
+func (list savedSearchList) Less(i, j int) bool {
+	return list[i].Name < list[j].Name
+}
+
+func (list savedSearchList) Swap(i, j int) {
+	list[i], list[j] = list[j], list[i]
+}
+
+// Get the saved searches, sorted by name.
+func (ss *savedSearches) List() []common.SavedSearch {
+	ss.lock.Lock()
+	defer ss.lock.Unlock()
+	list := make([]common.SavedSearch, 0, len(ss.searches))
+	for _, search := range ss.searches {
+		list = append(list, *search)
+	}
+	sort.Sort(savedSearchList(list))
+	return list
+}
+
+// Get the query of a saved search, ready to run.  See instantiateSearch.
+func (ss *savedSearches) Instantiate(name string,
+	params map[string]string) (*common.Query, error) {
+	ss.lock.Lock()
+	search := ss.searches[name]
+	ss.lock.Unlock()
+	if search == nil {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"There is no saved search named %s.", name)
+	}
+	return instantiateSearch(search, params)
+}
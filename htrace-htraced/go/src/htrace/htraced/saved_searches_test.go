@@ -0,0 +1,269 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"reflect"
+	"testing"
+)
+
+// A search for the spans with a description which began in a time range
+// given by the start and end parameters.
+func newWindowSearch(name string) *common.SavedSearch {
+	return &common.SavedSearch{
+		Name:        name,
+		Description: "Spans of op which began in a window.",
+		Query: common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME, Val: "${start}"},
+				common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME, Val: "${end}"},
+				common.Predicate{Op: common.EQUALS,
+					Field: common.DESCRIPTION, Val: "op"},
+			},
+			Lim: 100,
+		},
+		Params: map[string]string{"start": "0", "end": "now"},
+	}
+}
+
+func spanIdsOf(spans []*common.Span) []common.SpanId {
+	ids := make([]common.SpanId, len(spans))
+	for i := range spans {
+		ids[i] = spans[i].Id
+	}
+	return ids
+}
+
+func TestSavedSearches(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSavedSearches",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := make([]common.Span, 0, 40)
+	for i := 0; i < 40; i++ {
+		desc := "op"
+		if i%4 == 3 {
+			desc = "other"
+		}
+		spans = append(spans, *newTraceGroupTestSpan(i+1,
+			int64(1000+(i*100)), desc))
+	}
+	createSpans(spans, ht.Store)
+
+	saved, err := hcl.SaveSearch(newWindowSearch("window"))
+	if err != nil {
+		t.Fatalf("SaveSearch failed: %s\n", err.Error())
+	}
+	if saved.SavedMs == 0 {
+		t.Fatalf("Expected the server to set SavedMs, but got %s\n",
+			asJson(saved))
+	}
+	searches, err := hcl.GetSavedSearches()
+	if err != nil {
+		t.Fatalf("GetSavedSearches failed: %s\n", err.Error())
+	}
+	if len(searches) != 1 || !reflect.DeepEqual(searches[0], *saved) {
+		t.Fatalf("Expected GetSavedSearches to return %s, but got %s\n",
+			asJson(saved), asJson(searches))
+	}
+
+	// Running the search with overrides returns the same spans as the
+	// equivalent ad-hoc query.
+	adHoc := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "1500"},
+			common.Predicate{Op: common.LESS_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "3200"},
+			common.Predicate{Op: common.EQUALS,
+				Field: common.DESCRIPTION, Val: "op"},
+		},
+		Lim: 100,
+	}
+	expected, err, _ := ht.Store.HandleQuery(adHoc)
+	if err != nil {
+		t.Fatalf("ad-hoc query failed: %s\n", err.Error())
+	}
+	if len(expected) == 0 {
+		t.Fatalf("Expected the ad-hoc query to match some spans.\n")
+	}
+	params := map[string]string{"start": "1500", "end": "3200"}
+	page, err := hcl.RunSavedSearch("window", params, 0, "")
+	if err != nil {
+		t.Fatalf("RunSavedSearch failed: %s\n", err.Error())
+	}
+	if page.HasMore ||
+		!reflect.DeepEqual(spanIdsOf(page.Spans), spanIdsOf(expected)) {
+		t.Fatalf("Expected the saved search to return %s, but got %s\n",
+			asJson(spanIdsOf(expected)), asJson(page))
+	}
+
+	// Pages of the saved search cover the same spans.
+	found := make([]*common.Span, 0, len(expected))
+	after := ""
+	for numPages := 0; ; numPages++ {
+		if numPages > len(expected) {
+			t.Fatalf("Too many pages: got %d spans so far.\n", len(found))
+		}
+		page, err = hcl.RunSavedSearch("window", params, 3, after)
+		if err != nil {
+			t.Fatalf("RunSavedSearch failed: %s\n", err.Error())
+		}
+		if page.Lim != 3 {
+			t.Fatalf("Expected the page limit to be 3, but got %d\n",
+				page.Lim)
+		}
+		found = append(found, page.Spans...)
+		if !page.HasMore {
+			break
+		}
+		after = page.Next
+	}
+	if !reflect.DeepEqual(spanIdsOf(found), spanIdsOf(expected)) {
+		t.Fatalf("Expected the pages to return %s, but got %s\n",
+			asJson(spanIdsOf(expected)), asJson(spanIdsOf(found)))
+	}
+
+	// Parameters which the search doesn't have, and bad parameter values,
+	// are rejected.
+	_, err = hcl.RunSavedSearch("window",
+		map[string]string{"begin": "1500"}, 0, "")
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.RunSavedSearch("window",
+		map[string]string{"end": "tomorrow"}, 0, "")
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+	if idx := err.(*common.HtraceError).PredicateIndex(); idx != 1 {
+		t.Fatalf("Expected the error to be about predicate 1, but it "+
+			"was about %d\n", idx)
+	}
+
+	err = hcl.DeleteSavedSearch("window")
+	if err != nil {
+		t.Fatalf("DeleteSavedSearch failed: %s\n", err.Error())
+	}
+	_, err = hcl.RunSavedSearch("window", nil, 0, "")
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	err = hcl.DeleteSavedSearch("window")
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+}
+
+func TestSavedSearchValidation(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSavedSearchValidation",
+		Cnf: map[string]string{
+			conf.HTRACE_SAVED_SEARCHES_MAX: "1",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	type invalidSearch struct {
+		what   string
+		modify func(search *common.SavedSearch)
+		code   common.ErrorCode
+		// The predicate the error is about, or -1.
+		predIdx int
+	}
+	invalid := []invalidSearch{
+		{"bad name", func(search *common.SavedSearch) {
+			search.Name = "a/b"
+		}, common.ERR_BAD_PARAMETER, -1},
+		{"template on a description", func(search *common.SavedSearch) {
+			search.Query.Predicates[2].Val = "${start}"
+		}, common.ERR_QUERY_VALIDATION, 2},
+		{"no default", func(search *common.SavedSearch) {
+			delete(search.Params, "end")
+		}, common.ERR_QUERY_VALIDATION, 1},
+		{"unused default", func(search *common.SavedSearch) {
+			search.Params["unused"] = "0"
+		}, common.ERR_BAD_PARAMETER, -1},
+		{"bad default", func(search *common.SavedSearch) {
+			search.Params["start"] = "yesterday"
+		}, common.ERR_QUERY_VALIDATION, 0},
+		{"bad op", func(search *common.SavedSearch) {
+			search.Query.Predicates[2].Op = "bogus"
+		}, common.ERR_QUERY_VALIDATION, 2},
+		{"negative limit", func(search *common.SavedSearch) {
+			search.Query.Lim = -1
+		}, common.ERR_QUERY_VALIDATION, -1},
+		{"bad continuation token", func(search *common.SavedSearch) {
+			search.Query.After = "bogus"
+		}, common.ERR_QUERY_VALIDATION, -1},
+	}
+	for i := range invalid {
+		search := newWindowSearch("invalid")
+		invalid[i].modify(search)
+		_, err = hcl.SaveSearch(search)
+		if err == nil {
+			t.Fatalf("%s: expected SaveSearch to fail.\n", invalid[i].what)
+		}
+		expectErrorCode(t, err, invalid[i].code)
+		idx := err.(*common.HtraceError).PredicateIndex()
+		if idx != invalid[i].predIdx {
+			t.Fatalf("%s: expected the error to be about predicate %d, but "+
+				"it was about %d: %s\n", invalid[i].what, invalid[i].predIdx,
+				idx, err.Error())
+		}
+	}
+	searches, err := hcl.GetSavedSearches()
+	if err != nil {
+		t.Fatalf("GetSavedSearches failed: %s\n", err.Error())
+	}
+	if len(searches) != 0 {
+		t.Fatalf("Expected invalid searches not to be saved, but got %s\n",
+			asJson(searches))
+	}
+
+	// A search can be replaced, even when there are as many searches as
+	// allowed, but no more searches can be added.
+	_, err = hcl.SaveSearch(newWindowSearch("window"))
+	if err != nil {
+		t.Fatalf("SaveSearch failed: %s\n", err.Error())
+	}
+	_, err = hcl.SaveSearch(newWindowSearch("window"))
+	if err != nil {
+		t.Fatalf("SaveSearch failed to replace a search: %s\n", err.Error())
+	}
+	_, err = hcl.SaveSearch(newWindowSearch("window2"))
+	expectErrorCode(t, err, common.ERR_BAD_REQUEST)
+}
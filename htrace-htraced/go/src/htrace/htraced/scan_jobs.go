@@ -0,0 +1,415 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Scan jobs.
+//
+// A scan job runs an aggregation over every span in the datastore, without
+// sending the spans over the network.  The jobs are compiled in, and are
+// selected by name; see scanJobFactories.  Each shard is scanned by its own
+// goroutine, with its own aggregator, and the aggregators are merged once
+// every shard is done.
+//
+// The scans read the primary index in batches of scan.job.batch.size spans,
+// opening a new iterator for each batch, so that a long scan doesn't pin old
+// leveldb files.  They run at no more than scan.job.max.spans.per.sec spans
+// per second in total, so that ingest and queries aren't starved.  Only one
+// job can run at a time.  A job can be cancelled between batches, and is
+// cancelled when the datastore is closed.  Nothing is saved, so an
+// interrupted job has to be started again from the beginning.
+//
+
+// An aggregation which a scan job runs over the spans.
+type scanAggregator interface {
+	// Add a span to the aggregation.
+	ProcessSpan(span *common.Span)
+
+	// Merge the aggregation of another shard into this one.  The other
+	// aggregator was made by the same factory.
+	MergeResults(other scanAggregator)
+
+	// Get the result of the aggregation, which will be returned as JSON.
+	Result() interface{}
+}
+
+// Makes a new, empty aggregator.
+type scanAggregatorFactory func() scanAggregator
+
+// The scan jobs which can be run, by name.
+var scanJobFactories = map[string]scanAggregatorFactory{
+	"durationByDescription": func() scanAggregator {
+		return &durationByDescription{durations: make(common.ScanJobDurations)}
+	},
+	"countByTracer": func() scanAggregator {
+		return &countByTracer{counts: make(common.ScanJobCounts)}
+	},
+}
+
+// Get the names of the scan jobs, in sorted order.
+func scanJobNames() []string {
+	names := make([]string, 0, len(scanJobFactories))
+	for name := range scanJobFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Summarizes the span durations for each description.
+type durationByDescription struct {
+	durations common.ScanJobDurations
+}
+
+func (agg *durationByDescription) add(desc string,
+	sum *common.DurationSummary) {
+	cur := agg.durations[desc]
+	if cur == nil {
+		copied := *sum
+		agg.durations[desc] = &copied
+		return
+	}
+	cur.Count += sum.Count
+	cur.TotalMs += sum.TotalMs
+	if sum.MinMs < cur.MinMs {
+		cur.MinMs = sum.MinMs
+	}
+	if sum.MaxMs > cur.MaxMs {
+		cur.MaxMs = sum.MaxMs
+	}
+}
+
+func (agg *durationByDescription) ProcessSpan(span *common.Span) {
+	if span.HasNegativeDuration() {
+		// The span's clock went backwards, so its duration is meaningless.
+		return
+	}
+	durMs := span.Duration()
+	agg.add(span.Description, &common.DurationSummary{
+		Count:   1,
+		TotalMs: durMs,
+		MinMs:   durMs,
+		MaxMs:   durMs,
+	})
+}
+
+func (agg *durationByDescription) MergeResults(other scanAggregator) {
+	for desc, sum := range other.(*durationByDescription).durations {
+		agg.add(desc, sum)
+	}
+}
+
+func (agg *durationByDescription) Result() interface{} {
+	return agg.durations
+}
+
+// Counts the spans with each tracer ID.
+type countByTracer struct {
+	counts common.ScanJobCounts
+}
+
+func (agg *countByTracer) ProcessSpan(span *common.Span) {
+	agg.counts[span.TracerId]++
+}
+
+func (agg *countByTracer) MergeResults(other scanAggregator) {
+	for trid, count := range other.(*countByTracer).counts {
+		agg.counts[trid] += count
+	}
+}
+
+func (agg *countByTracer) Result() interface{} {
+	return agg.counts
+}
+
+// A scan job which is running or has finished.
+type scanJob struct {
+	// Protects status.
+	lock sync.Mutex
+
+	status common.ScanJobStatus
+
+	// Closed to stop the job.
+	stop chan struct{}
+
+	// Protects against closing stop twice.
+	stopOnce sync.Once
+
+	// Tracks whether the job's goroutines have exited.
+	exited sync.WaitGroup
+}
+
+func (job *scanJob) getStatus() *common.ScanJobStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := job.status
+	return &status
+}
+
+func (job *scanJob) cancel() {
+	job.stopOnce.Do(func() {
+		close(job.stop)
+	})
+}
+
+// Get the status of the most recent scan job.
+func (store *dataStore) ScanJobStatus() *common.ScanJobStatus {
+	store.scanLock.Lock()
+	job := store.scan
+	store.scanLock.Unlock()
+	if job == nil {
+		return &common.ScanJobStatus{
+			State:       common.SCAN_JOB_NONE,
+			TotalShards: len(store.shards),
+		}
+	}
+	return job.getStatus()
+}
+
+// Start the scan job with the given name.  The shards are scanned in the
+// background.
+func (store *dataStore) StartScanJob(name string) (*common.ScanJobStatus, error) {
+	factory := scanJobFactories[name]
+	if factory == nil {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Unknown scan job '%s'.  Valid scan jobs are %s.", name,
+			strings.Join(scanJobNames(), ", "))
+	}
+	store.scanLock.Lock()
+	defer store.scanLock.Unlock()
+	if store.scan != nil &&
+		store.scan.getStatus().State == common.SCAN_JOB_RUNNING {
+		return nil, common.NewHtraceError(common.ERR_CONFLICT, nil,
+			"The scan job %s is already running.",
+			store.scan.getStatus().Name)
+	}
+	job := &scanJob{
+		status: common.ScanJobStatus{
+			State:       common.SCAN_JOB_RUNNING,
+			Name:        name,
+			StartMs:     common.TimeToUnixMs(time.Now().UTC()),
+			TotalShards: len(store.shards),
+		},
+		stop: make(chan struct{}),
+	}
+	store.scan = job
+	store.lg.Infof("Started the scan job %s.\n", name)
+	job.exited.Add(1)
+	go job.run(store, factory)
+	return job.getStatus(), nil
+}
+
+// Cancel the running scan job, and wait for it to stop.  Returns the status
+// of the most recent scan job.
+func (store *dataStore) CancelScanJob() (*common.ScanJobStatus, error) {
+	store.scanLock.Lock()
+	job := store.scan
+	store.scanLock.Unlock()
+	if job == nil || job.getStatus().State != common.SCAN_JOB_RUNNING {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"No scan job is running.")
+	}
+	job.cancel()
+	job.exited.Wait()
+	return job.getStatus(), nil
+}
+
+// Stop the running scan job, if there is one, and wait for it to exit.
+func (store *dataStore) stopScanJob() {
+	store.scanLock.Lock()
+	job := store.scan
+	store.scanLock.Unlock()
+	if job != nil {
+		job.cancel()
+		job.exited.Wait()
+	}
+}
+
+var errScanJobCancelled = errors.New("The scan job was cancelled.")
+
+// Scan every shard in parallel, and merge the results.
+func (job *scanJob) run(store *dataStore, factory scanAggregatorFactory) {
+	defer job.exited.Done()
+	aggs := make([]scanAggregator, len(store.shards))
+	errs := make([]error, len(store.shards))
+	var wg sync.WaitGroup
+	for shdIdx := range store.shards {
+		aggs[shdIdx] = factory()
+		wg.Add(1)
+		go func(shdIdx int) {
+			defer wg.Done()
+			errs[shdIdx] = job.scanShard(store, store.shards[shdIdx],
+				aggs[shdIdx])
+			if errs[shdIdx] != nil && errs[shdIdx] != errScanJobCancelled {
+				// There is no point in scanning the other shards.
+				job.cancel()
+			}
+		}(shdIdx)
+	}
+	wg.Wait()
+	var err error
+	for shdIdx := range errs {
+		if errs[shdIdx] != nil &&
+			(err == nil || err == errScanJobCancelled) {
+			err = errs[shdIdx]
+		}
+	}
+	var result []byte
+	if err == nil {
+		for shdIdx := 1; shdIdx < len(aggs); shdIdx++ {
+			aggs[0].MergeResults(aggs[shdIdx])
+		}
+		result, err = json.Marshal(aggs[0].Result())
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.EndMs = common.TimeToUnixMs(time.Now().UTC())
+	switch {
+	case err == errScanJobCancelled:
+		job.status.State = common.SCAN_JOB_CANCELLED
+		store.lg.Infof("The scan job %s was cancelled after scanning %d "+
+			"span(s).\n", job.status.Name, job.status.ScannedSpans)
+	case err != nil:
+		job.status.State = common.SCAN_JOB_FAILED
+		job.status.Error = err.Error()
+		store.lg.Errorf("The scan job %s failed: %s\n", job.status.Name,
+			err.Error())
+	default:
+		job.status.State = common.SCAN_JOB_DONE
+		job.status.Result = result
+		store.lg.Infof("Finished the scan job %s in %d ms.  Scanned %d "+
+			"span(s).\n", job.status.Name,
+			job.status.EndMs-job.status.StartMs, job.status.ScannedSpans)
+	}
+}
+
+// Scan a shard one batch at a time.
+func (job *scanJob) scanShard(store *dataStore, shd *shard,
+	agg scanAggregator) error {
+	var cursor []byte
+	for {
+		select {
+		case <-job.stop:
+			return errScanJobCancelled
+		default:
+		}
+		startTime := time.Now()
+		numScanned, done, err := job.scanBatch(store, shd, agg, &cursor)
+		if err != nil {
+			return err
+		}
+		job.lock.Lock()
+		job.status.ScannedSpans += uint64(numScanned)
+		if done {
+			job.status.ShardsDone++
+		}
+		job.lock.Unlock()
+		if done {
+			return nil
+		}
+		err = job.throttle(store, numScanned, startTime)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Scan the next batch of a shard, starting after the cursor.  Returns the
+// number of spans scanned, and whether the shard is done.
+func (job *scanJob) scanBatch(store *dataStore, shd *shard,
+	agg scanAggregator, cursor *[]byte) (int, bool, error) {
+	if !shd.acquire() {
+		return 0, false, common.NewHtraceError(common.ERR_SHARD_QUARANTINED,
+			nil, "Can't scan shard %s, because it is quarantined.", shd.path)
+	}
+	defer shd.release()
+	prefix := []byte{SPAN_ID_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(store.bulkOpts)
+	defer iter.Close()
+	if *cursor == nil {
+		iter.Seek(prefix)
+	} else {
+		iter.Seek(*cursor)
+		if iter.Valid() && bytes.Equal(iter.Key(), *cursor) {
+			iter.Next()
+		}
+	}
+	numScanned := 0
+	for ; iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if numScanned >= store.scanBatchSize {
+			break
+		}
+		numScanned++
+		*cursor = append((*cursor)[:0], key...)
+		sid := common.SpanId(key[1:])
+		buf, err := shd.openSpanRecord(sid, iter.Value())
+		if err != nil {
+			return numScanned, false, err
+		}
+		span, err := decodeSpan(sid, buf)
+		if err != nil {
+			return numScanned, false, errors.New(fmt.Sprintf("Error "+
+				"decoding span %s in shard %s: %s", sid.String(), shd.path,
+				err.Error()))
+		}
+		agg.ProcessSpan(span)
+	}
+	if err := iter.GetError(); err != nil {
+		shd.checkCorruption(err)
+		return numScanned, false, err
+	}
+	return numScanned, numScanned < store.scanBatchSize, nil
+}
+
+// Wait long enough that scanning numScanned spans of one shard since
+// startTime keeps the whole job within scan.job.max.spans.per.sec.
+func (job *scanJob) throttle(store *dataStore, numScanned int,
+	startTime time.Time) error {
+	if store.scanMaxRate <= 0 {
+		return nil
+	}
+	delay := time.Duration(numScanned*len(store.shards))*time.Second/
+		time.Duration(store.scanMaxRate) - time.Since(startTime)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-job.stop:
+		return errScanJobCancelled
+	}
+}
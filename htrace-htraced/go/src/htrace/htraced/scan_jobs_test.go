@@ -0,0 +1,204 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"math/rand"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Wait for the scan job to stop running, and return its status.
+func waitForScanJob(t *testing.T, hcl *htrace.Client) *common.ScanJobStatus {
+	for {
+		status, err := hcl.ScanJobStatus()
+		if err != nil {
+			t.Fatalf("ScanJobStatus failed: %s\n", err.Error())
+		}
+		if status.State != common.SCAN_JOB_RUNNING {
+			return status
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScanJobs(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestScanJobs",
+		Cnf: map[string]string{
+			conf.HTRACE_SCAN_JOB_BATCH_SIZE: "16",
+			conf.HTRACE_SCAN_JOB_MAX_RATE:   "0",
+		},
+		DataDirs:     make([]string, 3),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	status, err := hcl.ScanJobStatus()
+	if err != nil {
+		t.Fatalf("ScanJobStatus failed: %s\n", err.Error())
+	}
+	if status.State != common.SCAN_JOB_NONE || status.TotalShards != 3 {
+		t.Fatalf("Unexpected initial status %s\n", asJson(status))
+	}
+	_, err = hcl.StartScanJob("uploadedCode")
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.CancelScanJob()
+	expectErrorCode(t, err, common.ERR_BAD_REQUEST)
+
+	rnd := rand.New(rand.NewSource(1))
+	spans := createRandomTestSpans(250)
+	expected := make(common.ScanJobDurations)
+	expectedCounts := make(common.ScanJobCounts)
+	for i := range spans {
+		spans[i].Description = fmt.Sprintf("op%d", rnd.Intn(5))
+		spans[i].TracerId = fmt.Sprintf("tracer%d", rnd.Intn(3))
+		spans[i].BeginNs = 0
+		spans[i].EndNs = 0
+		spans[i].End = spans[i].Begin + rnd.Int63n(1000)
+		durMs := spans[i].End - spans[i].Begin
+		sum := expected[spans[i].Description]
+		if sum == nil {
+			sum = &common.DurationSummary{MinMs: durMs, MaxMs: durMs}
+			expected[spans[i].Description] = sum
+		}
+		sum.Count++
+		sum.TotalMs += durMs
+		if durMs < sum.MinMs {
+			sum.MinMs = durMs
+		}
+		if durMs > sum.MaxMs {
+			sum.MaxMs = durMs
+		}
+		expectedCounts[spans[i].TracerId]++
+	}
+	ingestSpans(ht, spans)
+
+	status, err = hcl.StartScanJob("durationByDescription")
+	if err != nil {
+		t.Fatalf("StartScanJob failed: %s\n", err.Error())
+	}
+	if status.Name != "durationByDescription" {
+		t.Fatalf("Unexpected status %s\n", asJson(status))
+	}
+	status = waitForScanJob(t, hcl)
+	if status.State != common.SCAN_JOB_DONE ||
+		status.ScannedSpans != uint64(len(spans)) || status.ShardsDone != 3 ||
+		status.EndMs < status.StartMs {
+		t.Fatalf("Unexpected status %s\n", asJson(status))
+	}
+	var durations common.ScanJobDurations
+	err = json.Unmarshal(status.Result, &durations)
+	if err != nil {
+		t.Fatalf("Error parsing the result %s: %s\n", string(status.Result),
+			err.Error())
+	}
+	if !reflect.DeepEqual(durations, expected) {
+		t.Fatalf("Expected durations %s, but got %s\n", asJson(expected),
+			asJson(durations))
+	}
+
+	status, err = hcl.StartScanJob("countByTracer")
+	if err != nil {
+		t.Fatalf("StartScanJob failed: %s\n", err.Error())
+	}
+	status = waitForScanJob(t, hcl)
+	var counts common.ScanJobCounts
+	err = json.Unmarshal(status.Result, &counts)
+	if err != nil {
+		t.Fatalf("Error parsing the result %s: %s\n", string(status.Result),
+			err.Error())
+	}
+	if status.State != common.SCAN_JOB_DONE ||
+		!reflect.DeepEqual(counts, expectedCounts) {
+		t.Fatalf("Expected counts %s, but got %s\n", asJson(expectedCounts),
+			asJson(status))
+	}
+}
+
+func TestCancelScanJob(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestCancelScanJob",
+		Cnf: map[string]string{
+			conf.HTRACE_SCAN_JOB_BATCH_SIZE: "5",
+			conf.HTRACE_SCAN_JOB_MAX_RATE:   "100",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(300)
+	ingestSpans(ht, spans)
+
+	// At 100 spans per second, scanning every span would take 3 seconds.
+	_, err = hcl.StartScanJob("countByTracer")
+	if err != nil {
+		t.Fatalf("StartScanJob failed: %s\n", err.Error())
+	}
+	_, err = hcl.StartScanJob("durationByDescription")
+	expectErrorCode(t, err, common.ERR_CONFLICT)
+	common.WaitFor(time.Minute, time.Millisecond, func() bool {
+		return ht.Store.ScanJobStatus().ScannedSpans > 0
+	})
+	status, err := hcl.CancelScanJob()
+	if err != nil {
+		t.Fatalf("CancelScanJob failed: %s\n", err.Error())
+	}
+	if status.State != common.SCAN_JOB_CANCELLED ||
+		status.ScannedSpans >= uint64(len(spans)) || status.Result != nil {
+		t.Fatalf("Unexpected status %s\n", asJson(status))
+	}
+
+	// Nothing is scanned once the job is cancelled.
+	time.Sleep(200 * time.Millisecond)
+	status2 := ht.Store.ScanJobStatus()
+	if status2.ScannedSpans != status.ScannedSpans {
+		t.Fatalf("The job scanned %d more span(s) after it was cancelled.\n",
+			status2.ScannedSpans-status.ScannedSpans)
+	}
+
+	// Another job can be started now.
+	_, err = hcl.StartScanJob("durationByDescription")
+	if err != nil {
+		t.Fatalf("StartScanJob failed: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,282 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// When datastore.sequence.numbers is enabled, the shard goroutine assigns
+// each span a 64-bit sequence number right before writing it.  The sequence
+// number is written in the same leveldb batch as the span itself, so every
+// span which is committed has one.  Sequence numbers are unique within a
+// datastore and never reused.  Within one run of htraced, the spans which
+// were written successfully have consecutive sequence numbers; a write which
+// fails leaves a gap.
+//
+// As with arrival times, spans from different shards can become visible out
+// of sequence order.  Readers only see spans whose sequence numbers are below
+// the sequence watermark, which is the first sequence number of the oldest
+// batch currently being written.
+//
+// To make sure that sequence numbers never go backwards across restarts, they
+// are reserved in blocks of SEQUENCE_RESERVATION_SIZE.  Each span write also
+// records the end of the current reservation in its shard, and at startup we
+// continue from the largest reservation found in any shard.  So each restart
+// skips the unused part of the last reservation.
+
+// The number of sequence numbers we reserve at once.
+const SEQUENCE_RESERVATION_SIZE = 100000
+
+// The key holding the end of the sequence number reservation.
+const SEQUENCE_LIMIT_KEY = 'l'
+
+type seqAllocator struct {
+	// Protects next and limit, as well as the writingSeq field of each shard.
+	lock sync.Mutex
+
+	// The next sequence number to assign.
+	next uint64
+
+	// The end of the current reservation.  All the sequence numbers we have
+	// assigned are less than this.
+	limit uint64
+}
+
+func seqIndexKey(seq uint64, sid common.SpanId) []byte {
+	return append(append([]byte{SEQUENCE_INDEX_PREFIX}, u64toSlice(seq)...),
+		sid.Val()...)
+}
+
+func spanSeqKey(sid common.SpanId) []byte {
+	return append([]byte{SPAN_SEQUENCE_PREFIX}, sid.Val()...)
+}
+
+// Read the end of the sequence number reservation recorded in a shard, or 0
+// if there is none.  The caller must hold the shard.
+func (shd *shard) readSeqLimit() uint64 {
+	buf, err := shd.ldb.Get(shd.store.readOpts, []byte{SEQUENCE_LIMIT_KEY})
+	if err != nil {
+		shd.store.lg.Warnf("Error reading the sequence number reservation "+
+			"from shard %s: %s\n", shd.path, err.Error())
+		return 0
+	}
+	if len(buf) != 8 {
+		return 0
+	}
+	return keyToU64(buf)
+}
+
+// Make sure that we never assign a sequence number less than limit.
+func (store *dataStore) advanceSeqs(limit uint64) {
+	seqs := &store.seqs
+	seqs.lock.Lock()
+	defer seqs.lock.Unlock()
+	if limit > seqs.next {
+		seqs.next = limit
+	}
+	if seqs.next > seqs.limit {
+		seqs.limit = seqs.next
+	}
+}
+
+// Initialize the sequence number allocator from the reservations recorded in
+// the shards.  Sequence number 0 means "no sequence number," so we start at 1.
+func (store *dataStore) loadSeqLimit() {
+	store.advanceSeqs(1)
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if shd.acquire() {
+			store.advanceSeqs(shd.readSeqLimit())
+			shd.release()
+		}
+	}
+	store.lg.Infof("The next sequence number is %d\n", store.seqs.next)
+}
+
+// Allocate n sequence numbers for a batch of spans which the given shard is
+// about to write.  Returns the first sequence number, and the end of the
+// reservation to record in the shard.
+func (store *dataStore) beginSeqs(shd *shard, n int) (uint64, uint64) {
+	seqs := &store.seqs
+	seqs.lock.Lock()
+	defer seqs.lock.Unlock()
+	first := seqs.next
+	seqs.next += uint64(n)
+	if seqs.next > seqs.limit {
+		seqs.limit = seqs.next + SEQUENCE_RESERVATION_SIZE
+	}
+	shd.writingSeq = first
+	return first, seqs.limit
+}
+
+// Mark the end of writing a batch of spans.
+func (store *dataStore) endSeqs(shd *shard) {
+	store.seqs.lock.Lock()
+	defer store.seqs.lock.Unlock()
+	shd.writingSeq = 0
+}
+
+// Get the sequence watermark.  All spans with a sequence number strictly less
+// than the watermark are visible.
+func (store *dataStore) seqWatermark() uint64 {
+	store.seqs.lock.Lock()
+	defer store.seqs.lock.Unlock()
+	watermark := store.seqs.next
+	for shdIdx := range store.shards {
+		writingSeq := store.shards[shdIdx].writingSeq
+		if writingSeq != 0 && writingSeq < watermark {
+			watermark = writingSeq
+		}
+	}
+	return watermark
+}
+
+// Find the sequence number of a span in this shard, or 0 if it has none.
+func (shd *shard) findSpanSeq(sid common.SpanId) uint64 {
+	buf, err := shd.ldb.Get(shd.store.readOpts, spanSeqKey(sid))
+	if err != nil {
+		if strings.Index(err.Error(), "NotFound:") != -1 {
+			return 0
+		}
+		shd.store.lg.Warnf("Shard(%s): findSpanSeq(%s) error: %s\n",
+			shd.path, sid.String(), err.Error())
+		shd.checkCorruption(err)
+		return 0
+	}
+	if len(buf) != 8 {
+		return 0
+	}
+	return keyToU64(buf)
+}
+
+// Find the sequence number of a span, or 0 if it has none.
+func (store *dataStore) FindSpanSeq(sid common.SpanId) uint64 {
+	val, found := store.findInSpanShards(sid,
+		func(shd *shard) (interface{}, bool) {
+			seq := shd.findSpanSeq(sid)
+			return seq, seq != 0
+		})
+	if !found {
+		return 0
+	}
+	return val.(uint64)
+}
+
+// An entry in the sequence number index.
+type seqEntry struct {
+	// The sequence number index key.
+	key []byte
+
+	// The shard containing the entry.
+	shd *shard
+}
+
+type seqEntrySlice []seqEntry
+
+func (s seqEntrySlice) Len() int {
+	return len(s)
+}
+
+func (s seqEntrySlice) Less(i, j int) bool {
+	return bytes.Compare(s[i].key, s[j].key) < 0
+}
+
+func (s seqEntrySlice) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// Read up to lim sequence number index entries which come at or after
+// startKey and before endKey.
+func (shd *shard) findSeqs(startKey []byte, endKey []byte, lim int,
+	entries []seqEntry) []seqEntry {
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	numFound := 0
+	for iter.Seek(startKey); iter.Valid() && numFound < lim; iter.Next() {
+		key := iter.Key()
+		if len(key) != 25 || bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		entries = append(entries, seqEntry{key: key, shd: shd})
+		numFound++
+	}
+	return entries
+}
+
+// Find up to lim spans whose sequence numbers are at least fromSeq, in
+// sequence number order.  Each span has its Seq field set.  Returns the spans
+// and the sequence number to continue the search from.
+//
+// Spans which are deleted between the time we read the sequence number index
+// and the time we look them up are skipped.
+func (store *dataStore) FindSpansBySeq(fromSeq uint64,
+	lim int) ([]*common.Span, uint64) {
+	spans := make([]*common.Span, 0, lim)
+	watermark := store.seqWatermark()
+	if lim <= 0 || fromSeq >= watermark {
+		return spans, fromSeq
+	}
+	startKey := seqIndexKey(fromSeq, common.INVALID_SPAN_ID)
+	endKey := append([]byte{SEQUENCE_INDEX_PREFIX}, u64toSlice(watermark)...)
+	entries := make([]seqEntry, 0, lim)
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if shd.acquire() {
+			entries = shd.findSeqs(startKey, endKey, lim, entries)
+			shd.release()
+		}
+	}
+	sort.Sort(seqEntrySlice(entries))
+	if len(entries) < lim {
+		// We have seen every span below the watermark.
+		return store.lookupSeqEntries(entries, spans), watermark
+	}
+	entries = entries[0:lim]
+	nextSeq := keyToU64(entries[lim-1].key[1:9]) + 1
+	return store.lookupSeqEntries(entries, spans), nextSeq
+}
+
+// Look up the spans for some sequence number index entries.
+func (store *dataStore) lookupSeqEntries(entries []seqEntry,
+	spans []*common.Span) []*common.Span {
+	for i := range entries {
+		sid := common.SpanId(entries[i].key[9:25])
+		var span *common.Span
+		if entries[i].shd.acquire() {
+			span = entries[i].shd.FindSpan(sid)
+			entries[i].shd.release()
+		}
+		if span == nil {
+			if store.lg.DebugEnabled() {
+				store.lg.Debugf("FindSpansBySeq: span %s was deleted "+
+					"before we could read it.\n", sid.String())
+			}
+			continue
+		}
+		span.Seq = keyToU64(entries[i].key[1:9])
+		spans = append(spans, span)
+	}
+	return spans
+}
@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Read every span with a sequence number at or after fromSeq, using small
+// requests so that we exercise the continuation.
+func scanSpansBySeq(t *testing.T, hcl *htrace.Client,
+	fromSeq uint64) []*common.Span {
+	spans := make([]*common.Span, 0)
+	for {
+		resp, err := hcl.FindSpansBySeq(fromSeq, 7)
+		if err != nil {
+			t.Fatalf("FindSpansBySeq(%d) failed: %s\n", fromSeq, err.Error())
+		}
+		spans = append(spans, resp.Spans...)
+		if resp.NextSeq == fromSeq {
+			return spans
+		}
+		if resp.NextSeq < fromSeq {
+			t.Fatalf("FindSpansBySeq(%d) went backwards to %d\n",
+				fromSeq, resp.NextSeq)
+		}
+		fromSeq = resp.NextSeq
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	const NUM_INGESTORS = 4
+	const SPANS_PER_INGESTOR = 50
+	const NUM_TEST_SPANS = NUM_INGESTORS * SPANS_PER_INGESTOR
+	htraceBld := &MiniHTracedBuilder{Name: "TestSequenceNumbers",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_SEQUENCE_NUMBERS:    "true",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		DataDirs:            make([]string, 3),
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS + 1)
+
+	// Ingest the spans from several goroutines at once.
+	var wg sync.WaitGroup
+	for i := 0; i < NUM_INGESTORS; i++ {
+		wg.Add(1)
+		go func(spans []*common.Span) {
+			defer wg.Done()
+			ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+			for j := range spans {
+				ing.IngestSpan(spans[j])
+			}
+			ing.Close(time.Now())
+		}(allSpans[i*SPANS_PER_INGESTOR : (i+1)*SPANS_PER_INGESTOR])
+	}
+	wg.Wait()
+	ht.Store.WrittenSpans.Waits(NUM_TEST_SPANS)
+
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	spans := scanSpansBySeq(t, hcl, 0)
+	if len(spans) != NUM_TEST_SPANS {
+		t.Fatalf("Expected %d spans, but got %d\n", NUM_TEST_SPANS, len(spans))
+	}
+	seen := make(map[string]bool)
+	for i := range spans {
+		if spans[i].Seq != uint64(i+1) {
+			t.Fatalf("Expected span %d to have sequence number %d, but it "+
+				"had %d\n", i, i+1, spans[i].Seq)
+		}
+		if seen[spans[i].Id.String()] {
+			t.Fatalf("Span %s was returned more than once.\n",
+				spans[i].Id.String())
+		}
+		seen[spans[i].Id.String()] = true
+	}
+	for i := 0; i < NUM_TEST_SPANS; i++ {
+		if !seen[allSpans[i].Id.String()] {
+			t.Fatalf("Span %s was not returned.\n", allSpans[i].Id.String())
+		}
+	}
+
+	// Looking up a span by id should return its sequence number.
+	span, err := hcl.FindSpan(spans[3].Id)
+	if err != nil {
+		t.Fatalf("FindSpan failed: %s\n", err.Error())
+	}
+	if span.Seq != 4 {
+		t.Fatalf("Expected FindSpan to return sequence number 4, but got "+
+			"%d\n", span.Seq)
+	}
+	hcl.Close()
+	ht.Close()
+	ht = nil
+
+	// After a restart, new spans get sequence numbers greater than any we
+	// assigned before.
+	htraceBld = &MiniHTracedBuilder{Name: "TestSequenceNumbers2",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_SEQUENCE_NUMBERS:    "true",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err = htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to reopen datastore: %s", err.Error())
+	}
+	ingestSpans(ht, allSpans[NUM_TEST_SPANS:])
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans = scanSpansBySeq(t, hcl, NUM_TEST_SPANS+1)
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 new span, but got %d\n", len(spans))
+	}
+	if !spans[0].Id.Equal(allSpans[NUM_TEST_SPANS].Id) {
+		t.Fatalf("Expected span %s, but got %s\n",
+			allSpans[NUM_TEST_SPANS].Id.String(), spans[0].Id.String())
+	}
+	if spans[0].Seq <= NUM_TEST_SPANS {
+		t.Fatalf("Sequence number %d went backwards after a restart.\n",
+			spans[0].Seq)
+	}
+}
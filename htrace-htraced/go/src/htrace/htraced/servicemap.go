@@ -0,0 +1,250 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sort"
+	"sync/atomic"
+)
+
+// The service map shows which tracers call which.  We build it by scanning the
+// begin time index of each shard for the spans in a time window, and then
+// looking up the parents of those spans to find their tracer ids.  Parents
+// which are themselves in the window don't need to be looked up again.  The
+// others are grouped by the shard their id hashes to, and looked up in key
+// order with a single iterator per shard, rather than with a point read each.
+//
+// The scan limit is divided evenly between the shards, so that a partial map
+// still covers the whole window rather than just the first few shards.
+
+// The fields of a span which the service map needs.  The field tags must match
+// those of common.SpanData.
+type serviceMapSpanData struct {
+	Begin    int64           `json:"b"`
+	End      int64           `json:"e"`
+	Parents  []common.SpanId `json:"p"`
+	TracerId string          `json:"r"`
+}
+
+type serviceMapEdgeKey struct {
+	parent string
+	child  string
+}
+
+type serviceMapEdges []common.ServiceMapEdge
+
+func (edges serviceMapEdges) Len() int {
+	return len(edges)
+}
+
+func (edges serviceMapEdges) Less(i, j int) bool {
+	if edges[i].Parent != edges[j].Parent {
+		return edges[i].Parent < edges[j].Parent
+	}
+	return edges[i].Child < edges[j].Child
+}
+
+func (edges serviceMapEdges) Swap(i, j int) {
+	edges[i], edges[j] = edges[j], edges[i]
+}
+
+// Scan the shard for spans which begin in [beginMs, endMs), and add them to
+// spans.  At most lim spans are added.  Returns true if there were more.
+func (shd *shard) scanServiceMapSpans(beginMs int64, endMs int64, lim int,
+	spans map[string]*serviceMapSpanData) bool {
+	lg := shd.store.lg
+	searchKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(beginMs))...)
+	endKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(endMs))...)
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	numSpans := 0
+	for iter.Seek(searchKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if numSpans >= lim {
+			return true
+		}
+		sid := common.SpanId(key[9:])
+		buf := shd.findSpanBytes(sid)
+		if buf == nil {
+			// The span was reaped after we read the index entry.
+			continue
+		}
+		data := &serviceMapSpanData{}
+		err := decodeSpanBytes(buf, data)
+		if err != nil {
+			lg.Warnf("Shard(%s): scanServiceMapSpans: error decoding span "+
+				"%s: %s\n", shd.path, sid.String(), err.Error())
+			continue
+		}
+		spans[string(sid)] = data
+		numSpans++
+	}
+	return false
+}
+
+// Find the tracer ids of the given spans in this shard, and add them to
+// tracerIds.  The span ids must be sorted.
+func (shd *shard) findTracerIds(sids []common.SpanId,
+	tracerIds map[string]string) {
+	lg := shd.store.lg
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	for i := range sids {
+		key := append([]byte{SPAN_ID_INDEX_PREFIX}, sids[i].Val()...)
+		iter.Seek(key)
+		if !iter.Valid() || !bytes.Equal(iter.Key(), key) {
+			continue
+		}
+		buf, err := shd.openSpanRecord(sids[i], iter.Value())
+		if err != nil {
+			lg.Warnf("Shard(%s): findTracerIds: %s\n", shd.path, err.Error())
+			continue
+		}
+		var data partialSpanData
+		err = decodeSpanBytes(buf, &data)
+		if err != nil {
+			lg.Warnf("Shard(%s): findTracerIds: error decoding span %s: %s\n",
+				shd.path, sids[i].String(), err.Error())
+			continue
+		}
+		tracerIds[string(sids[i])] = data.TracerId
+	}
+}
+
+// Build the service map for spans which begin in [beginMs, endMs).  At most
+// lim spans are scanned.
+func (store *dataStore) BuildServiceMap(beginMs int64, endMs int64,
+	lim int) *common.ServiceMap {
+	smap := &common.ServiceMap{
+		BeginMs: beginMs,
+		EndMs:   endMs,
+		Edges:   make([]common.ServiceMapEdge, 0),
+	}
+	numShards := len(store.shards)
+	shardLim := (lim + numShards - 1) / numShards
+	spans := make(map[string]*serviceMapSpanData)
+	for i := range store.shards {
+		shd := store.shards[i]
+		if !shd.acquire() {
+			continue
+		}
+		if shd.scanServiceMapSpans(beginMs, endMs, shardLim, spans) {
+			smap.Partial = true
+		}
+		shd.release()
+	}
+	smap.NumSpans = len(spans)
+
+	// Find the tracer ids of the parents which were not in the window.
+	tracerIds := make(map[string]string)
+	for sid, data := range spans {
+		tracerIds[sid] = data.TracerId
+	}
+	lookups := make(map[string]bool)
+	lookupsByShard := make([][]common.SpanId, numShards)
+	for _, data := range spans {
+		for _, pid := range data.Parents {
+			if _, found := tracerIds[string(pid)]; found || lookups[string(pid)] {
+				continue
+			}
+			lookups[string(pid)] = true
+			shdIdx := store.getShardIndex(pid)
+			lookupsByShard[shdIdx] = append(lookupsByShard[shdIdx], pid)
+		}
+	}
+	for i := range store.shards {
+		if len(lookupsByShard[i]) == 0 {
+			continue
+		}
+		sort.Sort(common.SpanIdSlice(lookupsByShard[i]))
+		shd := store.shards[i]
+		if shd.acquire() {
+			shd.findTracerIds(lookupsByShard[i], tracerIds)
+			shd.release()
+		}
+	}
+	if atomic.LoadInt32(&store.redirected) != 0 {
+		// Some spans may have been written to a shard other than the one their
+		// id hashes to.  Look for the parents we didn't find one at a time.
+		for pid := range lookups {
+			if _, found := tracerIds[pid]; found {
+				continue
+			}
+			buf := store.FindSpanBytes(common.SpanId(pid))
+			if buf == nil {
+				continue
+			}
+			var data partialSpanData
+			if decodeSpanBytes(buf, &data) == nil {
+				tracerIds[pid] = data.TracerId
+			}
+		}
+	}
+
+	// Aggregate the edges.
+	edges := make(map[serviceMapEdgeKey]*common.ServiceMapEdge)
+	for _, data := range spans {
+		duration := data.End - data.Begin
+		if data.End != 0 && duration < 0 {
+			// The span ended before it began, so it would skew the
+			// durations of its edges.
+			continue
+		}
+		for _, pid := range data.Parents {
+			parent, found := tracerIds[string(pid)]
+			if !found {
+				parent = common.SERVICE_MAP_UNKNOWN_TRACER
+				smap.NumUnknownParents++
+			}
+			key := serviceMapEdgeKey{parent: parent, child: data.TracerId}
+			edge := edges[key]
+			if edge == nil {
+				edge = &common.ServiceMapEdge{
+					Parent:        parent,
+					Child:         data.TracerId,
+					MinDurationMs: duration,
+					MaxDurationMs: duration,
+				}
+				edges[key] = edge
+			}
+			edge.Count++
+			edge.TotalDurationMs += duration
+			if duration < edge.MinDurationMs {
+				edge.MinDurationMs = duration
+			}
+			if duration > edge.MaxDurationMs {
+				edge.MaxDurationMs = duration
+			}
+		}
+	}
+	for _, edge := range edges {
+		edge.AvgDurationMs = edge.TotalDurationMs / int64(edge.Count)
+		smap.Edges = append(smap.Edges, *edge)
+	}
+	sort.Sort(serviceMapEdges(smap.Edges))
+	return smap
+}
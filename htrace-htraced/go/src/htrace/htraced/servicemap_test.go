@@ -0,0 +1,193 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/test"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Compute the service map we expect for the spans of a tree which begin in
+// [beginMs, endMs).
+func expectedServiceMap(tree *test.SpanTree, beginMs int64,
+	endMs int64) []common.ServiceMapEdge {
+	spansById := make(map[string]*common.Span)
+	for i := range tree.Spans {
+		spansById[string(tree.Spans[i].Id)] = tree.Spans[i]
+	}
+	edges := make(map[serviceMapEdgeKey]*common.ServiceMapEdge)
+	for i := range tree.Spans {
+		span := tree.Spans[i]
+		if span.Begin < beginMs || span.Begin >= endMs {
+			continue
+		}
+		for _, pid := range span.Parents {
+			parent := spansById[string(pid)]
+			key := serviceMapEdgeKey{parent: parent.TracerId, child: span.TracerId}
+			edge := edges[key]
+			if edge == nil {
+				edge = &common.ServiceMapEdge{Parent: parent.TracerId,
+					Child: span.TracerId, MinDurationMs: math.MaxInt64}
+				edges[key] = edge
+			}
+			edge.Count++
+			edge.TotalDurationMs += span.Duration()
+			if span.Duration() < edge.MinDurationMs {
+				edge.MinDurationMs = span.Duration()
+			}
+			if span.Duration() > edge.MaxDurationMs {
+				edge.MaxDurationMs = span.Duration()
+			}
+		}
+	}
+	result := make([]common.ServiceMapEdge, 0)
+	for _, edge := range edges {
+		edge.AvgDurationMs = edge.TotalDurationMs / int64(edge.Count)
+		result = append(result, *edge)
+	}
+	sort.Sort(serviceMapEdges(result))
+	return result
+}
+
+func expectServiceMapEdges(t *testing.T, expected []common.ServiceMapEdge,
+	smap *common.ServiceMap) {
+	if !reflect.DeepEqual(expected, smap.Edges) {
+		t.Fatalf("Expected service map edges %s, but got %s\n",
+			asJson(expected), asJson(smap.Edges))
+	}
+}
+
+func TestServiceMap(t *testing.T) {
+	gen := &test.SpanTreeGenerator{
+		Seed:             1879,
+		Depth:            3,
+		NumRoots:         10,
+		MinFanOut:        1,
+		MaxFanOut:        4,
+		MinDurationMs:    1000,
+		MaxDurationMs:    10000,
+		StartMs:          123456789,
+		Nested:           true,
+		TracerIdPerLevel: true,
+	}
+	tree := gen.Generate()
+	htraceBld := &MiniHTracedBuilder{Name: "TestServiceMap",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, tree.Spans)
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Every span in the tree is in the window.
+	smap, err := hcl.GetServiceMap(math.MinInt64, math.MaxInt64, 1000)
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %s\n", err.Error())
+	}
+	if smap.NumSpans != len(tree.Spans) || smap.Partial ||
+		smap.NumUnknownParents != 0 {
+		t.Fatalf("Expected NumSpans=%d, Partial=false, NumUnknownParents=0, "+
+			"but got NumSpans=%d, Partial=%t, NumUnknownParents=%d\n",
+			len(tree.Spans), smap.NumSpans, smap.Partial, smap.NumUnknownParents)
+	}
+	numAtLevel := make([]uint64, gen.Depth)
+	for _, level := range tree.Levels {
+		numAtLevel[level]++
+	}
+	if len(smap.Edges) != 2 ||
+		smap.Edges[0].Parent != "tracer0" || smap.Edges[0].Child != "tracer1" ||
+		smap.Edges[0].Count != numAtLevel[1] ||
+		smap.Edges[1].Parent != "tracer1" || smap.Edges[1].Child != "tracer2" ||
+		smap.Edges[1].Count != numAtLevel[2] {
+		t.Fatalf("Expected edges tracer0 -> tracer1 (%d) and tracer1 -> "+
+			"tracer2 (%d), but got %s\n", numAtLevel[1], numAtLevel[2],
+			asJson(smap.Edges))
+	}
+	expectServiceMapEdges(t, expectedServiceMap(tree, math.MinInt64,
+		math.MaxInt64), smap)
+
+	// Parents which begin before the window should still be resolved.
+	beginMs := gen.StartMs + gen.MaxDurationMs/2
+	endMs := gen.StartMs + gen.MaxDurationMs
+	smap, err = hcl.GetServiceMap(beginMs, endMs, 1000)
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %s\n", err.Error())
+	}
+	if smap.NumUnknownParents != 0 || smap.Partial {
+		t.Fatalf("Expected a complete service map with no unknown parents, "+
+			"but got %s\n", asJson(smap))
+	}
+	expectServiceMapEdges(t, expectedServiceMap(tree, beginMs, endMs), smap)
+
+	// A small limit should produce a partial map.
+	smap, err = hcl.GetServiceMap(math.MinInt64, math.MaxInt64, 4)
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %s\n", err.Error())
+	}
+	if !smap.Partial || smap.NumSpans != 4 {
+		t.Fatalf("Expected a partial service map of 4 spans, but got "+
+			"Partial=%t, NumSpans=%d\n", smap.Partial, smap.NumSpans)
+	}
+
+	// Parents which can't be found are counted as edges from "unknown".
+	ingestSpans(ht, []*common.Span{&common.Span{
+		Id: common.TestId("00000000000000000000000000000001"),
+		SpanData: common.SpanData{
+			Begin:    100,
+			End:      150,
+			TracerId: "orphan",
+			Parents: []common.SpanId{
+				common.TestId("00000000000000000000000000000002")},
+		}}})
+	smap, err = hcl.GetServiceMap(0, 1000, 1000)
+	if err != nil {
+		t.Fatalf("GetServiceMap failed: %s\n", err.Error())
+	}
+	expectServiceMapEdges(t, []common.ServiceMapEdge{{
+		Parent: common.SERVICE_MAP_UNKNOWN_TRACER, Child: "orphan", Count: 1,
+		TotalDurationMs: 50, AvgDurationMs: 50, MinDurationMs: 50,
+		MaxDurationMs: 50}}, smap)
+	if smap.NumSpans != 1 || smap.NumUnknownParents != 1 {
+		t.Fatalf("Expected NumSpans=1, NumUnknownParents=1, but got "+
+			"NumSpans=%d, NumUnknownParents=%d\n", smap.NumSpans,
+			smap.NumUnknownParents)
+	}
+
+	// An invalid window should be rejected.
+	_, err = hcl.GetServiceMap(1000, 0, 1000)
+	if common.ErrorCodeOf(err) != common.ERR_BAD_PARAMETER {
+		t.Fatalf("Expected a BAD_PARAMETER error for an invalid window, but "+
+			"got %v\n", err)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"htrace/common"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The key-value store which holds the data of a shard.  With the leveldb
+// datastore backend, this is a leveldb instance.  With the memory backend, it
+// is a memoryDB.  The methods behave like the levigo methods of the same name.
+type shardDB interface {
+	Get(ro *levigo.ReadOptions, key []byte) ([]byte, error)
+	Put(wo *levigo.WriteOptions, key []byte, value []byte) error
+	NewWriteBatch() shardBatch
+	Write(wo *levigo.WriteOptions, batch shardBatch) error
+	NewIterator(ro *levigo.ReadOptions) shardIterator
+	GetApproximateSizes(ranges []levigo.Range) []uint64
+	PropertyValue(name string) string
+	Close()
+}
+
+// A batch of writes to a shardDB.  A batch may only be written to the
+// shardDB which created it.
+type shardBatch interface {
+	Put(key []byte, value []byte)
+	Delete(key []byte)
+	Close()
+}
+
+// An iterator over the keys of a shardDB, in sorted order.
+type shardIterator interface {
+	Seek(key []byte)
+	SeekToFirst()
+	SeekToLast()
+	Valid() bool
+	Key() []byte
+	Value() []byte
+	Next()
+	Prev()
+	GetError() error
+	Close()
+}
+
+// Open the shardDB in a shard directory, using the given persistent
+// datastore backend.  With the leveldb backend, opts decides whether the
+// shard is created if it is missing.  With the journal backend, create does.
+// If the shard directory's lock is stale, it is broken only if stealLock is
+// set.  See lockShardDir.
+func openShardDB(lg *common.Logger, backend string, path string,
+	opts *levigo.Options, create bool, stealLock bool) (shardDB, error) {
+	var db shardDB
+	var err error
+	switch backend {
+	case DATASTORE_BACKEND_LEVELDB:
+		db, err = openLevelDbShard(path, opts)
+	case DATASTORE_BACKEND_JOURNAL:
+		db, err = openJournalDB(lg, path, create)
+	default:
+		return nil, errors.New(fmt.Sprintf("The %s datastore backend does "+
+			"not use shard directories.", backend))
+	}
+	if err != nil {
+		if isLockError(err) {
+			err = describeLockError(path, err)
+		}
+		return nil, err
+	}
+	lk, err := lockShardDir(lg, path, stealLock)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &lockedShardDB{shardDB: db, lk: lk}, nil
+}
+
+// Guess which datastore backend created the non-empty shard directory at
+// path, based on the files in it.
+func shardDirBackend(path string) string {
+	_, err := os.Stat(path + "/" + JOURNAL_FILE_NAME)
+	if err == nil {
+		return DATASTORE_BACKEND_JOURNAL
+	}
+	return DATASTORE_BACKEND_LEVELDB
+}
+
+// A shardDB backed by a leveldb instance.
+type levelDbShard struct {
+	*levigo.DB
+}
+
+// Open the leveldb instance at the given path.
+func openLevelDbShard(path string, opts *levigo.Options) (shardDB, error) {
+	ldb, err := levigo.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDbShard{ldb}, nil
+}
+
+func (db *levelDbShard) NewWriteBatch() shardBatch {
+	return levigo.NewWriteBatch()
+}
+
+func (db *levelDbShard) Write(wo *levigo.WriteOptions, batch shardBatch) error {
+	return db.DB.Write(wo, batch.(*levigo.WriteBatch))
+}
+
+func (db *levelDbShard) NewIterator(ro *levigo.ReadOptions) shardIterator {
+	return db.DB.NewIterator(ro)
+}
+
+// The number of levels in a leveldb instance, the number of level 0 files at
+// which leveldb compacts level 0, and the size at which it compacts level 1.
+// Each level after that can be 10 times bigger than the one before, except
+// for the last, which can be any size.  See leveldb's db/version_set.cc.
+const LEVELDB_NUM_LEVELS = 7
+const LEVELDB_L0_COMPACTION_TRIGGER = 4
+const LEVELDB_L1_MAX_MB = 10
+
+// Parse the table of levels in the leveldb.stats property, and get the number
+// of level 0 files and leveldb's compaction score.  The other backends don't
+// have leveldb.stats, so they get 0 for both.
+func parseLevelDbStats(stats string) (uint64, float64) {
+	var level0Files uint64
+	score := 0.0
+	for _, line := range strings.Split(stats, "\n") {
+		// Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		level, err := strconv.Atoi(fields[0])
+		if err != nil || level < 0 || level >= LEVELDB_NUM_LEVELS-1 {
+			continue
+		}
+		files, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		sizeMb, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			continue
+		}
+		var levelScore float64
+		if level == 0 {
+			level0Files = files
+			levelScore = float64(files) / LEVELDB_L0_COMPACTION_TRIGGER
+		} else {
+			levelScore = sizeMb /
+				(LEVELDB_L1_MAX_MB * math.Pow(10, float64(level-1)))
+		}
+		if levelScore > score {
+			score = levelScore
+		}
+	}
+	return level0Files, score
+}
+
+// A shardDB whose contents can be captured at a point in time, for
+// datastore snapshots.  The memory backend doesn't implement this.
+type snapshottableDB interface {
+	// Capture the current contents of the shardDB.  This should be quick,
+	// since writes to every shard are paused while it runs.
+	snapshot() (shardSnapshot, error)
+}
+
+// The contents of a shardDB at a point in time.
+type shardSnapshot interface {
+	// Write the snapshot to a new shard directory.  The shardDB must stay
+	// open until this returns.
+	writeTo(path string) error
+
+	// Release the resources held by the snapshot.
+	release()
+}
+
+// The number of keys we copy in each write batch when writing a leveldb
+// snapshot.
+const LEVELDB_SNAPSHOT_BATCH_KEYS = 1000
+
+type levelDbSnapshot struct {
+	db   *levelDbShard
+	snap *levigo.Snapshot
+}
+
+func (db *levelDbShard) snapshot() (shardSnapshot, error) {
+	return &levelDbSnapshot{db: db, snap: db.NewSnapshot()}, nil
+}
+
+// Copy the keys in the snapshot to a new leveldb instance.
+func (snap *levelDbSnapshot) writeTo(path string) error {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	dst, err := levigo.Open(path, opts)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	readOpts := levigo.NewReadOptions()
+	defer readOpts.Close()
+	readOpts.SetFillCache(false)
+	readOpts.SetSnapshot(snap.snap)
+	writeOpts := levigo.NewWriteOptions()
+	defer writeOpts.Close()
+	iter := snap.db.DB.NewIterator(readOpts)
+	defer iter.Close()
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	numKeys := 0
+	for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+		batch.Put(iter.Key(), iter.Value())
+		numKeys++
+		if numKeys == LEVELDB_SNAPSHOT_BATCH_KEYS {
+			err = dst.Write(writeOpts, batch)
+			if err != nil {
+				return err
+			}
+			batch.Clear()
+			numKeys = 0
+		}
+	}
+	err = iter.GetError()
+	if err != nil {
+		return err
+	}
+	// Sync the last batch, so that the whole copy is durable.
+	writeOpts.SetSync(true)
+	return dst.Write(writeOpts, batch)
+}
+
+func (snap *levelDbSnapshot) release() {
+	snap.db.ReleaseSnapshot(snap.snap)
+}
@@ -0,0 +1,262 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseLevelDbStats(t *testing.T) {
+	stats := "                               Compactions\n" +
+		"Level  Files Size(MB) Time(sec) Read(MB) Write(MB)\n" +
+		"--------------------------------------------------\n" +
+		"  0        6        3         0        0         3\n" +
+		"  1        4        8         1       12         8\n" +
+		"  2       20      150         2       40        38\n" +
+		"  6      500     9000         0        0         0\n"
+	level0Files, score := parseLevelDbStats(stats)
+	if level0Files != 6 {
+		t.Fatalf("Expected 6 level 0 files, but got %d\n", level0Files)
+	}
+	// Level 2 is 150 MB, but leveldb compacts it at 100 MB.  The last level
+	// has no limit.
+	if math.Abs(score-1.5) > 1e-9 {
+		t.Fatalf("Expected a compaction score of 1.5, but got %g\n", score)
+	}
+	level0Files, score = parseLevelDbStats("")
+	if level0Files != 0 || score != 0 {
+		t.Fatalf("Expected no level 0 files and a score of 0 for empty "+
+			"stats, but got %d and %g\n", level0Files, score)
+	}
+}
+
+// The configuration which keeps queries apart from ingest.
+var READ_ISOLATION_CNF = map[string]string{
+	conf.HTRACE_LEVELDB_CACHE_PER_SHARD:    "true",
+	conf.HTRACE_LEVELDB_BLOOM_BITS_PER_KEY: "10",
+	conf.HTRACE_LEVELDB_SCAN_FILL_CACHE:    "false",
+}
+
+// Reads must see the spans which were written before them, even though
+// lookups, query scans, and writes use different options.
+func TestReadIsolationSeesCommittedWrites(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{
+		Name:         "TestReadIsolationSeesCommittedWrites",
+		Cnf:          READ_ISOLATION_CNF,
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	if ht.Store.shards[0].openOpts == nil ||
+		ht.Store.shards[0].openOpts == ht.Store.shards[1].openOpts {
+		t.Fatalf("Expected each shard to have its own options.\n")
+	}
+
+	// Keep querying while the spans are written.
+	stop := make(chan interface{})
+	var readers sync.WaitGroup
+	readErrs := make(chan error, 1)
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			_, err, _ := ht.Store.HandleQuery(&common.Query{Lim: 100})
+			if err != nil {
+				readErrs <- err
+				return
+			}
+		}
+	}()
+	const NUM_ROUNDS = 20
+	const SPANS_PER_ROUND = 50
+	rnd := rand.New(rand.NewSource(1942))
+	written := make([]*common.Span, 0, NUM_ROUNDS*SPANS_PER_ROUND)
+	allQuery := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   fmt.Sprintf("%d", int64(math.MinInt64)),
+			},
+		},
+		Lim: NUM_ROUNDS * SPANS_PER_ROUND,
+	}
+	for round := 0; round < NUM_ROUNDS; round++ {
+		batch := make([]*common.Span, SPANS_PER_ROUND)
+		for i := range batch {
+			batch[i] = test.NewRandomSpan(rnd, written)
+		}
+		ingestSpans(ht, batch)
+		written = append(written, batch...)
+		for i := range batch {
+			if ht.Store.FindSpan(batch[i].Id) == nil {
+				t.Fatalf("Round %d: failed to find span %s right after "+
+					"it was written.\n", round, batch[i].Id.String())
+			}
+		}
+		spans, err, _ := ht.Store.HandleQuery(allQuery)
+		if err != nil {
+			t.Fatalf("Round %d: query failed: %s\n", round, err.Error())
+		}
+		if len(spans) != len(written) {
+			t.Fatalf("Round %d: expected the query to find all %d spans "+
+				"written so far, but it found %d\n", round, len(written),
+				len(spans))
+		}
+	}
+	close(stop)
+	readers.Wait()
+	select {
+	case err = <-readErrs:
+		t.Fatalf("Concurrent query failed: %s\n", err.Error())
+	default:
+	}
+
+	// Every span was looked up once after it was written.
+	stats := ht.Store.ServerStats()
+	var lookups uint64
+	for i := range stats.Dirs {
+		lookups += stats.Dirs[i].SpanCacheHits + stats.Dirs[i].SpanCacheMisses
+	}
+	if lookups < uint64(len(written)) {
+		t.Fatalf("Expected at least %d span cache lookups in the shard "+
+			"stats, but got %s\n", len(written), asJson(stats.Dirs))
+	}
+}
+
+// Get the 99th percentile of some durations.
+func p99(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := make([]time.Duration, len(durations))
+	copy(sorted, durations)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[(len(sorted)*99)/100]
+}
+
+// Look up spans and run short range queries while spans are written
+// continuously, and report the 99th percentile latency of each.
+func benchmarkQueriesDuringIngest(b *testing.B, cnf map[string]string) {
+	const NUM_SPANS = 50000
+	const INGEST_BATCH = 1000
+	bldCnf := map[string]string{
+		conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		conf.HTRACE_LOG_LEVEL:                     "INFO",
+		conf.HTRACE_SPAN_CACHE_BYTES:              "0",
+		conf.HTRACE_CHILDREN_CACHE_BYTES:          "0",
+	}
+	for k, v := range cnf {
+		bldCnf[k] = v
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "BenchmarkQueriesDuringIngest",
+		Cnf:          bldCnf,
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		b.Fatalf("Error creating MiniHTraced: %s\n", err.Error())
+	}
+	defer ht.Close()
+	rnd := rand.New(rand.NewSource(2))
+	allSpans := make([]*common.Span, NUM_SPANS)
+	for n := range allSpans {
+		allSpans[n] = test.NewRandomSpan(rnd, allSpans[0:n])
+	}
+	ingestSpans(ht, allSpans)
+
+	stop := make(chan interface{})
+	var writers sync.WaitGroup
+	writers.Add(1)
+	go func() {
+		defer writers.Done()
+		wrnd := rand.New(rand.NewSource(3))
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+			for i := 0; i < INGEST_BATCH; i++ {
+				ing.IngestSpan(test.NewRandomSpan(wrnd, nil))
+			}
+			ing.Close(time.Now())
+		}
+	}()
+	lookups := make([]time.Duration, 0, b.N)
+	scans := make([]time.Duration, 0, b.N)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		span := allSpans[rnd.Intn(NUM_SPANS)]
+		start := time.Now()
+		if ht.Store.FindSpan(span.Id) == nil {
+			b.Fatalf("Failed to find span %s\n", span.Id.String())
+		}
+		lookups = append(lookups, time.Since(start))
+		start = time.Now()
+		_, err, _ := ht.Store.HandleQuery(&common.Query{
+			Predicates: []common.Predicate{
+				common.Predicate{
+					Op:    common.GREATER_THAN_OR_EQUALS,
+					Field: common.BEGIN_TIME,
+					Val:   fmt.Sprintf("%d", span.Begin),
+				},
+			},
+			Lim: 20,
+		})
+		if err != nil {
+			b.Fatalf("Query failed: %s\n", err.Error())
+		}
+		scans = append(scans, time.Since(start))
+	}
+	b.StopTimer()
+	close(stop)
+	writers.Wait()
+	b.Logf("%d iterations: lookup p99 %s, range query p99 %s\n", b.N,
+		p99(lookups).String(), p99(scans).String())
+}
+
+func BenchmarkQueriesDuringIngest(b *testing.B) {
+	benchmarkQueriesDuringIngest(b, map[string]string{})
+}
+
+func BenchmarkQueriesDuringIngestIsolated(b *testing.B) {
+	benchmarkQueriesDuringIngest(b, READ_ISOLATION_CNF)
+}
@@ -0,0 +1,544 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//
+// Latency SLOs.
+//
+// An SLO says what percentage of the spans with a given description or tracer
+// ID must finish within a threshold, over a window of time.  SLOs are defined
+// through /server/slos, and kept in the first shard under
+// SLO_DEFINITION_PREFIX, so that they survive restarts.
+//
+// Each SLO's window is divided into slo.buckets buckets, which are aligned to
+// multiples of their length since the epoch.  A span counts in the bucket
+// its end time falls in.  On each datastore heartbeat, each SLO reads the
+// spans which arrived since it last looked, using the arrival time index, and
+// remembers where it stopped, so that no span is read twice.  Spans can
+// arrive well after they end.  They are still counted in their bucket if
+// they arrive within slo.grace.ms of the end of the bucket.  Spans which
+// arrive later than that, or which ended before the oldest bucket, are
+// counted as late instead.  A bucket is complete once the grace period after
+// it has passed.
+//
+// The counts are only kept in memory.  When htraced starts, and when an SLO
+// is defined, the SLO reads the spans which arrived during the last window,
+// so the counts are rebuilt from the stored spans.  A span which is written
+// more than once, such as an active span which later finishes, is counted
+// each time it is written with an end time.
+//
+
+// The state of an SLO.
+type sloState struct {
+	def common.SloDefinition
+
+	// The length of each bucket, in milliseconds.
+	bucketMs int64
+
+	// Where the next evaluation starts reading the arrival time index.
+	cursor common.ArrivalCursor
+
+	// The arrival time up to which spans have been evaluated.
+	evaluatedMs int64
+
+	// The buckets, oldest first.
+	buckets []common.SloBucket
+
+	// The number of spans which arrived too late to be counted.
+	lateSpans uint64
+}
+
+// A span which an SLO has read.
+type sloObservation struct {
+	arrivalMs  int64
+	endMs      int64
+	durationNs int64
+}
+
+type sloTracker struct {
+	store *dataStore
+
+	// The number of buckets in each SLO's window.
+	numBuckets int
+
+	// How long after the end of a bucket spans are still counted in it.
+	graceMs int64
+
+	// The maximum number of spans each SLO reads in each evaluation.
+	maxScan int
+
+	// The maximum number of SLOs.
+	maxSlos int
+
+	// Held while evaluating the SLOs, so that only one evaluation runs at a
+	// time.
+	evalLock sync.Mutex
+
+	// Protects slos and the sloStates in it.
+	lock sync.Mutex
+
+	// The SLOs, by name.
+	slos map[string]*sloState
+
+	// The channel on which we receive datastore heartbeats.
+	heartbeats chan interface{}
+
+	// Tracks whether the evaluation goroutine has exited.
+	exited sync.WaitGroup
+}
+
+func newSloTracker(store *dataStore, cnf *conf.Config) *sloTracker {
+	str := &sloTracker{
+		store:      store,
+		numBuckets: cnf.GetInt(conf.HTRACE_SLO_BUCKETS),
+		graceMs:    cnf.GetInt64(conf.HTRACE_SLO_GRACE_MS),
+		maxScan:    cnf.GetInt(conf.HTRACE_SLO_SCAN_MAX_SPANS),
+		maxSlos:    cnf.GetInt(conf.HTRACE_SLO_MAX_SLOS),
+		slos:       make(map[string]*sloState),
+	}
+	if str.numBuckets < 1 {
+		str.numBuckets = 1
+	}
+	if str.graceMs < 0 {
+		str.graceMs = 0
+	}
+	if str.maxScan < 1 {
+		str.maxScan = 1
+	}
+	return str
+}
+
+func sloDefinitionKey(name string) []byte {
+	return append([]byte{SLO_DEFINITION_PREFIX}, []byte(name)...)
+}
+
+// Start tracking an SLO.  Its counts are rebuilt from the spans which
+// arrived during the last window.  The lock must be held.
+func (str *sloTracker) addLocked(def *common.SloDefinition) {
+	st := &sloState{
+		def:      *def,
+		bucketMs: def.WindowMs / int64(str.numBuckets),
+	}
+	if st.bucketMs < 1 {
+		st.bucketMs = 1
+	}
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	st.cursor.ArrivalMs = nowMs - def.WindowMs
+	st.evaluatedMs = st.cursor.ArrivalMs
+	st.advance(st.bucketStart(st.evaluatedMs), str.numBuckets)
+	str.slos[def.Name] = st
+}
+
+// Load the SLO definitions from the first shard.
+func (str *sloTracker) load() {
+	store := str.store
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to load the SLO definitions, because shard "+
+			"%s is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	str.lock.Lock()
+	defer str.lock.Unlock()
+	prefix := []byte{SLO_DEFINITION_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		var def common.SloDefinition
+		err := json.Unmarshal(iter.Value(), &def)
+		if err != nil {
+			store.lg.Errorf("Error parsing the definition of SLO %s: %s\n",
+				string(iter.Key()[1:]), err.Error())
+			continue
+		}
+		str.addLocked(&def)
+	}
+	if len(str.slos) > 0 {
+		store.lg.Infof("Loaded %d SLO definition(s).\n", len(str.slos))
+	}
+}
+
+func validateSloDefinition(def *common.SloDefinition) error {
+	if def.Name == "" || strings.ContainsAny(def.Name, "/?#") {
+		return errors.New(fmt.Sprintf("Invalid SLO name '%s'.  The name "+
+			"must be non-empty, and can't contain /, ?, or #.", def.Name))
+	}
+	if def.ThresholdMs < 0 {
+		return errors.New(fmt.Sprintf("Invalid threshold %d ms.  The "+
+			"threshold can't be negative.", def.ThresholdMs))
+	}
+	if def.TargetPercent <= 0 || def.TargetPercent > 100 {
+		return errors.New(fmt.Sprintf("Invalid target %g%%.  The target "+
+			"must be more than 0%% and at most 100%%.", def.TargetPercent))
+	}
+	if def.WindowMs <= 0 {
+		return errors.New(fmt.Sprintf("Invalid window %d ms.  The window "+
+			"must be positive.", def.WindowMs))
+	}
+	return nil
+}
+
+// Define an SLO, replacing any SLO with the same name.  A replaced SLO starts
+// counting again from scratch.
+func (str *sloTracker) Define(def *common.SloDefinition) (*common.SloStatus,
+	error) {
+	store := str.store
+	if store.readOnly {
+		return nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't define SLOs: this server is read-only.")
+	}
+	err := validateSloDefinition(def)
+	if err != nil {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"%s", err.Error())
+	}
+	buf, err := json.Marshal(def)
+	if err != nil {
+		return nil, err
+	}
+	str.lock.Lock()
+	defer str.lock.Unlock()
+	if str.slos[def.Name] == nil && len(str.slos) >= str.maxSlos {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"Can't define SLO %s, because there are already %d SLOs, "+
+				"which is the limit.", def.Name, str.maxSlos)
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't define SLO %s, because shard %s, which holds the SLO "+
+				"definitions, is quarantined.", def.Name, shd.path)
+	}
+	defer shd.release()
+	err = shd.ldb.Put(store.writeOpts, sloDefinitionKey(def.Name), buf)
+	if err != nil {
+		shd.checkCorruption(err)
+		return nil, err
+	}
+	str.addLocked(def)
+	store.lg.Infof("Defined SLO %s\n", string(buf))
+	return str.slos[def.Name].status(), nil
+}
+
+// Remove an SLO.
+func (str *sloTracker) Remove(name string) error {
+	store := str.store
+	if store.readOnly {
+		return common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't remove SLOs: this server is read-only.")
+	}
+	str.lock.Lock()
+	defer str.lock.Unlock()
+	if str.slos[name] == nil {
+		return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"There is no SLO named %s.", name)
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't remove SLO %s, because shard %s, which holds the SLO "+
+				"definitions, is quarantined.", name, shd.path)
+	}
+	defer shd.release()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	batch.Delete(sloDefinitionKey(name))
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		shd.checkCorruption(err)
+		return err
+	}
+	delete(str.slos, name)
+	store.lg.Infof("Removed SLO %s\n", name)
+	return nil
+}
+
+type sloStatuses []common.SloStatus
+
+func (sts sloStatuses) Len() int {
+	return len(sts)
+}
+
+func (sts sloStatuses) Less(i, j int) bool {
+	return sts[i].Definition.Name < sts[j].Definition.Name
+}
+
+func (sts sloStatuses) Swap(i, j int) {
+	sts[i], sts[j] = sts[j], sts[i]
+}
+
+// Get the state of every SLO, sorted by name.
+func (str *sloTracker) Get() []common.SloStatus {
+	str.lock.Lock()
+	defer str.lock.Unlock()
+	statuses := make([]common.SloStatus, 0, len(str.slos))
+	for _, st := range str.slos {
+		statuses = append(statuses, *st.status())
+	}
+	sort.Sort(sloStatuses(statuses))
+	return statuses
+}
+
+// Get the state of an SLO.  The lock must be held.
+func (st *sloState) status() *common.SloStatus {
+	status := &common.SloStatus{
+		Definition:  st.def,
+		LateSpans:   st.lateSpans,
+		EvaluatedMs: st.evaluatedMs,
+		Buckets:     make([]common.SloBucket, len(st.buckets)),
+	}
+	copy(status.Buckets, st.buckets)
+	for i := range st.buckets {
+		status.CompliantSpans += st.buckets[i].CompliantSpans
+		status.ViolatingSpans += st.buckets[i].ViolatingSpans
+	}
+	status.CompliancePercent = 100
+	total := status.CompliantSpans + status.ViolatingSpans
+	if total > 0 {
+		status.CompliancePercent =
+			float64(status.CompliantSpans) * 100 / float64(total)
+	}
+	status.Met = status.CompliancePercent >= st.def.TargetPercent
+	return status
+}
+
+// Get the start of the bucket containing the given time.
+func (st *sloState) bucketStart(ms int64) int64 {
+	startMs := ms - ms%st.bucketMs
+	if ms < 0 && ms%st.bucketMs != 0 {
+		startMs -= st.bucketMs
+	}
+	return startMs
+}
+
+// Add buckets until the last one starts at startMs, keeping at most
+// numBuckets buckets.
+func (st *sloState) advance(startMs int64, numBuckets int) {
+	nextMs := startMs - int64(numBuckets-1)*st.bucketMs
+	if len(st.buckets) > 0 {
+		lastMs := st.buckets[len(st.buckets)-1].StartMs
+		if lastMs >= startMs {
+			return
+		}
+		if lastMs+st.bucketMs > nextMs {
+			nextMs = lastMs + st.bucketMs
+		}
+	}
+	for ; nextMs <= startMs; nextMs += st.bucketMs {
+		if len(st.buckets) == numBuckets {
+			copy(st.buckets, st.buckets[1:])
+			st.buckets = st.buckets[:len(st.buckets)-1]
+		}
+		st.buckets = append(st.buckets, common.SloBucket{
+			StartMs: nextMs,
+			EndMs:   nextMs + st.bucketMs,
+		})
+	}
+}
+
+// Count a span which the SLO has read.  The lock must be held.
+func (st *sloState) record(ob *sloObservation, graceMs int64, numBuckets int) {
+	// A span can't have ended after it arrived, unless the clocks disagree.
+	endMs := ob.endMs
+	if endMs > ob.arrivalMs {
+		endMs = ob.arrivalMs
+	}
+	startMs := st.bucketStart(endMs)
+	if ob.arrivalMs >= startMs+st.bucketMs+graceMs {
+		st.lateSpans++
+		return
+	}
+	st.advance(startMs, numBuckets)
+	idx := (startMs - st.buckets[0].StartMs) / st.bucketMs
+	if idx < 0 {
+		st.lateSpans++
+		return
+	}
+	if ob.durationNs <= st.def.ThresholdMs*common.NS_PER_MS {
+		st.buckets[idx].CompliantSpans++
+	} else {
+		st.buckets[idx].ViolatingSpans++
+	}
+}
+
+// Check whether a span counts towards an SLO.  Spans which haven't ended don't
+// count, and neither do synthetic spans, since they don't reflect what real
+// users see, or spans which end before they begin.
+func sloMatches(def *common.SloDefinition, span *common.Span) bool {
+	if span.End == 0 && span.EndNs == 0 {
+		return false
+	}
+	if span.HasNegativeDuration() {
+		return false
+	}
+	if span.Flags.Has(common.SPAN_FLAG_SYNTHETIC) {
+		return false
+	}
+	if def.Description != "" && span.Description != def.Description {
+		return false
+	}
+	if def.TracerId != "" && span.TracerId != def.TracerId {
+		return false
+	}
+	return true
+}
+
+// Start evaluating the SLOs on each heartbeat from the given heartbeater.
+func (str *sloTracker) Start(hb *Heartbeater) {
+	str.heartbeats = make(chan interface{}, 1)
+	str.exited.Add(1)
+	go func() {
+		defer str.exited.Done()
+		for {
+			_, isOpen := <-str.heartbeats
+			if !isOpen {
+				return
+			}
+			str.evaluate()
+		}
+	}()
+	hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "sloTracker",
+		targetChan: str.heartbeats,
+	})
+}
+
+// Stop evaluating the SLOs.  The heartbeater must already have been shut
+// down.
+func (str *sloTracker) Stop() {
+	if str.heartbeats == nil {
+		return
+	}
+	close(str.heartbeats)
+	str.exited.Wait()
+	str.heartbeats = nil
+}
+
+// Count the spans which arrived since the last evaluation, for every SLO.
+func (str *sloTracker) evaluate() {
+	str.evalLock.Lock()
+	defer str.evalLock.Unlock()
+	str.lock.Lock()
+	states := make([]*sloState, 0, len(str.slos))
+	for _, st := range str.slos {
+		states = append(states, st)
+	}
+	str.lock.Unlock()
+	watermarkMs := str.store.arrivalWatermark()
+	for i := range states {
+		str.evaluateOne(states[i], watermarkMs)
+	}
+}
+
+// Count the spans which arrived since the last evaluation of an SLO, up to
+// the given arrival watermark.
+func (str *sloTracker) evaluateOne(st *sloState, watermarkMs int64) {
+	str.lock.Lock()
+	def := st.def
+	cursor := st.cursor
+	str.lock.Unlock()
+
+	var startKey []byte
+	exclusive := false
+	if cursor.Id != nil {
+		startKey = append(append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+			u64toSlice(s2u64(cursor.ArrivalMs))...), cursor.Id.Val()...)
+		exclusive = true
+	} else {
+		startKey = append(append([]byte{ARRIVAL_TIME_INDEX_PREFIX},
+			u64toSlice(s2u64(cursor.ArrivalMs))...),
+			common.INVALID_SPAN_ID.Val()...)
+	}
+	entries := str.store.findArrivals(startKey, exclusive, str.maxScan,
+		watermarkMs)
+	obs := make([]sloObservation, 0, len(entries))
+	for i := range entries {
+		cursor = entries[i].cursor()
+		shd := entries[i].shd
+		if !shd.acquire() {
+			continue
+		}
+		buf := shd.findSpanBytes(cursor.Id)
+		if buf == nil {
+			// The span was deleted before we could read it.
+			shd.release()
+			continue
+		}
+		cand, err := newSpanCandidate(shd, cursor.Id, buf)
+		shd.release()
+		if err != nil {
+			str.store.lg.Warnf("SLO %s: unable to decode span %s: %s\n",
+				def.Name, cursor.Id.String(), err.Error())
+			continue
+		}
+		if sloMatches(&def, &cand.span) {
+			endMs, _ := cand.span.EndParts()
+			obs = append(obs, sloObservation{
+				arrivalMs:  cursor.ArrivalMs,
+				endMs:      endMs,
+				durationNs: cand.span.DurationNs(),
+			})
+		}
+		cand.release()
+	}
+
+	str.lock.Lock()
+	defer str.lock.Unlock()
+	if str.slos[def.Name] != st {
+		// The SLO was removed or redefined while we were reading spans.
+		return
+	}
+	for i := range obs {
+		st.record(&obs[i], str.graceMs, str.numBuckets)
+	}
+	if len(entries) < str.maxScan {
+		// We have read everything which arrived before the watermark.
+		if watermarkMs > cursor.ArrivalMs {
+			cursor.ArrivalMs = watermarkMs
+			cursor.Id = nil
+		}
+		st.evaluatedMs = watermarkMs
+	} else {
+		st.evaluatedMs = cursor.ArrivalMs
+	}
+	st.cursor = cursor
+	st.advance(st.bucketStart(st.evaluatedMs), str.numBuckets)
+	for i := range st.buckets {
+		st.buckets[i].Complete =
+			st.evaluatedMs >= st.buckets[i].EndMs+str.graceMs
+	}
+}
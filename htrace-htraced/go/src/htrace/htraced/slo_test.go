@@ -0,0 +1,229 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func buildSloHTraced(t *testing.T, dataDirs []string) *MiniHTraced {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSlos",
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "300000",
+			conf.HTRACE_SLO_BUCKETS:                   "10",
+			conf.HTRACE_SLO_GRACE_MS:                  "5000",
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	return ht
+}
+
+// Evaluate the SLOs once every span written so far is below the arrival
+// watermark.
+func evaluateSlos(ht *MiniHTraced) {
+	time.Sleep(2 * time.Millisecond)
+	ht.Store.slos.evaluate()
+}
+
+func getSlos(t *testing.T, hcl *htrace.Client) map[string]*common.SloStatus {
+	statuses, err := hcl.GetSlos()
+	if err != nil {
+		t.Fatalf("GetSlos failed: %s\n", err.Error())
+	}
+	slos := make(map[string]*common.SloStatus)
+	for i := range statuses {
+		slos[statuses[i].Definition.Name] = &statuses[i]
+	}
+	return slos
+}
+
+func expectSloCounts(t *testing.T, status *common.SloStatus, compliant uint64,
+	violating uint64, late uint64, met bool) {
+	if status == nil {
+		t.Fatalf("The SLO is missing.\n")
+	}
+	if status.CompliantSpans != compliant ||
+		status.ViolatingSpans != violating || status.LateSpans != late ||
+		status.Met != met {
+		t.Fatalf("Expected %d compliant, %d violating, and %d late spans, "+
+			"with met=%t, but got %s\n", compliant, violating, late, met,
+			asJson(status))
+	}
+	total := compliant + violating
+	if total > 0 {
+		pct := float64(compliant) * 100 / float64(total)
+		if status.CompliancePercent != pct {
+			t.Fatalf("Expected compliance %g%%, but got %s\n", pct,
+				asJson(status))
+		}
+	}
+}
+
+func TestSlos(t *testing.T) {
+	dataDirs := make([]string, 2)
+	for i := range dataDirs {
+		dir, err := ioutil.TempDir(os.TempDir(), fmt.Sprintf("TestSlos%d", i+1))
+		if err != nil {
+			t.Fatalf("failed to create TempDir: %s\n", err.Error())
+		}
+		defer os.RemoveAll(dir)
+		dataDirs[i] = dir
+	}
+	ht := buildSloHTraced(t, dataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+	}()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer func() {
+		hcl.Close()
+	}()
+
+	// Invalid definitions are rejected.
+	_, err = hcl.DefineSlo(&common.SloDefinition{Name: "bad",
+		ThresholdMs: 50, TargetPercent: 0, WindowMs: 10000})
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.DefineSlo(&common.SloDefinition{Name: "bad/name",
+		ThresholdMs: 50, TargetPercent: 99, WindowMs: 10000})
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.DefineSlo(&common.SloDefinition{Name: "bad",
+		ThresholdMs: 50, TargetPercent: 99, WindowMs: 0})
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+
+	status, err := hcl.DefineSlo(&common.SloDefinition{
+		Name:          "createFile",
+		Description:   "createFile",
+		ThresholdMs:   50,
+		TargetPercent: 99,
+		WindowMs:      10000,
+	})
+	if err != nil {
+		t.Fatalf("DefineSlo failed: %s\n", err.Error())
+	}
+	if len(status.Buckets) != 10 ||
+		status.Buckets[1].StartMs-status.Buckets[0].StartMs != 1000 {
+		t.Fatalf("Expected 10 buckets of 1000 ms, but got %s\n",
+			asJson(status))
+	}
+	_, err = hcl.DefineSlo(&common.SloDefinition{
+		Name:          "namenode",
+		TracerId:      "namenode",
+		ThresholdMs:   100,
+		TargetPercent: 75,
+		WindowMs:      10000,
+	})
+	if err != nil {
+		t.Fatalf("DefineSlo failed: %s\n", err.Error())
+	}
+
+	// 8 createFile spans finish under the threshold, and 2 over it.  They
+	// arrive 3 seconds after they end, which is inside the grace period.
+	// Another createFile span arrives 8 seconds after it ends, which is too
+	// late.  The datanode spans don't match either SLO.
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	spans := createRandomTestSpans(13)
+	for i := range spans {
+		spans[i].TracerId = "namenode"
+		spans[i].Description = "createFile"
+		spans[i].End = nowMs - 3000
+		spans[i].Begin = spans[i].End - 10
+		spans[i].BeginNs = 0
+		spans[i].EndNs = 0
+		switch {
+		case i == 7:
+			spans[i].Begin = spans[i].End - 50
+		case i == 8 || i == 9:
+			spans[i].Begin = spans[i].End - 80
+		case i == 10:
+			spans[i].End = nowMs - 8000
+			spans[i].Begin = spans[i].End - 10
+		case i > 10:
+			spans[i].TracerId = "datanode"
+			spans[i].Description = "readBlock"
+		}
+	}
+	ingestSpans(ht, spans)
+	evaluateSlos(ht)
+	slos := getSlos(t, hcl)
+	expectSloCounts(t, slos["createFile"], 8, 2, 1, false)
+	expectSloCounts(t, slos["namenode"], 10, 0, 1, true)
+	var numCounted uint64
+	for _, bucket := range slos["createFile"].Buckets {
+		if bucket.StartMs <= nowMs-3000 && nowMs-3000 < bucket.EndMs {
+			numCounted = bucket.CompliantSpans + bucket.ViolatingSpans
+			if bucket.Complete {
+				t.Fatalf("Bucket %s was complete inside the grace period.\n",
+					asJson(bucket))
+			}
+		}
+	}
+	if numCounted != 10 {
+		t.Fatalf("Expected 10 spans in the bucket ending at %d, but got %s\n",
+			nowMs-3000, asJson(slos["createFile"]))
+	}
+
+	// Evaluating again doesn't count the spans twice.
+	evaluateSlos(ht)
+	expectSloCounts(t, getSlos(t, hcl)["createFile"], 8, 2, 1, false)
+
+	// The definitions survive a restart, and the counts are rebuilt from the
+	// stored spans.
+	hcl.Close()
+	ht.Close()
+	ht = buildSloHTraced(t, dataDirs)
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	evaluateSlos(ht)
+	slos = getSlos(t, hcl)
+	expectSloCounts(t, slos["createFile"], 8, 2, 1, false)
+	expectSloCounts(t, slos["namenode"], 10, 0, 1, true)
+
+	// Remove an SLO.
+	err = hcl.DeleteSlo("namenode")
+	if err != nil {
+		t.Fatalf("DeleteSlo failed: %s\n", err.Error())
+	}
+	err = hcl.DeleteSlo("namenode")
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	slos = getSlos(t, hcl)
+	if len(slos) != 1 || slos["createFile"] == nil {
+		t.Fatalf("Expected only the createFile SLO, but got %s\n",
+			asJson(slos))
+	}
+}
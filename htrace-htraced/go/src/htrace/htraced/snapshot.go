@@ -0,0 +1,427 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// A snapshot copies every shard of the datastore to a new directory while
+// htraced keeps running, so that the copy can be backed up.  Copying the
+// shard directories directly doesn't work, since the files change while they
+// are being copied.
+//
+// To take a snapshot, we briefly pause the shard goroutines, so that no
+// batch of spans is partly written, and capture each shard with its storage
+// engine.  With leveldb this is a leveldb snapshot; with the journal backend
+// it is the current length of the journal.  Since all shards are captured
+// while writes are paused, they are all at the same point: the snapshot holds
+// exactly the spans whose sequence numbers are below the sequence watermark
+// at that moment.  Writes then resume, and the captured shards are copied in
+// the background.  Once every shard has been copied, we write a manifest
+// describing the snapshot.  A snapshot directory without a manifest is
+// incomplete.
+//
+// A snapshot can be opened for verification with OpenSnapshot.  Each shard is
+// copied to DEST/shardN/db, so to restore the snapshot, or to serve it with a
+// read-only htraced, set data.store.directories to DEST/shard0, DEST/shard1,
+// and so on.
+
+// The name of the manifest file in a snapshot directory.
+const SNAPSHOT_MANIFEST_FILE_NAME = "MANIFEST.json"
+
+// Get the path of a shard in a snapshot, relative to the snapshot directory.
+// This is laid out like a data directory, which keeps its shard in "db".
+func snapshotShardDir(shardIdx int) string {
+	return fmt.Sprintf("shard%d%sdb", shardIdx, conf.PATH_SEP)
+}
+
+// A snapshot which is running or has finished.
+type snapshotJob struct {
+	// Protects status.
+	lock sync.Mutex
+
+	status common.SnapshotStatus
+}
+
+func (job *snapshotJob) getStatus() *common.SnapshotStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	status := job.status
+	return &status
+}
+
+// Get the status of the most recent snapshot.
+func (store *dataStore) SnapshotStatus() *common.SnapshotStatus {
+	store.snapLock.Lock()
+	job := store.snap
+	store.snapLock.Unlock()
+	if job == nil {
+		return &common.SnapshotStatus{
+			State:       common.SNAPSHOT_NONE,
+			TotalShards: len(store.shards),
+		}
+	}
+	return job.getStatus()
+}
+
+// Start taking a snapshot of the datastore in dest, which must be empty or
+// not exist.  Returns once all the shards have been captured; the shards are
+// copied in the background.  Only one snapshot can run at a time.
+func (store *dataStore) StartSnapshot(dest string) (*common.SnapshotStatus, error) {
+	if store.backend == DATASTORE_BACKEND_MEMORY {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"The %s datastore backend does not support snapshots.",
+			store.backend)
+	}
+	store.snapLock.Lock()
+	defer store.snapLock.Unlock()
+	if store.snap != nil &&
+		store.snap.getStatus().State == common.SNAPSHOT_RUNNING {
+		return nil, common.NewHtraceError(common.ERR_CONFLICT, nil,
+			"A snapshot to %s is already running.", store.snap.status.Dest)
+	}
+	err := prepareSnapshotDir(dest)
+	if err != nil {
+		return nil, common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"%s", err.Error())
+	}
+	snaps, manifest, err := store.captureShards()
+	if err != nil {
+		return nil, err
+	}
+	job := &snapshotJob{
+		status: common.SnapshotStatus{
+			State:       common.SNAPSHOT_RUNNING,
+			Dest:        dest,
+			StartMs:     manifest.TimeMs,
+			TotalShards: len(snaps),
+			Manifest:    manifest,
+		},
+	}
+	store.snap = job
+	store.lg.Infof("Started a snapshot to %s at sequence watermark %d.\n",
+		dest, manifest.SeqWatermark)
+	go job.run(store, snaps, dest)
+	return job.getStatus(), nil
+}
+
+// Make sure that the snapshot directory exists and is empty.
+func prepareSnapshotDir(dest string) error {
+	if dest == "" {
+		return errors.New("No snapshot directory was given.")
+	}
+	err := os.MkdirAll(dest, 0777)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to create the snapshot "+
+			"directory %s: %s", dest, err.Error()))
+	}
+	dir, err := os.Open(dest)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to open the snapshot "+
+			"directory %s: %s", dest, err.Error()))
+	}
+	defer dir.Close()
+	_, err = dir.Readdirnames(1)
+	if err != io.EOF {
+		return errors.New(fmt.Sprintf("The snapshot directory %s is not "+
+			"empty.", dest))
+	}
+	return nil
+}
+
+// Pause writes, and capture every shard.  Fails if any shard is quarantined,
+// since the snapshot would be missing its spans.
+func (store *dataStore) captureShards() ([]shardSnapshot,
+	*common.SnapshotManifest, error) {
+	store.writePause.Lock()
+	defer store.writePause.Unlock()
+	snaps := make([]shardSnapshot, 0, len(store.shards))
+	var err error
+	for shdIdx := range store.shards {
+		shd := store.shards[shdIdx]
+		if !shd.acquire() {
+			err = common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+				"Can't take a snapshot, because shard %s is quarantined.",
+				shd.path)
+			break
+		}
+		var snap shardSnapshot
+		sdb, ok := shd.ldb.(snapshottableDB)
+		if ok {
+			snap, err = sdb.snapshot()
+		} else {
+			err = errors.New(fmt.Sprintf("Shard %s does not support "+
+				"snapshots.", shd.path))
+		}
+		if err != nil {
+			shd.release()
+			break
+		}
+		snaps = append(snaps, snap)
+		shd.release()
+	}
+	if err != nil {
+		for shdIdx := range snaps {
+			store.shards[shdIdx].releaseSnapshot(snaps[shdIdx])
+		}
+		return nil, nil, err
+	}
+	manifest := &common.SnapshotManifest{
+		DaemonId:      store.shardInfo.DaemonId,
+		LayoutVersion: store.shardInfo.LayoutVersion,
+		Backend:       store.backend,
+		Placement:     store.placement.Name(),
+		Shards:        make([]string, len(snaps)),
+		TimeMs:        common.TimeToUnixMs(time.Now().UTC()),
+	}
+	for shdIdx := range manifest.Shards {
+		manifest.Shards[shdIdx] = snapshotShardDir(shdIdx)
+	}
+	if store.seqsEnabled {
+		manifest.SeqWatermark = store.seqWatermark()
+	}
+	return snaps, manifest, nil
+}
+
+// Release a shard snapshot.  The shardDB must still be open, so we acquire
+// the shard first.
+func (shd *shard) releaseSnapshot(snap shardSnapshot) {
+	shd.ldbLock.RLock()
+	defer shd.ldbLock.RUnlock()
+	if shd.ldb != nil {
+		snap.release()
+	}
+}
+
+// Copy the captured shards to the snapshot directory, and write the manifest.
+func (job *snapshotJob) run(store *dataStore, snaps []shardSnapshot,
+	dest string) {
+	var err error
+	for shdIdx := range snaps {
+		shd := store.shards[shdIdx]
+		if err == nil {
+			err = shd.writeSnapshot(snaps[shdIdx],
+				dest+conf.PATH_SEP+snapshotShardDir(shdIdx))
+		}
+		shd.releaseSnapshot(snaps[shdIdx])
+		if err == nil {
+			job.lock.Lock()
+			job.status.ShardsDone++
+			job.lock.Unlock()
+		}
+	}
+	if err == nil {
+		err = writeSnapshotManifest(dest, job.status.Manifest)
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.status.EndMs = common.TimeToUnixMs(time.Now().UTC())
+	if err != nil {
+		job.status.State = common.SNAPSHOT_FAILED
+		job.status.Error = err.Error()
+		store.lg.Errorf("The snapshot to %s failed: %s\n", dest, err.Error())
+		return
+	}
+	job.status.State = common.SNAPSHOT_DONE
+	store.lg.Infof("Finished the snapshot to %s in %d ms.\n", dest,
+		job.status.EndMs-job.status.StartMs)
+}
+
+// Write a captured shard to path.  The shard stays acquired while we copy it,
+// so that it isn't closed underneath us.
+func (shd *shard) writeSnapshot(snap shardSnapshot, path string) error {
+	shd.ldbLock.RLock()
+	defer shd.ldbLock.RUnlock()
+	if shd.ldb == nil {
+		return errors.New(fmt.Sprintf("Shard %s was closed before it could "+
+			"be copied.", shd.path))
+	}
+	err := os.MkdirAll(path, 0777)
+	if err == nil {
+		err = snap.writeTo(path)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("Failed to copy shard %s to %s: %s",
+			shd.path, path, err.Error()))
+	}
+	return nil
+}
+
+// Write the manifest of a finished snapshot.  We write it to a temporary file
+// first, so that the manifest only appears once it is complete.
+func writeSnapshotManifest(dest string,
+	manifest *common.SnapshotManifest) error {
+	buf, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := dest + conf.PATH_SEP + SNAPSHOT_MANIFEST_FILE_NAME
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.New(fmt.Sprintf("Failed to write the snapshot "+
+			"manifest %s: %s", path, err.Error()))
+	}
+	syncDir(dest)
+	return nil
+}
+
+// Read the manifest of the snapshot in dir.
+func readSnapshotManifest(dir string) (*common.SnapshotManifest, error) {
+	path := dir + conf.PATH_SEP + SNAPSHOT_MANIFEST_FILE_NAME
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(fmt.Sprintf("%s does not exist.  The "+
+				"snapshot in %s is incomplete, or %s is not a snapshot.",
+				path, dir, dir))
+		}
+		return nil, err
+	}
+	var manifest common.SnapshotManifest
+	err = json.Unmarshal(buf, &manifest)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse the snapshot "+
+			"manifest %s: %s", path, err.Error()))
+	}
+	return &manifest, nil
+}
+
+// Reads the spans in a snapshot, for verification.  It never writes to the
+// snapshot.
+type SnapshotReader struct {
+	// The manifest of the snapshot.
+	Manifest *common.SnapshotManifest
+
+	// The loader holding the snapshot shards.
+	dld *DataStoreLoader
+}
+
+// Open the snapshot in dir.  The configuration supplies the logging and
+// leveldb settings; the datastore settings come from the snapshot manifest.
+func OpenSnapshot(cnf *conf.Config, dir string) (*SnapshotReader, error) {
+	dld := NewDataStoreLoader(cnf)
+	manifest, err := dld.LoadSnapshot(dir)
+	if err != nil {
+		dld.Close()
+		return nil, err
+	}
+	return &SnapshotReader{Manifest: manifest, dld: dld}, nil
+}
+
+func (rdr *SnapshotReader) Close() {
+	if rdr.dld != nil {
+		rdr.dld.Close()
+		rdr.dld = nil
+	}
+}
+
+// Find a span in the snapshot, or return nil if it is not there.
+func (rdr *SnapshotReader) FindSpan(sid common.SpanId) (*common.Span, error) {
+	primaryKey := append([]byte{SPAN_ID_INDEX_PREFIX}, sid.Val()...)
+	for shdIdx := range rdr.dld.shards {
+		shd := rdr.dld.shards[shdIdx]
+		buf, err := shd.ldb.Get(rdr.dld.readOpts, primaryKey)
+		if err != nil {
+			return nil, err
+		}
+		if buf != nil {
+			return rdr.decodeSpan(shd, sid, buf)
+		}
+	}
+	return nil, nil
+}
+
+// Call visit on each span in the snapshot, in span ID order within each
+// shard, until it returns false.  Each span has its Seq field set if it has
+// a sequence number.
+func (rdr *SnapshotReader) VisitSpans(visit func(span *common.Span) bool) error {
+	prefix := []byte{SPAN_ID_INDEX_PREFIX}
+	for shdIdx := range rdr.dld.shards {
+		shd := rdr.dld.shards[shdIdx]
+		cont, err := func() (bool, error) {
+			iter := shd.ldb.NewIterator(rdr.dld.readOpts)
+			defer iter.Close()
+			for iter.Seek(prefix); iter.Valid(); iter.Next() {
+				key := iter.Key()
+				if !bytes.HasPrefix(key, prefix) {
+					break
+				}
+				span, err := rdr.decodeSpan(shd,
+					common.SpanId(key[1:]), iter.Value())
+				if err != nil {
+					return false, err
+				}
+				if !visit(span) {
+					return false, nil
+				}
+			}
+			return true, iter.GetError()
+		}()
+		if err != nil || !cont {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rdr *SnapshotReader) decodeSpan(shd *ShardLoader, sid common.SpanId,
+	buf []byte) (*common.Span, error) {
+	buf, err := openSpanRecord(shd.cipher, sid, buf)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Snapshot shard %s: %s",
+			shd.path, err.Error()))
+	}
+	span, err := decodeSpan(sid, buf)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Snapshot shard %s: error "+
+			"decoding span %s: %s", shd.path, sid.String(), err.Error()))
+	}
+	seqBuf, err := shd.ldb.Get(rdr.dld.readOpts, spanSeqKey(sid))
+	if err != nil {
+		return nil, err
+	}
+	if len(seqBuf) == 8 {
+		span.Seq = keyToU64(seqBuf)
+	}
+	return span, nil
+}
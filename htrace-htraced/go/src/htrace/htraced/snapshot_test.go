@@ -0,0 +1,192 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	for _, backend := range TEST_DISK_BACKENDS {
+		testSnapshot(t, backend)
+	}
+}
+
+func testSnapshot(t *testing.T, backend string) {
+	const SPANS_PER_BATCH = 10
+	htraceBld := &MiniHTracedBuilder{Name: "TestSnapshot" + backend,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_BACKEND:             backend,
+			conf.HTRACE_DATASTORE_SEQUENCE_NUMBERS:    "true",
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "30000",
+		},
+		DataDirs:     make([]string, 3),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	snapDir, err := ioutil.TempDir(os.TempDir(), "TestSnapshot"+backend)
+	if err != nil {
+		t.Fatalf("failed to create TempDir: %s\n", err.Error())
+	}
+	defer os.RemoveAll(snapDir)
+	dest := snapDir + "/snap"
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	status, err := hcl.SnapshotStatus()
+	if err != nil {
+		t.Fatalf("SnapshotStatus failed: %s\n", err.Error())
+	}
+	if status.State != common.SNAPSHOT_NONE {
+		t.Fatalf("Expected no snapshot, but got %s\n", asJson(status))
+	}
+
+	// Ingest spans in the background until we are told to stop.
+	var numIngested int64
+	stop := make(chan interface{})
+	var wg sync.WaitGroup
+	stopIngesting := func() {
+		if stop != nil {
+			close(stop)
+			wg.Wait()
+			stop = nil
+		}
+	}
+	defer stopIngesting()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for batch := int64(1); ; batch++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			rnd := rand.New(rand.NewSource(batch))
+			ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+			for i := 0; i < SPANS_PER_BATCH; i++ {
+				ing.IngestSpan(test.NewRandomSpan(rnd, []*common.Span{}))
+			}
+			ing.Close(time.Now())
+			atomic.AddInt64(&numIngested, SPANS_PER_BATCH)
+		}
+	}()
+	ht.Store.WrittenSpans.Waits(SPANS_PER_BATCH)
+	status, err = hcl.Snapshot(dest)
+	if err != nil {
+		t.Fatalf("Snapshot(%s) failed: %s\n", dest, err.Error())
+	}
+	manifest := status.Manifest
+	if manifest == nil || manifest.SeqWatermark <= 1 {
+		t.Fatalf("Expected a manifest with a sequence watermark, but got "+
+			"%s\n", asJson(status))
+	}
+	for status.State == common.SNAPSHOT_RUNNING {
+		time.Sleep(time.Millisecond)
+		status, err = hcl.SnapshotStatus()
+		if err != nil {
+			t.Fatalf("SnapshotStatus failed: %s\n", err.Error())
+		}
+	}
+	if status.State != common.SNAPSHOT_DONE {
+		t.Fatalf("The snapshot failed: %s\n", asJson(status))
+	}
+	_, err = hcl.Snapshot(snapDir)
+	common.AssertErrContains(t, err, "is not empty")
+	if status.ShardsDone != 3 || status.TotalShards != 3 {
+		t.Fatalf("Expected 3 of 3 shards to be done, but got %s\n",
+			asJson(status))
+	}
+
+	// Keep ingesting until some spans land above the watermark.
+	for ht.Store.seqWatermark() <= manifest.SeqWatermark {
+		time.Sleep(time.Millisecond)
+	}
+	stopIngesting()
+	ht.Store.WrittenSpans.Waits(atomic.LoadInt64(&numIngested) - SPANS_PER_BATCH)
+
+	expected := make(map[string]uint64)
+	spans, _ := ht.Store.FindSpansBySeq(0, int(numIngested)+1)
+	for i := range spans {
+		if spans[i].Seq < manifest.SeqWatermark {
+			expected[spans[i].Id.String()] = spans[i].Seq
+		}
+	}
+	if len(expected) == len(spans) {
+		t.Fatalf("Expected some spans to be written after the snapshot.\n")
+	}
+	rdr, err := OpenSnapshot(ht.Cnf, dest)
+	if err != nil {
+		t.Fatalf("OpenSnapshot(%s) failed: %s\n", dest, err.Error())
+	}
+	defer rdr.Close()
+	if rdr.Manifest.DaemonId != manifest.DaemonId ||
+		rdr.Manifest.SeqWatermark != manifest.SeqWatermark {
+		t.Fatalf("Expected manifest %s, but read %s\n", asJson(manifest),
+			asJson(rdr.Manifest))
+	}
+	numFound := 0
+	err = rdr.VisitSpans(func(span *common.Span) bool {
+		seq, ok := expected[span.Id.String()]
+		if !ok {
+			t.Fatalf("Unexpected span %s with sequence number %d in the "+
+				"snapshot.\n", span.Id.String(), span.Seq)
+		}
+		if seq != span.Seq {
+			t.Fatalf("Expected span %s to have sequence number %d in the "+
+				"snapshot, but it had %d.\n", span.Id.String(), seq, span.Seq)
+		}
+		numFound++
+		return true
+	})
+	if err != nil {
+		t.Fatalf("VisitSpans failed: %s\n", err.Error())
+	}
+	if numFound != len(expected) {
+		t.Fatalf("Expected %d spans in the snapshot, but found %d.\n",
+			len(expected), numFound)
+	}
+	span, err := rdr.FindSpan(spans[0].Id)
+	if err != nil || span == nil {
+		t.Fatalf("Failed to find span %s in the snapshot.\n",
+			spans[0].Id.String())
+	}
+	span, err = rdr.FindSpan(spans[len(spans)-1].Id)
+	if err != nil || span != nil {
+		t.Fatalf("Found span %s in the snapshot, but it was written "+
+			"afterwards.\n", spans[len(spans)-1].Id.String())
+	}
+}
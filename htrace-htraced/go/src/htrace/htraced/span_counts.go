@@ -0,0 +1,174 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sync/atomic"
+)
+
+// Each shard keeps an in-memory count of the spans it holds.  The shard
+// goroutine adjusts the count as it writes new spans and reaps old ones, and
+// saves it in the ShardInfo on each heartbeat and when the shard is closed.
+// While a shard is open, its ShardInfo is marked unclean.  If htraced exits
+// without closing the shard, the saved count may be stale, so the next
+// heartbeat after startup recounts the spans in the shard.  Until then, the
+// count is reported as approximate.
+//
+// The oldest and newest begin times aren't stored anywhere.  We find them by
+// looking at the first and last entries of the begin time index.
+
+// Load the span count from the shard's ShardInfo, and mark the count as
+// unclean until the shard is closed.  Read-only shards are left as they are.
+func (shd *shard) loadSpanCount(info *ShardInfo) {
+	infoCopy := *info
+	shd.info = &infoCopy
+	atomic.StoreUint64(&shd.numSpans, info.SpanCount)
+	if info.SpanCountClean {
+		atomic.StoreInt32(&shd.recountPending, 0)
+	} else {
+		shd.store.lg.Infof("Shard %s was not closed cleanly.  Its span "+
+			"count of %d will be recounted.\n", shd.path, info.SpanCount)
+		atomic.StoreInt32(&shd.recountPending, 1)
+	}
+	if !shd.store.readOnly {
+		shd.saveSpanCount(false)
+	}
+}
+
+// Save the span count in the shard's ShardInfo.  If clean is true, and no
+// recount is pending, the saved count is marked as exact.
+func (shd *shard) saveSpanCount(clean bool) {
+	info := *shd.info
+	info.SpanCount = atomic.LoadUint64(&shd.numSpans)
+	info.SpanCountClean = clean && (atomic.LoadInt32(&shd.recountPending) == 0)
+	err := writeShardInfo(shd.ldb, shd.store.writeOpts, &info)
+	if err != nil {
+		shd.store.lg.Errorf("Error saving the span count of shard %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+	}
+}
+
+// Decrement the span count after a span has been deleted.
+func (shd *shard) decrementSpanCount() {
+	// The count can be too low while a recount is pending.  Don't let it
+	// wrap around.
+	if atomic.LoadUint64(&shd.numSpans) > 0 {
+		atomic.AddUint64(&shd.numSpans, ^uint64(0))
+	}
+}
+
+// Recount the spans in the shard if necessary, and save the count.  This is
+// called from the shard goroutine, so no spans can be written concurrently.
+func (shd *shard) updateSpanCount() {
+	if atomic.LoadInt32(&shd.recountPending) != 0 {
+		shd.recountSpans()
+	}
+	shd.saveSpanCount(false)
+}
+
+// Count the spans in the shard by scanning the primary index.
+func (shd *shard) recountSpans() {
+	lg := shd.store.lg
+	prefix := []byte{SPAN_ID_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(shd.store.bulkOpts)
+	defer iter.Close()
+	var numSpans uint64
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		if !bytes.HasPrefix(iter.Key(), prefix) {
+			break
+		}
+		numSpans++
+	}
+	err := iter.GetError()
+	if err != nil {
+		lg.Errorf("Error recounting the spans in shard %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+		return
+	}
+	lg.Infof("Recounted %d span(s) in shard %s.  The saved count was %d.\n",
+		numSpans, shd.path, atomic.LoadUint64(&shd.numSpans))
+	atomic.StoreUint64(&shd.numSpans, numSpans)
+	atomic.StoreInt32(&shd.recountPending, 0)
+}
+
+// Get the begin time stored in a begin time index key.
+func beginTimeFromKey(key []byte) int64 {
+	return int64(keyToU64(key[1:9]) ^ 0x8000000000000000)
+}
+
+// Find the earliest and latest begin times in the shard's begin time index.
+// Returns false if the index is empty.
+func (shd *shard) findBeginTimeRange() (int64, int64, bool) {
+	prefix := []byte{BEGIN_TIME_INDEX_PREFIX}
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	iter.Seek(prefix)
+	if !iter.Valid() || !bytes.HasPrefix(iter.Key(), prefix) {
+		return 0, 0, false
+	}
+	oldest := beginTimeFromKey(iter.Key())
+	// Seek to the first key after the index, and step back.
+	iter.Seek([]byte{BEGIN_TIME_INDEX_PREFIX + 1})
+	if iter.Valid() {
+		iter.Prev()
+	} else {
+		iter.SeekToLast()
+	}
+	if !iter.Valid() || !bytes.HasPrefix(iter.Key(), prefix) {
+		return oldest, oldest, true
+	}
+	return oldest, beginTimeFromKey(iter.Key()), true
+}
+
+// Get the approximate number of spans in the datastore, and the range of
+// their begin times.
+func (store *dataStore) SpanCounts() *common.SpanCounts {
+	counts := &common.SpanCounts{}
+	found := false
+	for i := range store.shards {
+		shd := store.shards[i]
+		if !shd.acquire() {
+			// We don't know how many spans a quarantined shard holds.
+			counts.NumSpansApproximate = true
+			continue
+		}
+		counts.NumSpans += atomic.LoadUint64(&shd.numSpans)
+		if atomic.LoadInt32(&shd.recountPending) != 0 {
+			counts.NumSpansApproximate = true
+		}
+		oldest, newest, ok := shd.findBeginTimeRange()
+		shd.release()
+		if !ok {
+			continue
+		}
+		if !found || oldest < counts.OldestBeginMs {
+			counts.OldestBeginMs = oldest
+		}
+		if !found || newest > counts.NewestBeginMs {
+			counts.NewestBeginMs = newest
+		}
+		found = true
+	}
+	return counts
+}
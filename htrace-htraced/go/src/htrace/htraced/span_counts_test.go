@@ -0,0 +1,177 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"os"
+	"testing"
+	"time"
+)
+
+func expectSpanCounts(t *testing.T, hcl *htrace.Client, spans []*common.Span,
+	approximate bool) {
+	counts, err := hcl.GetSpanCounts()
+	if err != nil {
+		t.Fatalf("GetSpanCounts failed: %s\n", err.Error())
+	}
+	if counts.NumSpansApproximate != approximate {
+		t.Fatalf("Expected NumSpansApproximate = %v, but got %v\n",
+			approximate, counts.NumSpansApproximate)
+	}
+	if approximate {
+		return
+	}
+	if counts.NumSpans != uint64(len(spans)) {
+		t.Fatalf("Expected NumSpans = %d, but got %d\n",
+			len(spans), counts.NumSpans)
+	}
+	oldest, newest := spans[0].Begin, spans[0].Begin
+	for i := range spans {
+		if spans[i].Begin < oldest {
+			oldest = spans[i].Begin
+		}
+		if spans[i].Begin > newest {
+			newest = spans[i].Begin
+		}
+	}
+	if counts.OldestBeginMs != oldest {
+		t.Fatalf("Expected OldestBeginMs = %d, but got %d\n",
+			oldest, counts.OldestBeginMs)
+	}
+	if counts.NewestBeginMs != newest {
+		t.Fatalf("Expected NewestBeginMs = %d, but got %d\n",
+			newest, counts.NewestBeginMs)
+	}
+}
+
+func buildSpanCountsHTraced(t *testing.T, name string,
+	dataDirs []string) (*MiniHTraced, *htrace.Client) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_DATASTORE_HEARTBEAT_PERIOD_MS: "300000",
+		},
+		DataDirs:            dataDirs,
+		KeepDataDirsOnClose: true,
+		WrittenSpans:        common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		ht.Close()
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	return ht, hcl
+}
+
+func TestSpanCounts(t *testing.T) {
+	ht, hcl := buildSpanCountsHTraced(t, "TestSpanCounts", make([]string, 2))
+	dataDirs := make([]string, len(ht.DataDirs))
+	copy(dataDirs, ht.DataDirs)
+	defer func() {
+		if ht != nil {
+			ht.Close()
+		}
+		for i := range dataDirs {
+			os.RemoveAll(dataDirs[i])
+		}
+	}()
+	counts, err := hcl.GetSpanCounts()
+	if err != nil {
+		t.Fatalf("GetSpanCounts failed: %s\n", err.Error())
+	}
+	if counts.NumSpans != 0 || counts.NumSpansApproximate ||
+		counts.OldestBeginMs != 0 ||
+		counts.NewestBeginMs != 0 {
+		t.Fatalf("Expected no spans in an empty datastore, but got %s\n",
+			asJson(counts))
+	}
+
+	// Rewriting a span should not change the count.
+	NUM_TEST_SPANS := 30
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	ingestSpans(ht, allSpans)
+	ingestSpans(ht, allSpans[0:1])
+	expectSpanCounts(t, hcl, allSpans, false)
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	var total uint64
+	for i := range stats.Dirs {
+		if stats.Dirs[i].NumSpans == 0 {
+			t.Fatalf("Expected spans in shard %s\n", stats.Dirs[i].Path)
+		}
+		total += stats.Dirs[i].NumSpans
+	}
+	if total != uint64(NUM_TEST_SPANS) {
+		t.Fatalf("Expected the shards to hold %d spans, but they hold %d\n",
+			NUM_TEST_SPANS, total)
+	}
+
+	// The count survives a clean restart.
+	ht.Close()
+	ht, hcl = buildSpanCountsHTraced(t, "TestSpanCounts2", dataDirs)
+	expectSpanCounts(t, hcl, allSpans, false)
+
+	// Simulate an unclean shutdown by clearing the saved counts.
+	hcnf := ht.Cnf.Clone()
+	ht.Close()
+	ht = nil
+	dld := NewDataStoreLoader(hcnf)
+	dld.LoadShards()
+	for shardIdx := range dld.shards {
+		sinfo, err := dld.shards[shardIdx].readShardInfo()
+		if err != nil {
+			dld.Close()
+			t.Fatalf("error reading shard info for shard %s: %s\n",
+				dld.shards[shardIdx].path, err.Error())
+		}
+		sinfo.SpanCount = 0
+		sinfo.SpanCountClean = false
+		err = dld.shards[shardIdx].writeShardInfo(sinfo)
+		if err != nil {
+			dld.Close()
+			t.Fatalf("error writing shard info for shard %s: %s\n",
+				dld.shards[shardIdx].path, err.Error())
+		}
+	}
+	dld.Close()
+	ht, hcl = buildSpanCountsHTraced(t, "TestSpanCounts3", dataDirs)
+	expectSpanCounts(t, hcl, allSpans, true)
+
+	// The next heartbeat recounts the spans.
+	for i := range ht.Store.shards {
+		ht.Store.shards[i].heartbeats <- nil
+	}
+	common.WaitFor(time.Minute*1, time.Millisecond*10, func() bool {
+		counts, err := hcl.GetSpanCounts()
+		if err != nil {
+			t.Fatalf("GetSpanCounts failed: %s\n", err.Error())
+		}
+		return !counts.NumSpansApproximate
+	})
+	expectSpanCounts(t, hcl, allSpans, false)
+}
@@ -0,0 +1,132 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"htrace/conf"
+	"strings"
+)
+
+//
+// Failed spans.
+//
+// Clients may say whether a span failed by setting its Error field.  Most
+// instrumentation predates the field, and marks failures by convention
+// instead, with an info key like "error" or "exception", or a timeline
+// annotation.  So when a span arrives without the field, we decide from the
+// conventions listed in span.error.info.keys and
+// span.error.timeline.prefixes.  The decision is stored in the span, so that
+// changing the conventions later doesn't change the spans which were already
+// written.
+//
+// Failed spans also get an entry in the error index, which is ordered by
+// begin time, like the root index.  So a query for the failures in a time
+// range only reads the failed spans.  Like the other index entries, the entry
+// is removed when the span is deleted, or rewritten as a span which didn't
+// fail.
+//
+
+type spanErrorRules struct {
+	// The info keys which mark a span as failed.
+	infoKeys []string
+
+	// The timeline annotation prefixes which mark a span as failed.
+	timelinePrefixes []string
+}
+
+func newSpanErrorRules(cnf *conf.Config) *spanErrorRules {
+	return &spanErrorRules{
+		infoKeys: splitConfList(cnf.Get(conf.HTRACE_SPAN_ERROR_INFO_KEYS)),
+		timelinePrefixes: splitConfList(
+			cnf.Get(conf.HTRACE_SPAN_ERROR_TIMELINE_PREFIXES)),
+	}
+}
+
+// Split a comma-separated configuration value, dropping empty entries.
+func splitConfList(str string) []string {
+	ret := make([]string, 0)
+	for _, entry := range strings.Split(str, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry != "" {
+			ret = append(ret, entry)
+		}
+	}
+	return ret
+}
+
+// Decide whether a span failed, and set its Error field to match.  A value
+// sent by the client wins over the conventions.  Returns true if the span
+// failed.
+func (rules *spanErrorRules) apply(span *common.Span) bool {
+	failed := false
+	if span.Error != nil {
+		failed = *span.Error
+	} else {
+		failed = rules.matches(span)
+	}
+	if failed {
+		span.Error = &failed
+	} else {
+		span.Error = nil
+	}
+	return failed
+}
+
+// Returns true if the conventions mark a span as failed.
+func (rules *spanErrorRules) matches(span *common.Span) bool {
+	for _, key := range rules.infoKeys {
+		if val, present := span.Info[key]; present && !isFalseValue(val) {
+			return true
+		}
+	}
+	for i := range span.TimelineAnnotations {
+		msg := span.TimelineAnnotations[i].Msg
+		for _, prefix := range rules.timelinePrefixes {
+			if strings.HasPrefix(msg, prefix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Returns true if an info value says that something didn't happen.
+func isFalseValue(val string) bool {
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "", "false", "no", "0":
+		return true
+	default:
+		return false
+	}
+}
+
+func errorIndexKey(span *common.Span) []byte {
+	return append(append([]byte{ERROR_INDEX_PREFIX},
+		u64toSlice(s2u64(span.Begin))...), span.Id.Val()...)
+}
+
+// Count a failed span, for the per-tracer error metrics.
+func (ing *SpanIngestor) recordError(tracerId string) {
+	if ing.errors == nil {
+		ing.errors = make(map[string]int)
+	}
+	ing.errors[tracerId]++
+}
@@ -0,0 +1,229 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"strconv"
+	"testing"
+)
+
+// Query for the spans which did or didn't fail, and which begin at or after
+// beginMs.  Returns the spans and the total number of rows scanned.
+func queryErrorSpans(t *testing.T, ht *MiniHTraced, isError string,
+	beginMs int64) ([]*common.Span, int) {
+	spans, err, numScanned := ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.IS_ERROR,
+				Val:   isError,
+			},
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   strconv.FormatInt(beginMs, 10),
+			},
+		},
+		Lim: 10000,
+	})
+	if err != nil {
+		t.Fatalf("Query for error=%s failed: %s\n", isError, err.Error())
+	}
+	totalScanned := 0
+	for i := range numScanned {
+		totalScanned += numScanned[i]
+	}
+	return spans, totalScanned
+}
+
+func TestSpanErrors(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestSpanErrors",
+		Cnf: map[string]string{
+			conf.HTRACE_SPAN_ERROR_TIMELINE_PREFIXES: "ERROR:",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	const hour = int64(400000)
+	baseMs := hour * DESC_STATS_HOUR_MS
+	spans := setDescStatsSpans(createRandomTestSpans(40), "ok", hour,
+		1000000)
+	for i := range spans {
+		spans[i].TracerId = "tracerA"
+		spans[i].Info = nil
+		spans[i].TimelineAnnotations = nil
+	}
+	failed, notFailed := true, false
+	for i := 0; i < 5; i++ {
+		spans[i].Description = "explicit"
+		spans[i].Error = &failed
+	}
+	for i := 5; i < 10; i++ {
+		spans[i].Description = "info"
+		spans[i].Info = common.TraceInfoMap{"error": "true"}
+	}
+	for i := 10; i < 12; i++ {
+		spans[i].Description = "info"
+		spans[i].Info = common.TraceInfoMap{
+			"exception": "java.io.IOException"}
+	}
+	spans[12].Info = common.TraceInfoMap{"error": "false"}
+	spans[13].Info = common.TraceInfoMap{"error": "true"}
+	spans[13].Error = &notFailed
+	spans[14].Description = "timeline"
+	spans[14].TimelineAnnotations = []common.TimelineAnnotation{
+		common.TimelineAnnotation{Time: baseMs + 14, Msg: "ERROR: disk full"},
+	}
+	const numFailed = 13
+	ingestSpans(ht, spans)
+
+	// Only the failed spans come back, and only they are scanned.
+	errSpans, numScanned := queryErrorSpans(t, ht, "true", baseMs)
+	if len(errSpans) != numFailed {
+		t.Fatalf("Expected %d failed spans, but got %s\n", numFailed,
+			asJson(errSpans))
+	}
+	for i := range errSpans {
+		if !errSpans[i].IsError() {
+			t.Fatalf("Span %s didn't fail.\n", errSpans[i].String())
+		}
+	}
+	if numScanned > numFailed+len(ht.Store.shards) {
+		t.Fatalf("Scanned %d rows to find %d failed spans.\n", numScanned,
+			numFailed)
+	}
+
+	// The begin time bounds the scan of the error index.
+	errSpans, numScanned = queryErrorSpans(t, ht, "true", baseMs+5)
+	if len(errSpans) != 8 {
+		t.Fatalf("Expected 8 failed spans to begin at or after %d, but got "+
+			"%s\n", baseMs+5, asJson(errSpans))
+	}
+	if numScanned > 8+len(ht.Store.shards) {
+		t.Fatalf("Scanned %d rows to find 8 failed spans.\n", numScanned)
+	}
+	okSpans, _ := queryErrorSpans(t, ht, "false", baseMs)
+	if len(okSpans) != len(spans)-numFailed {
+		t.Fatalf("Expected %d spans which didn't fail, but got %d\n",
+			len(spans)-numFailed, len(okSpans))
+	}
+	for _, idx := range []int{12, 13} {
+		span := ht.Store.FindSpan(spans[idx].Id)
+		if span.IsError() || span.Error != nil {
+			t.Fatalf("Span %d should not have failed: %s\n", idx,
+				span.String())
+		}
+	}
+
+	// The plan says which index the query read.
+	page, err := ht.Store.HandleQueryPage(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.IS_ERROR,
+				Val:   "true",
+			},
+		},
+		Lim:  100,
+		Plan: true,
+	})
+	if err != nil {
+		t.Fatalf("Paged query failed: %s\n", err.Error())
+	}
+	if page.Plan == nil || page.Plan.Index != "error" {
+		t.Fatalf("Expected to read the error index, but got %s\n",
+			asJson(page.Plan))
+	}
+
+	// The description statistics count the failed spans.
+	resp := getDescStats(t, hcl, baseMs, baseMs+DESC_STATS_HOUR_MS, 10)
+	expectedErrors := map[string]uint64{
+		"ok": 0, "explicit": 5, "info": 7, "timeline": 1,
+	}
+	if len(resp.Descriptions) != len(expectedErrors) {
+		t.Fatalf("Unexpected description statistics %s\n", asJson(resp))
+	}
+	for i := range resp.Descriptions {
+		stats := &resp.Descriptions[i]
+		if stats.Errors != expectedErrors[stats.Description] {
+			t.Fatalf("Expected %d errors for %s, but got %s\n",
+				expectedErrors[stats.Description], stats.Description,
+				asJson(stats))
+		}
+	}
+
+	// So do the server stats.
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.ErrorSpans != numFailed ||
+		stats.ErrorSpansByTracer["tracerA"] != numFailed {
+		t.Fatalf("Expected %d failed spans from tracerA, but got %d, and "+
+			"%v\n", numFailed, stats.ErrorSpans, stats.ErrorSpansByTracer)
+	}
+
+	// Rewriting a failed span as one which didn't fail removes it from the
+	// error index.
+	rewritten := *spans[0]
+	rewritten.Error = &notFailed
+	ingestSpans(ht, []*common.Span{&rewritten})
+	errSpans, _ = queryErrorSpans(t, ht, "true", baseMs)
+	if len(errSpans) != numFailed-1 {
+		t.Fatalf("Expected %d failed spans after the rewrite, but got %d\n",
+			numFailed-1, len(errSpans))
+	}
+	for i := range errSpans {
+		if errSpans[i].Id.Equal(rewritten.Id) {
+			t.Fatalf("Span %s is still in the error index.\n",
+				rewritten.Id.String())
+		}
+	}
+
+	// Invalid values are rejected.
+	_, err, _ = ht.Store.HandleQuery(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.CONTAINS,
+				Field: common.IS_ERROR,
+				Val:   "true",
+			},
+		},
+		Lim: 10,
+	})
+	if err == nil {
+		t.Fatalf("Expected a CONTAINS query on %s to fail.\n",
+			common.IS_ERROR)
+	}
+}
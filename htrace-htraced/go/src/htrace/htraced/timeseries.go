@@ -0,0 +1,229 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"time"
+)
+
+//
+// Span counts by time.
+//
+// /query/timeseries counts the spans which begin in a time window, in buckets
+// of equal width, so that the web UI can draw the volume of spans over time
+// before anyone runs a query.  Like /query/values, it scans the begin time
+// index of each shard once, and the scan limit is divided evenly between the
+// shards.  If a query is given, its predicates filter the spans, decoding only
+// the fields they need, as the query source does.  The time window is given
+// separately, so the query can't have begin time predicates.
+//
+// When the description statistics can answer, we use them instead of
+// scanning.  That is when there is no filter, or only a filter on a single
+// description, and the buckets are whole hours which line up with the hours
+// of the statistics.  Every hour in the window must have statistics, and a
+// description must have been tracked for the whole of each hour it was seen
+// in.  The statistics describe the finished spans as they were ingested,
+// less those deleted by downsampling, so they leave out active spans and
+// spans which end before they begin, and count a span which was written twice
+// twice.  Callers which need the
+// counts of the stored spans can turn the statistics off.
+//
+
+// Count the spans which begin in [beginMs, endMs) in the given number of
+// buckets.  If query is non-nil, only the spans which match it are counted.
+// At most scanLim spans are scanned.  If useStats is true, the counts are
+// taken from the description statistics when they can be.
+func (store *dataStore) QueryTimeSeries(query *common.Query, beginMs int64,
+	endMs int64, numBuckets int, scanLim int,
+	useStats bool) (*common.TimeSeries, error) {
+	bucketMs := (endMs - beginMs + int64(numBuckets) - 1) / int64(numBuckets)
+	ts := &common.TimeSeries{
+		Field:    common.BEGIN_TIME,
+		BeginMs:  beginMs,
+		EndMs:    endMs,
+		BucketMs: bucketMs,
+		Counts:   make([]uint64, numBuckets),
+	}
+	var preds []*predicateData
+	var scope []bool
+	if query != nil {
+		pq, err := store.loadQuery(query, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if pq.prev != nil {
+			return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION,
+				nil, "Span counts can't start after a previous span.")
+		}
+		for i := range pq.preds {
+			if pq.preds[i].Field == common.BEGIN_TIME {
+				return nil, common.NewHtraceError(common.ERR_QUERY_VALIDATION,
+					nil, "The query can't have begin time predicates.  "+
+						"Use the begin and end of the window instead.")
+			}
+		}
+		preds, scope = pq.preds, pq.scope
+	}
+	if useStats && scope == nil && store.countFromStats(ts, preds) {
+		return ts, nil
+	}
+	numShards := 0
+	for i := range store.shards {
+		if scope == nil || scope[i] {
+			numShards++
+		}
+	}
+	if numShards == 0 {
+		return ts, nil
+	}
+	shardLim := (scanLim + numShards - 1) / numShards
+	for i := range store.shards {
+		if scope != nil && !scope[i] {
+			continue
+		}
+		shd := store.shards[i]
+		if !shd.acquire() {
+			continue
+		}
+		numScanned, partial := shd.scanTimeSeries(ts, preds, shardLim)
+		shd.release()
+		ts.NumScanned += numScanned
+		if partial {
+			ts.Partial = true
+		}
+	}
+	return ts, nil
+}
+
+// Fill in the counts of a time series from the description statistics, if
+// they can answer.  Returns false if they can't.
+func (store *dataStore) countFromStats(ts *common.TimeSeries,
+	preds []*predicateData) bool {
+	dst := store.descStats
+	if dst == nil || ts.BucketMs%DESC_STATS_HOUR_MS != 0 ||
+		ts.BeginMs%DESC_STATS_HOUR_MS != 0 ||
+		ts.BeginMs+ts.BucketMs*int64(len(ts.Counts)) != ts.EndMs {
+		return false
+	}
+	var desc *string
+	if len(preds) > 1 {
+		return false
+	} else if len(preds) == 1 {
+		pred := preds[0]
+		if pred.Field != common.DESCRIPTION || pred.Op != common.EQUALS ||
+			pred.negated {
+			return false
+		}
+		desc = &pred.Val
+	}
+	firstHour := descStatsHourOf(ts.BeginMs)
+	hoursPerBucket := ts.BucketMs / DESC_STATS_HOUR_MS
+	counts, ok := dst.countByHour(firstHour,
+		firstHour+hoursPerBucket*int64(len(ts.Counts)), desc)
+	if !ok {
+		return false
+	}
+	for i := range counts {
+		ts.Counts[int64(i)/hoursPerBucket] += counts[i]
+	}
+	ts.FromStats = true
+	return true
+}
+
+// Scan the shard for the spans which begin in the window of a time series
+// and match the predicates, and count them.  At most lim spans are scanned.
+// Returns the number of spans scanned, and true if there were more.
+func (shd *shard) scanTimeSeries(ts *common.TimeSeries,
+	preds []*predicateData, lim int) (int, bool) {
+	lg := shd.store.lg
+	searchKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(ts.BeginMs))...)
+	endKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(ts.EndMs))...)
+	iter := shd.ldb.NewIterator(shd.store.scanOpts)
+	defer iter.Close()
+	numScanned := 0
+	for iter.Seek(searchKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if numScanned >= lim {
+			return numScanned, true
+		}
+		numScanned++
+		if len(preds) > 0 {
+			sid := common.SpanId(key[9:])
+			buf := shd.findSpanBytes(sid)
+			if buf == nil {
+				// The span was reaped after we read the index entry.
+				continue
+			}
+			matched, err := shd.spanBytesMatch(sid, buf, preds)
+			if err != nil {
+				lg.Warnf("Shard(%s): scanTimeSeries: error decoding span "+
+					"%s: %s\n", shd.path, sid.String(), err.Error())
+				continue
+			}
+			if !matched {
+				continue
+			}
+		}
+		begin := int64(keyToU64(key[1:9]) ^ 0x8000000000000000)
+		ts.Counts[(begin-ts.BeginMs)/ts.BucketMs]++
+	}
+	return numScanned, false
+}
+
+// Check whether a span satisfies the predicates.  Only the fields which the
+// predicates need are decoded.
+func (shd *shard) spanBytesMatch(sid common.SpanId, buf []byte,
+	preds []*predicateData) (bool, error) {
+	cand, err := newSpanCandidate(shd, sid, buf)
+	if err != nil {
+		return false, err
+	}
+	defer cand.release()
+	var span *common.Span
+	for i := range preds {
+		target := &cand.span
+		if preds[i].Field == common.NUM_PARENTS {
+			err = cand.loadNumParents()
+			if err != nil {
+				return false, err
+			}
+		}
+		if preds[i].needsFullSpan() {
+			if span == nil {
+				span, err = cand.materialize()
+				if err != nil {
+					return false, err
+				}
+			}
+			target = span
+		}
+		if !preds[i].accepts(target) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,209 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"reflect"
+	"testing"
+)
+
+// Count the spans which begin in each bucket of a time series.
+func expectedTimeSeries(spans []*common.Span, beginMs int64, endMs int64,
+	numBuckets int, desc string) []uint64 {
+	bucketMs := (endMs - beginMs + int64(numBuckets) - 1) / int64(numBuckets)
+	counts := make([]uint64, numBuckets)
+	for i := range spans {
+		if spans[i].Begin < beginMs || spans[i].Begin >= endMs {
+			continue
+		}
+		if desc != "" && spans[i].Description != desc {
+			continue
+		}
+		counts[(spans[i].Begin-beginMs)/bucketMs]++
+	}
+	return counts
+}
+
+func TestQueryTimeSeries(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestQueryTimeSeries",
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Hour k of the 6 hours gets 3 * (k + 1) spans, spread evenly over the
+	// hour.  Every third span is a "put".
+	const hour = int64(400000)
+	const numHours = 6
+	baseMs := hour * DESC_STATS_HOUR_MS
+	endMs := baseMs + numHours*DESC_STATS_HOUR_MS
+	spans := createRandomTestSpans(3 * numHours * (numHours + 1) / 2)
+	spanIdx := 0
+	for k := int64(0); k < numHours; k++ {
+		num := 3 * (k + 1)
+		for j := int64(0); j < num; j++ {
+			span := spans[spanIdx]
+			span.Begin = baseMs + k*DESC_STATS_HOUR_MS +
+				j*(DESC_STATS_HOUR_MS/num)
+			span.End = span.Begin + 100
+			span.Description = "get"
+			if spanIdx%3 == 0 {
+				span.Description = "put"
+			}
+			spanIdx++
+		}
+	}
+	ingestSpans(ht, spans)
+
+	// The histogram matches the distribution, and sums to the total.  Whole
+	// hours are served from the description statistics.
+	for _, numBuckets := range []int{1, 2, 3, 6, 7, 12, 100} {
+		ts, err := hcl.QueryTimeSeries(nil, baseMs, endMs, numBuckets, 1000)
+		if err != nil {
+			t.Fatalf("QueryTimeSeries failed: %s\n", err.Error())
+		}
+		expected := expectedTimeSeries(spans, baseMs, endMs, numBuckets, "")
+		if !reflect.DeepEqual(expected, ts.Counts) || ts.Partial {
+			t.Fatalf("Expected %v with %d buckets, but got %s\n", expected,
+				numBuckets, asJson(ts))
+		}
+		var total uint64
+		for i := range ts.Counts {
+			total += ts.Counts[i]
+		}
+		if total != uint64(len(spans)) {
+			t.Fatalf("Expected the counts to sum to %d, but got %s\n",
+				len(spans), asJson(ts))
+		}
+		fromStats := numHours%numBuckets == 0
+		if ts.FromStats != fromStats {
+			t.Fatalf("Expected FromStats=%t with %d buckets, but got %s\n",
+				fromStats, numBuckets, asJson(ts))
+		}
+		if !fromStats && ts.NumScanned != len(spans) {
+			t.Fatalf("Expected %d spans to be scanned, but got %s\n",
+				len(spans), asJson(ts))
+		}
+	}
+
+	// The statistics give the same counts as a scan, with and without a
+	// description filter.
+	putQuery := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "put",
+			},
+		},
+	}
+	for _, query := range []*common.Query{nil, putQuery} {
+		desc := ""
+		if query != nil {
+			desc = "put"
+		}
+		expected := expectedTimeSeries(spans, baseMs, endMs, 3, desc)
+		scanned, err := ht.Store.QueryTimeSeries(query, baseMs, endMs, 3,
+			1000, false)
+		if err != nil {
+			t.Fatalf("QueryTimeSeries failed: %s\n", err.Error())
+		}
+		fromStats, err := ht.Store.QueryTimeSeries(query, baseMs, endMs, 3,
+			1000, true)
+		if err != nil {
+			t.Fatalf("QueryTimeSeries failed: %s\n", err.Error())
+		}
+		if scanned.FromStats || !fromStats.FromStats ||
+			!reflect.DeepEqual(expected, scanned.Counts) ||
+			!reflect.DeepEqual(expected, fromStats.Counts) {
+			t.Fatalf("Expected %v for description '%s', but got %s and "+
+				"%s\n", expected, desc, asJson(scanned), asJson(fromStats))
+		}
+	}
+
+	// Other filters are applied while scanning.
+	ts, err := hcl.QueryTimeSeries(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "put",
+			},
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.TRACER_ID,
+				Val:   spans[0].TracerId,
+			},
+		},
+	}, baseMs, endMs, 6, 1000)
+	if err != nil {
+		t.Fatalf("QueryTimeSeries failed: %s\n", err.Error())
+	}
+	expected := make([]uint64, 6)
+	for i := range spans {
+		if spans[i].Description == "put" &&
+			spans[i].TracerId == spans[0].TracerId {
+			expected[(spans[i].Begin-baseMs)/DESC_STATS_HOUR_MS]++
+		}
+	}
+	if ts.FromStats || !reflect.DeepEqual(expected, ts.Counts) {
+		t.Fatalf("Expected %v, but got %s\n", expected, asJson(ts))
+	}
+
+	// A tiny scan limit gives a partial result.
+	ts, err = hcl.QueryTimeSeries(nil, baseMs, endMs, 7, 4)
+	if err != nil {
+		t.Fatalf("QueryTimeSeries failed: %s\n", err.Error())
+	}
+	var total uint64
+	for i := range ts.Counts {
+		total += ts.Counts[i]
+	}
+	if !ts.Partial || ts.NumScanned != 4 || total != 4 {
+		t.Fatalf("Expected a partial result counting 4 spans, but got %s\n",
+			asJson(ts))
+	}
+
+	_, err = hcl.QueryTimeSeries(nil, baseMs, endMs, 0, 1000)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.QueryTimeSeries(nil, endMs, baseMs, 6, 1000)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.QueryTimeSeries(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   "0",
+			},
+		},
+	}, baseMs, endMs, 6, 1000)
+	expectErrorCode(t, err, common.ERR_QUERY_VALIDATION)
+}
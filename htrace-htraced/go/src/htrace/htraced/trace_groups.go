@@ -0,0 +1,179 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"sort"
+)
+
+// Query results can be grouped by the trace they belong to, for UIs which
+// show one row per trace.  We find the trace of each result by following its
+// first parent until we reach a span with no parents.  The parent index is
+// written by clients, so the chain may be broken, or even contain a cycle.  In
+// that case, the result is grouped under the highest ancestor we could find.
+
+// The maximum number of parents we will follow to find the root of a span.
+const MAX_TRACE_ROOT_DEPTH = 1000
+
+// Finds the roots of spans.  The spans fetched and the roots found are cached,
+// so that results which share ancestors don't walk them again.  A resolver
+// should only be used for a single request.
+type traceRootResolver struct {
+	store *dataStore
+
+	// The spans we have fetched, keyed by ID.  Spans which could not be
+	// found map to nil.
+	spans map[string]*common.Span
+
+	// The root of each span we have walked through, keyed by ID.
+	roots map[string]*common.Span
+
+	// The IDs of the spans whose root is incomplete.
+	incomplete map[string]bool
+
+	// The number of spans we have fetched from the datastore.
+	numFetched int
+}
+
+func newTraceRootResolver(store *dataStore) *traceRootResolver {
+	return &traceRootResolver{
+		store:      store,
+		spans:      make(map[string]*common.Span),
+		roots:      make(map[string]*common.Span),
+		incomplete: make(map[string]bool),
+	}
+}
+
+// Get a span, fetching it from the datastore if we haven't already.
+func (rsv *traceRootResolver) getSpan(sid common.SpanId) *common.Span {
+	span, ok := rsv.spans[string(sid)]
+	if !ok {
+		span = rsv.store.FindSpan(sid)
+		rsv.numFetched++
+		rsv.spans[string(sid)] = span
+	}
+	return span
+}
+
+// Find the root of a span.  Returns the root, and true if it is incomplete.
+func (rsv *traceRootResolver) resolve(span *common.Span) (*common.Span, bool) {
+	rsv.spans[string(span.Id)] = span
+	path := make([]string, 0, 8)
+	visited := make(map[string]bool)
+	cur := span
+	var root *common.Span
+	incomplete := false
+	for {
+		key := string(cur.Id)
+		if cached, ok := rsv.roots[key]; ok {
+			root = cached
+			incomplete = rsv.incomplete[key]
+			break
+		}
+		path = append(path, key)
+		visited[key] = true
+		if len(cur.Parents) == 0 {
+			root = cur
+			break
+		}
+		parentId := cur.Parents[0]
+		parent := rsv.getSpan(parentId)
+		if parent == nil || visited[string(parentId)] ||
+			len(path) >= MAX_TRACE_ROOT_DEPTH {
+			root = cur
+			incomplete = true
+			break
+		}
+		cur = parent
+	}
+	for i := range path {
+		rsv.roots[path[i]] = root
+		if incomplete {
+			rsv.incomplete[path[i]] = true
+		}
+	}
+	return root, incomplete
+}
+
+// Sorts trace groups so that the group with the newest match comes first.
+type traceGroupsByNewest struct {
+	groups []*common.TraceGroup
+	newest []int64
+}
+
+func (g *traceGroupsByNewest) Len() int {
+	return len(g.groups)
+}
+
+func (g *traceGroupsByNewest) Less(i, j int) bool {
+	if g.newest[i] != g.newest[j] {
+		return g.newest[i] > g.newest[j]
+	}
+	return g.groups[i].Root.Id.Compare(g.groups[j].Root.Id) < 0
+}
+
+func (g *traceGroupsByNewest) Swap(i, j int) {
+	g.groups[i], g.groups[j] = g.groups[j], g.groups[i]
+	g.newest[i], g.newest[j] = g.newest[j], g.newest[i]
+}
+
+// Group query results by the root of their trace.  The groups are ordered by
+// the begin time of their newest match, newest first, and at most lim groups
+// are returned.
+func (store *dataStore) GroupByTrace(spans []*common.Span,
+	lim int) []*common.TraceGroup {
+	return groupByTrace(newTraceRootResolver(store), spans, lim)
+}
+
+func groupByTrace(rsv *traceRootResolver, spans []*common.Span,
+	lim int) []*common.TraceGroup {
+	sorter := &traceGroupsByNewest{
+		groups: make([]*common.TraceGroup, 0),
+		newest: make([]int64, 0),
+	}
+	groupIdx := make(map[string]int)
+	for i := range spans {
+		root, incomplete := rsv.resolve(spans[i])
+		idx, ok := groupIdx[string(root.Id)]
+		if !ok {
+			idx = len(sorter.groups)
+			groupIdx[string(root.Id)] = idx
+			sorter.groups = append(sorter.groups, &common.TraceGroup{
+				Root:    root,
+				Matches: make([]*common.Span, 0, 1),
+			})
+			sorter.newest = append(sorter.newest, spans[i].Begin)
+		}
+		group := sorter.groups[idx]
+		group.Matches = append(group.Matches, spans[i])
+		if incomplete {
+			group.Incomplete = true
+		}
+		if spans[i].Begin > sorter.newest[idx] {
+			sorter.newest[idx] = spans[i].Begin
+		}
+	}
+	sort.Sort(sorter)
+	if len(sorter.groups) > lim {
+		return sorter.groups[0:lim]
+	}
+	return sorter.groups
+}
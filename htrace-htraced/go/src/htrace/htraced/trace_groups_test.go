@@ -0,0 +1,144 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"testing"
+)
+
+// Create a span for the trace grouping tests.  The span ID is derived from
+// idx, so spans sort by idx.
+func newTraceGroupTestSpan(idx int, begin int64, desc string,
+	parents ...*common.Span) *common.Span {
+	span := &common.Span{
+		Id: common.TestId(fmt.Sprintf("%032x", idx)),
+		SpanData: common.SpanData{
+			Begin:       begin,
+			End:         begin + 5,
+			Description: desc,
+			Parents:     []common.SpanId{},
+			TracerId:    "tgtest",
+		},
+	}
+	for i := range parents {
+		span.Parents = append(span.Parents, parents[i].Id)
+	}
+	return span
+}
+
+func expectTraceGroup(t *testing.T, group *common.TraceGroup,
+	root *common.Span, incomplete bool, matches ...*common.Span) {
+	common.ExpectSpansEqual(t, root, group.Root)
+	if group.Incomplete != incomplete {
+		t.Fatalf("Expected the group of %s to have Incomplete = %t\n",
+			root.Id.String(), incomplete)
+	}
+	if len(group.Matches) != len(matches) {
+		t.Fatalf("Expected %d matches in the group of %s, but got %s\n",
+			len(matches), root.Id.String(), asJson(group.Matches))
+	}
+	for i := range matches {
+		common.ExpectSpansEqual(t, matches[i], group.Matches[i])
+	}
+}
+
+func TestGroupByTrace(t *testing.T) {
+	a1 := newTraceGroupTestSpan(1, 100, "root")
+	a2 := newTraceGroupTestSpan(2, 110, "middle", a1)
+	a3 := newTraceGroupTestSpan(3, 120, "match", a2)
+	a4 := newTraceGroupTestSpan(4, 130, "match", a2)
+	b1 := newTraceGroupTestSpan(5, 200, "match")
+	b2 := newTraceGroupTestSpan(6, 210, "match", b1)
+	// c1 is never stored, so c2 is the highest ancestor of c3 we can find.
+	c1 := newTraceGroupTestSpan(7, 300, "missing")
+	c2 := newTraceGroupTestSpan(8, 305, "middle", c1)
+	c3 := newTraceGroupTestSpan(9, 310, "match", c2)
+	htraceBld := &MiniHTracedBuilder{Name: "TestGroupByTrace",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	ingestSpans(ht, []*common.Span{a1, a2, a3, a4, b1, b2, c2, c3})
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	query := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.DESCRIPTION,
+				Val:   "match",
+			},
+		},
+		Lim: 10,
+	}
+	groups, err := hcl.QueryGrouped(query, 10)
+	if err != nil {
+		t.Fatalf("QueryGrouped failed: %s\n", err.Error())
+	}
+	if len(groups) != 3 {
+		t.Fatalf("Expected 3 groups, but got %s\n", asJson(groups))
+	}
+	expectTraceGroup(t, groups[0], c2, true, c3)
+	expectTraceGroup(t, groups[1], b1, false, b1, b2)
+	expectTraceGroup(t, groups[2], a1, false, a3, a4)
+
+	// The group limit keeps the groups with the newest matches.
+	groups, err = hcl.QueryGrouped(query, 2)
+	if err != nil {
+		t.Fatalf("QueryGrouped failed: %s\n", err.Error())
+	}
+	if len(groups) != 2 {
+		t.Fatalf("Expected 2 groups, but got %s\n", asJson(groups))
+	}
+	expectTraceGroup(t, groups[0], c2, true, c3)
+	expectTraceGroup(t, groups[1], b1, false, b1, b2)
+
+	// Matches which share ancestors only fetch them once.
+	rsv := newTraceRootResolver(ht.Store)
+	groups = groupByTrace(rsv, []*common.Span{a4, a3}, 10)
+	if len(groups) != 1 {
+		t.Fatalf("Expected 1 group, but got %s\n", asJson(groups))
+	}
+	expectTraceGroup(t, groups[0], a1, false, a4, a3)
+	if rsv.numFetched != 2 {
+		t.Fatalf("Expected to fetch 2 ancestors, but fetched %d\n",
+			rsv.numFetched)
+	}
+	// The cached roots are still right for spans higher up the trace.
+	root, incomplete := rsv.resolve(a2)
+	if !root.Id.Equal(a1.Id) || incomplete {
+		t.Fatalf("Expected the root of %s to be %s, but got %s\n",
+			a2.Id.String(), a1.Id.String(), root.Id.String())
+	}
+	if rsv.numFetched != 2 {
+		t.Fatalf("Expected no more fetches, but fetched %d\n", rsv.numFetched)
+	}
+}
@@ -0,0 +1,422 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"time"
+	"unicode"
+)
+
+//
+// Trace tags.
+//
+// A trace tag is a string, such as "incident-1234", which is attached to the
+// root of a trace after its spans have been written, so that the trace can be
+// found again later.  Tags are set through /span/{id}/tags, and the traces
+// which carry a tag are listed by /tags/{tag}.
+//
+// Tags are kept in the first shard, apart from the spans, so that tagging a
+// trace doesn't rewrite any of them:
+//
+// j[tag][0][8-byte-big-endian-root-sid] -> {}
+// y[8-byte-big-endian-root-sid][tag] -> 8-byte-big-endian-creation-time
+//
+// The j keys list the roots carrying each tag in span id order, which is the
+// order /tags/{tag} pages through them in.  The y keys list the tags of each
+// root.  Both are always written and removed in the same batch.
+//
+// When a trace's root expires, its tags are kept unless
+// trace.tags.reap.orphans is set.  In that case, on each datastore heartbeat,
+// the tags whose root can't be found are removed, once they are older than
+// the reaper date.  A tag added speculatively, before its root was written,
+// is therefore kept for at least the span expiry time.
+//
+
+// The maximum length of a tag, in bytes.
+const MAX_TRACE_TAG_LEN = 256
+
+// The default and maximum number of roots returned by /tags/{tag}.
+const DEFAULT_TAGGED_TRACES_LIM = 100
+const MAX_TAGGED_TRACES_LIM = 10000
+
+type traceTagger struct {
+	store *dataStore
+
+	// True if we remove the tags of traces whose root has expired.
+	reapOrphans bool
+
+	// The maximum number of tags a trace can carry.
+	maxPerTrace int
+
+	// Held while changing tags, so that the number of tags of a trace
+	// can't change between counting and writing them.
+	lock sync.Mutex
+
+	// The channel on which we receive datastore heartbeats.
+	heartbeats chan interface{}
+
+	// Tracks whether the reaping goroutine has exited.
+	exited sync.WaitGroup
+}
+
+func newTraceTagger(store *dataStore, cnf *conf.Config) *traceTagger {
+	tgr := &traceTagger{
+		store:       store,
+		reapOrphans: cnf.GetBool(conf.HTRACE_TRACE_TAGS_REAP_ORPHANS),
+		maxPerTrace: cnf.GetInt(conf.HTRACE_TRACE_TAGS_MAX_PER_TRACE),
+	}
+	if tgr.maxPerTrace < 1 {
+		tgr.maxPerTrace = 1
+	}
+	return tgr
+}
+
+func traceTagKey(tag string, root common.SpanId) []byte {
+	return append(traceTagPrefix(tag), root.Val()...)
+}
+
+// Get the prefix of the j keys of a tag.
+func traceTagPrefix(tag string) []byte {
+	return append(append([]byte{TRACE_TAG_PREFIX}, []byte(tag)...), 0)
+}
+
+func traceTagsByRootKey(root common.SpanId, tag string) []byte {
+	return append(append([]byte{TRACE_TAGS_BY_ROOT_PREFIX}, root.Val()...),
+		[]byte(tag)...)
+}
+
+func validateTraceTag(tag string) error {
+	if tag == "" || len(tag) > MAX_TRACE_TAG_LEN {
+		return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+			"Invalid tag '%s'.  Tags must be between 1 and %d bytes long.",
+			tag, MAX_TRACE_TAG_LEN)
+	}
+	for _, r := range tag {
+		if r == '/' || r == '?' || r == '#' || unicode.IsControl(r) {
+			return common.NewHtraceError(common.ERR_BAD_PARAMETER, nil,
+				"Invalid tag '%s'.  Tags can't contain /, ?, #, or control "+
+					"characters.", tag)
+		}
+	}
+	return nil
+}
+
+// Read the tags of a trace root from the first shard, which must have been
+// acquired.
+func (tgr *traceTagger) readTags(shd *shard,
+	root common.SpanId) []string {
+	prefix := append([]byte{TRACE_TAGS_BY_ROOT_PREFIX}, root.Val()...)
+	iter := shd.ldb.NewIterator(tgr.store.readOpts)
+	defer iter.Close()
+	tags := make([]string, 0)
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		tags = append(tags, string(key[len(prefix):]))
+	}
+	return tags
+}
+
+// Add and remove tags of a trace.  Returns the tags the trace carries
+// afterwards.
+func (tgr *traceTagger) Tag(root common.SpanId,
+	req *common.TagTraceReq) (*common.TraceTags, error) {
+	store := tgr.store
+	if store.readOnly {
+		return nil, common.NewHtraceError(common.ERR_READ_ONLY, nil,
+			"Can't tag traces: this server is read-only.")
+	}
+	for _, tags := range [][]string{req.Add, req.Remove} {
+		for i := range tags {
+			err := validateTraceTag(tags[i])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if !req.Speculative {
+		span := store.FindSpan(root)
+		if span == nil {
+			return nil, common.NewHtraceError(common.ERR_SPAN_NOT_FOUND,
+				map[string]string{"id": root.String()},
+				"No such span as %s", root.String())
+		}
+		if len(span.Parents) > 0 {
+			return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+				"Span %s is not the root of its trace, so it can't be "+
+					"tagged.", root.String())
+		}
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't tag trace %s, because shard %s, which holds the trace "+
+				"tags, is quarantined.", root.String(), shd.path)
+	}
+	defer shd.release()
+	tgr.lock.Lock()
+	defer tgr.lock.Unlock()
+	tagged := make(map[string]bool)
+	for _, tag := range tgr.readTags(shd, root) {
+		tagged[tag] = true
+	}
+	added := make(map[string]bool)
+	for _, tag := range req.Add {
+		if !tagged[tag] {
+			added[tag] = true
+		}
+	}
+	for _, tag := range req.Remove {
+		delete(added, tag)
+	}
+	numTags := len(added)
+	for tag := range tagged {
+		numTags++
+		for _, removed := range req.Remove {
+			if tag == removed {
+				numTags--
+				break
+			}
+		}
+	}
+	if numTags > tgr.maxPerTrace {
+		return nil, common.NewHtraceError(common.ERR_BAD_REQUEST, nil,
+			"Can't give trace %s %d tags, because a trace can carry at "+
+				"most %d.", root.String(), numTags, tgr.maxPerTrace)
+	}
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	for tag := range added {
+		batch.Put(traceTagKey(tag, root), EMPTY_BYTE_BUF)
+		batch.Put(traceTagsByRootKey(root, tag), u64toSlice(s2u64(nowMs)))
+	}
+	for _, tag := range req.Remove {
+		batch.Delete(traceTagKey(tag, root))
+		batch.Delete(traceTagsByRootKey(root, tag))
+	}
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		shd.checkCorruption(err)
+		return nil, err
+	}
+	tags := tgr.readTags(shd, root)
+	store.lg.Infof("Trace %s now has tag(s) %v\n", root.String(), tags)
+	return &common.TraceTags{RootId: root, Tags: tags}, nil
+}
+
+// Get the tags of a trace.
+func (tgr *traceTagger) Get(root common.SpanId) (*common.TraceTags, error) {
+	shd := tgr.store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't read the tags of trace %s, because shard %s, which "+
+				"holds the trace tags, is quarantined.", root.String(),
+			shd.path)
+	}
+	defer shd.release()
+	return &common.TraceTags{RootId: root, Tags: tgr.readTags(shd, root)},
+		nil
+}
+
+// Find the roots of the traces which carry a tag, in span id order, starting
+// after the given root id.  At most lim roots are returned.
+func (tgr *traceTagger) Find(tag string, after common.SpanId,
+	lim int) (*common.TaggedTraces, error) {
+	err := validateTraceTag(tag)
+	if err != nil {
+		return nil, err
+	}
+	shd := tgr.store.shards[0]
+	if !shd.acquire() {
+		return nil, common.NewHtraceError(common.ERR_SHARD_QUARANTINED, nil,
+			"Can't find the traces tagged %s, because shard %s, which "+
+				"holds the trace tags, is quarantined.", tag, shd.path)
+	}
+	defer shd.release()
+	prefix := traceTagPrefix(tag)
+	startKey := prefix
+	if after != nil {
+		startKey = traceTagKey(tag, after)
+	}
+	resp := &common.TaggedTraces{
+		Tag:     tag,
+		RootIds: make([]common.SpanId, 0),
+	}
+	iter := shd.ldb.NewIterator(tgr.store.readOpts)
+	defer iter.Close()
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		root := common.SpanId(append([]byte{}, key[len(prefix):]...))
+		if after != nil && root.Equal(after) {
+			continue
+		}
+		if len(resp.RootIds) >= lim {
+			resp.Next = resp.RootIds[len(resp.RootIds)-1]
+			break
+		}
+		resp.RootIds = append(resp.RootIds, root)
+	}
+	return resp, nil
+}
+
+// Returns true if the trace with the given root carries a tag.
+func (tgr *traceTagger) HasTag(root common.SpanId, tag string) bool {
+	shd := tgr.store.shards[0]
+	if !shd.acquire() {
+		return false
+	}
+	defer shd.release()
+	val, err := shd.ldb.Get(tgr.store.readOpts, traceTagKey(tag, root))
+	return err == nil && val != nil
+}
+
+// Keep only the spans which are tagged with tag.  Only roots can be tagged,
+// so this only keeps roots.
+func (tgr *traceTagger) filterSpans(spans []*common.Span,
+	tag string) []*common.Span {
+	kept := make([]*common.Span, 0, len(spans))
+	for i := range spans {
+		if tgr.HasTag(spans[i].Id, tag) {
+			kept = append(kept, spans[i])
+		}
+	}
+	return kept
+}
+
+// Keep only the trace groups whose root is tagged with tag.
+func (tgr *traceTagger) filterGroups(groups []*common.TraceGroup,
+	tag string) []*common.TraceGroup {
+	kept := make([]*common.TraceGroup, 0, len(groups))
+	for i := range groups {
+		if tgr.HasTag(groups[i].Root.Id, tag) {
+			kept = append(kept, groups[i])
+		}
+	}
+	return kept
+}
+
+// Start removing orphaned tags on each heartbeat from the given heartbeater,
+// if trace.tags.reap.orphans is set.
+func (tgr *traceTagger) Start(hb *Heartbeater) {
+	if !tgr.reapOrphans || tgr.store.readOnly {
+		return
+	}
+	tgr.heartbeats = make(chan interface{}, 1)
+	tgr.exited.Add(1)
+	go func() {
+		defer tgr.exited.Done()
+		for {
+			_, isOpen := <-tgr.heartbeats
+			if !isOpen {
+				return
+			}
+			tgr.reap()
+		}
+	}()
+	hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "traceTagger",
+		targetChan: tgr.heartbeats,
+	})
+}
+
+// Stop removing orphaned tags.  The heartbeater must already have been shut
+// down.
+func (tgr *traceTagger) Stop() {
+	if tgr.heartbeats == nil {
+		return
+	}
+	close(tgr.heartbeats)
+	tgr.exited.Wait()
+	tgr.heartbeats = nil
+}
+
+// Remove the tags whose root can't be found, and which are older than the
+// reaper date, if trace.tags.reap.orphans is set.  Returns the number of tags
+// removed.
+func (tgr *traceTagger) reap() int {
+	if !tgr.reapOrphans {
+		return 0
+	}
+	store := tgr.store
+	shd := store.shards[0]
+	if !shd.acquire() {
+		return 0
+	}
+	defer shd.release()
+	tgr.lock.Lock()
+	defer tgr.lock.Unlock()
+	urdate := s2u64(store.rpr.GetReaperDate())
+	found := make(map[string]bool)
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	numReaped := 0
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	prefix := []byte{TRACE_TAGS_BY_ROOT_PREFIX}
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		if len(key) < 1+common.SPAN_ID_LEN {
+			continue
+		}
+		val := iter.Value()
+		if len(val) != 8 || binary.BigEndian.Uint64(val) >= urdate {
+			continue
+		}
+		root := common.SpanId(append([]byte{}, key[1:1+common.SPAN_ID_LEN]...))
+		exists, ok := found[string(root)]
+		if !ok {
+			exists = store.FindSpan(root) != nil
+			found[string(root)] = exists
+		}
+		if exists {
+			continue
+		}
+		tag := string(key[1+common.SPAN_ID_LEN:])
+		batch.Delete(append([]byte{}, key...))
+		batch.Delete(traceTagKey(tag, root))
+		numReaped++
+	}
+	if numReaped == 0 {
+		return 0
+	}
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		shd.checkCorruption(err)
+		store.lg.Errorf("Error removing %d orphaned trace tag(s): %s\n",
+			numReaped, err.Error())
+		return 0
+	}
+	store.lg.Infof("Removed %d orphaned trace tag(s).\n", numReaped)
+	return numReaped
+}
@@ -0,0 +1,284 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func expectTags(t *testing.T, tags *common.TraceTags, expected ...string) {
+	if len(expected) == 0 {
+		expected = []string{}
+	}
+	if !reflect.DeepEqual(tags.Tags, expected) {
+		t.Fatalf("Expected trace %s to have tags %v, but it has %v\n",
+			tags.RootId.String(), expected, tags.Tags)
+	}
+}
+
+func TestTraceTags(t *testing.T) {
+	gen := &test.SpanTreeGenerator{
+		Seed:          1940,
+		Depth:         3,
+		NumRoots:      2,
+		MinFanOut:     2,
+		MaxFanOut:     3,
+		MinDurationMs: 1000,
+		MaxDurationMs: 10000,
+		StartMs:       123456789,
+		Nested:        true,
+		Order:         test.PARENT_FIRST,
+	}
+	tree := gen.Generate()
+	htraceBld := &MiniHTracedBuilder{Name: "TestTraceTags",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	err = hcl.WriteSpans(tree.Spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(tree.Spans)))
+	root := tree.Roots[0]
+	child := tree.ChildrenOf(root)[0]
+
+	// Only existing roots can be tagged, unless the request is speculative.
+	_, err = hcl.TagTrace(child, &common.TagTraceReq{
+		Add: []string{"incident-1234"}})
+	expectErrorCode(t, err, common.ERR_BAD_REQUEST)
+	missing := common.TestId("ffffffffffffffffffffffffffffffff")
+	_, err = hcl.TagTrace(missing, &common.TagTraceReq{
+		Add: []string{"incident-1234"}})
+	expectErrorCode(t, err, common.ERR_SPAN_NOT_FOUND)
+	for _, bad := range []string{"", "a/b", "a?b", "a#b", "a\nb",
+		string(make([]byte, MAX_TRACE_TAG_LEN+1))} {
+		_, err = hcl.TagTrace(root, &common.TagTraceReq{
+			Add: []string{bad}})
+		expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	}
+
+	tags, err := hcl.TagTrace(root, &common.TagTraceReq{
+		Add: []string{"incident-1234", "slow"}})
+	if err != nil {
+		t.Fatalf("TagTrace failed: %s\n", err.Error())
+	}
+	expectTags(t, tags, "incident-1234", "slow")
+	tags, err = hcl.GetTraceTags(root)
+	if err != nil {
+		t.Fatalf("GetTraceTags failed: %s\n", err.Error())
+	}
+	expectTags(t, tags, "incident-1234", "slow")
+	traces, err := hcl.FindTracesByTag("incident-1234", nil, 10)
+	if err != nil {
+		t.Fatalf("FindTracesByTag failed: %s\n", err.Error())
+	}
+	if len(traces.RootIds) != 1 || !traces.RootIds[0].Equal(root) ||
+		traces.Next != nil {
+		t.Fatalf("Expected only trace %s to be tagged, but got %s\n",
+			root.String(), asJson(traces))
+	}
+
+	// The tag filters grouped query results and bundles.
+	query := &common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{Op: common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME, Val: "0"},
+		},
+		Lim: len(tree.Spans),
+	}
+	spans, err, _ := ht.Store.HandleQuery(query)
+	if err != nil {
+		t.Fatalf("query failed: %s\n", err.Error())
+	}
+	groups := ht.Store.tags.filterGroups(ht.Store.GroupByTrace(spans, 10),
+		"incident-1234")
+	if len(groups) != 1 || !groups[0].Root.Id.Equal(root) {
+		t.Fatalf("Expected only the group of %s to carry the tag, but got "+
+			"%s\n", root.String(), asJson(groups))
+	}
+	bundle := ht.Store.AssembleTraceBundle(child, len(tree.Spans))
+	if !reflect.DeepEqual(bundle.Manifest.Tags,
+		[]string{"incident-1234", "slow"}) {
+		t.Fatalf("Expected the bundle manifest to list the trace tags, but "+
+			"got %v\n", bundle.Manifest.Tags)
+	}
+	for i, root := range tree.Roots {
+		resp, err := http.Get(fmt.Sprintf("http://%s/span/%s/bundle?tag=%s",
+			ht.Rsv.Addr().String(), root.String(), "incident-1234"))
+		if err != nil {
+			t.Fatalf("failed to fetch bundle: %s\n", err.Error())
+		}
+		resp.Body.Close()
+		expectedStatus := http.StatusOK
+		if i > 0 {
+			expectedStatus = http.StatusNotFound
+		}
+		if resp.StatusCode != expectedStatus {
+			t.Fatalf("Expected status %d for the bundle of %s, but got %d\n",
+				expectedStatus, root.String(), resp.StatusCode)
+		}
+	}
+
+	// Once the tag is removed, the trace is no longer listed.
+	tags, err = hcl.TagTrace(root, &common.TagTraceReq{
+		Remove: []string{"incident-1234"}})
+	if err != nil {
+		t.Fatalf("TagTrace failed: %s\n", err.Error())
+	}
+	expectTags(t, tags, "slow")
+	traces, err = hcl.FindTracesByTag("incident-1234", nil, 10)
+	if err != nil {
+		t.Fatalf("FindTracesByTag failed: %s\n", err.Error())
+	}
+	if len(traces.RootIds) != 0 {
+		t.Fatalf("Expected no traces to be tagged, but got %s\n",
+			asJson(traces))
+	}
+}
+
+func TestTraceTagsPagination(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestTraceTagsPagination",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	const NUM_TRACES = 250
+	expected := make([]common.SpanId, NUM_TRACES)
+	for i := range expected {
+		expected[i] = common.TestId(fmt.Sprintf("%032x", i+1))
+		_, err = ht.Store.tags.Tag(expected[i], &common.TagTraceReq{
+			Add: []string{"batch"}, Speculative: true})
+		if err != nil {
+			t.Fatalf("Tag failed: %s\n", err.Error())
+		}
+	}
+	// Another tag sorts right after this one, and must not be listed.
+	_, err = ht.Store.tags.Tag(expected[0], &common.TagTraceReq{
+		Add: []string{"batch2"}, Speculative: true})
+	if err != nil {
+		t.Fatalf("Tag failed: %s\n", err.Error())
+	}
+	found := make([]common.SpanId, 0, NUM_TRACES)
+	var after common.SpanId
+	for numPages := 0; ; numPages++ {
+		if numPages > NUM_TRACES/7+1 {
+			t.Fatalf("Too many pages: got %d roots so far.\n", len(found))
+		}
+		traces, err := hcl.FindTracesByTag("batch", after, 7)
+		if err != nil {
+			t.Fatalf("FindTracesByTag failed: %s\n", err.Error())
+		}
+		found = append(found, traces.RootIds...)
+		if traces.Next == nil {
+			break
+		}
+		after = traces.Next
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("Paging returned %d roots, but expected %d, in span id "+
+			"order.\n", len(found), len(expected))
+	}
+}
+
+func TestTraceTagsReapOrphans(t *testing.T) {
+	for _, reap := range []bool{false, true} {
+		testTraceTagsReapOrphans(t, reap)
+	}
+}
+
+func testTraceTagsReapOrphans(t *testing.T, reap bool) {
+	htraceBld := &MiniHTracedBuilder{
+		Name: fmt.Sprintf("TestTraceTagsReapOrphans%t", reap),
+		Cnf: map[string]string{
+			conf.HTRACE_TRACE_TAGS_REAP_ORPHANS: fmt.Sprintf("%t", reap),
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	// The root begins in the future, so that the reaper keeps it.
+	root := newTraceGroupTestSpan(1,
+		common.TimeToUnixMs(time.Now().UTC().Add(time.Hour)), "root")
+	createSpans([]common.Span{*root}, ht.Store)
+	orphan := common.TestId(fmt.Sprintf("%032x", 2))
+	for _, sid := range []common.SpanId{root.Id, orphan} {
+		_, err = ht.Store.tags.Tag(sid, &common.TagTraceReq{
+			Add: []string{"incident"}, Speculative: true})
+		if err != nil {
+			t.Fatalf("Tag failed: %s\n", err.Error())
+		}
+	}
+	// Tags newer than the reaper date are kept, even if they are orphaned.
+	if numReaped := ht.Store.tags.reap(); numReaped != 0 {
+		t.Fatalf("Reaped %d tag(s) which were newer than the reaper date.\n",
+			numReaped)
+	}
+	ht.Store.rpr.SetReaperDate(
+		common.TimeToUnixMs(time.Now().UTC().Add(time.Minute)))
+	expectedReaped := 0
+	if reap {
+		expectedReaped = 1
+	}
+	if numReaped := ht.Store.tags.reap(); numReaped != expectedReaped {
+		t.Fatalf("Expected to reap %d orphaned tag(s), but reaped %d.\n",
+			expectedReaped, numReaped)
+	}
+	traces, err := ht.Store.tags.Find("incident", nil, 10)
+	if err != nil {
+		t.Fatalf("Find failed: %s\n", err.Error())
+	}
+	expectedIds := []common.SpanId{root.Id, orphan}
+	if reap {
+		expectedIds = expectedIds[0:1]
+	}
+	if !reflect.DeepEqual(traces.RootIds, expectedIds) {
+		t.Fatalf("Expected the traces tagged incident to be %v, but got %v\n",
+			expectedIds, traces.RootIds)
+	}
+}
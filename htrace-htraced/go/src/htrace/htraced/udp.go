@@ -0,0 +1,235 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"htrace/common"
+	"htrace/conf"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//
+// The UDP span listener.
+//
+// Clients which can't afford to manage TCP connections can send spans to
+// htraced in UDP datagrams, much like statsd.  Each datagram starts with a
+// common.UdpDatagramHeader, followed by the msgpack-encoded spans.  There is
+// no response, so a client never learns whether its spans were stored.
+// Datagrams which can't be decoded are counted in the metrics sink and
+// otherwise ignored.
+//
+// UDP spans are not recorded in the audit log, since each datagram would
+// need its own entry.
+//
+
+type UdpServer struct {
+	lg *common.Logger
+
+	// The datastore we write spans to.
+	store *dataStore
+
+	// The socket we receive datagrams on.
+	conn *net.UDPConn
+
+	// The largest datagram we accept.
+	maxBytes int
+
+	// The buffer we receive datagrams into.  It is one byte bigger than
+	// maxBytes, so that we can tell when a datagram was too big.
+	buf []byte
+
+	// Configuration for msgpack decoding
+	msgpackHandle codec.MsgpackHandle
+
+	// Used to shut down
+	shutdown chan interface{}
+
+	// A WaitGroup used to block until the UDP server has exited.
+	exited sync.WaitGroup
+}
+
+func CreateUdpServer(cnf *conf.Config, store *dataStore) (*UdpServer, error) {
+	lg := common.NewLogger("udp", cnf)
+	addr, err := cnf.GetAddress(conf.HTRACE_UDP_ADDRESS)
+	if err != nil {
+		return nil, err
+	}
+	if conf.IsUnixAddress(addr) {
+		return nil, errors.New(fmt.Sprintf("Invalid value '%s' for %s: "+
+			"the UDP listener can't use a unix socket.", addr,
+			conf.HTRACE_UDP_ADDRESS))
+	}
+	if store.readOnly {
+		return nil, errors.New(fmt.Sprintf("Can't receive spans on %s "+
+			"because the server is read-only.", conf.HTRACE_UDP_ADDRESS))
+	}
+	maxBytes := cnf.GetInt(conf.HTRACE_UDP_MAX_DATAGRAM_BYTES)
+	hdrLen := binary.Size(&common.UdpDatagramHeader{})
+	if maxBytes < hdrLen {
+		return nil, errors.New(fmt.Sprintf("Invalid value %d for %s: it "+
+			"must be at least %d, the size of the datagram header.",
+			maxBytes, conf.HTRACE_UDP_MAX_DATAGRAM_BYTES, hdrLen))
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	recvBufBytes := cnf.GetInt(conf.HTRACE_UDP_RECV_BUFFER_BYTES)
+	if recvBufBytes > 0 {
+		err = conn.SetReadBuffer(recvBufBytes)
+		if err != nil {
+			conn.Close()
+			return nil, errors.New(fmt.Sprintf("Failed to set the UDP "+
+				"receive buffer size to %d: %s", recvBufBytes, err.Error()))
+		}
+	}
+	usv := &UdpServer{
+		lg:       lg,
+		store:    store,
+		conn:     conn,
+		maxBytes: maxBytes,
+		buf:      make([]byte, maxBytes+1),
+		msgpackHandle: codec.MsgpackHandle{
+			WriteExt: true,
+		},
+		shutdown: make(chan interface{}),
+	}
+	usv.exited.Add(1)
+	go usv.run()
+	lg.Infof("Started UDP server on %s.  maxBytes=%d, recvBufBytes=%d.\n",
+		conn.LocalAddr().String(), maxBytes, recvBufBytes)
+	return usv, nil
+}
+
+func (usv *UdpServer) run() {
+	srvAddr := usv.conn.LocalAddr().String()
+	defer func() {
+		usv.lg.Infof("UdpServer on %s exiting\n", srvAddr)
+		usv.exited.Done()
+	}()
+	for {
+		n, from, err := usv.conn.ReadFromUDP(usv.buf)
+		if err != nil {
+			select {
+			case <-usv.shutdown:
+				return
+			default:
+			}
+			usv.lg.Errorf("UdpServer on %s got read error: %s\n", srvAddr,
+				err.Error())
+			continue
+		}
+		usv.handleDatagram(usv.buf[:n], from.IP.String())
+	}
+}
+
+// Decode the spans in a datagram, and write them to the datastore.
+func (usv *UdpServer) handleDatagram(buf []byte, client string) {
+	msink := usv.store.msink
+	atomic.AddUint64(&msink.UdpDatagrams, 1)
+	msink.UpdateBytesReceived(len(buf))
+	if usv.store.pause.check() != nil {
+		atomic.AddUint64(&msink.UdpPausedDatagrams, 1)
+		return
+	}
+	rejections := usv.store.rejections
+	if len(buf) > usv.maxBytes {
+		atomic.AddUint64(&msink.UdpOversizedDatagrams, 1)
+		usv.store.ingestLog.Warnf(client, "%s: Dropping a UDP datagram "+
+			"because it is bigger than %d bytes.\n", client, usv.maxBytes)
+		rejections.recordBytes(common.REJECT_REASON_OVERSIZED, client,
+			REJECTION_TRANSPORT_UDP, fmt.Sprintf("The %d-byte datagram is "+
+				"bigger than %d bytes.", len(buf), usv.maxBytes), buf)
+		return
+	}
+	var hdr common.UdpDatagramHeader
+	err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &hdr)
+	if err != nil {
+		atomic.AddUint64(&msink.UdpDecodeFailures, 1)
+		usv.store.ingestLog.Warnf(client, "%s: Dropping a %d-byte UDP "+
+			"datagram which is too short for the header.\n", client, len(buf))
+		rejections.recordBytes(common.REJECT_REASON_DECODE, client,
+			REJECTION_TRANSPORT_UDP, fmt.Sprintf("The %d-byte datagram is "+
+				"too short for the header.", len(buf)), buf)
+		return
+	}
+	if hdr.Magic != common.UDP_MAGIC || hdr.Version != common.UDP_VERSION_MSGPACK {
+		atomic.AddUint64(&msink.UdpDecodeFailures, 1)
+		usv.store.ingestLog.Warnf(client, "%s: Dropping a UDP datagram with "+
+			"magic 0x%08x and version %d.  Expected magic 0x%08x and version "+
+			"%d.\n", client, hdr.Magic, hdr.Version, common.UDP_MAGIC,
+			common.UDP_VERSION_MSGPACK)
+		rejections.recordBytes(common.REJECT_REASON_DECODE, client,
+			REJECTION_TRANSPORT_UDP, fmt.Sprintf("The datagram has magic "+
+				"0x%08x and version %d.", hdr.Magic, hdr.Version), buf)
+		return
+	}
+	startTime := time.Now()
+	dec := codec.NewDecoderBytes(buf[binary.Size(&hdr):], &usv.msgpackHandle)
+	ing := usv.store.NewSpanIngestor(usv.lg, client, "")
+	ing.SetTransport(REJECTION_TRANSPORT_UDP)
+	defer ing.Close(startTime)
+	for spanIdx := 0; spanIdx < int(hdr.NumSpans); spanIdx++ {
+		var span *common.Span
+		err = dec.Decode(&span)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// The spans we already decoded are still written.
+			atomic.AddUint64(&msink.UdpTruncatedDatagrams, 1)
+			usv.store.ingestLog.Warnf(client, "%s: UDP datagram ended after "+
+				"%d out of %d span(s).\n", client, spanIdx, hdr.NumSpans)
+			rejections.recordBytes(common.REJECT_REASON_DECODE, client,
+				REJECTION_TRANSPORT_UDP, fmt.Sprintf("The datagram ended "+
+					"after %d out of %d span(s).", spanIdx, hdr.NumSpans), buf)
+			return
+		} else if err != nil {
+			atomic.AddUint64(&msink.UdpDecodeFailures, 1)
+			usv.store.ingestLog.Warnf(client, "%s: Failed to decode span %d "+
+				"out of %d in a UDP datagram: %s\n", client, spanIdx,
+				hdr.NumSpans, err.Error())
+			rejections.recordBytes(common.REJECT_REASON_DECODE, client,
+				REJECTION_TRANSPORT_UDP, fmt.Sprintf("Failed to decode span "+
+					"%d out of %d: %s", spanIdx, hdr.NumSpans, err.Error()), buf)
+			return
+		}
+		ing.IngestSpan(span)
+	}
+}
+
+func (usv *UdpServer) Addr() net.Addr {
+	return usv.conn.LocalAddr()
+}
+
+func (usv *UdpServer) Close() {
+	close(usv.shutdown)
+	usv.conn.Close()
+	usv.exited.Wait()
+}
@@ -0,0 +1,148 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/ugorji/go/codec"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"net"
+	"testing"
+	"time"
+)
+
+// Encode a UDP datagram.  numSpans is the span count to put in the header,
+// which need not match the number of spans.
+func makeUdpDatagram(t *testing.T, numSpans int,
+	spans []*common.Span) []byte {
+	var buf bytes.Buffer
+	hdr := common.UdpDatagramHeader{
+		Magic:    common.UDP_MAGIC,
+		Version:  common.UDP_VERSION_MSGPACK,
+		NumSpans: uint16(numSpans),
+	}
+	err := binary.Write(&buf, binary.LittleEndian, &hdr)
+	if err != nil {
+		t.Fatalf("failed to write datagram header: %s\n", err.Error())
+	}
+	enc := codec.NewEncoder(&buf, &codec.MsgpackHandle{WriteExt: true})
+	for i := range spans {
+		err = enc.Encode(spans[i])
+		if err != nil {
+			t.Fatalf("failed to encode span: %s\n", err.Error())
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestUdpServer(t *testing.T) {
+	const NUM_SPANS = 40
+	const MAX_BYTES = 4096
+	htraceBld := &MiniHTracedBuilder{Name: "TestUdpServer",
+		Cnf: map[string]string{
+			conf.HTRACE_UDP_ADDRESS:            "127.0.0.1:0",
+			conf.HTRACE_UDP_MAX_DATAGRAM_BYTES: "4096",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	conn, err := net.Dial("udp", ht.Usv.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial the UDP server: %s\n", err.Error())
+	}
+	defer conn.Close()
+
+	spans := createRandomTestSpans(NUM_SPANS + 1)
+	datagrams := make([][]byte, 0)
+	for i := 0; i < NUM_SPANS; i += 2 {
+		datagrams = append(datagrams, makeUdpDatagram(t, 2, spans[i:i+2]))
+	}
+	// The header says there are two spans, but the second one is cut off.
+	// The first one is still written.
+	truncated := makeUdpDatagram(t, 2, []*common.Span{spans[NUM_SPANS],
+		spans[0]})
+	truncated = truncated[:len(truncated)-10]
+	badMagic := makeUdpDatagram(t, 1, spans[0:1])
+	badMagic[0] = 0
+	garbage := makeUdpDatagram(t, 1, nil)
+	garbage = append(garbage, []byte{0xc1, 0x01, 0x02}...)
+	malformed := [][]byte{
+		truncated,
+		[]byte{0x48, 0x54},
+		badMagic,
+		garbage,
+		make([]byte, MAX_BYTES+1),
+	}
+	for _, datagram := range append(datagrams, malformed...) {
+		_, err = conn.Write(datagram)
+		if err != nil {
+			t.Fatalf("failed to send datagram: %s\n", err.Error())
+		}
+	}
+	ht.Store.WrittenSpans.Waits(NUM_SPANS + 1)
+	numDatagrams := uint64(len(datagrams) + len(malformed))
+	var stats *common.ServerStats
+	common.WaitFor(5*time.Minute, time.Millisecond, func() bool {
+		stats, err = hcl.GetServerStats()
+		if err != nil {
+			t.Fatalf("GetServerStats failed: %s\n", err.Error())
+		}
+		return stats.UdpDatagrams == numDatagrams
+	})
+	if stats.UdpDecodeFailures != 3 || stats.UdpTruncatedDatagrams != 1 ||
+		stats.UdpOversizedDatagrams != 1 {
+		t.Fatalf("Unexpected UDP stats: decodeFailures=%d, truncated=%d, "+
+			"oversized=%d\n", stats.UdpDecodeFailures,
+			stats.UdpTruncatedDatagrams, stats.UdpOversizedDatagrams)
+	}
+	if stats.WrittenSpans != NUM_SPANS+1 {
+		t.Fatalf("Expected %d spans written, but got %d\n", NUM_SPANS+1,
+			stats.WrittenSpans)
+	}
+	for i := range spans {
+		span, err := hcl.FindSpan(spans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", spans[i].Id.String(),
+				err.Error())
+		}
+		expectSpanStored(t, spans[i], span)
+	}
+
+	// The spans are counted against the address they came from.
+	resp, err := hcl.GetClientStats("", "127.0.0.1", 1)
+	if err != nil {
+		t.Fatalf("GetClientStats failed: %s\n", err.Error())
+	}
+	if len(resp.Clients) != 1 || resp.Clients[0].Written != NUM_SPANS+1 {
+		t.Fatalf("Unexpected client stats %s\n", asJson(resp))
+	}
+}
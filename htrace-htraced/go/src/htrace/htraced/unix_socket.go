@@ -0,0 +1,171 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/conf"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+//
+// Unix domain socket listeners.
+//
+// The REST and HRPC servers can listen on a unix socket rather than a TCP
+// port, by setting web.address or hrpc.address to an address such as
+// "unix:///var/run/htraced.sock".  This is cheaper than the loopback
+// interface for a collector running on the same host, and needs no port.
+//
+// A unix socket is a file, which outlives a process which is killed
+// uncleanly.  When we start, we check whether anything is still accepting
+// connections on an existing socket, and remove it if not.  A socket which
+// another process is serving is left alone, so that starting a second daemon
+// with the same configuration fails, just as it does with a TCP port in use.
+//
+// Connections accepted on a unix socket have no meaningful remote address, so
+// we report the address of the socket instead.  That way the logs, the
+// per-client metrics, and the span ingestors all see the unix:// form.
+//
+
+// How long to wait when checking whether an existing socket is still being
+// served.
+const STALE_SOCKET_DIAL_TIMEOUT = time.Second
+
+// The address of a unix socket, in the unix:// form.
+type unixSocketAddr string
+
+func (addr unixSocketAddr) Network() string {
+	return "unix"
+}
+
+func (addr unixSocketAddr) String() string {
+	return string(addr)
+}
+
+// A listener on a unix socket, which reports its address in the unix:// form.
+type unixListener struct {
+	net.Listener
+	addr unixSocketAddr
+}
+
+func (lis *unixListener) Accept() (net.Conn, error) {
+	conn, err := lis.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixConn{Conn: conn, addr: lis.addr}, nil
+}
+
+func (lis *unixListener) Addr() net.Addr {
+	return lis.addr
+}
+
+// A connection accepted on a unix socket.  Its remote address is the address
+// of the socket.
+type unixConn struct {
+	net.Conn
+	addr unixSocketAddr
+}
+
+func (conn *unixConn) RemoteAddr() net.Addr {
+	return conn.addr
+}
+
+// Listen on a normalized REST or HRPC address.  Returns the listener, and
+// whether a stale unix socket had to be removed first.
+func listenOn(cnf *conf.Config, addr string) (net.Listener, bool, error) {
+	network, path := conf.NetworkAddress(addr)
+	if network != "unix" {
+		listener, err := net.Listen(network, path)
+		return listener, false, err
+	}
+	mode, err := getUnixSocketMode(cnf)
+	if err != nil {
+		return nil, false, err
+	}
+	removed, err := removeStaleSocket(path)
+	if err != nil {
+		return nil, false, err
+	}
+	listener, err := net.Listen(network, path)
+	if err != nil {
+		return nil, removed, err
+	}
+	err = os.Chmod(path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, removed, errors.New(fmt.Sprintf("Failed to set the "+
+			"permissions of %s to %04o: %s", path, mode, err.Error()))
+	}
+	return &unixListener{Listener: listener, addr: unixSocketAddr(addr)},
+		removed, nil
+}
+
+func getUnixSocketMode(cnf *conf.Config) (os.FileMode, error) {
+	str := cnf.Get(conf.HTRACE_UNIX_SOCKET_MODE)
+	mode, err := strconv.ParseUint(str, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, errors.New(fmt.Sprintf("Invalid value '%s' for %s: "+
+			"expected permissions in octal, such as 0660.", str,
+			conf.HTRACE_UNIX_SOCKET_MODE))
+	}
+	return os.FileMode(mode), nil
+}
+
+// Remove a unix socket left behind by a process which didn't shut down
+// cleanly.  Returns true if there was one.
+func removeStaleSocket(path string) (bool, error) {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return false, errors.New(fmt.Sprintf("Can't listen on %s, because "+
+			"it exists and is not a socket.", path))
+	}
+	conn, err := net.DialTimeout("unix", path, STALE_SOCKET_DIAL_TIMEOUT)
+	if err == nil {
+		conn.Close()
+		return false, errors.New(fmt.Sprintf("Can't listen on %s, because "+
+			"another process is already listening on it.", path))
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, errors.New(fmt.Sprintf("Failed to remove the stale "+
+			"socket %s: %s", path, err.Error()))
+	}
+	return true, nil
+}
+
+// Get the host part of a client's remote address.  Clients connected over a
+// unix socket are identified by the address of the socket.
+func remoteHost(remoteAddr string) (string, error) {
+	if conf.IsUnixAddress(remoteAddr) {
+		return remoteAddr, nil
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	return host, err
+}
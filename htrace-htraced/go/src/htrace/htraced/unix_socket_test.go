@@ -0,0 +1,197 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildOnUnixSockets(name string, dir string) (*MiniHTraced, error) {
+	htraceBld := &MiniHTracedBuilder{Name: name,
+		Cnf: map[string]string{
+			conf.HTRACE_WEB_ADDRESS: conf.UNIX_ADDRESS_PREFIX +
+				filepath.Join(dir, "rest.sock"),
+			conf.HTRACE_HRPC_ADDRESS: conf.UNIX_ADDRESS_PREFIX +
+				filepath.Join(dir, "hrpc.sock"),
+			conf.HTRACE_UNIX_SOCKET_MODE: "0600",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	return htraceBld.Build()
+}
+
+func expectSocketRemoved(t *testing.T, path string) {
+	_, err := os.Lstat(path)
+	if !os.IsNotExist(err) {
+		t.Fatalf("Expected %s to be removed, but got %v\n", path, err)
+	}
+}
+
+func TestUnixSocketListeners(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir(os.TempDir(), "TestUnixSocketListeners")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	restPath := filepath.Join(dir, "rest.sock")
+	hrpcPath := filepath.Join(dir, "hrpc.sock")
+	ht, err := buildOnUnixSockets("TestUnixSocketListeners", dir)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	common.ExpectStrEqual(t, "unix://"+restPath, ht.Rsv.Addr().String())
+	common.ExpectStrEqual(t, "unix://"+hrpcPath, ht.Hsv.Addr().String())
+	for _, path := range []string{restPath, hrpcPath} {
+		info, err := os.Lstat(path)
+		if err != nil {
+			t.Fatalf("failed to stat %s: %s\n", path, err.Error())
+		}
+		if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+			t.Fatalf("Expected %s to be a socket with mode 0600, but its "+
+				"mode is %s\n", path, info.Mode().String())
+		}
+	}
+
+	// Write spans over HRPC, and read them back over REST.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	rnd := rand.New(rand.NewSource(1931))
+	spans := make([]*common.Span, 10)
+	for i := range spans {
+		spans[i] = test.NewRandomSpan(rnd, spans[0:i])
+	}
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(spans)))
+	info := hcl.TransportInfo()
+	if !info[0].Negotiated {
+		t.Fatalf("Expected the spans to be written over HRPC.\n")
+	}
+	for i := range spans {
+		span, err := hcl.FindSpan(spans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%s) failed: %s\n", spans[i].Id.String(),
+				err.Error())
+		}
+		expectSpanStored(t, spans[i], span)
+	}
+	result, err := hcl.Query(&common.Query{Lim: 100})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(result) != len(spans) {
+		t.Fatalf("Expected %d spans, but the query returned %d\n",
+			len(spans), len(result))
+	}
+
+	// Clients which only use REST can write spans too.
+	rcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer rcl.Close()
+	restSpan := test.NewRandomSpan(rnd, spans)
+	err = rcl.WriteSpans([]*common.Span{restSpan})
+	if err != nil {
+		t.Fatalf("WriteSpans over REST failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+
+	// The server reports the socket addresses.
+	ver, err := hcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	common.ExpectStrEqual(t, "unix://"+restPath, ver.RestAddr)
+	common.ExpectStrEqual(t, "unix://"+hrpcPath, ver.HrpcAddr)
+
+	// A second server can't take over sockets which are in use.
+	_, err = buildOnUnixSockets("TestUnixSocketListeners2", dir)
+	common.AssertErrContains(t, err, "another process is already listening")
+
+	// Closing the server removes the sockets.
+	ht.Close()
+	expectSocketRemoved(t, restPath)
+	expectSocketRemoved(t, hrpcPath)
+}
+
+func TestUnixSocketStaleRecovery(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir(os.TempDir(), "TestUnixSocketStaleRecovery")
+	if err != nil {
+		t.Fatalf("failed to create a temporary directory: %s\n", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	restPath := filepath.Join(dir, "rest.sock")
+	ht, err := buildOnUnixSockets("TestUnixSocketStaleRecovery", dir)
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	// Simulate a crash, which leaves the socket files behind.
+	for _, lis := range []net.Listener{ht.Rsv.listener, ht.Hsv.listener} {
+		lis.(*unixListener).Listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	}
+	ht.Close()
+	_, err = os.Lstat(restPath)
+	if err != nil {
+		t.Fatalf("Expected %s to be left behind: %s\n", restPath, err.Error())
+	}
+
+	// The next server removes the stale sockets and starts normally.
+	ht, err = buildOnUnixSockets("TestUnixSocketStaleRecovery2", dir)
+	if err != nil {
+		t.Fatalf("failed to create datastore on stale sockets: %s",
+			err.Error())
+	}
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	span := test.NewRandomSpan(rand.New(rand.NewSource(1)), nil)
+	err = hcl.WriteSpans([]*common.Span{span})
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	ht.Close()
+
+	// We never remove a file which isn't a socket.
+	err = ioutil.WriteFile(restPath, []byte("not a socket"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write %s: %s\n", restPath, err.Error())
+	}
+	_, err = buildOnUnixSockets("TestUnixSocketStaleRecovery3", dir)
+	common.AssertErrContains(t, err, "exists and is not a socket")
+}
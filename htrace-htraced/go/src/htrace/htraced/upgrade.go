@@ -0,0 +1,371 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+)
+
+//
+// Layout upgrades.
+//
+// Layout version 3 keyed the duration index by the span duration in
+// milliseconds.  Version 4 appends the nanoseconds left over to the
+// milliseconds, so that spans with nanosecond times sort correctly.  Spans
+// written under version 3 never had nanosecond times, so upgrading a shard
+// only means inserting 4 zero bytes after the milliseconds in each of its
+// duration index keys.  This is done in batches of UPGRADE_BATCH_SIZE keys.
+// The keys which have already been rewritten are skipped, so an upgrade which
+// was interrupted can simply be run again.
+//
+// Version 5 adds the description index.  Upgrading a shard means reading each
+// of its spans, and writing the description index entry for it, again in
+// batches of UPGRADE_BATCH_SIZE.  Writing an entry twice does no harm, so
+// this can be run again as well.  Shards with a data key are skipped, since
+// they never have description index entries.
+//
+// Version 6 cuts long descriptions short in the description index keys.
+// Upgrading a version 5 shard means removing all of its description index
+// keys, and then writing them again as for version 5.  Both steps can be run
+// again.
+//
+// The new layout version is written last.
+//
+// The description index of a shard is also rebuilt in the same way when
+// index.description.max.bytes differs from the limit recorded in its
+// ShardInfo.  The new limit is recorded last, so a rebuild which was
+// interrupted is done again from the start.  A read-only datastore can't be
+// rebuilt, so it keeps using the recorded limit.
+//
+
+// The oldest layout version which we can upgrade.
+const OLDEST_UPGRADABLE_LAYOUT_VERSION = 3
+
+// The number of keys to rewrite in each write batch during an upgrade.
+const UPGRADE_BATCH_SIZE = 10000
+
+// The length of a duration index key in layout version 3.
+const V3_DURATION_KEY_LEN = 1 + 8 + common.SPAN_ID_LEN
+
+// Returns true if we can upgrade a datastore with the given layout version.
+func canUpgradeLayout(version uint64) bool {
+	return version >= OLDEST_UPGRADABLE_LAYOUT_VERSION &&
+		version < CURRENT_LAYOUT_VERSION
+}
+
+// Upgrade all the loaded shards to CURRENT_LAYOUT_VERSION.  Quarantined shards
+// are left alone.
+func (dld *DataStoreLoader) upgradeShards() error {
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.info == nil || shd.quarantineErr != nil {
+			continue
+		}
+		if shd.info.LayoutVersion == CURRENT_LAYOUT_VERSION {
+			continue
+		}
+		dld.lg.Infof("Upgrading shard %s from layout version %d to %d.\n",
+			shd.path, shd.info.LayoutVersion, CURRENT_LAYOUT_VERSION)
+		if shd.info.LayoutVersion < 4 {
+			numKeys, err := shd.upgradeDurationIndex()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to upgrade shard %s: "+
+					"%s", shd.path, err.Error()))
+			}
+			dld.lg.Infof("Rewrote %d duration index key(s) in shard %s.\n",
+				numKeys, shd.path)
+		}
+		if shd.info.LayoutVersion == 5 {
+			numKeys, err := shd.clearDescriptionIndex()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to upgrade shard %s: "+
+					"%s", shd.path, err.Error()))
+			}
+			dld.lg.Infof("Removed %d old description index key(s) in shard "+
+				"%s.\n", numKeys, shd.path)
+		}
+		if len(shd.info.WrappedDataKey) == 0 {
+			numKeys, err := shd.buildDescriptionIndex()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to upgrade shard %s: "+
+					"%s", shd.path, err.Error()))
+			}
+			dld.lg.Infof("Wrote %d description index key(s) in shard %s.\n",
+				numKeys, shd.path)
+		}
+		info := *shd.info
+		info.LayoutVersion = CURRENT_LAYOUT_VERSION
+		info.DescriptionIndexMaxBytes = dld.descIndexMaxBytes
+		err := shd.writeShardInfo(&info)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to write the upgraded "+
+				"shard info of shard %s: %s", shd.path, err.Error()))
+		}
+		shd.info = &info
+		dld.lg.Infof("Upgraded shard %s.\n", shd.path)
+	}
+	return nil
+}
+
+// Rebuild the description index of each loaded shard whose recorded
+// index.description.max.bytes differs from the configured one.  Quarantined
+// shards are left alone.
+func (dld *DataStoreLoader) rebuildDescriptionIndexes() error {
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.info == nil || shd.quarantineErr != nil {
+			continue
+		}
+		recorded := shd.info.descriptionIndexMaxBytes()
+		if recorded == dld.descIndexMaxBytes {
+			continue
+		}
+		dld.lg.Infof("Rebuilding the description index of shard %s, since "+
+			"it was built with %s = %d, but it is now %d.\n", shd.path,
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES, recorded,
+			dld.descIndexMaxBytes)
+		if len(shd.info.WrappedDataKey) == 0 {
+			numKeys, err := shd.clearDescriptionIndex()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to rebuild the "+
+					"description index of shard %s: %s", shd.path,
+					err.Error()))
+			}
+			dld.lg.Infof("Removed %d old description index key(s) in shard "+
+				"%s.\n", numKeys, shd.path)
+			numKeys, err = shd.buildDescriptionIndex()
+			if err != nil {
+				return errors.New(fmt.Sprintf("Failed to rebuild the "+
+					"description index of shard %s: %s", shd.path,
+					err.Error()))
+			}
+			dld.lg.Infof("Wrote %d description index key(s) in shard %s.\n",
+				numKeys, shd.path)
+		}
+		info := *shd.info
+		info.DescriptionIndexMaxBytes = dld.descIndexMaxBytes
+		err := shd.writeShardInfo(&info)
+		if err != nil {
+			return errors.New(fmt.Sprintf("Failed to write the shard info "+
+				"of shard %s: %s", shd.path, err.Error()))
+		}
+		shd.info = &info
+	}
+	return nil
+}
+
+// Make sure that the description indexes of all the loaded shards were built
+// with the same index.description.max.bytes, and use that limit, since a
+// read-only datastore can't be rebuilt.
+func (dld *DataStoreLoader) checkDescriptionIndexesMatch() error {
+	first := dld.firstShardInfo()
+	if first == nil {
+		return nil
+	}
+	recorded := first.descriptionIndexMaxBytes()
+	for i := range dld.shards {
+		shd := dld.shards[i]
+		if shd.info == nil {
+			continue
+		}
+		if shd.info.descriptionIndexMaxBytes() != recorded {
+			return errors.New(fmt.Sprintf("The description indexes of the "+
+				"datastore were built with different values of %s, but %s "+
+				"is set.  Start htraced normally once to rebuild them.",
+				conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES,
+				conf.HTRACE_READ_ONLY))
+		}
+	}
+	if recorded != dld.descIndexMaxBytes {
+		dld.lg.Warnf("The description index was built with %s = %d, but it "+
+			"is now %d.  Continuing to use %d, since %s is set.\n",
+			conf.HTRACE_INDEX_DESCRIPTION_MAX_BYTES, recorded,
+			dld.descIndexMaxBytes, recorded, conf.HTRACE_READ_ONLY)
+		dld.descIndexMaxBytes = recorded
+	}
+	return nil
+}
+
+// Rewrite the version 3 duration index keys of the shard in the current
+// layout.  Returns the number of keys rewritten.
+func (shd *ShardLoader) upgradeDurationIndex() (int, error) {
+	numKeys := 0
+	startKey := []byte{DURATION_INDEX_PREFIX}
+	for {
+		batch := shd.ldb.NewWriteBatch()
+		numBatched, nextKey, err := shd.batchDurationIndexUpgrade(batch,
+			startKey)
+		if err == nil && numBatched > 0 {
+			err = shd.ldb.Write(shd.dld.writeOpts, batch)
+		}
+		batch.Close()
+		if err != nil {
+			return numKeys, err
+		}
+		numKeys += numBatched
+		if nextKey == nil {
+			return numKeys, nil
+		}
+		startKey = nextKey
+	}
+}
+
+// Add the rewrites of up to UPGRADE_BATCH_SIZE duration index keys to the
+// batch, starting at startKey.  Returns the number of keys added, and the key
+// to start the next batch at, or nil if there are no more keys.
+func (shd *ShardLoader) batchDurationIndexUpgrade(batch shardBatch,
+	startKey []byte) (int, []byte, error) {
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	defer iter.Close()
+	numBatched := 0
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) == 0 || key[0] != DURATION_INDEX_PREFIX {
+			break
+		}
+		if len(key) != V3_DURATION_KEY_LEN {
+			// This key was already rewritten.
+			continue
+		}
+		if numBatched >= UPGRADE_BATCH_SIZE {
+			return numBatched, append([]byte{}, key...), nil
+		}
+		newKey := make([]byte, 0, len(key)+4)
+		newKey = append(newKey, key[0:9]...)
+		newKey = append(newKey, 0, 0, 0, 0)
+		newKey = append(newKey, key[9:]...)
+		batch.Delete(append([]byte{}, key...))
+		batch.Put(newKey, append([]byte{}, iter.Value()...))
+		numBatched++
+	}
+	return numBatched, nil, iter.GetError()
+}
+
+// Remove all the description index entries of the shard.  Returns the number
+// of entries removed.
+func (shd *ShardLoader) clearDescriptionIndex() (int, error) {
+	numKeys := 0
+	for {
+		batch := shd.ldb.NewWriteBatch()
+		numBatched, err := shd.batchDescriptionIndexRemoval(batch)
+		if err == nil && numBatched > 0 {
+			err = shd.ldb.Write(shd.dld.writeOpts, batch)
+		}
+		batch.Close()
+		if err != nil {
+			return numKeys, err
+		}
+		numKeys += numBatched
+		if numBatched < UPGRADE_BATCH_SIZE {
+			return numKeys, nil
+		}
+	}
+}
+
+// Add the removal of up to UPGRADE_BATCH_SIZE description index entries to
+// the batch.  Returns the number of removals added.
+func (shd *ShardLoader) batchDescriptionIndexRemoval(
+	batch shardBatch) (int, error) {
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	defer iter.Close()
+	numBatched := 0
+	for iter.Seek([]byte{DESCRIPTION_INDEX_PREFIX}); iter.Valid() &&
+		numBatched < UPGRADE_BATCH_SIZE; iter.Next() {
+		key := iter.Key()
+		if len(key) == 0 || key[0] != DESCRIPTION_INDEX_PREFIX {
+			break
+		}
+		batch.Delete(append([]byte{}, key...))
+		numBatched++
+	}
+	return numBatched, iter.GetError()
+}
+
+// Write the description index entries of all the spans in the shard.  Returns
+// the number of entries written.
+func (shd *ShardLoader) buildDescriptionIndex() (int, error) {
+	numKeys := 0
+	startKey := []byte{SPAN_ID_INDEX_PREFIX}
+	for {
+		batch := shd.ldb.NewWriteBatch()
+		numBatched, nextKey, err := shd.batchDescriptionIndexUpgrade(batch,
+			startKey)
+		if err == nil && numBatched > 0 {
+			err = shd.ldb.Write(shd.dld.writeOpts, batch)
+		}
+		batch.Close()
+		if err != nil {
+			return numKeys, err
+		}
+		numKeys += numBatched
+		if nextKey == nil {
+			return numKeys, nil
+		}
+		startKey = nextKey
+	}
+}
+
+// Add the description index entries of up to UPGRADE_BATCH_SIZE spans to the
+// batch, starting at startKey.  Returns the number of entries added, and the
+// key to start the next batch at, or nil if there are no more spans.
+func (shd *ShardLoader) batchDescriptionIndexUpgrade(batch shardBatch,
+	startKey []byte) (int, []byte, error) {
+	iter := shd.ldb.NewIterator(shd.dld.readOpts)
+	defer iter.Close()
+	numBatched := 0
+	for iter.Seek(startKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if len(key) == 0 || key[0] != SPAN_ID_INDEX_PREFIX {
+			break
+		}
+		if numBatched >= UPGRADE_BATCH_SIZE {
+			return numBatched, append([]byte{}, key...), nil
+		}
+		sid := common.SpanId(append([]byte{}, key[1:]...))
+		var data partialSpanData
+		err := decodeSpanBytes(iter.Value(), &data)
+		if err != nil {
+			return numBatched, nil, errors.New(fmt.Sprintf("Error decoding "+
+				"span %s: %s", sid.String(), err.Error()))
+		}
+		desc := indexedDescription(data.Description,
+			data.DescriptionNormalized)
+		batch.Put(append(append([]byte{DESCRIPTION_INDEX_PREFIX},
+			descriptionIndexValue(desc, shd.dld.descIndexMaxBytes)...),
+			sid.Val()...), EMPTY_BYTE_BUF)
+		numBatched++
+	}
+	return numBatched, nil, iter.GetError()
+}
+
+// Returns an error if the datastore needs an upgrade, which can't be done
+// because we may not write to it.
+func checkNoUpgradeNeeded(info *ShardInfo, reason string) error {
+	if info.LayoutVersion == CURRENT_LAYOUT_VERSION {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("The datastore has layout version %d, "+
+		"and must be upgraded to version %d, but %s.  Start htraced "+
+		"normally once to upgrade it.", info.LayoutVersion,
+		CURRENT_LAYOUT_VERSION, reason))
+}
@@ -0,0 +1,145 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"htrace/common"
+	"sort"
+)
+
+// We find the distinct values of a field by scanning the begin time index of
+// each shard for the spans in a time window.  Neither tracer ids nor
+// descriptions are in the index keys, so we read the span records, but only
+// decode the fields we need.  Like the service map, the scan limit is divided
+// evenly between the shards.
+
+// The fields of a span which distinct values can be found for.  The field
+// tags must match those of common.SpanData.
+type distinctValuesSpanData struct {
+	Description string `json:"d"`
+	TracerId    string `json:"r"`
+}
+
+// Returns true if we can find the distinct values of a field.
+func distinctValuesSupported(field common.Field) bool {
+	return field == common.TRACER_ID || field == common.DESCRIPTION
+}
+
+type valueCounts []common.ValueCount
+
+func (vcs valueCounts) Len() int {
+	return len(vcs)
+}
+
+func (vcs valueCounts) Less(i, j int) bool {
+	if vcs[i].Count != vcs[j].Count {
+		return vcs[i].Count > vcs[j].Count
+	}
+	return vcs[i].Value < vcs[j].Value
+}
+
+func (vcs valueCounts) Swap(i, j int) {
+	vcs[i], vcs[j] = vcs[j], vcs[i]
+}
+
+// Scan the shard for spans which begin in [beginMs, endMs), and count the
+// values of the given field.  At most lim spans are scanned.  Returns the
+// number of spans scanned, and true if there were more.
+func (shd *shard) scanDistinctValues(field common.Field, beginMs int64,
+	endMs int64, lim int, counts map[string]int) (int, bool) {
+	lg := shd.store.lg
+	searchKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(beginMs))...)
+	endKey := append([]byte{BEGIN_TIME_INDEX_PREFIX},
+		u64toSlice(s2u64(endMs))...)
+	iter := shd.ldb.NewIterator(shd.store.readOpts)
+	defer iter.Close()
+	numScanned := 0
+	for iter.Seek(searchKey); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if bytes.Compare(key, endKey) >= 0 {
+			break
+		}
+		if numScanned >= lim {
+			return numScanned, true
+		}
+		numScanned++
+		sid := common.SpanId(key[9:])
+		buf := shd.findSpanBytes(sid)
+		if buf == nil {
+			// The span was reaped after we read the index entry.
+			continue
+		}
+		var data distinctValuesSpanData
+		err := decodeSpanBytes(buf, &data)
+		if err != nil {
+			lg.Warnf("Shard(%s): scanDistinctValues: error decoding span "+
+				"%s: %s\n", shd.path, sid.String(), err.Error())
+			continue
+		}
+		if field == common.TRACER_ID {
+			counts[data.TracerId]++
+		} else {
+			counts[data.Description]++
+		}
+	}
+	return numScanned, false
+}
+
+// Find the most common values of a field for spans which begin in
+// [beginMs, endMs).  At most lim values are returned, and at most scanLim
+// spans are scanned.  The field must be one that distinctValuesSupported
+// accepts.
+func (store *dataStore) FindDistinctValues(field common.Field, beginMs int64,
+	endMs int64, lim int, scanLim int) *common.DistinctValues {
+	dv := &common.DistinctValues{
+		Field:   field,
+		BeginMs: beginMs,
+		EndMs:   endMs,
+	}
+	numShards := len(store.shards)
+	shardLim := (scanLim + numShards - 1) / numShards
+	counts := make(map[string]int)
+	for i := range store.shards {
+		shd := store.shards[i]
+		if !shd.acquire() {
+			continue
+		}
+		numScanned, partial := shd.scanDistinctValues(field, beginMs, endMs,
+			shardLim, counts)
+		shd.release()
+		dv.NumScanned += numScanned
+		if partial {
+			dv.Partial = true
+		}
+	}
+	values := make(valueCounts, 0, len(counts))
+	for value, count := range counts {
+		values = append(values, common.ValueCount{Value: value, Count: count})
+	}
+	sort.Sort(values)
+	if len(values) > lim {
+		values = values[0:lim]
+	}
+	dv.Values = values
+	dv.NumValues = len(counts)
+	return dv
+}
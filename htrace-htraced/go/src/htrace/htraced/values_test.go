@@ -0,0 +1,114 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"reflect"
+	"testing"
+)
+
+func TestDistinctValues(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestDistinctValues",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// 17 spans in the window [1000, 2000), and a few outside it.
+	tracerIds := []struct {
+		value string
+		count int
+	}{{"alpha", 10}, {"beta", 5}, {"gamma", 2}}
+	descs := []string{"get", "get", "get", "put", "get", "put", "get",
+		"delete", "get", "put", "get", "list", "get", "put", "delete",
+		"get", "put"}
+	spans := createRandomTestSpans(20)
+	i := 0
+	for _, trid := range tracerIds {
+		for j := 0; j < trid.count; j++ {
+			spans[i].TracerId = trid.value
+			spans[i].Description = descs[i]
+			spans[i].Begin = 1000 + int64(i)*50
+			spans[i].End = spans[i].Begin + 10
+			i++
+		}
+	}
+	for ; i < len(spans); i++ {
+		spans[i].TracerId = "outside"
+		spans[i].Description = "outside"
+		spans[i].Begin = 2000 + int64(i)
+		spans[i].End = spans[i].Begin + 10
+	}
+	ingestSpans(ht, spans)
+
+	dv, err := hcl.DistinctValues(common.TRACER_ID, 1000, 2000, 10, 1000)
+	if err != nil {
+		t.Fatalf("DistinctValues failed: %s\n", err.Error())
+	}
+	expected := []common.ValueCount{{Value: "alpha", Count: 10},
+		{Value: "beta", Count: 5}, {Value: "gamma", Count: 2}}
+	if !reflect.DeepEqual(expected, dv.Values) || dv.NumValues != 3 ||
+		dv.NumScanned != 17 || dv.Partial {
+		t.Fatalf("unexpected tracer id values %s\n", asJson(dv))
+	}
+
+	// Descriptions are ordered by count, and then by value.  Only the top
+	// lim are returned.
+	dv, err = hcl.DistinctValues(common.DESCRIPTION, 1000, 2000, 3, 1000)
+	if err != nil {
+		t.Fatalf("DistinctValues failed: %s\n", err.Error())
+	}
+	expected = []common.ValueCount{{Value: "get", Count: 9},
+		{Value: "put", Count: 5}, {Value: "delete", Count: 2}}
+	if !reflect.DeepEqual(expected, dv.Values) || dv.NumValues != 4 ||
+		dv.Partial {
+		t.Fatalf("unexpected description values %s\n", asJson(dv))
+	}
+
+	// A tiny scan limit gives a partial result.
+	dv, err = hcl.DistinctValues(common.TRACER_ID, 1000, 2000, 10, 4)
+	if err != nil {
+		t.Fatalf("DistinctValues failed: %s\n", err.Error())
+	}
+	total := 0
+	for _, vc := range dv.Values {
+		total += vc.Count
+	}
+	if !dv.Partial || dv.NumScanned != 4 || total != 4 {
+		t.Fatalf("expected a partial result counting 4 spans, but got %s\n",
+			asJson(dv))
+	}
+
+	// Only some fields are supported.
+	_, err = hcl.DistinctValues(common.BEGIN_TIME, 1000, 2000, 10, 1000)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+	_, err = hcl.DistinctValues(common.TRACER_ID, 2000, 1000, 10, 1000)
+	expectErrorCode(t, err, common.ERR_BAD_PARAMETER)
+}
@@ -0,0 +1,152 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"htrace/common"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The visibility watermark lets batch consumers know when a time window is
+// complete.  It is a time W such that every span with a begin time before W
+// which the server will accept has been written, and can be queried.
+//
+// Clients buffer spans before sending them, so spans arrive somewhat after
+// they begin.  We allow them to be up to latenessMs late.  A span is late if
+// its begin time is before now - latenessMs, or before a watermark we have
+// already handed out.  Late spans are counted, and rejected if rejectLate is
+// set.  Otherwise they are written, but the watermark makes no promises about
+// them.
+//
+// Spans which are not late are tracked from the moment the SpanIngestor
+// accepts them until the shard goroutine has written them.  The tracking is
+// done per batch, since that is the unit the shard goroutines work on: each
+// pendingBatch records the earliest begin time of the spans in it.  The
+// watermark is the earliest pending begin time, or now - latenessMs if that
+// is earlier.  When nothing is pending, the watermark just follows the clock.
+//
+// A span which updates a span we have already written, such as an active span
+// which has now finished, is not late even if it began long ago.  The span
+// was already visible, so the watermark's promise still holds.
+type watermarkTracker struct {
+	// How late a span can arrive and still be covered by the watermark.
+	latenessMs int64
+
+	// If true, late spans are dropped rather than written.
+	rejectLate bool
+
+	// The total number of late spans.  Accessed atomically.
+	lateSpans uint64
+
+	// Protects pending and lastMs.
+	lock sync.Mutex
+
+	// The batches of spans which have been accepted but not yet written.
+	pending map[*pendingBatch]struct{}
+
+	// The most recent watermark we returned.  The watermark never moves
+	// backwards.
+	lastMs int64
+}
+
+// A batch of spans which has been accepted but not yet written.
+type pendingBatch struct {
+	// The earliest begin time of a span in this batch.
+	minBeginMs int64
+}
+
+func newWatermarkTracker(latenessMs int64, rejectLate bool) *watermarkTracker {
+	if latenessMs < 0 {
+		latenessMs = 0
+	}
+	return &watermarkTracker{
+		latenessMs: latenessMs,
+		rejectLate: rejectLate,
+		pending:    make(map[*pendingBatch]struct{}),
+	}
+}
+
+// Start tracking a span which is about to be added to a batch.  pb is the
+// pendingBatch of that batch, or nil if it doesn't have one yet.  Returns the
+// pendingBatch to use from now on, and false if the span is late.  Late spans
+// are not tracked.
+func (wmk *watermarkTracker) admit(pb *pendingBatch,
+	beginMs int64) (*pendingBatch, bool) {
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	wmk.lock.Lock()
+	defer wmk.lock.Unlock()
+	if beginMs < nowMs-wmk.latenessMs || beginMs < wmk.lastMs {
+		return pb, false
+	}
+	if pb == nil {
+		pb = &pendingBatch{minBeginMs: beginMs}
+		wmk.pending[pb] = struct{}{}
+	} else if beginMs < pb.minBeginMs {
+		pb.minBeginMs = beginMs
+	}
+	return pb, true
+}
+
+// Stop tracking a batch of spans, because it has been written or dropped.
+func (wmk *watermarkTracker) done(pb *pendingBatch) {
+	if pb == nil {
+		return
+	}
+	wmk.lock.Lock()
+	defer wmk.lock.Unlock()
+	delete(wmk.pending, pb)
+}
+
+// Count a late span.
+func (wmk *watermarkTracker) recordLate() {
+	atomic.AddUint64(&wmk.lateSpans, 1)
+}
+
+func (wmk *watermarkTracker) LateSpans() uint64 {
+	return atomic.LoadUint64(&wmk.lateSpans)
+}
+
+// Compute the current watermark.
+func (wmk *watermarkTracker) Get() *common.Watermark {
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	wmk.lock.Lock()
+	defer wmk.lock.Unlock()
+	wmMs := nowMs - wmk.latenessMs
+	for pb := range wmk.pending {
+		if pb.minBeginMs < wmMs {
+			wmMs = pb.minBeginMs
+		}
+	}
+	// A pending span can't begin before lastMs, since admit would have
+	// called it late.  So this only matters if the clock goes backwards.
+	if wmMs < wmk.lastMs {
+		wmMs = wmk.lastMs
+	}
+	wmk.lastMs = wmMs
+	return &common.Watermark{
+		WatermarkMs:    wmMs,
+		LatenessMs:     wmk.latenessMs,
+		RejectLate:     wmk.rejectLate,
+		PendingBatches: len(wmk.pending),
+		LateSpans:      wmk.LateSpans(),
+	}
+}
@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatermark(t *testing.T) {
+	const LATENESS_MS = 2000
+	release := make(chan struct{})
+	var releaseOnce sync.Once
+	releaseWrites := func() {
+		releaseOnce.Do(func() {
+			close(release)
+		})
+	}
+	htraceBld := &MiniHTracedBuilder{Name: "TestWatermark",
+		Cnf: map[string]string{
+			conf.HTRACE_WATERMARK_LATENESS_MS: fmt.Sprintf("%d", LATENESS_MS),
+			conf.HTRACE_WATERMARK_REJECT_LATE: "true",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+		DatastoreTestHooks: &datastoreTestHooks{
+			BeforeWriteBatch: func() {
+				<-release
+			},
+		},
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	defer releaseWrites()
+	var hcl *htrace.Client
+	hcl, err = htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	var prevMs int64
+	getWatermark := func() *common.Watermark {
+		wm, err := hcl.GetWatermark()
+		if err != nil {
+			t.Fatalf("GetWatermark failed: %s\n", err.Error())
+		}
+		if wm.WatermarkMs < prevMs {
+			t.Fatalf("The watermark went backwards from %d to %d\n",
+				prevMs, wm.WatermarkMs)
+		}
+		prevMs = wm.WatermarkMs
+		return wm
+	}
+
+	// With nothing pending, the watermark follows the clock.
+	wm := getWatermark()
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	if wm.WatermarkMs > nowMs-LATENESS_MS || wm.WatermarkMs < nowMs-60000 {
+		t.Fatalf("Expected the watermark to be about %d, but it was %d\n",
+			nowMs-LATENESS_MS, wm.WatermarkMs)
+	}
+	if wm.PendingBatches != 0 || wm.LatenessMs != LATENESS_MS ||
+		!wm.RejectLate {
+		t.Fatalf("Unexpected watermark %s\n", asJson(wm))
+	}
+
+	// Ingest some spans while the shard goroutines are held up.  The
+	// watermark must not pass them, no matter how much time goes by.
+	rnd := rand.New(rand.NewSource(1895))
+	spans := make([]*common.Span, 10)
+	for i := range spans {
+		spans[i] = test.NewRandomSpan(rnd, spans[0:i])
+		spans[i].Begin = nowMs - 500 + int64(i*10)
+		spans[i].End = spans[i].Begin + 5
+	}
+	minBeginMs := spans[0].Begin
+	maxBeginMs := spans[len(spans)-1].Begin
+	ing := ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	for i := range spans {
+		ing.IngestSpan(spans[i])
+	}
+	ing.Close(time.Now())
+	for {
+		wm = getWatermark()
+		if wm.WatermarkMs > minBeginMs {
+			t.Fatalf("The watermark %d passed the uncommitted span %s\n",
+				wm.WatermarkMs, spans[0].String())
+		}
+		if wm.PendingBatches == 0 {
+			t.Fatalf("Expected some pending batches, but got %s\n", asJson(wm))
+		}
+		if common.TimeToUnixMs(time.Now().UTC())-LATENESS_MS > maxBeginMs+100 {
+			break
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	// Once the spans are written, the watermark catches up with the clock.
+	releaseWrites()
+	expectSpanOutcomes(t, ht, SpanOutcomes{Written: int64(len(spans))})
+	common.WaitFor(time.Minute, time.Millisecond*10, func() bool {
+		wm = getWatermark()
+		return wm.WatermarkMs > maxBeginMs
+	})
+	if wm.PendingBatches != 0 {
+		t.Fatalf("Expected no pending batches, but got %s\n", asJson(wm))
+	}
+	for i := range spans {
+		if ht.Store.FindSpan(spans[i].Id) == nil {
+			t.Fatalf("Span %s is before the watermark, but can't be found\n",
+				spans[i].String())
+		}
+	}
+
+	// A new span which begins before the watermark is late, and is rejected.
+	late := test.NewRandomSpan(rnd, nil)
+	late.Begin = wm.WatermarkMs - 1000
+	late.End = late.Begin + 5
+	ing = ht.Store.NewSpanIngestor(ht.Store.lg, "127.0.0.1", "")
+	ing.IngestSpan(late)
+	ing.Close(time.Now())
+	expectSpanOutcomes(t, ht, SpanOutcomes{Rejected: 1})
+	if ht.Store.FindSpan(late.Id) != nil {
+		t.Fatalf("The late span %s was not rejected\n", late.String())
+	}
+	wm = getWatermark()
+	if wm.LateSpans != 1 {
+		t.Fatalf("Expected 1 late span, but got %s\n", asJson(wm))
+	}
+
+	// An update to a span which was already written is not late, even
+	// though it began before the watermark.
+	update := *spans[0]
+	update.End = update.Begin + 1000
+	ingestSpans(ht, []*common.Span{&update})
+	common.ExpectSpansEqual(t, &update, ht.Store.FindSpan(update.Id))
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.LateSpans != 1 {
+		t.Fatalf("Expected 1 late span in the server stats, but got %d\n",
+			stats.LateSpans)
+	}
+}
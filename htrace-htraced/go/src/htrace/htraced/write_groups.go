@@ -0,0 +1,414 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"time"
+)
+
+//
+// Write groups.
+//
+// A client which writes the spans of a trace in several requests can't tell
+// from the responses whether all of them arrived: a request may be lost, or
+// the client may crash part way through.  So a WriteSpans request can declare
+// that its spans, or some of them, belong to a write group with a given
+// number of members.  When an ingestor is closed, the members it accepted are
+// added to their groups, and /groups/{id} reports how many are still
+// missing.  A group is complete once every member has arrived.  Members are
+// counted once they have been handed to their shard, so a complete group's
+// spans may not be visible to queries for a moment.
+//
+// There are at most write.groups.max groups.  When a new group arrives and
+// there is no room for it, the group which was updated least recently is
+// forgotten.  A group is also forgotten write.groups.ttl.ms after its last
+// member arrived, so abandoned groups don't linger.  Groups which are invalid,
+// or bigger than write.groups.max.size, are logged and ignored: they never
+// cause spans to be rejected.
+//
+// The groups which changed are saved in the first shard on each datastore
+// heartbeat, and when the datastore is closed:
+//
+// W[group-id] -> writeGroup (JSON)
+//
+
+// The maximum length of a write group ID, in bytes.
+const MAX_WRITE_GROUP_ID_LEN = 256
+
+// The state of a write group.
+type writeGroup struct {
+	// The number of members, as first declared.
+	Size int `json:"s"`
+
+	// The members which have arrived.
+	Members []common.SpanId `json:"m"`
+
+	CreatedMs int64 `json:"c"`
+	UpdatedMs int64 `json:"u"`
+
+	// When the last member arrived, or 0 if the group is not complete.
+	CompletedMs int64 `json:"d,omitempty"`
+
+	// The members, as strings, so that duplicates can be found.
+	received map[string]bool
+
+	// True if the group changed since it was last saved.
+	dirty bool
+}
+
+// Add a member to a group.  Members past the declared size are ignored.
+func (grp *writeGroup) add(id common.SpanId) {
+	if len(grp.Members) >= grp.Size || grp.received[string(id)] {
+		return
+	}
+	grp.received[string(id)] = true
+	grp.Members = append(grp.Members, id)
+}
+
+type writeGroupTracker struct {
+	store *dataStore
+
+	// The maximum number of groups, or 0 if groups are ignored.
+	max int
+
+	// How long a group is kept after its last member arrived.
+	ttlMs int64
+
+	// The maximum declared size of a group.
+	maxSize int
+
+	// Protects the fields below.
+	lock sync.Mutex
+
+	// The groups, by ID.
+	groups map[string]*writeGroup
+
+	// The IDs of the groups which were forgotten since the last save.
+	removed []string
+
+	// The number of groups which expired, and which were evicted to make
+	// room for others.
+	expired uint64
+	evicted uint64
+
+	// The channel on which we receive datastore heartbeats.
+	heartbeats chan interface{}
+
+	// Tracks whether the saving goroutine has exited.
+	exited sync.WaitGroup
+}
+
+func newWriteGroupTracker(store *dataStore,
+	cnf *conf.Config) *writeGroupTracker {
+	wgt := &writeGroupTracker{
+		store:   store,
+		max:     cnf.GetInt(conf.HTRACE_WRITE_GROUPS_MAX),
+		ttlMs:   cnf.GetInt64(conf.HTRACE_WRITE_GROUPS_TTL_MS),
+		maxSize: cnf.GetInt(conf.HTRACE_WRITE_GROUPS_MAX_SIZE),
+		groups:  make(map[string]*writeGroup),
+	}
+	if wgt.max < 0 {
+		wgt.max = 0
+	}
+	if wgt.ttlMs < 1 {
+		wgt.ttlMs = 1
+	}
+	return wgt
+}
+
+func writeGroupKey(id string) []byte {
+	return append([]byte{WRITE_GROUP_PREFIX}, []byte(id)...)
+}
+
+// Check a group declared by a client.  Returns a description of the problem,
+// or the empty string if there is none.
+func (wgt *writeGroupTracker) findProblem(decl *common.WriteGroup) string {
+	if decl.Id == "" || len(decl.Id) > MAX_WRITE_GROUP_ID_LEN {
+		return fmt.Sprintf("write group IDs must be between 1 and %d bytes "+
+			"long", MAX_WRITE_GROUP_ID_LEN)
+	}
+	if decl.Size < 1 || decl.Size > wgt.maxSize {
+		return fmt.Sprintf("write group %s has %d members, but groups must "+
+			"have between 1 and %d", decl.Id, decl.Size, wgt.maxSize)
+	}
+	return ""
+}
+
+// Add the spans which an ingestor accepted to the groups declared by its
+// request.
+func (wgt *writeGroupTracker) record(slg *common.LogSuppressor, addr string,
+	decls []common.WriteGroup, accepted []common.SpanId, nowMs int64) {
+	if wgt.max == 0 {
+		return
+	}
+	// The accepted spans, as strings, if a group lists its members.
+	var acceptedSet map[string]bool
+	wgt.lock.Lock()
+	defer wgt.lock.Unlock()
+	for i := range decls {
+		decl := &decls[i]
+		problem := wgt.findProblem(decl)
+		if problem != "" {
+			slg.Warnf(addr, "Ignoring a write group sent by %s: %s.\n", addr,
+				problem)
+			continue
+		}
+		grp := wgt.groups[decl.Id]
+		if grp == nil {
+			if len(wgt.groups) >= wgt.max {
+				wgt.evictLocked()
+			}
+			grp = &writeGroup{
+				Size:      decl.Size,
+				Members:   make([]common.SpanId, 0),
+				CreatedMs: nowMs,
+				received:  make(map[string]bool),
+			}
+			wgt.groups[decl.Id] = grp
+		} else if grp.Size != decl.Size {
+			slg.Warnf(addr, "Write group %s sent by %s has %d members, but it "+
+				"was first declared with %d.\n", decl.Id, addr, decl.Size,
+				grp.Size)
+		}
+		if len(decl.SpanIds) == 0 {
+			for j := range accepted {
+				grp.add(accepted[j])
+			}
+		} else {
+			if acceptedSet == nil {
+				acceptedSet = make(map[string]bool, len(accepted))
+				for j := range accepted {
+					acceptedSet[string(accepted[j])] = true
+				}
+			}
+			for _, id := range decl.SpanIds {
+				if acceptedSet[string(id)] {
+					grp.add(id)
+				}
+			}
+		}
+		grp.UpdatedMs = nowMs
+		if grp.CompletedMs == 0 && len(grp.Members) == grp.Size {
+			grp.CompletedMs = nowMs
+		}
+		grp.dirty = true
+	}
+}
+
+// Forget the group which was updated least recently.
+func (wgt *writeGroupTracker) evictLocked() {
+	var oldestId string
+	var oldest *writeGroup
+	for id, grp := range wgt.groups {
+		if oldest == nil || grp.UpdatedMs < oldest.UpdatedMs {
+			oldestId, oldest = id, grp
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	delete(wgt.groups, oldestId)
+	wgt.removed = append(wgt.removed, oldestId)
+	wgt.evicted++
+}
+
+// Forget the groups which expired before nowMs.  Returns the number of
+// groups forgotten.
+func (wgt *writeGroupTracker) expire(nowMs int64) int {
+	wgt.lock.Lock()
+	defer wgt.lock.Unlock()
+	return wgt.expireLocked(nowMs)
+}
+
+func (wgt *writeGroupTracker) expireLocked(nowMs int64) int {
+	numExpired := 0
+	for id, grp := range wgt.groups {
+		if grp.UpdatedMs+wgt.ttlMs <= nowMs {
+			delete(wgt.groups, id)
+			wgt.removed = append(wgt.removed, id)
+			numExpired++
+		}
+	}
+	wgt.expired += uint64(numExpired)
+	return numExpired
+}
+
+// Get the state of a group.
+func (wgt *writeGroupTracker) Get(id string,
+	nowMs int64) (*common.WriteGroupStatus, error) {
+	wgt.lock.Lock()
+	defer wgt.lock.Unlock()
+	grp := wgt.groups[id]
+	if grp == nil || grp.UpdatedMs+wgt.ttlMs <= nowMs {
+		return nil, common.NewHtraceError(common.ERR_GROUP_NOT_FOUND,
+			map[string]string{"id": id}, "No such write group as %s.", id)
+	}
+	return &common.WriteGroupStatus{
+		Id:          id,
+		Size:        grp.Size,
+		Received:    len(grp.Members),
+		Missing:     grp.Size - len(grp.Members),
+		Complete:    grp.CompletedMs != 0,
+		CreatedMs:   grp.CreatedMs,
+		UpdatedMs:   grp.UpdatedMs,
+		CompletedMs: grp.CompletedMs,
+		ExpiresMs:   grp.UpdatedMs + wgt.ttlMs,
+	}, nil
+}
+
+// Get the number of groups, and the number which expired and were evicted.
+func (wgt *writeGroupTracker) Stats() (int, uint64, uint64) {
+	wgt.lock.Lock()
+	defer wgt.lock.Unlock()
+	return len(wgt.groups), wgt.expired, wgt.evicted
+}
+
+// Load the saved groups from the first shard.  Groups which have expired are
+// dropped.
+func (wgt *writeGroupTracker) load() {
+	store := wgt.store
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to load the write groups, because shard %s "+
+			"is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	wgt.lock.Lock()
+	defer wgt.lock.Unlock()
+	prefix := []byte{WRITE_GROUP_PREFIX}
+	iter := shd.ldb.NewIterator(store.readOpts)
+	defer iter.Close()
+	for iter.Seek(prefix); iter.Valid(); iter.Next() {
+		key := iter.Key()
+		if !bytes.HasPrefix(key, prefix) {
+			break
+		}
+		id := string(key[1:])
+		grp := &writeGroup{}
+		err := json.Unmarshal(iter.Value(), grp)
+		if err != nil {
+			store.lg.Errorf("Error parsing write group %s: %s\n", id,
+				err.Error())
+			continue
+		}
+		grp.received = make(map[string]bool, len(grp.Members))
+		for i := range grp.Members {
+			grp.received[string(grp.Members[i])] = true
+		}
+		if len(wgt.groups) >= wgt.max {
+			wgt.evictLocked()
+		}
+		wgt.groups[id] = grp
+	}
+	wgt.expireLocked(common.TimeToUnixMs(time.Now().UTC()))
+	if len(wgt.groups) > 0 {
+		store.lg.Infof("Loaded %d write group(s).\n", len(wgt.groups))
+	}
+}
+
+// Save the groups which changed, and remove the ones which were forgotten.
+func (wgt *writeGroupTracker) save() {
+	store := wgt.store
+	wgt.lock.Lock()
+	wgt.expireLocked(common.TimeToUnixMs(time.Now().UTC()))
+	puts := make(map[string][]byte)
+	for id, grp := range wgt.groups {
+		if !grp.dirty {
+			continue
+		}
+		buf, err := json.Marshal(grp)
+		if err != nil {
+			store.lg.Errorf("Error encoding write group %s: %s\n", id,
+				err.Error())
+			continue
+		}
+		puts[id] = buf
+		grp.dirty = false
+	}
+	removed := wgt.removed
+	wgt.removed = nil
+	wgt.lock.Unlock()
+	if len(puts) == 0 && len(removed) == 0 {
+		return
+	}
+	shd := store.shards[0]
+	if !shd.acquire() {
+		store.lg.Warnf("Unable to save the write groups, because shard %s "+
+			"is quarantined.\n", shd.path)
+		return
+	}
+	defer shd.release()
+	batch := shd.ldb.NewWriteBatch()
+	defer batch.Close()
+	for _, id := range removed {
+		batch.Delete(writeGroupKey(id))
+	}
+	for id, buf := range puts {
+		batch.Put(writeGroupKey(id), buf)
+	}
+	err := shd.ldb.Write(store.writeOpts, batch)
+	if err != nil {
+		store.lg.Errorf("Error saving the write groups to %s: %s\n",
+			shd.path, err.Error())
+		shd.checkCorruption(err)
+		return
+	}
+	store.lg.Debugf("Saved %d write group(s), and removed %d.\n", len(puts),
+		len(removed))
+}
+
+// Start expiring and saving the groups on each datastore heartbeat.
+func (wgt *writeGroupTracker) Start(hb *Heartbeater) {
+	wgt.heartbeats = make(chan interface{}, 1)
+	wgt.exited.Add(1)
+	go func() {
+		defer wgt.exited.Done()
+		for {
+			_, isOpen := <-wgt.heartbeats
+			if !isOpen {
+				return
+			}
+			wgt.save()
+		}
+	}()
+	hb.AddHeartbeatTarget(&HeartbeatTarget{
+		name:       "writeGroupTracker",
+		targetChan: wgt.heartbeats,
+	})
+}
+
+// Stop saving the groups on each heartbeat, and save them one last time.  The
+// heartbeater must already have been shut down.
+func (wgt *writeGroupTracker) Stop() {
+	if wgt.heartbeats == nil {
+		return
+	}
+	close(wgt.heartbeats)
+	wgt.exited.Wait()
+	wgt.heartbeats = nil
+	wgt.save()
+}
@@ -0,0 +1,258 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"htrace/test"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func expectWriteGroup(t *testing.T, hcl *htrace.Client, id string,
+	size int, received int) {
+	status, err := hcl.GetWriteGroup(id)
+	if err != nil {
+		t.Fatalf("GetWriteGroup(%s) failed: %s\n", id, err.Error())
+	}
+	if status.Size != size || status.Received != received ||
+		status.Missing != size-received ||
+		status.Complete != (received == size) ||
+		(status.CompletedMs != 0) != status.Complete {
+		t.Fatalf("Expected write group %s to have %d of %d members, but "+
+			"got %s\n", id, received, size, asJson(status))
+	}
+}
+
+func TestWriteGroupAcrossBatches(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestWriteGroupAcrossBatches",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	// Each transport gets spans, and so a group, of its own.
+	rnd := rand.New(rand.NewSource(1954))
+	newSpans := func(n int) []*common.Span {
+		spans := make([]*common.Span, n)
+		for i := range spans {
+			spans[i] = test.NewRandomSpan(rnd, spans[0:i])
+		}
+		return spans
+	}
+	for _, cnf := range []*conf.Config{ht.ClientConf(),
+		ht.RestOnlyClientConf()} {
+		hcl, err := htrace.NewClient(cnf, nil)
+		if err != nil {
+			t.Fatalf("failed to create client: %s", err.Error())
+		}
+		defer hcl.Close()
+		spans := newSpans(6)
+		id := fmt.Sprintf("group-%s", spans[0].Id.String())
+		groups := []common.WriteGroup{{Id: id, Size: len(spans)}}
+		_, err = hcl.WriteSpanGroups(spans[0:4], groups, nil)
+		if err != nil {
+			t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+		}
+		ht.Store.WrittenSpans.Waits(4)
+		expectWriteGroup(t, hcl, id, len(spans), 4)
+
+		// Members which were already counted are not counted again.
+		_, err = hcl.WriteSpanGroups(spans[3:], groups, nil)
+		if err != nil {
+			t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+		}
+		ht.Store.WrittenSpans.Waits(3)
+		expectWriteGroup(t, hcl, id, len(spans), len(spans))
+	}
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// A group which lists its members only counts those spans.
+	spans := newSpans(3)
+	groups := []common.WriteGroup{{Id: "listed", Size: 2,
+		SpanIds: []common.SpanId{spans[0].Id, spans[2].Id}}}
+	_, err = hcl.WriteSpanGroups(spans[0:2], groups, nil)
+	if err != nil {
+		t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(2)
+	expectWriteGroup(t, hcl, "listed", 2, 1)
+
+	// Invalid groups are ignored, but their spans are still written.
+	groups = []common.WriteGroup{{Id: "empty", Size: 0}}
+	result, err := hcl.WriteSpanGroups(spans[2:], groups, nil)
+	if err != nil {
+		t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+	}
+	if result.Resp.Accepted != 1 {
+		t.Fatalf("Expected the span to be accepted, but got %s\n",
+			asJson(result.Resp))
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	_, err = hcl.GetWriteGroup("empty")
+	expectErrorCode(t, err, common.ERR_GROUP_NOT_FOUND)
+
+	// The client can declare a group for each trace itself.
+	gen := &test.SpanTreeGenerator{
+		Seed:          1954,
+		Depth:         3,
+		NumRoots:      2,
+		MinFanOut:     2,
+		MaxFanOut:     3,
+		MinDurationMs: 10,
+		MaxDurationMs: 1000,
+		StartMs:       123456789,
+		Nested:        true,
+	}
+	tree := gen.Generate()
+	hcl.SetWriteGroupByTrace(true)
+	err = hcl.WriteSpans(tree.Spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(int64(len(tree.Spans)))
+	roots := rootsOfTree(tree)
+	for _, root := range tree.Roots {
+		size := 0
+		for i := range tree.Spans {
+			if roots[string(tree.Spans[i].Id)].Equal(root) {
+				size++
+			}
+		}
+		expectWriteGroup(t, hcl, root.String(), size, size)
+	}
+}
+
+func TestWriteGroupsExpire(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestWriteGroupsExpire",
+		Cnf: map[string]string{
+			conf.HTRACE_WRITE_GROUPS_TTL_MS: "60000",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(2)
+	groups := []common.WriteGroup{{Id: "abandoned", Size: 3}}
+	_, err = hcl.WriteSpanGroups(spans, groups, nil)
+	if err != nil {
+		t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(2)
+	expectWriteGroup(t, hcl, "abandoned", 3, 2)
+	status, err := hcl.GetWriteGroup("abandoned")
+	if err != nil {
+		t.Fatalf("GetWriteGroup failed: %s\n", err.Error())
+	}
+	if status.ExpiresMs != status.UpdatedMs+60000 {
+		t.Fatalf("Expected the group to expire 60000 ms after it was "+
+			"updated, but got %s\n", asJson(status))
+	}
+
+	// The group is forgotten once no member has arrived for the TTL.
+	nowMs := common.TimeToUnixMs(time.Now().UTC())
+	if n := ht.Store.writeGroups.expire(nowMs); n != 0 {
+		t.Fatalf("Expected no groups to expire yet, but %d did.\n", n)
+	}
+	if n := ht.Store.writeGroups.expire(status.ExpiresMs); n != 1 {
+		t.Fatalf("Expected 1 group to expire, but %d did.\n", n)
+	}
+	_, err = hcl.GetWriteGroup("abandoned")
+	expectErrorCode(t, err, common.ERR_GROUP_NOT_FOUND)
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.WriteGroups != 0 || stats.ExpiredWriteGroups != 1 {
+		t.Fatalf("Unexpected write group stats %d, %d\n", stats.WriteGroups,
+			stats.ExpiredWriteGroups)
+	}
+}
+
+func TestWriteGroupsBounded(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestWriteGroupsBounded",
+		Cnf: map[string]string{
+			conf.HTRACE_WRITE_GROUPS_MAX:      "3",
+			conf.HTRACE_WRITE_GROUPS_MAX_SIZE: "10",
+		},
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.RestOnlyClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans := createRandomTestSpans(6)
+	for i := 0; i < 5; i++ {
+		groups := []common.WriteGroup{{Id: fmt.Sprintf("group%d", i),
+			Size: 2}}
+		_, err = hcl.WriteSpanGroups(spans[i:i+1], groups, nil)
+		if err != nil {
+			t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+		}
+		ht.Store.WrittenSpans.Waits(1)
+	}
+	// Groups bigger than write.groups.max.size are ignored.
+	groups := []common.WriteGroup{{Id: "huge", Size: 11}}
+	_, err = hcl.WriteSpanGroups(spans[5:], groups, nil)
+	if err != nil {
+		t.Fatalf("WriteSpanGroups failed: %s\n", err.Error())
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	_, err = hcl.GetWriteGroup("huge")
+	expectErrorCode(t, err, common.ERR_GROUP_NOT_FOUND)
+
+	stats, err := hcl.GetServerStats()
+	if err != nil {
+		t.Fatalf("GetServerStats failed: %s\n", err.Error())
+	}
+	if stats.WriteGroups != 3 || stats.EvictedWriteGroups != 2 {
+		t.Fatalf("Expected 3 write groups, and 2 evicted, but got %d and "+
+			"%d\n", stats.WriteGroups, stats.EvictedWriteGroups)
+	}
+	// The newest group is never the one evicted.
+	expectWriteGroup(t, hcl, "group4", 2, 1)
+}
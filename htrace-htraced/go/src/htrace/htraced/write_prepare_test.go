@@ -0,0 +1,207 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A REST server which records the spans sent to it, and does nothing else.
+type capturingServer struct {
+	lock sync.Mutex
+
+	// The descriptions of the spans sent in each WriteSpans request.
+	writes [][]string
+
+	// If true, WriteSpans requests fail.
+	fail bool
+}
+
+func (cs *capturingServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/writeSpans" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if cs.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	dec := json.NewDecoder(req.Body)
+	var msg common.WriteSpansReq
+	if err := dec.Decode(&msg); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	descs := make([]string, 0, msg.NumSpans)
+	for i := 0; i < msg.NumSpans; i++ {
+		var span common.Span
+		if err := dec.Decode(&span); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		descs = append(descs, span.Description)
+	}
+	cs.writes = append(cs.writes, descs)
+	w.Write([]byte("{}"))
+}
+
+func (cs *capturingServer) numWrites() int {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	return len(cs.writes)
+}
+
+func (cs *capturingServer) lastWrite() []string {
+	cs.lock.Lock()
+	defer cs.lock.Unlock()
+	if len(cs.writes) == 0 {
+		return nil
+	}
+	return cs.writes[len(cs.writes)-1]
+}
+
+// Test that the client drops duplicate and invalid spans, and sorts spans by
+// ID, before sending them, but only when asked to.
+func TestWritePreparation(t *testing.T) {
+	cs := &capturingServer{}
+	srv := httptest.NewServer(cs)
+	defer srv.Close()
+	cnf := conf.TEST_VALUES()
+	cnf[conf.HTRACE_WEB_ADDRESS] = strings.TrimPrefix(srv.URL, "http://")
+	cnf[conf.HTRACE_HRPC_ADDRESS] = ""
+	cnf[conf.HTRACE_CLIENT_WRITE_DEDUPE] = "true"
+	cnf[conf.HTRACE_CLIENT_WRITE_VALIDATE] = "true"
+	hcnf, err := (&conf.Builder{Values: cnf, Defaults: conf.DEFAULTS}).Build()
+	if err != nil {
+		t.Fatalf("failed to build configuration: %s", err.Error())
+	}
+	hcl, err := htrace.NewClient(hcnf, nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	hcl.SetWriteSort(true)
+
+	newSpan := func(id string, desc string) *common.Span {
+		return &common.Span{Id: common.TestId(id),
+			SpanData: common.SpanData{
+				Begin:       123,
+				End:         456,
+				Description: desc,
+				TracerId:    "prepare",
+			}}
+	}
+	huge := newSpan("00000000000000000000000000000002", "huge")
+	huge.Extras = common.SpanExtras{
+		"big": json.RawMessage(`"` +
+			strings.Repeat("x", common.MAX_SPAN_EXTRAS_BYTES) + `"`),
+	}
+	third := newSpan("00000000000000000000000000000001", "third")
+	spans := []*common.Span{
+		newSpan("00000000000000000000000000000003", "first"),
+		third,
+		newSpan("00000000000000000000000000000000", "zero"),
+		newSpan("00000000000000000000000000000003", "second"),
+		huge,
+		third,
+	}
+
+	// The invalid spans and the earlier duplicates are dropped, and the
+	// rest are sorted by ID.
+	_, err = hcl.WriteSpansDetailed(spans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s", err.Error())
+	}
+	expected := []string{"third", "second"}
+	if sent := cs.lastWrite(); !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("expected the client to send %v, but it sent %v\n",
+			expected, sent)
+	}
+	mtx := hcl.Metrics()
+	if mtx.DuplicateSpansDropped != 2 || mtx.InvalidSpansDropped != 2 {
+		t.Fatalf("expected 2 duplicate and 2 invalid spans to be dropped, "+
+			"but got %d and %d\n", mtx.DuplicateSpansDropped,
+			mtx.InvalidSpansDropped)
+	}
+	if mtx.SpansWritten != 2 {
+		t.Fatalf("expected 2 spans written, but got %d\n", mtx.SpansWritten)
+	}
+
+	// Undelivered spans are reported by their index in the spans passed in.
+	cs.lock.Lock()
+	cs.fail = true
+	cs.lock.Unlock()
+	result, err := hcl.WriteSpansDetailed(spans, nil)
+	if err == nil {
+		t.Fatalf("expected the write to fail\n")
+	}
+	expectedRanges := []htrace.SpanRange{{Begin: 3, End: 4}, {Begin: 5, End: 6}}
+	if !reflect.DeepEqual(result.Undelivered, expectedRanges) {
+		t.Fatalf("expected undelivered spans %v, but got %v\n",
+			expectedRanges, result.Undelivered)
+	}
+	cs.lock.Lock()
+	cs.fail = false
+	cs.lock.Unlock()
+
+	// A write whose spans are all dropped sends nothing.
+	numWrites := cs.numWrites()
+	_, err = hcl.WriteSpansDetailed(spans[2:3], nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s", err.Error())
+	}
+	if cs.numWrites() != numWrites {
+		t.Fatalf("expected no request for a write of invalid spans\n")
+	}
+
+	// With every step turned off, the spans are sent as they are.
+	hcl.SetWriteDedupe(false)
+	hcl.SetWriteSort(false)
+	hcl.SetWriteValidate(false)
+	err = hcl.WriteSpans(spans)
+	if err != nil {
+		t.Fatalf("WriteSpans failed: %s", err.Error())
+	}
+	expected = []string{"first", "third", "zero", "second", "huge", "third"}
+	if sent := cs.lastWrite(); !reflect.DeepEqual(sent, expected) {
+		t.Fatalf("expected the client to send %v, but it sent %v\n",
+			expected, sent)
+	}
+	// The metrics are totals.  The failed write dropped the same spans as
+	// the first one, since they are dropped before anything is sent, and the
+	// write of the span with the zero ID dropped it too.
+	mtx = hcl.Metrics()
+	if mtx.DuplicateSpansDropped != 4 || mtx.InvalidSpansDropped != 5 {
+		t.Fatalf("expected 4 duplicate and 5 invalid spans to be dropped, "+
+			"but got %d and %d\n", mtx.DuplicateSpansDropped,
+			mtx.InvalidSpansDropped)
+	}
+}
@@ -0,0 +1,225 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	htrace "htrace/client"
+	"htrace/common"
+	"htrace/conf"
+	"sync"
+	"testing"
+)
+
+func TestWriteSplitting(t *testing.T) {
+	t.Run("REST", func(t *testing.T) {
+		testWriteSplitting(t, &htrace.TestHooks{HrpcDisabled: true})
+	})
+	t.Run("HRPC", func(t *testing.T) {
+		testWriteSplitting(t, nil)
+	})
+}
+
+func testWriteSplitting(t *testing.T, testHooks *htrace.TestHooks) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestWriteSplitting",
+		Cnf: map[string]string{
+			conf.HTRACE_WRITE_SPANS_MAX_SPANS: "7",
+			conf.HTRACE_WRITE_SPANS_MAX_BYTES: "4000",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), testHooks)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// The client doesn't know the limits yet, so its first request is
+	// rejected as too large.  It learns the limits, and splits the write.
+	NUM_TEST_SPANS := 50
+	allSpans := createRandomTestSpans(NUM_TEST_SPANS)
+	res, err := hcl.WriteSpansDetailed(allSpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if len(res.Undelivered) != 0 {
+		t.Fatalf("Expected every span to be delivered, but got %s\n",
+			asJson(res))
+	}
+	if res.NumChunks < (NUM_TEST_SPANS+6)/7 {
+		t.Fatalf("Expected at least %d chunks, but got %d\n",
+			(NUM_TEST_SPANS+6)/7, res.NumChunks)
+	}
+	if testHooks != nil && res.Resp.Accepted != NUM_TEST_SPANS {
+		t.Fatalf("Expected the server to accept %d spans, but got %s\n",
+			NUM_TEST_SPANS, asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(int64(NUM_TEST_SPANS))
+	for i := range allSpans {
+		span, err := hcl.FindSpan(allSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
+		}
+		expectSpanStored(t, allSpans[i], span)
+	}
+	info, err := hcl.GetServerVersion()
+	if err != nil {
+		t.Fatalf("GetServerVersion failed: %s\n", err.Error())
+	}
+	if info.MaxWriteSpans != 7 || info.MaxWriteBytes != 4000 {
+		t.Fatalf("Expected the server to advertise its write limits, but "+
+			"got %s\n", asJson(info))
+	}
+
+	// Now that the client knows the limits, a big write is split before
+	// anything is sent.
+	moreSpans := createRandomTestSpans(15)
+	res, err = hcl.WriteSpansDetailed(moreSpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 3 {
+		t.Fatalf("Expected 3 chunks, but got %d\n", res.NumChunks)
+	}
+	ht.Store.WrittenSpans.Waits(15)
+}
+
+// Rejects particular WriteSpans requests, counting from 0.
+type rejectWritesFaults struct {
+	noFaults
+	lock    sync.Mutex
+	numReqs int
+	reject  map[int]bool
+}
+
+func (rwf *rejectWritesFaults) RejectWriteSpans() bool {
+	rwf.lock.Lock()
+	defer rwf.lock.Unlock()
+	reqIdx := rwf.numReqs
+	rwf.numReqs++
+	return rwf.reject[reqIdx]
+}
+
+func TestWriteSplittingFailures(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestWriteSplittingFailures",
+		Cnf: map[string]string{
+			conf.HTRACE_WRITE_SPANS_MAX_SPANS: "5",
+		},
+		DataDirs:     make([]string, 2),
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	testHooks := &htrace.TestHooks{HrpcDisabled: true}
+	hcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "0"), testHooks)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// Without retries, the spans in the rejected requests are reported as
+	// undelivered, and the rest are written.
+	ht.Store.faults = &rejectWritesFaults{
+		reject: map[int]bool{1: true, 2: true},
+	}
+	allSpans := createRandomTestSpans(20)
+	res, err := hcl.WriteSpansDetailed(allSpans, nil)
+	werr, ok := err.(*htrace.WriteSpansError)
+	if !ok {
+		t.Fatalf("Expected a WriteSpansError, but got %v\n", err)
+	}
+	if werr.NumSpans != 20 || werr.NumUndelivered() != 10 {
+		t.Fatalf("Unexpected WriteSpansError %s\n", werr.Error())
+	}
+	if common.ErrorCodeOf(werr.Err) != common.ERR_INTERNAL {
+		t.Fatalf("Expected the rejection error, but got %s\n",
+			werr.Err.Error())
+	}
+	expectedUndelivered := []htrace.SpanRange{
+		htrace.SpanRange{Begin: 5, End: 15},
+	}
+	if asJson(res.Undelivered) != asJson(expectedUndelivered) {
+		t.Fatalf("Expected undelivered spans %s, but got %s\n",
+			asJson(expectedUndelivered), asJson(res.Undelivered))
+	}
+	if res.NumChunks != 2 || res.Resp.Accepted != 10 {
+		t.Fatalf("Unexpected result %s\n", asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(10)
+
+	// The caller can send the undelivered spans again.
+	for _, r := range res.Undelivered {
+		err = hcl.WriteSpans(allSpans[r.Begin:r.End])
+		if err != nil {
+			t.Fatalf("Rewriting %s failed: %s\n", r.String(), err.Error())
+		}
+	}
+	ht.Store.WrittenSpans.Waits(10)
+	for i := range allSpans {
+		span, err := hcl.FindSpan(allSpans[i].Id)
+		if err != nil {
+			t.Fatalf("FindSpan(%d) failed: %s\n", i, err.Error())
+		}
+		expectSpanStored(t, allSpans[i], span)
+	}
+
+	// With retries, a rejected request is sent again.
+	retryHcl, err := htrace.NewClient(ht.ClientConf().Clone(
+		conf.HTRACE_CLIENT_WRITE_MAX_SPANS, "5",
+		conf.HTRACE_CLIENT_WRITE_RETRIES, "1",
+		conf.HTRACE_CLIENT_WRITE_PARALLELISM, "2"), testHooks)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer retryHcl.Close()
+	ht.Store.faults = &rejectWritesFaults{
+		reject: map[int]bool{0: true},
+	}
+	moreSpans := createRandomTestSpans(10)
+	res, err = retryHcl.WriteSpansDetailed(moreSpans, nil)
+	if err != nil {
+		t.Fatalf("WriteSpansDetailed failed: %s\n", err.Error())
+	}
+	if res.NumChunks != 2 || res.Resp.Accepted != 10 {
+		t.Fatalf("Unexpected result %s\n", asJson(res))
+	}
+	ht.Store.WrittenSpans.Waits(10)
+
+	// A write which fits in one request isn't retried, and fails with the
+	// server's error.
+	ht.Store.faults = &rejectWritesFaults{
+		reject: map[int]bool{0: true},
+	}
+	err = retryHcl.WriteSpans(createRandomTestSpans(3))
+	if _, ok := err.(*htrace.WriteSpansError); ok {
+		t.Fatalf("Expected the server's error, but got %s\n", err.Error())
+	}
+	common.AssertErrContains(t, err, "Chaos mode rejected")
+}
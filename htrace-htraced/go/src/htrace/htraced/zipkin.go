@@ -0,0 +1,272 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"htrace/common"
+	"strings"
+)
+
+// Spans can be exported in Zipkin's v2 JSON format, so that they can be
+// viewed with Zipkin tools.  The translation loses some information.
+//
+// Zipkin span ids are 64 bits, but ours are 128.  The Zipkin id of a span is
+// the low 64 bits of its id.  Clients which follow the HTrace convention give
+// every span of a trace the same high 64 bits, so the low bits are enough to
+// tell the spans of a trace apart.
+//
+// Zipkin traces have an explicit id, but ours don't.  The Zipkin trace id is
+// the full id of the root of the span's trace, found by following first
+// parents, as we do when grouping query results by trace.  If a parent is
+// missing, the highest ancestor we could find stands in for the root.
+//
+// Zipkin spans have at most one parent.  The first parent becomes the Zipkin
+// parentId, and the full ids of any others are recorded in the
+// ZIPKIN_EXTRA_PARENTS_TAG tag.
+//
+// Zipkin times are in microseconds.  Nanosecond begin and end times are
+// truncated to microseconds.  Zipkin has no way to say that a span is still
+// running, so spans which haven't ended have no duration.  Links, and flags
+// other than debug, are dropped.
+
+// Get the Zipkin id for a span id.
+func zipkinId(sid common.SpanId) string {
+	val := sid.Val()
+	if len(val) > 8 {
+		val = val[len(val)-8:]
+	}
+	return hex.EncodeToString(val)
+}
+
+// Convert a span to Zipkin format.  root is the root of the span's trace.
+func toZipkinSpan(span *common.Span, root *common.Span) *common.ZipkinSpan {
+	zspan := &common.ZipkinSpan{
+		TraceId: root.Id.String(),
+		Id:      zipkinId(span.Id),
+		Name:    span.Description,
+		Debug:   span.Flags.Has(common.SPAN_FLAG_DEBUG),
+	}
+	if len(span.Parents) > 0 {
+		zspan.ParentId = zipkinId(span.Parents[0])
+	}
+	beginMs, beginNs := span.BeginParts()
+	zspan.Timestamp = beginMs*1000 + beginNs/1000
+	if span.End != 0 {
+		durMs, durNs := span.DurationParts()
+		zspan.Duration = durMs*1000 + durNs/1000
+		// Zipkin rounds durations of less than a microsecond up, since a
+		// duration of 0 would mean the span hasn't ended.
+		if zspan.Duration < 1 {
+			zspan.Duration = 1
+		}
+	}
+	if span.TracerId != "" {
+		zspan.LocalEndpoint = &common.ZipkinEndpoint{
+			ServiceName: span.TracerId,
+		}
+	}
+	for i := range span.TimelineAnnotations {
+		zspan.Annotations = append(zspan.Annotations, common.ZipkinAnnotation{
+			Timestamp: span.TimelineAnnotations[i].Time * 1000,
+			Value:     span.TimelineAnnotations[i].Msg,
+		})
+	}
+	if len(span.Info) > 0 || len(span.Parents) > 1 {
+		zspan.Tags = make(map[string]string, len(span.Info)+1)
+		for k, v := range span.Info {
+			zspan.Tags[k] = v
+		}
+		if len(span.Parents) > 1 {
+			extra := make([]string, len(span.Parents)-1)
+			for i := range extra {
+				extra[i] = span.Parents[i+1].String()
+			}
+			zspan.Tags[common.ZIPKIN_EXTRA_PARENTS_TAG] =
+				strings.Join(extra, ",")
+		}
+	}
+	return zspan
+}
+
+// Convert spans to Zipkin format.
+func (store *dataStore) ToZipkin(spans []*common.Span) []*common.ZipkinSpan {
+	rsv := newTraceRootResolver(store)
+	zspans := make([]*common.ZipkinSpan, len(spans))
+	for i := range spans {
+		root, _ := rsv.resolve(spans[i])
+		zspans[i] = toZipkinSpan(spans[i], root)
+	}
+	return zspans
+}
+
+// Spans can also be received in Zipkin format, on the standard Zipkin
+// collector path, so that services which use Zipkin tracers can send their
+// spans to us directly.  The translation is the reverse of the one above.
+//
+// The id of a received span is the low 64 bits of its Zipkin trace id,
+// followed by its 64-bit Zipkin span id.  Some Zipkin tracers send 128-bit
+// trace ids, and others only the low 64 bits of the same ids, so the high
+// bits can't be relied upon.  If the trace id has high bits, it is kept in
+// the ZIPKIN_TRACE_ID_INFO_KEY info key.
+//
+// A Zipkin client and the server it calls may report the same span id, with
+// the server's half marked as shared.  We store the two halves as separate
+// spans: the server half gets an id derived from the shared one, and becomes
+// a child of the client half.  Children of the shared span stay children of
+// the client half.
+//
+// Times are converted from microseconds to nanoseconds, so that they keep
+// their precision.  A span with no duration has not finished, and gets no end
+// time.  The span kind, the shared flag, and the endpoint details other than
+// the service name are kept in info keys, which take precedence over tags of
+// the same name.
+
+// The path which Zipkin tracers send spans to.
+const ZIPKIN_SPANS_PATH = "/api/v2/spans"
+
+// XORed with the span id of the server half of a shared span, to get the low
+// 64 bits of its id.
+const ZIPKIN_SHARED_ID_MASK = 0x5a17ed5a17ed5a17
+
+// Parse a Zipkin id of up to maxLen bytes, and return it padded to maxLen
+// bytes.
+func parseZipkinId(what string, str string, maxLen int) ([]byte, error) {
+	if str == "" || len(str) > 2*maxLen {
+		return nil, errors.New(fmt.Sprintf("Invalid %s '%s': expected 1 "+
+			"to %d hex digits.", what, str, 2*maxLen))
+	}
+	padded := strings.Repeat("0", 2*maxLen-len(str)) + str
+	val, err := hex.DecodeString(padded)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Invalid %s '%s': %s", what,
+			str, err.Error()))
+	}
+	return val, nil
+}
+
+// Store a Zipkin endpoint in an info key, if it has anything besides the
+// service name.
+func setZipkinEndpointInfo(info common.TraceInfoMap, key string,
+	ep *common.ZipkinEndpoint, keepServiceName bool) error {
+	if ep == nil {
+		return nil
+	}
+	stored := *ep
+	if !keepServiceName {
+		stored.ServiceName = ""
+	}
+	if stored == (common.ZipkinEndpoint{}) {
+		return nil
+	}
+	buf, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+	info[key] = string(buf)
+	return nil
+}
+
+// Convert a span in Zipkin format to one of ours.
+func fromZipkinSpan(zspan *common.ZipkinSpan) (*common.Span, error) {
+	traceId, err := parseZipkinId("traceId", zspan.TraceId, 16)
+	if err != nil {
+		return nil, err
+	}
+	spanId, err := parseZipkinId("id", zspan.Id, 8)
+	if err != nil {
+		return nil, err
+	}
+	if zspan.Timestamp <= 0 {
+		return nil, errors.New(fmt.Sprintf("Span %s has no timestamp.",
+			zspan.Id))
+	}
+	if zspan.Duration < 0 {
+		return nil, errors.New(fmt.Sprintf("Span %s has a negative "+
+			"duration.", zspan.Id))
+	}
+	traceLow := traceId[8:]
+	span := &common.Span{
+		Id: common.SpanId(append(append([]byte{}, traceLow...), spanId...)),
+		SpanData: common.SpanData{
+			Description: zspan.Name,
+			Parents:     []common.SpanId{},
+			Info:        make(common.TraceInfoMap, len(zspan.Tags)+2),
+		},
+	}
+	for k, v := range zspan.Tags {
+		span.Info[k] = v
+	}
+	if zspan.Shared && zspan.Kind == "SERVER" {
+		span.Parents = append(span.Parents, span.Id)
+		shared := binary.BigEndian.Uint64(spanId) ^ ZIPKIN_SHARED_ID_MASK
+		span.Id = common.SpanId(append(append([]byte{}, traceLow...),
+			u64toSlice(shared)...))
+		span.Info[common.ZIPKIN_SHARED_INFO_KEY] = "true"
+	} else if zspan.ParentId != "" {
+		parentId, err := parseZipkinId("parentId", zspan.ParentId, 8)
+		if err != nil {
+			return nil, err
+		}
+		span.Parents = append(span.Parents, common.SpanId(
+			append(append([]byte{}, traceLow...), parentId...)))
+	}
+	if zspan.Kind != "" {
+		span.Info[common.ZIPKIN_KIND_INFO_KEY] = zspan.Kind
+	}
+	if len(strings.TrimLeft(zspan.TraceId, "0")) > 16 {
+		span.Info[common.ZIPKIN_TRACE_ID_INFO_KEY] = zspan.TraceId
+	}
+	err = setZipkinEndpointInfo(span.Info,
+		common.ZIPKIN_LOCAL_ENDPOINT_INFO_KEY, zspan.LocalEndpoint, false)
+	if err != nil {
+		return nil, err
+	}
+	err = setZipkinEndpointInfo(span.Info,
+		common.ZIPKIN_REMOTE_ENDPOINT_INFO_KEY, zspan.RemoteEndpoint, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(span.Info) == 0 {
+		span.Info = nil
+	}
+	if zspan.LocalEndpoint != nil {
+		span.TracerId = zspan.LocalEndpoint.ServiceName
+	}
+	span.SetBeginNs(zspan.Timestamp * 1000)
+	if zspan.Duration > 0 {
+		span.SetEndNs((zspan.Timestamp + zspan.Duration) * 1000)
+	}
+	for i := range zspan.Annotations {
+		span.TimelineAnnotations = append(span.TimelineAnnotations,
+			common.TimelineAnnotation{
+				Time: zspan.Annotations[i].Timestamp / 1000,
+				Msg:  zspan.Annotations[i].Value,
+			})
+	}
+	if zspan.Debug {
+		span.Flags |= common.SPAN_FLAG_DEBUG
+	}
+	return span, nil
+}
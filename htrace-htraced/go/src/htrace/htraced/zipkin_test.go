@@ -0,0 +1,387 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htrace "htrace/client"
+	"htrace/common"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestZipkinExport(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestZipkinExport",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+
+	// A span with two parents, info, timeline annotations, nanosecond
+	// times, and the debug flag.
+	detailed := common.Span{Id: common.TestId("00000000000000000000000000000004"),
+		SpanData: common.SpanData{
+			Description: "readFd",
+			Parents: []common.SpanId{
+				common.TestId("00000000000000000000000000000002"),
+				common.TestId("00000000000000000000000000000003"),
+			},
+			Info: common.TraceInfoMap{"path": "/a/b", "bytes": "4096"},
+			TimelineAnnotations: []common.TimelineAnnotation{
+				{Time: 310, Msg: "opened"},
+				{Time: 390, Msg: "read"},
+			},
+			TracerId: "fourthd",
+			Flags:    common.SPAN_FLAG_DEBUG,
+		}}
+	detailed.SetBeginNs(300*common.NS_PER_MS + 1500)
+	detailed.SetEndNs(400*common.NS_PER_MS + 999)
+	allSpans := append(append([]common.Span{}, SIMPLE_TEST_SPANS...), detailed)
+	createSpans(allSpans, ht.Store)
+
+	rootId := "00000000000000000000000000000001"
+	expected := []common.ZipkinSpan{
+		{TraceId: rootId, Id: "0000000000000001", Name: "getFileDescriptors",
+			Timestamp: 123000, Duration: 333000,
+			LocalEndpoint: &common.ZipkinEndpoint{ServiceName: "firstd"}},
+		{TraceId: rootId, Id: "0000000000000002",
+			ParentId: "0000000000000001", Name: "openFd",
+			Timestamp: 125000, Duration: 75000,
+			LocalEndpoint: &common.ZipkinEndpoint{ServiceName: "secondd"}},
+		{TraceId: rootId, Id: "0000000000000003",
+			ParentId: "0000000000000001", Name: "passFd",
+			Timestamp: 200000, Duration: 256000,
+			LocalEndpoint: &common.ZipkinEndpoint{ServiceName: "thirdd"}},
+		{TraceId: rootId, Id: "0000000000000004",
+			ParentId: "0000000000000002", Name: "readFd",
+			Timestamp: 300001, Duration: 99999, Debug: true,
+			LocalEndpoint: &common.ZipkinEndpoint{ServiceName: "fourthd"},
+			Annotations: []common.ZipkinAnnotation{
+				{Timestamp: 310000, Value: "opened"},
+				{Timestamp: 390000, Value: "read"},
+			},
+			Tags: map[string]string{
+				"path":                          "/a/b",
+				"bytes":                         "4096",
+				common.ZIPKIN_EXTRA_PARENTS_TAG: "00000000000000000000000000000003",
+			}},
+	}
+
+	var buf bytes.Buffer
+	err = hcl.ExportZipkin(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.GREATER_THAN_OR_EQUALS,
+				Field: common.BEGIN_TIME,
+				Val:   "0",
+			},
+		},
+		Lim: 10,
+	}, &buf)
+	if err != nil {
+		t.Fatalf("ExportZipkin failed: %s\n", err.Error())
+	}
+	var zspans []common.ZipkinSpan
+	err = json.Unmarshal(buf.Bytes(), &zspans)
+	if err != nil {
+		t.Fatalf("Error unmarshalling %s: %s\n", buf.String(), err.Error())
+	}
+	if len(zspans) != len(expected) {
+		t.Fatalf("Expected %d spans, but got %s\n", len(expected), buf.String())
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(expected[i], zspans[i]) {
+			t.Fatalf("Expected span %d to be %s, but got %s\n", i,
+				asJson(&expected[i]), asJson(&zspans[i]))
+		}
+	}
+
+	// Check the field names against the Zipkin v2 format.
+	resp, err := http.Get(fmt.Sprintf("http://%s/span/%s/zipkin",
+		ht.Rsv.Addr().String(), detailed.Id.String()))
+	if err != nil {
+		t.Fatalf("Error fetching the zipkin span: %s\n", err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Error reading the zipkin span: %s\n", err.Error())
+	}
+	common.ExpectStrEqual(t, `[{"traceId":"00000000000000000000000000000001",`+
+		`"id":"0000000000000004","parentId":"0000000000000002",`+
+		`"name":"readFd","timestamp":300001,"duration":99999,"debug":true,`+
+		`"localEndpoint":{"serviceName":"fourthd"},"annotations":[`+
+		`{"timestamp":310000,"value":"opened"},`+
+		`{"timestamp":390000,"value":"read"}],"tags":{"bytes":"4096",`+
+		`"htrace.extraParents":"00000000000000000000000000000003",`+
+		`"path":"/a/b"}}]`, string(body))
+
+	resp, err = http.Get(fmt.Sprintf("http://%s/span/%s/zipkin",
+		ht.Rsv.Addr().String(), "00000000000000000000000000000099"))
+	if err != nil {
+		t.Fatalf("Error fetching a missing zipkin span: %s\n", err.Error())
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a 404 for a missing span, but got %d\n",
+			resp.StatusCode)
+	}
+}
+
+func TestZipkinSpanWithoutEnd(t *testing.T) {
+	root := &common.Span{Id: common.TestId("00000000000000010000000000000001"),
+		SpanData: common.SpanData{Begin: 100, End: 100, TracerId: "a"}}
+	active := &common.Span{Id: common.TestId("00000000000000010000000000000002"),
+		SpanData: common.SpanData{Begin: 100,
+			Parents: []common.SpanId{root.Id}}}
+	zspan := toZipkinSpan(root, root)
+	if zspan.Duration != 1 || zspan.Id != "0000000000000001" {
+		t.Fatalf("Unexpected zipkin span %s\n", asJson(zspan))
+	}
+	zspan = toZipkinSpan(active, root)
+	if zspan.Duration != 0 || zspan.LocalEndpoint != nil ||
+		zspan.TraceId != root.Id.String() || zspan.ParentId != "0000000000000001" {
+		t.Fatalf("Unexpected zipkin span %s\n", asJson(zspan))
+	}
+}
+
+// Spans reported by a frontend and a backend service instrumented with
+// Brave.  The frontend's client span and the backend's server span share an
+// id.  The backend reports a 128-bit trace id for its local span, and that
+// span has not finished.
+const ZIPKIN_TEST_PAYLOAD = `[
+{"traceId":"86154a4ba6e91385","id":"86154a4ba6e91385","kind":"SERVER",
+ "name":"get","timestamp":1472470996199000,"duration":207000,
+ "localEndpoint":{"serviceName":"frontend","ipv4":"192.168.99.101"},
+ "remoteEndpoint":{"ipv6":"::1","port":63837},
+ "annotations":[{"timestamp":1472470996199500,"value":"wr"}],
+ "tags":{"http.method":"GET","http.path":"/"}},
+{"traceId":"86154a4ba6e91385","parentId":"86154a4ba6e91385",
+ "id":"4d1e00c0db9010db","kind":"CLIENT","name":"get",
+ "timestamp":1472470996199431,"duration":206570,
+ "localEndpoint":{"serviceName":"frontend","ipv4":"192.168.99.101"},
+ "remoteEndpoint":{"serviceName":"backend","ipv4":"192.168.99.101",
+  "port":9000},
+ "tags":{"http.method":"GET","http.path":"/api"}},
+{"traceId":"86154a4ba6e91385","parentId":"86154a4ba6e91385",
+ "id":"4d1e00c0db9010db","kind":"SERVER","name":"get /api",
+ "timestamp":1472470996238000,"duration":151000,"shared":true,
+ "localEndpoint":{"serviceName":"backend","ipv4":"192.168.99.101",
+  "port":9000},
+ "remoteEndpoint":{"ipv4":"172.19.0.2","port":58648},
+ "tags":{"http.method":"GET","http.path":"/api"}},
+{"traceId":"463ac35c9f6413ad86154a4ba6e91385","parentId":"4d1e00c0db9010db",
+ "id":"5b4185666d50f68b","name":"query","timestamp":1472470996250000,
+ "localEndpoint":{"serviceName":"backend"},"debug":true}
+]`
+
+func postZipkinSpans(t *testing.T, ht *MiniHTraced, payload string) (int,
+	string) {
+	resp, err := http.Post(fmt.Sprintf("http://%s%s", ht.Rsv.Addr().String(),
+		ZIPKIN_SPANS_PATH), "application/json", strings.NewReader(payload))
+	if err != nil {
+		t.Fatalf("Error posting Zipkin spans: %s\n", err.Error())
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading the response: %s\n", err.Error())
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestZipkinIngest(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestZipkinIngest",
+		WrittenSpans: common.NewSemaphore(0),
+		DataDirs:     make([]string, 2),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	code, body := postZipkinSpans(t, ht, ZIPKIN_TEST_PAYLOAD)
+	if code != http.StatusAccepted || body != "" {
+		t.Fatalf("Expected an empty 202 response, but got %d: %s\n",
+			code, body)
+	}
+	ht.Store.WrittenSpans.Waits(4)
+
+	rootId := common.TestId("86154a4ba6e9138586154a4ba6e91385")
+	clientId := common.TestId("86154a4ba6e913854d1e00c0db9010db")
+	serverId := common.SpanId(append(common.TestId("86154a4ba6e91385" +
+		"0000000000000000")[0:8], u64toSlice(0x4d1e00c0db9010db^
+		ZIPKIN_SHARED_ID_MASK)...))
+	queryId := common.TestId("86154a4ba6e913855b4185666d50f68b")
+	expected := []*common.Span{
+		&common.Span{Id: rootId, SpanData: common.SpanData{
+			Begin: 1472470996199, End: 1472470996406,
+			BeginNs: 1472470996199000000, EndNs: 1472470996406000000,
+			Description: "get",
+			Parents:     []common.SpanId{},
+			Info: common.TraceInfoMap{
+				"http.method":                         "GET",
+				"http.path":                           "/",
+				common.ZIPKIN_KIND_INFO_KEY:           "SERVER",
+				common.ZIPKIN_LOCAL_ENDPOINT_INFO_KEY: `{"ipv4":"192.168.99.101"}`,
+				common.ZIPKIN_REMOTE_ENDPOINT_INFO_KEY: `{"ipv6":"::1",` +
+					`"port":63837}`,
+			},
+			TracerId: "frontend",
+			TimelineAnnotations: []common.TimelineAnnotation{
+				{Time: 1472470996199, Msg: "wr"},
+			},
+		}},
+		&common.Span{Id: clientId, SpanData: common.SpanData{
+			Begin: 1472470996199, End: 1472470996406,
+			BeginNs: 1472470996199431000, EndNs: 1472470996406001000,
+			Description: "get",
+			Parents:     []common.SpanId{rootId},
+			Info: common.TraceInfoMap{
+				"http.method":                         "GET",
+				"http.path":                           "/api",
+				common.ZIPKIN_KIND_INFO_KEY:           "CLIENT",
+				common.ZIPKIN_LOCAL_ENDPOINT_INFO_KEY: `{"ipv4":"192.168.99.101"}`,
+				common.ZIPKIN_REMOTE_ENDPOINT_INFO_KEY: `{"serviceName":` +
+					`"backend","ipv4":"192.168.99.101","port":9000}`,
+			},
+			TracerId: "frontend",
+		}},
+		&common.Span{Id: serverId, SpanData: common.SpanData{
+			Begin: 1472470996238, End: 1472470996389,
+			BeginNs: 1472470996238000000, EndNs: 1472470996389000000,
+			Description: "get /api",
+			Parents:     []common.SpanId{clientId},
+			Info: common.TraceInfoMap{
+				"http.method":                         "GET",
+				"http.path":                           "/api",
+				common.ZIPKIN_KIND_INFO_KEY:           "SERVER",
+				common.ZIPKIN_SHARED_INFO_KEY:         "true",
+				common.ZIPKIN_LOCAL_ENDPOINT_INFO_KEY: `{"ipv4":"192.168.99.101","port":9000}`,
+				common.ZIPKIN_REMOTE_ENDPOINT_INFO_KEY: `{"ipv4":"172.19.0.2",` +
+					`"port":58648}`,
+			},
+			TracerId: "backend",
+		}},
+		&common.Span{Id: queryId, SpanData: common.SpanData{
+			Begin: 1472470996250, BeginNs: 1472470996250000000,
+			Description: "query",
+			Parents:     []common.SpanId{clientId},
+			Info: common.TraceInfoMap{
+				common.ZIPKIN_TRACE_ID_INFO_KEY: "463ac35c9f6413ad86154a4ba6e91385",
+			},
+			TracerId: "backend",
+			Flags:    common.SPAN_FLAG_DEBUG,
+		}},
+	}
+	for i := range expected {
+		span := ht.Store.FindSpan(expected[i].Id)
+		if span == nil {
+			t.Fatalf("Failed to find span %s\n", expected[i].Id.String())
+		}
+		// Clear the fields which the server fills in.
+		span.NumParents = 0
+		span.SchemaVersion = 0
+		common.ExpectStrEqual(t, asJson(expected[i]), asJson(span))
+	}
+	children := ht.Store.FindChildren(clientId, 10)
+	sort.Sort(common.SpanIdSlice(children))
+	common.ExpectStrEqual(t, asJson([]common.SpanId{serverId, queryId}),
+		asJson(children))
+
+	// The spans can be queried by the service name they were sent with.
+	hcl, err := htrace.NewClient(ht.ClientConf(), nil)
+	if err != nil {
+		t.Fatalf("failed to create client: %s", err.Error())
+	}
+	defer hcl.Close()
+	spans, err := hcl.Query(&common.Query{
+		Predicates: []common.Predicate{
+			common.Predicate{
+				Op:    common.EQUALS,
+				Field: common.TRACER_ID,
+				Val:   "backend",
+			},
+		},
+		Lim: 10,
+	})
+	if err != nil {
+		t.Fatalf("Query failed: %s\n", err.Error())
+	}
+	if len(spans) != 2 || !spans[0].Id.Equal(serverId) ||
+		!spans[1].Id.Equal(queryId) {
+		t.Fatalf("Expected the two backend spans, but got %s\n",
+			asJson(spans))
+	}
+}
+
+func TestZipkinIngestSkipsBadSpans(t *testing.T) {
+	htraceBld := &MiniHTracedBuilder{Name: "TestZipkinIngestSkipsBadSpans",
+		WrittenSpans: common.NewSemaphore(0),
+	}
+	ht, err := htraceBld.Build()
+	if err != nil {
+		t.Fatalf("failed to create datastore: %s", err.Error())
+	}
+	defer ht.Close()
+	code, _ := postZipkinSpans(t, ht, `[
+{"traceId":"a","id":"1","name":"good","timestamp":1000,"duration":10},
+{"traceId":"xyz","id":"2","name":"badTraceId","timestamp":1000},
+{"traceId":"a","id":"3","name":"noTimestamp"},
+null]`)
+	if code != http.StatusAccepted {
+		t.Fatalf("Expected a 202 response, but got %d\n", code)
+	}
+	ht.Store.WrittenSpans.Waits(1)
+	span := ht.Store.FindSpan(common.TestId("000000000000000a0000000000000001"))
+	if span == nil || span.Description != "good" {
+		t.Fatalf("Expected to find the good span, but got %s\n",
+			asJson(span))
+	}
+	stats := ht.Store.msink.GetClientStats("", "", 10)
+	if len(stats.Clients) != 1 || stats.Clients[0].ParseSkipped != 3 {
+		t.Fatalf("Expected 3 skipped spans, but got %s\n", asJson(stats))
+	}
+
+	code, body := postZipkinSpans(t, ht, `[{"traceId":"a","id":"4"}]`)
+	if code != http.StatusBadRequest ||
+		!strings.Contains(body, "has no timestamp") {
+		t.Fatalf("Expected a 400 response, but got %d: %s\n", code, body)
+	}
+	code, body = postZipkinSpans(t, ht, `{"traceId":"a"}`)
+	if code != http.StatusBadRequest {
+		t.Fatalf("Expected a 400 response, but got %d: %s\n", code, body)
+	}
+}
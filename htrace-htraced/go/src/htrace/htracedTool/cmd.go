@@ -31,7 +31,6 @@ import (
 	"htrace/conf"
 	"io"
 	"os"
-	"sort"
 	"strings"
 	"text/tabwriter"
 	"time"
@@ -43,6 +42,9 @@ var GIT_VERSION string
 const EXIT_SUCCESS = 0
 const EXIT_FAILURE = 1
 
+// The number of client addresses to request at a time when printing stats.
+const CLIENT_STATS_PAGE_SIZE = 1000
+
 var verbose bool
 
 const USAGE = `The Apache HTrace command-line tool.  This tool retrieves and modifies settings and
@@ -75,6 +77,14 @@ func main() {
 	serverStatsJson := serverStats.Flag("json", "Display statistics as raw JSON.").Default("false").Bool()
 	serverDebugInfo := app.Command("serverDebugInfo", "Print the debug info of the htraced server.")
 	serverConf := app.Command("serverConf", "Print the server configuration retrieved from the htraced server.")
+	reloadServerConf := app.Command("reloadServerConf", "Ask the htraced server to reload its configuration file.")
+	serverHealth := app.Command("serverHealth", "Print the health of each of the htraced server's shards.")
+	retryShard := app.Command("retryShard", "Ask the htraced server to reopen a quarantined shard.")
+	retryShardIdx := retryShard.Arg("idx", "The index of the shard to retry.").Required().Int()
+	pauseIngest := app.Command("pauseIngest", "Ask the htraced server to stop accepting spans.")
+	pauseIngestDuration := pauseIngest.Flag("duration", "How long to pause for, for example 5m.  "+
+		"By default, ingestion stays paused until resumeIngest.").Duration()
+	resumeIngest := app.Command("resumeIngest", "Ask the htraced server to start accepting spans again.")
 	findSpan := app.Command("findSpan", "Print information about a trace span with a given ID.")
 	findSpanId := findSpan.Arg("id", "Span ID to find. Example: be305e54-4534-2110-a0b2-e06b9effe112").Required().String()
 	findChildren := app.Command("findChildren", "Print out the span IDs that are children of a given span ID.")
@@ -102,6 +112,13 @@ func main() {
 		"[TYPE] [OPERATOR] [CONST], joined by AND statements.").Required().String()
 	rawQuery := app.Command("rawQuery", "Send a raw JSON query to htraced.")
 	rawQueryArg := rawQuery.Arg("json", "The query JSON to send.").Required().String()
+	rawQueryPlan := rawQuery.Flag("plan", "The path to write the plan of the query to.  "+
+		"The plan can be replayed later with replayPlan.").String()
+	rawQueryExplain := rawQuery.Flag("explain", "Print how the server would run the "+
+		"query, and how many spans it expects to match, instead of running it.").Bool()
+	replayPlan := app.Command("replayPlan", "Run a query again with a plan written by "+
+		"rawQuery, and print what changed.")
+	replayPlanPath := replayPlan.Arg("path", "The plan file.").Required().String()
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 
 	// Add the command-line settings into the configuration.
@@ -145,6 +162,16 @@ func main() {
 		os.Exit(printServerDebugInfo(hcl))
 	case serverConf.FullCommand():
 		os.Exit(printServerConfJson(hcl))
+	case reloadServerConf.FullCommand():
+		os.Exit(doReloadServerConf(hcl))
+	case serverHealth.FullCommand():
+		os.Exit(printServerHealth(hcl))
+	case retryShard.FullCommand():
+		os.Exit(doRetryShard(hcl, *retryShardIdx))
+	case pauseIngest.FullCommand():
+		os.Exit(doPauseIngest(hcl, *pauseIngestDuration))
+	case resumeIngest.FullCommand():
+		os.Exit(doResumeIngest(hcl))
 	case findSpan.FullCommand():
 		var id *common.SpanId
 		id.FromString(*findSpanId)
@@ -172,12 +199,19 @@ func main() {
 		}
 		os.Exit(EXIT_SUCCESS)
 	case rawQuery.FullCommand():
-		err := doRawQuery(hcl, *rawQueryArg)
+		err := doRawQuery(hcl, *rawQueryArg, *rawQueryPlan, *rawQueryExplain)
 		if err != nil {
 			fmt.Printf("raw query error: %s\n", err.Error())
 			os.Exit(EXIT_FAILURE)
 		}
 		os.Exit(EXIT_SUCCESS)
+	case replayPlan.FullCommand():
+		err := doReplayPlan(hcl, *replayPlanPath)
+		if err != nil {
+			fmt.Printf("replay plan error: %s\n", err.Error())
+			os.Exit(EXIT_FAILURE)
+		}
+		os.Exit(EXIT_SUCCESS)
 	}
 
 	app.UsageErrorf(os.Stderr, "You must supply a command to run.")
@@ -197,6 +231,29 @@ func printServerVersion(hcl *htrace.Client) int {
 		return EXIT_FAILURE
 	}
 	fmt.Printf("HTraced server version %s (%s)\n", ver.ReleaseVersion, ver.GitVersion)
+	if !ver.Persistent {
+		fmt.Printf("The %s datastore does not persist spans", ver.DatastoreBackend)
+		if ver.MaxSpans > 0 {
+			fmt.Printf(", and holds at most %d spans", ver.MaxSpans)
+		}
+		fmt.Printf(".\n")
+	}
+	if ver.ReadOnly {
+		fmt.Printf("The server is read-only, and rejects span writes.\n")
+	}
+	if ver.DaemonId != "" {
+		fmt.Printf("DaemonId %s.\n", ver.DaemonId)
+	}
+	if ver.RestAddr != "" {
+		fmt.Printf("REST server on %s.\n", ver.RestAddr)
+	}
+	if ver.HrpcAddr != "" {
+		fmt.Printf("HRPC server on %s.\n", ver.HrpcAddr)
+	}
+	if ver.HrpcProtocolVersion > 0 {
+		fmt.Printf("HRPC protocol version %d, supporting %s.\n",
+			ver.HrpcProtocolVersion, strings.Join(ver.HrpcMethods, ", "))
+	}
 	return EXIT_SUCCESS
 }
 
@@ -215,38 +272,193 @@ func printServerStats(hcl *htrace.Client) int {
 	fmt.Fprintf(w, "Server Time\t%s\n",
 		common.UnixMsToTime(stats.CurMs).Format(time.RFC3339))
 	fmt.Fprintf(w, "Spans reaped\t%d\n", stats.ReapedSpans)
+	if stats.DownsampledSpans+stats.DownsampleKeptSpans > 0 {
+		fmt.Fprintf(w, "Spans deleted by downsampling\t%d\n",
+			stats.DownsampledSpans)
+		fmt.Fprintf(w, "Spans kept by downsampling\t%d\n",
+			stats.DownsampleKeptSpans)
+	}
+	if stats.WriteGroups > 0 ||
+		stats.ExpiredWriteGroups+stats.EvictedWriteGroups > 0 {
+		fmt.Fprintf(w, "Write groups\t%d\n", stats.WriteGroups)
+		fmt.Fprintf(w, "Write groups expired\t%d\n",
+			stats.ExpiredWriteGroups)
+		fmt.Fprintf(w, "Write groups evicted\t%d\n",
+			stats.EvictedWriteGroups)
+	}
+	approx := ""
+	if stats.NumSpansApproximate {
+		approx = " (approximate)"
+	}
+	fmt.Fprintf(w, "Spans stored\t%d%s\n", stats.NumSpans, approx)
+	if stats.NumSpans > 0 {
+		fmt.Fprintf(w, "Oldest span begin\t%s\n",
+			common.UnixMsToTime(stats.OldestBeginMs).Format(time.RFC3339))
+		fmt.Fprintf(w, "Newest span begin\t%s\n",
+			common.UnixMsToTime(stats.NewestBeginMs).Format(time.RFC3339))
+	}
 	fmt.Fprintf(w, "Spans ingested\t%d\n", stats.IngestedSpans)
 	fmt.Fprintf(w, "Spans written\t%d\n", stats.WrittenSpans)
 	fmt.Fprintf(w, "Spans dropped by server\t%d\n", stats.ServerDroppedSpans)
+	fmt.Fprintf(w, "Spans dropped for quarantined shards\t%d\n",
+		stats.QuarantineDroppedSpans)
+	fmt.Fprintf(w, "Spans left out of the duration index\t%d\n",
+		stats.IndexSkippedSpans)
+	fmt.Fprintf(w, "Spans which ended before they began (%s)\t%d\n",
+		stats.NegativeDurationPolicy, stats.NegativeDurationSpans)
+	for _, off := range stats.NegativeDurationOffenders {
+		worstId := "unknown"
+		if len(off.WorstSpanId) == common.SPAN_ID_LEN {
+			worstId = off.WorstSpanId.String()
+		}
+		fmt.Fprintf(w, "  %s\t%d span(s), worst %d ms (span %s, "+
+			"tracer %s)\n", off.Addr, off.NumSpans, off.WorstMs,
+			worstId, off.WorstTracerId)
+	}
+	fmt.Fprintf(w, "Spans with only some parents indexed\t%d\n",
+		stats.ParentIndexTruncatedSpans)
+	fmt.Fprintf(w, "Invalid info entries removed\t%d\n",
+		stats.InfoEntriesStripped)
+	if stats.MaxNumParents > 0 {
+		fmt.Fprintf(w, "Most parents of a span\t%d (span %s, tracer %s)\n",
+			stats.MaxNumParents, stats.MaxNumParentsSpanId.String(),
+			stats.MaxNumParentsTracerId)
+	}
+	fmt.Fprintf(w, "Recent max/average parents per span\t%d/%d\n",
+		stats.RecentMaxNumParents, stats.RecentAverageNumParents)
+	for _, name := range common.SpanFlagNames() {
+		fmt.Fprintf(w, "Spans flagged %s\t%d\n", name, stats.FlaggedSpans[name])
+	}
+	fmt.Fprintf(w, "Spans rejected by quotas\t%d\n", stats.QuotaRejectedSpans)
+	fmt.Fprintf(w, "Spans sampled out by quotas\t%d\n",
+		stats.QuotaSampledOutSpans)
+	fmt.Fprintf(w, "Span cache hits/misses\t%d/%d\n",
+		stats.SpanCacheHits, stats.SpanCacheMisses)
+	fmt.Fprintf(w, "Children cache hits/misses\t%d/%d\n",
+		stats.ChildrenCacheHits, stats.ChildrenCacheMisses)
+	fmt.Fprintf(w, "Hedged span lookups\t%d\n", stats.HedgedLookups)
+	fmt.Fprintf(w, "Shard probes cancelled by hedging\t%d\n",
+		stats.HedgeCancels)
+	fmt.Fprintf(w, "Span lookups which missed their deadline\t%d\n",
+		stats.LookupDeadlineMisses)
+	fmt.Fprintf(w, "Canary spans verified/not found/mismatched\t%d/%d/%d\n",
+		stats.CanaryVerified, stats.CanaryNotFound, stats.CanaryMismatches)
+	fmt.Fprintf(w, "Spans replayed from the intake logs\t%d (in %dms)\n",
+		stats.IntakeReplayedSpans, stats.IntakeReplayMs)
+	fmt.Fprintf(w, "Waits for a full intake log\t%d\n", stats.IntakeLogWaits)
 	dur := time.Millisecond * time.Duration(stats.AverageWriteSpansLatencyMs)
 	fmt.Fprintf(w, "Average WriteSpan Latency\t%s\n", dur.String())
 	dur = time.Millisecond * time.Duration(stats.MaxWriteSpansLatencyMs)
 	fmt.Fprintf(w, "Maximum WriteSpan Latency\t%s\n", dur.String())
+	fmt.Fprintf(w, "Open HRPC connections\t%d\n", stats.HrpcOpenConnections)
+	fmt.Fprintf(w, "Idle HRPC connections closed\t%d\n", stats.HrpcIdleCloses)
+	fmt.Fprintf(w, "HRPC requests aborted on deadline\t%d\n",
+		stats.HrpcDeadlineAborts)
+	fmt.Fprintf(w, "HRPC connections rejected\t%d\n", stats.HrpcAcceptRejections)
+	fmt.Fprintf(w, "HRPC requests over the size limit\t%d\n",
+		stats.HrpcOversizedMessages)
+	fmt.Fprintf(w, "HRPC malformed request frames\t%d\n",
+		stats.HrpcMalformedFrames)
+	if stats.UdpDatagrams > 0 {
+		fmt.Fprintf(w, "UDP datagrams received\t%d\n", stats.UdpDatagrams)
+		fmt.Fprintf(w, "UDP datagrams which failed to decode\t%d\n",
+			stats.UdpDecodeFailures)
+		fmt.Fprintf(w, "UDP datagrams truncated\t%d\n",
+			stats.UdpTruncatedDatagrams)
+		fmt.Fprintf(w, "UDP datagrams too big\t%d\n",
+			stats.UdpOversizedDatagrams)
+		fmt.Fprintf(w, "UDP datagrams dropped while paused\t%d\n",
+			stats.UdpPausedDatagrams)
+	}
+	fmt.Fprintf(w, "Requests denied read permission\t%d\n",
+		stats.AuthReadDenials)
+	fmt.Fprintf(w, "Requests denied write permission\t%d\n",
+		stats.AuthWriteDenials)
+	fmt.Fprintf(w, "Requests denied admin permission\t%d\n",
+		stats.AuthAdminDenials)
+	fmt.Fprintf(w, "Goroutines\t%d\n", stats.Runtime.NumGoroutines)
+	if stats.Runtime.NumOpenFds >= 0 {
+		fmt.Fprintf(w, "Open file descriptors\t%d\n", stats.Runtime.NumOpenFds)
+	}
+	fmt.Fprintf(w, "Heap in use\t%d bytes\n", stats.Runtime.HeapInuseBytes)
+	fmt.Fprintf(w, "Garbage collections\t%d\n", stats.Runtime.NumGc)
+	dur = time.Duration(stats.Runtime.GcPauseTotalNs)
+	fmt.Fprintf(w, "Total GC pause time\t%s\n", dur.String())
+	dur = time.Microsecond * time.Duration(stats.Runtime.AverageGcPauseUs)
+	fmt.Fprintf(w, "Average recent GC pause\t%s\n", dur.String())
+	dur = time.Microsecond * time.Duration(stats.Runtime.MaxGcPauseUs)
+	fmt.Fprintf(w, "Maximum recent GC pause\t%s\n", dur.String())
+	for i := range stats.Endpoints {
+		sli := &stats.Endpoints[i]
+		fmt.Fprintf(w, "REST %s requests\t%d (apdex %.3f, %.2f%% client "+
+			"errors, %.2f%% server errors, recent average %dms, max %dms)\n",
+			sli.Class, sli.Requests, sli.Apdex, sli.ClientErrorPercent,
+			sli.ServerErrorPercent, sli.AverageLatencyMs, sli.MaxLatencyMs)
+	}
 	fmt.Fprintf(w, "Number of leveldb directories\t%d\n", len(stats.Dirs))
 	w.Flush()
 	fmt.Println("")
+	for i := range stats.HighCardinalityTracers {
+		hct := &stats.HighCardinalityTracers[i]
+		fmt.Printf("Tracer '%s' has used at least %d distinct span "+
+			"descriptions, like '%s' (%d more span(s) since).  Normalized: "+
+			"'%s'\n", hct.TracerId, hct.DistinctDescriptions, hct.Description,
+			hct.SpansOverLimit, hct.NormalizedDescription)
+	}
+	if len(stats.HighCardinalityTracers) > 0 {
+		fmt.Println("")
+	}
 	for i := range stats.Dirs {
 		dir := stats.Dirs[i]
 		fmt.Printf("==== %s ===\n", dir.Path)
+		if dir.QuarantineError != "" {
+			fmt.Printf("QUARANTINED: %s\n", dir.QuarantineError)
+			continue
+		}
 		fmt.Printf("Approximate number of bytes: %d\n", dir.ApproximateBytes)
+		fmt.Printf("Approximate number of spans: %d\n", dir.NumSpans)
+		if dir.BloomFilterBytes > 0 {
+			fmt.Printf("Bloom filter: %d bytes, ready=%t, estimated false "+
+				"positive rate %.6f, %d lookup(s) skipped, %d probed\n",
+				dir.BloomFilterBytes, dir.BloomFilterReady, dir.BloomFilterFpp,
+				dir.BloomFilterSkips, dir.BloomFilterProbes)
+		}
+		fmt.Printf("Slowest span lookup: %dms\n", dir.MaxLookupMs)
+		fmt.Printf("Span cache: %d hit(s), %d miss(es)\n",
+			dir.SpanCacheHits, dir.SpanCacheMisses)
+		fmt.Printf("Level 0 files: %d, compaction score: %.2f\n",
+			dir.Level0Files, dir.CompactionScore)
+		if dir.IntakeLogBytes > 0 {
+			fmt.Printf("Intake log: %d bytes\n", dir.IntakeLogBytes)
+		}
 		stats := strings.Replace(dir.LevelDbStats, "\\n", "\n", -1)
 		fmt.Printf("%s\n", stats)
 	}
 	w = new(tabwriter.Writer)
 	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
 	fmt.Fprintf(w, "HOST SPAN METRICS\n")
-	mtxMap := stats.HostSpanMetrics
-	keys := make(sort.StringSlice, len(mtxMap))
-	i := 0
-	for k, _ := range mtxMap {
-		keys[i] = k
-		i++
-	}
-	sort.Sort(keys)
-	for k := range keys {
-		mtx := mtxMap[keys[k]]
-		fmt.Fprintf(w, "%s\twritten: %d\tserver dropped: %d\n",
-			keys[k], mtx.Written, mtx.ServerDropped)
+	after := ""
+	for {
+		resp, err := hcl.GetClientStats(after, "", CLIENT_STATS_PAGE_SIZE)
+		if err != nil {
+			w.Flush()
+			fmt.Println(err.Error())
+			return EXIT_FAILURE
+		}
+		for i := range resp.Clients {
+			mtx := resp.Clients[i]
+			fmt.Fprintf(w, "%s\twritten: %d\tserver dropped: %d\t"+
+				"duplicate parents: %d\tself parents: %d\t"+
+				"parse skipped: %d\treserved info keys: %d\t"+
+				"negative durations: %d\n",
+				mtx.Addr, mtx.Written, mtx.ServerDropped, mtx.DuplicateParents,
+				mtx.SelfParents, mtx.ParseSkipped, mtx.ReservedInfoKeys,
+				mtx.NegativeDurations)
+		}
+		if resp.Next == "" {
+			break
+		}
+		after = resp.Next
 	}
 	w.Flush()
 	return EXIT_SUCCESS
@@ -285,6 +497,116 @@ func printServerDebugInfo(hcl *htrace.Client) int {
 }
 
 // Print information retrieved from an htraced server via /server/conf as JSON
+// Ask the htraced server to reload its configuration, and print the changes.
+func doReloadServerConf(hcl *htrace.Client) int {
+	result, err := hcl.ReloadServerConf()
+	if err != nil {
+		fmt.Println(err.Error())
+		return EXIT_FAILURE
+	}
+	if result.Outcome == common.CONF_RELOAD_FAILED {
+		fmt.Printf("Failed to reload the configuration: %s\n", result.Error)
+		return EXIT_FAILURE
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintf(w, "KEY\tOLD VALUE\tNEW VALUE\tOUTCOME\n")
+	for i := range result.Changes {
+		change := result.Changes[i]
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", change.Key, change.OldValue,
+			change.NewValue, change.Outcome)
+	}
+	w.Flush()
+	fmt.Printf("Reloaded the configuration with outcome %s.\n", result.Outcome)
+	if result.Outcome != common.CONF_RELOAD_OK {
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
+}
+
+// Print the health of each shard retrieved from an htraced server via
+// /server/health.
+func printServerHealth(hcl *htrace.Client) int {
+	health, err := hcl.GetServerHealth()
+	if err != nil {
+		fmt.Println(err.Error())
+		return EXIT_FAILURE
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 0, '\t', 0)
+	fmt.Fprintf(w, "INDEX\tPATH\tSTATUS\tERROR\n")
+	for i := range health.Shards {
+		shd := health.Shards[i]
+		if shd.Healthy {
+			fmt.Fprintf(w, "%d\t%s\tOK\t\n", i, shd.Path)
+		} else {
+			fmt.Fprintf(w, "%d\t%s\tQUARANTINED since %s\t%s\n", i, shd.Path,
+				common.UnixMsToTime(shd.QuarantinedMs).Format(time.RFC3339),
+				shd.Error)
+		}
+	}
+	w.Flush()
+	if health.IngestPause.Paused {
+		fmt.Println(describeIngestPause(&health.IngestPause))
+	}
+	if !health.Healthy {
+		return EXIT_FAILURE
+	}
+	return EXIT_SUCCESS
+}
+
+// Describe whether ingestion is paused.
+func describeIngestPause(pause *common.IngestPause) string {
+	if !pause.Paused {
+		return "Ingestion is not paused."
+	}
+	str := fmt.Sprintf("Ingestion was paused by %s at %s", pause.PausedBy,
+		common.UnixMsToTime(pause.PausedMs).Format(time.RFC3339))
+	if pause.ResumeMs == 0 {
+		return str + ", until it is resumed."
+	}
+	return str + fmt.Sprintf(", and resumes at %s.",
+		common.UnixMsToTime(pause.ResumeMs).Format(time.RFC3339))
+}
+
+// Ask the htraced server to stop accepting spans.
+func doPauseIngest(hcl *htrace.Client, dur time.Duration) int {
+	pause, err := hcl.PauseIngest(dur)
+	if err != nil {
+		fmt.Println(err.Error())
+		return EXIT_FAILURE
+	}
+	fmt.Println(describeIngestPause(pause))
+	return EXIT_SUCCESS
+}
+
+// Ask the htraced server to start accepting spans again.
+func doResumeIngest(hcl *htrace.Client) int {
+	pause, err := hcl.ResumeIngest()
+	if err != nil {
+		fmt.Println(err.Error())
+		return EXIT_FAILURE
+	}
+	fmt.Println(describeIngestPause(pause))
+	return EXIT_SUCCESS
+}
+
+// Ask the htraced server to reopen a quarantined shard.
+func doRetryShard(hcl *htrace.Client, shardIdx int) int {
+	health, err := hcl.RetryShard(shardIdx)
+	if err != nil {
+		fmt.Println(err.Error())
+		return EXIT_FAILURE
+	}
+	if !health.Healthy {
+		fmt.Printf("Shard %s is still quarantined: %s\n", health.Path,
+			health.Error)
+		return EXIT_FAILURE
+	}
+	fmt.Printf("Shard %s is healthy.\n", health.Path)
+	return EXIT_SUCCESS
+}
+
 func printServerConfJson(hcl *htrace.Client) int {
 	cnf, err := hcl.GetServerConf()
 	if err != nil {
@@ -399,35 +721,32 @@ func doDumpAll(hcl *htrace.Client, outPath string, lim int) error {
 			file.Close()
 		}
 	}()
-	out := make(chan *common.Span, 50)
-	var dumpErr error
-	go func() {
-		dumpErr = hcl.DumpAll(lim, out)
-	}()
-	var numSpans int64
-	nextLogTime := time.Now().Add(time.Second * 5)
-	for {
-		span, channelOpen := <-out
-		if !channelOpen {
-			break
-		}
-		if err == nil {
-			_, err = fmt.Fprintf(w, "%s\n", span.ToJson())
-		}
-		if verbose {
-			numSpans++
-			now := time.Now()
-			if !now.Before(nextLogTime) {
-				nextLogTime = now.Add(time.Second * 5)
-				fmt.Printf("received %d span(s)...\n", numSpans)
-			}
-		}
+	var nextLogTime time.Time
+	if verbose {
+		nextLogTime = time.Now().Add(time.Second * 5)
 	}
+	report, err := hcl.DumpAllTo(w, htrace.DumpOpts{
+		Lim: lim,
+		Checkpoint: func(lastId common.SpanId, numBytes int64) error {
+			if verbose {
+				now := time.Now()
+				if !now.Before(nextLogTime) {
+					nextLogTime = now.Add(time.Second * 5)
+					fmt.Printf("wrote %d byte(s), through span %s...\n",
+						numBytes, lastId.String())
+				}
+			}
+			return nil
+		},
+	})
 	if err != nil {
-		return errors.New(fmt.Sprintf("Write error %s", err.Error()))
+		return errors.New(fmt.Sprintf("Dump error after %d span(s): %s",
+			report.NumSpans, err.Error()))
 	}
-	if dumpErr != nil {
-		return errors.New(fmt.Sprintf("Dump error %s", dumpErr.Error()))
+	if verbose {
+		fmt.Printf("dumped %d span(s) (%d bytes) in %d page(s), taking %s\n",
+			report.NumSpans, report.NumBytes, report.NumPages,
+			report.Duration.String())
 	}
 	err = w.Flush()
 	if err != nil {
@@ -25,6 +25,7 @@ import (
 	"fmt"
 	htrace "htrace/client"
 	"htrace/common"
+	"io/ioutil"
 	"strings"
 	"unicode"
 )
@@ -139,16 +140,93 @@ func doQueryFromString(hcl *htrace.Client, str string, lim int) error {
 }
 
 // Send a query from a raw JSON string.
-func doRawQuery(hcl *htrace.Client, str string) error {
+func doRawQuery(hcl *htrace.Client, str string, planPath string,
+	explain bool) error {
 	jsonBytes := []byte(str)
 	var query common.Query
 	err := json.Unmarshal(jsonBytes, &query)
 	if err != nil {
 		return errors.New(fmt.Sprintf("Error parsing provided JSON: %s\n", err.Error()))
 	}
+	if explain {
+		return doExplainQuery(hcl, &query)
+	}
+	if planPath != "" {
+		return doQueryWithPlan(hcl, &query, planPath)
+	}
 	return doQuery(hcl, &query)
 }
 
+// Print how the server would run a query.
+func doExplainQuery(hcl *htrace.Client, query *common.Query) error {
+	exp, err := hcl.ExplainQuery(query)
+	if err != nil {
+		return err
+	}
+	buf, err := json.MarshalIndent(exp, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", string(buf))
+	return nil
+}
+
+// Send a query, and write its plan to a file.
+func doQueryWithPlan(hcl *htrace.Client, query *common.Query, planPath string) error {
+	query.Plan = true
+	page, err := hcl.QueryPage(query)
+	if err != nil {
+		return err
+	}
+	for i := range page.Spans {
+		fmt.Printf("%s\n", page.Spans[i].ToJson())
+	}
+	if page.Plan == nil {
+		return errors.New("The server did not return a plan for the query.")
+	}
+	buf, err := json.MarshalIndent(page.Plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(planPath, buf, 0644)
+}
+
+// Replay a query plan from a file.
+func doReplayPlan(hcl *htrace.Client, planPath string) error {
+	buf, err := ioutil.ReadFile(planPath)
+	if err != nil {
+		return err
+	}
+	var plan common.QueryPlan
+	err = json.Unmarshal(buf, &plan)
+	if err != nil {
+		return errors.New(fmt.Sprintf("Error parsing %s: %s", planPath,
+			err.Error()))
+	}
+	replay, err := hcl.ReplayQueryPlan(&plan)
+	if err != nil {
+		return err
+	}
+	if len(replay.PlanDifferences) == 0 {
+		fmt.Printf("The plan has not changed.\n")
+	}
+	for i := range replay.PlanDifferences {
+		fmt.Printf("%s\n", replay.PlanDifferences[i])
+	}
+	fmt.Printf("Results of the captured plan changed: %t\n",
+		replay.VerbatimResultsDiffer)
+	fmt.Printf("Results of the current plan differ: %t\n",
+		replay.ReplannedResultsDiffer)
+	if verbose {
+		buf, err = json.MarshalIndent(replay, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\n", string(buf))
+	}
+	return nil
+}
+
 // Send a query.
 func doQuery(hcl *htrace.Client, query *common.Query) error {
 	if verbose {
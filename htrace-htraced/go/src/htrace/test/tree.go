@@ -0,0 +1,241 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package test
+
+import (
+	"fmt"
+	"htrace/common"
+	"math/rand"
+	"sort"
+)
+
+//
+// SpanTreeGenerator creates trees of spans for use in tests and benchmarks.
+//
+// Unlike NewRandomSpan, the spans it creates have a known structure, which
+// can be used as the ground truth when testing features that walk the span
+// tree.  The same seed and options always produce the same spans.
+//
+
+// The order in which the generated spans are returned.
+type EmissionOrder int
+
+const (
+	// Each span comes before all of its descendants.
+	PARENT_FIRST EmissionOrder = iota
+
+	// Each span comes after all of its descendants.
+	CHILD_FIRST
+)
+
+type SpanTreeGenerator struct {
+	// The random seed to use.
+	Seed int64
+
+	// The number of levels in each tree.  A depth of 1 means that there are
+	// only root spans.
+	Depth int
+
+	// The number of trees to generate.  If this is 0, we keep generating trees
+	// until we have MaxSpans spans.
+	NumRoots int
+
+	// If non-zero, the maximum number of spans to generate.
+	MaxSpans int
+
+	// The minimum and maximum number of children of each non-leaf span.  The
+	// number of children is chosen uniformly from this range, unless FanOut
+	// is set.
+	MinFanOut int
+	MaxFanOut int
+
+	// If non-nil, a function which returns the number of children a span at
+	// the given level should have.  Roots are at level 0.
+	FanOut func(rnd *rand.Rand, level int) int
+
+	// The minimum and maximum duration of root spans, in milliseconds.  The
+	// duration is chosen uniformly from this range.
+	MinDurationMs int64
+	MaxDurationMs int64
+
+	// The start of the time range, in milliseconds since the epoch.  Root
+	// spans begin within MaxDurationMs of this time.
+	StartMs int64
+
+	// If true, the begin and end times of each span lie within those of its
+	// parent.  Otherwise, every span gets an independently chosen begin time
+	// and duration.
+	Nested bool
+
+	// The number of distinct descriptions and tracer ids to use.  If these
+	// are 0, only one is used.
+	NumDescriptions int
+	NumTracerIds    int
+
+	// If true, every span at level N gets the tracer id "tracerN", and
+	// NumTracerIds is ignored.
+	TracerIdPerLevel bool
+
+	// The order in which to return the spans.
+	Order EmissionOrder
+}
+
+// The result of generating span trees.
+type SpanTree struct {
+	// All the spans, in emission order.
+	Spans []*common.Span
+
+	// The ids of the root spans.
+	Roots []common.SpanId
+
+	// Maps span ids to the ids of their children, sorted by id.  Leaf spans
+	// are not present.
+	Children map[string][]common.SpanId
+
+	// Maps span ids to their level in the tree.  Roots are at level 0.
+	Levels map[string]int
+}
+
+// Get the children of a span, sorted by id.
+func (tree *SpanTree) ChildrenOf(sid common.SpanId) []common.SpanId {
+	return tree.Children[sid.String()]
+}
+
+// A node in the tree we are generating.
+type spanNode struct {
+	span     *common.Span
+	children []*spanNode
+}
+
+// Generate span trees.
+func (gen *SpanTreeGenerator) Generate() *SpanTree {
+	if gen.NumRoots <= 0 && gen.MaxSpans <= 0 {
+		panic("SpanTreeGenerator: either NumRoots or MaxSpans must be set.")
+	}
+	rnd := rand.New(rand.NewSource(gen.Seed))
+	tree := &SpanTree{
+		Spans:    make([]*common.Span, 0),
+		Roots:    make([]common.SpanId, 0),
+		Children: make(map[string][]common.SpanId),
+		Levels:   make(map[string]int),
+	}
+	numSpans := 0
+	roots := make([]*spanNode, 0)
+	for gen.NumRoots <= 0 || len(roots) < gen.NumRoots {
+		if gen.MaxSpans > 0 && numSpans >= gen.MaxSpans {
+			break
+		}
+		begin := gen.StartMs + randRange(rnd, 0, gen.MaxDurationMs)
+		end := begin + randRange(rnd, gen.MinDurationMs, gen.MaxDurationMs)
+		root := gen.newNode(rnd, tree, nil, 0, begin, end, &numSpans)
+		roots = append(roots, root)
+		tree.Roots = append(tree.Roots, root.span.Id)
+	}
+	for i := range roots {
+		gen.emit(tree, roots[i])
+	}
+	for _, children := range tree.Children {
+		sort.Sort(common.SpanIdSlice(children))
+	}
+	return tree
+}
+
+// Create a span and its descendants.
+func (gen *SpanTreeGenerator) newNode(rnd *rand.Rand, tree *SpanTree,
+	parent *spanNode, level int, begin int64, end int64,
+	numSpans *int) *spanNode {
+	span := &common.Span{
+		Id: NonZeroRandSpanId(rnd),
+		SpanData: common.SpanData{
+			Begin:       begin,
+			End:         end,
+			Description: fmt.Sprintf("desc%d", randIndex(rnd, gen.NumDescriptions)),
+			Parents:     []common.SpanId{},
+		},
+	}
+	if gen.TracerIdPerLevel {
+		span.TracerId = fmt.Sprintf("tracer%d", level)
+	} else {
+		span.TracerId = fmt.Sprintf("tracer%d", randIndex(rnd, gen.NumTracerIds))
+	}
+	node := &spanNode{span: span}
+	*numSpans++
+	tree.Levels[span.Id.String()] = level
+	if parent != nil {
+		span.Parents = []common.SpanId{parent.span.Id}
+		parentKey := parent.span.Id.String()
+		tree.Children[parentKey] = append(tree.Children[parentKey], span.Id)
+	}
+	if level+1 >= gen.Depth {
+		return node
+	}
+	var fanOut int
+	if gen.FanOut != nil {
+		fanOut = gen.FanOut(rnd, level)
+	} else {
+		fanOut = int(randRange(rnd, int64(gen.MinFanOut), int64(gen.MaxFanOut)))
+	}
+	for i := 0; i < fanOut; i++ {
+		if gen.MaxSpans > 0 && *numSpans >= gen.MaxSpans {
+			break
+		}
+		var childBegin, childEnd int64
+		if gen.Nested {
+			childBegin = randRange(rnd, begin, end)
+			childEnd = randRange(rnd, childBegin, end)
+		} else {
+			childBegin = gen.StartMs + randRange(rnd, 0, gen.MaxDurationMs)
+			childEnd = childBegin +
+				randRange(rnd, gen.MinDurationMs, gen.MaxDurationMs)
+		}
+		node.children = append(node.children, gen.newNode(rnd, tree, node,
+			level+1, childBegin, childEnd, numSpans))
+	}
+	return node
+}
+
+// Add a node and its descendants to the list of spans, in emission order.
+func (gen *SpanTreeGenerator) emit(tree *SpanTree, node *spanNode) {
+	if gen.Order == PARENT_FIRST {
+		tree.Spans = append(tree.Spans, node.span)
+	}
+	for i := range node.children {
+		gen.emit(tree, node.children[i])
+	}
+	if gen.Order == CHILD_FIRST {
+		tree.Spans = append(tree.Spans, node.span)
+	}
+}
+
+// Choose a number uniformly from [min, max].
+func randRange(rnd *rand.Rand, min int64, max int64) int64 {
+	if max <= min {
+		return min
+	}
+	return min + rnd.Int63n(max-min+1)
+}
+
+// Choose an index uniformly from [0, num).
+func randIndex(rnd *rand.Rand, num int) int {
+	if num <= 1 {
+		return 0
+	}
+	return rnd.Intn(num)
+}
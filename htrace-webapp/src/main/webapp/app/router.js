@@ -57,14 +57,24 @@ htrace.HTraceRouter = Backbone.Router.extend({
                          JSON.stringify(response));
           },
           "success": function(model, response, options) {
-            router.switchView(new htrace.ServerInfoView({
-              model: {
-                "version": version,
-                "stats": stats
+            clients = new htrace.ClientStats();
+            clients.fetch({
+              "error": function(model, response, options) {
+                window.alert("Failed to fetch htraced client stats: " +
+                             JSON.stringify(response));
               },
-              el: "#app"
-            }))
-            router.activateNavBarEntry("serverInfo")
+              "success": function(model, response, options) {
+                router.switchView(new htrace.ServerInfoView({
+                  model: {
+                    "version": version,
+                    "stats": stats,
+                    "clients": clients
+                  },
+                  el: "#app"
+                }))
+                router.activateNavBarEntry("serverInfo")
+              }
+            })
           }
         })
       }
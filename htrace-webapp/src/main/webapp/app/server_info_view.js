@@ -52,20 +52,11 @@ htrace.ServerInfoView = Backbone.View.extend({
             '<th>ServerDropped</th>' +
           '</tr>' +
         '</thead>';
-    var remotes = [];
-    var stats = this.model.stats
-    var spanMetrics = stats.get("HostSpanMetrics")
-    for (var remote in spanMetrics) {
-      if (spanMetrics.hasOwnProperty(remote)) {
-        remotes.push(remote)
-      }
-    }
-    remotes = remotes.sort()
-    for (var i = 0; i < remotes.length; i++) {
-      var remote = remotes[i];
-      var smtx = spanMetrics[remote];
+    var clients = this.model.clients.get("Clients")
+    for (var i = 0; i < clients.length; i++) {
+      var smtx = clients[i];
       out = out + "<tr>" + 
-        "<td>" + remote + "</td>" +
+        "<td>" + smtx.Addr + "</td>" +
         "<td>" + smtx.Written + "</td>" +
         "<td>" + smtx.ServerDropped + "</td>" +
         "</tr>";
@@ -34,3 +34,16 @@ htrace.ServerStats = Backbone.Model.extend({
     return "server/stats";
   }
 });
+
+// The per-client span metrics.  This is only the first page of clients; see
+// /server/stats/clients in rest.go.
+htrace.ClientStats = Backbone.Model.extend({
+  defaults: {
+    "Clients": [],
+    "Next": ""
+  },
+
+  url: function() {
+    return "server/stats/clients?lim=1000";
+  }
+});
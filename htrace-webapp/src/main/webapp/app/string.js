@@ -58,5 +58,5 @@ htrace.normalizeSpanId = function(str) {
     throw "Span IDs must contain only hexadecimal digits, but '" + str +
       "' contained invalid characters.";
   }
-  return str;
+  return str.toLowerCase();
 };